@@ -0,0 +1,193 @@
+// Package audit records the destructive and administrative operations of the
+// registry, such as deletions, as a stream of JSON entries separate from the
+// access log.
+package audit
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/distribution/distribution/v3/configuration"
+	"github.com/opencontainers/go-digest"
+)
+
+// The actions recorded by the audit log.
+const (
+	ActionManifestDelete = "manifest.delete"
+	ActionTagDelete      = "tag.delete"
+	ActionBlobDelete     = "blob.delete"
+
+	// ActionGarbageCollect is a run of the garbage collection, whose
+	// deletions are recorded as the gc.* actions.
+	ActionGarbageCollect   = "gc.run"
+	ActionGCManifestDelete = "gc.manifest.delete"
+	ActionGCTagDelete      = "gc.tag.delete"
+	ActionGCBlobDelete     = "gc.blob.delete"
+
+	// ActionProxyManifestPurge and ActionProxyBlobPurge are the content
+	// expired or evicted from the pull through cache.
+	ActionProxyManifestPurge = "proxy.manifest.purge"
+	ActionProxyBlobPurge     = "proxy.blob.purge"
+)
+
+// The outcomes of the operations.
+const (
+	OutcomeSuccess = "success"
+	OutcomeFailure = "failure"
+)
+
+// defaultMaxBackups is the number of files rolled over which are kept, when
+// not configured.
+const defaultMaxBackups = 5
+
+// Entry is the record of an operation.
+type Entry struct {
+	Time   time.Time `json:"time"`
+	Action string    `json:"action"`
+	// Actor is the user authenticated by the request, or the user running
+	// the command.
+	Actor      string        `json:"actor,omitempty"`
+	Repository string        `json:"repository,omitempty"`
+	Digest     digest.Digest `json:"digest,omitempty"`
+	Tag        string        `json:"tag,omitempty"`
+	ClientIP   string        `json:"clientIP,omitempty"`
+	RequestID  string        `json:"requestID,omitempty"`
+	Outcome    string        `json:"outcome"`
+	// Status is the status of the response to the request.
+	Status int    `json:"status,omitempty"`
+	Error  string `json:"error,omitempty"`
+}
+
+// Logger appends entries to the audit log. The nil Logger discards them.
+type Logger struct {
+	mu         sync.Mutex
+	path       string
+	maxSize    int64
+	maxBackups int
+
+	w    io.Writer
+	f    *os.File
+	size int64
+}
+
+// New opens the audit log configured, appending to the file of its output or
+// writing to the standard output.
+func New(config configuration.AuditLog) (*Logger, error) {
+	if config.Output == "" {
+		return nil, errors.New("no audit log output configured")
+	}
+	l := &Logger{
+		maxSize:    config.MaxSize,
+		maxBackups: config.MaxBackups,
+	}
+	if l.maxBackups == 0 {
+		l.maxBackups = defaultMaxBackups
+	}
+	if config.Output == "stdout" {
+		l.w = os.Stdout
+		return l, nil
+	}
+
+	l.path = config.Output
+	if err := l.open(); err != nil {
+		return nil, err
+	}
+	return l, nil
+}
+
+// open opens the file of the audit log for appending.
+func (l *Logger) open() error {
+	f, err := os.OpenFile(l.path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0o600)
+	if err != nil {
+		return fmt.Errorf("failed to open the audit log: %w", err)
+	}
+	fi, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return fmt.Errorf("failed to open the audit log: %w", err)
+	}
+	l.f, l.w, l.size = f, f, fi.Size()
+	return nil
+}
+
+// Log appends the entry to the audit log, returning once it is written and
+// synced to the file. The time of the entry defaults to now.
+func (l *Logger) Log(entry Entry) error {
+	if l == nil {
+		return nil
+	}
+	if entry.Time.IsZero() {
+		entry.Time = time.Now().UTC()
+	}
+	p, err := json.Marshal(entry)
+	if err != nil {
+		return err
+	}
+	p = append(p, '\n')
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.f != nil && l.maxSize > 0 && l.size > 0 && l.size+int64(len(p)) > l.maxSize {
+		if err := l.rollover(); err != nil {
+			return err
+		}
+	}
+	n, err := l.w.Write(p)
+	l.size += int64(n)
+	if err != nil {
+		return fmt.Errorf("failed to write to the audit log: %w", err)
+	}
+	if l.f != nil {
+		if err := l.f.Sync(); err != nil {
+			return fmt.Errorf("failed to sync the audit log: %w", err)
+		}
+	}
+	return nil
+}
+
+// rollover renames the file of the audit log to path.1, shifting the files
+// previously rolled over, and opens a new file.
+func (l *Logger) rollover() error {
+	if err := l.f.Close(); err != nil {
+		return fmt.Errorf("failed to close the audit log: %w", err)
+	}
+	for i := l.maxBackups - 1; i > 0; i-- {
+		err := os.Rename(fmt.Sprintf("%s.%d", l.path, i), fmt.Sprintf("%s.%d", l.path, i+1))
+		if err != nil && !errors.Is(err, os.ErrNotExist) {
+			return fmt.Errorf("failed to roll over the audit log: %w", err)
+		}
+	}
+	if err := os.Rename(l.path, l.path+".1"); err != nil {
+		return fmt.Errorf("failed to roll over the audit log: %w", err)
+	}
+	return l.open()
+}
+
+// Reopen closes and reopens the file of the audit log, for it to be rotated
+// by an external tool.
+func (l *Logger) Reopen() error {
+	if l == nil || l.f == nil {
+		return nil
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if err := l.f.Close(); err != nil {
+		return fmt.Errorf("failed to close the audit log: %w", err)
+	}
+	return l.open()
+}
+
+// Close closes the file of the audit log.
+func (l *Logger) Close() error {
+	if l == nil || l.f == nil {
+		return nil
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.f.Close()
+}
@@ -0,0 +1,114 @@
+package audit
+
+import (
+	"bufio"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/distribution/distribution/v3/configuration"
+)
+
+// readEntries returns the entries of the file.
+func readEntries(t *testing.T, path string) []Entry {
+	t.Helper()
+	f, err := os.Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+
+	var entries []Entry
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		var entry Entry
+		if err := json.Unmarshal(scanner.Bytes(), &entry); err != nil {
+			t.Fatalf("invalid entry %q: %v", scanner.Text(), err)
+		}
+		entries = append(entries, entry)
+	}
+	return entries
+}
+
+func TestLogger(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "audit.log")
+	l, err := New(configuration.AuditLog{Output: path})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+
+	entry := Entry{
+		Action:     ActionTagDelete,
+		Actor:      "alice",
+		Repository: "foo/bar",
+		Tag:        "latest",
+		Outcome:    OutcomeSuccess,
+	}
+	if err := l.Log(entry); err != nil {
+		t.Fatal(err)
+	}
+
+	// The file rotated by another tool is reopened.
+	if err := os.Rename(path, path+".rotated"); err != nil {
+		t.Fatal(err)
+	}
+	if err := l.Reopen(); err != nil {
+		t.Fatal(err)
+	}
+	if err := l.Log(entry); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, p := range []string{path + ".rotated", path} {
+		entries := readEntries(t, p)
+		if len(entries) != 1 {
+			t.Fatalf("unexpected entries in %s: %v", p, entries)
+		}
+		logged := entries[0]
+		if logged.Time.IsZero() {
+			t.Fatal("the time of the entry is not set")
+		}
+		logged.Time = entry.Time
+		if logged != entry {
+			t.Fatalf("unexpected entry %v, expected %v", logged, entry)
+		}
+	}
+
+	var nilLogger *Logger
+	if err := nilLogger.Log(entry); err != nil {
+		t.Fatalf("unexpected error logging to the nil logger: %v", err)
+	}
+}
+
+func TestLoggerRollover(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "audit.log")
+	entry := Entry{Time: time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC), Action: ActionBlobDelete, Outcome: OutcomeSuccess}
+	p, err := json.Marshal(entry)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Two entries fit in a file.
+	l, err := New(configuration.AuditLog{Output: path, MaxSize: int64(2*len(p) + 2), MaxBackups: 2})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	for range 7 {
+		if err := l.Log(entry); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	for p, expected := range map[string]int{path: 1, path + ".1": 2, path + ".2": 2} {
+		if entries := readEntries(t, p); len(entries) != expected {
+			t.Fatalf("unexpected number of entries in %s: %d, expected %d", p, len(entries), expected)
+		}
+	}
+	if _, err := os.Stat(path + ".3"); !os.IsNotExist(err) {
+		t.Fatalf("unexpected backup beyond maxbackups: %v", err)
+	}
+}
@@ -26,6 +26,10 @@ var (
 	// ErrBlobUploadUnknown returned when upload is not found.
 	ErrBlobUploadUnknown = errors.New("blob upload unknown")
 
+	// ErrBlobUploadConflict returned when the session of an upload was
+	// updated by a concurrent request since it was resumed.
+	ErrBlobUploadConflict = errors.New("blob upload updated concurrently")
+
 	// ErrBlobInvalidLength returned when the blob has an expected length on
 	// commit, meaning mismatched with the descriptor or an invalid value.
 	ErrBlobInvalidLength = errors.New("blob invalid length")
@@ -42,6 +46,35 @@ func (err ErrBlobInvalidDigest) Error() string {
 		err.Digest, err.Reason)
 }
 
+// ErrBlobCorrupted is returned when the content of a stored blob does not
+// match its digest. Actual is the digest of the content read, and is empty if
+// the blob was quarantined by an earlier read.
+type ErrBlobCorrupted struct {
+	Digest digest.Digest
+	Actual digest.Digest
+}
+
+func (err ErrBlobCorrupted) Error() string {
+	if err.Actual == "" {
+		return fmt.Sprintf("blob %v is quarantined", err.Digest)
+	}
+	return fmt.Sprintf("content of blob %v does not match its digest: %v", err.Digest, err.Actual)
+}
+
+// ErrQuotaExceeded is returned when linking a blob of Size bytes to a
+// repository would bring its usage over the limit of its quota.
+type ErrQuotaExceeded struct {
+	Repository string
+	Usage      int64
+	Limit      int64
+	Size       int64
+}
+
+func (err ErrQuotaExceeded) Error() string {
+	return fmt.Sprintf("quota of repository %s exceeded: usage %d bytes, limit %d bytes, blob %d bytes",
+		err.Repository, err.Usage, err.Limit, err.Size)
+}
+
 // ErrBlobMounted returned when a blob is mounted from another repository
 // instead of initiating an upload session.
 type ErrBlobMounted struct {
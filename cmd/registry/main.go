@@ -4,18 +4,34 @@ import (
 	_ "net/http/pprof"
 
 	"github.com/distribution/distribution/v3/registry"
+	_ "github.com/distribution/distribution/v3/registry/auth/chain"
+	_ "github.com/distribution/distribution/v3/registry/auth/clientcert"
 	_ "github.com/distribution/distribution/v3/registry/auth/htpasswd"
+	_ "github.com/distribution/distribution/v3/registry/auth/ldap"
+	_ "github.com/distribution/distribution/v3/registry/auth/oidc"
+	_ "github.com/distribution/distribution/v3/registry/auth/policy"
 	_ "github.com/distribution/distribution/v3/registry/auth/silly"
 	_ "github.com/distribution/distribution/v3/registry/auth/token"
 	_ "github.com/distribution/distribution/v3/registry/proxy"
 	_ "github.com/distribution/distribution/v3/registry/storage/driver/azure"
+	_ "github.com/distribution/distribution/v3/registry/storage/driver/b2"
 	_ "github.com/distribution/distribution/v3/registry/storage/driver/filesystem"
 	_ "github.com/distribution/distribution/v3/registry/storage/driver/gcs"
 	_ "github.com/distribution/distribution/v3/registry/storage/driver/inmemory"
 	_ "github.com/distribution/distribution/v3/registry/storage/driver/middleware/cloudfront"
+	_ "github.com/distribution/distribution/v3/registry/storage/driver/middleware/compress"
+	_ "github.com/distribution/distribution/v3/registry/storage/driver/middleware/diskcache"
+	_ "github.com/distribution/distribution/v3/registry/storage/driver/middleware/encrypt"
+	_ "github.com/distribution/distribution/v3/registry/storage/driver/middleware/failover"
+	_ "github.com/distribution/distribution/v3/registry/storage/driver/middleware/fallbackread"
+	_ "github.com/distribution/distribution/v3/registry/storage/driver/middleware/gcloudcdn"
+	_ "github.com/distribution/distribution/v3/registry/storage/driver/middleware/mirrorwrite"
 	_ "github.com/distribution/distribution/v3/registry/storage/driver/middleware/redirect"
+	_ "github.com/distribution/distribution/v3/registry/storage/driver/middleware/retry"
 	_ "github.com/distribution/distribution/v3/registry/storage/driver/middleware/rewrite"
+	_ "github.com/distribution/distribution/v3/registry/storage/driver/ocios"
 	_ "github.com/distribution/distribution/v3/registry/storage/driver/s3-aws"
+	_ "github.com/distribution/distribution/v3/registry/storage/driver/sftp"
 )
 
 func main() {
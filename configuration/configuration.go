@@ -5,9 +5,13 @@ import (
 	"fmt"
 	"io"
 	"net/http"
+	"path"
 	"reflect"
+	"regexp"
 	"strings"
 	"time"
+
+	"github.com/distribution/reference"
 )
 
 const (
@@ -27,6 +31,11 @@ type Configuration struct {
 	// Version is the version which defines the format of the rest of the configuration
 	Version Version `yaml:"version"`
 
+	// ExpandEnv expands the references to environment variables, such as
+	// ${VAR} or ${VAR:-default}, in the string values of the configuration
+	// file.
+	ExpandEnv bool `yaml:"expandenv,omitempty"`
+
 	// Log supports setting various parameters related to the logging
 	// subsystem.
 	Log Log `yaml:"log"`
@@ -73,17 +82,396 @@ type Configuration struct {
 	// Proxy defines the configuration options for using the registry as a pull-through cache.
 	Proxy Proxy `yaml:"proxy,omitempty"`
 
+	// Replication configures the replication of the pushes to peer registries.
+	Replication Replication `yaml:"replication,omitempty"`
+
 	// Validation configures validation options for the registry.
 	Validation Validation `yaml:"validation,omitempty"`
 
 	// Policy configures registry policy options.
 	Policy Policy `yaml:"policy,omitempty"`
+
+	// Tracing configures the OpenTelemetry tracing of the requests.
+	Tracing Tracing `yaml:"tracing,omitempty"`
+
+	// Stats configures the statistics kept on the repositories.
+	Stats Stats `yaml:"stats,omitempty"`
+
+	// Tenancy isolates the content of the tenants of the registry, each
+	// under its own prefix of the storage.
+	Tenancy Tenancy `yaml:"tenancy,omitempty"`
+}
+
+// Tenancy isolates the content of the tenants of the registry. The first
+// component of the name of a repository selects its tenant, whose
+// repositories and blobs are kept under the prefix of the tenant in the
+// storage, so that no blob is shared or mounted across tenants.
+type Tenancy struct {
+	// Tenants are the tenants of the registry. The names of the repositories
+	// must start with one of them.
+	Tenants []Tenant `yaml:"tenants,omitempty"`
+}
+
+// Tenant is a tenant of the registry.
+type Tenant struct {
+	// Name is the first component of the names of the repositories of the
+	// tenant.
+	Name string `yaml:"name"`
+
+	// Prefix is the path under which the content of the tenant is kept in
+	// the storage, /tenants/<name> by default.
+	Prefix string `yaml:"prefix,omitempty"`
+
+	// Quota limits the total size in bytes of the layers linked by the
+	// repositories of the tenant, unlimited if zero.
+	Quota int64 `yaml:"quota,omitempty"`
+
+	// Subjects are the patterns of the names of the users authenticated
+	// who may access the repositories of the tenant, using the syntax of
+	// path.Match. Any user may access them if empty.
+	Subjects []string `yaml:"subjects,omitempty"`
+}
+
+// tenantNameRegexp matches the names of the tenants, which are path
+// components of the names of the repositories.
+var tenantNameRegexp = regexp.MustCompile(`^[a-z0-9]+(?:(?:[._]|__|[-]+)[a-z0-9]+)*$`)
+
+// tenantPrefixRegexp matches the prefixes of the tenants in the storage.
+var tenantPrefixRegexp = regexp.MustCompile(`^(/[A-Za-z0-9._-]+)+$`)
+
+// Enabled returns whether the tenancy is enabled.
+func (t Tenancy) Enabled() bool {
+	return len(t.Tenants) > 0
+}
+
+// TenantPrefix returns the prefix of the tenant in the storage.
+func (t Tenant) TenantPrefix() string {
+	if t.Prefix != "" {
+		return strings.TrimSuffix(t.Prefix, "/")
+	}
+	return "/tenants/" + t.Name
+}
+
+func (t Tenancy) validate() error {
+	names := map[string]struct{}{}
+	var prefixes []string
+	for i, tenant := range t.Tenants {
+		if !tenantNameRegexp.MatchString(tenant.Name) {
+			return fmt.Errorf("tenancy.tenants[%d]: invalid name %q", i, tenant.Name)
+		}
+		if _, ok := names[tenant.Name]; ok {
+			return fmt.Errorf("tenancy.tenants[%d]: duplicate name %q", i, tenant.Name)
+		}
+		names[tenant.Name] = struct{}{}
+		prefix := tenant.TenantPrefix()
+		if !tenantPrefixRegexp.MatchString(prefix) || prefix == "/docker" || strings.HasPrefix(prefix, "/docker/") {
+			return fmt.Errorf("tenancy.tenants[%d]: invalid prefix %q", i, tenant.Prefix)
+		}
+		for _, other := range prefixes {
+			if prefix == other || strings.HasPrefix(prefix, other+"/") || strings.HasPrefix(other, prefix+"/") {
+				return fmt.Errorf("tenancy.tenants[%d]: prefix %q overlaps the prefix %q of another tenant", i, prefix, other)
+			}
+		}
+		prefixes = append(prefixes, prefix)
+		if tenant.Quota < 0 {
+			return fmt.Errorf("tenancy.tenants[%d]: quota must be a non-negative integer value", i)
+		}
+		for _, pattern := range tenant.Subjects {
+			if _, err := path.Match(pattern, ""); err != nil || pattern == "" {
+				return fmt.Errorf("tenancy.tenants[%d]: invalid subject pattern %q", i, pattern)
+			}
+		}
+	}
+	return nil
+}
+
+// Stats configures the statistics kept on the repositories.
+type Stats struct {
+	// Pulls counts the pulls of the manifests of the repositories.
+	Pulls PullStats `yaml:"pulls,omitempty"`
+
+	// LastAccess records when the repositories and their tags were last
+	// pulled and pushed.
+	LastAccess LastAccessStats `yaml:"lastaccess,omitempty"`
+}
+
+// PullStats counts the pulls of the manifests of each repository, by the
+// tag or digest they are pulled by. The pulls are counted in memory and
+// flushed to the store periodically, and on shutdown.
+type PullStats struct {
+	// Enabled turns the counting of the pulls on.
+	Enabled bool `yaml:"enabled,omitempty"`
+
+	// Store is where the counts are kept: "storage", the default, or
+	// "redis", which must be used when several instances of the registry
+	// share the storage.
+	Store string `yaml:"store,omitempty"`
+
+	// FlushInterval is the interval at which the pulls counted are flushed
+	// to the store, 30s by default.
+	FlushInterval time.Duration `yaml:"flushinterval,omitempty"`
+}
+
+const (
+	// PullStatsStoreStorage keeps the pull counts in the storage.
+	PullStatsStoreStorage = "storage"
+
+	// PullStatsStoreRedis keeps the pull counts in redis.
+	PullStatsStoreRedis = "redis"
+)
+
+func (p PullStats) validate() error {
+	switch p.Store {
+	case "", PullStatsStoreStorage, PullStatsStoreRedis:
+	default:
+		return fmt.Errorf("unknown pull stats store %q", p.Store)
+	}
+	if p.FlushInterval < 0 {
+		return errors.New("pull stats flushinterval must be a positive duration")
+	}
+	return nil
+}
+
+// LastAccessStats records the last pull and push of each repository and tag
+// in the storage. Each timestamp is written at most once per UpdateInterval,
+// so that it may lag behind by as much.
+type LastAccessStats struct {
+	// Enabled turns the recording of the timestamps on.
+	Enabled bool `yaml:"enabled,omitempty"`
+
+	// UpdateInterval is the minimum interval between the writes of a
+	// timestamp, 1h by default.
+	UpdateInterval time.Duration `yaml:"updateinterval,omitempty"`
+}
+
+func (l LastAccessStats) validate() error {
+	if l.UpdateInterval < 0 {
+		return errors.New("last access updateinterval must be a positive duration")
+	}
+	return nil
+}
+
+// Tracing configures the export and sampling of the OpenTelemetry traces.
+type Tracing struct {
+	// Exporter is the exporter of the spans, otlp. When empty, the exporter
+	// is configured by the OTEL_TRACES_EXPORTER and OTEL_EXPORTER_OTLP_*
+	// environment variables.
+	Exporter string `yaml:"exporter,omitempty"`
+
+	// OTLP configures the otlp exporter.
+	OTLP OTLPExporter `yaml:"otlp,omitempty"`
+
+	// Sampling configures the traces which are sampled. By default, no trace
+	// is.
+	Sampling TracingSampling `yaml:"sampling,omitempty"`
+}
+
+// OTLPExporter configures the export of the spans to an OTLP collector.
+type OTLPExporter struct {
+	// Endpoint is the host and port of the collector.
+	Endpoint string `yaml:"endpoint,omitempty"`
+
+	// Protocol is the protocol of the export, http/protobuf (the default) or
+	// grpc.
+	Protocol string `yaml:"protocol,omitempty"`
+
+	// Insecure disables the TLS of the connection to the collector.
+	Insecure bool `yaml:"insecure,omitempty"`
+
+	// Headers are sent with each export.
+	Headers map[string]string `yaml:"headers,omitempty"`
+}
+
+// TracingSampling configures the sampling of the traces.
+type TracingSampling struct {
+	// Ratio is the ratio, between 0 and 1, of the traces sampled.
+	Ratio float64 `yaml:"ratio,omitempty"`
+
+	// ParentBased samples the requests joining a trace as the caller did,
+	// applying the ratio only to the traces the registry starts.
+	ParentBased bool `yaml:"parentbased,omitempty"`
 }
 
 // Policy defines configuration options for managing registry policies.
 type Policy struct {
 	// Repository configures policies for repositories
 	Repository Repository `yaml:"repository,omitempty"`
+
+	// Retention configures the tags deleted by garbage collection.
+	Retention Retention `yaml:"retention,omitempty"`
+
+	// Network restricts the actions on repositories to client addresses.
+	Network NetworkPolicy `yaml:"network,omitempty"`
+
+	// ImmutableTags refuses the pushes moving the tags matching its rules.
+	ImmutableTags ImmutableTags `yaml:"immutabletags,omitempty"`
+
+	// Quotas limits the size of the blobs linked by the repositories.
+	Quotas Quotas `yaml:"quotas,omitempty"`
+}
+
+// Quotas limits the total size of the layers linked by each repository
+// matching a rule. A blob counts against every repository linking it.
+type Quotas struct {
+	// Repositories are the quotas of the repositories matching their
+	// pattern. The first matching quota applies, to each repository on its
+	// own.
+	Repositories []RepositoryQuota `yaml:"repositories,omitempty"`
+
+	// Usage is where the usage of the repositories is kept: "storage", the
+	// default, or "redis", which must be used when several instances of the
+	// registry share the storage.
+	Usage string `yaml:"usage,omitempty"`
+}
+
+// RepositoryQuota is the quota of the repositories matching a glob pattern.
+type RepositoryQuota struct {
+	// Pattern is the glob pattern of the names of the repositories.
+	Pattern string `yaml:"pattern"`
+
+	// Limit is the size in bytes the layers linked by a repository may not
+	// exceed.
+	Limit int64 `yaml:"limit"`
+}
+
+const (
+	// QuotaUsageStorage keeps the usage of the quotas in the storage.
+	QuotaUsageStorage = "storage"
+
+	// QuotaUsageRedis keeps the usage of the quotas in redis.
+	QuotaUsageRedis = "redis"
+)
+
+// Enabled returns whether quotas apply to repositories.
+func (q Quotas) Enabled() bool {
+	return len(q.Repositories) > 0
+}
+
+func (q Quotas) validate() error {
+	for i, quota := range q.Repositories {
+		if _, err := path.Match(quota.Pattern, ""); err != nil || quota.Pattern == "" {
+			return fmt.Errorf("policy.quotas.repositories[%d]: invalid pattern %q", i, quota.Pattern)
+		}
+		if quota.Limit <= 0 {
+			return fmt.Errorf("policy.quotas.repositories[%d]: limit must be a positive integer value", i)
+		}
+	}
+	switch q.Usage {
+	case "", QuotaUsageStorage, QuotaUsageRedis:
+	default:
+		return fmt.Errorf("unknown quota usage store %q", q.Usage)
+	}
+	return nil
+}
+
+// ImmutableTags makes the tags matching a rule immutable: once pushed, a tag
+// cannot be pushed again for another manifest.
+type ImmutableTags struct {
+	// Rules are the rules matching the immutable tags.
+	Rules []ImmutableTagRule `yaml:"rules,omitempty"`
+
+	// ProtectDeletes also refuses the deletes of the immutable tags, and of
+	// the manifests they reference.
+	ProtectDeletes bool `yaml:"protectdeletes,omitempty"`
+}
+
+// ImmutableTagRule matches the immutable tags of the repositories.
+type ImmutableTagRule struct {
+	// Repository is the glob pattern of the names of the repositories.
+	Repository string `yaml:"repository"`
+
+	// Tags are the glob patterns of the immutable tags.
+	Tags []string `yaml:"tags"`
+}
+
+// NetworkPolicy restricts the actions on repositories to the client addresses
+// allowed by its rules.
+type NetworkPolicy struct {
+	// TrustedProxies are the CIDRs of the proxies whose X-Forwarded-For
+	// header is trusted to find the client address. The header is ignored
+	// when the connection is not from a trusted proxy.
+	TrustedProxies []string `yaml:"trustedproxies,omitempty"`
+
+	// Rules are the rules restricting the actions. An action is denied if
+	// the client address is denied by a rule for the action, or if rules for
+	// the action allow addresses and none allows the client address.
+	Rules []NetworkRule `yaml:"rules,omitempty"`
+}
+
+// NetworkRule allows or denies actions on repositories to client addresses.
+type NetworkRule struct {
+	// Actions are the actions the rule applies to, such as pull, push or
+	// delete. The * action applies to every action.
+	Actions []string `yaml:"actions"`
+
+	// Allow are the CIDRs of the client addresses allowed the actions.
+	Allow []string `yaml:"allow,omitempty"`
+
+	// Deny are the CIDRs of the client addresses denied the actions.
+	Deny []string `yaml:"deny,omitempty"`
+}
+
+// Retention defines the tags garbage collection keeps: the default rule,
+// followed by the rules of the repositories matching a pattern.
+type Retention struct {
+	RetentionRule `yaml:",inline"`
+
+	// Repositories are the rules applying instead of the default rule to the
+	// repositories matching their pattern. The first matching rule applies.
+	Repositories []RepositoryRetention `yaml:"repositories,omitempty"`
+}
+
+// RetentionRule keeps the tags matching a protected pattern, the KeepLatest
+// tags pushed last, the tags pushed within KeepWithinDuration and those pulled
+// within KeepPulledWithinDuration, and lets garbage collection delete the
+// others.
+type RetentionRule struct {
+	// KeepLatest is the number of tags kept, from the tag pushed last.
+	KeepLatest int `yaml:"keeplatest,omitempty"`
+
+	// KeepWithinDuration keeps the tags pushed within this duration.
+	KeepWithinDuration time.Duration `yaml:"keepwithinduration,omitempty"`
+
+	// KeepPulledWithinDuration keeps the tags pulled within this duration,
+	// as recorded by the last access stats, and those pushed within it
+	// which were not pulled since.
+	KeepPulledWithinDuration time.Duration `yaml:"keeppulledwithinduration,omitempty"`
+
+	// ProtectPatterns are the glob patterns of the tags which are never
+	// deleted. The protected patterns of the default rule also apply to the
+	// repositories.
+	ProtectPatterns []string `yaml:"protectpatterns,omitempty"`
+
+	// PruneReferrersTags subjects the tags of the referrers tag schema,
+	// such as sha256-<digest>, to the rule. They are never deleted
+	// otherwise.
+	PruneReferrersTags bool `yaml:"prunereferrerstags,omitempty"`
+}
+
+// RepositoryRetention is the retention rule of the repositories matching a
+// glob pattern.
+type RepositoryRetention struct {
+	// Pattern is the glob pattern of the names of the repositories.
+	Pattern string `yaml:"pattern"`
+
+	RetentionRule `yaml:",inline"`
+}
+
+// Enabled returns whether the retention policy deletes tags.
+func (r Retention) Enabled() bool {
+	if r.RetentionRule.enabled() {
+		return true
+	}
+	for _, rule := range r.Repositories {
+		if rule.enabled() {
+			return true
+		}
+	}
+	return false
+}
+
+func (r RetentionRule) enabled() bool {
+	return r.KeepLatest > 0 || r.KeepWithinDuration > 0 || r.KeepPulledWithinDuration > 0
 }
 
 // Repository defines configuration options related to repository policies in the registry.
@@ -101,6 +489,72 @@ type Catalog struct {
 	// to the catalog endpoint will return at most MaxEntries entries.
 	// An empty or a negative value will set a default of 1000 maximum entries by default.
 	MaxEntries int `yaml:"maxentries,omitempty"`
+
+	// Index keeps the names of the repositories in an index, so that the
+	// catalog is listed without walking the storage.
+	Index CatalogIndex `yaml:"index,omitempty"`
+
+	// Search serves the search of the repositories and tags of the index.
+	Search CatalogSearch `yaml:"search,omitempty"`
+}
+
+// CatalogIndex keeps the names of the repositories in an index, updated as
+// repositories are pushed to and removed, and reconciled with the storage
+// periodically.
+type CatalogIndex struct {
+	// Enabled serves the catalog from the index.
+	Enabled bool `yaml:"enabled,omitempty"`
+
+	// Store is where the index is kept: "storage", the default, or "redis",
+	// which must be used when several instances of the registry share the
+	// storage.
+	Store string `yaml:"store,omitempty"`
+
+	// ReconcileInterval is the interval at which the index is reconciled
+	// with the repositories of the storage, 1h by default.
+	ReconcileInterval time.Duration `yaml:"reconcileinterval,omitempty"`
+}
+
+const (
+	// CatalogIndexStoreStorage keeps the catalog index in the storage.
+	CatalogIndexStoreStorage = "storage"
+
+	// CatalogIndexStoreRedis keeps the catalog index in redis.
+	CatalogIndexStoreRedis = "redis"
+)
+
+// CatalogSearch configures the search of the repositories and tags of the
+// catalog index, at /v2/_search.
+type CatalogSearch struct {
+	// Enabled serves the search, which requires the catalog index.
+	Enabled bool `yaml:"enabled,omitempty"`
+
+	// PrefixOnly only matches the names starting with the term, instead of
+	// those containing it, which lists the matching repositories from the
+	// index without scanning it.
+	PrefixOnly bool `yaml:"prefixonly,omitempty"`
+}
+
+func (c Catalog) validate() error {
+	if err := c.Index.validate(); err != nil {
+		return err
+	}
+	if c.Search.Enabled && !c.Index.Enabled {
+		return errors.New("catalog search requires the catalog index")
+	}
+	return nil
+}
+
+func (c CatalogIndex) validate() error {
+	switch c.Store {
+	case "", CatalogIndexStoreStorage, CatalogIndexStoreRedis:
+	default:
+		return fmt.Errorf("unknown catalog index store %q", c.Store)
+	}
+	if c.ReconcileInterval < 0 {
+		return errors.New("catalog index reconcileinterval must be a positive duration")
+	}
+	return nil
 }
 
 // Log represents the configuration for logging within the application.
@@ -108,9 +562,18 @@ type Log struct {
 	// AccessLog configures access logging.
 	AccessLog AccessLog `yaml:"accesslog,omitempty"`
 
+	// Audit configures the audit log of the destructive and administrative
+	// operations.
+	Audit AuditLog `yaml:"audit,omitempty"`
+
 	// Level is the granularity at which registry operations are logged.
 	Level Loglevel `yaml:"level,omitempty"`
 
+	// Repositories overrides the level of the logs of the requests for the
+	// repositories matching its patterns, using the syntax of path.Match.
+	// The most verbose level of the patterns matching a repository applies.
+	Repositories map[string]Loglevel `yaml:"repositories,omitempty"`
+
 	// Formatter overrides the default formatter with another. Options
 	// include "text", "json" and "logstash".
 	Formatter string `yaml:"formatter,omitempty"`
@@ -131,6 +594,34 @@ type Log struct {
 type AccessLog struct {
 	// Disabled disables access logging.
 	Disabled bool `yaml:"disabled,omitempty"`
+
+	// Format is the format of the lines of the access log: "combined", the
+	// default, "common" or "json".
+	Format string `yaml:"format,omitempty"`
+
+	// Fields lists the fields of the json format which are logged, in
+	// order. All of them are logged by default.
+	Fields []string `yaml:"fields,omitempty"`
+
+	// Rename maps fields of the json format to the names they are logged
+	// as.
+	Rename map[string]string `yaml:"rename,omitempty"`
+}
+
+// AuditLog configures the audit log, a stream of JSON entries recording the
+// deletions and other administrative operations.
+type AuditLog struct {
+	// Output is the file the entries are appended to, or stdout. The audit
+	// log is disabled when empty.
+	Output string `yaml:"output,omitempty"`
+
+	// MaxSize is the size in bytes over which the file is rolled over. The
+	// file is never rolled over if zero.
+	MaxSize int64 `yaml:"maxsize,omitempty"`
+
+	// MaxBackups is the number of files rolled over which are kept, 5 by
+	// default.
+	MaxBackups int `yaml:"maxbackups,omitempty"`
 }
 
 // HTTP defines configuration options for the HTTP interface of the registry.
@@ -184,6 +675,43 @@ type HTTP struct {
 
 	// H2C configures support for HTTP/2 without requiring TLS (HTTP/2 Cleartext).
 	H2C H2C `yaml:"h2c,omitempty"`
+
+	// RateLimit limits the rate of the requests of each client.
+	RateLimit RateLimit `yaml:"ratelimit,omitempty"`
+}
+
+// RateLimit limits the rate of the requests of each client with token
+// buckets. The client address is found with the trusted proxies of the
+// network policy.
+type RateLimit struct {
+	// Key is what the requests are counted by: user, ip or repository.
+	// Requests without a user are counted by ip when keyed by user, and
+	// requests without a repository are not limited when keyed by
+	// repository. Defaults to ip.
+	Key string `yaml:"key,omitempty"`
+
+	// Limits are the limits applying to the requests. A request is limited
+	// if any limit matching it is exceeded.
+	Limits []RateLimitRule `yaml:"limits,omitempty"`
+}
+
+// RateLimitRule limits the rate of the requests to some endpoints.
+type RateLimitRule struct {
+	// Endpoint is the endpoint the limit applies to: manifest, blob, or *
+	// for every endpoint. Defaults to *.
+	Endpoint string `yaml:"endpoint,omitempty"`
+
+	// Method is the kind of requests the limit applies to: read for GET
+	// and HEAD requests, write for the others, or * for every request.
+	// Defaults to *.
+	Method string `yaml:"method,omitempty"`
+
+	// Rate is the number of requests per second allowed on average.
+	Rate float64 `yaml:"rate"`
+
+	// Burst is the number of requests allowed at once. Defaults to the
+	// rate, rounded up.
+	Burst int `yaml:"burst,omitempty"`
 }
 
 // Debug defines the configuration options for the registry's debug interface.
@@ -395,6 +923,89 @@ type Health struct {
 	// StorageDriver configures a health check on the configured storage
 	// driver
 	StorageDriver StorageDriver `yaml:"storagedriver,omitempty"`
+
+	// Redis configures a health check on the connection to the configured
+	// redis
+	Redis RedisHealth `yaml:"redis,omitempty"`
+
+	// Upstream configures a health check on the remotes of the pull through
+	// cache
+	Upstream UpstreamHealth `yaml:"upstream,omitempty"`
+
+	// ECR configures the health check on the credentials of the remotes
+	// authenticating with ECR, registered for each of them
+	ECR ECRHealth `yaml:"ecr,omitempty"`
+}
+
+// UpstreamHealth configures the health check requesting each remote of the
+// pull through cache with its credentials.
+type UpstreamHealth struct {
+	// Enabled turns on the health check for the remotes
+	Enabled bool `yaml:"enabled,omitempty"`
+
+	// Interval is the duration in between checks
+	Interval time.Duration `yaml:"interval,omitempty"`
+
+	// Timeout is the duration to wait for the remotes to answer
+	Timeout time.Duration `yaml:"timeout,omitempty"`
+
+	// Threshold is the number of times a check must fail to trigger an
+	// unhealthy state
+	Threshold int `yaml:"threshold,omitempty"`
+
+	// Reference is a tagged or canonical reference whose manifest is
+	// requested from the remote serving it, instead of its base route.
+	Reference string `yaml:"reference,omitempty"`
+
+	// Informational reports the failures of the check without failing the
+	// health of the registry, for the caches which keep serving the content
+	// they hold while their remote is unreachable.
+	Informational bool `yaml:"informational,omitempty"`
+}
+
+// validate checks that the reference is tagged or canonical.
+func (u UpstreamHealth) validate() error {
+	if u.Reference == "" {
+		return nil
+	}
+	ref, err := reference.Parse(u.Reference)
+	if err != nil {
+		return fmt.Errorf("invalid upstream health check reference %q: %v", u.Reference, err)
+	}
+	_, tagged := ref.(reference.Tagged)
+	_, digested := ref.(reference.Digested)
+	if _, named := ref.(reference.Named); !named || (!tagged && !digested) {
+		return fmt.Errorf("upstream health check reference %q must be tagged or canonical", u.Reference)
+	}
+	return nil
+}
+
+// ECRHealth configures the health check verifying that an authorization
+// token can be obtained from ECR for the remotes of the pull through cache.
+type ECRHealth struct {
+	// Interval is the duration in between checks
+	Interval time.Duration `yaml:"interval,omitempty"`
+
+	// Threshold is the number of times a check must fail to trigger an
+	// unhealthy state
+	Threshold int `yaml:"threshold,omitempty"`
+}
+
+// RedisHealth configures the health check pinging redis, each node of a
+// cluster.
+type RedisHealth struct {
+	// Enabled turns on the health check for redis
+	Enabled bool `yaml:"enabled,omitempty"`
+
+	// Interval is the duration in between checks
+	Interval time.Duration `yaml:"interval,omitempty"`
+
+	// Timeout is the duration to wait for the pings to be answered
+	Timeout time.Duration `yaml:"timeout,omitempty"`
+
+	// Threshold is the number of times a check must fail to trigger an
+	// unhealthy state
+	Threshold int `yaml:"threshold,omitempty"`
 }
 
 // StorageDriver configures health checks specific to the storage driver.
@@ -408,6 +1019,24 @@ type StorageDriver struct {
 	// Threshold is the number of times a check must fail to trigger an
 	// unhealthy state
 	Threshold int `yaml:"threshold,omitempty"`
+
+	// WriteProbe configures a health check writing to the storage driver,
+	// independently of the check above
+	WriteProbe WriteProbe `yaml:"writeprobe,omitempty"`
+}
+
+// WriteProbe configures the health check writing a small object to the
+// storage driver, reading it back and deleting it.
+type WriteProbe struct {
+	// Enabled turns on the write probe
+	Enabled bool `yaml:"enabled,omitempty"`
+
+	// Interval is the duration in between probes
+	Interval time.Duration `yaml:"interval,omitempty"`
+
+	// Threshold is the number of times a probe must fail to trigger an
+	// unhealthy state
+	Threshold int `yaml:"threshold,omitempty"`
 }
 
 // Platform specifies the characteristics of a computing environment
@@ -498,6 +1127,12 @@ func (storage Storage) Type() string {
 			// allow configuration of delete
 		case "redirect":
 			// allow configuration of redirect
+		case "mount":
+			// allow configuration of blob mounts
+		case "verification":
+			// allow configuration of blob read verification
+		case "uploads":
+			// allow configuration of the upload sessions
 		case "tag":
 			// allow configuration of tag
 		default:
@@ -554,6 +1189,12 @@ func (storage *Storage) UnmarshalYAML(unmarshal func(any) error) error {
 					// allow configuration of delete
 				case "redirect":
 					// allow configuration of redirect
+				case "mount":
+					// allow configuration of blob mounts
+				case "verification":
+					// allow configuration of blob read verification
+				case "uploads":
+					// allow configuration of the upload sessions
 				case "tag":
 					// allow configuration of tag
 				default:
@@ -652,37 +1293,215 @@ func (auth Auth) MarshalYAML() (any, error) {
 type Notifications struct {
 	// EventConfig is the configuration for the event format that is sent to each Endpoint.
 	EventConfig Events `yaml:"events,omitempty"`
-	// Endpoints is a list of http configurations for endpoints that
-	// respond to webhook notifications. In the future, we may allow other
-	// kinds of endpoints, such as external queues.
+	// Endpoints is a list of configurations for endpoints that respond to
+	// webhook notifications, or for SQS queues, SNS topics and NATS servers.
 	Endpoints []Endpoint `yaml:"endpoints,omitempty"`
+	// IncludeAnnotations includes the annotations of the manifests, and the
+	// labels of their image configuration, in their push events.
+	IncludeAnnotations bool `yaml:"includeannotations,omitempty"`
+	// MaxAnnotationsSize is the maximum size in bytes of the annotations and
+	// labels of an event, over which they are left out of it. It defaults to
+	// DefaultMaxAnnotationsSize.
+	MaxAnnotationsSize int `yaml:"maxannotationssize,omitempty"`
 }
 
-// Endpoint describes the configuration of an http webhook notification
-// endpoint.
+// DefaultMaxAnnotationsSize is the default maximum size in bytes of the
+// annotations and labels of a push event.
+const DefaultMaxAnnotationsSize = 8 << 10
+
+// Endpoint describes the configuration of a notification endpoint: an http
+// webhook, an SQS queue, an SNS topic or NATS servers.
 type Endpoint struct {
-	Name              string        `yaml:"name"`              // identifies the endpoint in the registry instance.
-	Disabled          bool          `yaml:"disabled"`          // disables the endpoint
-	URL               string        `yaml:"url"`               // post url for the endpoint.
-	Headers           http.Header   `yaml:"headers"`           // static headers that should be added to all requests
-	Timeout           time.Duration `yaml:"timeout"`           // HTTP timeout
-	Threshold         int           `yaml:"threshold"`         // circuit breaker threshold before backing off on failure
-	Backoff           time.Duration `yaml:"backoff"`           // backoff duration
-	IgnoredMediaTypes []string      `yaml:"ignoredmediatypes"` // target media types to ignore
-	Ignore            Ignore        `yaml:"ignore"`            // ignore event types
+	Name              string            `yaml:"name"`                  // identifies the endpoint in the registry instance.
+	Disabled          bool              `yaml:"disabled"`              // disables the endpoint
+	Type              string            `yaml:"type,omitempty"`        // http, the default, sqs, sns or nats
+	URL               string            `yaml:"url"`                   // post url for the endpoint, the queue URL or ARN, the topic ARN, or the NATS server URLs.
+	Headers           http.Header       `yaml:"headers"`               // static headers that should be added to all requests
+	Timeout           time.Duration     `yaml:"timeout"`               // timeout of each HTTP request, backoff excluded
+	Threshold         int               `yaml:"threshold"`             // circuit breaker threshold before backing off on failure
+	Backoff           time.Duration     `yaml:"backoff"`               // backoff duration
+	IgnoredMediaTypes []string          `yaml:"ignoredmediatypes"`     // target media types to ignore
+	Ignore            Ignore            `yaml:"ignore"`                // ignore event types
+	Filter            Filter            `yaml:"filter"`                // events sent to the endpoint
+	AWS               AWSEndpoint       `yaml:"aws,omitempty"`         // AWS client of sqs and sns endpoints
+	NATS              NATSEndpoint      `yaml:"nats,omitempty"`        // NATS client of nats endpoints
+	Retry             Retry             `yaml:"retry,omitempty"`       // retries of the events
+	DeadLetter        DeadLetter        `yaml:"deadletter,omitempty"`  // events which exhausted their retries
+	QueueSize         int               `yaml:"queuesize,omitempty"`   // maximum number of pending events, unbounded if zero
+	Signing           Signing           `yaml:"signing,omitempty"`     // HMAC signatures of the requests
+	Deduplication     Deduplication     `yaml:"dedup,omitempty"`       // windows collapsing identical events
+	Concurrency       int               `yaml:"concurrency,omitempty"` // events of http endpoints delivered at once, one if zero
+	Transport         EndpointTransport `yaml:"transport,omitempty"`   // connections of http endpoints
+}
+
+// EndpointTransport configures the connections of http notification
+// endpoints, kept alive between the requests. The zero values keep the
+// defaults of the Go HTTP client.
+type EndpointTransport struct {
+	// KeepAlive is the interval between the keep-alive probes of the
+	// connections.
+	KeepAlive time.Duration `yaml:"keepalive,omitempty"`
+
+	// MaxIdleConns is the maximum number of idle connections kept to the
+	// endpoint, at least the concurrency of the endpoint.
+	MaxIdleConns int `yaml:"maxidleconns,omitempty"`
+
+	// IdleConnTimeout is how long an idle connection is kept before it is
+	// closed.
+	IdleConnTimeout time.Duration `yaml:"idleconntimeout,omitempty"`
+}
+
+// Deduplication configures the windows within which the identical pull or
+// push events of a notification endpoint are collapsed into the first one.
+// Events are identical if they have the same action, repository, digest, tag
+// and actor. Events are not deduplicated if the window of their action is
+// zero, the default.
+type Deduplication struct {
+	Pull time.Duration `yaml:"pull,omitempty"`
+	Push time.Duration `yaml:"push,omitempty"`
+}
+
+// Signing configures the HMAC-SHA256 signatures of the requests of http
+// notification endpoints, for them to verify that the events come from the
+// registry.
+type Signing struct {
+	// Secret is the shared secret the requests are signed with, or
+	// SecretFile a file holding it.
+	Secret     string `yaml:"secret,omitempty"`
+	SecretFile string `yaml:"secretfile,omitempty"`
+
+	// PreviousSecret, or PreviousSecretFile, is the secret being rotated
+	// out. While it is set, the requests are signed with both secrets.
+	PreviousSecret     string `yaml:"previoussecret,omitempty"`
+	PreviousSecretFile string `yaml:"previoussecretfile,omitempty"`
+}
+
+// Retry configures how long the events of a notification endpoint are
+// retried. By default, they are retried until they are delivered.
+type Retry struct {
+	// MaxAttempts is the number of attempts to deliver an event before it
+	// is dead-lettered, unlimited if zero.
+	MaxAttempts int `yaml:"maxattempts,omitempty"`
+
+	// Backoff is the backoff curve: constant, the default, backs off for the
+	// backoff of the endpoint once threshold consecutive attempts failed,
+	// and exponential doubles the backoff after each failed attempt, up to
+	// MaxBackoff.
+	Backoff    string        `yaml:"backoff,omitempty"`
+	MaxBackoff time.Duration `yaml:"maxbackoff,omitempty"`
+
+	// TTL is the age after which an event which failed to be delivered is
+	// dead-lettered rather than retried, unlimited if zero.
+	TTL time.Duration `yaml:"ttl,omitempty"`
+}
+
+// DeadLetter configures where the events which exhausted their retries are
+// written, for them to be replayed. Without either, they are dropped.
+type DeadLetter struct {
+	// File is a file the events are appended to, as JSON lines.
+	File string `yaml:"file,omitempty"`
+
+	// URL is an http endpoint the events are posted to, with Headers, and
+	// the timeout, threshold and backoff of the endpoint. They are retried
+	// until they are delivered.
+	URL     string      `yaml:"url,omitempty"`
+	Headers http.Header `yaml:"headers,omitempty"`
+}
+
+// AWSEndpoint configures the AWS client of sqs and sns notification
+// endpoints. Without credentials, the AWS credential chain is used.
+type AWSEndpoint struct {
+	// Region is the region of the queue or topic. If empty, it is derived
+	// from the URL of the endpoint.
+	Region string `yaml:"region,omitempty"`
+
+	// AccessKeyID, SecretAccessKey and SessionToken are static credentials.
+	AccessKeyID     string `yaml:"accesskeyid,omitempty"`
+	SecretAccessKey string `yaml:"secretaccesskey,omitempty"`
+	SessionToken    string `yaml:"sessiontoken,omitempty"`
+
+	// RoleARN is the role assumed to publish the events, with the optional
+	// ExternalID.
+	RoleARN    string `yaml:"rolearn,omitempty"`
+	ExternalID string `yaml:"externalid,omitempty"`
+
+	// Endpoint overrides the URL of the AWS API, such as a VPC endpoint.
+	Endpoint string `yaml:"endpoint,omitempty"`
+}
+
+// NATSEndpoint configures the NATS client of nats notification endpoints.
+type NATSEndpoint struct {
+	// Subject is the template of the subject of the events, in which
+	// {action} and {repository} are replaced by those of the event. It
+	// defaults to registry.events.{action}.
+	Subject string `yaml:"subject,omitempty"`
+
+	// User and Password, or Token, authenticate to the servers, unless set
+	// in their URLs.
+	User     string `yaml:"user,omitempty"`
+	Password string `yaml:"password,omitempty"`
+	Token    string `yaml:"token,omitempty"`
+
+	// NKeyFile is a file holding the nkey seed of the user. CredsFile is a
+	// credentials file, holding the JWT and nkey seed of the user.
+	NKeyFile  string `yaml:"nkeyfile,omitempty"`
+	CredsFile string `yaml:"credsfile,omitempty"`
+
+	// JetStream requires the events to be acknowledged by a JetStream
+	// stream.
+	JetStream bool `yaml:"jetstream,omitempty"`
+
+	// ReconnectWait is the time between attempts to reconnect to the
+	// servers.
+	ReconnectWait time.Duration `yaml:"reconnectwait,omitempty"`
+
+	// BufferSize is the maximum size, in bytes, of the events buffered while
+	// disconnected. Further events are dropped.
+	BufferSize int `yaml:"buffersize,omitempty"`
 }
 
 // Events configures notification events.
 type Events struct {
 	IncludeReferences bool `yaml:"includereferences"` // include reference data in manifest events
+	Proxy             bool `yaml:"proxy,omitempty"`   // emit the events of the pull through cache
+
+	// TagDeletes is how the tags removed by the deletion of a manifest by
+	// digest are reported, TagDeletesEvents if not set.
+	TagDeletes string `yaml:"tagdeletes,omitempty"`
 }
 
+// The reports of the tags removed by the deletion of a manifest.
+const (
+	// TagDeletesEvents follows the delete event of the manifest with a
+	// tag.delete event for each of its tags, the default.
+	TagDeletesEvents = "events"
+	// TagDeletesManifest lists the tags in the delete event of the manifest.
+	TagDeletesManifest = "manifest"
+)
+
 // Ignore configures mediaTypes and actions of the event, that it won't be propagated
 type Ignore struct {
 	MediaTypes []string `yaml:"mediatypes"` // target media types to ignore
 	Actions    []string `yaml:"actions"`    // ignore action types
 }
 
+// Filter selects the events sent to an endpoint: an event is sent if it
+// matches every list of the filter. The ignore options of the endpoint are
+// added to the exclude lists.
+type Filter struct {
+	Repositories FilterList `yaml:"repositories,omitempty"` // glob patterns of the repository names
+	Actions      FilterList `yaml:"actions,omitempty"`      // actions, such as push, pull, mount or delete
+	MediaTypes   FilterList `yaml:"mediatypes,omitempty"`   // glob patterns of the target media types
+}
+
+// FilterList includes and excludes values. A value matches the list if it
+// matches none of the exclude list, and any of the include list, unless it
+// is empty.
+type FilterList struct {
+	Include []string `yaml:"include,omitempty"`
+	Exclude []string `yaml:"exclude,omitempty"`
+}
+
 // Middleware configures named middlewares to be applied at injection points.
 type Middleware struct {
 	// Name the middleware registers itself as
@@ -698,6 +1517,17 @@ type Proxy struct {
 	// RemoteURL is the URL of the remote registry
 	RemoteURL string `yaml:"remoteurl"`
 
+	// Mode is how the content is pulled through: ProxyModeCache, the
+	// default, or ProxyModeStreamThrough.
+	Mode string `yaml:"mode,omitempty"`
+
+	// Remotes lists additional upstream registries, each with its own
+	// credentials. Repositories are routed to the remote with the longest
+	// matching prefix. The flat RemoteURL, Username, Password, Exec and ECR
+	// fields describe the default remote and are translated into the first
+	// entry of the list by RemoteConfigs.
+	Remotes []ProxyRemote `yaml:"remotes,omitempty"`
+
 	// Username of the hub user
 	Username string `yaml:"username"`
 
@@ -712,18 +1542,279 @@ type Proxy struct {
 	// If set, Username, Password, and Exec are ignored.
 	ECR *ECRConfig `yaml:"ecr,omitempty"`
 
+	// TagFilter restricts the tags pulled through the default remote
+	TagFilter ProxyTagFilter `yaml:"tagfilter,omitempty"`
+
+	// ForceBasic sends the credentials of the default remote with basic
+	// authentication on every request, for an upstream which requires them
+	// without challenging the requests.
+	ForceBasic bool `yaml:"forcebasic,omitempty"`
+
+	// HTTPProxy, HTTPSProxy and NoProxy route the requests to the default
+	// remote through http proxies, in place of the environment variables.
+	HTTPProxy  string `yaml:"httpproxy,omitempty"`
+	HTTPSProxy string `yaml:"httpsproxy,omitempty"`
+	NoProxy    string `yaml:"noproxy,omitempty"`
+
 	// TTL is the expiry time of the content and will be cleaned up when it expires
 	// if not set, defaults to 7 * 24 hours
 	// If set to zero, will never expire cache
 	TTL *time.Duration `yaml:"ttl,omitempty"`
 
+	// ManifestTTL is the expiry time of the manifests cached, TTL if not set.
+	// If set to zero, the manifests never expire.
+	ManifestTTL *time.Duration `yaml:"manifestttl,omitempty"`
+
+	// BlobTTL is the expiry time of the blobs cached, TTL if not set. If set
+	// to zero, the blobs never expire.
+	BlobTTL *time.Duration `yaml:"blobttl,omitempty"`
+
+	// MediaTypeTTLs override the expiry time of the manifests and blobs of
+	// media types, keyed by media type or by pattern such as
+	// "application/vnd.in-toto*". A media type takes precedence over the
+	// patterns matching it, and a longer pattern over a shorter one.
+	MediaTypeTTLs map[string]time.Duration `yaml:"mediatypettls,omitempty"`
+
 	// CacheWriteTimeout is the maximum duration allowed for cache write operations
 	// to complete when pulling blobs from the remote registry. This timeout ensures
 	// that cache writes don't hang indefinitely if the storage backend is slow.
 	// If not set, defaults to 5 minutes.
 	CacheWriteTimeout *time.Duration `yaml:"cachewritetimeout,omitempty"`
+
+	// MaxCacheSize is the maximum total size in bytes of blobs held in the
+	// proxy cache. If not set or zero, the cache size is unbounded.
+	MaxCacheSize int64 `yaml:"maxcachesize,omitempty"`
+
+	// MaxCacheBlobSize is the maximum size in bytes of a blob cached. The
+	// larger blobs are streamed from the remote to the client without being
+	// persisted. If not set or zero, blobs of any size are cached.
+	MaxCacheBlobSize int64 `yaml:"maxcacheblobsize,omitempty"`
+
+	// QuotaPolicy selects what happens when caching an upstream blob would
+	// exceed MaxCacheSize. "evict" (the default) synchronously removes the
+	// oldest cached blobs to make room, "stream" serves the blob to the client
+	// without persisting it.
+	QuotaPolicy string `yaml:"quotapolicy,omitempty"`
+
+	// FetchOnMount fetches a blob from the upstream of the source repository
+	// of a cross-repository mount when it is not cached yet. Otherwise only
+	// the blobs already held by the cache are mounted.
+	FetchOnMount bool `yaml:"fetchonmount,omitempty"`
+
+	// Prefetch fetches the blobs referenced by a manifest fetched from the
+	// remote in the background, so that they are cached by the time they are
+	// requested.
+	Prefetch ProxyPrefetch `yaml:"prefetch,omitempty"`
+
+	// ParallelFetch fetches the large blobs from the remote in parts,
+	// requested concurrently with ranged requests.
+	ParallelFetch ProxyParallelFetch `yaml:"parallelfetch,omitempty"`
+
+	// Verification verifies the cosign signatures of the manifests fetched
+	// from the remote before caching them, refusing the pulls of those
+	// whose signatures do not verify.
+	Verification ProxyVerification `yaml:"verification,omitempty"`
+
+	// SeedFile is a YAML or JSON list of the image references pulled
+	// through the cache in the background once the registry starts
+	// listening, so that the cache is warm before they are requested.
+	SeedFile string `yaml:"seedfile,omitempty"`
+
+	// SeedPlatforms are the platforms of the images of the indexes of the
+	// seed file pulled, every platform if empty.
+	SeedPlatforms []Platform `yaml:"seedplatforms,omitempty"`
+}
+
+// ProxyPrefetch configures the prefetch of the blobs referenced by the
+// manifests fetched by a pull through cache
+type ProxyPrefetch struct {
+	// Enabled prefetches the config and layer blobs of the image manifests
+	// fetched from the remote.
+	Enabled bool `yaml:"enabled,omitempty"`
+
+	// Concurrency is the number of blobs prefetched at once, 4 if not set.
+	Concurrency int `yaml:"concurrency,omitempty"`
+
+	// MaxSize is the size in bytes over which a blob is not prefetched, but
+	// fetched once requested. If not set or zero, every blob is prefetched.
+	MaxSize int64 `yaml:"maxsize,omitempty"`
+}
+
+// ProxyParallelFetch configures the fetch of the large blobs of the remote
+// of a pull through cache in parts requested concurrently
+type ProxyParallelFetch struct {
+	// Enabled fetches the blobs of at least Threshold bytes in parts.
+	Enabled bool `yaml:"enabled,omitempty"`
+
+	// Threshold is the size in bytes from which a blob is fetched in
+	// parts, 64 MiB if not set.
+	Threshold int64 `yaml:"threshold,omitempty"`
+
+	// PartSize is the size in bytes of the parts requested, 16 MiB if not
+	// set.
+	PartSize int64 `yaml:"partsize,omitempty"`
+
+	// Concurrency is the number of parts requested at once, 4 if not set.
+	Concurrency int `yaml:"concurrency,omitempty"`
+}
+
+// ProxyVerification configures the verification of the cosign signatures of
+// the manifests fetched by a pull through cache, or copied by mirror sync
+type ProxyVerification struct {
+	// Repositories are glob patterns of the repositories whose manifests
+	// are verified. If not set, the manifests of every repository are.
+	Repositories []string `yaml:"repositories,omitempty"`
+
+	// Keys are the files of the PEM public keys a signature is verified
+	// with, any of them verifying it.
+	Keys []string `yaml:"keys,omitempty"`
+
+	// Keyless verifies the signatures of the short-lived certificates
+	// issued by Fulcio to an identity.
+	Keyless *ProxyKeyless `yaml:"keyless,omitempty"`
+
+	// CacheSize is the number of digests whose verification is cached,
+	// 10000 if not set.
+	CacheSize int `yaml:"cachesize,omitempty"`
+}
+
+// Enabled reports whether the signatures are verified.
+func (v ProxyVerification) Enabled() bool {
+	return len(v.Keys) > 0 || v.Keyless != nil
 }
 
+// ProxyKeyless configures the verification of the signatures of Fulcio
+// certificates, logged to the Rekor transparency log
+type ProxyKeyless struct {
+	// Roots is the file of the PEM certificates of the Fulcio roots, and of
+	// their intermediates.
+	Roots string `yaml:"roots"`
+
+	// RekorKey is the file of the PEM public key of Rekor, the signed entry
+	// timestamps of the bundles of the signatures are verified with.
+	RekorKey string `yaml:"rekorkey"`
+
+	// Identities are the identities whose certificates are accepted.
+	Identities []ProxyKeylessIdentity `yaml:"identities"`
+}
+
+// ProxyKeylessIdentity is an identity Fulcio issues certificates to
+type ProxyKeylessIdentity struct {
+	// Issuer is the OIDC issuer which authenticated the identity.
+	Issuer string `yaml:"issuer"`
+
+	// Subject is a regular expression matching the whole email or URI of
+	// the identity.
+	Subject string `yaml:"subject"`
+}
+
+// ProxyRemote configures a single upstream registry of a pull through cache
+type ProxyRemote struct {
+	// RemoteURL is the URL of the remote registry
+	RemoteURL string `yaml:"remoteurl"`
+
+	// Prefix restricts the remote to the repositories named by this value
+	// or under it, such as team/app for the prefix team or team/, which are
+	// requested from the remote without the prefix. An empty prefix matches
+	// every repository.
+	Prefix string `yaml:"prefix,omitempty"`
+
+	// Username of the remote registry user
+	Username string `yaml:"username,omitempty"`
+
+	// Password of the remote registry user
+	Password string `yaml:"password,omitempty"`
+
+	// Exec specifies a custom exec-based command to retrieve credentials.
+	// If set, Username and Password are ignored.
+	Exec *ExecConfig `yaml:"exec,omitempty"`
+
+	// ECR specifies configuration for AWS ECR authentication.
+	// If set, Username, Password, and Exec are ignored.
+	ECR *ECRConfig `yaml:"ecr,omitempty"`
+
+	// TagFilter restricts the tags pulled through the remote
+	TagFilter ProxyTagFilter `yaml:"tagfilter,omitempty"`
+
+	// ForceBasic sends the credentials with basic authentication on every
+	// request, for a remote which requires them without challenging the
+	// requests.
+	ForceBasic bool `yaml:"forcebasic,omitempty"`
+
+	// HTTPProxy is the URL of the http proxy of the requests to the remote
+	// over http, including the requests to its token service and to ECR. The
+	// proxy credentials, if any, are set as the user info of the URL. If no
+	// proxy is set, the proxies of the environment variables are used.
+	HTTPProxy string `yaml:"httpproxy,omitempty"`
+
+	// HTTPSProxy is the URL of the http proxy of the requests to the remote
+	// over https, tunneled with CONNECT.
+	HTTPSProxy string `yaml:"httpsproxy,omitempty"`
+
+	// NoProxy lists, separated by commas, the hosts, domains and CIDR
+	// ranges reached without the proxies, like the NO_PROXY environment
+	// variable.
+	NoProxy string `yaml:"noproxy,omitempty"`
+}
+
+// ProxyTagFilter restricts the tags pulled through a remote with regular
+// expressions matched against the whole tag requested, before it is fetched
+// from the remote. The pulls by digest are not filtered.
+type ProxyTagFilter struct {
+	// Allow, if not empty, lists the patterns of the only tags pulled
+	Allow []string `yaml:"allow,omitempty"`
+
+	// Deny lists the patterns of the tags never pulled, even if allowed
+	Deny []string `yaml:"deny,omitempty"`
+
+	// Passthrough serves the tags filtered out from the remote without
+	// caching them, instead of answering that they are unknown
+	Passthrough bool `yaml:"passthrough,omitempty"`
+}
+
+// Enabled reports whether the registry is configured as a pull through cache
+func (p Proxy) Enabled() bool {
+	return p.RemoteURL != "" || len(p.Remotes) > 0
+}
+
+// RemoteConfigs returns the configured upstream remotes, translating the
+// flat single-remote configuration into the first entry.
+func (p Proxy) RemoteConfigs() []ProxyRemote {
+	var remotes []ProxyRemote
+	if p.RemoteURL != "" {
+		remotes = append(remotes, ProxyRemote{
+			RemoteURL:  p.RemoteURL,
+			Username:   p.Username,
+			Password:   p.Password,
+			Exec:       p.Exec,
+			ECR:        p.ECR,
+			TagFilter:  p.TagFilter,
+			ForceBasic: p.ForceBasic,
+			HTTPProxy:  p.HTTPProxy,
+			HTTPSProxy: p.HTTPSProxy,
+			NoProxy:    p.NoProxy,
+		})
+	}
+	return append(remotes, p.Remotes...)
+}
+
+const (
+	// ProxyModeCache caches the content pulled through in the storage
+	ProxyModeCache = "cache"
+
+	// ProxyModeStreamThrough streams the content pulled through from the
+	// remote to the client, without persisting anything in the storage
+	ProxyModeStreamThrough = "streamthrough"
+)
+
+const (
+	// ProxyQuotaPolicyEvict evicts the oldest cached blobs to make room
+	ProxyQuotaPolicyEvict = "evict"
+
+	// ProxyQuotaPolicyStream streams over-quota blobs without caching them
+	ProxyQuotaPolicyStream = "stream"
+)
+
 // ExecConfig defines the configuration for executing a command as a credential helper.
 // This allows the registry to authenticate against an upstream registry by executing a
 // specified command to obtain credentials. The command can be re-executed based on the
@@ -776,6 +1867,61 @@ type ECRConfig struct {
 	Lifetime *time.Duration `yaml:"lifetime,omitempty"`
 }
 
+// Replication configures the replication of the manifests pushed to the
+// registry, with the blobs they reference, to peer registries.
+type Replication struct {
+	// Actor is the actor name of the pushes of the replication. The pushes
+	// of this actor are not replicated, for peers replicating to each other
+	// not to replicate them back. It defaults to DefaultReplicationActor.
+	Actor string `yaml:"actor,omitempty"`
+
+	// Backoff is the backoff after a failed replication, doubled after each
+	// failed attempt up to MaxBackoff. They default to 1s and 5m.
+	Backoff    time.Duration `yaml:"backoff,omitempty"`
+	MaxBackoff time.Duration `yaml:"maxbackoff,omitempty"`
+
+	// Peers are the registries the pushes are replicated to.
+	Peers []ReplicationPeer `yaml:"peers,omitempty"`
+}
+
+// DefaultReplicationActor is the default actor name of the pushes of the
+// replication.
+const DefaultReplicationActor = "replication"
+
+// ReplicationPeer is a registry the pushes are replicated to, with the
+// credentials of the pushes.
+type ReplicationPeer struct {
+	// Name identifies the peer, and its queue of pending replications in
+	// the storage.
+	Name string `yaml:"name"`
+
+	// URL is the URL of the peer registry.
+	URL string `yaml:"url"`
+
+	// Prefix restricts the replication to the repositories whose name
+	// starts with this value. An empty prefix matches every repository.
+	Prefix string `yaml:"prefix,omitempty"`
+
+	// Username and Password, Exec or ECR are the credentials of the peer,
+	// as for the remotes of a pull through cache.
+	Username string      `yaml:"username,omitempty"`
+	Password string      `yaml:"password,omitempty"`
+	Exec     *ExecConfig `yaml:"exec,omitempty"`
+	ECR      *ECRConfig  `yaml:"ecr,omitempty"`
+}
+
+// Remote returns the peer as a remote registry, for its credentials.
+func (p ReplicationPeer) Remote() ProxyRemote {
+	return ProxyRemote{
+		RemoteURL: p.URL,
+		Prefix:    p.Prefix,
+		Username:  p.Username,
+		Password:  p.Password,
+		Exec:      p.Exec,
+		ECR:       p.ECR,
+	}
+}
+
 // Validation configures validation options for the registry.
 type Validation struct {
 	// Enabled enables the other options in this section. This field is
@@ -796,6 +1942,221 @@ type ValidationManifests struct {
 
 	// ImageIndexes configures validation of image indexes
 	Indexes ValidationIndexes `yaml:"indexes,omitempty"`
+
+	// Subjects configures validation of the subjects of OCI manifests and
+	// image indexes.
+	Subjects ValidationSubjects `yaml:"subjects,omitempty"`
+
+	// MaxSize is the maximum size in bytes of a manifest pushed to the
+	// registry, or fetched from upstream by a pull through cache. It
+	// defaults to DefaultManifestMaxSize, zero removes the limit.
+	MaxSize *int64 `yaml:"maxsize,omitempty"`
+
+	// MediaTypes restricts the media types of the manifests stored in the
+	// registry, and of the layers they reference.
+	MediaTypes ValidationMediaTypes `yaml:"mediatypes,omitempty"`
+
+	// Annotations requires annotations of the OCI manifests and image
+	// indexes pushed to the registry.
+	Annotations ValidationAnnotations `yaml:"annotations,omitempty"`
+
+	// Layers relaxes the checks that the layers of the image manifests
+	// pushed to the registry exist.
+	Layers ValidationLayers `yaml:"layers,omitempty"`
+
+	// Schema1 is the policy for the schema1 manifests of the old Docker
+	// clients, pushed to the registry or fetched from upstream by a pull
+	// through cache, Schema1Allow if not set.
+	Schema1 string `yaml:"schema1,omitempty"`
+}
+
+// The policies for schema1 manifests.
+const (
+	// Schema1Allow keeps the registry's handling of schema1 manifests, which
+	// it does not store and refuses as unsupported, the default.
+	Schema1Allow = "allow"
+	// Schema1Reject rejects them with an error naming their media type and
+	// the media types to push instead.
+	Schema1Reject = "reject"
+	// Schema1Convert converts the schema1 manifests pushed by tag, or fetched
+	// from upstream, to schema2 manifests, and stores only the schema2
+	// manifests.
+	Schema1Convert = "convert"
+)
+
+// ValidationMediaTypes restricts the media types of manifests and of their
+// layers, by default and for the repositories matching a pattern.
+type ValidationMediaTypes struct {
+	MediaTypeRule `yaml:",inline"`
+
+	// Repositories are the rules applying instead of the default rule to the
+	// repositories matching their pattern. The first matching rule applies.
+	Repositories []RepositoryMediaTypes `yaml:"repositories,omitempty"`
+}
+
+// MediaTypeRule lists the media types allowed for manifests and for the
+// layers they reference. An empty list allows every media type.
+type MediaTypeRule struct {
+	// Manifests are the allowed media types of manifests.
+	Manifests []string `yaml:"manifests,omitempty"`
+
+	// Layers are the allowed media types of the layers of image manifests.
+	Layers []string `yaml:"layers,omitempty"`
+}
+
+// RepositoryMediaTypes is the media type rule of the repositories matching a
+// glob pattern.
+type RepositoryMediaTypes struct {
+	// Pattern is the glob pattern of the names of the repositories.
+	Pattern string `yaml:"pattern"`
+
+	MediaTypeRule `yaml:",inline"`
+}
+
+// ValidationLayers relaxes the checks that the layers of the image manifests
+// pushed exist, by default and for the repositories matching a pattern.
+type ValidationLayers struct {
+	LayerRule `yaml:",inline"`
+
+	// Repositories are the rules applying instead of the default rule to the
+	// repositories matching their pattern. The first matching rule applies.
+	Repositories []RepositoryLayers `yaml:"repositories,omitempty"`
+}
+
+// LayerRule lists the exceptions to the check that the layers of an image
+// manifest exist in its repository. The zero value checks every layer.
+type LayerRule struct {
+	// ExemptMediaTypes are the media types of the layers accepted without
+	// checking that they exist.
+	ExemptMediaTypes []string `yaml:"exemptmediatypes,omitempty"`
+
+	// AnyRepository accepts a layer missing from the repository if a blob of
+	// its digest and size is in any repository of the registry, as when it
+	// is to be mounted.
+	AnyRepository bool `yaml:"anyrepository,omitempty"`
+}
+
+// RepositoryLayers is the layer rule of the repositories matching a glob
+// pattern.
+type RepositoryLayers struct {
+	// Pattern is the glob pattern of the names of the repositories.
+	Pattern string `yaml:"pattern"`
+
+	LayerRule `yaml:",inline"`
+}
+
+// ValidationAnnotations requires annotations of the OCI manifests and image
+// indexes, by default and for the repositories matching a pattern.
+type ValidationAnnotations struct {
+	AnnotationRule `yaml:",inline"`
+
+	// Repositories are the rules applying instead of the default rule to the
+	// repositories matching their pattern. The first matching rule applies.
+	Repositories []RepositoryAnnotations `yaml:"repositories,omitempty"`
+
+	// Proxy also applies the rules to the manifests fetched from upstream by
+	// a pull through cache, which are exempt by default.
+	Proxy bool `yaml:"proxy,omitempty"`
+}
+
+// The policies of an annotation rule for Docker manifests and manifest
+// lists, which have no annotations.
+const (
+	// AnnotationsSchema2Exempt accepts them, the default.
+	AnnotationsSchema2Exempt = "exempt"
+	// AnnotationsSchema2Reject rejects them.
+	AnnotationsSchema2Reject = "reject"
+)
+
+// AnnotationRule lists the annotations an OCI manifest or image index must
+// have.
+type AnnotationRule struct {
+	// Required are the annotations required.
+	Required []RequiredAnnotation `yaml:"required,omitempty"`
+
+	// Schema2 is the policy for Docker manifests and manifest lists,
+	// AnnotationsSchema2Exempt if not set.
+	Schema2 string `yaml:"schema2,omitempty"`
+}
+
+// RequiredAnnotation is an annotation a manifest must have.
+type RequiredAnnotation struct {
+	// Key is the key of the annotation.
+	Key string `yaml:"key"`
+
+	// Value is a regular expression the whole value of the annotation must
+	// match. Any value is accepted if not set.
+	Value string `yaml:"value,omitempty"`
+}
+
+// RepositoryAnnotations is the annotation rule of the repositories matching a
+// glob pattern.
+type RepositoryAnnotations struct {
+	// Pattern is the glob pattern of the names of the repositories.
+	Pattern string `yaml:"pattern"`
+
+	AnnotationRule `yaml:",inline"`
+}
+
+// Enabled reports whether any rule requires annotations, or rejects Docker
+// manifests.
+func (v ValidationAnnotations) Enabled() bool {
+	if len(v.Required) > 0 || v.Schema2 != "" {
+		return true
+	}
+	for _, rule := range v.Repositories {
+		if len(rule.Required) > 0 || rule.Schema2 != "" {
+			return true
+		}
+	}
+	return false
+}
+
+func (v ValidationAnnotations) validate() error {
+	rules := []AnnotationRule{v.AnnotationRule}
+	for _, rule := range v.Repositories {
+		if _, err := path.Match(rule.Pattern, ""); err != nil || rule.Pattern == "" {
+			return fmt.Errorf("invalid annotation repository pattern %q", rule.Pattern)
+		}
+		rules = append(rules, rule.AnnotationRule)
+	}
+	for _, rule := range rules {
+		switch rule.Schema2 {
+		case "", AnnotationsSchema2Exempt, AnnotationsSchema2Reject:
+		default:
+			return fmt.Errorf("unknown annotation schema2 policy %q", rule.Schema2)
+		}
+		for _, annotation := range rule.Required {
+			if annotation.Key == "" {
+				return errors.New("required annotations must have a key")
+			}
+			if _, err := regexp.Compile(annotation.Value); err != nil {
+				return fmt.Errorf("invalid value of the required annotation %s: %v", annotation.Key, err)
+			}
+		}
+	}
+	return nil
+}
+
+// DefaultManifestMaxSize is the maximum size of a manifest if
+// validation.manifests.maxsize is not set.
+const DefaultManifestMaxSize = 4 << 20
+
+// MaxSizeBytes returns the maximum size of a manifest in bytes, or zero if
+// manifests are not limited in size.
+func (v ValidationManifests) MaxSizeBytes() int64 {
+	if v.MaxSize == nil {
+		return DefaultManifestMaxSize
+	}
+	return *v.MaxSize
+}
+
+// ValidationSubjects configures validation rules for the subject of a manifest.
+type ValidationSubjects struct {
+	// RequireExists requires the subject of a pushed manifest to exist in the
+	// repository. It should be left unset for proxies and mirrors, which may
+	// receive referrers before their subject.
+	RequireExists bool `yaml:"requireexists,omitempty"`
 }
 
 // URLs defines validation rules for URLs found in the manifests pushed to the registry.
@@ -873,10 +2234,20 @@ func Parse(rd io.Reader) (*Configuration, error) {
 						v0_1.Loglevel = Loglevel("")
 					}
 
+					for pattern := range v0_1.Log.Repositories {
+						if _, err := path.Match(pattern, ""); err != nil || pattern == "" {
+							return nil, fmt.Errorf("log.repositories: invalid pattern %q", pattern)
+						}
+					}
+
 					if v0_1.Catalog.MaxEntries <= 0 {
 						v0_1.Catalog.MaxEntries = defaultMaxEntries
 					}
 
+					if err := v0_1.Catalog.validate(); err != nil {
+						return nil, err
+					}
+
 					if v0_1.Tags.MaxTags <= 0 {
 						if v0_1.Tags.MaxTags < 0 {
 							return nil, errors.New("maxtags limit must be a non-negative integer value")
@@ -884,6 +2255,67 @@ func Parse(rd io.Reader) (*Configuration, error) {
 						v0_1.Tags.MaxTags = defaultMaxTags
 					}
 
+					if size := v0_1.Validation.Manifests.MaxSize; size != nil && *size < 0 {
+						return nil, errors.New("manifest maxsize must be a non-negative integer value")
+					}
+
+					if err := v0_1.Validation.Manifests.Annotations.validate(); err != nil {
+						return nil, err
+					}
+
+					switch policy := v0_1.Validation.Manifests.Schema1; policy {
+					case "", Schema1Allow, Schema1Reject, Schema1Convert:
+					default:
+						return nil, fmt.Errorf("unknown schema1 manifest policy %q", policy)
+					}
+
+					switch report := v0_1.Notifications.EventConfig.TagDeletes; report {
+					case "", TagDeletesEvents, TagDeletesManifest:
+					default:
+						return nil, fmt.Errorf("unknown report of the tag deletes %q", report)
+					}
+
+					if err := v0_1.Policy.Quotas.validate(); err != nil {
+						return nil, err
+					}
+
+					if err := v0_1.Tenancy.validate(); err != nil {
+						return nil, err
+					}
+					if v0_1.Tenancy.Enabled() && v0_1.Proxy.Enabled() {
+						return nil, errors.New("tenancy is not supported by a pull through cache")
+					}
+					if v0_1.Tenancy.Enabled() && len(v0_1.Replication.Peers) > 0 {
+						return nil, errors.New("replication is not supported with tenancy")
+					}
+					if v0_1.Tenancy.Enabled() && v0_1.Policy.Quotas.Enabled() {
+						return nil, errors.New("the quotas of the repositories are not supported with tenancy, set the quotas of the tenants instead")
+					}
+
+					if err := v0_1.Stats.Pulls.validate(); err != nil {
+						return nil, err
+					}
+
+					if err := v0_1.Stats.LastAccess.validate(); err != nil {
+						return nil, err
+					}
+
+					if err := v0_1.Health.Upstream.validate(); err != nil {
+						return nil, err
+					}
+
+					if audit := v0_1.Log.Audit; audit.MaxSize < 0 || audit.MaxBackups < 0 {
+						return nil, errors.New("audit log maxsize and maxbackups must be non-negative integer values")
+					}
+
+					if ratio := v0_1.Tracing.Sampling.Ratio; ratio < 0 || ratio > 1 {
+						return nil, errors.New("tracing sampling ratio must be between 0 and 1")
+					}
+
+					if err := v0_1.Redis.validate(); err != nil {
+						return nil, err
+					}
+
 					if v0_1.Storage.Type() == "" {
 						return nil, errors.New("no storage configuration provided")
 					}
@@ -1022,6 +2454,12 @@ type RedisTLSOptions struct {
 // Redis represents the configuration for connecting to a Redis server. It includes
 // both the basic connection options and optional TLS settings to secure the connection.
 type Redis struct {
+	// Mode is the deployment of Redis connected to: RedisModeSingle,
+	// RedisModeSentinel or RedisModeCluster. By default, it is a sentinel
+	// deployment if a master name is set, a cluster if several addresses are,
+	// and a single node otherwise.
+	Mode string `yaml:"mode,omitempty"`
+
 	// Options provides the configuration for connecting to Redis, including
 	// options for both clustered and standalone Redis setups. It is provided inline
 	// from the `redis.UniversalOptions` struct.
@@ -1032,6 +2470,46 @@ type Redis struct {
 	TLS RedisTLSOptions `yaml:"tls,omitempty"`
 }
 
+// The deployments of Redis.
+const (
+	// RedisModeSingle connects to the single node of the address.
+	RedisModeSingle = "single"
+	// RedisModeSentinel connects to the master named by the sentinels of
+	// the addresses, following its failovers.
+	RedisModeSentinel = "sentinel"
+	// RedisModeCluster connects to the cluster of the seed addresses.
+	RedisModeCluster = "cluster"
+)
+
+// validate checks that the mode of the Redis configuration is consistent
+// with its addresses and master name.
+func (r Redis) validate() error {
+	if r.Mode == "" {
+		return nil
+	}
+	if len(r.Options.Addrs) == 0 {
+		return fmt.Errorf("redis %s mode requires addrs", r.Mode)
+	}
+	switch r.Mode {
+	case RedisModeSingle:
+		if len(r.Options.Addrs) > 1 {
+			return errors.New("redis single mode takes a single address")
+		}
+	case RedisModeSentinel:
+		if r.Options.MasterName == "" {
+			return errors.New("redis sentinel mode requires a mastername")
+		}
+		return nil
+	case RedisModeCluster:
+	default:
+		return fmt.Errorf("unsupported redis mode: %q", r.Mode)
+	}
+	if r.Options.MasterName != "" {
+		return errors.New("redis mastername is only supported by the sentinel mode")
+	}
+	return nil
+}
+
 const (
 	ClientAuthRequestClientCert          = "request-client-cert"
 	ClientAuthRequireAnyClientCert       = "require-any-client-cert"
@@ -111,9 +111,15 @@ func NewParser(prefix string, parseInfos []VersionedParseInfo) *Parser {
 // than version, following the scheme below:
 // v.Abc may be replaced by the value of PREFIX_ABC,
 // v.Abc.Xyz may be replaced by the value of PREFIX_ABC_XYZ, and so forth
+//
+// If the top-level expandenv key is true, the references to environment
+// variables in the string values are expanded once decoded, before the
+// overrides: ${VAR} is replaced by the value of VAR, which must be set, and
+// ${VAR:-default} by default if VAR is unset or empty. $${ is a literal ${.
 func (p *Parser) Parse(in []byte, v any) error {
 	var versionedStruct struct {
-		Version Version
+		Version   Version
+		ExpandEnv bool `yaml:"expandenv"`
 	}
 
 	if err := yaml.Unmarshal(in, &versionedStruct); err != nil {
@@ -131,6 +137,12 @@ func (p *Parser) Parse(in []byte, v any) error {
 		return err
 	}
 
+	if versionedStruct.ExpandEnv {
+		if err := p.expandEnv(parseAs, ""); err != nil {
+			return fmt.Errorf("expanding environment variables: %v", err)
+		}
+	}
+
 	for _, envVar := range p.env {
 		pathStr := envVar.name
 		if strings.HasPrefix(pathStr, strings.ToUpper(p.prefix)+"_") {
@@ -315,3 +327,137 @@ func (p *Parser) overwriteMap(m reflect.Value, fullpath string, path []string, p
 
 	return nil
 }
+
+// expandEnv expands the references to environment variables in the string
+// values of v, path being the path of v in the configuration file.
+func (p *Parser) expandEnv(v reflect.Value, path string) error {
+	switch v.Kind() {
+	case reflect.Ptr:
+		if v.IsNil() {
+			return nil
+		}
+		return p.expandEnv(v.Elem(), path)
+	case reflect.Interface:
+		if v.IsNil() {
+			return nil
+		}
+		// The value of an interface is not settable, so a copy is
+		// expanded in its place.
+		elem := reflect.New(v.Elem().Type()).Elem()
+		elem.Set(v.Elem())
+		if err := p.expandEnv(elem, path); err != nil {
+			return err
+		}
+		v.Set(elem)
+	case reflect.Struct:
+		for i := 0; i < v.NumField(); i++ {
+			sf := v.Type().Field(i)
+			if !sf.IsExported() {
+				continue
+			}
+			name, yamlOpts, _ := strings.Cut(sf.Tag.Get("yaml"), ",")
+			switch {
+			case name == "-":
+				continue
+			case yamlOpts == "inline":
+				name = ""
+			case name == "":
+				name = strings.ToLower(sf.Name)
+			}
+			if err := p.expandEnv(v.Field(i), joinPath(path, name)); err != nil {
+				return err
+			}
+		}
+	case reflect.Map:
+		iter := v.MapRange()
+		for iter.Next() {
+			elem := reflect.New(v.Type().Elem()).Elem()
+			elem.Set(iter.Value())
+			if err := p.expandEnv(elem, joinPath(path, fmt.Sprint(iter.Key().Interface()))); err != nil {
+				return err
+			}
+			v.SetMapIndex(iter.Key(), elem)
+		}
+	case reflect.Slice, reflect.Array:
+		for i := 0; i < v.Len(); i++ {
+			if err := p.expandEnv(v.Index(i), fmt.Sprintf("%s[%d]", path, i)); err != nil {
+				return err
+			}
+		}
+	case reflect.String:
+		expanded, err := p.expandString(v.String())
+		if err != nil {
+			return fmt.Errorf("%s: %v", path, err)
+		}
+		v.SetString(expanded)
+	}
+	return nil
+}
+
+// expandString expands the references to environment variables in s.
+func (p *Parser) expandString(s string) (string, error) {
+	if !strings.Contains(s, "${") {
+		return s, nil
+	}
+	var b strings.Builder
+	for {
+		i := strings.Index(s, "${")
+		if i < 0 {
+			b.WriteString(s)
+			return b.String(), nil
+		}
+		if i > 0 && s[i-1] == '$' {
+			// $${ is escaped.
+			b.WriteString(s[:i-1])
+			b.WriteString("${")
+			s = s[i+2:]
+			continue
+		}
+		end := strings.IndexByte(s[i+2:], '}')
+		if end < 0 {
+			return "", fmt.Errorf("unterminated environment variable reference")
+		}
+		name, fallback, hasFallback := strings.Cut(s[i+2:i+2+end], ":-")
+		if !isEnvName(name) {
+			return "", fmt.Errorf("invalid environment variable name %q", name)
+		}
+		value, ok := p.lookupEnv(name)
+		if !ok || (hasFallback && value == "") {
+			if !hasFallback {
+				return "", fmt.Errorf("environment variable %s is not set", name)
+			}
+			value = fallback
+		}
+		b.WriteString(s[:i])
+		b.WriteString(value)
+		s = s[i+2+end+1:]
+	}
+}
+
+// lookupEnv returns the value of the environment variable of the parser.
+func (p *Parser) lookupEnv(name string) (string, bool) {
+	i := sort.Search(len(p.env), func(i int) bool { return p.env[i].name >= name })
+	if i < len(p.env) && p.env[i].name == name {
+		return p.env[i].value, true
+	}
+	return "", false
+}
+
+func isEnvName(name string) bool {
+	if name == "" || (name[0] >= '0' && name[0] <= '9') {
+		return false
+	}
+	for _, c := range name {
+		if c != '_' && (c < '0' || c > '9') && (c < 'A' || c > 'Z') && (c < 'a' || c > 'z') {
+			return false
+		}
+	}
+	return true
+}
+
+func joinPath(path, name string) string {
+	if path == "" || name == "" {
+		return path + name
+	}
+	return path + "." + name
+}
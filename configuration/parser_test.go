@@ -3,6 +3,7 @@ package configuration
 import (
 	"reflect"
 	"testing"
+	"time"
 
 	"github.com/stretchr/testify/require"
 )
@@ -133,3 +134,107 @@ func TestParseInlinedStruct(t *testing.T) {
 	require.NoError(t, err)
 	require.Equal(t, expected, config)
 }
+
+type expandedConfiguration struct {
+	Version       Version                  `yaml:"version"`
+	ExpandEnv     bool                     `yaml:"expandenv"`
+	Log           *Log                     `yaml:"log"`
+	Notifications []Notif                  `yaml:"notifications,omitempty"`
+	Storage       map[string]Parameters    `yaml:"storage,omitempty"`
+	Headers       map[string][]string      `yaml:"headers,omitempty"`
+	Inlined       Inlined                  `yaml:",inline"`
+	Timeouts      map[string]time.Duration `yaml:"timeouts,omitempty"`
+}
+
+const expandedConfig = `version: "0.1"
+expandenv: true
+log:
+  formatter: ${FORMATTER:-text}
+notifications:
+  - name: ${NAME}-first
+  - name: "$${NAME} ${UNSET:-second}"
+storage:
+  s3:
+    accesskey: ${ACCESS_KEY}
+    secretkey: ${EMPTY:-default}
+    nested:
+      tags: [literal, "${NAME}"]
+headers:
+  Authorization: ["Bearer ${TOKEN}"]
+firstValue: ${NAME}$
+timeouts:
+  upload: 10s`
+
+func newExpandingParser() *Parser {
+	return NewParser("registry", []VersionedParseInfo{
+		{
+			Version: "0.1",
+			ParseAs: reflect.TypeFor[expandedConfiguration](),
+			ConversionFunc: func(c any) (any, error) {
+				return c, nil
+			},
+		},
+	})
+}
+
+func TestParseExpandEnv(t *testing.T) {
+	t.Setenv("NAME", "foo")
+	t.Setenv("ACCESS_KEY", "AKIA")
+	t.Setenv("EMPTY", "")
+	t.Setenv("TOKEN", "${NAME}")
+
+	var config expandedConfiguration
+	err := newExpandingParser().Parse([]byte(expandedConfig), &config)
+	require.NoError(t, err)
+	require.Equal(t, expandedConfiguration{
+		Version:   "0.1",
+		ExpandEnv: true,
+		Log:       &Log{Formatter: "text"},
+		Notifications: []Notif{
+			{Name: "foo-first"},
+			{Name: "${NAME} second"},
+		},
+		Storage: map[string]Parameters{
+			"s3": {
+				"accesskey": "AKIA",
+				"secretkey": "default",
+				"nested":    map[any]any{"tags": []any{"literal", "foo"}},
+			},
+		},
+		// The values of the variables are not expanded.
+		Headers:  map[string][]string{"Authorization": {"Bearer ${NAME}"}},
+		Inlined:  Inlined{FirstValue: "foo$"},
+		Timeouts: map[string]time.Duration{"upload": 10 * time.Second},
+	}, config)
+}
+
+func TestParseExpandEnvErrors(t *testing.T) {
+	t.Setenv("NAME", "foo")
+	for _, tc := range []struct {
+		config string
+		err    string
+	}{
+		{
+			config: "storage:\n  s3:\n    nested:\n      tags: [first, \"${MISSING}\"]",
+			err:    "storage.s3.nested.tags[1]: environment variable MISSING is not set",
+		},
+		{
+			config: "notifications:\n  - name: ${NAME\n",
+			err:    "notifications[0].name: unterminated environment variable reference",
+		},
+		{
+			config: "firstValue: ${NAME-default}",
+			err:    `firstValue: invalid environment variable name "NAME-default"`,
+		},
+	} {
+		var config expandedConfiguration
+		err := newExpandingParser().Parse([]byte("version: \"0.1\"\nexpandenv: true\n"+tc.config), &config)
+		require.EqualError(t, err, "expanding environment variables: "+tc.err)
+	}
+
+	// The references are left as is unless expandenv is set.
+	var config expandedConfiguration
+	err := newExpandingParser().Parse([]byte("version: \"0.1\"\nfirstValue: ${MISSING}"), &config)
+	require.NoError(t, err)
+	require.Equal(t, "${MISSING}", config.Inlined.FirstValue)
+}
@@ -43,6 +43,16 @@ func (err ErrRepositoryUnknown) Error() string {
 	return fmt.Sprintf("unknown repository name=%s", err.Name)
 }
 
+// ErrRepositoryExists is returned if a repository is renamed to the name of a
+// repository known by the registry.
+type ErrRepositoryExists struct {
+	Name string
+}
+
+func (err ErrRepositoryExists) Error() string {
+	return fmt.Sprintf("repository name=%s already exists", err.Name)
+}
+
 // ErrRepositoryNameInvalid should be used to denote an invalid repository
 // name. Reason may set, indicating the cause of invalidity.
 type ErrRepositoryNameInvalid struct {
@@ -101,12 +111,53 @@ func (errs ErrManifestVerification) Error() string {
 // ErrManifestBlobUnknown returned when a referenced blob cannot be found.
 type ErrManifestBlobUnknown struct {
 	Digest digest.Digest
+
+	// Field and MediaType are the field of the manifest holding the
+	// descriptor of the blob, such as "layers[2]", and its media type, if
+	// known.
+	Field     string
+	MediaType string
 }
 
 func (err ErrManifestBlobUnknown) Error() string {
+	if err.Field != "" {
+		return fmt.Sprintf("unknown blob %v of %s (%s) on manifest", err.Digest, err.Field, err.MediaType)
+	}
 	return fmt.Sprintf("unknown blob %v on manifest", err.Digest)
 }
 
+// ErrManifestFieldInvalid is returned when a field of a manifest, such as
+// its subject, holds an invalid value.
+type ErrManifestFieldInvalid struct {
+	Field  string
+	Reason error
+}
+
+func (err ErrManifestFieldInvalid) Error() string {
+	return fmt.Sprintf("manifest field %s invalid: %v", err.Field, err.Reason)
+}
+
+// ErrManifestTooLarge is returned when a manifest exceeds the maximum manifest
+// size of the registry.
+type ErrManifestTooLarge struct {
+	Limit int64
+}
+
+func (err ErrManifestTooLarge) Error() string {
+	return fmt.Sprintf("manifest exceeds the maximum size of %d bytes", err.Limit)
+}
+
+// ErrManifestSignatureInvalid is returned when the signatures of a manifest
+// fetched from a remote registry do not verify, or it has none.
+type ErrManifestSignatureInvalid struct {
+	Digest digest.Digest
+	Reason error
+}
+
+func (err ErrManifestSignatureInvalid) Error() string {
+	return fmt.Sprintf("signature of manifest %s invalid: %v", err.Digest, err.Reason)
+}
+
 // ErrManifestNameInvalid should be used to denote an invalid manifest
 // name. Reason may set, indicating the cause of invalidity.
 type ErrManifestNameInvalid struct {
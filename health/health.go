@@ -23,8 +23,9 @@ func init() {
 // registry defined in DefaultRegistry. However, unit tests may need to create
 // separate registries to isolate themselves from other tests.
 type Registry struct {
-	mu               sync.RWMutex
-	registeredChecks map[string]Checker
+	mu                sync.RWMutex
+	registeredChecks  map[string]Checker
+	registeredNotices map[string]NoticeFunc
 }
 
 // NewRegistry creates a new registry. This isn't necessary for normal use of
@@ -32,7 +33,8 @@ type Registry struct {
 // own set of checks.
 func NewRegistry() *Registry {
 	return &Registry{
-		registeredChecks: make(map[string]Checker),
+		registeredChecks:  make(map[string]Checker),
+		registeredNotices: make(map[string]NoticeFunc),
 	}
 }
 
@@ -56,6 +58,11 @@ func (cf CheckFunc) Check(ctx context.Context) error {
 	return cf(ctx)
 }
 
+// NoticeFunc reports a condition of the service which is not a failure, such
+// as a maintenance mode. It returns an empty string if there is nothing to
+// report.
+type NoticeFunc func(context.Context) string
+
 // Updater implements a health check that is explicitly set.
 type Updater interface {
 	Checker
@@ -187,6 +194,26 @@ func CheckStatus(ctx context.Context) map[string]string {
 	return DefaultRegistry.CheckStatus(ctx)
 }
 
+// NoticeStatus returns a map with all the current notices.
+func (registry *Registry) NoticeStatus(ctx context.Context) map[string]string {
+	registry.mu.RLock()
+	defer registry.mu.RUnlock()
+	statusKeys := make(map[string]string)
+	for k, v := range registry.registeredNotices {
+		if notice := v(ctx); notice != "" {
+			statusKeys[k] = notice
+		}
+	}
+
+	return statusKeys
+}
+
+// NoticeStatus returns a map with all the current notices from the default
+// registry.
+func NoticeStatus(ctx context.Context) map[string]string {
+	return DefaultRegistry.NoticeStatus(ctx)
+}
+
 // Register associates the checker with the provided name.
 func (registry *Registry) Register(name string, check Checker) {
 	if registry == nil {
@@ -219,8 +246,23 @@ func RegisterFunc(name string, check CheckFunc) {
 	DefaultRegistry.RegisterFunc(name, check)
 }
 
+// RegisterNotice associates the notice with the provided name, replacing any
+// notice registered with it. The notices are reported by StatusHandler, but
+// do not fail the health checks.
+func (registry *Registry) RegisterNotice(name string, notice NoticeFunc) {
+	registry.mu.Lock()
+	defer registry.mu.Unlock()
+	registry.registeredNotices[name] = notice
+}
+
+// RegisterNotice associates the notice with the provided name in the default
+// registry.
+func RegisterNotice(name string, notice NoticeFunc) {
+	DefaultRegistry.RegisterNotice(name, notice)
+}
+
 // StatusHandler returns a JSON blob with all the currently registered Health Checks
-// and their corresponding status.
+// and their corresponding status, along with the current notices.
 // Returns 503 if any Error status exists, 200 otherwise
 func StatusHandler(w http.ResponseWriter, r *http.Request) {
 	if r.Method == http.MethodGet {
@@ -231,6 +273,11 @@ func StatusHandler(w http.ResponseWriter, r *http.Request) {
 		if len(checks) != 0 {
 			status = http.StatusServiceUnavailable
 		}
+		for k, notice := range NoticeStatus(r.Context()) {
+			if _, ok := checks[k]; !ok {
+				checks[k] = notice
+			}
+		}
 
 		statusResponse(w, r, status, checks)
 	} else {
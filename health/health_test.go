@@ -49,6 +49,42 @@ func TestReturns503IfThereAreErrorChecks(t *testing.T) {
 	}
 }
 
+// TestNoticesAreReported ensures that the notices are reported by the health
+// endpoint, without failing the health checks.
+func TestNoticesAreReported(t *testing.T) {
+	// clear out existing checks.
+	DefaultRegistry = NewRegistry()
+
+	notice := "maintenance"
+	RegisterNotice("some_notice", func(context.Context) string {
+		return notice
+	})
+	if checks := CheckStatus(context.Background()); len(checks) != 0 {
+		t.Fatalf("unexpected failing checks: %v", checks)
+	}
+
+	req, err := http.NewRequest(http.MethodGet, "https://fakeurl.com/debug/health", nil)
+	if err != nil {
+		t.Fatalf("Failed to create request.")
+	}
+
+	recorder := httptest.NewRecorder()
+	StatusHandler(recorder, req)
+	if recorder.Code != http.StatusOK {
+		t.Fatalf("Did not get a 200.")
+	}
+	if body := recorder.Body.String(); body != `{"some_notice":"maintenance"}` {
+		t.Fatalf("unexpected health status: %s", body)
+	}
+
+	notice = ""
+	recorder = httptest.NewRecorder()
+	StatusHandler(recorder, req)
+	if body := recorder.Body.String(); body != `{}` {
+		t.Fatalf("unexpected health status without notice: %s", body)
+	}
+}
+
 // TestHealthHandler ensures that our handler implementation correct protects
 // the web application when things aren't so healthy.
 func TestHealthHandler(t *testing.T) {
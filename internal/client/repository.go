@@ -25,6 +25,10 @@ import (
 	v1 "github.com/opencontainers/image-spec/specs-go/v1"
 )
 
+// maxReferrersSize is the maximum size of the index of the referrers of a
+// manifest read.
+const maxReferrersSize = 4 << 20
+
 // Registry provides an interface for calling Repositories, which returns a catalog of repositories.
 type Registry interface {
 	Repositories(ctx context.Context, repos []string, last string) (n int, err error)
@@ -290,6 +294,18 @@ func descriptorFromResponse(response *http.Response) (v1.Descriptor, error) {
 // to construct a descriptor for the tag.  If the registry doesn't support HEADing
 // a manifest, fallback to GET.
 func (t *tags) Get(ctx context.Context, tag string) (v1.Descriptor, error) {
+	return t.get(ctx, tag, "")
+}
+
+// GetIfChanged is like Get, but makes conditional requests. If the tag still
+// references the manifest dgst, ErrManifestNotModified is returned.
+func (t *tags) GetIfChanged(ctx context.Context, tag string, dgst digest.Digest) (v1.Descriptor, error) {
+	return t.get(ctx, tag, fmt.Sprintf(`"%s"`, dgst))
+}
+
+// get constructs a descriptor for the tag, with requests whose If-None-Match
+// header is etag, if it is set.
+func (t *tags) get(ctx context.Context, tag string, etag string) (v1.Descriptor, error) {
 	ref, err := reference.WithTag(t.name, tag)
 	if err != nil {
 		return v1.Descriptor{}, err
@@ -308,6 +324,9 @@ func (t *tags) Get(ctx context.Context, tag string) (v1.Descriptor, error) {
 		for _, t := range distribution.ManifestMediaTypes() {
 			req.Header.Add("Accept", t)
 		}
+		if etag != "" {
+			req.Header.Set("If-None-Match", etag)
+		}
 		resp, err := t.client.Do(req)
 		return resp, err
 	}
@@ -319,6 +338,8 @@ func (t *tags) Get(ctx context.Context, tag string) (v1.Descriptor, error) {
 	defer resp.Body.Close()
 
 	switch {
+	case resp.StatusCode == http.StatusNotModified:
+		return v1.Descriptor{}, distribution.ErrManifestNotModified
 	case resp.StatusCode >= 200 && resp.StatusCode < 400 && len(resp.Header.Get("Docker-Content-Digest")) > 0:
 		// if the response is a success AND a Docker-Content-Digest can be retrieved from the headers
 		return descriptorFromResponse(resp)
@@ -333,6 +354,9 @@ func (t *tags) Get(ctx context.Context, tag string) (v1.Descriptor, error) {
 		}
 		defer resp.Body.Close()
 
+		if resp.StatusCode == http.StatusNotModified {
+			return v1.Descriptor{}, distribution.ErrManifestNotModified
+		}
 		if resp.StatusCode >= 200 && resp.StatusCode < 400 {
 			return descriptorFromResponse(resp)
 		}
@@ -344,8 +368,38 @@ func (t *tags) Lookup(ctx context.Context, digest v1.Descriptor) ([]string, erro
 	panic("not implemented")
 }
 
+// List returns a page of at most limit tags after last, as ordered by the
+// remote, or io.EOF with the last page.
 func (t *tags) List(ctx context.Context, limit int, last string) ([]string, error) {
-	panic("not implemented")
+	u, err := t.ub.BuildTagsURL(t.name, buildCatalogValues(limit, last))
+	if err != nil {
+		return nil, err
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, u, nil)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := t.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if err := HandleHTTPResponseError(resp); err != nil {
+		return nil, err
+	}
+
+	var tagsResponse struct {
+		Tags []string `json:"tags"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&tagsResponse); err != nil {
+		return nil, err
+	}
+	if resp.Header.Get("Link") == "" {
+		return tagsResponse.Tags, io.EOF
+	}
+	return tagsResponse.Tags, nil
 }
 
 func (t *tags) Tag(ctx context.Context, tag string, desc distribution.Descriptor) error {
@@ -631,6 +685,53 @@ func (ms *manifests) Delete(ctx context.Context, dgst digest.Digest) error {
 	return HandleHTTPResponseError(resp)
 }
 
+// Referrers lists the manifests whose subject is the manifest subject, only
+// those of artifactType if it is not empty, with the referrers API. A
+// registry without the API has no referrers.
+func (ms *manifests) Referrers(ctx context.Context, subject digest.Digest, artifactType string) ([]v1.Descriptor, error) {
+	ref, err := reference.WithDigest(ms.name, subject)
+	if err != nil {
+		return nil, err
+	}
+	var values []url.Values
+	if artifactType != "" {
+		values = append(values, url.Values{"artifactType": []string{artifactType}})
+	}
+	u, err := ms.ub.BuildReferrersURL(ref, values...)
+	if err != nil {
+		return nil, err
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, u, nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Accept", v1.MediaTypeImageIndex)
+
+	resp, err := ms.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode == http.StatusNotFound {
+		return []v1.Descriptor{}, nil
+	}
+	if err := HandleHTTPResponseError(resp); err != nil {
+		return nil, err
+	}
+	var index v1.Index
+	if err := json.NewDecoder(io.LimitReader(resp.Body, maxReferrersSize)).Decode(&index); err != nil {
+		return nil, err
+	}
+	referrers := index.Manifests
+	if artifactType != "" && resp.Header.Get("OCI-Filters-Applied") != "artifactType" {
+		referrers = slices.DeleteFunc(referrers, func(desc v1.Descriptor) bool {
+			return desc.ArtifactType != artifactType
+		})
+	}
+	return referrers, nil
+}
+
 // todo(richardscothern): Restore interface and implementation with merge of #1050
 /*func (ms *manifests) Enumerate(ctx context.Context, manifests []distribution.Manifest, last distribution.Manifest) (n int, err error) {
 	panic("not supported")
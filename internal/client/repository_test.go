@@ -1574,6 +1574,39 @@ func TestObtainsManifestForTagWithoutHeaders(t *testing.T) {
 	}
 }
 
+func TestTagGetIfChanged(t *testing.T) {
+	repo, _ := reference.WithName("test.example.com/repo")
+	_, dgst, pl := newRandomOCIManifest(t, 6)
+	s := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if req.Header.Get("If-None-Match") == fmt.Sprintf(`"%s"`, dgst) {
+			w.WriteHeader(http.StatusNotModified)
+			return
+		}
+		w.Header().Set("Content-Type", v1.MediaTypeImageManifest)
+		w.Header().Set("Content-Length", fmt.Sprint(len(pl)))
+		w.Header().Set("Docker-Content-Digest", dgst.String())
+	}))
+	defer s.Close()
+
+	ctx := dcontext.Background()
+	r, err := NewRepository(repo, s.URL, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tagService := r.Tags(ctx).(*tags)
+
+	if _, err := tagService.GetIfChanged(ctx, "latest", dgst); err != distribution.ErrManifestNotModified {
+		t.Fatalf("expected the tag not to be modified, got %v", err)
+	}
+	desc, err := tagService.GetIfChanged(ctx, "latest", digest.FromString("previous"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if desc.Digest != dgst {
+		t.Fatalf("unexpected digest %s", desc.Digest)
+	}
+}
+
 func TestManifestTagsPaginated(t *testing.T) {
 	s := httptest.NewServer(http.NotFoundHandler())
 	defer s.Close()
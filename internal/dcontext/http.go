@@ -19,8 +19,17 @@ var (
 	ErrNoResponseWriterContext = errors.New("no http response in context")
 )
 
+// RequestIDHeader is the header of the request id, adopted from the request
+// if it is valid and returned in the response.
+const RequestIDHeader = "X-Request-Id"
+
+// maxRequestIDLength bounds the length of the request ids adopted from the
+// requests.
+const maxRequestIDLength = 128
+
 // WithRequest places the request on the context. The context of the request
-// is assigned a unique id, available at "http.request.id". The request itself
+// is assigned the id of its X-Request-Id header, or a unique id if it has no
+// valid one, available at "http.request.id". The request itself
 // is available at "http.request". Other common attributes are available under
 // the prefix "http.request.". If a request is already present on the context,
 // this method will panic.
@@ -35,11 +44,27 @@ func WithRequest(ctx context.Context, r *http.Request) context.Context {
 	return &httpRequestContext{
 		Context:   ctx,
 		startedAt: time.Now(),
-		id:        uuid.NewString(),
+		id:        requestID(r),
 		r:         r,
 	}
 }
 
+// requestID returns the id of the X-Request-Id header of the request, if it
+// is made of at most maxRequestIDLength printable characters other than
+// spaces, and a unique id otherwise.
+func requestID(r *http.Request) string {
+	id := r.Header.Get(RequestIDHeader)
+	if id == "" || len(id) > maxRequestIDLength {
+		return uuid.NewString()
+	}
+	for i := 0; i < len(id); i++ {
+		if id[i] <= ' ' || id[i] > '~' {
+			return uuid.NewString()
+		}
+	}
+	return id
+}
+
 // GetRequestID attempts to resolve the current request id, if possible. An
 // error is return if it is not available on the context.
 func GetRequestID(ctx context.Context) string {
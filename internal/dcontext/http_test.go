@@ -3,6 +3,7 @@ package dcontext
 import (
 	"net/http"
 	"reflect"
+	"strings"
 	"testing"
 	"time"
 )
@@ -92,6 +93,31 @@ func TestWithRequest(t *testing.T) {
 	}
 }
 
+func TestWithRequestID(t *testing.T) {
+	for _, tc := range []struct {
+		header  string
+		adopted bool
+	}{
+		{header: "", adopted: false},
+		{header: "4c9f7f8e-61ad-5480-9af8-3358aebbc788", adopted: true},
+		{header: "req:42/a.b_c", adopted: true},
+		{header: "with space", adopted: false},
+		{header: "forged\nline", adopted: false},
+		{header: strings.Repeat("a", maxRequestIDLength), adopted: true},
+		{header: strings.Repeat("a", maxRequestIDLength+1), adopted: false},
+	} {
+		req := &http.Request{Header: make(http.Header)}
+		req.Header.Set(RequestIDHeader, tc.header)
+		id := GetRequestID(WithRequest(Background(), req))
+		if id == "" {
+			t.Fatalf("no request id for header %q", tc.header)
+		}
+		if adopted := id == tc.header; adopted != tc.adopted {
+			t.Fatalf("unexpected request id %q for header %q", id, tc.header)
+		}
+	}
+}
+
 type testResponseWriter struct {
 	flushed bool
 	status  int
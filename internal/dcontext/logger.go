@@ -56,6 +56,13 @@ func WithLogger(ctx context.Context, logger Logger) context.Context {
 	return context.WithValue(ctx, loggerKey{}, logger)
 }
 
+// WithLogrusLogger returns a context whose logger writes with the logrus
+// logger, such as one logging at another level, keeping the fields of the
+// logger of the context.
+func WithLogrusLogger(ctx context.Context, logger *logrus.Logger) context.Context {
+	return WithLogger(ctx, logrus.NewEntry(logger).WithFields(getLogrusLogger(ctx).Data))
+}
+
 // GetLoggerWithField returns a logger instance with the specified field key
 // and value without affecting the context. Extra specified keys will be
 // resolved from the context.
@@ -55,6 +55,10 @@ type Manifest struct {
 	// MediaType is the media type of this schema.
 	MediaType string `json:"mediaType,omitempty"`
 
+	// ArtifactType is the type of the artifact, when the manifest is used
+	// for an artifact.
+	ArtifactType string `json:"artifactType,omitempty"`
+
 	// Config references the image configuration as a blob.
 	Config v1.Descriptor `json:"config"`
 
@@ -62,6 +66,9 @@ type Manifest struct {
 	// configuration.
 	Layers []v1.Descriptor `json:"layers"`
 
+	// Subject references the manifest this manifest refers to.
+	Subject *v1.Descriptor `json:"subject,omitempty"`
+
 	// Annotations contains arbitrary metadata for the image manifest.
 	Annotations map[string]string `json:"annotations,omitempty"`
 }
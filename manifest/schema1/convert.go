@@ -0,0 +1,192 @@
+package schema1
+
+import (
+	"bufio"
+	"compress/gzip"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+	"time"
+
+	"github.com/distribution/distribution/v3"
+	"github.com/distribution/distribution/v3/manifest/schema2"
+	"github.com/opencontainers/go-digest"
+	"github.com/opencontainers/image-spec/specs-go"
+	v1 "github.com/opencontainers/image-spec/specs-go/v1"
+)
+
+// v1Image holds the fields of the v1Compatibility image configurations read
+// to convert the manifests.
+type v1Image struct {
+	ID              string    `json:"id"`
+	Parent          string    `json:"parent,omitempty"`
+	Created         time.Time `json:"created"`
+	Author          string    `json:"author,omitempty"`
+	Comment         string    `json:"comment,omitempty"`
+	ThrowAway       bool      `json:"throwaway,omitempty"`
+	ContainerConfig struct {
+		Cmd []string `json:"Cmd"`
+	} `json:"container_config"`
+}
+
+// v1OnlyFields are the fields of the v1Compatibility image configurations
+// which the image configurations converted do not keep.
+var v1OnlyFields = []string{"id", "parent", "Size", "parent_id", "layer_id", "throwaway"}
+
+// Convert converts the schema1 manifest to a schema2 manifest, listing its
+// layers from the base layer of the image up, and returns the image
+// configuration it references. The configuration is the v1Compatibility
+// configuration of the top layer, with the history of the layers and the
+// diff ids of the layers read from blobs. The layers marked as throwaway only
+// appear as empty layers of the history.
+func Convert(ctx context.Context, m *DeserializedManifest, blobs distribution.BlobProvider) (*schema2.DeserializedManifest, []byte, error) {
+	fsLayers, history, images, err := layers(m.Manifest)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	var (
+		descriptors []v1.Descriptor
+		diffIDs     []digest.Digest
+		entries     []v1.History
+	)
+	for i := len(images) - 1; i >= 0; i-- {
+		image := images[i]
+		created := image.Created
+		entries = append(entries, v1.History{
+			Created:    &created,
+			CreatedBy:  strings.Join(image.ContainerConfig.Cmd, " "),
+			Author:     image.Author,
+			Comment:    image.Comment,
+			EmptyLayer: image.ThrowAway,
+		})
+		if image.ThrowAway {
+			continue
+		}
+		desc, diffID, err := diffID(ctx, blobs, fsLayers[i].BlobSum)
+		if err != nil {
+			return nil, nil, err
+		}
+		descriptors = append(descriptors, desc)
+		diffIDs = append(diffIDs, diffID)
+	}
+
+	var config map[string]json.RawMessage
+	if err := json.Unmarshal([]byte(history[0].V1Compatibility), &config); err != nil {
+		return nil, nil, fmt.Errorf("invalid v1Compatibility of the top layer: %w", err)
+	}
+	for _, field := range v1OnlyFields {
+		delete(config, field)
+	}
+	if config["rootfs"], err = json.Marshal(v1.RootFS{Type: "layers", DiffIDs: diffIDs}); err != nil {
+		return nil, nil, err
+	}
+	if config["history"], err = json.Marshal(entries); err != nil {
+		return nil, nil, err
+	}
+	configJSON, err := json.Marshal(config)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	converted, err := schema2.FromStruct(schema2.Manifest{
+		Versioned: specs.Versioned{SchemaVersion: 2},
+		MediaType: schema2.MediaTypeManifest,
+		Config: v1.Descriptor{
+			MediaType: schema2.MediaTypeImageConfig,
+			Digest:    digest.FromBytes(configJSON),
+			Size:      int64(len(configJSON)),
+		},
+		Layers: descriptors,
+	})
+	if err != nil {
+		return nil, nil, err
+	}
+	return converted, configJSON, nil
+}
+
+// layers returns the layers and history of the manifest with the v1
+// configurations of its layers, without the layers listed twice in a row,
+// after checking that each layer is the parent of the one above it.
+func layers(m Manifest) ([]FSLayer, []History, []v1Image, error) {
+	fsLayers := append([]FSLayer(nil), m.FSLayers...)
+	history := append([]History(nil), m.History...)
+	images := make([]v1Image, len(history))
+	for i, h := range history {
+		if err := json.Unmarshal([]byte(h.V1Compatibility), &images[i]); err != nil {
+			return nil, nil, nil, fmt.Errorf("invalid v1Compatibility of layer %d: %w", i, err)
+		}
+		if images[i].ID == "" {
+			return nil, nil, nil, fmt.Errorf("no id in the v1Compatibility of layer %d", i)
+		}
+	}
+
+	// The old clients pushed some layers twice in a row, with the same id.
+	for i := len(images) - 2; i >= 0; i-- {
+		if images[i].ID == images[i+1].ID {
+			fsLayers = append(fsLayers[:i], fsLayers[i+1:]...)
+			history = append(history[:i], history[i+1:]...)
+			images = append(images[:i], images[i+1:]...)
+		}
+	}
+	for i := range len(images) - 1 {
+		if images[i].Parent != images[i+1].ID {
+			return nil, nil, nil, fmt.Errorf("invalid parent %q of layer %s", images[i].Parent, images[i].ID)
+		}
+	}
+	if base := images[len(images)-1]; base.Parent != "" {
+		return nil, nil, nil, fmt.Errorf("invalid parent %q of base layer %s", base.Parent, base.ID)
+	}
+	return fsLayers, history, images, nil
+}
+
+// diffID returns the descriptor of a layer and the digest of its
+// uncompressed content.
+func diffID(ctx context.Context, blobs distribution.BlobProvider, dgst digest.Digest) (v1.Descriptor, digest.Digest, error) {
+	rc, err := blobs.Open(ctx, dgst)
+	if err != nil {
+		if errors.Is(err, distribution.ErrBlobUnknown) {
+			return v1.Descriptor{}, "", distribution.ErrManifestBlobUnknown{Digest: dgst}
+		}
+		return v1.Descriptor{}, "", err
+	}
+	defer rc.Close()
+
+	counter := &countingReader{r: rc}
+	br := bufio.NewReader(counter)
+	mediaType := schema2.MediaTypeUncompressedLayer
+	var content io.Reader = br
+	if magic, err := br.Peek(2); err == nil && magic[0] == 0x1f && magic[1] == 0x8b {
+		zr, err := gzip.NewReader(br)
+		if err != nil {
+			return v1.Descriptor{}, "", fmt.Errorf("invalid layer %s: %w", dgst, err)
+		}
+		defer zr.Close()
+		mediaType = schema2.MediaTypeLayer
+		content = zr
+	}
+	digester := digest.Canonical.Digester()
+	if _, err := io.Copy(digester.Hash(), content); err != nil {
+		return v1.Descriptor{}, "", fmt.Errorf("invalid layer %s: %w", dgst, err)
+	}
+	// Read what follows the compressed stream, to size the blob.
+	if _, err := io.Copy(io.Discard, br); err != nil {
+		return v1.Descriptor{}, "", err
+	}
+	return v1.Descriptor{MediaType: mediaType, Digest: dgst, Size: counter.n}, digester.Digest(), nil
+}
+
+// countingReader counts the bytes read from r.
+type countingReader struct {
+	r io.Reader
+	n int64
+}
+
+func (cr *countingReader) Read(p []byte) (int, error) {
+	n, err := cr.r.Read(p)
+	cr.n += int64(n)
+	return n, err
+}
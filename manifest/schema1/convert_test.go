@@ -0,0 +1,200 @@
+package schema1
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/distribution/distribution/v3"
+	"github.com/distribution/distribution/v3/manifest/schema2"
+	"github.com/opencontainers/go-digest"
+)
+
+// testBlobs provides the layer blobs of the fixtures.
+type testBlobs map[digest.Digest][]byte
+
+func (tb testBlobs) Get(ctx context.Context, dgst digest.Digest) ([]byte, error) {
+	p, ok := tb[dgst]
+	if !ok {
+		return nil, distribution.ErrBlobUnknown
+	}
+	return p, nil
+}
+
+func (tb testBlobs) Open(ctx context.Context, dgst digest.Digest) (io.ReadSeekCloser, error) {
+	p, err := tb.Get(ctx, dgst)
+	if err != nil {
+		return nil, err
+	}
+	return nopCloser{bytes.NewReader(p)}, nil
+}
+
+type nopCloser struct {
+	io.ReadSeeker
+}
+
+func (nopCloser) Close() error { return nil }
+
+func fixtureBlobs(t *testing.T) testBlobs {
+	blobs := testBlobs{}
+	for _, name := range []string{"base.tar.gz", "motd.tar.gz"} {
+		p := readFixture(t, name)
+		blobs[digest.FromBytes(p)] = p
+	}
+	return blobs
+}
+
+func unmarshalFixture(t *testing.T, name string) *DeserializedManifest {
+	t.Helper()
+	var m DeserializedManifest
+	if err := m.UnmarshalJSON(readFixture(t, name)); err != nil {
+		t.Fatal(err)
+	}
+	return &m
+}
+
+// TestConvert compares the conversion of the fixtures with the schema2
+// manifest and image configuration expected. The diff ids of the
+// configuration are the digests of the uncompressed layers, its history
+// lists the layers from the base layer up, with the throwaway layer empty and
+// the layer listed twice only once.
+func TestConvert(t *testing.T) {
+	for _, fixture := range []string{"schema1.json", "schema1-signed.json"} {
+		t.Run(fixture, func(t *testing.T) {
+			converted, config, err := Convert(context.Background(), unmarshalFixture(t, fixture), fixtureBlobs(t))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if expected := readFixture(t, "config.json"); !bytes.Equal(config, expected) {
+				t.Fatalf("unexpected image configuration:\n%s\nexpected:\n%s", config, expected)
+			}
+			mediaType, payload, err := converted.Payload()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if mediaType != schema2.MediaTypeManifest {
+				t.Fatalf("unexpected media type %s", mediaType)
+			}
+			if expected := readFixture(t, "schema2.json"); !bytes.Equal(payload, expected) {
+				t.Fatalf("unexpected manifest:\n%s\nexpected:\n%s", payload, expected)
+			}
+			if converted.Config.Digest != digest.FromBytes(config) {
+				t.Fatalf("the manifest references %s, not its configuration", converted.Config.Digest)
+			}
+		})
+	}
+}
+
+// editFixture returns the unsigned fixture with its decoded v1Compatibility
+// configurations edited.
+func editFixture(t *testing.T, edit func(images []map[string]any)) *DeserializedManifest {
+	m := unmarshalFixture(t, "schema1.json").Manifest
+	images := make([]map[string]any, len(m.History))
+	for i, h := range m.History {
+		if err := json.Unmarshal([]byte(h.V1Compatibility), &images[i]); err != nil {
+			t.Fatal(err)
+		}
+	}
+	edit(images)
+	for i, image := range images {
+		p, err := json.Marshal(image)
+		if err != nil {
+			t.Fatal(err)
+		}
+		m.History[i].V1Compatibility = string(p)
+	}
+	p, err := json.Marshal(m)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var edited DeserializedManifest
+	if err := edited.UnmarshalJSON(p); err != nil {
+		t.Fatal(err)
+	}
+	return &edited
+}
+
+func TestConvertInvalid(t *testing.T) {
+	for _, tc := range []struct {
+		name string
+		edit func(images []map[string]any)
+		err  string
+	}{
+		{
+			name: "parent",
+			edit: func(images []map[string]any) { images[0]["parent"] = "0000" },
+			err:  `invalid parent "0000"`,
+		},
+		{
+			name: "base parent",
+			edit: func(images []map[string]any) { images[3]["parent"] = "0000" },
+			err:  `invalid parent "0000" of base layer`,
+		},
+		{
+			name: "id",
+			edit: func(images []map[string]any) { delete(images[1], "id") },
+			err:  "no id",
+		},
+		{
+			name: "created",
+			edit: func(images []map[string]any) { images[1]["created"] = "yesterday" },
+			err:  "invalid v1Compatibility of layer 1",
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			_, _, err := Convert(context.Background(), editFixture(t, tc.edit), fixtureBlobs(t))
+			if err == nil || !strings.Contains(err.Error(), tc.err) {
+				t.Fatalf("expected an error containing %q, got %v", tc.err, err)
+			}
+		})
+	}
+}
+
+func TestConvertBlobUnknown(t *testing.T) {
+	blobs := fixtureBlobs(t)
+	base := digest.FromBytes(readFixture(t, "base.tar.gz"))
+	delete(blobs, base)
+	_, _, err := Convert(context.Background(), unmarshalFixture(t, "schema1.json"), blobs)
+	var unknown distribution.ErrManifestBlobUnknown
+	if !errors.As(err, &unknown) || unknown.Digest != base {
+		t.Fatalf("expected the base layer to be unknown, got %v", err)
+	}
+}
+
+// TestConvertUncompressed checks that the uncompressed layers are identified
+// by their digest.
+func TestConvertUncompressed(t *testing.T) {
+	layer := []byte(strings.Repeat("\x00", 1024))
+	blobs := testBlobs{digest.FromBytes(layer): layer}
+	var m DeserializedManifest
+	if err := m.UnmarshalJSON([]byte(`{
+   "schemaVersion": 1,
+   "fsLayers": [{"blobSum": "` + digest.FromBytes(layer).String() + `"}],
+   "history": [{"v1Compatibility": "{\"id\":\"a1\",\"created\":\"2017-05-01T10:02:01Z\"}"}]
+}`)); err != nil {
+		t.Fatal(err)
+	}
+	converted, config, err := Convert(context.Background(), &m, blobs)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(converted.Layers) != 1 || converted.Layers[0].MediaType != schema2.MediaTypeUncompressedLayer || converted.Layers[0].Size != int64(len(layer)) {
+		t.Fatalf("unexpected layers %v", converted.Layers)
+	}
+	var image struct {
+		RootFS struct {
+			DiffIDs []digest.Digest `json:"diff_ids"`
+		} `json:"rootfs"`
+	}
+	if err := json.Unmarshal(config, &image); err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(image.RootFS.DiffIDs, []digest.Digest{digest.FromBytes(layer)}) {
+		t.Fatalf("unexpected diff ids %v", image.RootFS.DiffIDs)
+	}
+}
@@ -0,0 +1,210 @@
+// Package schema1 reads the schema1 manifests of the old Docker clients,
+// which the registry does not store, to refuse them or convert them to
+// schema2 manifests.
+package schema1
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+
+	"github.com/distribution/distribution/v3"
+	"github.com/distribution/distribution/v3/manifest/schema2"
+	"github.com/opencontainers/go-digest"
+	"github.com/opencontainers/image-spec/specs-go"
+	v1 "github.com/opencontainers/image-spec/specs-go/v1"
+)
+
+const (
+	// MediaTypeManifest specifies the mediaType of the unsigned schema1
+	// manifests.
+	MediaTypeManifest = "application/vnd.docker.distribution.manifest.v1+json"
+
+	// MediaTypeSignedManifest specifies the mediaType of the signed schema1
+	// manifests, in the JWS JSON serialization.
+	MediaTypeSignedManifest = "application/vnd.docker.distribution.manifest.v1+prettyjws"
+
+	// MediaTypeManifestLayer specifies the mediaType of the layers of the
+	// schema1 manifests.
+	MediaTypeManifestLayer = "application/vnd.docker.container.image.rootfs.diff+x-gtar"
+)
+
+func init() {
+	for _, mediaType := range []string{MediaTypeManifest, MediaTypeSignedManifest} {
+		if err := distribution.RegisterManifestSchema(mediaType, unmarshalSchema1); err != nil {
+			panic(fmt.Sprintf("Unable to register manifest: %s", err))
+		}
+	}
+}
+
+func unmarshalSchema1(b []byte) (distribution.Manifest, v1.Descriptor, error) {
+	m := &DeserializedManifest{}
+	if err := m.UnmarshalJSON(b); err != nil {
+		return nil, v1.Descriptor{}, err
+	}
+	mediaType, _, _ := m.Payload()
+	return m, v1.Descriptor{
+		Digest:    digest.FromBytes(m.payload),
+		Size:      int64(len(b)),
+		MediaType: mediaType,
+	}, nil
+}
+
+// IsMediaType reports whether mediaType is the media type of a schema1
+// manifest.
+func IsMediaType(mediaType string) bool {
+	return mediaType == MediaTypeManifest || mediaType == MediaTypeSignedManifest
+}
+
+// RejectedError refuses a schema1 manifest, naming the media types to use
+// instead.
+type RejectedError struct {
+	// MediaType is the media type of the manifest refused.
+	MediaType string
+}
+
+func (e RejectedError) Error() string {
+	return fmt.Sprintf("schema1 manifests (%s) are not supported: push the image again as a Docker schema2 (%s) or OCI (%s) manifest", e.MediaType, schema2.MediaTypeManifest, v1.MediaTypeImageManifest)
+}
+
+// FSLayer is a layer of a schema1 manifest.
+type FSLayer struct {
+	// BlobSum is the digest of the layer blob.
+	BlobSum digest.Digest `json:"blobSum"`
+}
+
+// History is the entry of the history of a schema1 manifest for a layer.
+type History struct {
+	// V1Compatibility is the image configuration of the layer, in the format
+	// of the v1 registries.
+	V1Compatibility string `json:"v1Compatibility"`
+}
+
+// Manifest defines a schema1 manifest. Its layers and history are listed
+// from the top layer of the image down to its base layer.
+type Manifest struct {
+	specs.Versioned
+
+	// Name is the name of the image's repository.
+	Name string `json:"name"`
+
+	// Tag is the tag of the image.
+	Tag string `json:"tag"`
+
+	// Architecture is the host architecture on which the image runs.
+	Architecture string `json:"architecture"`
+
+	// FSLayers lists the layers of the image.
+	FSLayers []FSLayer `json:"fsLayers"`
+
+	// History lists the image configurations of the layers.
+	History []History `json:"history"`
+}
+
+// References returns the descriptors of the layers of the manifest, from the
+// base layer of the image up.
+func (m Manifest) References() []v1.Descriptor {
+	references := make([]v1.Descriptor, 0, len(m.FSLayers))
+	for i := len(m.FSLayers) - 1; i >= 0; i-- {
+		references = append(references, v1.Descriptor{
+			MediaType: MediaTypeManifestLayer,
+			Digest:    m.FSLayers[i].BlobSum,
+		})
+	}
+	return references
+}
+
+// DeserializedManifest wraps Manifest with a copy of the original JSON. It
+// satisfies the distribution.Manifest interface.
+type DeserializedManifest struct {
+	Manifest
+
+	// all is the manifest received, with its signatures if it is signed.
+	all []byte
+	// payload is the manifest without its signatures, whose digest
+	// identifies the manifest.
+	payload []byte
+	signed  bool
+}
+
+// UnmarshalJSON populates a new Manifest struct from JSON data.
+func (m *DeserializedManifest) UnmarshalJSON(b []byte) error {
+	var mfst struct {
+		Manifest
+		Signatures []struct {
+			Protected string `json:"protected"`
+		} `json:"signatures"`
+	}
+	if err := json.Unmarshal(b, &mfst); err != nil {
+		return err
+	}
+	if mfst.SchemaVersion != 1 {
+		return fmt.Errorf("schemaVersion in manifest should be 1 not %d", mfst.SchemaVersion)
+	}
+	if len(mfst.FSLayers) != len(mfst.History) {
+		return fmt.Errorf("manifest has %d layers but %d history entries", len(mfst.FSLayers), len(mfst.History))
+	}
+	if len(mfst.FSLayers) == 0 {
+		return errors.New("manifest has no layers")
+	}
+
+	m.all = make([]byte, len(b))
+	copy(m.all, b)
+	m.payload = m.all
+	m.signed = len(mfst.Signatures) > 0
+	if m.signed {
+		payload, err := signedPayload(m.all, mfst.Signatures[0].Protected)
+		if err != nil {
+			return err
+		}
+		m.payload = payload
+	}
+	m.Manifest = mfst.Manifest
+	return nil
+}
+
+// signedPayload returns the payload of a signed manifest: its content up to
+// the signatures, closed by the tail which the protected header of its
+// signatures records.
+func signedPayload(b []byte, protected string) ([]byte, error) {
+	header, err := base64.RawURLEncoding.DecodeString(protected)
+	if err != nil {
+		return nil, fmt.Errorf("invalid protected header of the manifest signature: %w", err)
+	}
+	var format struct {
+		FormatLength int    `json:"formatLength"`
+		FormatTail   string `json:"formatTail"`
+	}
+	if err := json.Unmarshal(header, &format); err != nil {
+		return nil, fmt.Errorf("invalid protected header of the manifest signature: %w", err)
+	}
+	tail, err := base64.RawURLEncoding.DecodeString(format.FormatTail)
+	if err != nil {
+		return nil, fmt.Errorf("invalid format tail of the manifest signature: %w", err)
+	}
+	if format.FormatLength <= 0 || format.FormatLength > len(b) {
+		return nil, fmt.Errorf("invalid format length %d of the manifest signature", format.FormatLength)
+	}
+	payload := make([]byte, 0, format.FormatLength+len(tail))
+	payload = append(payload, b[:format.FormatLength]...)
+	return append(payload, tail...), nil
+}
+
+// MarshalJSON returns the manifest received.
+func (m *DeserializedManifest) MarshalJSON() ([]byte, error) {
+	if len(m.all) > 0 {
+		return m.all, nil
+	}
+
+	return nil, errors.New("JSON representation not initialized in DeserializedManifest")
+}
+
+// Payload returns the manifest received, with its signatures if it is
+// signed.
+func (m DeserializedManifest) Payload() (string, []byte, error) {
+	if m.signed {
+		return MediaTypeSignedManifest, m.all, nil
+	}
+	return MediaTypeManifest, m.all, nil
+}
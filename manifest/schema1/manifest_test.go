@@ -0,0 +1,72 @@
+package schema1
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/distribution/distribution/v3"
+	"github.com/opencontainers/go-digest"
+)
+
+func readFixture(t *testing.T, name string) []byte {
+	t.Helper()
+	p, err := os.ReadFile(filepath.Join("testdata", name))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return p
+}
+
+func TestUnmarshal(t *testing.T) {
+	unsigned := readFixture(t, "schema1.json")
+	for _, tc := range []struct {
+		fixture, mediaType string
+	}{
+		{"schema1.json", MediaTypeManifest},
+		{"schema1-signed.json", MediaTypeSignedManifest},
+	} {
+		t.Run(tc.fixture, func(t *testing.T) {
+			p := readFixture(t, tc.fixture)
+			m, desc, err := distribution.UnmarshalManifest(tc.mediaType, p)
+			if err != nil {
+				t.Fatal(err)
+			}
+			// The signed manifests are identified by their payload, without
+			// their signatures.
+			if desc.Digest != digest.FromBytes(unsigned) || desc.Size != int64(len(p)) || desc.MediaType != tc.mediaType {
+				t.Fatalf("unexpected descriptor %#v", desc)
+			}
+			mediaType, payload, err := m.Payload()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if mediaType != tc.mediaType || string(payload) != string(p) {
+				t.Fatalf("unexpected payload of media type %s", mediaType)
+			}
+			mfst := m.(*DeserializedManifest)
+			if mfst.Name != "library/motd" || mfst.Tag != "latest" || len(mfst.FSLayers) != 4 || len(mfst.History) != 4 {
+				t.Fatalf("unexpected manifest %#v", mfst.Manifest)
+			}
+			references := m.References()
+			if len(references) != 4 || references[0].Digest != mfst.FSLayers[3].BlobSum || references[3].Digest != mfst.FSLayers[0].BlobSum {
+				t.Fatalf("unexpected references %v", references)
+			}
+		})
+	}
+}
+
+func TestUnmarshalInvalid(t *testing.T) {
+	for name, p := range map[string]string{
+		"schema version":    `{"schemaVersion": 2, "fsLayers": [{"blobSum": "sha256:a3ed95caeb02ffe68cdd9fd84406680ae93d633cb16422d00e8a7c22955b46d4"}], "history": [{"v1Compatibility": "{}"}]}`,
+		"no layers":         `{"schemaVersion": 1, "fsLayers": [], "history": []}`,
+		"history mismatch":  `{"schemaVersion": 1, "fsLayers": [{"blobSum": "sha256:a3ed95caeb02ffe68cdd9fd84406680ae93d633cb16422d00e8a7c22955b46d4"}], "history": []}`,
+		"protected header":  `{"schemaVersion": 1, "fsLayers": [{"blobSum": "sha256:a3ed95caeb02ffe68cdd9fd84406680ae93d633cb16422d00e8a7c22955b46d4"}], "history": [{"v1Compatibility": "{}"}], "signatures": [{"protected": "!"}]}`,
+		"format length":     `{"schemaVersion": 1, "fsLayers": [{"blobSum": "sha256:a3ed95caeb02ffe68cdd9fd84406680ae93d633cb16422d00e8a7c22955b46d4"}], "history": [{"v1Compatibility": "{}"}], "signatures": [{"protected": "eyJmb3JtYXRMZW5ndGgiOjEwMDAwMCwiZm9ybWF0VGFpbCI6IkNuMCJ9"}]}`,
+		"malformed content": `{"schemaVersion": 1, "fsLayers": {}}`,
+	} {
+		if _, _, err := distribution.UnmarshalManifest(MediaTypeSignedManifest, []byte(p)); err == nil {
+			t.Errorf("%s: expected an error", name)
+		}
+	}
+}
@@ -49,6 +49,14 @@ type ManifestEnumerator interface {
 	Enumerate(ctx context.Context, ingester func(digest.Digest) error) error
 }
 
+// ReferrersLister is a ManifestService listing the manifests whose subject is
+// a manifest.
+type ReferrersLister interface {
+	// Referrers returns the descriptors of the manifests whose subject is
+	// the manifest subject, only those of artifactType if it is not empty.
+	Referrers(ctx context.Context, subject digest.Digest, artifactType string) ([]v1.Descriptor, error)
+}
+
 // Describable is an interface for descriptors.
 //
 // Implementations of Describable are generally objects which can be
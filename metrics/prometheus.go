@@ -16,4 +16,13 @@ var (
 
 	// ProxyNamespace is the prometheus namespace of proxy related metrics
 	ProxyNamespace = metrics.NewNamespace(NamespacePrefix, "proxy", nil)
+
+	// ReplicationNamespace is the prometheus namespace of the replication to peer registries
+	ReplicationNamespace = metrics.NewNamespace(NamespacePrefix, "replication", nil)
+
+	// AccessNamespace is the prometheus namespace of access control related metrics
+	AccessNamespace = metrics.NewNamespace(NamespacePrefix, "access", nil)
+
+	// StatsNamespace is the prometheus namespace of the statistics of the repositories
+	StatsNamespace = metrics.NewNamespace(NamespacePrefix, "stats", nil)
 )
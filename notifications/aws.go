@@ -0,0 +1,434 @@
+package notifications
+
+import (
+	"context"
+	"encoding/json"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/arn"
+	"github.com/aws/aws-sdk-go/aws/credentials"
+	"github.com/aws/aws-sdk-go/aws/credentials/stscreds"
+	awsendpoints "github.com/aws/aws-sdk-go/aws/endpoints"
+	"github.com/aws/aws-sdk-go/aws/session"
+	v4 "github.com/aws/aws-sdk-go/aws/signer/v4"
+	"github.com/distribution/distribution/v3/configuration"
+	events "github.com/docker/go-events"
+	"github.com/sirupsen/logrus"
+)
+
+// Types of the AWS endpoints.
+const (
+	EndpointTypeSQS = "sqs"
+	EndpointTypeSNS = "sns"
+)
+
+const (
+	// awsBatchSize is the maximum number of messages of a batch, for both
+	// SendMessageBatch and PublishBatch.
+	awsBatchSize = 10
+	// awsMaxMessageSize is the maximum size of a message, and of the
+	// messages of a batch, with their attributes.
+	awsMaxMessageSize = 256 * 1024
+)
+
+// ErrMessageTooLarge is reported for events too large to be published to an
+// SQS queue or SNS topic. They are dropped rather than retried.
+var ErrMessageTooLarge = errors.New("message too large")
+
+// NewAWSEndpoint returns a running endpoint publishing events to the SQS
+// queue, by URL or ARN, or to the SNS topic, by ARN, of the target.
+//
+// The AWS credentials are not part of the EndpointConfig, which is exported
+// with the metrics of the endpoint.
+func NewAWSEndpoint(name, endpointType, target string, config EndpointConfig, awsConfig configuration.AWSEndpoint) (*Endpoint, error) {
+	endpoint := newEndpoint(name, target, config)
+	publisher, err := newAWSQueryClient(endpointType, target, awsConfig, &http.Client{
+		Transport: endpoint.Transport,
+		Timeout:   endpoint.Timeout,
+	})
+	if err != nil {
+		return nil, fmt.Errorf("notifications: endpoint %s: %v", name, err)
+	}
+
+	endpoint.run(newAWSSink(publisher, target, endpoint.metrics.httpStatusListener()), awsBatchSize, 1)
+	return endpoint, nil
+}
+
+// awsMessage is a message published to an SQS queue or SNS topic.
+type awsMessage struct {
+	// id identifies the message in its batch.
+	id   string
+	body string
+	// attributes are string message attributes.
+	attributes map[string]string
+	// groupID and deduplicationID are only set for FIFO queues and topics.
+	groupID         string
+	deduplicationID string
+}
+
+func (m awsMessage) size() int {
+	size := len(m.body)
+	for name, value := range m.attributes {
+		size += len(name) + len(value) + len("String")
+	}
+	return size
+}
+
+// awsBatchFailure is a message of a batch which was not published.
+type awsBatchFailure struct {
+	ID          string `xml:"Id"`
+	Code        string `xml:"Code"`
+	Message     string `xml:"Message"`
+	SenderFault bool   `xml:"SenderFault"`
+}
+
+// awsPublisher publishes batches of messages to an SQS queue or SNS topic.
+type awsPublisher interface {
+	// publishBatch returns the HTTP status of the response and the messages
+	// which were not published, or an error if the batch was not accepted.
+	publishBatch(ctx context.Context, messages []awsMessage) (int, []awsBatchFailure, error)
+}
+
+// awsSink publishes events to an SQS queue or SNS topic, one message for each
+// event, with the envelope of the event as body. Batches are published with
+// as few requests as possible.
+type awsSink struct {
+	publisher awsPublisher
+	target    string
+	fifo      bool
+	listeners []httpStatusListener
+	mu        sync.Mutex
+	closed    bool
+}
+
+func newAWSSink(publisher awsPublisher, target string, listeners ...httpStatusListener) *awsSink {
+	return &awsSink{
+		publisher: publisher,
+		target:    target,
+		fifo:      strings.HasSuffix(target, ".fifo"),
+		listeners: listeners,
+	}
+}
+
+// Write publishes the event, or the events of an *eventBatch. The events of
+// a batch which are published, or too large to ever be, are removed from it,
+// and an error is returned if any is left to retry.
+func (s *awsSink) Write(event events.Event) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.closed {
+		return ErrSinkClosed
+	}
+
+	batch, ok := event.(*eventBatch)
+	if !ok {
+		batch = &eventBatch{events: []events.Event{event}}
+	}
+
+	var (
+		pending  []events.Event
+		messages []awsMessage
+	)
+	for _, event := range batch.events {
+		message, err := s.message(event, len(messages))
+		if err != nil {
+			logrus.Errorf("%v: dropping event: %v", s, err)
+			for _, listener := range s.listeners {
+				listener.err(err, event)
+			}
+			continue
+		}
+		pending = append(pending, event)
+		messages = append(messages, message)
+	}
+
+	var failed []events.Event
+	for start := 0; start < len(messages); {
+		end, size := start, 0
+		for end < len(messages) && end-start < awsBatchSize && size+messages[end].size() <= awsMaxMessageSize {
+			size += messages[end].size()
+			end++
+		}
+
+		status, failures, err := s.publisher.publishBatch(context.Background(), messages[start:end])
+		if err != nil {
+			for _, event := range pending[start:end] {
+				for _, listener := range s.listeners {
+					if status == 0 {
+						listener.err(err, event)
+					} else {
+						listener.failure(status, event)
+					}
+				}
+			}
+			batch.events = append(failed, pending[start:]...)
+			return fmt.Errorf("%v: error publishing %d events: %v", s, len(batch.events), err)
+		}
+
+		failedIDs := make(map[string]awsBatchFailure, len(failures))
+		for _, failure := range failures {
+			failedIDs[failure.ID] = failure
+		}
+		for i := start; i < end; i++ {
+			failure, ok := failedIDs[messages[i].id]
+			if !ok {
+				for _, listener := range s.listeners {
+					listener.success(status, pending[i])
+				}
+				continue
+			}
+			logrus.Warnf("%v: error publishing event: %s: %s", s, failure.Code, failure.Message)
+			failureStatus := http.StatusInternalServerError
+			if failure.SenderFault {
+				failureStatus = http.StatusBadRequest
+			}
+			for _, listener := range s.listeners {
+				listener.failure(failureStatus, pending[i])
+			}
+			failed = append(failed, pending[i])
+		}
+		start = end
+	}
+
+	batch.events = failed
+	if len(failed) > 0 {
+		return fmt.Errorf("%v: %d events of the batch were not published", s, len(failed))
+	}
+	return nil
+}
+
+// message returns the message of the event, with the index of the event in
+// the batch as ID.
+func (s *awsSink) message(event events.Event, index int) (awsMessage, error) {
+	body, err := json.Marshal(Envelope{Events: []events.Event{event}})
+	if err != nil {
+		return awsMessage{}, fmt.Errorf("error marshaling event envelope: %v", err)
+	}
+
+	message := awsMessage{
+		id:         strconv.Itoa(index),
+		body:       string(body),
+		attributes: map[string]string{},
+	}
+	if e, ok := event.(Event); ok {
+		if e.Action != "" {
+			message.attributes["action"] = e.Action
+		}
+		if e.Target.Repository != "" {
+			message.attributes["repository"] = e.Target.Repository
+		}
+		if s.fifo {
+			// Events of a repository are delivered in order.
+			message.groupID = e.Target.Repository
+			if message.groupID == "" {
+				message.groupID = "registry"
+			}
+			message.deduplicationID = e.ID
+		}
+	}
+	if size := message.size(); size > awsMaxMessageSize {
+		return awsMessage{}, fmt.Errorf("%w: %d bytes", ErrMessageTooLarge, size)
+	}
+	return message, nil
+}
+
+// Close the sink to further writes.
+func (s *awsSink) Close() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.closed {
+		return fmt.Errorf("awssink: already closed")
+	}
+
+	s.closed = true
+	return nil
+}
+
+func (s *awsSink) String() string {
+	return fmt.Sprintf("awsSink{%s}", s.target)
+}
+
+// awsQueryClient publishes batches of messages with the query API of SQS or
+// SNS, signed with the credentials of the endpoint.
+type awsQueryClient struct {
+	service string
+	region  string
+	// url is the URL requests are posted to.
+	url string
+	// params are the parameters of every request, such as the queue or
+	// topic.
+	params url.Values
+	signer *v4.Signer
+	client *http.Client
+}
+
+// sqsURLPattern matches SQS queue URLs, capturing the region.
+var sqsURLPattern = regexp.MustCompile(`^(?:sqs\.([^.]+)\.amazonaws\.com(?:\.cn)?|([^.]+)\.queue\.amazonaws\.com(?:\.cn)?)$`)
+
+func newAWSQueryClient(service, target string, config configuration.AWSEndpoint, client *http.Client) (*awsQueryClient, error) {
+	c := &awsQueryClient{service: service, region: config.Region, client: client}
+
+	// The target is an ARN, or the URL of an SQS queue.
+	parsed, err := arn.Parse(target)
+	isARN := err == nil
+	switch {
+	case isARN && parsed.Service != service:
+		return nil, fmt.Errorf("%s endpoint requires an %s ARN: %s", service, service, target)
+	case isARN && c.region == "":
+		c.region = parsed.Region
+	case !isARN && service == EndpointTypeSNS:
+		return nil, fmt.Errorf("sns endpoint requires a topic ARN: %s", target)
+	case !isARN && service == EndpointTypeSQS:
+		u, err := url.Parse(target)
+		if err != nil || u.Scheme == "" || u.Host == "" {
+			return nil, fmt.Errorf("sqs endpoint requires a queue URL or ARN: %s", target)
+		}
+		if matches := sqsURLPattern.FindStringSubmatch(u.Hostname()); c.region == "" && matches != nil {
+			c.region = matches[1] + matches[2]
+		}
+	}
+	if c.region == "" {
+		return nil, fmt.Errorf("%s endpoint requires a region: %s", service, target)
+	}
+
+	apiURL := config.Endpoint
+	if apiURL == "" {
+		resolved, err := awsendpoints.DefaultResolver().EndpointFor(service, c.region)
+		if err != nil {
+			return nil, err
+		}
+		apiURL = resolved.URL
+	}
+
+	switch service {
+	case EndpointTypeSQS:
+		queueURL := target
+		if isARN {
+			queueURL = strings.TrimSuffix(apiURL, "/") + "/" + parsed.AccountID + "/" + parsed.Resource
+		}
+		c.url = queueURL
+		c.params = url.Values{"Action": {"SendMessageBatch"}, "Version": {"2012-11-05"}, "QueueUrl": {queueURL}}
+	case EndpointTypeSNS:
+		c.url = apiURL
+		c.params = url.Values{"Action": {"PublishBatch"}, "Version": {"2010-03-31"}, "TopicArn": {target}}
+	default:
+		return nil, fmt.Errorf("unknown aws endpoint type %q", service)
+	}
+
+	awsConfig := aws.NewConfig().WithRegion(c.region)
+	if config.AccessKeyID != "" && config.SecretAccessKey != "" {
+		awsConfig = awsConfig.WithCredentials(credentials.NewStaticCredentials(config.AccessKeyID, config.SecretAccessKey, config.SessionToken))
+	}
+	sess, err := session.NewSession(awsConfig)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create AWS session: %v", err)
+	}
+	creds := sess.Config.Credentials
+	if config.RoleARN != "" {
+		creds = stscreds.NewCredentials(sess, config.RoleARN, func(p *stscreds.AssumeRoleProvider) {
+			if config.ExternalID != "" {
+				p.ExternalID = aws.String(config.ExternalID)
+			}
+		})
+	}
+	c.signer = v4.NewSigner(creds)
+	return c, nil
+}
+
+// encode returns the form of the request publishing the messages.
+func (c *awsQueryClient) encode(messages []awsMessage) url.Values {
+	form := url.Values{}
+	for k, v := range c.params {
+		form[k] = v
+	}
+
+	// The entries and attributes are lists of the query API, numbered from
+	// one, under names which differ between SQS and SNS.
+	entryPrefix, bodyName, attributePrefix := "SendMessageBatchRequestEntry.", "MessageBody", "MessageAttribute."
+	if c.service == EndpointTypeSNS {
+		entryPrefix, bodyName, attributePrefix = "PublishBatchRequestEntries.member.", "Message", "MessageAttributes.entry."
+	}
+	for i, message := range messages {
+		entry := entryPrefix + strconv.Itoa(i+1) + "."
+		form.Set(entry+"Id", message.id)
+		form.Set(entry+bodyName, message.body)
+		if message.groupID != "" {
+			form.Set(entry+"MessageGroupId", message.groupID)
+			form.Set(entry+"MessageDeduplicationId", message.deduplicationID)
+		}
+		n := 0
+		for _, name := range []string{"action", "repository"} {
+			value, ok := message.attributes[name]
+			if !ok {
+				continue
+			}
+			n++
+			attribute := entry + attributePrefix + strconv.Itoa(n) + "."
+			form.Set(attribute+"Name", name)
+			form.Set(attribute+"Value.DataType", "String")
+			form.Set(attribute+"Value.StringValue", value)
+		}
+	}
+	return form
+}
+
+// awsBatchResponse is the response of SendMessageBatch or PublishBatch.
+type awsBatchResponse struct {
+	SQSFailed []awsBatchFailure `xml:"SendMessageBatchResult>BatchResultErrorEntry"`
+	SNSFailed []awsBatchFailure `xml:"PublishBatchResult>Failed>member"`
+}
+
+// awsErrorResponse is the response of a failed request.
+type awsErrorResponse struct {
+	Code    string `xml:"Error>Code"`
+	Message string `xml:"Error>Message"`
+}
+
+func (c *awsQueryClient) publishBatch(ctx context.Context, messages []awsMessage) (int, []awsBatchFailure, error) {
+	body := c.encode(messages).Encode()
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, c.url, strings.NewReader(body))
+	if err != nil {
+		return 0, nil, err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded; charset=utf-8")
+	if _, err := c.signer.Sign(req, strings.NewReader(body), c.service, c.region, time.Now()); err != nil {
+		return 0, nil, fmt.Errorf("error signing request: %v", err)
+	}
+
+	resp, err := c.client.Do(req)
+	if err != nil {
+		return 0, nil, err
+	}
+	defer resp.Body.Close()
+
+	p, err := io.ReadAll(io.LimitReader(resp.Body, 1<<20))
+	if err != nil {
+		return resp.StatusCode, nil, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		var errResp awsErrorResponse
+		if err := xml.Unmarshal(p, &errResp); err != nil || errResp.Code == "" {
+			return resp.StatusCode, nil, fmt.Errorf("response status %v unaccepted", resp.Status)
+		}
+		return resp.StatusCode, nil, fmt.Errorf("%s: %s", errResp.Code, errResp.Message)
+	}
+
+	var batchResp awsBatchResponse
+	if err := xml.Unmarshal(p, &batchResp); err != nil {
+		return resp.StatusCode, nil, fmt.Errorf("error decoding response: %v", err)
+	}
+	return resp.StatusCode, append(batchResp.SQSFailed, batchResp.SNSFailed...), nil
+}
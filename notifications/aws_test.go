@@ -0,0 +1,260 @@
+package notifications
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/distribution/distribution/v3/configuration"
+	v1 "github.com/opencontainers/image-spec/specs-go/v1"
+)
+
+// testPublisher records the batches it is given, and fails the messages of
+// the repositories in fail.
+type testPublisher struct {
+	mu      sync.Mutex
+	batches [][]awsMessage
+	fail    map[string]bool
+	err     error
+}
+
+func (p *testPublisher) publishBatch(ctx context.Context, messages []awsMessage) (int, []awsBatchFailure, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.err != nil {
+		return http.StatusServiceUnavailable, nil, p.err
+	}
+	p.batches = append(p.batches, messages)
+
+	var failures []awsBatchFailure
+	for _, message := range messages {
+		if p.fail[message.attributes["repository"]] {
+			failures = append(failures, awsBatchFailure{ID: message.id, Code: "InternalError", Message: "try again"})
+		}
+	}
+	return http.StatusOK, failures, nil
+}
+
+func testEventBatch(n int, repo string) *eventBatch {
+	batch := &eventBatch{}
+	for i := 0; i < n; i++ {
+		batch.events = append(batch.events, createTestEvent("push", repo, v1.MediaTypeImageManifest))
+	}
+	return batch
+}
+
+func TestAWSSinkBatching(t *testing.T) {
+	publisher := &testPublisher{}
+	metrics := newSafeMetrics("sqs")
+	sink := newAWSSink(publisher, "https://sqs.us-east-1.amazonaws.com/123456789012/events", metrics.httpStatusListener())
+
+	if err := sink.Write(testEventBatch(23, "library/app")); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if len(publisher.batches) != 3 || len(publisher.batches[0]) != 10 || len(publisher.batches[2]) != 3 {
+		t.Fatalf("unexpected batches of %d requests", len(publisher.batches))
+	}
+	if metrics.Successes != 23 {
+		t.Fatalf("unexpected metrics: %+v", metrics.EndpointMetrics)
+	}
+
+	message := publisher.batches[0][0]
+	if message.attributes["action"] != "push" || message.attributes["repository"] != "library/app" {
+		t.Fatalf("unexpected attributes %v", message.attributes)
+	}
+	if message.groupID != "" {
+		t.Fatalf("unexpected group ID %q for a standard queue", message.groupID)
+	}
+	var envelope Envelope
+	if err := json.Unmarshal([]byte(message.body), &envelope); err != nil || len(envelope.Events) != 1 {
+		t.Fatalf("unexpected body %s: %v", message.body, err)
+	}
+
+	// Batches are split to stay within the maximum size.
+	publisher.batches = nil
+	batch := testEventBatch(3, "library/app")
+	for i := range batch.events {
+		event := batch.events[i].(Event)
+		event.Actor.Name = strings.Repeat("a", awsMaxMessageSize/2)
+		batch.events[i] = event
+	}
+	if err := sink.Write(batch); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if len(publisher.batches) != 3 {
+		t.Fatalf("expected a request for each large message, got %d", len(publisher.batches))
+	}
+}
+
+func TestAWSSinkPartialFailure(t *testing.T) {
+	publisher := &testPublisher{fail: map[string]bool{"library/broken": true}}
+	metrics := newSafeMetrics("sns")
+	sink := newAWSSink(publisher, "arn:aws:sns:us-east-1:123456789012:events", metrics.httpStatusListener())
+
+	batch := testEventBatch(4, "library/app")
+	broken := createTestEvent("push", "library/broken", v1.MediaTypeImageManifest)
+	batch.events = append(batch.events, broken)
+	if err := sink.Write(batch); err == nil {
+		t.Fatal("expected an error for the failed message")
+	}
+
+	// Only the failed event is retried.
+	if len(batch.events) != 1 || batch.events[0].(Event).ID != broken.ID {
+		t.Fatalf("unexpected events left in the batch: %v", batch.events)
+	}
+	if metrics.Successes != 4 || metrics.Failures != 1 || metrics.Statuses["500 Internal Server Error"] != 1 {
+		t.Fatalf("unexpected metrics: %+v", metrics.EndpointMetrics)
+	}
+
+	publisher.fail = nil
+	if err := sink.Write(batch); err != nil {
+		t.Fatalf("unexpected error retrying: %v", err)
+	}
+	if len(batch.events) != 0 || metrics.Successes != 5 {
+		t.Fatalf("unexpected retry: %v %+v", batch.events, metrics.EndpointMetrics)
+	}
+
+	// A failed request leaves the whole batch to retry.
+	publisher.err = errors.New("unavailable")
+	batch = testEventBatch(2, "library/app")
+	if err := sink.Write(batch); err == nil {
+		t.Fatal("expected an error")
+	}
+	if len(batch.events) != 2 || metrics.Failures != 3 {
+		t.Fatalf("unexpected failed request: %v %+v", batch.events, metrics.EndpointMetrics)
+	}
+}
+
+func TestAWSSinkMessageTooLarge(t *testing.T) {
+	publisher := &testPublisher{}
+	metrics := newSafeMetrics("sqs")
+	sink := newAWSSink(publisher, "https://sqs.us-east-1.amazonaws.com/123456789012/events", metrics.httpStatusListener())
+
+	large := createTestEvent("push", "library/app", v1.MediaTypeImageManifest)
+	large.Actor.Name = strings.Repeat("a", awsMaxMessageSize)
+	batch := testEventBatch(2, "library/app")
+	batch.events = append(batch.events, large)
+
+	// The large event is dropped, not retried.
+	if err := sink.Write(batch); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if len(publisher.batches) != 1 || len(publisher.batches[0]) != 2 || len(batch.events) != 0 {
+		t.Fatalf("unexpected batches %v", publisher.batches)
+	}
+	if metrics.Successes != 2 || metrics.Errors != 1 {
+		t.Fatalf("unexpected metrics: %+v", metrics.EndpointMetrics)
+	}
+
+	if err := sink.Write(large); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if len(publisher.batches) != 1 || metrics.Errors != 2 {
+		t.Fatalf("expected the event to be dropped: %+v", metrics.EndpointMetrics)
+	}
+}
+
+func TestAWSSinkFIFO(t *testing.T) {
+	publisher := &testPublisher{}
+	sink := newAWSSink(publisher, "https://sqs.us-east-1.amazonaws.com/123456789012/events.fifo")
+
+	event := createTestEvent("delete", "library/app", v1.MediaTypeImageManifest)
+	if err := sink.Write(event); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	message := publisher.batches[0][0]
+	if message.groupID != "library/app" || message.deduplicationID != event.ID {
+		t.Fatalf("unexpected group ID %q and deduplication ID %q", message.groupID, message.deduplicationID)
+	}
+}
+
+func TestAWSQueryClient(t *testing.T) {
+	var form url.Values
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !strings.HasPrefix(r.Header.Get("Authorization"), "AWS4-HMAC-SHA256 Credential=AKID/") {
+			t.Errorf("unexpected authorization %q", r.Header.Get("Authorization"))
+		}
+		body, _ := io.ReadAll(r.Body)
+		form, _ = url.ParseQuery(string(body))
+
+		switch form.Get("Action") {
+		case "SendMessageBatch":
+			if r.URL.Path != "/123456789012/events" {
+				t.Errorf("unexpected queue path %q", r.URL.Path)
+			}
+			io.WriteString(w, `<SendMessageBatchResponse><SendMessageBatchResult>
+<SendMessageBatchResultEntry><Id>0</Id></SendMessageBatchResultEntry>
+<BatchResultErrorEntry><Id>1</Id><Code>InvalidParameterValue</Code><Message>bad</Message><SenderFault>true</SenderFault></BatchResultErrorEntry>
+</SendMessageBatchResult></SendMessageBatchResponse>`)
+		case "PublishBatch":
+			w.WriteHeader(http.StatusForbidden)
+			io.WriteString(w, `<ErrorResponse><Error><Code>AuthorizationError</Code><Message>denied</Message></Error></ErrorResponse>`)
+		}
+	}))
+	defer server.Close()
+
+	awsConfig := configuration.AWSEndpoint{AccessKeyID: "AKID", SecretAccessKey: "secret", Endpoint: server.URL}
+	sqs, err := newAWSQueryClient(EndpointTypeSQS, "arn:aws:sqs:eu-west-1:123456789012:events", awsConfig, server.Client())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if sqs.region != "eu-west-1" {
+		t.Fatalf("unexpected region %q", sqs.region)
+	}
+
+	messages := []awsMessage{
+		{id: "0", body: "{}", attributes: map[string]string{"action": "push", "repository": "library/app"}},
+		{id: "1", body: "{}", attributes: map[string]string{"action": "pull"}},
+	}
+	status, failures, err := sqs.publishBatch(context.Background(), messages)
+	if err != nil || status != http.StatusOK {
+		t.Fatalf("unexpected response %d: %v", status, err)
+	}
+	if len(failures) != 1 || failures[0].ID != "1" || !failures[0].SenderFault {
+		t.Fatalf("unexpected failures %+v", failures)
+	}
+	for key, value := range map[string]string{
+		"QueueUrl":                                                            server.URL + "/123456789012/events",
+		"SendMessageBatchRequestEntry.1.Id":                                   "0",
+		"SendMessageBatchRequestEntry.1.MessageBody":                          "{}",
+		"SendMessageBatchRequestEntry.1.MessageAttribute.2.Name":              "repository",
+		"SendMessageBatchRequestEntry.1.MessageAttribute.2.Value.StringValue": "library/app",
+		"SendMessageBatchRequestEntry.2.MessageAttribute.1.Value.StringValue": "pull",
+	} {
+		if form.Get(key) != value {
+			t.Errorf("unexpected %s %q", key, form.Get(key))
+		}
+	}
+
+	sns, err := newAWSQueryClient(EndpointTypeSNS, "arn:aws:sns:eu-west-1:123456789012:events", awsConfig, server.Client())
+	if err != nil {
+		t.Fatal(err)
+	}
+	status, _, err = sns.publishBatch(context.Background(), messages)
+	if err == nil || status != http.StatusForbidden || !strings.Contains(err.Error(), "AuthorizationError") {
+		t.Fatalf("unexpected response %d: %v", status, err)
+	}
+	if form.Get("TopicArn") != "arn:aws:sns:eu-west-1:123456789012:events" || form.Get("PublishBatchRequestEntries.member.1.MessageAttributes.entry.1.Name") != "action" {
+		t.Fatalf("unexpected form %v", form)
+	}
+
+	for _, target := range []string{
+		"https://example.com/123456789012/events",
+		"arn:aws:sns:eu-west-1:123456789012:events",
+		"not a url",
+	} {
+		if _, err := newAWSQueryClient(EndpointTypeSQS, target, configuration.AWSEndpoint{}, server.Client()); err == nil {
+			t.Errorf("%s: expected an error", target)
+		}
+	}
+	if _, err := newAWSQueryClient(EndpointTypeSNS, "https://sqs.us-east-1.amazonaws.com/123456789012/events", configuration.AWSEndpoint{}, server.Client()); err == nil {
+		t.Error("expected an error for an sns endpoint without a topic ARN")
+	}
+}
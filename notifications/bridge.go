@@ -5,6 +5,7 @@ import (
 	"time"
 
 	"github.com/distribution/distribution/v3"
+	"github.com/distribution/distribution/v3/configuration"
 	"github.com/distribution/distribution/v3/internal/requestutil"
 	"github.com/distribution/distribution/v3/internal/uuid"
 	"github.com/distribution/reference"
@@ -16,13 +17,17 @@ import (
 type bridge struct {
 	ub                URLBuilder
 	includeReferences bool
+	tagDeletes        string
 	actor             ActorRecord
 	source            SourceRecord
 	request           RequestRecord
 	sink              events.Sink
 }
 
-var _ Listener = &bridge{}
+var (
+	_ Listener      = &bridge{}
+	_ ProxyListener = &bridge{}
+)
 
 // URLBuilder defines a subset of url builder to be used by the event listener.
 type URLBuilder interface {
@@ -32,12 +37,15 @@ type URLBuilder interface {
 
 // NewBridge returns a notification listener that writes records to sink,
 // using the actor and source. Any urls populated in the events created by
-// this bridge will be created using the URLBuilder.
+// this bridge will be created using the URLBuilder. The tags removed by the
+// deletion of a manifest are reported as tagDeletes, one of the
+// configuration.TagDeletes values.
 // TODO(stevvooe): Update this to simply take a context.Context object.
-func NewBridge(ub URLBuilder, source SourceRecord, actor ActorRecord, request RequestRecord, sink events.Sink, includeReferences bool) Listener {
+func NewBridge(ub URLBuilder, source SourceRecord, actor ActorRecord, request RequestRecord, sink events.Sink, includeReferences bool, tagDeletes string) Listener {
 	return &bridge{
 		ub:                ub,
 		includeReferences: includeReferences,
+		tagDeletes:        tagDeletes,
 		actor:             actor,
 		source:            source,
 		request:           request,
@@ -45,6 +53,17 @@ func NewBridge(ub URLBuilder, source SourceRecord, actor ActorRecord, request Re
 	}
 }
 
+// NewProxyBridge returns a listener to the events of a pull through cache that
+// writes records to sink, using the actor and source.
+func NewProxyBridge(source SourceRecord, actor ActorRecord, request RequestRecord, sink events.Sink) ProxyListener {
+	return &bridge{
+		actor:   actor,
+		source:  source,
+		request: request,
+		sink:    sink,
+	}
+}
+
 // NewRequestRecord builds a RequestRecord for use in NewBridge from an
 // http.Request, associating it with a request id.
 func NewRequestRecord(id string, r *http.Request) RequestRecord {
@@ -57,6 +76,24 @@ func NewRequestRecord(id string, r *http.Request) RequestRecord {
 	}
 }
 
+// WithAnnotations passes the annotations of a pushed manifest, and the labels
+// of its image configuration, to the listeners of its push.
+func WithAnnotations(annotations, labels map[string]string) distribution.ManifestServiceOption {
+	return WithAnnotationsOption{Annotations: annotations, Labels: labels}
+}
+
+// WithAnnotationsOption holds the annotations and labels of a pushed manifest.
+type WithAnnotationsOption struct {
+	Annotations map[string]string
+	Labels      map[string]string
+}
+
+// Apply conforms to the ManifestServiceOption interface
+func (o WithAnnotationsOption) Apply(m distribution.ManifestService) error {
+	// no implementation
+	return nil
+}
+
 func (b *bridge) ManifestPushed(repo reference.Named, sm distribution.Manifest, options ...distribution.ManifestServiceOption) error {
 	manifestEvent, err := b.createManifestEvent(EventActionPush, repo, sm)
 	if err != nil {
@@ -64,9 +101,12 @@ func (b *bridge) ManifestPushed(repo reference.Named, sm distribution.Manifest,
 	}
 
 	for _, option := range options {
-		if opt, ok := option.(distribution.WithTagOption); ok {
+		switch opt := option.(type) {
+		case distribution.WithTagOption:
 			manifestEvent.Target.Tag = opt.Tag
-			break
+		case WithAnnotationsOption:
+			manifestEvent.Target.Annotations = opt.Annotations
+			manifestEvent.Target.Labels = opt.Labels
 		}
 	}
 	return b.sink.Write(*manifestEvent)
@@ -91,6 +131,28 @@ func (b *bridge) ManifestDeleted(repo reference.Named, dgst digest.Digest) error
 	return b.createManifestDeleteEventAndWrite(EventActionDelete, repo, dgst)
 }
 
+// TaggedManifestDeleted reports the tags removed with the manifest in its
+// delete event, or as tag.delete events following it.
+func (b *bridge) TaggedManifestDeleted(repo reference.Named, dgst digest.Digest, tags []string) error {
+	event := b.createEvent(EventActionDelete)
+	event.Target.Repository = repo.Name()
+	event.Target.Digest = dgst
+	if b.tagDeletes == configuration.TagDeletesManifest {
+		event.Target.Tags = tags
+		return b.sink.Write(*event)
+	}
+
+	if err := b.sink.Write(*event); err != nil {
+		return err
+	}
+	for _, tag := range tags {
+		if err := b.TagDeleted(repo, tag, dgst); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
 func (b *bridge) BlobPushed(repo reference.Named, desc v1.Descriptor) error {
 	return b.createBlobEventAndWrite(EventActionPush, repo, desc)
 }
@@ -112,10 +174,11 @@ func (b *bridge) BlobDeleted(repo reference.Named, dgst digest.Digest) error {
 	return b.createBlobDeleteEventAndWrite(EventActionDelete, repo, dgst)
 }
 
-func (b *bridge) TagDeleted(repo reference.Named, tag string) error {
-	event := b.createEvent(EventActionDelete)
+func (b *bridge) TagDeleted(repo reference.Named, tag string, dgst digest.Digest) error {
+	event := b.createEvent(EventActionTagDelete)
 	event.Target.Repository = repo.Name()
 	event.Target.Tag = tag
+	event.Target.Digest = dgst
 
 	return b.sink.Write(*event)
 }
@@ -127,6 +190,33 @@ func (b *bridge) RepoDeleted(repo reference.Named) error {
 	return b.sink.Write(*event)
 }
 
+func (b *bridge) RepoRenamed(repo, fromRepo reference.Named) error {
+	event := b.createEvent(EventActionRename)
+	event.Target.Repository = repo.Name()
+	event.Target.FromRepository = fromRepo.Name()
+
+	return b.sink.Write(*event)
+}
+
+func (b *bridge) PullThroughMissed(repo reference.Named, desc v1.Descriptor, tag string, upstream UpstreamRecord) error {
+	event := b.createEvent(EventActionPullThroughMiss)
+	event.Target.Descriptor = desc
+	event.Target.Length = desc.Size
+	event.Target.Repository = repo.Name()
+	event.Target.Tag = tag
+	event.Upstream = &upstream
+	return b.sink.Write(*event)
+}
+
+func (b *bridge) BlobCorrupted(repo reference.Named, desc v1.Descriptor, actual digest.Digest) error {
+	event := b.createEvent(EventActionBlobCorrupt)
+	event.Target.Descriptor = desc
+	event.Target.Length = desc.Size
+	event.Target.Repository = repo.Name()
+	event.Target.ActualDigest = actual
+	return b.sink.Write(*event)
+}
+
 func (b *bridge) createManifestDeleteEventAndWrite(action string, repo reference.Named, dgst digest.Digest) error {
 	event := b.createEvent(action)
 	event.Target.Repository = repo.Name()
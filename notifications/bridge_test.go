@@ -1,9 +1,12 @@
 package notifications
 
 import (
+	"fmt"
+	"reflect"
 	"testing"
 
 	"github.com/distribution/distribution/v3"
+	"github.com/distribution/distribution/v3/configuration"
 	"github.com/distribution/distribution/v3/internal/uuid"
 	"github.com/distribution/distribution/v3/manifest/schema2"
 	v2 "github.com/distribution/distribution/v3/registry/api/v2"
@@ -83,6 +86,25 @@ func TestEventBridgeManifestPushedWithTag(t *testing.T) {
 	}
 }
 
+func TestEventBridgeManifestPushedWithAnnotations(t *testing.T) {
+	annotations := map[string]string{"org.opencontainers.image.source": "https://github.com/example/app"}
+	labels := map[string]string{"maintainer": "team@example.com"}
+	l := createTestEnv(t, testSinkFn(func(event events.Event) error {
+		checkCommonManifest(t, EventActionPush, event)
+		target := event.(Event).Target
+		if target.Tag != "latest" || target.Annotations["org.opencontainers.image.source"] != annotations["org.opencontainers.image.source"] || target.Labels["maintainer"] != labels["maintainer"] {
+			t.Fatalf("missing or unexpected annotations: %#v", target)
+		}
+
+		return nil
+	}))
+
+	repoRef, _ := reference.WithName(repo)
+	if err := l.ManifestPushed(repoRef, sm, distribution.WithTag(tag), WithAnnotations(annotations, labels)); err != nil {
+		t.Fatalf("unexpected error notifying manifest push: %v", err)
+	}
+}
+
 func TestEventBridgeManifestPulledWithTag(t *testing.T) {
 	l := createTestEnv(t, testSinkFn(func(event events.Event) error {
 		checkCommonManifest(t, EventActionPull, event)
@@ -116,19 +138,60 @@ func TestEventBridgeManifestDeleted(t *testing.T) {
 
 func TestEventBridgeTagDeleted(t *testing.T) {
 	l := createTestEnv(t, testSinkFn(func(event events.Event) error {
-		checkDeleted(t, EventActionDelete, event)
+		checkDeleted(t, EventActionTagDelete, event)
 		if event.(Event).Target.Tag != tag {
 			t.Fatalf("unexpected tag on event target: %q != %q", event.(Event).Target.Tag, tag)
 		}
+		if event.(Event).Target.Digest != dgst {
+			t.Fatalf("unexpected digest on event target: %q != %q", event.(Event).Target.Digest, dgst)
+		}
 		return nil
 	}))
 
 	repoRef, _ := reference.WithName(repo)
-	if err := l.TagDeleted(repoRef, tag); err != nil {
+	if err := l.TagDeleted(repoRef, tag, dgst); err != nil {
 		t.Fatalf("unexpected error notifying tag deletion: %v", err)
 	}
 }
 
+func TestEventBridgeTaggedManifestDeleted(t *testing.T) {
+	repoRef, _ := reference.WithName(repo)
+	manifestDigest := digest.FromString("manifest")
+	for _, tc := range []struct {
+		tagDeletes string
+		expected   []string
+	}{
+		{tagDeletes: "", expected: []string{"delete " + repo + "@" + manifestDigest.String(), "tag.delete " + repo + ":latest", "tag.delete " + repo + ":v1"}},
+		{tagDeletes: configuration.TagDeletesEvents, expected: []string{"delete " + repo + "@" + manifestDigest.String(), "tag.delete " + repo + ":latest", "tag.delete " + repo + ":v1"}},
+		{tagDeletes: configuration.TagDeletesManifest, expected: []string{"delete " + repo + "@" + manifestDigest.String() + " [latest v1]"}},
+	} {
+		var written []string
+		l := NewBridge(ub, source, actor, request, testSinkFn(func(event events.Event) error {
+			e := event.(Event)
+			checkDeleted(t, e.Action, event)
+			if e.Target.Digest != manifestDigest {
+				t.Fatalf("unexpected digest on event target: %q != %q", e.Target.Digest, manifestDigest)
+			}
+			switch {
+			case e.Action == EventActionTagDelete:
+				written = append(written, e.Action+" "+e.Target.Repository+":"+e.Target.Tag)
+			case len(e.Target.Tags) > 0:
+				written = append(written, fmt.Sprintf("%s %s@%s %v", e.Action, e.Target.Repository, e.Target.Digest, e.Target.Tags))
+			default:
+				written = append(written, e.Action+" "+e.Target.Repository+"@"+e.Target.Digest.String())
+			}
+			return nil
+		}), true, tc.tagDeletes)
+
+		if err := l.TaggedManifestDeleted(repoRef, manifestDigest, []string{"latest", "v1"}); err != nil {
+			t.Fatalf("unexpected error notifying manifest deletion: %v", err)
+		}
+		if !reflect.DeepEqual(written, tc.expected) {
+			t.Fatalf("%q: unexpected events %q, expected %q", tc.tagDeletes, written, tc.expected)
+		}
+	}
+}
+
 func TestEventBridgeRepoDeleted(t *testing.T) {
 	l := createTestEnv(t, testSinkFn(func(event events.Event) error {
 		checkDeleted(t, EventActionDelete, event)
@@ -141,6 +204,84 @@ func TestEventBridgeRepoDeleted(t *testing.T) {
 	}
 }
 
+func TestEventBridgeRepoRenamed(t *testing.T) {
+	l := createTestEnv(t, testSinkFn(func(event events.Event) error {
+		e := event.(Event)
+		if e.Action != EventActionRename {
+			t.Fatalf("unexpected event action: %q != %q", e.Action, EventActionRename)
+		}
+		if e.Target.Repository != repo || e.Target.FromRepository != "previous/name" {
+			t.Fatalf("unexpected target: %#v", e.Target)
+		}
+		if e.Source != source || e.Actor != actor || e.Request != request {
+			t.Fatalf("unexpected event: %#v", e)
+		}
+		return nil
+	}))
+
+	repoRef, _ := reference.WithName(repo)
+	fromRef, _ := reference.WithName("previous/name")
+	if err := l.RepoRenamed(repoRef, fromRef); err != nil {
+		t.Fatalf("unexpected error notifying repo rename: %v", err)
+	}
+}
+
+func TestEventBridgePullThroughMissed(t *testing.T) {
+	createTestEnv(t, nil)
+	upstream := UpstreamRecord{Host: "registry-1.docker.io", Bytes: int64(len(payload)), Duration: 0.25}
+	var written int
+	l := NewProxyBridge(source, actor, request, testSinkFn(func(event events.Event) error {
+		written++
+		checkCommon(t, event)
+		e := event.(Event)
+		if e.Action != EventActionPullThroughMiss {
+			t.Fatalf("unexpected event action: %q != %q", e.Action, EventActionPullThroughMiss)
+		}
+		if e.Target.Tag != tag || e.Target.MediaType != v1.MediaTypeImageManifest {
+			t.Fatalf("unexpected target: %#v", e.Target)
+		}
+		if e.Upstream == nil || *e.Upstream != upstream {
+			t.Fatalf("unexpected upstream: %#v", e.Upstream)
+		}
+		return nil
+	}))
+
+	repoRef, _ := reference.WithName(repo)
+	desc := v1.Descriptor{MediaType: v1.MediaTypeImageManifest, Digest: dgst, Size: int64(len(payload))}
+	if err := l.PullThroughMissed(repoRef, desc, tag, upstream); err != nil {
+		t.Fatalf("unexpected error notifying pull through miss: %v", err)
+	}
+	if written != 1 {
+		t.Fatalf("unexpected number of events written: %d", written)
+	}
+}
+
+func TestEventBridgeBlobCorrupted(t *testing.T) {
+	actual := digest.FromString("corrupted")
+	var written int
+	l := createTestEnv(t, testSinkFn(func(event events.Event) error {
+		written++
+		checkCommon(t, event)
+		e := event.(Event)
+		if e.Action != EventActionBlobCorrupt {
+			t.Fatalf("unexpected event action: %q != %q", e.Action, EventActionBlobCorrupt)
+		}
+		if e.Target.Repository != repo || e.Target.Length != int64(len(payload)) || e.Target.ActualDigest != actual {
+			t.Fatalf("unexpected target: %#v", e.Target)
+		}
+		return nil
+	}))
+
+	repoRef, _ := reference.WithName(repo)
+	desc := v1.Descriptor{MediaType: layerMediaType, Digest: dgst, Size: int64(len(payload))}
+	if err := l.(IntegrityListener).BlobCorrupted(repoRef, desc, actual); err != nil {
+		t.Fatalf("unexpected error notifying blob corruption: %v", err)
+	}
+	if written != 1 {
+		t.Fatalf("unexpected number of events written: %d", written)
+	}
+}
+
 func createTestEnv(t *testing.T, fn testSinkFn) Listener {
 	mfst := schema2.Manifest{
 		Versioned: specs.Versioned{SchemaVersion: 2},
@@ -157,7 +298,7 @@ func createTestEnv(t *testing.T, fn testSinkFn) Listener {
 	dgst = digest.FromBytes(payload)
 	sm = deserializedManifest
 
-	return NewBridge(ub, source, actor, request, fn, true)
+	return NewBridge(ub, source, actor, request, fn, true, "")
 }
 
 func checkDeleted(t *testing.T, action string, event events.Event) {
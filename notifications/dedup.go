@@ -0,0 +1,106 @@
+package notifications
+
+import (
+	"sync"
+	"time"
+
+	"github.com/distribution/distribution/v3/configuration"
+	events "github.com/docker/go-events"
+	"github.com/opencontainers/go-digest"
+)
+
+// maxDedupEntries bounds the number of events a deduplicating sink
+// remembers. Once it is reached, and none of them has expired, events are
+// passed along without being remembered.
+const maxDedupEntries = 10000
+
+// dedupKey identifies the identical events.
+type dedupKey struct {
+	action     string
+	repository string
+	digest     digest.Digest
+	tag        string
+	actor      string
+}
+
+// dedupSink collapses the identical events written within the window of
+// their action into the first one, counting the others in the metrics.
+type dedupSink struct {
+	events.Sink
+	windows map[string]time.Duration
+	metrics *safeMetrics
+	now     func() time.Time
+
+	mu sync.Mutex
+	// expiries holds the time until which the events are suppressed.
+	expiries map[dedupKey]time.Time
+}
+
+func newDedupSink(sink events.Sink, config configuration.Deduplication, metrics *safeMetrics) events.Sink {
+	windows := make(map[string]time.Duration)
+	if config.Pull > 0 {
+		windows[EventActionPull] = config.Pull
+	}
+	if config.Push > 0 {
+		windows[EventActionPush] = config.Push
+	}
+	if len(windows) == 0 {
+		return sink
+	}
+
+	return &dedupSink{
+		Sink:     sink,
+		windows:  windows,
+		metrics:  metrics,
+		now:      time.Now,
+		expiries: make(map[dedupKey]time.Time),
+	}
+}
+
+// Write discards the event if an identical one was written within its
+// window, and passes it along otherwise.
+func (ds *dedupSink) Write(event events.Event) error {
+	e := event.(Event)
+	window, ok := ds.windows[e.Action]
+	if !ok {
+		return ds.Sink.Write(event)
+	}
+	key := dedupKey{
+		action:     e.Action,
+		repository: e.Target.Repository,
+		digest:     e.Target.Digest,
+		tag:        e.Target.Tag,
+		actor:      e.Actor.Name,
+	}
+
+	if ds.suppressed(key, window) {
+		ds.metrics.deduplicated(event)
+		return nil
+	}
+	return ds.Sink.Write(event)
+}
+
+// suppressed returns whether an event of the key is within the window of an
+// identical one, remembering it otherwise.
+func (ds *dedupSink) suppressed(key dedupKey, window time.Duration) bool {
+	ds.mu.Lock()
+	defer ds.mu.Unlock()
+
+	now := ds.now()
+	if expiry, ok := ds.expiries[key]; ok && now.Before(expiry) {
+		return true
+	}
+
+	if len(ds.expiries) >= maxDedupEntries {
+		for k, expiry := range ds.expiries {
+			if !now.Before(expiry) {
+				delete(ds.expiries, k)
+			}
+		}
+		if len(ds.expiries) >= maxDedupEntries {
+			return false
+		}
+	}
+	ds.expiries[key] = now.Add(window)
+	return false
+}
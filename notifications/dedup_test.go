@@ -0,0 +1,152 @@
+package notifications
+
+import (
+	"net/http"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/distribution/distribution/v3/configuration"
+	events "github.com/docker/go-events"
+	"github.com/opencontainers/go-digest"
+	v1 "github.com/opencontainers/image-spec/specs-go/v1"
+)
+
+// countingSink counts the events written to it.
+type countingSink struct {
+	mu     sync.Mutex
+	events []Event
+}
+
+func (s *countingSink) Write(event events.Event) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.events = append(s.events, event.(Event))
+	return nil
+}
+
+func (s *countingSink) Close() error { return nil }
+
+func (s *countingSink) written() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return len(s.events)
+}
+
+func createDedupTestEvent(action, actor string) Event {
+	event := createTestEvent(action, "library/app", v1.MediaTypeImageManifest)
+	event.Target.Digest = digest.FromString("manifest")
+	event.Target.Tag = "latest"
+	event.Actor.Name = actor
+	return event
+}
+
+func TestDedupSink(t *testing.T) {
+	counting := &countingSink{}
+	metrics := newSafeMetrics(t.Name())
+	sink := newDedupSink(counting, configuration.Deduplication{Pull: time.Minute}, metrics).(*dedupSink)
+	now := time.Now()
+	sink.now = func() time.Time { return now }
+
+	// A burst of identical pulls is delivered once.
+	for range 5 {
+		if err := sink.Write(createDedupTestEvent(EventActionPull, "kubelet")); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if n := counting.written(); n != 1 {
+		t.Fatalf("expected a single delivery of the burst, got %d", n)
+	}
+	if metrics.Deduplicated != 4 {
+		t.Fatalf("expected 4 deduplicated events, got %d", metrics.Deduplicated)
+	}
+
+	// Pushes are not deduplicated without a window, nor are the pulls of
+	// another actor.
+	for _, event := range []Event{
+		createDedupTestEvent(EventActionPush, "kubelet"),
+		createDedupTestEvent(EventActionPush, "kubelet"),
+		createDedupTestEvent(EventActionPull, "ci"),
+	} {
+		if err := sink.Write(event); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if n := counting.written(); n != 4 {
+		t.Fatalf("expected the distinct events to be delivered, got %d deliveries", n)
+	}
+
+	// The pull is delivered again once the window expired.
+	now = now.Add(time.Minute)
+	if err := sink.Write(createDedupTestEvent(EventActionPull, "kubelet")); err != nil {
+		t.Fatal(err)
+	}
+	if n := counting.written(); n != 5 || metrics.Deduplicated != 4 {
+		t.Fatalf("unexpected deliveries %d and deduplicated events %d after the window", n, metrics.Deduplicated)
+	}
+
+	if sink := newDedupSink(counting, configuration.Deduplication{}, metrics); sink != events.Sink(counting) {
+		t.Fatalf("unexpected sink %T without windows", sink)
+	}
+}
+
+func TestDedupSinkBounded(t *testing.T) {
+	counting := &countingSink{}
+	sink := newDedupSink(counting, configuration.Deduplication{Push: time.Minute}, newSafeMetrics(t.Name())).(*dedupSink)
+	now := time.Now()
+	sink.now = func() time.Time { return now }
+
+	for i := range maxDedupEntries + 10 {
+		event := createDedupTestEvent(EventActionPush, "ci")
+		event.Target.Digest = digest.FromString(strconv.Itoa(i))
+		if err := sink.Write(event); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if len(sink.expiries) != maxDedupEntries {
+		t.Fatalf("expected %d remembered events, got %d", maxDedupEntries, len(sink.expiries))
+	}
+
+	// Expired events are forgotten to remember new ones.
+	now = now.Add(time.Minute)
+	if err := sink.Write(createDedupTestEvent(EventActionPush, "ci")); err != nil {
+		t.Fatal(err)
+	}
+	if len(sink.expiries) != 1 {
+		t.Fatalf("expected the expired events to be forgotten, %d remembered", len(sink.expiries))
+	}
+}
+
+func TestEndpointDeduplication(t *testing.T) {
+	unregisterTestEndpoints(t)
+	server := newTestEventServer(t, http.StatusOK)
+
+	endpoint := NewEndpoint("deduplicated", server.URL, EndpointConfig{
+		Deduplication: configuration.Deduplication{Pull: time.Minute},
+	})
+	defer endpoint.Close()
+
+	// A HEAD then GET of a manifest, and retries.
+	first := createDedupTestEvent(EventActionPull, "kubelet")
+	for _, event := range []Event{first, createDedupTestEvent(EventActionPull, "kubelet"), createDedupTestEvent(EventActionPull, "kubelet")} {
+		if err := endpoint.Write(event); err != nil {
+			t.Fatalf("error writing event: %v", err)
+		}
+	}
+
+	deadline := time.Now().Add(5 * time.Second)
+	var metrics EndpointMetrics
+	for endpoint.ReadMetrics(&metrics); metrics.Successes < 1; endpoint.ReadMetrics(&metrics) {
+		if time.Now().After(deadline) {
+			t.Fatalf("the event was not delivered: %+v", metrics)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if ids := server.posted(); len(ids) != 1 || ids[0] != first.ID {
+		t.Fatalf("unexpected deliveries %v", ids)
+	}
+	if metrics.Events != 1 || metrics.Deduplicated != 2 {
+		t.Fatalf("unexpected metrics %+v", metrics)
+	}
+}
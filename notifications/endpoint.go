@@ -3,10 +3,12 @@ package notifications
 import (
 	"maps"
 	"net/http"
+	"slices"
 	"time"
 
 	"github.com/distribution/distribution/v3/configuration"
 	events "github.com/docker/go-events"
+	"github.com/sirupsen/logrus"
 )
 
 // EndpointConfig covers the optional configuration parameters for an active
@@ -19,6 +21,17 @@ type EndpointConfig struct {
 	IgnoredMediaTypes []string
 	Transport         *http.Transport `json:"-"`
 	Ignore            configuration.Ignore
+	Filter            configuration.Filter
+	Retry             configuration.Retry
+	DeadLetter        configuration.DeadLetter
+	QueueSize         int
+	Deduplication     configuration.Deduplication
+	// Concurrency is the number of events of an http endpoint delivered at
+	// once. The events of a repository are delivered one at a time, in
+	// order.
+	Concurrency int
+	// SigningSecrets sign the requests of http endpoints, if any.
+	SigningSecrets [][]byte `json:"-"`
 }
 
 // defaults set any zero-valued fields to a reasonable default.
@@ -35,8 +48,12 @@ func (ec *EndpointConfig) defaults() {
 		ec.Backoff = time.Second
 	}
 
+	if ec.Concurrency <= 0 {
+		ec.Concurrency = 1
+	}
+
 	if ec.Transport == nil {
-		ec.Transport = http.DefaultTransport.(*http.Transport)
+		ec.Transport = NewTransport(configuration.EndpointTransport{}, ec.Concurrency)
 	}
 }
 
@@ -50,29 +67,76 @@ type Endpoint struct {
 
 	EndpointConfig
 
-	metrics *safeMetrics
+	metrics    *safeMetrics
+	deadLetter *deadLetterSink
 }
 
 // NewEndpoint returns a running endpoint, ready to receive events.
 func NewEndpoint(name, url string, config EndpointConfig) *Endpoint {
+	endpoint := newEndpoint(name, url, config)
+
+	// Configures the inmemory queue, retry, http pipeline.
+	sink := newHTTPSink(
+		endpoint.url, endpoint.Timeout, endpoint.Headers,
+		endpoint.Transport, endpoint.metrics.httpStatusListener())
+	sink.secrets = endpoint.SigningSecrets
+	endpoint.run(sink, 1, endpoint.Concurrency)
+
+	return endpoint
+}
+
+func newEndpoint(name, url string, config EndpointConfig) *Endpoint {
 	var endpoint Endpoint
 	endpoint.name = name
 	endpoint.url = url
 	endpoint.EndpointConfig = config
 	endpoint.defaults()
 	endpoint.metrics = newSafeMetrics(name)
+	return &endpoint
+}
 
-	// Configures the inmemory queue, retry, http pipeline.
-	endpoint.Sink = newHTTPSink(
-		endpoint.url, endpoint.Timeout, endpoint.Headers,
-		endpoint.Transport, endpoint.metrics.httpStatusListener())
-	endpoint.Sink = events.NewRetryingSink(endpoint.Sink, events.NewBreaker(endpoint.Threshold, endpoint.Backoff))
-	endpoint.Sink = newEventQueue(endpoint.Sink, endpoint.metrics.eventQueueListener())
-	mediaTypes := append(config.Ignore.MediaTypes, config.IgnoredMediaTypes...)
-	endpoint.Sink = newIgnoredSink(endpoint.Sink, mediaTypes, config.Ignore.Actions)
+// run configures the filter, deduplication, inmemory queue and retry in
+// front of the sink, and registers the endpoint. The queue writes up to
+// batchSize events at once, with up to concurrency writes in flight, each
+// retried on its own.
+func (e *Endpoint) run(sink events.Sink, batchSize, concurrency int) {
+	e.deadLetter = newDeadLetterSink(e)
+	// The retry strategies count the attempts of the event they retry, so
+	// each concurrent write has its own.
+	writers := make([]events.Sink, max(concurrency, 1))
+	for i := range writers {
+		writers[i] = events.NewRetryingSink(sink, newRetryStrategy(e.EndpointConfig, e.deadLetter))
+	}
+	queue := newConcurrentEventQueue(writers, batchSize, e.metrics.eventQueueListener())
+	// Events overflowing a bounded queue are dead-lettered, so that a
+	// failing endpoint does not hold an unbounded backlog.
+	queue.maxLen = e.QueueSize
+	queue.overflow = func(event events.Event) {
+		e.deadLetter.write(event, 0, errQueueFull)
+	}
+	e.Sink = queue
+	e.Sink = newDedupSink(e.Sink, e.Deduplication, e.metrics)
 
-	register(&endpoint)
-	return &endpoint
+	// Events are filtered before they are queued, so that ignored events
+	// are never retried.
+	filter := e.Filter
+	filter.MediaTypes.Exclude = slices.Concat(filter.MediaTypes.Exclude, e.Ignore.MediaTypes, e.IgnoredMediaTypes)
+	filter.Actions.Exclude = slices.Concat(filter.Actions.Exclude, e.Ignore.Actions)
+	e.Sink = newFilteredSink(e.Sink, filter)
+
+	register(e)
+}
+
+// Close closes the endpoint, and its dead-letter endpoint, if any.
+func (e *Endpoint) Close() error {
+	err := e.Sink.Close()
+	unregister(e)
+	if e.deadLetter.endpoint != nil {
+		if err := e.deadLetter.endpoint.Close(); err != nil {
+			logrus.Errorf("notifications: error closing the dead-letter endpoint of %s: %v", e.name, err)
+		}
+	}
+	return err
 }
 
 // Name returns the name of the endpoint, generally used for debugging.
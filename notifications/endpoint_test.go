@@ -0,0 +1,198 @@
+package notifications
+
+import (
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"slices"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/distribution/distribution/v3/configuration"
+	v1 "github.com/opencontainers/image-spec/specs-go/v1"
+)
+
+// unregisterTestEndpoints unregisters the endpoints created by the test from
+// the expvar metrics once it completes.
+func unregisterTestEndpoints(t *testing.T) {
+	endpoints.mu.Lock()
+	registered := endpoints.registered
+	endpoints.mu.Unlock()
+	t.Cleanup(func() {
+		endpoints.mu.Lock()
+		endpoints.registered = registered
+		endpoints.mu.Unlock()
+	})
+}
+
+// TestEndpointFilter checks that only the events matching the filter of an
+// endpoint reach it, and that the others are not queued.
+func TestEndpointFilter(t *testing.T) {
+	var (
+		mu           sync.Mutex
+		repositories []string
+	)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var envelope struct {
+			Events []Event `json:"events"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&envelope); err != nil {
+			t.Errorf("error decoding envelope: %v", err)
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		mu.Lock()
+		for _, event := range envelope.Events {
+			repositories = append(repositories, event.Action+" "+event.Target.Repository)
+		}
+		mu.Unlock()
+	}))
+	defer server.Close()
+
+	unregisterTestEndpoints(t)
+	endpoint := NewEndpoint("filtered", server.URL, EndpointConfig{
+		Filter: configuration.Filter{
+			Repositories: configuration.FilterList{Include: []string{"prod/*"}},
+			Actions:      configuration.FilterList{Include: []string{"push"}},
+		},
+		Ignore: configuration.Ignore{MediaTypes: []string{"application/octet-stream"}},
+	})
+	defer endpoint.Close()
+
+	for _, event := range []Event{
+		createTestEvent("push", "prod/app", v1.MediaTypeImageManifest),
+		createTestEvent("push", "prod/app", "application/octet-stream"),
+		createTestEvent("pull", "prod/app", v1.MediaTypeImageManifest),
+		createTestEvent("push", "dev/app", v1.MediaTypeImageManifest),
+		createTestEvent("push", "prod/api", v1.MediaTypeImageManifest),
+	} {
+		if err := endpoint.Write(event); err != nil {
+			t.Fatalf("error writing event: %v", err)
+		}
+	}
+
+	var metrics EndpointMetrics
+	deadline := time.Now().Add(5 * time.Second)
+	for endpoint.ReadMetrics(&metrics); metrics.Successes < 2; endpoint.ReadMetrics(&metrics) {
+		if time.Now().After(deadline) {
+			t.Fatalf("events were not delivered: %+v", metrics)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if metrics.Events != 2 {
+		t.Fatalf("expected the ignored events not to be queued: %+v", metrics)
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+	if !slices.Equal(repositories, []string{"push prod/app", "push prod/api"}) {
+		t.Fatalf("unexpected events %q", repositories)
+	}
+}
+
+// TestEndpointConcurrency checks that the events of an endpoint are delivered
+// concurrently, over connections kept alive, and that the events of each
+// repository are delivered one at a time, in order.
+func TestEndpointConcurrency(t *testing.T) {
+	const (
+		concurrency  = 4
+		repositories = 4
+		perRepo      = 5
+		delay        = 50 * time.Millisecond
+	)
+	var (
+		mu          sync.Mutex
+		delivered   = map[string][]string{}
+		inFlight    = map[string]int{}
+		active      int
+		maxActive   int
+		connections int
+	)
+	server := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var envelope struct {
+			Events []Event `json:"events"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&envelope); err != nil {
+			t.Errorf("error decoding envelope: %v", err)
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		repository := envelope.Events[0].Target.Repository
+
+		mu.Lock()
+		if inFlight[repository]++; inFlight[repository] > 1 {
+			t.Errorf("events of %s delivered concurrently", repository)
+		}
+		active++
+		maxActive = max(maxActive, active)
+		mu.Unlock()
+
+		time.Sleep(delay)
+
+		mu.Lock()
+		inFlight[repository]--
+		active--
+		delivered[repository] = append(delivered[repository], envelope.Events[0].Target.Tag)
+		mu.Unlock()
+	}))
+	server.Config.ConnState = func(conn net.Conn, state http.ConnState) {
+		if state == http.StateNew {
+			mu.Lock()
+			connections++
+			mu.Unlock()
+		}
+	}
+	server.Start()
+	defer server.Close()
+
+	unregisterTestEndpoints(t)
+	endpoint := NewEndpoint("concurrent", server.URL, EndpointConfig{Concurrency: concurrency})
+	defer endpoint.Close()
+
+	start := time.Now()
+	for i := range perRepo {
+		for r := range repositories {
+			event := createTestEvent("push", fmt.Sprintf("library/app%d", r), v1.MediaTypeImageManifest)
+			event.Target.Tag = strconv.Itoa(i)
+			if err := endpoint.Write(event); err != nil {
+				t.Fatalf("error writing event: %v", err)
+			}
+		}
+	}
+
+	var metrics EndpointMetrics
+	deadline := time.Now().Add(10 * time.Second)
+	for endpoint.ReadMetrics(&metrics); metrics.Successes < repositories*perRepo; endpoint.ReadMetrics(&metrics) {
+		if time.Now().After(deadline) {
+			t.Fatalf("events were not delivered: %+v", metrics)
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+	elapsed := time.Since(start)
+	if metrics.Pending != 0 || metrics.InFlight != 0 {
+		t.Fatalf("expected no event pending or in flight: %+v", metrics)
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+	if serial := repositories * perRepo * delay; elapsed >= serial {
+		t.Fatalf("delivering the events took %v, no faster than one at a time (%v)", elapsed, serial)
+	}
+	if maxActive < 2 || maxActive > concurrency {
+		t.Fatalf("expected between 2 and %d events delivered at once, got %d", concurrency, maxActive)
+	}
+	if connections >= repositories*perRepo {
+		t.Fatalf("expected the connections to be kept alive, got %d for %d events", connections, repositories*perRepo)
+	}
+	want := []string{"0", "1", "2", "3", "4"}
+	for r := range repositories {
+		repository := fmt.Sprintf("library/app%d", r)
+		if !slices.Equal(delivered[repository], want) {
+			t.Fatalf("events of %s delivered out of order: %q", repository, delivered[repository])
+		}
+	}
+}
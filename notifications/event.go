@@ -5,6 +5,7 @@ import (
 	"time"
 
 	events "github.com/docker/go-events"
+	"github.com/opencontainers/go-digest"
 	v1 "github.com/opencontainers/image-spec/specs-go/v1"
 )
 
@@ -14,6 +15,23 @@ const (
 	EventActionPush   = "push"
 	EventActionMount  = "mount"
 	EventActionDelete = "delete"
+
+	// EventActionPullThroughMiss is the action of the events of the
+	// manifests a pull through cache fetched from its upstream.
+	EventActionPullThroughMiss = "pull-through.miss"
+
+	// EventActionBlobCorrupt is the action of the events of the blobs whose
+	// content was found not to match their digest when they were served.
+	EventActionBlobCorrupt = "blob.corrupt"
+
+	// EventActionRename is the action of the events of the repositories
+	// renamed through the admin API.
+	EventActionRename = "rename"
+
+	// EventActionTagDelete is the action of the events of the tags deleted,
+	// by their own deletion or by the deletion of their manifest, whose
+	// delete event does not report them.
+	EventActionTagDelete = "tag.delete"
 )
 
 const (
@@ -64,7 +82,7 @@ type Event struct {
 		Repository string `json:"repository,omitempty"`
 
 		// FromRepository identifies the named repository which a blob was mounted
-		// from if appropriate.
+		// from, or the previous name of a renamed repository, if appropriate.
 		FromRepository string `json:"fromRepository,omitempty"`
 
 		// URL provides a direct link to the content.
@@ -73,10 +91,27 @@ type Event struct {
 		// Tag provides the tag
 		Tag string `json:"tag,omitempty"`
 
+		// Tags provides the tags removed by the deletion of a manifest, if
+		// they are reported in its delete event.
+		Tags []string `json:"tags,omitempty"`
+
 		// References provides the references descriptors.
 		References []v1.Descriptor `json:"references,omitempty"`
+
+		// Labels provides the labels of the image configuration of a pushed
+		// manifest, if annotations are included in the events. Its
+		// annotations are those of the descriptor.
+		Labels map[string]string `json:"labels,omitempty"`
+
+		// ActualDigest is the digest of the content read, for the events of
+		// the blobs found corrupted.
+		ActualDigest digest.Digest `json:"actualDigest,omitempty"`
 	} `json:"target"`
 
+	// Upstream describes the fetch from the upstream of a pull through
+	// cache, for its events.
+	Upstream *UpstreamRecord `json:"upstream,omitempty"`
+
 	// Request covers the request that generated the event.
 	Request RequestRecord `json:"request"`
 
@@ -143,6 +178,19 @@ type SourceRecord struct {
 	InstanceID string `json:"instanceID,omitempty"`
 }
 
+// UpstreamRecord describes a fetch from the upstream registry of a pull
+// through cache.
+type UpstreamRecord struct {
+	// Host is the host of the upstream registry.
+	Host string `json:"host"`
+
+	// Bytes is the number of bytes fetched from the upstream.
+	Bytes int64 `json:"bytes"`
+
+	// Duration is the time taken by the fetch, in seconds.
+	Duration float64 `json:"duration"`
+}
+
 // ErrSinkClosed is returned if a write is issued to a sink that has been
 // closed. If encountered, the error should be considered terminal and
 // retries will not be successful.
@@ -4,14 +4,18 @@ import (
 	"bytes"
 	"encoding/json"
 	"fmt"
+	"net"
 	"net/http"
+	"strconv"
 	"sync"
 	"time"
 
+	"github.com/distribution/distribution/v3/configuration"
 	events "github.com/docker/go-events"
 )
 
-// httpSink implements a single-flight, http notification endpoint. This is
+// httpSink implements an http notification endpoint, which may be written
+// concurrently, keeping its connections alive between the requests. This is
 // very lightweight in that it only makes an attempt at an http request.
 // Reliability should be provided by the caller.
 type httpSink struct {
@@ -21,13 +25,15 @@ type httpSink struct {
 	closed    bool
 	client    *http.Client
 	listeners []httpStatusListener
+	// secrets sign the requests, if any.
+	secrets [][]byte
 
 	// TODO(stevvooe): Allow one to configure the media type accepted by this
 	// sink and choose the serialization based on that.
 }
 
-// newHTTPSink returns an unreliable, single-flight http sink. Wrap in other
-// sinks for increased reliability.
+// newHTTPSink returns an unreliable http sink. Wrap in other sinks for
+// increased reliability. The timeout bounds each request.
 func newHTTPSink(u string, timeout time.Duration, headers http.Header, transport *http.Transport, listeners ...httpStatusListener) *httpSink {
 	if transport == nil {
 		transport = http.DefaultTransport.(*http.Transport)
@@ -57,10 +63,10 @@ type httpStatusListener interface {
 // accepted or rejected as a group.
 func (hs *httpSink) Write(event events.Event) error {
 	hs.mu.Lock()
-	defer hs.mu.Unlock()
-	defer hs.client.Transport.(*headerRoundTripper).CloseIdleConnections()
+	closed := hs.closed
+	hs.mu.Unlock()
 
-	if hs.closed {
+	if closed {
 		return ErrSinkClosed
 	}
 
@@ -80,8 +86,21 @@ func (hs *httpSink) Write(event events.Event) error {
 		return fmt.Errorf("%v: error marshaling event envelope: %v", hs, err)
 	}
 
-	body := bytes.NewReader(p)
-	resp, err := hs.client.Post(hs.url, EventsMediaType, body)
+	req, err := http.NewRequest(http.MethodPost, hs.url, bytes.NewReader(p))
+	if err != nil {
+		for _, listener := range hs.listeners {
+			listener.err(err, event)
+		}
+		return fmt.Errorf("%v: error creating request: %v", hs, err)
+	}
+	req.Header.Set("Content-Type", EventsMediaType)
+	if len(hs.secrets) > 0 {
+		timestamp := strconv.FormatInt(time.Now().Unix(), 10)
+		req.Header.Set(SignatureTimestampHeader, timestamp)
+		req.Header.Set(SignatureHeader, signPayload(hs.secrets, timestamp, p))
+	}
+
+	resp, err := hs.client.Do(req)
 	if err != nil {
 		for _, listener := range hs.listeners {
 			listener.err(err, event)
@@ -122,6 +141,7 @@ func (hs *httpSink) Close() error {
 	}
 
 	hs.closed = true
+	hs.client.Transport.(*headerRoundTripper).CloseIdleConnections()
 	return nil
 }
 
@@ -129,6 +149,25 @@ func (hs *httpSink) String() string {
 	return fmt.Sprintf("httpSink{%s}", hs.url)
 }
 
+// NewTransport returns the transport of an http endpoint, with the keep-alive
+// and idle connections of the configuration, keeping enough idle connections
+// to the endpoint for its concurrent requests.
+func NewTransport(config configuration.EndpointTransport, concurrency int) *http.Transport {
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	if config.KeepAlive != 0 {
+		transport.DialContext = (&net.Dialer{
+			Timeout:   30 * time.Second,
+			KeepAlive: config.KeepAlive,
+		}).DialContext
+	}
+	transport.MaxIdleConnsPerHost = max(config.MaxIdleConns, concurrency, http.DefaultMaxIdleConnsPerHost)
+	transport.MaxIdleConns = max(transport.MaxIdleConns, transport.MaxIdleConnsPerHost)
+	if config.IdleConnTimeout > 0 {
+		transport.IdleConnTimeout = config.IdleConnTimeout
+	}
+	return transport
+}
+
 type headerRoundTripper struct {
 	*http.Transport // must be transport to support CancelRequest
 	headers         http.Header
@@ -12,7 +12,9 @@ import (
 	"strconv"
 	"strings"
 	"testing"
+	"time"
 
+	"github.com/distribution/distribution/v3/configuration"
 	"github.com/distribution/distribution/v3/manifest/schema2"
 	events "github.com/docker/go-events"
 )
@@ -207,3 +209,19 @@ func createTestEvent(action, repo, typ string) Event {
 
 	return *event
 }
+
+func TestNewTransport(t *testing.T) {
+	transport := NewTransport(configuration.EndpointTransport{}, 1)
+	if transport == http.DefaultTransport || transport.MaxIdleConnsPerHost != http.DefaultMaxIdleConnsPerHost {
+		t.Fatalf("unexpected default transport %+v", transport)
+	}
+
+	transport = NewTransport(configuration.EndpointTransport{
+		KeepAlive:       time.Minute,
+		MaxIdleConns:    8,
+		IdleConnTimeout: 5 * time.Minute,
+	}, 16)
+	if transport.MaxIdleConnsPerHost != 16 || transport.IdleConnTimeout != 5*time.Minute {
+		t.Fatalf("unexpected transport %+v", transport)
+	}
+}
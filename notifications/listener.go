@@ -2,8 +2,10 @@ package notifications
 
 import (
 	"context"
+	"errors"
 	"io"
 	"net/http"
+	"slices"
 
 	"github.com/distribution/distribution/v3"
 
@@ -18,6 +20,9 @@ type ManifestListener interface {
 	ManifestPushed(repo reference.Named, sm distribution.Manifest, options ...distribution.ManifestServiceOption) error
 	ManifestPulled(repo reference.Named, sm distribution.Manifest, options ...distribution.ManifestServiceOption) error
 	ManifestDeleted(repo reference.Named, dgst digest.Digest) error
+	// TaggedManifestDeleted is called instead of ManifestDeleted when the
+	// deletion of the manifest removes its tags.
+	TaggedManifestDeleted(repo reference.Named, dgst digest.Digest, tags []string) error
 }
 
 // BlobListener describes a listener that can respond to layer related events.
@@ -30,8 +35,21 @@ type BlobListener interface {
 
 // RepoListener provides repository methods that respond to repository lifecycle
 type RepoListener interface {
-	TagDeleted(repo reference.Named, tag string) error
+	TagDeleted(repo reference.Named, tag string, dgst digest.Digest) error
 	RepoDeleted(repo reference.Named) error
+	RepoRenamed(repo, fromRepo reference.Named) error
+}
+
+// ProxyListener describes a listener that can respond to the events of a pull
+// through cache.
+type ProxyListener interface {
+	PullThroughMissed(repo reference.Named, desc v1.Descriptor, tag string, upstream UpstreamRecord) error
+}
+
+// IntegrityListener describes a listener that can respond to the blobs found
+// corrupted. The listeners implementing it are notified by Listen.
+type IntegrityListener interface {
+	BlobCorrupted(repo reference.Named, desc v1.Descriptor, actual digest.Digest) error
 }
 
 // Listener combines all repository events into a single interface.
@@ -62,6 +80,20 @@ func Listen(repo distribution.Repository, remover distribution.RepositoryRemover
 		}
 }
 
+type deletedTagsKey struct{}
+
+// WithDeletedTags returns a context passing the tags removed by the deletion
+// of a manifest by digest, which are reported with the deletion of the
+// manifest rather than by the untag of each tag with the context.
+func WithDeletedTags(ctx context.Context, tags []string) context.Context {
+	return context.WithValue(ctx, deletedTagsKey{}, tags)
+}
+
+func deletedTags(ctx context.Context) []string {
+	tags, _ := ctx.Value(deletedTagsKey{}).([]string)
+	return tags
+}
+
 func (nl *removerListener) Remove(ctx context.Context, name reference.Named) error {
 	err := nl.RepositoryRemover.Remove(ctx, name)
 	if err != nil {
@@ -96,7 +128,12 @@ type manifestServiceListener struct {
 func (msl *manifestServiceListener) Delete(ctx context.Context, dgst digest.Digest) error {
 	err := msl.ManifestService.Delete(ctx, dgst)
 	if err == nil {
-		if err := msl.parent.listener.ManifestDeleted(msl.parent.Repository.Named(), dgst); err != nil {
+		if tags := deletedTags(ctx); len(tags) > 0 {
+			err := msl.parent.listener.TaggedManifestDeleted(msl.parent.Repository.Named(), dgst, tags)
+			if err != nil {
+				dcontext.GetLogger(ctx).Errorf("error dispatching manifest delete to listener: %v", err)
+			}
+		} else if err := msl.parent.listener.ManifestDeleted(msl.parent.Repository.Named(), dgst); err != nil {
 			dcontext.GetLogger(ctx).Errorf("error dispatching manifest delete to listener: %v", err)
 		}
 	}
@@ -127,6 +164,16 @@ func (msl *manifestServiceListener) Put(ctx context.Context, sm distribution.Man
 	return dgst, err
 }
 
+// Referrers lists the referrers of the manifest service, if it lists them,
+// without dispatching any event.
+func (msl *manifestServiceListener) Referrers(ctx context.Context, subject digest.Digest, artifactType string) ([]v1.Descriptor, error) {
+	lister, ok := msl.ManifestService.(distribution.ReferrersLister)
+	if !ok {
+		return nil, distribution.ErrUnsupported
+	}
+	return lister.Referrers(ctx, subject, artifactType)
+}
+
 type blobServiceListener struct {
 	distribution.BlobStore
 	parent *repositoryListener
@@ -166,6 +213,16 @@ func (bsl *blobServiceListener) Open(ctx context.Context, dgst digest.Digest) (i
 
 func (bsl *blobServiceListener) ServeBlob(ctx context.Context, w http.ResponseWriter, r *http.Request, dgst digest.Digest) error {
 	err := bsl.BlobStore.ServeBlob(ctx, w, r, dgst)
+	var corrupted distribution.ErrBlobCorrupted
+	if errors.As(err, &corrupted) && corrupted.Actual != "" {
+		if il, ok := bsl.parent.listener.(IntegrityListener); ok {
+			if desc, err := bsl.Stat(context.WithoutCancel(ctx), dgst); err != nil {
+				dcontext.GetLogger(ctx).Errorf("error resolving descriptor in ServeBlob listener: %v", err)
+			} else if err := il.BlobCorrupted(bsl.parent.Repository.Named(), desc, corrupted.Actual); err != nil {
+				dcontext.GetLogger(ctx).Errorf("error dispatching blob corruption to listener: %v", err)
+			}
+		}
+	}
 	if err == nil {
 		// Use a detached context for Stat() since the HTTP request context may be canceled
 		// after ServeBlob completes, but we still want to send the notification.
@@ -243,6 +300,16 @@ func (bwl *blobWriterListener) Commit(ctx context.Context, desc v1.Descriptor) (
 	return committed, err
 }
 
+// SessionOffset returns the offset of the session persisted of the upload, if
+// the writer persists one.
+func (bwl *blobWriterListener) SessionOffset() (int64, bool) {
+	session, ok := bwl.BlobWriter.(interface{ SessionOffset() (int64, bool) })
+	if !ok {
+		return 0, false
+	}
+	return session.SessionOffset()
+}
+
 type tagServiceListener struct {
 	distribution.TagService
 	parent *repositoryListener
@@ -256,12 +323,41 @@ func (rl *repositoryListener) Tags(ctx context.Context) distribution.TagService
 }
 
 func (tagSL *tagServiceListener) Untag(ctx context.Context, tag string) error {
+	if slices.Contains(deletedTags(ctx), tag) {
+		// The tag is reported with the deletion of its manifest.
+		return tagSL.TagService.Untag(ctx, tag)
+	}
+	// The digest the tag pointed to is reported with its deletion.
+	desc, err := tagSL.TagService.Get(ctx, tag)
+	if err != nil {
+		return err
+	}
 	if err := tagSL.TagService.Untag(ctx, tag); err != nil {
 		return err
 	}
-	if err := tagSL.parent.listener.TagDeleted(tagSL.parent.Repository.Named(), tag); err != nil {
+	if err := tagSL.parent.listener.TagDeleted(tagSL.parent.Repository.Named(), tag, desc.Digest); err != nil {
 		dcontext.GetLogger(ctx).Errorf("error dispatching tag deleted to listener: %v", err)
 		return err
 	}
 	return nil
 }
+
+// ListDetails lists the tag details of the tag service, if it lists them,
+// without dispatching any event.
+func (tagSL *tagServiceListener) ListDetails(ctx context.Context, limit int, last string) ([]distribution.TagDetail, error) {
+	lister, ok := tagSL.TagService.(distribution.TagDetailLister)
+	if !ok {
+		return nil, distribution.ErrUnsupported
+	}
+	return lister.ListDetails(ctx, limit, last)
+}
+
+// History returns the tag history of the tag service, if it provides it,
+// without dispatching any event.
+func (tagSL *tagServiceListener) History(ctx context.Context, tag string) ([]distribution.TagHistoryEntry, error) {
+	provider, ok := tagSL.TagService.(distribution.TagHistoryProvider)
+	if !ok {
+		return nil, distribution.ErrUnsupported
+	}
+	return provider.History(ctx, tag)
+}
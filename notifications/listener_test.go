@@ -3,6 +3,8 @@ package notifications
 import (
 	"bytes"
 	"reflect"
+	"slices"
+	"sync"
 	"testing"
 
 	"github.com/distribution/distribution/v3"
@@ -13,6 +15,7 @@ import (
 	"github.com/distribution/distribution/v3/registry/storage/driver/inmemory"
 	"github.com/distribution/distribution/v3/testutil"
 	"github.com/distribution/reference"
+	events "github.com/docker/go-events"
 	"github.com/opencontainers/go-digest"
 	"github.com/opencontainers/image-spec/specs-go"
 	v1 "github.com/opencontainers/image-spec/specs-go/v1"
@@ -101,7 +104,13 @@ func (tl *testListener) BlobDeleted(repo reference.Named, d digest.Digest) error
 	return nil
 }
 
-func (tl *testListener) TagDeleted(repo reference.Named, tag string) error {
+func (tl *testListener) TaggedManifestDeleted(repo reference.Named, d digest.Digest, tags []string) error {
+	tl.ops["manifest:delete"]++
+	tl.ops["tag:delete"] += len(tags)
+	return nil
+}
+
+func (tl *testListener) TagDeleted(repo reference.Named, tag string, d digest.Digest) error {
 	tl.ops["tag:delete"]++
 	return nil
 }
@@ -111,6 +120,11 @@ func (tl *testListener) RepoDeleted(repo reference.Named) error {
 	return nil
 }
 
+func (tl *testListener) RepoRenamed(repo, fromRepo reference.Named) error {
+	tl.ops["repo:rename"]++
+	return nil
+}
+
 // checkTestRepository takes the registry through all of its operations,
 // carrying out generic checks.
 func checkTestRepository(t *testing.T, repository distribution.Repository, remover distribution.RepositoryRemover) {
@@ -232,3 +246,110 @@ func checkTestRepository(t *testing.T, repository distribution.Repository, remov
 		t.Fatalf("unexpected error deleting repo: %v", err)
 	}
 }
+
+// eventRecorder is an in-memory sink recording the events written to it.
+type eventRecorder struct {
+	mu     sync.Mutex
+	events []Event
+}
+
+func (r *eventRecorder) Write(event events.Event) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.events = append(r.events, event.(Event))
+	return nil
+}
+
+func (r *eventRecorder) Close() error {
+	return nil
+}
+
+func TestGarbageCollectionEvents(t *testing.T) {
+	ctx := dcontext.Background()
+	driver := inmemory.New()
+	registry, err := storage.NewRegistry(ctx, driver, storage.EnableDelete)
+	if err != nil {
+		t.Fatalf("error creating registry: %v", err)
+	}
+	repoRef, _ := reference.WithName("foo/bar")
+	repository, err := registry.Repository(ctx, repoRef)
+	if err != nil {
+		t.Fatalf("unexpected error getting repo: %v", err)
+	}
+
+	// A manifest tagged then untagged, which garbage collection deletes
+	// along with its layer links.
+	m := schema2.Manifest{
+		Versioned: specs.Versioned{SchemaVersion: 2},
+		MediaType: schema2.MediaTypeManifest,
+	}
+	config := []byte(`{"name": "foo"}`)
+	m.Config = v1.Descriptor{MediaType: "foo/bar", Digest: digest.FromBytes(config)}
+	if err := testutil.PushBlob(ctx, repository, bytes.NewReader(config), m.Config.Digest); err != nil {
+		t.Fatal(err)
+	}
+	for range 2 {
+		rs, dgst, err := testutil.CreateRandomTarFile()
+		if err != nil {
+			t.Fatalf("error creating test layer: %v", err)
+		}
+		if err := testutil.PushBlob(ctx, repository, rs, dgst); err != nil {
+			t.Fatal(err)
+		}
+		m.Layers = append(m.Layers, v1.Descriptor{MediaType: "application/octet-stream", Digest: dgst})
+	}
+	sm, err := schema2.FromStruct(m)
+	if err != nil {
+		t.Fatal(err)
+	}
+	manifests, err := repository.Manifests(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	dgst, err := manifests.Put(ctx, sm)
+	if err != nil {
+		t.Fatalf("unexpected error putting the manifest: %v", err)
+	}
+	if err := repository.Tags(ctx).Tag(ctx, "latest", v1.Descriptor{Digest: dgst}); err != nil {
+		t.Fatal(err)
+	}
+	if err := repository.Tags(ctx).Untag(ctx, "latest"); err != nil {
+		t.Fatal(err)
+	}
+
+	recorder := &eventRecorder{}
+	broadcaster := events.NewBroadcaster(recorder)
+	listener := NewBridge(ub, source, ActorRecord{Name: "garbage-collector"}, RequestRecord{}, broadcaster, false, "")
+	report, err := storage.GarbageCollect(ctx, driver, registry, storage.GCOpts{RemoveUntagged: true, Quiet: true, Listener: listener})
+	if err != nil {
+		t.Fatalf("failed to garbage collect: %v", err)
+	}
+	if err := broadcaster.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	var expected []string
+	for _, r := range report.Repositories {
+		for _, m := range r.Manifests {
+			expected = append(expected, r.Name+"@"+m.Digest.String())
+		}
+		for _, blob := range r.Blobs {
+			expected = append(expected, r.Name+"@"+blob.Digest.String())
+		}
+	}
+	if len(expected) != 1+len(m.Layers)+1 {
+		t.Fatalf("unexpected deletions %v", expected)
+	}
+	var notified []string
+	for _, event := range recorder.events {
+		if event.Action != EventActionDelete || event.Actor.Name != "garbage-collector" || event.Source != source {
+			t.Fatalf("unexpected event %+v", event)
+		}
+		notified = append(notified, event.Target.Repository+"@"+event.Target.Digest.String())
+	}
+	slices.Sort(expected)
+	slices.Sort(notified)
+	if !slices.Equal(notified, expected) {
+		t.Fatalf("events %v, expected the deletions %v", notified, expected)
+	}
+}
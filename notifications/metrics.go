@@ -16,6 +16,8 @@ var (
 	eventsCounter = prometheus.NotificationsNamespace.NewLabeledCounter("events", "The number of total events", "type", "endpoint")
 	// pendingGauge measures the pending queue size
 	pendingGauge = prometheus.NotificationsNamespace.NewLabeledGauge("pending", "The gauge of pending events in queue", metrics.Total, "endpoint")
+	// inFlightGauge measures the events being delivered
+	inFlightGauge = prometheus.NotificationsNamespace.NewLabeledGauge("inflight", "The gauge of events being delivered", metrics.Total, "endpoint")
 	// statusCounter counts the total notification call per each status code
 	statusCounter = prometheus.NotificationsNamespace.NewLabeledCounter("status", "The number of status code", "code", "endpoint")
 )
@@ -79,12 +81,15 @@ func init() {
 // number of events. The goal of this to export it via expvar but we may find
 // some other future solution to be better.
 type EndpointMetrics struct {
-	Pending   int            // events pending in queue
-	Events    int            // total events incoming
-	Successes int            // total events written successfully
-	Failures  int            // total events failed
-	Errors    int            // total events errored
-	Statuses  map[string]int // status code histogram, per call event
+	Pending      int            // events pending in queue, including those in flight
+	InFlight     int            // events being delivered
+	Events       int            // total events incoming
+	Successes    int            // total events written successfully
+	Failures     int            // total events failed
+	Errors       int            // total events errored
+	DeadLettered int            // total events which exhausted their retries
+	Deduplicated int            // total events suppressed as duplicates
+	Statuses     map[string]int // status code histogram, per call event
 }
 
 // safeMetrics guards the metrics implementation with a lock and provides a
@@ -154,6 +159,24 @@ func (emsl *endpointMetricsHTTPStatusListener) err(err error, event events.Event
 	eventsCounter.WithValues("Errors", emsl.EndpointName).Inc(1)
 }
 
+// deadLettered counts an event which exhausted its retries.
+func (sm *safeMetrics) deadLettered(event events.Event) {
+	sm.Lock()
+	defer sm.Unlock()
+	sm.DeadLettered++
+
+	eventsCounter.WithValues("DeadLettered", sm.EndpointName).Inc(1)
+}
+
+// deduplicated counts an event suppressed as a duplicate.
+func (sm *safeMetrics) deduplicated(event events.Event) {
+	sm.Lock()
+	defer sm.Unlock()
+	sm.Deduplicated++
+
+	eventsCounter.WithValues("Deduplicated", sm.EndpointName).Inc(1)
+}
+
 // endpointMetricsEventQueueListener maintains the incoming events counter and
 // the queues pending count.
 type endpointMetricsEventQueueListener struct {
@@ -170,12 +193,22 @@ func (eqc *endpointMetricsEventQueueListener) ingress(event events.Event) {
 	pendingGauge.WithValues(eqc.EndpointName).Inc(1)
 }
 
+func (eqc *endpointMetricsEventQueueListener) dispatch(event events.Event) {
+	eqc.Lock()
+	defer eqc.Unlock()
+	eqc.InFlight++
+
+	inFlightGauge.WithValues(eqc.EndpointName).Inc(1)
+}
+
 func (eqc *endpointMetricsEventQueueListener) egress(event events.Event) {
 	eqc.Lock()
 	defer eqc.Unlock()
 	eqc.Pending--
+	eqc.InFlight--
 
 	pendingGauge.WithValues(eqc.EndpointName).Dec(1)
+	inFlightGauge.WithValues(eqc.EndpointName).Dec(1)
 }
 
 // register places the endpoint into expvar so that stats are tracked.
@@ -185,3 +218,16 @@ func register(e *Endpoint) {
 
 	endpoints.registered = append(endpoints.registered, e)
 }
+
+// unregister removes the closed endpoint from expvar.
+func unregister(e *Endpoint) {
+	endpoints.mu.Lock()
+	defer endpoints.mu.Unlock()
+
+	for i, registered := range endpoints.registered {
+		if registered == e {
+			endpoints.registered = append(endpoints.registered[:i], endpoints.registered[i+1:]...)
+			return
+		}
+	}
+}
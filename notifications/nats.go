@@ -0,0 +1,366 @@
+package notifications
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/distribution/distribution/v3/configuration"
+	events "github.com/docker/go-events"
+	"github.com/nats-io/nats.go"
+	"github.com/nats-io/nats.go/jetstream"
+	"github.com/nats-io/nkeys"
+	"github.com/sirupsen/logrus"
+)
+
+// EndpointTypeNATS is the type of the NATS endpoints.
+const EndpointTypeNATS = "nats"
+
+const (
+	defaultNATSSubject       = "registry.events.{action}"
+	defaultNATSReconnectWait = 2 * time.Second
+	defaultNATSBufferSize    = 8 * 1024 * 1024
+)
+
+var (
+	// ErrNATSBufferFull is reported for events dropped because the buffer of
+	// a disconnected NATS endpoint is full.
+	ErrNATSBufferFull = nats.ErrReconnectBufExceeded
+
+	errNATSDisconnected = errors.New("nats: disconnected")
+)
+
+// NewNATSEndpoint returns a running endpoint publishing events to the NATS
+// servers, a comma separated list of URLs. It connects in the background,
+// buffering the events until then.
+//
+// The NATS credentials are not part of the EndpointConfig, which is
+// exported with the metrics of the endpoint.
+func NewNATSEndpoint(name, servers string, config EndpointConfig, natsConfig configuration.NATSEndpoint) (*Endpoint, error) {
+	options, err := newNATSOptions(servers, natsConfig)
+	if err != nil {
+		return nil, fmt.Errorf("notifications: endpoint %s: %v", name, err)
+	}
+
+	endpoint := newEndpoint(name, options.String(), config)
+	options.timeout = endpoint.Timeout
+	sink, err := newNATSSink(options, natsConfig.Subject, natsConfig.JetStream, endpoint.metrics.httpStatusListener())
+	if err != nil {
+		return nil, fmt.Errorf("notifications: endpoint %s: %v", name, err)
+	}
+	endpoint.run(sink, 1, 1)
+	return endpoint, nil
+}
+
+// natsSink publishes events to NATS, one message for each event, with the
+// envelope of the event as payload.
+type natsSink struct {
+	conn      *nats.Conn
+	js        jetstream.JetStream
+	options   *natsOptions
+	subject   string
+	listeners []httpStatusListener
+	mu        sync.Mutex
+	closed    bool
+	// buffered are the events published while disconnected, counted once
+	// the connection is established.
+	buffered []events.Event
+}
+
+// newNATSSink returns a sink connecting to the servers in the background.
+func newNATSSink(options *natsOptions, subject string, jetStream bool, listeners ...httpStatusListener) (*natsSink, error) {
+	if subject == "" {
+		subject = defaultNATSSubject
+	}
+	s := &natsSink{
+		options:   options,
+		subject:   subject,
+		listeners: listeners,
+	}
+
+	servers := make([]string, 0, len(options.servers))
+	for _, server := range options.servers {
+		servers = append(servers, server.String())
+	}
+	natsOptions := append([]nats.Option{
+		nats.Name("registry"),
+		nats.Timeout(options.timeout),
+		nats.RetryOnFailedConnect(true),
+		nats.MaxReconnects(-1),
+		nats.ReconnectWait(options.reconnectWait),
+		nats.ReconnectBufSize(options.bufferSize),
+		nats.ConnectHandler(s.connected),
+		nats.ReconnectHandler(s.connected),
+		nats.DisconnectErrHandler(func(_ *nats.Conn, err error) {
+			if err != nil {
+				logrus.Warnf("nats: disconnected from %s, reconnecting: %v", options, err)
+			}
+		}),
+		nats.ErrorHandler(func(_ *nats.Conn, _ *nats.Subscription, err error) {
+			logrus.Errorf("nats: %v", err)
+		}),
+	}, options.auth...)
+	conn, err := nats.Connect(strings.Join(servers, ","), natsOptions...)
+	if err != nil {
+		return nil, err
+	}
+	s.conn = conn
+	if jetStream {
+		if s.js, err = jetstream.New(conn); err != nil {
+			conn.Close()
+			return nil, err
+		}
+	}
+	return s, nil
+}
+
+// connected counts the events buffered while disconnected as successes, as
+// they were sent once connected.
+func (s *natsSink) connected(*nats.Conn) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.closed || len(s.buffered) == 0 {
+		return
+	}
+	logrus.Infof("nats: sent %d events buffered while disconnected", len(s.buffered))
+	for _, event := range s.buffered {
+		for _, listener := range s.listeners {
+			listener.success(http.StatusOK, event)
+		}
+	}
+	s.buffered = nil
+}
+
+// natsSubjectReplacer replaces the characters of repository names which
+// have a meaning in NATS subjects.
+var natsSubjectReplacer = strings.NewReplacer(".", "_", "*", "_", ">", "_", " ", "_")
+
+// subjectFor returns the subject of the event.
+func (s *natsSink) subjectFor(event events.Event) string {
+	var action, repository string
+	if e, ok := event.(Event); ok {
+		action = e.Action
+		repository = natsSubjectReplacer.Replace(e.Target.Repository)
+	}
+	if action == "" {
+		action = "unknown"
+	}
+	if repository == "" {
+		repository = "unknown"
+	}
+	return strings.NewReplacer("{action}", action, "{repository}", repository).Replace(s.subject)
+}
+
+// Write publishes the event. Without JetStream, events are buffered while
+// disconnected, and counted as successes once sent. With JetStream, they
+// must be acknowledged, so they are retried once reconnected.
+func (s *natsSink) Write(event events.Event) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.closed {
+		return ErrSinkClosed
+	}
+
+	p, err := json.Marshal(Envelope{Events: []events.Event{event}})
+	if err != nil {
+		for _, listener := range s.listeners {
+			listener.err(err, event)
+		}
+		return fmt.Errorf("%v: error marshaling event envelope: %v", s, err)
+	}
+	subject := s.subjectFor(event)
+
+	if s.js == nil {
+		buffered := !s.conn.IsConnected()
+		err := s.conn.Publish(subject, p)
+		switch {
+		case errors.Is(err, ErrNATSBufferFull):
+			logrus.Errorf("%v: dropping event: %v", s, err)
+			for _, listener := range s.listeners {
+				listener.err(err, event)
+			}
+			return nil
+		case err != nil:
+			for _, listener := range s.listeners {
+				listener.err(err, event)
+			}
+			return fmt.Errorf("%v: error publishing: %v", s, err)
+		case buffered:
+			s.buffered = append(s.buffered, event)
+		default:
+			for _, listener := range s.listeners {
+				listener.success(http.StatusOK, event)
+			}
+		}
+		return nil
+	}
+
+	status, err := s.request(subject, p)
+	if err != nil {
+		for _, listener := range s.listeners {
+			if status == 0 {
+				listener.err(err, event)
+			} else {
+				listener.failure(status, event)
+			}
+		}
+		return fmt.Errorf("%v: error publishing: %v", s, err)
+	}
+	for _, listener := range s.listeners {
+		listener.success(http.StatusOK, event)
+	}
+	return nil
+}
+
+// request publishes a message to a JetStream stream and waits for its
+// acknowledgement. It returns the status of a rejected message.
+func (s *natsSink) request(subject string, payload []byte) (int, error) {
+	if !s.conn.IsConnected() {
+		return 0, errNATSDisconnected
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), s.options.timeout)
+	defer cancel()
+
+	_, err := s.js.Publish(ctx, subject, payload)
+	var apiErr *jetstream.APIError
+	switch {
+	case err == nil:
+		return 0, nil
+	case errors.Is(err, jetstream.ErrNoStreamResponse):
+		return http.StatusServiceUnavailable, fmt.Errorf("nats: no stream for subject %s", subject)
+	case errors.As(err, &apiErr):
+		status := apiErr.Code
+		if status == 0 {
+			status = http.StatusInternalServerError
+		}
+		return status, err
+	case errors.Is(err, jetstream.ErrInvalidJSAck):
+		return http.StatusInternalServerError, err
+	}
+	return 0, err
+}
+
+// Close the sink to further writes, and the connection, dropping the events
+// buffered.
+func (s *natsSink) Close() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.closed {
+		return fmt.Errorf("natssink: already closed")
+	}
+
+	s.closed = true
+	s.conn.Close()
+	for _, event := range s.buffered {
+		for _, listener := range s.listeners {
+			listener.err(ErrSinkClosed, event)
+		}
+	}
+	s.buffered = nil
+	return nil
+}
+
+func (s *natsSink) String() string {
+	return fmt.Sprintf("natsSink{%s}", s.options)
+}
+
+// natsOptions are the servers and credentials of a NATS connection.
+type natsOptions struct {
+	servers       []*url.URL
+	auth          []nats.Option
+	reconnectWait time.Duration
+	bufferSize    int
+	timeout       time.Duration
+}
+
+func newNATSOptions(servers string, config configuration.NATSEndpoint) (*natsOptions, error) {
+	options := &natsOptions{
+		reconnectWait: config.ReconnectWait,
+		bufferSize:    config.BufferSize,
+		timeout:       time.Second,
+	}
+	if options.reconnectWait <= 0 {
+		options.reconnectWait = defaultNATSReconnectWait
+	}
+	if options.bufferSize <= 0 {
+		options.bufferSize = defaultNATSBufferSize
+	}
+
+	for _, server := range strings.Split(servers, ",") {
+		server = strings.TrimSpace(server)
+		if server == "" {
+			continue
+		}
+		if !strings.Contains(server, "://") {
+			server = "nats://" + server
+		}
+		u, err := url.Parse(server)
+		if err != nil {
+			return nil, fmt.Errorf("invalid nats server url %q: %v", server, err)
+		}
+		if u.Scheme != "nats" && u.Scheme != "tls" {
+			return nil, fmt.Errorf("invalid nats server url %q: unsupported scheme %q", server, u.Scheme)
+		}
+		if u.Port() == "" {
+			u.Host = net.JoinHostPort(u.Hostname(), "4222")
+		}
+		options.servers = append(options.servers, u)
+	}
+	if len(options.servers) == 0 {
+		return nil, errors.New("nats endpoint requires a server url")
+	}
+
+	if config.User != "" || config.Password != "" {
+		options.auth = append(options.auth, nats.UserInfo(config.User, config.Password))
+	}
+	if config.Token != "" {
+		options.auth = append(options.auth, nats.Token(config.Token))
+	}
+	switch {
+	case config.CredsFile != "" && config.NKeyFile != "":
+		return nil, errors.New("nats endpoint cannot have both a nkeyfile and a credsfile")
+	case config.CredsFile != "":
+		// The credentials are read on each connection, so they are only
+		// checked here.
+		p, err := os.ReadFile(config.CredsFile)
+		if err != nil {
+			return nil, err
+		}
+		if _, err := nkeys.ParseDecoratedJWT(p); err != nil {
+			return nil, fmt.Errorf("%s: %v", config.CredsFile, err)
+		}
+		if _, err := nkeys.ParseDecoratedUserNKey(p); err != nil {
+			return nil, fmt.Errorf("%s: %v", config.CredsFile, err)
+		}
+		options.auth = append(options.auth, nats.UserCredentials(config.CredsFile))
+	case config.NKeyFile != "":
+		nkey, err := nats.NkeyOptionFromSeed(config.NKeyFile)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %v", config.NKeyFile, err)
+		}
+		options.auth = append(options.auth, nkey)
+	}
+	return options, nil
+}
+
+// String returns the server URLs, without their credentials.
+func (o *natsOptions) String() string {
+	servers := make([]string, 0, len(o.servers))
+	for _, server := range o.servers {
+		u := *server
+		u.User = nil
+		servers = append(servers, u.String())
+	}
+	return strings.Join(servers, ",")
+}
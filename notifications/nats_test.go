@@ -0,0 +1,377 @@
+package notifications
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/distribution/distribution/v3/configuration"
+	"github.com/nats-io/nats-server/v2/server"
+	natstest "github.com/nats-io/nats-server/v2/test"
+	"github.com/nats-io/nats.go"
+	"github.com/nats-io/nats.go/jetstream"
+	"github.com/nats-io/nkeys"
+	v1 "github.com/opencontainers/image-spec/specs-go/v1"
+)
+
+// runNATSServer runs an in-process NATS server, on a random port unless
+// opts sets one, shut down at the end of the test.
+func runNATSServer(t *testing.T, opts server.Options) *server.Server {
+	t.Helper()
+	if opts.Port == 0 {
+		opts.Port = -1
+	}
+	opts.Host = natstest.DefaultTestOptions.Host
+	opts.NoSigs = true
+	opts.MaxControlLine = natstest.DefaultTestOptions.MaxControlLine
+	opts.DisableShortFirstPing = true
+	s := natstest.RunServer(&opts)
+	t.Cleanup(s.Shutdown)
+	return s
+}
+
+// subscribeNATS returns the messages published to the server, received by a
+// client with the options.
+func subscribeNATS(t *testing.T, s *server.Server, options ...nats.Option) <-chan *nats.Msg {
+	t.Helper()
+	conn, err := nats.Connect(s.ClientURL(), options...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(conn.Close)
+	messages := make(chan *nats.Msg, 100)
+	if _, err := conn.ChanSubscribe(">", messages); err != nil {
+		t.Fatal(err)
+	}
+	if err := conn.Flush(); err != nil {
+		t.Fatal(err)
+	}
+	return messages
+}
+
+func nextNATSMessage(t *testing.T, messages <-chan *nats.Msg) *nats.Msg {
+	t.Helper()
+	select {
+	case message := <-messages:
+		return message
+	case <-time.After(5 * time.Second):
+		t.Fatal("no message was published")
+		return nil
+	}
+}
+
+// newTestNATSSink returns a sink connecting to the servers.
+func newTestNATSSink(t *testing.T, servers string, config configuration.NATSEndpoint, metrics *safeMetrics) *natsSink {
+	t.Helper()
+	options, err := newNATSOptions(servers, config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sink, err := newNATSSink(options, config.Subject, config.JetStream, metrics.httpStatusListener())
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { sink.Close() })
+	return sink
+}
+
+func waitNATS(t *testing.T, condition func() bool) {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for !condition() {
+		if time.Now().After(deadline) {
+			t.Fatal("timeout waiting for the nats connection")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+// newNATSJetStream returns a JetStream client of the server.
+func newNATSJetStream(t *testing.T, s *server.Server) jetstream.JetStream {
+	t.Helper()
+	conn, err := nats.Connect(s.ClientURL())
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(conn.Close)
+	js, err := jetstream.New(conn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return js
+}
+
+// createNATSStream creates the EVENTS stream, capturing the events.
+func createNATSStream(t *testing.T, js jetstream.JetStream) jetstream.Stream {
+	t.Helper()
+	stream, err := js.CreateStream(context.Background(), jetstream.StreamConfig{
+		Name:     "EVENTS",
+		Subjects: []string{"registry.events.>"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return stream
+}
+
+// natsStreamMessages returns the number of messages of the stream.
+func natsStreamMessages(t *testing.T, stream jetstream.Stream) uint64 {
+	t.Helper()
+	info, err := stream.Info(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	return info.State.Msgs
+}
+
+func TestNATSSinkPublish(t *testing.T) {
+	user, err := nkeys.CreateUser()
+	if err != nil {
+		t.Fatal(err)
+	}
+	public, err := user.PublicKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	seed, err := user.Seed()
+	if err != nil {
+		t.Fatal(err)
+	}
+	seedPath := filepath.Join(t.TempDir(), "user.nk")
+	if err := os.WriteFile(seedPath, append(seed, '\n'), 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	// Only the nkey user is authorized.
+	s := runNATSServer(t, server.Options{Nkeys: []*server.NkeyUser{{Nkey: public}}})
+	nkey, err := nats.NkeyOptionFromSeed(seedPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	messages := subscribeNATS(t, s, nkey)
+
+	metrics := newSafeMetrics("nats")
+	sink := newTestNATSSink(t, s.ClientURL(), configuration.NATSEndpoint{NKeyFile: seedPath}, metrics)
+	waitNATS(t, sink.conn.IsConnected)
+
+	event := createTestEvent("push", "library/app", v1.MediaTypeImageManifest)
+	if err := sink.Write(event); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	message := nextNATSMessage(t, messages)
+	if message.Subject != "registry.events.push" {
+		t.Fatalf("unexpected subject %q", message.Subject)
+	}
+	var envelope struct {
+		Events []Event `json:"events"`
+	}
+	if err := json.Unmarshal(message.Data, &envelope); err != nil || len(envelope.Events) != 1 || envelope.Events[0].ID != event.ID {
+		t.Fatalf("unexpected payload %s: %v", message.Data, err)
+	}
+	if metrics.Successes != 1 {
+		t.Fatalf("unexpected metrics: %+v", metrics.EndpointMetrics)
+	}
+}
+
+func TestNATSSinkCredentials(t *testing.T) {
+	// The credentials of the url take precedence over those of the
+	// configuration, which the server does not authorize.
+	s := runNATSServer(t, server.Options{Users: []*server.User{{Username: "frodo", Password: "ring"}}})
+	messages := subscribeNATS(t, s, nats.UserInfo("frodo", "ring"))
+
+	addr := strings.TrimPrefix(s.ClientURL(), "nats://")
+	sink := newTestNATSSink(t, "nats://frodo:ring@"+addr, configuration.NATSEndpoint{
+		User:     "sam",
+		Password: "potatoes",
+		Subject:  "registry.{repository}.{action}",
+	}, newSafeMetrics("nats"))
+	waitNATS(t, sink.conn.IsConnected)
+
+	if err := sink.Write(createTestEvent("delete", "library/app.v2", v1.MediaTypeImageManifest)); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	// The dots of the repository would be tokens of the subject.
+	if message := nextNATSMessage(t, messages); message.Subject != "registry.library/app_v2.delete" {
+		t.Fatalf("unexpected subject %q", message.Subject)
+	}
+
+	// The credentials of the url are not exported with the metrics.
+	if servers := sink.options.String(); servers != "nats://"+addr {
+		t.Fatalf("unexpected servers %q", servers)
+	}
+
+	user, err := nkeys.CreateUser()
+	if err != nil {
+		t.Fatal(err)
+	}
+	seed, err := user.Seed()
+	if err != nil {
+		t.Fatal(err)
+	}
+	dir := t.TempDir()
+	credsPath := filepath.Join(dir, "user.creds")
+	creds := fmt.Sprintf(`-----BEGIN NATS USER JWT-----
+eyJ0eXAiOiJKV1QiLCJhbGciOiJlZDI1NTE5LW5rZXkifQ.e30.c2ln
+------END NATS USER JWT------
+
+************************* IMPORTANT *************************
+NKEY Seed printed below can be used to sign and prove identity.
+
+-----BEGIN USER NKEY SEED-----
+%s
+------END USER NKEY SEED------
+`, seed)
+	if err := os.WriteFile(credsPath, []byte(creds), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := newNATSOptions(addr, configuration.NATSEndpoint{CredsFile: credsPath}); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	invalidPath := filepath.Join(dir, "invalid.creds")
+	if err := os.WriteFile(invalidPath, []byte("not credentials"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	for _, config := range []configuration.NATSEndpoint{
+		{CredsFile: invalidPath},
+		{NKeyFile: invalidPath},
+		{CredsFile: credsPath, NKeyFile: credsPath},
+	} {
+		if _, err := newNATSOptions(addr, config); err == nil {
+			t.Errorf("%+v: expected an error", config)
+		}
+	}
+	for _, servers := range []string{"", "http://localhost:4222"} {
+		if _, err := newNATSOptions(servers, configuration.NATSEndpoint{}); err == nil {
+			t.Errorf("%q: expected an error", servers)
+		}
+	}
+}
+
+func TestNATSSinkJetStream(t *testing.T) {
+	s := runNATSServer(t, server.Options{JetStream: true, StoreDir: t.TempDir()})
+	js := newNATSJetStream(t, s)
+	stream := createNATSStream(t, js)
+
+	metrics := newSafeMetrics("nats")
+	sink := newTestNATSSink(t, s.ClientURL(), configuration.NATSEndpoint{JetStream: true}, metrics)
+	waitNATS(t, sink.conn.IsConnected)
+
+	if err := sink.Write(createTestEvent("push", "library/app", v1.MediaTypeImageManifest)); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if n := natsStreamMessages(t, stream); n != 1 {
+		t.Fatalf("%d messages in the stream, expected 1", n)
+	}
+
+	// Without a stream, the requests have no responders.
+	if err := js.DeleteStream(context.Background(), "EVENTS"); err != nil {
+		t.Fatal(err)
+	}
+	if err := sink.Write(createTestEvent("push", "library/app", v1.MediaTypeImageManifest)); err == nil {
+		t.Fatal("expected an error without stream")
+	}
+	if metrics.Successes != 1 || metrics.Failures != 1 || metrics.Statuses["503 Service Unavailable"] != 1 {
+		t.Fatalf("unexpected metrics: %+v", metrics.EndpointMetrics)
+	}
+
+	// Acknowledged events are not buffered while disconnected.
+	s.Shutdown()
+	waitNATS(t, func() bool { return !sink.conn.IsConnected() })
+	if err := sink.Write(createTestEvent("push", "library/app", v1.MediaTypeImageManifest)); err == nil {
+		t.Fatal("expected an error while disconnected")
+	}
+	if metrics.Errors != 1 {
+		t.Fatalf("unexpected metrics: %+v", metrics.EndpointMetrics)
+	}
+}
+
+func TestNATSSinkReconnect(t *testing.T) {
+	// The stream keeps the messages published before the subscribers
+	// reconnect.
+	opts := server.Options{JetStream: true, StoreDir: t.TempDir()}
+	s := runNATSServer(t, opts)
+	createNATSStream(t, newNATSJetStream(t, s))
+
+	metrics := newSafeMetrics("nats")
+	sink := newTestNATSSink(t, s.ClientURL(), configuration.NATSEndpoint{ReconnectWait: 10 * time.Millisecond}, metrics)
+	waitNATS(t, sink.conn.IsConnected)
+
+	opts.Port = s.Addr().(*net.TCPAddr).Port
+	s.Shutdown()
+	waitNATS(t, func() bool { return !sink.conn.IsConnected() })
+
+	// Events are buffered while disconnected, and sent once reconnected.
+	for _, repo := range []string{"library/a", "library/b"} {
+		if err := sink.Write(createTestEvent("push", repo, v1.MediaTypeImageManifest)); err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+	}
+	if metrics.Successes != 0 {
+		t.Fatalf("buffered events counted as successes: %+v", metrics.EndpointMetrics)
+	}
+
+	s = runNATSServer(t, opts)
+	waitNATS(t, func() bool {
+		metrics.Lock()
+		defer metrics.Unlock()
+		return metrics.Successes == 2
+	})
+	if sink.conn.Stats().Reconnects == 0 {
+		t.Fatal("expected a reconnection")
+	}
+
+	stream, err := newNATSJetStream(t, s).Stream(context.Background(), "EVENTS")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i, repo := range []string{"library/a", "library/b"} {
+		message, err := stream.GetMsg(context.Background(), uint64(i+1))
+		if err != nil {
+			t.Fatal(err)
+		}
+		var envelope Envelope
+		if err := json.Unmarshal(message.Data, &envelope); err != nil || !strings.Contains(string(message.Data), repo) {
+			t.Fatalf("unexpected payload %s: %v", message.Data, err)
+		}
+	}
+}
+
+func TestNATSSinkBufferOverflow(t *testing.T) {
+	// Nothing listens on the address of a stopped server.
+	s := runNATSServer(t, server.Options{})
+	servers := s.ClientURL()
+	s.Shutdown()
+
+	metrics := newSafeMetrics("nats")
+	sink := newTestNATSSink(t, servers, configuration.NATSEndpoint{ReconnectWait: time.Hour, BufferSize: 4096}, metrics)
+
+	var written int
+	for i := 0; i < 20; i++ {
+		if err := sink.Write(createTestEvent("push", "library/app", v1.MediaTypeImageManifest)); err != nil {
+			t.Fatalf("dropped events are not retried: %v", err)
+		}
+		written++
+	}
+	sink.mu.Lock()
+	buffered := len(sink.buffered)
+	sink.mu.Unlock()
+	if buffered == 0 || buffered == written {
+		t.Fatalf("unexpected buffer of %d events", buffered)
+	}
+	if metrics.Errors != written-buffered {
+		t.Fatalf("expected the dropped events to be errors: %+v", metrics.EndpointMetrics)
+	}
+
+	// Buffered events are dropped on close.
+	sink.Close()
+	if metrics.Errors != written {
+		t.Fatalf("unexpected metrics: %+v", metrics.EndpointMetrics)
+	}
+}
@@ -0,0 +1,232 @@
+package notifications
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"sync"
+	"time"
+
+	events "github.com/docker/go-events"
+	"github.com/sirupsen/logrus"
+)
+
+// Backoff curves of the retries.
+const (
+	RetryBackoffConstant    = "constant"
+	RetryBackoffExponential = "exponential"
+)
+
+// errQueueFull is the reason of the events dead-lettered because the queue
+// of their endpoint is full.
+var errQueueFull = errors.New("queue full")
+
+// retryStrategy backs off with the curve of the endpoint, and gives up on
+// the events which exhausted their attempts or TTL, dead-lettering them. The
+// RetryingSink writes one event at a time, until it is delivered or given up
+// on, so the attempts counted are those of the current event.
+type retryStrategy struct {
+	events.RetryStrategy
+	maxAttempts int
+	ttl         time.Duration
+	deadLetter  *deadLetterSink
+
+	mu       sync.Mutex
+	attempts int
+}
+
+func newRetryStrategy(config EndpointConfig, deadLetter *deadLetterSink) *retryStrategy {
+	rs := &retryStrategy{
+		maxAttempts: config.Retry.MaxAttempts,
+		ttl:         config.Retry.TTL,
+		deadLetter:  deadLetter,
+	}
+	if config.Retry.Backoff == RetryBackoffExponential {
+		rs.RetryStrategy = events.NewExponentialBackoff(events.ExponentialBackoffConfig{
+			Factor: config.Backoff,
+			Max:    config.Retry.MaxBackoff,
+		})
+	} else {
+		rs.RetryStrategy = events.NewBreaker(config.Threshold, config.Backoff)
+	}
+	return rs
+}
+
+// Failure records the failure, and gives up on the event if it exhausted its
+// attempts or TTL.
+func (rs *retryStrategy) Failure(event events.Event, err error) bool {
+	rs.RetryStrategy.Failure(event, err)
+
+	rs.mu.Lock()
+	rs.attempts++
+	attempts := rs.attempts
+	giveUp := (rs.maxAttempts > 0 && attempts >= rs.maxAttempts) || (rs.ttl > 0 && eventAge(event) > rs.ttl)
+	if giveUp {
+		rs.attempts = 0
+	}
+	rs.mu.Unlock()
+
+	if giveUp {
+		rs.deadLetter.write(event, attempts, err)
+	}
+	return giveUp
+}
+
+// Success resets the attempts.
+func (rs *retryStrategy) Success(event events.Event) {
+	rs.RetryStrategy.Success(event)
+
+	rs.mu.Lock()
+	defer rs.mu.Unlock()
+	rs.attempts = 0
+}
+
+// eventAge returns the age of the event, or of the oldest event of a batch.
+func eventAge(event events.Event) time.Duration {
+	var age time.Duration
+	switch e := event.(type) {
+	case Event:
+		if !e.Timestamp.IsZero() {
+			age = time.Since(e.Timestamp)
+		}
+	case *eventBatch:
+		for _, event := range e.events {
+			age = max(age, eventAge(event))
+		}
+	}
+	return age
+}
+
+// DeadLetter is a line of a dead-letter file: an event which exhausted its
+// retries.
+type DeadLetter struct {
+	Endpoint string    `json:"endpoint"`
+	Time     time.Time `json:"time"`
+	Attempts int       `json:"attempts"`
+	Error    string    `json:"error"`
+	Event    Event     `json:"event"`
+}
+
+// deadLetterSink writes the events an endpoint gave up on to its dead-letter
+// file or endpoint, or drops them.
+type deadLetterSink struct {
+	name     string
+	file     string
+	endpoint *Endpoint
+	metrics  *safeMetrics
+
+	// mu serializes the writes to the file.
+	mu sync.Mutex
+}
+
+func newDeadLetterSink(e *Endpoint) *deadLetterSink {
+	d := &deadLetterSink{
+		name:    e.name,
+		file:    e.DeadLetter.File,
+		metrics: e.metrics,
+	}
+	if e.DeadLetter.URL != "" {
+		// The dead-letter endpoint retries its events until they are
+		// delivered.
+		d.endpoint = NewEndpoint(e.name+"-deadletter", e.DeadLetter.URL, EndpointConfig{
+			Headers:        e.DeadLetter.Headers,
+			Timeout:        e.Timeout,
+			Threshold:      e.Threshold,
+			Backoff:        e.Backoff,
+			Transport:      e.Transport,
+			SigningSecrets: e.SigningSecrets,
+		})
+	}
+	return d
+}
+
+// write dead-letters the event, or the events of a batch, which failed with
+// reason after the attempts.
+func (d *deadLetterSink) write(event events.Event, attempts int, reason error) {
+	if batch, ok := event.(*eventBatch); ok {
+		for _, event := range batch.events {
+			d.write(event, attempts, reason)
+		}
+		return
+	}
+	d.metrics.deadLettered(event)
+
+	e, ok := event.(Event)
+	switch {
+	case !ok:
+		logrus.Errorf("notifications: endpoint %s: dropping event of type %T after %d attempts: %v", d.name, event, attempts, reason)
+	case d.endpoint != nil:
+		logrus.Warnf("notifications: endpoint %s: dead-lettering event %s to %s after %d attempts: %v", d.name, e.ID, d.endpoint.URL(), attempts, reason)
+		if err := d.endpoint.Write(event); err != nil {
+			logrus.Errorf("notifications: endpoint %s: error dead-lettering event %s: %v", d.name, e.ID, err)
+		}
+	case d.file != "":
+		logrus.Warnf("notifications: endpoint %s: dead-lettering event %s to %s after %d attempts: %v", d.name, e.ID, d.file, attempts, reason)
+		if err := d.append(DeadLetter{
+			Endpoint: d.name,
+			Time:     time.Now().UTC(),
+			Attempts: attempts,
+			Error:    reason.Error(),
+			Event:    e,
+		}); err != nil {
+			logrus.Errorf("notifications: endpoint %s: error dead-lettering event %s: %v", d.name, e.ID, err)
+		}
+	default:
+		logrus.Errorf("notifications: endpoint %s: dropping event %s after %d attempts: %v", d.name, e.ID, attempts, reason)
+	}
+}
+
+// append writes the dead letter as a line of the file, which is opened for
+// each write, so that it may be rotated.
+func (d *deadLetterSink) append(letter DeadLetter) error {
+	p, err := json.Marshal(letter)
+	if err != nil {
+		return err
+	}
+
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	f, err := os.OpenFile(d.file, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0o600)
+	if err != nil {
+		return err
+	}
+	if _, err := f.Write(append(p, '\n')); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+// ReplayDeadLetters posts the events of a dead-letter file to the url, in
+// order and without retry, after skipping its first skip lines. It returns
+// the number of lines posted or skipped, so that a replay stopped by an
+// error can be resumed by skipping them.
+func ReplayDeadLetters(r io.Reader, url string, config EndpointConfig, skip int) (int, error) {
+	config.defaults()
+	sink := newHTTPSink(url, config.Timeout, config.Headers, config.Transport)
+	sink.secrets = config.SigningSecrets
+	defer sink.Close()
+
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(nil, 16*1024*1024)
+	n := 0
+	for scanner.Scan() {
+		if n < skip || len(scanner.Bytes()) == 0 {
+			n++
+			continue
+		}
+		var letter DeadLetter
+		if err := json.Unmarshal(scanner.Bytes(), &letter); err != nil {
+			return n, fmt.Errorf("line %d: %v", n+1, err)
+		}
+		if err := sink.Write(letter.Event); err != nil {
+			return n, err
+		}
+		n++
+	}
+	return n, scanner.Err()
+}
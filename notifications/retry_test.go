@@ -0,0 +1,259 @@
+package notifications
+
+import (
+	"bufio"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/distribution/distribution/v3/configuration"
+	events "github.com/docker/go-events"
+	v1 "github.com/opencontainers/image-spec/specs-go/v1"
+)
+
+// testEventServer records the ids of the events posted to it, and responds
+// with the status.
+type testEventServer struct {
+	*httptest.Server
+	mu     sync.Mutex
+	status int
+	ids    []string
+}
+
+func newTestEventServer(t *testing.T, status int) *testEventServer {
+	s := &testEventServer{status: status}
+	s.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var envelope struct {
+			Events []Event `json:"events"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&envelope); err != nil {
+			t.Errorf("error decoding envelope: %v", err)
+		}
+		s.mu.Lock()
+		defer s.mu.Unlock()
+		for _, event := range envelope.Events {
+			s.ids = append(s.ids, event.ID)
+		}
+		w.WriteHeader(s.status)
+	}))
+	t.Cleanup(s.Close)
+	return s
+}
+
+func (s *testEventServer) posted() []string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([]string(nil), s.ids...)
+}
+
+func waitDeadLettered(t *testing.T, endpoint *Endpoint, n int) {
+	t.Helper()
+	var metrics EndpointMetrics
+	deadline := time.Now().Add(5 * time.Second)
+	for endpoint.ReadMetrics(&metrics); metrics.DeadLettered < n; endpoint.ReadMetrics(&metrics) {
+		if time.Now().After(deadline) {
+			t.Fatalf("events were not dead-lettered: %+v", metrics)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func readDeadLetters(t *testing.T, path string) []DeadLetter {
+	t.Helper()
+	f, err := os.Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+
+	var letters []DeadLetter
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		var letter DeadLetter
+		if err := json.Unmarshal(scanner.Bytes(), &letter); err != nil {
+			t.Fatalf("invalid dead letter %s: %v", scanner.Text(), err)
+		}
+		letters = append(letters, letter)
+	}
+	return letters
+}
+
+func TestRetryMaxAttempts(t *testing.T) {
+	unregisterTestEndpoints(t)
+	server := newTestEventServer(t, http.StatusInternalServerError)
+	deadLetterPath := filepath.Join(t.TempDir(), "deadletter.jsonl")
+
+	endpoint := NewEndpoint("failing", server.URL, EndpointConfig{
+		Threshold:  1,
+		Backoff:    10 * time.Millisecond,
+		Retry:      configuration.Retry{MaxAttempts: 3},
+		DeadLetter: configuration.DeadLetter{File: deadLetterPath},
+	})
+	defer endpoint.Close()
+
+	first := createTestEvent("push", "library/app", v1.MediaTypeImageManifest)
+	second := createTestEvent("delete", "library/app", v1.MediaTypeImageManifest)
+	for _, event := range []Event{first, second} {
+		if err := endpoint.Write(event); err != nil {
+			t.Fatalf("error writing event: %v", err)
+		}
+	}
+	waitDeadLettered(t, endpoint, 2)
+
+	// Each event is attempted three times, in order.
+	ids := server.posted()
+	if strings.Join(ids, " ") != strings.Join([]string{first.ID, first.ID, first.ID, second.ID, second.ID, second.ID}, " ") {
+		t.Fatalf("unexpected attempts %v", ids)
+	}
+	letters := readDeadLetters(t, deadLetterPath)
+	if len(letters) != 2 || letters[0].Event.ID != first.ID || letters[1].Event.ID != second.ID {
+		t.Fatalf("unexpected dead letters %+v", letters)
+	}
+	if letters[0].Endpoint != "failing" || letters[0].Attempts != 3 || !strings.Contains(letters[0].Error, "500") {
+		t.Fatalf("unexpected dead letter %+v", letters[0])
+	}
+}
+
+func TestRetryTTL(t *testing.T) {
+	unregisterTestEndpoints(t)
+	server := newTestEventServer(t, http.StatusServiceUnavailable)
+	deadLetterServer := newTestEventServer(t, http.StatusOK)
+
+	endpoint := NewEndpoint("expiring", server.URL, EndpointConfig{
+		Threshold: 1,
+		Backoff:   10 * time.Millisecond,
+		Retry:     configuration.Retry{TTL: 100 * time.Millisecond},
+		DeadLetter: configuration.DeadLetter{
+			URL: deadLetterServer.URL,
+		},
+	})
+	defer endpoint.Close()
+
+	event := createTestEvent("push", "library/app", v1.MediaTypeImageManifest)
+	if err := endpoint.Write(event); err != nil {
+		t.Fatalf("error writing event: %v", err)
+	}
+	waitDeadLettered(t, endpoint, 1)
+	if time.Since(event.Timestamp) < 100*time.Millisecond {
+		t.Fatal("the event was dead-lettered before its TTL")
+	}
+
+	// The dead-letter endpoint receives the event.
+	deadline := time.Now().Add(5 * time.Second)
+	for len(deadLetterServer.posted()) == 0 {
+		if time.Now().After(deadline) {
+			t.Fatal("the event was not posted to the dead-letter endpoint")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if ids := deadLetterServer.posted(); len(ids) != 1 || ids[0] != event.ID {
+		t.Fatalf("unexpected dead-lettered events %v", ids)
+	}
+}
+
+// TestBoundedQueue checks that a failing endpoint does not block the others,
+// and that the events overflowing its queue are dead-lettered.
+func TestBoundedQueue(t *testing.T) {
+	unregisterTestEndpoints(t)
+	failing := newTestEventServer(t, http.StatusInternalServerError)
+	healthy := newTestEventServer(t, http.StatusOK)
+	deadLetterPath := filepath.Join(t.TempDir(), "deadletter.jsonl")
+
+	failingEndpoint := NewEndpoint("failing", failing.URL, EndpointConfig{
+		Threshold:  1,
+		Backoff:    100 * time.Millisecond,
+		Retry:      configuration.Retry{MaxAttempts: 2},
+		DeadLetter: configuration.DeadLetter{File: deadLetterPath},
+		QueueSize:  2,
+	})
+	defer failingEndpoint.Close()
+	healthyEndpoint := NewEndpoint("healthy", healthy.URL, EndpointConfig{})
+	defer healthyEndpoint.Close()
+
+	broadcaster := events.NewBroadcaster(failingEndpoint, healthyEndpoint)
+	defer broadcaster.Close()
+
+	const n = 10
+	start := time.Now()
+	for range n {
+		if err := broadcaster.Write(createTestEvent("push", "library/app", v1.MediaTypeImageManifest)); err != nil {
+			t.Fatalf("error writing event: %v", err)
+		}
+	}
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Fatalf("writes were blocked for %s", elapsed)
+	}
+
+	deadline := time.Now().Add(5 * time.Second)
+	for len(healthy.posted()) < n {
+		if time.Now().After(deadline) {
+			t.Fatalf("the healthy endpoint received %d events", len(healthy.posted()))
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	waitDeadLettered(t, failingEndpoint, n)
+	var overflowed int
+	for _, letter := range readDeadLetters(t, deadLetterPath) {
+		if letter.Error == errQueueFull.Error() {
+			overflowed++
+		}
+	}
+	if overflowed < n-3 {
+		t.Fatalf("expected the events beyond the queue to overflow, got %d", overflowed)
+	}
+}
+
+func TestNewRetryStrategy(t *testing.T) {
+	rs := newRetryStrategy(EndpointConfig{Threshold: 1, Backoff: time.Second}, nil)
+	if _, ok := rs.RetryStrategy.(*events.Breaker); !ok {
+		t.Fatalf("unexpected default strategy %T", rs.RetryStrategy)
+	}
+	rs = newRetryStrategy(EndpointConfig{Backoff: time.Second, Retry: configuration.Retry{Backoff: RetryBackoffExponential}}, nil)
+	if _, ok := rs.RetryStrategy.(*events.ExponentialBackoff); !ok {
+		t.Fatalf("unexpected exponential strategy %T", rs.RetryStrategy)
+	}
+}
+
+func TestReplayDeadLetters(t *testing.T) {
+	server := newTestEventServer(t, http.StatusOK)
+
+	var lines []string
+	var ids []string
+	for range 3 {
+		event := createTestEvent("push", "library/app", v1.MediaTypeImageManifest)
+		p, err := json.Marshal(DeadLetter{Endpoint: "failing", Attempts: 3, Event: event})
+		if err != nil {
+			t.Fatal(err)
+		}
+		lines = append(lines, string(p))
+		ids = append(ids, event.ID)
+	}
+	file := strings.Join(lines, "\n") + "\n"
+
+	n, err := ReplayDeadLetters(strings.NewReader(file), server.URL, EndpointConfig{}, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n != 3 || strings.Join(server.posted(), " ") != strings.Join(ids[1:], " ") {
+		t.Fatalf("unexpected replay of %d lines: %v", n, server.posted())
+	}
+
+	// A failure stops the replay, returning the lines to skip to resume it.
+	server.mu.Lock()
+	server.status = http.StatusInternalServerError
+	server.mu.Unlock()
+	n, err = ReplayDeadLetters(strings.NewReader(file), server.URL, EndpointConfig{}, 0)
+	if err == nil || n != 0 {
+		t.Fatalf("unexpected replay of %d lines: %v", n, err)
+	}
+	if _, err := ReplayDeadLetters(strings.NewReader("{invalid\n"), server.URL, EndpointConfig{}, 0); err == nil {
+		t.Fatal("expected an error for an invalid line")
+	}
+}
@@ -0,0 +1,84 @@
+package notifications
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"os"
+	"strings"
+
+	"github.com/distribution/distribution/v3/configuration"
+)
+
+// Headers of the signed notification requests.
+const (
+	// SignatureHeader holds the signatures of the request, comma separated
+	// sha256=<hex> values, one for each secret.
+	SignatureHeader = "X-Registry-Signature"
+	// SignatureTimestampHeader holds the time the request was signed at, in
+	// seconds since the epoch. It is part of the signed material.
+	SignatureTimestampHeader = "X-Registry-Signature-Timestamp"
+)
+
+// LoadSigningSecrets returns the secrets of the signing configuration, the
+// current one first, reading them from their files if need be. It returns
+// no secret if signing is not configured.
+func LoadSigningSecrets(config configuration.Signing) ([][]byte, error) {
+	current, err := signingSecret(config.Secret, config.SecretFile)
+	if err != nil {
+		return nil, err
+	}
+	previous, err := signingSecret(config.PreviousSecret, config.PreviousSecretFile)
+	if err != nil {
+		return nil, err
+	}
+
+	switch {
+	case current == nil && previous != nil:
+		return nil, errors.New("signing: a previous secret requires a secret")
+	case current == nil:
+		return nil, nil
+	case previous == nil:
+		return [][]byte{current}, nil
+	}
+	return [][]byte{current, previous}, nil
+}
+
+// signingSecret returns the secret, or the content of the file, without its
+// trailing newline.
+func signingSecret(secret, file string) ([]byte, error) {
+	switch {
+	case secret != "" && file != "":
+		return nil, errors.New("signing: a secret and a secret file are exclusive")
+	case secret != "":
+		return []byte(secret), nil
+	case file == "":
+		return nil, nil
+	}
+
+	p, err := os.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+	p = bytes.TrimRight(p, "\r\n")
+	if len(p) == 0 {
+		return nil, errors.New("signing: empty secret file " + file)
+	}
+	return p, nil
+}
+
+// signPayload returns the signatures of the payload sent at the timestamp,
+// an HMAC-SHA256 of "<timestamp>.<payload>" for each secret.
+func signPayload(secrets [][]byte, timestamp string, payload []byte) string {
+	signatures := make([]string, 0, len(secrets))
+	for _, secret := range secrets {
+		mac := hmac.New(sha256.New, secret)
+		mac.Write([]byte(timestamp))
+		mac.Write([]byte("."))
+		mac.Write(payload)
+		signatures = append(signatures, "sha256="+hex.EncodeToString(mac.Sum(nil)))
+	}
+	return strings.Join(signatures, ",")
+}
@@ -0,0 +1,135 @@
+package notifications
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/distribution/distribution/v3/configuration"
+	v1 "github.com/opencontainers/image-spec/specs-go/v1"
+)
+
+func TestSignPayload(t *testing.T) {
+	payload := []byte(`{"events":[]}`)
+	for _, tc := range []struct {
+		secrets  []string
+		expected string
+	}{
+		{
+			secrets:  []string{"It's a Secret to Everybody"},
+			expected: "sha256=f5fcdc41a6cb9be07aded8cb60f306047df427b2677ab8dc14bb7eea06d638b1",
+		},
+		{
+			// During a rotation, the signature of the current secret comes
+			// first.
+			secrets:  []string{"It's a Secret to Everybody", "previous-secret"},
+			expected: "sha256=f5fcdc41a6cb9be07aded8cb60f306047df427b2677ab8dc14bb7eea06d638b1,sha256=8aa1e986775644d1abc23229050d354932b7b72755752a3e01d7b7d60b5fab79",
+		},
+	} {
+		var secrets [][]byte
+		for _, secret := range tc.secrets {
+			secrets = append(secrets, []byte(secret))
+		}
+		if signature := signPayload(secrets, "1700000000", payload); signature != tc.expected {
+			t.Errorf("%v: unexpected signature %s", tc.secrets, signature)
+		}
+	}
+}
+
+func TestLoadSigningSecrets(t *testing.T) {
+	dir := t.TempDir()
+	secretPath := filepath.Join(dir, "secret")
+	if err := os.WriteFile(secretPath, []byte("from-file\n"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	emptyPath := filepath.Join(dir, "empty")
+	if err := os.WriteFile(emptyPath, []byte("\n"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	secrets, err := LoadSigningSecrets(configuration.Signing{SecretFile: secretPath, PreviousSecret: "previous"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(secrets) != 2 || string(secrets[0]) != "from-file" || string(secrets[1]) != "previous" {
+		t.Fatalf("unexpected secrets %q", secrets)
+	}
+	if secrets, err := LoadSigningSecrets(configuration.Signing{}); err != nil || secrets != nil {
+		t.Fatalf("unexpected secrets %q without signing: %v", secrets, err)
+	}
+
+	for name, config := range map[string]configuration.Signing{
+		"secret and file":      {Secret: "secret", SecretFile: secretPath},
+		"only previous secret": {PreviousSecret: "previous"},
+		"missing file":         {SecretFile: filepath.Join(dir, "missing")},
+		"empty file":           {SecretFile: emptyPath},
+	} {
+		if _, err := LoadSigningSecrets(config); err == nil {
+			t.Errorf("%s: expected an error", name)
+		}
+	}
+}
+
+// TestHTTPSinkSignature verifies the signature of the requests the way the
+// endpoints are documented to.
+func TestHTTPSinkSignature(t *testing.T) {
+	secrets := [][]byte{[]byte("current"), []byte("previous")}
+	verify := func(r *http.Request, secret []byte) bool {
+		body, err := io.ReadAll(r.Body)
+		r.Body = io.NopCloser(bytes.NewReader(body))
+		if err != nil {
+			return false
+		}
+		timestamp := r.Header.Get(SignatureTimestampHeader)
+		seconds, err := strconv.ParseInt(timestamp, 10, 64)
+		if err != nil || time.Since(time.Unix(seconds, 0)).Abs() > 5*time.Minute {
+			return false
+		}
+		mac := hmac.New(sha256.New, secret)
+		mac.Write([]byte(timestamp + "."))
+		mac.Write(body)
+		expected := "sha256=" + hex.EncodeToString(mac.Sum(nil))
+		for _, signature := range strings.Split(r.Header.Get(SignatureHeader), ",") {
+			if hmac.Equal([]byte(signature), []byte(expected)) {
+				return true
+			}
+		}
+		return false
+	}
+
+	var verified []bool
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		verified = []bool{verify(r, secrets[0]), verify(r, secrets[1]), verify(r, []byte("other"))}
+	}))
+	defer server.Close()
+
+	sink := newHTTPSink(server.URL, 0, nil, nil)
+	sink.secrets = secrets
+	if err := sink.Write(createTestEvent("push", "library/app", v1.MediaTypeImageManifest)); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if !verified[0] || !verified[1] || verified[2] {
+		t.Fatalf("unexpected verification of the secrets %v", verified)
+	}
+
+	// Requests are only signed with secrets.
+	sink = newHTTPSink(server.URL, 0, nil, nil)
+	server.Config.Handler = http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get(SignatureHeader) != "" || r.Header.Get(SignatureTimestampHeader) != "" {
+			t.Errorf("unexpected signature headers %v", r.Header)
+		}
+	})
+	if err := sink.Write(createTestEvent("push", "library/app", v1.MediaTypeImageManifest)); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+}
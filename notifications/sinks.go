@@ -3,41 +3,76 @@ package notifications
 import (
 	"container/list"
 	"fmt"
+	"path"
 	"sync"
 
+	"github.com/distribution/distribution/v3/configuration"
 	events "github.com/docker/go-events"
 	"github.com/sirupsen/logrus"
 )
 
 // eventQueue accepts all messages into a queue for asynchronous consumption
-// by a sink. It is unbounded and thread safe but the sink must be reliable or
+// by sinks. It is unbounded and thread safe but the sinks must be reliable or
 // events will be dropped.
 type eventQueue struct {
-	sink      events.Sink
+	// sinks are written concurrently, one event or batch at a time each. The
+	// events of a repository are written one at a time, in order.
+	sinks []events.Sink
+	// batchSize is the maximum number of events written at once. Batches of
+	// more than one event are written as an *eventBatch.
+	batchSize int
+	// maxLen is the maximum number of pending events, unbounded if zero.
+	// Further events are passed to overflow instead.
+	maxLen    int
+	overflow  func(events.Event)
 	events    *list.List
 	listeners []eventQueueListener
 	cond      *sync.Cond
 	mu        sync.Mutex
 	closed    bool
+	// inFlight counts the events being written, per repository, and active
+	// the writes.
+	inFlight map[string]int
+	active   int
 }
 
 // eventQueueListener is called when various events happen on the queue.
 type eventQueueListener interface {
 	ingress(event events.Event)
+	// dispatch is called when the event is written to a sink, and egress
+	// once the write returns.
+	dispatch(event events.Event)
 	egress(event events.Event)
 }
 
 // newEventQueue returns a queue to the provided sink. If the updater is non-
 // nil, it will be called to update pending metrics on ingress and egress.
 func newEventQueue(sink events.Sink, listeners ...eventQueueListener) *eventQueue {
+	return newBatchingEventQueue(sink, 1, listeners...)
+}
+
+// newBatchingEventQueue returns a queue writing the pending events to the
+// provided sink in batches of up to batchSize events.
+func newBatchingEventQueue(sink events.Sink, batchSize int, listeners ...eventQueueListener) *eventQueue {
+	return newConcurrentEventQueue([]events.Sink{sink}, batchSize, listeners...)
+}
+
+// newConcurrentEventQueue returns a queue writing the pending events to the
+// sinks concurrently, in batches of up to batchSize events. The events of a
+// repository are written in order, never concurrently.
+func newConcurrentEventQueue(sinks []events.Sink, batchSize int, listeners ...eventQueueListener) *eventQueue {
 	eq := eventQueue{
-		sink:      sink,
+		sinks:     sinks,
+		batchSize: max(batchSize, 1),
 		events:    list.New(),
 		listeners: listeners,
+		inFlight:  make(map[string]int),
 	}
 
 	eq.cond = sync.NewCond(&eq.mu)
-	go eq.run()
+	for _, sink := range sinks {
+		go eq.run(sink)
+	}
 	return &eq
 }
 
@@ -51,11 +86,16 @@ func (eq *eventQueue) Write(event events.Event) error {
 		return ErrSinkClosed
 	}
 
+	if eq.maxLen > 0 && eq.events.Len() >= eq.maxLen {
+		eq.overflow(event)
+		return nil
+	}
+
 	for _, listener := range eq.listeners {
 		listener.ingress(event)
 	}
 	eq.events.PushBack(event)
-	eq.cond.Signal() // signal waiters
+	eq.cond.Broadcast() // signal waiters
 
 	return nil
 }
@@ -71,94 +111,205 @@ func (eq *eventQueue) Close() error {
 
 	// set closed flag
 	eq.closed = true
-	eq.cond.Signal() // signal flushes queue
-	eq.cond.Wait()   // wait for signal from last flush
+	eq.cond.Broadcast() // signal flushes queue
+	for eq.events.Len() > 0 || eq.active > 0 {
+		eq.cond.Wait() // wait for signal from last flush
+	}
 
-	return eq.sink.Close()
+	var err error
+	for _, sink := range eq.sinks {
+		if cerr := sink.Close(); cerr != nil && err == nil {
+			err = cerr
+		}
+	}
+	return err
 }
 
-// run is the main goroutine to flush events to the target sink.
-func (eq *eventQueue) run() {
+// run is the goroutine flushing events to one of the target sinks.
+func (eq *eventQueue) run(sink events.Sink) {
 	for {
-		event := eq.next()
+		block := eq.next()
 
-		if event == nil {
+		if block == nil {
 			return // nil block means event queue is closed.
 		}
 
-		if err := eq.sink.Write(event); err != nil {
-			logrus.Warnf("eventqueue: error writing events to %v, these events will be lost: %v", eq.sink, err)
+		var event events.Event = block[0]
+		if len(block) > 1 {
+			event = &eventBatch{events: block}
+		}
+		if err := sink.Write(event); err != nil {
+			logrus.Warnf("eventqueue: error writing events to %v, these events will be lost: %v", sink, err)
 		}
 
-		for _, listener := range eq.listeners {
-			listener.egress(event)
+		for _, event := range block {
+			for _, listener := range eq.listeners {
+				listener.egress(event)
+			}
 		}
+		eq.done(block)
 	}
 }
 
-// next encompasses the critical section of the run loop. When the queue is
-// empty, it will block on the condition. If new data arrives, it will wake
-// and return a block. When closed, a nil slice will be returned.
-func (eq *eventQueue) next() events.Event {
+// next encompasses the critical section of the run loop. When the queue has
+// no event of a repository not being written, it will block on the
+// condition. If new data arrives, it will wake and return a block of up to
+// batchSize events, in order, skipping the repositories being written. When
+// closed, a nil slice will be returned.
+func (eq *eventQueue) next() []events.Event {
 	eq.mu.Lock()
 	defer eq.mu.Unlock()
 
-	for eq.events.Len() < 1 {
-		if eq.closed {
+	for {
+		if eq.events.Len() < 1 && eq.closed {
 			eq.cond.Broadcast()
 			return nil
 		}
 
+		var block []events.Event
+		for e := eq.events.Front(); e != nil && len(block) < eq.batchSize; {
+			event, next := e.Value.(events.Event), e.Next()
+			if key := eventKey(event); eq.inFlight[key] == 0 || containsKey(block, key) {
+				block = append(block, event)
+				eq.events.Remove(e)
+			}
+			e = next
+		}
+		if len(block) > 0 {
+			for _, event := range block {
+				eq.inFlight[eventKey(event)]++
+				for _, listener := range eq.listeners {
+					listener.dispatch(event)
+				}
+			}
+			eq.active++
+			return block
+		}
+
 		eq.cond.Wait()
 	}
+}
+
+// done releases the repositories of the block written.
+func (eq *eventQueue) done(block []events.Event) {
+	eq.mu.Lock()
+	defer eq.mu.Unlock()
+
+	for _, event := range block {
+		key := eventKey(event)
+		if eq.inFlight[key]--; eq.inFlight[key] == 0 {
+			delete(eq.inFlight, key)
+		}
+	}
+	eq.active--
+	eq.cond.Broadcast()
+}
+
+// eventKey returns the key of the events written in order: their repository.
+func eventKey(event events.Event) string {
+	if e, ok := event.(Event); ok {
+		return e.Target.Repository
+	}
+	return ""
+}
 
-	front := eq.events.Front()
-	block := front.Value.(events.Event)
-	eq.events.Remove(front)
+func containsKey(block []events.Event, key string) bool {
+	for _, event := range block {
+		if eventKey(event) == key {
+			return true
+		}
+	}
+	return false
+}
 
-	return block
+// eventBatch is a batch of events written at once. Sinks delivering some of
+// the events of a batch remove them from it, so that only the others are
+// retried.
+type eventBatch struct {
+	events []events.Event
 }
 
-// ignoredSink discards events with ignored target media types and actions.
+func (b *eventBatch) String() string {
+	return fmt.Sprintf("batch of %d events", len(b.events))
+}
+
+// filteredSink discards the events not matching the filter of an endpoint,
 // passes the rest along.
-type ignoredSink struct {
+type filteredSink struct {
 	events.Sink
-	ignoreMediaTypes map[string]bool
-	ignoreActions    map[string]bool
+	filter configuration.Filter
 }
 
-func newIgnoredSink(sink events.Sink, ignored []string, ignoreActions []string) events.Sink {
-	if len(ignored) == 0 && len(ignoreActions) == 0 {
+func newFilteredSink(sink events.Sink, filter configuration.Filter) events.Sink {
+	if emptyList(filter.Repositories) && emptyList(filter.Actions) && emptyList(filter.MediaTypes) {
 		return sink
 	}
 
-	ignoredMap := make(map[string]bool)
-	for _, mediaType := range ignored {
-		ignoredMap[mediaType] = true
-	}
-
-	ignoredActionsMap := make(map[string]bool)
-	for _, action := range ignoreActions {
-		ignoredActionsMap[action] = true
+	return &filteredSink{
+		Sink:   sink,
+		filter: filter,
 	}
+}
 
-	return &ignoredSink{
-		Sink:             sink,
-		ignoreMediaTypes: ignoredMap,
-		ignoreActions:    ignoredActionsMap,
-	}
+// newIgnoredSink returns a sink discarding events with ignored target media
+// types and actions.
+func newIgnoredSink(sink events.Sink, ignored []string, ignoreActions []string) events.Sink {
+	return newFilteredSink(sink, configuration.Filter{
+		MediaTypes: configuration.FilterList{Exclude: ignored},
+		Actions:    configuration.FilterList{Exclude: ignoreActions},
+	})
 }
 
-// Write discards events with ignored target media types and passes the rest
-// along.
-func (imts *ignoredSink) Write(event events.Event) error {
-	if imts.ignoreMediaTypes[event.(Event).Target.MediaType] || imts.ignoreActions[event.(Event).Action] {
+// Write discards events not matching the filter and passes the rest along.
+func (fs *filteredSink) Write(event events.Event) error {
+	e := event.(Event)
+	if !matchesList(fs.filter.Repositories, e.Target.Repository, globMatch) ||
+		!matchesList(fs.filter.Actions, e.Action, exactMatch) ||
+		!matchesList(fs.filter.MediaTypes, e.Target.MediaType, globMatch) {
 		return nil
 	}
 
-	return imts.Sink.Write(event)
+	return fs.Sink.Write(event)
 }
 
-func (imts *ignoredSink) Close() error {
+func (fs *filteredSink) Close() error {
 	return nil
 }
+
+// matchesList returns whether the value matches none of the exclude patterns
+// of the list, and any of its include patterns, unless there are none.
+func matchesList(list configuration.FilterList, value string, match func(pattern, value string) bool) bool {
+	for _, pattern := range list.Exclude {
+		if match(pattern, value) {
+			return false
+		}
+	}
+	if len(list.Include) == 0 {
+		return true
+	}
+	for _, pattern := range list.Include {
+		if match(pattern, value) {
+			return true
+		}
+	}
+	return false
+}
+
+func emptyList(list configuration.FilterList) bool {
+	return len(list.Include) == 0 && len(list.Exclude) == 0
+}
+
+func exactMatch(pattern, value string) bool {
+	return pattern == value
+}
+
+// globMatch matches the value with the path.Match pattern, where * does not
+// match a /. Values equal to the pattern always match, so that media types
+// are not mistaken for malformed patterns.
+func globMatch(pattern, value string) bool {
+	if pattern == value {
+		return true
+	}
+	ok, _ := path.Match(pattern, value)
+	return ok
+}
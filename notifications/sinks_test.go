@@ -2,11 +2,15 @@ package notifications
 
 import (
 	"reflect"
+	"slices"
+	"strconv"
 	"sync"
 	"testing"
 	"time"
 
+	"github.com/distribution/distribution/v3/configuration"
 	events "github.com/docker/go-events"
+	v1 "github.com/opencontainers/image-spec/specs-go/v1"
 
 	"github.com/sirupsen/logrus"
 )
@@ -127,6 +131,77 @@ func TestIgnoredSink(t *testing.T) {
 	}
 }
 
+func TestFilteredSink(t *testing.T) {
+	prodPush := createTestEvent("push", "prod/app", v1.MediaTypeImageManifest)
+	prodBlob := createTestEvent("push", "prod/app", "application/octet-stream")
+	prodPull := createTestEvent("pull", "prod/app", v1.MediaTypeImageManifest)
+	nestedPush := createTestEvent("push", "prod/team/app", v1.MediaTypeImageManifest)
+	scratchPush := createTestEvent("push", "prod/scratch", v1.MediaTypeImageManifest)
+	devPush := createTestEvent("push", "dev/app", v1.MediaTypeImageManifest)
+
+	if ts := (&testSink{}); newFilteredSink(ts, configuration.Filter{}) != events.Sink(ts) {
+		t.Fatal("expected an empty filter not to wrap the sink")
+	}
+
+	for _, tc := range []struct {
+		name     string
+		filter   configuration.Filter
+		expected []Event
+	}{
+		{
+			name:     "no filter",
+			expected: []Event{prodPush, prodBlob, prodPull, nestedPush, scratchPush, devPush},
+		},
+		{
+			name: "manifest pushes to prod",
+			filter: configuration.Filter{
+				Repositories: configuration.FilterList{Include: []string{"prod/*"}, Exclude: []string{"prod/scratch"}},
+				Actions:      configuration.FilterList{Include: []string{"push"}},
+				MediaTypes:   configuration.FilterList{Include: []string{"application/vnd.*"}},
+			},
+			expected: []Event{prodPush},
+		},
+		{
+			name: "nested repositories",
+			filter: configuration.Filter{
+				Repositories: configuration.FilterList{Include: []string{"prod/*", "prod/*/*"}},
+				Actions:      configuration.FilterList{Exclude: []string{"pull"}},
+			},
+			expected: []Event{prodPush, prodBlob, nestedPush, scratchPush},
+		},
+		{
+			name: "excluded media type",
+			filter: configuration.Filter{
+				MediaTypes: configuration.FilterList{Exclude: []string{"application/octet-stream"}},
+			},
+			expected: []Event{prodPush, prodPull, nestedPush, scratchPush, devPush},
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			ts := &testSink{}
+			s := newFilteredSink(ts, tc.filter)
+
+			var written []Event
+			for _, event := range []Event{prodPush, prodBlob, prodPull, nestedPush, scratchPush, devPush} {
+				ts.mu.Lock()
+				ts.event = nil
+				ts.mu.Unlock()
+				if err := s.Write(event); err != nil {
+					t.Fatalf("error writing event: %v", err)
+				}
+				ts.mu.Lock()
+				if ts.event != nil {
+					written = append(written, ts.event.(Event))
+				}
+				ts.mu.Unlock()
+			}
+			if !reflect.DeepEqual(written, tc.expected) {
+				t.Fatalf("unexpected events: %#v != %#v", written, tc.expected)
+			}
+		})
+	}
+}
+
 type testSink struct {
 	event  events.Event
 	count  int
@@ -178,3 +253,84 @@ func checkClose(t *testing.T, sink events.Sink) {
 		t.Fatal("error should be ErrSinkClosed")
 	}
 }
+
+// orderSink records the events written per repository, failing the test if
+// the events of a repository are written concurrently.
+type orderSink struct {
+	t         *testing.T
+	mu        *sync.Mutex
+	inFlight  map[string]int
+	delivered map[string][]string
+	closed    bool
+}
+
+func (os *orderSink) Write(event events.Event) error {
+	repository := event.(Event).Target.Repository
+	os.mu.Lock()
+	if os.inFlight[repository]++; os.inFlight[repository] > 1 {
+		os.t.Errorf("events of %s written concurrently", repository)
+	}
+	os.mu.Unlock()
+
+	time.Sleep(time.Millisecond)
+
+	os.mu.Lock()
+	defer os.mu.Unlock()
+	os.inFlight[repository]--
+	os.delivered[repository] = append(os.delivered[repository], event.(Event).Target.Tag)
+	return nil
+}
+
+func (os *orderSink) Close() error {
+	os.mu.Lock()
+	defer os.mu.Unlock()
+	os.closed = true
+	return nil
+}
+
+func TestConcurrentEventQueue(t *testing.T) {
+	const nevents = 100
+	var (
+		mu        sync.Mutex
+		inFlight  = map[string]int{}
+		delivered = map[string][]string{}
+		sinks     []events.Sink
+	)
+	for range 4 {
+		sinks = append(sinks, &orderSink{t: t, mu: &mu, inFlight: inFlight, delivered: delivered})
+	}
+	metrics := newSafeMetrics("")
+	eq := newConcurrentEventQueue(sinks, 1, metrics.eventQueueListener())
+
+	var want []string
+	for i := range nevents {
+		want = append(want, strconv.Itoa(i))
+		for _, repository := range []string{"library/a", "library/b", "library/c"} {
+			event := createTestEvent("push", repository, "blob")
+			event.Target.Tag = strconv.Itoa(i)
+			if err := eq.Write(event); err != nil {
+				t.Fatalf("error writing event: %v", err)
+			}
+		}
+	}
+	checkClose(t, eq)
+
+	mu.Lock()
+	defer mu.Unlock()
+	for repository, tags := range delivered {
+		if !slices.Equal(tags, want) {
+			t.Fatalf("events of %s written out of order: %q", repository, tags)
+		}
+	}
+	for _, sink := range sinks {
+		if !sink.(*orderSink).closed {
+			t.Fatal("sinks should have been closed")
+		}
+	}
+
+	metrics.Lock()
+	defer metrics.Unlock()
+	if metrics.Events != 3*nevents || metrics.Pending != 0 || metrics.InFlight != 0 {
+		t.Fatalf("unexpected metrics %+v", metrics.EndpointMetrics)
+	}
+}
@@ -0,0 +1,57 @@
+package notifications
+
+import (
+	"fmt"
+	"net/http"
+	"net/url"
+
+	"github.com/distribution/distribution/v3/configuration"
+)
+
+// ValidateEndpoint checks the configuration of an endpoint without
+// connecting to it: its type and url, its retry backoff, its concurrency
+// and transport, and its signing secrets.
+func ValidateEndpoint(endpoint configuration.Endpoint) error {
+	switch endpoint.Retry.Backoff {
+	case "", RetryBackoffConstant, RetryBackoffExponential:
+	default:
+		return fmt.Errorf("unknown retry backoff %q of notification endpoint %s", endpoint.Retry.Backoff, endpoint.Name)
+	}
+	if endpoint.Concurrency < 0 {
+		return fmt.Errorf("notification endpoint %s: concurrency must not be negative", endpoint.Name)
+	}
+	if endpoint.Transport.MaxIdleConns < 0 || endpoint.Transport.KeepAlive < 0 || endpoint.Transport.IdleConnTimeout < 0 {
+		return fmt.Errorf("notification endpoint %s: the transport settings must not be negative", endpoint.Name)
+	}
+	if _, err := LoadSigningSecrets(endpoint.Signing); err != nil {
+		return fmt.Errorf("notification endpoint %s: %v", endpoint.Name, err)
+	}
+
+	switch endpoint.Type {
+	case "", "http":
+		u, err := url.Parse(endpoint.URL)
+		if err != nil {
+			return fmt.Errorf("notification endpoint %s: invalid url: %v", endpoint.Name, err)
+		}
+		if (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			return fmt.Errorf("notification endpoint %s: url %q must be an http or https url", endpoint.Name, endpoint.URL)
+		}
+	case EndpointTypeSQS, EndpointTypeSNS:
+		if endpoint.Concurrency > 1 {
+			return fmt.Errorf("notification endpoint %s: concurrency is only supported by http endpoints", endpoint.Name)
+		}
+		if _, err := newAWSQueryClient(endpoint.Type, endpoint.URL, endpoint.AWS, http.DefaultClient); err != nil {
+			return fmt.Errorf("notification endpoint %s: %v", endpoint.Name, err)
+		}
+	case EndpointTypeNATS:
+		if endpoint.Concurrency > 1 {
+			return fmt.Errorf("notification endpoint %s: concurrency is only supported by http endpoints", endpoint.Name)
+		}
+		if _, err := newNATSOptions(endpoint.URL, endpoint.NATS); err != nil {
+			return fmt.Errorf("notification endpoint %s: %v", endpoint.Name, err)
+		}
+	default:
+		return fmt.Errorf("unknown type %q of notification endpoint %s", endpoint.Type, endpoint.Name)
+	}
+	return nil
+}
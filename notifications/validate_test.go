@@ -0,0 +1,37 @@
+package notifications
+
+import (
+	"testing"
+
+	"github.com/distribution/distribution/v3/configuration"
+)
+
+func TestValidateEndpoint(t *testing.T) {
+	for _, tc := range []struct {
+		name     string
+		endpoint configuration.Endpoint
+		err      bool
+	}{
+		{name: "http", endpoint: configuration.Endpoint{Name: "a", URL: "https://example.com/events"}},
+		{name: "malformed url", endpoint: configuration.Endpoint{Name: "a", URL: "https://[::1"}, err: true},
+		{name: "relative url", endpoint: configuration.Endpoint{Name: "a", URL: "/events"}, err: true},
+		{name: "unknown scheme", endpoint: configuration.Endpoint{Name: "a", URL: "ftp://example.com/events"}, err: true},
+		{name: "unknown type", endpoint: configuration.Endpoint{Name: "a", Type: "kafka", URL: "kafka://example.com"}, err: true},
+		{name: "unknown retry backoff", endpoint: configuration.Endpoint{Name: "a", URL: "https://example.com/events", Retry: configuration.Retry{Backoff: "linear"}}, err: true},
+		{name: "missing signing secret file", endpoint: configuration.Endpoint{Name: "a", URL: "https://example.com/events", Signing: configuration.Signing{SecretFile: "/nonexistent/secret"}}, err: true},
+		{name: "concurrency", endpoint: configuration.Endpoint{Name: "a", URL: "https://example.com/events", Concurrency: 8, Transport: configuration.EndpointTransport{MaxIdleConns: 16}}},
+		{name: "negative concurrency", endpoint: configuration.Endpoint{Name: "a", URL: "https://example.com/events", Concurrency: -1}, err: true},
+		{name: "negative idle connections", endpoint: configuration.Endpoint{Name: "a", URL: "https://example.com/events", Transport: configuration.EndpointTransport{MaxIdleConns: -1}}, err: true},
+		{name: "sqs concurrency", endpoint: configuration.Endpoint{Name: "a", Type: EndpointTypeSQS, URL: "https://sqs.us-east-1.amazonaws.com/123456789012/events", Concurrency: 2}, err: true},
+		{name: "sqs", endpoint: configuration.Endpoint{Name: "a", Type: EndpointTypeSQS, URL: "https://sqs.us-east-1.amazonaws.com/123456789012/events"}},
+		{name: "sns without arn", endpoint: configuration.Endpoint{Name: "a", Type: EndpointTypeSNS, URL: "https://example.com/topic"}, err: true},
+		{name: "nats", endpoint: configuration.Endpoint{Name: "a", Type: EndpointTypeNATS, URL: "nats://127.0.0.1:4222"}},
+		{name: "nats without server", endpoint: configuration.Endpoint{Name: "a", Type: EndpointTypeNATS}, err: true},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			if err := ValidateEndpoint(tc.endpoint); (err != nil) != tc.err {
+				t.Fatalf("unexpected error %v", err)
+			}
+		})
+	}
+}
@@ -49,6 +49,14 @@ type Namespace interface {
 	BlobStatter() BlobStatter
 }
 
+// RepositoryPrefixLister is a Namespace listing the repositories whose name
+// starts with a prefix, without enumerating the others.
+type RepositoryPrefixLister interface {
+	// RepositoriesWithPrefix fills 'repos' like Repositories, with the
+	// repositories whose name starts with 'prefix'.
+	RepositoriesWithPrefix(ctx context.Context, repos []string, last, prefix string) (n int, err error)
+}
+
 // RepositoryEnumerator describes an operation to enumerate repositories
 type RepositoryEnumerator interface {
 	Enumerate(ctx context.Context, ingester func(string) error) error
@@ -59,6 +67,14 @@ type RepositoryRemover interface {
 	Remove(ctx context.Context, name reference.Named) error
 }
 
+// RepositoryRenamer renames repositories, keeping their manifests, tags and
+// layers.
+type RepositoryRenamer interface {
+	// Rename moves the repository from to the name to, which must not hold a
+	// repository.
+	Rename(ctx context.Context, from, to reference.Named) error
+}
+
 // ManifestServiceOption is a function argument for Manifest Service methods
 type ManifestServiceOption interface {
 	Apply(ManifestService) error
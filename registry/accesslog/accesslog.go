@@ -0,0 +1,307 @@
+// Package accesslog writes the access log of the registry, a line for each
+// request in the combined or the common log format, or as a JSON object
+// including the fields computed by the registry, such as the repository and
+// the outcome of the pull through cache.
+package accesslog
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"slices"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/distribution/distribution/v3/configuration"
+	"github.com/distribution/distribution/v3/internal/dcontext"
+)
+
+// The formats of the access log.
+const (
+	FormatCombined = "combined"
+	FormatCommon   = "common"
+	FormatJSON     = "json"
+)
+
+// The fields of the json format, logged in this order.
+const (
+	FieldTime       = "time"
+	FieldRemoteAddr = "remoteAddr"
+	FieldUser       = "user"
+	FieldMethod     = "method"
+	FieldURI        = "uri"
+	FieldProtocol   = "protocol"
+	FieldStatus     = "status"
+	FieldSize       = "size"
+	FieldReferer    = "referer"
+	FieldUserAgent  = "userAgent"
+	// FieldDuration is the duration of the request in seconds.
+	FieldDuration   = "duration"
+	FieldRequestID  = "requestID"
+	FieldRepository = "repository"
+	FieldAction     = "action"
+	FieldDigest     = "digest"
+	FieldCache      = "cache"
+	// FieldUpstreamDuration is the time spent on the upstream of the pull
+	// through cache by the request, in seconds.
+	FieldUpstreamDuration = "upstreamDuration"
+)
+
+// field is a field of the json format, whose value is omitted when nil.
+type field struct {
+	name  string
+	value func(*line) any
+}
+
+// orNil returns the string, or nil if it is empty.
+func orNil(s string) any {
+	if s == "" {
+		return nil
+	}
+	return s
+}
+
+var fields = []field{
+	{FieldTime, func(l *line) any { return l.time.UTC().Format(time.RFC3339Nano) }},
+	{FieldRemoteAddr, func(l *line) any { return l.remoteAddr }},
+	{FieldUser, func(l *line) any { return orNil(l.record.User) }},
+	{FieldMethod, func(l *line) any { return l.r.Method }},
+	{FieldURI, func(l *line) any { return l.uri }},
+	{FieldProtocol, func(l *line) any { return l.r.Proto }},
+	{FieldStatus, func(l *line) any { return l.status }},
+	{FieldSize, func(l *line) any { return l.size }},
+	{FieldReferer, func(l *line) any { return orNil(l.r.Referer()) }},
+	{FieldUserAgent, func(l *line) any { return orNil(l.r.UserAgent()) }},
+	{FieldDuration, func(l *line) any { return l.duration.Seconds() }},
+	{FieldRequestID, func(l *line) any { return orNil(l.requestID) }},
+	{FieldRepository, func(l *line) any { return orNil(l.record.Repository) }},
+	{FieldAction, func(l *line) any { return orNil(l.record.Action) }},
+	{FieldDigest, func(l *line) any { return orNil(l.record.Digest.String()) }},
+	{FieldCache, func(l *line) any { return orNil(l.record.Cache) }},
+	{FieldUpstreamDuration, func(l *line) any {
+		if l.record.UpstreamDuration == 0 {
+			return nil
+		}
+		return l.record.UpstreamDuration.Seconds()
+	}},
+}
+
+// line is a request logged.
+type line struct {
+	r          *http.Request
+	time       time.Time
+	duration   time.Duration
+	remoteAddr string
+	uri        string
+	status     int
+	size       int64
+	requestID  string
+	record     *Record
+}
+
+// handler logs the requests served by the next handler.
+type handler struct {
+	next   http.Handler
+	format string
+	fields []field
+
+	mu sync.Mutex
+	w  io.Writer
+	// now returns the current time, which is fixed by the tests.
+	now func() time.Time
+}
+
+// NewHandler returns a handler logging the requests served by next to w in
+// the format configured, or an error if the configuration is invalid.
+func NewHandler(w io.Writer, config configuration.AccessLog, next http.Handler) (http.Handler, error) {
+	h := &handler{
+		next:   next,
+		format: config.Format,
+		w:      w,
+		now:    time.Now,
+	}
+	switch h.format {
+	case "":
+		h.format = FormatCombined
+	case FormatCombined, FormatCommon, FormatJSON:
+	default:
+		return nil, fmt.Errorf("unsupported access log format: %q", config.Format)
+	}
+	if h.format != FormatJSON && (len(config.Fields) > 0 || len(config.Rename) > 0) {
+		return nil, fmt.Errorf("access log fields are only supported by the %s format", FormatJSON)
+	}
+
+	known := make(map[string]field, len(fields))
+	for _, f := range fields {
+		known[f.name] = f
+	}
+	h.fields = slices.Clone(fields)
+	if len(config.Fields) > 0 {
+		h.fields = make([]field, 0, len(config.Fields))
+		for _, name := range config.Fields {
+			f, ok := known[name]
+			if !ok {
+				return nil, fmt.Errorf("unknown access log field: %q", name)
+			}
+			h.fields = append(h.fields, f)
+		}
+	}
+	for name := range config.Rename {
+		if _, ok := known[name]; !ok {
+			return nil, fmt.Errorf("unknown access log field renamed: %q", name)
+		}
+	}
+	names := make(map[string]struct{}, len(h.fields))
+	for i, f := range h.fields {
+		if name, ok := config.Rename[f.name]; ok {
+			if name == "" {
+				return nil, fmt.Errorf("access log field %q renamed to an empty name", f.name)
+			}
+			h.fields[i].name = name
+		}
+		if _, ok := names[h.fields[i].name]; ok {
+			return nil, fmt.Errorf("access log field %q logged more than once", h.fields[i].name)
+		}
+		names[h.fields[i].name] = struct{}{}
+	}
+	return h, nil
+}
+
+func (h *handler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	l := line{
+		r:      r,
+		time:   h.now(),
+		uri:    r.RequestURI,
+		record: &Record{},
+	}
+	rw := &responseWriter{ResponseWriter: w, status: http.StatusOK}
+	h.next.ServeHTTP(rw, r.WithContext(WithRecord(r.Context(), l.record)))
+
+	l.duration = h.now().Sub(l.time)
+	l.status, l.size = rw.status, rw.size
+	l.requestID = rw.Header().Get(dcontext.RequestIDHeader)
+	l.remoteAddr = r.RemoteAddr
+	if host, _, err := net.SplitHostPort(r.RemoteAddr); err == nil {
+		l.remoteAddr = host
+	}
+	if r.ProtoMajor == 2 && r.Method == http.MethodConnect {
+		l.uri = r.Host
+	}
+	if l.uri == "" {
+		l.uri = r.URL.RequestURI()
+	}
+
+	var buf bytes.Buffer
+	if h.format == FormatJSON {
+		h.appendJSON(&buf, &l)
+	} else {
+		appendCommon(&buf, &l)
+		if h.format == FormatCombined {
+			buf.WriteString(` "`)
+			appendQuoted(&buf, l.r.Referer())
+			buf.WriteString(`" "`)
+			appendQuoted(&buf, l.r.UserAgent())
+			buf.WriteByte('"')
+		}
+	}
+	buf.WriteByte('\n')
+
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if _, err := h.w.Write(buf.Bytes()); err != nil {
+		dcontext.GetLogger(r.Context()).Errorf("error writing the access log: %v", err)
+	}
+}
+
+// appendCommon appends the line in the common log format.
+func appendCommon(buf *bytes.Buffer, l *line) {
+	user := l.record.User
+	if user == "" {
+		user = "-"
+	}
+	buf.WriteString(l.remoteAddr)
+	buf.WriteString(" - ")
+	appendQuoted(buf, user)
+	buf.WriteString(" [")
+	buf.WriteString(l.time.Format("02/Jan/2006:15:04:05 -0700"))
+	buf.WriteString(`] "`)
+	buf.WriteString(l.r.Method)
+	buf.WriteByte(' ')
+	appendQuoted(buf, l.uri)
+	buf.WriteByte(' ')
+	buf.WriteString(l.r.Proto)
+	buf.WriteString(`" `)
+	buf.WriteString(strconv.Itoa(l.status))
+	buf.WriteByte(' ')
+	buf.WriteString(strconv.FormatInt(l.size, 10))
+}
+
+// appendQuoted appends s with its quotes, backslashes and non-printable
+// characters escaped, as gorilla/handlers does.
+func appendQuoted(buf *bytes.Buffer, s string) {
+	q := strconv.Quote(s)
+	buf.WriteString(q[1 : len(q)-1])
+}
+
+// appendJSON appends the line as a JSON object of the fields configured.
+func (h *handler) appendJSON(buf *bytes.Buffer, l *line) {
+	enc := json.NewEncoder(buf)
+	enc.SetEscapeHTML(false)
+	buf.WriteByte('{')
+	first := true
+	for _, f := range h.fields {
+		v := f.value(l)
+		if v == nil {
+			continue
+		}
+		if !first {
+			buf.WriteByte(',')
+		}
+		first = false
+		// The names and values, strings and numbers, are always encoded
+		// and terminated by a newline.
+		_ = enc.Encode(f.name)
+		buf.Truncate(buf.Len() - 1)
+		buf.WriteByte(':')
+		_ = enc.Encode(v)
+		buf.Truncate(buf.Len() - 1)
+	}
+	buf.WriteByte('}')
+}
+
+// responseWriter records the status and the size of the response.
+type responseWriter struct {
+	http.ResponseWriter
+	status      int
+	size        int64
+	wroteHeader bool
+}
+
+func (rw *responseWriter) WriteHeader(status int) {
+	if !rw.wroteHeader {
+		rw.status = status
+		rw.wroteHeader = status >= http.StatusOK || status == http.StatusSwitchingProtocols
+	}
+	rw.ResponseWriter.WriteHeader(status)
+}
+
+func (rw *responseWriter) Write(p []byte) (int, error) {
+	rw.wroteHeader = true
+	n, err := rw.ResponseWriter.Write(p)
+	rw.size += int64(n)
+	return n, err
+}
+
+func (rw *responseWriter) Flush() {
+	if flusher, ok := rw.ResponseWriter.(http.Flusher); ok {
+		flusher.Flush()
+	}
+}
+
+func (rw *responseWriter) Unwrap() http.ResponseWriter {
+	return rw.ResponseWriter
+}
@@ -0,0 +1,161 @@
+package accesslog
+
+import (
+	"bytes"
+	"flag"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/distribution/distribution/v3/configuration"
+	"github.com/distribution/distribution/v3/internal/dcontext"
+	"github.com/opencontainers/go-digest"
+)
+
+var updateGolden = flag.Bool("update", false, "update the golden files in testdata")
+
+// blobHandler serves a blob pulled through the cache, as the registry does.
+var blobHandler = http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+	record := GetRecord(r.Context())
+	record.SetRequest("library/alpine", "pull", digest.FromString("layer"))
+	record.SetUser("alice")
+	record.SetCache(false)
+	record.AddUpstreamDuration(120 * time.Millisecond)
+
+	w.Header().Set(dcontext.RequestIDHeader, "0c5b4d1e-request")
+	w.WriteHeader(http.StatusOK)
+	_, _ = w.Write([]byte("some layer content"))
+})
+
+// serve logs the request for the blob in the format configured.
+func serve(t *testing.T, config configuration.AccessLog) []byte {
+	t.Helper()
+	var buf bytes.Buffer
+	h, err := NewHandler(&buf, config, blobHandler)
+	if err != nil {
+		t.Fatalf("unexpected error creating the handler: %v", err)
+	}
+	start := time.Date(2024, 3, 1, 12, 30, 45, 0, time.UTC)
+	calls := 0
+	h.(*handler).now = func() time.Time {
+		calls++
+		if calls == 1 {
+			return start
+		}
+		return start.Add(250 * time.Millisecond)
+	}
+
+	r := httptest.NewRequest(http.MethodGet, "/v2/library/alpine/blobs/"+digest.FromString("layer").String(), nil)
+	r.RemoteAddr = "192.0.2.10:51234"
+	r.Header.Set("User-Agent", `docker/27.0 "test"`)
+	r.Header.Set("Referer", "https://example.com/")
+	h.ServeHTTP(httptest.NewRecorder(), r)
+	return buf.Bytes()
+}
+
+func TestHandlerFormats(t *testing.T) {
+	for _, tc := range []struct {
+		golden string
+		config configuration.AccessLog
+	}{
+		{golden: "default.log"},
+		{golden: "combined.log", config: configuration.AccessLog{Format: FormatCombined}},
+		{golden: "common.log", config: configuration.AccessLog{Format: FormatCommon}},
+		{golden: "json.log", config: configuration.AccessLog{Format: FormatJSON}},
+		{golden: "json-fields.log", config: configuration.AccessLog{
+			Format: FormatJSON,
+			Fields: []string{FieldTime, FieldMethod, FieldURI, FieldStatus, FieldSize, FieldRepository, FieldCache, FieldUpstreamDuration},
+			Rename: map[string]string{FieldTime: "@timestamp", FieldURI: "path", FieldCache: "cache_status"},
+		}},
+	} {
+		t.Run(tc.golden, func(t *testing.T) {
+			p := serve(t, tc.config)
+			golden := filepath.Join("testdata", tc.golden)
+			if *updateGolden {
+				if err := os.WriteFile(golden, p, 0o644); err != nil {
+					t.Fatal(err)
+				}
+			}
+			expected, err := os.ReadFile(golden)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !bytes.Equal(p, expected) {
+				t.Fatalf("line differs from %s:\n%s", golden, p)
+			}
+		})
+	}
+}
+
+func TestHandlerOmitsEmptyFields(t *testing.T) {
+	var buf bytes.Buffer
+	h, err := NewHandler(&buf, configuration.AccessLog{Format: FormatJSON}, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	h.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "/v2/", nil))
+	for _, name := range []string{FieldUser, FieldRepository, FieldAction, FieldDigest, FieldCache, FieldUpstreamDuration, FieldRequestID} {
+		if strings.Contains(buf.String(), `"`+name+`"`) {
+			t.Errorf("unexpected field %s in %s", name, buf.String())
+		}
+	}
+	if !strings.Contains(buf.String(), `"status":200,"size":0`) {
+		t.Errorf("unexpected status or size in %s", buf.String())
+	}
+}
+
+func TestNewHandlerInvalidConfiguration(t *testing.T) {
+	for _, tc := range []struct {
+		name   string
+		config configuration.AccessLog
+		err    string
+	}{
+		{
+			name:   "unknown format",
+			config: configuration.AccessLog{Format: "apache"},
+			err:    `unsupported access log format: "apache"`,
+		},
+		{
+			name:   "fields of the combined format",
+			config: configuration.AccessLog{Fields: []string{FieldStatus}},
+			err:    "access log fields are only supported by the json format",
+		},
+		{
+			name:   "unknown field",
+			config: configuration.AccessLog{Format: FormatJSON, Fields: []string{"latency"}},
+			err:    `unknown access log field: "latency"`,
+		},
+		{
+			name:   "unknown field renamed",
+			config: configuration.AccessLog{Format: FormatJSON, Rename: map[string]string{"latency": "duration"}},
+			err:    `unknown access log field renamed: "latency"`,
+		},
+		{
+			name:   "empty name",
+			config: configuration.AccessLog{Format: FormatJSON, Rename: map[string]string{FieldURI: ""}},
+			err:    `access log field "uri" renamed to an empty name`,
+		},
+		{
+			name:   "duplicate name",
+			config: configuration.AccessLog{Format: FormatJSON, Rename: map[string]string{FieldURI: FieldMethod}},
+			err:    `access log field "method" logged more than once`,
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			_, err := NewHandler(&bytes.Buffer{}, tc.config, blobHandler)
+			if err == nil || err.Error() != tc.err {
+				t.Fatalf("unexpected error %v, expected %s", err, tc.err)
+			}
+		})
+	}
+
+	// The names of the fields are left untouched by the renames.
+	serve(t, configuration.AccessLog{Format: FormatJSON, Rename: map[string]string{FieldURI: "path"}})
+	if fields[4].name != FieldURI {
+		t.Fatalf("unexpected name of the uri field: %s", fields[4].name)
+	}
+}
@@ -0,0 +1,99 @@
+package accesslog
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"github.com/opencontainers/go-digest"
+)
+
+// The outcomes of the pull through cache.
+const (
+	CacheHit  = "hit"
+	CacheMiss = "miss"
+)
+
+// recordKey is the context key of the record of the request.
+type recordKey struct{}
+
+// Record holds the fields of the access log computed by the handlers serving
+// the request. Its methods may be called on the nil Record of a request
+// which is not logged.
+type Record struct {
+	mu sync.Mutex
+
+	// User is the user authenticated by the request.
+	User string
+	// Repository is the name of the repository of the request.
+	Repository string
+	// Action is the access to the repository requested: pull, push or
+	// delete.
+	Action string
+	// Digest is the digest of the blob of the request.
+	Digest digest.Digest
+	// Cache is the outcome of the pull through cache, CacheHit or
+	// CacheMiss, if the request was served by it.
+	Cache string
+	// UpstreamDuration is the time spent on the upstream of the pull
+	// through cache.
+	UpstreamDuration time.Duration
+}
+
+// WithRecord returns a context holding the record of its request.
+func WithRecord(ctx context.Context, record *Record) context.Context {
+	return context.WithValue(ctx, recordKey{}, record)
+}
+
+// GetRecord returns the record of the request of the context, or nil if the
+// request is not logged.
+func GetRecord(ctx context.Context) *Record {
+	record, _ := ctx.Value(recordKey{}).(*Record)
+	return record
+}
+
+// SetRequest records the repository, the action and the blob digest of the
+// request.
+func (r *Record) SetRequest(repository, action string, dgst digest.Digest) {
+	if r == nil {
+		return
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.Repository, r.Action, r.Digest = repository, action, dgst
+}
+
+// SetUser records the user authenticated by the request.
+func (r *Record) SetUser(user string) {
+	if r == nil {
+		return
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.User = user
+}
+
+// SetCache records the outcome of the pull through cache, which is a miss
+// once the content of any lookup had to be fetched from the upstream.
+func (r *Record) SetCache(hit bool) {
+	if r == nil {
+		return
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if !hit {
+		r.Cache = CacheMiss
+	} else if r.Cache == "" {
+		r.Cache = CacheHit
+	}
+}
+
+// AddUpstreamDuration adds d to the time spent on the upstream.
+func (r *Record) AddUpstreamDuration(d time.Duration) {
+	if r == nil {
+		return
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.UpstreamDuration += d
+}
@@ -224,6 +224,103 @@ var (
 		the maximum allowed.`,
 		HTTPStatusCode: http.StatusBadRequest,
 	})
+
+	// ErrorCodeAddressDenied is returned when the network policy does not
+	// allow the action from the address of the client.
+	ErrorCodeAddressDenied = register(errGroup, ErrorDescriptor{
+		Value:   "ADDRESS_DENIED",
+		Message: "requested access is denied from the client address",
+		Description: `The network policy of the registry does not allow
+		the operation on the repository from the address of the client.`,
+		HTTPStatusCode: http.StatusForbidden,
+	})
+
+	// ErrorCodeManifestSignatureInvalid is returned when the signatures of
+	// the manifest of a pull through cache do not verify.
+	ErrorCodeManifestSignatureInvalid = register(errGroup, ErrorDescriptor{
+		Value:   "MANIFEST_SIGNATURE_INVALID",
+		Message: "manifest signature verification failed",
+		Description: `During a manifest pull through a cache verifying the
+		signatures of the manifests of the remote, if the manifest is not
+		signed by a trusted key or identity, this error will be returned.`,
+		HTTPStatusCode: http.StatusForbidden,
+	})
+
+	// ErrorCodeTagImmutable is returned when a manifest push would move an
+	// immutable tag, or a delete would remove it.
+	ErrorCodeTagImmutable = register(errGroup, ErrorDescriptor{
+		Value:   "TAG_IMMUTABLE",
+		Message: "tag is immutable",
+		Description: `The tag matches an immutability rule of the registry
+		and already references another manifest, so that it cannot be
+		pushed again, or cannot be deleted.`,
+		HTTPStatusCode: http.StatusConflict,
+	})
+
+	// ErrorCodeQuotaExceeded is returned when linking a blob to a repository
+	// would exceed its quota.
+	ErrorCodeQuotaExceeded = register(errGroup, ErrorDescriptor{
+		Value:   "QUOTA_EXCEEDED",
+		Message: "repository quota exceeded",
+		Description: `The blob uploaded or mounted would bring the total size
+		of the blobs linked by the repository over its quota. The detail
+		holds the usage and the limit of the repository, in bytes.`,
+		HTTPStatusCode: http.StatusRequestEntityTooLarge,
+	})
+
+	// ErrorCodeAdminRequestInvalid is returned when the body of a request to
+	// the admin API is invalid.
+	ErrorCodeAdminRequestInvalid = register(errGroup, ErrorDescriptor{
+		Value:   "ADMIN_REQUEST_INVALID",
+		Message: "invalid admin request",
+		Description: `The body of a request to the admin API of the registry
+		could not be parsed, or holds invalid values.`,
+		HTTPStatusCode: http.StatusBadRequest,
+	})
+
+	// ErrorCodeNameMoved is returned when the repository was renamed.
+	ErrorCodeNameMoved = register(errGroup, ErrorDescriptor{
+		Value:   "NAME_MOVED",
+		Message: "repository name moved",
+		Description: `This is returned if the repository was renamed. The
+		new name is returned in the detail, and the reads of the repository
+		are redirected to it.`,
+		HTTPStatusCode: http.StatusMovedPermanently,
+	})
+
+	// ErrorCodeUpstreamAuthFailed is returned when the upstream of a pull
+	// through cache refuses the credentials of the cache.
+	ErrorCodeUpstreamAuthFailed = register(errGroup, ErrorDescriptor{
+		Value:   "UPSTREAM_AUTH_FAILED",
+		Message: "authentication to the upstream registry failed",
+		Description: `The client is authorized by the registry, but the
+		upstream registry the content is pulled through from, or its token
+		service, refused the credentials configured for it. The host of the
+		upstream is returned in the detail.`,
+		HTTPStatusCode: http.StatusBadGateway,
+	})
+
+	// ErrorCodeUpstreamAuthUnavailable is returned when the credentials of a
+	// pull through cache for its upstream cannot be obtained.
+	ErrorCodeUpstreamAuthUnavailable = register(errGroup, ErrorDescriptor{
+		Value:   "UPSTREAM_AUTH_UNAVAILABLE",
+		Message: "authentication to the upstream registry is unavailable",
+		Description: `The client is authorized by the registry, but the token
+		service of the upstream registry the content is pulled through from,
+		or the service its credentials are obtained from, failed. The host of
+		the upstream is returned in the detail.`,
+		HTTPStatusCode: http.StatusServiceUnavailable,
+	})
+
+	// ErrorCodeSearchInvalid is returned when the parameters of a search are
+	// invalid.
+	ErrorCodeSearchInvalid = register(errGroup, ErrorDescriptor{
+		Value:   "SEARCH_INVALID",
+		Message: "invalid search",
+		Description: `The term of a search is missing or too long, or the
+		type of the results searched is unknown.`,
+		HTTPStatusCode: http.StatusBadRequest,
+	})
 )
 
 var (
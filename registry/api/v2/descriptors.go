@@ -36,6 +36,14 @@ var (
 		Description: `Tag or digest of the target manifest.`,
 	}
 
+	tagParameterDescriptor = ParameterDescriptor{
+		Name:        "tag",
+		Type:        "string",
+		Format:      reference.TagRegexp.String(),
+		Required:    true,
+		Description: `Name of the target tag.`,
+	}
+
 	uuidParameterDescriptor = ParameterDescriptor{
 		Name:        "uuid",
 		Type:        "opaque",
@@ -98,6 +106,13 @@ var (
 		Format:      "<digest>",
 	}
 
+	etagHeader = ParameterDescriptor{
+		Name:        "ETag",
+		Description: "Entity tag of the manifest, which is its quoted digest.",
+		Type:        "string",
+		Format:      `"<digest>"`,
+	}
+
 	linkHeader = ParameterDescriptor{
 		Name:        "Link",
 		Type:        "link",
@@ -219,6 +234,33 @@ var (
 			errcode.ErrorCodeTooManyRequests,
 		},
 	}
+
+	readOnlyResponseDescriptor = ResponseDescriptor{
+		Name:        "Read-Only",
+		StatusCode:  http.StatusServiceUnavailable,
+		Description: "The registry is in read-only mode, for maintenance. The message of the error explains why.",
+		Headers: []ParameterDescriptor{
+			{
+				Name:        "Retry-After",
+				Type:        "integer",
+				Description: "Number of seconds after which the client may retry the write.",
+				Format:      "<seconds>",
+			},
+			{
+				Name:        "Content-Length",
+				Type:        "integer",
+				Description: "Length of the JSON response body.",
+				Format:      "<length>",
+			},
+		},
+		Body: BodyDescriptor{
+			ContentType: "application/json",
+			Format:      errorsBody,
+		},
+		ErrorCodes: []errcode.ErrorCode{
+			errcode.ErrorCodeUnavailable,
+		},
+	}
 )
 
 const (
@@ -245,6 +287,47 @@ const (
         ...
     ]
 }`
+
+	readOnlyBody = `{
+	"enabled": <true|false>,
+	"message": <message>,
+	"since": <time>
+}`
+
+	renameBody = `{
+	"name": <new name>,
+	"from": <previous name>,
+	"redirect": <true|false>
+}`
+
+	expirationsBody = `{
+	"expirations": [
+		{
+			"repository": <name>,
+			"reference": <digest>,
+			"type": <blob|manifest>,
+			"expiry": <time>
+		},
+		...
+	]
+}`
+
+	mirrorBody = `{
+	"repository": <name>,
+	"mirrored": <count>,
+	"skipped": <count>,
+	"failed": <count>,
+	"filtered": <count>,
+	"tags": [
+		{
+			"tag": <tag>,
+			"status": <mirrored|skipped|failed>,
+			"digest": <digest>,
+			"error": <error, if failed>
+		},
+		...
+	]
+}`
 )
 
 // APIDescriptor exports descriptions of the layout of the v2 registry API.
@@ -518,6 +601,71 @@ var routeDescriptors = []RouteDescriptor{
 							tooManyRequestsDescriptor,
 						},
 					},
+					{
+						Name:           "Tags In Detail",
+						Description:    "Return the tags for the specified repository along with the manifest each tag references and the time it was last modified, paginated like the plain list. The pagination links keep the `detail` parameter.",
+						PathParameters: []ParameterDescriptor{nameParameterDescriptor},
+						QueryParameters: append([]ParameterDescriptor{
+							{
+								Name:        "detail",
+								Type:        "boolean",
+								Description: "Set to `true` to list the tags in detail.",
+								Format:      "true",
+								Required:    true,
+							},
+						}, paginationParameters...),
+						Successes: []ResponseDescriptor{
+							{
+								StatusCode:  http.StatusOK,
+								Description: "A list of the tags for the named repository in detail. The `mediaType` is left out if the manifest cannot be read, and `lastPulled` and `lastPushed` unless the registry records them and they are known.",
+								Headers: []ParameterDescriptor{
+									{
+										Name:        "Content-Length",
+										Type:        "integer",
+										Description: "Length of the JSON response body.",
+										Format:      "<length>",
+									},
+									linkHeader,
+								},
+								Body: BodyDescriptor{
+									ContentType: "application/json",
+									Format: `{
+    "name": <name>,
+    "tags": [
+        {
+            "name": <tag>,
+            "digest": <digest>,
+            "mediaType": <media type of manifest>,
+            "lastModified": <RFC 3339 time>,
+            "lastPulled": <RFC 3339 time>,
+            "lastPushed": <RFC 3339 time>
+        },
+        ...
+    ]
+}`,
+								},
+							},
+						},
+						Failures: []ResponseDescriptor{
+							invalidPaginationResponseDescriptor,
+							unauthorizedResponseDescriptor,
+							repositoryNotFoundResponseDescriptor,
+							deniedResponseDescriptor,
+							tooManyRequestsDescriptor,
+							{
+								Name:        "Not Supported",
+								Description: "The registry does not list tags in detail, such as when it is a pull-through cache.",
+								StatusCode:  http.StatusMethodNotAllowed,
+								ErrorCodes: []errcode.ErrorCode{
+									errcode.ErrorCodeUnsupported,
+								},
+								Body: BodyDescriptor{
+									ContentType: "application/json",
+									Format:      errorsBody,
+								},
+							},
+						},
+					},
 				},
 			},
 		},
@@ -536,6 +684,12 @@ var routeDescriptors = []RouteDescriptor{
 						Headers: []ParameterDescriptor{
 							hostHeader,
 							authHeader,
+							{
+								Name:        "If-None-Match",
+								Type:        "string",
+								Description: "The entity tags of the manifests known to the client, such as `\"<digest>\"`. Weak entity tags and `*` are accepted.",
+								Format:      `"<digest>", ...`,
+							},
 						},
 						PathParameters: []ParameterDescriptor{
 							nameParameterDescriptor,
@@ -547,12 +701,21 @@ var routeDescriptors = []RouteDescriptor{
 								StatusCode:  http.StatusOK,
 								Headers: []ParameterDescriptor{
 									digestHeader,
+									etagHeader,
 								},
 								Body: BodyDescriptor{
 									ContentType: "<media type of manifest>",
 									Format:      manifestBody,
 								},
 							},
+							{
+								Description: "The manifest identified by `name` and `reference` matches the `If-None-Match` header, and is not sent.",
+								StatusCode:  http.StatusNotModified,
+								Headers: []ParameterDescriptor{
+									digestHeader,
+									etagHeader,
+								},
+							},
 						},
 						Failures: []ResponseDescriptor{
 							{
@@ -605,6 +768,12 @@ var routeDescriptors = []RouteDescriptor{
 									},
 									contentLengthZeroHeader,
 									digestHeader,
+									{
+										Name:        "OCI-Subject",
+										Type:        "digest",
+										Description: "Digest of the `subject` of the manifest, set if it has one, the manifest being listed among its referrers.",
+										Format:      "<digest>",
+									},
 								},
 							},
 						},
@@ -625,10 +794,23 @@ var routeDescriptors = []RouteDescriptor{
 									errcode.ErrorCodeBlobUnknown,
 								},
 							},
+							{
+								Name:        "Manifest Too Large",
+								Description: "The manifest exceeds the maximum manifest size of the registry, stated in the detail of the error. The manifest is read no further than the limit.",
+								StatusCode:  http.StatusRequestEntityTooLarge,
+								Body: BodyDescriptor{
+									ContentType: "application/json",
+									Format:      errorsBody,
+								},
+								ErrorCodes: []errcode.ErrorCode{
+									errcode.ErrorCodeManifestInvalid,
+								},
+							},
 							unauthorizedResponseDescriptor,
 							repositoryNotFoundResponseDescriptor,
 							deniedResponseDescriptor,
 							tooManyRequestsDescriptor,
+							readOnlyResponseDescriptor,
 							{
 								Name:        "Missing Layer(s)",
 								Description: "One or more layers may be missing during a manifest upload. If so, the missing layers will be enumerated in the error response.",
@@ -672,6 +854,12 @@ var routeDescriptors = []RouteDescriptor{
 						Headers: []ParameterDescriptor{
 							hostHeader,
 							authHeader,
+							{
+								Name:        "If-Match",
+								Type:        "string",
+								Description: "Only delete the manifest or tag if it references a manifest whose entity tag, `\"<digest>\"`, is listed. Weak entity tags never match.",
+								Format:      `"<digest>", ...`,
+							},
 						},
 						PathParameters: []ParameterDescriptor{
 							nameParameterDescriptor,
@@ -700,6 +888,7 @@ var routeDescriptors = []RouteDescriptor{
 							repositoryNotFoundResponseDescriptor,
 							deniedResponseDescriptor,
 							tooManyRequestsDescriptor,
+							readOnlyResponseDescriptor,
 							{
 								Name:        "Unknown Manifest",
 								Description: "The specified `name` or `reference` are unknown to the registry and the delete was unable to proceed. Clients can assume the manifest or tag was already deleted if this response is returned.",
@@ -713,6 +902,11 @@ var routeDescriptors = []RouteDescriptor{
 									Format:      errorsBody,
 								},
 							},
+							{
+								Name:        "Precondition Failed",
+								Description: "The manifest or tag references a manifest not listed by the `If-Match` header, and was not deleted.",
+								StatusCode:  http.StatusPreconditionFailed,
+							},
 							{
 								Name:        "Not allowed",
 								Description: "Manifest or tag delete is not allowed because the registry is configured as a pull-through cache or `delete` has been disabled.",
@@ -729,136 +923,155 @@ var routeDescriptors = []RouteDescriptor{
 	},
 
 	{
-		Name:        RouteNameBlob,
-		Path:        "/v2/{name:" + reference.NameRegexp.String() + "}/blobs/{digest:" + digest.DigestRegexp.String() + "}",
-		Entity:      "Blob",
-		Description: "Operations on blobs identified by `name` and `digest`. Used to fetch or delete layers by digest.",
+		// The route of a tag is matched after the route listing the tags, so
+		// that a tag named "list" can only be deleted through its manifest
+		// route.
+		Name:        RouteNameTag,
+		Path:        "/v2/{name:" + reference.NameRegexp.String() + "}/tags/{tag:" + reference.TagRegexp.String() + "}",
+		Entity:      "Tag",
+		Description: "Delete a tag identified by `name` and `tag`, leaving the manifest it references and the other tags intact.",
 		Methods: []MethodDescriptor{
 			{
-				Method:      http.MethodGet,
-				Description: "Retrieve the blob from the registry identified by `digest`. A `HEAD` request can also be issued to this endpoint to obtain resource information without receiving all data.",
+				Method:      http.MethodDelete,
+				Description: "Delete the tag identified by `name` and `tag`. The manifest the tag references is not deleted, nor are the other tags referencing it.",
 				Requests: []RequestDescriptor{
 					{
-						Name: "Fetch Blob",
 						Headers: []ParameterDescriptor{
 							hostHeader,
 							authHeader,
 						},
 						PathParameters: []ParameterDescriptor{
 							nameParameterDescriptor,
-							digestPathParameter,
+							tagParameterDescriptor,
 						},
 						Successes: []ResponseDescriptor{
 							{
-								Description: "The blob identified by `digest` is available. The blob content will be present in the body of the request.",
-								StatusCode:  http.StatusOK,
-								Headers: []ParameterDescriptor{
-									{
-										Name:        "Content-Length",
-										Type:        "integer",
-										Description: "The length of the requested blob content.",
-										Format:      "<length>",
-									},
-									digestHeader,
-								},
-								Body: BodyDescriptor{
-									ContentType: "application/octet-stream",
-									Format:      "<blob binary data>",
-								},
-							},
-							{
-								Description: "The blob identified by `digest` is available at the provided location.",
-								StatusCode:  http.StatusTemporaryRedirect,
-								Headers: []ParameterDescriptor{
-									{
-										Name:        "Location",
-										Type:        "url",
-										Description: "The location where the layer should be accessible.",
-										Format:      "<blob location>",
-									},
-									digestHeader,
-								},
+								StatusCode: http.StatusAccepted,
 							},
 						},
 						Failures: []ResponseDescriptor{
 							{
-								Description: "There was a problem with the request that needs to be addressed by the client, such as an invalid `name` or `tag`.",
+								Name:        "Invalid Name or Tag",
+								Description: "The specified `name` or `tag` were invalid and the delete was unable to proceed.",
 								StatusCode:  http.StatusBadRequest,
 								ErrorCodes: []errcode.ErrorCode{
 									errcode.ErrorCodeNameInvalid,
-									errcode.ErrorCodeDigestInvalid,
+									errcode.ErrorCodeTagInvalid,
 								},
 								Body: BodyDescriptor{
 									ContentType: "application/json",
 									Format:      errorsBody,
 								},
 							},
+							unauthorizedResponseDescriptor,
+							repositoryNotFoundResponseDescriptor,
+							deniedResponseDescriptor,
+							tooManyRequestsDescriptor,
+							readOnlyResponseDescriptor,
 							{
-								Description: "The blob, identified by `name` and `digest`, is unknown to the registry.",
+								Name:        "Unknown Tag",
+								Description: "The specified `name` or `tag` are unknown to the registry and the delete was unable to proceed. Clients can assume the tag was already deleted if this response is returned.",
 								StatusCode:  http.StatusNotFound,
+								ErrorCodes: []errcode.ErrorCode{
+									errcode.ErrorCodeNameUnknown,
+									errcode.ErrorCodeManifestUnknown,
+								},
 								Body: BodyDescriptor{
 									ContentType: "application/json",
 									Format:      errorsBody,
 								},
+							},
+							{
+								Name:        "Not allowed",
+								Description: "Tag delete is not allowed because the registry is configured as a pull-through cache or `delete` has been disabled.",
+								StatusCode:  http.StatusMethodNotAllowed,
 								ErrorCodes: []errcode.ErrorCode{
-									errcode.ErrorCodeNameUnknown,
-									errcode.ErrorCodeBlobUnknown,
+									errcode.ErrorCodeUnsupported,
 								},
 							},
-							unauthorizedResponseDescriptor,
-							repositoryNotFoundResponseDescriptor,
-							deniedResponseDescriptor,
-							tooManyRequestsDescriptor,
 						},
 					},
+				},
+			},
+		},
+	},
+
+	{
+		Name:        RouteNameTagHistory,
+		Path:        "/v2/{name:" + reference.NameRegexp.String() + "}/tags/{tag:" + reference.TagRegexp.String() + "}/history",
+		Entity:      "Tag History",
+		Description: "Retrieve the manifests a tag has referenced.",
+		Methods: []MethodDescriptor{
+			{
+				Method:      http.MethodGet,
+				Description: "Fetch the digests of the manifests the tag identified by `name` and `tag` has referenced, with the time the tag last referenced each of them, newest first. The manifests may since have been deleted.",
+				Requests: []RequestDescriptor{
 					{
-						Name:        "Fetch Blob Part",
-						Description: "This endpoint may also support RFC7233 compliant range requests. Support can be detected by issuing a HEAD request. If the header `Accept-Range: bytes` is returned, range requests can be used to fetch partial content.",
 						Headers: []ParameterDescriptor{
 							hostHeader,
 							authHeader,
-							{
-								Name:        "Range",
-								Type:        "string",
-								Description: "HTTP Range header specifying blob chunk.",
-								Format:      "bytes=<start>-<end>",
-							},
 						},
 						PathParameters: []ParameterDescriptor{
 							nameParameterDescriptor,
-							digestPathParameter,
+							tagParameterDescriptor,
+						},
+						QueryParameters: []ParameterDescriptor{
+							{
+								Name:        "n",
+								Type:        "integer",
+								Description: "Limit the number of entries to `n` in the response.",
+								Format:      "<integer>",
+								Required:    false,
+							},
+							{
+								Name:        "last",
+								Type:        "digest",
+								Description: "Result set will include the entries after the entry of the digest `last`.",
+								Format:      "<digest>",
+								Required:    false,
+							},
 						},
 						Successes: []ResponseDescriptor{
 							{
-								Description: "The blob identified by `digest` is available. The specified chunk of blob content will be present in the body of the request.",
-								StatusCode:  http.StatusPartialContent,
+								StatusCode:  http.StatusOK,
+								Description: "The history of the tag.",
 								Headers: []ParameterDescriptor{
 									{
 										Name:        "Content-Length",
 										Type:        "integer",
-										Description: "The length of the requested blob chunk.",
+										Description: "Length of the JSON response body.",
 										Format:      "<length>",
 									},
-									{
-										Name:        "Content-Range",
-										Type:        "byte range",
-										Description: "Content range of blob chunk.",
-										Format:      "bytes <start>-<end>/<size>",
-									},
+									linkHeader,
 								},
 								Body: BodyDescriptor{
-									ContentType: "application/octet-stream",
-									Format:      "<blob binary data>",
+									ContentType: "application/json",
+									Format: `{
+    "name": <name>,
+    "tag": <tag>,
+    "history": [
+        {
+            "digest": <digest>,
+            "lastModified": <RFC 3339 time>
+        },
+        ...
+    ]
+}`,
 								},
 							},
 						},
 						Failures: []ResponseDescriptor{
+							invalidPaginationResponseDescriptor,
+							unauthorizedResponseDescriptor,
+							repositoryNotFoundResponseDescriptor,
+							deniedResponseDescriptor,
+							tooManyRequestsDescriptor,
 							{
-								Description: "There was a problem with the request that needs to be addressed by the client, such as an invalid `name` or `tag`.",
-								StatusCode:  http.StatusBadRequest,
+								Name:        "Unknown Tag",
+								Description: "The specified `tag` is unknown to the registry.",
+								StatusCode:  http.StatusNotFound,
 								ErrorCodes: []errcode.ErrorCode{
-									errcode.ErrorCodeNameInvalid,
-									errcode.ErrorCodeDigestInvalid,
+									errcode.ErrorCodeManifestUnknown,
 								},
 								Body: BodyDescriptor{
 									ContentType: "application/json",
@@ -866,31 +1079,33 @@ var routeDescriptors = []RouteDescriptor{
 								},
 							},
 							{
-								StatusCode: http.StatusNotFound,
+								Name:        "Not Supported",
+								Description: "The registry does not record the history of tags, such as when it is a pull-through cache.",
+								StatusCode:  http.StatusMethodNotAllowed,
 								ErrorCodes: []errcode.ErrorCode{
-									errcode.ErrorCodeNameUnknown,
-									errcode.ErrorCodeBlobUnknown,
+									errcode.ErrorCodeUnsupported,
 								},
 								Body: BodyDescriptor{
 									ContentType: "application/json",
 									Format:      errorsBody,
 								},
 							},
-							{
-								Description: "The range specification cannot be satisfied for the requested content. This can happen when the range is not formatted correctly or if the range is outside of the valid size of the content.",
-								StatusCode:  http.StatusRequestedRangeNotSatisfiable,
-							},
-							unauthorizedResponseDescriptor,
-							repositoryNotFoundResponseDescriptor,
-							deniedResponseDescriptor,
-							tooManyRequestsDescriptor,
 						},
 					},
 				},
 			},
+		},
+	},
+
+	{
+		Name:        RouteNamePullStats,
+		Path:        "/v2/{name:" + reference.NameRegexp.String() + "}/_stats/pulls",
+		Entity:      "Pull Statistics",
+		Description: "Retrieve the number of pulls of the manifests of a repository.",
+		Methods: []MethodDescriptor{
 			{
-				Method:      http.MethodDelete,
-				Description: "Delete the blob identified by `name` and `digest`",
+				Method:      http.MethodGet,
+				Description: "Fetch the number of times the manifests of the repository identified by `name` were pulled, by the tag or digest they were pulled by, most pulled first. Only the `GET` requests fetching a manifest are counted, not the `HEAD` requests or those answered with `304 Not Modified`.",
 				Requests: []RequestDescriptor{
 					{
 						Headers: []ParameterDescriptor{
@@ -899,249 +1114,206 @@ var routeDescriptors = []RouteDescriptor{
 						},
 						PathParameters: []ParameterDescriptor{
 							nameParameterDescriptor,
-							digestPathParameter,
 						},
 						Successes: []ResponseDescriptor{
 							{
-								StatusCode: http.StatusAccepted,
+								StatusCode:  http.StatusOK,
+								Description: "The pull counts of the repository.",
 								Headers: []ParameterDescriptor{
 									{
 										Name:        "Content-Length",
 										Type:        "integer",
-										Description: "0",
-										Format:      "0",
+										Description: "Length of the JSON response body.",
+										Format:      "<length>",
 									},
-									digestHeader,
-								},
-							},
-						},
-						Failures: []ResponseDescriptor{
-							{
-								Name:       "Invalid Name or Digest",
-								StatusCode: http.StatusBadRequest,
-								ErrorCodes: []errcode.ErrorCode{
-									errcode.ErrorCodeDigestInvalid,
-									errcode.ErrorCodeNameInvalid,
 								},
-							},
-							{
-								Description: "The blob, identified by `name` and `digest`, is unknown to the registry.",
-								StatusCode:  http.StatusNotFound,
 								Body: BodyDescriptor{
 									ContentType: "application/json",
-									Format:      errorsBody,
-								},
-								ErrorCodes: []errcode.ErrorCode{
-									errcode.ErrorCodeNameUnknown,
-									errcode.ErrorCodeBlobUnknown,
+									Format: `{
+    "name": <name>,
+    "pulls": [
+        {
+            "reference": <tag or digest>,
+            "count": <count>
+        },
+        ...
+    ]
+}`,
 								},
 							},
+						},
+						Failures: []ResponseDescriptor{
+							unauthorizedResponseDescriptor,
+							deniedResponseDescriptor,
+							tooManyRequestsDescriptor,
 							{
-								Description: "Blob delete is not allowed because the registry is configured as a pull-through cache or `delete` has been disabled",
+								Name:        "Not Supported",
+								Description: "The registry does not count the pulls.",
 								StatusCode:  http.StatusMethodNotAllowed,
+								ErrorCodes: []errcode.ErrorCode{
+									errcode.ErrorCodeUnsupported,
+								},
 								Body: BodyDescriptor{
 									ContentType: "application/json",
 									Format:      errorsBody,
 								},
-								ErrorCodes: []errcode.ErrorCode{
-									errcode.ErrorCodeUnsupported,
-								},
 							},
-							unauthorizedResponseDescriptor,
-							repositoryNotFoundResponseDescriptor,
-							deniedResponseDescriptor,
-							tooManyRequestsDescriptor,
 						},
 					},
 				},
 			},
-
-			// TODO(stevvooe): We may want to add a PUT request here to
-			// kickoff an upload of a blob, integrated with the blob upload
-			// API.
 		},
 	},
 
 	{
-		Name:        RouteNameBlobUpload,
-		Path:        "/v2/{name:" + reference.NameRegexp.String() + "}/blobs/uploads/",
-		Entity:      "Initiate Blob Upload",
-		Description: "Initiate a blob upload. This endpoint can be used to create resumable uploads or monolithic uploads.",
+		Name:        RouteNameRepositoryMetadata,
+		Path:        "/v2/{name:" + reference.NameRegexp.String() + "}/_metadata",
+		Entity:      "Repository Metadata",
+		Description: "Retrieve the metadata of a repository.",
 		Methods: []MethodDescriptor{
 			{
-				Method:      http.MethodPost,
-				Description: "Initiate a resumable blob upload. If successful, an upload location will be provided to complete the upload. Optionally, if the `digest` parameter is present, the request body will be used to complete the upload in a single request.",
+				Method:      http.MethodGet,
+				Description: "Fetch when the repository identified by `name` was last pulled and pushed. The times are written at most once per update interval, by which they may lag behind.",
 				Requests: []RequestDescriptor{
 					{
-						Name:        "Initiate Monolithic Blob Upload",
-						Description: "Upload a blob identified by the `digest` parameter in single request. This upload will not be resumable unless a recoverable error is returned.",
 						Headers: []ParameterDescriptor{
 							hostHeader,
 							authHeader,
-							{
-								Name:   "Content-Length",
-								Type:   "integer",
-								Format: "<length of blob>",
-							},
 						},
 						PathParameters: []ParameterDescriptor{
 							nameParameterDescriptor,
 						},
-						QueryParameters: []ParameterDescriptor{
-							{
-								Name:        "digest",
-								Type:        "query",
-								Format:      "<digest>",
-								Regexp:      digest.DigestRegexp,
-								Description: `Digest of uploaded blob. If present, the upload will be completed, in a single request, with contents of the request body as the resulting blob.`,
-							},
-						},
-						Body: BodyDescriptor{
-							ContentType: "application/octet-stream",
-							Format:      "<binary data>",
-						},
 						Successes: []ResponseDescriptor{
 							{
-								Description: "The blob has been created in the registry and is available at the provided location.",
-								StatusCode:  http.StatusCreated,
+								StatusCode:  http.StatusOK,
+								Description: "The metadata of the repository. The times not recorded are left out.",
 								Headers: []ParameterDescriptor{
 									{
-										Name:   "Location",
-										Type:   "url",
-										Format: "<blob location>",
+										Name:        "Content-Length",
+										Type:        "integer",
+										Description: "Length of the JSON response body.",
+										Format:      "<length>",
 									},
-									contentLengthZeroHeader,
-									dockerUploadUUIDHeader,
+								},
+								Body: BodyDescriptor{
+									ContentType: "application/json",
+									Format: `{
+    "name": <name>,
+    "lastPulled": <RFC 3339 time>,
+    "lastPushed": <RFC 3339 time>
+}`,
 								},
 							},
 						},
 						Failures: []ResponseDescriptor{
+							unauthorizedResponseDescriptor,
+							deniedResponseDescriptor,
+							tooManyRequestsDescriptor,
 							{
-								Name:       "Invalid Name or Digest",
-								StatusCode: http.StatusBadRequest,
-								ErrorCodes: []errcode.ErrorCode{
-									errcode.ErrorCodeDigestInvalid,
-									errcode.ErrorCodeNameInvalid,
-								},
-							},
-							{
-								Name:        "Not allowed",
-								Description: "Blob upload is not allowed because the registry is configured as a pull-through cache or for some other reason",
+								Name:        "Not Supported",
+								Description: "The registry does not record the last pulls and pushes.",
 								StatusCode:  http.StatusMethodNotAllowed,
 								ErrorCodes: []errcode.ErrorCode{
 									errcode.ErrorCodeUnsupported,
 								},
+								Body: BodyDescriptor{
+									ContentType: "application/json",
+									Format:      errorsBody,
+								},
 							},
-							unauthorizedResponseDescriptor,
-							repositoryNotFoundResponseDescriptor,
-							deniedResponseDescriptor,
-							tooManyRequestsDescriptor,
 						},
 					},
+				},
+			},
+		},
+	},
+
+	{
+		Name:        RouteNameReferrers,
+		Path:        "/v2/{name:" + reference.NameRegexp.String() + "}/referrers/{digest:" + digest.DigestRegexp.String() + "}",
+		Entity:      "Referrers",
+		Description: "Retrieve the manifests referring to a manifest identified by `name` and `digest` through their `subject` field.",
+		Methods: []MethodDescriptor{
+			{
+				Method:      http.MethodGet,
+				Description: "Fetch the descriptors of the manifests of the repository whose `subject` is the manifest identified by `digest`, as an image index. The manifest identified by `digest` does not need to exist.",
+				Requests: []RequestDescriptor{
 					{
-						Name:        "Initiate Resumable Blob Upload",
-						Description: "Initiate a resumable blob upload with an empty request body.",
+						Name:        "Referrers",
+						Description: "Return the referrers of the manifest.",
 						Headers: []ParameterDescriptor{
 							hostHeader,
 							authHeader,
-							contentLengthZeroHeader,
 						},
 						PathParameters: []ParameterDescriptor{
 							nameParameterDescriptor,
-						},
-						Successes: []ResponseDescriptor{
-							{
-								Description: "The upload has been created. The `Location` header must be used to complete the upload. The response should be identical to a `GET` request on the contents of the returned `Location` header.",
-								StatusCode:  http.StatusAccepted,
-								Headers: []ParameterDescriptor{
-									{
-										Name:        "Location",
-										Type:        "url",
-										Format:      "/v2/<name>/blobs/uploads/<uuid>",
-										Description: "The location of the created upload. Clients should use the contents verbatim to complete the upload, adding parameters where required.",
-									},
-									{
-										Name:        "Range",
-										Format:      "0-<offset>",
-										Description: "Range header indicating the progress of the upload. When starting an upload, it will return an empty range, since no content has been received.",
-									},
-									contentLengthZeroHeader,
-									dockerUploadUUIDHeader,
-								},
-							},
-						},
-						Failures: []ResponseDescriptor{
 							{
-								Name:       "Invalid Name or Digest",
-								StatusCode: http.StatusBadRequest,
-								ErrorCodes: []errcode.ErrorCode{
-									errcode.ErrorCodeDigestInvalid,
-									errcode.ErrorCodeNameInvalid,
-								},
+								Name:        "digest",
+								Type:        "path",
+								Required:    true,
+								Format:      digest.DigestRegexp.String(),
+								Description: `Digest of the subject manifest.`,
 							},
-							unauthorizedResponseDescriptor,
-							repositoryNotFoundResponseDescriptor,
-							deniedResponseDescriptor,
-							tooManyRequestsDescriptor,
-						},
-					},
-					{
-						Name:        "Mount Blob",
-						Description: "Mount a blob identified by the `mount` parameter from another repository.",
-						Headers: []ParameterDescriptor{
-							hostHeader,
-							authHeader,
-							contentLengthZeroHeader,
-						},
-						PathParameters: []ParameterDescriptor{
-							nameParameterDescriptor,
 						},
 						QueryParameters: []ParameterDescriptor{
 							{
-								Name:        "mount",
-								Type:        "query",
-								Format:      "<digest>",
-								Regexp:      digest.DigestRegexp,
-								Description: `Digest of blob to mount from the source repository.`,
-							},
-							{
-								Name:        "from",
+								Name:        "artifactType",
 								Type:        "query",
-								Format:      "<repository name>",
-								Regexp:      reference.NameRegexp,
-								Description: `Name of the source repository.`,
+								Format:      "<artifact type>",
+								Description: "Only return the referrers of this artifact type. The header `OCI-Filters-Applied: artifactType` is set on the response when they are filtered.",
 							},
 						},
 						Successes: []ResponseDescriptor{
 							{
-								Description: "The blob has been mounted in the repository and is available at the provided location.",
-								StatusCode:  http.StatusCreated,
+								StatusCode:  http.StatusOK,
+								Description: "An image index listing the referrers of the manifest, with an empty list of manifests if it has none.",
 								Headers: []ParameterDescriptor{
 									{
-										Name:   "Location",
-										Type:   "url",
-										Format: "<blob location>",
+										Name:        "Content-Length",
+										Type:        "integer",
+										Description: "Length of the JSON response body.",
+										Format:      "<length>",
 									},
-									contentLengthZeroHeader,
-									dockerUploadUUIDHeader,
+									{
+										Name:        "OCI-Filters-Applied",
+										Type:        "string",
+										Description: "The filters applied to the referrers, set if `artifactType` is.",
+										Format:      "artifactType",
+									},
+								},
+								Body: BodyDescriptor{
+									ContentType: "application/vnd.oci.image.index.v1+json",
+									Format: `{
+    "schemaVersion": 2,
+    "mediaType": "application/vnd.oci.image.index.v1+json",
+    "manifests": [
+        {
+            "mediaType": <media type>,
+            "digest": <digest>,
+            "size": <size>,
+            "artifactType": <artifact type>,
+            "annotations": {
+                <key>: <value>,
+                ...
+            }
+        },
+        ...
+    ]
+}`,
 								},
 							},
 						},
 						Failures: []ResponseDescriptor{
 							{
-								Name:       "Invalid Name or Digest",
-								StatusCode: http.StatusBadRequest,
+								Name:        "Invalid Digest",
+								Description: "The specified `digest` is invalid.",
+								StatusCode:  http.StatusBadRequest,
 								ErrorCodes: []errcode.ErrorCode{
-									errcode.ErrorCodeDigestInvalid,
-									errcode.ErrorCodeNameInvalid,
+									ErrorCodeDigestInvalid,
 								},
-							},
-							{
-								Name:        "Not allowed",
-								Description: "Blob mount is not allowed because the registry is configured as a pull-through cache or for some other reason",
-								StatusCode:  http.StatusMethodNotAllowed,
-								ErrorCodes: []errcode.ErrorCode{
-									errcode.ErrorCodeUnsupported,
+								Body: BodyDescriptor{
+									ContentType: "application/json",
+									Format:      errorsBody,
 								},
 							},
 							unauthorizedResponseDescriptor,
@@ -1156,50 +1328,64 @@ var routeDescriptors = []RouteDescriptor{
 	},
 
 	{
-		Name:        RouteNameBlobUploadChunk,
-		Path:        "/v2/{name:" + reference.NameRegexp.String() + "}/blobs/uploads/{uuid:[a-zA-Z0-9-_.=]+}",
-		Entity:      "Blob Upload",
-		Description: "Interact with blob uploads. Clients should never assemble URLs for this endpoint and should only take it through the `Location` header on related API requests. The `Location` header and its parameters should be preserved by clients, using the latest value returned via upload related API calls.",
+		Name:        RouteNameBlob,
+		Path:        "/v2/{name:" + reference.NameRegexp.String() + "}/blobs/{digest:" + digest.DigestRegexp.String() + "}",
+		Entity:      "Blob",
+		Description: "Operations on blobs identified by `name` and `digest`. Used to fetch or delete layers by digest.",
 		Methods: []MethodDescriptor{
 			{
 				Method:      http.MethodGet,
-				Description: "Retrieve status of upload identified by `uuid`. The primary purpose of this endpoint is to resolve the current status of a resumable upload.",
+				Description: "Retrieve the blob from the registry identified by `digest`. A `HEAD` request can also be issued to this endpoint to obtain resource information without receiving all data.",
 				Requests: []RequestDescriptor{
 					{
-						Description: "Retrieve the progress of the current upload, as reported by the `Range` header.",
+						Name: "Fetch Blob",
 						Headers: []ParameterDescriptor{
 							hostHeader,
 							authHeader,
 						},
 						PathParameters: []ParameterDescriptor{
 							nameParameterDescriptor,
-							uuidParameterDescriptor,
+							digestPathParameter,
 						},
 						Successes: []ResponseDescriptor{
 							{
-								Name:        "Upload Progress",
-								Description: "The upload is known and in progress. The last received offset is available in the `Range` header.",
-								StatusCode:  http.StatusNoContent,
+								Description: "The blob identified by `digest` is available. The blob content will be present in the body of the request.",
+								StatusCode:  http.StatusOK,
 								Headers: []ParameterDescriptor{
 									{
-										Name:        "Range",
-										Type:        "header",
-										Format:      "0-<offset>",
-										Description: "Range indicating the current progress of the upload.",
+										Name:        "Content-Length",
+										Type:        "integer",
+										Description: "The length of the requested blob content.",
+										Format:      "<length>",
 									},
-									contentLengthZeroHeader,
-									dockerUploadUUIDHeader,
+									digestHeader,
+								},
+								Body: BodyDescriptor{
+									ContentType: "application/octet-stream",
+									Format:      "<blob binary data>",
+								},
+							},
+							{
+								Description: "The blob identified by `digest` is available at the provided location.",
+								StatusCode:  http.StatusTemporaryRedirect,
+								Headers: []ParameterDescriptor{
+									{
+										Name:        "Location",
+										Type:        "url",
+										Description: "The location where the layer should be accessible.",
+										Format:      "<blob location>",
+									},
+									digestHeader,
 								},
 							},
 						},
 						Failures: []ResponseDescriptor{
 							{
-								Description: "There was an error processing the upload and it must be restarted.",
+								Description: "There was a problem with the request that needs to be addressed by the client, such as an invalid `name` or `tag`.",
 								StatusCode:  http.StatusBadRequest,
 								ErrorCodes: []errcode.ErrorCode{
-									errcode.ErrorCodeDigestInvalid,
 									errcode.ErrorCodeNameInvalid,
-									errcode.ErrorCodeBlobUploadInvalid,
+									errcode.ErrorCodeDigestInvalid,
 								},
 								Body: BodyDescriptor{
 									ContentType: "application/json",
@@ -1207,16 +1393,92 @@ var routeDescriptors = []RouteDescriptor{
 								},
 							},
 							{
-								Description: "The upload is unknown to the registry. The upload must be restarted.",
+								Description: "The blob, identified by `name` and `digest`, is unknown to the registry.",
 								StatusCode:  http.StatusNotFound,
+								Body: BodyDescriptor{
+									ContentType: "application/json",
+									Format:      errorsBody,
+								},
 								ErrorCodes: []errcode.ErrorCode{
-									errcode.ErrorCodeBlobUploadUnknown,
+									errcode.ErrorCodeNameUnknown,
+									errcode.ErrorCodeBlobUnknown,
+								},
+							},
+							unauthorizedResponseDescriptor,
+							repositoryNotFoundResponseDescriptor,
+							deniedResponseDescriptor,
+							tooManyRequestsDescriptor,
+						},
+					},
+					{
+						Name:        "Fetch Blob Part",
+						Description: "This endpoint may also support RFC7233 compliant range requests. Support can be detected by issuing a HEAD request. If the header `Accept-Range: bytes` is returned, range requests can be used to fetch partial content.",
+						Headers: []ParameterDescriptor{
+							hostHeader,
+							authHeader,
+							{
+								Name:        "Range",
+								Type:        "string",
+								Description: "HTTP Range header specifying blob chunk.",
+								Format:      "bytes=<start>-<end>",
+							},
+						},
+						PathParameters: []ParameterDescriptor{
+							nameParameterDescriptor,
+							digestPathParameter,
+						},
+						Successes: []ResponseDescriptor{
+							{
+								Description: "The blob identified by `digest` is available. The specified chunk of blob content will be present in the body of the request.",
+								StatusCode:  http.StatusPartialContent,
+								Headers: []ParameterDescriptor{
+									{
+										Name:        "Content-Length",
+										Type:        "integer",
+										Description: "The length of the requested blob chunk.",
+										Format:      "<length>",
+									},
+									{
+										Name:        "Content-Range",
+										Type:        "byte range",
+										Description: "Content range of blob chunk.",
+										Format:      "bytes <start>-<end>/<size>",
+									},
+								},
+								Body: BodyDescriptor{
+									ContentType: "application/octet-stream",
+									Format:      "<blob binary data>",
+								},
+							},
+						},
+						Failures: []ResponseDescriptor{
+							{
+								Description: "There was a problem with the request that needs to be addressed by the client, such as an invalid `name` or `tag`.",
+								StatusCode:  http.StatusBadRequest,
+								ErrorCodes: []errcode.ErrorCode{
+									errcode.ErrorCodeNameInvalid,
+									errcode.ErrorCodeDigestInvalid,
+								},
+								Body: BodyDescriptor{
+									ContentType: "application/json",
+									Format:      errorsBody,
+								},
+							},
+							{
+								StatusCode: http.StatusNotFound,
+								ErrorCodes: []errcode.ErrorCode{
+									errcode.ErrorCodeNameUnknown,
+									errcode.ErrorCodeBlobUnknown,
 								},
 								Body: BodyDescriptor{
 									ContentType: "application/json",
 									Format:      errorsBody,
 								},
 							},
+							{
+								Description: "The range specification cannot be satisfied for the requested content. This can happen when the range is not formatted correctly or if the range is outside of the valid size of the content.",
+								StatusCode:  http.StatusRequestedRangeNotSatisfiable,
+							},
 							unauthorizedResponseDescriptor,
 							repositoryNotFoundResponseDescriptor,
 							deniedResponseDescriptor,
@@ -1226,19 +1488,113 @@ var routeDescriptors = []RouteDescriptor{
 				},
 			},
 			{
-				Method:      http.MethodPatch,
-				Description: "Upload a chunk of data for the specified upload.",
+				Method:      http.MethodDelete,
+				Description: "Delete the blob identified by `name` and `digest`",
 				Requests: []RequestDescriptor{
 					{
-						Name:        "Stream upload",
-						Description: "Upload a stream of data to upload without completing the upload.",
+						Headers: []ParameterDescriptor{
+							hostHeader,
+							authHeader,
+						},
 						PathParameters: []ParameterDescriptor{
 							nameParameterDescriptor,
-							uuidParameterDescriptor,
+							digestPathParameter,
+						},
+						Successes: []ResponseDescriptor{
+							{
+								StatusCode: http.StatusAccepted,
+								Headers: []ParameterDescriptor{
+									{
+										Name:        "Content-Length",
+										Type:        "integer",
+										Description: "0",
+										Format:      "0",
+									},
+									digestHeader,
+								},
+							},
+						},
+						Failures: []ResponseDescriptor{
+							{
+								Name:       "Invalid Name or Digest",
+								StatusCode: http.StatusBadRequest,
+								ErrorCodes: []errcode.ErrorCode{
+									errcode.ErrorCodeDigestInvalid,
+									errcode.ErrorCodeNameInvalid,
+								},
+							},
+							{
+								Description: "The blob, identified by `name` and `digest`, is unknown to the registry.",
+								StatusCode:  http.StatusNotFound,
+								Body: BodyDescriptor{
+									ContentType: "application/json",
+									Format:      errorsBody,
+								},
+								ErrorCodes: []errcode.ErrorCode{
+									errcode.ErrorCodeNameUnknown,
+									errcode.ErrorCodeBlobUnknown,
+								},
+							},
+							{
+								Description: "Blob delete is not allowed because the registry is configured as a pull-through cache or `delete` has been disabled",
+								StatusCode:  http.StatusMethodNotAllowed,
+								Body: BodyDescriptor{
+									ContentType: "application/json",
+									Format:      errorsBody,
+								},
+								ErrorCodes: []errcode.ErrorCode{
+									errcode.ErrorCodeUnsupported,
+								},
+							},
+							unauthorizedResponseDescriptor,
+							repositoryNotFoundResponseDescriptor,
+							deniedResponseDescriptor,
+							tooManyRequestsDescriptor,
+							readOnlyResponseDescriptor,
 						},
+					},
+				},
+			},
+
+			// TODO(stevvooe): We may want to add a PUT request here to
+			// kickoff an upload of a blob, integrated with the blob upload
+			// API.
+		},
+	},
+
+	{
+		Name:        RouteNameBlobUpload,
+		Path:        "/v2/{name:" + reference.NameRegexp.String() + "}/blobs/uploads/",
+		Entity:      "Initiate Blob Upload",
+		Description: "Initiate a blob upload. This endpoint can be used to create resumable uploads or monolithic uploads.",
+		Methods: []MethodDescriptor{
+			{
+				Method:      http.MethodPost,
+				Description: "Initiate a resumable blob upload. If successful, an upload location will be provided to complete the upload. Optionally, if the `digest` parameter is present, the request body will be used to complete the upload in a single request.",
+				Requests: []RequestDescriptor{
+					{
+						Name:        "Initiate Monolithic Blob Upload",
+						Description: "Upload a blob identified by the `digest` parameter in single request. This upload will not be resumable unless a recoverable error is returned.",
 						Headers: []ParameterDescriptor{
 							hostHeader,
 							authHeader,
+							{
+								Name:   "Content-Length",
+								Type:   "integer",
+								Format: "<length of blob>",
+							},
+						},
+						PathParameters: []ParameterDescriptor{
+							nameParameterDescriptor,
+						},
+						QueryParameters: []ParameterDescriptor{
+							{
+								Name:        "digest",
+								Type:        "query",
+								Format:      "<digest>",
+								Regexp:      digest.DigestRegexp,
+								Description: `Digest of uploaded blob. If present, the upload will be completed, in a single request, with contents of the request body as the resulting blob.`,
+							},
 						},
 						Body: BodyDescriptor{
 							ContentType: "application/octet-stream",
@@ -1246,21 +1602,13 @@ var routeDescriptors = []RouteDescriptor{
 						},
 						Successes: []ResponseDescriptor{
 							{
-								Name:        "Data Accepted",
-								Description: "The stream of data has been accepted and the current progress is available in the range header. The updated upload location is available in the `Location` header.",
-								StatusCode:  http.StatusAccepted,
+								Description: "The blob has been created in the registry and is available at the provided location.",
+								StatusCode:  http.StatusCreated,
 								Headers: []ParameterDescriptor{
 									{
-										Name:        "Location",
-										Type:        "url",
-										Format:      "/v2/<name>/blobs/uploads/<uuid>",
-										Description: "The location of the upload. Clients should assume this changes after each request. Clients should use the contents verbatim to complete the upload, adding parameters where required.",
-									},
-									{
-										Name:        "Range",
-										Type:        "header",
-										Format:      "0-<offset>",
-										Description: "Range indicating the current progress of the upload.",
+										Name:   "Location",
+										Type:   "url",
+										Format: "<blob location>",
 									},
 									contentLengthZeroHeader,
 									dockerUploadUUIDHeader,
@@ -1269,23 +1617,812 @@ var routeDescriptors = []RouteDescriptor{
 						},
 						Failures: []ResponseDescriptor{
 							{
-								Description: "There was an error processing the upload and it must be restarted.",
-								StatusCode:  http.StatusBadRequest,
+								Name:       "Invalid Name or Digest",
+								StatusCode: http.StatusBadRequest,
 								ErrorCodes: []errcode.ErrorCode{
 									errcode.ErrorCodeDigestInvalid,
 									errcode.ErrorCodeNameInvalid,
-									errcode.ErrorCodeBlobUploadInvalid,
 								},
+							},
+							{
+								Name:        "Not allowed",
+								Description: "Blob upload is not allowed because the registry is configured as a pull-through cache or for some other reason",
+								StatusCode:  http.StatusMethodNotAllowed,
+								ErrorCodes: []errcode.ErrorCode{
+									errcode.ErrorCodeUnsupported,
+								},
+							},
+							unauthorizedResponseDescriptor,
+							repositoryNotFoundResponseDescriptor,
+							deniedResponseDescriptor,
+							tooManyRequestsDescriptor,
+							readOnlyResponseDescriptor,
+						},
+					},
+					{
+						Name:        "Initiate Resumable Blob Upload",
+						Description: "Initiate a resumable blob upload with an empty request body.",
+						Headers: []ParameterDescriptor{
+							hostHeader,
+							authHeader,
+							contentLengthZeroHeader,
+						},
+						PathParameters: []ParameterDescriptor{
+							nameParameterDescriptor,
+						},
+						Successes: []ResponseDescriptor{
+							{
+								Description: "The upload has been created. The `Location` header must be used to complete the upload. The response should be identical to a `GET` request on the contents of the returned `Location` header.",
+								StatusCode:  http.StatusAccepted,
+								Headers: []ParameterDescriptor{
+									{
+										Name:        "Location",
+										Type:        "url",
+										Format:      "/v2/<name>/blobs/uploads/<uuid>",
+										Description: "The location of the created upload. Clients should use the contents verbatim to complete the upload, adding parameters where required.",
+									},
+									{
+										Name:        "Range",
+										Format:      "0-<offset>",
+										Description: "Range header indicating the progress of the upload. When starting an upload, it will return an empty range, since no content has been received.",
+									},
+									contentLengthZeroHeader,
+									dockerUploadUUIDHeader,
+								},
+							},
+						},
+						Failures: []ResponseDescriptor{
+							{
+								Name:       "Invalid Name or Digest",
+								StatusCode: http.StatusBadRequest,
+								ErrorCodes: []errcode.ErrorCode{
+									errcode.ErrorCodeDigestInvalid,
+									errcode.ErrorCodeNameInvalid,
+								},
+							},
+							unauthorizedResponseDescriptor,
+							repositoryNotFoundResponseDescriptor,
+							deniedResponseDescriptor,
+							tooManyRequestsDescriptor,
+							readOnlyResponseDescriptor,
+						},
+					},
+					{
+						Name:        "Mount Blob",
+						Description: "Mount a blob identified by the `mount` parameter from another repository.",
+						Headers: []ParameterDescriptor{
+							hostHeader,
+							authHeader,
+							contentLengthZeroHeader,
+						},
+						PathParameters: []ParameterDescriptor{
+							nameParameterDescriptor,
+						},
+						QueryParameters: []ParameterDescriptor{
+							{
+								Name:        "mount",
+								Type:        "query",
+								Format:      "<digest>",
+								Regexp:      digest.DigestRegexp,
+								Description: `Digest of blob to mount from the source repository.`,
+							},
+							{
+								Name:        "from",
+								Type:        "query",
+								Format:      "<repository name>",
+								Regexp:      reference.NameRegexp,
+								Description: `Name of the source repository.`,
+							},
+						},
+						Successes: []ResponseDescriptor{
+							{
+								Description: "The blob has been mounted in the repository and is available at the provided location.",
+								StatusCode:  http.StatusCreated,
+								Headers: []ParameterDescriptor{
+									{
+										Name:   "Location",
+										Type:   "url",
+										Format: "<blob location>",
+									},
+									contentLengthZeroHeader,
+									dockerUploadUUIDHeader,
+								},
+							},
+						},
+						Failures: []ResponseDescriptor{
+							{
+								Name:       "Invalid Name or Digest",
+								StatusCode: http.StatusBadRequest,
+								ErrorCodes: []errcode.ErrorCode{
+									errcode.ErrorCodeDigestInvalid,
+									errcode.ErrorCodeNameInvalid,
+								},
+							},
+							{
+								Name:        "Not allowed",
+								Description: "Blob mount is not allowed because the registry is configured as a pull-through cache or for some other reason",
+								StatusCode:  http.StatusMethodNotAllowed,
+								ErrorCodes: []errcode.ErrorCode{
+									errcode.ErrorCodeUnsupported,
+								},
+							},
+							unauthorizedResponseDescriptor,
+							repositoryNotFoundResponseDescriptor,
+							deniedResponseDescriptor,
+							tooManyRequestsDescriptor,
+							readOnlyResponseDescriptor,
+						},
+					},
+				},
+			},
+		},
+	},
+
+	{
+		Name:        RouteNameBlobUploadChunk,
+		Path:        "/v2/{name:" + reference.NameRegexp.String() + "}/blobs/uploads/{uuid:[a-zA-Z0-9-_.=]+}",
+		Entity:      "Blob Upload",
+		Description: "Interact with blob uploads. Clients should never assemble URLs for this endpoint and should only take it through the `Location` header on related API requests. The `Location` header and its parameters should be preserved by clients, using the latest value returned via upload related API calls.",
+		Methods: []MethodDescriptor{
+			{
+				Method:      http.MethodGet,
+				Description: "Retrieve status of upload identified by `uuid`. The primary purpose of this endpoint is to resolve the current status of a resumable upload.",
+				Requests: []RequestDescriptor{
+					{
+						Description: "Retrieve the progress of the current upload, as reported by the `Range` header.",
+						Headers: []ParameterDescriptor{
+							hostHeader,
+							authHeader,
+						},
+						PathParameters: []ParameterDescriptor{
+							nameParameterDescriptor,
+							uuidParameterDescriptor,
+						},
+						Successes: []ResponseDescriptor{
+							{
+								Name:        "Upload Progress",
+								Description: "The upload is known and in progress. The last received offset is available in the `Range` header.",
+								StatusCode:  http.StatusNoContent,
+								Headers: []ParameterDescriptor{
+									{
+										Name:        "Range",
+										Type:        "header",
+										Format:      "0-<offset>",
+										Description: "Range indicating the current progress of the upload.",
+									},
+									contentLengthZeroHeader,
+									dockerUploadUUIDHeader,
+								},
+							},
+						},
+						Failures: []ResponseDescriptor{
+							{
+								Description: "There was an error processing the upload and it must be restarted.",
+								StatusCode:  http.StatusBadRequest,
+								ErrorCodes: []errcode.ErrorCode{
+									errcode.ErrorCodeDigestInvalid,
+									errcode.ErrorCodeNameInvalid,
+									errcode.ErrorCodeBlobUploadInvalid,
+								},
+								Body: BodyDescriptor{
+									ContentType: "application/json",
+									Format:      errorsBody,
+								},
+							},
+							{
+								Description: "The upload is unknown to the registry. The upload must be restarted.",
+								StatusCode:  http.StatusNotFound,
+								ErrorCodes: []errcode.ErrorCode{
+									errcode.ErrorCodeBlobUploadUnknown,
+								},
+								Body: BodyDescriptor{
+									ContentType: "application/json",
+									Format:      errorsBody,
+								},
+							},
+							unauthorizedResponseDescriptor,
+							repositoryNotFoundResponseDescriptor,
+							deniedResponseDescriptor,
+							tooManyRequestsDescriptor,
+						},
+					},
+				},
+			},
+			{
+				Method:      http.MethodPatch,
+				Description: "Upload a chunk of data for the specified upload.",
+				Requests: []RequestDescriptor{
+					{
+						Name:        "Stream upload",
+						Description: "Upload a stream of data to upload without completing the upload.",
+						PathParameters: []ParameterDescriptor{
+							nameParameterDescriptor,
+							uuidParameterDescriptor,
+						},
+						Headers: []ParameterDescriptor{
+							hostHeader,
+							authHeader,
+						},
+						Body: BodyDescriptor{
+							ContentType: "application/octet-stream",
+							Format:      "<binary data>",
+						},
+						Successes: []ResponseDescriptor{
+							{
+								Name:        "Data Accepted",
+								Description: "The stream of data has been accepted and the current progress is available in the range header. The updated upload location is available in the `Location` header.",
+								StatusCode:  http.StatusAccepted,
+								Headers: []ParameterDescriptor{
+									{
+										Name:        "Location",
+										Type:        "url",
+										Format:      "/v2/<name>/blobs/uploads/<uuid>",
+										Description: "The location of the upload. Clients should assume this changes after each request. Clients should use the contents verbatim to complete the upload, adding parameters where required.",
+									},
+									{
+										Name:        "Range",
+										Type:        "header",
+										Format:      "0-<offset>",
+										Description: "Range indicating the current progress of the upload.",
+									},
+									contentLengthZeroHeader,
+									dockerUploadUUIDHeader,
+								},
+							},
+						},
+						Failures: []ResponseDescriptor{
+							{
+								Description: "There was an error processing the upload and it must be restarted.",
+								StatusCode:  http.StatusBadRequest,
+								ErrorCodes: []errcode.ErrorCode{
+									errcode.ErrorCodeDigestInvalid,
+									errcode.ErrorCodeNameInvalid,
+									errcode.ErrorCodeBlobUploadInvalid,
+								},
+								Body: BodyDescriptor{
+									ContentType: "application/json",
+									Format:      errorsBody,
+								},
+							},
+							{
+								Description: "The upload is unknown to the registry. The upload must be restarted.",
+								StatusCode:  http.StatusNotFound,
+								ErrorCodes: []errcode.ErrorCode{
+									errcode.ErrorCodeBlobUploadUnknown,
+								},
+								Body: BodyDescriptor{
+									ContentType: "application/json",
+									Format:      errorsBody,
+								},
+							},
+							unauthorizedResponseDescriptor,
+							repositoryNotFoundResponseDescriptor,
+							deniedResponseDescriptor,
+							tooManyRequestsDescriptor,
+							readOnlyResponseDescriptor,
+						},
+					},
+					{
+						Name:        "Chunked upload",
+						Description: "Upload a chunk of data to specified upload without completing the upload. The data will be uploaded to the specified Content Range.",
+						PathParameters: []ParameterDescriptor{
+							nameParameterDescriptor,
+							uuidParameterDescriptor,
+						},
+						Headers: []ParameterDescriptor{
+							hostHeader,
+							authHeader,
+							{
+								Name:        "Content-Range",
+								Type:        "header",
+								Format:      "<start of range>-<end of range, inclusive>",
+								Required:    true,
+								Description: "Range of bytes identifying the desired block of content represented by the body. Start must the end offset retrieved via status check plus one. Note that this is a non-standard use of the `Content-Range` header.",
+							},
+							{
+								Name:        "Content-Length",
+								Type:        "integer",
+								Format:      "<length of chunk>",
+								Description: "Length of the chunk being uploaded, corresponding the length of the request body.",
+							},
+						},
+						Body: BodyDescriptor{
+							ContentType: "application/octet-stream",
+							Format:      "<binary chunk>",
+						},
+						Successes: []ResponseDescriptor{
+							{
+								Name:        "Chunk Accepted",
+								Description: "The chunk of data has been accepted and the current progress is available in the range header. The updated upload location is available in the `Location` header.",
+								StatusCode:  http.StatusAccepted,
+								Headers: []ParameterDescriptor{
+									{
+										Name:        "Location",
+										Type:        "url",
+										Format:      "/v2/<name>/blobs/uploads/<uuid>",
+										Description: "The location of the upload. Clients should assume this changes after each request. Clients should use the contents verbatim to complete the upload, adding parameters where required.",
+									},
+									{
+										Name:        "Range",
+										Type:        "header",
+										Format:      "0-<offset>",
+										Description: "Range indicating the current progress of the upload.",
+									},
+									contentLengthZeroHeader,
+									dockerUploadUUIDHeader,
+								},
+							},
+						},
+						Failures: []ResponseDescriptor{
+							{
+								Description: "There was an error processing the upload and it must be restarted.",
+								StatusCode:  http.StatusBadRequest,
+								ErrorCodes: []errcode.ErrorCode{
+									errcode.ErrorCodeDigestInvalid,
+									errcode.ErrorCodeNameInvalid,
+									errcode.ErrorCodeBlobUploadInvalid,
+								},
+								Body: BodyDescriptor{
+									ContentType: "application/json",
+									Format:      errorsBody,
+								},
+							},
+							{
+								Description: "The upload is unknown to the registry. The upload must be restarted.",
+								StatusCode:  http.StatusNotFound,
+								ErrorCodes: []errcode.ErrorCode{
+									errcode.ErrorCodeBlobUploadUnknown,
+								},
+								Body: BodyDescriptor{
+									ContentType: "application/json",
+									Format:      errorsBody,
+								},
+							},
+							{
+								Description: "The `Content-Range` specification cannot be accepted, either because it does not overlap with the current progress or it is invalid.",
+								StatusCode:  http.StatusRequestedRangeNotSatisfiable,
+							},
+							unauthorizedResponseDescriptor,
+							repositoryNotFoundResponseDescriptor,
+							deniedResponseDescriptor,
+							tooManyRequestsDescriptor,
+							readOnlyResponseDescriptor,
+						},
+					},
+				},
+			},
+			{
+				Method:      http.MethodPut,
+				Description: "Complete the upload specified by `uuid`, optionally appending the body as the final chunk.",
+				Requests: []RequestDescriptor{
+					{
+						Description: "Complete the upload, providing all the data in the body, if necessary. A request without a body will just complete the upload with previously uploaded content.",
+						Headers: []ParameterDescriptor{
+							hostHeader,
+							authHeader,
+							{
+								Name:        "Content-Length",
+								Type:        "integer",
+								Format:      "<length of data>",
+								Description: "Length of the data being uploaded, corresponding to the length of the request body. May be zero if no data is provided.",
+							},
+						},
+						PathParameters: []ParameterDescriptor{
+							nameParameterDescriptor,
+							uuidParameterDescriptor,
+						},
+						QueryParameters: []ParameterDescriptor{
+							{
+								Name:        "digest",
+								Type:        "string",
+								Format:      "<digest>",
+								Regexp:      digest.DigestRegexp,
+								Required:    true,
+								Description: `Digest of uploaded blob.`,
+							},
+						},
+						Body: BodyDescriptor{
+							ContentType: "application/octet-stream",
+							Format:      "<binary data>",
+						},
+						Successes: []ResponseDescriptor{
+							{
+								Name:        "Upload Complete",
+								Description: "The upload has been completed and accepted by the registry. The canonical location will be available in the `Location` header.",
+								StatusCode:  http.StatusCreated,
+								Headers: []ParameterDescriptor{
+									{
+										Name:        "Location",
+										Type:        "url",
+										Format:      "<blob location>",
+										Description: "The canonical location of the blob for retrieval",
+									},
+									{
+										Name:        "Content-Range",
+										Type:        "header",
+										Format:      "<start of range>-<end of range, inclusive>",
+										Description: "Range of bytes identifying the desired block of content represented by the body. Start must match the end of offset retrieved via status check. Note that this is a non-standard use of the `Content-Range` header.",
+									},
+									contentLengthZeroHeader,
+									digestHeader,
+								},
+							},
+						},
+						Failures: []ResponseDescriptor{
+							{
+								Description: "There was an error processing the upload and it must be restarted.",
+								StatusCode:  http.StatusBadRequest,
+								ErrorCodes: []errcode.ErrorCode{
+									errcode.ErrorCodeDigestInvalid,
+									errcode.ErrorCodeNameInvalid,
+									errcode.ErrorCodeBlobUploadInvalid,
+									errcode.ErrorCodeUnsupported,
+								},
+								Body: BodyDescriptor{
+									ContentType: "application/json",
+									Format:      errorsBody,
+								},
+							},
+							{
+								Description: "The upload is unknown to the registry. The upload must be restarted.",
+								StatusCode:  http.StatusNotFound,
+								ErrorCodes: []errcode.ErrorCode{
+									errcode.ErrorCodeBlobUploadUnknown,
+								},
+								Body: BodyDescriptor{
+									ContentType: "application/json",
+									Format:      errorsBody,
+								},
+							},
+							unauthorizedResponseDescriptor,
+							repositoryNotFoundResponseDescriptor,
+							deniedResponseDescriptor,
+							tooManyRequestsDescriptor,
+							readOnlyResponseDescriptor,
+						},
+					},
+				},
+			},
+			{
+				Method:      http.MethodDelete,
+				Description: "Cancel outstanding upload processes, releasing associated resources. If this is not called, the unfinished uploads will eventually timeout.",
+				Requests: []RequestDescriptor{
+					{
+						Description: "Cancel the upload specified by `uuid`.",
+						PathParameters: []ParameterDescriptor{
+							nameParameterDescriptor,
+							uuidParameterDescriptor,
+						},
+						Headers: []ParameterDescriptor{
+							hostHeader,
+							authHeader,
+							contentLengthZeroHeader,
+						},
+						Successes: []ResponseDescriptor{
+							{
+								Name:        "Upload Deleted",
+								Description: "The upload has been successfully deleted.",
+								StatusCode:  http.StatusNoContent,
+								Headers: []ParameterDescriptor{
+									contentLengthZeroHeader,
+								},
+							},
+						},
+						Failures: []ResponseDescriptor{
+							{
+								Description: "An error was encountered processing the delete. The client may ignore this error.",
+								StatusCode:  http.StatusBadRequest,
+								ErrorCodes: []errcode.ErrorCode{
+									errcode.ErrorCodeNameInvalid,
+									errcode.ErrorCodeBlobUploadInvalid,
+								},
+								Body: BodyDescriptor{
+									ContentType: "application/json",
+									Format:      errorsBody,
+								},
+							},
+							{
+								Description: "The upload is unknown to the registry. The client may ignore this error and assume the upload has been deleted.",
+								StatusCode:  http.StatusNotFound,
+								ErrorCodes: []errcode.ErrorCode{
+									errcode.ErrorCodeBlobUploadUnknown,
+								},
+								Body: BodyDescriptor{
+									ContentType: "application/json",
+									Format:      errorsBody,
+								},
+							},
+							unauthorizedResponseDescriptor,
+							repositoryNotFoundResponseDescriptor,
+							deniedResponseDescriptor,
+							tooManyRequestsDescriptor,
+							readOnlyResponseDescriptor,
+						},
+					},
+				},
+			},
+		},
+	},
+	{
+		Name:        RouteNameCatalog,
+		Path:        "/v2/_catalog",
+		Entity:      "Catalog",
+		Description: "List a set of available repositories in the local registry cluster. Does not provide any indication of what may be available upstream. Applications can only determine if a repository is available but not if it is not available.",
+		Methods: []MethodDescriptor{
+			{
+				Method:      http.MethodGet,
+				Description: "Retrieve a sorted, json list of repositories available in the registry.",
+				Requests: []RequestDescriptor{
+					{
+						Name:        "Catalog Fetch",
+						Description: "Request an unabridged list of repositories available.  The implementation may impose a maximum limit and return a partial set with pagination links.",
+						Successes: []ResponseDescriptor{
+							{
+								Description: "Returns the unabridged list of repositories as a json response.",
+								StatusCode:  http.StatusOK,
+								Headers: []ParameterDescriptor{
+									{
+										Name:        "Content-Length",
+										Type:        "integer",
+										Description: "Length of the JSON response body.",
+										Format:      "<length>",
+									},
+								},
+								Body: BodyDescriptor{
+									ContentType: "application/json",
+									Format: `{
+	"repositories": [
+		<name>,
+		...
+	],
+}`,
+								},
+							},
+						},
+					},
+					{
+						Name:            "Catalog Fetch Paginated",
+						Description:     "Return the specified portion of repositories.",
+						QueryParameters: paginationParameters,
+						Successes: []ResponseDescriptor{
+							{
+								StatusCode: http.StatusOK,
+								Body: BodyDescriptor{
+									ContentType: "application/json",
+									Format: `{
+	"repositories": [
+		<name>,
+		...
+	],
+	"next": "<url>?last=<name>&n=<last value of n>"
+}`,
+								},
+								Headers: []ParameterDescriptor{
+									{
+										Name:        "Content-Length",
+										Type:        "integer",
+										Description: "Length of the JSON response body.",
+										Format:      "<length>",
+									},
+									linkHeader,
+								},
+							},
+						},
+						Failures: []ResponseDescriptor{
+							invalidPaginationResponseDescriptor,
+						},
+					},
+					{
+						Name:        "Catalog Fetch By Prefix",
+						Description: "Return the repositories whose name starts with `prefix`, paginated like the whole catalog. The pagination links keep the prefix.",
+						QueryParameters: append([]ParameterDescriptor{
+							{
+								Name:        "prefix",
+								Type:        "string",
+								Description: "Only return the repositories whose name starts with prefix, such as `team-x/`. It must start a valid repository name.",
+								Format:      "<prefix>",
+								Required:    false,
+							},
+						}, paginationParameters...),
+						Successes: []ResponseDescriptor{
+							{
+								StatusCode: http.StatusOK,
+								Body: BodyDescriptor{
+									ContentType: "application/json",
+									Format: `{
+	"repositories": [
+		<name>,
+		...
+	]
+}`,
+								},
+								Headers: []ParameterDescriptor{
+									{
+										Name:        "Content-Length",
+										Type:        "integer",
+										Description: "Length of the JSON response body.",
+										Format:      "<length>",
+									},
+									linkHeader,
+								},
+							},
+						},
+						Failures: []ResponseDescriptor{
+							{
+								Name:        "Invalid Prefix",
+								Description: "The specified `prefix` does not start a valid repository name.",
+								StatusCode:  http.StatusBadRequest,
+								ErrorCodes: []errcode.ErrorCode{
+									errcode.ErrorCodeNameInvalid,
+								},
+								Body: BodyDescriptor{
+									ContentType: "application/json",
+									Format:      errorsBody,
+								},
+							},
+							invalidPaginationResponseDescriptor,
+						},
+					},
+				},
+			},
+		},
+	},
+	{
+		Name:        RouteNameSearch,
+		Path:        "/v2/_search",
+		Entity:      "Search",
+		Description: "Search the repositories, or the tags of the repositories, of the catalog index whose names contain a term, among those the client is authorized to pull from. The search is only served when the catalog index and its search are enabled.",
+		Methods: []MethodDescriptor{
+			{
+				Method:      http.MethodGet,
+				Description: "Retrieve the repositories or the tags matching the term, in the order of the catalog, as a json response.",
+				Requests: []RequestDescriptor{
+					{
+						Name:        "Search",
+						Description: "Search the repositories or the tags whose name contains `q`, regardless of case. The registry may be configured to only match the names starting with `q`. The results are paginated like the catalog, `last` being a repository name, or a `<name>:<tag>` reference for tags.",
+						QueryParameters: append([]ParameterDescriptor{
+							{
+								Name:        "q",
+								Type:        "string",
+								Description: "The term searched in the names of the repositories, or in the `<name>:<tag>` references of the tags.",
+								Format:      "<term>",
+								Required:    true,
+							},
+							{
+								Name:        "type",
+								Type:        "string",
+								Description: "What is searched: `repo`, the default, or `tag`.",
+								Format:      "repo|tag",
+								Required:    false,
+							},
+						}, paginationParameters...),
+						Successes: []ResponseDescriptor{
+							{
+								Description: "Returns the repositories, or the tags with the digests of their manifests, matching the term.",
+								StatusCode:  http.StatusOK,
+								Body: BodyDescriptor{
+									ContentType: "application/json",
+									Format: `{
+	"repositories": [
+		<name>,
+		...
+	]
+}
+
+or
+
+{
+	"tags": [
+		{
+			"name": <name>,
+			"tag": <tag>,
+			"digest": <digest>
+		},
+		...
+	]
+}`,
+								},
+								Headers: []ParameterDescriptor{
+									{
+										Name:        "Content-Length",
+										Type:        "integer",
+										Description: "Length of the JSON response body.",
+										Format:      "<length>",
+									},
+									linkHeader,
+								},
+							},
+						},
+						Failures: []ResponseDescriptor{
+							{
+								Name:        "Invalid Search",
+								Description: "The term is missing or too long, or the type is unknown.",
+								StatusCode:  http.StatusBadRequest,
+								ErrorCodes: []errcode.ErrorCode{
+									errcode.ErrorCodeSearchInvalid,
+								},
+								Body: BodyDescriptor{
+									ContentType: "application/json",
+									Format:      errorsBody,
+								},
+							},
+							{
+								Name:        "Search Unsupported",
+								Description: "The catalog index or its search is not enabled.",
+								StatusCode:  http.StatusMethodNotAllowed,
+								ErrorCodes: []errcode.ErrorCode{
+									errcode.ErrorCodeUnsupported,
+								},
+								Body: BodyDescriptor{
+									ContentType: "application/json",
+									Format:      errorsBody,
+								},
+							},
+							invalidPaginationResponseDescriptor,
+							unauthorizedResponseDescriptor,
+						},
+					},
+				},
+			},
+		},
+	},
+	{
+		Name:        RouteNameAdminReadOnly,
+		Path:        "/v2/_admin/readonly",
+		Entity:      "Read-Only Mode",
+		Description: "Get or switch the read-only mode of the registry, which refuses the writes to the repositories while the reads continue. The admin API is only served when authentication is configured, and requires access to the `admin` resource of type `registry`.",
+		Methods: []MethodDescriptor{
+			{
+				Method:      http.MethodGet,
+				Description: "Retrieve the read-only mode of the registry.",
+				Requests: []RequestDescriptor{
+					{
+						Successes: []ResponseDescriptor{
+							{
+								Description: "Returns the read-only mode as a json response.",
+								StatusCode:  http.StatusOK,
+								Body: BodyDescriptor{
+									ContentType: "application/json",
+									Format:      readOnlyBody,
+								},
+							},
+						},
+						Failures: []ResponseDescriptor{
+							unauthorizedResponseDescriptor,
+							deniedResponseDescriptor,
+						},
+					},
+				},
+			},
+			{
+				Method:      http.MethodPut,
+				Description: "Enable or disable the read-only mode of the registry. The writes refused while it is enabled return the message to the clients.",
+				Requests: []RequestDescriptor{
+					{
+						Body: BodyDescriptor{
+							ContentType: "application/json",
+							Format: `{
+	"enabled": <true|false>,
+	"message": <message>
+}`,
+						},
+						Successes: []ResponseDescriptor{
+							{
+								Description: "The read-only mode was switched. Returns the read-only mode as a json response.",
+								StatusCode:  http.StatusOK,
 								Body: BodyDescriptor{
 									ContentType: "application/json",
-									Format:      errorsBody,
+									Format:      readOnlyBody,
 								},
 							},
+						},
+						Failures: []ResponseDescriptor{
 							{
-								Description: "The upload is unknown to the registry. The upload must be restarted.",
-								StatusCode:  http.StatusNotFound,
+								Name:        "Invalid Request",
+								Description: "The body of the request could not be parsed.",
+								StatusCode:  http.StatusBadRequest,
 								ErrorCodes: []errcode.ErrorCode{
-									errcode.ErrorCodeBlobUploadUnknown,
+									errcode.ErrorCodeAdminRequestInvalid,
 								},
 								Body: BodyDescriptor{
 									ContentType: "application/json",
@@ -1293,70 +2430,58 @@ var routeDescriptors = []RouteDescriptor{
 								},
 							},
 							unauthorizedResponseDescriptor,
-							repositoryNotFoundResponseDescriptor,
 							deniedResponseDescriptor,
-							tooManyRequestsDescriptor,
 						},
 					},
+				},
+			},
+		},
+	},
+	{
+		Name:        RouteNameAdminRename,
+		Path:        "/v2/_admin/repositories/{repository:" + reference.NameRegexp.String() + "}/rename",
+		Entity:      "Repository Rename",
+		Description: "Rename a repository, moving its manifests, tags, layer links and referrers to a new name without copying its blobs. The admin API is only served when authentication is configured, and requires access to the `admin` resource of type `registry`.",
+		Methods: []MethodDescriptor{
+			{
+				Method:      http.MethodPost,
+				Description: "Rename the repository identified by `repository`. The writes to both names are refused while the repository is renamed. If `redirect` is true, the reads of the previous name are redirected to the new one with `301 Moved Permanently`, and its writes refused with the `NAME_MOVED` error code.",
+				Requests: []RequestDescriptor{
 					{
-						Name:        "Chunked upload",
-						Description: "Upload a chunk of data to specified upload without completing the upload. The data will be uploaded to the specified Content Range.",
 						PathParameters: []ParameterDescriptor{
-							nameParameterDescriptor,
-							uuidParameterDescriptor,
-						},
-						Headers: []ParameterDescriptor{
-							hostHeader,
-							authHeader,
 							{
-								Name:        "Content-Range",
-								Type:        "header",
-								Format:      "<start of range>-<end of range, inclusive>",
+								Name:        "repository",
+								Type:        "string",
+								Format:      reference.NameRegexp.String(),
 								Required:    true,
-								Description: "Range of bytes identifying the desired block of content represented by the body. Start must the end offset retrieved via status check plus one. Note that this is a non-standard use of the `Content-Range` header.",
-							},
-							{
-								Name:        "Content-Length",
-								Type:        "integer",
-								Format:      "<length of chunk>",
-								Description: "Length of the chunk being uploaded, corresponding the length of the request body.",
+								Description: "Name of the repository to rename.",
 							},
 						},
 						Body: BodyDescriptor{
-							ContentType: "application/octet-stream",
-							Format:      "<binary chunk>",
+							ContentType: "application/json",
+							Format: `{
+	"name": <new name>,
+	"redirect": <true|false>
+}`,
 						},
 						Successes: []ResponseDescriptor{
 							{
-								Name:        "Chunk Accepted",
-								Description: "The chunk of data has been accepted and the current progress is available in the range header. The updated upload location is available in the `Location` header.",
-								StatusCode:  http.StatusAccepted,
-								Headers: []ParameterDescriptor{
-									{
-										Name:        "Location",
-										Type:        "url",
-										Format:      "/v2/<name>/blobs/uploads/<uuid>",
-										Description: "The location of the upload. Clients should assume this changes after each request. Clients should use the contents verbatim to complete the upload, adding parameters where required.",
-									},
-									{
-										Name:        "Range",
-										Type:        "header",
-										Format:      "0-<offset>",
-										Description: "Range indicating the current progress of the upload.",
-									},
-									contentLengthZeroHeader,
-									dockerUploadUUIDHeader,
+								Description: "The repository was renamed.",
+								StatusCode:  http.StatusOK,
+								Body: BodyDescriptor{
+									ContentType: "application/json",
+									Format:      renameBody,
 								},
 							},
 						},
 						Failures: []ResponseDescriptor{
 							{
-								Description: "There was an error processing the upload and it must be restarted.",
+								Name:        "Invalid Request",
+								Description: "The body of the request could not be parsed, a name is invalid, or the new name holds a repository.",
 								StatusCode:  http.StatusBadRequest,
 								ErrorCodes: []errcode.ErrorCode{
-									errcode.ErrorCodeDigestInvalid,
+									errcode.ErrorCodeAdminRequestInvalid,
 									errcode.ErrorCodeNameInvalid,
-									errcode.ErrorCodeBlobUploadInvalid,
 								},
 								Body: BodyDescriptor{
 									ContentType: "application/json",
@@ -1364,10 +2489,11 @@ var routeDescriptors = []RouteDescriptor{
 								},
 							},
 							{
-								Description: "The upload is unknown to the registry. The upload must be restarted.",
+								Name:        "Unknown Repository",
+								Description: "The repository to rename is unknown.",
 								StatusCode:  http.StatusNotFound,
 								ErrorCodes: []errcode.ErrorCode{
-									errcode.ErrorCodeBlobUploadUnknown,
+									errcode.ErrorCodeNameUnknown,
 								},
 								Body: BodyDescriptor{
 									ContentType: "application/json",
@@ -1375,83 +2501,71 @@ var routeDescriptors = []RouteDescriptor{
 								},
 							},
 							{
-								Description: "The `Content-Range` specification cannot be accepted, either because it does not overlap with the current progress or it is invalid.",
-								StatusCode:  http.StatusRequestedRangeNotSatisfiable,
+								Name:        "Unavailable",
+								Description: "The registry is in read-only mode, or either name is being renamed.",
+								StatusCode:  http.StatusServiceUnavailable,
+								ErrorCodes: []errcode.ErrorCode{
+									errcode.ErrorCodeUnavailable,
+								},
+								Body: BodyDescriptor{
+									ContentType: "application/json",
+									Format:      errorsBody,
+								},
 							},
 							unauthorizedResponseDescriptor,
-							repositoryNotFoundResponseDescriptor,
 							deniedResponseDescriptor,
-							tooManyRequestsDescriptor,
 						},
 					},
 				},
 			},
+		},
+	},
+	{
+		Name:        RouteNameProxyExpirations,
+		Path:        "/v2/_proxy/expirations",
+		Entity:      "Proxy Cache Expirations",
+		Description: "List the blobs and manifests of a pull through cache scheduled to expire. The route is only served by a pull through cache when authentication is configured, and requires access to the `admin` resource of type `registry`.",
+		Methods: []MethodDescriptor{
 			{
-				Method:      http.MethodPut,
-				Description: "Complete the upload specified by `uuid`, optionally appending the body as the final chunk.",
+				Method:      http.MethodGet,
+				Description: "Retrieve the entries scheduled to expire, soonest first, paginated by the repository and the reference of the last entry returned as `<repository>@<reference>`.",
 				Requests: []RequestDescriptor{
 					{
-						Description: "Complete the upload, providing all the data in the body, if necessary. A request without a body will just complete the upload with previously uploaded content.",
-						Headers: []ParameterDescriptor{
-							hostHeader,
-							authHeader,
+						QueryParameters: append([]ParameterDescriptor{
 							{
-								Name:        "Content-Length",
-								Type:        "integer",
-								Format:      "<length of data>",
-								Description: "Length of the data being uploaded, corresponding to the length of the request body. May be zero if no data is provided.",
+								Name:        "within",
+								Type:        "duration",
+								Description: "Only list the entries expiring within the duration, such as `24h`. All the entries scheduled to expire are listed if not present.",
+								Format:      "<duration>",
+								Required:    false,
 							},
-						},
-						PathParameters: []ParameterDescriptor{
-							nameParameterDescriptor,
-							uuidParameterDescriptor,
-						},
-						QueryParameters: []ParameterDescriptor{
 							{
-								Name:        "digest",
+								Name:        "repository",
 								Type:        "string",
-								Format:      "<digest>",
-								Regexp:      digest.DigestRegexp,
-								Required:    true,
-								Description: `Digest of uploaded blob.`,
+								Description: "Only list the entries of the repository.",
+								Format:      "<name>",
+								Required:    false,
 							},
-						},
-						Body: BodyDescriptor{
-							ContentType: "application/octet-stream",
-							Format:      "<binary data>",
-						},
+						}, paginationParameters...),
 						Successes: []ResponseDescriptor{
 							{
-								Name:        "Upload Complete",
-								Description: "The upload has been completed and accepted by the registry. The canonical location will be available in the `Location` header.",
-								StatusCode:  http.StatusCreated,
-								Headers: []ParameterDescriptor{
-									{
-										Name:        "Location",
-										Type:        "url",
-										Format:      "<blob location>",
-										Description: "The canonical location of the blob for retrieval",
-									},
-									{
-										Name:        "Content-Range",
-										Type:        "header",
-										Format:      "<start of range>-<end of range, inclusive>",
-										Description: "Range of bytes identifying the desired block of content represented by the body. Start must match the end of offset retrieved via status check. Note that this is a non-standard use of the `Content-Range` header.",
-									},
-									contentLengthZeroHeader,
-									digestHeader,
+								Description: "Returns the entries scheduled to expire as a json response. The pagination links keep the `within` and `repository` parameters.",
+								StatusCode:  http.StatusOK,
+								Headers:     []ParameterDescriptor{linkHeader},
+								Body: BodyDescriptor{
+									ContentType: "application/json",
+									Format:      expirationsBody,
 								},
 							},
 						},
 						Failures: []ResponseDescriptor{
 							{
-								Description: "There was an error processing the upload and it must be restarted.",
+								Name:        "Invalid Request",
+								Description: "The `within` duration or the `repository` name is invalid.",
 								StatusCode:  http.StatusBadRequest,
 								ErrorCodes: []errcode.ErrorCode{
-									errcode.ErrorCodeDigestInvalid,
-									errcode.ErrorCodeNameInvalid,
-									errcode.ErrorCodeBlobUploadInvalid,
-									errcode.ErrorCodeUnsupported,
+									errcode.ErrorCodeAdminRequestInvalid,
+									errcode.ErrorCodePaginationNumberInvalid,
 								},
 								Body: BodyDescriptor{
 									ContentType: "application/json",
@@ -1459,10 +2573,11 @@ var routeDescriptors = []RouteDescriptor{
 								},
 							},
 							{
-								Description: "The upload is unknown to the registry. The upload must be restarted.",
-								StatusCode:  http.StatusNotFound,
+								Name:        "Not A Cache",
+								Description: "The registry is not a pull through cache, or authentication is not configured.",
+								StatusCode:  http.StatusMethodNotAllowed,
 								ErrorCodes: []errcode.ErrorCode{
-									errcode.ErrorCodeBlobUploadUnknown,
+									errcode.ErrorCodeUnsupported,
 								},
 								Body: BodyDescriptor{
 									ContentType: "application/json",
@@ -1470,45 +2585,56 @@ var routeDescriptors = []RouteDescriptor{
 								},
 							},
 							unauthorizedResponseDescriptor,
-							repositoryNotFoundResponseDescriptor,
 							deniedResponseDescriptor,
-							tooManyRequestsDescriptor,
 						},
 					},
 				},
 			},
+		},
+	},
+	{
+		Name:        RouteNameProxyMirror,
+		Path:        "/v2/_proxy/mirror",
+		Entity:      "Proxy Cache Mirror",
+		Description: "Mirror the tags of a repository of the remote of a pull through cache, pulling them through the cache as a client would. The route is only served by a pull through cache when authentication is configured, and requires access to the `admin` resource of type `registry`.",
+		Methods: []MethodDescriptor{
 			{
-				Method:      http.MethodDelete,
-				Description: "Cancel outstanding upload processes, releasing associated resources. If this is not called, the unfinished uploads will eventually timeout.",
+				Method:      http.MethodPost,
+				Description: "List the tags of `repository` from the remote, and pull those matching the glob pattern `tagPattern`, every tag if empty, with the images of the `platforms` of their indexes, the seed platforms of the cache if empty. The tags filtered out by the tag filter of the remote are not pulled, and those cached already under the digest the remote resolves them to are skipped. The content mirrored expires as pulled. The response is sent once every tag is pulled.",
 				Requests: []RequestDescriptor{
 					{
-						Description: "Cancel the upload specified by `uuid`.",
-						PathParameters: []ParameterDescriptor{
-							nameParameterDescriptor,
-							uuidParameterDescriptor,
-						},
-						Headers: []ParameterDescriptor{
-							hostHeader,
-							authHeader,
-							contentLengthZeroHeader,
+						Body: BodyDescriptor{
+							ContentType: "application/json",
+							Format: `{
+	"repository": <name>,
+	"tagPattern": <glob pattern>,
+	"platforms": [
+		{
+			"architecture": <architecture>,
+			"os": <os>
+		},
+		...
+	]
+}`,
 						},
 						Successes: []ResponseDescriptor{
 							{
-								Name:        "Upload Deleted",
-								Description: "The upload has been successfully deleted.",
-								StatusCode:  http.StatusNoContent,
-								Headers: []ParameterDescriptor{
-									contentLengthZeroHeader,
+								Description: "The tags were listed and pulled, some possibly failing, as reported by their status.",
+								StatusCode:  http.StatusOK,
+								Body: BodyDescriptor{
+									ContentType: "application/json",
+									Format:      mirrorBody,
 								},
 							},
 						},
 						Failures: []ResponseDescriptor{
 							{
-								Description: "An error was encountered processing the delete. The client may ignore this error.",
+								Name:        "Invalid Request",
+								Description: "The body of the request could not be parsed, or the repository name or the tag pattern is invalid.",
 								StatusCode:  http.StatusBadRequest,
 								ErrorCodes: []errcode.ErrorCode{
+									errcode.ErrorCodeAdminRequestInvalid,
 									errcode.ErrorCodeNameInvalid,
-									errcode.ErrorCodeBlobUploadInvalid,
 								},
 								Body: BodyDescriptor{
 									ContentType: "application/json",
@@ -1516,93 +2642,43 @@ var routeDescriptors = []RouteDescriptor{
 								},
 							},
 							{
-								Description: "The upload is unknown to the registry. The client may ignore this error and assume the upload has been deleted.",
+								Name:        "Unknown Repository",
+								Description: "No remote of the cache serves the repository.",
 								StatusCode:  http.StatusNotFound,
 								ErrorCodes: []errcode.ErrorCode{
-									errcode.ErrorCodeBlobUploadUnknown,
+									errcode.ErrorCodeNameUnknown,
 								},
 								Body: BodyDescriptor{
 									ContentType: "application/json",
 									Format:      errorsBody,
 								},
 							},
-							unauthorizedResponseDescriptor,
-							repositoryNotFoundResponseDescriptor,
-							deniedResponseDescriptor,
-							tooManyRequestsDescriptor,
-						},
-					},
-				},
-			},
-		},
-	},
-	{
-		Name:        RouteNameCatalog,
-		Path:        "/v2/_catalog",
-		Entity:      "Catalog",
-		Description: "List a set of available repositories in the local registry cluster. Does not provide any indication of what may be available upstream. Applications can only determine if a repository is available but not if it is not available.",
-		Methods: []MethodDescriptor{
-			{
-				Method:      http.MethodGet,
-				Description: "Retrieve a sorted, json list of repositories available in the registry.",
-				Requests: []RequestDescriptor{
-					{
-						Name:        "Catalog Fetch",
-						Description: "Request an unabridged list of repositories available.  The implementation may impose a maximum limit and return a partial set with pagination links.",
-						Successes: []ResponseDescriptor{
 							{
-								Description: "Returns the unabridged list of repositories as a json response.",
-								StatusCode:  http.StatusOK,
-								Headers: []ParameterDescriptor{
-									{
-										Name:        "Content-Length",
-										Type:        "integer",
-										Description: "Length of the JSON response body.",
-										Format:      "<length>",
-									},
+								Name:        "Not A Cache",
+								Description: "The registry is not a pull through cache caching the content, or authentication is not configured.",
+								StatusCode:  http.StatusMethodNotAllowed,
+								ErrorCodes: []errcode.ErrorCode{
+									errcode.ErrorCodeUnsupported,
 								},
 								Body: BodyDescriptor{
 									ContentType: "application/json",
-									Format: `{
-	"repositories": [
-		<name>,
-		...
-	],
-}`,
+									Format:      errorsBody,
 								},
 							},
-						},
-					},
-					{
-						Name:            "Catalog Fetch Paginated",
-						Description:     "Return the specified portion of repositories.",
-						QueryParameters: paginationParameters,
-						Successes: []ResponseDescriptor{
 							{
-								StatusCode: http.StatusOK,
+								Name:        "Remote Unavailable",
+								Description: "The tags of the repository could not be listed from the remote.",
+								StatusCode:  http.StatusServiceUnavailable,
+								ErrorCodes: []errcode.ErrorCode{
+									errcode.ErrorCodeUnavailable,
+								},
 								Body: BodyDescriptor{
 									ContentType: "application/json",
-									Format: `{
-	"repositories": [
-		<name>,
-		...
-	],
-	"next": "<url>?last=<name>&n=<last value of n>"
-}`,
-								},
-								Headers: []ParameterDescriptor{
-									{
-										Name:        "Content-Length",
-										Type:        "integer",
-										Description: "Length of the JSON response body.",
-										Format:      "<length>",
-									},
-									linkHeader,
+									Format:      errorsBody,
 								},
 							},
-						},
-						Failures: []ResponseDescriptor{
-							invalidPaginationResponseDescriptor,
+							unauthorizedResponseDescriptor,
+							deniedResponseDescriptor,
 						},
 					},
 				},
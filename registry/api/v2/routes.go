@@ -9,13 +9,23 @@ import (
 // The following are definitions of the name under which all V2 routes are
 // registered. These symbols can be used to look up a route based on the name.
 const (
-	RouteNameBase            = "base"
-	RouteNameManifest        = "manifest"
-	RouteNameTags            = "tags"
-	RouteNameBlob            = "blob"
-	RouteNameBlobUpload      = "blob-upload"
-	RouteNameBlobUploadChunk = "blob-upload-chunk"
-	RouteNameCatalog         = "catalog"
+	RouteNameBase               = "base"
+	RouteNameManifest           = "manifest"
+	RouteNameTags               = "tags"
+	RouteNameTag                = "tag"
+	RouteNameTagHistory         = "tag-history"
+	RouteNameReferrers          = "referrers"
+	RouteNameBlob               = "blob"
+	RouteNameBlobUpload         = "blob-upload"
+	RouteNameBlobUploadChunk    = "blob-upload-chunk"
+	RouteNameCatalog            = "catalog"
+	RouteNameSearch             = "search"
+	RouteNameAdminReadOnly      = "admin-readonly"
+	RouteNameAdminRename        = "admin-rename"
+	RouteNameProxyExpirations   = "proxy-expirations"
+	RouteNameProxyMirror        = "proxy-mirror"
+	RouteNamePullStats          = "pull-stats"
+	RouteNameRepositoryMetadata = "repository-metadata"
 )
 
 var (
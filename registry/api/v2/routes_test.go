@@ -35,6 +35,33 @@ func TestRouter(t *testing.T) {
 			RequestURI: "/v2/",
 			Vars:       map[string]string{},
 		},
+		{
+			RouteName:  RouteNameSearch,
+			RequestURI: "/v2/_search",
+			Vars:       map[string]string{},
+		},
+		{
+			RouteName:  RouteNameAdminReadOnly,
+			RequestURI: "/v2/_admin/readonly",
+			Vars:       map[string]string{},
+		},
+		{
+			RouteName:  RouteNameAdminRename,
+			RequestURI: "/v2/_admin/repositories/foo/bar/rename",
+			Vars: map[string]string{
+				"repository": "foo/bar",
+			},
+		},
+		{
+			RouteName:  RouteNameProxyExpirations,
+			RequestURI: "/v2/_proxy/expirations",
+			Vars:       map[string]string{},
+		},
+		{
+			RouteName:  RouteNameProxyMirror,
+			RequestURI: "/v2/_proxy/mirror",
+			Vars:       map[string]string{},
+		},
 		{
 			RouteName:  RouteNameManifest,
 			RequestURI: "/v2/foo/manifests/bar",
@@ -87,6 +114,52 @@ func TestRouter(t *testing.T) {
 				"name": "docker.com/foo/bar/baz",
 			},
 		},
+		{
+			RouteName:  RouteNameTag,
+			RequestURI: "/v2/foo/bar/tags/latest",
+			Vars: map[string]string{
+				"name": "foo/bar",
+				"tag":  "latest",
+			},
+		},
+		{
+			RouteName:  RouteNameTag,
+			RequestURI: "/v2/docker.com/foo/tags/v1.0_rc-1",
+			Vars: map[string]string{
+				"name": "docker.com/foo",
+				"tag":  "v1.0_rc-1",
+			},
+		},
+		{
+			RouteName:  RouteNameTagHistory,
+			RequestURI: "/v2/foo/bar/tags/latest/history",
+			Vars: map[string]string{
+				"name": "foo/bar",
+				"tag":  "latest",
+			},
+		},
+		{
+			RouteName:  RouteNamePullStats,
+			RequestURI: "/v2/foo/bar/_stats/pulls",
+			Vars: map[string]string{
+				"name": "foo/bar",
+			},
+		},
+		{
+			RouteName:  RouteNameRepositoryMetadata,
+			RequestURI: "/v2/foo/bar/_metadata",
+			Vars: map[string]string{
+				"name": "foo/bar",
+			},
+		},
+		{
+			RouteName:  RouteNameReferrers,
+			RequestURI: "/v2/foo/bar/referrers/sha256:abcdef0919234",
+			Vars: map[string]string{
+				"name":   "foo/bar",
+				"digest": "sha256:abcdef0919234",
+			},
+		},
 		{
 			RouteName:  RouteNameBlob,
 			RequestURI: "/v2/foo/bar/blobs/sha256:abcdef0919234",
@@ -127,6 +127,70 @@ func (ub *URLBuilder) BuildCatalogURL(values ...url.Values) (string, error) {
 	return appendValuesURL(catalogURL, values...).String(), nil
 }
 
+// BuildSearchURL constructs a url to search the repositories and tags of the
+// registry.
+func (ub *URLBuilder) BuildSearchURL(values ...url.Values) (string, error) {
+	route := ub.cloneRoute(RouteNameSearch)
+
+	searchURL, err := route.URL()
+	if err != nil {
+		return "", err
+	}
+
+	return appendValuesURL(searchURL, values...).String(), nil
+}
+
+// BuildAdminReadOnlyURL constructs a url to get or set the read-only mode of
+// the registry.
+func (ub *URLBuilder) BuildAdminReadOnlyURL() (string, error) {
+	route := ub.cloneRoute(RouteNameAdminReadOnly)
+
+	readOnlyURL, err := route.URL()
+	if err != nil {
+		return "", err
+	}
+
+	return readOnlyURL.String(), nil
+}
+
+// BuildAdminRenameURL constructs a url to rename the named repository.
+func (ub *URLBuilder) BuildAdminRenameURL(name reference.Named) (string, error) {
+	route := ub.cloneRoute(RouteNameAdminRename)
+
+	renameURL, err := route.URL("repository", name.Name())
+	if err != nil {
+		return "", err
+	}
+
+	return renameURL.String(), nil
+}
+
+// BuildProxyExpirationsURL constructs a url to list the entries of the pull
+// through cache scheduled to expire.
+func (ub *URLBuilder) BuildProxyExpirationsURL(values ...url.Values) (string, error) {
+	route := ub.cloneRoute(RouteNameProxyExpirations)
+
+	expirationsURL, err := route.URL()
+	if err != nil {
+		return "", err
+	}
+
+	return appendValuesURL(expirationsURL, values...).String(), nil
+}
+
+// BuildProxyMirrorURL constructs a url to mirror the tags of a repository of
+// the remote of the pull through cache.
+func (ub *URLBuilder) BuildProxyMirrorURL() (string, error) {
+	route := ub.cloneRoute(RouteNameProxyMirror)
+
+	mirrorURL, err := route.URL()
+	if err != nil {
+		return "", err
+	}
+
+	return mirrorURL.String(), nil
+}
+
 // BuildTagsURL constructs a url to list the tags in the named repository.
 func (ub *URLBuilder) BuildTagsURL(name reference.Named, values ...url.Values) (string, error) {
 	route := ub.cloneRoute(RouteNameTags)
@@ -139,6 +203,57 @@ func (ub *URLBuilder) BuildTagsURL(name reference.Named, values ...url.Values) (
 	return appendValuesURL(tagsURL, values...).String(), nil
 }
 
+// BuildTagURL constructs a url for the tag identified by ref.
+func (ub *URLBuilder) BuildTagURL(ref reference.NamedTagged) (string, error) {
+	route := ub.cloneRoute(RouteNameTag)
+
+	tagURL, err := route.URL("name", ref.Name(), "tag", ref.Tag())
+	if err != nil {
+		return "", err
+	}
+
+	return tagURL.String(), nil
+}
+
+// BuildTagHistoryURL constructs a url to list the history of the tag
+// identified by ref.
+func (ub *URLBuilder) BuildTagHistoryURL(ref reference.NamedTagged, values ...url.Values) (string, error) {
+	route := ub.cloneRoute(RouteNameTagHistory)
+
+	historyURL, err := route.URL("name", ref.Name(), "tag", ref.Tag())
+	if err != nil {
+		return "", err
+	}
+
+	return appendValuesURL(historyURL, values...).String(), nil
+}
+
+// BuildPullStatsURL constructs a url to fetch the pull counts of the named
+// repository.
+func (ub *URLBuilder) BuildPullStatsURL(name reference.Named) (string, error) {
+	route := ub.cloneRoute(RouteNamePullStats)
+
+	statsURL, err := route.URL("name", name.Name())
+	if err != nil {
+		return "", err
+	}
+
+	return statsURL.String(), nil
+}
+
+// BuildRepositoryMetadataURL constructs a url to fetch the metadata of the
+// named repository.
+func (ub *URLBuilder) BuildRepositoryMetadataURL(name reference.Named) (string, error) {
+	route := ub.cloneRoute(RouteNameRepositoryMetadata)
+
+	metadataURL, err := route.URL("name", name.Name())
+	if err != nil {
+		return "", err
+	}
+
+	return metadataURL.String(), nil
+}
+
 // BuildManifestURL constructs a url for the manifest identified by name and
 // reference. The argument reference may be either a tag or digest.
 func (ub *URLBuilder) BuildManifestURL(ref reference.Named) (string, error) {
@@ -174,6 +289,19 @@ func (ub *URLBuilder) BuildBlobURL(ref reference.Canonical) (string, error) {
 	return layerURL.String(), nil
 }
 
+// BuildReferrersURL constructs a url to list the referrers of the manifest
+// identified by name and digest.
+func (ub *URLBuilder) BuildReferrersURL(ref reference.Canonical, values ...url.Values) (string, error) {
+	route := ub.cloneRoute(RouteNameReferrers)
+
+	referrersURL, err := route.URL("name", ref.Name(), "digest", ref.Digest().String())
+	if err != nil {
+		return "", err
+	}
+
+	return appendValuesURL(referrersURL, values...).String(), nil
+}
+
 // BuildBlobUploadURL constructs a url to begin a blob upload in the
 // repository identified by name.
 func (ub *URLBuilder) BuildBlobUploadURL(name reference.Named, values ...url.Values) (string, error) {
@@ -26,6 +26,49 @@ func makeURLBuilderTestCases(urlBuilder *URLBuilder) []urlBuilderTestCase {
 			expectedErr:  nil,
 			build:        urlBuilder.BuildBaseURL,
 		},
+		{
+			description:  "test search url",
+			expectedPath: "/v2/_search?q=app&type=tag",
+			expectedErr:  nil,
+			build: func() (string, error) {
+				return urlBuilder.BuildSearchURL(url.Values{
+					"q":    []string{"app"},
+					"type": []string{"tag"},
+				})
+			},
+		},
+		{
+			description:  "test admin read-only url",
+			expectedPath: "/v2/_admin/readonly",
+			expectedErr:  nil,
+			build:        urlBuilder.BuildAdminReadOnlyURL,
+		},
+		{
+			description:  "test admin rename url",
+			expectedPath: "/v2/_admin/repositories/foo/bar/rename",
+			expectedErr:  nil,
+			build: func() (string, error) {
+				return urlBuilder.BuildAdminRenameURL(fooBarRef)
+			},
+		},
+		{
+			description:  "test proxy expirations url",
+			expectedPath: "/v2/_proxy/expirations?within=24h",
+			expectedErr:  nil,
+			build: func() (string, error) {
+				return urlBuilder.BuildProxyExpirationsURL(url.Values{
+					"within": []string{"24h"},
+				})
+			},
+		},
+		{
+			description:  "test proxy mirror url",
+			expectedPath: "/v2/_proxy/mirror",
+			expectedErr:  nil,
+			build: func() (string, error) {
+				return urlBuilder.BuildProxyMirrorURL()
+			},
+		},
 		{
 			description:  "test tags url",
 			expectedPath: "/v2/foo/bar/tags/list",
@@ -54,6 +97,40 @@ func makeURLBuilderTestCases(urlBuilder *URLBuilder) []urlBuilderTestCase {
 				})
 			},
 		},
+		{
+			description:  "test tag url",
+			expectedPath: "/v2/foo/bar/tags/tag",
+			expectedErr:  nil,
+			build: func() (string, error) {
+				ref, _ := reference.WithTag(fooBarRef, "tag")
+				return urlBuilder.BuildTagURL(ref)
+			},
+		},
+		{
+			description:  "test tag history url",
+			expectedPath: "/v2/foo/bar/tags/tag/history?n=2",
+			expectedErr:  nil,
+			build: func() (string, error) {
+				ref, _ := reference.WithTag(fooBarRef, "tag")
+				return urlBuilder.BuildTagHistoryURL(ref, url.Values{"n": []string{"2"}})
+			},
+		},
+		{
+			description:  "test pull stats url",
+			expectedPath: "/v2/foo/bar/_stats/pulls",
+			expectedErr:  nil,
+			build: func() (string, error) {
+				return urlBuilder.BuildPullStatsURL(fooBarRef)
+			},
+		},
+		{
+			description:  "test repository metadata url",
+			expectedPath: "/v2/foo/bar/_metadata",
+			expectedErr:  nil,
+			build: func() (string, error) {
+				return urlBuilder.BuildRepositoryMetadataURL(fooBarRef)
+			},
+		},
 		{
 			description:  "test manifest url tagged ref",
 			expectedPath: "/v2/foo/bar/manifests/tag",
@@ -80,6 +157,17 @@ func makeURLBuilderTestCases(urlBuilder *URLBuilder) []urlBuilderTestCase {
 				return urlBuilder.BuildBlobURL(ref)
 			},
 		},
+		{
+			description:  "build referrers url with artifactType query parameter",
+			expectedPath: "/v2/foo/bar/referrers/sha256:3b3692957d439ac1928219a83fac91e7bf96c153725526874673ae1f2023f8d5?artifactType=application%2Fvnd.example%2Bjson",
+			expectedErr:  nil,
+			build: func() (string, error) {
+				ref, _ := reference.WithDigest(fooBarRef, "sha256:3b3692957d439ac1928219a83fac91e7bf96c153725526874673ae1f2023f8d5")
+				return urlBuilder.BuildReferrersURL(ref, url.Values{
+					"artifactType": []string{"application/vnd.example+json"},
+				})
+			},
+		},
 		{
 			description:  "build blob upload url",
 			expectedPath: "/v2/foo/bar/blobs/uploads/",
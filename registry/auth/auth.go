@@ -43,6 +43,11 @@ var (
 
 	// ErrAuthenticationFailure returned when authentication fails.
 	ErrAuthenticationFailure = errors.New("authentication failure")
+
+	// ErrUnavailable is returned, wrapped, when the service backing an
+	// access controller cannot tell whether a request is authorized. The
+	// request is denied with a 503 Service Unavailable.
+	ErrUnavailable = errors.New("authorization service unavailable")
 )
 
 // InitFunc is the type of an AccessController factory function and is used
@@ -51,8 +56,16 @@ type InitFunc func(options map[string]any) (AccessController, error)
 
 var accessControllers map[string]InitFunc
 
+// ValidateFunc is the type of the functions checking the options of an
+// AccessController backend without constructing it, which may have side
+// effects such as starting goroutines or creating files.
+type ValidateFunc func(options map[string]any) error
+
+var validators map[string]ValidateFunc
+
 func init() {
 	accessControllers = make(map[string]InitFunc)
+	validators = make(map[string]ValidateFunc)
 }
 
 // UserInfo carries information about
@@ -109,6 +122,15 @@ type AccessController interface {
 	Authorized(r *http.Request, access ...Access) (*Grant, error)
 }
 
+// Closer is implemented by the access controllers which run in the
+// background, such as to reload their files.
+type Closer interface {
+	// Close stops the background work of the access controller, which may
+	// still authorize requests after. Access controllers wrapping others
+	// close them, if they implement Closer.
+	Close() error
+}
+
 // CredentialAuthenticator is an object which is able to authenticate credentials
 type CredentialAuthenticator interface {
 	AuthenticateUser(username, password string) error
@@ -126,6 +148,31 @@ func Register(name string, initFunc InitFunc) error {
 	return nil
 }
 
+// RegisterValidator is used to register a ValidateFunc for the
+// AccessController backend with the given name.
+func RegisterValidator(name string, validate ValidateFunc) error {
+	if _, exists := validators[name]; exists {
+		return fmt.Errorf("validator already registered: %s", name)
+	}
+
+	validators[name] = validate
+
+	return nil
+}
+
+// ValidateAccessController checks the options of the named backend. The
+// options of the backends without a validator are only checked once
+// constructed.
+func ValidateAccessController(name string, options map[string]any) error {
+	if _, exists := accessControllers[name]; !exists {
+		return fmt.Errorf("no access controller registered with name: %s", name)
+	}
+	if validate, exists := validators[name]; exists {
+		return validate(options)
+	}
+	return nil
+}
+
 // GetAccessController constructs an AccessController
 // with the given options using the named backend.
 func GetAccessController(name string, options map[string]any) (AccessController, error) {
@@ -0,0 +1,226 @@
+// Package chain provides an access controller which tries a list of other
+// access controllers in turn, such as htpasswd for machine clients and oidc
+// for humans. The first which grants the request access wins.
+//
+// Requests which none of the access controllers grant access get the
+// challenges of all of them.
+package chain
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"slices"
+	"strings"
+
+	"github.com/distribution/distribution/v3/health"
+	"github.com/distribution/distribution/v3/internal/dcontext"
+	"github.com/distribution/distribution/v3/registry/auth"
+	"github.com/sirupsen/logrus"
+)
+
+func init() {
+	if err := auth.Register("chain", auth.InitFunc(newAccessController)); err != nil {
+		logrus.Errorf("failed to register chain auth: %v", err)
+	}
+	if err := auth.RegisterValidator("chain", validateOptions); err != nil {
+		logrus.Errorf("failed to register chain auth: %v", err)
+	}
+}
+
+// link is an access controller of the chain, configured as in the auth
+// section of the configuration.
+type link struct {
+	authType string
+	options  map[string]any
+}
+
+type accessController struct {
+	types       []string
+	controllers []auth.AccessController
+}
+
+var (
+	_ auth.AccessController = &accessController{}
+	_ health.Checker        = &accessController{}
+	_ auth.Closer           = &accessController{}
+)
+
+func newAccessController(options map[string]any) (auth.AccessController, error) {
+	links, err := linksOf(options["controllers"])
+	if err != nil {
+		return nil, err
+	}
+	ac := &accessController{}
+	for i, l := range links {
+		controller, err := auth.GetAccessController(l.authType, l.options)
+		if err != nil {
+			return nil, fmt.Errorf("unable to configure %s access controller %d of chain: %v", l.authType, i, err)
+		}
+		ac.types = append(ac.types, l.authType)
+		ac.controllers = append(ac.controllers, controller)
+	}
+	return ac, nil
+}
+
+// Close closes the access controllers of the chain which implement
+// auth.Closer.
+func (ac *accessController) Close() error {
+	var errs []error
+	for _, controller := range ac.controllers {
+		if closer, ok := controller.(auth.Closer); ok {
+			errs = append(errs, closer.Close())
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// validateOptions checks the options of the access controllers of the
+// chain, without constructing them.
+func validateOptions(options map[string]any) error {
+	links, err := linksOf(options["controllers"])
+	if err != nil {
+		return err
+	}
+	for i, l := range links {
+		if err := auth.ValidateAccessController(l.authType, l.options); err != nil {
+			return fmt.Errorf("invalid %s access controller %d of chain: %v", l.authType, i, err)
+		}
+	}
+	return nil
+}
+
+// linksOf returns the access controllers of the controllers option, a list
+// of maps with a single key, the type of the access controller.
+func linksOf(opt any) ([]link, error) {
+	list, ok := opt.([]any)
+	if !ok || len(list) == 0 {
+		return nil, errors.New(`"controllers" must list the access controllers of chain access controller`)
+	}
+	links := make([]link, 0, len(list))
+	for i, item := range list {
+		var controllers map[string]any
+		switch v := item.(type) {
+		case map[string]any:
+			controllers = v
+		case map[any]any:
+			controllers = toStringMap(v)
+		}
+		if len(controllers) != 1 {
+			return nil, fmt.Errorf(`"controllers" entry %d must configure one access controller for chain access controller`, i)
+		}
+		for authType, controllerOpts := range controllers {
+			l := link{authType: authType}
+			switch v := controllerOpts.(type) {
+			case nil:
+				l.options = map[string]any{}
+			case map[string]any:
+				l.options = v
+			case map[any]any:
+				l.options = toStringMap(v)
+			default:
+				return nil, fmt.Errorf(`"controllers" entry %d (%s) must be a map for chain access controller`, i, authType)
+			}
+			links = append(links, l)
+		}
+	}
+	return links, nil
+}
+
+func toStringMap(m map[any]any) map[string]any {
+	sm := make(map[string]any, len(m))
+	for k, v := range m {
+		sm[fmt.Sprint(k)] = v
+	}
+	return sm
+}
+
+// Authorized tries the access controllers in order, returning the grant of
+// the first which grants the request access. The requests denied with a
+// challenge fall through to the next access controller. If none grants
+// access, the request gets the challenges of all of them, unless one of them
+// failed, such as when the service backing it is unavailable: the request is
+// then denied with the error of the first which failed.
+func (ac *accessController) Authorized(req *http.Request, accessItems ...auth.Access) (*auth.Grant, error) {
+	var (
+		challenges challenge
+		failure    error
+	)
+	for i, controller := range ac.controllers {
+		grant, err := controller.Authorized(req, accessItems...)
+		if err == nil {
+			dcontext.GetLogger(req.Context()).Debugf("chain: request granted by %s access controller", ac.types[i])
+			return grant, nil
+		}
+		var ch auth.Challenge
+		if errors.As(err, &ch) {
+			challenges = append(challenges, ch)
+			continue
+		}
+		dcontext.GetLogger(req.Context()).Errorf("chain: %s access controller failed: %v", ac.types[i], err)
+		if failure == nil {
+			failure = fmt.Errorf("%s access controller: %w", ac.types[i], err)
+		}
+	}
+	if failure != nil {
+		return nil, failure
+	}
+	return nil, challenges
+}
+
+// Check implements health.Checker, failing if one of the access controllers
+// checked fails.
+func (ac *accessController) Check(ctx context.Context) error {
+	for i, controller := range ac.controllers {
+		checker, ok := controller.(health.Checker)
+		if !ok {
+			continue
+		}
+		if err := checker.Check(ctx); err != nil {
+			return fmt.Errorf("%s access controller: %w", ac.types[i], err)
+		}
+	}
+	return nil
+}
+
+// challenge merges the challenges of the access controllers of the chain.
+type challenge []auth.Challenge
+
+func (ch challenge) Error() string {
+	msgs := make([]string, len(ch))
+	for i, c := range ch {
+		msgs[i] = c.Error()
+	}
+	return strings.Join(msgs, "; ")
+}
+
+// SetHeaders sets the headers of every challenge, in order, so that the
+// response carries a WWW-Authenticate header per challenge. The challenges
+// replacing the headers, rather than adding to them, are set on their own.
+func (ch challenge) SetHeaders(r *http.Request, w http.ResponseWriter) {
+	for _, c := range ch {
+		hw := headerWriter(http.Header{})
+		c.SetHeaders(r, hw)
+		for key, values := range hw {
+			for _, value := range values {
+				if !slices.Contains(w.Header().Values(key), value) {
+					w.Header().Add(key, value)
+				}
+			}
+		}
+	}
+}
+
+// headerWriter is a http.ResponseWriter collecting the headers set.
+type headerWriter http.Header
+
+func (hw headerWriter) Header() http.Header {
+	return http.Header(hw)
+}
+
+func (hw headerWriter) Write(p []byte) (int, error) {
+	return len(p), nil
+}
+
+func (hw headerWriter) WriteHeader(int) {}
@@ -0,0 +1,196 @@
+package chain
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"slices"
+	"strings"
+	"testing"
+
+	"github.com/distribution/distribution/v3/registry/auth"
+)
+
+var errBackend = errors.New("backend unavailable")
+
+// testController grants access to the requests with credentials of its
+// scheme, as its user, and challenges the others. It fails every request if
+// fail is set.
+type testController struct {
+	scheme string
+	user   string
+	fail   bool
+}
+
+func (tc *testController) Authorized(req *http.Request, access ...auth.Access) (*auth.Grant, error) {
+	if tc.fail {
+		return nil, fmt.Errorf("%w: %s", auth.ErrUnavailable, errBackend)
+	}
+	if !strings.HasPrefix(req.Header.Get("Authorization"), tc.scheme+" ") {
+		return nil, testChallenge{scheme: tc.scheme}
+	}
+	return &auth.Grant{User: auth.UserInfo{Name: tc.user}}, nil
+}
+
+func (tc *testController) Check(context.Context) error {
+	if tc.fail {
+		return errBackend
+	}
+	return nil
+}
+
+type testChallenge struct {
+	scheme string
+}
+
+func (ch testChallenge) Error() string {
+	return ch.scheme + " credentials required"
+}
+
+// SetHeaders replaces the header, like most access controllers do.
+func (ch testChallenge) SetHeaders(r *http.Request, w http.ResponseWriter) {
+	w.Header().Set("WWW-Authenticate", fmt.Sprintf("%s realm=%q", ch.scheme, "test"))
+}
+
+func init() {
+	if err := auth.Register("chaintest", func(options map[string]any) (auth.AccessController, error) {
+		scheme, _ := options["scheme"].(string)
+		if scheme == "" {
+			return nil, errors.New("scheme required")
+		}
+		user, _ := options["user"].(string)
+		fail, _ := options["fail"].(bool)
+		return &testController{scheme: scheme, user: user, fail: fail}, nil
+	}); err != nil {
+		panic(err)
+	}
+}
+
+// newChain returns a chain of test access controllers, configured as parsed
+// from YAML.
+func newChain(t *testing.T, controllers ...map[any]any) *accessController {
+	t.Helper()
+	list := make([]any, len(controllers))
+	for i, options := range controllers {
+		list[i] = map[any]any{"chaintest": options}
+	}
+	ac, err := newAccessController(map[string]any{"controllers": list})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return ac.(*accessController)
+}
+
+func request(authorization string) *http.Request {
+	req := httptest.NewRequest(http.MethodGet, "http://registry.example.com/v2/", nil)
+	if authorization != "" {
+		req.Header.Set("Authorization", authorization)
+	}
+	return req
+}
+
+func TestChainOrder(t *testing.T) {
+	ac := newChain(t,
+		map[any]any{"scheme": "Basic", "user": "robot"},
+		map[any]any{"scheme": "Bearer", "user": "alice"},
+		map[any]any{"scheme": "Bearer", "user": "bob"},
+	)
+
+	for authorization, user := range map[string]string{
+		"Basic cm9ib3Q6cGFzcw==": "robot",
+		// The first access controller granting access wins.
+		"Bearer token": "alice",
+	} {
+		grant, err := ac.Authorized(request(authorization))
+		if err != nil {
+			t.Fatalf("%s: unexpected error %v", authorization, err)
+		}
+		if grant.User.Name != user {
+			t.Fatalf("%s: expected the request to be granted to %s, got %s", authorization, user, grant.User.Name)
+		}
+	}
+}
+
+func TestChainChallenges(t *testing.T) {
+	ac := newChain(t,
+		map[any]any{"scheme": "Basic"},
+		map[any]any{"scheme": "Bearer"},
+		map[any]any{"scheme": "Bearer"},
+	)
+
+	for _, authorization := range []string{"", "Digest credentials"} {
+		_, err := ac.Authorized(request(authorization))
+		var ch auth.Challenge
+		if !errors.As(err, &ch) {
+			t.Fatalf("expected a challenge, got %v", err)
+		}
+		w := httptest.NewRecorder()
+		ch.SetHeaders(request(authorization), w)
+		// The identical challenges are only set once.
+		want := []string{`Basic realm="test"`, `Bearer realm="test"`}
+		if got := w.Header().Values("WWW-Authenticate"); !slices.Equal(got, want) {
+			t.Fatalf("expected the challenges %q, got %q", want, got)
+		}
+		if got := err.Error(); !strings.Contains(got, "Basic credentials required") || !strings.Contains(got, "Bearer credentials required") {
+			t.Fatalf("unexpected error %q", got)
+		}
+	}
+}
+
+func TestChainFailure(t *testing.T) {
+	ac := newChain(t,
+		map[any]any{"scheme": "Bearer", "fail": true},
+		map[any]any{"scheme": "Basic", "user": "robot"},
+	)
+
+	// An access controller failing does not prevent the next ones from
+	// granting access.
+	grant, err := ac.Authorized(request("Basic cm9ib3Q6cGFzcw=="))
+	if err != nil || grant.User.Name != "robot" {
+		t.Fatalf("expected the request to be granted to robot, got %v, %v", grant, err)
+	}
+
+	// But the requests no access controller grants access are denied with
+	// its error rather than challenged.
+	_, err = ac.Authorized(request("Bearer token"))
+	var ch auth.Challenge
+	if errors.As(err, &ch) || !errors.Is(err, auth.ErrUnavailable) {
+		t.Fatalf("expected the failure of the access controller, got %v", err)
+	}
+
+	if err := ac.Check(context.Background()); !errors.Is(err, errBackend) {
+		t.Fatalf("expected the health check to fail, got %v", err)
+	}
+}
+
+func TestChainOptions(t *testing.T) {
+	valid := map[string]any{"controllers": []any{
+		map[string]any{"chaintest": map[string]any{"scheme": "Basic"}},
+		map[any]any{"chaintest": map[any]any{"scheme": "Bearer"}},
+	}}
+	if err := validateOptions(valid); err != nil {
+		t.Fatalf("unexpected error %v", err)
+	}
+	if _, err := newAccessController(valid); err != nil {
+		t.Fatalf("unexpected error %v", err)
+	}
+
+	for name, options := range map[string]map[string]any{
+		"no controllers":     {},
+		"empty":              {"controllers": []any{}},
+		"not a list":         {"controllers": map[string]any{"chaintest": nil}},
+		"two types":          {"controllers": []any{map[string]any{"chaintest": nil, "silly": nil}}},
+		"options not map":    {"controllers": []any{map[string]any{"chaintest": "Basic"}}},
+		"unknown type":       {"controllers": []any{map[string]any{"unknown": nil}}},
+		"invalid controller": {"controllers": []any{map[string]any{"chaintest": nil}}},
+	} {
+		if _, err := newAccessController(options); err == nil {
+			t.Errorf("%s: expected an error", name)
+		}
+	}
+	if err := validateOptions(map[string]any{"controllers": []any{map[string]any{"unknown": nil}}}); err == nil {
+		t.Error("expected an error validating an unknown access controller")
+	}
+}
@@ -0,0 +1,208 @@
+// Package clientcert provides an access controller which authorizes requests
+// from the identity of their verified TLS client certificate, such as the
+// SPIFFE ID of a workload in a service mesh.
+//
+// The certificate is verified by the TLS server of the registry, against the
+// http.tls.clientcas of the configuration. This access controller only reads
+// the identity of a verified certificate, and never authorizes a request
+// without one.
+package clientcert
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"path"
+	"slices"
+
+	"github.com/distribution/distribution/v3/registry/auth"
+	"github.com/mitchellh/mapstructure"
+	"github.com/sirupsen/logrus"
+)
+
+// init registers the clientcert auth backend.
+func init() {
+	if err := auth.Register("clientcert", auth.InitFunc(newAccessController)); err != nil {
+		logrus.Errorf("failed to register clientcert auth: %v", err)
+	}
+}
+
+// Sources of the identity in the client certificate.
+const (
+	IdentityURI        = "uri"
+	IdentityDNS        = "dns"
+	IdentityEmail      = "email"
+	IdentityCommonName = "commonname"
+	IdentitySubject    = "subject"
+)
+
+// Errors used by the clientcert access controller.
+var (
+	ErrCertificateRequired = errors.New("verified client certificate required")
+	ErrNoIdentity          = errors.New("client certificate has no identity")
+	ErrInsufficientScope   = errors.New("insufficient scope")
+)
+
+// Rule grants actions on the repositories matching any of a list of glob
+// patterns to the identities matching any of another.
+type Rule struct {
+	// Identities are the glob patterns of the identities, such as
+	// spiffe://example.com/ns/team-a/sa/*.
+	Identities []string `mapstructure:"identities"`
+	// Repositories are the glob patterns of the repository names.
+	Repositories []string `mapstructure:"repositories"`
+	// Actions are the granted actions, such as pull, push or delete. The
+	// * action grants every action.
+	Actions []string `mapstructure:"actions"`
+}
+
+// matches returns whether the rule applies to the identity.
+func (r Rule) matches(identity string) bool {
+	for _, pattern := range r.Identities {
+		if ok, _ := path.Match(pattern, identity); ok {
+			return true
+		}
+	}
+	return false
+}
+
+// grants returns whether the rule grants the access.
+func (r Rule) grants(access auth.Access) bool {
+	if access.Type != "repository" {
+		return false
+	}
+	if !slices.Contains(r.Actions, access.Action) && !slices.Contains(r.Actions, "*") {
+		return false
+	}
+	for _, pattern := range r.Repositories {
+		if ok, _ := path.Match(pattern, access.Name); ok {
+			return true
+		}
+	}
+	return false
+}
+
+// options are the options of the clientcert access controller.
+type options struct {
+	Identity string `mapstructure:"identity"`
+	Rules    []Rule `mapstructure:"rules"`
+}
+
+func parseOptions(parameters map[string]any) (options, error) {
+	opts := options{Identity: IdentityURI}
+	if err := mapstructure.Decode(parameters, &opts); err != nil {
+		return options{}, fmt.Errorf("invalid clientcert auth options: %v", err)
+	}
+
+	switch opts.Identity {
+	case IdentityURI, IdentityDNS, IdentityEmail, IdentityCommonName, IdentitySubject:
+	default:
+		return options{}, fmt.Errorf("unknown clientcert identity %q", opts.Identity)
+	}
+	for i, rule := range opts.Rules {
+		if len(rule.Identities) == 0 || len(rule.Repositories) == 0 || len(rule.Actions) == 0 {
+			return options{}, fmt.Errorf("clientcert rule %d requires identities, repositories and actions", i)
+		}
+		for _, pattern := range slices.Concat(rule.Identities, rule.Repositories) {
+			if _, err := path.Match(pattern, ""); err != nil {
+				return options{}, fmt.Errorf("clientcert rule %d has an invalid pattern %q: %v", i, pattern, err)
+			}
+		}
+	}
+	return opts, nil
+}
+
+// accessController implements auth.AccessController with the identity of
+// verified client certificates.
+type accessController struct {
+	identity string
+	rules    []Rule
+}
+
+var _ auth.AccessController = &accessController{}
+
+func newAccessController(parameters map[string]any) (auth.AccessController, error) {
+	opts, err := parseOptions(parameters)
+	if err != nil {
+		return nil, err
+	}
+	return &accessController{identity: opts.Identity, rules: opts.Rules}, nil
+}
+
+// Authorized reads the identity of the verified client certificate of the
+// request, and checks that the rules grant all the access items to it.
+func (ac *accessController) Authorized(req *http.Request, accessItems ...auth.Access) (*auth.Grant, error) {
+	// VerifiedChains is only set if the certificate was verified against
+	// the client CAs of the server.
+	if req.TLS == nil || len(req.TLS.VerifiedChains) == 0 || len(req.TLS.VerifiedChains[0]) == 0 {
+		return nil, &challenge{err: ErrCertificateRequired}
+	}
+
+	identity := ac.identityOf(req)
+	if identity == "" {
+		return nil, &challenge{err: ErrNoIdentity}
+	}
+
+	resources := make([]auth.Resource, 0, len(accessItems))
+	for _, access := range accessItems {
+		if !ac.granted(identity, access) {
+			return nil, &challenge{err: ErrInsufficientScope}
+		}
+		resources = append(resources, access.Resource)
+	}
+
+	return &auth.Grant{
+		User:      auth.UserInfo{Name: identity},
+		Resources: resources,
+	}, nil
+}
+
+// identityOf returns the identity of the leaf certificate of the verified
+// chain, or an empty string if it has none.
+func (ac *accessController) identityOf(req *http.Request) string {
+	cert := req.TLS.VerifiedChains[0][0]
+	switch ac.identity {
+	case IdentityURI:
+		if len(cert.URIs) > 0 {
+			return cert.URIs[0].String()
+		}
+	case IdentityDNS:
+		if len(cert.DNSNames) > 0 {
+			return cert.DNSNames[0]
+		}
+	case IdentityEmail:
+		if len(cert.EmailAddresses) > 0 {
+			return cert.EmailAddresses[0]
+		}
+	case IdentityCommonName:
+		return cert.Subject.CommonName
+	case IdentitySubject:
+		return cert.Subject.String()
+	}
+	return ""
+}
+
+// granted returns whether any rule grants the access to the identity.
+func (ac *accessController) granted(identity string, access auth.Access) bool {
+	for _, rule := range ac.rules {
+		if rule.matches(identity) && rule.grants(access) {
+			return true
+		}
+	}
+	return false
+}
+
+// challenge implements auth.Challenge. There is no authentication scheme
+// for clients to retry with: they must present another certificate.
+type challenge struct {
+	err error
+}
+
+var _ auth.Challenge = challenge{}
+
+// SetHeaders does not set any header.
+func (ch challenge) SetHeaders(r *http.Request, w http.ResponseWriter) {}
+
+func (ch challenge) Error() string {
+	return fmt.Sprintf("client certificate authentication failed: %s", ch.err)
+}
@@ -0,0 +1,247 @@
+package clientcert
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"errors"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+	"time"
+
+	"github.com/distribution/distribution/v3/registry/auth"
+)
+
+type testCA struct {
+	cert *x509.Certificate
+	key  *ecdsa.PrivateKey
+}
+
+func newTestCA(t *testing.T) *testCA {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "test ca"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+		KeyUsage:              x509.KeyUsageCertSign,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &testCA{cert: cert, key: key}
+}
+
+// clientCert issues a client certificate with the common name and URI.
+func (ca *testCA) clientCert(t *testing.T, commonName, uri string) tls.Certificate {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(time.Now().UnixNano()),
+		Subject:      pkix.Name{CommonName: commonName},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+	}
+	if uri != "" {
+		u, err := url.Parse(uri)
+		if err != nil {
+			t.Fatal(err)
+		}
+		template.URIs = []*url.URL{u}
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, ca.cert, &key.PublicKey, ca.key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key}
+}
+
+// newTestServer starts a TLS server verifying client certificates issued by
+// ca if given, and responding with the result of the access controller for
+// pulling the repository of the path.
+func newTestServer(t *testing.T, ac auth.AccessController, ca *testCA) *httptest.Server {
+	t.Helper()
+	server := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		grant, err := ac.Authorized(r, auth.Access{
+			Resource: auth.Resource{Type: "repository", Name: r.URL.Path[1:]},
+			Action:   r.URL.Query().Get("action"),
+		})
+		var ch auth.Challenge
+		switch {
+		case errors.As(err, &ch):
+			ch.SetHeaders(r, w)
+			w.WriteHeader(http.StatusUnauthorized)
+		case err != nil:
+			w.WriteHeader(http.StatusBadRequest)
+		default:
+			_, _ = w.Write([]byte(grant.User.Name))
+		}
+	}))
+	pool := x509.NewCertPool()
+	if ca != nil {
+		pool.AddCert(ca.cert)
+	}
+	server.TLS = &tls.Config{ClientCAs: pool, ClientAuth: tls.VerifyClientCertIfGiven}
+	server.StartTLS()
+	t.Cleanup(server.Close)
+	return server
+}
+
+func get(t *testing.T, server *httptest.Server, cert *tls.Certificate, path string) (int, string) {
+	t.Helper()
+	client := server.Client()
+	transport := client.Transport.(*http.Transport).Clone()
+	if cert != nil {
+		transport.TLSClientConfig.Certificates = []tls.Certificate{*cert}
+	}
+	client.Transport = transport
+
+	resp, err := client.Get(server.URL + path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	body := make([]byte, 256)
+	n, _ := resp.Body.Read(body)
+	return resp.StatusCode, string(body[:n])
+}
+
+func TestAuthorized(t *testing.T) {
+	ca := newTestCA(t)
+	ac, err := newAccessController(map[string]any{
+		"rules": []any{
+			map[any]any{
+				"identities":   []any{"spiffe://example.com/ns/team-a/sa/*"},
+				"repositories": []any{"team-a/*"},
+				"actions":      []any{"pull", "push"},
+			},
+			map[any]any{
+				"identities":   []any{"spiffe://example.com/ns/ci/sa/builder"},
+				"repositories": []any{"*/*"},
+				"actions":      []any{"pull"},
+			},
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	server := newTestServer(t, ac, ca)
+
+	teamA := ca.clientCert(t, "team-a", "spiffe://example.com/ns/team-a/sa/deployer")
+	builder := ca.clientCert(t, "builder", "spiffe://example.com/ns/ci/sa/builder")
+	noURI := ca.clientCert(t, "no-uri", "")
+	untrusted := newTestCA(t).clientCert(t, "team-a", "spiffe://example.com/ns/team-a/sa/deployer")
+
+	for _, tc := range []struct {
+		name     string
+		cert     *tls.Certificate
+		path     string
+		status   int
+		identity string
+	}{
+		{"allowed", &teamA, "/team-a/app?action=push", http.StatusOK, "spiffe://example.com/ns/team-a/sa/deployer"},
+		{"allowed by exact identity", &builder, "/team-b/app?action=pull", http.StatusOK, "spiffe://example.com/ns/ci/sa/builder"},
+		{"denied repository", &teamA, "/team-b/app?action=pull", http.StatusUnauthorized, ""},
+		{"denied action", &builder, "/team-b/app?action=push", http.StatusUnauthorized, ""},
+		{"no identity", &noURI, "/team-a/app?action=pull", http.StatusUnauthorized, ""},
+		{"no certificate", nil, "/team-a/app?action=pull", http.StatusUnauthorized, ""},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			status, body := get(t, server, tc.cert, tc.path)
+			if status != tc.status {
+				t.Fatalf("expected status %d, got %d", tc.status, status)
+			}
+			if tc.identity != "" && body != tc.identity {
+				t.Fatalf("expected identity %q, got %q", tc.identity, body)
+			}
+		})
+	}
+
+	// A certificate the server did not verify is rejected by the TLS
+	// handshake, and would not be read by the access controller.
+	client := server.Client()
+	transport := client.Transport.(*http.Transport).Clone()
+	transport.TLSClientConfig.Certificates = []tls.Certificate{untrusted}
+	client.Transport = transport
+	if resp, err := client.Get(server.URL + "/team-a/app?action=pull"); err == nil {
+		resp.Body.Close()
+		t.Fatal("expected the handshake with an untrusted certificate to fail")
+	}
+}
+
+func TestUnverifiedCertificate(t *testing.T) {
+	ca := newTestCA(t)
+	ac, err := newAccessController(map[string]any{
+		"identity": "commonname",
+		"rules": []any{
+			map[any]any{"identities": []any{"admin"}, "repositories": []any{"*"}, "actions": []any{"*"}},
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The certificate is requested but not verified by the server.
+	server := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if _, err := ac.Authorized(r); err == nil {
+			t.Error("expected an unverified certificate to be rejected")
+		}
+	}))
+	server.TLS = &tls.Config{ClientAuth: tls.RequireAnyClientCert}
+	server.StartTLS()
+	defer server.Close()
+
+	cert := ca.clientCert(t, "admin", "")
+	if status, _ := get(t, server, &cert, "/app"); status != http.StatusOK {
+		t.Fatalf("unexpected status %d", status)
+	}
+
+	// The same certificate is accepted when verified.
+	verified := newTestServer(t, ac, ca)
+	if status, body := get(t, verified, &cert, "/app?action=delete"); status != http.StatusOK || body != "admin" {
+		t.Fatalf("unexpected status %d and identity %q", status, body)
+	}
+}
+
+func TestParseOptions(t *testing.T) {
+	for name, parameters := range map[string]map[string]any{
+		"unknown identity": {"identity": "serial"},
+		"rule without identities": {"rules": []any{
+			map[any]any{"repositories": []any{"*"}, "actions": []any{"pull"}},
+		}},
+		"invalid pattern": {"rules": []any{
+			map[any]any{"identities": []any{"["}, "repositories": []any{"*"}, "actions": []any{"pull"}},
+		}},
+	} {
+		if _, err := parseOptions(parameters); err == nil {
+			t.Errorf("%s: expected an error", name)
+		}
+	}
+
+	opts, err := parseOptions(nil)
+	if err != nil || opts.Identity != IdentityURI {
+		t.Fatalf("unexpected default options %+v: %v", opts, err)
+	}
+}
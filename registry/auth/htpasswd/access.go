@@ -3,21 +3,32 @@
 // location.
 //
 // This authentication method MUST be used under TLS, as simple token-replay attack is possible.
+//
+// The file is polled for changes until the access controller is closed. A
+// file which cannot be parsed is rejected, keeping the previous credentials.
+// SIGHUP is left to the reload of the registry configuration, which creates a
+// new access controller.
+//
+// The passwords are hashed with bcrypt or argon2id. The entries weaker than
+// the minimum hash strength configured are rejected as the file is loaded.
 package htpasswd
 
 import (
 	"context"
 	"crypto/rand"
 	"encoding/base64"
+	"errors"
 	"fmt"
+	"io/fs"
 	"net/http"
 	"os"
 	"path/filepath"
+	"slices"
+	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 
-	"golang.org/x/crypto/bcrypt"
-
 	"github.com/distribution/distribution/v3/internal/dcontext"
 	"github.com/distribution/distribution/v3/registry/auth"
 	"github.com/sirupsen/logrus"
@@ -27,33 +38,107 @@ func init() {
 	if err := auth.Register("htpasswd", auth.InitFunc(newAccessController)); err != nil {
 		logrus.Errorf("failed to register htpasswd auth: %v", err)
 	}
+	if err := auth.RegisterValidator("htpasswd", validateOptions); err != nil {
+		logrus.Errorf("failed to register htpasswd auth: %v", err)
+	}
 }
 
+// defaultReloadInterval is the interval at which the htpasswd file is checked
+// for changes, unless set by the reloadinterval option.
+const defaultReloadInterval = 5 * time.Second
+
 type accessController struct {
 	realm    string
 	path     string
-	modtime  time.Time
-	mu       sync.Mutex
-	htpasswd *htpasswd
+	strength Strength
+
+	// mu serializes reloads, and guards modtime and size, which identify
+	// the version of the file last loaded.
+	mu      sync.Mutex
+	modtime time.Time
+	size    int64
+	// htpasswd holds the credentials, swapped as a whole on reload.
+	htpasswd atomic.Pointer[htpasswd]
+	// stop is closed by Close, stopping the polling of the file.
+	stop      chan struct{}
+	closeOnce sync.Once
 
 	// overrideDummyHash allows overriding the dummy-hash for testing.
 	overrideDummyHash []byte
 }
 
-var _ auth.AccessController = &accessController{}
+var (
+	_ auth.AccessController = &accessController{}
+	_ auth.Closer           = &accessController{}
+)
 
-func newAccessController(options map[string]any) (auth.AccessController, error) {
+// accessOptions are the options of an htpasswd access controller.
+type accessOptions struct {
+	realm          string
+	path           string
+	reloadInterval time.Duration
+	strength       Strength
+}
+
+func checkOptions(options map[string]any) (accessOptions, error) {
 	realm, present := options["realm"]
 	if _, ok := realm.(string); !present || !ok {
-		return nil, fmt.Errorf(`"realm" must be set for htpasswd access controller`)
+		return accessOptions{}, fmt.Errorf(`"realm" must be set for htpasswd access controller`)
 	}
 
 	pathOpt, present := options["path"]
 	path, ok := pathOpt.(string)
 	if !present || !ok {
-		return nil, fmt.Errorf(`"path" must be set for htpasswd access controller`)
+		return accessOptions{}, fmt.Errorf(`"path" must be set for htpasswd access controller`)
+	}
+
+	reloadInterval := defaultReloadInterval
+	if intervalOpt, present := options["reloadinterval"]; present {
+		interval, ok := intervalOpt.(string)
+		if !ok {
+			return accessOptions{}, fmt.Errorf(`"reloadinterval" must be a duration for htpasswd access controller`)
+		}
+		d, err := time.ParseDuration(interval)
+		if err != nil || d <= 0 {
+			return accessOptions{}, fmt.Errorf(`"reloadinterval" must be a positive duration for htpasswd access controller: %q`, interval)
+		}
+		reloadInterval = d
+	}
+
+	strength, err := ParseStrength(options["minhashstrength"])
+	if err != nil {
+		return accessOptions{}, err
+	}
+	return accessOptions{realm: realm.(string), path: path, reloadInterval: reloadInterval, strength: strength}, nil
+}
+
+// validateOptions checks the options, and the htpasswd file if it exists. A
+// missing file is created on startup.
+func validateOptions(options map[string]any) error {
+	opts, err := checkOptions(options)
+	if err != nil {
+		return err
+	}
+	f, err := os.Open(opts.path)
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil
 	}
-	if err := createHtpasswdFile(path); err != nil {
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	if _, err := parseHTPasswd(f); err != nil {
+		return fmt.Errorf("invalid htpasswd file %s: %v", opts.path, err)
+	}
+	return nil
+}
+
+func newAccessController(options map[string]any) (auth.AccessController, error) {
+	opts, err := checkOptions(options)
+	if err != nil {
+		return nil, err
+	}
+	if err := createHtpasswdFile(opts.path, opts.strength); err != nil {
 		return nil, err
 	}
 	var dummyHash []byte
@@ -62,47 +147,97 @@ func newAccessController(options map[string]any) (auth.AccessController, error)
 		dummyHash = hash.([]byte)
 	}
 
-	return &accessController{realm: realm.(string), path: path, overrideDummyHash: dummyHash}, nil
+	ac := &accessController{
+		realm:             opts.realm,
+		path:              opts.path,
+		strength:          opts.strength,
+		stop:              make(chan struct{}),
+		overrideDummyHash: dummyHash,
+	}
+	if err := ac.reload(true); err != nil {
+		return nil, err
+	}
+	go ac.watch(opts.reloadInterval)
+	return ac, nil
 }
 
-func (ac *accessController) Authorized(req *http.Request, accessRecords ...auth.Access) (*auth.Grant, error) {
-	username, password, ok := req.BasicAuth()
-	if !ok {
-		return nil, &challenge{
-			realm: ac.realm,
-			err:   auth.ErrInvalidCredential,
+// watch reloads the htpasswd file when it changes, checking every interval,
+// until the access controller is closed.
+func (ac *accessController) watch(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+		case <-ac.stop:
+			return
+		}
+		if err := ac.reload(false); err != nil {
+			logrus.Errorf("htpasswd: keeping the previous credentials: %v", err)
 		}
 	}
+}
+
+// Close stops the polling of the htpasswd file. The credentials last loaded
+// are still checked.
+func (ac *accessController) Close() error {
+	ac.closeOnce.Do(func() { close(ac.stop) })
+	return nil
+}
+
+// reload parses the htpasswd file and swaps in its credentials if it changed
+// since it was last loaded, or if force is set. The previous credentials are
+// kept if the file cannot be read or parsed.
+func (ac *accessController) reload(force bool) error {
+	ac.mu.Lock()
+	defer ac.mu.Unlock()
 
-	// Dynamically parsing the latest account list
 	fstat, err := os.Stat(ac.path)
 	if err != nil {
-		return nil, err
+		return err
+	}
+	if !force && fstat.ModTime().Equal(ac.modtime) && fstat.Size() == ac.size {
+		return nil
 	}
+	// The file is not retried until it changes again.
+	ac.modtime, ac.size = fstat.ModTime(), fstat.Size()
 
-	lastModified := fstat.ModTime()
-	ac.mu.Lock()
-	if ac.htpasswd == nil || !ac.modtime.Equal(lastModified) {
-		ac.modtime = lastModified
+	f, err := os.Open(ac.path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
 
-		f, err := os.Open(ac.path)
-		if err != nil {
-			ac.mu.Unlock()
-			return nil, err
+	h, rejected, err := newHTPasswd(f, ac.overrideDummyHash, ac.strength)
+	if err != nil {
+		return fmt.Errorf("invalid htpasswd file %s: %v", ac.path, err)
+	}
+	if len(rejected) > 0 {
+		users := make([]string, 0, len(rejected))
+		for user, reason := range rejected {
+			users = append(users, fmt.Sprintf("%s (%v)", user, reason))
 		}
-		defer f.Close()
+		slices.Sort(users)
+		logrus.Warnf("htpasswd: rejecting the users of %s whose password hashes do not meet the minimum hash strength: %s", ac.path, strings.Join(users, ", "))
+	}
+	ac.htpasswd.Store(h)
+	if !force {
+		logrus.Infof("htpasswd: reloaded %s", ac.path)
+	}
+	return nil
+}
 
-		h, err := newHTPasswd(f, ac.overrideDummyHash)
-		if err != nil {
-			ac.mu.Unlock()
-			return nil, err
+func (ac *accessController) Authorized(req *http.Request, accessRecords ...auth.Access) (*auth.Grant, error) {
+	username, password, ok := req.BasicAuth()
+	if !ok {
+		return nil, &challenge{
+			realm: ac.realm,
+			err:   auth.ErrInvalidCredential,
 		}
-		ac.htpasswd = h
 	}
-	localHTPasswd := ac.htpasswd
-	ac.mu.Unlock()
 
-	if err := localHTPasswd.authenticateUser(req.Context(), username, password); err != nil {
+	if err := ac.htpasswd.Load().authenticateUser(req.Context(), username, password); err != nil {
 		return nil, &challenge{
 			realm: ac.realm,
 			err:   err,
@@ -129,8 +264,9 @@ func (ch challenge) Error() string {
 	return fmt.Sprintf("basic authentication challenge for realm %q: %s", ch.realm, ch.err)
 }
 
-// createHtpasswdFile creates and populates htpasswd file with a new user in case the file is missing
-func createHtpasswdFile(path string) error {
+// createHtpasswdFile creates and populates htpasswd file with a new user in case the file is missing,
+// hashing its password as strongly as the strength requires.
+func createHtpasswdFile(path string, strength Strength) error {
 	if f, err := os.Open(path); err == nil {
 		f.Close()
 		return nil
@@ -151,11 +287,15 @@ func createHtpasswdFile(path string) error {
 		return err
 	}
 	pass := base64.RawURLEncoding.EncodeToString(secretBytes[:])
-	encryptedPass, err := bcrypt.GenerateFromPassword([]byte(pass), bcrypt.DefaultCost)
+	algorithm := AlgorithmBcrypt
+	if strength.Algorithm == AlgorithmArgon2id {
+		algorithm = AlgorithmArgon2id
+	}
+	encryptedPass, err := strength.Hash(pass, algorithm)
 	if err != nil {
 		return err
 	}
-	if _, err := fmt.Fprintf(f, "docker:%s", string(encryptedPass[:])); err != nil {
+	if _, err := fmt.Fprintf(f, "docker:%s", encryptedPass); err != nil {
 		return err
 	}
 	dcontext.GetLoggerWithFields(context.Background(), map[any]any{
@@ -2,13 +2,17 @@ package htpasswd
 
 import (
 	"bytes"
+	"fmt"
 	"net/http"
 	"net/http/httptest"
 	"os"
 	"path/filepath"
+	"sync"
 	"testing"
+	"time"
 
 	"github.com/distribution/distribution/v3/registry/auth"
+	"golang.org/x/crypto/bcrypt"
 )
 
 func TestBasicAccessController(t *testing.T) {
@@ -167,3 +171,168 @@ func TestCreateHtpasswdFile(t *testing.T) {
 		t.Fatalf("failed to find default user in file %s", string(content))
 	}
 }
+
+func TestReloadHtpasswdFile(t *testing.T) {
+	tempFile := filepath.Join(t.TempDir(), "htpasswd")
+	writeUsers := func(users ...string) {
+		t.Helper()
+		var content bytes.Buffer
+		for _, user := range users {
+			hash, err := bcrypt.GenerateFromPassword([]byte(user+"-password"), bcrypt.MinCost)
+			if err != nil {
+				t.Fatal(err)
+			}
+			fmt.Fprintf(&content, "%s:%s\n", user, hash)
+		}
+		if err := os.WriteFile(tempFile, content.Bytes(), 0o600); err != nil {
+			t.Fatal(err)
+		}
+	}
+	writeUsers("frodo", "sam")
+
+	accessCtrl, err := newAccessController(map[string]any{
+		"realm":          "The-Shire",
+		"path":           tempFile,
+		"reloadinterval": "10ms",
+	})
+	if err != nil {
+		t.Fatalf("error creating access controller: %v", err)
+	}
+	authorized := func(user string) bool {
+		req := httptest.NewRequest(http.MethodGet, "/v2/", nil)
+		req.SetBasicAuth(user, user+"-password")
+		_, err := accessCtrl.Authorized(req)
+		return err == nil
+	}
+	// eventually waits for a user to be authorized, or not.
+	eventually := func(user string, expected bool) {
+		t.Helper()
+		deadline := time.Now().Add(5 * time.Second)
+		for authorized(user) != expected {
+			if time.Now().After(deadline) {
+				t.Fatalf("authorization of %s is not %v", user, expected)
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+	}
+
+	if !authorized("frodo") || !authorized("sam") || authorized("pippin") {
+		t.Fatal("unexpected initial credentials")
+	}
+
+	// Authentication checks run concurrently with the reload.
+	done := make(chan struct{})
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		for {
+			select {
+			case <-done:
+				return
+			default:
+				authorized("frodo")
+			}
+		}
+	}()
+
+	writeUsers("frodo", "pippin")
+	eventually("pippin", true)
+	eventually("sam", false)
+	close(done)
+	wg.Wait()
+
+	// A malformed file keeps the previous credentials.
+	if err := os.WriteFile(tempFile, []byte("merry\n"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	if err := accessCtrl.(*accessController).reload(true); err == nil {
+		t.Fatal("expected an error reloading a malformed file")
+	}
+	if !authorized("frodo") || !authorized("pippin") {
+		t.Fatal("the previous credentials were not kept")
+	}
+
+	// The file is no longer polled once the access controller is closed.
+	writeUsers("frodo")
+	eventually("frodo", true)
+	if err := accessCtrl.(*accessController).Close(); err != nil {
+		t.Fatalf("error closing access controller: %v", err)
+	}
+	// A second Close is a no-op.
+	if err := accessCtrl.(*accessController).Close(); err != nil {
+		t.Fatalf("error closing access controller again: %v", err)
+	}
+	writeUsers("merry")
+	time.Sleep(100 * time.Millisecond)
+	if !authorized("frodo") || authorized("merry") {
+		t.Fatal("the file was reloaded after the access controller was closed")
+	}
+}
+
+func TestMinHashStrength(t *testing.T) {
+	tempFile := filepath.Join(t.TempDir(), "htpasswd")
+	var content bytes.Buffer
+	for user, hash := range map[string]func() (string, error){
+		"frodo": func() (string, error) { return HashBcrypt("frodo-password", bcrypt.MinCost) },
+		"sam":   func() (string, error) { return HashArgon2id("sam-password", testArgon2idParams) },
+		"merry": func() (string, error) {
+			return HashArgon2id("merry-password", Argon2idParams{Memory: 2048, Iterations: 1, Parallelism: 1})
+		},
+		"pippin":  func() (string, error) { return "{SHA}5siv5c0SHx681xU6GiSx9ZQryqs=", nil },
+		"gandalf": func() (string, error) { return "$argon2id$v=19$m=2048", nil },
+	} {
+		h, err := hash()
+		if err != nil {
+			t.Fatal(err)
+		}
+		fmt.Fprintf(&content, "%s:%s\n", user, h)
+	}
+	if err := os.WriteFile(tempFile, content.Bytes(), 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	accessCtrl, err := newAccessController(map[string]any{
+		"realm": "The-Shire",
+		"path":  tempFile,
+		"minhashstrength": map[any]any{
+			"algorithm":      "argon2id",
+			"argon2idmemory": 2048,
+		},
+	})
+	if err != nil {
+		t.Fatalf("error creating access controller: %v", err)
+	}
+	for user, expected := range map[string]bool{
+		"frodo":  false,
+		"sam":    false,
+		"merry":  true,
+		"pippin": false,
+	} {
+		req := httptest.NewRequest(http.MethodGet, "/v2/", nil)
+		req.SetBasicAuth(user, user+"-password")
+		if _, err := accessCtrl.Authorized(req); (err == nil) != expected {
+			t.Errorf("expected the authorization of %s to be %v, got %v", user, expected, err)
+		}
+	}
+
+	// The htpasswd file created has a hash as strong as required.
+	options := map[string]any{
+		"realm":           "The-Shire",
+		"path":            filepath.Join(t.TempDir(), "htpasswd"),
+		"minhashstrength": map[string]any{"algorithm": "argon2id", "argon2idmemory": 1024, "argon2iditerations": 1},
+	}
+	if _, err := newAccessController(options); err != nil {
+		t.Fatalf("error creating access controller: %v", err)
+	}
+	if content, err := os.ReadFile(options["path"].(string)); err != nil {
+		t.Fatalf("failed to read file %v", err)
+	} else if !bytes.HasPrefix(content, []byte("docker:$argon2id$v=19$m=1024,t=1,")) {
+		t.Fatalf("failed to find default user in file %s", string(content))
+	}
+
+	options["minhashstrength"] = map[string]any{"algorithm": "scrypt"}
+	if err := validateOptions(options); err == nil {
+		t.Fatal("expected an error validating an unknown algorithm")
+	}
+}
@@ -0,0 +1,292 @@
+package htpasswd
+
+import (
+	"bytes"
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+
+	"golang.org/x/crypto/argon2"
+	"golang.org/x/crypto/bcrypt"
+)
+
+const (
+	// AlgorithmBcrypt and AlgorithmArgon2id are the password hash algorithms
+	// supported.
+	AlgorithmBcrypt   = "bcrypt"
+	AlgorithmArgon2id = "argon2id"
+
+	// DefaultBcryptCost is the cost of the bcrypt hashes generated, unless
+	// configured.
+	DefaultBcryptCost = 12
+
+	// argon2idSaltSize and argon2idKeySize are the sizes of the salt and
+	// key of the argon2id hashes generated.
+	argon2idSaltSize = 16
+	argon2idKeySize  = 32
+)
+
+// DefaultArgon2idParams are the parameters of the argon2id hashes generated,
+// unless configured, those recommended by RFC 9106 for memory constrained
+// environments.
+var DefaultArgon2idParams = Argon2idParams{Memory: 64 * 1024, Iterations: 3, Parallelism: 4}
+
+// Argon2idParams are the parameters of an argon2id hash.
+type Argon2idParams struct {
+	// Memory is the memory used, in KiB.
+	Memory      uint32
+	Iterations  uint32
+	Parallelism uint8
+}
+
+// argon2idHash is an argon2id hash, in the PHC string format of the argon2
+// reference implementation:
+//
+//	$argon2id$v=19$m=<memory>,t=<iterations>,p=<parallelism>$<salt>$<key>
+//
+// The salt and key are base64 encoded, without padding.
+type argon2idHash struct {
+	params Argon2idParams
+	salt   []byte
+	key    []byte
+}
+
+func isArgon2id(hash []byte) bool {
+	return bytes.HasPrefix(hash, []byte("$argon2id$"))
+}
+
+func isBcrypt(hash []byte) bool {
+	return bytes.HasPrefix(hash, []byte("$2a$")) || bytes.HasPrefix(hash, []byte("$2b$")) || bytes.HasPrefix(hash, []byte("$2y$"))
+}
+
+func parseArgon2id(hash []byte) (*argon2idHash, error) {
+	parts := strings.Split(string(hash), "$")
+	if len(parts) != 6 || parts[0] != "" || parts[1] != AlgorithmArgon2id {
+		return nil, errors.New("malformed argon2id hash")
+	}
+	if parts[2] != fmt.Sprintf("v=%d", argon2.Version) {
+		return nil, fmt.Errorf("unsupported argon2id version %q", parts[2])
+	}
+
+	var h argon2idHash
+	for _, param := range strings.Split(parts[3], ",") {
+		name, value, _ := strings.Cut(param, "=")
+		var bits int
+		switch name {
+		case "m", "t":
+			bits = 32
+		case "p":
+			bits = 8
+		default:
+			return nil, fmt.Errorf("unknown argon2id parameter %q", param)
+		}
+		n, err := strconv.ParseUint(value, 10, bits)
+		if err != nil || n == 0 {
+			return nil, fmt.Errorf("invalid argon2id parameter %q", param)
+		}
+		switch name {
+		case "m":
+			h.params.Memory = uint32(n)
+		case "t":
+			h.params.Iterations = uint32(n)
+		case "p":
+			h.params.Parallelism = uint8(n)
+		}
+	}
+	if h.params.Memory == 0 || h.params.Iterations == 0 || h.params.Parallelism == 0 {
+		return nil, errors.New("argon2id hash lacks parameters")
+	}
+
+	var err error
+	if h.salt, err = base64.RawStdEncoding.DecodeString(parts[4]); err != nil || len(h.salt) == 0 {
+		return nil, errors.New("invalid argon2id salt")
+	}
+	if h.key, err = base64.RawStdEncoding.DecodeString(parts[5]); err != nil || len(h.key) == 0 {
+		return nil, errors.New("invalid argon2id key")
+	}
+	return &h, nil
+}
+
+func (h *argon2idHash) String() string {
+	return fmt.Sprintf("$%s$v=%d$m=%d,t=%d,p=%d$%s$%s", AlgorithmArgon2id, argon2.Version,
+		h.params.Memory, h.params.Iterations, h.params.Parallelism,
+		base64.RawStdEncoding.EncodeToString(h.salt), base64.RawStdEncoding.EncodeToString(h.key))
+}
+
+// matches reports whether the hash is the hash of the password.
+func (h *argon2idHash) matches(password string) bool {
+	key := argon2.IDKey([]byte(password), h.salt, h.params.Iterations, h.params.Memory, h.params.Parallelism, uint32(len(h.key)))
+	return subtle.ConstantTimeCompare(key, h.key) == 1
+}
+
+// compareHashAndPassword compares a bcrypt or argon2id hash with the
+// password, returning nil if they match, and
+// bcrypt.ErrMismatchedHashAndPassword if not.
+func compareHashAndPassword(hash []byte, password string) error {
+	if !isArgon2id(hash) {
+		return bcrypt.CompareHashAndPassword(hash, []byte(password))
+	}
+	h, err := parseArgon2id(hash)
+	if err != nil {
+		return err
+	}
+	if !h.matches(password) {
+		return bcrypt.ErrMismatchedHashAndPassword
+	}
+	return nil
+}
+
+// HashBcrypt returns the bcrypt hash of the password, at the cost.
+func HashBcrypt(password string, cost int) (string, error) {
+	hash, err := bcrypt.GenerateFromPassword([]byte(password), cost)
+	if err != nil {
+		return "", err
+	}
+	return string(hash), nil
+}
+
+// HashArgon2id returns the argon2id hash of the password, with a random salt.
+func HashArgon2id(password string, params Argon2idParams) (string, error) {
+	if params.Memory == 0 || params.Iterations == 0 || params.Parallelism == 0 {
+		return "", errors.New("argon2id parameters must be positive")
+	}
+	h := argon2idHash{params: params, salt: make([]byte, argon2idSaltSize)}
+	if _, err := rand.Read(h.salt); err != nil {
+		return "", err
+	}
+	h.key = argon2.IDKey([]byte(password), h.salt, params.Iterations, params.Memory, params.Parallelism, argon2idKeySize)
+	return h.String(), nil
+}
+
+// Strength is the minimum strength of the password hashes of an htpasswd
+// file. The zero Strength accepts every hash.
+type Strength struct {
+	// Algorithm is the weakest algorithm accepted: bcrypt accepts both
+	// bcrypt and argon2id hashes, argon2id only argon2id hashes.
+	Algorithm  string
+	BcryptCost int
+	// Argon2id holds the minimum memory and iterations of argon2id hashes.
+	// The parallelism is not checked, only set on the hashes generated.
+	Argon2id Argon2idParams
+}
+
+// ParseStrength parses the minhashstrength option of an htpasswd access
+// controller.
+func ParseStrength(opt any) (Strength, error) {
+	var options map[string]any
+	switch v := opt.(type) {
+	case nil:
+		return Strength{}, nil
+	case map[string]any:
+		options = v
+	case map[any]any:
+		options = make(map[string]any, len(v))
+		for k, value := range v {
+			options[fmt.Sprint(k)] = value
+		}
+	default:
+		return Strength{}, errors.New(`"minhashstrength" must be a map for htpasswd access controller`)
+	}
+
+	var s Strength
+	for name, value := range options {
+		switch name {
+		case "algorithm":
+			algorithm, ok := value.(string)
+			if !ok || (algorithm != AlgorithmBcrypt && algorithm != AlgorithmArgon2id) {
+				return Strength{}, fmt.Errorf(`"minhashstrength.algorithm" must be %s or %s for htpasswd access controller`, AlgorithmBcrypt, AlgorithmArgon2id)
+			}
+			s.Algorithm = algorithm
+		case "bcryptcost", "argon2idmemory", "argon2iditerations":
+			n, ok := value.(int)
+			if !ok || n < 0 || n > math.MaxUint32 {
+				return Strength{}, fmt.Errorf(`"minhashstrength.%s" must be a non-negative integer for htpasswd access controller`, name)
+			}
+			switch name {
+			case "bcryptcost":
+				if n > bcrypt.MaxCost {
+					return Strength{}, fmt.Errorf(`"minhashstrength.bcryptcost" must be at most %d for htpasswd access controller`, bcrypt.MaxCost)
+				}
+				s.BcryptCost = n
+			case "argon2idmemory":
+				s.Argon2id.Memory = uint32(n)
+			case "argon2iditerations":
+				s.Argon2id.Iterations = uint32(n)
+			}
+		default:
+			return Strength{}, fmt.Errorf(`unknown option "minhashstrength.%s" for htpasswd access controller`, name)
+		}
+	}
+	return s, nil
+}
+
+// check returns why the hash is weaker than the strength, nil if it is not.
+func (s Strength) check(hash []byte) error {
+	if s == (Strength{}) {
+		return nil
+	}
+	switch {
+	case isArgon2id(hash):
+		h, err := parseArgon2id(hash)
+		if err != nil {
+			return err
+		}
+		if h.params.Memory < s.Argon2id.Memory {
+			return fmt.Errorf("argon2id memory %d KiB", h.params.Memory)
+		}
+		if h.params.Iterations < s.Argon2id.Iterations {
+			return fmt.Errorf("argon2id iterations %d", h.params.Iterations)
+		}
+		return nil
+	case isBcrypt(hash):
+		if s.Algorithm == AlgorithmArgon2id {
+			return errors.New("bcrypt hash")
+		}
+		cost, err := bcrypt.Cost(hash)
+		if err != nil {
+			return err
+		}
+		if cost < s.BcryptCost {
+			return fmt.Errorf("bcrypt cost %d", cost)
+		}
+		return nil
+	default:
+		return errors.New("unsupported hash")
+	}
+}
+
+// Hash returns a hash of the password as strong as the strength, an argon2id
+// hash unless algorithm is bcrypt. The parameters of the hash are those of
+// the strength, or the defaults if unset.
+func (s Strength) Hash(password, algorithm string) (string, error) {
+	switch algorithm {
+	case AlgorithmBcrypt:
+		if s.Algorithm == AlgorithmArgon2id {
+			return "", errors.New("bcrypt hashes are weaker than the minimum hash strength")
+		}
+		cost := s.BcryptCost
+		if cost == 0 {
+			cost = DefaultBcryptCost
+		}
+		return HashBcrypt(password, cost)
+	case AlgorithmArgon2id, "":
+		params := DefaultArgon2idParams
+		if s.Argon2id.Memory != 0 {
+			params.Memory = s.Argon2id.Memory
+		}
+		if s.Argon2id.Iterations != 0 {
+			params.Iterations = s.Argon2id.Iterations
+		}
+		if s.Argon2id.Parallelism != 0 {
+			params.Parallelism = s.Argon2id.Parallelism
+		}
+		return HashArgon2id(password, params)
+	default:
+		return "", fmt.Errorf("unsupported hash algorithm %q", algorithm)
+	}
+}
@@ -0,0 +1,170 @@
+package htpasswd
+
+import (
+	"errors"
+	"strings"
+	"testing"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+// testArgon2idParams keep the argon2id hashes of the tests cheap.
+var testArgon2idParams = Argon2idParams{Memory: 1024, Iterations: 1, Parallelism: 1}
+
+func TestArgon2id(t *testing.T) {
+	hash, err := HashArgon2id("baggins", testArgon2idParams)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.HasPrefix(hash, "$argon2id$v=19$m=1024,t=1,p=1$") {
+		t.Fatalf("unexpected argon2id hash %q", hash)
+	}
+	if err := compareHashAndPassword([]byte(hash), "baggins"); err != nil {
+		t.Fatalf("expected the password to match, got %v", err)
+	}
+	if err := compareHashAndPassword([]byte(hash), "sackville"); !errors.Is(err, bcrypt.ErrMismatchedHashAndPassword) {
+		t.Fatalf("expected the password not to match, got %v", err)
+	}
+
+	// A test vector of the argon2 reference implementation.
+	reference := "$argon2id$v=19$m=256,t=3,p=2$c29tZXNhbHQ$RmjTCsQYfmh47t6s8P2DxaCjDbLMFu8L"
+	if err := compareHashAndPassword([]byte(reference), "password"); err != nil {
+		t.Fatalf("expected the password of the test vector to match, got %v", err)
+	}
+	h, err := parseArgon2id([]byte(reference))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if h.String() != reference {
+		t.Fatalf("expected the hash to be formatted as parsed, got %q", h.String())
+	}
+
+	for _, malformed := range []string{
+		"$argon2id$v=19$m=1024,t=1,p=1$c29tZXNhbHQ",
+		"$argon2id$v=16$m=1024,t=1,p=1$c29tZXNhbHQ$a2V5",
+		"$argon2id$v=19$m=1024,t=1$c29tZXNhbHQ$a2V5",
+		"$argon2id$v=19$m=1024,t=0,p=1$c29tZXNhbHQ$a2V5",
+		"$argon2id$v=19$m=1024,t=1,p=256$c29tZXNhbHQ$a2V5",
+		"$argon2id$v=19$m=1024,t=1,p=1,x=1$c29tZXNhbHQ$a2V5",
+		"$argon2id$v=19$m=1024,t=1,p=1$!$a2V5",
+		"$argon2id$v=19$m=1024,t=1,p=1$c29tZXNhbHQ$",
+	} {
+		if err := compareHashAndPassword([]byte(malformed), "baggins"); err == nil || errors.Is(err, bcrypt.ErrMismatchedHashAndPassword) {
+			t.Errorf("%s: expected the hash to be rejected as malformed, got %v", malformed, err)
+		}
+	}
+}
+
+func TestStrength(t *testing.T) {
+	bcrypt4, err := HashBcrypt("baggins", bcrypt.MinCost)
+	if err != nil {
+		t.Fatal(err)
+	}
+	bcrypt5, err := HashBcrypt("baggins", bcrypt.MinCost+1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	argon2id1, err := HashArgon2id("baggins", testArgon2idParams)
+	if err != nil {
+		t.Fatal(err)
+	}
+	argon2id2, err := HashArgon2id("baggins", Argon2idParams{Memory: 2048, Iterations: 2, Parallelism: 1})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, tc := range []struct {
+		desc     string
+		strength Strength
+		accepted []string
+		rejected []string
+	}{
+		{
+			desc:     "none",
+			accepted: []string{bcrypt4, argon2id1, "{SHA}5siv5c0SHx681xU6GiSx9ZQryqs="},
+		},
+		{
+			desc:     "bcrypt cost",
+			strength: Strength{BcryptCost: 5},
+			accepted: []string{bcrypt5, argon2id1},
+			rejected: []string{bcrypt4, "{SHA}5siv5c0SHx681xU6GiSx9ZQryqs=", "$argon2id$v=19$m=1024"},
+		},
+		{
+			desc:     "argon2id",
+			strength: Strength{Algorithm: AlgorithmArgon2id},
+			accepted: []string{argon2id1},
+			rejected: []string{bcrypt5},
+		},
+		{
+			desc:     "argon2id parameters",
+			strength: Strength{Algorithm: AlgorithmArgon2id, Argon2id: Argon2idParams{Memory: 2048, Iterations: 2}},
+			accepted: []string{argon2id2},
+			rejected: []string{argon2id1, bcrypt5},
+		},
+	} {
+		for _, hash := range tc.accepted {
+			if err := tc.strength.check([]byte(hash)); err != nil {
+				t.Errorf("%s: expected %s to be accepted, got %v", tc.desc, hash, err)
+			}
+		}
+		for _, hash := range tc.rejected {
+			if err := tc.strength.check([]byte(hash)); err == nil {
+				t.Errorf("%s: expected %s to be rejected", tc.desc, hash)
+			}
+		}
+	}
+}
+
+func TestStrengthHash(t *testing.T) {
+	strength := Strength{BcryptCost: 5, Argon2id: Argon2idParams{Memory: 2048, Iterations: 2, Parallelism: 1}}
+	hash, err := strength.Hash("baggins", AlgorithmArgon2id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.HasPrefix(hash, "$argon2id$v=19$m=2048,t=2,p=1$") {
+		t.Fatalf("expected the hash to have the parameters of the strength, got %q", hash)
+	}
+	hash, err = strength.Hash("baggins", AlgorithmBcrypt)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cost, err := bcrypt.Cost([]byte(hash)); err != nil || cost != 5 {
+		t.Fatalf("expected the hash to have the cost of the strength, got %d, %v", cost, err)
+	}
+
+	if _, err := (Strength{Algorithm: AlgorithmArgon2id}).Hash("baggins", AlgorithmBcrypt); err == nil {
+		t.Fatal("expected an error hashing with bcrypt when argon2id is required")
+	}
+	if _, err := strength.Hash("baggins", "md5"); err == nil {
+		t.Fatal("expected an error hashing with an unsupported algorithm")
+	}
+}
+
+func TestParseStrength(t *testing.T) {
+	strength, err := ParseStrength(map[any]any{
+		"algorithm":          "argon2id",
+		"bcryptcost":         12,
+		"argon2idmemory":     65536,
+		"argon2iditerations": 3,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := Strength{Algorithm: AlgorithmArgon2id, BcryptCost: 12, Argon2id: Argon2idParams{Memory: 65536, Iterations: 3}}
+	if strength != want {
+		t.Fatalf("expected %+v, got %+v", want, strength)
+	}
+
+	for desc, opt := range map[string]any{
+		"not a map":         "argon2id",
+		"unknown algorithm": map[string]any{"algorithm": "md5"},
+		"negative":          map[string]any{"bcryptcost": -1},
+		"too costly":        map[string]any{"bcryptcost": 32},
+		"not an integer":    map[string]any{"argon2idmemory": "64MiB"},
+		"unknown option":    map[string]any{"scryptcost": 10},
+	} {
+		if _, err := ParseStrength(opt); err == nil {
+			t.Errorf("%s: expected an error", desc)
+		}
+	}
+}
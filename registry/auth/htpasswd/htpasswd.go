@@ -3,10 +3,16 @@ package htpasswd
 import (
 	"bufio"
 	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
 	"errors"
 	"fmt"
 	"io"
 	"strings"
+	"sync"
+	"time"
 
 	"github.com/distribution/distribution/v3/internal/dcontext"
 	"github.com/distribution/distribution/v3/registry/auth"
@@ -17,28 +23,61 @@ import (
 // dummyBcryptHash is used for non-existing users to prevent timing attacks.
 const dummyBcryptHash = "$2a$05$AAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAA"
 
+const (
+	// verificationTTL is how long a successful verification of a password
+	// is remembered, so that clients authenticating on every request do not
+	// pay for the hash each time.
+	verificationTTL = 5 * time.Minute
+
+	// maxVerifications is the maximum number of verifications remembered.
+	// Further passwords are verified on every request, until some expire.
+	maxVerifications = 1000
+)
+
 // htpasswd holds a path to a system .htpasswd file and the machinery to parse
-// it. Only bcrypt hash entries are supported.
+// it. Only bcrypt and argon2id hash entries are supported.
 type htpasswd struct {
 	entries map[string][]byte // maps username to password byte slice.
 
 	// dummyHash is used for non-existing users to prevent timing attacks.
 	dummyHash []byte
+
+	// verified holds the expiration of the successful verifications, keyed
+	// by the HMAC of the username, hash and password with verifiedKey, so
+	// that the passwords cannot be recovered from memory.
+	mu          sync.Mutex
+	verified    map[[sha256.Size]byte]time.Time
+	verifiedKey []byte
 }
 
-// newHTPasswd parses the reader and returns an htpasswd or an error.
-func newHTPasswd(rd io.Reader, dummyHash []byte) (*htpasswd, error) {
+// newHTPasswd parses the reader and returns an htpasswd or an error. The
+// entries weaker than the strength are left out, and returned with the reason
+// they were rejected.
+func newHTPasswd(rd io.Reader, dummyHash []byte, strength Strength) (*htpasswd, map[string]error, error) {
 	entries, err := parseHTPasswd(rd)
 	if err != nil {
-		return nil, err
+		return nil, nil, err
+	}
+	rejected := map[string]error{}
+	for user, hash := range entries {
+		if err := strength.check(hash); err != nil {
+			rejected[user] = err
+			delete(entries, user)
+		}
 	}
 	if dummyHash == nil {
 		dummyHash = []byte(dummyBcryptHash)
 	}
+	verifiedKey := make([]byte, sha256.Size)
+	if _, err := rand.Read(verifiedKey); err != nil {
+		return nil, nil, err
+	}
 	return &htpasswd{
-		entries:   entries,
-		dummyHash: dummyHash,
-	}, nil
+		entries:     entries,
+		dummyHash:   dummyHash,
+		verified:    map[[sha256.Size]byte]time.Time{},
+		verifiedKey: verifiedKey,
+	}, rejected, nil
 }
 
 // AuthenticateUser checks a given user:password credential against the
@@ -51,7 +90,16 @@ func (htpasswd *htpasswd) authenticateUser(ctx context.Context, username string,
 		return auth.ErrAuthenticationFailure
 	}
 
-	if err := bcrypt.CompareHashAndPassword(credentials, []byte(password)); err != nil {
+	key := htpasswd.verificationKey(username, credentials, password)
+	now := time.Now()
+	htpasswd.mu.Lock()
+	expires, ok := htpasswd.verified[key]
+	htpasswd.mu.Unlock()
+	if ok && now.Before(expires) {
+		return nil
+	}
+
+	if err := compareHashAndPassword(credentials, password); err != nil {
 		logger := dcontext.GetLogger(ctx).WithError(err).WithField("username", username)
 		if !errors.Is(err, bcrypt.ErrMismatchedHashAndPassword) {
 			logger.Error("error authenticating user")
@@ -62,9 +110,40 @@ func (htpasswd *htpasswd) authenticateUser(ctx context.Context, username string,
 		return auth.ErrAuthenticationFailure
 	}
 
+	htpasswd.remember(key, now)
 	return nil
 }
 
+func (htpasswd *htpasswd) verificationKey(username string, hash []byte, password string) [sha256.Size]byte {
+	mac := hmac.New(sha256.New, htpasswd.verifiedKey)
+	for _, field := range [][]byte{[]byte(username), hash, []byte(password)} {
+		// The fields are length prefixed, so that they cannot be confused.
+		_ = binary.Write(mac, binary.BigEndian, uint32(len(field)))
+		mac.Write(field)
+	}
+	var key [sha256.Size]byte
+	copy(key[:], mac.Sum(nil))
+	return key
+}
+
+// remember records a successful verification, once the expired ones are
+// forgotten if there are too many.
+func (htpasswd *htpasswd) remember(key [sha256.Size]byte, now time.Time) {
+	htpasswd.mu.Lock()
+	defer htpasswd.mu.Unlock()
+	if len(htpasswd.verified) >= maxVerifications {
+		for k, expires := range htpasswd.verified {
+			if !now.Before(expires) {
+				delete(htpasswd.verified, k)
+			}
+		}
+		if len(htpasswd.verified) >= maxVerifications {
+			return
+		}
+	}
+	htpasswd.verified[key] = now.Add(verificationTTL)
+}
+
 // parseHTPasswd parses the contents of htpasswd. This will read all the
 // entries in the file, whether or not they are needed. An error is returned
 // if a syntax errors are encountered or if the reader fails.
@@ -1,10 +1,12 @@
 package htpasswd
 
 import (
+	"context"
 	"fmt"
 	"reflect"
 	"strings"
 	"testing"
+	"time"
 )
 
 func TestParseHTPasswd(t *testing.T) {
@@ -81,3 +83,47 @@ asdf
 		}
 	}
 }
+
+func TestAuthenticateUserCache(t *testing.T) {
+	hash, err := HashArgon2id("baggins", testArgon2idParams)
+	if err != nil {
+		t.Fatal(err)
+	}
+	h, _, err := newHTPasswd(strings.NewReader("bilbo:"+hash+"\n"), nil, Strength{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx := context.Background()
+
+	if err := h.authenticateUser(ctx, "bilbo", "sackville"); err == nil {
+		t.Fatal("expected the wrong password to be rejected")
+	}
+	if len(h.verified) != 0 {
+		t.Fatal("expected the failed verification not to be remembered")
+	}
+	for range 2 {
+		if err := h.authenticateUser(ctx, "bilbo", "baggins"); err != nil {
+			t.Fatalf("unexpected error %v", err)
+		}
+	}
+	if len(h.verified) != 1 {
+		t.Fatalf("expected the verification to be remembered once, got %d", len(h.verified))
+	}
+	// The verification remembered is only that of the password verified.
+	if err := h.authenticateUser(ctx, "bilbo", "sackville"); err == nil {
+		t.Fatal("expected the wrong password to be rejected")
+	}
+
+	// Expired verifications are verified, and remembered, again.
+	for key := range h.verified {
+		h.verified[key] = time.Now().Add(-time.Second)
+	}
+	if err := h.authenticateUser(ctx, "bilbo", "baggins"); err != nil {
+		t.Fatalf("unexpected error %v", err)
+	}
+	for _, expires := range h.verified {
+		if !time.Now().Before(expires) {
+			t.Fatal("expected the verification to be remembered again")
+		}
+	}
+}
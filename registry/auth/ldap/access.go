@@ -0,0 +1,482 @@
+// Package ldap provides an access controller which authenticates the basic
+// auth credentials of requests against an LDAP directory, such as Active
+// Directory, and grants access to repositories from the groups of the user.
+//
+// The user is found by a search, bound as a service account or anonymously,
+// then authenticated by a bind with the presented password. The groups of
+// the user are found by a second search. Successful authentications are
+// cached briefly, and repeated failures are rejected without contacting the
+// directory, so that clients retrying a bad password do not lock the account
+// out.
+//
+// This authentication method MUST be used under TLS, as basic auth sends
+// passwords in the clear.
+package ldap
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/distribution/distribution/v3/internal/dcontext"
+	"github.com/distribution/distribution/v3/registry/auth"
+	"github.com/mitchellh/mapstructure"
+	"github.com/sirupsen/logrus"
+)
+
+// init registers the ldap auth backend.
+func init() {
+	if err := auth.Register("ldap", auth.InitFunc(newAccessController)); err != nil {
+		logrus.Errorf("failed to register ldap auth: %v", err)
+	}
+}
+
+const (
+	defaultUserFilter       = "(uid=%s)"
+	defaultGroupFilter      = "(member=%s)"
+	defaultGroupAttribute   = "cn"
+	defaultPoolSize         = 4
+	defaultTimeout          = 10 * time.Second
+	defaultCacheTTL         = time.Minute
+	defaultLockoutThreshold = 3
+	defaultLockoutDuration  = 5 * time.Minute
+)
+
+// ErrInsufficientScope is returned when the groups of the user are not
+// granted the requested access.
+var ErrInsufficientScope = errors.New("insufficient scope")
+
+// Rule grants actions on the repositories matching any of a list of glob
+// patterns to the members of a group.
+type Rule struct {
+	// Group is the name of the group, the groupattribute of its entry.
+	Group string `mapstructure:"group"`
+	// Repositories are the glob patterns of the repository names.
+	Repositories []string `mapstructure:"repositories"`
+	// Actions are the granted actions, such as pull, push or delete. The
+	// * action grants every action.
+	Actions []string `mapstructure:"actions"`
+}
+
+// grants returns whether the rule grants the access.
+func (r Rule) grants(access auth.Access) bool {
+	if access.Type != "repository" {
+		return false
+	}
+	if !slices.Contains(r.Actions, access.Action) && !slices.Contains(r.Actions, "*") {
+		return false
+	}
+	for _, pattern := range r.Repositories {
+		if ok, _ := path.Match(pattern, access.Name); ok {
+			return true
+		}
+	}
+	return false
+}
+
+// options are the options of the ldap access controller.
+type options struct {
+	Realm            string        `mapstructure:"realm"`
+	URL              string        `mapstructure:"url"`
+	StartTLS         bool          `mapstructure:"starttls"`
+	CA               string        `mapstructure:"ca"`
+	BindDN           string        `mapstructure:"binddn"`
+	BindPassword     string        `mapstructure:"bindpassword"`
+	UserBase         string        `mapstructure:"userbase"`
+	UserFilter       string        `mapstructure:"userfilter"`
+	GroupBase        string        `mapstructure:"groupbase"`
+	GroupFilter      string        `mapstructure:"groupfilter"`
+	GroupAttribute   string        `mapstructure:"groupattribute"`
+	PoolSize         int           `mapstructure:"poolsize"`
+	Timeout          time.Duration `mapstructure:"timeout"`
+	CacheTTL         time.Duration `mapstructure:"cachettl"`
+	OfflineGrace     time.Duration `mapstructure:"offlinegrace"`
+	LockoutThreshold int           `mapstructure:"lockoutthreshold"`
+	LockoutDuration  time.Duration `mapstructure:"lockoutduration"`
+	Rules            []Rule        `mapstructure:"rules"`
+}
+
+func parseOptions(parameters map[string]any) (options, error) {
+	opts := options{
+		UserFilter:       defaultUserFilter,
+		GroupFilter:      defaultGroupFilter,
+		GroupAttribute:   defaultGroupAttribute,
+		PoolSize:         defaultPoolSize,
+		Timeout:          defaultTimeout,
+		CacheTTL:         defaultCacheTTL,
+		LockoutThreshold: defaultLockoutThreshold,
+		LockoutDuration:  defaultLockoutDuration,
+	}
+	decoder, err := mapstructure.NewDecoder(&mapstructure.DecoderConfig{
+		DecodeHook: mapstructure.StringToTimeDurationHookFunc(),
+		Result:     &opts,
+	})
+	if err != nil {
+		return options{}, err
+	}
+	if err := decoder.Decode(parameters); err != nil {
+		return options{}, fmt.Errorf("invalid ldap auth options: %v", err)
+	}
+
+	for name, value := range map[string]string{"realm": opts.Realm, "url": opts.URL, "userbase": opts.UserBase} {
+		if value == "" {
+			return options{}, fmt.Errorf("%q must be set for ldap access controller", name)
+		}
+	}
+	if opts.BindDN == "" && opts.BindPassword != "" {
+		return options{}, errors.New(`"bindpassword" requires "binddn" for ldap access controller`)
+	}
+	if opts.GroupBase == "" && len(opts.Rules) > 0 {
+		return options{}, errors.New(`"groupbase" must be set for the rules of ldap access controller`)
+	}
+	if opts.PoolSize < 0 || opts.Timeout <= 0 || opts.CacheTTL < 0 || opts.OfflineGrace < 0 || opts.LockoutThreshold < 0 || opts.LockoutDuration < 0 {
+		return options{}, errors.New("ldap access controller sizes and durations must not be negative")
+	}
+	for i, rule := range opts.Rules {
+		if rule.Group == "" || len(rule.Repositories) == 0 || len(rule.Actions) == 0 {
+			return options{}, fmt.Errorf("ldap rule %d requires a group, repositories and actions", i)
+		}
+		for _, pattern := range rule.Repositories {
+			if _, err := path.Match(pattern, ""); err != nil {
+				return options{}, fmt.Errorf("ldap rule %d has an invalid repository pattern %q: %v", i, pattern, err)
+			}
+		}
+	}
+	return opts, nil
+}
+
+// cachedUser is a successful authentication of a user.
+type cachedUser struct {
+	// credentials is the salted hash of the password.
+	credentials []byte
+	groups      []string
+	time        time.Time
+}
+
+// failures counts the failed authentications of a user.
+type failures struct {
+	count int
+	// credentials are the salted hashes of the rejected passwords.
+	credentials [][]byte
+	last        time.Time
+}
+
+type accessController struct {
+	realm          string
+	userBase       string
+	userFilter     string
+	groupBase      string
+	groupFilter    string
+	groupAttribute string
+	rules          []Rule
+	pool           *pool
+
+	cacheTTL         time.Duration
+	offlineGrace     time.Duration
+	lockoutThreshold int
+	lockoutDuration  time.Duration
+	// salt is mixed in the hashes of the cached credentials.
+	salt []byte
+
+	mu       sync.Mutex
+	users    map[string]cachedUser
+	failures map[string]*failures
+	// err is the error of the last operation with the directory.
+	err error
+}
+
+var _ auth.AccessController = &accessController{}
+
+func newAccessController(parameters map[string]any) (auth.AccessController, error) {
+	opts, err := parseOptions(parameters)
+	if err != nil {
+		return nil, err
+	}
+
+	u, err := url.Parse(opts.URL)
+	if err != nil || (u.Scheme != "ldap" && u.Scheme != "ldaps") || u.Host == "" {
+		return nil, fmt.Errorf("invalid ldap url %q", opts.URL)
+	}
+	tlsConfig := &tls.Config{ServerName: u.Hostname(), MinVersion: tls.VersionTLS12}
+	if opts.CA != "" {
+		pem, err := os.ReadFile(opts.CA)
+		if err != nil {
+			return nil, fmt.Errorf("unable to read ldap ca %q: %v", opts.CA, err)
+		}
+		tlsConfig.RootCAs = x509.NewCertPool()
+		if !tlsConfig.RootCAs.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("no certificate found in ldap ca %q", opts.CA)
+		}
+	}
+	for _, filter := range []string{opts.UserFilter, opts.GroupFilter} {
+		if _, err := compileFilter(fmt.Sprintf(filter, "x")); err != nil {
+			return nil, err
+		}
+	}
+
+	salt := make([]byte, 32)
+	if _, err := rand.Read(salt); err != nil {
+		return nil, err
+	}
+
+	return &accessController{
+		realm:          opts.Realm,
+		userBase:       opts.UserBase,
+		userFilter:     opts.UserFilter,
+		groupBase:      opts.GroupBase,
+		groupFilter:    opts.GroupFilter,
+		groupAttribute: opts.GroupAttribute,
+		rules:          opts.Rules,
+		pool: &pool{
+			config: dialConfig{
+				url:       u,
+				startTLS:  opts.StartTLS,
+				tlsConfig: tlsConfig,
+				timeout:   opts.Timeout,
+			},
+			bindDN:   opts.BindDN,
+			password: opts.BindPassword,
+			size:     opts.PoolSize,
+		},
+		cacheTTL:         opts.CacheTTL,
+		offlineGrace:     opts.OfflineGrace,
+		lockoutThreshold: opts.LockoutThreshold,
+		lockoutDuration:  opts.LockoutDuration,
+		salt:             salt,
+		users:            map[string]cachedUser{},
+		failures:         map[string]*failures{},
+	}, nil
+}
+
+// Authorized authenticates the basic auth credentials of the request against
+// the directory, and checks that the rules grant all the access items to the
+// groups of the user.
+func (ac *accessController) Authorized(req *http.Request, accessItems ...auth.Access) (*auth.Grant, error) {
+	username, password, ok := req.BasicAuth()
+	// An empty password would make an unauthenticated bind, which succeeds.
+	if !ok || username == "" || password == "" {
+		return nil, &challenge{realm: ac.realm, err: auth.ErrInvalidCredential}
+	}
+
+	groups, err := ac.authenticate(req.Context(), username, password)
+	if err != nil {
+		if errors.Is(err, auth.ErrAuthenticationFailure) {
+			return nil, &challenge{realm: ac.realm, err: err}
+		}
+		return nil, err
+	}
+
+	resources := make([]auth.Resource, 0, len(accessItems))
+	for _, access := range accessItems {
+		if !ac.granted(groups, access) {
+			return nil, &challenge{realm: ac.realm, err: ErrInsufficientScope}
+		}
+		resources = append(resources, access.Resource)
+	}
+	return &auth.Grant{User: auth.UserInfo{Name: username}, Resources: resources}, nil
+}
+
+// Check implements health.Checker. It fails if the last operation with the
+// directory failed.
+func (ac *accessController) Check(context.Context) error {
+	ac.mu.Lock()
+	defer ac.mu.Unlock()
+	return ac.err
+}
+
+func (ac *accessController) granted(groups []string, access auth.Access) bool {
+	for _, rule := range ac.rules {
+		if slices.Contains(groups, rule.Group) && rule.grants(access) {
+			return true
+		}
+	}
+	return false
+}
+
+// authenticate returns the groups of the user if the password is valid.
+func (ac *accessController) authenticate(ctx context.Context, username, password string) ([]string, error) {
+	credentials := ac.hash(username, password)
+	now := time.Now()
+
+	cached, ok, err := ac.cached(username, credentials, now)
+	if err != nil || (ok && now.Sub(cached.time) < ac.cacheTTL) {
+		return cached.groups, err
+	}
+
+	groups, err := ac.authenticateLDAP(ctx, username, password)
+	ac.mu.Lock()
+	defer ac.mu.Unlock()
+	switch {
+	case errors.Is(err, auth.ErrAuthenticationFailure):
+		ac.err = nil
+		f := ac.failures[username]
+		if f == nil || now.Sub(f.last) >= ac.lockoutDuration {
+			f = &failures{}
+			ac.failures[username] = f
+		}
+		f.count++
+		f.last = now
+		f.credentials = append(f.credentials, credentials)
+		delete(ac.users, username)
+		dcontext.GetLoggerWithField(ctx, "username", username).Info("user failed to authenticate")
+		return nil, err
+	case err != nil:
+		ac.err = err
+		if ok && now.Sub(cached.time) < ac.cacheTTL+ac.offlineGrace {
+			dcontext.GetLoggerWithField(ctx, "username", username).Warnf("ldap directory unavailable, using the cached authentication: %v", err)
+			return cached.groups, nil
+		}
+		return nil, fmt.Errorf("ldap directory unavailable: %v", err)
+	}
+
+	ac.err = nil
+	delete(ac.failures, username)
+	ac.users[username] = cachedUser{credentials: credentials, groups: groups, time: now}
+	return groups, nil
+}
+
+// cached returns the cached authentication of the user with the credentials,
+// if any. It fails the authentication without contacting the directory if the
+// credentials were already rejected, or if the user failed to authenticate
+// too many times recently.
+func (ac *accessController) cached(username string, credentials []byte, now time.Time) (cachedUser, bool, error) {
+	ac.mu.Lock()
+	defer ac.mu.Unlock()
+
+	if f := ac.failures[username]; f != nil && now.Sub(f.last) < ac.lockoutDuration {
+		if ac.lockoutThreshold > 0 && f.count >= ac.lockoutThreshold {
+			return cachedUser{}, false, auth.ErrAuthenticationFailure
+		}
+		for _, rejected := range f.credentials {
+			if subtle.ConstantTimeCompare(rejected, credentials) == 1 {
+				return cachedUser{}, false, auth.ErrAuthenticationFailure
+			}
+		}
+	}
+
+	cached, ok := ac.users[username]
+	if !ok || subtle.ConstantTimeCompare(cached.credentials, credentials) != 1 {
+		return cachedUser{}, false, nil
+	}
+	return cached, true, nil
+}
+
+// authenticateLDAP finds the user in the directory, binds with the password
+// and returns the groups of the user. It returns auth.ErrAuthenticationFailure
+// if the user is unknown or the password invalid.
+func (ac *accessController) authenticateLDAP(ctx context.Context, username, password string) ([]string, error) {
+	userFilter, err := compileFilter(fmt.Sprintf(ac.userFilter, escapeFilter(username)))
+	if err != nil {
+		return nil, err
+	}
+
+	var dn string
+	err = ac.withConn(ctx, func(c *conn) error {
+		entries, err := c.search(ac.userBase, userFilter, []string{"dn"}, 2)
+		if err != nil {
+			return err
+		}
+		if len(entries) != 1 {
+			return auth.ErrAuthenticationFailure
+		}
+		dn = entries[0].dn
+
+		err = c.bind(dn, password)
+		// The connection is bound as the user, or as nobody after a failed
+		// bind, until it is bound as the search user again.
+		if rebindErr := c.bind(ac.pool.bindDN, ac.pool.password); rebindErr != nil {
+			return rebindErr
+		}
+		if errors.Is(err, errInvalidCredentials) {
+			return auth.ErrAuthenticationFailure
+		}
+		return err
+	})
+	if err != nil || ac.groupBase == "" {
+		return nil, err
+	}
+
+	groupFilter, err := compileFilter(fmt.Sprintf(ac.groupFilter, escapeFilter(dn)))
+	if err != nil {
+		return nil, err
+	}
+	var groups []string
+	err = ac.withConn(ctx, func(c *conn) error {
+		entries, err := c.search(ac.groupBase, groupFilter, []string{ac.groupAttribute}, 0)
+		if err != nil {
+			return err
+		}
+		groups = groups[:0]
+		for _, e := range entries {
+			for name, values := range e.attributes {
+				if strings.EqualFold(name, ac.groupAttribute) {
+					groups = append(groups, values...)
+				}
+			}
+		}
+		return nil
+	})
+	return groups, err
+}
+
+// withConn runs fn with a pooled connection. The operation is retried once
+// on a new connection if a pooled one is broken.
+func (ac *accessController) withConn(ctx context.Context, fn func(*conn) error) error {
+	for attempt := 0; ; attempt++ {
+		c, err := ac.pool.get(ctx)
+		if err != nil {
+			return err
+		}
+		err = fn(c)
+		var netErr net.Error
+		if err == nil || errors.Is(err, auth.ErrAuthenticationFailure) || errors.As(err, &resultError{}) {
+			ac.pool.put(c)
+			return err
+		}
+		c.close()
+		if attempt > 0 || (errors.As(err, &netErr) && netErr.Timeout()) {
+			return err
+		}
+	}
+}
+
+// hash returns the salted hash of the credentials.
+func (ac *accessController) hash(username, password string) []byte {
+	h := sha256.New()
+	h.Write(ac.salt)
+	h.Write([]byte(username))
+	h.Write([]byte{0})
+	h.Write([]byte(password))
+	return h.Sum(nil)
+}
+
+// challenge implements the auth.Challenge interface.
+type challenge struct {
+	realm string
+	err   error
+}
+
+var _ auth.Challenge = challenge{}
+
+// SetHeaders sets the basic challenge header on the response.
+func (ch challenge) SetHeaders(r *http.Request, w http.ResponseWriter) {
+	w.Header().Set("WWW-Authenticate", fmt.Sprintf("Basic realm=%q", ch.realm))
+}
+
+func (ch challenge) Error() string {
+	return fmt.Sprintf("basic authentication challenge for realm %q: %s", ch.realm, ch.err)
+}
@@ -0,0 +1,541 @@
+package ldap
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"errors"
+	"math/big"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/distribution/distribution/v3/registry/auth"
+)
+
+// testServer is a minimal LDAP server, supporting simple binds, searches with
+// equality and presence filters, and StartTLS.
+type testServer struct {
+	listener  net.Listener
+	tlsConfig *tls.Config
+	// passwords are the passwords of the entries, by DN.
+	passwords map[string]string
+	entries   []entry
+	// operations counts the binds and searches.
+	operations atomic.Int64
+
+	mu    sync.Mutex
+	conns []net.Conn
+}
+
+func newTestServer(t *testing.T) *testServer {
+	t.Helper()
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := &testServer{
+		listener: l,
+		passwords: map[string]string{
+			"cn=registry,dc=example,dc=com":         "registry-password",
+			"uid=alice,ou=people,dc=example,dc=com": "alice-password",
+			"uid=bob,ou=people,dc=example,dc=com":   "bob-password",
+		},
+		entries: []entry{
+			{dn: "uid=alice,ou=people,dc=example,dc=com", attributes: map[string][]string{"uid": {"alice"}, "objectClass": {"person"}}},
+			{dn: "uid=bob,ou=people,dc=example,dc=com", attributes: map[string][]string{"uid": {"bob"}, "objectClass": {"person"}}},
+			{dn: "cn=developers,ou=groups,dc=example,dc=com", attributes: map[string][]string{
+				"cn":     {"developers"},
+				"member": {"uid=alice,ou=people,dc=example,dc=com", "uid=bob,ou=people,dc=example,dc=com"},
+			}},
+			{dn: "cn=admins,ou=groups,dc=example,dc=com", attributes: map[string][]string{
+				"cn":     {"admins"},
+				"member": {"uid=bob,ou=people,dc=example,dc=com"},
+			}},
+		},
+	}
+	go s.serve()
+	t.Cleanup(s.close)
+	return s
+}
+
+func (s *testServer) url() string {
+	return "ldap://" + s.listener.Addr().String()
+}
+
+// close stops the server and closes its connections.
+func (s *testServer) close() {
+	s.listener.Close()
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, c := range s.conns {
+		c.Close()
+	}
+}
+
+func (s *testServer) serve() {
+	for {
+		nc, err := s.listener.Accept()
+		if err != nil {
+			return
+		}
+		s.mu.Lock()
+		s.conns = append(s.conns, nc)
+		s.mu.Unlock()
+		go s.handle(nc)
+	}
+}
+
+func (s *testServer) handle(nc net.Conn) {
+	defer nc.Close()
+	for {
+		msg, err := readPacket(nc)
+		if err != nil {
+			return
+		}
+		id, request := msg.children[0], msg.children[1]
+		reply := func(p *packet) {
+			_, _ = nc.Write(sequence(id, p).bytes())
+		}
+		result := func(op byte, code int64) *packet {
+			return constructed(classApplication, op, integer(tagEnumerated, code), octetString(""), octetString(""))
+		}
+
+		switch request.tag {
+		case opBindRequest:
+			s.operations.Add(1)
+			dn, password := request.children[1].str(), request.children[2].str()
+			if expected, ok := s.passwords[dn]; (dn != "" || password != "") && (!ok || expected != password) {
+				reply(result(opBindResponse, resultInvalidCredentials))
+				continue
+			}
+			reply(result(opBindResponse, resultSuccess))
+		case opSearchRequest:
+			s.operations.Add(1)
+			base, filter := request.children[0].str(), request.children[6]
+			for _, e := range s.entries {
+				if !strings.HasSuffix(e.dn, base) || !matchFilter(filter, e) {
+					continue
+				}
+				attrs := sequence()
+				for _, a := range request.children[7].children {
+					values := constructed(classUniversal, tagSet)
+					for _, v := range e.attributes[a.str()] {
+						values.children = append(values.children, octetString(v))
+					}
+					attrs.children = append(attrs.children, sequence(octetString(a.str()), values))
+				}
+				reply(constructed(classApplication, opSearchResultEntry, octetString(e.dn), attrs))
+			}
+			reply(result(opSearchResultDone, resultSuccess))
+		case opExtendedRequest:
+			if s.tlsConfig == nil {
+				reply(result(opExtendedResponse, 2))
+				continue
+			}
+			reply(result(opExtendedResponse, resultSuccess))
+			tlsConn := tls.Server(nc, s.tlsConfig)
+			if err := tlsConn.Handshake(); err != nil {
+				return
+			}
+			nc = tlsConn
+		case opUnbindRequest:
+			return
+		}
+	}
+}
+
+func matchFilter(f *packet, e entry) bool {
+	switch f.tag {
+	case filterAnd:
+		for _, child := range f.children {
+			if !matchFilter(child, e) {
+				return false
+			}
+		}
+		return true
+	case filterOr:
+		for _, child := range f.children {
+			if matchFilter(child, e) {
+				return true
+			}
+		}
+		return false
+	case filterNot:
+		return !matchFilter(f.children[0], e)
+	case filterPresent:
+		return len(e.attributes[f.str()]) > 0
+	case filterEquality:
+		for _, v := range e.attributes[f.children[0].str()] {
+			if strings.EqualFold(v, f.children[1].str()) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+func testParameters(s *testServer) map[string]any {
+	return map[string]any{
+		"realm":        "test-realm",
+		"url":          s.url(),
+		"binddn":       "cn=registry,dc=example,dc=com",
+		"bindpassword": "registry-password",
+		"userbase":     "ou=people,dc=example,dc=com",
+		"userfilter":   "(&(objectClass=person)(uid=%s))",
+		"groupbase":    "ou=groups,dc=example,dc=com",
+		"rules": []any{
+			map[any]any{"group": "developers", "repositories": []any{"dev/*"}, "actions": []any{"pull", "push"}},
+			map[any]any{"group": "admins", "repositories": []any{"*", "*/*"}, "actions": []any{"*"}},
+		},
+	}
+}
+
+func newTestController(t *testing.T, parameters map[string]any) *accessController {
+	t.Helper()
+	ac, err := newAccessController(parameters)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return ac.(*accessController)
+}
+
+func authorize(ac auth.AccessController, username, password string, access ...auth.Access) (*auth.Grant, error) {
+	req, _ := http.NewRequest(http.MethodGet, "/v2/", nil)
+	if username != "" || password != "" {
+		req.SetBasicAuth(username, password)
+	}
+	return ac.Authorized(req, access...)
+}
+
+func repositoryAccess(name, action string) auth.Access {
+	return auth.Access{Resource: auth.Resource{Type: "repository", Name: name}, Action: action}
+}
+
+func isChallenge(err error) bool {
+	var ch auth.Challenge
+	return errors.As(err, &ch)
+}
+
+func TestAuthorized(t *testing.T) {
+	s := newTestServer(t)
+	ac := newTestController(t, testParameters(s))
+
+	grant, err := authorize(ac, "alice", "alice-password", repositoryAccess("dev/app", "push"))
+	if err != nil {
+		t.Fatalf("unexpected error authorizing alice: %v", err)
+	}
+	if grant.User.Name != "alice" || len(grant.Resources) != 1 || grant.Resources[0].Name != "dev/app" {
+		t.Fatalf("unexpected grant: %+v", grant)
+	}
+
+	for _, tc := range []struct {
+		name               string
+		username, password string
+		access             auth.Access
+		expected           error
+	}{
+		{"missing credentials", "", "", repositoryAccess("dev/app", "pull"), auth.ErrInvalidCredential},
+		{"empty password", "alice", "", repositoryAccess("dev/app", "pull"), auth.ErrInvalidCredential},
+		{"wrong password", "alice", "wrong", repositoryAccess("dev/app", "pull"), auth.ErrAuthenticationFailure},
+		{"unknown user", "carol", "carol-password", repositoryAccess("dev/app", "pull"), auth.ErrAuthenticationFailure},
+		{"filter injection", "*", "alice-password", repositoryAccess("dev/app", "pull"), auth.ErrAuthenticationFailure},
+		{"not granted", "alice", "alice-password", repositoryAccess("prod/app", "pull"), ErrInsufficientScope},
+		{"not granted action", "alice", "alice-password", repositoryAccess("dev/app", "delete"), ErrInsufficientScope},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			_, err := authorize(ac, tc.username, tc.password, tc.access)
+			if !isChallenge(err) {
+				t.Fatalf("expected a challenge, got %v", err)
+			}
+			if ch := err.(*challenge); ch.err != tc.expected {
+				t.Fatalf("expected %v, got %v", tc.expected, ch.err)
+			}
+		})
+	}
+
+	if _, err := authorize(ac, "bob", "bob-password", repositoryAccess("prod/app", "delete")); err != nil {
+		t.Fatalf("unexpected error authorizing bob: %v", err)
+	}
+	if err := ac.Check(context.Background()); err != nil {
+		t.Fatalf("unexpected health check error: %v", err)
+	}
+}
+
+func TestLockout(t *testing.T) {
+	s := newTestServer(t)
+	parameters := testParameters(s)
+	parameters["lockoutthreshold"] = 3
+	ac := newTestController(t, parameters)
+
+	if _, err := authorize(ac, "alice", "wrong"); !isChallenge(err) {
+		t.Fatalf("expected a challenge, got %v", err)
+	}
+	// A rejected password is not sent to the directory again.
+	operations := s.operations.Load()
+	if _, err := authorize(ac, "alice", "wrong"); !isChallenge(err) {
+		t.Fatalf("expected a challenge, got %v", err)
+	}
+	if n := s.operations.Load(); n != operations {
+		t.Fatalf("rejected password was sent to the directory: %d operations", n-operations)
+	}
+
+	for _, password := range []string{"wrong2", "wrong3"} {
+		if _, err := authorize(ac, "alice", password); !isChallenge(err) {
+			t.Fatalf("expected a challenge, got %v", err)
+		}
+	}
+	// The user is locked out, even with the right password.
+	operations = s.operations.Load()
+	if _, err := authorize(ac, "alice", "alice-password"); !isChallenge(err) {
+		t.Fatalf("expected a challenge for a locked out user, got %v", err)
+	}
+	if n := s.operations.Load(); n != operations {
+		t.Fatalf("locked out user was sent to the directory: %d operations", n-operations)
+	}
+	// Other users are not locked out.
+	if _, err := authorize(ac, "bob", "bob-password"); err != nil {
+		t.Fatalf("unexpected error authorizing bob: %v", err)
+	}
+}
+
+func TestCache(t *testing.T) {
+	s := newTestServer(t)
+	parameters := testParameters(s)
+	parameters["cachettl"] = "1h"
+	ac := newTestController(t, parameters)
+
+	if _, err := authorize(ac, "alice", "alice-password", repositoryAccess("dev/app", "pull")); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	operations := s.operations.Load()
+	if _, err := authorize(ac, "alice", "alice-password", repositoryAccess("dev/app", "pull")); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if n := s.operations.Load(); n != operations {
+		t.Fatalf("cached authentication was sent to the directory: %d operations", n-operations)
+	}
+	// The cache does not accept another password.
+	if _, err := authorize(ac, "alice", "wrong"); !isChallenge(err) {
+		t.Fatalf("expected a challenge, got %v", err)
+	}
+}
+
+func TestDirectoryUnavailable(t *testing.T) {
+	for _, tc := range []struct {
+		name         string
+		offlineGrace string
+		allowed      bool
+	}{
+		{"fail closed", "0s", false},
+		{"offline grace", "1h", true},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			s := newTestServer(t)
+			parameters := testParameters(s)
+			parameters["cachettl"] = "1ms"
+			parameters["offlinegrace"] = tc.offlineGrace
+			ac := newTestController(t, parameters)
+
+			if _, err := authorize(ac, "alice", "alice-password", repositoryAccess("dev/app", "pull")); err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			time.Sleep(10 * time.Millisecond)
+			s.close()
+
+			_, err := authorize(ac, "alice", "alice-password", repositoryAccess("dev/app", "pull"))
+			if tc.allowed && err != nil {
+				t.Fatalf("unexpected error during offline grace: %v", err)
+			}
+			if !tc.allowed && (err == nil || isChallenge(err)) {
+				t.Fatalf("expected an error, got %v", err)
+			}
+			if err := ac.Check(context.Background()); err == nil {
+				t.Fatal("expected a health check error")
+			}
+			// Users not in the cache are never allowed.
+			if _, err := authorize(ac, "bob", "bob-password"); err == nil || isChallenge(err) {
+				t.Fatalf("expected an error, got %v", err)
+			}
+		})
+	}
+}
+
+func TestStartTLS(t *testing.T) {
+	s := newTestServer(t)
+	ca := generateTLS(t, s)
+
+	parameters := testParameters(s)
+	parameters["starttls"] = true
+	parameters["ca"] = ca
+	ac := newTestController(t, parameters)
+	if _, err := authorize(ac, "alice", "alice-password", repositoryAccess("dev/app", "pull")); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	// The certificate of the server is not trusted without the ca.
+	delete(parameters, "ca")
+	ac = newTestController(t, parameters)
+	if _, err := authorize(ac, "alice", "alice-password", repositoryAccess("dev/app", "pull")); err == nil || isChallenge(err) {
+		t.Fatalf("expected a certificate error, got %v", err)
+	}
+}
+
+// generateTLS sets a certificate for 127.0.0.1 on the server, and returns the
+// path of the certificate of its CA.
+func generateTLS(t *testing.T, s *testServer) string {
+	t.Helper()
+	caKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	caTemplate := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "test ca"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+		KeyUsage:              x509.KeyUsageCertSign,
+	}
+	caDER, err := x509.CreateCertificate(rand.Reader, caTemplate, caTemplate, &caKey.PublicKey, caKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(2),
+		Subject:      pkix.Name{CommonName: "127.0.0.1"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		IPAddresses:  []net.IP{net.ParseIP("127.0.0.1")},
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, caTemplate, &key.PublicKey, caKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s.tlsConfig = &tls.Config{Certificates: []tls.Certificate{{Certificate: [][]byte{der}, PrivateKey: key}}}
+
+	path := filepath.Join(t.TempDir(), "ca.pem")
+	if err := os.WriteFile(path, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: caDER}), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestParseOptions(t *testing.T) {
+	for _, tc := range []struct {
+		name       string
+		parameters map[string]any
+	}{
+		{"missing realm", map[string]any{"url": "ldap://localhost", "userbase": "dc=example"}},
+		{"missing url", map[string]any{"realm": "r", "userbase": "dc=example"}},
+		{"missing userbase", map[string]any{"realm": "r", "url": "ldap://localhost"}},
+		{"password without dn", map[string]any{"realm": "r", "url": "ldap://localhost", "userbase": "dc=example", "bindpassword": "p"}},
+		{"rules without groupbase", map[string]any{"realm": "r", "url": "ldap://localhost", "userbase": "dc=example", "rules": []any{
+			map[any]any{"group": "g", "repositories": []any{"*"}, "actions": []any{"pull"}},
+		}}},
+		{"invalid pattern", map[string]any{"realm": "r", "url": "ldap://localhost", "userbase": "dc=example", "groupbase": "dc=example", "rules": []any{
+			map[any]any{"group": "g", "repositories": []any{"["}, "actions": []any{"pull"}},
+		}}},
+		{"invalid duration", map[string]any{"realm": "r", "url": "ldap://localhost", "userbase": "dc=example", "cachettl": "soon"}},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			if _, err := parseOptions(tc.parameters); err == nil {
+				t.Fatal("expected an error")
+			}
+		})
+	}
+
+	for _, u := range []string{"http://localhost", "localhost:389", "ldap://"} {
+		if _, err := newAccessController(map[string]any{"realm": "r", "url": u, "userbase": "dc=example"}); err == nil {
+			t.Fatalf("expected an error for url %q", u)
+		}
+	}
+	if _, err := newAccessController(map[string]any{"realm": "r", "url": "ldap://localhost", "userbase": "dc=example", "userfilter": "(uid=%s"}); err == nil {
+		t.Fatal("expected an error for an invalid user filter")
+	}
+}
+
+func TestCompileFilter(t *testing.T) {
+	for _, tc := range []struct {
+		filter string
+		valid  bool
+	}{
+		{"(uid=alice)", true},
+		{"uid=alice", true},
+		{"(&(objectClass=person)(|(uid=alice)(mail=alice@example.com)))", true},
+		{"(!(uid=alice))", true},
+		{"(memberOf=*)", true},
+		{`(cn=a\2ab)`, true},
+		{"(uid=al*)", false},
+		{"(uid>=alice)", false},
+		{"(&)", false},
+		{"(uid=alice", false},
+		{"(uid=alice))", false},
+		{`(cn=a\2)`, false},
+	} {
+		_, err := compileFilter(tc.filter)
+		if tc.valid && err != nil {
+			t.Errorf("unexpected error compiling %q: %v", tc.filter, err)
+		}
+		if !tc.valid && err == nil {
+			t.Errorf("expected an error compiling %q", tc.filter)
+		}
+	}
+
+	if escaped := escapeFilter(`a*(b)\c` + "\x00"); escaped != `a\2a\28b\29\5cc\00` {
+		t.Fatalf("unexpected escaped value %q", escaped)
+	}
+	p, err := compileFilter("(uid=" + escapeFilter("*)(uid=*") + ")")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if p.tag != filterEquality || p.children[1].str() != "*)(uid=*" {
+		t.Fatalf("escaped value was not kept as an equality: %+v", p)
+	}
+}
+
+func TestPacket(t *testing.T) {
+	for _, v := range []int64{0, 1, 127, 128, 255, 256, -1, -128, -129, 1 << 40} {
+		p, rest, err := parsePacket(integer(tagInteger, v).bytes())
+		if err != nil || len(rest) != 0 {
+			t.Fatalf("unexpected error parsing %d: %v", v, err)
+		}
+		if got, err := p.int(); err != nil || got != v {
+			t.Fatalf("expected %d, got %d (%v)", v, got, err)
+		}
+	}
+
+	long := octetString(strings.Repeat("x", 1000))
+	p, _, err := parsePacket(sequence(long, boolean(true)).bytes())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(p.children) != 2 || p.children[0].str() != long.str() || p.children[1].data[0] != 0xff {
+		t.Fatalf("unexpected packet %+v", p)
+	}
+
+	for _, b := range [][]byte{{0x30}, {0x30, 0x05, 0x04}, {0x30, 0x85, 1, 1, 1, 1, 1}, {0x1f, 0x00}} {
+		if _, _, err := parsePacket(b); err == nil {
+			t.Fatalf("expected an error parsing %x", b)
+		}
+	}
+}
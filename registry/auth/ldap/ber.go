@@ -0,0 +1,201 @@
+package ldap
+
+import (
+	"errors"
+	"fmt"
+	"io"
+)
+
+// BER classes and universal tags of the subset of ASN.1 used by LDAP, see
+// RFC 4511, section 5.1.
+const (
+	classUniversal   byte = 0x00
+	classApplication byte = 0x40
+	classContext     byte = 0x80
+
+	tagBoolean     byte = 0x01
+	tagInteger     byte = 0x02
+	tagOctetString byte = 0x04
+	tagEnumerated  byte = 0x0a
+	tagSequence    byte = 0x10
+	tagSet         byte = 0x11
+
+	// maxPacketSize bounds the size of a message read from the server.
+	maxPacketSize = 16 << 20
+)
+
+var errMalformedPacket = errors.New("malformed BER packet")
+
+// packet is a BER encoded value, either primitive with data, or constructed
+// with children. Only low tag numbers and definite lengths are supported,
+// which is all LDAP needs.
+type packet struct {
+	class       byte
+	constructed bool
+	tag         byte
+	data        []byte
+	children    []*packet
+}
+
+func constructed(class, tag byte, children ...*packet) *packet {
+	return &packet{class: class, constructed: true, tag: tag, children: children}
+}
+
+func sequence(children ...*packet) *packet {
+	return constructed(classUniversal, tagSequence, children...)
+}
+
+func primitive(class, tag byte, data []byte) *packet {
+	return &packet{class: class, tag: tag, data: data}
+}
+
+func octetString(s string) *packet {
+	return primitive(classUniversal, tagOctetString, []byte(s))
+}
+
+func integer(tag byte, v int64) *packet {
+	// Minimal two's complement encoding.
+	var data []byte
+	for {
+		data = append([]byte{byte(v)}, data...)
+		if (v < 0x80 && v >= -0x80) || len(data) == 8 {
+			break
+		}
+		v >>= 8
+	}
+	return primitive(classUniversal, tag, data)
+}
+
+func boolean(v bool) *packet {
+	if v {
+		return primitive(classUniversal, tagBoolean, []byte{0xff})
+	}
+	return primitive(classUniversal, tagBoolean, []byte{0x00})
+}
+
+// is returns whether the packet has the class and tag.
+func (p *packet) is(class, tag byte) bool {
+	return p.class == class && p.tag == tag
+}
+
+func (p *packet) int() (int64, error) {
+	if p.constructed || len(p.data) == 0 || len(p.data) > 8 {
+		return 0, errMalformedPacket
+	}
+	v := int64(int8(p.data[0]))
+	for _, b := range p.data[1:] {
+		v = v<<8 | int64(b)
+	}
+	return v, nil
+}
+
+func (p *packet) str() string {
+	return string(p.data)
+}
+
+// bytes returns the BER encoding of the packet.
+func (p *packet) bytes() []byte {
+	content := p.data
+	if p.constructed {
+		content = nil
+		for _, child := range p.children {
+			content = append(content, child.bytes()...)
+		}
+	}
+
+	identifier := p.class | p.tag
+	if p.constructed {
+		identifier |= 0x20
+	}
+	b := []byte{identifier}
+	if n := len(content); n < 0x80 {
+		b = append(b, byte(n))
+	} else {
+		var length []byte
+		for ; n > 0; n >>= 8 {
+			length = append([]byte{byte(n)}, length...)
+		}
+		b = append(b, 0x80|byte(len(length)))
+		b = append(b, length...)
+	}
+	return append(b, content...)
+}
+
+// readPacket reads a packet from r.
+func readPacket(r io.Reader) (*packet, error) {
+	var header [2]byte
+	if _, err := io.ReadFull(r, header[:]); err != nil {
+		return nil, err
+	}
+	length := int(header[1])
+	if length&0x80 != 0 {
+		n := length & 0x7f
+		if n == 0 || n > 4 {
+			return nil, errMalformedPacket
+		}
+		lengthBytes := make([]byte, n)
+		if _, err := io.ReadFull(r, lengthBytes); err != nil {
+			return nil, err
+		}
+		length = 0
+		for _, b := range lengthBytes {
+			length = length<<8 | int(b)
+		}
+	}
+	if length > maxPacketSize {
+		return nil, fmt.Errorf("BER packet of %d bytes exceeds %d bytes", length, maxPacketSize)
+	}
+	content := make([]byte, length)
+	if _, err := io.ReadFull(r, content); err != nil {
+		return nil, err
+	}
+	return newPacket(header[0], content)
+}
+
+// parsePacket parses a packet from the start of b, returning the rest of b.
+func parsePacket(b []byte) (*packet, []byte, error) {
+	if len(b) < 2 {
+		return nil, nil, errMalformedPacket
+	}
+	identifier, length, b := b[0], int(b[1]), b[2:]
+	if length&0x80 != 0 {
+		n := length & 0x7f
+		if n == 0 || n > 4 || len(b) < n {
+			return nil, nil, errMalformedPacket
+		}
+		length = 0
+		for _, c := range b[:n] {
+			length = length<<8 | int(c)
+		}
+		b = b[n:]
+	}
+	if length < 0 || len(b) < length {
+		return nil, nil, errMalformedPacket
+	}
+	p, err := newPacket(identifier, b[:length])
+	return p, b[length:], err
+}
+
+func newPacket(identifier byte, content []byte) (*packet, error) {
+	if identifier&0x1f == 0x1f {
+		return nil, errMalformedPacket
+	}
+	p := &packet{
+		class:       identifier & 0xc0,
+		constructed: identifier&0x20 != 0,
+		tag:         identifier & 0x1f,
+	}
+	if !p.constructed {
+		p.data = content
+		return p, nil
+	}
+	for len(content) > 0 {
+		child, rest, err := parsePacket(content)
+		if err != nil {
+			return nil, err
+		}
+		p.children = append(p.children, child)
+		content = rest
+	}
+	return p, nil
+}
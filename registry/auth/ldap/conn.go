@@ -0,0 +1,306 @@
+package ldap
+
+import (
+	"bufio"
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"net"
+	"net/url"
+	"sync"
+	"time"
+)
+
+// Protocol operations, see RFC 4511, section 4.
+const (
+	opBindRequest       byte = 0
+	opBindResponse      byte = 1
+	opUnbindRequest     byte = 2
+	opSearchRequest     byte = 3
+	opSearchResultEntry byte = 4
+	opSearchResultDone  byte = 5
+	opSearchResultRef   byte = 19
+	opExtendedRequest   byte = 23
+	opExtendedResponse  byte = 24
+
+	resultSuccess                 = 0
+	resultInvalidCredentials      = 49
+	scopeWholeSubtree             = 2
+	derefNever                    = 0
+	startTLSOID                   = "1.3.6.1.4.1.1466.20037"
+	protocolVersion               = 3
+	authenticationSimple     byte = 0
+)
+
+// errInvalidCredentials is returned by a bind with a wrong DN or password.
+var errInvalidCredentials = errors.New("invalid credentials")
+
+// resultError is a result of an operation other than success.
+type resultError struct {
+	code    int64
+	message string
+}
+
+func (err resultError) Error() string {
+	return fmt.Sprintf("ldap result code %d: %s", err.code, err.message)
+}
+
+// entry is an entry returned by a search.
+type entry struct {
+	dn         string
+	attributes map[string][]string
+}
+
+// conn is a connection to an LDAP server, used for one operation at a time.
+type conn struct {
+	nc      net.Conn
+	r       *bufio.Reader
+	timeout time.Duration
+	msgID   int64
+}
+
+// dialConfig holds the settings to connect to the server.
+type dialConfig struct {
+	url       *url.URL
+	startTLS  bool
+	tlsConfig *tls.Config
+	timeout   time.Duration
+}
+
+// dial connects to the server, negotiating TLS for ldaps URLs or if startTLS
+// is set.
+func dial(ctx context.Context, config dialConfig) (*conn, error) {
+	host := config.url.Host
+	if config.url.Port() == "" {
+		if config.url.Scheme == "ldaps" {
+			host = net.JoinHostPort(config.url.Hostname(), "636")
+		} else {
+			host = net.JoinHostPort(config.url.Hostname(), "389")
+		}
+	}
+
+	dialer := &net.Dialer{Timeout: config.timeout}
+	var (
+		nc  net.Conn
+		err error
+	)
+	if config.url.Scheme == "ldaps" {
+		nc, err = (&tls.Dialer{NetDialer: dialer, Config: config.tlsConfig}).DialContext(ctx, "tcp", host)
+	} else {
+		nc, err = dialer.DialContext(ctx, "tcp", host)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	c := &conn{nc: nc, r: bufio.NewReader(nc), timeout: config.timeout}
+	if config.startTLS && config.url.Scheme != "ldaps" {
+		if err := c.startTLS(ctx, config.tlsConfig); err != nil {
+			c.close()
+			return nil, err
+		}
+	}
+	return c, nil
+}
+
+// startTLS upgrades the connection to TLS with the StartTLS extended
+// operation.
+func (c *conn) startTLS(ctx context.Context, config *tls.Config) error {
+	responses, err := c.do(opExtendedRequest, constructed(classApplication, opExtendedRequest,
+		primitive(classContext, 0, []byte(startTLSOID))), opExtendedResponse)
+	if err != nil {
+		return err
+	}
+	if err := checkResult(responses[0]); err != nil {
+		return fmt.Errorf("StartTLS refused: %v", err)
+	}
+
+	tlsConn := tls.Client(c.nc, config)
+	if err := tlsConn.HandshakeContext(ctx); err != nil {
+		return err
+	}
+	c.nc, c.r = tlsConn, bufio.NewReader(tlsConn)
+	return nil
+}
+
+// bind authenticates the connection with a simple bind. An empty DN and
+// password bind anonymously.
+func (c *conn) bind(dn, password string) error {
+	responses, err := c.do(opBindRequest, constructed(classApplication, opBindRequest,
+		integer(tagInteger, protocolVersion),
+		octetString(dn),
+		primitive(classContext, authenticationSimple, []byte(password))), opBindResponse)
+	if err != nil {
+		return err
+	}
+	return checkResult(responses[0])
+}
+
+// search returns the entries under base matching the filter, with the given
+// attributes. At most sizeLimit entries are returned if it is positive.
+func (c *conn) search(base string, filter *packet, attributes []string, sizeLimit int64) ([]entry, error) {
+	attrs := sequence()
+	for _, attr := range attributes {
+		attrs.children = append(attrs.children, octetString(attr))
+	}
+	responses, err := c.do(opSearchRequest, constructed(classApplication, opSearchRequest,
+		octetString(base),
+		integer(tagEnumerated, scopeWholeSubtree),
+		integer(tagEnumerated, derefNever),
+		integer(tagInteger, sizeLimit),
+		integer(tagInteger, int64(c.timeout/time.Second)),
+		boolean(false),
+		filter,
+		attrs), opSearchResultDone)
+	if err != nil {
+		return nil, err
+	}
+
+	var entries []entry
+	for _, response := range responses {
+		switch {
+		case response.is(classApplication, opSearchResultEntry):
+			e, err := parseEntry(response)
+			if err != nil {
+				return nil, err
+			}
+			entries = append(entries, e)
+		case response.is(classApplication, opSearchResultDone):
+			if err := checkResult(response); err != nil {
+				return nil, err
+			}
+		}
+	}
+	return entries, nil
+}
+
+// close unbinds and closes the connection.
+func (c *conn) close() {
+	msg := sequence(integer(tagInteger, c.msgID+1), primitive(classApplication, opUnbindRequest, nil))
+	_ = c.nc.SetWriteDeadline(time.Now().Add(time.Second))
+	_, _ = c.nc.Write(msg.bytes())
+	_ = c.nc.Close()
+}
+
+// do sends a request, and reads the responses to it until the one of the
+// final operation.
+func (c *conn) do(op byte, request *packet, final byte) ([]*packet, error) {
+	c.msgID++
+	msg := sequence(integer(tagInteger, c.msgID), request)
+	if err := c.nc.SetDeadline(time.Now().Add(c.timeout)); err != nil {
+		return nil, err
+	}
+	if _, err := c.nc.Write(msg.bytes()); err != nil {
+		return nil, err
+	}
+
+	var responses []*packet
+	for {
+		response, err := readPacket(c.r)
+		if err != nil {
+			return nil, err
+		}
+		if !response.is(classUniversal, tagSequence) || len(response.children) < 2 {
+			return nil, errMalformedPacket
+		}
+		if id, err := response.children[0].int(); err != nil || id != c.msgID {
+			return nil, fmt.Errorf("unexpected response to ldap message %d", c.msgID)
+		}
+		operation := response.children[1]
+		if operation.class != classApplication {
+			return nil, errMalformedPacket
+		}
+		if operation.tag == opSearchResultRef {
+			// Referrals to other servers are not followed.
+			continue
+		}
+		responses = append(responses, operation)
+		if operation.tag == final {
+			return responses, nil
+		}
+		if op != opSearchRequest {
+			return nil, fmt.Errorf("unexpected ldap operation %d in response to %d", operation.tag, op)
+		}
+	}
+}
+
+// checkResult returns the error of an LDAPResult, nil if it is a success.
+func checkResult(result *packet) error {
+	if len(result.children) < 3 {
+		return errMalformedPacket
+	}
+	code, err := result.children[0].int()
+	if err != nil {
+		return err
+	}
+	switch code {
+	case resultSuccess:
+		return nil
+	case resultInvalidCredentials:
+		return errInvalidCredentials
+	default:
+		return resultError{code: code, message: result.children[2].str()}
+	}
+}
+
+func parseEntry(p *packet) (entry, error) {
+	if len(p.children) < 2 {
+		return entry{}, errMalformedPacket
+	}
+	e := entry{dn: p.children[0].str(), attributes: map[string][]string{}}
+	for _, attr := range p.children[1].children {
+		if len(attr.children) < 2 {
+			return entry{}, errMalformedPacket
+		}
+		name := attr.children[0].str()
+		for _, value := range attr.children[1].children {
+			e.attributes[name] = append(e.attributes[name], value.str())
+		}
+	}
+	return e, nil
+}
+
+// pool holds idle connections bound as the search user.
+type pool struct {
+	config   dialConfig
+	bindDN   string
+	password string
+	size     int
+
+	mu   sync.Mutex
+	idle []*conn
+}
+
+// get returns an idle connection, or a new one.
+func (p *pool) get(ctx context.Context) (*conn, error) {
+	p.mu.Lock()
+	if n := len(p.idle); n > 0 {
+		c := p.idle[n-1]
+		p.idle = p.idle[:n-1]
+		p.mu.Unlock()
+		return c, nil
+	}
+	p.mu.Unlock()
+
+	c, err := dial(ctx, p.config)
+	if err != nil {
+		return nil, err
+	}
+	if err := c.bind(p.bindDN, p.password); err != nil {
+		c.close()
+		return nil, fmt.Errorf("search bind failed: %v", err)
+	}
+	return c, nil
+}
+
+// put returns a connection bound as the search user to the pool.
+func (p *pool) put(c *conn) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if len(p.idle) >= p.size {
+		go c.close()
+		return
+	}
+	p.idle = append(p.idle, c)
+}
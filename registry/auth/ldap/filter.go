@@ -0,0 +1,132 @@
+package ldap
+
+import (
+	"encoding/hex"
+	"fmt"
+	"strings"
+)
+
+// Filter choices, see RFC 4511, section 4.5.1.
+const (
+	filterAnd      byte = 0
+	filterOr       byte = 1
+	filterNot      byte = 2
+	filterEquality byte = 3
+	filterPresent  byte = 7
+)
+
+// escapeFilter escapes a value to be inserted in a search filter, see
+// RFC 4515, section 3.
+func escapeFilter(s string) string {
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		switch c := s[i]; c {
+		case '*', '(', ')', '\\', 0:
+			fmt.Fprintf(&b, "\\%02x", c)
+		default:
+			b.WriteByte(c)
+		}
+	}
+	return b.String()
+}
+
+// compileFilter compiles the string representation of a search filter. Only
+// the and, or, not, equality and presence filters are supported.
+func compileFilter(filter string) (*packet, error) {
+	if !strings.HasPrefix(filter, "(") {
+		filter = "(" + filter + ")"
+	}
+	p, rest, err := parseFilter(filter)
+	if err != nil {
+		return nil, fmt.Errorf("invalid search filter %q: %v", filter, err)
+	}
+	if rest != "" {
+		return nil, fmt.Errorf("invalid search filter %q: trailing %q", filter, rest)
+	}
+	return p, nil
+}
+
+func parseFilter(s string) (*packet, string, error) {
+	if !strings.HasPrefix(s, "(") {
+		return nil, "", fmt.Errorf("expected ( at %q", s)
+	}
+	s = s[1:]
+	if s == "" {
+		return nil, "", fmt.Errorf("unterminated filter")
+	}
+
+	var p *packet
+	switch s[0] {
+	case '&', '|':
+		tag := filterAnd
+		if s[0] == '|' {
+			tag = filterOr
+		}
+		p = constructed(classContext, tag)
+		s = s[1:]
+		for strings.HasPrefix(s, "(") {
+			child, rest, err := parseFilter(s)
+			if err != nil {
+				return nil, "", err
+			}
+			p.children = append(p.children, child)
+			s = rest
+		}
+		if len(p.children) == 0 {
+			return nil, "", fmt.Errorf("empty filter list")
+		}
+	case '!':
+		child, rest, err := parseFilter(s[1:])
+		if err != nil {
+			return nil, "", err
+		}
+		p, s = constructed(classContext, filterNot, child), rest
+	default:
+		end := strings.IndexByte(s, ')')
+		if end < 0 {
+			return nil, "", fmt.Errorf("unterminated filter")
+		}
+		attr, value, ok := strings.Cut(s[:end], "=")
+		if !ok || attr == "" || strings.ContainsAny(attr, "~<>:") {
+			return nil, "", fmt.Errorf("unsupported filter item %q", s[:end])
+		}
+		s = s[end:]
+		if value == "*" {
+			p = primitive(classContext, filterPresent, []byte(attr))
+			break
+		}
+		if strings.Contains(value, "*") {
+			return nil, "", fmt.Errorf("substring filters are not supported: %q", value)
+		}
+		unescaped, err := unescapeFilter(value)
+		if err != nil {
+			return nil, "", err
+		}
+		p = constructed(classContext, filterEquality, octetString(attr), octetString(unescaped))
+	}
+
+	if !strings.HasPrefix(s, ")") {
+		return nil, "", fmt.Errorf("expected ) at %q", s)
+	}
+	return p, s[1:], nil
+}
+
+func unescapeFilter(s string) (string, error) {
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		if s[i] != '\\' {
+			b.WriteByte(s[i])
+			continue
+		}
+		if i+3 > len(s) {
+			return "", fmt.Errorf("invalid escape in %q", s)
+		}
+		c, err := hex.DecodeString(s[i+1 : i+3])
+		if err != nil {
+			return "", fmt.Errorf("invalid escape in %q", s)
+		}
+		b.Write(c)
+		i += 2
+	}
+	return b.String(), nil
+}
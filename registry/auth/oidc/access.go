@@ -0,0 +1,332 @@
+// Package oidc provides an access controller which authenticates requests with
+// bearer tokens issued by an OpenID Connect provider, and grants access to
+// repositories from the claims of the tokens.
+//
+// The signing keys of the issuer are found through OpenID Connect discovery,
+// cached, and refreshed periodically and when a token is signed by an unknown
+// key. Access is granted by rules matching a claim value, such as a group of
+// the user, to a set of actions on the repositories matching glob patterns.
+package oidc
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"path"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/distribution/distribution/v3/registry/auth"
+	"github.com/go-jose/go-jose/v4"
+	"github.com/go-jose/go-jose/v4/jwt"
+	"github.com/mitchellh/mapstructure"
+	"github.com/sirupsen/logrus"
+)
+
+// init registers the oidc auth backend.
+func init() {
+	if err := auth.Register("oidc", auth.InitFunc(newAccessController)); err != nil {
+		logrus.Errorf("failed to register oidc auth: %v", err)
+	}
+}
+
+const (
+	defaultLeeway       = time.Minute
+	defaultKeyRefresh   = 5 * time.Minute
+	defaultUserClaim    = "sub"
+	defaultFetchTimeout = 30 * time.Second
+)
+
+// signingAlgorithms are the asymmetric algorithms accepted for the signature
+// of tokens. Symmetric algorithms cannot be used with the public keys of an
+// OpenID provider.
+var signingAlgorithms = []jose.SignatureAlgorithm{
+	jose.EdDSA,
+	jose.RS256,
+	jose.RS384,
+	jose.RS512,
+	jose.ES256,
+	jose.ES384,
+	jose.ES512,
+	jose.PS256,
+	jose.PS384,
+	jose.PS512,
+}
+
+// Errors used by the oidc access controller.
+var (
+	ErrTokenRequired     = errors.New("authorization token required")
+	ErrInvalidToken      = errors.New("invalid token")
+	ErrInsufficientScope = errors.New("insufficient scope")
+)
+
+// Rule grants actions on the repositories matching any of a list of glob
+// patterns to the tokens whose claim holds a value.
+type Rule struct {
+	// Claim is the name of the claim, such as groups.
+	Claim string `mapstructure:"claim"`
+	// Value is the value the claim must be, or contain if it is a list.
+	Value string `mapstructure:"value"`
+	// Repositories are the glob patterns of the repository names.
+	Repositories []string `mapstructure:"repositories"`
+	// Actions are the granted actions, such as pull, push or delete. The
+	// * action grants every action.
+	Actions []string `mapstructure:"actions"`
+}
+
+// matches returns whether the claims satisfy the rule.
+func (r Rule) matches(claims map[string]any) bool {
+	switch v := claims[r.Claim].(type) {
+	case string:
+		return v == r.Value
+	case []any:
+		for _, e := range v {
+			if s, ok := e.(string); ok && s == r.Value {
+				return true
+			}
+		}
+	case nil:
+	default:
+		return fmt.Sprint(v) == r.Value
+	}
+	return false
+}
+
+// grants returns whether the rule grants the access.
+func (r Rule) grants(access auth.Access) bool {
+	if access.Type != "repository" {
+		return false
+	}
+	if !slices.Contains(r.Actions, access.Action) && !slices.Contains(r.Actions, "*") {
+		return false
+	}
+	for _, pattern := range r.Repositories {
+		if ok, _ := path.Match(pattern, access.Name); ok {
+			return true
+		}
+	}
+	return false
+}
+
+// options are the options of the oidc access controller.
+type options struct {
+	Issuer     string        `mapstructure:"issuer"`
+	Audience   string        `mapstructure:"audience"`
+	UserClaim  string        `mapstructure:"userclaim"`
+	Leeway     time.Duration `mapstructure:"leeway"`
+	KeyRefresh time.Duration `mapstructure:"keyrefresh"`
+	Rules      []Rule        `mapstructure:"rules"`
+}
+
+func parseOptions(parameters map[string]any) (options, error) {
+	opts := options{
+		UserClaim:  defaultUserClaim,
+		Leeway:     defaultLeeway,
+		KeyRefresh: defaultKeyRefresh,
+	}
+	decoder, err := mapstructure.NewDecoder(&mapstructure.DecoderConfig{
+		DecodeHook: mapstructure.StringToTimeDurationHookFunc(),
+		Result:     &opts,
+	})
+	if err != nil {
+		return options{}, err
+	}
+	if err := decoder.Decode(parameters); err != nil {
+		return options{}, fmt.Errorf("invalid oidc auth options: %v", err)
+	}
+
+	if opts.Issuer == "" {
+		return options{}, errors.New(`"issuer" must be set for oidc access controller`)
+	}
+	if opts.Audience == "" {
+		return options{}, errors.New(`"audience" must be set for oidc access controller`)
+	}
+	if opts.Leeway < 0 {
+		return options{}, errors.New(`"leeway" must not be negative for oidc access controller`)
+	}
+	if opts.KeyRefresh <= 0 {
+		return options{}, errors.New(`"keyrefresh" must be positive for oidc access controller`)
+	}
+	for i, rule := range opts.Rules {
+		if rule.Claim == "" || len(rule.Repositories) == 0 || len(rule.Actions) == 0 {
+			return options{}, fmt.Errorf("oidc rule %d requires a claim, repositories and actions", i)
+		}
+		for _, pattern := range rule.Repositories {
+			if _, err := path.Match(pattern, ""); err != nil {
+				return options{}, fmt.Errorf("oidc rule %d has an invalid repository pattern %q: %v", i, pattern, err)
+			}
+		}
+	}
+	return opts, nil
+}
+
+// accessController implements auth.AccessController with tokens of an
+// OpenID Connect issuer.
+type accessController struct {
+	issuer    string
+	audience  string
+	userClaim string
+	leeway    time.Duration
+	rules     []Rule
+	keys      *keySet
+}
+
+var _ auth.AccessController = &accessController{}
+
+func newAccessController(parameters map[string]any) (auth.AccessController, error) {
+	opts, err := parseOptions(parameters)
+	if err != nil {
+		return nil, err
+	}
+
+	keys := newKeySet(opts.Issuer, &http.Client{Timeout: defaultFetchTimeout}, signingAlgorithms)
+	if err := keys.refresh(context.Background()); err != nil {
+		return nil, err
+	}
+	go keys.run(opts.KeyRefresh)
+
+	return &accessController{
+		issuer:    opts.Issuer,
+		audience:  opts.Audience,
+		userClaim: opts.UserClaim,
+		leeway:    opts.Leeway,
+		rules:     opts.Rules,
+		keys:      keys,
+	}, nil
+}
+
+// Authorized validates the bearer token of the request, and checks that the
+// rules grant all the access items to its claims.
+func (ac *accessController) Authorized(req *http.Request, accessItems ...auth.Access) (*auth.Grant, error) {
+	challenge := &challenge{
+		realm:   ac.issuer,
+		service: ac.audience,
+		access:  accessItems,
+	}
+
+	prefix, rawToken, ok := strings.Cut(req.Header.Get("Authorization"), " ")
+	if !ok || rawToken == "" || !strings.EqualFold(prefix, "bearer") {
+		challenge.err = ErrTokenRequired
+		return nil, challenge
+	}
+
+	claims, err := ac.verify(req.Context(), rawToken)
+	if err != nil {
+		logrus.Infof("oidc auth: failed to verify token: %v", err)
+		challenge.err = ErrInvalidToken
+		return nil, challenge
+	}
+
+	resources := make([]auth.Resource, 0, len(accessItems))
+	for _, access := range accessItems {
+		if !ac.granted(claims, access) {
+			challenge.err = ErrInsufficientScope
+			return nil, challenge
+		}
+		resources = append(resources, access.Resource)
+	}
+
+	user, _ := claims[ac.userClaim].(string)
+	return &auth.Grant{
+		User:      auth.UserInfo{Name: user},
+		Resources: resources,
+	}, nil
+}
+
+// Check implements health.Checker. It fails if the last fetch of the keys of
+// the issuer failed.
+func (ac *accessController) Check(ctx context.Context) error {
+	return ac.keys.Check(ctx)
+}
+
+// verify checks the signature, issuer, audience and validity period of the
+// token, and returns its claims.
+func (ac *accessController) verify(ctx context.Context, rawToken string) (map[string]any, error) {
+	token, err := jwt.ParseSigned(rawToken, signingAlgorithms)
+	if err != nil {
+		return nil, err
+	}
+	if len(token.Headers) != 1 {
+		return nil, errors.New("token must have a single signature")
+	}
+
+	keys := ac.keys.refreshUnknown(ctx, token.Headers[0].KeyID)
+	if len(keys) == 0 {
+		return nil, fmt.Errorf("token signed by unknown key %q", token.Headers[0].KeyID)
+	}
+
+	var (
+		standard jwt.Claims
+		claims   map[string]any
+	)
+	err = errors.New("no key verifies the token")
+	for _, key := range keys {
+		if err = token.Claims(key, &standard, &claims); err == nil {
+			break
+		}
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	if standard.Expiry == nil {
+		return nil, errors.New("token has no expiry")
+	}
+	expected := jwt.Expected{
+		Issuer:      ac.issuer,
+		AnyAudience: jwt.Audience{ac.audience},
+		Time:        time.Now(),
+	}
+	if err := standard.ValidateWithLeeway(expected, ac.leeway); err != nil {
+		return nil, err
+	}
+	return claims, nil
+}
+
+// granted returns whether any rule grants the access to the claims.
+func (ac *accessController) granted(claims map[string]any, access auth.Access) bool {
+	for _, rule := range ac.rules {
+		if rule.matches(claims) && rule.grants(access) {
+			return true
+		}
+	}
+	return false
+}
+
+// challenge implements auth.Challenge, pointing clients to the issuer.
+type challenge struct {
+	realm   string
+	service string
+	access  []auth.Access
+	err     error
+}
+
+var _ auth.Challenge = challenge{}
+
+// SetHeaders sets a bearer challenge whose realm is the issuer.
+func (ch challenge) SetHeaders(r *http.Request, w http.ResponseWriter) {
+	header := fmt.Sprintf("Bearer realm=%q,service=%q", ch.realm, ch.service)
+
+	if len(ch.access) > 0 {
+		scopes := make([]string, 0, len(ch.access))
+		for _, access := range ch.access {
+			scopes = append(scopes, fmt.Sprintf("%s:%s:%s", access.Type, access.Name, access.Action))
+		}
+		header = fmt.Sprintf("%s,scope=%q", header, strings.Join(scopes, " "))
+	}
+
+	switch ch.err {
+	case ErrInvalidToken:
+		header = fmt.Sprintf("%s,error=%q", header, "invalid_token")
+	case ErrInsufficientScope:
+		header = fmt.Sprintf("%s,error=%q", header, "insufficient_scope")
+	}
+
+	w.Header().Set("WWW-Authenticate", header)
+}
+
+func (ch challenge) Error() string {
+	return ch.err.Error()
+}
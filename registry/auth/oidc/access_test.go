@@ -0,0 +1,298 @@
+package oidc
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/distribution/distribution/v3/registry/auth"
+	"github.com/go-jose/go-jose/v4"
+	"github.com/go-jose/go-jose/v4/jwt"
+)
+
+const testAudience = "registry.example.com"
+
+// fakeIssuer is an OpenID provider serving discovery and a key set, and
+// signing tokens.
+type fakeIssuer struct {
+	*httptest.Server
+
+	mu   sync.Mutex
+	keys []*jose.JSONWebKey
+}
+
+func newFakeIssuer(t *testing.T) *fakeIssuer {
+	issuer := &fakeIssuer{}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/.well-known/openid-configuration", func(w http.ResponseWriter, r *http.Request) {
+		_ = json.NewEncoder(w).Encode(discovery{Issuer: issuer.URL, JWKSURI: issuer.URL + "/keys"})
+	})
+	mux.HandleFunc("/keys", func(w http.ResponseWriter, r *http.Request) {
+		issuer.mu.Lock()
+		defer issuer.mu.Unlock()
+		var jwks jose.JSONWebKeySet
+		for _, key := range issuer.keys {
+			jwks.Keys = append(jwks.Keys, key.Public())
+		}
+		_ = json.NewEncoder(w).Encode(jwks)
+	})
+	issuer.Server = httptest.NewServer(mux)
+	t.Cleanup(issuer.Close)
+	issuer.rotate(t)
+	return issuer
+}
+
+// rotate adds a signing key, used for the next tokens.
+func (issuer *fakeIssuer) rotate(t *testing.T) {
+	pk, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	issuer.mu.Lock()
+	defer issuer.mu.Unlock()
+	issuer.keys = append(issuer.keys, &jose.JSONWebKey{
+		Key:       pk,
+		KeyID:     pk.X.String(),
+		Algorithm: string(jose.ES256),
+		Use:       "sig",
+	})
+}
+
+// sign returns a token of the claims signed by the last key of the issuer.
+func (issuer *fakeIssuer) sign(t *testing.T, claims map[string]any) string {
+	issuer.mu.Lock()
+	key := issuer.keys[len(issuer.keys)-1]
+	issuer.mu.Unlock()
+	signer, err := jose.NewSigner(jose.SigningKey{Algorithm: jose.ES256, Key: key}, (&jose.SignerOptions{}).WithType("JWT"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	token, err := jwt.Signed(signer).Claims(claims).Serialize()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return token
+}
+
+// claims returns valid claims of a member of the groups.
+func (issuer *fakeIssuer) claims(groups ...string) map[string]any {
+	now := time.Now()
+	return map[string]any{
+		"iss":    issuer.URL,
+		"sub":    "alice",
+		"aud":    testAudience,
+		"iat":    now.Unix(),
+		"nbf":    now.Unix(),
+		"exp":    now.Add(time.Hour).Unix(),
+		"groups": groups,
+	}
+}
+
+func newTestAccessController(t *testing.T, issuer *fakeIssuer) *accessController {
+	ac, err := newAccessController(map[string]any{
+		"issuer":   issuer.URL,
+		"audience": testAudience,
+		"leeway":   "30s",
+		"rules": []any{
+			map[any]any{
+				"claim":        "groups",
+				"value":        "team-a",
+				"repositories": []any{"team/*"},
+				"actions":      []any{"pull"},
+			},
+			map[any]any{
+				"claim":        "groups",
+				"value":        "team-a-admins",
+				"repositories": []any{"team/*"},
+				"actions":      []any{"*"},
+			},
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return ac.(*accessController)
+}
+
+func authorize(ac auth.AccessController, token string, access ...auth.Access) (*auth.Grant, *http.Request, error) {
+	req := httptest.NewRequest(http.MethodGet, "/v2/", nil)
+	if token != "" {
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+	grant, err := ac.Authorized(req, access...)
+	return grant, req, err
+}
+
+func repositoryAccess(name, action string) auth.Access {
+	return auth.Access{Resource: auth.Resource{Type: "repository", Name: name}, Action: action}
+}
+
+func TestAccessController(t *testing.T) {
+	issuer := newFakeIssuer(t)
+	ac := newTestAccessController(t, issuer)
+
+	for _, tc := range []struct {
+		name   string
+		claims func(map[string]any)
+		groups []string
+		access []auth.Access
+		err    error
+	}{
+		{
+			name:   "allowed",
+			groups: []string{"team-a"},
+			access: []auth.Access{repositoryAccess("team/app", "pull")},
+		},
+		{
+			name:   "wildcard action",
+			groups: []string{"other", "team-a-admins"},
+			access: []auth.Access{repositoryAccess("team/app", "pull"), repositoryAccess("team/app", "push")},
+		},
+		{
+			name:   "denied action",
+			groups: []string{"team-a"},
+			access: []auth.Access{repositoryAccess("team/app", "pull"), repositoryAccess("team/app", "push")},
+			err:    ErrInsufficientScope,
+		},
+		{
+			name:   "denied repository",
+			groups: []string{"team-a"},
+			access: []auth.Access{repositoryAccess("other/app", "pull")},
+			err:    ErrInsufficientScope,
+		},
+		{
+			name:   "denied group",
+			groups: []string{"team-b"},
+			access: []auth.Access{repositoryAccess("team/app", "pull")},
+			err:    ErrInsufficientScope,
+		},
+		{
+			name:   "denied catalog",
+			groups: []string{"team-a-admins"},
+			access: []auth.Access{{Resource: auth.Resource{Type: "registry", Name: "catalog"}, Action: "*"}},
+			err:    ErrInsufficientScope,
+		},
+		{
+			name:   "expired",
+			claims: func(c map[string]any) { c["exp"] = time.Now().Add(-time.Minute).Unix() },
+			groups: []string{"team-a"},
+			access: []auth.Access{repositoryAccess("team/app", "pull")},
+			err:    ErrInvalidToken,
+		},
+		{
+			name:   "expired within leeway",
+			claims: func(c map[string]any) { c["exp"] = time.Now().Add(-10 * time.Second).Unix() },
+			groups: []string{"team-a"},
+			access: []auth.Access{repositoryAccess("team/app", "pull")},
+		},
+		{
+			name:   "no expiry",
+			claims: func(c map[string]any) { delete(c, "exp") },
+			groups: []string{"team-a"},
+			access: []auth.Access{repositoryAccess("team/app", "pull")},
+			err:    ErrInvalidToken,
+		},
+		{
+			name:   "wrong audience",
+			claims: func(c map[string]any) { c["aud"] = "other.example.com" },
+			groups: []string{"team-a"},
+			access: []auth.Access{repositoryAccess("team/app", "pull")},
+			err:    ErrInvalidToken,
+		},
+		{
+			name:   "wrong issuer",
+			claims: func(c map[string]any) { c["iss"] = "https://other.example.com" },
+			groups: []string{"team-a"},
+			access: []auth.Access{repositoryAccess("team/app", "pull")},
+			err:    ErrInvalidToken,
+		},
+	} {
+		claims := issuer.claims(tc.groups...)
+		if tc.claims != nil {
+			tc.claims(claims)
+		}
+		grant, req, err := authorize(ac, issuer.sign(t, claims), tc.access...)
+		if tc.err == nil {
+			if err != nil {
+				t.Errorf("%s: unexpected error: %v", tc.name, err)
+			} else if grant.User.Name != "alice" || len(grant.Resources) != len(tc.access) {
+				t.Errorf("%s: unexpected grant: %#v", tc.name, grant)
+			}
+			continue
+		}
+		ch, ok := err.(auth.Challenge)
+		if !ok || err.Error() != tc.err.Error() {
+			t.Errorf("%s: expected a challenge for %v, got %v", tc.name, tc.err, err)
+			continue
+		}
+		w := httptest.NewRecorder()
+		ch.SetHeaders(req, w)
+		if header := w.Header().Get("WWW-Authenticate"); !strings.HasPrefix(header, `Bearer realm="`+issuer.URL+`"`) {
+			t.Errorf("%s: the challenge does not advertise the issuer: %s", tc.name, header)
+		}
+	}
+}
+
+func TestAccessControllerTokenRequired(t *testing.T) {
+	issuer := newFakeIssuer(t)
+	ac := newTestAccessController(t, issuer)
+
+	_, req, err := authorize(ac, "", repositoryAccess("team/app", "pull"))
+	ch, ok := err.(auth.Challenge)
+	if !ok || err.Error() != ErrTokenRequired.Error() {
+		t.Fatalf("expected a challenge for %v, got %v", ErrTokenRequired, err)
+	}
+	w := httptest.NewRecorder()
+	ch.SetHeaders(req, w)
+	expected := `Bearer realm="` + issuer.URL + `",service="` + testAudience + `",scope="repository:team/app:pull"`
+	if header := w.Header().Get("WWW-Authenticate"); header != expected {
+		t.Fatalf("unexpected challenge %s, expected %s", header, expected)
+	}
+}
+
+func TestAccessControllerKeyRotation(t *testing.T) {
+	issuer := newFakeIssuer(t)
+	ac := newTestAccessController(t, issuer)
+	access := repositoryAccess("team/app", "pull")
+
+	// A token signed by a key rotated in after the last fetch is accepted
+	// once the keys may be refreshed.
+	issuer.rotate(t)
+	token := issuer.sign(t, issuer.claims("team-a"))
+	if _, _, err := authorize(ac, token, access); err == nil {
+		t.Fatal("expected the refresh to be rate limited")
+	}
+	ac.keys.minRefresh = 0
+	if _, _, err := authorize(ac, token, access); err != nil {
+		t.Fatalf("token signed by a rotated key was not authorized: %v", err)
+	}
+}
+
+func TestParseOptions(t *testing.T) {
+	for name, parameters := range map[string]map[string]any{
+		"no issuer":       {"audience": testAudience},
+		"no audience":     {"issuer": "https://issuer.example.com"},
+		"invalid leeway":  {"issuer": "https://issuer.example.com", "audience": testAudience, "leeway": "soon"},
+		"invalid pattern": {"issuer": "https://issuer.example.com", "audience": testAudience, "rules": []any{map[any]any{"claim": "groups", "repositories": []any{"["}, "actions": []any{"pull"}}}},
+		"no actions":      {"issuer": "https://issuer.example.com", "audience": testAudience, "rules": []any{map[any]any{"claim": "groups", "repositories": []any{"team/*"}}}},
+	} {
+		if _, err := parseOptions(parameters); err == nil {
+			t.Errorf("%s: expected an error", name)
+		}
+	}
+
+	opts, err := parseOptions(map[string]any{"issuer": "https://issuer.example.com", "audience": testAudience})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if opts.Leeway != defaultLeeway || opts.KeyRefresh != defaultKeyRefresh || opts.UserClaim != defaultUserClaim {
+		t.Fatalf("unexpected default options: %#v", opts)
+	}
+}
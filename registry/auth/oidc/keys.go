@@ -0,0 +1,204 @@
+package oidc
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/go-jose/go-jose/v4"
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	// minKeyRefresh is the minimum interval between two fetches of the
+	// issuer keys triggered by tokens signed by unknown keys.
+	minKeyRefresh = 10 * time.Second
+
+	// maxDocumentSize is the maximum size of the discovery document and of
+	// the key set of the issuer.
+	maxDocumentSize = 1 << 20
+)
+
+// discovery is the part of the OpenID Provider configuration of an issuer
+// used by the access controller.
+type discovery struct {
+	Issuer  string `json:"issuer"`
+	JWKSURI string `json:"jwks_uri"`
+}
+
+// keySet caches the signing keys of an issuer, found through OpenID Connect
+// discovery. It is refreshed periodically, and when a token is signed by a
+// key it does not know. A failed fetch keeps the last good keys.
+type keySet struct {
+	issuer     string
+	client     *http.Client
+	algorithms []jose.SignatureAlgorithm
+	// minRefresh is the minimum interval between two fetches triggered by
+	// unknown keys.
+	minRefresh time.Duration
+
+	mu        sync.RWMutex
+	jwksURI   string
+	keys      []jose.JSONWebKey
+	lastFetch time.Time
+	err       error
+}
+
+func newKeySet(issuer string, client *http.Client, algorithms []jose.SignatureAlgorithm) *keySet {
+	return &keySet{
+		issuer:     issuer,
+		client:     client,
+		algorithms: algorithms,
+		minRefresh: minKeyRefresh,
+	}
+}
+
+// lookup returns the keys which may have signed a token with the given key
+// ID: the key with this ID, or every key if the token does not name one.
+func (ks *keySet) lookup(keyID string) []jose.JSONWebKey {
+	ks.mu.RLock()
+	defer ks.mu.RUnlock()
+	if keyID == "" {
+		return ks.keys
+	}
+	for _, key := range ks.keys {
+		if key.KeyID == keyID {
+			return []jose.JSONWebKey{key}
+		}
+	}
+	return nil
+}
+
+// refresh fetches the keys of the issuer, recording the outcome for the
+// health check.
+func (ks *keySet) refresh(ctx context.Context) error {
+	ks.mu.Lock()
+	defer ks.mu.Unlock()
+	return ks.refreshLocked(ctx)
+}
+
+func (ks *keySet) refreshLocked(ctx context.Context) error {
+	ks.lastFetch = time.Now()
+	ks.err = ks.fetch(ctx)
+	if ks.err != nil {
+		logrus.Errorf("oidc auth: keeping the last good keys of %s: %v", ks.issuer, ks.err)
+	}
+	return ks.err
+}
+
+// refreshUnknown refreshes the keys if none has the given ID, unless they
+// were fetched less than minRefresh ago. It returns the keys with the ID.
+func (ks *keySet) refreshUnknown(ctx context.Context, keyID string) []jose.JSONWebKey {
+	if keys := ks.lookup(keyID); len(keys) != 0 || keyID == "" {
+		return keys
+	}
+	ks.mu.Lock()
+	if time.Since(ks.lastFetch) >= ks.minRefresh {
+		_ = ks.refreshLocked(ctx)
+	}
+	ks.mu.Unlock()
+	return ks.lookup(keyID)
+}
+
+// run refreshes the keys at every interval, forever.
+func (ks *keySet) run(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for range ticker.C {
+		_ = ks.refresh(context.Background())
+	}
+}
+
+// Check implements health.Checker, failing if the last fetch failed.
+func (ks *keySet) Check(context.Context) error {
+	ks.mu.RLock()
+	defer ks.mu.RUnlock()
+	return ks.err
+}
+
+// fetch discovers the key set URL of the issuer, if not known yet, and
+// fetches the key set. Keys which cannot verify tokens are ignored.
+func (ks *keySet) fetch(ctx context.Context) error {
+	if ks.jwksURI == "" {
+		var d discovery
+		if err := ks.get(ctx, strings.TrimSuffix(ks.issuer, "/")+"/.well-known/openid-configuration", &d); err != nil {
+			return err
+		}
+		if d.Issuer != ks.issuer {
+			return fmt.Errorf("discovery document of %s is for issuer %q", ks.issuer, d.Issuer)
+		}
+		if d.JWKSURI == "" {
+			return fmt.Errorf("discovery document of %s has no jwks_uri", ks.issuer)
+		}
+		ks.jwksURI = d.JWKSURI
+	}
+
+	var jwks jose.JSONWebKeySet
+	if err := ks.get(ctx, ks.jwksURI, &jwks); err != nil {
+		return err
+	}
+	keys := make([]jose.JSONWebKey, 0, len(jwks.Keys))
+	for _, key := range jwks.Keys {
+		if err := ks.validate(key); err != nil {
+			logrus.Warnf("oidc auth: ignoring key of %s: %v", ks.jwksURI, err)
+			continue
+		}
+		keys = append(keys, key.Public())
+	}
+	if len(keys) == 0 {
+		return fmt.Errorf("key set %s holds no valid signing key", ks.jwksURI)
+	}
+	ks.keys = keys
+	return nil
+}
+
+// validate checks that a key can verify tokens: it must be a valid public
+// key meant for signatures, using one of the accepted signing algorithms.
+func (ks *keySet) validate(key jose.JSONWebKey) error {
+	if !key.Valid() {
+		return fmt.Errorf("key %q is invalid", key.KeyID)
+	}
+	if key.Use != "" && key.Use != "sig" {
+		return fmt.Errorf("key %q is not a signing key: use %q", key.KeyID, key.Use)
+	}
+	if key.Algorithm != "" && !slices.Contains(ks.algorithms, jose.SignatureAlgorithm(key.Algorithm)) {
+		return fmt.Errorf("key %q uses a signing algorithm which is not accepted: %s", key.KeyID, key.Algorithm)
+	}
+	if public := key.Public(); public.Key == nil {
+		return fmt.Errorf("key %q is not an asymmetric key", key.KeyID)
+	}
+	return nil
+}
+
+func (ks *keySet) get(ctx context.Context, url string, v any) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	if err != nil {
+		return fmt.Errorf("unable to fetch %s: %v", url, err)
+	}
+	req.Header.Set("Accept", "application/json")
+	resp, err := ks.client.Do(req)
+	if err != nil {
+		return fmt.Errorf("unable to fetch %s: %v", url, err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("unable to fetch %s: unexpected status %s", url, resp.Status)
+	}
+	body, err := io.ReadAll(io.LimitReader(resp.Body, maxDocumentSize+1))
+	if err != nil {
+		return fmt.Errorf("unable to read %s: %v", url, err)
+	}
+	if len(body) > maxDocumentSize {
+		return fmt.Errorf("%s exceeds %d bytes", url, maxDocumentSize)
+	}
+	if err := json.Unmarshal(body, v); err != nil {
+		return fmt.Errorf("failed to parse %s: %v", url, err)
+	}
+	return nil
+}
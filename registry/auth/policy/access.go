@@ -0,0 +1,269 @@
+// Package policy provides an access controller which authorizes the users of
+// another access controller, such as htpasswd or token, with a policy file
+// mapping users and groups to actions on repository patterns.
+//
+// The other access controller only authenticates the requests. The policy
+// file is polled for changes, and reloaded on SIGHUP. A file which cannot be
+// parsed is rejected, keeping the previous policy.
+package policy
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"os/signal"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
+
+	"github.com/distribution/distribution/v3/internal/dcontext"
+	"github.com/distribution/distribution/v3/registry/auth"
+	"github.com/sirupsen/logrus"
+)
+
+func init() {
+	if err := auth.Register("policy", auth.InitFunc(newAccessController)); err != nil {
+		logrus.Errorf("failed to register policy auth: %v", err)
+	}
+}
+
+// defaultReloadInterval is the interval at which the policy file is checked
+// for changes, unless set by the reloadinterval option.
+const defaultReloadInterval = 5 * time.Second
+
+// ErrAccessDenied is returned when the policy does not grant the access.
+var ErrAccessDenied = errors.New("access denied by policy")
+
+type accessController struct {
+	path string
+	// source authenticates the requests.
+	source auth.AccessController
+
+	// mu serializes reloads, and guards modtime and size, which identify
+	// the version of the file last loaded.
+	mu      sync.Mutex
+	modtime time.Time
+	size    int64
+	// policy is swapped as a whole on reload.
+	policy atomic.Pointer[policy]
+	// hup receives SIGHUP, forcing a reload.
+	hup chan os.Signal
+	// stop is closed by Close, stopping the polling of the file.
+	stop      chan struct{}
+	closeOnce sync.Once
+}
+
+var (
+	_ auth.AccessController = &accessController{}
+	_ auth.Closer           = &accessController{}
+)
+
+func newAccessController(options map[string]any) (auth.AccessController, error) {
+	path, ok := options["path"].(string)
+	if !ok || path == "" {
+		return nil, fmt.Errorf(`"path" must be set for policy access controller`)
+	}
+
+	reloadInterval := defaultReloadInterval
+	if intervalOpt, present := options["reloadinterval"]; present {
+		interval, ok := intervalOpt.(string)
+		if !ok {
+			return nil, fmt.Errorf(`"reloadinterval" must be a duration for policy access controller`)
+		}
+		d, err := time.ParseDuration(interval)
+		if err != nil || d <= 0 {
+			return nil, fmt.Errorf(`"reloadinterval" must be a positive duration for policy access controller: %q`, interval)
+		}
+		reloadInterval = d
+	}
+
+	sourceType, sourceOptions, err := sourceOf(options["authentication"])
+	if err != nil {
+		return nil, err
+	}
+	if sourceType == "policy" {
+		return nil, fmt.Errorf("policy access controller cannot authenticate with itself")
+	}
+	source, err := auth.GetAccessController(sourceType, sourceOptions)
+	if err != nil {
+		return nil, fmt.Errorf("unable to configure %s authentication of policy access controller: %v", sourceType, err)
+	}
+
+	ac := &accessController{
+		path:   path,
+		source: source,
+		hup:    make(chan os.Signal, 1),
+		stop:   make(chan struct{}),
+	}
+	if err := ac.reload(true); err != nil {
+		return nil, err
+	}
+	signal.Notify(ac.hup, syscall.SIGHUP)
+	go ac.watch(reloadInterval)
+	return ac, nil
+}
+
+// sourceOf returns the type and options of the authentication option, a map
+// with a single key, the type of the access controller, like the auth section
+// of the configuration.
+func sourceOf(opt any) (string, map[string]any, error) {
+	var sources map[string]any
+	switch v := opt.(type) {
+	case map[string]any:
+		sources = v
+	case map[any]any:
+		sources = toStringMap(v)
+	}
+	if len(sources) != 1 {
+		return "", nil, fmt.Errorf(`"authentication" must configure one access controller for policy access controller`)
+	}
+	for sourceType, sourceOpts := range sources {
+		switch v := sourceOpts.(type) {
+		case nil:
+			return sourceType, map[string]any{}, nil
+		case map[string]any:
+			return sourceType, v, nil
+		case map[any]any:
+			return sourceType, toStringMap(v), nil
+		default:
+			return "", nil, fmt.Errorf(`"authentication.%s" must be a map for policy access controller`, sourceType)
+		}
+	}
+	panic("unreachable")
+}
+
+func toStringMap(m map[any]any) map[string]any {
+	sm := make(map[string]any, len(m))
+	for k, v := range m {
+		sm[fmt.Sprint(k)] = v
+	}
+	return sm
+}
+
+// watch reloads the policy file when it changes, checking every interval,
+// and on SIGHUP, until the access controller is closed.
+func (ac *accessController) watch(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		var force bool
+		select {
+		case <-ticker.C:
+		case <-ac.hup:
+			force = true
+		case <-ac.stop:
+			return
+		}
+		if err := ac.reload(force); err != nil {
+			logrus.Errorf("policy: keeping the previous policy: %v", err)
+		}
+	}
+}
+
+// Close stops the polling of the policy file and closes the access
+// controller authenticating the requests, if it implements auth.Closer.
+func (ac *accessController) Close() error {
+	ac.closeOnce.Do(func() {
+		signal.Stop(ac.hup)
+		close(ac.stop)
+	})
+	if closer, ok := ac.source.(auth.Closer); ok {
+		return closer.Close()
+	}
+	return nil
+}
+
+// reload parses the policy file and swaps it in if it changed since it was
+// last loaded, or if force is set. The previous policy is kept if the file
+// cannot be read or parsed.
+func (ac *accessController) reload(force bool) error {
+	ac.mu.Lock()
+	defer ac.mu.Unlock()
+
+	fstat, err := os.Stat(ac.path)
+	if err != nil {
+		return err
+	}
+	if !force && fstat.ModTime().Equal(ac.modtime) && fstat.Size() == ac.size {
+		return nil
+	}
+	// The file is not retried until it changes again.
+	ac.modtime, ac.size = fstat.ModTime(), fstat.Size()
+
+	b, err := os.ReadFile(ac.path)
+	if err != nil {
+		return err
+	}
+	p, err := parsePolicy(b)
+	if err != nil {
+		return fmt.Errorf("invalid policy file %s: %v", ac.path, err)
+	}
+	ac.policy.Store(p)
+	if !force {
+		logrus.Infof("policy: reloaded %s", ac.path)
+	}
+	return nil
+}
+
+// Authorized authenticates the request with the authentication access
+// controller, unless it has no credentials, and checks that the policy grants
+// all the access items to the user, or to anonymous requests.
+func (ac *accessController) Authorized(req *http.Request, accessItems ...auth.Access) (*auth.Grant, error) {
+	var user auth.UserInfo
+	if req.Header.Get("Authorization") != "" {
+		grant, err := ac.source.Authorized(req)
+		if err != nil {
+			return nil, err
+		}
+		if grant.User.Name == "" {
+			return nil, fmt.Errorf("policy: authentication returned no user")
+		}
+		user = grant.User
+	}
+
+	p := ac.policy.Load()
+	resources := make([]auth.Resource, 0, len(accessItems))
+	for _, access := range accessItems {
+		allowed, reason := p.decide(user.Name, access)
+		if !allowed {
+			name := user.Name
+			if name == "" {
+				name = "anonymous"
+			}
+			dcontext.GetLogger(req.Context()).Infof("policy: %s denied %s on %s %s by %s", name, access.Action, access.Type, access.Name, reason)
+			return nil, ac.challenge(req, user, accessItems)
+		}
+		resources = append(resources, access.Resource)
+	}
+	return &auth.Grant{User: user, Resources: resources}, nil
+}
+
+// challenge returns the challenge of the authentication access controller
+// for the denied access, asking anonymous clients for credentials.
+func (ac *accessController) challenge(req *http.Request, user auth.UserInfo, accessItems []auth.Access) error {
+	anonymous := req.Clone(req.Context())
+	anonymous.Header.Del("Authorization")
+	_, err := ac.source.Authorized(anonymous, accessItems...)
+	var ch auth.Challenge
+	if !errors.As(err, &ch) {
+		return ErrAccessDenied
+	}
+	return &challenge{Challenge: ch, anonymous: user.Name == ""}
+}
+
+// challenge implements auth.Challenge with the challenge of the
+// authentication access controller, without telling which rule denied.
+type challenge struct {
+	auth.Challenge
+	anonymous bool
+}
+
+func (ch challenge) Error() string {
+	if ch.anonymous {
+		return auth.ErrInvalidCredential.Error()
+	}
+	return ErrAccessDenied.Error()
+}
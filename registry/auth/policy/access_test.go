@@ -0,0 +1,230 @@
+package policy
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/distribution/distribution/v3/registry/auth"
+	_ "github.com/distribution/distribution/v3/registry/auth/htpasswd"
+	"golang.org/x/crypto/bcrypt"
+)
+
+const testPolicy = `
+default: deny
+anonymous:
+  pull: [public/**]
+authenticated:
+  pull: ["*"]
+groups:
+  developers:
+    members: [frodo, sam]
+    push: [dev/*]
+    "*": [scratch/**]
+  auditors:
+    members: [sam]
+    deny: [dev/secret]
+users:
+  frodo:
+    delete: [dev/*]
+    deny: [scratch/vault/**]
+`
+
+func repository(name, action string) auth.Access {
+	return auth.Access{Resource: auth.Resource{Type: "repository", Name: name}, Action: action}
+}
+
+func TestDecide(t *testing.T) {
+	p, err := parsePolicy([]byte(testPolicy))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, tc := range []struct {
+		user    string
+		access  auth.Access
+		allowed bool
+	}{
+		// The anonymous permissions only apply without a user.
+		{"", repository("public/app", "pull"), true},
+		{"", repository("public/team/app", "pull"), true},
+		{"", repository("public/app", "push"), false},
+		{"", repository("app", "pull"), false},
+		// * does not match a /, ** matches any number of segments.
+		{"pippin", repository("app", "pull"), true},
+		{"pippin", repository("team/app", "pull"), false},
+		{"pippin", repository("public/app", "pull"), false},
+		{"frodo", repository("dev/app", "push"), true},
+		{"frodo", repository("dev/team/app", "push"), false},
+		{"frodo", repository("scratch", "push"), true},
+		{"frodo", repository("scratch/a/b", "delete"), true},
+		// The * action grants every action.
+		{"sam", repository("scratch/app", "delete"), true},
+		// A deny pattern of any entry takes precedence over every grant.
+		{"sam", repository("dev/secret", "push"), false},
+		{"frodo", repository("dev/secret", "push"), true},
+		{"frodo", repository("scratch/vault/key", "pull"), false},
+		{"frodo", repository("dev/app", "delete"), true},
+		{"sam", repository("dev/app", "delete"), false},
+		// Other resources follow the default.
+		{"frodo", auth.Access{Resource: auth.Resource{Type: "registry", Name: "catalog"}, Action: "*"}, false},
+	} {
+		allowed, reason := p.decide(tc.user, tc.access)
+		if allowed != tc.allowed {
+			t.Errorf("%q %s %s: expected %v, got %v by %s", tc.user, tc.access.Action, tc.access.Name, tc.allowed, allowed, reason)
+		}
+	}
+
+	p.Default = "allow"
+	if allowed, _ := p.decide("pippin", repository("team/app", "push")); !allowed {
+		t.Error("expected the default to allow")
+	}
+	if allowed, _ := p.decide("sam", repository("dev/secret", "pull")); allowed {
+		t.Error("expected a deny pattern to take precedence over the default")
+	}
+}
+
+func TestParsePolicy(t *testing.T) {
+	for name, content := range map[string]string{
+		"no default":      "users: {frodo: {pull: ['*']}}",
+		"unknown default": "default: maybe",
+		"unknown key":     "default: deny\nadmins: [frodo]",
+		"partial **":      "default: deny\nauthenticated: {pull: ['dev/**app']}",
+		"invalid pattern": "default: deny\nanonymous: {pull: ['[']}",
+	} {
+		if _, err := parsePolicy([]byte(content)); err == nil {
+			t.Errorf("%s: expected an error", name)
+		}
+	}
+}
+
+// newTestController writes the htpasswd and policy files, and returns an
+// access controller authenticating with them.
+func newTestController(t *testing.T, policyPath string) *accessController {
+	t.Helper()
+	var htpasswd bytes.Buffer
+	for _, user := range []string{"frodo", "sam", "pippin"} {
+		hash, err := bcrypt.GenerateFromPassword([]byte(user+"-password"), bcrypt.MinCost)
+		if err != nil {
+			t.Fatal(err)
+		}
+		fmt.Fprintf(&htpasswd, "%s:%s\n", user, hash)
+	}
+	htpasswdPath := filepath.Join(t.TempDir(), "htpasswd")
+	if err := os.WriteFile(htpasswdPath, htpasswd.Bytes(), 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	ac, err := newAccessController(map[string]any{
+		"path":           policyPath,
+		"reloadinterval": "10ms",
+		"authentication": map[any]any{
+			"htpasswd": map[any]any{"realm": "The-Shire", "path": htpasswdPath},
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return ac.(*accessController)
+}
+
+func authorize(ac *accessController, user, password string, access auth.Access) error {
+	req := httptest.NewRequest(http.MethodGet, "/v2/", nil)
+	if user != "" {
+		req.SetBasicAuth(user, password)
+	}
+	_, err := ac.Authorized(req, access)
+	return err
+}
+
+func TestAuthorized(t *testing.T) {
+	policyPath := filepath.Join(t.TempDir(), "policy.yml")
+	if err := os.WriteFile(policyPath, []byte(testPolicy), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	ac := newTestController(t, policyPath)
+
+	if err := authorize(ac, "frodo", "frodo-password", repository("dev/app", "push")); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if err := authorize(ac, "", "", repository("public/app", "pull")); err != nil {
+		t.Fatalf("unexpected error for the anonymous user: %v", err)
+	}
+
+	// Denied requests get the challenge of the authentication, without the
+	// rule which denied them.
+	for _, tc := range []struct {
+		user, password string
+		access         auth.Access
+	}{
+		{"", "", repository("dev/app", "pull")},
+		{"sam", "sam-password", repository("dev/secret", "push")},
+		{"frodo", "wrong", repository("dev/app", "push")},
+	} {
+		err := authorize(ac, tc.user, tc.password, tc.access)
+		var ch auth.Challenge
+		if !errors.As(err, &ch) {
+			t.Fatalf("%q: expected a challenge, got %v", tc.user, err)
+		}
+		w := httptest.NewRecorder()
+		ch.SetHeaders(httptest.NewRequest(http.MethodGet, "/v2/", nil), w)
+		if w.Header().Get("WWW-Authenticate") != `Basic realm="The-Shire"` {
+			t.Fatalf("%q: unexpected challenge %q", tc.user, w.Header().Get("WWW-Authenticate"))
+		}
+		if bytes.Contains([]byte(err.Error()), []byte("dev/")) {
+			t.Fatalf("%q: the error tells the denied rule: %v", tc.user, err)
+		}
+	}
+}
+
+func TestReloadPolicyFile(t *testing.T) {
+	policyPath := filepath.Join(t.TempDir(), "policy.yml")
+	if err := os.WriteFile(policyPath, []byte(testPolicy), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	ac := newTestController(t, policyPath)
+
+	allowed := func() bool {
+		return authorize(ac, "pippin", "pippin-password", repository("dev/app", "push")) == nil
+	}
+	if allowed() {
+		t.Fatal("unexpected initial policy")
+	}
+
+	updated := testPolicy + "  pippin:\n    push: [dev/*]\n"
+	if err := os.WriteFile(policyPath, []byte(updated), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	deadline := time.Now().Add(5 * time.Second)
+	for !allowed() {
+		if time.Now().After(deadline) {
+			t.Fatal("the policy file was not reloaded")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	// An invalid file keeps the previous policy.
+	if err := os.WriteFile(policyPath, []byte("default: maybe\n"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	if err := ac.reload(true); err == nil {
+		t.Fatal("expected an error reloading an invalid file")
+	}
+	if !allowed() {
+		t.Fatal("the previous policy was not kept")
+	}
+
+	// An invalid file is an error at startup.
+	if _, err := newAccessController(map[string]any{
+		"path":           policyPath,
+		"authentication": map[any]any{"htpasswd": map[any]any{"realm": "The-Shire", "path": policyPath}},
+	}); err == nil {
+		t.Fatal("expected an error with an invalid policy file")
+	}
+}
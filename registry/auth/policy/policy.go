@@ -0,0 +1,185 @@
+package policy
+
+import (
+	"errors"
+	"fmt"
+	"path"
+	"slices"
+	"sort"
+	"strings"
+
+	"github.com/distribution/distribution/v3/registry/auth"
+	"gopkg.in/yaml.v2"
+)
+
+// denyKey is the key of the patterns of the repositories denied every action.
+const denyKey = "deny"
+
+// permissions map actions, or * for every action, to the patterns of the
+// repositories they are granted on. The deny key holds the patterns of the
+// repositories denied every action.
+type permissions map[string][]string
+
+// group is a group of users and its permissions.
+type group struct {
+	Members     []string    `yaml:"members"`
+	Permissions permissions `yaml:",inline"`
+}
+
+// policy is the content of a policy file.
+type policy struct {
+	// Default is allow or deny, the decision when no permission applies.
+	Default string `yaml:"default"`
+	// Anonymous are the permissions of requests without credentials.
+	Anonymous permissions `yaml:"anonymous"`
+	// Authenticated are the permissions of every authenticated user.
+	Authenticated permissions            `yaml:"authenticated"`
+	Groups        map[string]group       `yaml:"groups"`
+	Users         map[string]permissions `yaml:"users"`
+}
+
+func parsePolicy(b []byte) (*policy, error) {
+	var p policy
+	if err := yaml.UnmarshalStrict(b, &p); err != nil {
+		return nil, err
+	}
+	if p.Default != "allow" && p.Default != "deny" {
+		return nil, fmt.Errorf(`default must be "allow" or "deny", not %q`, p.Default)
+	}
+
+	check := func(name string, perms permissions) error {
+		for action, patterns := range perms {
+			for _, pattern := range patterns {
+				if err := validatePattern(pattern); err != nil {
+					return fmt.Errorf("%s: %s: %v", name, action, err)
+				}
+			}
+		}
+		return nil
+	}
+	if err := check("anonymous", p.Anonymous); err != nil {
+		return nil, err
+	}
+	if err := check("authenticated", p.Authenticated); err != nil {
+		return nil, err
+	}
+	for name, g := range p.Groups {
+		if err := check("group "+name, g.Permissions); err != nil {
+			return nil, err
+		}
+	}
+	for name, perms := range p.Users {
+		if err := check("user "+name, perms); err != nil {
+			return nil, err
+		}
+	}
+	return &p, nil
+}
+
+// entry is a set of permissions applying to a request, named for the logs.
+type entry struct {
+	name        string
+	permissions permissions
+}
+
+// entries returns the permissions applying to the user, in the order they
+// are evaluated: the user, its groups by name, then every authenticated
+// user. The anonymous permissions apply to requests without a user.
+func (p *policy) entries(user string) []entry {
+	if user == "" {
+		return []entry{{name: "anonymous", permissions: p.Anonymous}}
+	}
+
+	var entries []entry
+	if perms, ok := p.Users[user]; ok {
+		entries = append(entries, entry{name: "user " + user, permissions: perms})
+	}
+	names := make([]string, 0, len(p.Groups))
+	for name := range p.Groups {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		if g := p.Groups[name]; slices.Contains(g.Members, user) {
+			entries = append(entries, entry{name: "group " + name, permissions: g.Permissions})
+		}
+	}
+	return append(entries, entry{name: "authenticated", permissions: p.Authenticated})
+}
+
+// decide returns whether the policy grants the access to the user, and the
+// reason of the decision. A deny pattern of any applying entry denies the
+// access, otherwise any permission grants it, otherwise the default applies.
+// Only repositories have permissions: other resources follow the default.
+func (p *policy) decide(user string, access auth.Access) (bool, string) {
+	if access.Type != "repository" {
+		return p.Default == "allow", "default " + p.Default
+	}
+
+	entries := p.entries(user)
+	for _, e := range entries {
+		for _, pattern := range e.permissions[denyKey] {
+			if matchPattern(pattern, access.Name) {
+				return false, fmt.Sprintf("deny pattern %q of %s", pattern, e.name)
+			}
+		}
+	}
+	for _, e := range entries {
+		for _, action := range []string{access.Action, "*"} {
+			for _, pattern := range e.permissions[action] {
+				if matchPattern(pattern, access.Name) {
+					return true, fmt.Sprintf("%s pattern %q of %s", action, pattern, e.name)
+				}
+			}
+		}
+	}
+	return p.Default == "allow", "default " + p.Default
+}
+
+// validatePattern checks the syntax of a repository pattern.
+func validatePattern(pattern string) error {
+	if pattern == "" {
+		return errors.New("empty pattern")
+	}
+	for _, segment := range strings.Split(pattern, "/") {
+		if segment == "**" {
+			continue
+		}
+		if strings.Contains(segment, "**") {
+			return fmt.Errorf("pattern %q: ** must be a whole path segment", pattern)
+		}
+		if _, err := path.Match(segment, ""); err != nil {
+			return fmt.Errorf("pattern %q: %v", pattern, err)
+		}
+	}
+	return nil
+}
+
+// matchPattern returns whether the repository name matches the pattern. The
+// pattern is matched segment by segment: a ** segment matches any number of
+// segments, including none, and other segments are matched with path.Match,
+// where * does not match a /.
+func matchPattern(pattern, name string) bool {
+	return matchSegments(strings.Split(pattern, "/"), strings.Split(name, "/"))
+}
+
+func matchSegments(pattern, name []string) bool {
+	for len(pattern) > 0 {
+		if pattern[0] == "**" {
+			for i := 0; i <= len(name); i++ {
+				if matchSegments(pattern[1:], name[i:]) {
+					return true
+				}
+			}
+			return false
+		}
+		if len(name) == 0 {
+			return false
+		}
+		if ok, _ := path.Match(pattern[0], name[0]); !ok {
+			return false
+		}
+		pattern, name = pattern[1:], name[1:]
+	}
+	return len(name) == 0
+}
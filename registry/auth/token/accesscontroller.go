@@ -1,6 +1,7 @@
 package token
 
 import (
+	"context"
 	"crypto"
 	"crypto/x509"
 	"encoding/json"
@@ -11,7 +12,10 @@ import (
 	"net/http"
 	"net/url"
 	"os"
+	"os/signal"
 	"strings"
+	"syscall"
+	"time"
 
 	"github.com/distribution/distribution/v3/registry/auth"
 	"github.com/go-jose/go-jose/v4"
@@ -23,6 +27,9 @@ func init() {
 	if err := auth.Register("token", auth.InitFunc(newAccessController)); err != nil {
 		logrus.Errorf("failed to register token auth: %v", err)
 	}
+	if err := auth.RegisterValidator("token", validateOptions); err != nil {
+		logrus.Errorf("failed to register token auth: %v", err)
+	}
 }
 
 // accessSet maps a typed, named resource to
@@ -155,11 +162,24 @@ type accessController struct {
 	realm             string
 	autoRedirect      bool
 	autoRedirectPath  string
-	issuer            string
+	issuers           []string
+	audiences         []string
+	strictAudience    bool
+	keyIDPrefix       string
 	service           string
 	rootCerts         *x509.CertPool
 	trustedKeys       map[string]crypto.PublicKey
+	bundle            []*x509.Certificate
 	signingAlgorithms []jose.SignatureAlgorithm
+	// certDir is the root certificate directory, nil if rootcertdir is
+	// unset. Its trust anchors replace rootCerts and trustedKeys.
+	certDir *rootCertDir
+	// remoteKeys is the JWKS fetched from the jwks URL, nil if jwks is
+	// unset or names a file. It holds trustedKeys as well.
+	remoteKeys *remoteJWKS
+	// introspector resolves the tokens which are not JWTs, or all of them
+	// without signing keys, nil if introspection is not configured.
+	introspector *introspector
 }
 
 const (
@@ -169,14 +189,24 @@ const (
 // tokenAccessOptions is a convenience type for handling
 // options to the constructor of an accessController.
 type tokenAccessOptions struct {
-	realm             string
-	autoRedirect      bool
-	autoRedirectPath  string
-	issuer            string
-	service           string
-	rootCertBundle    string
-	jwks              string
-	signingAlgorithms []string
+	realm              string
+	autoRedirect       bool
+	autoRedirectPath   string
+	issuers            []string
+	audiences          []string
+	strictAudience     bool
+	keyIDPrefix        string
+	service            string
+	rootCertBundle     string
+	rootCertDir        string
+	rootCertDirRefresh time.Duration
+	jwks               string
+	jwksRefresh        time.Duration
+	signingAlgorithms  []string
+
+	introspectionURL          string
+	introspectionClientID     string
+	introspectionClientSecret string
 }
 
 // checkOptions gathers the necessary options
@@ -198,12 +228,62 @@ func checkOptions(options map[string]any) (tokenAccessOptions, error) {
 				vals = append(vals, "")
 				continue
 			}
+			// The issuers list may replace the issuer, which is
+			// optional with token introspection.
+			_, issuers := options["issuers"]
+			_, introspection := options["introspectionurl"]
+			if key == "issuer" && (issuers || introspection) {
+				vals = append(vals, "")
+				continue
+			}
 			return tokenAccessOptions{}, fmt.Errorf("token auth requires a valid option string: %q", key)
 		}
 		vals = append(vals, val)
 	}
 
-	opts.realm, opts.issuer, opts.service, opts.rootCertBundle, opts.jwks = vals[0], vals[1], vals[2], vals[3], vals[4]
+	var issuer string
+	opts.realm, issuer, opts.service, opts.rootCertBundle, opts.jwks = vals[0], vals[1], vals[2], vals[3], vals[4]
+
+	issuers, err := stringList(options, "issuers")
+	if err != nil {
+		return tokenAccessOptions{}, err
+	}
+	if issuer != "" {
+		issuers = append([]string{issuer}, issuers...)
+	}
+	opts.issuers = issuers
+
+	if err := checkIntrospectionOptions(options, &opts); err != nil {
+		return tokenAccessOptions{}, err
+	}
+	if len(issuers) == 0 && opts.introspectionURL == "" {
+		return tokenAccessOptions{}, errors.New("token auth requires a valid option string: \"issuer\", or a list of issuers")
+	}
+
+	// The service is the accepted audience, unless audiences are listed.
+	opts.audiences, err = stringList(options, "audiences")
+	if err != nil {
+		return tokenAccessOptions{}, err
+	}
+	if len(opts.audiences) == 0 {
+		opts.audiences = []string{opts.service}
+	}
+
+	if strictAudienceVal, ok := options["strictaudience"]; ok {
+		strictAudience, ok := strictAudienceVal.(bool)
+		if !ok {
+			return tokenAccessOptions{}, errors.New("token auth requires a valid option bool: strictaudience")
+		}
+		opts.strictAudience = strictAudience
+	}
+
+	if keyIDPrefixVal, ok := options["kidprefix"]; ok {
+		keyIDPrefix, ok := keyIDPrefixVal.(string)
+		if !ok {
+			return tokenAccessOptions{}, errors.New("token auth requires a valid option string: kidprefix")
+		}
+		opts.keyIDPrefix = keyIDPrefix
+	}
 
 	autoRedirectVal, ok := options["autoredirect"]
 	if ok {
@@ -227,6 +307,40 @@ func checkOptions(options map[string]any) (tokenAccessOptions, error) {
 		}
 	}
 
+	if rootCertDirVal, ok := options["rootcertdir"]; ok {
+		rootCertDir, ok := rootCertDirVal.(string)
+		if !ok {
+			return tokenAccessOptions{}, errors.New("token auth requires a valid option string: rootcertdir")
+		}
+		opts.rootCertDir = rootCertDir
+	}
+
+	opts.rootCertDirRefresh = defaultRootCertDirRefresh
+	if refreshVal, ok := options["rootcertdirrefresh"]; ok {
+		refresh, ok := refreshVal.(string)
+		if !ok {
+			return tokenAccessOptions{}, errors.New("token auth requires a valid option duration: rootcertdirrefresh")
+		}
+		d, err := time.ParseDuration(refresh)
+		if err != nil || d <= 0 {
+			return tokenAccessOptions{}, fmt.Errorf("token auth requires a valid option duration: rootcertdirrefresh: %q", refresh)
+		}
+		opts.rootCertDirRefresh = d
+	}
+
+	opts.jwksRefresh = defaultJWKSRefresh
+	if jwksRefreshVal, ok := options["jwksrefresh"]; ok {
+		jwksRefresh, ok := jwksRefreshVal.(string)
+		if !ok {
+			return tokenAccessOptions{}, errors.New("token auth requires a valid option duration: jwksrefresh")
+		}
+		d, err := time.ParseDuration(jwksRefresh)
+		if err != nil || d <= 0 {
+			return tokenAccessOptions{}, fmt.Errorf("token auth requires a valid option duration: jwksrefresh: %q", jwksRefresh)
+		}
+		opts.jwksRefresh = d
+	}
+
 	signingAlgos, ok := options["signingalgorithms"]
 	if ok {
 		signingAlgorithmsVals, ok := signingAlgos.([]any)
@@ -247,6 +361,56 @@ func checkOptions(options map[string]any) (tokenAccessOptions, error) {
 	return opts, nil
 }
 
+// checkIntrospectionOptions gathers the options of token introspection, which
+// is enabled by the introspectionurl option and requires client credentials.
+func checkIntrospectionOptions(options map[string]any, opts *tokenAccessOptions) error {
+	val, ok := options["introspectionurl"]
+	if !ok {
+		return nil
+	}
+	introspectionURL, ok := val.(string)
+	if !ok || !isJWKSURL(introspectionURL) {
+		return errors.New("token auth requires a valid option url: introspectionurl")
+	}
+	if _, err := url.Parse(introspectionURL); err != nil {
+		return fmt.Errorf("token auth requires a valid option url: introspectionurl: %v", err)
+	}
+	opts.introspectionURL = introspectionURL
+
+	for key, dst := range map[string]*string{
+		"introspectionclientid":     &opts.introspectionClientID,
+		"introspectionclientsecret": &opts.introspectionClientSecret,
+	} {
+		val, ok := options[key].(string)
+		if !ok || val == "" {
+			return fmt.Errorf("token auth requires a valid option string with introspectionurl: %q", key)
+		}
+		*dst = val
+	}
+	return nil
+}
+
+// stringList returns the option as a list of strings, nil if it is unset.
+func stringList(options map[string]any, key string) ([]string, error) {
+	val, ok := options[key]
+	if !ok {
+		return nil, nil
+	}
+	vals, ok := val.([]any)
+	if !ok {
+		return nil, fmt.Errorf("token auth requires a valid option list of strings: %s", key)
+	}
+	list := make([]string, 0, len(vals))
+	for _, v := range vals {
+		s, ok := v.(string)
+		if !ok || s == "" {
+			return nil, fmt.Errorf("token auth requires a valid option list of strings: %s", key)
+		}
+		list = append(list, s)
+	}
+	return list, nil
+}
+
 var (
 	rootCertFetcher func(string) ([]*x509.Certificate, error) = getRootCerts
 	jwkFetcher      func(string) (*jose.JSONWebKeySet, error) = getJwks
@@ -316,54 +480,80 @@ func getSigningAlgorithms(algos []string) ([]jose.SignatureAlgorithm, error) {
 	return signAlgVals, nil
 }
 
-// newAccessController creates an accessController using the given options.
-func newAccessController(options map[string]any) (auth.AccessController, error) {
-	config, err := checkOptions(options)
-	if err != nil {
-		return nil, err
-	}
-
-	var (
-		rootCerts []*x509.Certificate
-		jwks      *jose.JSONWebKeySet
-		signAlgos []jose.SignatureAlgorithm
-	)
-
+// loadSigningKeys loads the root certificate bundle and the local jwks of
+// the options, and checks the root certificate directory. A remote jwks is
+// not fetched.
+func loadSigningKeys(config tokenAccessOptions) (rootCerts []*x509.Certificate, jwks *jose.JSONWebKeySet, err error) {
 	if config.rootCertBundle != "" {
 		rootCerts, err = rootCertFetcher(config.rootCertBundle)
 		if err != nil {
-			return nil, err
+			return nil, nil, err
+		}
+	}
+
+	var dirCerts []*x509.Certificate
+	if config.rootCertDir != "" {
+		dirCerts, err = readRootCertDir(config.rootCertDir)
+		if err != nil {
+			return nil, nil, err
 		}
 	}
 
-	if config.jwks != "" {
+	remote := isJWKSURL(config.jwks)
+	if config.jwks != "" && !remote {
 		jwks, err = jwkFetcher(config.jwks)
 		if err != nil {
-			return nil, err
+			return nil, nil, err
 		}
 	}
 
-	if (len(rootCerts) == 0 && jwks == nil) || // no certs bundle and no jwks
-		(len(rootCerts) == 0 && jwks != nil && len(jwks.Keys) == 0) { // no certs bundle and empty jwks
-		return nil, errors.New("token auth requires at least one token signing key")
+	noCerts := len(rootCerts) == 0 && len(dirCerts) == 0
+	if !remote && config.introspectionURL == "" && ((noCerts && jwks == nil) || // no certs and no jwks
+		(noCerts && jwks != nil && len(jwks.Keys) == 0)) { // no certs and empty jwks
+		return nil, nil, errors.New("token auth requires at least one token signing key")
 	}
+	return rootCerts, jwks, nil
+}
 
-	trustedKeys := make(map[string]crypto.PublicKey)
-	rootPool := x509.NewCertPool()
-	for _, rootCert := range rootCerts {
-		rootPool.AddCert(rootCert)
-		if key := GetJWKThumbprint(rootCert.PublicKey); key != "" {
-			trustedKeys[key] = rootCert.PublicKey
-		}
+// validateOptions checks the options and loads the signing keys, without
+// fetching a remote jwks.
+func validateOptions(options map[string]any) error {
+	config, err := checkOptions(options)
+	if err != nil {
+		return err
+	}
+	if _, _, err := loadSigningKeys(config); err != nil {
+		return err
+	}
+	_, err = getSigningAlgorithms(config.signingAlgorithms)
+	return err
+}
+
+// newAccessController creates an accessController using the given options.
+func newAccessController(options map[string]any) (auth.AccessController, error) {
+	config, err := checkOptions(options)
+	if err != nil {
+		return nil, err
+	}
+
+	rootCerts, jwks, err := loadSigningKeys(config)
+	if err != nil {
+		return nil, err
 	}
+	remote := isJWKSURL(config.jwks)
 
-	if jwks != nil {
-		for _, key := range jwks.Keys {
-			trustedKeys[key.KeyID] = key.Public()
+	static := newTrustAnchors(rootCerts, jwks)
+	var certDir *rootCertDir
+	trustedKeys := static.keys
+	if config.rootCertDir != "" {
+		certDir, err = newRootCertDir(config.rootCertDir, rootCerts, jwks)
+		if err != nil {
+			return nil, err
 		}
+		trustedKeys = certDir.trustAnchors().keys
 	}
 
-	signAlgos, err = getSigningAlgorithms(config.signingAlgorithms)
+	signAlgos, err := getSigningAlgorithms(config.signingAlgorithms)
 	if err != nil {
 		return nil, err
 	}
@@ -373,16 +563,48 @@ func newAccessController(options map[string]any) (auth.AccessController, error)
 		signAlgos = defaultSigningAlgorithms
 	}
 
-	return &accessController{
+	var remoteKeys *remoteJWKS
+	if remote {
+		// A JWKS which cannot be fetched on startup is only fatal when
+		// there is no other key to verify tokens with.
+		remoteKeys = newRemoteJWKS(config.jwks, trustedKeys, signAlgos)
+		if err := remoteKeys.refresh(context.Background()); err != nil && len(trustedKeys) == 0 {
+			return nil, err
+		}
+		go remoteKeys.run(config.jwksRefresh)
+		if certDir != nil {
+			certDir.onChange = remoteKeys.setStatic
+		}
+	}
+	if certDir != nil {
+		signal.Notify(certDir.hup, syscall.SIGHUP)
+		go certDir.run(config.rootCertDirRefresh)
+	}
+
+	var introspection *introspector
+	if config.introspectionURL != "" {
+		introspection = newIntrospector(config)
+	}
+
+	ac := &accessController{
 		realm:             config.realm,
 		autoRedirect:      config.autoRedirect,
 		autoRedirectPath:  config.autoRedirectPath,
-		issuer:            config.issuer,
+		issuers:           config.issuers,
+		audiences:         config.audiences,
+		strictAudience:    config.strictAudience,
+		keyIDPrefix:       config.keyIDPrefix,
 		service:           config.service,
-		rootCerts:         rootPool,
-		trustedKeys:       trustedKeys,
+		rootCerts:         static.roots,
+		trustedKeys:       static.keys,
+		bundle:            rootCerts,
 		signingAlgorithms: signAlgos,
-	}, nil
+		certDir:           certDir,
+		remoteKeys:        remoteKeys,
+		introspector:      introspection,
+	}
+	publishTrustedKeys(ac)
+	return ac, nil
 }
 
 // Authorized handles checking whether the given request is authorized
@@ -402,20 +624,12 @@ func (ac *accessController) Authorized(req *http.Request, accessItems ...auth.Ac
 		return nil, challenge
 	}
 
-	token, err := NewToken(rawToken, ac.signingAlgorithms)
-	if err != nil {
-		challenge.err = err
-		return nil, challenge
-	}
-
-	verifyOpts := VerifyOptions{
-		TrustedIssuers:    []string{ac.issuer},
-		AcceptedAudiences: []string{ac.service},
-		Roots:             ac.rootCerts,
-		TrustedKeys:       ac.trustedKeys,
+	claims, err := ac.verify(req.Context(), rawToken)
+	if errors.Is(err, auth.ErrUnavailable) {
+		// Fail closed: the request is denied without a challenge.
+		logrus.Errorf("token auth: denying request: %v", err)
+		return nil, err
 	}
-
-	claims, err := token.Verify(verifyOpts)
 	if err != nil {
 		challenge.err = err
 		return nil, challenge
@@ -434,3 +648,78 @@ func (ac *accessController) Authorized(req *http.Request, accessItems ...auth.Ac
 		Resources: claims.resources(),
 	}, nil
 }
+
+// verify returns the claims of the token, verified with the signing keys or,
+// for the opaque tokens or without signing keys, introspected.
+func (ac *accessController) verify(ctx context.Context, rawToken string) (*ClaimSet, error) {
+	if ac.introspector != nil && len(ac.trustedKeys) == 0 && ac.remoteKeys == nil && ac.certDir == nil {
+		return ac.introspector.introspect(ctx, rawToken)
+	}
+
+	token, err := NewToken(rawToken, ac.signingAlgorithms)
+	if err != nil && ac.introspector != nil {
+		return ac.introspector.introspect(ctx, rawToken)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	verifyOpts := VerifyOptions{
+		TrustedIssuers:    ac.issuers,
+		AcceptedAudiences: ac.audiences,
+		StrictAudience:    ac.strictAudience,
+		KeyIDPrefix:       ac.keyIDPrefix,
+	}
+	ac.setTrustAnchors(&verifyOpts)
+
+	claims, err := token.Verify(verifyOpts)
+	if err != nil && ac.certDir != nil && ac.certDir.rescanUnknown(token.keyID()) {
+		// The token may be signed by a certificate which was just added.
+		ac.setTrustAnchors(&verifyOpts)
+		claims, err = token.Verify(verifyOpts)
+	}
+	if err != nil && ac.remoteKeys != nil && ac.remoteKeys.refreshUnknown(ctx, token.keyID()) {
+		// The token is signed by a key which was just fetched.
+		ac.setTrustAnchors(&verifyOpts)
+		claims, err = token.Verify(verifyOpts)
+	}
+	return claims, err
+}
+
+// setTrustAnchors sets the root certificates and the keys currently trusted
+// in the verify options.
+func (ac *accessController) setTrustAnchors(verifyOpts *VerifyOptions) {
+	verifyOpts.Roots, verifyOpts.TrustedKeys = ac.rootCerts, ac.trustedKeys
+	if ac.certDir != nil {
+		anchors := ac.certDir.trustAnchors()
+		verifyOpts.Roots, verifyOpts.TrustedKeys = anchors.roots, anchors.keys
+	}
+	if ac.remoteKeys != nil {
+		verifyOpts.TrustedKeys = ac.remoteKeys.trustedKeys()
+	}
+}
+
+// trustedKeyInfos lists the keys currently trusted.
+func (ac *accessController) trustedKeyInfos() []trustedKeyInfo {
+	certs := ac.bundle
+	if ac.certDir != nil {
+		certs = ac.certDir.trustAnchors().certs
+	}
+	var verifyOpts VerifyOptions
+	ac.setTrustAnchors(&verifyOpts)
+	return trustedKeyInfos(certs, verifyOpts.TrustedKeys)
+}
+
+// Check implements health.Checker. It fails if the last scan of the root
+// certificate directory or the last fetch of the remote JWKS failed.
+func (ac *accessController) Check(ctx context.Context) error {
+	if ac.certDir != nil {
+		if err := ac.certDir.Check(); err != nil {
+			return err
+		}
+	}
+	if ac.remoteKeys == nil {
+		return nil
+	}
+	return ac.remoteKeys.Check(ctx)
+}
@@ -1,6 +1,7 @@
 package token
 
 import (
+	"slices"
 	"testing"
 
 	"crypto/rand"
@@ -93,6 +94,43 @@ func TestCheckOptions(t *testing.T) {
 	if ta.autoRedirectPath != "/auth/token" {
 		t.Fatal("autoredirectpath should be /auth/token")
 	}
+	if !slices.Equal(ta.issuers, []string{issuer}) || !slices.Equal(ta.audiences, []string{service}) {
+		t.Fatalf("unexpected default issuers %q and audiences %q", ta.issuers, ta.audiences)
+	}
+
+	options = map[string]any{
+		"realm":          realm,
+		"issuers":        []any{"staging-issuer", "production-issuer"},
+		"service":        service,
+		"audiences":      []any{service, "mirror.example.com"},
+		"strictaudience": true,
+		"kidprefix":      "production-",
+	}
+
+	ta, err = checkOptions(options)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !slices.Equal(ta.issuers, []string{"staging-issuer", "production-issuer"}) {
+		t.Fatalf("unexpected issuers %q", ta.issuers)
+	}
+	if !slices.Equal(ta.audiences, []string{service, "mirror.example.com"}) || !ta.strictAudience {
+		t.Fatalf("unexpected audiences %q", ta.audiences)
+	}
+	if ta.keyIDPrefix != "production-" {
+		t.Fatalf("unexpected kidprefix %q", ta.keyIDPrefix)
+	}
+
+	for name, options := range map[string]map[string]any{
+		"no issuer":       {"realm": realm, "service": service},
+		"invalid issuers": {"realm": realm, "service": service, "issuers": "production-issuer"},
+		"empty audience":  {"realm": realm, "issuer": issuer, "service": service, "audiences": []any{""}},
+		"invalid strict":  {"realm": realm, "issuer": issuer, "service": service, "strictaudience": "yes"},
+	} {
+		if _, err := checkOptions(options); err == nil {
+			t.Errorf("%s: expected an error", name)
+		}
+	}
 }
 
 func mockGetRootCerts(path string) ([]*x509.Certificate, error) {
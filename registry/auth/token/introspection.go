@@ -0,0 +1,235 @@
+package token
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/distribution/distribution/v3/registry/auth"
+)
+
+const (
+	// inactiveTokenTTL is how long an inactive token is remembered, so that
+	// the clients retrying it do not flood the introspection endpoint.
+	inactiveTokenTTL = 10 * time.Second
+
+	// maxIntrospectedTokens is the maximum number of introspected tokens
+	// remembered. Further tokens are introspected on every request, until
+	// some expire.
+	maxIntrospectedTokens = 10000
+
+	// maxIntrospectionSize is the maximum size of an introspection response.
+	maxIntrospectionSize = 1 << 20
+)
+
+// introspectionResponse is the response of an OAuth 2.0 token introspection
+// endpoint, see https://datatracker.ietf.org/doc/html/rfc7662#section-2.2.
+// The access of the token is its scope.
+type introspectionResponse struct {
+	Active bool   `json:"active"`
+	Scope  string `json:"scope"`
+	ClaimSet
+}
+
+// introspectedToken is the outcome of the introspection of a token, which
+// is remembered until it expires.
+type introspectedToken struct {
+	// claims are nil if the token is inactive.
+	claims  *ClaimSet
+	expires time.Time
+}
+
+// introspector resolves opaque bearer tokens with an OAuth 2.0 token
+// introspection endpoint, authenticating with client credentials. Active
+// tokens are remembered until they expire, and inactive tokens for
+// inactiveTokenTTL.
+type introspector struct {
+	url          string
+	clientID     string
+	clientSecret string
+	client       *http.Client
+	// verifyOpts hold the issuers and audiences the tokens are checked
+	// against, when the endpoint returns them.
+	verifyOpts VerifyOptions
+
+	mu     sync.Mutex
+	tokens map[[sha256.Size]byte]introspectedToken
+}
+
+func newIntrospector(config tokenAccessOptions) *introspector {
+	return &introspector{
+		url:          config.introspectionURL,
+		clientID:     config.introspectionClientID,
+		clientSecret: config.introspectionClientSecret,
+		client:       &http.Client{Timeout: 10 * time.Second},
+		verifyOpts: VerifyOptions{
+			TrustedIssuers:    config.issuers,
+			AcceptedAudiences: config.audiences,
+			StrictAudience:    config.strictAudience,
+		},
+		tokens: make(map[[sha256.Size]byte]introspectedToken),
+	}
+}
+
+// introspect returns the claims of the token, ErrInvalidToken if it is not
+// active or not meant for the registry, or an error wrapping
+// auth.ErrUnavailable if the endpoint cannot tell.
+func (i *introspector) introspect(ctx context.Context, rawToken string) (*ClaimSet, error) {
+	key := sha256.Sum256([]byte(rawToken))
+	now := time.Now()
+
+	i.mu.Lock()
+	token, ok := i.tokens[key]
+	i.mu.Unlock()
+	if !ok || !now.Before(token.expires) {
+		resp, err := i.fetch(ctx, rawToken)
+		if err != nil {
+			return nil, fmt.Errorf("%w: %v", auth.ErrUnavailable, err)
+		}
+		token = introspectedToken{
+			claims:  i.check(resp, now),
+			expires: now.Add(inactiveTokenTTL),
+		}
+		if token.claims != nil {
+			// Active tokens without an expiration are introspected on
+			// every request.
+			token.expires = time.Unix(token.claims.Expiration, 0)
+		}
+		i.remember(key, token, now)
+	}
+
+	if token.claims == nil {
+		return nil, ErrInvalidToken
+	}
+	return token.claims, nil
+}
+
+// check returns the claims of the token, nil if it is not active, has
+// expired, or is not meant for the registry. The issuer and audience are
+// only checked if the endpoint returns them.
+func (i *introspector) check(resp *introspectionResponse, now time.Time) *ClaimSet {
+	if !resp.Active {
+		return nil
+	}
+	claims := resp.ClaimSet
+	claims.Access = parseScope(resp.Scope)
+
+	if claims.Expiration != 0 && !now.Before(time.Unix(claims.Expiration, 0)) {
+		rejectClaim(&claims, "exp", fmt.Sprintf("after %d", now.Unix()), claims.Expiration)
+		return nil
+	}
+	if claims.NotBefore != 0 && now.Before(time.Unix(claims.NotBefore, 0)) {
+		rejectClaim(&claims, "nbf", fmt.Sprintf("before %d", now.Unix()), claims.NotBefore)
+		return nil
+	}
+	if claims.Issuer != "" && len(i.verifyOpts.TrustedIssuers) > 0 && !contains(i.verifyOpts.TrustedIssuers, claims.Issuer) {
+		rejectClaim(&claims, "iss", i.verifyOpts.TrustedIssuers, claims.Issuer)
+		return nil
+	}
+	if len(claims.Audience) > 0 && (!containsAny(i.verifyOpts.AcceptedAudiences, claims.Audience) ||
+		(i.verifyOpts.StrictAudience && !containsAll(i.verifyOpts.AcceptedAudiences, claims.Audience))) {
+		rejectClaim(&claims, "aud", i.verifyOpts.AcceptedAudiences, claims.Audience)
+		return nil
+	}
+	return &claims
+}
+
+// remember records the token, once the expired tokens are forgotten if there
+// are too many.
+func (i *introspector) remember(key [sha256.Size]byte, token introspectedToken, now time.Time) {
+	if !now.Before(token.expires) {
+		return
+	}
+	i.mu.Lock()
+	defer i.mu.Unlock()
+	if len(i.tokens) >= maxIntrospectedTokens {
+		for k, t := range i.tokens {
+			if !now.Before(t.expires) {
+				delete(i.tokens, k)
+			}
+		}
+		if len(i.tokens) >= maxIntrospectedTokens {
+			return
+		}
+	}
+	i.tokens[key] = token
+}
+
+// fetch posts the token to the introspection endpoint.
+func (i *introspector) fetch(ctx context.Context, rawToken string) (*introspectionResponse, error) {
+	form := url.Values{
+		"token":           {rawToken},
+		"token_type_hint": {"access_token"},
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, i.url, strings.NewReader(form.Encode()))
+	if err != nil {
+		return nil, fmt.Errorf("unable to introspect token at %q: %v", i.url, err)
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.Header.Set("Accept", "application/json")
+	// The client credentials are form encoded, see
+	// https://datatracker.ietf.org/doc/html/rfc6749#section-2.3.1
+	req.SetBasicAuth(url.QueryEscape(i.clientID), url.QueryEscape(i.clientSecret))
+
+	resp, err := i.client.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("unable to introspect token at %q: %v", i.url, err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("unable to introspect token at %q: unexpected status %s", i.url, resp.Status)
+	}
+
+	body, err := io.ReadAll(io.LimitReader(resp.Body, maxIntrospectionSize+1))
+	if err != nil {
+		return nil, fmt.Errorf("unable to read introspection response of %q: %v", i.url, err)
+	}
+	if len(body) > maxIntrospectionSize {
+		return nil, fmt.Errorf("introspection response of %q exceeds %d bytes", i.url, maxIntrospectionSize)
+	}
+	var introspection introspectionResponse
+	if err := json.Unmarshal(body, &introspection); err != nil {
+		return nil, fmt.Errorf("failed to parse introspection response of %q: %v", i.url, err)
+	}
+	return &introspection, nil
+}
+
+// parseScope returns the access of the resource scopes of an OAuth 2.0 scope,
+// see the resource scope grammar of docs/spec/auth/scope.md. The name of a
+// resource may hold the port of its registry, so the actions follow the last
+// colon. The other scopes, such as openid, are ignored.
+func parseScope(scope string) []*ResourceActions {
+	var access []*ResourceActions
+	for _, resourceScope := range strings.Fields(scope) {
+		resourceType, rest, ok := strings.Cut(resourceScope, ":")
+		if !ok {
+			continue
+		}
+		i := strings.LastIndex(rest, ":")
+		if resourceType == "" || i <= 0 {
+			continue
+		}
+		name, actions := rest[:i], rest[i+1:]
+
+		var class string
+		if open := strings.IndexByte(resourceType, '('); open > 0 && strings.HasSuffix(resourceType, ")") {
+			resourceType, class = resourceType[:open], resourceType[open+1:len(resourceType)-1]
+		}
+
+		resourceActions := &ResourceActions{Type: resourceType, Class: class, Name: name}
+		for _, action := range strings.Split(actions, ",") {
+			if action != "" {
+				resourceActions.Actions = append(resourceActions.Actions, action)
+			}
+		}
+		access = append(access, resourceActions)
+	}
+	return access
+}
@@ -0,0 +1,221 @@
+package token
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/distribution/distribution/v3/registry/auth"
+)
+
+// introspectionServer is an OAuth 2.0 token introspection endpoint, which
+// responds with the body of the token posted, and counts the requests per
+// token.
+type introspectionServer struct {
+	*httptest.Server
+	mu        sync.Mutex
+	responses map[string]string
+	requests  map[string]int
+}
+
+func newIntrospectionServer(t *testing.T, responses map[string]string) *introspectionServer {
+	s := &introspectionServer{responses: responses, requests: map[string]int{}}
+	s.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			t.Errorf("unexpected introspection method %s", r.Method)
+		}
+		if id, secret, ok := r.BasicAuth(); !ok || id != "registry" || secret != "s3cr%3At" {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		token := r.PostFormValue("token")
+		s.mu.Lock()
+		s.requests[token]++
+		s.mu.Unlock()
+		response, ok := s.responses[token]
+		if !ok {
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		_, _ = w.Write([]byte(response))
+	}))
+	t.Cleanup(s.Close)
+	return s
+}
+
+func (s *introspectionServer) requestsOf(token string) int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.requests[token]
+}
+
+func newIntrospectionController(t *testing.T, url string) *accessController {
+	t.Helper()
+	ac, err := newAccessController(map[string]any{
+		"realm":                     "https://auth.example.com/token/",
+		"service":                   "registry.example.com",
+		"issuers":                   []any{"https://idp.example.com"},
+		"introspectionurl":          url,
+		"introspectionclientid":     "registry",
+		"introspectionclientsecret": "s3cr:t",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return ac.(*accessController)
+}
+
+func authorizeBearer(ac *accessController, token string, access ...auth.Access) (*auth.Grant, error) {
+	req := httptest.NewRequest(http.MethodGet, "http://registry.example.com/v2/", nil)
+	req.Header.Set("Authorization", "Bearer "+token)
+	return ac.Authorized(req, access...)
+}
+
+func pullAccess(name string) auth.Access {
+	return auth.Access{Resource: auth.Resource{Type: "repository", Name: name}, Action: "pull"}
+}
+
+func TestIntrospection(t *testing.T) {
+	exp := time.Now().Add(time.Hour).Unix()
+	server := newIntrospectionServer(t, map[string]string{
+		"active": `{"active": true, "sub": "alice", "iss": "https://idp.example.com", "aud": "registry.example.com",
+			"exp": ` + strconv.FormatInt(exp, 10) + `, "scope": "openid repository:library/app:pull,push repository:localhost:5000/app:pull"}`,
+		"inactive":       `{"active": false}`,
+		"expired":        `{"active": true, "sub": "alice", "exp": ` + strconv.FormatInt(time.Now().Add(-time.Minute).Unix(), 10) + `, "scope": "repository:library/app:pull"}`,
+		"other-audience": `{"active": true, "sub": "alice", "aud": "other.example.com", "scope": "repository:library/app:pull"}`,
+		"other-issuer":   `{"active": true, "sub": "alice", "iss": "https://other.example.com", "scope": "repository:library/app:pull"}`,
+		"malformed":      `{"active": "yes"`,
+	})
+	ac := newIntrospectionController(t, server.URL)
+
+	t.Run("active", func(t *testing.T) {
+		grant, err := authorizeBearer(ac, "active", pullAccess("library/app"), pullAccess("localhost:5000/app"))
+		if err != nil {
+			t.Fatalf("unexpected error %v", err)
+		}
+		if grant.User.Name != "alice" || len(grant.Resources) != 2 {
+			t.Fatalf("unexpected grant %+v", grant)
+		}
+
+		_, err = authorizeBearer(ac, "active", pullAccess("library/other"))
+		if challenge, ok := err.(auth.Challenge); !ok || !errors.Is(challenge.(*authChallenge).err, ErrInsufficientScope) {
+			t.Fatalf("expected an insufficient scope challenge, got %v", err)
+		}
+	})
+
+	t.Run("cached", func(t *testing.T) {
+		for range 3 {
+			if _, err := authorizeBearer(ac, "active", pullAccess("library/app")); err != nil {
+				t.Fatalf("unexpected error %v", err)
+			}
+		}
+		if n := server.requestsOf("active"); n != 1 {
+			t.Fatalf("expected the active token to be introspected once, got %d", n)
+		}
+	})
+
+	for _, token := range []string{"inactive", "expired", "other-audience", "other-issuer"} {
+		t.Run(token, func(t *testing.T) {
+			for range 2 {
+				_, err := authorizeBearer(ac, token, pullAccess("library/app"))
+				if challenge, ok := err.(auth.Challenge); !ok || !errors.Is(challenge.(*authChallenge).err, ErrInvalidToken) {
+					t.Fatalf("expected an invalid token challenge, got %v", err)
+				}
+			}
+			if n := server.requestsOf(token); n != 1 {
+				t.Fatalf("expected the token to be introspected once, got %d", n)
+			}
+		})
+	}
+
+	t.Run("malformed", func(t *testing.T) {
+		_, err := authorizeBearer(ac, "malformed", pullAccess("library/app"))
+		if _, ok := err.(auth.Challenge); ok || !errors.Is(err, auth.ErrUnavailable) {
+			t.Fatalf("expected the request to be denied as unavailable, got %v", err)
+		}
+	})
+
+	t.Run("unavailable", func(t *testing.T) {
+		// The endpoint fails for unknown tokens, and failures are not
+		// cached.
+		for range 2 {
+			_, err := authorizeBearer(ac, "unknown", pullAccess("library/app"))
+			if _, ok := err.(auth.Challenge); ok || !errors.Is(err, auth.ErrUnavailable) {
+				t.Fatalf("expected the request to be denied as unavailable, got %v", err)
+			}
+		}
+		if n := server.requestsOf("unknown"); n != 2 {
+			t.Fatalf("expected the failures not to be cached, got %d requests", n)
+		}
+
+		down := newIntrospectionController(t, "http://127.0.0.1:1/introspect")
+		if _, err := authorizeBearer(down, "active", pullAccess("library/app")); !errors.Is(err, auth.ErrUnavailable) {
+			t.Fatalf("expected the request to be denied as unavailable, got %v", err)
+		}
+	})
+
+	t.Run("no token", func(t *testing.T) {
+		req := httptest.NewRequest(http.MethodGet, "http://registry.example.com/v2/", nil)
+		_, err := ac.Authorized(req, pullAccess("library/app"))
+		if _, ok := err.(auth.Challenge); !ok {
+			t.Fatalf("expected a challenge, got %v", err)
+		}
+	})
+}
+
+func TestIntrospectionOptions(t *testing.T) {
+	base := map[string]any{
+		"realm":                     "https://auth.example.com/token/",
+		"service":                   "registry.example.com",
+		"introspectionurl":          "https://idp.example.com/introspect",
+		"introspectionclientid":     "registry",
+		"introspectionclientsecret": "secret",
+	}
+	if err := validateOptions(base); err != nil {
+		t.Fatalf("expected introspection not to require an issuer or signing keys, got %v", err)
+	}
+
+	for name, change := range map[string]map[string]any{
+		"invalid url":     {"introspectionurl": "idp.example.com/introspect"},
+		"no client id":    {"introspectionclientid": nil},
+		"no secret":       {"introspectionclientsecret": ""},
+		"invalid options": {"introspectionurl": 42},
+	} {
+		options := map[string]any{}
+		for k, v := range base {
+			options[k] = v
+		}
+		for k, v := range change {
+			if v == nil {
+				delete(options, k)
+			} else {
+				options[k] = v
+			}
+		}
+		if err := validateOptions(options); err == nil {
+			t.Errorf("%s: expected an error", name)
+		}
+	}
+}
+
+func TestParseScope(t *testing.T) {
+	got := parseScope("openid repository:library/app:pull,push repository:localhost:5000/app:pull registry:catalog:* repository(plugin):app: profile:")
+	want := []*ResourceActions{
+		{Type: "repository", Name: "library/app", Actions: []string{"pull", "push"}},
+		{Type: "repository", Name: "localhost:5000/app", Actions: []string{"pull"}},
+		{Type: "registry", Name: "catalog", Actions: []string{"*"}},
+		{Type: "repository", Class: "plugin", Name: "app"},
+	}
+	if !reflect.DeepEqual(got, want) {
+		for _, a := range got {
+			t.Logf("%+v", *a)
+		}
+		t.Fatal("unexpected access")
+	}
+}
@@ -0,0 +1,227 @@
+package token
+
+import (
+	"context"
+	"crypto"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"maps"
+	"net/http"
+	"slices"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/go-jose/go-jose/v4"
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	// defaultJWKSRefresh is the interval at which a remote JWKS is
+	// refreshed, unless set by the jwksrefresh option.
+	defaultJWKSRefresh = 5 * time.Minute
+
+	// minJWKSRefresh is the minimum interval between two fetches of a
+	// remote JWKS triggered by tokens signed by unknown keys.
+	minJWKSRefresh = 10 * time.Second
+
+	// maxJWKSSize is the maximum size of a remote JWKS document.
+	maxJWKSSize = 1 << 20
+)
+
+// isJWKSURL returns whether the jwks option names a URL, rather than a file.
+func isJWKSURL(jwks string) bool {
+	return strings.HasPrefix(jwks, "https://") || strings.HasPrefix(jwks, "http://")
+}
+
+// remoteJWKS is a JSON Web Key Set fetched from a URL. It is refreshed
+// periodically, and when a token is signed by a key it does not know. A failed
+// fetch keeps the last good key set.
+type remoteJWKS struct {
+	url        string
+	client     *http.Client
+	algorithms []jose.SignatureAlgorithm
+	// static are the keys of the root certificates and of the local jwks,
+	// trusted regardless of the remote key set. They are replaced by
+	// setStatic as the root certificate directory changes.
+	static map[string]crypto.PublicKey
+	// minRefresh is the minimum interval between two fetches triggered by
+	// unknown keys.
+	minRefresh time.Duration
+
+	// keys are the static keys merged with the last good remote key set.
+	keys atomic.Pointer[map[string]crypto.PublicKey]
+
+	mu        sync.Mutex
+	lastFetch time.Time
+	err       error
+	// remote is the last good remote key set.
+	remote map[string]crypto.PublicKey
+}
+
+func newRemoteJWKS(url string, static map[string]crypto.PublicKey, algorithms []jose.SignatureAlgorithm) *remoteJWKS {
+	r := &remoteJWKS{
+		url:        url,
+		client:     &http.Client{Timeout: 30 * time.Second},
+		algorithms: algorithms,
+		static:     static,
+		minRefresh: minJWKSRefresh,
+	}
+	r.keys.Store(&static)
+	return r
+}
+
+// trustedKeys returns the keys currently trusted.
+func (r *remoteJWKS) trustedKeys() map[string]crypto.PublicKey {
+	return *r.keys.Load()
+}
+
+// refresh fetches the key set, recording the outcome for the health check.
+func (r *remoteJWKS) refresh(ctx context.Context) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.refreshLocked(ctx)
+}
+
+func (r *remoteJWKS) refreshLocked(ctx context.Context) error {
+	r.lastFetch = time.Now()
+	r.err = r.fetch(ctx)
+	if r.err != nil {
+		logrus.Errorf("token auth: keeping the last good key set: %v", r.err)
+	}
+	return r.err
+}
+
+// refreshUnknown refreshes the key set if it does not hold the key with the
+// given ID, unless it was fetched less than minRefresh ago. It returns whether
+// the key was fetched.
+func (r *remoteJWKS) refreshUnknown(ctx context.Context, keyID string) bool {
+	if keyID == "" {
+		return false
+	}
+	if _, ok := r.trustedKeys()[keyID]; ok {
+		return false
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	// Another request may have fetched the key in the meantime.
+	if _, ok := r.trustedKeys()[keyID]; ok {
+		return true
+	}
+	if time.Since(r.lastFetch) < r.minRefresh || r.refreshLocked(ctx) != nil {
+		return false
+	}
+	_, ok := r.trustedKeys()[keyID]
+	return ok
+}
+
+// run refreshes the key set at every interval, forever.
+func (r *remoteJWKS) run(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for range ticker.C {
+		_ = r.refresh(context.Background())
+	}
+}
+
+// Check implements health.Checker, failing if the last fetch failed.
+func (r *remoteJWKS) Check(context.Context) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.err
+}
+
+func (r *remoteJWKS) fetch(ctx context.Context) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, r.url, nil)
+	if err != nil {
+		return fmt.Errorf("unable to fetch jwks %q: %v", r.url, err)
+	}
+	req.Header.Set("Accept", "application/json")
+	resp, err := r.client.Do(req)
+	if err != nil {
+		return fmt.Errorf("unable to fetch jwks %q: %v", r.url, err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("unable to fetch jwks %q: unexpected status %s", r.url, resp.Status)
+	}
+
+	rawJWKS, err := io.ReadAll(io.LimitReader(resp.Body, maxJWKSSize+1))
+	if err != nil {
+		return fmt.Errorf("unable to read jwks %q: %v", r.url, err)
+	}
+	if len(rawJWKS) > maxJWKSSize {
+		return fmt.Errorf("jwks %q exceeds %d bytes", r.url, maxJWKSSize)
+	}
+	var jwks jose.JSONWebKeySet
+	if err := json.Unmarshal(rawJWKS, &jwks); err != nil {
+		return fmt.Errorf("failed to parse jwks %q: %v", r.url, err)
+	}
+
+	remote := make(map[string]crypto.PublicKey)
+	for _, key := range jwks.Keys {
+		if err := validateJWK(key, r.algorithms); err != nil {
+			logrus.Warnf("token auth: ignoring key of jwks %q: %v", r.url, err)
+			continue
+		}
+		remote[key.KeyID] = key.Public()
+	}
+	if len(remote) == 0 {
+		return fmt.Errorf("jwks %q holds no valid signing key", r.url)
+	}
+
+	r.remote = remote
+	r.merge()
+	return nil
+}
+
+// setStatic replaces the static keys.
+func (r *remoteJWKS) setStatic(static map[string]crypto.PublicKey) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.static = static
+	r.merge()
+}
+
+// merge stores the static keys merged with the remote ones, the static keys
+// taking precedence. It must be called with mu held.
+func (r *remoteJWKS) merge() {
+	keys := maps.Clone(r.static)
+	for keyID, key := range r.remote {
+		if _, ok := keys[keyID]; !ok {
+			keys[keyID] = key
+		}
+	}
+	r.keys.Store(&keys)
+}
+
+// validateJWK checks that a key of a remote JWKS can verify tokens: it must
+// have an ID, be a public key meant for signatures, and use one of the
+// accepted signing algorithms.
+func validateJWK(key jose.JSONWebKey, algorithms []jose.SignatureAlgorithm) error {
+	if key.KeyID == "" {
+		return errors.New("key has no ID")
+	}
+	if !key.Valid() {
+		return fmt.Errorf("key %q is invalid", key.KeyID)
+	}
+	if key.Use != "" && key.Use != "sig" {
+		return fmt.Errorf("key %q is not a signing key: use %q", key.KeyID, key.Use)
+	}
+	if key.Algorithm != "" && !slices.Contains(algorithms, jose.SignatureAlgorithm(key.Algorithm)) {
+		return fmt.Errorf("key %q uses a signing algorithm which is not accepted: %s", key.KeyID, key.Algorithm)
+	}
+	public := key.Public()
+	if public.Key == nil {
+		return fmt.Errorf("key %q is not an asymmetric key", key.KeyID)
+	}
+	if key.Algorithm != "" {
+		if err := checkSigningAlgorithm(key.Algorithm, public.Key); err != nil {
+			return fmt.Errorf("key %q is invalid: %v", key.KeyID, err)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,305 @@
+package token
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/distribution/distribution/v3/registry/auth"
+	"github.com/go-jose/go-jose/v4"
+)
+
+// jwksServer serves a JWKS whose keys can be rotated.
+type jwksServer struct {
+	*httptest.Server
+
+	mu      sync.Mutex
+	keys    []jose.JSONWebKey
+	fail    bool
+	fetches int
+}
+
+func newJWKSServer(t *testing.T) *jwksServer {
+	s := &jwksServer{}
+	s.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		s.mu.Lock()
+		defer s.mu.Unlock()
+		s.fetches++
+		if s.fail {
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		_ = json.NewEncoder(w).Encode(jose.JSONWebKeySet{Keys: s.keys})
+	}))
+	t.Cleanup(s.Close)
+	return s
+}
+
+// serve sets the public keys of the signing keys as the served JWKS.
+func (s *jwksServer) serve(keys ...*jose.JSONWebKey) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.keys = s.keys[:0]
+	for _, key := range keys {
+		public := key.Public()
+		public.Use = "sig"
+		s.keys = append(s.keys, public)
+	}
+}
+
+func (s *jwksServer) setFail(fail bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.fail = fail
+}
+
+func (s *jwksServer) fetchCount() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.fetches
+}
+
+// makeJWKSSigningKeys returns n signing keys without certificate chain.
+func makeJWKSSigningKeys(t *testing.T, n int) []*jose.JSONWebKey {
+	rootKeys, err := makeRootKeys(n)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keys := make([]*jose.JSONWebKey, n)
+	for i, rootKey := range rootKeys {
+		if keys[i], err = makeSigningKeyWithChain(rootKey, 0); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return keys
+}
+
+const (
+	jwksTestIssuer  = "test-issuer.example.com"
+	jwksTestService = "test-service.example.com"
+)
+
+var jwksTestAccess = auth.Access{
+	Resource: auth.Resource{Type: "repository", Name: "foo/bar"},
+	Action:   "pull",
+}
+
+// authorize checks whether a token signed by key is authorized.
+func authorize(t *testing.T, ac auth.AccessController, key *jose.JSONWebKey) error {
+	t.Helper()
+	token, err := makeTestToken(key, jwksTestIssuer, jwksTestService,
+		[]*ResourceActions{{
+			Type:    jwksTestAccess.Type,
+			Name:    jwksTestAccess.Name,
+			Actions: []string{jwksTestAccess.Action},
+		}},
+		time.Now(), time.Now().Add(5*time.Minute))
+	if err != nil {
+		t.Fatal(err)
+	}
+	req, err := http.NewRequest(http.MethodGet, "http://example.com/v2/foo/bar/manifests/latest", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Header.Set("Authorization", fmt.Sprintf("Bearer %s", token.Raw))
+	_, err = ac.Authorized(req, jwksTestAccess)
+	return err
+}
+
+func newJWKSAccessController(t *testing.T, options map[string]any) *accessController {
+	t.Helper()
+	opts := map[string]any{
+		"realm":   "https://auth.example.com/token/",
+		"issuer":  jwksTestIssuer,
+		"service": jwksTestService,
+	}
+	for k, v := range options {
+		opts[k] = v
+	}
+	ac, err := newAccessController(opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return ac.(*accessController)
+}
+
+func TestRemoteJWKSUnknownKeyRefresh(t *testing.T) {
+	keys := makeJWKSSigningKeys(t, 2)
+	server := newJWKSServer(t)
+	server.serve(keys[0])
+
+	ac := newJWKSAccessController(t, map[string]any{"jwks": server.URL})
+	if err := authorize(t, ac, keys[0]); err != nil {
+		t.Fatalf("token signed by a served key was not authorized: %v", err)
+	}
+
+	// A token signed by a key rotated in after the last fetch triggers a
+	// refresh, unless the key set was fetched too recently.
+	server.serve(keys[0], keys[1])
+	fetches := server.fetchCount()
+	if err := authorize(t, ac, keys[1]); err == nil {
+		t.Fatal("expected the refresh to be rate limited")
+	}
+	if server.fetchCount() != fetches {
+		t.Fatal("the key set was fetched within the minimum refresh interval")
+	}
+
+	ac.remoteKeys.minRefresh = 0
+	if err := authorize(t, ac, keys[1]); err != nil {
+		t.Fatalf("token signed by a rotated key was not authorized: %v", err)
+	}
+	if server.fetchCount() != fetches+1 {
+		t.Fatalf("expected a single refresh, got %d", server.fetchCount()-fetches)
+	}
+
+	// Known keys do not trigger a fetch.
+	if err := authorize(t, ac, keys[0]); err != nil {
+		t.Fatal(err)
+	}
+	if server.fetchCount() != fetches+1 {
+		t.Fatal("a token signed by a known key triggered a refresh")
+	}
+}
+
+func TestRemoteJWKSRotation(t *testing.T) {
+	keys := makeJWKSSigningKeys(t, 2)
+	server := newJWKSServer(t)
+	server.serve(keys[0])
+
+	ac := newJWKSAccessController(t, map[string]any{"jwks": server.URL, "jwksrefresh": "10ms"})
+	ac.remoteKeys.minRefresh = time.Hour
+	if err := authorize(t, ac, keys[0]); err != nil {
+		t.Fatal(err)
+	}
+
+	// The periodic refresh drops the rotated out key.
+	server.serve(keys[1])
+	deadline := time.Now().Add(5 * time.Second)
+	for authorize(t, ac, keys[0]) == nil {
+		if time.Now().After(deadline) {
+			t.Fatal("the rotated out key is still trusted")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if err := authorize(t, ac, keys[1]); err != nil {
+		t.Fatalf("token signed by the rotated in key was not authorized: %v", err)
+	}
+}
+
+func TestRemoteJWKSFetchFailure(t *testing.T) {
+	keys := makeJWKSSigningKeys(t, 1)
+	server := newJWKSServer(t)
+	server.serve(keys[0])
+
+	ac := newJWKSAccessController(t, map[string]any{"jwks": server.URL})
+	ctx := context.Background()
+	if err := ac.Check(ctx); err != nil {
+		t.Fatalf("unexpected health check failure: %v", err)
+	}
+
+	// A failed fetch keeps the last good key set, and fails the health check.
+	server.setFail(true)
+	if err := ac.remoteKeys.refresh(ctx); err == nil {
+		t.Fatal("expected the refresh to fail")
+	}
+	if err := ac.Check(ctx); err == nil {
+		t.Fatal("expected the health check to fail")
+	}
+	if err := authorize(t, ac, keys[0]); err != nil {
+		t.Fatalf("the last good key set was dropped: %v", err)
+	}
+
+	server.setFail(false)
+	if err := ac.remoteKeys.refresh(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if err := ac.Check(ctx); err != nil {
+		t.Fatalf("the health check did not recover: %v", err)
+	}
+}
+
+func TestRemoteJWKSStartup(t *testing.T) {
+	server := newJWKSServer(t)
+	server.setFail(true)
+	options := map[string]any{
+		"realm":   "https://auth.example.com/token/",
+		"issuer":  jwksTestIssuer,
+		"service": jwksTestService,
+		"jwks":    server.URL,
+	}
+	if _, err := newAccessController(options); err == nil {
+		t.Fatal("expected an error without any signing key")
+	}
+
+	// The root certificate bundle lets the registry start until the JWKS
+	// can be fetched.
+	rootKeys, err := makeRootKeys(1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	bundle, err := writeTempRootCerts(rootKeys)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(bundle)
+	ac := newJWKSAccessController(t, map[string]any{"jwks": server.URL, "rootcertbundle": bundle})
+	if err := ac.Check(context.Background()); err == nil {
+		t.Fatal("expected the health check to fail")
+	}
+
+	// Both the bundle and the JWKS are trusted.
+	keys := makeJWKSSigningKeys(t, 1)
+	server.serve(keys[0])
+	server.setFail(false)
+	ac.remoteKeys.minRefresh = 0
+	if err := authorize(t, ac, keys[0]); err != nil {
+		t.Fatalf("token signed by a JWKS key was not authorized: %v", err)
+	}
+	chained, err := makeSigningKeyWithChain(rootKeys[0], 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := authorize(t, ac, chained); err != nil {
+		t.Fatalf("token signed by the root certificate bundle was not authorized: %v", err)
+	}
+}
+
+func TestValidateJWK(t *testing.T) {
+	keys := makeJWKSSigningKeys(t, 1)
+	public := keys[0].Public()
+	algorithms := []jose.SignatureAlgorithm{jose.ES256}
+	if err := validateJWK(public, algorithms); err != nil {
+		t.Fatalf("unexpected error validating a signing key: %v", err)
+	}
+
+	for name, mutate := range map[string]func(*jose.JSONWebKey){
+		"no key ID":      func(k *jose.JSONWebKey) { k.KeyID = "" },
+		"encryption key": func(k *jose.JSONWebKey) { k.Use = "enc" },
+		"algorithm":      func(k *jose.JSONWebKey) { k.Algorithm = string(jose.RS256) },
+		"symmetric key":  func(k *jose.JSONWebKey) { k.Key = []byte("secret"); k.Algorithm = "" },
+	} {
+		key := public
+		mutate(&key)
+		if err := validateJWK(key, algorithms); err == nil {
+			t.Errorf("%s: expected the key to be invalid", name)
+		}
+	}
+
+	// The algorithm of a key must match its type, even if it is accepted.
+	for name, alg := range map[string]jose.SignatureAlgorithm{
+		"EdDSA with an ECDSA key": jose.EdDSA,
+		"ES384 with a P-256 key":  jose.ES384,
+	} {
+		key := public
+		key.Algorithm = string(alg)
+		if err := validateJWK(key, []jose.SignatureAlgorithm{jose.ES256, jose.ES384, jose.EdDSA}); err == nil {
+			t.Errorf("%s: expected the key to be invalid", name)
+		}
+	}
+}
@@ -0,0 +1,249 @@
+package token
+
+import (
+	"crypto"
+	"crypto/x509"
+	"expvar"
+	"fmt"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/go-jose/go-jose/v4"
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	// defaultRootCertDirRefresh is the interval at which the root
+	// certificate directory is scanned, unless set by the rootcertdirrefresh
+	// option.
+	defaultRootCertDirRefresh = time.Minute
+
+	// minRootCertDirRescan is the minimum interval between two scans of the
+	// root certificate directory triggered by unknown keys.
+	minRootCertDirRescan = time.Second
+)
+
+// trustAnchors are the root certificates and the keys trusted to sign tokens.
+type trustAnchors struct {
+	roots *x509.CertPool
+	keys  map[string]crypto.PublicKey
+	certs []*x509.Certificate
+}
+
+// newTrustAnchors trusts the root certificates, whose keys are identified by
+// their JWK thumbprint, and the keys of the jwks.
+func newTrustAnchors(rootCerts []*x509.Certificate, jwks *jose.JSONWebKeySet) *trustAnchors {
+	anchors := &trustAnchors{
+		roots: x509.NewCertPool(),
+		keys:  make(map[string]crypto.PublicKey),
+		certs: rootCerts,
+	}
+	for _, rootCert := range rootCerts {
+		anchors.roots.AddCert(rootCert)
+		if key := GetJWKThumbprint(rootCert.PublicKey); key != "" {
+			anchors.keys[key] = rootCert.PublicKey
+		}
+	}
+	if jwks != nil {
+		for _, key := range jwks.Keys {
+			anchors.keys[key.KeyID] = key.Public()
+		}
+	}
+	return anchors
+}
+
+// rootCertDir is a directory of PEM files of root certificates, trusted along
+// with the root certificate bundle and the local jwks. It is scanned
+// periodically, on SIGHUP, and when a token is signed by an unknown key, so
+// that the token signing keys can be rotated without a restart: the
+// certificates of the old and new files are trusted together, and removing
+// a file revokes its certificates. A scan which fails keeps the last good
+// certificates.
+type rootCertDir struct {
+	path string
+	// bundle and jwks are trusted regardless of the directory.
+	bundle []*x509.Certificate
+	jwks   *jose.JSONWebKeySet
+	// minRescan is the minimum interval between two scans triggered by
+	// unknown keys.
+	minRescan time.Duration
+	// onChange, if set, is called with the keys trusted once a scan changed
+	// them.
+	onChange func(map[string]crypto.PublicKey)
+
+	// anchors are replaced as a whole by the scans which change them.
+	anchors atomic.Pointer[trustAnchors]
+	// hup receives SIGHUP, forcing a scan.
+	hup chan os.Signal
+
+	mu       sync.Mutex
+	lastScan time.Time
+	err      error
+}
+
+func newRootCertDir(path string, bundle []*x509.Certificate, jwks *jose.JSONWebKeySet) (*rootCertDir, error) {
+	d := &rootCertDir{
+		path:      path,
+		bundle:    bundle,
+		jwks:      jwks,
+		minRescan: minRootCertDirRescan,
+		hup:       make(chan os.Signal, 1),
+	}
+	if err := d.rescan(); err != nil {
+		return nil, err
+	}
+	return d, nil
+}
+
+// trustAnchors returns the anchors currently trusted.
+func (d *rootCertDir) trustAnchors() *trustAnchors {
+	return d.anchors.Load()
+}
+
+// rescan scans the directory, recording the outcome for the health check.
+func (d *rootCertDir) rescan() error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return d.rescanLocked()
+}
+
+func (d *rootCertDir) rescanLocked() error {
+	d.lastScan = time.Now()
+	certs, err := readRootCertDir(d.path)
+	d.err = err
+	if err != nil {
+		logrus.Errorf("token auth: keeping the last good root certificates: %v", err)
+		return err
+	}
+
+	certs = append(slices.Clone(d.bundle), certs...)
+	if previous := d.anchors.Load(); previous != nil && slices.EqualFunc(previous.certs, certs, (*x509.Certificate).Equal) {
+		return nil
+	}
+	anchors := newTrustAnchors(certs, d.jwks)
+	d.anchors.Store(anchors)
+	logrus.Infof("token auth: trusting %d root certificates of %s", len(certs)-len(d.bundle), d.path)
+	if d.onChange != nil {
+		d.onChange(anchors.keys)
+	}
+	return nil
+}
+
+// rescanUnknown scans the directory if the key with the given ID is not
+// trusted, unless it was scanned less than minRescan ago. The tokens signed
+// by a certificate chain may not name the key of their root certificate, so
+// they trigger a scan as well. It returns whether the trust anchors changed.
+func (d *rootCertDir) rescanUnknown(keyID string) bool {
+	anchors := d.trustAnchors()
+	if _, ok := anchors.keys[keyID]; ok {
+		return false
+	}
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	// Another request may have changed them in the meantime.
+	if d.anchors.Load() != anchors {
+		return true
+	}
+	if time.Since(d.lastScan) < d.minRescan || d.rescanLocked() != nil {
+		return false
+	}
+	return d.anchors.Load() != anchors
+}
+
+// run scans the directory at every interval and on SIGHUP, forever.
+func (d *rootCertDir) run(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+		case <-d.hup:
+		}
+		_ = d.rescan()
+	}
+}
+
+// Check fails if the last scan failed.
+func (d *rootCertDir) Check() error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return d.err
+}
+
+// readRootCertDir returns the certificates of the PEM files of the directory,
+// in the order of their names. Hidden files, such as the ..data directory of
+// a Kubernetes volume, are skipped.
+func readRootCertDir(path string) ([]*x509.Certificate, error) {
+	entries, err := os.ReadDir(path)
+	if err != nil {
+		return nil, fmt.Errorf("unable to read token auth root certificate directory %q: %s", path, err)
+	}
+	var certs []*x509.Certificate
+	for _, entry := range entries {
+		if strings.HasPrefix(entry.Name(), ".") {
+			continue
+		}
+		file := filepath.Join(path, entry.Name())
+		// Follow the symbolic links, which the files of a volume may be.
+		info, err := os.Stat(file)
+		if err != nil {
+			return nil, fmt.Errorf("unable to read token auth root certificate file %q: %s", file, err)
+		}
+		if !info.Mode().IsRegular() {
+			continue
+		}
+		fileCerts, err := getRootCerts(file)
+		if err != nil {
+			return nil, err
+		}
+		certs = append(certs, fileCerts...)
+	}
+	return certs, nil
+}
+
+// trustedKeyInfo describes a trusted key in the registry expvar.
+type trustedKeyInfo struct {
+	KeyID string `json:"kid"`
+	// NotAfter is the expiry of the root certificate of the key, unset for
+	// the keys of a jwks.
+	NotAfter *time.Time `json:"notAfter,omitempty"`
+}
+
+// trustedKeyInfos lists the keys trusted, sorted by ID.
+func trustedKeyInfos(certs []*x509.Certificate, keys map[string]crypto.PublicKey) []trustedKeyInfo {
+	infos := make([]trustedKeyInfo, 0, len(keys))
+	seen := make(map[string]bool)
+	for _, cert := range certs {
+		keyID := GetJWKThumbprint(cert.PublicKey)
+		if keyID == "" || seen[keyID] {
+			continue
+		}
+		seen[keyID] = true
+		notAfter := cert.NotAfter
+		infos = append(infos, trustedKeyInfo{KeyID: keyID, NotAfter: &notAfter})
+	}
+	for keyID := range keys {
+		if !seen[keyID] {
+			infos = append(infos, trustedKeyInfo{KeyID: keyID})
+		}
+	}
+	slices.SortFunc(infos, func(a, b trustedKeyInfo) int { return strings.Compare(a.KeyID, b.KeyID) })
+	return infos
+}
+
+// publishTrustedKeys exports the keys trusted by the access controller on
+// the registry expvar, served by the debug server.
+func publishTrustedKeys(ac *accessController) {
+	registry := expvar.Get("registry")
+	if registry == nil {
+		registry = expvar.NewMap("registry")
+	}
+	registry.(*expvar.Map).Set("tokentrustedkeys", expvar.Func(func() any {
+		return ac.trustedKeyInfos()
+	}))
+}
@@ -0,0 +1,203 @@
+package token
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"encoding/json"
+	"encoding/pem"
+	"expvar"
+	"os"
+	"path/filepath"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/go-jose/go-jose/v4"
+)
+
+// writeRootCertFile writes the certificate of the root key to the file name
+// of the directory, returning the key signing tokens with a chain to it.
+func writeRootCertFile(t *testing.T, dir, name string, rootKey *ecdsa.PrivateKey) *jose.JSONWebKey {
+	t.Helper()
+	rootCerts, err := makeRootCerts([]*ecdsa.PrivateKey{rootKey})
+	if err != nil {
+		t.Fatal(err)
+	}
+	data := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: rootCerts[0].Raw})
+	if err := os.WriteFile(filepath.Join(dir, name), data, 0o600); err != nil {
+		t.Fatal(err)
+	}
+	key, err := makeSigningKeyWithChain(rootKey, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return key
+}
+
+func TestRootCertDirRotation(t *testing.T) {
+	rootKeys, err := makeRootKeys(3)
+	if err != nil {
+		t.Fatal(err)
+	}
+	dir := t.TempDir()
+	oldKey := writeRootCertFile(t, dir, "old.pem", rootKeys[0])
+
+	ac := newJWKSAccessController(t, map[string]any{"rootcertdir": dir})
+	ac.certDir.minRescan = time.Hour
+	if err := authorize(t, ac, oldKey); err != nil {
+		t.Fatalf("token signed by the old key was not authorized: %v", err)
+	}
+
+	// The new key is trusted along with the old one once the directory is
+	// scanned.
+	newKey := writeRootCertFile(t, dir, "new.pem", rootKeys[1])
+	if err := authorize(t, ac, newKey); err == nil {
+		t.Fatal("expected the scan to be rate limited")
+	}
+	if err := ac.certDir.rescan(); err != nil {
+		t.Fatal(err)
+	}
+	for name, key := range map[string]*jose.JSONWebKey{"old": oldKey, "new": newKey} {
+		if err := authorize(t, ac, key); err != nil {
+			t.Fatalf("token signed by the %s key was not authorized: %v", name, err)
+		}
+	}
+
+	// Removing the file of the old key revokes it.
+	if err := os.Remove(filepath.Join(dir, "old.pem")); err != nil {
+		t.Fatal(err)
+	}
+	if err := ac.certDir.rescan(); err != nil {
+		t.Fatal(err)
+	}
+	if err := authorize(t, ac, oldKey); err == nil {
+		t.Fatal("token signed by the removed key was authorized")
+	}
+	if err := authorize(t, ac, newKey); err != nil {
+		t.Fatalf("token signed by the new key was not authorized: %v", err)
+	}
+
+	// A file which cannot be parsed keeps the last good certificates, and
+	// fails the health check.
+	if err := os.WriteFile(filepath.Join(dir, "invalid.pem"), []byte("-----BEGIN CERTIFICATE-----\naW52YWxpZA==\n-----END CERTIFICATE-----\n"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	if err := ac.certDir.rescan(); err == nil {
+		t.Fatal("expected the scan to fail")
+	}
+	if err := ac.Check(context.Background()); err == nil {
+		t.Fatal("expected the health check to fail")
+	}
+	if err := authorize(t, ac, newKey); err != nil {
+		t.Fatalf("the last good certificates were dropped: %v", err)
+	}
+	if err := os.Remove(filepath.Join(dir, "invalid.pem")); err != nil {
+		t.Fatal(err)
+	}
+
+	// A token signed by an unknown key triggers a scan.
+	ac.certDir.minRescan = 0
+	nextKey := writeRootCertFile(t, dir, "next.pem", rootKeys[2])
+	if err := authorize(t, ac, nextKey); err != nil {
+		t.Fatalf("token signed by a key added since the last scan was not authorized: %v", err)
+	}
+	if err := ac.Check(context.Background()); err != nil {
+		t.Fatalf("the health check did not recover: %v", err)
+	}
+}
+
+func TestRootCertDirSignal(t *testing.T) {
+	rootKeys, err := makeRootKeys(2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	dir := t.TempDir()
+	writeRootCertFile(t, dir, "old.pem", rootKeys[0])
+
+	ac := newJWKSAccessController(t, map[string]any{"rootcertdir": dir, "rootcertdirrefresh": "1h"})
+	ac.certDir.minRescan = time.Hour
+	newKey := writeRootCertFile(t, dir, "new.pem", rootKeys[1])
+
+	// SIGHUP forces a scan, without waiting for the refresh interval.
+	ac.certDir.hup <- syscall.SIGHUP
+	deadline := time.Now().Add(5 * time.Second)
+	for authorize(t, ac, newKey) != nil {
+		if time.Now().After(deadline) {
+			t.Fatal("the directory was not scanned on SIGHUP")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestRootCertDirWithBundleAndJWKS(t *testing.T) {
+	rootKeys, err := makeRootKeys(2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	bundle, err := writeTempRootCerts(rootKeys[:1])
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(bundle)
+	bundleKey, err := makeSigningKeyWithChain(rootKeys[0], 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	keys := makeJWKSSigningKeys(t, 1)
+	server := newJWKSServer(t)
+	server.serve(keys[0])
+
+	dir := t.TempDir()
+	ac := newJWKSAccessController(t, map[string]any{"rootcertdir": dir, "rootcertbundle": bundle, "jwks": server.URL})
+	ac.certDir.minRescan = 0
+	dirKey := writeRootCertFile(t, dir, "dir.pem", rootKeys[1])
+
+	// The bundle, the directory and the JWKS are trusted together.
+	for name, key := range map[string]*jose.JSONWebKey{"bundle": bundleKey, "directory": dirKey, "jwks": keys[0]} {
+		if err := authorize(t, ac, key); err != nil {
+			t.Fatalf("token signed by the %s key was not authorized: %v", name, err)
+		}
+	}
+
+	// The debug endpoint lists the ID and expiry of the trusted keys.
+	var infos []trustedKeyInfo
+	if err := json.Unmarshal([]byte(expvar.Get("registry").(*expvar.Map).Get("tokentrustedkeys").String()), &infos); err != nil {
+		t.Fatal(err)
+	}
+	if len(infos) != 3 {
+		t.Fatalf("unexpected trusted keys %+v", infos)
+	}
+	var expiring int
+	for _, info := range infos {
+		if info.NotAfter != nil {
+			expiring++
+		}
+	}
+	if expiring != 2 {
+		t.Fatalf("expected the expiry of the 2 root certificates, got %+v", infos)
+	}
+}
+
+func TestRootCertDirOptions(t *testing.T) {
+	options := map[string]any{
+		"realm":       "https://auth.example.com/token/",
+		"issuer":      jwksTestIssuer,
+		"service":     jwksTestService,
+		"rootcertdir": filepath.Join(t.TempDir(), "missing"),
+	}
+	if err := validateOptions(options); err == nil {
+		t.Fatal("expected an error for a missing directory")
+	}
+
+	// An empty directory holds no signing key.
+	options["rootcertdir"] = t.TempDir()
+	if err := validateOptions(options); err == nil {
+		t.Fatal("expected an error without any signing key")
+	}
+
+	options["rootcertdirrefresh"] = "0s"
+	if _, err := checkOptions(options); err == nil {
+		t.Fatal("expected an error for an invalid refresh interval")
+	}
+}
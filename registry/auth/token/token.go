@@ -2,9 +2,14 @@ package token
 
 import (
 	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rsa"
 	"crypto/x509"
 	"errors"
 	"fmt"
+	"strings"
 	"time"
 
 	"github.com/go-jose/go-jose/v4"
@@ -95,8 +100,13 @@ type Token struct {
 type VerifyOptions struct {
 	TrustedIssuers    []string
 	AcceptedAudiences []string
-	Roots             *x509.CertPool
-	TrustedKeys       map[string]crypto.PublicKey
+	// StrictAudience requires every audience of the token to be accepted,
+	// rather than any of them.
+	StrictAudience bool
+	// KeyIDPrefix, if set, is required of the ID of the signing key.
+	KeyIDPrefix string
+	Roots       *x509.CertPool
+	TrustedKeys map[string]crypto.PublicKey
 }
 
 // NewToken parses the given raw token string
@@ -123,6 +133,13 @@ func (t *Token) Verify(verifyOpts VerifyOptions) (*ClaimSet, error) {
 		return nil, ErrInvalidToken
 	}
 
+	// Verify that the signing algorithm is the one of the key type, so that
+	// a token cannot pick a weaker verification than the key was meant for.
+	if err := checkSigningAlgorithm(t.JWT.Headers[0].Algorithm, signingKey); err != nil {
+		log.Infof("failed to verify token: %v", err)
+		return nil, ErrInvalidToken
+	}
+
 	// NOTE(milosgajdos): Claims both verifies the signature
 	// and returns the claims within the payload
 	var claims ClaimSet
@@ -133,13 +150,20 @@ func (t *Token) Verify(verifyOpts VerifyOptions) (*ClaimSet, error) {
 
 	// Verify that the Issuer claim is a trusted authority.
 	if !contains(verifyOpts.TrustedIssuers, claims.Issuer) {
-		log.Infof("token from untrusted issuer: %q", claims.Issuer)
+		rejectClaim(&claims, "iss", verifyOpts.TrustedIssuers, claims.Issuer)
 		return nil, ErrInvalidToken
 	}
 
 	// Verify that the Audience claim is allowed.
-	if !containsAny(verifyOpts.AcceptedAudiences, claims.Audience) {
-		log.Infof("token intended for another audience: %v", claims.Audience)
+	if !containsAny(verifyOpts.AcceptedAudiences, claims.Audience) ||
+		(verifyOpts.StrictAudience && !containsAll(verifyOpts.AcceptedAudiences, claims.Audience)) {
+		rejectClaim(&claims, "aud", verifyOpts.AcceptedAudiences, claims.Audience)
+		return nil, ErrInvalidToken
+	}
+
+	// Verify that the signing key is one of those meant for this registry.
+	if keyID := t.keyID(); !strings.HasPrefix(keyID, verifyOpts.KeyIDPrefix) {
+		rejectClaim(&claims, "kid", verifyOpts.KeyIDPrefix+"*", keyID)
 		return nil, ErrInvalidToken
 	}
 
@@ -161,6 +185,29 @@ func (t *Token) Verify(verifyOpts VerifyOptions) (*ClaimSet, error) {
 	return &claims, nil
 }
 
+// rejectClaim logs the claim of the token which failed verification, with the
+// expected and actual values, and the token ID for correlation.
+func rejectClaim(claims *ClaimSet, claim string, expected, got any) {
+	log.WithFields(log.Fields{
+		"claim":    claim,
+		"expected": expected,
+		"got":      got,
+		"jti":      claims.JWTID,
+	}).Info("token rejected")
+}
+
+// keyID returns the ID of the key which signed the token.
+func (t *Token) keyID() string {
+	if len(t.JWT.Headers) == 0 {
+		return ""
+	}
+	header := t.JWT.Headers[0]
+	if header.JSONWebKey != nil {
+		return header.JSONWebKey.KeyID
+	}
+	return header.KeyID
+}
+
 // VerifySigningKey attempts to verify and return the signing key which was used to sign the token.
 func (t *Token) VerifySigningKey(verifyOpts VerifyOptions) (crypto.PublicKey, error) {
 	if len(t.JWT.Headers) == 0 {
@@ -269,6 +316,44 @@ func getCertPubKey(chains [][]*x509.Certificate) crypto.PublicKey {
 	return cert.PublicKey.(crypto.PublicKey)
 }
 
+// checkSigningAlgorithm returns an error if a token signed with alg cannot be
+// verified by key: EdDSA requires an Ed25519 key, ES256, ES384 and ES512 an
+// ECDSA key on the matching curve, RS* and PS* an RSA key and HS* a shared
+// secret.
+func checkSigningAlgorithm(alg string, key crypto.PublicKey) error {
+	switch k := key.(type) {
+	case jose.JSONWebKey:
+		return checkSigningAlgorithm(alg, k.Key)
+	case *jose.JSONWebKey:
+		return checkSigningAlgorithm(alg, k.Key)
+	}
+
+	var ok bool
+	switch jose.SignatureAlgorithm(alg) {
+	case jose.EdDSA:
+		_, ok = key.(ed25519.PublicKey)
+	case jose.ES256:
+		ok = isECDSAKey(key, elliptic.P256())
+	case jose.ES384:
+		ok = isECDSAKey(key, elliptic.P384())
+	case jose.ES512:
+		ok = isECDSAKey(key, elliptic.P521())
+	case jose.RS256, jose.RS384, jose.RS512, jose.PS256, jose.PS384, jose.PS512:
+		_, ok = key.(*rsa.PublicKey)
+	case jose.HS256, jose.HS384, jose.HS512:
+		_, ok = key.([]byte)
+	}
+	if !ok {
+		return fmt.Errorf("signing algorithm %q does not match the %T signing key", alg, key)
+	}
+	return nil
+}
+
+func isECDSAKey(key crypto.PublicKey, curve elliptic.Curve) bool {
+	k, ok := key.(*ecdsa.PublicKey)
+	return ok && k.Curve == curve
+}
+
 // accessSet returns a set of actions available for the resource
 // actions listed in the `access` section of this token.
 func (c *ClaimSet) accessSet() accessSet {
@@ -3,18 +3,22 @@ package token
 import (
 	"crypto"
 	"crypto/ecdsa"
+	"crypto/ed25519"
 	"crypto/elliptic"
 	"crypto/rand"
+	"crypto/rsa"
 	"crypto/x509"
 	"crypto/x509/pkix"
 	"encoding/base64"
 	"encoding/json"
 	"encoding/pem"
+	"errors"
 	"fmt"
 	"math/big"
 	"net"
 	"net/http"
 	"os"
+	"path/filepath"
 	"testing"
 	"time"
 
@@ -93,26 +97,16 @@ func makeSigningKeyWithChain(rootKey *ecdsa.PrivateKey, depth int) (*jose.JSONWe
 }
 
 func makeTestToken(jwk *jose.JSONWebKey, issuer, audience string, access []*ResourceActions, now time.Time, exp time.Time) (*Token, error) {
-	signingKey := jose.SigningKey{
-		Algorithm: jose.ES256,
-		Key:       jwk,
-	}
-	signerOpts := jose.SignerOptions{
-		EmbedJWK: true,
-	}
-	signerOpts.WithType("JWT")
-
-	signer, err := jose.NewSigner(signingKey, &signerOpts)
-	if err != nil {
-		return nil, fmt.Errorf("unable to create a signer: %s", err)
-	}
+	return makeTestTokenWithAlgorithm(jwk, jose.ES256, issuer, audience, access, now, exp)
+}
 
+func makeTestTokenWithAlgorithm(jwk *jose.JSONWebKey, alg jose.SignatureAlgorithm, issuer, audience string, access []*ResourceActions, now time.Time, exp time.Time) (*Token, error) {
 	randomBytes := make([]byte, 15)
-	if _, err = rand.Read(randomBytes); err != nil {
+	if _, err := rand.Read(randomBytes); err != nil {
 		return nil, fmt.Errorf("unable to read random bytes for jwt id: %s", err)
 	}
 
-	claimSet := &ClaimSet{
+	return makeTestTokenWithClaims(jwk, alg, &ClaimSet{
 		Issuer:     issuer,
 		Subject:    "foo",
 		Audience:   []string{audience},
@@ -121,6 +115,22 @@ func makeTestToken(jwk *jose.JSONWebKey, issuer, audience string, access []*Reso
 		IssuedAt:   now.Unix(),
 		JWTID:      base64.URLEncoding.EncodeToString(randomBytes),
 		Access:     access,
+	})
+}
+
+func makeTestTokenWithClaims(jwk *jose.JSONWebKey, alg jose.SignatureAlgorithm, claimSet *ClaimSet) (*Token, error) {
+	signingKey := jose.SigningKey{
+		Algorithm: alg,
+		Key:       jwk,
+	}
+	signerOpts := jose.SignerOptions{
+		EmbedJWK: true,
+	}
+	signerOpts.WithType("JWT")
+
+	signer, err := jose.NewSigner(signingKey, &signerOpts)
+	if err != nil {
+		return nil, fmt.Errorf("unable to create a signer: %s", err)
 	}
 
 	tokenString, err := jwt.Signed(signer).Claims(claimSet).Serialize()
@@ -279,6 +289,103 @@ func TestTokenVerify(t *testing.T) {
 	}
 }
 
+// This tests that tokens are rejected unless their issuer, audience and key
+// ID are those expected of the registry.
+func TestTokenVerifyClaims(t *testing.T) {
+	rootKeys, err := makeRootKeys(1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	jwk, err := makeSigningKeyWithChain(rootKeys[0], 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	trustedKeys := map[string]crypto.PublicKey{jwk.KeyID: jwk.Public()}
+
+	for _, tc := range []struct {
+		name     string
+		issuer   string
+		audience []string
+		opts     VerifyOptions
+		valid    bool
+	}{
+		{
+			name:     "trusted issuer",
+			issuer:   "production-issuer",
+			audience: []string{"registry.example.com"},
+			opts:     VerifyOptions{TrustedIssuers: []string{"staging-issuer", "production-issuer"}, AcceptedAudiences: []string{"registry.example.com"}},
+			valid:    true,
+		},
+		{
+			name:     "wrong issuer",
+			issuer:   "staging-issuer",
+			audience: []string{"registry.example.com"},
+			opts:     VerifyOptions{TrustedIssuers: []string{"production-issuer"}, AcceptedAudiences: []string{"registry.example.com"}},
+		},
+		{
+			name:     "array audience",
+			issuer:   "production-issuer",
+			audience: []string{"registry.example.com", "mirror.example.com"},
+			opts:     VerifyOptions{TrustedIssuers: []string{"production-issuer"}, AcceptedAudiences: []string{"mirror.example.com"}},
+			valid:    true,
+		},
+		{
+			name:     "array audience with another registry",
+			issuer:   "production-issuer",
+			audience: []string{"registry.example.com", "staging.example.com"},
+			opts:     VerifyOptions{TrustedIssuers: []string{"production-issuer"}, AcceptedAudiences: []string{"registry.example.com"}, StrictAudience: true},
+		},
+		{
+			name:     "strict array audience",
+			issuer:   "production-issuer",
+			audience: []string{"registry.example.com", "mirror.example.com"},
+			opts:     VerifyOptions{TrustedIssuers: []string{"production-issuer"}, AcceptedAudiences: []string{"registry.example.com", "mirror.example.com"}, StrictAudience: true},
+			valid:    true,
+		},
+		{
+			name:   "no audience",
+			issuer: "production-issuer",
+			opts:   VerifyOptions{TrustedIssuers: []string{"production-issuer"}, AcceptedAudiences: []string{"registry.example.com"}, StrictAudience: true},
+		},
+		{
+			name:     "key ID prefix",
+			issuer:   "production-issuer",
+			audience: []string{"registry.example.com"},
+			opts:     VerifyOptions{TrustedIssuers: []string{"production-issuer"}, AcceptedAudiences: []string{"registry.example.com"}, KeyIDPrefix: jwk.KeyID[:4]},
+			valid:    true,
+		},
+		{
+			name:     "wrong key ID prefix",
+			issuer:   "production-issuer",
+			audience: []string{"registry.example.com"},
+			opts:     VerifyOptions{TrustedIssuers: []string{"production-issuer"}, AcceptedAudiences: []string{"registry.example.com"}, KeyIDPrefix: "staging-"},
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			token, err := makeTestTokenWithClaims(jwk, jose.ES256, &ClaimSet{
+				Issuer:     tc.issuer,
+				Subject:    "foo",
+				Audience:   tc.audience,
+				Expiration: time.Now().Add(5 * time.Minute).Unix(),
+				NotBefore:  time.Now().Unix(),
+				IssuedAt:   time.Now().Unix(),
+				JWTID:      tc.name,
+			})
+			if err != nil {
+				t.Fatal(err)
+			}
+			tc.opts.TrustedKeys = trustedKeys
+			_, err = token.Verify(tc.opts)
+			if tc.valid && err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if !tc.valid && !errors.Is(err, ErrInvalidToken) {
+				t.Fatalf("expected %v, got %v", ErrInvalidToken, err)
+			}
+		})
+	}
+}
+
 // This tests that we don't fail tokens with nbf within
 // the defined leeway in seconds
 func TestLeeway(t *testing.T) {
@@ -700,3 +807,177 @@ func TestVerifyJWKWithTrustedKey(t *testing.T) {
 		t.Errorf("Expected 'untrusted JWK with no certificate chain' error, got: %v", err)
 	}
 }
+
+// This test makes tokens signed with Ed25519 keys, trusted through a root
+// certificate bundle with a certificate chain, and through a JWKS.
+func TestTokenVerifyEd25519(t *testing.T) {
+	var (
+		issuer   = "test-issuer"
+		audience = "test-audience"
+		access   = []*ResourceActions{
+			{
+				Type:    "repository",
+				Name:    "foo/bar",
+				Actions: []string{"pull", "push"},
+			},
+		}
+	)
+
+	rootPub, rootKey, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rootCert, err := generateCert(rootKey, rootPub, &certTemplateInfo{commonName: "ed25519 root", isCA: true}, &certTemplateInfo{commonName: "ed25519 root"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	signingPub, signingKey, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	signingCert, err := generateCert(rootKey, signingPub, &certTemplateInfo{commonName: "ed25519 signing", isCA: true}, &certTemplateInfo{commonName: "ed25519 root"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	dir := t.TempDir()
+	rootCertBundleFilename := filepath.Join(dir, "bundle.pem")
+	if err := os.WriteFile(rootCertBundleFilename, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: rootCert.Raw}), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	_, jwksKey, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	jwksFilename := filepath.Join(dir, "jwks.json")
+	jwks, err := json.Marshal(jose.JSONWebKeySet{Keys: []jose.JSONWebKey{{
+		Key:       jwksKey.Public(),
+		KeyID:     "ed25519-jwks",
+		Algorithm: string(jose.EdDSA),
+		Use:       "sig",
+	}}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(jwksFilename, jwks, 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	ac, err := newAccessController(map[string]any{
+		"realm":          "https://auth.example.com/token/",
+		"issuer":         issuer,
+		"service":        audience,
+		"rootcertbundle": rootCertBundleFilename,
+		"jwks":           jwksFilename,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ecdsaKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, tc := range []struct {
+		name  string
+		jwk   *jose.JSONWebKey
+		alg   jose.SignatureAlgorithm
+		valid bool
+	}{
+		{
+			name:  "certificate chain",
+			jwk:   &jose.JSONWebKey{Key: signingKey, KeyID: "ed25519-chain", Certificates: []*x509.Certificate{signingCert}},
+			alg:   jose.EdDSA,
+			valid: true,
+		},
+		{
+			name:  "jwks",
+			jwk:   &jose.JSONWebKey{Key: jwksKey, KeyID: "ed25519-jwks"},
+			alg:   jose.EdDSA,
+			valid: true,
+		},
+		{
+			name: "untrusted key",
+			jwk:  &jose.JSONWebKey{Key: signingKey, KeyID: "ed25519-untrusted"},
+			alg:  jose.EdDSA,
+		},
+		{
+			// The token claims to be signed with ES256 by the ID of an
+			// Ed25519 key.
+			name: "algorithm mismatch",
+			jwk:  &jose.JSONWebKey{Key: ecdsaKey, KeyID: "ed25519-jwks"},
+			alg:  jose.ES256,
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			token, err := makeTestTokenWithAlgorithm(tc.jwk, tc.alg, issuer, audience, access, time.Now(), time.Now().Add(5*time.Minute))
+			if err != nil {
+				t.Fatal(err)
+			}
+			req, err := http.NewRequest(http.MethodGet, "http://example.com/foo", nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			req.Header.Set("Authorization", "Bearer "+token.Raw)
+
+			_, err = ac.Authorized(req, auth.Access{
+				Resource: auth.Resource{Type: "repository", Name: "foo/bar"},
+				Action:   "pull",
+			})
+			if tc.valid && err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if !tc.valid && err == nil {
+				t.Fatal("expected the token to be rejected")
+			}
+		})
+	}
+}
+
+func TestCheckSigningAlgorithm(t *testing.T) {
+	edKey, _, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	p256Key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	p384Key, err := ecdsa.GenerateKey(elliptic.P384(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rsaKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, tc := range []struct {
+		alg   jose.SignatureAlgorithm
+		key   crypto.PublicKey
+		valid bool
+	}{
+		{jose.EdDSA, edKey, true},
+		{jose.EdDSA, jose.JSONWebKey{Key: edKey}, true},
+		{jose.EdDSA, &p256Key.PublicKey, false},
+		{jose.ES256, &p256Key.PublicKey, true},
+		{jose.ES256, edKey, false},
+		{jose.ES256, &p384Key.PublicKey, false},
+		{jose.ES384, &p384Key.PublicKey, true},
+		{jose.RS256, &rsaKey.PublicKey, true},
+		{jose.PS512, &rsaKey.PublicKey, true},
+		{jose.RS256, edKey, false},
+		{jose.HS256, edKey, false},
+		{jose.HS256, &rsaKey.PublicKey, false},
+		{"none", edKey, false},
+	} {
+		err := checkSigningAlgorithm(string(tc.alg), tc.key)
+		if tc.valid && err != nil {
+			t.Errorf("unexpected error for %s with %T: %v", tc.alg, tc.key, err)
+		}
+		if !tc.valid && err == nil {
+			t.Errorf("expected an error for %s with %T", tc.alg, tc.key)
+		}
+	}
+}
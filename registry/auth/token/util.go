@@ -43,6 +43,17 @@ func containsAny(ss []string, q []string) bool {
 	return false
 }
 
+// containsAll returns true if all of q are found in ss.
+func containsAll(ss []string, q []string) bool {
+	for _, s := range q {
+		if !contains(ss, s) {
+			return false
+		}
+	}
+
+	return true
+}
+
 // NOTE: RFC7638 does not prescribe which hashing function to use, but suggests
 // sha256 as a sane default as of time of writing
 func hashAndEncode(payload string) string {
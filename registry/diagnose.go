@@ -0,0 +1,63 @@
+package registry
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"time"
+
+	"github.com/distribution/distribution/v3/configuration"
+	"github.com/distribution/distribution/v3/registry/proxy"
+)
+
+// diagnoseECRRemotes diagnoses the credentials of the ECR remotes of the pull
+// through cache.
+func diagnoseECRRemotes(config *configuration.Configuration) ([]proxy.ECRDiagnosis, error) {
+	var diagnoses []proxy.ECRDiagnosis
+	for _, remote := range config.Proxy.RemoteConfigs() {
+		if remote.ECR != nil {
+			diagnoses = append(diagnoses, proxy.DiagnoseECR(remote))
+		}
+	}
+	if len(diagnoses) == 0 {
+		return nil, errors.New("no proxy remote has ecr credentials configured")
+	}
+	return diagnoses, nil
+}
+
+// writeECRDiagnoses writes the diagnoses as text, or as a JSON list if
+// asJSON is set.
+func writeECRDiagnoses(w io.Writer, diagnoses []proxy.ECRDiagnosis, asJSON bool) error {
+	if asJSON {
+		enc := json.NewEncoder(w)
+		enc.SetIndent("", "  ")
+		return enc.Encode(diagnoses)
+	}
+	for i, d := range diagnoses {
+		if i > 0 {
+			fmt.Fprintln(w)
+		}
+		fmt.Fprintf(w, "remote:      %s\n", d.RemoteURL)
+		if d.AccountID != "" {
+			fmt.Fprintf(w, "account:     %s (%s)\n", d.AccountID, d.Region)
+		}
+		fmt.Fprintf(w, "credentials: %s\n", d.Credentials)
+		if d.Provider != "" {
+			fmt.Fprintf(w, "provider:    %s\n", d.Provider)
+			fmt.Fprintf(w, "access key:  %s\n", d.AccessKeyID)
+		}
+		switch {
+		case d.Identity != "":
+			fmt.Fprintf(w, "identity:    %s\n", d.Identity)
+		case d.IdentityError != "":
+			fmt.Fprintf(w, "identity:    unknown, %s\n", d.IdentityError)
+		}
+		if d.FailedStep != "" {
+			fmt.Fprintf(w, "failed:      %s: %s\n", d.FailedStep, d.Error)
+		} else if d.TokenExpiry != nil {
+			fmt.Fprintf(w, "token:       granted, expires %s\n", d.TokenExpiry.UTC().Format(time.RFC3339))
+		}
+	}
+	return nil
+}
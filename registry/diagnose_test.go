@@ -0,0 +1,87 @@
+package registry
+
+import (
+	"bytes"
+	"encoding/json"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/distribution/distribution/v3/configuration"
+	"github.com/distribution/distribution/v3/registry/proxy"
+)
+
+func TestDiagnoseECRRemotes(t *testing.T) {
+	config := &configuration.Configuration{}
+	config.Proxy.Remotes = []configuration.ProxyRemote{
+		{RemoteURL: "https://registry-1.docker.io"},
+		{RemoteURL: "https://registry.example.com", ECR: &configuration.ECRConfig{}},
+	}
+	diagnoses, err := diagnoseECRRemotes(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(diagnoses) != 1 || diagnoses[0].RemoteURL != "https://registry.example.com" {
+		t.Fatalf("expected the ecr remote only to be diagnosed, got %+v", diagnoses)
+	}
+	if diagnoses[0].FailedStep != proxy.ECRStepConfig {
+		t.Fatalf("expected the diagnosis of a remote which is not an ecr registry to fail, got %+v", diagnoses[0])
+	}
+
+	config.Proxy.Remotes = config.Proxy.Remotes[:1]
+	if _, err := diagnoseECRRemotes(config); err == nil {
+		t.Fatal("expected an error without any ecr remote")
+	}
+}
+
+func TestWriteECRDiagnoses(t *testing.T) {
+	expiry := time.Date(2026, 1, 2, 3, 4, 5, 0, time.UTC)
+	diagnoses := []proxy.ECRDiagnosis{
+		{
+			RemoteURL:   "https://123456789012.dkr.ecr.us-west-2.amazonaws.com",
+			AccountID:   "123456789012",
+			Region:      "us-west-2",
+			Credentials: "default chain",
+			Provider:    "WebIdentityCredentials",
+			AccessKeyID: "ASIAWEB",
+			Identity:    "arn:aws:sts::123456789012:assumed-role/registry/session",
+			TokenExpiry: &expiry,
+		},
+		{
+			RemoteURL:   "https://210987654321.dkr.ecr.eu-west-1.amazonaws.com",
+			AccountID:   "210987654321",
+			Region:      "eu-west-1",
+			Credentials: "profile ci",
+			FailedStep:  proxy.ECRStepCredentials,
+			Error:       "SharedCredsLoad: failed to load shared credentials file",
+		},
+	}
+
+	var text bytes.Buffer
+	if err := writeECRDiagnoses(&text, diagnoses, false); err != nil {
+		t.Fatal(err)
+	}
+	for _, expected := range []string{
+		"provider:    WebIdentityCredentials\n",
+		"identity:    arn:aws:sts::123456789012:assumed-role/registry/session\n",
+		"token:       granted, expires 2026-01-02T03:04:05Z\n",
+		"credentials: profile ci\n",
+		"failed:      credentials: SharedCredsLoad: failed to load shared credentials file\n",
+	} {
+		if !strings.Contains(text.String(), expected) {
+			t.Fatalf("expected %q in the output:\n%s", expected, text.String())
+		}
+	}
+
+	var out bytes.Buffer
+	if err := writeECRDiagnoses(&out, diagnoses, true); err != nil {
+		t.Fatal(err)
+	}
+	var decoded []proxy.ECRDiagnosis
+	if err := json.Unmarshal(out.Bytes(), &decoded); err != nil {
+		t.Fatal(err)
+	}
+	if len(decoded) != 2 || decoded[0].Provider != "WebIdentityCredentials" || decoded[1].FailedStep != proxy.ECRStepCredentials {
+		t.Fatalf("unexpected diagnoses decoded: %+v", decoded)
+	}
+}
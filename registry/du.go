@@ -0,0 +1,36 @@
+package registry
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"text/tabwriter"
+
+	"github.com/distribution/distribution/v3/registry/storage"
+)
+
+// writeDiskUsageReport writes the usage of the top repositories of the
+// report, every repository if top is 0, and a summary as text, or the report
+// as JSON if asJSON is set. The summary covers every repository.
+func writeDiskUsageReport(w io.Writer, report *storage.DiskUsageReport, top int, asJSON bool) error {
+	if top > 0 && top < len(report.Repositories) {
+		trimmed := *report
+		trimmed.Repositories = report.Repositories[:top]
+		report = &trimmed
+	}
+	if asJSON {
+		enc := json.NewEncoder(w)
+		enc.SetIndent("", "  ")
+		return enc.Encode(report)
+	}
+	tw := tabwriter.NewWriter(w, 0, 4, 2, ' ', tabwriter.AlignRight)
+	fmt.Fprintln(tw, "EXCLUSIVE\tSHARED\tTAGS\tMANIFESTS\t\tREPOSITORY")
+	for _, r := range report.Repositories {
+		fmt.Fprintf(tw, "%d\t%d\t%d\t%d\t\t%s\n", r.ExclusiveBytes, r.SharedBytes, r.Tags, r.Manifests, r.Name)
+	}
+	if err := tw.Flush(); err != nil {
+		return err
+	}
+	_, err := fmt.Fprintf(w, "%d blobs, %d bytes, %d unlinked blobs, %d bytes\n", report.Blobs, report.Bytes, report.UnlinkedBlobs, report.UnlinkedBytes)
+	return err
+}
@@ -0,0 +1,48 @@
+package registry
+
+import (
+	"bytes"
+	"encoding/json"
+	"testing"
+
+	"github.com/distribution/distribution/v3/registry/storage"
+)
+
+func TestWriteDiskUsageReport(t *testing.T) {
+	report := &storage.DiskUsageReport{
+		Repositories: []storage.RepositoryUsage{
+			{Name: "team/app", Tags: 2, Manifests: 3, ExclusiveBytes: 1000, SharedBytes: 50},
+			{Name: "library/base", Manifests: 1, SharedBytes: 50},
+		},
+		Blobs:         4,
+		Bytes:         1057,
+		UnlinkedBlobs: 1,
+		UnlinkedBytes: 7,
+	}
+
+	var buf bytes.Buffer
+	if err := writeDiskUsageReport(&buf, report, 1, false); err != nil {
+		t.Fatal(err)
+	}
+	expected := "  EXCLUSIVE  SHARED  TAGS  MANIFESTS  REPOSITORY\n" +
+		"       1000      50     2          3  team/app\n" +
+		"4 blobs, 1057 bytes, 1 unlinked blobs, 7 bytes\n"
+	if buf.String() != expected {
+		t.Fatalf("unexpected report:\n%s\nexpected:\n%s", buf.String(), expected)
+	}
+
+	buf.Reset()
+	if err := writeDiskUsageReport(&buf, report, 0, true); err != nil {
+		t.Fatal(err)
+	}
+	var decoded storage.DiskUsageReport
+	if err := json.Unmarshal(buf.Bytes(), &decoded); err != nil {
+		t.Fatal(err)
+	}
+	if len(decoded.Repositories) != 2 || decoded.Repositories[1].Name != "library/base" || decoded.UnlinkedBytes != 7 {
+		t.Fatalf("unexpected JSON report %+v", decoded)
+	}
+	if len(report.Repositories) != 2 {
+		t.Fatal("the report was trimmed in place")
+	}
+}
@@ -0,0 +1,259 @@
+package registry
+
+import (
+	"archive/tar"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"path"
+	"slices"
+
+	"github.com/distribution/reference"
+	"github.com/opencontainers/go-digest"
+	v1 "github.com/opencontainers/image-spec/specs-go/v1"
+
+	"github.com/distribution/distribution/v3"
+	"github.com/distribution/distribution/v3/internal/dcontext"
+	"github.com/distribution/distribution/v3/manifest/schema2"
+)
+
+// exportOpts configures an export.
+type exportOpts struct {
+	// Tags are glob patterns of the tags exported, every tag if empty.
+	Tags []string
+	// Referrers also exports the manifests whose subject is a manifest
+	// exported, and theirs.
+	Referrers bool
+}
+
+// exportReport counts the content of an export.
+type exportReport struct {
+	Tags      int   `json:"tags"`
+	Manifests int   `json:"manifests"`
+	Blobs     int   `json:"blobs"`
+	Bytes     int64 `json:"bytes"`
+}
+
+// exportLayout writes the tags of the repository matching the patterns of
+// opts, with the manifests and blobs they reference, to w as a tar archive of
+// an OCI image layout. The index of the layout holds a descriptor per tag,
+// annotated with its name, and the descriptors of the referrers exported.
+// Each blob is written once, however many manifests reference it.
+func exportLayout(ctx context.Context, registry distribution.Namespace, name string, opts exportOpts, w io.Writer) (*exportReport, error) {
+	named, err := reference.WithName(name)
+	if err != nil {
+		return nil, err
+	}
+	repo, err := registry.Repository(ctx, named)
+	if err != nil {
+		return nil, err
+	}
+	manifests, err := repo.Manifests(ctx)
+	if err != nil {
+		return nil, err
+	}
+	for _, pattern := range opts.Tags {
+		if _, err := path.Match(pattern, ""); err != nil {
+			return nil, fmt.Errorf("invalid pattern %q: %v", pattern, err)
+		}
+	}
+
+	all, err := repo.Tags(ctx).All(ctx)
+	if err != nil {
+		return nil, err
+	}
+	var tags []string
+	for _, tag := range all {
+		if len(opts.Tags) == 0 || slices.ContainsFunc(opts.Tags, func(pattern string) bool {
+			matched, _ := path.Match(pattern, tag)
+			return matched
+		}) {
+			tags = append(tags, tag)
+		}
+	}
+	if len(tags) == 0 {
+		return nil, fmt.Errorf("no tag of %s to export", name)
+	}
+	slices.Sort(tags)
+
+	e := &layoutExporter{
+		repo:      repo,
+		manifests: manifests,
+		tw:        tar.NewWriter(w),
+		opts:      opts,
+		written:   make(map[digest.Digest]v1.Descriptor),
+		report:    &exportReport{},
+	}
+	layout, err := json.Marshal(v1.ImageLayout{Version: v1.ImageLayoutVersion})
+	if err != nil {
+		return nil, err
+	}
+	if err := e.writeFile(v1.ImageLayoutFile, layout); err != nil {
+		return e.report, err
+	}
+
+	index := v1.Index{MediaType: v1.MediaTypeImageIndex}
+	index.SchemaVersion = 2
+	for _, tag := range tags {
+		desc, err := repo.Tags(ctx).Get(ctx, tag)
+		if err != nil {
+			return e.report, fmt.Errorf("tag %s: %v", tag, err)
+		}
+		desc, err = e.exportManifest(ctx, desc.Digest)
+		if err != nil {
+			return e.report, fmt.Errorf("tag %s: %v", tag, err)
+		}
+		desc.Annotations = map[string]string{v1.AnnotationRefName: tag}
+		index.Manifests = append(index.Manifests, desc)
+		e.report.Tags++
+	}
+	index.Manifests = append(index.Manifests, e.referrers...)
+
+	content, err := json.Marshal(index)
+	if err != nil {
+		return e.report, err
+	}
+	if err := e.writeFile(v1.ImageIndexFile, content); err != nil {
+		return e.report, err
+	}
+	return e.report, e.tw.Close()
+}
+
+// layoutExporter writes the manifests and blobs of a repository to the tar
+// archive of a layout.
+type layoutExporter struct {
+	repo      distribution.Repository
+	manifests distribution.ManifestService
+	tw        *tar.Writer
+	opts      exportOpts
+	// written holds the descriptors of the manifests and blobs written.
+	written map[digest.Digest]v1.Descriptor
+	// referrers are the descriptors of the referrers written.
+	referrers []v1.Descriptor
+	report    *exportReport
+}
+
+// exportManifest writes the manifest, after the manifests and blobs it
+// references and, with opts.Referrers, its referrers, and returns its
+// descriptor. The images of an index the repository lacks, as left by a sync
+// of some platforms, are skipped.
+func (e *layoutExporter) exportManifest(ctx context.Context, dgst digest.Digest) (v1.Descriptor, error) {
+	if desc, ok := e.written[dgst]; ok {
+		return desc, nil
+	}
+	m, err := e.manifests.Get(ctx, dgst)
+	if err != nil {
+		return v1.Descriptor{}, fmt.Errorf("manifest %s: %w", dgst, err)
+	}
+	mediaType, payload, err := m.Payload()
+	if err != nil {
+		return v1.Descriptor{}, err
+	}
+
+	manifestTypes := distribution.ManifestMediaTypes()
+	for _, desc := range m.References() {
+		switch {
+		case slices.Contains(manifestTypes, desc.MediaType):
+			if _, err := e.exportManifest(ctx, desc.Digest); err != nil {
+				var unknown distribution.ErrManifestUnknownRevision
+				if !errors.As(err, &unknown) {
+					return v1.Descriptor{}, err
+				}
+				dcontext.GetLogger(ctx).Warnf("skipping the manifest %s of the index %s, unknown to the repository", desc.Digest, dgst)
+			}
+		case desc.MediaType == schema2.MediaTypeForeignLayer, len(desc.URLs) > 0:
+			// The non-distributable layers are pulled from their urls.
+		default:
+			if err := e.exportBlob(ctx, desc.Digest); err != nil {
+				return v1.Descriptor{}, err
+			}
+		}
+	}
+
+	if err := e.writeBlob(dgst, payload); err != nil {
+		return v1.Descriptor{}, err
+	}
+	desc := v1.Descriptor{MediaType: mediaType, Digest: dgst, Size: int64(len(payload))}
+	e.written[dgst] = desc
+	e.report.Manifests++
+
+	if e.opts.Referrers {
+		lister, ok := e.manifests.(distribution.ReferrersLister)
+		if !ok {
+			return v1.Descriptor{}, fmt.Errorf("the referrers of %s cannot be listed", dgst)
+		}
+		referrers, err := lister.Referrers(ctx, dgst, "")
+		if err != nil {
+			return v1.Descriptor{}, fmt.Errorf("referrers of %s: %v", dgst, err)
+		}
+		for _, referrer := range referrers {
+			if _, ok := e.written[referrer.Digest]; ok {
+				continue
+			}
+			if _, err := e.exportManifest(ctx, referrer.Digest); err != nil {
+				return v1.Descriptor{}, err
+			}
+			e.referrers = append(e.referrers, referrer)
+		}
+	}
+	return desc, nil
+}
+
+// exportBlob streams the blob into the archive, unless written already.
+func (e *layoutExporter) exportBlob(ctx context.Context, dgst digest.Digest) error {
+	if _, ok := e.written[dgst]; ok {
+		return nil
+	}
+	desc, err := e.repo.Blobs(ctx).Stat(ctx, dgst)
+	if err != nil {
+		return fmt.Errorf("blob %s: %v", dgst, err)
+	}
+	rc, err := e.repo.Blobs(ctx).Open(ctx, dgst)
+	if err != nil {
+		return fmt.Errorf("blob %s: %v", dgst, err)
+	}
+	defer rc.Close()
+	if err := e.tw.WriteHeader(layoutHeader(blobPath(dgst), desc.Size)); err != nil {
+		return err
+	}
+	if _, err := io.CopyN(e.tw, rc, desc.Size); err != nil {
+		return fmt.Errorf("blob %s: %v", dgst, err)
+	}
+	e.written[dgst] = desc
+	e.report.Blobs++
+	e.report.Bytes += desc.Size
+	return nil
+}
+
+// writeBlob writes the content of a manifest to its blob.
+func (e *layoutExporter) writeBlob(dgst digest.Digest, content []byte) error {
+	if err := e.writeFile(blobPath(dgst), content); err != nil {
+		return err
+	}
+	e.report.Bytes += int64(len(content))
+	return nil
+}
+
+func (e *layoutExporter) writeFile(name string, content []byte) error {
+	if err := e.tw.WriteHeader(layoutHeader(name, int64(len(content)))); err != nil {
+		return err
+	}
+	_, err := e.tw.Write(content)
+	return err
+}
+
+// blobPath returns the path of the blob in a layout.
+func blobPath(dgst digest.Digest) string {
+	return path.Join(v1.ImageBlobsDir, dgst.Algorithm().String(), dgst.Encoded())
+}
+
+func layoutHeader(name string, size int64) *tar.Header {
+	return &tar.Header{
+		Typeflag: tar.TypeReg,
+		Name:     name,
+		Size:     size,
+		Mode:     0o644,
+	}
+}
@@ -0,0 +1,139 @@
+package registry
+
+import (
+	"archive/tar"
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"strings"
+	"testing"
+
+	"github.com/opencontainers/go-digest"
+	"github.com/opencontainers/image-spec/specs-go"
+	v1 "github.com/opencontainers/image-spec/specs-go/v1"
+
+	"github.com/distribution/distribution/v3/manifest/ocischema"
+	"github.com/distribution/distribution/v3/registry/storage"
+	"github.com/distribution/distribution/v3/registry/storage/driver/inmemory"
+)
+
+// readLayout returns the files of the archive of a layout, by name, failing
+// if a file is written twice or a blob does not match its digest.
+func readLayout(t *testing.T, archive io.Reader) map[string][]byte {
+	t.Helper()
+	files := make(map[string][]byte)
+	tr := tar.NewReader(archive)
+	for {
+		hdr, err := tr.Next()
+		if errors.Is(err, io.EOF) {
+			break
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		content, err := io.ReadAll(tr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, ok := files[hdr.Name]; ok {
+			t.Fatalf("%s written twice", hdr.Name)
+		}
+		if encoded, ok := strings.CutPrefix(hdr.Name, "blobs/sha256/"); ok && digest.FromBytes(content).Encoded() != encoded {
+			t.Fatalf("content of %s does not match its digest", hdr.Name)
+		}
+		files[hdr.Name] = content
+	}
+	return files
+}
+
+func TestExportLayout(t *testing.T) {
+	ctx := context.Background()
+	registry, err := storage.NewRegistry(ctx, inmemory.New())
+	if err != nil {
+		t.Fatal(err)
+	}
+	repo := testRepository(t, registry, "team/app")
+	first := pushTestImage(t, repo, "v1", "first", &v1.Platform{Architecture: "amd64", OS: "linux"})
+	pushTestImage(t, repo, "latest", "first", nil)
+	second := pushTestImage(t, repo, "v2", "second", &v1.Platform{Architecture: "arm64", OS: "linux"})
+	index := pushTestIndex(t, repo, "multi", first, second)
+
+	// A signature of the first image, untagged.
+	signature, err := repo.Blobs(ctx).Put(ctx, "application/vnd.example.signature", []byte("signature"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	m, err := ocischema.FromStruct(ocischema.Manifest{
+		Versioned:    specs.Versioned{SchemaVersion: 2},
+		MediaType:    v1.MediaTypeImageManifest,
+		ArtifactType: "application/vnd.example.signature",
+		Config:       v1.DescriptorEmptyJSON,
+		Layers:       []v1.Descriptor{signature},
+		Subject:      &v1.Descriptor{MediaType: first.MediaType, Digest: first.Digest, Size: first.Size},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := repo.Blobs(ctx).Put(ctx, v1.MediaTypeEmptyJSON, v1.DescriptorEmptyJSON.Data); err != nil {
+		t.Fatal(err)
+	}
+	referrer := putTestManifest(t, repo, m, "")
+
+	var archive bytes.Buffer
+	report, err := exportLayout(ctx, registry, "team/app", exportOpts{Tags: []string{"v*", "multi"}, Referrers: true}, &archive)
+	if err != nil {
+		t.Fatal(err)
+	}
+	files := readLayout(t, &archive)
+
+	if string(files["oci-layout"]) != `{"imageLayoutVersion":"1.0.0"}` {
+		t.Fatalf("unexpected oci-layout %s", files["oci-layout"])
+	}
+	var layout v1.Index
+	if err := json.Unmarshal(files["index.json"], &layout); err != nil {
+		t.Fatal(err)
+	}
+	var refs []string
+	for _, desc := range layout.Manifests {
+		refs = append(refs, desc.Digest.String()+" "+desc.Annotations[v1.AnnotationRefName])
+	}
+	expected := []string{
+		index.Digest.String() + " multi",
+		first.Digest.String() + " v1",
+		second.Digest.String() + " v2",
+		referrer.Digest.String() + " ",
+	}
+	if strings.Join(refs, "\n") != strings.Join(expected, "\n") {
+		t.Fatalf("unexpected index %v", refs)
+	}
+
+	// Every manifest and blob, shared by tags or not, is written once.
+	for _, dgst := range []digest.Digest{index.Digest, first.Digest, second.Digest, referrer.Digest, signature.Digest} {
+		if _, ok := files["blobs/sha256/"+dgst.Encoded()]; !ok {
+			t.Fatalf("blob %s not exported", dgst)
+		}
+	}
+	// The index, the images and the referrer, the configs and layers of the
+	// images, and the config and layer of the referrer.
+	if len(files) != 2+4+4+2 || report.Tags != 3 || report.Manifests != 4 || report.Blobs != 6 {
+		t.Fatalf("unexpected export of %d files, report %+v", len(files), report)
+	}
+}
+
+func TestExportLayoutNoTag(t *testing.T) {
+	ctx := context.Background()
+	registry, err := storage.NewRegistry(ctx, inmemory.New())
+	if err != nil {
+		t.Fatal(err)
+	}
+	pushTestImage(t, testRepository(t, registry, "team/app"), "v1", "first", nil)
+
+	if _, err := exportLayout(ctx, registry, "team/app", exportOpts{Tags: []string{"v2*"}}, io.Discard); err == nil {
+		t.Fatal("expected an error exporting no tag")
+	}
+	if _, err := exportLayout(ctx, registry, "team/missing", exportOpts{}, io.Discard); err == nil {
+		t.Fatal("expected an error exporting an unknown repository")
+	}
+}
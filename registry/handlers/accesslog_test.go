@@ -0,0 +1,118 @@
+package handlers
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/distribution/distribution/v3/configuration"
+	"github.com/distribution/distribution/v3/registry/accesslog"
+	v2 "github.com/distribution/distribution/v3/registry/api/v2"
+	"github.com/distribution/reference"
+)
+
+// syncBuffer is the access log written by the server and read by the test.
+type syncBuffer struct {
+	mu  sync.Mutex
+	buf bytes.Buffer
+}
+
+func (b *syncBuffer) Write(p []byte) (int, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.Write(p)
+}
+
+// lines waits for the access log to hold n lines, and returns them.
+func (b *syncBuffer) lines(t *testing.T, n int) []map[string]any {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		b.mu.Lock()
+		s := b.buf.String()
+		b.mu.Unlock()
+		if lines := strings.Split(strings.TrimSuffix(s, "\n"), "\n"); s != "" && len(lines) >= n {
+			var entries []map[string]any
+			for _, line := range lines {
+				var entry map[string]any
+				if err := json.Unmarshal([]byte(line), &entry); err != nil {
+					t.Fatalf("invalid access log line %q: %v", line, err)
+				}
+				entries = append(entries, entry)
+			}
+			return entries
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("the access log holds less than %d lines: %q", n, s)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestProxyAccessLog(t *testing.T) {
+	upstreamEnv := newTestEnv(t, false)
+	defer upstreamEnv.Shutdown()
+	createRepository(upstreamEnv, t, "foo/logged", "latest")
+
+	config := configuration.Configuration{
+		Storage: configuration.Storage{
+			"inmemory": configuration.Parameters{},
+			"maintenance": configuration.Parameters{"uploadpurging": map[any]any{
+				"enabled": false,
+			}},
+		},
+		Proxy: configuration.Proxy{
+			RemoteURL: upstreamEnv.server.URL,
+		},
+	}
+	config.Log.AccessLog.Format = accesslog.FormatJSON
+	config.HTTP.Headers = headerConfig
+
+	var log syncBuffer
+	app := NewApp(context.Background(), &config)
+	handler, err := accesslog.NewHandler(&log, config.Log.AccessLog, app)
+	checkErr(t, err, "creating access log handler")
+	server := httptest.NewServer(handler)
+	defer server.Close()
+	builder, err := v2.NewURLBuilderFromString(server.URL, false)
+	checkErr(t, err, "creating url builder")
+
+	imageName, _ := reference.WithName("foo/logged")
+	tagRef, _ := reference.WithTag(imageName, "latest")
+	manifestURL, err := builder.BuildManifestURL(tagRef)
+	checkErr(t, err, "building manifest url")
+
+	var requestIDs []string
+	for range 2 {
+		resp, err := http.Get(manifestURL)
+		checkErr(t, err, "pulling manifest")
+		resp.Body.Close()
+		checkResponse(t, "pulling manifest", resp, http.StatusOK)
+		requestIDs = append(requestIDs, resp.Header.Get("X-Request-Id"))
+	}
+
+	// The manifest is fetched from the upstream, then served from the
+	// cache once its tag is revalidated.
+	entries := log.lines(t, 2)
+	for i, cache := range []string{accesslog.CacheMiss, accesslog.CacheHit} {
+		entry := entries[i]
+		if entry["repository"] != "foo/logged" || entry["action"] != "pull" || entry["cache"] != cache {
+			t.Fatalf("unexpected repository, action or cache of line %v, expected a %s", entry, cache)
+		}
+		if entry["requestID"] != requestIDs[i] || entry["status"] != float64(http.StatusOK) {
+			t.Fatalf("unexpected request or status of line %v", entry)
+		}
+		if d, ok := entry["upstreamDuration"].(float64); !ok || d <= 0 {
+			t.Fatalf("unexpected upstream duration of line %v", entry)
+		}
+		if _, ok := entry["digest"]; ok {
+			t.Fatalf("unexpected digest of the manifest request %v", entry)
+		}
+	}
+}
@@ -13,24 +13,33 @@ import (
 	"net/url"
 	"os"
 	"path"
+	"path/filepath"
 	"reflect"
 	"regexp"
 	"slices"
 	"strconv"
 	"strings"
+	"sync"
 	"testing"
 
 	"github.com/distribution/distribution/v3"
 	"github.com/distribution/distribution/v3/configuration"
+	"github.com/distribution/distribution/v3/internal/dcontext"
 	"github.com/distribution/distribution/v3/manifest/manifestlist"
+	"github.com/distribution/distribution/v3/manifest/ocischema"
+	"github.com/distribution/distribution/v3/manifest/schema1"
 	"github.com/distribution/distribution/v3/manifest/schema2"
+	"github.com/distribution/distribution/v3/notifications"
 	"github.com/distribution/distribution/v3/registry/api/errcode"
 	v2 "github.com/distribution/distribution/v3/registry/api/v2"
+	"github.com/distribution/distribution/v3/registry/auth"
 	storagedriver "github.com/distribution/distribution/v3/registry/storage/driver"
 	"github.com/distribution/distribution/v3/registry/storage/driver/factory"
+	_ "github.com/distribution/distribution/v3/registry/storage/driver/filesystem"
 	_ "github.com/distribution/distribution/v3/registry/storage/driver/inmemory"
 	"github.com/distribution/distribution/v3/testutil"
 	"github.com/distribution/reference"
+	events "github.com/docker/go-events"
 	"github.com/gorilla/handlers"
 	"github.com/opencontainers/go-digest"
 	"github.com/opencontainers/image-spec/specs-go"
@@ -453,6 +462,75 @@ func TestCatalogAPI(t *testing.T) {
 	}
 }
 
+// TestCatalogAPIPrefix tests the prefix filter of the /v2/_catalog endpoint,
+// along with its pagination.
+func TestCatalogAPIPrefix(t *testing.T) {
+	env := newTestEnv(t, false)
+	defer env.Shutdown()
+
+	for _, image := range []string{"team-x/a", "team-x/b", "team-x/c", "team-xy/d", "team-y/e"} {
+		createRepository(env, t, image, "sometag")
+	}
+
+	getCatalog := func(values url.Values) (*http.Response, []string) {
+		t.Helper()
+		catalogURL, err := env.builder.BuildCatalogURL(values)
+		checkErr(t, err, "building catalog url")
+		resp, err := http.Get(catalogURL)
+		checkErr(t, err, "issuing catalog request")
+		defer resp.Body.Close()
+		checkResponse(t, "issuing catalog api check", resp, http.StatusOK)
+		var ctlg catalogAPIResponse
+		if err := json.NewDecoder(resp.Body).Decode(&ctlg); err != nil {
+			t.Fatalf("error decoding catalog: %v", err)
+		}
+		return resp, ctlg.Repositories
+	}
+
+	resp, repos := getCatalog(url.Values{"prefix": []string{"team-x"}})
+	if !reflect.DeepEqual(repos, []string{"team-x/a", "team-x/b", "team-x/c", "team-xy/d"}) {
+		t.Fatalf("unexpected repositories: %v", repos)
+	}
+	if resp.Header.Get("Link") != "" {
+		t.Fatalf("unexpected Link header: %s", resp.Header.Get("Link"))
+	}
+
+	// The pagination keeps the prefix.
+	resp, repos = getCatalog(url.Values{"prefix": []string{"team-x/"}, "n": []string{"2"}})
+	if !reflect.DeepEqual(repos, []string{"team-x/a", "team-x/b"}) {
+		t.Fatalf("unexpected first page: %v", repos)
+	}
+	values := checkLink(t, resp.Header.Get("Link"), 2, "team-x/b")
+	if values.Get("prefix") != "team-x/" {
+		t.Fatalf("Link header does not keep the prefix: %s", resp.Header.Get("Link"))
+	}
+	resp, repos = getCatalog(values)
+	if !reflect.DeepEqual(repos, []string{"team-x/c"}) {
+		t.Fatalf("unexpected second page: %v", repos)
+	}
+	if resp.Header.Get("Link") != "" {
+		t.Fatalf("unexpected Link header on the last page: %s", resp.Header.Get("Link"))
+	}
+
+	for _, prefix := range []string{"team-z", "other/"} {
+		resp, repos = getCatalog(url.Values{"prefix": []string{prefix}})
+		if len(repos) != 0 || resp.Header.Get("Link") != "" {
+			t.Fatalf("prefix %q: unexpected repositories %v", prefix, repos)
+		}
+	}
+
+	for _, prefix := range []string{"Team-x", "/team-x", "team-x//", "team..x"} {
+		catalogURL, err := env.builder.BuildCatalogURL(url.Values{"prefix": []string{prefix}})
+		checkErr(t, err, "building catalog url")
+		resp, err := http.Get(catalogURL)
+		checkErr(t, err, "issuing catalog request")
+		defer resp.Body.Close()
+		checkResponse(t, fmt.Sprintf("listing the catalog with prefix %q", prefix), resp, http.StatusBadRequest)
+		// nolint:errcheck
+		checkBodyHasErrorCodes(t, "invalid prefix", resp, errcode.ErrorCodeNameInvalid)
+	}
+}
+
 // TestTagsAPI tests the /v2/<name>/tags/list endpoint
 func TestTagsAPI(t *testing.T) {
 	env := newTestEnv(t, false)
@@ -612,6 +690,160 @@ func TestTagsAPI(t *testing.T) {
 	}
 }
 
+func TestTagsAPI_Detail(t *testing.T) {
+	env := newTestEnv(t, false)
+	defer env.Shutdown()
+
+	imageName, err := reference.WithName("test")
+	checkErr(t, err, "building image name")
+
+	tags := []string{"2j2ar", "asj9e", "jyi7b", "kb0j5", "sb71y"}
+	for _, tag := range tags {
+		createRepository(env, t, imageName.Name(), tag)
+	}
+
+	// The plain list is unchanged without the detail parameter.
+	tagsURL, err := env.builder.BuildTagsURL(imageName)
+	checkErr(t, err, "building tags URL")
+	resp, err := http.Get(tagsURL)
+	checkErr(t, err, "listing tags")
+	defer resp.Body.Close()
+	checkResponse(t, "listing tags", resp, http.StatusOK)
+	plain, err := io.ReadAll(resp.Body)
+	checkErr(t, err, "reading tags")
+	if expected := `{"name":"test","tags":["2j2ar","asj9e","jyi7b","kb0j5","sb71y"]}` + "\n"; string(plain) != expected {
+		t.Fatalf("unexpected plain tags response: %q", plain)
+	}
+
+	tagsURL, err = env.builder.BuildTagsURL(imageName, url.Values{"detail": []string{"true"}, "n": []string{"2"}})
+	checkErr(t, err, "building tags URL")
+	var details []tagDetailEntry
+	for tagsURL != "" {
+		resp, err := http.Get(tagsURL)
+		checkErr(t, err, "listing tags in detail")
+		defer resp.Body.Close()
+		checkResponse(t, "listing tags in detail", resp, http.StatusOK)
+		var body tagDetailsAPIResponse
+		if err := json.NewDecoder(resp.Body).Decode(&body); err != nil {
+			t.Fatalf("unexpected error decoding tag details: %v", err)
+		}
+		details = append(details, body.Tags...)
+
+		tagsURL = ""
+		if link := resp.Header.Get("Link"); link != "" {
+			matches := regexp.MustCompile(`<(/v2/test/tags/list\?.*)>; rel="next"`).FindStringSubmatch(link)
+			if len(matches) != 2 || !strings.Contains(matches[1], "detail=true") {
+				t.Fatalf("unexpected Link header: %q", link)
+			}
+			tagsURL = env.server.URL + matches[1]
+		}
+	}
+
+	if len(details) != len(tags) {
+		t.Fatalf("%d tags listed in detail, expected %d", len(details), len(tags))
+	}
+	for i, detail := range details {
+		if detail.Name != tags[i] {
+			t.Fatalf("tag %s listed in detail, expected %s", detail.Name, tags[i])
+		}
+		if detail.LastModified.IsZero() {
+			t.Fatalf("tag %s listed without a modification time", detail.Name)
+		}
+
+		ref, err := reference.WithTag(imageName, detail.Name)
+		checkErr(t, err, "building tag reference")
+		manifestURL, err := env.builder.BuildManifestURL(ref)
+		checkErr(t, err, "building manifest URL")
+		req, err := http.NewRequest(http.MethodHead, manifestURL, nil)
+		checkErr(t, err, "building manifest request")
+		req.Header.Set("Accept", schema2.MediaTypeManifest)
+		resp, err := http.DefaultClient.Do(req)
+		checkErr(t, err, "resolving tag")
+		defer resp.Body.Close()
+		checkResponse(t, "resolving tag", resp, http.StatusOK)
+		if resp.Header.Get("Docker-Content-Digest") != detail.Digest.String() {
+			t.Fatalf("tag %s: digest %s listed, resolved %s", detail.Name, detail.Digest, resp.Header.Get("Docker-Content-Digest"))
+		}
+		if resp.Header.Get("Content-Type") != detail.MediaType {
+			t.Fatalf("tag %s: media type %s listed, resolved %s", detail.Name, detail.MediaType, resp.Header.Get("Content-Type"))
+		}
+	}
+}
+
+func TestTagAPI_History(t *testing.T) {
+	env := newTestEnv(t, false)
+	defer env.Shutdown()
+
+	imageName, err := reference.WithName("test")
+	checkErr(t, err, "building image name")
+
+	// The tag is overwritten three times.
+	var pushed []digest.Digest
+	for range 3 {
+		pushed = append(pushed, createRepository(env, t, imageName.Name(), "latest"))
+	}
+	createRepository(env, t, imageName.Name(), "other")
+
+	ref, err := reference.WithTag(imageName, "latest")
+	checkErr(t, err, "building tag reference")
+	historyURL, err := env.builder.BuildTagHistoryURL(ref, url.Values{"n": []string{"2"}})
+	checkErr(t, err, "building tag history URL")
+	var history []tagHistoryEntry
+	for historyURL != "" {
+		resp, err := http.Get(historyURL)
+		checkErr(t, err, "getting tag history")
+		defer resp.Body.Close()
+		checkResponse(t, "getting tag history", resp, http.StatusOK)
+		var body tagHistoryAPIResponse
+		if err := json.NewDecoder(resp.Body).Decode(&body); err != nil {
+			t.Fatalf("unexpected error decoding tag history: %v", err)
+		}
+		if body.Name != "test" || body.Tag != "latest" {
+			t.Fatalf("unexpected tag history of %s:%s", body.Name, body.Tag)
+		}
+		history = append(history, body.History...)
+
+		historyURL = ""
+		if link := resp.Header.Get("Link"); link != "" {
+			matches := regexp.MustCompile(`<(/v2/test/tags/latest/history\?.*)>; rel="next"`).FindStringSubmatch(link)
+			if len(matches) != 2 {
+				t.Fatalf("unexpected Link header: %q", link)
+			}
+			historyURL = env.server.URL + matches[1]
+		}
+	}
+
+	if len(history) != len(pushed) {
+		t.Fatalf("%d history entries, expected %d: %v", len(history), len(pushed), history)
+	}
+	for i, entry := range history {
+		if expected := pushed[len(pushed)-1-i]; entry.Digest != expected {
+			t.Fatalf("history entry %d is %s, expected %s", i, entry.Digest, expected)
+		}
+		if entry.LastModified.IsZero() {
+			t.Fatalf("history entry %s without a modification time", entry.Digest)
+		}
+	}
+
+	unknownRef, err := reference.WithTag(imageName, "unknown")
+	checkErr(t, err, "building tag reference")
+	historyURL, err = env.builder.BuildTagHistoryURL(unknownRef)
+	checkErr(t, err, "building tag history URL")
+	resp, err := http.Get(historyURL)
+	checkErr(t, err, "getting tag history")
+	defer resp.Body.Close()
+	checkResponse(t, "getting history of an unknown tag", resp, http.StatusNotFound)
+	checkBodyHasErrorCodes(t, "getting history of an unknown tag", resp, errcode.ErrorCodeManifestUnknown)
+
+	historyURL, err = env.builder.BuildTagHistoryURL(ref, url.Values{"n": []string{"-1"}})
+	checkErr(t, err, "building tag history URL")
+	resp, err = http.Get(historyURL)
+	checkErr(t, err, "getting tag history")
+	defer resp.Body.Close()
+	checkResponse(t, "getting tag history with an invalid n", resp, http.StatusBadRequest)
+	checkBodyHasErrorCodes(t, "getting tag history with an invalid n", resp, errcode.ErrorCodePaginationNumberInvalid)
+}
+
 func checkLink(t *testing.T, urlStr string, numEntries int, last string) url.Values {
 	re := regexp.MustCompile("<(/v2/_catalog.*)>; rel=\"next\"")
 	matches := re.FindStringSubmatch(urlStr)
@@ -822,6 +1054,175 @@ func TestBlobDeleteDisabled(t *testing.T) {
 	checkResponse(t, "status of disabled delete", resp, http.StatusMethodNotAllowed)
 }
 
+// TestBlobUploadHandoff tests that an upload started by a registry instance is
+// continued and completed by another sharing the storage, each with its own
+// generated secret.
+func TestBlobUploadHandoff(t *testing.T) {
+	root := t.TempDir()
+	newInstance := func() *testEnv {
+		config := configuration.Configuration{
+			Storage: configuration.Storage{
+				"filesystem": configuration.Parameters{"rootdirectory": root},
+				"maintenance": configuration.Parameters{"uploadpurging": map[any]any{
+					"enabled": false,
+				}},
+			},
+		}
+		config.HTTP.Headers = headerConfig
+		return newTestEnvWithConfig(t, &config)
+	}
+	first, second := newInstance(), newInstance()
+	defer first.Shutdown()
+	defer second.Shutdown()
+	if first.config.HTTP.Secret == second.config.HTTP.Secret {
+		t.Fatal("unexpected shared secret")
+	}
+	// on returns the upload location on the server of the instance.
+	on := func(env *testEnv, location string) string {
+		u, err := url.Parse(location)
+		if err != nil {
+			t.Fatalf("error parsing location: %v", err)
+		}
+		server, _ := url.Parse(env.server.URL)
+		u.Host = server.Host
+		return u.String()
+	}
+
+	imageName, _ := reference.WithName("foo/handoff")
+	content := bytes.Repeat([]byte("0123456789"), 10000)
+	started, _ := startPushLayer(t, first, imageName)
+
+	// The first chunk is sent to the second instance.
+	location, _ := pushChunk(t, second.builder, imageName, on(second, started), bytes.NewReader(content[:40000]), 40000)
+
+	// The state the first instance started the upload with is stale.
+	resp, err := doPushChunk(t, on(first, started), bytes.NewReader(content[40000:]), chunkOptions{})
+	if err != nil {
+		t.Fatalf("unexpected error pushing chunk: %v", err)
+	}
+	checkResponse(t, "pushing chunk from a stale state", resp, http.StatusRequestedRangeNotSatisfiable)
+	resp.Body.Close()
+
+	// The second chunk is sent to the first instance, as after a restart.
+	location, _ = pushChunk(t, first.builder, imageName, on(first, location), bytes.NewReader(content[40000:]), int64(len(content)))
+
+	dgst := digest.FromBytes(content)
+	layerURL := finishUpload(t, second.builder, imageName, on(second, location), dgst)
+	resp, err = http.Get(on(first, layerURL))
+	if err != nil {
+		t.Fatalf("unexpected error fetching layer: %v", err)
+	}
+	defer resp.Body.Close()
+	checkResponse(t, "fetching uploaded layer", resp, http.StatusOK)
+	verifier := dgst.Verifier()
+	if _, err := io.Copy(verifier, resp.Body); err != nil {
+		t.Fatalf("unexpected error reading layer: %v", err)
+	}
+	if !verifier.Verified() {
+		t.Fatal("unexpected layer content")
+	}
+}
+
+func TestBlobUploadChunkRanges(t *testing.T) {
+	env := newTestEnv(t, false)
+	defer env.Shutdown()
+
+	imageName, _ := reference.WithName("foo/chunks")
+	content := bytes.Repeat([]byte("0123456789"), 100)
+	// patch sends the chunk of the content in the range, and checks the
+	// status and the Range of the response.
+	patch := func(msg, location string, start, end int64, body io.Reader, expectedStatus int, expectedRange string) string {
+		t.Helper()
+		resp, err := doPushChunk(t, location, body, chunkOptions{contentRange: fmt.Sprintf("%d-%d", start, end)})
+		if err != nil {
+			t.Fatalf("unexpected error pushing chunk: %v", err)
+		}
+		defer resp.Body.Close()
+		checkResponse(t, msg, resp, expectedStatus)
+		checkHeaders(t, resp, http.Header{
+			"Location": []string{"*"},
+			"Range":    []string{expectedRange},
+		})
+		if expectedStatus == http.StatusRequestedRangeNotSatisfiable {
+			checkBodyHasErrorCodes(t, msg, resp, errcode.ErrorCodeRangeInvalid)
+		}
+		return resp.Header.Get("Location")
+	}
+	chunk := func(start, end int64) io.Reader {
+		return bytes.NewReader(content[start : end+1])
+	}
+
+	started, _ := startPushLayer(t, env, imageName)
+	first := patch("pushing the first chunk", started, 0, 299, chunk(0, 299), http.StatusAccepted, "0-299")
+
+	// The chunks leaving a gap, or overlapping the data received, are
+	// rejected with the range of the data received.
+	patch("pushing a gapped chunk", first, 400, 599, chunk(400, 599), http.StatusRequestedRangeNotSatisfiable, "0-299")
+	patch("pushing an overlapping chunk", first, 200, 499, chunk(200, 499), http.StatusRequestedRangeNotSatisfiable, "0-299")
+	patch("pushing the first chunk again", first, 0, 299, chunk(0, 299), http.StatusRequestedRangeNotSatisfiable, "0-299")
+
+	second := patch("pushing the second chunk", first, 300, 599, chunk(300, 599), http.StatusAccepted, "0-599")
+
+	// A retry of the chunk received last, with the location it was sent to,
+	// is acknowledged without being written again.
+	patch("retrying the second chunk", first, 300, 599, chunk(300, 599), http.StatusAccepted, "0-599")
+	patch("retrying the second chunk with another range", first, 300, 499, chunk(300, 499), http.StatusRequestedRangeNotSatisfiable, "0-599")
+
+	// A chunk shorter than its range is rejected.
+	resp, err := doPushChunk(t, second, io.MultiReader(chunk(600, 699)), chunkOptions{contentRange: "600-799"})
+	if err != nil {
+		t.Fatalf("unexpected error pushing chunk: %v", err)
+	}
+	checkResponse(t, "pushing a short chunk", resp, http.StatusBadRequest)
+	resp.Body.Close()
+	_, end, err := getUploadStatus(second)
+	if err != nil {
+		t.Fatalf("unexpected error getting the upload status: %v", err)
+	}
+	if end != 699 {
+		t.Fatalf("unexpected end of the data received %d", end)
+	}
+
+	// A chunk starting at the offset is received, even sent with a stale
+	// location.
+	patch("pushing the last chunk with a stale location", first, 700, 999, chunk(700, 999), http.StatusAccepted, "0-999")
+
+	// A PUT without a body completes the upload, with a stale location too.
+	dgst := digest.FromBytes(content)
+	layerURL := finishUpload(t, env.builder, imageName, started, dgst)
+	resp, err = http.Get(layerURL)
+	if err != nil {
+		t.Fatalf("unexpected error fetching layer: %v", err)
+	}
+	defer resp.Body.Close()
+	checkResponse(t, "fetching uploaded layer", resp, http.StatusOK)
+	received, err := io.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatalf("unexpected error reading layer: %v", err)
+	}
+	if !bytes.Equal(received, content) {
+		t.Fatal("unexpected layer content")
+	}
+
+	// The final chunk of a PUT is checked as those of the PATCH requests.
+	started, _ = startPushLayer(t, env, imageName)
+	patch("pushing the first chunk", started, 0, 299, chunk(0, 299), http.StatusAccepted, "0-299")
+	u, _ := url.Parse(started)
+	u.RawQuery = url.Values{"_state": u.Query()["_state"], "digest": []string{dgst.String()}}.Encode()
+	req, err := http.NewRequest(http.MethodPut, u.String(), chunk(300, 999))
+	if err != nil {
+		t.Fatalf("unexpected error creating request: %v", err)
+	}
+	req.Header.Set("Content-Range", "300-999")
+	resp, err = http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatalf("unexpected error completing upload: %v", err)
+	}
+	defer resp.Body.Close()
+	checkResponse(t, "putting the final chunk with a stale location", resp, http.StatusRequestedRangeNotSatisfiable)
+	checkHeaders(t, resp, http.Header{"Range": []string{"0-299"}})
+}
+
 func testBlobAPI(t *testing.T, env *testEnv, args blobArgs) *testEnv {
 	// TODO(stevvooe): This test code is complete junk but it should cover the
 	// complete flow. This must be broken down and checked against the
@@ -1234,7 +1635,7 @@ func TestDeleteReadOnly(t *testing.T) {
 	uploadURLBase, _ := startPushLayer(t, env, imageName)
 	pushLayer(t, env.builder, imageName, layerDigest, uploadURLBase, layerFile)
 
-	env.app.readOnly = true
+	setReadOnly(t, env.app, true, "")
 
 	resp, err := httpDelete(layerURL)
 	if err != nil {
@@ -1242,13 +1643,13 @@ func TestDeleteReadOnly(t *testing.T) {
 	}
 	defer resp.Body.Close()
 
-	checkResponse(t, "deleting layer in read-only mode", resp, http.StatusMethodNotAllowed)
+	checkResponse(t, "deleting layer in read-only mode", resp, http.StatusServiceUnavailable)
 }
 
 func TestStartPushReadOnly(t *testing.T) {
 	env := newTestEnv(t, true)
 	defer env.Shutdown()
-	env.app.readOnly = true
+	setReadOnly(t, env.app, true, "")
 
 	imageName, _ := reference.WithName("foo/bar")
 
@@ -1263,7 +1664,7 @@ func TestStartPushReadOnly(t *testing.T) {
 	}
 	defer resp.Body.Close()
 
-	checkResponse(t, "starting push in read-only mode", resp, http.StatusMethodNotAllowed)
+	checkResponse(t, "starting push in read-only mode", resp, http.StatusServiceUnavailable)
 }
 
 func httpDelete(url string) (*http.Response, error) {
@@ -1303,6 +1704,111 @@ func TestManifestAPI(t *testing.T) {
 	testManifestAPIManifestList(t, env2, schema2Args)
 }
 
+func TestManifestAPI_ConditionalGet(t *testing.T) {
+	env := newTestEnv(t, false)
+	defer env.Shutdown()
+
+	imageName, err := reference.WithName("foo/conditional")
+	checkErr(t, err, "building image name")
+	dgst := createRepository(env, t, imageName.Name(), "latest")
+	tagRef, err := reference.WithTag(imageName, "latest")
+	checkErr(t, err, "building tag reference")
+	digestRef, err := reference.WithDigest(imageName, dgst)
+	checkErr(t, err, "building digest reference")
+
+	other := digest.FromString("other manifest")
+	for _, c := range []struct {
+		name        string
+		ifNoneMatch string
+		status      int
+	}{
+		{name: "matching", ifNoneMatch: fmt.Sprintf(`"%s"`, dgst), status: http.StatusNotModified},
+		{name: "unquoted matching", ifNoneMatch: dgst.String(), status: http.StatusNotModified},
+		{name: "non-matching", ifNoneMatch: fmt.Sprintf(`"%s"`, other), status: http.StatusOK},
+		{name: "multiple", ifNoneMatch: fmt.Sprintf(`"%s", "%s"`, other, dgst), status: http.StatusNotModified},
+		{name: "multiple non-matching", ifNoneMatch: fmt.Sprintf(`"%s", W/"%s"`, other, other), status: http.StatusOK},
+		{name: "weak", ifNoneMatch: fmt.Sprintf(`W/"%s"`, dgst), status: http.StatusNotModified},
+		{name: "any", ifNoneMatch: "*", status: http.StatusNotModified},
+	} {
+		for _, ref := range []reference.Named{tagRef, digestRef} {
+			for _, method := range []string{http.MethodGet, http.MethodHead} {
+				t.Run(fmt.Sprintf("%s %s %s", c.name, method, ref), func(t *testing.T) {
+					u, err := env.builder.BuildManifestURL(ref)
+					checkErr(t, err, "building manifest URL")
+					req, err := http.NewRequest(method, u, nil)
+					checkErr(t, err, "building manifest request")
+					req.Header.Set("Accept", schema2.MediaTypeManifest)
+					req.Header.Set("If-None-Match", c.ifNoneMatch)
+					resp, err := http.DefaultClient.Do(req)
+					checkErr(t, err, "fetching manifest")
+					defer resp.Body.Close()
+					checkResponse(t, "fetching manifest", resp, c.status)
+					checkHeaders(t, resp, http.Header{
+						"Docker-Content-Digest": []string{dgst.String()},
+						"ETag":                  []string{fmt.Sprintf(`"%s"`, dgst)},
+					})
+					if c.status == http.StatusNotModified {
+						body, err := io.ReadAll(resp.Body)
+						checkErr(t, err, "reading response")
+						if len(body) != 0 {
+							t.Fatalf("unexpected body of a not modified manifest: %q", body)
+						}
+					}
+				})
+			}
+		}
+	}
+}
+
+func TestManifestAPI_ConditionalDelete(t *testing.T) {
+	env := newTestEnv(t, true)
+	defer env.Shutdown()
+
+	imageName, err := reference.WithName("foo/conditional")
+	checkErr(t, err, "building image name")
+	dgst := createRepository(env, t, imageName.Name(), "latest")
+	tagRef, err := reference.WithTag(imageName, "latest")
+	checkErr(t, err, "building tag reference")
+	digestRef, err := reference.WithDigest(imageName, dgst)
+	checkErr(t, err, "building digest reference")
+
+	deleteIfMatch := func(ref reference.Named, ifMatch string) *http.Response {
+		u, err := env.builder.BuildManifestURL(ref)
+		checkErr(t, err, "building manifest URL")
+		req, err := http.NewRequest(http.MethodDelete, u, nil)
+		checkErr(t, err, "building delete request")
+		req.Header.Set("If-Match", ifMatch)
+		resp, err := http.DefaultClient.Do(req)
+		checkErr(t, err, "deleting manifest")
+		return resp
+	}
+
+	other := digest.FromString("other manifest")
+	for _, ref := range []reference.Named{tagRef, digestRef} {
+		for _, ifMatch := range []string{fmt.Sprintf(`"%s"`, other), fmt.Sprintf(`W/"%s"`, dgst)} {
+			msg := fmt.Sprintf("deleting %s if it matches %s", ref, ifMatch)
+			resp := deleteIfMatch(ref, ifMatch)
+			defer resp.Body.Close()
+			checkResponse(t, msg, resp, http.StatusPreconditionFailed)
+		}
+	}
+
+	resp := deleteIfMatch(tagRef, fmt.Sprintf(`"%s", "%s"`, other, dgst))
+	defer resp.Body.Close()
+	checkResponse(t, "deleting tag if it matches", resp, http.StatusAccepted)
+
+	resp = deleteIfMatch(digestRef, fmt.Sprintf(`"%s"`, dgst))
+	defer resp.Body.Close()
+	checkResponse(t, "deleting manifest if it matches", resp, http.StatusAccepted)
+
+	u, err := env.builder.BuildManifestURL(digestRef)
+	checkErr(t, err, "building manifest URL")
+	resp, err = http.Head(u)
+	checkErr(t, err, "checking manifest no longer exists")
+	defer resp.Body.Close()
+	checkResponse(t, "checking manifest no longer exists", resp, http.StatusNotFound)
+}
+
 func TestManifestAPI_DeleteTag(t *testing.T) {
 	env := newTestEnv(t, false)
 	defer env.Shutdown()
@@ -1316,81 +1822,1108 @@ func TestManifestAPI_DeleteTag(t *testing.T) {
 	ref, err := reference.WithTag(imageName, tag)
 	checkErr(t, err, "building tag reference")
 
-	u, err := env.builder.BuildManifestURL(ref)
-	checkErr(t, err, "building tag URL")
+	u, err := env.builder.BuildManifestURL(ref)
+	checkErr(t, err, "building tag URL")
+
+	resp, err := httpDelete(u)
+	m := "deleting tag"
+	checkErr(t, err, m)
+	defer resp.Body.Close()
+
+	checkResponse(t, m, resp, http.StatusAccepted)
+	if resp.Body != http.NoBody {
+		t.Fatal("unexpected response body")
+	}
+
+	msg := "checking tag no longer exists"
+	resp, err = http.Get(u)
+	checkErr(t, err, msg)
+	defer resp.Body.Close()
+	checkResponse(t, msg, resp, http.StatusNotFound)
+
+	digestRef, err := reference.WithDigest(imageName, dgst)
+	checkErr(t, err, "building manifest digest reference")
+
+	u, err = env.builder.BuildManifestURL(digestRef)
+	checkErr(t, err, "building manifest URL")
+
+	msg = "checking manifest still exists"
+	resp, err = http.Head(u)
+	checkErr(t, err, msg)
+	defer resp.Body.Close()
+	checkResponse(t, msg, resp, http.StatusOK)
+}
+
+func TestManifestAPI_DeleteTag_Unknown(t *testing.T) {
+	env := newTestEnv(t, false)
+	defer env.Shutdown()
+
+	imageName, err := reference.WithName("foo/bar")
+	checkErr(t, err, "building named object")
+
+	ref, err := reference.WithTag(imageName, "latest")
+	checkErr(t, err, "building tag reference")
+
+	u, err := env.builder.BuildManifestURL(ref)
+	checkErr(t, err, "building tag URL")
+
+	resp, err := httpDelete(u)
+	msg := "deleting unknown tag"
+	checkErr(t, err, msg)
+	defer resp.Body.Close()
+
+	checkResponse(t, msg, resp, http.StatusNotFound)
+	// nolint:errcheck
+	checkBodyHasErrorCodes(t, msg, resp, errcode.ErrorCodeManifestUnknown)
+}
+
+func TestManifestAPI_DeleteTag_ReadOnly(t *testing.T) {
+	env := newTestEnv(t, false)
+	defer env.Shutdown()
+	setReadOnly(t, env.app, true, "")
+
+	imageName, err := reference.WithName("foo/bar")
+	checkErr(t, err, "building named object")
+
+	ref, err := reference.WithTag(imageName, "latest")
+	checkErr(t, err, "building tag reference")
+
+	u, err := env.builder.BuildManifestURL(ref)
+	checkErr(t, err, "building URL")
+
+	resp, err := httpDelete(u)
+	msg := "deleting tag"
+	checkErr(t, err, msg)
+	defer resp.Body.Close()
+
+	checkResponse(t, msg, resp, http.StatusServiceUnavailable)
+}
+
+// TestTagAPI_Delete tests that the /v2/<name>/tags/<tag> endpoint deletes a
+// tag, leaving its manifest and the other tags referencing it.
+func TestTagAPI_Delete(t *testing.T) {
+	env := newTestEnv(t, true)
+	defer env.Shutdown()
+
+	imageName, err := reference.WithName("foo/bar")
+	checkErr(t, err, "building image name")
+
+	dgst := createRepository(env, t, imageName.Name(), "latest")
+	latest, err := reference.WithTag(imageName, "latest")
+	checkErr(t, err, "building tag reference")
+	stable, err := reference.WithTag(imageName, "stable")
+	checkErr(t, err, "building tag reference")
+
+	// The manifest is tagged stable as well.
+	manifestURL, err := env.builder.BuildManifestURL(latest)
+	checkErr(t, err, "building manifest URL")
+	req, err := http.NewRequest(http.MethodGet, manifestURL, nil)
+	checkErr(t, err, "building manifest request")
+	req.Header.Set("Accept", schema2.MediaTypeManifest)
+	resp, err := http.DefaultClient.Do(req)
+	checkErr(t, err, "fetching manifest")
+	defer resp.Body.Close()
+	checkResponse(t, "fetching manifest", resp, http.StatusOK)
+	payload, err := io.ReadAll(resp.Body)
+	checkErr(t, err, "reading manifest")
+	stableURL, err := env.builder.BuildManifestURL(stable)
+	checkErr(t, err, "building manifest URL")
+	req, err = http.NewRequest(http.MethodPut, stableURL, bytes.NewReader(payload))
+	checkErr(t, err, "building manifest request")
+	req.Header.Set("Content-Type", schema2.MediaTypeManifest)
+	resp, err = http.DefaultClient.Do(req)
+	checkErr(t, err, "tagging manifest")
+	defer resp.Body.Close()
+	checkResponse(t, "tagging manifest", resp, http.StatusCreated)
+	if resp.Header.Get("Docker-Content-Digest") != dgst.String() {
+		t.Fatalf("tags reference different manifests: %s, %s", dgst, resp.Header.Get("Docker-Content-Digest"))
+	}
+
+	u, err := env.builder.BuildTagURL(latest)
+	checkErr(t, err, "building tag URL")
+
+	msg := "deleting tag"
+	resp, err = httpDelete(u)
+	checkErr(t, err, msg)
+	defer resp.Body.Close()
+	checkResponse(t, msg, resp, http.StatusAccepted)
+
+	msg = "deleting deleted tag"
+	resp, err = httpDelete(u)
+	checkErr(t, err, msg)
+	defer resp.Body.Close()
+	checkResponse(t, msg, resp, http.StatusNotFound)
+	// nolint:errcheck
+	checkBodyHasErrorCodes(t, msg, resp, errcode.ErrorCodeManifestUnknown)
+
+	msg = "checking tag no longer exists"
+	resp, err = http.Head(manifestURL)
+	checkErr(t, err, msg)
+	defer resp.Body.Close()
+	checkResponse(t, msg, resp, http.StatusNotFound)
+
+	digestRef, err := reference.WithDigest(imageName, dgst)
+	checkErr(t, err, "building manifest digest reference")
+	for _, ref := range []reference.Named{stable, digestRef} {
+		manifestURL, err := env.builder.BuildManifestURL(ref)
+		checkErr(t, err, "building manifest URL")
+		msg := fmt.Sprintf("checking manifest %s still exists", ref)
+		resp, err := http.Head(manifestURL)
+		checkErr(t, err, msg)
+		defer resp.Body.Close()
+		checkResponse(t, msg, resp, http.StatusOK)
+	}
+
+	tagsURL, err := env.builder.BuildTagsURL(imageName)
+	checkErr(t, err, "building tags URL")
+	resp, err = http.Get(tagsURL)
+	checkErr(t, err, "listing tags")
+	defer resp.Body.Close()
+	checkResponse(t, "listing tags", resp, http.StatusOK)
+	var body tagsAPIResponse
+	if err := json.NewDecoder(resp.Body).Decode(&body); err != nil {
+		t.Fatalf("unexpected error decoding tags: %v", err)
+	}
+	if !reflect.DeepEqual(body.Tags, []string{"stable"}) {
+		t.Fatalf("unexpected tags after deleting a tag: %v", body.Tags)
+	}
+}
+
+func TestTagAPI_DeleteDisabled(t *testing.T) {
+	env := newTestEnv(t, false)
+	defer env.Shutdown()
+
+	imageName, err := reference.WithName("foo/bar")
+	checkErr(t, err, "building image name")
+	createRepository(env, t, imageName.Name(), "latest")
+
+	ref, err := reference.WithTag(imageName, "latest")
+	checkErr(t, err, "building tag reference")
+	u, err := env.builder.BuildTagURL(ref)
+	checkErr(t, err, "building tag URL")
+
+	msg := "deleting tag with delete disabled"
+	resp, err := httpDelete(u)
+	checkErr(t, err, msg)
+	defer resp.Body.Close()
+	checkResponse(t, msg, resp, http.StatusMethodNotAllowed)
+	// nolint:errcheck
+	checkBodyHasErrorCodes(t, msg, resp, errcode.ErrorCodeUnsupported)
+
+	manifestURL, err := env.builder.BuildManifestURL(ref)
+	checkErr(t, err, "building manifest URL")
+	msg = "checking tag still exists"
+	resp, err = http.Head(manifestURL)
+	checkErr(t, err, msg)
+	defer resp.Body.Close()
+	checkResponse(t, msg, resp, http.StatusOK)
+}
+
+// pushReferrer pushes an artifact manifest whose subject is subject, and
+// returns its digest.
+func pushReferrer(t *testing.T, env *testEnv, name reference.Named, subject digest.Digest, artifactType string, annotations map[string]string) digest.Digest {
+	emptyConfig := []byte("{}")
+	uploadURLBase, _ := startPushLayer(t, env, name)
+	pushLayer(t, env.builder, name, digest.FromBytes(emptyConfig), uploadURLBase, bytes.NewReader(emptyConfig))
+
+	manifest, err := ocischema.FromStruct(ocischema.Manifest{
+		Versioned:    specs.Versioned{SchemaVersion: 2},
+		MediaType:    v1.MediaTypeImageManifest,
+		ArtifactType: artifactType,
+		Config:       v1.DescriptorEmptyJSON,
+		Layers:       []v1.Descriptor{v1.DescriptorEmptyJSON},
+		Subject:      &v1.Descriptor{MediaType: schema2.MediaTypeManifest, Digest: subject},
+		Annotations:  annotations,
+	})
+	checkErr(t, err, "building referrer manifest")
+	_, payload, err := manifest.Payload()
+	checkErr(t, err, "getting referrer payload")
+	dgst := digest.FromBytes(payload)
+
+	ref, err := reference.WithDigest(name, dgst)
+	checkErr(t, err, "building referrer reference")
+	manifestURL, err := env.builder.BuildManifestURL(ref)
+	checkErr(t, err, "building manifest URL")
+	msg := "pushing referrer"
+	resp := putManifest(t, msg, manifestURL, v1.MediaTypeImageManifest, manifest)
+	defer resp.Body.Close()
+	checkResponse(t, msg, resp, http.StatusCreated)
+	checkHeaders(t, resp, http.Header{
+		"Docker-Content-Digest": []string{dgst.String()},
+		"OCI-Subject":           []string{subject.String()},
+	})
+	return dgst
+}
+
+// getReferrers fetches the referrers of subject, and checks whether the
+// response reports that they were filtered.
+func getReferrers(t *testing.T, env *testEnv, name reference.Named, subject digest.Digest, artifactType string) []v1.Descriptor {
+	ref, err := reference.WithDigest(name, subject)
+	checkErr(t, err, "building subject reference")
+	var values []url.Values
+	if artifactType != "" {
+		values = append(values, url.Values{"artifactType": []string{artifactType}})
+	}
+	u, err := env.builder.BuildReferrersURL(ref, values...)
+	checkErr(t, err, "building referrers URL")
+
+	msg := "fetching referrers"
+	resp, err := http.Get(u)
+	checkErr(t, err, msg)
+	defer resp.Body.Close()
+	checkResponse(t, msg, resp, http.StatusOK)
+	checkHeaders(t, resp, http.Header{"Content-Type": []string{v1.MediaTypeImageIndex}})
+	if filtered := resp.Header.Get("OCI-Filters-Applied") == "artifactType"; filtered != (artifactType != "") {
+		t.Fatalf("unexpected OCI-Filters-Applied header %q filtering by %q", resp.Header.Get("OCI-Filters-Applied"), artifactType)
+	}
+
+	var index v1.Index
+	if err := json.NewDecoder(resp.Body).Decode(&index); err != nil {
+		t.Fatalf("unexpected error decoding referrers: %v", err)
+	}
+	if index.SchemaVersion != 2 || index.MediaType != v1.MediaTypeImageIndex || index.Manifests == nil {
+		t.Fatalf("unexpected referrers index: %+v", index)
+	}
+	return index.Manifests
+}
+
+func TestReferrersAPI(t *testing.T) {
+	env := newTestEnv(t, true)
+	defer env.Shutdown()
+
+	imageName, err := reference.WithName("foo/referrers")
+	checkErr(t, err, "building image name")
+	subject := createRepository(env, t, imageName.Name(), "latest")
+
+	signature := pushReferrer(t, env, imageName, subject, "application/vnd.example.signature", nil)
+	sbom := pushReferrer(t, env, imageName, subject, "application/vnd.example.sbom", map[string]string{"org.example.format": "spdx"})
+
+	referrers := getReferrers(t, env, imageName, subject, "")
+	if len(referrers) != 2 {
+		t.Fatalf("%d referrers listed, expected 2: %v", len(referrers), referrers)
+	}
+	for _, desc := range referrers {
+		if desc.MediaType != v1.MediaTypeImageManifest || desc.Size == 0 {
+			t.Fatalf("unexpected referrer descriptor: %+v", desc)
+		}
+		switch desc.Digest {
+		case signature:
+			if desc.ArtifactType != "application/vnd.example.signature" || desc.Annotations != nil {
+				t.Fatalf("unexpected signature descriptor: %+v", desc)
+			}
+		case sbom:
+			if desc.ArtifactType != "application/vnd.example.sbom" || desc.Annotations["org.example.format"] != "spdx" {
+				t.Fatalf("unexpected SBOM descriptor: %+v", desc)
+			}
+		default:
+			t.Fatalf("unexpected referrer %s", desc.Digest)
+		}
+	}
+
+	referrers = getReferrers(t, env, imageName, subject, "application/vnd.example.sbom")
+	if len(referrers) != 1 || referrers[0].Digest != sbom {
+		t.Fatalf("unexpected referrers filtered by artifact type: %v", referrers)
+	}
+	if referrers := getReferrers(t, env, imageName, subject, "application/vnd.example.unknown"); len(referrers) != 0 {
+		t.Fatalf("unexpected referrers of an unknown artifact type: %v", referrers)
+	}
+	// A manifest which does not exist has no referrers.
+	if referrers := getReferrers(t, env, imageName, digest.FromString("unknown"), ""); len(referrers) != 0 {
+		t.Fatalf("unexpected referrers of an unknown manifest: %v", referrers)
+	}
+
+	msg := "fetching referrers of an invalid digest"
+	resp, err := http.Get(env.server.URL + "/v2/foo/referrers/referrers/sha256:abc")
+	checkErr(t, err, msg)
+	defer resp.Body.Close()
+	checkResponse(t, msg, resp, http.StatusBadRequest)
+	// nolint:errcheck
+	checkBodyHasErrorCodes(t, msg, resp, errcode.ErrorCodeDigestInvalid)
+
+	// Deleting a referrer removes it from the referrers of its subject.
+	ref, err := reference.WithDigest(imageName, signature)
+	checkErr(t, err, "building referrer reference")
+	manifestURL, err := env.builder.BuildManifestURL(ref)
+	checkErr(t, err, "building manifest URL")
+	msg = "deleting referrer"
+	resp, err = httpDelete(manifestURL)
+	checkErr(t, err, msg)
+	defer resp.Body.Close()
+	checkResponse(t, msg, resp, http.StatusAccepted)
+
+	referrers = getReferrers(t, env, imageName, subject, "")
+	if len(referrers) != 1 || referrers[0].Digest != sbom {
+		t.Fatalf("unexpected referrers after deleting a referrer: %v", referrers)
+	}
+}
+
+func TestManifestAPI_InvalidSubject(t *testing.T) {
+	env := newTestEnv(t, false)
+	defer env.Shutdown()
+
+	imageName, err := reference.WithName("foo/referrers")
+	checkErr(t, err, "building image name")
+	emptyConfig := []byte("{}")
+	uploadURLBase, _ := startPushLayer(t, env, imageName)
+	pushLayer(t, env.builder, imageName, digest.FromBytes(emptyConfig), uploadURLBase, bytes.NewReader(emptyConfig))
+
+	manifest, err := ocischema.FromStruct(ocischema.Manifest{
+		Versioned: specs.Versioned{SchemaVersion: 2},
+		MediaType: v1.MediaTypeImageManifest,
+		Config:    v1.DescriptorEmptyJSON,
+		Layers:    []v1.Descriptor{v1.DescriptorEmptyJSON},
+		Subject:   &v1.Descriptor{MediaType: v1.MediaTypeImageLayer, Digest: digest.FromString("subject")},
+	})
+	checkErr(t, err, "building referrer manifest")
+	ref, err := reference.WithTag(imageName, "invalid")
+	checkErr(t, err, "building tag reference")
+	manifestURL, err := env.builder.BuildManifestURL(ref)
+	checkErr(t, err, "building manifest URL")
+
+	msg := "pushing referrer of a layer"
+	resp := putManifest(t, msg, manifestURL, v1.MediaTypeImageManifest, manifest)
+	defer resp.Body.Close()
+	checkResponse(t, msg, resp, http.StatusBadRequest)
+	errs, _, _ := checkBodyHasErrorCodes(t, msg, resp, errcode.ErrorCodeManifestInvalid)
+	detail, ok := errs[0].(errcode.Error).Detail.(map[string]any)
+	if !ok || detail["field"] != "subject.mediaType" {
+		t.Fatalf("unexpected error detail: %#v", errs[0])
+	}
+}
+
+func TestManifestAPI_MediaTypes(t *testing.T) {
+	imageName, err := reference.WithName("foo/mediatypes")
+	checkErr(t, err, "building image name")
+	config := configuration.Configuration{
+		Storage: configuration.Storage{
+			"inmemory": configuration.Parameters{},
+			"maintenance": configuration.Parameters{"uploadpurging": map[any]any{
+				"enabled": false,
+			}},
+		},
+		Validation: configuration.Validation{
+			Manifests: configuration.ValidationManifests{
+				MediaTypes: configuration.ValidationMediaTypes{
+					MediaTypeRule: configuration.MediaTypeRule{
+						Layers: []string{v1.MediaTypeImageLayerGzip},
+					},
+				},
+			},
+		},
+	}
+	config.HTTP.Headers = headerConfig
+	env := newTestEnvWithConfig(t, &config)
+	defer env.Shutdown()
+
+	emptyConfig := []byte("{}")
+	uploadURLBase, _ := startPushLayer(t, env, imageName)
+	pushLayer(t, env.builder, imageName, digest.FromBytes(emptyConfig), uploadURLBase, bytes.NewReader(emptyConfig))
+
+	manifest, err := ocischema.FromStruct(ocischema.Manifest{
+		Versioned: specs.Versioned{SchemaVersion: 2},
+		MediaType: v1.MediaTypeImageManifest,
+		Config:    v1.DescriptorEmptyJSON,
+		Layers:    []v1.Descriptor{v1.DescriptorEmptyJSON},
+	})
+	checkErr(t, err, "building manifest")
+
+	ref, err := reference.WithTag(imageName, "latest")
+	checkErr(t, err, "building tag reference")
+	manifestURL, err := env.builder.BuildManifestURL(ref)
+	checkErr(t, err, "building manifest URL")
+
+	msg := "pushing a manifest with a layer of a disallowed media type"
+	resp := putManifest(t, msg, manifestURL, v1.MediaTypeImageManifest, manifest)
+	defer resp.Body.Close()
+	checkResponse(t, msg, resp, http.StatusBadRequest)
+	errs, _, _ := checkBodyHasErrorCodes(t, msg, resp, errcode.ErrorCodeManifestInvalid)
+	detail, ok := errs[0].(errcode.Error).Detail.(map[string]any)
+	if !ok || detail["field"] != "layers[0].mediaType" || !strings.Contains(fmt.Sprint(detail["reason"]), v1.MediaTypeEmptyJSON) {
+		t.Fatalf("the error detail does not name the rejected media type: %#v", errs[0])
+	}
+}
+
+func TestManifestAPI_Annotations(t *testing.T) {
+	imageName, err := reference.WithName("prod/annotations")
+	checkErr(t, err, "building image name")
+	config := configuration.Configuration{
+		Storage: configuration.Storage{
+			"inmemory": configuration.Parameters{},
+			"maintenance": configuration.Parameters{"uploadpurging": map[any]any{
+				"enabled": false,
+			}},
+		},
+		Validation: configuration.Validation{
+			Manifests: configuration.ValidationManifests{
+				Annotations: configuration.ValidationAnnotations{
+					Repositories: []configuration.RepositoryAnnotations{{
+						Pattern: "prod/*",
+						AnnotationRule: configuration.AnnotationRule{
+							Required: []configuration.RequiredAnnotation{
+								{Key: v1.AnnotationSource},
+								{Key: "com.example.build-id", Value: "[0-9]+"},
+							},
+						},
+					}},
+				},
+			},
+		},
+	}
+	config.HTTP.Headers = headerConfig
+	env := newTestEnvWithConfig(t, &config)
+	defer env.Shutdown()
+
+	emptyConfig := []byte("{}")
+	uploadURLBase, _ := startPushLayer(t, env, imageName)
+	pushLayer(t, env.builder, imageName, digest.FromBytes(emptyConfig), uploadURLBase, bytes.NewReader(emptyConfig))
+
+	ref, err := reference.WithTag(imageName, "latest")
+	checkErr(t, err, "building tag reference")
+	manifestURL, err := env.builder.BuildManifestURL(ref)
+	checkErr(t, err, "building manifest URL")
+	annotated := func(annotations map[string]string) *ocischema.DeserializedManifest {
+		manifest, err := ocischema.FromStruct(ocischema.Manifest{
+			Versioned:   specs.Versioned{SchemaVersion: 2},
+			MediaType:   v1.MediaTypeImageManifest,
+			Config:      v1.DescriptorEmptyJSON,
+			Layers:      []v1.Descriptor{v1.DescriptorEmptyJSON},
+			Annotations: annotations,
+		})
+		checkErr(t, err, "building manifest")
+		return manifest
+	}
+
+	msg := "pushing a manifest missing a required annotation"
+	resp := putManifest(t, msg, manifestURL, v1.MediaTypeImageManifest, annotated(map[string]string{"com.example.build-id": "42"}))
+	defer resp.Body.Close()
+	checkResponse(t, msg, resp, http.StatusBadRequest)
+	errs, _, _ := checkBodyHasErrorCodes(t, msg, resp, errcode.ErrorCodeManifestInvalid)
+	detail, ok := errs[0].(errcode.Error).Detail.(map[string]any)
+	if !ok || detail["field"] != "annotations" || !strings.Contains(fmt.Sprint(detail["reason"]), v1.AnnotationSource) {
+		t.Fatalf("the error detail does not name the missing annotation: %#v", errs[0])
+	}
+
+	msg = "pushing an annotated manifest"
+	resp = putManifest(t, msg, manifestURL, v1.MediaTypeImageManifest, annotated(map[string]string{
+		v1.AnnotationSource:    "https://example.com/app",
+		"com.example.build-id": "42",
+	}))
+	defer resp.Body.Close()
+	checkResponse(t, msg, resp, http.StatusCreated)
+}
+
+func TestManifestAPI_ImmutableTags(t *testing.T) {
+	config := configuration.Configuration{
+		Storage: configuration.Storage{
+			"inmemory": configuration.Parameters{},
+			"delete":   configuration.Parameters{"enabled": true},
+			"maintenance": configuration.Parameters{"uploadpurging": map[any]any{
+				"enabled": false,
+			}},
+		},
+		Policy: configuration.Policy{
+			ImmutableTags: configuration.ImmutableTags{
+				Rules:          []configuration.ImmutableTagRule{{Repository: "prod/*", Tags: []string{"v*"}}},
+				ProtectDeletes: true,
+			},
+		},
+	}
+	config.HTTP.Headers = headerConfig
+	env := newTestEnvWithConfig(t, &config)
+	defer env.Shutdown()
+
+	emptyConfig := []byte("{}")
+	manifests := make(map[string]*ocischema.DeserializedManifest)
+	for _, name := range []string{"prod/app", "dev/app"} {
+		imageName, err := reference.WithName(name)
+		checkErr(t, err, "building image name")
+		uploadURLBase, _ := startPushLayer(t, env, imageName)
+		pushLayer(t, env.builder, imageName, digest.FromBytes(emptyConfig), uploadURLBase, bytes.NewReader(emptyConfig))
+	}
+	for _, build := range []string{"1", "2"} {
+		manifest, err := ocischema.FromStruct(ocischema.Manifest{
+			Versioned:   specs.Versioned{SchemaVersion: 2},
+			MediaType:   v1.MediaTypeImageManifest,
+			Config:      v1.DescriptorEmptyJSON,
+			Layers:      []v1.Descriptor{v1.DescriptorEmptyJSON},
+			Annotations: map[string]string{"com.example.build-id": build},
+		})
+		checkErr(t, err, "building manifest")
+		manifests[build] = manifest
+	}
+	tagURL := func(name, tag string) string {
+		imageName, err := reference.WithName(name)
+		checkErr(t, err, "building image name")
+		ref, err := reference.WithTag(imageName, tag)
+		checkErr(t, err, "building tag reference")
+		u, err := env.builder.BuildManifestURL(ref)
+		checkErr(t, err, "building manifest URL")
+		return u
+	}
+	push := func(name, tag, build string, expectedStatus int) {
+		t.Helper()
+		msg := fmt.Sprintf("pushing build %s to %s:%s", build, name, tag)
+		resp := putManifest(t, msg, tagURL(name, tag), v1.MediaTypeImageManifest, manifests[build])
+		defer resp.Body.Close()
+		checkResponse(t, msg, resp, expectedStatus)
+		if expectedStatus == http.StatusConflict {
+			checkBodyHasErrorCodes(t, msg, resp, errcode.ErrorCodeTagImmutable)
+		}
+	}
+	remove := func(u string, expectedStatus int) {
+		t.Helper()
+		resp, err := httpDelete(u)
+		checkErr(t, err, "deleting "+u)
+		defer resp.Body.Close()
+		checkResponse(t, "deleting "+u, resp, expectedStatus)
+	}
+
+	// The immutable tag cannot move, but the same manifest can be pushed
+	// again.
+	push("prod/app", "v1", "1", http.StatusCreated)
+	push("prod/app", "v1", "1", http.StatusCreated)
+	push("prod/app", "v1", "2", http.StatusConflict)
+
+	// The other tags, and the tags of the other repositories, are mutable.
+	push("prod/app", "latest", "1", http.StatusCreated)
+	push("prod/app", "latest", "2", http.StatusCreated)
+	push("dev/app", "v1", "1", http.StatusCreated)
+	push("dev/app", "v1", "2", http.StatusCreated)
+
+	// The deletes of the immutable tag, and of its manifest, are refused.
+	remove(tagURL("prod/app", "v1"), http.StatusConflict)
+	imageName, _ := reference.WithName("prod/app")
+	_, payload, _ := manifests["1"].Payload()
+	digestRef, err := reference.WithDigest(imageName, digest.FromBytes(payload))
+	checkErr(t, err, "building manifest digest reference")
+	u, err := env.builder.BuildManifestURL(digestRef)
+	checkErr(t, err, "building manifest URL")
+	remove(u, http.StatusConflict)
+	remove(tagURL("prod/app", "latest"), http.StatusAccepted)
+	remove(tagURL("dev/app", "v1"), http.StatusAccepted)
+}
+
+func TestManifestAPI_Schema1(t *testing.T) {
+	imageName, err := reference.WithName("library/motd")
+	checkErr(t, err, "building image name")
+	readFixture := func(name string) []byte {
+		p, err := os.ReadFile(filepath.Join("..", "..", "manifest", "schema1", "testdata", name))
+		checkErr(t, err, "reading fixture "+name)
+		return p
+	}
+	signed := readFixture("schema1-signed.json")
+	converted := readFixture("schema2.json")
+
+	for _, policy := range []string{configuration.Schema1Allow, configuration.Schema1Reject, configuration.Schema1Convert} {
+		t.Run(policy, func(t *testing.T) {
+			config := configuration.Configuration{
+				Storage: configuration.Storage{
+					"inmemory": configuration.Parameters{},
+					"maintenance": configuration.Parameters{"uploadpurging": map[any]any{
+						"enabled": false,
+					}},
+				},
+				Validation: configuration.Validation{
+					Manifests: configuration.ValidationManifests{Schema1: policy},
+				},
+			}
+			config.HTTP.Headers = headerConfig
+			env := newTestEnvWithConfig(t, &config)
+			defer env.Shutdown()
+
+			for _, layer := range []string{"base.tar.gz", "motd.tar.gz"} {
+				p := readFixture(layer)
+				uploadURLBase, _ := startPushLayer(t, env, imageName)
+				pushLayer(t, env.builder, imageName, digest.FromBytes(p), uploadURLBase, bytes.NewReader(p))
+			}
+			put := func(ref reference.Named) *http.Response {
+				manifestURL, err := env.builder.BuildManifestURL(ref)
+				checkErr(t, err, "building manifest URL")
+				req, err := http.NewRequest(http.MethodPut, manifestURL, bytes.NewReader(signed))
+				checkErr(t, err, "building manifest PUT request")
+				req.Header.Set("Content-Type", schema1.MediaTypeSignedManifest)
+				resp, err := http.DefaultClient.Do(req)
+				checkErr(t, err, "putting manifest")
+				return resp
+			}
+			tagRef, err := reference.WithTag(imageName, "latest")
+			checkErr(t, err, "building tag reference")
+
+			msg := "pushing a schema1 manifest by tag"
+			resp := put(tagRef)
+			defer resp.Body.Close()
+			if policy != configuration.Schema1Convert {
+				checkResponse(t, msg, resp, http.StatusBadRequest)
+				errs, _, _ := checkBodyHasErrorCodes(t, msg, resp, errcode.ErrorCodeManifestInvalid)
+				if message := errs[0].(errcode.Error).Message; policy == configuration.Schema1Reject && !strings.Contains(message, schema1.MediaTypeSignedManifest) {
+					t.Fatalf("the error message does not name the media type: %q", message)
+				}
+				return
+			}
+			checkResponse(t, msg, resp, http.StatusCreated)
+			checkHeaders(t, resp, http.Header{
+				"Docker-Content-Digest": []string{digest.FromBytes(converted).String()},
+			})
+
+			// The schema2 manifest converted is served in its place.
+			manifestURL, err := env.builder.BuildManifestURL(tagRef)
+			checkErr(t, err, "building manifest URL")
+			req, err := http.NewRequest(http.MethodGet, manifestURL, nil)
+			checkErr(t, err, "building manifest GET request")
+			req.Header.Set("Accept", schema2.MediaTypeManifest)
+			resp, err = http.DefaultClient.Do(req)
+			checkErr(t, err, "getting manifest")
+			defer resp.Body.Close()
+			checkResponse(t, "getting the converted manifest", resp, http.StatusOK)
+			if p, err := io.ReadAll(resp.Body); err != nil || !bytes.Equal(p, converted) {
+				t.Fatalf("unexpected manifest served: %s (%v)", p, err)
+			}
+
+			// The manifest pushed by digest would not be stored under it.
+			_, desc, err := distribution.UnmarshalManifest(schema1.MediaTypeSignedManifest, signed)
+			checkErr(t, err, "unmarshaling manifest")
+			digestRef, err := reference.WithDigest(imageName, desc.Digest)
+			checkErr(t, err, "building digest reference")
+			resp = put(digestRef)
+			defer resp.Body.Close()
+			checkResponse(t, "pushing a schema1 manifest by digest", resp, http.StatusBadRequest)
+			checkBodyHasErrorCodes(t, "pushing a schema1 manifest by digest", resp, errcode.ErrorCodeManifestInvalid)
+		})
+	}
+}
+
+func TestManifestAPI_MaxSize(t *testing.T) {
+	imageName, err := reference.WithName("foo/maxsize")
+	checkErr(t, err, "building image name")
+	manifest, err := ocischema.FromStruct(ocischema.Manifest{
+		Versioned: specs.Versioned{SchemaVersion: 2},
+		MediaType: v1.MediaTypeImageManifest,
+		Config:    v1.DescriptorEmptyJSON,
+		Layers:    []v1.Descriptor{v1.DescriptorEmptyJSON},
+	})
+	checkErr(t, err, "building manifest")
+	_, payload, err := manifest.Payload()
+	checkErr(t, err, "getting manifest payload")
+
+	// The limit is one byte over the manifest.
+	maxSize := int64(len(payload)) + 1
+	config := configuration.Configuration{
+		Storage: configuration.Storage{
+			"inmemory": configuration.Parameters{},
+			"maintenance": configuration.Parameters{"uploadpurging": map[any]any{
+				"enabled": false,
+			}},
+		},
+		Validation: configuration.Validation{
+			Manifests: configuration.ValidationManifests{
+				MaxSize: &maxSize,
+			},
+		},
+	}
+	config.HTTP.Headers = headerConfig
+	env := newTestEnvWithConfig(t, &config)
+	defer env.Shutdown()
+
+	emptyConfig := []byte("{}")
+	uploadURLBase, _ := startPushLayer(t, env, imageName)
+	pushLayer(t, env.builder, imageName, digest.FromBytes(emptyConfig), uploadURLBase, bytes.NewReader(emptyConfig))
+
+	ref, err := reference.WithTag(imageName, "latest")
+	checkErr(t, err, "building tag reference")
+	manifestURL, err := env.builder.BuildManifestURL(ref)
+	checkErr(t, err, "building manifest URL")
+	put := func(body io.Reader) *http.Response {
+		req, err := http.NewRequest(http.MethodPut, manifestURL, body)
+		checkErr(t, err, "building manifest PUT request")
+		req.Header.Set("Content-Type", v1.MediaTypeImageManifest)
+		resp, err := http.DefaultClient.Do(req)
+		checkErr(t, err, "putting manifest")
+		return resp
+	}
+
+	msg := "pushing a manifest under the size limit"
+	resp := put(bytes.NewReader(payload))
+	defer resp.Body.Close()
+	checkResponse(t, msg, resp, http.StatusCreated)
+
+	// Trailing whitespace takes the payload over the limit, and is refused
+	// whether its length is known in advance or not.
+	oversized := append(slices.Clone(payload), ' ', ' ')
+	for _, body := range []io.Reader{
+		bytes.NewReader(oversized),
+		io.MultiReader(bytes.NewReader(oversized)),
+	} {
+		msg := "pushing a manifest over the size limit"
+		resp := put(body)
+		defer resp.Body.Close()
+		checkResponse(t, msg, resp, http.StatusRequestEntityTooLarge)
+		errs, _, _ := checkBodyHasErrorCodes(t, msg, resp, errcode.ErrorCodeManifestInvalid)
+		if detail, ok := errs[0].(errcode.Error).Detail.(string); !ok || !strings.Contains(detail, strconv.FormatInt(maxSize, 10)) {
+			t.Fatalf("the error detail does not state the limit: %#v", errs[0])
+		}
+	}
+}
+
+func TestBlobAPI_VerifyReads(t *testing.T) {
+	imageName, err := reference.WithName("foo/verified")
+	checkErr(t, err, "building image name")
+	config := configuration.Configuration{
+		Storage: configuration.Storage{
+			"inmemory":     configuration.Parameters{},
+			"verification": configuration.Parameters{"enabled": true, "maxsize": 1 << 20},
+			"maintenance": configuration.Parameters{"uploadpurging": map[any]any{
+				"enabled": false,
+			}},
+		},
+	}
+	config.HTTP.Headers = headerConfig
+	env := newTestEnvWithConfig(t, &config)
+	defer env.Shutdown()
+	sink := &requestEventSink{events: make(map[string][]string)}
+	env.app.events.sink = sink
+
+	content := []byte("the content of the layer")
+	dgst := digest.FromBytes(content)
+	uploadURLBase, _ := startPushLayer(t, env, imageName)
+	pushLayer(t, env.builder, imageName, dgst, uploadURLBase, bytes.NewReader(content))
+	ref, err := reference.WithDigest(imageName, dgst)
+	checkErr(t, err, "building blob reference")
+	blobURL, err := env.builder.BuildBlobURL(ref)
+	checkErr(t, err, "building blob URL")
+
+	resp, err := http.Get(blobURL)
+	checkErr(t, err, "fetching blob")
+	defer resp.Body.Close()
+	checkResponse(t, "fetching blob", resp, http.StatusOK)
 
-	resp, err := httpDelete(u)
-	m := "deleting tag"
-	checkErr(t, err, m)
+	blobPath := path.Join("/docker/registry/v2/blobs", dgst.Algorithm().String(), dgst.Encoded()[:2], dgst.Encoded(), "data")
+	checkErr(t, env.app.driver.PutContent(context.Background(), blobPath, []byte("the content of the l4yer")), "corrupting blob")
+
+	resp, err = http.Get(blobURL)
+	checkErr(t, err, "fetching corrupted blob")
 	defer resp.Body.Close()
+	checkResponse(t, "fetching corrupted blob", resp, http.StatusInternalServerError)
+	checkBodyHasErrorCodes(t, "fetching corrupted blob", resp, errcode.ErrorCodeBlobUnknown)
+	if events := sink.events[notifications.EventActionBlobCorrupt]; len(events) != 1 {
+		t.Fatalf("unexpected blob corruption events: %v", events)
+	}
 
-	checkResponse(t, m, resp, http.StatusAccepted)
-	if resp.Body != http.NoBody {
-		t.Fatal("unexpected response body")
+	// The quarantined blob is unknown to HEAD requests, and no further event
+	// is written.
+	resp, err = http.Head(blobURL)
+	checkErr(t, err, "checking quarantined blob")
+	defer resp.Body.Close()
+	checkResponse(t, "checking quarantined blob", resp, http.StatusNotFound)
+	resp, err = http.Get(blobURL)
+	checkErr(t, err, "fetching quarantined blob")
+	defer resp.Body.Close()
+	checkResponse(t, "fetching quarantined blob", resp, http.StatusInternalServerError)
+	if events := sink.events[notifications.EventActionBlobCorrupt]; len(events) != 1 {
+		t.Fatalf("unexpected blob corruption events: %v", events)
 	}
 
-	msg := "checking tag no longer exists"
-	resp, err = http.Get(u)
-	checkErr(t, err, msg)
+	// Pushing the blob again repairs it.
+	uploadURLBase, _ = startPushLayer(t, env, imageName)
+	pushLayer(t, env.builder, imageName, dgst, uploadURLBase, bytes.NewReader(content))
+	resp, err = http.Get(blobURL)
+	checkErr(t, err, "fetching repaired blob")
 	defer resp.Body.Close()
-	checkResponse(t, msg, resp, http.StatusNotFound)
+	checkResponse(t, "fetching repaired blob", resp, http.StatusOK)
+	body, err := io.ReadAll(resp.Body)
+	checkErr(t, err, "reading repaired blob")
+	if !bytes.Equal(body, content) {
+		t.Fatalf("unexpected content of the repaired blob: %q", body)
+	}
+}
 
-	digestRef, err := reference.WithDigest(imageName, dgst)
-	checkErr(t, err, "building manifest digest reference")
+func TestBlobAPI_Quotas(t *testing.T) {
+	config := configuration.Configuration{
+		Storage: configuration.Storage{
+			"inmemory": configuration.Parameters{},
+			"maintenance": configuration.Parameters{"uploadpurging": map[any]any{
+				"enabled": false,
+			}},
+		},
+		Policy: configuration.Policy{
+			Quotas: configuration.Quotas{
+				Repositories: []configuration.RepositoryQuota{{Pattern: "ci/*", Limit: 32}},
+			},
+		},
+	}
+	config.HTTP.Headers = headerConfig
+	env := newTestEnvWithConfig(t, &config)
+	defer env.Shutdown()
 
-	u, err = env.builder.BuildManifestURL(digestRef)
-	checkErr(t, err, "building manifest URL")
+	imageName, err := reference.WithName("ci/app")
+	checkErr(t, err, "building image name")
+	content := []byte("twenty four bytes layer.")
+	uploadURLBase, _ := startPushLayer(t, env, imageName)
+	pushLayer(t, env.builder, imageName, digest.FromBytes(content), uploadURLBase, bytes.NewReader(content))
+
+	checkQuotaExceeded := func(msg string, resp *http.Response, size int) {
+		t.Helper()
+		checkResponse(t, msg, resp, http.StatusRequestEntityTooLarge)
+		errs, _, _ := checkBodyHasErrorCodes(t, msg, resp, errcode.ErrorCodeQuotaExceeded)
+		detail, ok := errs[0].(errcode.Error).Detail.(map[string]any)
+		if !ok || detail["usage"] != float64(len(content)) || detail["limit"] != float64(32) || detail["size"] != float64(size) {
+			t.Fatalf("unexpected detail of the error %s: %v", msg, errs[0].(errcode.Error).Detail)
+		}
+	}
 
-	msg = "checking manifest still exists"
-	resp, err = http.Head(u)
-	checkErr(t, err, msg)
+	over := []byte("nine byte")
+	uploadURLBase, _ = startPushLayer(t, env, imageName)
+	resp, err := doPushLayer(t, env.builder, imageName, digest.FromBytes(over), uploadURLBase, bytes.NewReader(over))
+	checkErr(t, err, "pushing layer over the quota")
 	defer resp.Body.Close()
-	checkResponse(t, msg, resp, http.StatusOK)
+	checkQuotaExceeded("pushing layer over the quota", resp, len(over))
+
+	// The layer fits in a repository with its own quota, but cannot be
+	// mounted back.
+	otherName, err := reference.WithName("ci/other")
+	checkErr(t, err, "building image name")
+	uploadURLBase, _ = startPushLayer(t, env, otherName)
+	pushLayer(t, env.builder, otherName, digest.FromBytes(over), uploadURLBase, bytes.NewReader(over))
+	uploadURL, err := env.builder.BuildBlobUploadURL(imageName, url.Values{
+		"mount": []string{digest.FromBytes(over).String()},
+		"from":  []string{otherName.Name()},
+	})
+	checkErr(t, err, "building upload url")
+	resp, err = http.Post(uploadURL, "", nil)
+	checkErr(t, err, "mounting layer over the quota")
+	defer resp.Body.Close()
+	checkQuotaExceeded("mounting layer over the quota", resp, len(over))
 }
 
-func TestManifestAPI_DeleteTag_Unknown(t *testing.T) {
-	env := newTestEnv(t, false)
-	defer env.Shutdown()
+// pushEventSink records the push events written to it.
+type pushEventSink struct {
+	mu     sync.Mutex
+	pushes []notifications.Event
+}
 
-	imageName, err := reference.WithName("foo/bar")
-	checkErr(t, err, "building named object")
+func (s *pushEventSink) Write(event events.Event) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if e, ok := event.(notifications.Event); ok && e.Action == notifications.EventActionPush {
+		s.pushes = append(s.pushes, e)
+	}
+	return nil
+}
 
-	ref, err := reference.WithTag(imageName, "latest")
-	checkErr(t, err, "building tag reference")
+func (s *pushEventSink) Close() error { return nil }
 
-	u, err := env.builder.BuildManifestURL(ref)
-	checkErr(t, err, "building tag URL")
+func (s *pushEventSink) last(t *testing.T) notifications.Event {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if len(s.pushes) == 0 {
+		t.Fatal("no push event was written")
+	}
+	return s.pushes[len(s.pushes)-1]
+}
 
-	resp, err := httpDelete(u)
-	msg := "deleting unknown tag"
-	checkErr(t, err, msg)
-	defer resp.Body.Close()
+func TestManifestAPI_PushEventAnnotations(t *testing.T) {
+	imageName, err := reference.WithName("foo/annotations")
+	checkErr(t, err, "building image name")
+	config := configuration.Configuration{
+		Storage: configuration.Storage{
+			"inmemory": configuration.Parameters{},
+			"maintenance": configuration.Parameters{"uploadpurging": map[any]any{
+				"enabled": false,
+			}},
+		},
+		Notifications: configuration.Notifications{
+			IncludeAnnotations: true,
+			MaxAnnotationsSize: 256,
+		},
+	}
+	config.HTTP.Headers = headerConfig
+	env := newTestEnvWithConfig(t, &config)
+	defer env.Shutdown()
+	sink := &pushEventSink{}
+	env.app.events.sink = sink
 
-	checkResponse(t, msg, resp, http.StatusNotFound)
-	// nolint:errcheck
-	checkBodyHasErrorCodes(t, msg, resp, errcode.ErrorCodeManifestUnknown)
+	imageConfig := []byte(`{"architecture":"amd64","os":"linux","config":{"Labels":{"maintainer":"team@example.com"}},"rootfs":{"type":"layers","diff_ids":[]}}`)
+	uploadURLBase, _ := startPushLayer(t, env, imageName)
+	pushLayer(t, env.builder, imageName, digest.FromBytes(imageConfig), uploadURLBase, bytes.NewReader(imageConfig))
+	emptyConfig := []byte("{}")
+	uploadURLBase, _ = startPushLayer(t, env, imageName)
+	pushLayer(t, env.builder, imageName, digest.FromBytes(emptyConfig), uploadURLBase, bytes.NewReader(emptyConfig))
+
+	push := func(tag, mediaType string, m distribution.Manifest) v1.Descriptor {
+		ref, err := reference.WithTag(imageName, tag)
+		checkErr(t, err, "building tag reference")
+		manifestURL, err := env.builder.BuildManifestURL(ref)
+		checkErr(t, err, "building manifest URL")
+		msg := "pushing manifest " + tag
+		resp := putManifest(t, msg, manifestURL, mediaType, m)
+		defer resp.Body.Close()
+		checkResponse(t, msg, resp, http.StatusCreated)
+		_, payload, err := m.Payload()
+		checkErr(t, err, "getting manifest payload")
+		return v1.Descriptor{MediaType: mediaType, Digest: digest.FromBytes(payload), Size: int64(len(payload))}
+	}
+
+	source := map[string]string{"org.opencontainers.image.source": "https://github.com/example/app"}
+	image, err := ocischema.FromStruct(ocischema.Manifest{
+		Versioned: specs.Versioned{SchemaVersion: 2},
+		MediaType: v1.MediaTypeImageManifest,
+		Config: v1.Descriptor{
+			MediaType: v1.MediaTypeImageConfig,
+			Digest:    digest.FromBytes(imageConfig),
+			Size:      int64(len(imageConfig)),
+		},
+		Layers:      []v1.Descriptor{v1.DescriptorEmptyJSON},
+		Annotations: source,
+	})
+	checkErr(t, err, "building image manifest")
+	desc := push("image", v1.MediaTypeImageManifest, image)
+	event := sink.last(t)
+	if event.Target.Digest != desc.Digest || event.Target.Annotations["org.opencontainers.image.source"] != source["org.opencontainers.image.source"] {
+		t.Fatalf("unexpected annotations of the image push event: %#v", event.Target)
+	}
+	if len(event.Target.Labels) != 1 || event.Target.Labels["maintainer"] != "team@example.com" {
+		t.Fatalf("unexpected labels of the image push event: %#v", event.Target)
+	}
+
+	index, err := ocischema.FromDescriptors([]v1.Descriptor{desc}, map[string]string{"org.example.channel": "stable"})
+	checkErr(t, err, "building image index")
+	desc = push("index", v1.MediaTypeImageIndex, index)
+	event = sink.last(t)
+	if event.Target.Digest != desc.Digest || len(event.Target.Annotations) != 1 || event.Target.Annotations["org.example.channel"] != "stable" || event.Target.Labels != nil {
+		t.Fatalf("unexpected annotations of the index push event: %#v", event.Target)
+	}
+
+	// Annotations over the limit are left out of the event, but not of the
+	// manifest.
+	oversized, err := ocischema.FromStruct(ocischema.Manifest{
+		Versioned:   specs.Versioned{SchemaVersion: 2},
+		MediaType:   v1.MediaTypeImageManifest,
+		Config:      v1.DescriptorEmptyJSON,
+		Layers:      []v1.Descriptor{v1.DescriptorEmptyJSON},
+		Annotations: map[string]string{"org.example.blob": strings.Repeat("x", 512)},
+	})
+	checkErr(t, err, "building oversized manifest")
+	desc = push("oversized", v1.MediaTypeImageManifest, oversized)
+	event = sink.last(t)
+	if event.Target.Digest != desc.Digest || event.Target.Annotations != nil || event.Target.Labels != nil {
+		t.Fatalf("unexpected annotations over the limit in the push event: %#v", event.Target)
+	}
 }
 
-func TestManifestAPI_DeleteTag_ReadOnly(t *testing.T) {
-	env := newTestEnv(t, false)
-	defer env.Shutdown()
-	env.app.readOnly = true
+// deleteEventSink records the delete and tag.delete events, as strings
+// naming their target.
+type deleteEventSink struct {
+	mu      sync.Mutex
+	deletes []string
+}
 
-	imageName, err := reference.WithName("foo/bar")
-	checkErr(t, err, "building named object")
+func (s *deleteEventSink) Write(event events.Event) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	e, ok := event.(notifications.Event)
+	if !ok {
+		return nil
+	}
+	switch e.Action {
+	case notifications.EventActionTagDelete:
+		s.deletes = append(s.deletes, fmt.Sprintf("%s %s:%s@%s", e.Action, e.Target.Repository, e.Target.Tag, e.Target.Digest))
+	case notifications.EventActionDelete:
+		s.deletes = append(s.deletes, fmt.Sprintf("%s %s@%s %v", e.Action, e.Target.Repository, e.Target.Digest, e.Target.Tags))
+	}
+	return nil
+}
 
-	ref, err := reference.WithTag(imageName, "latest")
-	checkErr(t, err, "building tag reference")
+func (s *deleteEventSink) Close() error { return nil }
 
-	u, err := env.builder.BuildManifestURL(ref)
-	checkErr(t, err, "building URL")
+// take returns the events recorded since the last call.
+func (s *deleteEventSink) take() []string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	deletes := s.deletes
+	s.deletes = nil
+	return deletes
+}
 
-	resp, err := httpDelete(u)
-	msg := "deleting tag"
-	checkErr(t, err, msg)
-	defer resp.Body.Close()
+func TestManifestAPI_DeleteEvents(t *testing.T) {
+	env := newTestEnv(t, true)
+	defer env.Shutdown()
+	sink := &deleteEventSink{}
+	env.app.events.sink = sink
+
+	manifestURL := func(name reference.Named, ref string) string {
+		var r reference.Named
+		if dgst, err := digest.Parse(ref); err == nil {
+			r, _ = reference.WithDigest(name, dgst)
+		} else {
+			r, _ = reference.WithTag(name, ref)
+		}
+		u, err := env.builder.BuildManifestURL(r)
+		checkErr(t, err, "building manifest url")
+		return u
+	}
+	// tag tags the manifest dgst of the repository with the tag.
+	tag := func(name reference.Named, dgst digest.Digest, tag string) {
+		req, err := http.NewRequest(http.MethodGet, manifestURL(name, dgst.String()), nil)
+		checkErr(t, err, "building manifest request")
+		req.Header.Set("Accept", schema2.MediaTypeManifest)
+		resp, err := http.DefaultClient.Do(req)
+		checkErr(t, err, "fetching manifest")
+		defer resp.Body.Close()
+		payload, err := io.ReadAll(resp.Body)
+		checkErr(t, err, "reading manifest")
+		req, err = http.NewRequest(http.MethodPut, manifestURL(name, tag), bytes.NewReader(payload))
+		checkErr(t, err, "building tag request")
+		req.Header.Set("Content-Type", schema2.MediaTypeManifest)
+		resp, err = http.DefaultClient.Do(req)
+		checkErr(t, err, "tagging manifest")
+		defer resp.Body.Close()
+		checkResponse(t, "tagging manifest", resp, http.StatusCreated)
+	}
+	deleteManifest := func(name reference.Named, ref string, expectedStatus int) {
+		resp, err := httpDelete(manifestURL(name, ref))
+		checkErr(t, err, "deleting manifest")
+		defer resp.Body.Close()
+		checkResponse(t, "deleting manifest", resp, expectedStatus)
+	}
+	checkEvents := func(msg string, expected ...string) {
+		t.Helper()
+		if deletes := sink.take(); !reflect.DeepEqual(deletes, expected) {
+			t.Fatalf("%s: unexpected events %q, expected %q", msg, deletes, expected)
+		}
+	}
 
-	checkResponse(t, msg, resp, http.StatusMethodNotAllowed)
+	name, _ := reference.WithName("foo/deletes")
+	dgst := createRepository(env, t, name.Name(), "latest")
+	tag(name, dgst, "v1")
+	sink.take()
+
+	// The deletion of a tag reports the tag and its digest.
+	deleteManifest(name, "v1", http.StatusAccepted)
+	checkEvents("delete tag", fmt.Sprintf("tag.delete foo/deletes:v1@%s", dgst))
+
+	// The deletion of a tagged manifest reports its tags, in order.
+	tag(name, dgst, "v1")
+	sink.take()
+	deleteManifest(name, dgst.String(), http.StatusAccepted)
+	checkEvents("delete manifest with two tags",
+		fmt.Sprintf("delete foo/deletes@%s []", dgst),
+		fmt.Sprintf("tag.delete foo/deletes:latest@%s", dgst),
+		fmt.Sprintf("tag.delete foo/deletes:v1@%s", dgst))
+
+	dgst = createRepository(env, t, name.Name(), "latest")
+	deleteManifest(name, "latest", http.StatusAccepted)
+	sink.take()
+	deleteManifest(name, dgst.String(), http.StatusAccepted)
+	checkEvents("delete untagged manifest", fmt.Sprintf("delete foo/deletes@%s []", dgst))
+
+	// The tags can be reported in the event of the manifest instead.
+	env.app.Config.Notifications.EventConfig.TagDeletes = configuration.TagDeletesManifest
+	dgst = createRepository(env, t, name.Name(), "v1")
+	tag(name, dgst, "latest")
+	sink.take()
+	deleteManifest(name, dgst.String(), http.StatusAccepted)
+	checkEvents("delete manifest with two tags in the manifest event", fmt.Sprintf("delete foo/deletes@%s [latest v1]", dgst))
+	deleteManifest(name, "v1", http.StatusNotFound)
+	checkEvents("delete unknown tag")
 }
 
 // storageManifestErrDriverFactory implements the factory.StorageDriverFactory interface.
@@ -1643,7 +3176,8 @@ func testManifestAPISchema2(t *testing.T, env *testEnv, imageName reference.Name
 	resp = putManifest(t, "putting missing layer manifest", manifestURL, schema2.MediaTypeManifest, manifest)
 	defer resp.Body.Close()
 	checkResponse(t, "putting missing layer manifest", resp, http.StatusBadRequest)
-	_, p, counts = checkBodyHasErrorCodes(t, "getting unknown manifest tags", resp, errcode.ErrorCodeManifestBlobUnknown)
+	var errs errcode.Errors
+	errs, p, counts = checkBodyHasErrorCodes(t, "getting unknown manifest tags", resp, errcode.ErrorCodeManifestBlobUnknown)
 
 	expectedCounts = map[errcode.ErrorCode]int{
 		errcode.ErrorCodeManifestBlobUnknown: 2,
@@ -1653,6 +3187,14 @@ func testManifestAPISchema2(t *testing.T, env *testEnv, imageName reference.Name
 		t.Fatalf("unexpected number of error codes encountered: %v\n!=\n%v\n---\n%s", counts, expectedCounts, string(p))
 	}
 
+	// The errors name the descriptors of the missing layers.
+	for i, err := range errs {
+		detail, ok := err.(errcode.Error).Detail.(map[string]any)
+		if !ok || detail["field"] != fmt.Sprintf("layers[%d]", i) || detail["digest"] != manifest.Layers[i].Digest.String() || detail["mediaType"] != schema2.MediaTypeLayer {
+			t.Fatalf("unexpected error detail: %#v", err)
+		}
+	}
+
 	// Push 2 random layers
 	expectedLayers := make(map[digest.Digest]io.ReadSeeker)
 
@@ -2869,3 +4411,434 @@ func TestProxyManifestGetByTag(t *testing.T) {
 		"Docker-Content-Digest": []string{newDigest.String()},
 	})
 }
+
+// requestEventSink records the request ids of the events written to it.
+type requestEventSink struct {
+	mu     sync.Mutex
+	events map[string][]string
+}
+
+func (s *requestEventSink) Write(event events.Event) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if e, ok := event.(notifications.Event); ok {
+		s.events[e.Action] = append(s.events[e.Action], e.Request.ID)
+	}
+	return nil
+}
+
+func (s *requestEventSink) Close() error { return nil }
+
+func TestProxyRequestID(t *testing.T) {
+	imageName, _ := reference.WithName("foo/requestid")
+	truthEnv := newTestEnv(t, false)
+	defer truthEnv.Shutdown()
+	createRepository(truthEnv, t, imageName.Name(), "latest")
+
+	// The upstream records the request ids forwarded by the proxy.
+	var mu sync.Mutex
+	var forwarded []string
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		forwarded = append(forwarded, r.Header.Get("X-Forwarded-Request-Id"))
+		mu.Unlock()
+		truthEnv.server.Config.Handler.ServeHTTP(w, r)
+	}))
+	defer upstream.Close()
+
+	proxyConfig := configuration.Configuration{
+		Storage: configuration.Storage{
+			"inmemory": configuration.Parameters{},
+		},
+		Proxy: configuration.Proxy{
+			RemoteURL: upstream.URL,
+		},
+	}
+	proxyConfig.HTTP.Headers = headerConfig
+	proxyConfig.Notifications.EventConfig.Proxy = true
+	proxyEnv := newTestEnvWithConfig(t, &proxyConfig)
+	defer proxyEnv.Shutdown()
+	sink := &requestEventSink{events: make(map[string][]string)}
+	proxyEnv.app.events.sink = sink
+	// The startup checks of the upstream are not made for a request.
+	mu.Lock()
+	forwarded = nil
+	mu.Unlock()
+
+	checkForwarded := func(id string) {
+		t.Helper()
+		mu.Lock()
+		defer mu.Unlock()
+		if len(forwarded) == 0 {
+			t.Fatal("no upstream request was made")
+		}
+		for _, f := range forwarded {
+			if f != id {
+				t.Fatalf("unexpected request id forwarded to the upstream: %q != %q", f, id)
+			}
+		}
+		forwarded = nil
+	}
+
+	// The request id of the client is adopted.
+	tagRef, _ := reference.WithTag(imageName, "latest")
+	manifestURL, err := proxyEnv.builder.BuildManifestURL(tagRef)
+	checkErr(t, err, "building manifest url")
+	req, err := http.NewRequest(http.MethodGet, manifestURL, nil)
+	checkErr(t, err, "building manifest request")
+	req.Header.Set("X-Request-Id", "pull-1234")
+	resp, err := http.DefaultClient.Do(req)
+	checkErr(t, err, "fetching manifest from proxy")
+	defer resp.Body.Close()
+	checkResponse(t, "fetching manifest from proxy", resp, http.StatusOK)
+	checkHeaders(t, resp, http.Header{"X-Request-Id": []string{"pull-1234"}})
+	checkForwarded("pull-1234")
+
+	sink.mu.Lock()
+	for _, action := range []string{notifications.EventActionPull, notifications.EventActionPullThroughMiss} {
+		if ids := sink.events[action]; len(ids) != 1 || ids[0] != "pull-1234" {
+			t.Fatalf("unexpected request ids of the %s events: %v", action, ids)
+		}
+	}
+	sink.mu.Unlock()
+
+	// Otherwise, the request id is generated.
+	var m schema2.Manifest
+	checkErr(t, json.NewDecoder(resp.Body).Decode(&m), "decoding manifest")
+	blobRef, _ := reference.WithDigest(imageName, m.Config.Digest)
+	blobURL, err := proxyEnv.builder.BuildBlobURL(blobRef)
+	checkErr(t, err, "building blob url")
+	resp, err = http.Get(blobURL)
+	checkErr(t, err, "fetching blob from proxy")
+	defer resp.Body.Close()
+	checkResponse(t, "fetching blob from proxy", resp, http.StatusOK)
+	id := resp.Header.Get("X-Request-Id")
+	if id == "" || id == "pull-1234" {
+		t.Fatalf("unexpected generated request id %q", id)
+	}
+	if _, err := io.Copy(io.Discard, resp.Body); err != nil {
+		t.Fatalf("error reading blob: %v", err)
+	}
+	checkForwarded(id)
+}
+
+func TestProxyUpstreamAuthErrors(t *testing.T) {
+	// The token service of the upstream responds with the status set.
+	var mu sync.Mutex
+	tokenStatus := http.StatusOK
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		defer mu.Unlock()
+		switch {
+		case r.URL.Path == "/token" && tokenStatus != http.StatusOK:
+			w.Header().Set("Content-Type", "application/json")
+			w.WriteHeader(tokenStatus)
+			fmt.Fprint(w, `{"errors": [{"code": "UNAUTHORIZED", "message": "upstream secret"}]}`)
+		case r.URL.Path == "/token":
+			fmt.Fprint(w, `{"token": "upstream-token"}`)
+		case r.URL.Path == "/v2/" || r.Header.Get("Authorization") != "Bearer upstream-token":
+			w.Header().Set("WWW-Authenticate", fmt.Sprintf(`Bearer realm="http://%s/token",service="upstream"`, r.Host))
+			w.WriteHeader(http.StatusUnauthorized)
+		default:
+			w.WriteHeader(http.StatusForbidden)
+		}
+	}))
+	defer upstream.Close()
+
+	config := adminConfig()
+	config.Proxy = configuration.Proxy{RemoteURL: upstream.URL, Username: "user", Password: "password"}
+	app := NewApp(dcontext.Background(), &config)
+	host := strings.TrimPrefix(upstream.URL, "http://")
+
+	for _, tc := range []struct {
+		name          string
+		authorization string
+		tokenStatus   int
+		status        int
+		code          errcode.ErrorCode
+	}{
+		{"local denied", "", http.StatusOK, http.StatusUnauthorized, errcode.ErrorCodeUnauthorized},
+		{"upstream denied", "Bearer local", http.StatusOK, http.StatusBadGateway, errcode.ErrorCodeUpstreamAuthFailed},
+		{"token refused", "Bearer local", http.StatusUnauthorized, http.StatusBadGateway, errcode.ErrorCodeUpstreamAuthFailed},
+		{"token service down", "Bearer local", http.StatusServiceUnavailable, http.StatusServiceUnavailable, errcode.ErrorCodeUpstreamAuthUnavailable},
+	} {
+		mu.Lock()
+		tokenStatus = tc.tokenStatus
+		mu.Unlock()
+		for _, target := range []string{"/v2/library/app/manifests/latest", "/v2/library/app/blobs/" + digest.FromString("blob").String()} {
+			r := httptest.NewRequest(http.MethodGet, target, nil)
+			if tc.authorization != "" {
+				r.Header.Set("Authorization", tc.authorization)
+			}
+			w := httptest.NewRecorder()
+			app.ServeHTTP(w, r)
+			resp := w.Result()
+			msg := tc.name + " " + target
+			if resp.StatusCode != tc.status {
+				t.Errorf("%s: unexpected status %d, expected %d", msg, resp.StatusCode, tc.status)
+			}
+			errs, body, _ := checkBodyHasErrorCodes(t, msg, resp, tc.code)
+			if tc.code == errcode.ErrorCodeUnauthorized {
+				continue
+			}
+			if detail, _ := errs[0].(errcode.Error).Detail.(map[string]any); len(errs) != 1 || len(detail) != 1 || detail["upstream"] != host {
+				t.Errorf("%s: unexpected errors %s", msg, body)
+			}
+			if bytes.Contains(body, []byte("upstream secret")) || bytes.Contains(body, []byte("password")) {
+				t.Errorf("%s: the response of the upstream is served: %s", msg, body)
+			}
+		}
+	}
+}
+
+func init() {
+	if err := auth.Register("denypull", func(options map[string]any) (auth.AccessController, error) {
+		return denyPullAccessController{}, nil
+	}); err != nil {
+		panic(err)
+	}
+}
+
+// denyPullAccessController grants every access but pulling from the
+// repositories under denied/.
+type denyPullAccessController struct{}
+
+func (denyPullAccessController) Authorized(r *http.Request, access ...auth.Access) (*auth.Grant, error) {
+	grant := &auth.Grant{}
+	for _, a := range access {
+		if a.Action == "pull" && strings.HasPrefix(a.Name, "denied/") {
+			return nil, denyPullChallenge{access: a}
+		}
+		grant.Resources = append(grant.Resources, a.Resource)
+	}
+	return grant, nil
+}
+
+type denyPullChallenge struct {
+	access auth.Access
+}
+
+func (c denyPullChallenge) Error() string {
+	return fmt.Sprintf("%s access to %s denied", c.access.Action, c.access.Name)
+}
+
+func (c denyPullChallenge) SetHeaders(r *http.Request, w http.ResponseWriter) {}
+
+func TestProxyBlobMount(t *testing.T) {
+	truthEnv := newTestEnv(t, false)
+	defer truthEnv.Shutdown()
+
+	sourceName, _ := reference.WithName("foo/source")
+	deniedName, _ := reference.WithName("denied/source")
+	targetName, _ := reference.WithName("foo/target")
+
+	layerFile, layerDigest, err := testutil.CreateRandomTarFile()
+	checkErr(t, err, "creating random layer")
+	for _, name := range []reference.Named{sourceName, deniedName} {
+		if _, err := layerFile.Seek(0, io.SeekStart); err != nil {
+			t.Fatal(err)
+		}
+		uploadURLBase, _ := startPushLayer(t, truthEnv, name)
+		pushLayer(t, truthEnv.builder, name, layerDigest, uploadURLBase, layerFile)
+	}
+
+	newProxyEnv := func(fetchOnMount bool) *testEnv {
+		proxyConfig := configuration.Configuration{
+			Storage: configuration.Storage{
+				"inmemory": configuration.Parameters{},
+			},
+			Proxy: configuration.Proxy{
+				RemoteURL:    truthEnv.server.URL,
+				FetchOnMount: fetchOnMount,
+			},
+			Auth: configuration.Auth{
+				"denypull": configuration.Parameters{},
+			},
+		}
+		proxyConfig.HTTP.Headers = headerConfig
+		return newTestEnvWithConfig(t, &proxyConfig)
+	}
+	mount := func(env *testEnv, target, from reference.Named, dgst digest.Digest) *http.Response {
+		uploadURL, err := env.builder.BuildBlobUploadURL(target, url.Values{
+			"mount": []string{dgst.String()},
+			"from":  []string{from.Name()},
+		})
+		checkErr(t, err, "building upload url")
+		resp, err := http.Post(uploadURL, "", nil)
+		checkErr(t, err, "mounting blob")
+		return resp
+	}
+
+	// Without fetching on mount, only the blobs held by the cache are
+	// mounted; there is no upload session to fall back to.
+	proxyEnv := newProxyEnv(false)
+	defer proxyEnv.Shutdown()
+	resp := mount(proxyEnv, targetName, sourceName, layerDigest)
+	defer resp.Body.Close()
+	checkResponse(t, "mounting a blob which is not cached", resp, http.StatusMethodNotAllowed)
+	checkBodyHasErrorCodes(t, "mounting a blob which is not cached", resp, errcode.ErrorCodeUnsupported)
+
+	proxyEnv = newProxyEnv(true)
+	defer proxyEnv.Shutdown()
+	resp = mount(proxyEnv, targetName, sourceName, layerDigest)
+	defer resp.Body.Close()
+	checkResponse(t, "mounting a blob of a proxied repository", resp, http.StatusCreated)
+	checkHeaders(t, resp, http.Header{
+		"Docker-Content-Digest": []string{layerDigest.String()},
+	})
+
+	// The blob is served from the cache by the target repository, which
+	// does not exist upstream, and can be mounted from it in turn.
+	ref, _ := reference.WithDigest(targetName, layerDigest)
+	layerURL, err := proxyEnv.builder.BuildBlobURL(ref)
+	checkErr(t, err, "building blob url")
+	resp, err = http.Head(layerURL)
+	checkErr(t, err, "checking mounted blob")
+	defer resp.Body.Close()
+	checkResponse(t, "checking mounted blob", resp, http.StatusOK)
+
+	otherName, _ := reference.WithName("foo/other")
+	resp = mount(proxyEnv, otherName, targetName, layerDigest)
+	defer resp.Body.Close()
+	checkResponse(t, "mounting a blob cached in a proxied repository", resp, http.StatusCreated)
+
+	resp = mount(proxyEnv, targetName, sourceName, digest.FromString("missing blob"))
+	defer resp.Body.Close()
+	checkResponse(t, "mounting a blob which does not exist", resp, http.StatusMethodNotAllowed)
+	checkBodyHasErrorCodes(t, "mounting a blob which does not exist", resp, errcode.ErrorCodeUnsupported)
+
+	// Pull access to the source repository is still required.
+	resp = mount(proxyEnv, targetName, deniedName, layerDigest)
+	defer resp.Body.Close()
+	checkResponse(t, "mounting a blob from a denied repository", resp, http.StatusUnauthorized)
+}
+
+func TestProxyStreamThrough(t *testing.T) {
+	imageName, _ := reference.WithName("foo/streamthrough")
+	truthEnv := newTestEnv(t, false)
+	defer truthEnv.Shutdown()
+	dgst := createRepository(truthEnv, t, imageName.Name(), "latest")
+
+	proxyConfig := configuration.Configuration{
+		Storage: configuration.Storage{
+			"inmemory": configuration.Parameters{},
+		},
+		Proxy: configuration.Proxy{
+			RemoteURL: truthEnv.server.URL,
+			Mode:      configuration.ProxyModeStreamThrough,
+		},
+		Auth: configuration.Auth{
+			"denypull": configuration.Parameters{},
+		},
+	}
+	proxyConfig.HTTP.Headers = headerConfig
+	proxyConfig.Notifications.EventConfig.Proxy = true
+	proxyEnv := newTestEnvWithConfig(t, &proxyConfig)
+	defer proxyEnv.Shutdown()
+	sink := &requestEventSink{events: make(map[string][]string)}
+	proxyEnv.app.events.sink = sink
+
+	request := func(method, u string, header http.Header) *http.Response {
+		t.Helper()
+		req, err := http.NewRequest(method, u, nil)
+		checkErr(t, err, "building request")
+		req.Header = header
+		resp, err := http.DefaultClient.Do(req)
+		checkErr(t, err, "requesting "+u)
+		return resp
+	}
+
+	// The manifests are pulled by tag and by digest.
+	var m schema2.Manifest
+	tagRef, _ := reference.WithTag(imageName, "latest")
+	digestRef, _ := reference.WithDigest(imageName, dgst)
+	for _, ref := range []reference.Named{tagRef, digestRef} {
+		manifestURL, err := proxyEnv.builder.BuildManifestURL(ref)
+		checkErr(t, err, "building manifest url")
+		header := http.Header{"Accept": []string{schema2.MediaTypeManifest}}
+		for _, method := range []string{http.MethodHead, http.MethodGet} {
+			resp := request(method, manifestURL, header)
+			defer resp.Body.Close()
+			checkResponse(t, method+" manifest "+ref.String(), resp, http.StatusOK)
+			checkHeaders(t, resp, http.Header{
+				"Docker-Content-Digest": []string{dgst.String()},
+			})
+			if method == http.MethodGet {
+				checkErr(t, json.NewDecoder(resp.Body).Decode(&m), "decoding manifest")
+			}
+		}
+	}
+
+	// The blobs are served whole, partially or only their headers.
+	blobRef, _ := reference.WithDigest(imageName, m.Layers[0].Digest)
+	blobURL, err := proxyEnv.builder.BuildBlobURL(blobRef)
+	checkErr(t, err, "building blob url")
+	resp := request(http.MethodGet, blobURL, http.Header{})
+	defer resp.Body.Close()
+	checkResponse(t, "fetching blob", resp, http.StatusOK)
+	content, err := io.ReadAll(resp.Body)
+	checkErr(t, err, "reading blob")
+	if digest.FromBytes(content) != m.Layers[0].Digest {
+		t.Fatal("blob content does not match its digest")
+	}
+	resp = request(http.MethodHead, blobURL, http.Header{})
+	defer resp.Body.Close()
+	checkResponse(t, "checking blob", resp, http.StatusOK)
+	checkHeaders(t, resp, http.Header{
+		"Content-Length":        []string{fmt.Sprint(len(content))},
+		"Docker-Content-Digest": []string{m.Layers[0].Digest.String()},
+	})
+	resp = request(http.MethodGet, blobURL, http.Header{"Range": []string{"bytes=10-19"}})
+	defer resp.Body.Close()
+	checkResponse(t, "fetching blob range", resp, http.StatusPartialContent)
+	partial, err := io.ReadAll(resp.Body)
+	checkErr(t, err, "reading blob range")
+	if !bytes.Equal(partial, content[10:20]) {
+		t.Fatalf("unexpected blob range %q", partial)
+	}
+
+	// The errors are those of the caching mode.
+	unknownRef, _ := reference.WithTag(imageName, "unknown")
+	manifestURL, err := proxyEnv.builder.BuildManifestURL(unknownRef)
+	checkErr(t, err, "building manifest url")
+	resp = request(http.MethodGet, manifestURL, http.Header{})
+	defer resp.Body.Close()
+	checkResponse(t, "fetching unknown manifest", resp, http.StatusNotFound)
+	checkBodyHasErrorCodes(t, "fetching unknown manifest", resp, errcode.ErrorCodeManifestUnknown)
+	unknownBlobRef, _ := reference.WithDigest(imageName, digest.FromString("unknown blob"))
+	unknownBlobURL, err := proxyEnv.builder.BuildBlobURL(unknownBlobRef)
+	checkErr(t, err, "building blob url")
+	resp = request(http.MethodGet, unknownBlobURL, http.Header{})
+	defer resp.Body.Close()
+	checkResponse(t, "fetching unknown blob", resp, http.StatusNotFound)
+	checkBodyHasErrorCodes(t, "fetching unknown blob", resp, errcode.ErrorCodeBlobUnknown)
+
+	// Pushes are refused, and the local authorization still applies.
+	uploadURL, err := proxyEnv.builder.BuildBlobUploadURL(imageName)
+	checkErr(t, err, "building upload url")
+	resp = request(http.MethodPost, uploadURL, http.Header{})
+	defer resp.Body.Close()
+	checkResponse(t, "starting an upload", resp, http.StatusMethodNotAllowed)
+	deniedRef, _ := reference.WithName("denied/streamthrough")
+	deniedTagRef, _ := reference.WithTag(deniedRef, "latest")
+	manifestURL, err = proxyEnv.builder.BuildManifestURL(deniedTagRef)
+	checkErr(t, err, "building manifest url")
+	resp = request(http.MethodGet, manifestURL, http.Header{})
+	defer resp.Body.Close()
+	checkResponse(t, "fetching denied manifest", resp, http.StatusUnauthorized)
+
+	sink.mu.Lock()
+	if pulls := len(sink.events[notifications.EventActionPull]); pulls == 0 {
+		t.Fatal("no pull event was sent")
+	}
+	sink.mu.Unlock()
+
+	// Nothing was written to the storage.
+	entries, err := proxyEnv.app.driver.List(proxyEnv.ctx, "/")
+	if _, ok := err.(storagedriver.PathNotFoundError); err != nil && !ok {
+		t.Fatal(err)
+	}
+	if len(entries) != 0 {
+		t.Fatalf("unexpected entries written to the storage: %v", entries)
+	}
+}
@@ -5,6 +5,7 @@ import (
 	"crypto/rand"
 	"crypto/tls"
 	"crypto/x509"
+	"errors"
 	"expvar"
 	"fmt"
 	"math"
@@ -17,21 +18,26 @@ import (
 	"runtime"
 	"strconv"
 	"strings"
+	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/distribution/distribution/v3"
+	"github.com/distribution/distribution/v3/audit"
 	"github.com/distribution/distribution/v3/configuration"
 	"github.com/distribution/distribution/v3/health"
 	"github.com/distribution/distribution/v3/health/checks"
 	"github.com/distribution/distribution/v3/internal/dcontext"
 	prometheus "github.com/distribution/distribution/v3/metrics"
 	"github.com/distribution/distribution/v3/notifications"
+	"github.com/distribution/distribution/v3/registry/accesslog"
 	"github.com/distribution/distribution/v3/registry/api/errcode"
 	v2 "github.com/distribution/distribution/v3/registry/api/v2"
 	"github.com/distribution/distribution/v3/registry/auth"
 	registrymiddleware "github.com/distribution/distribution/v3/registry/middleware/registry"
 	repositorymiddleware "github.com/distribution/distribution/v3/registry/middleware/repository"
 	"github.com/distribution/distribution/v3/registry/proxy"
+	"github.com/distribution/distribution/v3/registry/replication"
 	"github.com/distribution/distribution/v3/registry/storage"
 	memorycache "github.com/distribution/distribution/v3/registry/storage/cache/memory"
 	rediscache "github.com/distribution/distribution/v3/registry/storage/cache/redis"
@@ -42,7 +48,9 @@ import (
 	"github.com/distribution/reference"
 	events "github.com/docker/go-events"
 	"github.com/docker/go-metrics"
+	"github.com/google/uuid"
 	"github.com/gorilla/mux"
+	"github.com/opencontainers/go-digest"
 	"github.com/redis/go-redis/extra/redisotel/v9"
 	"github.com/redis/go-redis/v9"
 	"github.com/sirupsen/logrus"
@@ -55,6 +63,22 @@ const randomSecretSize = 32
 // defaultCheckInterval is the default time in between health checks
 const defaultCheckInterval = 10 * time.Second
 
+// defaultWriteProbeInterval is the default interval of the storage driver
+// write probe, longer than that of the other checks since each probe costs
+// three requests to object stores.
+const defaultWriteProbeInterval = 10 * time.Minute
+
+// defaultECRCheckInterval is the default interval of the ECR credential
+// checks, which only call the ECR API when the cached token expires soon.
+const defaultECRCheckInterval = time.Minute
+
+// ecrCheckMargin is how long the cached ECR token must remain valid for the
+// credential check to pass without getting a new one.
+const ecrCheckMargin = time.Hour
+
+// defaultTagCacheTTL is the default time the tags are cached for
+const defaultTagCacheTTL = 5 * time.Second
+
 // App is a global registry application object. Shared resources can be placed
 // on this object that will be accessible from all requests. Any writable
 // fields should be protected.
@@ -66,8 +90,20 @@ type App struct {
 	router           *mux.Router                    // main application router, configured with dispatchers
 	driver           storagedriver.StorageDriver    // driver maintains the app global storage driver instance.
 	registry         distribution.Namespace         // registry is the primary registry backend for the app instance.
+	storage          distribution.Namespace         // storage is the registry backend behind the pull through cache, if any.
 	repoRemover      distribution.RepositoryRemover // repoRemover provides ability to delete repos
-	accessController auth.AccessController          // main access controller for application
+	audit            *audit.Logger                  // audit records the deletions, if configured
+	accessController auth.AccessController          // main access controller for application, guarded by authMu
+	networkPolicy    *networkPolicy                 // networkPolicy restricts actions to client addresses
+	immutableTags    *tagImmutability               // immutableTags refuses the pushes moving immutable tags
+	quotas           *storage.Quotas                // quotas limits the size of the layers linked by repositories, if configured
+	catalogIndex     *storage.CatalogIndex          // catalogIndex lists the repositories of the catalog, if configured
+	tenancy          *tenancy                       // tenancy routes the repositories to the registries of their tenant, if configured
+	pullCounts       *storage.PullCounts            // pullCounts counts the pulls of the manifests, if configured
+	lastAccess       *storage.LastAccess            // lastAccess records the last pulls and pushes, if configured
+	rateLimiter      *rateLimiter                   // rateLimiter limits the rate of requests of each client
+	driverCloser     storagedriver.Closer           // driverCloser closes the storage driver on shutdown, if it holds resources
+	cancel           context.CancelFunc             // cancel stops the background work of the app on shutdown
 
 	// httpHost is a parsed representation of the http.host parameter from
 	// the configuration. Only the Scheme and Host fields are used.
@@ -77,6 +113,11 @@ type App struct {
 	events struct {
 		sink   events.Sink
 		source notifications.SourceRecord
+
+		// broadcaster broadcasts the events to the endpoints, which are
+		// replaced on reloads under reloadMu.
+		broadcaster *events.Broadcaster
+		endpoints   []events.Sink
 	}
 
 	redis redis.UniversalClient
@@ -84,19 +125,37 @@ type App struct {
 	// isCache is true if this registry is configured as a pull through cache
 	isCache bool
 
-	// readOnly is true if the registry is in a read-only maintenance mode
-	readOnly bool
+	// deleteEnabled is true if the storage allows deletions
+	deleteEnabled bool
+
+	// readOnly is the read-only maintenance mode of the registry
+	readOnly *readOnlyMode
+
+	// renames refuses the writes to the repositories being renamed
+	renames *renameGuard
+
+	// authMu guards the access controller, which is replaced on reloads.
+	authMu sync.RWMutex
+
+	// logLevels overrides the log level of the requests for some
+	// repositories, replaced on reloads.
+	logLevels atomic.Pointer[repositoryLogLevels]
+
+	// reloadMu serializes the reloads of the configuration.
+	reloadMu sync.Mutex
 }
 
 // NewApp takes a configuration and returns a configured app, ready to serve
 // requests. The app only implements ServeHTTP and can be wrapped in other
 // handlers accordingly.
 func NewApp(ctx context.Context, config *configuration.Configuration) *App {
+	ctx, cancel := context.WithCancel(ctx)
 	app := &App{
 		Config:  config,
 		Context: ctx,
+		cancel:  cancel,
 		router:  v2.RouterWithPrefix(config.HTTP.Prefix),
-		isCache: config.Proxy.RemoteURL != "",
+		isCache: config.Proxy.Enabled(),
 	}
 
 	// Register the handler dispatchers.
@@ -105,10 +164,20 @@ func NewApp(ctx context.Context, config *configuration.Configuration) *App {
 	})
 	app.register(v2.RouteNameManifest, manifestDispatcher)
 	app.register(v2.RouteNameCatalog, catalogDispatcher)
+	app.register(v2.RouteNameSearch, searchDispatcher)
 	app.register(v2.RouteNameTags, tagsDispatcher)
+	app.register(v2.RouteNameTag, tagDispatcher)
+	app.register(v2.RouteNameTagHistory, tagHistoryDispatcher)
+	app.register(v2.RouteNameReferrers, referrersDispatcher)
 	app.register(v2.RouteNameBlob, blobDispatcher)
 	app.register(v2.RouteNameBlobUpload, blobUploadDispatcher)
 	app.register(v2.RouteNameBlobUploadChunk, blobUploadDispatcher)
+	app.register(v2.RouteNameAdminReadOnly, adminReadOnlyDispatcher)
+	app.register(v2.RouteNameAdminRename, adminRenameDispatcher)
+	app.register(v2.RouteNameProxyExpirations, proxyExpirationsDispatcher)
+	app.register(v2.RouteNameProxyMirror, proxyMirrorDispatcher)
+	app.register(v2.RouteNamePullStats, pullStatsDispatcher)
+	app.register(v2.RouteNameRepositoryMetadata, repositoryMetadataDispatcher)
 
 	// override the storage driver's UA string for registry outbound HTTP requests
 	storageParams := config.Storage.Parameters()
@@ -129,6 +198,9 @@ func NewApp(ctx context.Context, config *configuration.Configuration) *App {
 	}
 
 	purgeConfig := uploadPurgeDefaultConfig()
+	var usageConfig *usageConfig
+	var inventoryConfig *inventoryConfig
+	var readOnlyConfig map[any]any
 	if mc, ok := config.Storage["maintenance"]; ok {
 		if v, ok := mc["uploadpurging"]; ok {
 			purgeConfig, ok = v.(map[any]any)
@@ -137,25 +209,49 @@ func NewApp(ctx context.Context, config *configuration.Configuration) *App {
 			}
 		}
 		if v, ok := mc["readonly"]; ok {
-			readOnly, ok := v.(map[any]any)
+			readOnlyConfig, ok = v.(map[any]any)
 			if !ok {
 				panic("readonly config key must contain additional keys")
 			}
-			if readOnlyEnabled, ok := readOnly["enabled"]; ok {
-				app.readOnly, ok = readOnlyEnabled.(bool)
-				if !ok {
-					panic("readonly's enabled config key must have a boolean value")
-				}
+		}
+		if v, ok := mc["usage"]; ok {
+			usage, ok := v.(map[any]any)
+			if !ok {
+				panic("usage config key must contain additional keys")
+			}
+			usageConfig = parseUsageConfig(usage)
+		}
+		if v, ok := mc["inventory"]; ok {
+			inventory, ok := v.(map[any]any)
+			if !ok {
+				panic("inventory config key must contain additional keys")
 			}
+			inventoryConfig = parseInventoryConfig(inventory)
 		}
 	}
 
-	startUploadPurger(app, app.driver, dcontext.GetLogger(app), purgeConfig)
+	if config.Tenancy.Enabled() {
+		// The uploads of the tenants are kept under their prefix.
+		for _, tenant := range config.Tenancy.Tenants {
+			startUploadPurger(app, storage.TenantDriver(app.driver, tenant.TenantPrefix()), dcontext.GetLogger(app), purgeConfig)
+		}
+	} else {
+		startUploadPurger(app, app.driver, dcontext.GetLogger(app), purgeConfig)
+	}
+	if usageConfig != nil {
+		// The usage is measured on the storage driver itself, before the
+		// storage middlewares which may change what is stored.
+		startUsageCollector(app, app.driver, dcontext.GetLogger(app), usageConfig)
+	}
 
+	// The storage middlewares do not close the driver they wrap.
+	app.driverCloser, _ = app.driver.(storagedriver.Closer)
 	app.driver, err = applyStorageMiddleware(app, app.driver, config.Middleware["storage"])
 	if err != nil {
 		panic(err)
 	}
+	app.readOnly = newReadOnlyMode(app, readOnlyConfig, app.driver)
+	app.renames = newRenameGuard()
 
 	// Do not configure HTTP secret for a proxy registry as HTTP secret
 	// is only used for blob uploads and a proxy registry does not support blob uploads.
@@ -163,11 +259,19 @@ func NewApp(ctx context.Context, config *configuration.Configuration) *App {
 		app.configureSecret(config)
 	}
 	app.configureEvents(config)
+	app.configureAudit(config)
 	app.configureRedis(config)
 	app.configureLogHook(config)
 
 	options := registrymiddleware.GetRegistryOptions()
 
+	var inventory inventorySources
+	if inventoryConfig != nil {
+		inventory.blobs = storage.NewBlobInventory()
+		inventory.driver = app.driver
+		options = append(options, storage.TrackBlobInventory(inventory.blobs))
+	}
+
 	if config.HTTP.Host != "" {
 		u, err := url.Parse(config.HTTP.Host)
 		if err != nil {
@@ -177,7 +281,7 @@ func NewApp(ctx context.Context, config *configuration.Configuration) *App {
 	}
 
 	if app.isCache {
-		options = append(options, storage.DisableDigestResumption)
+		options = append(options, storage.DisableDigestResumption, storage.FreezeReferrersTags)
 	}
 
 	// configure deletion
@@ -186,8 +290,12 @@ func NewApp(ctx context.Context, config *configuration.Configuration) *App {
 		if ok {
 			if deleteEnabled, ok := e.(bool); ok && deleteEnabled {
 				options = append(options, storage.EnableDelete)
+				app.deleteEnabled = true
 			}
 		}
+		if cascade, ok := d["referrerstags"].(bool); ok && cascade {
+			options = append(options, storage.CascadeReferrersTags)
+		}
 	}
 
 	// configure tag lookup concurrency limit
@@ -222,6 +330,46 @@ func NewApp(ctx context.Context, config *configuration.Configuration) *App {
 		options = append(options, storage.EnableRedirect)
 	}
 
+	// configure cross-repository blob mounts
+	if mountConfig, ok := config.Storage["mount"]; ok {
+		switch v := mountConfig["disable"].(type) {
+		case bool:
+			if v {
+				dcontext.GetLogger(app).Infof("cross-repository blob mounts disabled")
+				options = append(options, storage.DisableBlobMounts)
+			}
+		default:
+			panic(fmt.Sprintf("invalid type for mount config: %#v", mountConfig))
+		}
+	}
+
+	// configure the verification of the blobs read
+	if verificationConfig, ok := config.Storage["verification"]; ok {
+		if enabled, _ := verificationConfig["enabled"].(bool); enabled {
+			maxSize := verificationParameter(verificationConfig, "maxsize")
+			sampling := verificationParameter(verificationConfig, "sampling")
+			dcontext.GetLogger(app).Infof("verifying blob reads, up to %d bytes, one in %d reads", maxSize, max(sampling, 1))
+			options = append(options, storage.VerifyBlobReads(maxSize, int(sampling)))
+		}
+	}
+
+	// configure the store of the upload sessions
+	if uploadsConfig, ok := config.Storage["uploads"]; ok {
+		switch store := uploadsConfig["sessionstore"]; store {
+		case nil, "storage":
+		case "redis":
+			if app.redis == nil {
+				panic("redis configuration required to keep the upload sessions")
+			}
+			// The sessions expire along with the uploads purged.
+			ttl := uploadSessionTTL(purgeConfig)
+			options = append(options, storage.UploadSessionProvider(rediscache.NewRedisUploadSessionProvider(app.redis, ttl)))
+			dcontext.GetLogger(app).Infof("using redis upload sessions, expiring after %s", ttl)
+		default:
+			panic(fmt.Sprintf("invalid upload session store %v", store))
+		}
+	}
+
 	if !config.Validation.Enabled {
 		config.Validation.Enabled = !config.Validation.Disabled
 	}
@@ -272,10 +420,106 @@ func NewApp(ctx context.Context, config *configuration.Configuration) *App {
 		default:
 			options = append(options, storage.EnableValidateImageIndexImagesExist)
 		}
+
+		if config.Validation.Manifests.Subjects.RequireExists {
+			options = append(options, storage.EnableValidateSubjectsExist)
+		}
+
+		mediaTypes := config.Validation.Manifests.MediaTypes
+		for _, rule := range mediaTypes.Repositories {
+			options = append(options, storage.AllowMediaTypes(rule.Pattern, rule.Manifests, rule.Layers))
+		}
+		if len(mediaTypes.Manifests) > 0 || len(mediaTypes.Layers) > 0 {
+			options = append(options, storage.AllowMediaTypes("", mediaTypes.Manifests, mediaTypes.Layers))
+		}
+
+		layers := config.Validation.Manifests.Layers
+		for _, rule := range layers.Repositories {
+			options = append(options, storage.RelaxLayerExistence(rule.Pattern, rule.ExemptMediaTypes, rule.AnyRepository))
+		}
+		if len(layers.ExemptMediaTypes) > 0 || layers.AnyRepository {
+			options = append(options, storage.RelaxLayerExistence("", layers.ExemptMediaTypes, layers.AnyRepository))
+		}
+
+		// The manifests fetched by a pull through cache are exempt of the
+		// annotation rules, unless enforced there too.
+		annotations := config.Validation.Manifests.Annotations
+		if annotations.Enabled() && config.Proxy.Enabled() && !annotations.Proxy {
+			dcontext.GetLogger(app).Info("Annotation validation is not applied to the manifests fetched by the pull through cache")
+		} else if annotations.Enabled() {
+			for _, rule := range annotations.Repositories {
+				options = append(options, annotationRequirement(rule.Pattern, rule.AnnotationRule))
+			}
+			if len(annotations.Required) > 0 || annotations.Schema2 != "" {
+				options = append(options, annotationRequirement("", annotations.AnnotationRule))
+			}
+		}
 	}
 
-	// configure storage caches
+	// configure the tag cache
 	if cc, ok := config.Storage["cache"]; ok {
+		if enabled, ok := cc["tagcache"]; ok {
+			enabled, ok := enabled.(bool)
+			if !ok {
+				panic("invalid tagcache value: must be a boolean")
+			}
+			if enabled {
+				ttl := defaultTagCacheTTL
+				if v, ok := cc["tagcachettl"]; ok {
+					ttl, err = time.ParseDuration(fmt.Sprint(v))
+					if err != nil || ttl <= 0 {
+						panic(fmt.Sprintf("invalid tagcachettl value %v: must be a positive duration", v))
+					}
+				}
+				if app.redis != nil {
+					options = append(options, storage.TagCacheProvider(rediscache.NewRedisTagCacheProvider(app.redis, ttl)))
+					dcontext.GetLogger(app).Infof("using redis tag cache")
+				} else {
+					options = append(options, storage.TagCacheProvider(memorycache.NewInMemoryTagCacheProvider(memorycache.DefaultSize, ttl)))
+					dcontext.GetLogger(app).Infof("using inmemory tag cache")
+				}
+			}
+		}
+	}
+
+	if config.Policy.Quotas.Enabled() {
+		app.quotas, err = newQuotas(config.Policy.Quotas, app.driver, app.redis)
+		if err != nil {
+			panic(err)
+		}
+		options = append(options, storage.EnforceQuotas(app.quotas))
+	}
+
+	if config.Catalog.Index.Enabled {
+		app.catalogIndex, err = newCatalogIndex(config.Catalog.Index, app.driver, app.redis)
+		if err != nil {
+			panic(err)
+		}
+		options = append(options, storage.IndexCatalog(app.catalogIndex))
+	}
+
+	if pullStats := config.Stats.Pulls; pullStats.Enabled {
+		app.pullCounts, err = newPullCounts(pullStats, app.driver, app.redis)
+		if err != nil {
+			panic(err)
+		}
+		interval := pullStats.FlushInterval
+		if interval <= 0 {
+			interval = defaultPullStatsFlushInterval
+		}
+		startPullCountsFlusher(app, app.pullCounts, dcontext.GetLogger(app), interval)
+	}
+
+	if lastAccess := config.Stats.LastAccess; lastAccess.Enabled {
+		interval := lastAccess.UpdateInterval
+		if interval <= 0 {
+			interval = defaultLastAccessUpdateInterval
+		}
+		app.lastAccess = storage.NewLastAccess(app.driver, interval)
+	}
+
+	// configure storage caches, which the tenants do not share
+	if cc, ok := config.Storage["cache"]; ok && !config.Tenancy.Enabled() {
 		v, ok := cc["blobdescriptor"]
 		if !ok {
 			// Backwards compatible: "layerinfo" == "blobdescriptor"
@@ -287,10 +531,29 @@ func NewApp(ctx context.Context, config *configuration.Configuration) *App {
 			if app.redis == nil {
 				panic("redis configuration required to use for layerinfo cache")
 			}
-			if _, ok := cc["blobdescriptorsize"]; ok {
-				dcontext.GetLogger(app).Warnf("blobdescriptorsize parameter is not supported with redis cache")
+			for _, parameter := range []string{"blobdescriptorsize", "blobdescriptorbytes"} {
+				if _, ok := cc[parameter]; ok {
+					dcontext.GetLogger(app).Warnf("%s parameter is not supported with redis cache", parameter)
+				}
+			}
+			var cacheOptions []rediscache.Option
+			if ttl, ok := cc["blobdescriptorttl"]; ok {
+				d, err := time.ParseDuration(fmt.Sprint(ttl))
+				if err != nil || d < 0 {
+					panic(fmt.Sprintf("invalid blobdescriptorttl value %v: must be a non-negative duration", ttl))
+				}
+				cacheOptions = append(cacheOptions, rediscache.WithTTL(d))
 			}
-			cacheProvider := rediscache.NewRedisBlobDescriptorCacheProvider(app.redis)
+			if refresh, ok := cc["blobdescriptorttlrefresh"]; ok {
+				refresh, ok := refresh.(bool)
+				if !ok {
+					panic("invalid blobdescriptorttlrefresh value: must be a boolean")
+				}
+				if refresh {
+					cacheOptions = append(cacheOptions, rediscache.WithTTLRefresh())
+				}
+			}
+			cacheProvider := rediscache.NewRedisBlobDescriptorCacheProvider(app.redis, cacheOptions...)
 			localOptions := append(options, storage.BlobDescriptorCacheProvider(cacheProvider))
 			app.registry, err = storage.NewRegistry(app, app.driver, localOptions...)
 			if err != nil {
@@ -308,7 +571,17 @@ func NewApp(ctx context.Context, config *configuration.Configuration) *App {
 				}
 			}
 
-			cacheProvider := memorycache.NewInMemoryBlobDescriptorCacheProvider(blobDescriptorSize)
+			var cacheOptions []memorycache.Option
+			if configuredBytes, ok := cc["blobdescriptorbytes"]; ok {
+				blobDescriptorBytes, err := strconv.ParseInt(fmt.Sprint(configuredBytes), 10, 64)
+				if err != nil || blobDescriptorBytes < 0 {
+					panic(fmt.Sprintf("invalid blobdescriptorbytes value %v: must be a non-negative integer", configuredBytes))
+				}
+				cacheOptions = append(cacheOptions, memorycache.WithMaxBytes(blobDescriptorBytes))
+			}
+
+			cacheProvider := memorycache.NewInMemoryBlobDescriptorCacheProvider(blobDescriptorSize, cacheOptions...)
+			inventory.cache, _ = cacheProvider.(descriptorCacheStats)
 			localOptions := append(options, storage.BlobDescriptorCacheProvider(cacheProvider))
 			app.registry, err = storage.NewRegistry(app, app.driver, localOptions...)
 			if err != nil {
@@ -322,6 +595,14 @@ func NewApp(ctx context.Context, config *configuration.Configuration) *App {
 		}
 	}
 
+	if config.Tenancy.Enabled() {
+		app.tenancy, err = newTenancy(app, config, options)
+		if err != nil {
+			panic(err)
+		}
+		app.registry = app.tenancy.namespace
+	}
+
 	if app.registry == nil {
 		// configure the registry if no cache section is available.
 		app.registry, err = storage.NewRegistry(app.Context, app.driver, options...)
@@ -334,26 +615,93 @@ func NewApp(ctx context.Context, config *configuration.Configuration) *App {
 	if err != nil {
 		panic(err)
 	}
+	app.storage = app.registry
+
+	if app.catalogIndex != nil {
+		interval := config.Catalog.Index.ReconcileInterval
+		if interval <= 0 {
+			interval = defaultCatalogReconcileInterval
+		}
+		startCatalogReconciler(app, app.catalogIndex, app.storage, dcontext.GetLogger(app), interval)
+	}
+
+	inventory.enumerator, _ = app.registry.(distribution.RepositoryEnumerator)
+
+	app.accessController, err = newAccessController(config.Auth)
+	if err != nil {
+		panic(err)
+	}
+	if app.accessController != nil {
+		dcontext.GetLogger(app).Debugf("configured %q access controller", config.Auth.Type())
+	}
 
-	authType := config.Auth.Type()
+	logLevels, err := newRepositoryLogLevels(config.Log.Repositories)
+	if err != nil {
+		panic(err)
+	}
+	app.logLevels.Store(logLevels)
 
-	if authType != "" && !strings.EqualFold(authType, "none") {
-		accessController, err := auth.GetAccessController(config.Auth.Type(), config.Auth.Parameters())
+	if len(config.Policy.Network.Rules) > 0 {
+		app.networkPolicy, err = newNetworkPolicy(config.Policy.Network)
 		if err != nil {
-			panic(fmt.Sprintf("unable to configure authorization (%s): %v", authType, err))
+			panic(err)
+		}
+	}
+
+	if len(config.Policy.ImmutableTags.Rules) > 0 {
+		app.immutableTags, err = newTagImmutability(config.Policy.ImmutableTags)
+		if err != nil {
+			panic(err)
+		}
+	}
+
+	if len(config.HTTP.RateLimit.Limits) > 0 {
+		app.rateLimiter, err = newRateLimiter(*config)
+		if err != nil {
+			panic(err)
 		}
-		app.accessController = accessController
-		dcontext.GetLogger(app).Debugf("configured %q access controller", authType)
 	}
 
 	// configure as a pull through cache
-	if config.Proxy.RemoteURL != "" {
-		app.registry, err = proxy.NewRegistryPullThroughCache(ctx, app.registry, app.driver, config.Proxy)
+	if config.Proxy.Enabled() {
+		options := []proxy.RegistryOption{
+			proxy.WithMaxManifestSize(config.Validation.Manifests.MaxSizeBytes()),
+			proxy.WithSchema1Policy(config.Validation.Manifests.Schema1),
+		}
+		if config.Notifications.EventConfig.Proxy {
+			options = append(options, proxy.WithManifestFetchListener(app.pullThroughMissed))
+		}
+		if inventory.blobs != nil {
+			options = append(options, proxy.WithBlobInventory(inventory.blobs))
+		}
+		if app.audit != nil {
+			options = append(options, proxy.WithAuditLog(app.audit))
+		}
+		app.registry, err = proxy.NewRegistryPullThroughCache(ctx, app.registry, app.driver, config.Proxy, options...)
 		if err != nil {
 			panic(err.Error())
 		}
 		app.isCache = true
-		dcontext.GetLogger(app).Info("Registry configured as a proxy cache to ", config.Proxy.RemoteURL)
+		for _, remote := range config.Proxy.RemoteConfigs() {
+			dcontext.GetLogger(app).Info("Registry configured as a proxy cache to ", remote.RemoteURL)
+		}
+		inventory.scheduler, _ = app.registry.(interface{ SchedulerEntries() int })
+	}
+	if len(config.Replication.Peers) > 0 {
+		if app.isCache {
+			panic("replication cannot be configured for a pull through cache")
+		}
+		replicator, err := replication.New(app, app.registry, app.driver, config.Replication)
+		if err != nil {
+			panic(err)
+		}
+		// The replicator is not an endpoint, it is kept on reloads.
+		if err := app.events.broadcaster.Add(replicator); err != nil {
+			panic(err)
+		}
+	}
+	if inventory.blobs != nil {
+		startInventoryCollector(app, dcontext.GetLogger(app), inventoryConfig, inventory)
 	}
 	var ok bool
 	app.repoRemover, ok = app.registry.(distribution.RepositoryRemover)
@@ -380,6 +728,10 @@ func (app *App) RegisterHealthChecks(healthRegistries ...*health.Registry) {
 		healthRegistry = healthRegistries[0]
 	}
 
+	// The read-only mode does not fail the health checks, which would also
+	// refuse the reads.
+	healthRegistry.RegisterNotice("readonly", app.readOnly.notice)
+
 	if app.Config.Health.StorageDriver.Enabled {
 		interval := app.Config.Health.StorageDriver.Interval
 		if interval == 0 {
@@ -402,6 +754,125 @@ func (app *App) RegisterHealthChecks(healthRegistries ...*health.Registry) {
 		go health.Poll(app, updater, storageDriverCheck, interval)
 	}
 
+	if probe := app.Config.Health.StorageDriver.WriteProbe; probe.Enabled {
+		interval := probe.Interval
+		if interval == 0 {
+			interval = defaultWriteProbeInterval
+		}
+
+		// Each instance probes its own object, which is only left behind by
+		// the failed probes.
+		name := uuid.NewString()
+		writeProbeCheck := health.CheckFunc(func(ctx context.Context) error {
+			err := storage.ProbeWrites(ctx, app.driver, name)
+			if err != nil {
+				dcontext.GetLogger(ctx).Errorf("storage driver write probe: %v", err)
+			}
+			return err
+		})
+
+		updater := health.NewThresholdStatusUpdater(probe.Threshold)
+		healthRegistry.Register("storagedriver_"+app.Config.Storage.Type()+"_writeprobe", updater)
+		go health.Poll(app, updater, writeProbeCheck, interval)
+	}
+
+	if app.Config.Health.Redis.Enabled && app.redis != nil {
+		interval := app.Config.Health.Redis.Interval
+		if interval == 0 {
+			interval = defaultCheckInterval
+		}
+
+		updater := health.NewThresholdStatusUpdater(app.Config.Health.Redis.Threshold)
+		healthRegistry.Register("redis", updater)
+		go health.Poll(app, updater, redisCheck(app.redis, app.Config.Health.Redis.Timeout), interval)
+	}
+
+	if app.Config.Health.Upstream.Enabled && app.isCache {
+		upstream := app.Config.Health.Upstream
+		interval := upstream.Interval
+		if interval == 0 {
+			interval = defaultCheckInterval
+		}
+		timeout := upstream.Timeout
+		if timeout == 0 {
+			timeout = interval
+		}
+		var ref reference.Named
+		if upstream.Reference != "" {
+			parsed, err := reference.Parse(upstream.Reference)
+			if err != nil {
+				panic(fmt.Sprintf("invalid upstream health check reference %q: %v", upstream.Reference, err))
+			}
+			ref, _ = parsed.(reference.Named)
+		}
+
+		remotes := app.Config.Proxy.RemoteConfigs()
+		names := make(map[string]struct{})
+		for i, rc := range remotes {
+			remote, err := proxy.NewRemote(app, rc)
+			if err != nil {
+				panic(fmt.Sprintf("unable to configure the health check of upstream %s: %v", rc.RemoteURL, err))
+			}
+			remoteURL := remote.URL()
+			name := remoteURL.Redacted()
+			if _, ok := names[name]; ok {
+				// Remotes of several prefixes may share their url.
+				name += " " + rc.Prefix
+			}
+			names[name] = struct{}{}
+
+			dcontext.GetLogger(app).Infof("configuring upstream health check remote=%s, interval=%d, threshold=%d, informational=%t", name, interval/time.Second, upstream.Threshold, upstream.Informational)
+			updater := health.NewThresholdStatusUpdater(upstream.Threshold)
+			if upstream.Informational {
+				healthRegistry.RegisterNotice(name, func(ctx context.Context) string {
+					if err := updater.Check(ctx); err != nil {
+						return err.Error()
+					}
+					return ""
+				})
+			} else {
+				healthRegistry.Register(name, updater)
+			}
+			go health.Poll(app, updater, upstreamCheck(remote, upstreamReference(remotes, i, ref), timeout), interval)
+		}
+	}
+
+	if r, ok := app.registry.(interface {
+		ECRCredentialChecks() []proxy.CredentialCheck
+	}); ok {
+		interval := app.Config.Health.ECR.Interval
+		if interval == 0 {
+			interval = defaultECRCheckInterval
+		}
+		threshold := app.Config.Health.ECR.Threshold
+		// The token is refreshed early enough for the threshold to be
+		// reached before it expires.
+		margin := max(ecrCheckMargin, interval*time.Duration(threshold+1))
+
+		names := make(map[string]struct{})
+		for _, ecrCheck := range r.ECRCredentialChecks() {
+			name := "ecr_" + ecrCheck.RemoteURL.Host
+			if _, ok := names[name]; ok {
+				name += " " + ecrCheck.Prefix
+			}
+			names[name] = struct{}{}
+
+			check := ecrCheck.Check
+			credentialCheck := health.CheckFunc(func(ctx context.Context) error {
+				err := check(ctx, margin)
+				if err != nil {
+					dcontext.GetLogger(ctx).Errorf("ECR credential health check %s: %v", name, err)
+				}
+				return err
+			})
+
+			dcontext.GetLogger(app).Infof("configuring ECR credential health check remote=%s, interval=%d, threshold=%d", name, interval/time.Second, threshold)
+			updater := health.NewThresholdStatusUpdater(threshold)
+			healthRegistry.Register(name, updater)
+			go health.Poll(app, updater, credentialCheck, interval)
+		}
+	}
+
 	for _, fileChecker := range app.Config.Health.FileCheckers {
 		interval := fileChecker.Interval
 		if interval == 0 {
@@ -445,14 +916,117 @@ func (app *App) RegisterHealthChecks(healthRegistries ...*health.Registry) {
 		healthRegistry.Register(tcpChecker.Addr, updater)
 		go health.Poll(app, updater, checker, interval)
 	}
+
+	// The access controller may depend on a remote service, such as the
+	// JWKS endpoint of token auth.
+	if checker, ok := app.accessController.(health.Checker); ok {
+		healthRegistry.Register("auth_"+app.Config.Auth.Type(), checker)
+	}
 }
 
-// Shutdown close the underlying registry
-func (app *App) Shutdown() error {
+// Shutdown stops the background work of the app and closes the underlying
+// registry, then flushes the notification queues until ctx is done and
+// closes the access controller and the storage driver. The app does not serve requests after.
+func (app *App) Shutdown(ctx context.Context) error {
+	app.cancel()
+
+	var err error
 	if r, ok := app.registry.(proxy.Closer); ok {
-		return r.Close()
+		err = r.Close()
 	}
-	return nil
+
+	flushed := make(chan struct{})
+	go func() {
+		app.events.broadcaster.Close()
+		close(flushed)
+	}()
+	select {
+	case <-flushed:
+	case <-ctx.Done():
+		err = errors.Join(err, fmt.Errorf("notification queues not flushed: %w", ctx.Err()))
+	}
+
+	if app.pullCounts != nil {
+		if flushErr := app.pullCounts.Flush(ctx); flushErr != nil {
+			err = errors.Join(err, fmt.Errorf("pull counts not flushed: %w", flushErr))
+		}
+	}
+
+	app.authMu.RLock()
+	if closer, ok := app.accessController.(auth.Closer); ok {
+		if authErr := closer.Close(); authErr != nil {
+			err = errors.Join(err, authErr)
+		}
+	}
+	app.authMu.RUnlock()
+
+	if auditErr := app.audit.Close(); auditErr != nil {
+		err = errors.Join(err, auditErr)
+	}
+	if app.driverCloser != nil {
+		if driverErr := app.driverCloser.Close(); driverErr != nil {
+			err = errors.Join(err, driverErr)
+		}
+	}
+	return err
+}
+
+// SeedProxyCache pulls the references of the seed file through the pull
+// through cache, returning once they are pulled or the app shuts down.
+func (app *App) SeedProxyCache(file string) (proxy.SeedSummary, error) {
+	seeder, ok := app.registry.(proxy.Seeder)
+	if !ok {
+		return proxy.SeedSummary{}, fmt.Errorf("the registry is not a pull through cache")
+	}
+	refs, err := proxy.ReadSeedFile(file)
+	if err != nil {
+		return proxy.SeedSummary{}, err
+	}
+	return seeder.Seed(app, refs), nil
+}
+
+// Registry returns the registry backend of the app, behind the storage and
+// registry middlewares, for the commands writing to the registry without
+// serving requests.
+func (app *App) Registry() distribution.Namespace {
+	return app.registry
+}
+
+// Quotas returns the quotas of the repositories, nil if none is configured.
+func (app *App) Quotas() *storage.Quotas {
+	return app.quotas
+}
+
+// CatalogIndex returns the index of the catalog, nil if none is configured.
+func (app *App) CatalogIndex() *storage.CatalogIndex {
+	return app.catalogIndex
+}
+
+// StorageRepository returns the repository of the registry backend behind
+// the pull through cache, if any, for the commands writing to the storage of
+// the registry without serving requests. With notify, its pushes are notified
+// to the endpoints of the configuration, attributed to actor.
+func (app *App) StorageRepository(ctx context.Context, name reference.Named, actor string, notify bool) (distribution.Repository, error) {
+	repository, err := app.storage.Repository(ctx, name)
+	if err != nil || !notify {
+		return repository, err
+	}
+	repository, _ = notifications.Listen(repository, nil, app.EventListener(actor))
+	return repository, nil
+}
+
+// EventListener returns a listener notifying the endpoints of the
+// configuration of the events of the commands changing the storage of the
+// registry without serving requests, attributed to actor. The events are
+// flushed on shutdown.
+func (app *App) EventListener(actor string) notifications.Listener {
+	urlBuilder := v2.NewURLBuilder(&app.httpHost, app.httpHost.Host == "")
+	return notifications.NewBridge(urlBuilder, app.events.source, notifications.ActorRecord{Name: actor}, notifications.RequestRecord{}, app.events.sink, app.Config.Notifications.EventConfig.IncludeReferences, app.Config.Notifications.EventConfig.TagDeletes)
+}
+
+// ReopenAuditLog reopens the file of the audit log, after it was rotated.
+func (app *App) ReopenAuditLog() error {
+	return app.audit.Reopen()
 }
 
 // register a handler with the application, by route name. The handler will be
@@ -478,39 +1052,33 @@ func (app *App) register(routeName string, dispatch dispatchFunc) {
 	app.router.GetRoute(routeName).Handler(handler)
 }
 
+// configureAudit opens the audit log, if configured.
+func (app *App) configureAudit(configuration *configuration.Configuration) {
+	if configuration.Log.Audit.Output == "" {
+		return
+	}
+	var err error
+	app.audit, err = audit.New(configuration.Log.Audit)
+	if err != nil {
+		panic(err)
+	}
+	dcontext.GetLogger(app).Infof("recording deletions in the audit log %s", configuration.Log.Audit.Output)
+}
+
 // configureEvents prepares the event sink for action.
 func (app *App) configureEvents(configuration *configuration.Configuration) {
-	// Configure all of the endpoint sinks.
-	// NOTE(milosgajdos): we are disabling the linter here as
-	// if an endpoint is disabled we continue with the evaluation
-	// of the next one so we do not know the exact size the slice
-	// should have at the time the iteration starts
-	// nolint:prealloc
-	var sinks []events.Sink
-	for _, endpoint := range configuration.Notifications.Endpoints {
-		if endpoint.Disabled {
-			dcontext.GetLogger(app).Infof("endpoint %s disabled, skipping", endpoint.Name)
-			continue
-		}
-
-		dcontext.GetLogger(app).Infof("configuring endpoint %v (%v), timeout=%s, headers=%v", endpoint.Name, endpoint.URL, endpoint.Timeout, endpoint.Headers)
-		endpoint := notifications.NewEndpoint(endpoint.Name, endpoint.URL, notifications.EndpointConfig{
-			Timeout:           endpoint.Timeout,
-			Threshold:         endpoint.Threshold,
-			Backoff:           endpoint.Backoff,
-			Headers:           endpoint.Headers,
-			IgnoredMediaTypes: endpoint.IgnoredMediaTypes,
-			Ignore:            endpoint.Ignore,
-		})
-
-		sinks = append(sinks, endpoint)
+	sinks, err := app.newEndpointSinks(configuration.Notifications.Endpoints)
+	if err != nil {
+		panic(err)
 	}
 
 	// NOTE(stevvooe): Moving to a new queuing implementation is as easy as
 	// replacing broadcaster with a rabbitmq implementation. It's recommended
 	// that the registry instances also act as the workers to keep deployment
 	// simple.
-	app.events.sink = events.NewBroadcaster(sinks...)
+	app.events.broadcaster = events.NewBroadcaster(sinks...)
+	app.events.endpoints = sinks
+	app.events.sink = app.events.broadcaster
 
 	// Populate registry event source
 	hostname, err := os.Hostname()
@@ -530,6 +1098,93 @@ func (app *App) configureEvents(configuration *configuration.Configuration) {
 	}
 }
 
+// newAccessController returns the access controller of the configuration,
+// nil if the authorization is disabled.
+func newAccessController(config configuration.Auth) (auth.AccessController, error) {
+	authType := config.Type()
+	if authType == "" || strings.EqualFold(authType, "none") {
+		return nil, nil
+	}
+	accessController, err := auth.GetAccessController(authType, config.Parameters())
+	if err != nil {
+		return nil, fmt.Errorf("unable to configure authorization (%s): %v", authType, err)
+	}
+	return accessController, nil
+}
+
+// newEndpointSinks returns the sinks of the enabled notification endpoints.
+// The sinks created before an endpoint fails to configure are closed.
+func (app *App) newEndpointSinks(endpoints []configuration.Endpoint) (sinks []events.Sink, err error) {
+	defer func() {
+		if err != nil {
+			app.closeSinks(sinks)
+			sinks = nil
+		}
+	}()
+
+	for _, endpoint := range endpoints {
+		if endpoint.Disabled {
+			dcontext.GetLogger(app).Infof("endpoint %s disabled, skipping", endpoint.Name)
+			continue
+		}
+
+		if err := notifications.ValidateEndpoint(endpoint); err != nil {
+			return sinks, err
+		}
+
+		dcontext.GetLogger(app).Infof("configuring endpoint %v (%v), timeout=%s, headers=%v", endpoint.Name, endpoint.URL, endpoint.Timeout, endpoint.Headers)
+		endpointConfig := notifications.EndpointConfig{
+			Timeout:           endpoint.Timeout,
+			Threshold:         endpoint.Threshold,
+			Backoff:           endpoint.Backoff,
+			Headers:           endpoint.Headers,
+			IgnoredMediaTypes: endpoint.IgnoredMediaTypes,
+			Ignore:            endpoint.Ignore,
+			Filter:            endpoint.Filter,
+			Retry:             endpoint.Retry,
+			DeadLetter:        endpoint.DeadLetter,
+			QueueSize:         endpoint.QueueSize,
+			Deduplication:     endpoint.Deduplication,
+			Concurrency:       endpoint.Concurrency,
+			Transport:         notifications.NewTransport(endpoint.Transport, endpoint.Concurrency),
+		}
+		signingSecrets, err := notifications.LoadSigningSecrets(endpoint.Signing)
+		if err != nil {
+			return sinks, fmt.Errorf("notification endpoint %s: %v", endpoint.Name, err)
+		}
+		endpointConfig.SigningSecrets = signingSecrets
+
+		switch endpoint.Type {
+		case "", "http":
+			sinks = append(sinks, notifications.NewEndpoint(endpoint.Name, endpoint.URL, endpointConfig))
+		case notifications.EndpointTypeSQS, notifications.EndpointTypeSNS:
+			awsEndpoint, err := notifications.NewAWSEndpoint(endpoint.Name, endpoint.Type, endpoint.URL, endpointConfig, endpoint.AWS)
+			if err != nil {
+				return sinks, err
+			}
+			sinks = append(sinks, awsEndpoint)
+		case notifications.EndpointTypeNATS:
+			natsEndpoint, err := notifications.NewNATSEndpoint(endpoint.Name, endpoint.URL, endpointConfig, endpoint.NATS)
+			if err != nil {
+				return sinks, err
+			}
+			sinks = append(sinks, natsEndpoint)
+		default:
+			return sinks, fmt.Errorf("unknown type %q of notification endpoint %s", endpoint.Type, endpoint.Name)
+		}
+	}
+	return sinks, nil
+}
+
+// closeSinks closes the sinks, logging the errors.
+func (app *App) closeSinks(sinks []events.Sink) {
+	for _, sink := range sinks {
+		if err := sink.Close(); err != nil && err != events.ErrSinkClosed {
+			dcontext.GetLogger(app).Errorf("error closing notification endpoint: %v", err)
+		}
+	}
+}
+
 func (app *App) configureRedis(cfg *configuration.Configuration) {
 	if len(cfg.Redis.Options.Addrs) == 0 {
 		dcontext.GetLogger(app).Infof("redis not configured")
@@ -604,7 +1259,7 @@ func (app *App) configureRedis(cfg *configuration.Configuration) {
 		opts.TLSConfig = tlsConf
 	}
 
-	app.redis = app.createPool(opts)
+	app.redis = app.createPool(opts, cfg.Redis.Mode)
 
 	// Enable metrics instrumentation.
 	if err := redisotel.InstrumentMetrics(app.redis); err != nil {
@@ -626,12 +1281,75 @@ func (app *App) configureRedis(cfg *configuration.Configuration) {
 	}))
 }
 
-func (app *App) createPool(cfg redis.UniversalOptions) redis.UniversalClient {
+// createPool returns the client of the redis deployment of the mode, which
+// reconnects to the nodes and follows the failovers of the sentinels.
+func (app *App) createPool(cfg redis.UniversalOptions, mode string) redis.UniversalClient {
 	cfg.OnConnect = func(ctx context.Context, cn *redis.Conn) error {
 		res := cn.Ping(ctx)
 		return res.Err()
 	}
-	return redis.NewUniversalClient(&cfg)
+	switch mode {
+	case configuration.RedisModeSingle:
+		return redis.NewClient(cfg.Simple())
+	case configuration.RedisModeSentinel:
+		return redis.NewFailoverClient(cfg.Failover())
+	case configuration.RedisModeCluster:
+		return redis.NewClusterClient(cfg.Cluster())
+	default:
+		return redis.NewUniversalClient(&cfg)
+	}
+}
+
+// redisCheck pings redis, each of the nodes of a cluster.
+// upstreamCheck requests the remote with its credentials, its base route or
+// the manifest of the reference if not nil.
+func upstreamCheck(remote *proxy.Remote, ref reference.Named, timeout time.Duration) health.CheckFunc {
+	return func(ctx context.Context) error {
+		ctx, cancel := context.WithTimeout(ctx, timeout)
+		defer cancel()
+		return remote.Ping(ctx, ref)
+	}
+}
+
+// upstreamReference returns the reference checked on the i-th remote: the
+// reference if the remote serves it, nil otherwise. A repository is served by
+// the remote with the longest matching prefix, the first configured on ties.
+func upstreamReference(remotes []configuration.ProxyRemote, i int, ref reference.Named) reference.Named {
+	if ref == nil {
+		return nil
+	}
+	match := -1
+	for j, rc := range remotes {
+		if strings.HasPrefix(ref.Name(), rc.Prefix) && (match < 0 || len(rc.Prefix) > len(remotes[match].Prefix)) {
+			match = j
+		}
+	}
+	if match != i {
+		return nil
+	}
+	return ref
+}
+
+func redisCheck(client redis.UniversalClient, timeout time.Duration) health.CheckFunc {
+	return func(ctx context.Context) error {
+		if timeout > 0 {
+			var cancel context.CancelFunc
+			ctx, cancel = context.WithTimeout(ctx, timeout)
+			defer cancel()
+		}
+		var err error
+		if cluster, ok := client.(*redis.ClusterClient); ok {
+			err = cluster.ForEachShard(ctx, func(ctx context.Context, shard *redis.Client) error {
+				return shard.Ping(ctx).Err()
+			})
+		} else {
+			err = client.Ping(ctx).Err()
+		}
+		if err != nil {
+			dcontext.GetLogger(ctx).Errorf("redis health check: %v", err)
+		}
+		return err
+	}
 }
 
 // configureLogHook prepares logging hook parameters.
@@ -688,6 +1406,7 @@ func (app *App) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 
 	// Set a header with the Docker Distribution API Version for all responses.
 	w.Header().Add("Docker-Distribution-API-Version", "registry/2.0")
+	w.Header().Set(dcontext.RequestIDHeader, dcontext.GetRequestID(ctx))
 	app.router.ServeHTTP(w, r)
 }
 
@@ -710,27 +1429,70 @@ func (app *App) dispatcher(dispatch dispatchFunc) http.Handler {
 			}
 		}
 
+		ctx, span := startSpan(r)
+		r = r.WithContext(ctx)
 		context := app.context(w, r)
+		if action := auditAction(r); action != "" && app.audit != nil {
+			w = newAuditResponseWriter(w, r, context, action)
+		}
+
+		defer func() {
+			status, _ := context.Value("http.response.status").(int)
+			endSpan(span, status, context.Errors)
+		}()
+
+		record := accesslog.GetRecord(context)
+		record.SetRequest(getName(context), accessLogAction(r.Method, getName(context)), digest.Digest(dcontext.GetStringValue(context, "vars.digest")))
 
 		defer func() {
 			// Automated error response handling here. Handlers may return their
 			// own errors if they need different behavior (such as range errors
 			// for layer upload).
 			if context.Errors.Len() > 0 {
-				_ = errcode.ServeJSON(w, context.Errors)
+				if !app.redirectMoved(w, r, context) {
+					_ = errcode.ServeJSON(w, clientErrors(context.Errors))
+				}
 				app.logError(context, context.Errors)
 			} else if status, ok := context.Value("http.response.status").(int); ok && status >= 200 && status <= 399 {
 				dcontext.GetResponseLogger(context).Infof("response completed")
 			}
 		}()
 
+		if err := app.checkNetworkPolicy(w, r, context); err != nil {
+			dcontext.GetLogger(context).Warnf("error checking network policy: %v", err)
+			return
+		}
+
 		if err := app.authorized(w, r, context); err != nil {
 			dcontext.GetLogger(context).Warnf("error authorizing context: %v", err)
 			return
 		}
 
+		if err := app.checkTenant(w, r, context); err != nil {
+			dcontext.GetLogger(context).Warnf("error checking tenant: %v", err)
+			return
+		}
+
+		if err := app.checkRateLimit(w, r, context); err != nil {
+			dcontext.GetLogger(context).Warnf("error checking rate limit: %v", err)
+			return
+		}
+
+		if err := app.checkReadOnly(w, r, context); err != nil {
+			dcontext.GetLogger(context).Warnf("error checking read-only mode: %v", err)
+			return
+		}
+
+		endWrite, err := app.checkRename(w, r, context)
+		if err != nil {
+			dcontext.GetLogger(context).Warnf("error checking repository rename: %v", err)
+			return
+		}
+		defer endWrite()
+
 		// Add username to request logging
 		context.Context = dcontext.WithLogger(context.Context, dcontext.GetLogger(context.Context, userNameKey))
+		record.SetUser(dcontext.GetStringValue(context, userNameKey))
 
 		// sync up context on the request.
 		r = r.WithContext(context)
@@ -827,11 +1589,34 @@ func (app *App) logError(ctx context.Context, errors errcode.Errors) {
 	}
 }
 
+// clientErrors returns the errors served to the client for errs. The failures
+// of a pull through cache to authenticate to its upstream, which the client
+// cannot act upon, are served as errors of the upstream naming its host, the
+// details of its response being logged only.
+func clientErrors(errs errcode.Errors) errcode.Errors {
+	served := make(errcode.Errors, 0, len(errs))
+	for _, err := range errs {
+		cause := err
+		if e, ok := err.(errcode.Error); ok {
+			if detail, ok := e.Detail.(error); ok {
+				cause = detail
+			}
+		}
+		var authErr *proxy.UpstreamAuthError
+		if errors.As(cause, &authErr) {
+			err = authErr.ClientError()
+		}
+		served = append(served, err)
+	}
+	return served
+}
+
 // context constructs the context object for the application. This only be
 // called once per request.
 func (app *App) context(w http.ResponseWriter, r *http.Request) *Context {
 	ctx := r.Context()
 	ctx = dcontext.WithVars(ctx, r)
+	ctx = app.withRepositoryLogLevel(ctx, getName(ctx))
 	ctx = dcontext.WithLogger(ctx, dcontext.GetLogger(ctx,
 		"vars.name",
 		"vars.reference",
@@ -862,7 +1647,10 @@ func (app *App) authorized(w http.ResponseWriter, r *http.Request, context *Cont
 	dcontext.GetLogger(context).Debug("authorizing request")
 	repo := getName(context)
 
-	if app.accessController == nil {
+	app.authMu.RLock()
+	accessController := app.accessController
+	app.authMu.RUnlock()
+	if accessController == nil {
 		return nil // access controller is not enabled.
 	}
 
@@ -890,9 +1678,10 @@ func (app *App) authorized(w http.ResponseWriter, r *http.Request, context *Cont
 			return fmt.Errorf("forbidden: no repository name")
 		}
 		accessRecords = appendCatalogAccessRecord(accessRecords, r)
+		accessRecords = appendAdminAccessRecord(accessRecords, r)
 	}
 
-	grant, err := app.accessController.Authorized(r.WithContext(context.Context), accessRecords...)
+	grant, err := accessController.Authorized(r.WithContext(context.Context), accessRecords...)
 	if err != nil {
 		switch err := err.(type) {
 		case auth.Challenge:
@@ -908,7 +1697,11 @@ func (app *App) authorized(w http.ResponseWriter, r *http.Request, context *Cont
 			// controller. Just return a bad request with no information
 			// to avoid exposure. The request should not proceed.
 			dcontext.GetLogger(context).Errorf("error checking authorization: %v", err)
-			w.WriteHeader(http.StatusBadRequest)
+			if errors.Is(err, auth.ErrUnavailable) {
+				w.WriteHeader(http.StatusServiceUnavailable)
+			} else {
+				w.WriteHeader(http.StatusBadRequest)
+			}
 		}
 
 		return err
@@ -934,9 +1727,51 @@ func (app *App) eventBridge(ctx *Context, r *http.Request) notifications.Listene
 	actor := notifications.ActorRecord{
 		Name: getUserName(ctx, r),
 	}
+	// The pushes of the replication from a peer are attributed to the actor
+	// it announces, not to be replicated back. The header is only honored
+	// for the users of the credentials of the peers, for the clients not to
+	// spoof the actor of their pushes.
+	if announced := r.Header.Get(replication.ActorHeader); announced != "" && app.replicationPeerUser(ctx) {
+		actor.Name = announced
+	}
 	request := notifications.NewRequestRecord(dcontext.GetRequestID(ctx), r)
 
-	return notifications.NewBridge(ctx.urlBuilder, app.events.source, actor, request, app.events.sink, app.Config.Notifications.EventConfig.IncludeReferences)
+	return notifications.NewBridge(ctx.urlBuilder, app.events.source, actor, request, app.events.sink, app.Config.Notifications.EventConfig.IncludeReferences, app.Config.Notifications.EventConfig.TagDeletes)
+}
+
+// replicationPeerUser returns whether the request of the context is
+// authenticated as the user of the credentials of a replication peer.
+func (app *App) replicationPeerUser(ctx context.Context) bool {
+	user := dcontext.GetStringValue(ctx, userNameKey)
+	if user == "" {
+		return false
+	}
+	for _, peer := range app.Config.Replication.Peers {
+		if peer.Username == user {
+			return true
+		}
+	}
+	return false
+}
+
+// pullThroughMissed writes the event of a manifest the proxy fetched from its
+// upstream, attributed to the request of the context.
+func (app *App) pullThroughMissed(ctx context.Context, fetch proxy.ManifestFetch) {
+	var actor notifications.ActorRecord
+	var request notifications.RequestRecord
+	if r, ok := ctx.Value("http.request").(*http.Request); ok {
+		actor.Name = getUserName(ctx, r)
+		request = notifications.NewRequestRecord(dcontext.GetRequestID(ctx), r)
+	}
+
+	listener := notifications.NewProxyBridge(app.events.source, actor, request, app.events.sink)
+	if err := listener.PullThroughMissed(fetch.Repository, fetch.Descriptor, fetch.Tag, notifications.UpstreamRecord{
+		Host:     fetch.Upstream,
+		Bytes:    fetch.Descriptor.Size,
+		Duration: fetch.Duration.Seconds(),
+	}); err != nil {
+		dcontext.GetLogger(ctx).Errorf("error dispatching pull through miss to listener: %v", err)
+	}
 }
 
 // nameRequired returns true if the route requires a name.
@@ -946,7 +1781,7 @@ func (app *App) nameRequired(r *http.Request) bool {
 		return true
 	}
 	routeName := route.GetName()
-	return routeName != v2.RouteNameBase && routeName != v2.RouteNameCatalog
+	return routeName != v2.RouteNameBase && routeName != v2.RouteNameCatalog && routeName != v2.RouteNameSearch && routeName != v2.RouteNameAdminReadOnly && routeName != v2.RouteNameProxyExpirations && routeName != v2.RouteNameProxyMirror && routeName != v2.RouteNameAdminRename
 }
 
 // apiBase implements a simple yes-man for doing overall checks against the
@@ -994,6 +1829,21 @@ func appendAccessRecords(records []auth.Access, method string, repo string) []au
 	return records
 }
 
+// accessLogAction returns the access to the repository requested by the
+// method, as logged by the access log, or "" if the request is not for a
+// repository.
+func accessLogAction(method string, repo string) string {
+	if repo == "" {
+		return ""
+	}
+	records := appendAccessRecords(nil, method, repo)
+	if len(records) == 0 {
+		return ""
+	}
+	// The push of content also requires its pull.
+	return records[len(records)-1].Action
+}
+
 // Add the access record for the catalog if it's our current route
 func appendCatalogAccessRecord(accessRecords []auth.Access, r *http.Request) []auth.Access {
 	route := mux.CurrentRoute(r)
@@ -1014,6 +1864,26 @@ func appendCatalogAccessRecord(accessRecords []auth.Access, r *http.Request) []a
 	return accessRecords
 }
 
+// Add the access record for the admin API if it's our current route
+func appendAdminAccessRecord(accessRecords []auth.Access, r *http.Request) []auth.Access {
+	route := mux.CurrentRoute(r)
+	routeName := route.GetName()
+
+	if routeName == v2.RouteNameAdminReadOnly || routeName == v2.RouteNameProxyExpirations || routeName == v2.RouteNameProxyMirror || routeName == v2.RouteNameAdminRename {
+		resource := auth.Resource{
+			Type: "registry",
+			Name: "admin",
+		}
+
+		accessRecords = append(accessRecords,
+			auth.Access{
+				Resource: resource,
+				Action:   "*",
+			})
+	}
+	return accessRecords
+}
+
 // applyRegistryMiddleware wraps a registry instance with the configured middlewares
 func applyRegistryMiddleware(ctx context.Context, registry distribution.Namespace, driver storagedriver.StorageDriver, middlewares []configuration.Middleware) (distribution.Namespace, error) {
 	for _, mw := range middlewares {
@@ -1062,6 +1932,18 @@ func uploadPurgeDefaultConfig() map[any]any {
 	return config
 }
 
+// uploadSessionTTL returns the age of the uploads purged by the purge
+// configuration, or that of the default configuration if it has none.
+func uploadSessionTTL(config map[any]any) time.Duration {
+	if age, ok := config["age"].(string); ok {
+		if ttl, err := time.ParseDuration(age); err == nil && ttl > 0 {
+			return ttl
+		}
+	}
+	ttl, _ := time.ParseDuration(uploadPurgeDefaultConfig()["age"].(string))
+	return ttl
+}
+
 func badPurgeUploadConfig(reason string) {
 	panic(fmt.Sprintf("Unable to parse upload purge configuration: %s", reason))
 }
@@ -1125,12 +2007,53 @@ func startUploadPurger(ctx context.Context, storageDriver storagedriver.StorageD
 		}
 		jitter := time.Duration(randInt.Int64()%60) * time.Minute
 		log.Infof("Starting upload purge in %s", jitter)
-		time.Sleep(jitter)
+		wait := jitter
 
 		for {
+			select {
+			case <-time.After(wait):
+			case <-ctx.Done():
+				return
+			}
 			storage.PurgeUploads(ctx, storageDriver, time.Now().Add(-purgeAgeDuration), !dryRunBool)
 			log.Infof("Starting upload purge in %s", intervalDuration)
-			time.Sleep(intervalDuration)
+			wait = intervalDuration
 		}
 	}()
 }
+
+// annotationRequirement returns the storage option of the annotation rule of
+// the repositories matching pattern.
+func annotationRequirement(pattern string, rule configuration.AnnotationRule) storage.RegistryOption {
+	required := make(map[string]*regexp.Regexp)
+	for _, annotation := range rule.Required {
+		var value *regexp.Regexp
+		if annotation.Value != "" {
+			value = regexp.MustCompile("^(?:" + annotation.Value + ")$")
+		}
+		required[annotation.Key] = value
+	}
+	return storage.RequireAnnotations(pattern, required, rule.Schema2 == configuration.AnnotationsSchema2Reject)
+}
+
+// verificationParameter returns the non-negative integer parameter of the
+// storage verification configuration, 0 if it is not set.
+func verificationParameter(config configuration.Parameters, key string) int64 {
+	var value int64
+	switch v := config[key].(type) {
+	case nil:
+	case int:
+		value = int64(v)
+	case string:
+		var err error
+		if value, err = strconv.ParseInt(v, 10, 64); err != nil {
+			panic(fmt.Sprintf("invalid value for storage verification %s: %q", key, v))
+		}
+	default:
+		panic(fmt.Sprintf("invalid type for storage verification %s: %#v", key, v))
+	}
+	if value < 0 {
+		panic(fmt.Sprintf("storage verification %s should be a non-negative integer, %d invalid", key, value))
+	}
+	return value
+}
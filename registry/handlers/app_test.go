@@ -1,19 +1,25 @@
 package handlers
 
 import (
+	"context"
 	"encoding/json"
+	"errors"
 	"net/http"
 	"net/http/httptest"
 	"net/url"
 	"reflect"
+	"sync/atomic"
 	"testing"
+	"time"
 
 	"github.com/distribution/distribution/v3/configuration"
 	"github.com/distribution/distribution/v3/internal/dcontext"
+	"github.com/distribution/distribution/v3/notifications"
 	"github.com/distribution/distribution/v3/registry/api/errcode"
 	v2 "github.com/distribution/distribution/v3/registry/api/v2"
 	"github.com/distribution/distribution/v3/registry/auth"
 	_ "github.com/distribution/distribution/v3/registry/auth/silly"
+	_ "github.com/distribution/distribution/v3/registry/auth/token"
 	"github.com/distribution/distribution/v3/registry/storage"
 	memorycache "github.com/distribution/distribution/v3/registry/storage/cache/memory"
 	"github.com/distribution/distribution/v3/registry/storage/driver/inmemory"
@@ -39,7 +45,9 @@ func TestAppDispatcher(t *testing.T) {
 	}
 	server := httptest.NewServer(app)
 	defer server.Close()
-	router := v2.Router()
+	// The routes are restricted to the host of the server, so they must not
+	// be those of the shared router.
+	router := v2.RouterWithPrefix("")
 
 	serverURL, err := url.Parse(server.URL)
 	if err != nil {
@@ -211,6 +219,110 @@ func TestNewApp(t *testing.T) {
 	}
 }
 
+// TestAuthUnavailable checks that the requests are denied with a 503 when
+// the service backing the access controller cannot be reached.
+func TestAuthUnavailable(t *testing.T) {
+	introspection := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusBadGateway)
+	}))
+	defer introspection.Close()
+
+	config := configuration.Configuration{
+		Storage: configuration.Storage{
+			"inmemory": nil,
+			"maintenance": configuration.Parameters{"uploadpurging": map[any]any{
+				"enabled": false,
+			}},
+		},
+		Auth: configuration.Auth{
+			"token": {
+				"realm":                     "realm-test",
+				"service":                   "service-test",
+				"introspectionurl":          introspection.URL,
+				"introspectionclientid":     "registry",
+				"introspectionclientsecret": "secret",
+			},
+		},
+	}
+	server := httptest.NewServer(NewApp(dcontext.Background(), &config))
+	defer server.Close()
+
+	req, err := http.NewRequest(http.MethodGet, server.URL+"/v2/", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Header.Set("Authorization", "Bearer opaque-token")
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusServiceUnavailable {
+		t.Fatalf("expected status %d, got %d", http.StatusServiceUnavailable, resp.StatusCode)
+	}
+}
+
+// TestAppShutdown checks that the app flushes the notifications queued when it
+// shuts down, unless its context is done first.
+func TestAppShutdown(t *testing.T) {
+	var received atomic.Int64
+	release := make(chan struct{})
+	endpoint := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/blocked" {
+			<-release
+		}
+		time.Sleep(50 * time.Millisecond)
+		received.Add(1)
+	}))
+	defer endpoint.Close()
+	defer close(release)
+
+	newApp := func(path string) *App {
+		config := configuration.Configuration{
+			Storage: configuration.Storage{
+				"inmemory": nil,
+				"maintenance": configuration.Parameters{"uploadpurging": map[any]any{
+					"enabled": false,
+				}},
+			},
+			Notifications: configuration.Notifications{
+				Endpoints: []configuration.Endpoint{{
+					Name:      "endpoint",
+					URL:       endpoint.URL + path,
+					Timeout:   time.Minute,
+					Threshold: 1,
+					Backoff:   time.Second,
+				}},
+			},
+		}
+		return NewApp(dcontext.Background(), &config)
+	}
+
+	app := newApp("/")
+	if err := app.events.sink.Write(&notifications.Event{ID: "1", Action: notifications.EventActionPush}); err != nil {
+		t.Fatal(err)
+	}
+	if err := app.Shutdown(context.Background()); err != nil {
+		t.Fatalf("unexpected error shutting down: %v", err)
+	}
+	if received.Load() != 1 {
+		t.Fatal("notification not flushed on shutdown")
+	}
+	if app.Context.Err() == nil {
+		t.Fatal("background work not cancelled on shutdown")
+	}
+
+	app = newApp("/blocked")
+	if err := app.events.sink.Write(&notifications.Event{ID: "2", Action: notifications.EventActionPush}); err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	if err := app.Shutdown(ctx); !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("unexpected error shutting down with a blocked endpoint: %v", err)
+	}
+}
+
 // Test the access record accumulator
 func TestAppendAccessRecords(t *testing.T) {
 	repo := "testRepo"
@@ -275,3 +387,201 @@ func TestAppendAccessRecords(t *testing.T) {
 		t.Fatal("Actual access record differs from expected")
 	}
 }
+
+func TestNetworkPolicyClientAddr(t *testing.T) {
+	policy, err := newNetworkPolicy(configuration.NetworkPolicy{
+		TrustedProxies: []string{"10.0.0.0/8", "fd00::/8"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, tc := range []struct {
+		name          string
+		remoteAddr    string
+		forwardedFor  []string
+		expected      string
+		expectInvalid bool
+	}{
+		{name: "direct", remoteAddr: "192.0.2.1:1234", expected: "192.0.2.1"},
+		{name: "direct ipv6", remoteAddr: "[2001:db8::1]:1234", expected: "2001:db8::1"},
+		{name: "ipv4 mapped ipv6", remoteAddr: "[::ffff:192.0.2.1]:1234", expected: "192.0.2.1"},
+		{name: "zone", remoteAddr: "[fe80::1%eth0]:1234", expected: "fe80::1"},
+		{name: "untrusted proxy", remoteAddr: "192.0.2.1:1234", forwardedFor: []string{"198.51.100.1"}, expected: "192.0.2.1"},
+		{name: "trusted proxy", remoteAddr: "10.0.0.1:1234", forwardedFor: []string{"198.51.100.1"}, expected: "198.51.100.1"},
+		{name: "trusted ipv6 proxy", remoteAddr: "[fd00::1]:1234", forwardedFor: []string{"2001:db8::2"}, expected: "2001:db8::2"},
+		{name: "multiple hops", remoteAddr: "10.0.0.1:1234", forwardedFor: []string{"198.51.100.1, 10.0.0.3, 10.0.0.2"}, expected: "198.51.100.1"},
+		{name: "multiple headers", remoteAddr: "10.0.0.1:1234", forwardedFor: []string{"198.51.100.1", "10.0.0.2"}, expected: "198.51.100.1"},
+		{name: "spoofed hop", remoteAddr: "10.0.0.1:1234", forwardedFor: []string{"10.42.0.1, 198.51.100.1"}, expected: "198.51.100.1"},
+		{name: "hop with port", remoteAddr: "10.0.0.1:1234", forwardedFor: []string{"[2001:db8::3]:443"}, expected: "2001:db8::3"},
+		{name: "all trusted", remoteAddr: "10.0.0.1:1234", forwardedFor: []string{"10.0.0.3, 10.0.0.2"}, expected: "10.0.0.3"},
+		{name: "invalid hop", remoteAddr: "10.0.0.1:1234", forwardedFor: []string{"198.51.100.1, unknown"}, expected: "10.0.0.1"},
+		{name: "invalid remote address", remoteAddr: "pipe", expectInvalid: true},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			r := httptest.NewRequest(http.MethodGet, "/v2/", nil)
+			r.RemoteAddr = tc.remoteAddr
+			for _, header := range tc.forwardedFor {
+				r.Header.Add("X-Forwarded-For", header)
+			}
+			addr, ok := policy.clientAddr(r)
+			if tc.expectInvalid {
+				if ok {
+					t.Fatalf("expected no address, got %s", addr)
+				}
+				return
+			}
+			if !ok || addr.String() != tc.expected {
+				t.Fatalf("expected %s, got %s", tc.expected, addr)
+			}
+		})
+	}
+}
+
+func TestNetworkPolicyAllowed(t *testing.T) {
+	policy, err := newNetworkPolicy(configuration.NetworkPolicy{
+		Rules: []configuration.NetworkRule{
+			{Actions: []string{"push"}, Allow: []string{"10.42.0.0/16", "2001:db8:42::/48"}},
+			{Actions: []string{"delete"}, Allow: []string{"192.168.100.0/24"}},
+			{Actions: []string{"*"}, Deny: []string{"203.0.113.0/24", "10.42.66.6"}},
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, tc := range []struct {
+		addr    string
+		action  string
+		allowed bool
+	}{
+		{"198.51.100.1", "pull", true},
+		{"198.51.100.1", "push", false},
+		{"10.42.1.1", "push", true},
+		{"2001:db8:42::1", "push", true},
+		{"2001:db8:43::1", "push", false},
+		{"10.42.1.1", "delete", false},
+		{"192.168.100.7", "delete", true},
+		{"203.0.113.5", "pull", false},
+		{"10.42.66.6", "push", false},
+	} {
+		addr, _ := parseAddr(tc.addr)
+		if allowed := policy.allowed(addr, tc.action); allowed != tc.allowed {
+			t.Errorf("%s from %s: expected allowed %v, got %v", tc.action, tc.addr, tc.allowed, allowed)
+		}
+	}
+
+	for _, config := range []configuration.NetworkPolicy{
+		{TrustedProxies: []string{"10.0.0.0/33"}},
+		{Rules: []configuration.NetworkRule{{Allow: []string{"10.0.0.0/8"}}}},
+		{Rules: []configuration.NetworkRule{{Actions: []string{"push"}, Deny: []string{"host.example.com"}}}},
+	} {
+		if _, err := newNetworkPolicy(config); err == nil {
+			t.Errorf("expected an error for %+v", config)
+		}
+	}
+}
+
+func TestTagImmutability(t *testing.T) {
+	immutability, err := newTagImmutability(configuration.ImmutableTags{
+		Rules: []configuration.ImmutableTagRule{
+			{Repository: "*", Tags: []string{"v*", "release-*"}},
+			{Repository: "prod/*", Tags: []string{"*"}},
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, tc := range []struct {
+		repository, tag string
+		immutable       bool
+	}{
+		{"app", "v1.2.3", true},
+		{"app", "release-1.2.3", true},
+		{"app", "latest", false},
+		{"team/app", "v1.2.3", false},
+		{"prod/app", "latest", true},
+		{"prod/team/app", "latest", false},
+	} {
+		if immutable := immutability.immutable(tc.repository, tc.tag); immutable != tc.immutable {
+			t.Errorf("%s:%s: expected immutable %v, got %v", tc.repository, tc.tag, tc.immutable, immutable)
+		}
+	}
+	if err := immutability.checkDelete("prod/app", "latest"); err != nil {
+		t.Fatalf("unexpected error deleting an immutable tag, deletes not protected: %v", err)
+	}
+
+	for _, config := range []configuration.ImmutableTags{
+		{Rules: []configuration.ImmutableTagRule{{Tags: []string{"v*"}}}},
+		{Rules: []configuration.ImmutableTagRule{{Repository: "prod/*"}}},
+		{Rules: []configuration.ImmutableTagRule{{Repository: "prod/[", Tags: []string{"v*"}}}},
+		{Rules: []configuration.ImmutableTagRule{{Repository: "prod/*", Tags: []string{"v["}}}},
+	} {
+		if _, err := newTagImmutability(config); err == nil {
+			t.Errorf("expected an error for %+v", config)
+		}
+	}
+}
+
+// TestNetworkPolicyApp checks that the network policy of an application
+// denies requests with a 403, and does not apply to the base route.
+func TestNetworkPolicyApp(t *testing.T) {
+	config := configuration.Configuration{
+		Storage: configuration.Storage{
+			"inmemory": nil,
+			"maintenance": configuration.Parameters{"uploadpurging": map[any]any{
+				"enabled": false,
+			}},
+		},
+		Policy: configuration.Policy{
+			Network: configuration.NetworkPolicy{
+				TrustedProxies: []string{"10.0.0.1"},
+				Rules: []configuration.NetworkRule{
+					{Actions: []string{"push"}, Allow: []string{"10.42.0.0/16"}},
+				},
+			},
+		},
+	}
+	app := NewApp(dcontext.Background(), &config)
+
+	for _, tc := range []struct {
+		method       string
+		path         string
+		remoteAddr   string
+		forwardedFor string
+		denied       bool
+	}{
+		{http.MethodGet, "/v2/", "198.51.100.1:1234", "", false},
+		{http.MethodGet, "/v2/foo/bar/tags/list", "198.51.100.1:1234", "", false},
+		{http.MethodPost, "/v2/foo/bar/blobs/uploads/", "198.51.100.1:1234", "", true},
+		{http.MethodPost, "/v2/foo/bar/blobs/uploads/", "10.42.0.5:1234", "", false},
+		{http.MethodPost, "/v2/foo/bar/blobs/uploads/", "10.0.0.1:1234", "10.42.0.5", false},
+		{http.MethodPost, "/v2/foo/bar/blobs/uploads/", "198.51.100.1:1234", "10.42.0.5", true},
+	} {
+		r := httptest.NewRequest(tc.method, tc.path, nil)
+		r.RemoteAddr = tc.remoteAddr
+		if tc.forwardedFor != "" {
+			r.Header.Set("X-Forwarded-For", tc.forwardedFor)
+		}
+		w := httptest.NewRecorder()
+		app.ServeHTTP(w, r)
+
+		if !tc.denied {
+			if w.Code == http.StatusForbidden {
+				t.Errorf("%s %s from %s: unexpected 403", tc.method, tc.path, tc.remoteAddr)
+			}
+			continue
+		}
+		if w.Code != http.StatusForbidden {
+			t.Errorf("%s %s from %s: expected 403, got %d", tc.method, tc.path, tc.remoteAddr, w.Code)
+			continue
+		}
+		var errs errcode.Errors
+		if err := json.NewDecoder(w.Body).Decode(&errs); err != nil {
+			t.Fatalf("error decoding error response: %v", err)
+		}
+		if coder, ok := errs[0].(errcode.ErrorCoder); !ok || coder.ErrorCode() != errcode.ErrorCodeAddressDenied {
+			t.Errorf("%s %s from %s: unexpected error %v", tc.method, tc.path, tc.remoteAddr, errs)
+		}
+	}
+}
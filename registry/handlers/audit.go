@@ -0,0 +1,109 @@
+package handlers
+
+import (
+	"net/http"
+
+	"github.com/distribution/distribution/v3/audit"
+	"github.com/distribution/distribution/v3/internal/dcontext"
+	"github.com/distribution/distribution/v3/internal/requestutil"
+	v2 "github.com/distribution/distribution/v3/registry/api/v2"
+	"github.com/gorilla/mux"
+	"github.com/opencontainers/go-digest"
+)
+
+// auditAction returns the action the request is recorded as in the audit log,
+// or "" if it is not audited.
+func auditAction(r *http.Request) string {
+	route := mux.CurrentRoute(r)
+	if r.Method != http.MethodDelete || route == nil {
+		return ""
+	}
+	switch route.GetName() {
+	case v2.RouteNameManifest:
+		if _, err := digest.Parse(mux.Vars(r)["reference"]); err != nil {
+			return audit.ActionTagDelete
+		}
+		return audit.ActionManifestDelete
+	case v2.RouteNameTag:
+		return audit.ActionTagDelete
+	case v2.RouteNameBlob:
+		return audit.ActionBlobDelete
+	default:
+		return ""
+	}
+}
+
+// auditResponseWriter records the request in the audit log as its response
+// is written, so that the response to a completed operation is only sent
+// once the operation is recorded.
+type auditResponseWriter struct {
+	http.ResponseWriter
+	context *Context
+	entry   audit.Entry
+	logged  bool
+}
+
+// newAuditResponseWriter returns the response writer recording the request
+// of the context as the action.
+func newAuditResponseWriter(w http.ResponseWriter, r *http.Request, context *Context, action string) *auditResponseWriter {
+	entry := audit.Entry{
+		Action:     action,
+		Repository: getName(context),
+		ClientIP:   requestutil.RemoteIP(r),
+		RequestID:  dcontext.GetRequestID(context),
+	}
+	if reference := getReference(context); reference != "" {
+		if dgst, err := digest.Parse(reference); err == nil {
+			entry.Digest = dgst
+		} else {
+			entry.Tag = reference
+		}
+	}
+	if tag := getTag(context); tag != "" {
+		entry.Tag = tag
+	}
+	if dgst := dcontext.GetStringValue(context, "vars.digest"); dgst != "" {
+		entry.Digest = digest.Digest(dgst)
+	}
+	return &auditResponseWriter{
+		ResponseWriter: w,
+		context:        context,
+		entry:          entry,
+	}
+}
+
+func (arw *auditResponseWriter) log(status int) {
+	if arw.logged {
+		return
+	}
+	arw.logged = true
+
+	entry := arw.entry
+	entry.Actor = dcontext.GetStringValue(arw.context, userNameKey)
+	entry.Status = status
+	if status >= http.StatusOK && status < http.StatusMultipleChoices {
+		entry.Outcome = audit.OutcomeSuccess
+	} else {
+		entry.Outcome = audit.OutcomeFailure
+		if arw.context.Errors.Len() > 0 {
+			entry.Error = arw.context.Errors.Error()
+		}
+	}
+	if err := arw.context.App.audit.Log(entry); err != nil {
+		dcontext.GetLogger(arw.context).Errorf("failed to record %s in the audit log: %v", entry.Action, err)
+	}
+}
+
+func (arw *auditResponseWriter) WriteHeader(status int) {
+	arw.log(status)
+	arw.ResponseWriter.WriteHeader(status)
+}
+
+func (arw *auditResponseWriter) Write(p []byte) (int, error) {
+	arw.log(http.StatusOK)
+	return arw.ResponseWriter.Write(p)
+}
+
+func (arw *auditResponseWriter) Unwrap() http.ResponseWriter {
+	return arw.ResponseWriter
+}
@@ -0,0 +1,242 @@
+package handlers
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"net/http"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/distribution/distribution/v3/audit"
+	"github.com/distribution/distribution/v3/configuration"
+	"github.com/distribution/distribution/v3/manifest/schema2"
+	"github.com/distribution/reference"
+	"github.com/opencontainers/go-digest"
+	"github.com/opencontainers/image-spec/specs-go"
+	v1 "github.com/opencontainers/image-spec/specs-go/v1"
+)
+
+// readAuditLog returns the entries of the audit log file.
+func readAuditLog(t *testing.T, path string) []audit.Entry {
+	t.Helper()
+	f, err := os.Open(path)
+	if err != nil {
+		t.Fatalf("error opening the audit log: %v", err)
+	}
+	defer f.Close()
+
+	var entries []audit.Entry
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		var entry audit.Entry
+		if err := json.Unmarshal(scanner.Bytes(), &entry); err != nil {
+			t.Fatalf("invalid audit log entry %q: %v", scanner.Text(), err)
+		}
+		entries = append(entries, entry)
+	}
+	return entries
+}
+
+func TestAuditLog(t *testing.T) {
+	auditPath := filepath.Join(t.TempDir(), "audit.log")
+	config := configuration.Configuration{
+		Storage: configuration.Storage{
+			"inmemory": configuration.Parameters{},
+			"delete":   configuration.Parameters{"enabled": true},
+			"maintenance": configuration.Parameters{"uploadpurging": map[any]any{
+				"enabled": false,
+			}},
+		},
+		Auth: configuration.Auth{
+			"silly": {
+				"realm":   "realm-test",
+				"service": "service-test",
+			},
+		},
+	}
+	config.Log.Audit.Output = auditPath
+	config.HTTP.Headers = headerConfig
+	env := newTestEnvWithConfig(t, &config)
+	defer env.Shutdown()
+
+	// The content is stored behind the back of the authorization.
+	ctx := context.Background()
+	imageName, _ := reference.WithName("foo/audited")
+	repository, err := env.app.registry.Repository(ctx, imageName)
+	checkErr(t, err, "getting repository")
+	blobs := repository.Blobs(ctx)
+	configDesc, err := blobs.Put(ctx, schema2.MediaTypeImageConfig, []byte("{}"))
+	checkErr(t, err, "putting config")
+	configDesc.MediaType = schema2.MediaTypeImageConfig
+	layerDesc, err := blobs.Put(ctx, schema2.MediaTypeLayer, []byte("some layer content"))
+	checkErr(t, err, "putting layer")
+	layerDesc.MediaType = schema2.MediaTypeLayer
+	manifest, err := schema2.FromStruct(schema2.Manifest{
+		Versioned: specs.Versioned{SchemaVersion: 2},
+		Config:    configDesc,
+		Layers:    []v1.Descriptor{layerDesc},
+	})
+	checkErr(t, err, "building manifest")
+	manifests, err := repository.Manifests(ctx)
+	checkErr(t, err, "getting manifests")
+	manifestDigest, err := manifests.Put(ctx, manifest)
+	checkErr(t, err, "putting manifest")
+	for _, tag := range []string{"latest", "stable"} {
+		checkErr(t, repository.Tags(ctx).Tag(ctx, tag, v1.Descriptor{Digest: manifestDigest}), "tagging manifest")
+	}
+
+	stableRef, _ := reference.WithTag(imageName, "stable")
+	tagURL, err := env.builder.BuildTagURL(stableRef)
+	checkErr(t, err, "building tag url")
+	tagRef, _ := reference.WithTag(imageName, "latest")
+	manifestTagURL, err := env.builder.BuildManifestURL(tagRef)
+	checkErr(t, err, "building manifest url")
+	digestRef, _ := reference.WithDigest(imageName, manifestDigest)
+	manifestURL, err := env.builder.BuildManifestURL(digestRef)
+	checkErr(t, err, "building manifest url")
+	layerRef, _ := reference.WithDigest(imageName, layerDesc.Digest)
+	layerURL, err := env.builder.BuildBlobURL(layerRef)
+	checkErr(t, err, "building blob url")
+
+	for _, tc := range []struct {
+		name       string
+		url        string
+		authorized bool
+		status     int
+		expected   audit.Entry
+	}{
+		{
+			name:       "tag",
+			url:        tagURL,
+			authorized: true,
+			status:     http.StatusAccepted,
+			expected:   audit.Entry{Action: audit.ActionTagDelete, Actor: "silly", Tag: "stable", Outcome: audit.OutcomeSuccess},
+		},
+		{
+			name:       "manifest by tag",
+			url:        manifestTagURL,
+			authorized: true,
+			status:     http.StatusAccepted,
+			expected:   audit.Entry{Action: audit.ActionTagDelete, Actor: "silly", Tag: "latest", Outcome: audit.OutcomeSuccess},
+		},
+		{
+			name:       "unauthorized",
+			url:        manifestURL,
+			authorized: false,
+			status:     http.StatusUnauthorized,
+			expected:   audit.Entry{Action: audit.ActionManifestDelete, Digest: manifestDigest, Outcome: audit.OutcomeFailure},
+		},
+		{
+			name:       "manifest",
+			url:        manifestURL,
+			authorized: true,
+			status:     http.StatusAccepted,
+			expected:   audit.Entry{Action: audit.ActionManifestDelete, Actor: "silly", Digest: manifestDigest, Outcome: audit.OutcomeSuccess},
+		},
+		{
+			name:       "unknown manifest",
+			url:        manifestURL,
+			authorized: true,
+			status:     http.StatusNotFound,
+			expected:   audit.Entry{Action: audit.ActionManifestDelete, Actor: "silly", Digest: manifestDigest, Outcome: audit.OutcomeFailure},
+		},
+		{
+			name:       "blob",
+			url:        layerURL,
+			authorized: true,
+			status:     http.StatusAccepted,
+			expected:   audit.Entry{Action: audit.ActionBlobDelete, Actor: "silly", Digest: layerDesc.Digest, Outcome: audit.OutcomeSuccess},
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			req, err := http.NewRequest(http.MethodDelete, tc.url, nil)
+			checkErr(t, err, "building request")
+			if tc.authorized {
+				req.Header.Set("Authorization", "Bearer token")
+			}
+			resp, err := http.DefaultClient.Do(req)
+			checkErr(t, err, "deleting")
+			defer resp.Body.Close()
+			checkResponse(t, "deleting", resp, tc.status)
+
+			// The entry is written before the response is sent.
+			entries := readAuditLog(t, auditPath)
+			entry := entries[len(entries)-1]
+			if entry.Time.IsZero() || entry.ClientIP != "127.0.0.1" || entry.RequestID != resp.Header.Get("X-Request-Id") {
+				t.Fatalf("unexpected time, client or request of entry %+v", entry)
+			}
+			if (tc.expected.Outcome == audit.OutcomeFailure) != (entry.Error != "" || tc.status == http.StatusUnauthorized) {
+				t.Fatalf("unexpected error of entry %+v", entry)
+			}
+			expected := tc.expected
+			expected.Repository = imageName.Name()
+			expected.Status = tc.status
+			expected.Time, expected.ClientIP, expected.RequestID, expected.Error = entry.Time, entry.ClientIP, entry.RequestID, entry.Error
+			if entry != expected {
+				t.Fatalf("unexpected entry %+v, expected %+v", entry, expected)
+			}
+		})
+	}
+	if entries := readAuditLog(t, auditPath); len(entries) != 6 {
+		t.Fatalf("unexpected number of entries: %v", entries)
+	}
+}
+
+func TestProxyAuditLog(t *testing.T) {
+	upstreamEnv := newTestEnv(t, false)
+	defer upstreamEnv.Shutdown()
+	createRepository(upstreamEnv, t, "foo/audited", "latest")
+
+	auditPath := filepath.Join(t.TempDir(), "audit.log")
+	ttl := 500 * time.Millisecond
+	config := configuration.Configuration{
+		Storage: configuration.Storage{
+			"inmemory": configuration.Parameters{},
+			"delete":   configuration.Parameters{"enabled": true},
+			"maintenance": configuration.Parameters{"uploadpurging": map[any]any{
+				"enabled": false,
+			}},
+		},
+		Proxy: configuration.Proxy{
+			RemoteURL: upstreamEnv.server.URL,
+			TTL:       &ttl,
+		},
+	}
+	config.Log.Audit.Output = auditPath
+	config.HTTP.Headers = headerConfig
+	env := newTestEnvWithConfig(t, &config)
+	defer env.Shutdown()
+
+	imageName, _ := reference.WithName("foo/audited")
+	tagRef, _ := reference.WithTag(imageName, "latest")
+	manifestURL, err := env.builder.BuildManifestURL(tagRef)
+	checkErr(t, err, "building manifest url")
+	resp, err := http.Get(manifestURL)
+	checkErr(t, err, "pulling manifest")
+	defer resp.Body.Close()
+	checkResponse(t, "pulling manifest", resp, http.StatusOK)
+	manifestDigest := digest.Digest(resp.Header.Get("Docker-Content-Digest"))
+
+	// The manifest expired from the cache is recorded.
+	deadline := time.Now().Add(5 * time.Second)
+	for len(readAuditLog(t, auditPath)) == 0 {
+		if time.Now().After(deadline) {
+			t.Fatal("the expiry of the manifest is not recorded")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	entry := readAuditLog(t, auditPath)[0]
+	expected := audit.Entry{
+		Time:       entry.Time,
+		Action:     audit.ActionProxyManifestPurge,
+		Repository: imageName.Name(),
+		Digest:     manifestDigest,
+		Outcome:    audit.OutcomeSuccess,
+	}
+	if entry != expected {
+		t.Fatalf("unexpected entry %+v, expected %+v", entry, expected)
+	}
+}
@@ -1,6 +1,8 @@
 package handlers
 
 import (
+	"encoding/json"
+	"errors"
 	"net/http"
 
 	"github.com/distribution/distribution/v3"
@@ -31,16 +33,11 @@ func blobDispatcher(ctx *Context, r *http.Request) http.Handler {
 		Digest:  dgst,
 	}
 
-	mhandler := handlers.MethodHandler{
-		http.MethodGet:  http.HandlerFunc(blobHandler.GetBlob),
-		http.MethodHead: http.HandlerFunc(blobHandler.GetBlob),
+	return handlers.MethodHandler{
+		http.MethodGet:    http.HandlerFunc(blobHandler.GetBlob),
+		http.MethodHead:   http.HandlerFunc(blobHandler.GetBlob),
+		http.MethodDelete: http.HandlerFunc(blobHandler.DeleteBlob),
 	}
-
-	if !ctx.readOnly {
-		mhandler[http.MethodDelete] = http.HandlerFunc(blobHandler.DeleteBlob)
-	}
-
-	return mhandler
 }
 
 // blobHandler serves http blob requests.
@@ -66,12 +63,33 @@ func (bh *blobHandler) GetBlob(w http.ResponseWriter, r *http.Request) {
 	}
 
 	if err := blobs.ServeBlob(bh, w, r, desc.Digest); err != nil {
+		if errors.As(err, new(distribution.ErrBlobCorrupted)) {
+			bh.blobCorrupted(w, r, err)
+			return
+		}
 		dcontext.GetLogger(bh).Debugf("unexpected error getting blob HTTP handler: %v", err)
 		bh.Errors = append(bh.Errors, errcode.ErrorCodeUnknown.WithDetail(err))
 		return
 	}
 }
 
+// blobCorrupted responds to the request of a blob whose content does not
+// match its digest. Quarantined blobs are unknown to HEAD requests, so that
+// clients push them again, while the content requests fail with a 500
+// response, as the registry still references the blob.
+func (bh *blobHandler) blobCorrupted(w http.ResponseWriter, r *http.Request, err error) {
+	dcontext.GetLogger(bh).Errorf("error serving blob: %v", err)
+	if r.Method == http.MethodHead {
+		bh.Errors = append(bh.Errors, errcode.ErrorCodeBlobUnknown.WithDetail(bh.Digest))
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusInternalServerError)
+	if err := json.NewEncoder(w).Encode(errcode.Errors{errcode.ErrorCodeBlobUnknown.WithDetail(bh.Digest)}); err != nil {
+		dcontext.GetLogger(bh).Errorf("error serving error json: %v", err)
+	}
+}
+
 // DeleteBlob deletes a layer blob
 func (bh *blobHandler) DeleteBlob(w http.ResponseWriter, r *http.Request) {
 	dcontext.GetLogger(bh).Debug("DeleteBlob")
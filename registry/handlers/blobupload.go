@@ -1,7 +1,9 @@
 package handlers
 
 import (
+	"context"
 	"fmt"
+	"io"
 	"net/http"
 	"net/url"
 	"strconv"
@@ -10,6 +12,7 @@ import (
 	"github.com/distribution/distribution/v3/internal/dcontext"
 	"github.com/distribution/distribution/v3/registry/api/errcode"
 	"github.com/distribution/distribution/v3/registry/storage"
+	storagedriver "github.com/distribution/distribution/v3/registry/storage/driver"
 	"github.com/distribution/reference"
 	"github.com/gorilla/handlers"
 	"github.com/opencontainers/go-digest"
@@ -25,15 +28,12 @@ func blobUploadDispatcher(ctx *Context, r *http.Request) http.Handler {
 	}
 
 	handler := handlers.MethodHandler{
-		http.MethodGet:  http.HandlerFunc(buh.GetUploadStatus),
-		http.MethodHead: http.HandlerFunc(buh.GetUploadStatus),
-	}
-
-	if !ctx.readOnly {
-		handler[http.MethodPost] = http.HandlerFunc(buh.StartBlobUpload)
-		handler[http.MethodPatch] = http.HandlerFunc(buh.PatchBlobData)
-		handler[http.MethodPut] = http.HandlerFunc(buh.PutBlobUploadComplete)
-		handler[http.MethodDelete] = http.HandlerFunc(buh.CancelBlobUpload)
+		http.MethodGet:    http.HandlerFunc(buh.GetUploadStatus),
+		http.MethodHead:   http.HandlerFunc(buh.GetUploadStatus),
+		http.MethodPost:   http.HandlerFunc(buh.StartBlobUpload),
+		http.MethodPatch:  http.HandlerFunc(buh.PatchBlobData),
+		http.MethodPut:    http.HandlerFunc(buh.PutBlobUploadComplete),
+		http.MethodDelete: http.HandlerFunc(buh.CancelBlobUpload),
 	}
 
 	if buh.UUID != "" {
@@ -84,6 +84,8 @@ func (buh *blobUploadHandler) StartBlobUpload(w http.ResponseWriter, r *http.Req
 			if err := buh.writeBlobCreatedHeaders(w, ebm.Descriptor); err != nil {
 				buh.Errors = append(buh.Errors, errcode.ErrorCodeUnknown.WithDetail(err))
 			}
+		} else if eqe, ok := err.(distribution.ErrQuotaExceeded); ok {
+			buh.Errors = append(buh.Errors, quotaExceeded(eqe))
 		} else if err == distribution.ErrUnsupported {
 			buh.Errors = append(buh.Errors, errcode.ErrorCodeUnsupported)
 		} else {
@@ -142,34 +144,43 @@ func (buh *blobUploadHandler) PatchBlobData(w http.ResponseWriter, r *http.Reque
 		return
 	}
 
-	cr := r.Header.Get("Content-Range")
-	cl := r.Header.Get("Content-Length")
-	if cr != "" && cl != "" {
-		start, end, err := parseContentRange(cr)
-		if err != nil {
+	// A retry of the chunk received last, sent to the location it was sent
+	// to before, is acknowledged without being written again.
+	if start, end, ok := buh.retriedChunk(r); ok {
+		dcontext.GetLogger(buh).Debugf("acknowledging the retry of chunk %d-%d of upload %s", start, end, buh.UUID)
+		if _, err := io.Copy(io.Discard, r.Body); err != nil {
 			buh.Errors = append(buh.Errors, errcode.ErrorCodeUnknown.WithDetail(err.Error()))
 			return
 		}
-		if start > end || start != buh.Upload.Size() {
-			buh.Errors = append(buh.Errors, errcode.ErrorCodeRangeInvalid)
+		if err := buh.blobUploadResponse(w, r); err != nil {
+			buh.Errors = append(buh.Errors, errcode.ErrorCodeUnknown.WithDetail(err))
 			return
 		}
+		w.WriteHeader(http.StatusAccepted)
+		return
+	}
 
-		clInt, err := strconv.ParseInt(cl, 10, 64)
-		if err != nil {
-			buh.Errors = append(buh.Errors, errcode.ErrorCodeUnknown.WithDetail(err.Error()))
-			return
-		}
-		if clInt != (end-start)+1 {
-			buh.Errors = append(buh.Errors, errcode.ErrorCodeSizeInvalid)
-			return
-		}
+	start, end, ok := buh.checkChunkRange(w, r)
+	if !ok {
+		return
 	}
 
-	if err := copyFullPayload(buh, w, r, buh.Upload, -1, "blob PATCH"); err != nil {
+	copied, err := copyFullPayload(buh, w, r, buh.Upload, -1, "blob PATCH")
+	if err != nil {
 		buh.Errors = append(buh.Errors, errcode.ErrorCodeUnknown.WithDetail(err.Error()))
 		return
 	}
+	if end >= 0 && copied != end-start+1 {
+		buh.Errors = append(buh.Errors, errcode.ErrorCodeSizeInvalid.WithDetail(fmt.Sprintf("%d bytes received for range %d-%d", copied, start, end)))
+		return
+	}
+
+	// The chunk is committed to the session of the upload once the writer
+	// is closed, unless a concurrent chunk was committed first.
+	if err := buh.Upload.Close(); err == distribution.ErrBlobUploadConflict {
+		buh.Errors = append(buh.Errors, errcode.ErrorCodeBlobUploadInvalid.WithDetail(err))
+		return
+	}
 
 	if err := buh.blobUploadResponse(w, r); err != nil {
 		buh.Errors = append(buh.Errors, errcode.ErrorCodeUnknown.WithDetail(err))
@@ -206,10 +217,25 @@ func (buh *blobUploadHandler) PutBlobUploadComplete(w http.ResponseWriter, r *ht
 		return
 	}
 
-	if err := copyFullPayload(buh, w, r, buh.Upload, -1, "blob PUT"); err != nil {
+	// The final chunk, if any, is checked as those of the PATCH requests. A
+	// request without a body completes the upload with the data received.
+	start, end := int64(-1), int64(-1)
+	if r.ContentLength != 0 {
+		var ok bool
+		if start, end, ok = buh.checkChunkRange(w, r); !ok {
+			return
+		}
+	}
+
+	copied, err := copyFullPayload(buh, w, r, buh.Upload, -1, "blob PUT")
+	if err != nil {
 		buh.Errors = append(buh.Errors, errcode.ErrorCodeUnknown.WithDetail(err.Error()))
 		return
 	}
+	if end >= 0 && copied != end-start+1 {
+		buh.Errors = append(buh.Errors, errcode.ErrorCodeSizeInvalid.WithDetail(fmt.Sprintf("%d bytes received for range %d-%d", copied, start, end)))
+		return
+	}
 
 	desc, err := buh.Upload.Commit(buh, v1.Descriptor{
 		Digest: dgst,
@@ -222,6 +248,8 @@ func (buh *blobUploadHandler) PutBlobUploadComplete(w http.ResponseWriter, r *ht
 		switch err := err.(type) {
 		case distribution.ErrBlobInvalidDigest:
 			buh.Errors = append(buh.Errors, errcode.ErrorCodeDigestInvalid.WithDetail(err))
+		case distribution.ErrQuotaExceeded:
+			buh.Errors = append(buh.Errors, quotaExceeded(err))
 		case errcode.Error:
 			buh.Errors = append(buh.Errors, err)
 		default:
@@ -272,30 +300,42 @@ func (buh *blobUploadHandler) CancelBlobUpload(w http.ResponseWriter, r *http.Re
 
 func (buh *blobUploadHandler) ResumeBlobUpload(ctx *Context, r *http.Request) http.Handler {
 	state, err := hmacKey(ctx.Config.HTTP.Secret).unpackUploadState(r.FormValue("_state"))
-	if err != nil {
+	// The state of an upload started by an instance with another secret, or
+	// before a restart with a generated one, is resumed from the session
+	// persisted in the storage instead.
+	persisted := err == errInvalidSecret
+	if err != nil && !persisted {
 		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 			dcontext.GetLogger(ctx).Infof("error resolving upload: %v", err)
 			buh.Errors = append(buh.Errors, errcode.ErrorCodeBlobUploadInvalid.WithDetail(err))
 		})
 	}
-	buh.State = state
 
-	if state.Name != ctx.Repository.Named().Name() {
-		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-			dcontext.GetLogger(ctx).Infof("mismatched repository name in upload state: %q != %q", state.Name, buh.Repository.Named().Name())
-			buh.Errors = append(buh.Errors, errcode.ErrorCodeBlobUploadInvalid.WithDetail(err))
-		})
-	}
+	if !persisted {
+		buh.State = state
 
-	if state.UUID != buh.UUID {
-		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-			dcontext.GetLogger(ctx).Infof("mismatched uuid in upload state: %q != %q", state.UUID, buh.UUID)
-			buh.Errors = append(buh.Errors, errcode.ErrorCodeBlobUploadInvalid.WithDetail(err))
-		})
+		if state.Name != ctx.Repository.Named().Name() {
+			return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				dcontext.GetLogger(ctx).Infof("mismatched repository name in upload state: %q != %q", state.Name, buh.Repository.Named().Name())
+				buh.Errors = append(buh.Errors, errcode.ErrorCodeBlobUploadInvalid.WithDetail(err))
+			})
+		}
+
+		if state.UUID != buh.UUID {
+			return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				dcontext.GetLogger(ctx).Infof("mismatched uuid in upload state: %q != %q", state.UUID, buh.UUID)
+				buh.Errors = append(buh.Errors, errcode.ErrorCodeBlobUploadInvalid.WithDetail(err))
+			})
+		}
 	}
 
+	// The storage drivers may size the uploads of the chunk from its length.
+	var resumeCtx context.Context = buh
+	if r.ContentLength > 0 {
+		resumeCtx = storagedriver.WithSizeHint(buh, r.ContentLength)
+	}
 	blobs := ctx.Repository.Blobs(buh)
-	upload, err := blobs.Resume(buh, buh.UUID)
+	upload, err := blobs.Resume(resumeCtx, buh.UUID)
 	if err != nil {
 		dcontext.GetLogger(ctx).Errorf("error resolving upload: %v", err)
 		if err == distribution.ErrBlobUploadUnknown {
@@ -310,15 +350,107 @@ func (buh *blobUploadHandler) ResumeBlobUpload(ctx *Context, r *http.Request) ht
 	}
 	buh.Upload = upload
 
-	if size := upload.Size(); size != buh.State.Offset {
-		dcontext.GetLogger(ctx).Errorf("upload resumed at wrong offset: %d != %d", size, buh.State.Offset)
-		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-			buh.Errors = append(buh.Errors, errcode.ErrorCodeRangeInvalid.WithDetail(err))
-		})
+	if persisted {
+		session, ok := upload.(interface{ SessionOffset() (int64, bool) })
+		var offset int64
+		if ok {
+			offset, ok = session.SessionOffset()
+		}
+		if !ok {
+			return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				dcontext.GetLogger(ctx).Infof("error resolving upload: %v", err)
+				buh.Errors = append(buh.Errors, errcode.ErrorCodeBlobUploadInvalid.WithDetail(err))
+			})
+		}
+		dcontext.GetLogger(ctx).Debugf("resuming upload %s from its persisted session", buh.UUID)
+		buh.State = blobUploadState{
+			Name:      ctx.Repository.Named().Name(),
+			UUID:      buh.UUID,
+			Offset:    offset,
+			StartedAt: upload.StartedAt(),
+		}
+	}
+
+	// The offset of a chunk is checked against its Content-Range, if any,
+	// and a request without a body completes an upload whatever its state.
+	if size := upload.Size(); size != buh.State.Offset && r.Method != http.MethodPatch && !(r.Method == http.MethodPut && r.ContentLength == 0) {
+		dcontext.GetLogger(ctx).Infof("upload resumed at wrong offset: %d != %d", size, buh.State.Offset)
+		return closeResources(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			buh.rangeInvalid(w, r, fmt.Sprintf("upload is at offset %d, not %d", size, buh.State.Offset))
+		}), upload)
 	}
 	return nil
 }
 
+// checkChunkRange checks the Content-Range of a chunk, if any, against the
+// offset of the upload and its Content-Length, and returns the range, or -1
+// if the request has no Content-Range. A chunk without a Content-Range must be
+// sent with the state of the current offset. It reports the errors and
+// returns false if the chunk is rejected.
+func (buh *blobUploadHandler) checkChunkRange(w http.ResponseWriter, r *http.Request) (int64, int64, bool) {
+	offset := buh.Upload.Size()
+	cr := r.Header.Get("Content-Range")
+	if cr == "" {
+		if buh.State.Offset != offset {
+			buh.rangeInvalid(w, r, fmt.Sprintf("upload is at offset %d, not %d", offset, buh.State.Offset))
+			return -1, -1, false
+		}
+		return -1, -1, true
+	}
+
+	start, end, err := parseContentRange(cr)
+	if err != nil {
+		buh.rangeInvalid(w, r, err.Error())
+		return -1, -1, false
+	}
+	if start > end || start != offset {
+		buh.rangeInvalid(w, r, fmt.Sprintf("range %s does not start at offset %d", cr, offset))
+		return -1, -1, false
+	}
+	if cl := r.Header.Get("Content-Length"); cl != "" {
+		clInt, err := strconv.ParseInt(cl, 10, 64)
+		if err != nil {
+			buh.Errors = append(buh.Errors, errcode.ErrorCodeSizeInvalid.WithDetail(err.Error()))
+			return -1, -1, false
+		}
+		if clInt != (end-start)+1 {
+			buh.Errors = append(buh.Errors, errcode.ErrorCodeSizeInvalid)
+			return -1, -1, false
+		}
+	}
+	return start, end, true
+}
+
+// retriedChunk returns the range of a PATCH request whose Content-Range is
+// the chunk received last, sent with the state the upload was in before it
+// was received: a retry of a request whose response was lost.
+func (buh *blobUploadHandler) retriedChunk(r *http.Request) (int64, int64, bool) {
+	cr := r.Header.Get("Content-Range")
+	if cr == "" || buh.State.Offset == buh.Upload.Size() {
+		return -1, -1, false
+	}
+	start, end, err := parseContentRange(cr)
+	if err != nil || start > end || start != buh.State.Offset || end+1 != buh.Upload.Size() {
+		return -1, -1, false
+	}
+	if r.ContentLength >= 0 && r.ContentLength != (end-start)+1 {
+		return -1, -1, false
+	}
+	return start, end, true
+}
+
+// rangeInvalid reports a chunk which does not continue the upload, with the
+// Location and the Range of the upload the client resumes from.
+func (buh *blobUploadHandler) rangeInvalid(w http.ResponseWriter, r *http.Request, detail string) {
+	if err := buh.blobUploadResponse(w, r); err != nil {
+		buh.Errors = append(buh.Errors, errcode.ErrorCodeUnknown.WithDetail(err))
+		return
+	}
+	// The error is written in the body.
+	w.Header().Del("Content-Length")
+	buh.Errors = append(buh.Errors, errcode.ErrorCodeRangeInvalid.WithDetail(detail))
+}
+
 // blobUploadResponse provides a standard request for uploading blobs and
 // chunk responses. This sets the correct headers but the response status is
 // left to the caller.
@@ -401,3 +533,13 @@ func (buh *blobUploadHandler) writeBlobCreatedHeaders(w http.ResponseWriter, des
 	w.WriteHeader(http.StatusCreated)
 	return nil
 }
+
+// quotaExceeded returns the QUOTA_EXCEEDED error detailing the usage and the
+// limit of the quota of the repository.
+func quotaExceeded(err distribution.ErrQuotaExceeded) errcode.Error {
+	return errcode.ErrorCodeQuotaExceeded.WithDetail(map[string]int64{
+		"usage": err.Usage,
+		"limit": err.Limit,
+		"size":  err.Size,
+	})
+}
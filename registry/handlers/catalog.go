@@ -6,15 +6,26 @@ import (
 	"io"
 	"net/http"
 	"net/url"
+	"regexp"
 	"strconv"
 
+	"github.com/distribution/distribution/v3"
 	"github.com/distribution/distribution/v3/registry/api/errcode"
 	"github.com/distribution/distribution/v3/registry/storage/driver"
+	"github.com/distribution/reference"
 	"github.com/gorilla/handlers"
 )
 
 const defaultReturnedEntries = 100
 
+var anchoredNameRegexp = regexp.MustCompile("^" + reference.NameRegexp.String() + "$")
+
+// validPrefix returns whether prefix starts a valid repository name, which it
+// does if a component completes it into a valid name.
+func validPrefix(prefix string) bool {
+	return len(prefix) <= reference.RepositoryNameTotalLengthMax && anchoredNameRegexp.MatchString(prefix+"a")
+}
+
 func catalogDispatcher(ctx *Context, r *http.Request) http.Handler {
 	catalogHandler := &catalogHandler{
 		Context: ctx,
@@ -38,6 +49,11 @@ func (ch *catalogHandler) GetCatalog(w http.ResponseWriter, r *http.Request) {
 
 	q := r.URL.Query()
 	lastEntry := q.Get("last")
+	prefix := q.Get("prefix")
+	if prefix != "" && !validPrefix(prefix) {
+		ch.Errors = append(ch.Errors, errcode.ErrorCodeNameInvalid.WithDetail(map[string]string{"prefix": prefix}))
+		return
+	}
 
 	entries := defaultReturnedEntries
 	maximumConfiguredEntries := ch.App.Config.Catalog.MaxEntries
@@ -71,7 +87,24 @@ func (ch *catalogHandler) GetCatalog(w http.ResponseWriter, r *http.Request) {
 	if entries == 0 {
 		moreEntries = false
 	} else {
-		returnedRepositories, err := ch.App.registry.Repositories(ch.Context, repos, lastEntry)
+		var (
+			returnedRepositories int
+			err                  error
+		)
+		if ch.App.tenancy != nil {
+			// Only the repositories of the tenants of the user are listed.
+			returnedRepositories, err = ch.App.tenancy.namespace.TenantRepositories(ch.Context, ch.App.visibleTenants(ch.Context), repos, lastEntry, prefix)
+		} else if prefix == "" {
+			returnedRepositories, err = ch.App.registry.Repositories(ch.Context, repos, lastEntry)
+		} else if lister, ok := ch.App.registry.(distribution.RepositoryPrefixLister); ok {
+			returnedRepositories, err = lister.RepositoriesWithPrefix(ch.Context, repos, lastEntry, prefix)
+		} else {
+			err = distribution.ErrUnsupported
+		}
+		if err == distribution.ErrUnsupported {
+			ch.Errors = append(ch.Errors, errcode.ErrorCodeUnsupported.WithDetail(err))
+			return
+		}
 		if err != nil {
 			_, pathNotFound := err.(driver.PathNotFoundError)
 			if err != io.EOF && !pathNotFound {
@@ -107,7 +140,9 @@ func (ch *catalogHandler) GetCatalog(w http.ResponseWriter, r *http.Request) {
 }
 
 // Use the original URL from the request to create a new URL for
-// the link header
+// the link header, keeping the prefix the catalog is filtered by, whether
+// the tags are listed in detail, the filters of the proxy expirations and the
+// term and type of a search
 func createLinkEntry(origURL string, maxEntries int, lastEntry string) (string, error) {
 	calledURL, err := url.Parse(origURL)
 	if err != nil {
@@ -117,6 +152,14 @@ func createLinkEntry(origURL string, maxEntries int, lastEntry string) (string,
 	v := url.Values{}
 	v.Add("n", strconv.Itoa(maxEntries))
 	v.Add("last", lastEntry)
+	if prefix := calledURL.Query().Get("prefix"); prefix != "" {
+		v.Add("prefix", prefix)
+	}
+	for _, param := range []string{"detail", "within", "repository", "q", "type"} {
+		if value := calledURL.Query().Get(param); value != "" {
+			v.Add(param, value)
+		}
+	}
 
 	calledURL.RawQuery = v.Encode()
 
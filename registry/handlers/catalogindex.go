@@ -0,0 +1,62 @@
+package handlers
+
+import (
+	"context"
+	"errors"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+
+	"github.com/distribution/distribution/v3"
+	"github.com/distribution/distribution/v3/configuration"
+	"github.com/distribution/distribution/v3/internal/dcontext"
+	"github.com/distribution/distribution/v3/registry/storage"
+	"github.com/distribution/distribution/v3/registry/storage/cache"
+	rediscache "github.com/distribution/distribution/v3/registry/storage/cache/redis"
+	storagedriver "github.com/distribution/distribution/v3/registry/storage/driver"
+)
+
+// defaultCatalogReconcileInterval is the interval at which the catalog index
+// is reconciled with the storage, unless configured.
+const defaultCatalogReconcileInterval = time.Hour
+
+// newCatalogIndex returns the catalog index of the configuration, kept in
+// the storage or in redis.
+func newCatalogIndex(config configuration.CatalogIndex, driver storagedriver.StorageDriver, pool redis.UniversalClient) (*storage.CatalogIndex, error) {
+	var provider cache.CatalogProvider
+	switch config.Store {
+	case configuration.CatalogIndexStoreRedis:
+		if pool == nil {
+			return nil, errors.New("redis configuration required to keep the catalog index")
+		}
+		provider = rediscache.NewRedisCatalogProvider(pool)
+	default:
+		provider = storage.NewStorageCatalogProvider(driver)
+	}
+	return storage.NewCatalogIndex(provider), nil
+}
+
+// startCatalogReconciler schedules a goroutine which reconciles the catalog
+// index with the repositories of the registry every interval, until the
+// context is done.
+func startCatalogReconciler(ctx context.Context, index *storage.CatalogIndex, registry distribution.Namespace, log dcontext.Logger, interval time.Duration) {
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+			}
+			reconciliation, err := index.Reconcile(ctx, registry)
+			if err != nil {
+				log.Errorf("failed to reconcile the catalog index: %v", err)
+				continue
+			}
+			if len(reconciliation.Added) > 0 || len(reconciliation.Removed) > 0 {
+				log.Infof("catalog index reconciled: %d repositories added, %d removed", len(reconciliation.Added), len(reconciliation.Removed))
+			}
+		}
+	}()
+}
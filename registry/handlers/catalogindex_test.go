@@ -0,0 +1,80 @@
+package handlers
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/url"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/distribution/distribution/v3/configuration"
+)
+
+func TestCatalogIndexAPI(t *testing.T) {
+	config := configuration.Configuration{
+		Storage: configuration.Storage{
+			"inmemory": configuration.Parameters{},
+			"maintenance": configuration.Parameters{"uploadpurging": map[any]any{
+				"enabled": false,
+			}},
+		},
+		Catalog: configuration.Catalog{
+			MaxEntries: 5,
+			Index:      configuration.CatalogIndex{Enabled: true, ReconcileInterval: time.Hour},
+		},
+	}
+	config.HTTP.Headers = headerConfig
+	env := newTestEnvWithConfig(t, &config)
+	defer env.Shutdown()
+
+	expected := []string{"bar", "foo/a", "foo/a/nested", "foo/b", "foo-c", "qux"}
+	for _, name := range []string{"foo/b", "qux", "foo/a", "foo-c", "bar", "foo/a/nested"} {
+		createRepository(env, t, name, "latest")
+	}
+
+	getCatalog := func(values url.Values) ([]string, string) {
+		t.Helper()
+		catalogURL, err := env.builder.BuildCatalogURL(values)
+		checkErr(t, err, "building catalog url")
+		resp, err := http.Get(catalogURL)
+		checkErr(t, err, "listing the catalog")
+		defer resp.Body.Close()
+		checkResponse(t, "listing the catalog", resp, http.StatusOK)
+		var ctlg struct {
+			Repositories []string `json:"repositories"`
+		}
+		if err := json.NewDecoder(resp.Body).Decode(&ctlg); err != nil {
+			t.Fatalf("error decoding the catalog: %v", err)
+		}
+		return ctlg.Repositories, resp.Header.Get("Link")
+	}
+
+	// The catalog is paginated by the Link header, which the last page,
+	// filled exactly, does not have.
+	var catalog []string
+	values := url.Values{"n": []string{"3"}}
+	for page := 0; ; page++ {
+		repos, link := getCatalog(values)
+		catalog = append(catalog, repos...)
+		if link == "" {
+			break
+		}
+		if page > len(expected) {
+			t.Fatalf("catalog not listed in %d pages", page)
+		}
+		values = checkLink(t, link, 3, repos[len(repos)-1])
+	}
+	if !reflect.DeepEqual(catalog, expected) {
+		t.Fatalf("unexpected catalog %v, expected %v", catalog, expected)
+	}
+
+	repos, link := getCatalog(url.Values{"n": []string{"2"}, "last": []string{"foo/a"}})
+	if !reflect.DeepEqual(repos, []string{"foo/a/nested", "foo/b"}) || link == "" {
+		t.Fatalf("unexpected repositories %v following foo/a, with link %q", repos, link)
+	}
+	repos, link = getCatalog(url.Values{"prefix": []string{"foo/"}})
+	if !reflect.DeepEqual(repos, []string{"foo/a", "foo/a/nested", "foo/b"}) || link != "" {
+		t.Fatalf("unexpected repositories %v with prefix foo/, with link %q", repos, link)
+	}
+}
@@ -1,11 +1,13 @@
 package handlers
 
 import (
+	"context"
 	"net"
 	"net/http"
 	"net/http/httptest"
 	"os"
 	"strings"
+	"sync/atomic"
 	"testing"
 	"time"
 
@@ -208,3 +210,136 @@ func TestHTTPHealthCheck(t *testing.T) {
 		t.Fatal("expected 0 items in health check results")
 	}
 }
+
+func TestUpstreamHealthCheck(t *testing.T) {
+	var up atomic.Bool
+	var requests atomic.Value
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if user, password, ok := r.BasicAuth(); !ok || user != "user" || password != "password" {
+			w.Header().Set("WWW-Authenticate", `Basic realm="upstream"`)
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		requests.Store(r.Method + " " + r.URL.Path)
+		if !up.Load() {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer upstream.Close()
+
+	waitFor := func(msg string, condition func() bool) {
+		t.Helper()
+		for deadline := time.Now().Add(5 * time.Second); !condition(); {
+			if time.Now().After(deadline) {
+				t.Fatalf("timed out waiting for %s", msg)
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+	}
+
+	for _, tc := range []struct {
+		name          string
+		reference     string
+		informational bool
+		request       string
+	}{
+		{name: "base", request: "GET /v2/"},
+		{name: "reference", reference: "library/alpine:latest", request: "HEAD /v2/library/alpine/manifests/latest"},
+		{name: "informational", informational: true, request: "GET /v2/"},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			up.Store(true)
+			requests.Store("")
+			config := &configuration.Configuration{
+				Storage: configuration.Storage{
+					"inmemory": configuration.Parameters{},
+					"maintenance": configuration.Parameters{"uploadpurging": map[any]any{
+						"enabled": false,
+					}},
+				},
+				Proxy: configuration.Proxy{
+					RemoteURL: upstream.URL,
+					Username:  "user",
+					Password:  "password",
+				},
+				Health: configuration.Health{
+					Upstream: configuration.UpstreamHealth{
+						Enabled:       true,
+						Interval:      20 * time.Millisecond,
+						Timeout:       time.Second,
+						Threshold:     2,
+						Reference:     tc.reference,
+						Informational: tc.informational,
+					},
+				},
+			}
+
+			ctx, cancel := context.WithCancel(dcontext.Background())
+			defer cancel()
+			app := NewApp(ctx, config)
+			healthRegistry := health.NewRegistry()
+			app.RegisterHealthChecks(healthRegistry)
+
+			failures := func() map[string]string {
+				if tc.informational {
+					if checks := healthRegistry.CheckStatus(ctx); len(checks) != 0 {
+						t.Fatalf("unexpected failing health checks: %v", checks)
+					}
+					return healthRegistry.NoticeStatus(ctx)
+				}
+				return healthRegistry.CheckStatus(ctx)
+			}
+
+			waitFor("the upstream to be requested", func() bool { return requests.Load() == tc.request })
+			if status := failures(); len(status) != 0 {
+				t.Fatalf("unexpected health status with the upstream up: %v", status)
+			}
+
+			up.Store(false)
+			waitFor("the upstream to be unhealthy", func() bool { return len(failures()) != 0 })
+			if status := failures()[upstream.URL]; !strings.Contains(status, "unexpected status: 503") {
+				t.Fatalf("unexpected health status with the upstream down: %v", failures())
+			}
+
+			up.Store(true)
+			waitFor("the upstream to be healthy", func() bool { return len(failures()) == 0 })
+		})
+	}
+}
+
+func TestStorageWriteProbeHealthCheck(t *testing.T) {
+	config := &configuration.Configuration{
+		Storage: configuration.Storage{
+			"inmemory": configuration.Parameters{},
+			"maintenance": configuration.Parameters{"uploadpurging": map[any]any{
+				"enabled": false,
+			}},
+		},
+		Health: configuration.Health{
+			StorageDriver: configuration.StorageDriver{
+				WriteProbe: configuration.WriteProbe{
+					Enabled:  true,
+					Interval: 20 * time.Millisecond,
+				},
+			},
+		},
+	}
+
+	ctx, cancel := context.WithCancel(dcontext.Background())
+	defer cancel()
+	app := NewApp(ctx, config)
+	healthRegistry := health.NewRegistry()
+	app.RegisterHealthChecks(healthRegistry)
+
+	// Wait for a few probes to happen
+	<-time.After(100 * time.Millisecond)
+
+	if status := healthRegistry.CheckStatus(ctx); len(status) != 0 {
+		t.Fatalf("unexpected health status: %v", status)
+	}
+	if _, err := app.driver.List(ctx, "/docker/registry/v2/_health"); err != nil {
+		t.Fatalf("expected the write probe to have written: %v", err)
+	}
+}
@@ -28,7 +28,7 @@ func closeResources(handler http.Handler, closers ...io.Closer) http.Handler {
 // upload, it avoids sending a 400 error to keep the logs cleaner.
 //
 // The copy will be limited to `limit` bytes, if limit is greater than zero.
-func copyFullPayload(ctx context.Context, responseWriter http.ResponseWriter, r *http.Request, destWriter io.Writer, limit int64, action string) error {
+func copyFullPayload(ctx context.Context, responseWriter http.ResponseWriter, r *http.Request, destWriter io.Writer, limit int64, action string) (int64, error) {
 	// Get a channel that tells us if the client disconnects
 	clientClosed := r.Context().Done()
 	body := r.Body
@@ -55,17 +55,17 @@ func copyFullPayload(ctx context.Context, responseWriter http.ResponseWriter, r
 				"copied":        copied,
 				"contentLength": r.ContentLength,
 			}, "error", "copied", "contentLength").Error("client disconnected during " + action)
-			return errors.New("client disconnected")
+			return copied, errors.New("client disconnected")
 		default:
 		}
 	}
 
 	if err != nil {
 		dcontext.GetLogger(ctx).Errorf("unknown error reading request payload: %v", err)
-		return err
+		return copied, err
 	}
 
-	return nil
+	return copied, nil
 }
 
 func parseContentRange(cr string) (start int64, end int64, err error) {
@@ -0,0 +1,100 @@
+package handlers
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"path"
+	"slices"
+
+	"github.com/opencontainers/go-digest"
+	v1 "github.com/opencontainers/image-spec/specs-go/v1"
+
+	"github.com/distribution/distribution/v3"
+	"github.com/distribution/distribution/v3/configuration"
+	"github.com/distribution/distribution/v3/registry/api/errcode"
+)
+
+// tagImmutability refuses the pushes moving the tags matching its rules. It
+// only applies to the requests of clients: the pull through cache and the
+// commands writing to the storage move the tags directly.
+type tagImmutability struct {
+	rules          []configuration.ImmutableTagRule
+	protectDeletes bool
+}
+
+func newTagImmutability(config configuration.ImmutableTags) (*tagImmutability, error) {
+	for i, rule := range config.Rules {
+		if _, err := path.Match(rule.Repository, ""); err != nil || rule.Repository == "" {
+			return nil, fmt.Errorf("policy.immutabletags.rules[%d]: invalid repository pattern %q", i, rule.Repository)
+		}
+		if len(rule.Tags) == 0 {
+			return nil, fmt.Errorf("policy.immutabletags.rules[%d]: no tags", i)
+		}
+		for _, pattern := range rule.Tags {
+			if _, err := path.Match(pattern, ""); err != nil {
+				return nil, fmt.Errorf("policy.immutabletags.rules[%d]: invalid tag pattern %q", i, pattern)
+			}
+		}
+	}
+	return &tagImmutability{rules: config.Rules, protectDeletes: config.ProtectDeletes}, nil
+}
+
+// immutable reports whether the tag of the repository matches a rule.
+func (ti *tagImmutability) immutable(repository, tag string) bool {
+	return slices.ContainsFunc(ti.rules, func(rule configuration.ImmutableTagRule) bool {
+		if ok, _ := path.Match(rule.Repository, repository); !ok {
+			return false
+		}
+		return slices.ContainsFunc(rule.Tags, func(pattern string) bool {
+			ok, _ := path.Match(pattern, tag)
+			return ok
+		})
+	})
+}
+
+// checkPush returns a TAG_IMMUTABLE error if the tag is immutable and
+// references another manifest than dgst. Pushing the manifest the tag
+// references again is allowed.
+func (ti *tagImmutability) checkPush(ctx context.Context, repo distribution.Repository, tag string, dgst digest.Digest) error {
+	if ti == nil || !ti.immutable(repo.Named().Name(), tag) {
+		return nil
+	}
+	desc, err := repo.Tags(ctx).Get(ctx, tag)
+	switch {
+	case errors.As(err, new(distribution.ErrTagUnknown)):
+		return nil
+	case err != nil:
+		return err
+	case desc.Digest != dgst:
+		return errcode.ErrorCodeTagImmutable.WithDetail(map[string]string{"tag": tag, "digest": desc.Digest.String()})
+	}
+	return nil
+}
+
+// checkDelete returns a TAG_IMMUTABLE error if the deletes are protected and
+// the tag is immutable.
+func (ti *tagImmutability) checkDelete(repository, tag string) error {
+	if ti == nil || !ti.protectDeletes || !ti.immutable(repository, tag) {
+		return nil
+	}
+	return errcode.ErrorCodeTagImmutable.WithDetail(map[string]string{"tag": tag})
+}
+
+// checkManifestDelete returns a TAG_IMMUTABLE error if the deletes are
+// protected and an immutable tag references the manifest.
+func (ti *tagImmutability) checkManifestDelete(ctx context.Context, repo distribution.Repository, dgst digest.Digest) error {
+	if ti == nil || !ti.protectDeletes {
+		return nil
+	}
+	tags, err := repo.Tags(ctx).Lookup(ctx, v1.Descriptor{Digest: dgst})
+	if err != nil {
+		return err
+	}
+	for _, tag := range tags {
+		if err := ti.checkDelete(repo.Named().Name(), tag); err != nil {
+			return err
+		}
+	}
+	return nil
+}
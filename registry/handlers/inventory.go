@@ -0,0 +1,163 @@
+package handlers
+
+import (
+	"context"
+	"fmt"
+	"sync/atomic"
+	"time"
+
+	"github.com/distribution/distribution/v3"
+	"github.com/distribution/distribution/v3/internal/dcontext"
+	prometheus "github.com/distribution/distribution/v3/metrics"
+	"github.com/distribution/distribution/v3/registry/storage"
+	storagedriver "github.com/distribution/distribution/v3/registry/storage/driver"
+	"github.com/docker/go-metrics"
+)
+
+var (
+	// inventoryBlobs is the number of blobs in the blob store.
+	inventoryBlobs = prometheus.StorageNamespace.NewGauge("inventory", "The number of blobs in the blob store", metrics.Unit("blobs"))
+	// inventoryBytes is the size of the blobs in the blob store.
+	inventoryBytes = prometheus.StorageNamespace.NewGauge("inventory", "The number of bytes of the blobs in the blob store", metrics.Bytes)
+	// inventoryRepositories is the number of repositories, counted when the
+	// inventory is reconciled.
+	inventoryRepositories = prometheus.StorageNamespace.NewGauge("inventory", "The number of repositories of the registry", metrics.Unit("repositories"))
+	// descriptorCacheEntries is the number of descriptors of the in-memory
+	// blob descriptor cache.
+	descriptorCacheEntries = prometheus.StorageNamespace.NewGauge("blob_descriptor_cache", "The number of descriptors in the in-memory blob descriptor cache", metrics.Unit("entries"))
+	// descriptorCacheEvictions is the number of descriptors evicted from the
+	// in-memory blob descriptor cache.
+	descriptorCacheEvictions = prometheus.StorageNamespace.NewCounter("blob_descriptor_cache_evictions", "The number of descriptors evicted from the in-memory blob descriptor cache")
+	// schedulerEntries is the number of blobs and manifests scheduled to
+	// expire from the pull through cache.
+	schedulerEntries = prometheus.ProxyNamespace.NewGauge("scheduler", "The number of blobs and manifests scheduled to expire from the cache", metrics.Unit("entries"))
+)
+
+// inventoryConfig configures the inventory of the registry content.
+type inventoryConfig struct {
+	interval          time.Duration
+	reconcileInterval time.Duration
+}
+
+// inventorySources are what the inventory gauges are refreshed from. The
+// sources not configured are nil.
+type inventorySources struct {
+	blobs      *storage.BlobInventory
+	driver     storagedriver.StorageDriver
+	enumerator distribution.RepositoryEnumerator
+	cache      descriptorCacheStats
+	scheduler  interface{ SchedulerEntries() int }
+}
+
+// descriptorCacheStats are the statistics of the in-memory blob descriptor
+// cache.
+type descriptorCacheStats interface {
+	Len() int
+	Evictions() int64
+}
+
+func badInventoryConfig(reason string) {
+	panic(fmt.Sprintf("Unable to parse storage inventory configuration: %s", reason))
+}
+
+// parseInventoryDuration parses the duration of the key of the inventory
+// configuration, which must be positive.
+func parseInventoryDuration(config map[any]any, key string, d *time.Duration) {
+	v, ok := config[key]
+	if !ok {
+		return
+	}
+	s, ok := v.(string)
+	if !ok {
+		badInventoryConfig(key + " is not a string")
+	}
+	parsed, err := time.ParseDuration(s)
+	if err != nil {
+		badInventoryConfig(fmt.Sprintf("Cannot parse %s: %s", key, err.Error()))
+	}
+	if parsed <= 0 {
+		badInventoryConfig(key + " must be positive")
+	}
+	*d = parsed
+}
+
+// parseInventoryConfig parses the inventory section of the storage
+// maintenance configuration. It returns nil if the inventory is disabled.
+func parseInventoryConfig(config map[any]any) *inventoryConfig {
+	enabled, ok := config["enabled"]
+	if !ok || enabled == false {
+		return nil
+	}
+	if _, ok := enabled.(bool); !ok {
+		badInventoryConfig("enabled is not a boolean")
+	}
+
+	ic := &inventoryConfig{interval: time.Minute, reconcileInterval: 24 * time.Hour}
+	parseInventoryDuration(config, "interval", &ic.interval)
+	parseInventoryDuration(config, "reconcileinterval", &ic.reconcileInterval)
+	return ic
+}
+
+// startInventoryCollector schedules a goroutine which periodically refreshes
+// the inventory gauges, and one which periodically reconciles the blob
+// inventory with the storage and counts the repositories, walking the
+// storage.
+func startInventoryCollector(ctx context.Context, log dcontext.Logger, config *inventoryConfig, sources inventorySources) {
+	var repositories atomic.Int64
+
+	go func() {
+		for {
+			start := time.Now()
+			if err := sources.blobs.Reconcile(ctx, sources.driver); err != nil {
+				log.Errorf("failed to reconcile the blob inventory: %v", err)
+			}
+			if sources.enumerator != nil {
+				var n int64
+				err := sources.enumerator.Enumerate(ctx, func(string) error {
+					n++
+					return nil
+				})
+				switch err.(type) {
+				case nil, storagedriver.PathNotFoundError:
+					repositories.Store(n)
+				default:
+					log.Errorf("failed to count the repositories: %v", err)
+				}
+			}
+			log.Debugf("reconciled the storage inventory in %s", time.Since(start))
+
+			select {
+			case <-time.After(config.reconcileInterval):
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+
+	go func() {
+		var lastEvictions int64
+		for {
+			blobs, bytes := sources.blobs.Counts()
+			inventoryBlobs.Set(float64(blobs))
+			inventoryBytes.Set(float64(bytes))
+			if sources.enumerator != nil {
+				inventoryRepositories.Set(float64(repositories.Load()))
+			}
+			if sources.cache != nil {
+				descriptorCacheEntries.Set(float64(sources.cache.Len()))
+				evictions := sources.cache.Evictions()
+				descriptorCacheEvictions.Inc(float64(evictions - lastEvictions))
+				lastEvictions = evictions
+			}
+			if sources.scheduler != nil {
+				schedulerEntries.Set(float64(sources.scheduler.SchedulerEntries()))
+			}
+
+			select {
+			case <-time.After(config.interval):
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+}
@@ -0,0 +1,198 @@
+package handlers
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/distribution/distribution/v3/configuration"
+	"github.com/distribution/distribution/v3/manifest/schema2"
+	v2 "github.com/distribution/distribution/v3/registry/api/v2"
+	"github.com/distribution/reference"
+	"github.com/docker/go-metrics"
+	"github.com/gorilla/handlers"
+	"github.com/opencontainers/go-digest"
+)
+
+// newInventoryEnv returns a test environment whose app stops refreshing the
+// inventory gauges at the end of the test, for them to be asserted by the
+// next test.
+func newInventoryEnv(t *testing.T, config *configuration.Configuration) *testEnv {
+	app := NewApp(t.Context(), config)
+	server := httptest.NewServer(handlers.CombinedLoggingHandler(os.Stderr, app))
+	builder, err := v2.NewURLBuilderFromString(server.URL+config.HTTP.Prefix, false)
+	if err != nil {
+		t.Fatalf("error creating url builder: %v", err)
+	}
+	return &testEnv{
+		ctx:     t.Context(),
+		config:  *config,
+		app:     app,
+		server:  server,
+		builder: builder,
+	}
+}
+
+// gauge returns the value of the gauge on the metrics endpoint.
+func gauge(t *testing.T, name string) float64 {
+	t.Helper()
+	rec := httptest.NewRecorder()
+	metrics.Handler().ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/metrics", nil))
+
+	scanner := bufio.NewScanner(rec.Body)
+	for scanner.Scan() {
+		value, ok := strings.CutPrefix(scanner.Text(), name+" ")
+		if !ok {
+			continue
+		}
+		v, err := strconv.ParseFloat(value, 64)
+		if err != nil {
+			t.Fatalf("error parsing gauge %s: %v", name, err)
+		}
+		return v
+	}
+	t.Fatalf("no gauge %s", name)
+	return 0
+}
+
+// waitForGauge waits for the gauge to be refreshed to a value satisfying
+// check.
+func waitForGauge(t *testing.T, name string, expected string, check func(float64) bool) {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for v := gauge(t, name); !check(v); v = gauge(t, name) {
+		if time.Now().After(deadline) {
+			t.Fatalf("unexpected %s: %v, expected %s", name, v, expected)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func waitForGaugeValue(t *testing.T, name string, expected float64) {
+	t.Helper()
+	waitForGauge(t, name, strconv.FormatFloat(expected, 'f', -1, 64), func(v float64) bool { return v == expected })
+}
+
+func TestInventoryGauges(t *testing.T) {
+	config := configuration.Configuration{
+		Storage: configuration.Storage{
+			"inmemory": configuration.Parameters{},
+			"cache":    configuration.Parameters{"blobdescriptor": "inmemory"},
+			"maintenance": configuration.Parameters{
+				"uploadpurging": map[any]any{"enabled": false},
+				"inventory": map[any]any{
+					"enabled":           true,
+					"interval":          "10ms",
+					"reconcileinterval": "50ms",
+				},
+			},
+		},
+	}
+	config.HTTP.Headers = headerConfig
+	env := newInventoryEnv(t, &config)
+	defer env.Shutdown()
+
+	imageName, _ := reference.WithName("foo/inventory")
+	layer := []byte("some layer content")
+	uploadURLBase, _ := startPushLayer(t, env, imageName)
+	pushLayer(t, env.builder, imageName, digest.FromBytes(layer), uploadURLBase, bytes.NewReader(layer))
+
+	// The blobs are counted as they are committed, and the repository when
+	// the inventory is reconciled.
+	waitForGaugeValue(t, "registry_storage_inventory_blobs", 1)
+	waitForGaugeValue(t, "registry_storage_inventory_bytes", float64(len(layer)))
+
+	createRepository(env, t, imageName.Name(), "latest")
+	waitForGaugeValue(t, "registry_storage_inventory_blobs", 4)
+	waitForGaugeValue(t, "registry_storage_inventory_repositories", 1)
+	waitForGauge(t, "registry_storage_blob_descriptor_cache_entries", "> 0", func(v float64) bool { return v > 0 })
+
+	// The content removed from the storage, such as by the garbage
+	// collection, is accounted for by the reconciliation.
+	if err := env.app.repoRemover.Remove(env.ctx, imageName); err != nil {
+		t.Fatalf("unexpected error removing repository: %v", err)
+	}
+	if err := env.app.driver.Delete(env.ctx, "/docker/registry/v2/blobs"); err != nil {
+		t.Fatalf("unexpected error deleting blobs: %v", err)
+	}
+	waitForGaugeValue(t, "registry_storage_inventory_blobs", 0)
+	waitForGaugeValue(t, "registry_storage_inventory_bytes", 0)
+	waitForGaugeValue(t, "registry_storage_inventory_repositories", 0)
+}
+
+func TestProxyInventoryGauges(t *testing.T) {
+	upstreamEnv := newTestEnv(t, false)
+	defer upstreamEnv.Shutdown()
+	createRepository(upstreamEnv, t, "foo/inventory", "latest")
+
+	ttl := 2 * time.Second
+	config := configuration.Configuration{
+		Storage: configuration.Storage{
+			"inmemory": configuration.Parameters{},
+			"delete":   configuration.Parameters{"enabled": true},
+			"maintenance": configuration.Parameters{
+				"uploadpurging": map[any]any{"enabled": false},
+				"inventory": map[any]any{
+					"enabled":  true,
+					"interval": "10ms",
+				},
+			},
+		},
+		Proxy: configuration.Proxy{
+			RemoteURL: upstreamEnv.server.URL,
+			TTL:       &ttl,
+		},
+	}
+	config.HTTP.Headers = headerConfig
+	env := newInventoryEnv(t, &config)
+	defer env.Shutdown()
+
+	imageName, _ := reference.WithName("foo/inventory")
+	tagRef, _ := reference.WithTag(imageName, "latest")
+	get := func(env *testEnv, ref reference.Reference) *http.Response {
+		var u string
+		var err error
+		if canonical, ok := ref.(reference.Canonical); ok {
+			u, err = env.builder.BuildBlobURL(canonical)
+		} else {
+			u, err = env.builder.BuildManifestURL(ref.(reference.Named))
+		}
+		checkErr(t, err, "building url")
+		resp, err := http.Get(u)
+		checkErr(t, err, "getting "+u)
+		checkResponse(t, "getting "+u, resp, http.StatusOK)
+		return resp
+	}
+
+	// The layer, which takes the longest to be cached, is pulled first for
+	// both to be cached before either expires.
+	resp := get(upstreamEnv, tagRef)
+	defer resp.Body.Close()
+	var manifest schema2.Manifest
+	checkErr(t, json.NewDecoder(resp.Body).Decode(&manifest), "decoding manifest")
+	blobRef, _ := reference.WithDigest(imageName, manifest.Layers[0].Digest)
+	resp = get(env, blobRef)
+	defer resp.Body.Close()
+	_, err := io.Copy(io.Discard, resp.Body)
+	checkErr(t, err, "reading blob")
+	resp = get(env, tagRef)
+	defer resp.Body.Close()
+
+	// The manifest and the layer are scheduled to expire, and counted in
+	// the blob store, as they are cached.
+	waitForGaugeValue(t, "registry_proxy_scheduler_entries", 2)
+	waitForGaugeValue(t, "registry_storage_inventory_blobs", 2)
+
+	// The expiry removes the layer from the blob store, the manifest being
+	// only unlinked from its repository.
+	waitForGaugeValue(t, "registry_proxy_scheduler_entries", 0)
+	waitForGaugeValue(t, "registry_storage_inventory_blobs", 1)
+}
@@ -0,0 +1,89 @@
+package handlers
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"time"
+
+	"github.com/distribution/distribution/v3/internal/dcontext"
+	"github.com/distribution/distribution/v3/registry/api/errcode"
+	"github.com/distribution/distribution/v3/registry/storage"
+	"github.com/gorilla/handlers"
+)
+
+// defaultLastAccessUpdateInterval is the minimum interval between the writes
+// of a last access timestamp, unless configured.
+const defaultLastAccessUpdateInterval = time.Hour
+
+// recordPull records a pull of the repository, and of the tag unless empty,
+// if the last accesses are recorded. A failure is only logged, since the
+// manifest was served.
+func (app *App) recordPull(ctx context.Context, repo, tag string) {
+	if app.lastAccess == nil {
+		return
+	}
+	if err := app.lastAccess.Pulled(ctx, repo, tag); err != nil {
+		dcontext.GetLogger(ctx).Errorf("failed to record the last pull of %s: %v", repo, err)
+	}
+}
+
+// recordPush records a push to the repository, and to the tag unless empty,
+// if the last accesses are recorded.
+func (app *App) recordPush(ctx context.Context, repo, tag string) {
+	if app.lastAccess == nil {
+		return
+	}
+	if err := app.lastAccess.Pushed(ctx, repo, tag); err != nil {
+		dcontext.GetLogger(ctx).Errorf("failed to record the last push to %s: %v", repo, err)
+	}
+}
+
+// repositoryMetadataDispatcher constructs the handler of the metadata of a
+// repository.
+func repositoryMetadataDispatcher(ctx *Context, r *http.Request) http.Handler {
+	repositoryMetadataHandler := &repositoryMetadataHandler{
+		Context: ctx,
+	}
+
+	return handlers.MethodHandler{
+		http.MethodGet: http.HandlerFunc(repositoryMetadataHandler.GetRepositoryMetadata),
+	}
+}
+
+// repositoryMetadataHandler handles the requests for the metadata of a
+// repository.
+type repositoryMetadataHandler struct {
+	*Context
+}
+
+type repositoryMetadataAPIResponse struct {
+	Name       string    `json:"name"`
+	LastPulled time.Time `json:"lastPulled,omitzero"`
+	LastPushed time.Time `json:"lastPushed,omitzero"`
+}
+
+// GetRepositoryMetadata returns the last pull and push of the repository.
+func (rh *repositoryMetadataHandler) GetRepositoryMetadata(w http.ResponseWriter, r *http.Request) {
+	if rh.App.lastAccess == nil {
+		rh.Errors = append(rh.Errors, errcode.ErrorCodeUnsupported)
+		return
+	}
+	name := rh.Repository.Named().Name()
+	times, err := storage.RepositoryAccessTimes(rh, rh.App.driver, name)
+	if err != nil {
+		rh.Errors = append(rh.Errors, errcode.ErrorCodeUnknown.WithDetail(err))
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	enc := json.NewEncoder(w)
+	if err := enc.Encode(repositoryMetadataAPIResponse{
+		Name:       name,
+		LastPulled: times.LastPulled.UTC(),
+		LastPushed: times.LastPushed.UTC(),
+	}); err != nil {
+		rh.Errors = append(rh.Errors, errcode.ErrorCodeUnknown.WithDetail(err))
+		return
+	}
+}
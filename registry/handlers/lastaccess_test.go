@@ -0,0 +1,101 @@
+package handlers
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/url"
+	"testing"
+	"time"
+
+	"github.com/distribution/distribution/v3/configuration"
+	"github.com/distribution/distribution/v3/registry/api/errcode"
+	"github.com/distribution/reference"
+)
+
+func getRepositoryMetadata(t *testing.T, env *testEnv, name reference.Named) repositoryMetadataAPIResponse {
+	t.Helper()
+	metadataURL, err := env.builder.BuildRepositoryMetadataURL(name)
+	checkErr(t, err, "building repository metadata url")
+	resp, err := http.Get(metadataURL)
+	checkErr(t, err, "fetching repository metadata")
+	defer resp.Body.Close()
+	checkResponse(t, "fetching repository metadata", resp, http.StatusOK)
+	var metadata repositoryMetadataAPIResponse
+	if err := json.NewDecoder(resp.Body).Decode(&metadata); err != nil {
+		t.Fatalf("error decoding repository metadata: %v", err)
+	}
+	return metadata
+}
+
+func TestLastAccess(t *testing.T) {
+	config := configuration.Configuration{
+		Storage: configuration.Storage{
+			"inmemory": configuration.Parameters{},
+			"maintenance": configuration.Parameters{"uploadpurging": map[any]any{
+				"enabled": false,
+			}},
+		},
+		Stats: configuration.Stats{
+			LastAccess: configuration.LastAccessStats{Enabled: true},
+		},
+	}
+	config.HTTP.Headers = headerConfig
+	env := newTestEnvWithConfig(t, &config)
+	defer env.Shutdown()
+
+	imageName, err := reference.WithName("foo/bar")
+	checkErr(t, err, "building image name")
+	before := time.Now().Add(-time.Second)
+	createRepository(env, t, imageName.Name(), "latest")
+
+	metadata := getRepositoryMetadata(t, env, imageName)
+	if metadata.Name != "foo/bar" || metadata.LastPushed.Before(before) || !metadata.LastPulled.IsZero() {
+		t.Fatalf("unexpected metadata after the push: %+v", metadata)
+	}
+
+	tagRef, _ := reference.WithTag(imageName, "latest")
+	manifestURL, err := env.builder.BuildManifestURL(tagRef)
+	checkErr(t, err, "building manifest url")
+	resp, err := http.Head(manifestURL)
+	checkErr(t, err, "checking manifest")
+	resp.Body.Close()
+	if metadata := getRepositoryMetadata(t, env, imageName); !metadata.LastPulled.IsZero() {
+		t.Fatalf("expected the HEAD request not to be recorded as a pull, got %v", metadata.LastPulled)
+	}
+	resp, err = http.Get(manifestURL)
+	checkErr(t, err, "fetching manifest")
+	resp.Body.Close()
+	metadata = getRepositoryMetadata(t, env, imageName)
+	if metadata.LastPulled.Before(before) {
+		t.Fatalf("expected the pull to be recorded, got %v", metadata.LastPulled)
+	}
+
+	tagsURL, err := env.builder.BuildTagsURL(imageName, url.Values{"detail": []string{"true"}})
+	checkErr(t, err, "building tags url")
+	resp, err = http.Get(tagsURL)
+	checkErr(t, err, "listing tags")
+	defer resp.Body.Close()
+	checkResponse(t, "listing tags", resp, http.StatusOK)
+	var tags tagDetailsAPIResponse
+	if err := json.NewDecoder(resp.Body).Decode(&tags); err != nil {
+		t.Fatalf("error decoding tags: %v", err)
+	}
+	if len(tags.Tags) != 1 || !tags.Tags[0].LastPulled.Equal(metadata.LastPulled) || tags.Tags[0].LastPushed.Before(before) {
+		t.Fatalf("unexpected tags %+v", tags.Tags)
+	}
+}
+
+func TestRepositoryMetadataDisabled(t *testing.T) {
+	env := newTestEnv(t, false)
+	defer env.Shutdown()
+
+	imageName, err := reference.WithName("foo/bar")
+	checkErr(t, err, "building image name")
+	metadataURL, err := env.builder.BuildRepositoryMetadataURL(imageName)
+	checkErr(t, err, "building repository metadata url")
+	resp, err := http.Get(metadataURL)
+	checkErr(t, err, "fetching repository metadata")
+	defer resp.Body.Close()
+	checkResponse(t, "fetching repository metadata", resp, http.StatusMethodNotAllowed)
+	checkBodyHasErrorCodes(t, "fetching repository metadata", resp, errcode.ErrorCodeUnsupported)
+}
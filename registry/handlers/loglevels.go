@@ -0,0 +1,87 @@
+package handlers
+
+import (
+	"context"
+	"fmt"
+	"path"
+	"slices"
+
+	"github.com/distribution/distribution/v3/configuration"
+	"github.com/distribution/distribution/v3/internal/dcontext"
+	"github.com/sirupsen/logrus"
+)
+
+// repositoryLogLevels overrides the level of the logs of the requests for the
+// repositories matching its patterns.
+type repositoryLogLevels struct {
+	rules []repositoryLogLevel
+}
+
+type repositoryLogLevel struct {
+	pattern string
+	level   logrus.Level
+	// logger is a copy of the standard logger logging at the level.
+	logger *logrus.Logger
+}
+
+// newRepositoryLogLevels returns the overrides of the log level of the
+// configuration, or nil if there are none. Their loggers copy the output,
+// formatter and hooks of the standard logger, so that they are created again
+// when it is reconfigured.
+func newRepositoryLogLevels(config map[string]configuration.Loglevel) (*repositoryLogLevels, error) {
+	if len(config) == 0 {
+		return nil, nil
+	}
+	standard := logrus.StandardLogger()
+	loggers := map[logrus.Level]*logrus.Logger{}
+	levels := &repositoryLogLevels{}
+	for pattern, name := range config {
+		if _, err := path.Match(pattern, ""); err != nil || pattern == "" {
+			return nil, fmt.Errorf("log.repositories: invalid pattern %q", pattern)
+		}
+		level, err := logrus.ParseLevel(string(name))
+		if err != nil {
+			return nil, fmt.Errorf("log.repositories: %s: %v", pattern, err)
+		}
+		if loggers[level] == nil {
+			loggers[level] = &logrus.Logger{
+				Out:          standard.Out,
+				Hooks:        standard.Hooks,
+				Formatter:    standard.Formatter,
+				ReportCaller: standard.ReportCaller,
+				Level:        level,
+				ExitFunc:     standard.ExitFunc,
+			}
+		}
+		levels.rules = append(levels.rules, repositoryLogLevel{pattern: pattern, level: level, logger: loggers[level]})
+	}
+	slices.SortFunc(levels.rules, func(a, b repositoryLogLevel) int {
+		return int(b.level) - int(a.level)
+	})
+	return levels, nil
+}
+
+// logger returns the logger of the most verbose level of the patterns
+// matching the repository, or nil if none does.
+func (l *repositoryLogLevels) logger(name string) *logrus.Logger {
+	for _, rule := range l.rules {
+		if ok, _ := path.Match(rule.pattern, name); ok {
+			return rule.logger
+		}
+	}
+	return nil
+}
+
+// withRepositoryLogLevel returns the context logging at the level overriding
+// the global one for the repository, if any. The logs of the proxy and of the
+// storage drivers written while handling the request use it too.
+func (app *App) withRepositoryLogLevel(ctx context.Context, name string) context.Context {
+	levels := app.logLevels.Load()
+	if levels == nil || name == "" {
+		return ctx
+	}
+	if logger := levels.logger(name); logger != nil {
+		return dcontext.WithLogrusLogger(ctx, logger)
+	}
+	return ctx
+}
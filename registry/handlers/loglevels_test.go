@@ -0,0 +1,75 @@
+package handlers
+
+import (
+	"testing"
+
+	"github.com/distribution/distribution/v3/configuration"
+	"github.com/sirupsen/logrus"
+	hookstest "github.com/sirupsen/logrus/hooks/test"
+)
+
+func TestRepositoryLogLevels(t *testing.T) {
+	level := logrus.GetLevel()
+	logrus.SetLevel(logrus.InfoLevel)
+	defer logrus.SetLevel(level)
+
+	config := configuration.Configuration{
+		Storage: configuration.Storage{
+			"inmemory": configuration.Parameters{},
+			"maintenance": configuration.Parameters{"uploadpurging": map[any]any{
+				"enabled": false,
+			}},
+		},
+		Log: configuration.Log{
+			Repositories: map[string]configuration.Loglevel{
+				"debug/*":     "debug",
+				"debug/quiet": "error",
+			},
+		},
+	}
+	config.HTTP.Headers = headerConfig
+	env := newTestEnvWithConfig(t, &config)
+	defer env.Shutdown()
+
+	hook := hookstest.NewGlobal()
+	defer hook.Reset()
+
+	// debugLogs returns the debug logs of the requests for the repository,
+	// and whether any was written by the storage driver.
+	debugLogs := func(name string) (int, bool) {
+		t.Helper()
+		hook.Reset()
+		createRepository(env, t, name, "latest")
+		n, driver := 0, false
+		for _, entry := range hook.AllEntries() {
+			if entry.Level != logrus.DebugLevel || entry.Data["vars.name"] != name {
+				continue
+			}
+			n++
+			driver = driver || entry.Data["trace.func"] != nil
+		}
+		return n, driver
+	}
+
+	if n, driver := debugLogs("debug/app"); n == 0 || !driver {
+		t.Fatalf("expected the debug logs of the requests and the storage driver for debug/app, got %d, from the driver: %v", n, driver)
+	}
+	if n, _ := debugLogs("other/app"); n != 0 {
+		t.Fatalf("unexpected %d debug logs for other/app, logged at the global level", n)
+	}
+	// The most verbose level of the matching patterns applies.
+	if n, _ := debugLogs("debug/quiet"); n == 0 {
+		t.Fatal("expected the debug logs of the requests for debug/quiet")
+	}
+
+	// The overrides are replaced on reload.
+	if err := env.app.ReloadLogLevels(configuration.Log{Repositories: map[string]configuration.Loglevel{"other/*": "debug"}}); err != nil {
+		t.Fatal(err)
+	}
+	if n, _ := debugLogs("other/app"); n == 0 {
+		t.Fatal("expected the debug logs of the requests for other/app after the reload")
+	}
+	if n, _ := debugLogs("debug/app"); n != 0 {
+		t.Fatalf("unexpected %d debug logs for debug/app after the reload", n)
+	}
+}
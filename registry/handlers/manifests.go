@@ -2,6 +2,9 @@ package handlers
 
 import (
 	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
 	"fmt"
 	"mime"
 	"net/http"
@@ -10,10 +13,13 @@ import (
 	"sync"
 
 	"github.com/distribution/distribution/v3"
+	"github.com/distribution/distribution/v3/configuration"
 	"github.com/distribution/distribution/v3/internal/dcontext"
 	"github.com/distribution/distribution/v3/manifest/manifestlist"
 	"github.com/distribution/distribution/v3/manifest/ocischema"
+	"github.com/distribution/distribution/v3/manifest/schema1"
 	"github.com/distribution/distribution/v3/manifest/schema2"
+	"github.com/distribution/distribution/v3/notifications"
 	"github.com/distribution/distribution/v3/registry/api/errcode"
 	"github.com/distribution/distribution/v3/registry/storage"
 	"github.com/distribution/distribution/v3/registry/storage/driver"
@@ -25,10 +31,9 @@ import (
 )
 
 const (
-	defaultArch         = "amd64"
-	defaultOS           = "linux"
-	maxManifestBodySize = 4 * 1024 * 1024
-	imageClass          = "image"
+	defaultArch = "amd64"
+	defaultOS   = "linux"
+	imageClass  = "image"
 )
 
 type storageType int
@@ -56,17 +61,12 @@ func manifestDispatcher(ctx *Context, r *http.Request) http.Handler {
 		manifestHandler.Digest = dgst
 	}
 
-	mhandler := handlers.MethodHandler{
-		http.MethodGet:  http.HandlerFunc(manifestHandler.GetManifest),
-		http.MethodHead: http.HandlerFunc(manifestHandler.GetManifest),
+	return handlers.MethodHandler{
+		http.MethodGet:    http.HandlerFunc(manifestHandler.GetManifest),
+		http.MethodHead:   http.HandlerFunc(manifestHandler.GetManifest),
+		http.MethodPut:    http.HandlerFunc(manifestHandler.PutManifest),
+		http.MethodDelete: http.HandlerFunc(manifestHandler.DeleteManifest),
 	}
-
-	if !ctx.readOnly {
-		mhandler[http.MethodPut] = http.HandlerFunc(manifestHandler.PutManifest)
-		mhandler[http.MethodDelete] = http.HandlerFunc(manifestHandler.DeleteManifest)
-	}
-
-	return mhandler
 }
 
 // manifestHandler handles http operations on image manifests.
@@ -130,7 +130,9 @@ func (imh *manifestHandler) GetManifest(w http.ResponseWriter, r *http.Request)
 		imh.Digest = desc.Digest
 	}
 
-	if etagMatch(r, imh.Digest.String()) {
+	if etagMatch(r, "If-None-Match", imh.Digest, true) {
+		w.Header().Set("Docker-Content-Digest", imh.Digest.String())
+		w.Header().Set("Etag", fmt.Sprintf(`"%s"`, imh.Digest))
 		w.WriteHeader(http.StatusNotModified)
 		return
 	}
@@ -141,9 +143,14 @@ func (imh *manifestHandler) GetManifest(w http.ResponseWriter, r *http.Request)
 	}
 	manifest, err := manifests.Get(imh, imh.Digest, options...)
 	if err != nil {
-		if _, ok := err.(distribution.ErrManifestUnknownRevision); ok {
+		switch err.(type) {
+		case distribution.ErrManifestUnknownRevision:
 			imh.Errors = append(imh.Errors, errcode.ErrorCodeManifestUnknown.WithDetail(err))
-		} else {
+		case distribution.ErrManifestTooLarge, distribution.ErrManifestVerification:
+			imh.Errors = append(imh.Errors, errcode.ErrorCodeManifestInvalid.WithDetail(err.Error()))
+		case distribution.ErrManifestSignatureInvalid:
+			imh.Errors = append(imh.Errors, errcode.ErrorCodeManifestSignatureInvalid.WithDetail(err.Error()))
+		default:
 			imh.Errors = append(imh.Errors, errcode.ErrorCodeUnknown.WithDetail(err))
 		}
 		return
@@ -192,9 +199,14 @@ func (imh *manifestHandler) GetManifest(w http.ResponseWriter, r *http.Request)
 
 		manifest, err = manifests.Get(imh, manifestDigest)
 		if err != nil {
-			if _, ok := err.(distribution.ErrManifestUnknownRevision); ok {
+			switch err.(type) {
+			case distribution.ErrManifestUnknownRevision:
 				imh.Errors = append(imh.Errors, errcode.ErrorCodeManifestUnknown.WithDetail(err))
-			} else {
+			case distribution.ErrManifestTooLarge, distribution.ErrManifestVerification:
+				imh.Errors = append(imh.Errors, errcode.ErrorCodeManifestInvalid.WithDetail(err.Error()))
+			case distribution.ErrManifestSignatureInvalid:
+				imh.Errors = append(imh.Errors, errcode.ErrorCodeManifestSignatureInvalid.WithDetail(err.Error()))
+			default:
 				imh.Errors = append(imh.Errors, errcode.ErrorCodeUnknown.WithDetail(err))
 			}
 			return
@@ -213,6 +225,12 @@ func (imh *manifestHandler) GetManifest(w http.ResponseWriter, r *http.Request)
 		return
 	}
 
+	// A pull through cache serves the schema1 manifests it fetches from
+	// upstream as the schema2 manifests converted from them.
+	if imh.App.isCache && imh.Digest.Algorithm().FromBytes(p) != imh.Digest {
+		imh.Digest = digest.FromBytes(p)
+	}
+
 	w.Header().Set("Content-Type", ct)
 	w.Header().Set("Content-Length", fmt.Sprint(len(p)))
 	w.Header().Set("Docker-Content-Digest", imh.Digest.String())
@@ -225,18 +243,54 @@ func (imh *manifestHandler) GetManifest(w http.ResponseWriter, r *http.Request)
 
 	if _, err := w.Write(p); err != nil {
 		w.WriteHeader(http.StatusInternalServerError)
+		return
 	}
+	imh.App.countPull(imh.Repository.Named().Name(), getReference(imh))
+	imh.App.recordPull(imh, imh.Repository.Named().Name(), imh.Tag)
 }
 
-func etagMatch(r *http.Request, etag string) bool {
-	for _, headerVal := range r.Header["If-None-Match"] {
-		if headerVal == etag || headerVal == fmt.Sprintf(`"%s"`, etag) { // allow quoted or unquoted
-			return true
+// etagMatch reports whether one of the entity tags listed by the header of the
+// request, which is If-None-Match or If-Match, matches the digest. Weak entity
+// tags only match with the weak comparison used by If-None-Match.
+func etagMatch(r *http.Request, header string, dgst digest.Digest, weak bool) bool {
+	for _, headerVal := range r.Header.Values(header) {
+		for etag := range strings.SplitSeq(headerVal, ",") {
+			etag = strings.TrimSpace(etag)
+			if etag == "*" {
+				return true
+			}
+			if strings.HasPrefix(etag, "W/") {
+				if !weak {
+					continue
+				}
+				etag = etag[len("W/"):]
+			}
+			if etag == dgst.String() || etag == fmt.Sprintf(`"%s"`, dgst) { // allow quoted or unquoted
+				return true
+			}
 		}
 	}
 	return false
 }
 
+// preconditionFailed reports whether the request has an If-Match header, none
+// of whose entity tags matches the digest.
+func preconditionFailed(r *http.Request, dgst digest.Digest) bool {
+	return len(r.Header.Values("If-Match")) > 0 && !etagMatch(r, "If-Match", dgst, false)
+}
+
+// writeManifestTooLarge rejects a manifest over the size limit of the
+// registry with a MANIFEST_INVALID error. It is written as 413 Request Entity
+// Too Large rather than the 400 Bad Request of the error code.
+func writeManifestTooLarge(ctx context.Context, w http.ResponseWriter, limit int64) {
+	err := errcode.ErrorCodeManifestInvalid.WithDetail(distribution.ErrManifestTooLarge{Limit: limit}.Error())
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusRequestEntityTooLarge)
+	if err := json.NewEncoder(w).Encode(errcode.Errors{err}); err != nil {
+		dcontext.GetLogger(ctx).Errorf("error serving error json: %v", err)
+	}
+}
+
 // PutManifest validates and stores a manifest in the registry.
 func (imh *manifestHandler) PutManifest(w http.ResponseWriter, r *http.Request) {
 	dcontext.GetLogger(imh).Debug("PutImageManifest")
@@ -246,8 +300,21 @@ func (imh *manifestHandler) PutManifest(w http.ResponseWriter, r *http.Request)
 		return
 	}
 
+	// Refuse a manifest over the size limit before reading it if its length
+	// is known, and stop reading it once over the limit otherwise.
+	maxSize := imh.App.Config.Validation.Manifests.MaxSizeBytes()
+	if maxSize > 0 && r.ContentLength > maxSize {
+		writeManifestTooLarge(imh, w, maxSize)
+		return
+	}
+
 	var jsonBuf bytes.Buffer
-	if err := copyFullPayload(imh, w, r, &jsonBuf, maxManifestBodySize, "image manifest PUT"); err != nil {
+	if _, err := copyFullPayload(imh, w, r, &jsonBuf, maxSize, "image manifest PUT"); err != nil {
+		var maxBytesErr *http.MaxBytesError
+		if errors.As(err, &maxBytesErr) {
+			writeManifestTooLarge(imh, w, maxSize)
+			return
+		}
 		// copyFullPayload reports the error if necessary
 		imh.Errors = append(imh.Errors, errcode.ErrorCodeManifestInvalid.WithDetail(err.Error()))
 		return
@@ -260,6 +327,13 @@ func (imh *manifestHandler) PutManifest(w http.ResponseWriter, r *http.Request)
 		return
 	}
 
+	if m, ok := manifest.(*schema1.DeserializedManifest); ok {
+		if manifest, desc, err = imh.applySchema1Policy(m); err != nil {
+			imh.Errors = append(imh.Errors, err)
+			return
+		}
+	}
+
 	if imh.Digest != "" {
 		if desc.Digest != imh.Digest {
 			dcontext.GetLogger(imh).Errorf("payload digest does not match: %q != %q", desc.Digest, imh.Digest)
@@ -291,6 +365,17 @@ func (imh *manifestHandler) PutManifest(w http.ResponseWriter, r *http.Request)
 		return
 	}
 
+	if imh.Tag != "" {
+		if err := imh.App.immutableTags.checkPush(imh, imh.Repository, imh.Tag, desc.Digest); err != nil {
+			imh.Errors = append(imh.Errors, err)
+			return
+		}
+	}
+
+	if imh.App.Config.Notifications.IncludeAnnotations {
+		options = append(options, imh.manifestAnnotations(manifest))
+	}
+
 	_, err = manifests.Put(imh, manifest, options...)
 	if err != nil {
 		// TODO(stevvooe): These error handling switches really need to be
@@ -308,9 +393,22 @@ func (imh *manifestHandler) PutManifest(w http.ResponseWriter, r *http.Request)
 			for _, verificationError := range err {
 				switch verificationError := verificationError.(type) {
 				case distribution.ErrManifestBlobUnknown:
-					imh.Errors = append(imh.Errors, errcode.ErrorCodeManifestBlobUnknown.WithDetail(verificationError.Digest))
+					if verificationError.Field == "" {
+						imh.Errors = append(imh.Errors, errcode.ErrorCodeManifestBlobUnknown.WithDetail(verificationError.Digest))
+						break
+					}
+					imh.Errors = append(imh.Errors, errcode.ErrorCodeManifestBlobUnknown.WithDetail(map[string]string{
+						"digest":    verificationError.Digest.String(),
+						"field":     verificationError.Field,
+						"mediaType": verificationError.MediaType,
+					}))
 				case distribution.ErrManifestNameInvalid:
 					imh.Errors = append(imh.Errors, errcode.ErrorCodeNameInvalid.WithDetail(err))
+				case distribution.ErrManifestFieldInvalid:
+					imh.Errors = append(imh.Errors, errcode.ErrorCodeManifestInvalid.WithDetail(map[string]string{
+						"field":  verificationError.Field,
+						"reason": verificationError.Reason.Error(),
+					}))
 				case distribution.ErrManifestUnverified:
 					imh.Errors = append(imh.Errors, errcode.ErrorCodeManifestUnverified)
 				default:
@@ -339,6 +437,7 @@ func (imh *manifestHandler) PutManifest(w http.ResponseWriter, r *http.Request)
 		}
 
 	}
+	imh.App.recordPush(imh, imh.Repository.Named().Name(), imh.Tag)
 
 	// Construct a canonical url for the uploaded manifest.
 	ref, err := reference.WithDigest(imh.Repository.Named(), imh.Digest)
@@ -357,6 +456,18 @@ func (imh *manifestHandler) PutManifest(w http.ResponseWriter, r *http.Request)
 
 	w.Header().Set("Location", location)
 	w.Header().Set("Docker-Content-Digest", imh.Digest.String())
+	// The subject tells the client that the manifest is listed among the
+	// referrers of its subject, so that it does not tag it as a fallback.
+	var subject *v1.Descriptor
+	switch m := manifest.(type) {
+	case *ocischema.DeserializedManifest:
+		subject = m.Subject
+	case *ocischema.DeserializedImageIndex:
+		subject = m.Subject
+	}
+	if subject != nil {
+		w.Header().Set("OCI-Subject", subject.Digest.String())
+	}
 	w.WriteHeader(http.StatusCreated)
 
 	dcontext.GetLogger(imh).Debug("Succeeded in putting manifest!")
@@ -427,6 +538,110 @@ func (imh *manifestHandler) applyResourcePolicy(manifest distribution.Manifest)
 	return nil
 }
 
+// maxLabelsConfigSize is the maximum size of an image configuration read for
+// its labels.
+const maxLabelsConfigSize = 1 << 20
+
+// applySchema1Policy applies the schema1 policy of the registry to a schema1
+// manifest pushed, returning the schema2 manifest converted from it to store
+// in its place, or the error refusing it. The image configuration of the
+// schema2 manifest is stored in the repository with the conversion.
+func (imh *manifestHandler) applySchema1Policy(m *schema1.DeserializedManifest) (distribution.Manifest, v1.Descriptor, error) {
+	mediaType, _, _ := m.Payload()
+	switch imh.App.Config.Validation.Manifests.Schema1 {
+	case configuration.Schema1Reject:
+		return nil, v1.Descriptor{}, errcode.ErrorCodeManifestInvalid.WithMessage(schema1.RejectedError{MediaType: mediaType}.Error())
+	case configuration.Schema1Convert:
+	default:
+		// The registry does not store schema1 manifests.
+		return nil, v1.Descriptor{}, errcode.ErrorCodeManifestInvalid.WithDetail(fmt.Errorf("unsupported manifest media type and no default available: %s", mediaType))
+	}
+
+	// The manifest stored does not have the digest it was pushed by.
+	if imh.Digest != "" {
+		return nil, v1.Descriptor{}, errcode.ErrorCodeManifestInvalid.WithMessage("schema1 manifests are only converted to schema2 manifests when pushed by tag")
+	}
+	blobs := imh.Repository.Blobs(imh)
+	converted, config, err := schema1.Convert(imh, m, blobs)
+	if err != nil {
+		var unknown distribution.ErrManifestBlobUnknown
+		if errors.As(err, &unknown) {
+			return nil, v1.Descriptor{}, errcode.ErrorCodeManifestBlobUnknown.WithDetail(unknown.Digest)
+		}
+		return nil, v1.Descriptor{}, errcode.ErrorCodeManifestInvalid.WithDetail(err.Error())
+	}
+	if _, err := blobs.Put(imh, schema2.MediaTypeImageConfig, config); err != nil {
+		return nil, v1.Descriptor{}, errcode.ErrorCodeUnknown.WithDetail(err)
+	}
+	_, payload, err := converted.Payload()
+	if err != nil {
+		return nil, v1.Descriptor{}, errcode.ErrorCodeUnknown.WithDetail(err)
+	}
+	desc := v1.Descriptor{
+		MediaType: schema2.MediaTypeManifest,
+		Digest:    digest.FromBytes(payload),
+		Size:      int64(len(payload)),
+	}
+	dcontext.GetLogger(imh).Infof("converted the schema1 manifest pushed for tag %s to schema2 manifest %s", imh.Tag, desc.Digest)
+	return converted, desc, nil
+}
+
+// manifestAnnotations returns an option passing the annotations of the
+// manifest, or of the index, and the labels of its image configuration to
+// the listeners of its push. They are left out if over the size limit of the
+// notifications.
+func (imh *manifestHandler) manifestAnnotations(manifest distribution.Manifest) distribution.ManifestServiceOption {
+	var annotations, labels map[string]string
+	switch m := manifest.(type) {
+	case *ocischema.DeserializedManifest:
+		annotations = m.Annotations
+		labels = imh.configLabels(m.Config)
+	case *ocischema.DeserializedImageIndex:
+		annotations = m.Annotations
+	case *schema2.DeserializedManifest:
+		labels = imh.configLabels(m.Config)
+	}
+
+	limit := imh.App.Config.Notifications.MaxAnnotationsSize
+	if limit <= 0 {
+		limit = configuration.DefaultMaxAnnotationsSize
+	}
+	if size := annotationsSize(annotations) + annotationsSize(labels); size > limit {
+		dcontext.GetLogger(imh).Warnf("leaving %d bytes of annotations and labels out of the push event, over the limit of %d bytes", size, limit)
+		return notifications.WithAnnotations(nil, nil)
+	}
+	return notifications.WithAnnotations(annotations, labels)
+}
+
+// configLabels returns the labels of the image configuration, if the
+// descriptor is one.
+func (imh *manifestHandler) configLabels(desc v1.Descriptor) map[string]string {
+	if (desc.MediaType != v1.MediaTypeImageConfig && desc.MediaType != schema2.MediaTypeImageConfig) || desc.Size > maxLabelsConfigSize {
+		return nil
+	}
+	p, err := imh.Repository.Blobs(imh).Get(imh, desc.Digest)
+	if err != nil {
+		// The manifest push verifies that the configuration exists.
+		dcontext.GetLogger(imh).Debugf("error reading image configuration %s: %v", desc.Digest, err)
+		return nil
+	}
+	var config v1.Image
+	if err := json.Unmarshal(p, &config); err != nil {
+		dcontext.GetLogger(imh).Warnf("error decoding image configuration %s: %v", desc.Digest, err)
+		return nil
+	}
+	return config.Config.Labels
+}
+
+// annotationsSize returns the size of the keys and values of the annotations.
+func annotationsSize(annotations map[string]string) int {
+	var size int
+	for k, v := range annotations {
+		size += len(k) + len(v)
+	}
+	return size
+}
+
 // DeleteManifest removes the manifest with the given digest or the tag with the given name from the registry.
 func (imh *manifestHandler) DeleteManifest(w http.ResponseWriter, r *http.Request) {
 	dcontext.GetLogger(imh).Debug("DeleteImageManifest")
@@ -438,7 +653,27 @@ func (imh *manifestHandler) DeleteManifest(w http.ResponseWriter, r *http.Reques
 
 	if imh.Tag != "" {
 		dcontext.GetLogger(imh).Debug("DeleteImageTag")
+		if err := imh.App.immutableTags.checkDelete(imh.Repository.Named().Name(), imh.Tag); err != nil {
+			imh.Errors = append(imh.Errors, err)
+			return
+		}
 		tagService := imh.Repository.Tags(imh.Context)
+		if len(r.Header.Values("If-Match")) > 0 {
+			desc, err := tagService.Get(imh.Context, imh.Tag)
+			if err != nil {
+				switch err.(type) {
+				case distribution.ErrTagUnknown:
+					imh.Errors = append(imh.Errors, errcode.ErrorCodeManifestUnknown.WithDetail(err))
+				default:
+					imh.Errors = append(imh.Errors, errcode.ErrorCodeUnknown.WithDetail(err))
+				}
+				return
+			}
+			if preconditionFailed(r, desc.Digest) {
+				w.WriteHeader(http.StatusPreconditionFailed)
+				return
+			}
+		}
 		if err := tagService.Untag(imh.Context, imh.Tag); err != nil {
 			switch err.(type) {
 			case distribution.ErrTagUnknown, driver.PathNotFoundError:
@@ -452,13 +687,34 @@ func (imh *manifestHandler) DeleteManifest(w http.ResponseWriter, r *http.Reques
 		return
 	}
 
+	if preconditionFailed(r, imh.Digest) {
+		w.WriteHeader(http.StatusPreconditionFailed)
+		return
+	}
+
+	if err := imh.App.immutableTags.checkManifestDelete(imh, imh.Repository, imh.Digest); err != nil {
+		imh.Errors = append(imh.Errors, err)
+		return
+	}
+
 	manifests, err := imh.Repository.Manifests(imh)
 	if err != nil {
 		imh.Errors = append(imh.Errors, err)
 		return
 	}
 
-	err = manifests.Delete(imh, imh.Digest)
+	// The tags are looked up before the manifest is deleted, so that they
+	// are reported with its deletion.
+	tagService := imh.Repository.Tags(imh)
+	referencedTags, err := tagService.Lookup(imh, v1.Descriptor{Digest: imh.Digest})
+	if err != nil {
+		imh.Errors = append(imh.Errors, err)
+		return
+	}
+	slices.Sort(referencedTags)
+	ctx := notifications.WithDeletedTags(imh, referencedTags)
+
+	err = manifests.Delete(ctx, imh.Digest)
 	if err != nil {
 		switch err {
 		case digest.ErrDigestUnsupported:
@@ -477,13 +733,6 @@ func (imh *manifestHandler) DeleteManifest(w http.ResponseWriter, r *http.Reques
 		}
 	}
 
-	tagService := imh.Repository.Tags(imh)
-	referencedTags, err := tagService.Lookup(imh, v1.Descriptor{Digest: imh.Digest})
-	if err != nil {
-		imh.Errors = append(imh.Errors, err)
-		return
-	}
-
 	var (
 		errs []error
 		mu   sync.Mutex
@@ -493,7 +742,7 @@ func (imh *manifestHandler) DeleteManifest(w http.ResponseWriter, r *http.Reques
 	for _, tag := range referencedTags {
 
 		g.Go(func() error {
-			if err := tagService.Untag(imh, tag); err != nil {
+			if err := tagService.Untag(ctx, tag); err != nil {
 				mu.Lock()
 				errs = append(errs, err)
 				mu.Unlock()
@@ -0,0 +1,193 @@
+package handlers
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"net/netip"
+	"slices"
+	"strings"
+
+	"github.com/distribution/distribution/v3/configuration"
+	"github.com/distribution/distribution/v3/internal/dcontext"
+	prometheus "github.com/distribution/distribution/v3/metrics"
+	"github.com/distribution/distribution/v3/registry/api/errcode"
+	"github.com/distribution/distribution/v3/registry/auth"
+	"github.com/docker/go-metrics"
+)
+
+// networkDenials is the number of requests denied by the network policy.
+var networkDenials = prometheus.AccessNamespace.NewLabeledCounter("network_denials", "The number of requests denied by the network policy", "action")
+
+func init() {
+	metrics.Register(prometheus.AccessNamespace)
+}
+
+// networkPolicy restricts the actions on repositories to client addresses.
+type networkPolicy struct {
+	trustedProxies []netip.Prefix
+	rules          []networkRule
+}
+
+type networkRule struct {
+	actions []string
+	allow   []netip.Prefix
+	deny    []netip.Prefix
+}
+
+func newNetworkPolicy(config configuration.NetworkPolicy) (*networkPolicy, error) {
+	trustedProxies, err := parsePrefixes(config.TrustedProxies)
+	if err != nil {
+		return nil, fmt.Errorf("policy.network.trustedproxies: %v", err)
+	}
+	policy := &networkPolicy{trustedProxies: trustedProxies}
+	for i, rule := range config.Rules {
+		if len(rule.Actions) == 0 {
+			return nil, fmt.Errorf("policy.network.rules[%d]: no actions", i)
+		}
+		allow, err := parsePrefixes(rule.Allow)
+		if err != nil {
+			return nil, fmt.Errorf("policy.network.rules[%d].allow: %v", i, err)
+		}
+		deny, err := parsePrefixes(rule.Deny)
+		if err != nil {
+			return nil, fmt.Errorf("policy.network.rules[%d].deny: %v", i, err)
+		}
+		policy.rules = append(policy.rules, networkRule{actions: rule.Actions, allow: allow, deny: deny})
+	}
+	return policy, nil
+}
+
+// parsePrefixes parses CIDRs, or single addresses.
+func parsePrefixes(cidrs []string) ([]netip.Prefix, error) {
+	prefixes := make([]netip.Prefix, 0, len(cidrs))
+	for _, cidr := range cidrs {
+		if !strings.Contains(cidr, "/") {
+			addr, err := netip.ParseAddr(cidr)
+			if err != nil {
+				return nil, err
+			}
+			addr = addr.Unmap()
+			prefixes = append(prefixes, netip.PrefixFrom(addr, addr.BitLen()))
+			continue
+		}
+		prefix, err := netip.ParsePrefix(cidr)
+		if err != nil {
+			return nil, err
+		}
+		if prefix.Addr().Is4In6() && prefix.Bits() >= 96 {
+			prefix = netip.PrefixFrom(prefix.Addr().Unmap(), prefix.Bits()-96)
+		}
+		prefixes = append(prefixes, prefix.Masked())
+	}
+	return prefixes, nil
+}
+
+func containsAddr(prefixes []netip.Prefix, addr netip.Addr) bool {
+	for _, prefix := range prefixes {
+		if prefix.Contains(addr) {
+			return true
+		}
+	}
+	return false
+}
+
+// parseAddr parses an address with or without a port, such as the remote
+// address of a request or an entry of X-Forwarded-For.
+func parseAddr(s string) (netip.Addr, bool) {
+	s = strings.TrimSpace(s)
+	if host, _, err := net.SplitHostPort(s); err == nil {
+		s = host
+	}
+	addr, err := netip.ParseAddr(strings.Trim(s, "[]"))
+	if err != nil {
+		return netip.Addr{}, false
+	}
+	return addr.WithZone("").Unmap(), true
+}
+
+// clientAddr returns the address of the client of the request.
+func (p *networkPolicy) clientAddr(r *http.Request) (netip.Addr, bool) {
+	return clientAddr(r, p.trustedProxies)
+}
+
+// clientAddr returns the address of the client of the request. The
+// X-Forwarded-For header is followed from the proxy closest to the registry,
+// as long as the hops are trusted proxies: the first hop which is not is the
+// client.
+func clientAddr(r *http.Request, trustedProxies []netip.Prefix) (netip.Addr, bool) {
+	addr, ok := parseAddr(r.RemoteAddr)
+	if !ok {
+		return netip.Addr{}, false
+	}
+
+	var hops []string
+	for _, header := range r.Header.Values("X-Forwarded-For") {
+		hops = append(hops, strings.Split(header, ",")...)
+	}
+	for i := len(hops) - 1; i >= 0 && containsAddr(trustedProxies, addr); i-- {
+		hop, ok := parseAddr(hops[i])
+		if !ok {
+			// The chain is broken: the trusted proxy is the client.
+			break
+		}
+		addr = hop
+	}
+	return addr, true
+}
+
+// allowed returns whether the action is allowed from the address.
+func (p *networkPolicy) allowed(addr netip.Addr, action string) bool {
+	restricted, allowed := false, false
+	for _, rule := range p.rules {
+		if !slices.Contains(rule.actions, action) && !slices.Contains(rule.actions, "*") {
+			continue
+		}
+		if containsAddr(rule.deny, addr) {
+			return false
+		}
+		if len(rule.allow) > 0 {
+			restricted = true
+			allowed = allowed || containsAddr(rule.allow, addr)
+		}
+	}
+	return !restricted || allowed
+}
+
+// checkNetworkPolicy denies the request with a 403 if the network policy does
+// not allow its actions on repositories from the client address.
+func (app *App) checkNetworkPolicy(w http.ResponseWriter, r *http.Request, context *Context) error {
+	if app.networkPolicy == nil {
+		return nil
+	}
+	repo := getName(context)
+	if repo == "" {
+		return nil
+	}
+
+	accessRecords := appendAccessRecords(nil, r.Method, repo)
+	if fromRepo := r.FormValue("from"); fromRepo != "" {
+		accessRecords = appendAccessRecords(accessRecords, http.MethodGet, fromRepo)
+	}
+
+	addr, ok := app.networkPolicy.clientAddr(r)
+	for _, access := range accessRecords {
+		if ok && app.networkPolicy.allowed(addr, access.Action) {
+			continue
+		}
+		networkDenials.WithValues(access.Action).Inc()
+		if err := errcode.ServeJSON(w, errcode.ErrorCodeAddressDenied.WithDetail(deniedAccess(access, addr))); err != nil {
+			dcontext.GetLogger(context).Errorf("error serving error json: %v (from %v)", err, context.Errors)
+		}
+		return fmt.Errorf("network policy denies %s on %s from %s", access.Action, access.Name, addr)
+	}
+	return nil
+}
+
+func deniedAccess(access auth.Access, addr netip.Addr) map[string]string {
+	detail := map[string]string{"name": access.Name, "action": access.Action}
+	if addr.IsValid() {
+		detail["address"] = addr.String()
+	}
+	return detail
+}
@@ -0,0 +1,158 @@
+package handlers
+
+import (
+	"encoding/json"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/distribution/distribution/v3/registry/api/errcode"
+	"github.com/distribution/distribution/v3/registry/proxy/scheduler"
+	"github.com/distribution/reference"
+	"github.com/gorilla/handlers"
+)
+
+// proxyExpirer lists the entries of a pull through cache scheduled to expire.
+type proxyExpirer interface {
+	Expirations(before time.Time) []scheduler.Expiration
+}
+
+// proxyExpirationsDispatcher constructs the handler of the expirations of the
+// pull through cache, served as part of the admin API.
+func proxyExpirationsDispatcher(ctx *Context, r *http.Request) http.Handler {
+	ctx.App.authMu.RLock()
+	authenticated := ctx.App.accessController != nil
+	ctx.App.authMu.RUnlock()
+	if !authenticated {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			ctx.Errors = append(ctx.Errors, errcode.ErrorCodeUnsupported.WithMessage("the admin API requires authentication to be configured"))
+		})
+	}
+	expirer, ok := ctx.App.registry.(proxyExpirer)
+	if !ok {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			ctx.Errors = append(ctx.Errors, errcode.ErrorCodeUnsupported.WithMessage("the registry is not a pull through cache"))
+		})
+	}
+
+	proxyExpirationsHandler := &proxyExpirationsHandler{
+		Context: ctx,
+		expirer: expirer,
+	}
+
+	return handlers.MethodHandler{
+		http.MethodGet: http.HandlerFunc(proxyExpirationsHandler.GetProxyExpirations),
+	}
+}
+
+// proxyExpirationsHandler handles the requests for the entries of the pull
+// through cache scheduled to expire.
+type proxyExpirationsHandler struct {
+	*Context
+	expirer proxyExpirer
+}
+
+type proxyExpirationsAPIResponse struct {
+	Expirations []proxyExpiration `json:"expirations"`
+}
+
+// proxyExpiration is a blob or a manifest scheduled to expire from the cache.
+type proxyExpiration struct {
+	Repository string    `json:"repository"`
+	Reference  string    `json:"reference"`
+	Type       string    `json:"type"`
+	Expiry     time.Time `json:"expiry"`
+}
+
+// GetProxyExpirations returns a json list of the entries scheduled to expire
+// within the requested duration, soonest first. Entries are paginated by the
+// repository and the reference of the last entry returned.
+func (ph *proxyExpirationsHandler) GetProxyExpirations(w http.ResponseWriter, r *http.Request) {
+	q := r.URL.Query()
+	lastEntry := q.Get("last")
+
+	// All the entries scheduled to expire are listed without a window.
+	var before time.Time
+	if within := q.Get("within"); within != "" {
+		d, err := time.ParseDuration(within)
+		if err != nil || d < 0 {
+			ph.Errors = append(ph.Errors, errcode.ErrorCodeAdminRequestInvalid.WithDetail(map[string]string{"within": within}))
+			return
+		}
+		before = time.Now().Add(d)
+	}
+
+	repository := q.Get("repository")
+	if repository != "" {
+		if _, err := reference.WithName(repository); err != nil {
+			ph.Errors = append(ph.Errors, errcode.ErrorCodeAdminRequestInvalid.WithDetail(map[string]string{"repository": repository}))
+			return
+		}
+	}
+
+	limit := -1
+	if n := q.Get("n"); n != "" {
+		parsedMax, err := strconv.Atoi(n)
+		if err != nil || parsedMax < 0 {
+			ph.Errors = append(ph.Errors, errcode.ErrorCodePaginationNumberInvalid.WithDetail(map[string]string{"n": n}))
+			return
+		}
+		limit = parsedMax
+	}
+
+	entries := make([]proxyExpiration, 0)
+	for _, expiration := range ph.expirer.Expirations(before) {
+		if repository != "" && expiration.Repository != repository {
+			continue
+		}
+		entries = append(entries, proxyExpiration{
+			Repository: expiration.Repository,
+			Reference:  expiration.Reference,
+			Type:       expiration.Type,
+			Expiry:     expiration.Expiry.UTC(),
+		})
+	}
+
+	// Resume after the last entry returned. An entry no longer scheduled
+	// ends the listing.
+	if lastEntry != "" {
+		start := len(entries)
+		for i, entry := range entries {
+			if entry.key() == lastEntry {
+				start = i + 1
+				break
+			}
+		}
+		entries = entries[start:]
+	}
+
+	moreEntries := false
+	if limit >= 0 && len(entries) > limit {
+		entries = entries[:limit]
+		moreEntries = limit > 0
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+
+	if moreEntries {
+		urlStr, err := createLinkEntry(r.URL.String(), limit, entries[len(entries)-1].key())
+		if err != nil {
+			ph.Errors = append(ph.Errors, errcode.ErrorCodeUnknown.WithDetail(err))
+			return
+		}
+		w.Header().Set("Link", urlStr)
+	}
+
+	enc := json.NewEncoder(w)
+	if err := enc.Encode(proxyExpirationsAPIResponse{
+		Expirations: entries,
+	}); err != nil {
+		ph.Errors = append(ph.Errors, errcode.ErrorCodeUnknown.WithDetail(err))
+		return
+	}
+}
+
+// key identifies the entry in the pagination links.
+func (e proxyExpiration) key() string {
+	return e.Repository + "@" + e.Reference
+}
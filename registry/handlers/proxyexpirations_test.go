@@ -0,0 +1,184 @@
+package handlers
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/distribution/distribution/v3"
+	"github.com/distribution/distribution/v3/configuration"
+	"github.com/distribution/distribution/v3/internal/dcontext"
+	"github.com/distribution/distribution/v3/registry/api/errcode"
+	_ "github.com/distribution/distribution/v3/registry/auth/silly"
+	"github.com/distribution/distribution/v3/registry/proxy/scheduler"
+	"github.com/distribution/distribution/v3/registry/storage/driver/inmemory"
+	"github.com/distribution/reference"
+	"github.com/opencontainers/go-digest"
+)
+
+// schedulingRegistry is a registry whose entries are scheduled to expire by a
+// scheduler, like a pull through cache.
+type schedulingRegistry struct {
+	distribution.Namespace
+	*scheduler.TTLExpirationScheduler
+}
+
+func adminConfig() configuration.Configuration {
+	return configuration.Configuration{
+		Storage: configuration.Storage{
+			"inmemory": nil,
+			"maintenance": configuration.Parameters{
+				"uploadpurging": map[any]any{"enabled": false},
+			},
+		},
+		Auth: configuration.Auth{
+			"silly": {
+				"realm":   "realm-test",
+				"service": "service-test",
+			},
+		},
+	}
+}
+
+func TestProxyExpirations(t *testing.T) {
+	config := adminConfig()
+	app := NewApp(dcontext.Background(), &config)
+
+	s := scheduler.New(dcontext.Background(), inmemory.New(), "/scheduler-state.json")
+	s.OnBlobExpire(func(reference.Reference) error { return nil })
+	s.OnManifestExpire(func(reference.Reference) error { return nil })
+	if err := s.Start(); err != nil {
+		t.Fatal(err)
+	}
+	defer s.Stop()
+	app.registry = schedulingRegistry{Namespace: app.registry, TTLExpirationScheduler: s}
+
+	canonical := func(repo, content string) reference.Canonical {
+		named, err := reference.WithName(repo)
+		if err != nil {
+			t.Fatal(err)
+		}
+		ref, err := reference.WithDigest(named, digest.FromString(content))
+		if err != nil {
+			t.Fatal(err)
+		}
+		return ref
+	}
+	soon := canonical("library/alpine", "soon")
+	later := canonical("library/ubuntu", "later")
+	latest := canonical("library/alpine", "latest")
+	if err := s.AddManifest(soon, time.Hour); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.AddBlob(latest, 12*time.Hour); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.AddBlob(later, 6*time.Hour); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.AddBlob(canonical("library/ubuntu", "next week"), 7*24*time.Hour); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.AddBlobWithSize(canonical("library/ubuntu", "never"), 1, nil); err != nil {
+		t.Fatal(err)
+	}
+
+	serve := func(query string) *httptest.ResponseRecorder {
+		t.Helper()
+		r := httptest.NewRequest(http.MethodGet, "/v2/_proxy/expirations"+query, nil)
+		r.Header.Set("Authorization", "Bearer admin")
+		w := httptest.NewRecorder()
+		app.ServeHTTP(w, r)
+		return w
+	}
+	list := func(query string, expected ...reference.Canonical) *httptest.ResponseRecorder {
+		t.Helper()
+		w := serve(query)
+		if w.Code != http.StatusOK {
+			t.Fatalf("unexpected status %d for %q: %s", w.Code, query, w.Body)
+		}
+		var response proxyExpirationsAPIResponse
+		if err := json.NewDecoder(strings.NewReader(w.Body.String())).Decode(&response); err != nil {
+			t.Fatalf("error decoding expirations: %v", err)
+		}
+		if len(response.Expirations) != len(expected) {
+			t.Fatalf("expected %d expirations for %q, got %+v", len(expected), query, response.Expirations)
+		}
+		for i, ref := range expected {
+			e := response.Expirations[i]
+			if e.Repository != ref.Name() || e.Reference != ref.Digest().String() {
+				t.Fatalf("expiration %d for %q is %+v, expected %s", i, query, e, ref)
+			}
+		}
+		return w
+	}
+
+	// The entries due within the window are listed soonest first.
+	w := list("?within=24h", soon, later, latest)
+	var response proxyExpirationsAPIResponse
+	if err := json.NewDecoder(w.Body).Decode(&response); err != nil {
+		t.Fatal(err)
+	}
+	if e := response.Expirations[0]; e.Type != "manifest" || time.Until(e.Expiry) > time.Hour || time.Until(e.Expiry) < 59*time.Minute {
+		t.Fatalf("unexpected expiration %+v", e)
+	}
+	if response.Expirations[1].Type != "blob" {
+		t.Fatalf("unexpected expiration %+v", response.Expirations[1])
+	}
+	list("?within=2h", soon)
+	list("?within=0s")
+	list("", soon, later, latest, canonical("library/ubuntu", "next week"))
+	list("?within=24h&repository=library/alpine", soon, latest)
+
+	// The pagination links keep the filters.
+	w = list("?within=24h&n=2", soon, later)
+	link := w.Header().Get("Link")
+	expectedLink := fmt.Sprintf("</v2/_proxy/expirations?last=%s&n=2&within=24h>; rel=\"next\"", url.QueryEscape(later.String()))
+	if link != expectedLink {
+		t.Fatalf("unexpected link %q, expected %q", link, expectedLink)
+	}
+	if w := list("?within=24h&n=2&last="+later.String(), latest); w.Header().Get("Link") != "" {
+		t.Fatalf("unexpected link on the last page %q", w.Header().Get("Link"))
+	}
+
+	for _, query := range []string{"?within=tomorrow", "?within=-1h", "?repository=Invalid", "?n=-1"} {
+		if w := serve(query); w.Code != http.StatusBadRequest {
+			t.Fatalf("expected 400 for %q, got %d", query, w.Code)
+		}
+	}
+
+	// The route requires access to the admin resource.
+	r := httptest.NewRequest(http.MethodGet, "/v2/_proxy/expirations", nil)
+	w = httptest.NewRecorder()
+	app.ServeHTTP(w, r)
+	if w.Code != http.StatusUnauthorized {
+		t.Fatalf("expected 401 without authentication, got %d", w.Code)
+	}
+	if challenge := w.Header().Get("WWW-Authenticate"); !strings.Contains(challenge, `scope="registry:admin:*"`) {
+		t.Fatalf("unexpected challenge %q", challenge)
+	}
+}
+
+func TestProxyExpirationsNotCache(t *testing.T) {
+	config := adminConfig()
+	app := NewApp(dcontext.Background(), &config)
+	r := httptest.NewRequest(http.MethodGet, "/v2/_proxy/expirations", nil)
+	r.Header.Set("Authorization", "Bearer admin")
+	w := httptest.NewRecorder()
+	app.ServeHTTP(w, r)
+	if w.Code != http.StatusMethodNotAllowed {
+		t.Fatalf("expected 405, got %d", w.Code)
+	}
+	var errs errcode.Errors
+	if err := json.NewDecoder(w.Body).Decode(&errs); err != nil {
+		t.Fatalf("error decoding error response: %v", err)
+	}
+	if len(errs) != 1 || errs[0].(errcode.Error).Code != errcode.ErrorCodeUnsupported {
+		t.Fatalf("unexpected errors %v", errs)
+	}
+}
@@ -0,0 +1,108 @@
+package handlers
+
+import (
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"path"
+
+	"github.com/distribution/distribution/v3"
+	"github.com/distribution/distribution/v3/configuration"
+	"github.com/distribution/distribution/v3/internal/dcontext"
+	"github.com/distribution/distribution/v3/registry/api/errcode"
+	"github.com/distribution/distribution/v3/registry/proxy"
+	"github.com/distribution/reference"
+	"github.com/gorilla/handlers"
+)
+
+// maxMirrorRequestSize is the maximum size of the body of a request
+// mirroring a repository.
+const maxMirrorRequestSize = 64 << 10
+
+// proxyMirrorDispatcher constructs the handler of the mirror of the
+// repositories of the remotes of the pull through cache, served as part of
+// the admin API.
+func proxyMirrorDispatcher(ctx *Context, r *http.Request) http.Handler {
+	ctx.App.authMu.RLock()
+	authenticated := ctx.App.accessController != nil
+	ctx.App.authMu.RUnlock()
+	if !authenticated {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			ctx.Errors = append(ctx.Errors, errcode.ErrorCodeUnsupported.WithMessage("the admin API requires authentication to be configured"))
+		})
+	}
+	mirrorer, ok := ctx.App.registry.(proxy.Mirrorer)
+	if !ok {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			ctx.Errors = append(ctx.Errors, errcode.ErrorCodeUnsupported.WithMessage("the registry is not a pull through cache"))
+		})
+	}
+
+	proxyMirrorHandler := &proxyMirrorHandler{
+		Context:  ctx,
+		mirrorer: mirrorer,
+	}
+
+	return handlers.MethodHandler{
+		http.MethodPost: http.HandlerFunc(proxyMirrorHandler.PostProxyMirror),
+	}
+}
+
+// proxyMirrorHandler handles the requests mirroring the repositories of the
+// remotes of the pull through cache.
+type proxyMirrorHandler struct {
+	*Context
+	mirrorer proxy.Mirrorer
+}
+
+// proxyMirrorRequest is the body of a request mirroring a repository.
+type proxyMirrorRequest struct {
+	Repository string                   `json:"repository"`
+	TagPattern string                   `json:"tagPattern"`
+	Platforms  []configuration.Platform `json:"platforms"`
+}
+
+// PostProxyMirror pulls the tags of the repository of the request matching
+// its pattern through the cache, and responds with the report of the mirror
+// once done.
+func (ph *proxyMirrorHandler) PostProxyMirror(w http.ResponseWriter, r *http.Request) {
+	var request proxyMirrorRequest
+	if err := json.NewDecoder(io.LimitReader(r.Body, maxMirrorRequestSize)).Decode(&request); err != nil {
+		ph.Errors = append(ph.Errors, errcode.ErrorCodeAdminRequestInvalid.WithDetail(err.Error()))
+		return
+	}
+	name, err := reference.WithName(request.Repository)
+	if err != nil {
+		ph.Errors = append(ph.Errors, errcode.ErrorCodeNameInvalid.WithDetail(distribution.ErrRepositoryNameInvalid{Name: request.Repository, Reason: err}))
+		return
+	}
+	if _, err := path.Match(request.TagPattern, ""); err != nil {
+		ph.Errors = append(ph.Errors, errcode.ErrorCodeAdminRequestInvalid.WithDetail(map[string]string{"tagPattern": request.TagPattern}))
+		return
+	}
+
+	dcontext.GetLogger(ph).Infof("mirroring the tags of %s matching %q requested by %s", name.Name(), request.TagPattern, getUserName(ph, r))
+	report, err := ph.mirrorer.Mirror(ph, proxy.MirrorRequest{
+		Repository: name,
+		TagPattern: request.TagPattern,
+		Platforms:  request.Platforms,
+	})
+	if err != nil {
+		var unknown distribution.ErrRepositoryUnknown
+		switch {
+		case errors.As(err, &unknown):
+			ph.Errors = append(ph.Errors, errcode.ErrorCodeNameUnknown.WithDetail(unknown))
+		case errors.Is(err, distribution.ErrUnsupported):
+			ph.Errors = append(ph.Errors, errcode.ErrorCodeUnsupported.WithMessage(err.Error()))
+		default:
+			ph.Errors = append(ph.Errors, errcode.ErrorCodeUnavailable.WithDetail(err.Error()))
+		}
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(report); err != nil {
+		ph.Errors = append(ph.Errors, errcode.ErrorCodeUnknown.WithDetail(err))
+	}
+}
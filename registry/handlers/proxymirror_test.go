@@ -0,0 +1,114 @@
+package handlers
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/distribution/distribution/v3"
+	"github.com/distribution/distribution/v3/configuration"
+	"github.com/distribution/distribution/v3/internal/dcontext"
+	"github.com/distribution/distribution/v3/registry/api/errcode"
+	"github.com/distribution/distribution/v3/registry/proxy"
+)
+
+// mirroringRegistry is a registry mirroring the repositories of its remotes
+// like a pull through cache, recording the requests.
+type mirroringRegistry struct {
+	distribution.Namespace
+	requests []proxy.MirrorRequest
+	err      error
+}
+
+func (m *mirroringRegistry) Mirror(ctx context.Context, req proxy.MirrorRequest) (*proxy.MirrorReport, error) {
+	m.requests = append(m.requests, req)
+	if m.err != nil {
+		return nil, m.err
+	}
+	return &proxy.MirrorReport{
+		Repository: req.Repository.Name(),
+		Mirrored:   1,
+		Tags:       []proxy.MirroredTag{{Tag: "3.20", Status: "mirrored"}},
+	}, nil
+}
+
+func TestProxyMirror(t *testing.T) {
+	config := adminConfig()
+	app := NewApp(dcontext.Background(), &config)
+	mirrorer := &mirroringRegistry{Namespace: app.registry}
+	app.registry = mirrorer
+
+	serve := func(body, authorization string) *httptest.ResponseRecorder {
+		t.Helper()
+		r := httptest.NewRequest(http.MethodPost, "/v2/_proxy/mirror", strings.NewReader(body))
+		if authorization != "" {
+			r.Header.Set("Authorization", authorization)
+		}
+		w := httptest.NewRecorder()
+		app.ServeHTTP(w, r)
+		return w
+	}
+
+	w := serve(`{"repository": "library/alpine", "tagPattern": "3.*", "platforms": [{"architecture": "arm64", "os": "linux"}]}`, "Bearer admin")
+	if w.Code != http.StatusOK {
+		t.Fatalf("unexpected status %d: %s", w.Code, w.Body.String())
+	}
+	var report proxy.MirrorReport
+	if err := json.Unmarshal(w.Body.Bytes(), &report); err != nil {
+		t.Fatal(err)
+	}
+	if report.Repository != "library/alpine" || report.Mirrored != 1 || len(report.Tags) != 1 {
+		t.Fatalf("unexpected report %+v", report)
+	}
+	req := mirrorer.requests[0]
+	if req.Repository.Name() != "library/alpine" || req.TagPattern != "3.*" || len(req.Platforms) != 1 || req.Platforms[0] != (configuration.Platform{Architecture: "arm64", OS: "linux"}) {
+		t.Fatalf("unexpected mirror request %+v", req)
+	}
+
+	// The mirror requires access to the admin resource.
+	if w := serve(`{"repository": "library/alpine"}`, ""); w.Code != http.StatusUnauthorized {
+		t.Fatalf("expected an unauthorized request to be refused, got %d", w.Code)
+	}
+
+	for _, tc := range []struct {
+		body   string
+		err    error
+		status int
+	}{
+		{body: `{"repository": `, status: http.StatusBadRequest},
+		{body: `{"repository": "Library/Alpine"}`, status: http.StatusBadRequest},
+		{body: `{"repository": "library/alpine", "tagPattern": "["}`, status: http.StatusBadRequest},
+		{body: `{"repository": "other/alpine"}`, err: distribution.ErrRepositoryUnknown{Name: "other/alpine"}, status: http.StatusNotFound},
+		{body: `{"repository": "library/alpine"}`, err: errors.New("listing the tags of library/alpine: connection refused"), status: http.StatusServiceUnavailable},
+		{body: `{"repository": "library/alpine"}`, err: distribution.ErrUnsupported, status: http.StatusMethodNotAllowed},
+	} {
+		mirrorer.err = tc.err
+		if w := serve(tc.body, "Bearer admin"); w.Code != tc.status {
+			t.Fatalf("%s: expected status %d, got %d: %s", tc.body, tc.status, w.Code, w.Body.String())
+		}
+	}
+}
+
+func TestProxyMirrorNotACache(t *testing.T) {
+	config := adminConfig()
+	app := NewApp(dcontext.Background(), &config)
+
+	r := httptest.NewRequest(http.MethodPost, "/v2/_proxy/mirror", strings.NewReader(`{"repository": "library/alpine"}`))
+	r.Header.Set("Authorization", "Bearer admin")
+	w := httptest.NewRecorder()
+	app.ServeHTTP(w, r)
+	if w.Code != http.StatusMethodNotAllowed {
+		t.Fatalf("unexpected status %d", w.Code)
+	}
+	var errs errcode.Errors
+	if err := json.NewDecoder(w.Body).Decode(&errs); err != nil {
+		t.Fatal(err)
+	}
+	if len(errs) != 1 || errs[0].(errcode.Error).Code != errcode.ErrorCodeUnsupported {
+		t.Fatalf("unexpected errors %v", errs)
+	}
+}
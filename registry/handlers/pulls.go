@@ -0,0 +1,149 @@
+package handlers
+
+import (
+	"cmp"
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+
+	"github.com/distribution/distribution/v3/configuration"
+	"github.com/distribution/distribution/v3/internal/dcontext"
+	prometheus "github.com/distribution/distribution/v3/metrics"
+	"github.com/distribution/distribution/v3/registry/api/errcode"
+	"github.com/distribution/distribution/v3/registry/storage"
+	"github.com/distribution/distribution/v3/registry/storage/cache"
+	rediscache "github.com/distribution/distribution/v3/registry/storage/cache/redis"
+	storagedriver "github.com/distribution/distribution/v3/registry/storage/driver"
+	"github.com/docker/go-metrics"
+	"github.com/gorilla/handlers"
+)
+
+// defaultPullStatsFlushInterval is the interval at which the pulls counted
+// are flushed, unless configured.
+const defaultPullStatsFlushInterval = 30 * time.Second
+
+// pulls is the number of manifests pulled, by the top-level namespace of
+// their repository, so that the number of series stays bounded.
+var pulls = prometheus.StatsNamespace.NewLabeledCounter("pulls", "The number of manifests pulled", "namespace")
+
+func init() {
+	metrics.Register(prometheus.StatsNamespace)
+}
+
+// newPullCounts returns the pull counts of the configuration, kept in the
+// storage or in redis.
+func newPullCounts(config configuration.PullStats, driver storagedriver.StorageDriver, pool redis.UniversalClient) (*storage.PullCounts, error) {
+	var provider cache.PullCountProvider
+	switch config.Store {
+	case configuration.PullStatsStoreRedis:
+		if pool == nil {
+			return nil, errors.New("redis configuration required to keep the pull counts")
+		}
+		provider = rediscache.NewRedisPullCountProvider(pool)
+	default:
+		provider = storage.NewStoragePullCountProvider(driver)
+	}
+	return storage.NewPullCounts(provider), nil
+}
+
+// startPullCountsFlusher schedules a goroutine which flushes the pulls
+// counted every interval, until the context is done. The pulls counted since
+// are flushed on shutdown.
+func startPullCountsFlusher(ctx context.Context, pullCounts *storage.PullCounts, log dcontext.Logger, interval time.Duration) {
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+			}
+			if err := pullCounts.Flush(ctx); err != nil {
+				log.Errorf("failed to flush the pull counts: %v", err)
+			}
+		}
+	}()
+}
+
+// countPull counts a pull of the manifest of the repository by the
+// reference, if the pulls are counted.
+func (app *App) countPull(repo, reference string) {
+	if app.pullCounts == nil {
+		return
+	}
+	app.pullCounts.Count(repo, reference)
+	namespace, _, ok := strings.Cut(repo, "/")
+	if !ok {
+		// The repositories without a namespace are counted together.
+		namespace = ""
+	}
+	pulls.WithValues(namespace).Inc(1)
+}
+
+// pullStatsDispatcher constructs the handler of the pull counts of a
+// repository.
+func pullStatsDispatcher(ctx *Context, r *http.Request) http.Handler {
+	pullStatsHandler := &pullStatsHandler{
+		Context: ctx,
+	}
+
+	return handlers.MethodHandler{
+		http.MethodGet: http.HandlerFunc(pullStatsHandler.GetPullStats),
+	}
+}
+
+// pullStatsHandler handles the requests for the pull counts of a repository.
+type pullStatsHandler struct {
+	*Context
+}
+
+type pullStatsAPIResponse struct {
+	Name  string           `json:"name"`
+	Pulls []pullStatsEntry `json:"pulls"`
+}
+
+// pullStatsEntry is the number of pulls of a manifest by a tag or digest.
+type pullStatsEntry struct {
+	Reference string `json:"reference"`
+	Count     int64  `json:"count"`
+}
+
+// GetPullStats returns a json list of the pull counts of the repository,
+// most pulled first.
+func (ph *pullStatsHandler) GetPullStats(w http.ResponseWriter, r *http.Request) {
+	if ph.App.pullCounts == nil {
+		ph.Errors = append(ph.Errors, errcode.ErrorCodeUnsupported)
+		return
+	}
+	name := ph.Repository.Named().Name()
+	counts, err := ph.App.pullCounts.Counts(ph, name)
+	if err != nil {
+		ph.Errors = append(ph.Errors, errcode.ErrorCodeUnknown.WithDetail(err))
+		return
+	}
+
+	entries := make([]pullStatsEntry, 0, len(counts))
+	for reference, count := range counts {
+		entries = append(entries, pullStatsEntry{Reference: reference, Count: count})
+	}
+	slices.SortFunc(entries, func(a, b pullStatsEntry) int {
+		return cmp.Or(cmp.Compare(b.Count, a.Count), strings.Compare(a.Reference, b.Reference))
+	})
+
+	w.Header().Set("Content-Type", "application/json")
+	enc := json.NewEncoder(w)
+	if err := enc.Encode(pullStatsAPIResponse{
+		Name:  name,
+		Pulls: entries,
+	}); err != nil {
+		ph.Errors = append(ph.Errors, errcode.ErrorCodeUnknown.WithDetail(err))
+		return
+	}
+}
@@ -0,0 +1,112 @@
+package handlers
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/distribution/distribution/v3/configuration"
+	"github.com/distribution/distribution/v3/registry/api/errcode"
+	"github.com/distribution/distribution/v3/registry/storage"
+	"github.com/distribution/reference"
+)
+
+func TestPullStats(t *testing.T) {
+	config := configuration.Configuration{
+		Storage: configuration.Storage{
+			"inmemory": configuration.Parameters{},
+			"maintenance": configuration.Parameters{"uploadpurging": map[any]any{
+				"enabled": false,
+			}},
+		},
+		Stats: configuration.Stats{
+			Pulls: configuration.PullStats{Enabled: true, FlushInterval: time.Hour},
+		},
+	}
+	config.HTTP.Headers = headerConfig
+	env := newTestEnvWithConfig(t, &config)
+	defer env.Shutdown()
+
+	imageName, err := reference.WithName("foo/bar")
+	checkErr(t, err, "building image name")
+	dgst := createRepository(env, t, imageName.Name(), "latest")
+	tagRef, _ := reference.WithTag(imageName, "latest")
+	digestRef, _ := reference.WithDigest(imageName, dgst)
+
+	request := func(method string, ref reference.Named, header http.Header) int {
+		t.Helper()
+		manifestURL, err := env.builder.BuildManifestURL(ref)
+		checkErr(t, err, "building manifest url")
+		req, err := http.NewRequest(method, manifestURL, nil)
+		checkErr(t, err, "building manifest request")
+		req.Header = header
+		resp, err := http.DefaultClient.Do(req)
+		checkErr(t, err, "fetching manifest")
+		defer resp.Body.Close()
+		return resp.StatusCode
+	}
+	for range 3 {
+		request(http.MethodGet, tagRef, nil)
+	}
+	request(http.MethodGet, digestRef, nil)
+	// Neither the HEAD requests nor the revalidations are pulls.
+	request(http.MethodHead, tagRef, nil)
+	if status := request(http.MethodGet, tagRef, http.Header{"If-None-Match": {`"` + dgst.String() + `"`}}); status != http.StatusNotModified {
+		t.Fatalf("expected the revalidation to be answered with %d, got %d", http.StatusNotModified, status)
+	}
+
+	statsURL, err := env.builder.BuildPullStatsURL(imageName)
+	checkErr(t, err, "building pull stats url")
+	resp, err := http.Get(statsURL)
+	checkErr(t, err, "fetching pull stats")
+	defer resp.Body.Close()
+	checkResponse(t, "fetching pull stats", resp, http.StatusOK)
+	var stats pullStatsAPIResponse
+	if err := json.NewDecoder(resp.Body).Decode(&stats); err != nil {
+		t.Fatalf("error decoding pull stats: %v", err)
+	}
+	expected := pullStatsAPIResponse{
+		Name: "foo/bar",
+		Pulls: []pullStatsEntry{
+			{Reference: "latest", Count: 3},
+			{Reference: dgst.String(), Count: 1},
+		},
+	}
+	if !reflect.DeepEqual(stats, expected) {
+		t.Fatalf("unexpected pull stats %+v, expected %+v", stats, expected)
+	}
+
+	// The pulls are flushed on shutdown, rather than on every pull.
+	provider := storage.NewStoragePullCountProvider(env.app.driver)
+	if counts, err := provider.PullCounts(context.Background(), "foo/bar"); err != nil || len(counts) != 0 {
+		t.Fatalf("expected the pulls not to be flushed yet, got %v: %v", counts, err)
+	}
+	if err := env.app.Shutdown(context.Background()); err != nil {
+		t.Fatalf("error shutting down: %v", err)
+	}
+	counts, err := provider.PullCounts(context.Background(), "foo/bar")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if counts["latest"] != 3 || counts[dgst.String()] != 1 || len(counts) != 2 {
+		t.Fatalf("unexpected pull counts %v flushed on shutdown", counts)
+	}
+}
+
+func TestPullStatsDisabled(t *testing.T) {
+	env := newTestEnv(t, false)
+	defer env.Shutdown()
+
+	imageName, err := reference.WithName("foo/bar")
+	checkErr(t, err, "building image name")
+	statsURL, err := env.builder.BuildPullStatsURL(imageName)
+	checkErr(t, err, "building pull stats url")
+	resp, err := http.Get(statsURL)
+	checkErr(t, err, "fetching pull stats")
+	defer resp.Body.Close()
+	checkResponse(t, "fetching pull stats", resp, http.StatusMethodNotAllowed)
+	checkBodyHasErrorCodes(t, "fetching pull stats", resp, errcode.ErrorCodeUnsupported)
+}
@@ -0,0 +1,33 @@
+package handlers
+
+import (
+	"errors"
+
+	"github.com/redis/go-redis/v9"
+
+	"github.com/distribution/distribution/v3/configuration"
+	"github.com/distribution/distribution/v3/registry/storage"
+	"github.com/distribution/distribution/v3/registry/storage/cache"
+	rediscache "github.com/distribution/distribution/v3/registry/storage/cache/redis"
+	storagedriver "github.com/distribution/distribution/v3/registry/storage/driver"
+)
+
+// newQuotas returns the quotas of the configuration, keeping the usage of
+// the repositories in the storage or in redis.
+func newQuotas(config configuration.Quotas, driver storagedriver.StorageDriver, pool redis.UniversalClient) (*storage.Quotas, error) {
+	var usage cache.QuotaUsageProvider
+	switch config.Usage {
+	case configuration.QuotaUsageRedis:
+		if pool == nil {
+			return nil, errors.New("redis configuration required to keep the usage of the quotas")
+		}
+		usage = rediscache.NewRedisQuotaUsageProvider(pool)
+	default:
+		usage = storage.NewStorageQuotaUsageProvider(driver)
+	}
+	rules := make([]storage.QuotaRule, 0, len(config.Repositories))
+	for _, quota := range config.Repositories {
+		rules = append(rules, storage.QuotaRule{Pattern: quota.Pattern, Limit: quota.Limit})
+	}
+	return storage.NewQuotas(usage, rules...)
+}
@@ -0,0 +1,225 @@
+package handlers
+
+import (
+	"fmt"
+	"math"
+	"net/http"
+	"net/netip"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/distribution/distribution/v3/configuration"
+	"github.com/distribution/distribution/v3/internal/dcontext"
+	prometheus "github.com/distribution/distribution/v3/metrics"
+	"github.com/distribution/distribution/v3/registry/api/errcode"
+	v2 "github.com/distribution/distribution/v3/registry/api/v2"
+	"github.com/gorilla/mux"
+	"golang.org/x/time/rate"
+)
+
+// rateLimited is the number of requests denied by the rate limits.
+var rateLimited = prometheus.AccessNamespace.NewLabeledCounter("rate_limited", "The number of requests denied by the rate limits", "endpoint", "method")
+
+// Keys of the rate limits.
+const (
+	rateLimitKeyUser       = "user"
+	rateLimitKeyIP         = "ip"
+	rateLimitKeyRepository = "repository"
+)
+
+// rateLimiter limits the rate of the requests of each client.
+type rateLimiter struct {
+	key            string
+	trustedProxies []netip.Prefix
+	limits         []*rateLimit
+}
+
+// rateLimit is a limit, with a token bucket for each client.
+type rateLimit struct {
+	endpoint string
+	method   string
+	limit    rate.Limit
+	burst    int
+	// window is the time for an empty bucket to fill up. Buckets idle for
+	// longer are full and dropped, and exceeding the limit is logged once
+	// per window.
+	window time.Duration
+
+	mu        sync.Mutex
+	buckets   map[string]*rateBucket
+	lastSweep time.Time
+}
+
+type rateBucket struct {
+	limiter  *rate.Limiter
+	lastSeen time.Time
+	// lastLogged is when exceeding the limit was last logged.
+	lastLogged time.Time
+}
+
+func newRateLimiter(config configuration.Configuration) (*rateLimiter, error) {
+	trustedProxies, err := parsePrefixes(config.Policy.Network.TrustedProxies)
+	if err != nil {
+		return nil, fmt.Errorf("policy.network.trustedproxies: %v", err)
+	}
+
+	limiter := &rateLimiter{key: config.HTTP.RateLimit.Key, trustedProxies: trustedProxies}
+	switch limiter.key {
+	case "":
+		limiter.key = rateLimitKeyIP
+	case rateLimitKeyUser, rateLimitKeyIP, rateLimitKeyRepository:
+	default:
+		return nil, fmt.Errorf("http.ratelimit.key: unknown key %q", limiter.key)
+	}
+
+	for i, rule := range config.HTTP.RateLimit.Limits {
+		limit := &rateLimit{
+			endpoint: rule.Endpoint,
+			method:   rule.Method,
+			limit:    rate.Limit(rule.Rate),
+			burst:    rule.Burst,
+			buckets:  make(map[string]*rateBucket),
+		}
+		switch limit.endpoint {
+		case "":
+			limit.endpoint = "*"
+		case "manifest", "blob", "*":
+		default:
+			return nil, fmt.Errorf("http.ratelimit.limits[%d]: unknown endpoint %q", i, limit.endpoint)
+		}
+		switch limit.method {
+		case "":
+			limit.method = "*"
+		case "read", "write", "*":
+		default:
+			return nil, fmt.Errorf("http.ratelimit.limits[%d]: unknown method %q", i, limit.method)
+		}
+		if rule.Rate <= 0 {
+			return nil, fmt.Errorf("http.ratelimit.limits[%d]: rate must be positive", i)
+		}
+		if limit.burst <= 0 {
+			limit.burst = int(math.Ceil(rule.Rate))
+		}
+		limit.window = max(time.Duration(float64(limit.burst)/rule.Rate*float64(time.Second)), time.Second)
+		limiter.limits = append(limiter.limits, limit)
+	}
+	return limiter, nil
+}
+
+// requestEndpoint returns the endpoint and method of the request, as matched
+// by the rate limits.
+func requestEndpoint(r *http.Request) (string, string) {
+	method := "write"
+	if r.Method == http.MethodGet || r.Method == http.MethodHead {
+		method = "read"
+	}
+
+	endpoint := "other"
+	if route := mux.CurrentRoute(r); route != nil {
+		switch route.GetName() {
+		case v2.RouteNameManifest:
+			endpoint = "manifest"
+		case v2.RouteNameBlob, v2.RouteNameBlobUpload, v2.RouteNameBlobUploadChunk:
+			endpoint = "blob"
+		}
+	}
+	return endpoint, method
+}
+
+func (l *rateLimit) matches(endpoint, method string) bool {
+	return (l.endpoint == "*" || l.endpoint == endpoint) && (l.method == "*" || l.method == method)
+}
+
+// reserve takes a token from the bucket of the key. If the bucket is empty,
+// no token is taken and it returns how long until one is available, and
+// whether the denial is the first of the window, to be logged.
+func (l *rateLimit) reserve(key string, now time.Time) (time.Duration, bool) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if now.Sub(l.lastSweep) > l.window {
+		for k, bucket := range l.buckets {
+			if now.Sub(bucket.lastSeen) > l.window {
+				delete(l.buckets, k)
+			}
+		}
+		l.lastSweep = now
+	}
+
+	bucket, ok := l.buckets[key]
+	if !ok {
+		bucket = &rateBucket{limiter: rate.NewLimiter(l.limit, l.burst)}
+		l.buckets[key] = bucket
+	}
+	bucket.lastSeen = now
+
+	reservation := bucket.limiter.ReserveN(now, 1)
+	delay := reservation.DelayFrom(now)
+	if delay == 0 {
+		return 0, false
+	}
+	reservation.CancelAt(now)
+
+	log := now.Sub(bucket.lastLogged) > l.window
+	if log {
+		bucket.lastLogged = now
+	}
+	return delay, log
+}
+
+// requestKey returns the key the request is counted by, or false if it is
+// not limited.
+func (rl *rateLimiter) requestKey(r *http.Request, context *Context) (string, bool) {
+	switch rl.key {
+	case rateLimitKeyRepository:
+		repo := getName(context)
+		return repo, repo != ""
+	case rateLimitKeyUser:
+		// Only the authorized user, unlike getUserName, which falls back to
+		// the unverified basic auth user.
+		if user := dcontext.GetStringValue(context, userNameKey); user != "" {
+			return "user:" + user, true
+		}
+	}
+	addr, ok := clientAddr(r, rl.trustedProxies)
+	if !ok {
+		return "", false
+	}
+	return "ip:" + addr.String(), true
+}
+
+// checkRateLimit denies the request with a 429 if it exceeds any rate limit
+// matching it.
+func (app *App) checkRateLimit(w http.ResponseWriter, r *http.Request, context *Context) error {
+	if app.rateLimiter == nil {
+		return nil
+	}
+	key, ok := app.rateLimiter.requestKey(r, context)
+	if !ok {
+		return nil
+	}
+
+	endpoint, method := requestEndpoint(r)
+	now := time.Now()
+	for _, limit := range app.rateLimiter.limits {
+		if !limit.matches(endpoint, method) {
+			continue
+		}
+		delay, log := limit.reserve(key, now)
+		if delay == 0 {
+			continue
+		}
+
+		rateLimited.WithValues(endpoint, method).Inc()
+		if log {
+			dcontext.GetLogger(context).Warnf("rate limit of %s %s requests exceeded by %s, further requests are not logged for %s", method, endpoint, key, limit.window)
+		}
+		w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(delay.Seconds()))))
+		if err := errcode.ServeJSON(w, errcode.ErrorCodeTooManyRequests); err != nil {
+			dcontext.GetLogger(context).Errorf("error serving error json: %v (from %v)", err, context.Errors)
+		}
+		return fmt.Errorf("rate limit of %s %s requests exceeded by %s", method, endpoint, key)
+	}
+	return nil
+}
@@ -0,0 +1,148 @@
+package handlers
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/distribution/distribution/v3/configuration"
+	"github.com/distribution/distribution/v3/internal/dcontext"
+	"github.com/distribution/distribution/v3/registry/api/errcode"
+)
+
+func TestRateLimitApp(t *testing.T) {
+	config := configuration.Configuration{
+		Storage: configuration.Storage{
+			"inmemory": nil,
+			"maintenance": configuration.Parameters{"uploadpurging": map[any]any{
+				"enabled": false,
+			}},
+		},
+		HTTP: configuration.HTTP{
+			RateLimit: configuration.RateLimit{
+				Limits: []configuration.RateLimitRule{
+					{Endpoint: "manifest", Method: "read", Rate: 10, Burst: 2},
+				},
+			},
+		},
+		Policy: configuration.Policy{
+			Network: configuration.NetworkPolicy{TrustedProxies: []string{"10.0.0.1"}},
+		},
+	}
+	app := NewApp(dcontext.Background(), &config)
+
+	serve := func(method, path, remoteAddr, forwardedFor string) *httptest.ResponseRecorder {
+		t.Helper()
+		r := httptest.NewRequest(method, path, nil)
+		r.RemoteAddr = remoteAddr
+		if forwardedFor != "" {
+			r.Header.Set("X-Forwarded-For", forwardedFor)
+		}
+		w := httptest.NewRecorder()
+		app.ServeHTTP(w, r)
+		return w
+	}
+	assertLimited := func(w *httptest.ResponseRecorder) {
+		t.Helper()
+		if w.Code != http.StatusTooManyRequests {
+			t.Fatalf("expected 429, got %d", w.Code)
+		}
+		if w.Header().Get("Retry-After") != "1" {
+			t.Fatalf("unexpected Retry-After %q", w.Header().Get("Retry-After"))
+		}
+		var errs errcode.Errors
+		if err := json.NewDecoder(w.Body).Decode(&errs); err != nil {
+			t.Fatalf("error decoding error response: %v", err)
+		}
+		if coder, ok := errs[0].(errcode.ErrorCoder); !ok || coder.ErrorCode() != errcode.ErrorCodeTooManyRequests {
+			t.Fatalf("unexpected error %v", errs)
+		}
+	}
+
+	const manifest = "/v2/foo/bar/manifests/latest"
+	for range 2 {
+		if w := serve(http.MethodGet, manifest, "198.51.100.1:1234", ""); w.Code == http.StatusTooManyRequests {
+			t.Fatal("unexpected 429 within the burst")
+		}
+	}
+	assertLimited(serve(http.MethodGet, manifest, "198.51.100.1:1234", ""))
+	assertLimited(serve(http.MethodHead, manifest, "198.51.100.1:1234", ""))
+
+	// Other clients, endpoints and methods have their own limits.
+	if w := serve(http.MethodGet, manifest, "198.51.100.2:1234", ""); w.Code == http.StatusTooManyRequests {
+		t.Fatal("unexpected 429 for another client")
+	}
+	if w := serve(http.MethodGet, "/v2/foo/bar/blobs/sha256:e3b0c44298fc1c149afbf4c8996fb92427ae41e4649b934ca495991b7852b855", "198.51.100.1:1234", ""); w.Code == http.StatusTooManyRequests {
+		t.Fatal("unexpected 429 for a blob")
+	}
+	if w := serve(http.MethodPut, manifest, "198.51.100.1:1234", ""); w.Code == http.StatusTooManyRequests {
+		t.Fatal("unexpected 429 for a write")
+	}
+
+	// Clients behind a trusted proxy are told apart by X-Forwarded-For,
+	// while the header of other clients is ignored.
+	for range 2 {
+		serve(http.MethodGet, manifest, "10.0.0.1:1234", "198.51.100.3")
+	}
+	assertLimited(serve(http.MethodGet, manifest, "10.0.0.1:1234", "198.51.100.3"))
+	if w := serve(http.MethodGet, manifest, "10.0.0.1:1234", "198.51.100.4"); w.Code == http.StatusTooManyRequests {
+		t.Fatal("unexpected 429 for another client behind the proxy")
+	}
+	assertLimited(serve(http.MethodGet, manifest, "198.51.100.1:1234", "198.51.100.5"))
+
+	// The bucket refills at the rate.
+	time.Sleep(150 * time.Millisecond)
+	if w := serve(http.MethodGet, manifest, "198.51.100.1:1234", ""); w.Code == http.StatusTooManyRequests {
+		t.Fatal("unexpected 429 after the bucket refilled")
+	}
+	assertLimited(serve(http.MethodGet, manifest, "198.51.100.1:1234", ""))
+}
+
+func TestNewRateLimiter(t *testing.T) {
+	for name, ratelimit := range map[string]configuration.RateLimit{
+		"unknown key":      {Key: "token", Limits: []configuration.RateLimitRule{{Rate: 1}}},
+		"unknown endpoint": {Limits: []configuration.RateLimitRule{{Endpoint: "tags", Rate: 1}}},
+		"unknown method":   {Limits: []configuration.RateLimitRule{{Method: "post", Rate: 1}}},
+		"no rate":          {Limits: []configuration.RateLimitRule{{Endpoint: "blob"}}},
+	} {
+		if _, err := newRateLimiter(configuration.Configuration{HTTP: configuration.HTTP{RateLimit: ratelimit}}); err == nil {
+			t.Errorf("%s: expected an error", name)
+		}
+	}
+
+	limiter, err := newRateLimiter(configuration.Configuration{HTTP: configuration.HTTP{RateLimit: configuration.RateLimit{
+		Limits: []configuration.RateLimitRule{{Rate: 0.5}},
+	}}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if limiter.key != "ip" {
+		t.Errorf("unexpected default key %q", limiter.key)
+	}
+	if limit := limiter.limits[0]; limit.endpoint != "*" || limit.method != "*" || limit.burst != 1 || limit.window != 2*time.Second {
+		t.Errorf("unexpected defaults %+v", limit)
+	}
+}
+
+func TestRateLimitLoggedOncePerWindow(t *testing.T) {
+	limit := &rateLimit{limit: 1, burst: 1, window: time.Second, buckets: make(map[string]*rateBucket)}
+	now := time.Now()
+	if delay, _ := limit.reserve("ip:198.51.100.1", now); delay != 0 {
+		t.Fatalf("unexpected delay %s", delay)
+	}
+	_, log := limit.reserve("ip:198.51.100.1", now)
+	if !log {
+		t.Fatal("expected the first denial to be logged")
+	}
+	if _, log := limit.reserve("ip:198.51.100.1", now.Add(100*time.Millisecond)); log {
+		t.Fatal("expected further denials of the window not to be logged")
+	}
+
+	// Idle buckets are dropped.
+	limit.reserve("ip:198.51.100.2", now.Add(3*time.Second))
+	if _, ok := limit.buckets["ip:198.51.100.1"]; ok || len(limit.buckets) != 1 {
+		t.Fatalf("unexpected buckets %v", limit.buckets)
+	}
+}
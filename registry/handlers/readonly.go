@@ -0,0 +1,294 @@
+package handlers
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/distribution/distribution/v3/internal/dcontext"
+	prometheus "github.com/distribution/distribution/v3/metrics"
+	"github.com/distribution/distribution/v3/registry/api/errcode"
+	v2 "github.com/distribution/distribution/v3/registry/api/v2"
+	"github.com/distribution/distribution/v3/registry/storage"
+	storagedriver "github.com/distribution/distribution/v3/registry/storage/driver"
+	"github.com/docker/go-metrics"
+	"github.com/gorilla/handlers"
+	"github.com/gorilla/mux"
+)
+
+// readOnlyEnabled is 1 while the registry is in read-only mode, 0 otherwise.
+var readOnlyEnabled = prometheus.StorageNamespace.NewGauge("readonly", "Whether the registry is in read-only mode", metrics.Unit("enabled"))
+
+const (
+	// defaultReadOnlyRetryAfter is how long the clients whose writes are
+	// refused are asked to wait before retrying, by default.
+	defaultReadOnlyRetryAfter = time.Minute
+	// maxReadOnlyRequestSize is the maximum size of the body of a request
+	// switching the read-only mode.
+	maxReadOnlyRequestSize = 64 << 10
+)
+
+// readOnlyMode is the read-only maintenance mode of the registry, refusing
+// the writes to the repositories while the reads continue. It is set by the
+// configuration, and may be switched at runtime through the admin API.
+type readOnlyMode struct {
+	message    string
+	retryAfter time.Duration
+	// driver persists the mode switched at runtime in a marker of the
+	// storage, if set, so that it is kept across restarts.
+	driver storagedriver.StorageDriver
+
+	mu     sync.RWMutex
+	status readOnlyStatus
+}
+
+// readOnlyStatus is the state of the read-only mode, as served by the admin
+// API.
+type readOnlyStatus struct {
+	Enabled bool      `json:"enabled"`
+	Message string    `json:"message,omitempty"`
+	Since   time.Time `json:"since,omitzero"`
+}
+
+func badReadOnlyConfig(reason string) {
+	panic(fmt.Sprintf("Unable to parse read-only configuration: %s", reason))
+}
+
+// newReadOnlyMode parses the readonly section of the storage maintenance
+// configuration, which may be nil. If the mode persists, the marker of the
+// storage overrides the configuration.
+func newReadOnlyMode(ctx context.Context, config map[any]any, storageDriver storagedriver.StorageDriver) *readOnlyMode {
+	mode := &readOnlyMode{retryAfter: defaultReadOnlyRetryAfter}
+	if enabled, ok := config["enabled"]; ok {
+		mode.status.Enabled, ok = enabled.(bool)
+		if !ok {
+			panic("readonly's enabled config key must have a boolean value")
+		}
+	}
+	if message, ok := config["message"]; ok {
+		mode.message, ok = message.(string)
+		if !ok {
+			badReadOnlyConfig("message is not a string")
+		}
+	}
+	if retryAfter, ok := config["retryafter"]; ok {
+		retryAfterStr, ok := retryAfter.(string)
+		if !ok {
+			badReadOnlyConfig("retryafter is not a string")
+		}
+		d, err := time.ParseDuration(retryAfterStr)
+		if err != nil {
+			badReadOnlyConfig(fmt.Sprintf("Cannot parse retryafter: %s", err.Error()))
+		}
+		if d <= 0 {
+			badReadOnlyConfig("retryafter must be positive")
+		}
+		mode.retryAfter = d
+	}
+	if persist, ok := config["persist"]; ok {
+		persistBool, ok := persist.(bool)
+		if !ok {
+			badReadOnlyConfig("persist is not a boolean")
+		}
+		if persistBool {
+			mode.driver = storageDriver
+		}
+	}
+
+	if mode.status.Enabled {
+		mode.status.Message = mode.message
+		mode.status.Since = time.Now()
+	}
+	if mode.driver != nil {
+		marker, err := storage.GetReadOnlyMarker(ctx, mode.driver)
+		if err != nil {
+			panic(fmt.Sprintf("unable to read the read-only marker: %v", err))
+		}
+		if marker != nil {
+			dcontext.GetLogger(ctx).Warnf("registry is read-only since %s, as marked in the storage", marker.Since)
+			mode.status = readOnlyStatus{Enabled: true, Message: marker.Message, Since: marker.Since}
+		}
+	}
+	mode.updateGauge()
+	return mode
+}
+
+// get returns the current state of the read-only mode.
+func (m *readOnlyMode) get() readOnlyStatus {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	return m.status
+}
+
+// set switches the read-only mode. The message is returned to the clients
+// whose writes are refused, instead of the message of the configuration if
+// not empty. If the mode persists, the marker of the storage is updated
+// first, so that the mode is not switched if it cannot be kept.
+func (m *readOnlyMode) set(ctx context.Context, enabled bool, message string) (readOnlyStatus, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	status := readOnlyStatus{Enabled: enabled}
+	if enabled {
+		status.Message = message
+		if status.Message == "" {
+			status.Message = m.message
+		}
+		status.Since = m.status.Since
+		if !m.status.Enabled {
+			status.Since = time.Now()
+		}
+	}
+	if m.driver != nil {
+		var err error
+		if enabled {
+			err = storage.PutReadOnlyMarker(ctx, m.driver, storage.ReadOnlyMarker{Message: status.Message, Since: status.Since})
+		} else {
+			err = storage.DeleteReadOnlyMarker(ctx, m.driver)
+		}
+		if err != nil {
+			return m.status, err
+		}
+	}
+	m.status = status
+	m.updateGauge()
+	return status, nil
+}
+
+func (m *readOnlyMode) updateGauge() {
+	if m.status.Enabled {
+		readOnlyEnabled.Set(1)
+	} else {
+		readOnlyEnabled.Set(0)
+	}
+}
+
+// notice reports the read-only mode in the health status, without failing
+// the health checks, since the reads continue.
+func (m *readOnlyMode) notice(context.Context) string {
+	status := m.get()
+	if !status.Enabled {
+		return ""
+	}
+	notice := "registry is read-only since " + status.Since.UTC().Format(time.RFC3339)
+	if status.Message != "" {
+		notice += ": " + status.Message
+	}
+	return notice
+}
+
+// isWrite returns whether the request writes to a repository, which is
+// refused by the read-only mode.
+func isWrite(r *http.Request) bool {
+	if r.Method == http.MethodGet || r.Method == http.MethodHead {
+		return false
+	}
+	route := mux.CurrentRoute(r)
+	if route == nil {
+		return false
+	}
+	switch route.GetName() {
+	case v2.RouteNameManifest, v2.RouteNameTag, v2.RouteNameBlob, v2.RouteNameBlobUpload, v2.RouteNameBlobUploadChunk:
+		return true
+	}
+	return false
+}
+
+// checkReadOnly refuses the writes with a 503 while the registry is in
+// read-only mode.
+func (app *App) checkReadOnly(w http.ResponseWriter, r *http.Request, context *Context) error {
+	if !isWrite(r) {
+		return nil
+	}
+	status := app.readOnly.get()
+	if !status.Enabled {
+		return nil
+	}
+
+	err := errcode.ErrorCodeUnavailable.WithMessage("registry is in read-only mode")
+	if status.Message != "" {
+		err = errcode.ErrorCodeUnavailable.WithMessage(status.Message)
+	}
+	w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(app.readOnly.retryAfter.Seconds()))))
+	if err := errcode.ServeJSON(w, err); err != nil {
+		dcontext.GetLogger(context).Errorf("error serving error json: %v (from %v)", err, context.Errors)
+	}
+	return fmt.Errorf("registry is in read-only mode")
+}
+
+// adminReadOnlyDispatcher constructs the handler of the read-only mode admin
+// api endpoint.
+func adminReadOnlyDispatcher(ctx *Context, r *http.Request) http.Handler {
+	ctx.App.authMu.RLock()
+	authenticated := ctx.App.accessController != nil
+	ctx.App.authMu.RUnlock()
+	if !authenticated {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			ctx.Errors = append(ctx.Errors, errcode.ErrorCodeUnsupported.WithMessage("the admin API requires authentication to be configured"))
+		})
+	}
+
+	readOnlyHandler := &readOnlyHandler{
+		Context: ctx,
+	}
+
+	return handlers.MethodHandler{
+		http.MethodGet: http.HandlerFunc(readOnlyHandler.GetReadOnly),
+		http.MethodPut: http.HandlerFunc(readOnlyHandler.PutReadOnly),
+	}
+}
+
+// readOnlyHandler handles the requests for the read-only mode of the
+// registry.
+type readOnlyHandler struct {
+	*Context
+}
+
+// readOnlyRequest is the body of a request switching the read-only mode.
+type readOnlyRequest struct {
+	Enabled *bool  `json:"enabled"`
+	Message string `json:"message"`
+}
+
+// GetReadOnly returns the read-only mode of the registry.
+func (roh *readOnlyHandler) GetReadOnly(w http.ResponseWriter, r *http.Request) {
+	roh.serveStatus(w, roh.App.readOnly.get())
+}
+
+// PutReadOnly switches the read-only mode of the registry.
+func (roh *readOnlyHandler) PutReadOnly(w http.ResponseWriter, r *http.Request) {
+	var request readOnlyRequest
+	if err := json.NewDecoder(io.LimitReader(r.Body, maxReadOnlyRequestSize)).Decode(&request); err != nil {
+		roh.Errors = append(roh.Errors, errcode.ErrorCodeAdminRequestInvalid.WithDetail(err.Error()))
+		return
+	}
+	if request.Enabled == nil {
+		roh.Errors = append(roh.Errors, errcode.ErrorCodeAdminRequestInvalid.WithDetail("enabled is required"))
+		return
+	}
+
+	status, err := roh.App.readOnly.set(roh, *request.Enabled, request.Message)
+	if err != nil {
+		roh.Errors = append(roh.Errors, errcode.ErrorCodeUnknown.WithDetail(err))
+		return
+	}
+	if status.Enabled {
+		dcontext.GetLogger(roh).Warnf("registry switched to read-only mode by %s: %s", getUserName(roh, r), status.Message)
+	} else {
+		dcontext.GetLogger(roh).Warnf("registry switched out of read-only mode by %s", getUserName(roh, r))
+	}
+	roh.serveStatus(w, status)
+}
+
+func (roh *readOnlyHandler) serveStatus(w http.ResponseWriter, status readOnlyStatus) {
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(status); err != nil {
+		roh.Errors = append(roh.Errors, errcode.ErrorCodeUnknown.WithDetail(err))
+	}
+}
@@ -0,0 +1,182 @@
+package handlers
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/distribution/distribution/v3/configuration"
+	"github.com/distribution/distribution/v3/health"
+	"github.com/distribution/distribution/v3/internal/dcontext"
+	"github.com/distribution/distribution/v3/registry/api/errcode"
+	_ "github.com/distribution/distribution/v3/registry/auth/silly"
+	"github.com/distribution/distribution/v3/registry/storage"
+	"github.com/opencontainers/go-digest"
+)
+
+// setReadOnly switches the read-only mode of the app.
+func setReadOnly(t *testing.T, app *App, enabled bool, message string) {
+	t.Helper()
+	if _, err := app.readOnly.set(context.Background(), enabled, message); err != nil {
+		t.Fatalf("error switching read-only mode: %v", err)
+	}
+}
+
+func TestReadOnlyAdminAPI(t *testing.T) {
+	config := configuration.Configuration{
+		Storage: configuration.Storage{
+			"inmemory": nil,
+			"delete":   configuration.Parameters{"enabled": true},
+			"maintenance": configuration.Parameters{
+				"uploadpurging": map[any]any{"enabled": false},
+				"readonly":      map[any]any{"persist": true, "retryafter": "30s"},
+			},
+		},
+		Auth: configuration.Auth{
+			"silly": {
+				"realm":   "realm-test",
+				"service": "service-test",
+			},
+		},
+	}
+	app := NewApp(dcontext.Background(), &config)
+	healthRegistry := health.NewRegistry()
+	app.RegisterHealthChecks(healthRegistry)
+
+	serve := func(method, path, body string) *httptest.ResponseRecorder {
+		t.Helper()
+		r := httptest.NewRequest(method, path, strings.NewReader(body))
+		r.Header.Set("Authorization", "Bearer admin")
+		w := httptest.NewRecorder()
+		app.ServeHTTP(w, r)
+		return w
+	}
+	checkStatus := func(w *httptest.ResponseRecorder, expected readOnlyStatus) {
+		t.Helper()
+		if w.Code != http.StatusOK {
+			t.Fatalf("unexpected status %d: %s", w.Code, w.Body)
+		}
+		var status readOnlyStatus
+		if err := json.NewDecoder(w.Body).Decode(&status); err != nil {
+			t.Fatalf("error decoding read-only mode: %v", err)
+		}
+		if status.Enabled != expected.Enabled || status.Message != expected.Message || status.Since.IsZero() == expected.Enabled {
+			t.Fatalf("unexpected read-only mode %+v, expected %+v", status, expected)
+		}
+	}
+
+	// The admin API requires authentication.
+	r := httptest.NewRequest(http.MethodPut, "/v2/_admin/readonly", strings.NewReader(`{"enabled": true}`))
+	w := httptest.NewRecorder()
+	app.ServeHTTP(w, r)
+	if w.Code != http.StatusUnauthorized {
+		t.Fatalf("expected 401 without authentication, got %d", w.Code)
+	}
+	if challenge := w.Header().Get("WWW-Authenticate"); !strings.Contains(challenge, `scope="registry:admin:*"`) {
+		t.Fatalf("unexpected challenge %q", challenge)
+	}
+
+	checkStatus(serve(http.MethodGet, "/v2/_admin/readonly", ""), readOnlyStatus{})
+	for _, body := range []string{`{"enabled": tru`, `{"message": "maintenance"}`} {
+		if w := serve(http.MethodPut, "/v2/_admin/readonly", body); w.Code != http.StatusBadRequest {
+			t.Fatalf("expected 400 with body %s, got %d", body, w.Code)
+		}
+	}
+
+	checkStatus(serve(http.MethodPut, "/v2/_admin/readonly", `{"enabled": true, "message": "garbage collection"}`), readOnlyStatus{Enabled: true, Message: "garbage collection"})
+	checkStatus(serve(http.MethodGet, "/v2/_admin/readonly", ""), readOnlyStatus{Enabled: true, Message: "garbage collection"})
+
+	dgst := digest.FromString("layer")
+	for _, write := range []struct{ method, path string }{
+		{http.MethodPost, "/v2/foo/bar/blobs/uploads/"},
+		{http.MethodPatch, "/v2/foo/bar/blobs/uploads/upload-id"},
+		{http.MethodPut, "/v2/foo/bar/blobs/uploads/upload-id?digest=" + dgst.String()},
+		{http.MethodDelete, "/v2/foo/bar/blobs/uploads/upload-id"},
+		{http.MethodDelete, "/v2/foo/bar/blobs/" + dgst.String()},
+		{http.MethodPut, "/v2/foo/bar/manifests/latest"},
+		{http.MethodDelete, "/v2/foo/bar/manifests/" + dgst.String()},
+		{http.MethodDelete, "/v2/foo/bar/tags/latest"},
+	} {
+		w := serve(write.method, write.path, "")
+		if w.Code != http.StatusServiceUnavailable {
+			t.Fatalf("expected 503 for %s %s, got %d", write.method, write.path, w.Code)
+		}
+		if w.Header().Get("Retry-After") != "30" {
+			t.Fatalf("unexpected Retry-After %q for %s %s", w.Header().Get("Retry-After"), write.method, write.path)
+		}
+		var errs errcode.Errors
+		if err := json.NewDecoder(w.Body).Decode(&errs); err != nil {
+			t.Fatalf("error decoding error response: %v", err)
+		}
+		if len(errs) != 1 || errs[0].(errcode.Error).Code != errcode.ErrorCodeUnavailable || errs[0].(errcode.Error).Message != "garbage collection" {
+			t.Fatalf("unexpected errors for %s %s: %v", write.method, write.path, errs)
+		}
+	}
+
+	// The reads continue, and the health checks do not fail.
+	if w := serve(http.MethodGet, "/v2/foo/bar/manifests/latest", ""); w.Code != http.StatusNotFound {
+		t.Fatalf("expected 404 reading unknown manifest, got %d", w.Code)
+	}
+	if checks := healthRegistry.CheckStatus(context.Background()); len(checks) != 0 {
+		t.Fatalf("unexpected failing health checks: %v", checks)
+	}
+	if notice := healthRegistry.NoticeStatus(context.Background())["readonly"]; !strings.HasSuffix(notice, ": garbage collection") {
+		t.Fatalf("unexpected read-only notice %q", notice)
+	}
+
+	// The mode persists in the storage.
+	marker, err := storage.GetReadOnlyMarker(context.Background(), app.driver)
+	if err != nil || marker == nil || marker.Message != "garbage collection" {
+		t.Fatalf("unexpected read-only marker %v: %v", marker, err)
+	}
+	restarted := newReadOnlyMode(context.Background(), map[any]any{"persist": true}, app.driver)
+	if status := restarted.get(); !status.Enabled || status.Message != "garbage collection" || !status.Since.Equal(marker.Since) {
+		t.Fatalf("unexpected read-only mode after restart %+v", status)
+	}
+
+	checkStatus(serve(http.MethodPut, "/v2/_admin/readonly", `{"enabled": false}`), readOnlyStatus{})
+	if w := serve(http.MethodPost, "/v2/foo/bar/blobs/uploads/", ""); w.Code != http.StatusAccepted {
+		t.Fatalf("expected 202 starting upload after read-only mode, got %d", w.Code)
+	}
+	if notice := healthRegistry.NoticeStatus(context.Background())["readonly"]; notice != "" {
+		t.Fatalf("unexpected read-only notice %q", notice)
+	}
+	if marker, err := storage.GetReadOnlyMarker(context.Background(), app.driver); err != nil || marker != nil {
+		t.Fatalf("unexpected read-only marker %v: %v", marker, err)
+	}
+}
+
+func TestReadOnlyAdminAPIWithoutAuth(t *testing.T) {
+	config := configuration.Configuration{
+		Storage: configuration.Storage{
+			"inmemory": nil,
+			"maintenance": configuration.Parameters{
+				"uploadpurging": map[any]any{"enabled": false},
+				"readonly":      map[any]any{"enabled": true, "message": "migration"},
+			},
+		},
+	}
+	app := NewApp(dcontext.Background(), &config)
+
+	// The mode enabled by the configuration refuses the writes.
+	r := httptest.NewRequest(http.MethodPost, "/v2/foo/bar/blobs/uploads/", nil)
+	w := httptest.NewRecorder()
+	app.ServeHTTP(w, r)
+	if w.Code != http.StatusServiceUnavailable || w.Header().Get("Retry-After") != "60" || !strings.Contains(w.Body.String(), "migration") {
+		t.Fatalf("unexpected response to write in read-only mode: %d %q", w.Code, w.Body)
+	}
+
+	// The admin API is not served without authentication.
+	r = httptest.NewRequest(http.MethodPut, "/v2/_admin/readonly", strings.NewReader(`{"enabled": false}`))
+	w = httptest.NewRecorder()
+	app.ServeHTTP(w, r)
+	if w.Code != http.StatusMethodNotAllowed {
+		t.Fatalf("expected 405 without authentication, got %d", w.Code)
+	}
+	if !app.readOnly.get().Enabled {
+		t.Fatal("expected the read-only mode to be kept")
+	}
+}
@@ -0,0 +1,334 @@
+package handlers
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/alicebob/miniredis/v2"
+	"github.com/distribution/distribution/v3/configuration"
+	storagedriver "github.com/distribution/distribution/v3/registry/storage/driver"
+	"github.com/distribution/distribution/v3/registry/storage/driver/factory"
+	"github.com/distribution/distribution/v3/registry/storage/driver/inmemory"
+	"github.com/distribution/reference"
+	"github.com/opencontainers/go-digest"
+	"github.com/redis/go-redis/v9"
+)
+
+// fakeSentinel answers the commands of the sentinel clients with the
+// address of its master.
+type fakeSentinel struct {
+	ln     net.Listener
+	mu     sync.Mutex
+	master string
+}
+
+func newFakeSentinel(t *testing.T, master string) *fakeSentinel {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("error listening: %v", err)
+	}
+	s := &fakeSentinel{ln: ln, master: master}
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go s.serve(conn)
+		}
+	}()
+	t.Cleanup(func() { ln.Close() })
+	return s
+}
+
+// failover makes master the master of the sentinel.
+func (s *fakeSentinel) failover(master string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.master = master
+}
+
+func (s *fakeSentinel) serve(conn net.Conn) {
+	defer conn.Close()
+	r := bufio.NewReader(conn)
+	for {
+		args, err := readCommand(r)
+		if err != nil {
+			return
+		}
+		var reply bytes.Buffer
+		switch cmd := strings.ToLower(args[0]); {
+		case cmd == "ping":
+			reply.WriteString("+PONG\r\n")
+		case cmd == "sentinel" && len(args) > 1 && strings.ToLower(args[1]) == "get-master-addr-by-name":
+			s.mu.Lock()
+			host, port, _ := net.SplitHostPort(s.master)
+			s.mu.Unlock()
+			fmt.Fprintf(&reply, "*2\r\n$%d\r\n%s\r\n$%d\r\n%s\r\n", len(host), host, len(port), port)
+		case cmd == "sentinel":
+			// The sentinels and replicas of the master.
+			reply.WriteString("*0\r\n")
+		case cmd == "subscribe":
+			for i, channel := range args[1:] {
+				fmt.Fprintf(&reply, "*3\r\n$9\r\nsubscribe\r\n$%d\r\n%s\r\n:%d\r\n", len(channel), channel, i+1)
+			}
+		default:
+			fmt.Fprintf(&reply, "-ERR unknown command '%s'\r\n", args[0])
+		}
+		if _, err := conn.Write(reply.Bytes()); err != nil {
+			return
+		}
+	}
+}
+
+// readCommand reads a command sent as an array of bulk strings.
+func readCommand(r *bufio.Reader) ([]string, error) {
+	readLine := func(prefix byte) (int, error) {
+		line, err := r.ReadString('\n')
+		if err != nil {
+			return 0, err
+		}
+		if len(line) < 3 || line[0] != prefix {
+			return 0, fmt.Errorf("unexpected line %q", line)
+		}
+		return strconv.Atoi(strings.TrimSuffix(line[1:], "\r\n"))
+	}
+	n, err := readLine('*')
+	if err != nil {
+		return nil, err
+	}
+	args := make([]string, n)
+	for i := range args {
+		size, err := readLine('$')
+		if err != nil {
+			return nil, err
+		}
+		p := make([]byte, size+2)
+		if _, err := io.ReadFull(r, p); err != nil {
+			return nil, err
+		}
+		args[i] = string(p[:size])
+	}
+	return args, nil
+}
+
+func TestRedisModes(t *testing.T) {
+	app := &App{}
+	for _, tc := range []struct {
+		mode    string
+		addrs   []string
+		master  string
+		cluster bool
+		addr    string
+	}{
+		{mode: "", addrs: []string{"127.0.0.1:6379"}, addr: "127.0.0.1:6379"},
+		{mode: "", addrs: []string{"127.0.0.1:7000", "127.0.0.1:7001"}, cluster: true},
+		{mode: "", addrs: []string{"127.0.0.1:26379"}, master: "mymaster", addr: "FailoverClient"},
+		{mode: configuration.RedisModeSingle, addrs: []string{"127.0.0.1:6379"}, addr: "127.0.0.1:6379"},
+		{mode: configuration.RedisModeSentinel, addrs: []string{"127.0.0.1:26379", "127.0.0.1:26380"}, master: "mymaster", addr: "FailoverClient"},
+		{mode: configuration.RedisModeCluster, addrs: []string{"127.0.0.1:7000"}, cluster: true},
+	} {
+		client := app.createPool(redis.UniversalOptions{Addrs: tc.addrs, MasterName: tc.master}, tc.mode)
+		switch c := client.(type) {
+		case *redis.ClusterClient:
+			if !tc.cluster {
+				t.Errorf("unexpected cluster client of mode %q and addrs %v", tc.mode, tc.addrs)
+			}
+		case *redis.Client:
+			if c.Options().Addr != tc.addr {
+				t.Errorf("unexpected client of %s for mode %q and addrs %v, expected %s", c.Options().Addr, tc.mode, tc.addrs, tc.addr)
+			}
+		default:
+			t.Errorf("unexpected client %T of mode %q", client, tc.mode)
+		}
+		client.Close()
+	}
+}
+
+func TestRedisSentinelFailover(t *testing.T) {
+	primary := miniredis.RunT(t)
+	replica := miniredis.RunT(t)
+	sentinel := newFakeSentinel(t, primary.Addr())
+
+	app := &App{}
+	client := app.createPool(redis.UniversalOptions{
+		Addrs:      []string{sentinel.ln.Addr().String()},
+		MasterName: "mymaster",
+	}, configuration.RedisModeSentinel)
+	defer client.Close()
+	check := redisCheck(client, 0)
+
+	ctx := context.Background()
+	if err := client.Set(ctx, "key", "primary", 0).Err(); err != nil {
+		t.Fatalf("unexpected error setting on the primary: %v", err)
+	}
+	if v, _ := primary.Get("key"); v != "primary" {
+		t.Fatalf("unexpected value on the primary: %q", v)
+	}
+	if err := check.Check(ctx); err != nil {
+		t.Fatalf("unexpected health check error: %v", err)
+	}
+
+	// The client reconnects to the master elected by the sentinels once
+	// the primary is gone.
+	sentinel.failover(replica.Addr())
+	primary.Close()
+	if err := client.Set(ctx, "key", "replica", 0).Err(); err != nil {
+		t.Fatalf("unexpected error setting after the failover: %v", err)
+	}
+	if v, _ := replica.Get("key"); v != "replica" {
+		t.Fatalf("unexpected value on the replica: %q", v)
+	}
+	if err := check.Check(ctx); err != nil {
+		t.Fatalf("unexpected health check error after the failover: %v", err)
+	}
+
+	replica.Close()
+	if err := check.Check(ctx); err == nil {
+		t.Fatal("expected the health check to fail without a master")
+	}
+}
+
+func TestRedisCachePassThrough(t *testing.T) {
+	server := miniredis.RunT(t)
+	config := configuration.Configuration{
+		Storage: configuration.Storage{
+			"inmemory": configuration.Parameters{},
+			"cache":    configuration.Parameters{"blobdescriptor": "redis"},
+			"maintenance": configuration.Parameters{"uploadpurging": map[any]any{
+				"enabled": false,
+			}},
+		},
+		Redis: configuration.Redis{
+			Mode: configuration.RedisModeSingle,
+			Options: configuration.RedisOptions{
+				Addrs:      []string{server.Addr()},
+				MaxRetries: -1,
+			},
+		},
+	}
+	config.HTTP.Headers = headerConfig
+	env := newTestEnvWithConfig(t, &config)
+	defer env.Shutdown()
+
+	imageName, _ := reference.WithName("foo/cached")
+	layer := []byte("some layer content")
+	dgst := digest.FromBytes(layer)
+	uploadURLBase, _ := startPushLayer(t, env, imageName)
+	pushLayer(t, env.builder, imageName, dgst, uploadURLBase, bytes.NewReader(layer))
+	if len(server.Keys()) == 0 {
+		t.Fatal("expected the descriptor to be cached")
+	}
+
+	// The blobs are served from the storage while redis is unreachable.
+	server.Close()
+	ref, _ := reference.WithDigest(imageName, dgst)
+	layerURL, err := env.builder.BuildBlobURL(ref)
+	checkErr(t, err, "building blob url")
+	resp, err := http.Head(layerURL)
+	checkErr(t, err, "checking layer")
+	defer resp.Body.Close()
+	checkResponse(t, "checking layer", resp, http.StatusOK)
+}
+
+// sharedDriverFactory creates the same driver for every instance of the
+// registry.
+type sharedDriverFactory struct {
+	driver storagedriver.StorageDriver
+}
+
+func (f *sharedDriverFactory) Create(ctx context.Context, parameters map[string]any) (storagedriver.StorageDriver, error) {
+	return f.driver, nil
+}
+
+var registerSharedInmemory sync.Once
+
+func TestRedisUploadSessions(t *testing.T) {
+	registerSharedInmemory.Do(func() {
+		factory.Register("sharedinmemory", &sharedDriverFactory{driver: inmemory.New()})
+	})
+	server := miniredis.RunT(t)
+	newInstance := func() *testEnv {
+		config := configuration.Configuration{
+			Storage: configuration.Storage{
+				"sharedinmemory": configuration.Parameters{},
+				"uploads":        configuration.Parameters{"sessionstore": "redis"},
+				"maintenance": configuration.Parameters{"uploadpurging": map[any]any{
+					"enabled": false,
+					"age":     "48h",
+				}},
+			},
+			Redis: configuration.Redis{
+				Options: configuration.RedisOptions{Addrs: []string{server.Addr()}},
+			},
+		}
+		config.HTTP.Headers = headerConfig
+		return newTestEnvWithConfig(t, &config)
+	}
+	// The instances sign the state of the uploads with their own secret, and
+	// resume them from the sessions kept in redis.
+	first, second := newInstance(), newInstance()
+	defer first.Shutdown()
+	defer second.Shutdown()
+	on := func(env *testEnv, location string) string {
+		u, err := url.Parse(location)
+		if err != nil {
+			t.Fatalf("error parsing location: %v", err)
+		}
+		server, _ := url.Parse(env.server.URL)
+		u.Host = server.Host
+		return u.String()
+	}
+
+	imageName, _ := reference.WithName("foo/sessions")
+	content := bytes.Repeat([]byte("0123456789"), 10000)
+	location, uuid := startPushLayer(t, first, imageName)
+	key := "repository::foo/sessions::uploads::" + uuid
+	if ttl := server.TTL(key); ttl != 48*time.Hour {
+		t.Fatalf("unexpected ttl %v of the session", ttl)
+	}
+
+	// The chunks are sent to either instance in turn.
+	envs := []*testEnv{second, first, second}
+	for i, env := range envs {
+		chunk := content[i*len(content)/len(envs) : (i+1)*len(content)/len(envs)]
+		location, _ = pushChunk(t, env.builder, imageName, on(env, location), bytes.NewReader(chunk), int64((i+1)*len(content)/len(envs)))
+		if version := server.HGet(key, "version"); version != strconv.Itoa(i+2) {
+			t.Fatalf("unexpected version %q of the session after chunk %d", version, i)
+		}
+	}
+	sessionPath := "/docker/registry/v2/repositories/foo/sessions/_uploads/" + uuid + "/session"
+	if _, err := first.app.driver.Stat(context.Background(), sessionPath); err == nil {
+		t.Fatal("expected the session not to be persisted in the storage")
+	}
+
+	dgst := digest.FromBytes(content)
+	layerURL := finishUpload(t, first.builder, imageName, on(first, location), dgst)
+	if server.Exists(key) {
+		t.Fatal("expected the session to be deleted once the upload completes")
+	}
+	resp, err := http.Get(on(second, layerURL))
+	if err != nil {
+		t.Fatalf("unexpected error fetching layer: %v", err)
+	}
+	defer resp.Body.Close()
+	checkResponse(t, "fetching uploaded layer", resp, http.StatusOK)
+	verifier := dgst.Verifier()
+	if _, err := io.Copy(verifier, resp.Body); err != nil {
+		t.Fatalf("unexpected error reading layer: %v", err)
+	}
+	if !verifier.Verified() {
+		t.Fatal("unexpected layer content")
+	}
+}
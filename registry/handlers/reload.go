@@ -0,0 +1,105 @@
+package handlers
+
+import (
+	"fmt"
+
+	"github.com/distribution/distribution/v3/configuration"
+	"github.com/distribution/distribution/v3/internal/dcontext"
+	"github.com/distribution/distribution/v3/registry/auth"
+)
+
+// ReloadAuth replaces the access controller with the one of the
+// configuration, and closes the replaced one. The current access controller
+// is kept if the new one fails to configure.
+func (app *App) ReloadAuth(config configuration.Auth) error {
+	app.reloadMu.Lock()
+	defer app.reloadMu.Unlock()
+
+	accessController, err := newAccessController(config)
+	if err != nil {
+		return err
+	}
+	app.authMu.Lock()
+	replaced := app.accessController
+	app.accessController = accessController
+	app.authMu.Unlock()
+	// The replaced access controller may still be authorizing requests,
+	// which are unaffected by its close.
+	if closer, ok := replaced.(auth.Closer); ok {
+		if err := closer.Close(); err != nil {
+			dcontext.GetLogger(app).Errorf("error closing the replaced access controller: %v", err)
+		}
+	}
+	dcontext.GetLogger(app).Infof("reloaded %q access controller", config.Type())
+	return nil
+}
+
+// ReloadNotifications replaces the notification endpoints with the ones of
+// the configuration. The current endpoints are kept if any of the new ones
+// fails to configure. The events queued by the replaced endpoints are
+// delivered in the background before they close.
+func (app *App) ReloadNotifications(config configuration.Notifications) error {
+	app.reloadMu.Lock()
+	defer app.reloadMu.Unlock()
+
+	if app.events.broadcaster == nil {
+		return fmt.Errorf("the notification endpoints cannot be replaced")
+	}
+	sinks, err := app.newEndpointSinks(config.Endpoints)
+	if err != nil {
+		return err
+	}
+	// The new endpoints are added before the replaced ones are removed, so
+	// that no event is missed by both.
+	for _, sink := range sinks {
+		if err := app.events.broadcaster.Add(sink); err != nil {
+			app.closeSinks(sinks)
+			return err
+		}
+	}
+	replaced := app.events.endpoints
+	for _, sink := range replaced {
+		if err := app.events.broadcaster.Remove(sink); err != nil {
+			dcontext.GetLogger(app).Errorf("error removing notification endpoint: %v", err)
+		}
+	}
+	app.events.endpoints = sinks
+	go app.closeSinks(replaced)
+	dcontext.GetLogger(app).Infof("reloaded %d notification endpoints", len(sinks))
+	return nil
+}
+
+// ReloadProxyTTL replaces the times the content cached from now on by the
+// pull through cache is cached for by the ttls of the config.
+func (app *App) ReloadProxyTTL(config configuration.Proxy) error {
+	app.reloadMu.Lock()
+	defer app.reloadMu.Unlock()
+
+	r, ok := app.registry.(interface {
+		SetTTL(configuration.Proxy) error
+	})
+	if !ok {
+		return fmt.Errorf("the registry is not a pull through cache")
+	}
+	if err := r.SetTTL(config); err != nil {
+		return err
+	}
+	dcontext.GetLogger(app).Infof("reloaded the proxy ttl")
+	return nil
+}
+
+// ReloadLogLevels replaces the overrides of the log level of the requests for
+// repositories by the ones of the configuration, logging with the current
+// output, formatter and hooks of the standard logger.
+func (app *App) ReloadLogLevels(config configuration.Log) error {
+	app.reloadMu.Lock()
+	defer app.reloadMu.Unlock()
+
+	logLevels, err := newRepositoryLogLevels(config.Repositories)
+	if err != nil {
+		return err
+	}
+	app.logLevels.Store(logLevels)
+	dcontext.GetLogger(app).Infof("reloaded %d repository log levels", len(config.Repositories))
+	return nil
+}
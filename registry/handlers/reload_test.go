@@ -0,0 +1,73 @@
+package handlers
+
+import (
+	"context"
+	"net/http"
+	"sync/atomic"
+	"testing"
+
+	"github.com/distribution/distribution/v3/configuration"
+	"github.com/distribution/distribution/v3/registry/auth"
+)
+
+func init() {
+	if err := auth.Register("closing", func(options map[string]any) (auth.AccessController, error) {
+		return &closingAccessController{}, nil
+	}); err != nil {
+		panic(err)
+	}
+}
+
+// closingAccessController grants every access, and counts its closes.
+type closingAccessController struct {
+	closed atomic.Int32
+}
+
+func (ac *closingAccessController) Authorized(r *http.Request, access ...auth.Access) (*auth.Grant, error) {
+	return &auth.Grant{}, nil
+}
+
+func (ac *closingAccessController) Close() error {
+	ac.closed.Add(1)
+	return nil
+}
+
+func TestReloadAuthClosesReplaced(t *testing.T) {
+	config := configuration.Configuration{
+		Storage: configuration.Storage{
+			"inmemory": configuration.Parameters{},
+			"maintenance": configuration.Parameters{"uploadpurging": map[any]any{
+				"enabled": false,
+			}},
+		},
+		Auth: configuration.Auth{"closing": configuration.Parameters{}},
+	}
+	app := NewApp(context.Background(), &config)
+	first := app.accessController.(*closingAccessController)
+
+	if err := app.ReloadAuth(config.Auth); err != nil {
+		t.Fatal(err)
+	}
+	second := app.accessController.(*closingAccessController)
+	if second == first {
+		t.Fatal("the access controller was not replaced")
+	}
+	if first.closed.Load() != 1 || second.closed.Load() != 0 {
+		t.Fatalf("unexpected closes after the reload: replaced %d, current %d", first.closed.Load(), second.closed.Load())
+	}
+
+	// A failed reload keeps the current access controller open.
+	if err := app.ReloadAuth(configuration.Auth{"unknown": configuration.Parameters{}}); err == nil {
+		t.Fatal("expected an error reloading an unknown access controller")
+	}
+	if app.accessController != second || second.closed.Load() != 0 {
+		t.Fatal("the current access controller was replaced or closed by a failed reload")
+	}
+
+	if err := app.Shutdown(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if second.closed.Load() != 1 {
+		t.Fatal("the access controller was not closed on shutdown")
+	}
+}
@@ -0,0 +1,334 @@
+package handlers
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/distribution/distribution/v3"
+	"github.com/distribution/distribution/v3/internal/dcontext"
+	"github.com/distribution/distribution/v3/registry/api/errcode"
+	v2 "github.com/distribution/distribution/v3/registry/api/v2"
+	"github.com/distribution/distribution/v3/registry/storage"
+	"github.com/distribution/reference"
+	"github.com/gorilla/handlers"
+	"github.com/gorilla/mux"
+)
+
+const (
+	// renameRetryAfter is how long the clients whose writes are refused
+	// while a repository is renamed are asked to wait before retrying.
+	renameRetryAfter = 10 * time.Second
+	// maxRenameRequestSize is the maximum size of the body of a request
+	// renaming a repository.
+	maxRenameRequestSize = 64 << 10
+)
+
+// renameGuard refuses the writes to the repositories being renamed, and holds
+// their rename until the writes in progress complete. It only covers the
+// requests served by this instance of the registry.
+type renameGuard struct {
+	mu       sync.Mutex
+	cond     *sync.Cond
+	writes   map[string]int
+	renaming map[string]struct{}
+}
+
+func newRenameGuard() *renameGuard {
+	g := &renameGuard{
+		writes:   make(map[string]int),
+		renaming: make(map[string]struct{}),
+	}
+	g.cond = sync.NewCond(&g.mu)
+	return g
+}
+
+// startWrite records a write to the repository, and returns false if the
+// repository is being renamed.
+func (g *renameGuard) startWrite(name string) bool {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	if _, ok := g.renaming[name]; ok {
+		return false
+	}
+	g.writes[name]++
+	return true
+}
+
+// endWrite records that a write started to the repository completed.
+func (g *renameGuard) endWrite(name string) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	g.writes[name]--
+	if g.writes[name] == 0 {
+		delete(g.writes, name)
+	}
+	g.cond.Broadcast()
+}
+
+// lock refuses the writes to the repositories, and waits for those in
+// progress. It returns false if one of the repositories is already being
+// renamed.
+func (g *renameGuard) lock(names ...string) bool {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	for _, name := range names {
+		if _, ok := g.renaming[name]; ok {
+			return false
+		}
+	}
+	for _, name := range names {
+		g.renaming[name] = struct{}{}
+	}
+	for g.writing(names) {
+		g.cond.Wait()
+	}
+	return true
+}
+
+// unlock accepts the writes to the repositories again.
+func (g *renameGuard) unlock(names ...string) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	for _, name := range names {
+		delete(g.renaming, name)
+	}
+}
+
+func (g *renameGuard) writing(names []string) bool {
+	for _, name := range names {
+		if g.writes[name] > 0 {
+			return true
+		}
+	}
+	return false
+}
+
+// checkRename refuses the writes to a repository being renamed with a 503,
+// and those to the previous name of a renamed repository with NAME_MOVED.
+// The marker of the previous name is only read by the requests opening an
+// upload or putting a manifest, which the other writes follow, so that they
+// are not slowed down. The write accepted must be ended by the function
+// returned once served.
+func (app *App) checkRename(w http.ResponseWriter, r *http.Request, context *Context) (func(), error) {
+	name := getName(context)
+	if !isWrite(r) || name == "" {
+		return func() {}, nil
+	}
+	if !app.renames.startWrite(name) {
+		w.Header().Set("Retry-After", strconv.Itoa(int(renameRetryAfter.Seconds())))
+		if err := errcode.ServeJSON(w, errcode.ErrorCodeUnavailable.WithMessage("repository is being renamed")); err != nil {
+			dcontext.GetLogger(context).Errorf("error serving error json: %v (from %v)", err, context.Errors)
+		}
+		return nil, fmt.Errorf("repository %s is being renamed", name)
+	}
+	endWrite := func() { app.renames.endWrite(name) }
+	if !opensWrite(r) {
+		return endWrite, nil
+	}
+
+	marker, err := storage.GetRepositoryMoved(context, app.driver, name)
+	if err != nil {
+		endWrite()
+		if err := errcode.ServeJSON(w, errcode.ErrorCodeUnknown.WithDetail(fmt.Errorf("error reading the moved marker: %v", err))); err != nil {
+			dcontext.GetLogger(context).Errorf("error serving error json: %v (from %v)", err, context.Errors)
+		}
+		return nil, fmt.Errorf("error reading the moved marker of %s: %v", name, err)
+	}
+	if marker != nil {
+		endWrite()
+		if err := errcode.ServeJSON(w, errcode.ErrorCodeNameMoved.WithDetail(map[string]string{"name": marker.Name})); err != nil {
+			dcontext.GetLogger(context).Errorf("error serving error json: %v (from %v)", err, context.Errors)
+		}
+		return nil, fmt.Errorf("repository %s was renamed to %s", name, marker.Name)
+	}
+	return endWrite, nil
+}
+
+// opensWrite reports whether the request opens an upload or puts a manifest.
+func opensWrite(r *http.Request) bool {
+	route := mux.CurrentRoute(r)
+	if route == nil {
+		return false
+	}
+	switch route.GetName() {
+	case v2.RouteNameBlobUpload:
+		return r.Method == http.MethodPost
+	case v2.RouteNameManifest:
+		return r.Method == http.MethodPut
+	}
+	return false
+}
+
+// redirectMoved redirects the read of the previous name of a renamed
+// repository, which failed with errs, to its new name, and returns whether it
+// did. The marker is only read once the repository is found unknown, so that
+// the reads of the other repositories are not slowed down.
+func (app *App) redirectMoved(w http.ResponseWriter, r *http.Request, context *Context) bool {
+	name := getName(context)
+	if (r.Method != http.MethodGet && r.Method != http.MethodHead) || name == "" {
+		return false
+	}
+	unknown := false
+	for _, err := range context.Errors {
+		if coder, ok := err.(errcode.ErrorCoder); ok {
+			switch coder.ErrorCode() {
+			case errcode.ErrorCodeNameUnknown, errcode.ErrorCodeManifestUnknown, errcode.ErrorCodeBlobUnknown:
+				unknown = true
+			}
+		}
+	}
+	if !unknown {
+		return false
+	}
+	marker, err := storage.GetRepositoryMoved(context, app.driver, name)
+	if err != nil {
+		dcontext.GetLogger(context).Errorf("error reading the moved marker of %s: %v", name, err)
+		return false
+	}
+	if marker == nil {
+		return false
+	}
+
+	baseURL, err := context.urlBuilder.BuildBaseURL()
+	if err != nil {
+		dcontext.GetLogger(context).Errorf("error building the url of %s: %v", marker.Name, err)
+		return false
+	}
+	prefix := "/v2/" + name + "/"
+	i := strings.Index(r.URL.Path, prefix)
+	if i < 0 {
+		return false
+	}
+	location := baseURL + marker.Name + "/" + r.URL.Path[i+len(prefix):]
+	if r.URL.RawQuery != "" {
+		location += "?" + r.URL.RawQuery
+	}
+	w.Header().Set("Location", location)
+	if err := errcode.ServeJSON(w, errcode.ErrorCodeNameMoved.WithDetail(map[string]string{"name": marker.Name})); err != nil {
+		dcontext.GetLogger(context).Errorf("error serving error json: %v (from %v)", err, context.Errors)
+	}
+	dcontext.GetLogger(context).Infof("redirected to the repository %s renamed from %s", marker.Name, name)
+	return true
+}
+
+// adminRenameDispatcher constructs the handler of the rename of the
+// repositories, served as part of the admin API.
+func adminRenameDispatcher(ctx *Context, r *http.Request) http.Handler {
+	ctx.App.authMu.RLock()
+	authenticated := ctx.App.accessController != nil
+	ctx.App.authMu.RUnlock()
+	if !authenticated {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			ctx.Errors = append(ctx.Errors, errcode.ErrorCodeUnsupported.WithMessage("the admin API requires authentication to be configured"))
+		})
+	}
+	renamer, ok := ctx.App.registry.(distribution.RepositoryRenamer)
+	if !ok {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			ctx.Errors = append(ctx.Errors, errcode.ErrorCodeUnsupported.WithMessage("the registry does not support renaming repositories"))
+		})
+	}
+
+	renameHandler := &renameHandler{
+		Context: ctx,
+		renamer: renamer,
+	}
+
+	return handlers.MethodHandler{
+		http.MethodPost: http.HandlerFunc(renameHandler.PostRename),
+	}
+}
+
+// renameHandler handles the requests renaming the repositories.
+type renameHandler struct {
+	*Context
+	renamer distribution.RepositoryRenamer
+}
+
+// renameRequest is the body of a request renaming a repository.
+type renameRequest struct {
+	Name     string `json:"name"`
+	Redirect bool   `json:"redirect"`
+}
+
+// renameAPIResponse is the response to the rename of a repository.
+type renameAPIResponse struct {
+	Name     string `json:"name"`
+	From     string `json:"from"`
+	Redirect bool   `json:"redirect"`
+}
+
+// PostRename renames the repository to the name of the request, leaving a
+// marker redirecting its previous name if requested.
+func (rh *renameHandler) PostRename(w http.ResponseWriter, r *http.Request) {
+	fromName := dcontext.GetStringValue(rh, "vars.repository")
+	from, err := reference.WithName(fromName)
+	if err != nil {
+		rh.Errors = append(rh.Errors, errcode.ErrorCodeNameInvalid.WithDetail(distribution.ErrRepositoryNameInvalid{Name: fromName, Reason: err}))
+		return
+	}
+	var request renameRequest
+	if err := json.NewDecoder(io.LimitReader(r.Body, maxRenameRequestSize)).Decode(&request); err != nil {
+		rh.Errors = append(rh.Errors, errcode.ErrorCodeAdminRequestInvalid.WithDetail(err.Error()))
+		return
+	}
+	to, err := reference.WithName(request.Name)
+	if err != nil {
+		rh.Errors = append(rh.Errors, errcode.ErrorCodeNameInvalid.WithDetail(distribution.ErrRepositoryNameInvalid{Name: request.Name, Reason: err}))
+		return
+	}
+	if to.Name() == from.Name() {
+		rh.Errors = append(rh.Errors, errcode.ErrorCodeAdminRequestInvalid.WithDetail("the repository is renamed to its own name"))
+		return
+	}
+	if rh.App.readOnly.get().Enabled {
+		rh.Errors = append(rh.Errors, errcode.ErrorCodeUnavailable.WithMessage("registry is in read-only mode"))
+		return
+	}
+
+	if !rh.App.renames.lock(from.Name(), to.Name()) {
+		rh.Errors = append(rh.Errors, errcode.ErrorCodeUnavailable.WithMessage("repository is being renamed"))
+		return
+	}
+	defer rh.App.renames.unlock(from.Name(), to.Name())
+
+	if err := rh.renamer.Rename(rh, from, to); err != nil {
+		switch err := err.(type) {
+		case distribution.ErrRepositoryUnknown:
+			rh.Errors = append(rh.Errors, errcode.ErrorCodeNameUnknown.WithDetail(err))
+		case distribution.ErrRepositoryExists:
+			rh.Errors = append(rh.Errors, errcode.ErrorCodeAdminRequestInvalid.WithDetail(err.Error()))
+		case distribution.ErrQuotaExceeded:
+			rh.Errors = append(rh.Errors, quotaExceeded(err))
+		default:
+			rh.Errors = append(rh.Errors, errcode.ErrorCodeUnknown.WithDetail(err))
+		}
+		return
+	}
+	dcontext.GetLogger(rh).Warnf("repository %s renamed to %s by %s", from.Name(), to.Name(), getUserName(rh, r))
+
+	if request.Redirect {
+		if err := storage.PutRepositoryMoved(rh, rh.App.driver, from.Name(), storage.RepositoryMoved{Name: to.Name(), Since: time.Now()}); err != nil {
+			rh.Errors = append(rh.Errors, errcode.ErrorCodeUnknown.WithDetail(fmt.Errorf("repository renamed, but its previous name could not be redirected: %v", err)))
+			return
+		}
+	}
+	if err := rh.App.eventBridge(rh.Context, r).RepoRenamed(to, from); err != nil {
+		dcontext.GetLogger(rh).Errorf("error dispatching repository rename to listener: %v", err)
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(renameAPIResponse{
+		Name:     to.Name(),
+		From:     from.Name(),
+		Redirect: request.Redirect,
+	}); err != nil {
+		rh.Errors = append(rh.Errors, errcode.ErrorCodeUnknown.WithDetail(err))
+	}
+}
@@ -0,0 +1,219 @@
+package handlers
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/distribution/distribution/v3/internal/dcontext"
+	"github.com/distribution/distribution/v3/notifications"
+	"github.com/distribution/distribution/v3/registry/api/errcode"
+	"github.com/distribution/distribution/v3/testutil"
+	"github.com/distribution/reference"
+	events "github.com/docker/go-events"
+	"github.com/opencontainers/go-digest"
+	v1 "github.com/opencontainers/image-spec/specs-go/v1"
+)
+
+type renameEventSink struct {
+	mu      sync.Mutex
+	renames []notifications.Event
+}
+
+func (s *renameEventSink) Write(event events.Event) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if e, ok := event.(notifications.Event); ok && e.Action == notifications.EventActionRename {
+		s.renames = append(s.renames, e)
+	}
+	return nil
+}
+
+func (s *renameEventSink) Close() error { return nil }
+
+// seedRepository pushes an image tagged latest to the repository name.
+func seedRepository(t *testing.T, app *App, name string) digest.Digest {
+	t.Helper()
+	ctx := dcontext.Background()
+	named, err := reference.WithName(name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	repo, err := app.registry.Repository(ctx, named)
+	if err != nil {
+		t.Fatal(err)
+	}
+	layers, err := testutil.CreateRandomLayers(2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := testutil.UploadBlobs(repo, layers); err != nil {
+		t.Fatal(err)
+	}
+	var digests []digest.Digest
+	for dgst := range layers {
+		digests = append(digests, dgst)
+	}
+	manifest, err := testutil.MakeSchema2Manifest(repo, digests)
+	if err != nil {
+		t.Fatal(err)
+	}
+	manifests, err := repo.Manifests(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	dgst, err := manifests.Put(ctx, manifest)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := repo.Tags(ctx).Tag(ctx, "latest", v1.Descriptor{Digest: dgst}); err != nil {
+		t.Fatal(err)
+	}
+	return dgst
+}
+
+func TestRenameAdminAPI(t *testing.T) {
+	config := adminConfig()
+	app := NewApp(dcontext.Background(), &config)
+	sink := &renameEventSink{}
+	app.events.sink = sink
+	dgst := seedRepository(t, app, "team/app")
+	seedRepository(t, app, "shared")
+
+	serve := func(method, path, body string) *httptest.ResponseRecorder {
+		t.Helper()
+		r := httptest.NewRequest(method, path, strings.NewReader(body))
+		r.Header.Set("Authorization", "Bearer admin")
+		w := httptest.NewRecorder()
+		app.ServeHTTP(w, r)
+		return w
+	}
+	checkError := func(w *httptest.ResponseRecorder, status int, code errcode.ErrorCode) {
+		t.Helper()
+		if w.Code != status {
+			t.Fatalf("unexpected status %d, expected %d: %s", w.Code, status, w.Body)
+		}
+		var errs errcode.Errors
+		if err := json.NewDecoder(w.Body).Decode(&errs); err != nil {
+			t.Fatalf("error decoding errors: %v", err)
+		}
+		if len(errs) != 1 || errs[0].(errcode.Error).Code != code {
+			t.Fatalf("unexpected errors %v, expected %s", errs, code)
+		}
+	}
+
+	// The admin API requires authentication.
+	r := httptest.NewRequest(http.MethodPost, "/v2/_admin/repositories/team/app/rename", strings.NewReader(`{"name": "platform/app"}`))
+	w := httptest.NewRecorder()
+	app.ServeHTTP(w, r)
+	if w.Code != http.StatusUnauthorized {
+		t.Fatalf("expected 401 without authentication, got %d", w.Code)
+	}
+	if challenge := w.Header().Get("WWW-Authenticate"); !strings.Contains(challenge, `scope="registry:admin:*"`) {
+		t.Fatalf("unexpected challenge %q", challenge)
+	}
+
+	checkError(serve(http.MethodPost, "/v2/_admin/repositories/team/app/rename", `{"name":`), http.StatusBadRequest, errcode.ErrorCodeAdminRequestInvalid)
+	checkError(serve(http.MethodPost, "/v2/_admin/repositories/team/app/rename", `{"name": "Invalid"}`), http.StatusBadRequest, errcode.ErrorCodeNameInvalid)
+	checkError(serve(http.MethodPost, "/v2/_admin/repositories/team/app/rename", `{"name": "team/app"}`), http.StatusBadRequest, errcode.ErrorCodeAdminRequestInvalid)
+	checkError(serve(http.MethodPost, "/v2/_admin/repositories/team/app/rename", `{"name": "shared"}`), http.StatusBadRequest, errcode.ErrorCodeAdminRequestInvalid)
+	checkError(serve(http.MethodPost, "/v2/_admin/repositories/team/unknown/rename", `{"name": "platform/app"}`), http.StatusNotFound, errcode.ErrorCodeNameUnknown)
+
+	w = serve(http.MethodPost, "/v2/_admin/repositories/team/app/rename", `{"name": "platform/app", "redirect": true}`)
+	if w.Code != http.StatusOK {
+		t.Fatalf("unexpected status %d: %s", w.Code, w.Body)
+	}
+	var response renameAPIResponse
+	if err := json.NewDecoder(w.Body).Decode(&response); err != nil {
+		t.Fatal(err)
+	}
+	if response != (renameAPIResponse{Name: "platform/app", From: "team/app", Redirect: true}) {
+		t.Fatalf("unexpected response %+v", response)
+	}
+	if len(sink.renames) != 1 || sink.renames[0].Target.Repository != "platform/app" || sink.renames[0].Target.FromRepository != "team/app" {
+		t.Fatalf("unexpected rename events %+v", sink.renames)
+	}
+
+	if w := serve(http.MethodGet, "/v2/platform/app/manifests/latest", ""); w.Code != http.StatusOK || w.Header().Get("Docker-Content-Digest") != dgst.String() {
+		t.Fatalf("unexpected response to the manifest of the renamed repository %d: %s", w.Code, w.Body)
+	}
+
+	// The reads of the previous name are redirected, its writes refused.
+	w = serve(http.MethodGet, "/v2/team/app/manifests/latest?ns=example", "")
+	if location := w.Header().Get("Location"); !strings.HasSuffix(location, "/v2/platform/app/manifests/latest?ns=example") {
+		t.Fatalf("unexpected location %q", location)
+	}
+	checkError(w, http.StatusMovedPermanently, errcode.ErrorCodeNameMoved)
+	w = serve(http.MethodPost, "/v2/team/app/blobs/uploads/", "")
+	if location := w.Header().Get("Location"); location != "" {
+		t.Fatalf("unexpected location %q of a write", location)
+	}
+	checkError(w, http.StatusMovedPermanently, errcode.ErrorCodeNameMoved)
+	checkError(serve(http.MethodPut, "/v2/team/app/manifests/latest", "{}"), http.StatusMovedPermanently, errcode.ErrorCodeNameMoved)
+
+	// Without redirect, the previous name is unknown.
+	w = serve(http.MethodPost, "/v2/_admin/repositories/platform/app/rename", `{"name": "other/app"}`)
+	if w.Code != http.StatusOK {
+		t.Fatalf("unexpected status %d: %s", w.Code, w.Body)
+	}
+	checkError(serve(http.MethodGet, "/v2/platform/app/manifests/latest", ""), http.StatusNotFound, errcode.ErrorCodeManifestUnknown)
+	if w := serve(http.MethodGet, "/v2/other/app/manifests/latest", ""); w.Code != http.StatusOK {
+		t.Fatalf("unexpected response to the manifest of the renamed repository %d: %s", w.Code, w.Body)
+	}
+
+	// The writes and the renames of a repository being renamed are refused.
+	if !app.renames.lock("other/app") {
+		t.Fatal("expected the repository to be locked")
+	}
+	w = serve(http.MethodPost, "/v2/other/app/blobs/uploads/", "")
+	if w.Header().Get("Retry-After") == "" {
+		t.Fatal("expected a Retry-After header")
+	}
+	checkError(w, http.StatusServiceUnavailable, errcode.ErrorCodeUnavailable)
+	checkError(serve(http.MethodPost, "/v2/_admin/repositories/other/app/rename", `{"name": "next/app"}`), http.StatusServiceUnavailable, errcode.ErrorCodeUnavailable)
+	app.renames.unlock("other/app")
+	if w := serve(http.MethodPost, "/v2/other/app/blobs/uploads/", ""); w.Code != http.StatusAccepted {
+		t.Fatalf("unexpected status %d of the upload once renamed: %s", w.Code, w.Body)
+	}
+}
+
+func TestRenameGuard(t *testing.T) {
+	g := newRenameGuard()
+	if !g.startWrite("app") {
+		t.Fatal("expected the write to be accepted")
+	}
+
+	// The rename waits for the write in progress.
+	locked := make(chan bool)
+	go func() { locked <- g.lock("app", "renamed") }()
+	for {
+		g.mu.Lock()
+		_, renaming := g.renaming["app"]
+		g.mu.Unlock()
+		if renaming {
+			break
+		}
+	}
+	select {
+	case <-locked:
+		t.Fatal("expected the rename to wait for the write")
+	default:
+	}
+	if g.startWrite("renamed") {
+		t.Fatal("expected the write to the new name to be refused")
+	}
+	g.endWrite("app")
+	if !<-locked {
+		t.Fatal("expected the repositories to be locked")
+	}
+	if g.lock("renamed") {
+		t.Fatal("expected the repository already renamed to be refused")
+	}
+	g.unlock("app", "renamed")
+	if !g.startWrite("app") {
+		t.Fatal("expected the write to be accepted once renamed")
+	}
+}
@@ -0,0 +1,203 @@
+package handlers
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/distribution/reference"
+	"github.com/opencontainers/go-digest"
+	"golang.org/x/crypto/bcrypt"
+
+	"github.com/distribution/distribution/v3/configuration"
+	v2 "github.com/distribution/distribution/v3/registry/api/v2"
+	_ "github.com/distribution/distribution/v3/registry/auth/htpasswd"
+	"github.com/distribution/distribution/v3/registry/replication"
+)
+
+// newReplicationTestEnv returns a test env of a registry storing its content
+// in dir, or in memory if empty, replicating to the peers.
+func newReplicationTestEnv(t *testing.T, dir string, peers ...configuration.ReplicationPeer) *testEnv {
+	config := configuration.Configuration{
+		Storage: configuration.Storage{
+			"inmemory": configuration.Parameters{},
+			"maintenance": configuration.Parameters{"uploadpurging": map[any]any{
+				"enabled": false,
+			}},
+		},
+		Replication: configuration.Replication{
+			Backoff:    10 * time.Millisecond,
+			MaxBackoff: 100 * time.Millisecond,
+			Peers:      peers,
+		},
+	}
+	if dir != "" {
+		config.Storage = configuration.Storage{
+			"filesystem": configuration.Parameters{"rootdirectory": dir},
+			"maintenance": configuration.Parameters{"uploadpurging": map[any]any{
+				"enabled": false,
+			}},
+		}
+	}
+	config.HTTP.Headers = headerConfig
+	env := newTestEnvWithConfig(t, &config)
+	t.Cleanup(func() {
+		env.Shutdown()
+		env.app.Shutdown(context.Background())
+	})
+	return env
+}
+
+// waitForTag waits until the tag of the repository of env points to dgst.
+func waitForTag(t *testing.T, env *testEnv, name, tag string, dgst digest.Digest) {
+	t.Helper()
+	named, _ := reference.WithName(name)
+	repo, err := env.app.registry.Repository(env.ctx, named)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for deadline := time.Now().Add(10 * time.Second); ; time.Sleep(10 * time.Millisecond) {
+		desc, err := repo.Tags(env.ctx).Get(env.ctx, tag)
+		if err == nil && desc.Digest == dgst {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("timed out waiting for %s:%s to be replicated: %v", name, tag, err)
+		}
+	}
+	manifests, err := repo.Manifests(env.ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	m, err := manifests.Get(env.ctx, dgst)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, desc := range m.References() {
+		if _, err := repo.Blobs(env.ctx).Stat(env.ctx, desc.Digest); err != nil {
+			t.Fatalf("blob %s not replicated: %v", desc.Digest, err)
+		}
+	}
+}
+
+// newReplicationUsers writes an htpasswd file of the users, all with the
+// password "password", and returns its path.
+func newReplicationUsers(t *testing.T, users ...string) string {
+	t.Helper()
+	hash, err := bcrypt.GenerateFromPassword([]byte("password"), bcrypt.MinCost)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var content string
+	for _, user := range users {
+		content += user + ":" + string(hash) + "\n"
+	}
+	path := filepath.Join(t.TempDir(), "htpasswd")
+	if err := os.WriteFile(path, []byte(content), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+// TestReplication pushes to a registry replicating to a peer, itself
+// replicating to a downstream registry, and checks that the pushes of the
+// replication are not replicated again, while a client announcing the actor
+// of the replication is.
+func TestReplication(t *testing.T) {
+	downstream := newReplicationTestEnv(t, "")
+
+	// The replication authenticates to the peer as the user of the
+	// credentials the peer has for its own peer.
+	peerConfig := configuration.Configuration{
+		Storage: configuration.Storage{
+			"inmemory": configuration.Parameters{},
+			"maintenance": configuration.Parameters{"uploadpurging": map[any]any{
+				"enabled": false,
+			}},
+		},
+		Auth: configuration.Auth{"htpasswd": configuration.Parameters{
+			"realm": "test-realm",
+			"path":  newReplicationUsers(t, "replicator", "client"),
+		}},
+		Replication: configuration.Replication{
+			Backoff:    10 * time.Millisecond,
+			MaxBackoff: 100 * time.Millisecond,
+			Peers: []configuration.ReplicationPeer{
+				{Name: "downstream", URL: downstream.server.URL, Username: "replicator", Password: "password"},
+			},
+		},
+	}
+	peerConfig.HTTP.Headers = headerConfig
+	peer := newTestEnvWithConfig(t, &peerConfig)
+	t.Cleanup(func() {
+		peer.Shutdown()
+		peer.app.Shutdown(context.Background())
+	})
+	local := newReplicationTestEnv(t, "", configuration.ReplicationPeer{Name: "peer", URL: peer.server.URL, Username: "replicator", Password: "password"})
+
+	dgst := createRepository(local, t, "foo/replicated", "latest")
+	waitForTag(t, peer, "foo/replicated", "latest", dgst)
+
+	// The pushes of a client to the peer itself are replicated, even if it
+	// announces the actor of the replication, after the replicated push
+	// which was queued first if it was.
+	client := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		r.SetBasicAuth("client", "password")
+		r.Header.Set(replication.ActorHeader, configuration.DefaultReplicationActor)
+		peer.server.Config.Handler.ServeHTTP(w, r)
+	}))
+	defer client.Close()
+	builder, err := v2.NewURLBuilderFromString(client.URL, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	clientEnv := *peer
+	clientEnv.server = client
+	clientEnv.builder = builder
+	direct := createRepository(&clientEnv, t, "foo/direct", "latest")
+	waitForTag(t, downstream, "foo/direct", "latest", direct)
+	named, _ := reference.WithName("foo/replicated")
+	repo, err := downstream.app.registry.Repository(downstream.ctx, named)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := repo.Tags(downstream.ctx).Get(downstream.ctx, "latest"); err == nil {
+		t.Fatal("unexpected replication of the push of the replication")
+	}
+}
+
+// TestReplicationPeerDown checks that the pushes are replicated once the peer
+// is back up, after a restart of the registry.
+func TestReplicationPeerDown(t *testing.T) {
+	peer := newReplicationTestEnv(t, "")
+	var down atomic.Bool
+	down.Store(true)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if down.Load() {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		peer.server.Config.Handler.ServeHTTP(w, r)
+	}))
+	defer server.Close()
+
+	dir := t.TempDir()
+	peers := []configuration.ReplicationPeer{{Name: "peer", URL: server.URL}}
+	local := newReplicationTestEnv(t, dir, peers...)
+	dgst := createRepository(local, t, "foo/queued", "latest")
+	// Give the replication a few attempts before the restart.
+	time.Sleep(100 * time.Millisecond)
+	local.Shutdown()
+	if err := local.app.Shutdown(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+
+	down.Store(false)
+	newReplicationTestEnv(t, dir, peers...)
+	waitForTag(t, peer, "foo/queued", "latest", dgst)
+}
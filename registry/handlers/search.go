@@ -0,0 +1,313 @@
+package handlers
+
+import (
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+
+	"github.com/distribution/distribution/v3"
+	"github.com/distribution/distribution/v3/internal/dcontext"
+	"github.com/distribution/distribution/v3/registry/api/errcode"
+	"github.com/distribution/distribution/v3/registry/auth"
+	"github.com/distribution/reference"
+	"github.com/gorilla/handlers"
+	"github.com/opencontainers/go-digest"
+)
+
+const (
+	// searchTypeRepository searches the names of the repositories.
+	searchTypeRepository = "repo"
+	// searchTypeTag searches the references of the tags.
+	searchTypeTag = "tag"
+)
+
+// maxSearchTermLength is the length of the longest reference of a tag.
+const maxSearchTermLength = reference.RepositoryNameTotalLengthMax + 1 + 128
+
+// searchPageSize is the number of repositories listed at once from the
+// catalog index when it is searched.
+const searchPageSize = 1000
+
+func searchDispatcher(ctx *Context, r *http.Request) http.Handler {
+	searchHandler := &searchHandler{
+		Context: ctx,
+	}
+
+	return handlers.MethodHandler{
+		http.MethodGet: http.HandlerFunc(searchHandler.GetSearch),
+	}
+}
+
+type searchHandler struct {
+	*Context
+}
+
+type searchRepositoriesAPIResponse struct {
+	Repositories []string `json:"repositories"`
+}
+
+type searchTagsAPIResponse struct {
+	Tags []searchTag `json:"tags"`
+}
+
+// searchTag is a tag matching a search, with the digest of its manifest.
+type searchTag struct {
+	Name   string        `json:"name"`
+	Tag    string        `json:"tag"`
+	Digest digest.Digest `json:"digest"`
+}
+
+// GetSearch returns the repositories, or the tags, of the catalog index
+// matching the term, among those the client may pull from.
+func (sh *searchHandler) GetSearch(w http.ResponseWriter, r *http.Request) {
+	if !sh.App.Config.Catalog.Search.Enabled || sh.App.catalogIndex == nil {
+		sh.Errors = append(sh.Errors, errcode.ErrorCodeUnsupported.WithMessage("search is not enabled"))
+		return
+	}
+
+	q := r.URL.Query()
+	term := strings.ToLower(q.Get("q"))
+	if term == "" || len(term) > maxSearchTermLength {
+		sh.Errors = append(sh.Errors, errcode.ErrorCodeSearchInvalid.WithDetail(map[string]string{"q": q.Get("q")}))
+		return
+	}
+	searchType := q.Get("type")
+	if searchType == "" {
+		searchType = searchTypeRepository
+	}
+	if searchType != searchTypeRepository && searchType != searchTypeTag {
+		sh.Errors = append(sh.Errors, errcode.ErrorCodeSearchInvalid.WithDetail(map[string]string{"type": searchType}))
+		return
+	}
+
+	entries := defaultReturnedEntries
+	maximumConfiguredEntries := sh.App.Config.Catalog.MaxEntries
+	if n := q.Get("n"); n != "" {
+		parsedMax, err := strconv.Atoi(n)
+		if err != nil || parsedMax < 0 || parsedMax > maximumConfiguredEntries {
+			sh.Errors = append(sh.Errors, errcode.ErrorCodePaginationNumberInvalid.WithDetail(map[string]string{"n": n}))
+			return
+		}
+		entries = parsedMax
+	}
+	entries = min(entries, maximumConfiguredEntries)
+
+	var (
+		response  any
+		lastEntry string
+		more      bool
+		err       error
+	)
+	switch searchType {
+	case searchTypeRepository:
+		var repos []string
+		repos, more, err = sh.searchRepositories(r, term, entries, q.Get("last"))
+		if len(repos) > 0 {
+			lastEntry = repos[len(repos)-1]
+		}
+		response = searchRepositoriesAPIResponse{Repositories: repos}
+	case searchTypeTag:
+		var tags []searchTag
+		tags, more, err = sh.searchTags(r, term, entries, q.Get("last"))
+		if len(tags) > 0 {
+			lastEntry = tags[len(tags)-1].Name + ":" + tags[len(tags)-1].Tag
+		}
+		response = searchTagsAPIResponse{Tags: tags}
+	}
+	if err != nil {
+		if errors.Is(err, auth.ErrUnavailable) {
+			sh.Errors = append(sh.Errors, errcode.ErrorCodeUnavailable.WithDetail(err))
+		} else {
+			sh.Errors = append(sh.Errors, errcode.ErrorCodeUnknown.WithDetail(err))
+		}
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+
+	// Add a link header if there are more entries to retrieve
+	if more {
+		urlStr, err := createLinkEntry(r.URL.String(), entries, lastEntry)
+		if err != nil {
+			sh.Errors = append(sh.Errors, errcode.ErrorCodeUnknown.WithDetail(err))
+			return
+		}
+		w.Header().Set("Link", urlStr)
+	}
+
+	enc := json.NewEncoder(w)
+	if err := enc.Encode(response); err != nil {
+		sh.Errors = append(sh.Errors, errcode.ErrorCodeUnknown.WithDetail(err))
+		return
+	}
+}
+
+// searchRepositories returns the first n repositories following last whose
+// name matches the term and which the client may pull from, and whether more
+// follow them.
+func (sh *searchHandler) searchRepositories(r *http.Request, term string, n int, last string) ([]string, bool, error) {
+	repos := []string{}
+	prefix := ""
+	if sh.App.Config.Catalog.Search.PrefixOnly {
+		prefix = term
+	}
+	more, err := sh.walkIndex(prefix, last, func(name string) (bool, error) {
+		if !sh.matches(name, term) {
+			return false, nil
+		}
+		allowed, err := sh.pullAllowed(r, name)
+		if err != nil || !allowed {
+			return false, err
+		}
+		if len(repos) == n {
+			return true, nil
+		}
+		repos = append(repos, name)
+		return false, nil
+	})
+	return repos, more, err
+}
+
+// searchTags returns the first n tags following last, a reference of a tag,
+// whose reference matches the term and which the client may pull from, and
+// whether more follow them. The tags are ordered by repository, in the order
+// of the catalog, then by name.
+func (sh *searchHandler) searchTags(r *http.Request, term string, n int, last string) ([]searchTag, bool, error) {
+	tags := []searchTag{}
+	lastName, lastTag, _ := strings.Cut(last, ":")
+
+	// searchRepository appends the tags of the repository following after
+	// which match the term, and returns whether more than n tags matched.
+	searchRepository := func(name, after string) (bool, error) {
+		named, err := reference.WithName(name)
+		if err != nil {
+			return false, nil
+		}
+		repository, err := sh.App.storage.Repository(sh, named)
+		if err != nil {
+			return false, err
+		}
+		tagService := repository.Tags(sh)
+		all, err := tagService.All(sh)
+		if err != nil {
+			if errors.As(err, new(distribution.ErrRepositoryUnknown)) {
+				return false, nil
+			}
+			return false, err
+		}
+		slices.Sort(all)
+		all = slices.DeleteFunc(all, func(tag string) bool {
+			return tag <= after || !sh.matches(name+":"+tag, term)
+		})
+		if len(all) == 0 {
+			return false, nil
+		}
+		allowed, err := sh.pullAllowed(r, name)
+		if err != nil || !allowed {
+			return false, err
+		}
+		for _, tag := range all {
+			if len(tags) == n {
+				return true, nil
+			}
+			desc, err := tagService.Get(sh, tag)
+			if err != nil {
+				if errors.As(err, new(distribution.ErrTagUnknown)) {
+					continue
+				}
+				return false, err
+			}
+			tags = append(tags, searchTag{Name: name, Tag: tag, Digest: desc.Digest})
+		}
+		return false, nil
+	}
+
+	if lastTag != "" {
+		more, err := searchRepository(lastName, lastTag)
+		if err != nil || more {
+			return tags, more, err
+		}
+	}
+	prefix := ""
+	if sh.App.Config.Catalog.Search.PrefixOnly {
+		prefix, _, _ = strings.Cut(term, ":")
+	}
+	more, err := sh.walkIndex(prefix, lastName, func(name string) (bool, error) {
+		return searchRepository(name, "")
+	})
+	return tags, more, err
+}
+
+// walkIndex calls f with the repositories of the catalog index starting with
+// prefix which follow last, in the order of the catalog, until f returns true
+// or an error. It returns whether f returned true.
+func (sh *searchHandler) walkIndex(prefix, last string, f func(name string) (bool, error)) (bool, error) {
+	page := make([]string, searchPageSize)
+	for {
+		filled, err := sh.App.catalogIndex.Repositories(sh, page, last, prefix)
+		if err != nil && err != io.EOF {
+			return false, err
+		}
+		for _, name := range page[:filled] {
+			stop, err := f(name)
+			if err != nil || stop {
+				return stop, err
+			}
+		}
+		if err == io.EOF || filled == 0 {
+			return false, nil
+		}
+		last = page[filled-1]
+	}
+}
+
+// matches returns whether the name matches the lowercase term, which it
+// contains regardless of case, or starts with if the search only matches
+// prefixes.
+func (sh *searchHandler) matches(name, term string) bool {
+	name = strings.ToLower(name)
+	if sh.App.Config.Catalog.Search.PrefixOnly {
+		return strings.HasPrefix(name, term)
+	}
+	return strings.Contains(name, term)
+}
+
+// pullAllowed returns whether the client of the request may pull from the
+// repository, as authorized by the access controller, the network policy and
+// the subjects of its tenant.
+// The repositories it is denied are left out of the results, but an access
+// controller which is unavailable fails the search.
+func (sh *searchHandler) pullAllowed(r *http.Request, name string) (bool, error) {
+	if !sh.App.repositoryTenantAllowed(sh, name) {
+		return false, nil
+	}
+	access := auth.Access{
+		Resource: auth.Resource{Type: "repository", Name: name},
+		Action:   "pull",
+	}
+	if sh.App.networkPolicy != nil {
+		addr, ok := sh.App.networkPolicy.clientAddr(r)
+		if !ok || !sh.App.networkPolicy.allowed(addr, access.Action) {
+			return false, nil
+		}
+	}
+
+	sh.App.authMu.RLock()
+	accessController := sh.App.accessController
+	sh.App.authMu.RUnlock()
+	if accessController == nil {
+		return true, nil
+	}
+	if _, err := accessController.Authorized(r.WithContext(sh.Context), access); err != nil {
+		if errors.Is(err, auth.ErrUnavailable) {
+			return false, err
+		}
+		dcontext.GetLogger(sh).Debugf("search: leaving out %s: %v", name, err)
+		return false, nil
+	}
+	return true, nil
+}
@@ -0,0 +1,173 @@
+package handlers
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/url"
+	"reflect"
+	"regexp"
+	"testing"
+	"time"
+
+	"github.com/distribution/distribution/v3/configuration"
+	"github.com/distribution/distribution/v3/registry/api/errcode"
+	"github.com/opencontainers/go-digest"
+)
+
+func TestSearchAPI(t *testing.T) {
+	root := t.TempDir()
+	newConfig := func() *configuration.Configuration {
+		config := &configuration.Configuration{
+			Storage: configuration.Storage{
+				"filesystem": configuration.Parameters{"rootdirectory": root},
+				"maintenance": configuration.Parameters{"uploadpurging": map[any]any{
+					"enabled": false,
+				}},
+			},
+			Catalog: configuration.Catalog{
+				MaxEntries: 5,
+				Index:      configuration.CatalogIndex{Enabled: true, ReconcileInterval: time.Hour},
+				Search:     configuration.CatalogSearch{Enabled: true},
+			},
+		}
+		config.HTTP.Headers = headerConfig
+		return config
+	}
+
+	// The repositories are pushed without authorization, then searched by a
+	// client denied the pulls from the repositories under denied/.
+	pushEnv := newTestEnvWithConfig(t, newConfig())
+	defer pushEnv.Shutdown()
+	digests := map[string]digest.Digest{}
+	for _, ref := range [][2]string{
+		{"apps/web", "latest"}, {"apps/web", "v1"}, {"denied/web", "latest"},
+		{"tools/webhook", "stable"}, {"tools/cli", "web-ui"}, {"zzz", "latest"},
+	} {
+		digests[ref[0]+":"+ref[1]] = createRepository(pushEnv, t, ref[0], ref[1])
+	}
+
+	config := newConfig()
+	config.Auth = configuration.Auth{"denypull": configuration.Parameters{}}
+	env := newTestEnvWithConfig(t, config)
+	defer env.Shutdown()
+
+	search := func(values url.Values, v any) string {
+		t.Helper()
+		searchURL, err := env.builder.BuildSearchURL(values)
+		checkErr(t, err, "building search url")
+		resp, err := http.Get(searchURL)
+		checkErr(t, err, "searching")
+		defer resp.Body.Close()
+		checkResponse(t, "searching", resp, http.StatusOK)
+		if err := json.NewDecoder(resp.Body).Decode(v); err != nil {
+			t.Fatalf("error decoding the search results: %v", err)
+		}
+		return resp.Header.Get("Link")
+	}
+	nextPage := func(link string) url.Values {
+		t.Helper()
+		matches := regexp.MustCompile(`<(/v2/_search\?.*)>; rel="next"`).FindStringSubmatch(link)
+		if len(matches) != 2 {
+			t.Fatalf("unexpected search link %q", link)
+		}
+		next, _ := url.Parse(matches[1])
+		return next.Query()
+	}
+
+	// The repositories are matched regardless of case, and paginated.
+	var repos []string
+	values := url.Values{"q": []string{"WEB"}, "n": []string{"1"}}
+	for page := 0; ; page++ {
+		var results searchRepositoriesAPIResponse
+		link := search(values, &results)
+		repos = append(repos, results.Repositories...)
+		if link == "" {
+			break
+		}
+		if page > 3 {
+			t.Fatalf("search not listed in %d pages", page)
+		}
+		values = nextPage(link)
+	}
+	if expected := []string{"apps/web", "tools/webhook"}; !reflect.DeepEqual(repos, expected) {
+		t.Fatalf("unexpected repositories %v found, expected %v", repos, expected)
+	}
+
+	// The tags are matched by their reference, and paginated within a
+	// repository.
+	var tags []searchTag
+	values = url.Values{"q": []string{"web"}, "type": []string{"tag"}, "n": []string{"2"}}
+	for page := 0; ; page++ {
+		var results searchTagsAPIResponse
+		link := search(values, &results)
+		tags = append(tags, results.Tags...)
+		if link == "" {
+			break
+		}
+		if page > 3 {
+			t.Fatalf("search not listed in %d pages", page)
+		}
+		values = nextPage(link)
+		if values.Get("type") != "tag" || values.Get("q") != "web" {
+			t.Fatalf("unexpected search link %q", link)
+		}
+	}
+	var expected []searchTag
+	for _, ref := range [][2]string{{"apps/web", "latest"}, {"apps/web", "v1"}, {"tools/cli", "web-ui"}, {"tools/webhook", "stable"}} {
+		expected = append(expected, searchTag{Name: ref[0], Tag: ref[1], Digest: digests[ref[0]+":"+ref[1]]})
+	}
+	if !reflect.DeepEqual(tags, expected) {
+		t.Fatalf("unexpected tags %v found, expected %v", tags, expected)
+	}
+
+	var results searchRepositoriesAPIResponse
+	if link := search(url.Values{"q": []string{"denied"}}, &results); len(results.Repositories) != 0 || link != "" {
+		t.Fatalf("unexpected repositories %v found, denied to the client", results.Repositories)
+	}
+
+	for _, values := range []url.Values{{}, {"q": []string{"web"}, "type": []string{"blob"}}} {
+		searchURL, err := env.builder.BuildSearchURL(values)
+		checkErr(t, err, "building search url")
+		resp, err := http.Get(searchURL)
+		checkErr(t, err, "searching")
+		checkResponse(t, "searching with invalid parameters", resp, http.StatusBadRequest)
+		checkBodyHasErrorCodes(t, "searching with invalid parameters", resp, errcode.ErrorCodeSearchInvalid)
+		resp.Body.Close()
+	}
+}
+
+func TestSearchPrefixOnly(t *testing.T) {
+	config := configuration.Configuration{
+		Storage: configuration.Storage{
+			"inmemory": configuration.Parameters{},
+			"maintenance": configuration.Parameters{"uploadpurging": map[any]any{
+				"enabled": false,
+			}},
+		},
+		Catalog: configuration.Catalog{
+			MaxEntries: 5,
+			Index:      configuration.CatalogIndex{Enabled: true, ReconcileInterval: time.Hour},
+			Search:     configuration.CatalogSearch{Enabled: true, PrefixOnly: true},
+		},
+	}
+	config.HTTP.Headers = headerConfig
+	env := newTestEnvWithConfig(t, &config)
+	defer env.Shutdown()
+
+	for _, name := range []string{"apps/web", "web/app", "webhook"} {
+		createRepository(env, t, name, "latest")
+	}
+	searchURL, err := env.builder.BuildSearchURL(url.Values{"q": []string{"web"}})
+	checkErr(t, err, "building search url")
+	resp, err := http.Get(searchURL)
+	checkErr(t, err, "searching")
+	defer resp.Body.Close()
+	checkResponse(t, "searching", resp, http.StatusOK)
+	var results searchRepositoriesAPIResponse
+	if err := json.NewDecoder(resp.Body).Decode(&results); err != nil {
+		t.Fatalf("error decoding the search results: %v", err)
+	}
+	if expected := []string{"web/app", "webhook"}; !reflect.DeepEqual(results.Repositories, expected) {
+		t.Fatalf("unexpected repositories %v found, expected %v", results.Repositories, expected)
+	}
+}
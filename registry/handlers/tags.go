@@ -2,13 +2,19 @@ package handlers
 
 import (
 	"encoding/json"
+	"errors"
 	"io"
 	"net/http"
 	"strconv"
+	"time"
 
 	"github.com/distribution/distribution/v3"
+	"github.com/distribution/distribution/v3/internal/dcontext"
 	"github.com/distribution/distribution/v3/registry/api/errcode"
+	"github.com/distribution/distribution/v3/registry/storage"
+	"github.com/distribution/distribution/v3/registry/storage/driver"
 	"github.com/gorilla/handlers"
+	"github.com/opencontainers/go-digest"
 )
 
 // tagsDispatcher constructs the tags handler api endpoint.
@@ -32,12 +38,28 @@ type tagsAPIResponse struct {
 	Tags []string `json:"tags"`
 }
 
+type tagDetailsAPIResponse struct {
+	Name string           `json:"name"`
+	Tags []tagDetailEntry `json:"tags"`
+}
+
+// tagDetailEntry is a tag of the extended tag listing.
+type tagDetailEntry struct {
+	Name         string        `json:"name"`
+	Digest       digest.Digest `json:"digest"`
+	MediaType    string        `json:"mediaType,omitempty"`
+	LastModified time.Time     `json:"lastModified"`
+	LastPulled   time.Time     `json:"lastPulled,omitzero"`
+	LastPushed   time.Time     `json:"lastPushed,omitzero"`
+}
+
 // GetTags returns a json list of tags for a specific image name.
 func (th *tagsHandler) GetTags(w http.ResponseWriter, r *http.Request) {
 	var moreEntries = true
 
 	q := r.URL.Query()
 	lastEntry := q.Get("last")
+	detail := q.Get("detail") == "true"
 
 	limit := -1
 
@@ -55,19 +77,48 @@ func (th *tagsHandler) GetTags(w http.ResponseWriter, r *http.Request) {
 	}
 
 	filled := make([]string, 0)
+	details := make([]tagDetailEntry, 0)
 
 	if limit == 0 {
 		moreEntries = false
 	} else {
 		tagService := th.Repository.Tags(th)
+		var (
+			returnedTags []string
+			err          error
+		)
 		// if limit is -1, we want to list all the tags, and receive a io.EOF error
-		returnedTags, err := tagService.List(th.Context, limit, lastEntry)
+		if detail {
+			var returnedDetails []distribution.TagDetail
+			returnedDetails, err = th.listDetails(tagService, limit, lastEntry)
+			for _, d := range returnedDetails {
+				returnedTags = append(returnedTags, d.Name)
+				entry := tagDetailEntry{
+					Name:         d.Name,
+					Digest:       d.Descriptor.Digest,
+					MediaType:    d.Descriptor.MediaType,
+					LastModified: d.ModTime.UTC(),
+				}
+				if th.App.lastAccess != nil {
+					times, accessErr := storage.TagAccessTimes(th, th.App.driver, th.Repository.Named().Name(), d.Name)
+					if accessErr != nil {
+						th.Errors = append(th.Errors, errcode.ErrorCodeUnknown.WithDetail(accessErr))
+						return
+					}
+					entry.LastPulled = times.LastPulled.UTC()
+					entry.LastPushed = times.LastPushed.UTC()
+				}
+				details = append(details, entry)
+			}
+		} else {
+			returnedTags, err = tagService.List(th.Context, limit, lastEntry)
+		}
 		if err != nil {
 			if err != io.EOF {
 				switch err := err.(type) {
 				case distribution.ErrRepositoryUnknown:
 					th.Errors = append(th.Errors, errcode.ErrorCodeNameUnknown.WithDetail(map[string]string{"name": th.Repository.Named().Name()}))
-				case errcode.Error:
+				case errcode.Error, errcode.ErrorCode:
 					th.Errors = append(th.Errors, err)
 				default:
 					th.Errors = append(th.Errors, errcode.ErrorCodeUnknown.WithDetail(err))
@@ -93,10 +144,194 @@ func (th *tagsHandler) GetTags(w http.ResponseWriter, r *http.Request) {
 		w.Header().Set("Link", urlStr)
 	}
 
-	enc := json.NewEncoder(w)
-	if err := enc.Encode(tagsAPIResponse{
+	var response any = tagsAPIResponse{
 		Name: th.Repository.Named().Name(),
 		Tags: filled,
+	}
+	if detail {
+		response = tagDetailsAPIResponse{
+			Name: th.Repository.Named().Name(),
+			Tags: details,
+		}
+	}
+
+	enc := json.NewEncoder(w)
+	if err := enc.Encode(response); err != nil {
+		th.Errors = append(th.Errors, errcode.ErrorCodeUnknown.WithDetail(err))
+		return
+	}
+}
+
+// listDetails lists the tag details of the tag service, returning
+// ErrorCodeUnsupported if it does not list them.
+func (th *tagsHandler) listDetails(tagService distribution.TagService, limit int, last string) ([]distribution.TagDetail, error) {
+	lister, ok := tagService.(distribution.TagDetailLister)
+	if !ok {
+		return nil, errcode.ErrorCodeUnsupported
+	}
+	details, err := lister.ListDetails(th.Context, limit, last)
+	if errors.Is(err, distribution.ErrUnsupported) {
+		return nil, errcode.ErrorCodeUnsupported
+	}
+	return details, err
+}
+
+// tagDispatcher constructs the tag handler api endpoint.
+func tagDispatcher(ctx *Context, r *http.Request) http.Handler {
+	tagHandler := &tagHandler{
+		Context: ctx,
+		Tag:     getTag(ctx),
+	}
+
+	return handlers.MethodHandler{
+		http.MethodDelete: http.HandlerFunc(tagHandler.DeleteTag),
+	}
+}
+
+// tagHandler handles requests for a tag under a repository name.
+type tagHandler struct {
+	*Context
+
+	Tag string
+}
+
+// DeleteTag removes the tag, leaving the manifest it references and the other
+// tags referencing it.
+func (th *tagHandler) DeleteTag(w http.ResponseWriter, r *http.Request) {
+	dcontext.GetLogger(th).Debug("DeleteTag")
+
+	if th.App.isCache || !th.App.deleteEnabled {
+		th.Errors = append(th.Errors, errcode.ErrorCodeUnsupported)
+		return
+	}
+
+	if err := th.App.immutableTags.checkDelete(th.Repository.Named().Name(), th.Tag); err != nil {
+		th.Errors = append(th.Errors, err)
+		return
+	}
+
+	if err := th.Repository.Tags(th).Untag(th, th.Tag); err != nil {
+		switch err.(type) {
+		case distribution.ErrTagUnknown, driver.PathNotFoundError:
+			th.Errors = append(th.Errors, errcode.ErrorCodeManifestUnknown.WithDetail(err))
+		default:
+			th.Errors = append(th.Errors, errcode.ErrorCodeUnknown.WithDetail(err))
+		}
+		return
+	}
+
+	w.WriteHeader(http.StatusAccepted)
+}
+
+// tagHistoryDispatcher constructs the tag history handler api endpoint.
+func tagHistoryDispatcher(ctx *Context, r *http.Request) http.Handler {
+	tagHandler := &tagHandler{
+		Context: ctx,
+		Tag:     getTag(ctx),
+	}
+
+	return handlers.MethodHandler{
+		http.MethodGet: http.HandlerFunc(tagHandler.GetTagHistory),
+	}
+}
+
+type tagHistoryAPIResponse struct {
+	Name    string            `json:"name"`
+	Tag     string            `json:"tag"`
+	History []tagHistoryEntry `json:"history"`
+}
+
+// tagHistoryEntry is a manifest the tag referenced.
+type tagHistoryEntry struct {
+	Digest       digest.Digest `json:"digest"`
+	LastModified time.Time     `json:"lastModified"`
+}
+
+// GetTagHistory returns a json list of the manifests the tag referenced,
+// newest first. Entries are paginated by the digest of the last entry
+// returned.
+func (th *tagHandler) GetTagHistory(w http.ResponseWriter, r *http.Request) {
+	q := r.URL.Query()
+	lastEntry := q.Get("last")
+
+	limit := -1
+	if n := q.Get("n"); n != "" {
+		if th.App.Config.Tags.MaxTags > 0 {
+			limit = th.App.Config.Tags.MaxTags
+		}
+		parsedMax, err := strconv.Atoi(n)
+		if err != nil || (limit > 0 && parsedMax > limit) || parsedMax < 0 {
+			th.Errors = append(th.Errors, errcode.ErrorCodePaginationNumberInvalid.WithDetail(map[string]int{"n": parsedMax}))
+			return
+		}
+		limit = parsedMax
+	}
+
+	provider, ok := th.Repository.Tags(th).(distribution.TagHistoryProvider)
+	if !ok {
+		th.Errors = append(th.Errors, errcode.ErrorCodeUnsupported)
+		return
+	}
+	history, err := provider.History(th, th.Tag)
+	if err != nil {
+		switch err.(type) {
+		case distribution.ErrTagUnknown:
+			th.Errors = append(th.Errors, errcode.ErrorCodeManifestUnknown.WithDetail(err))
+		case distribution.ErrRepositoryUnknown:
+			th.Errors = append(th.Errors, errcode.ErrorCodeNameUnknown.WithDetail(map[string]string{"name": th.Repository.Named().Name()}))
+		default:
+			if errors.Is(err, distribution.ErrUnsupported) {
+				th.Errors = append(th.Errors, errcode.ErrorCodeUnsupported)
+			} else {
+				th.Errors = append(th.Errors, errcode.ErrorCodeUnknown.WithDetail(err))
+			}
+		}
+		return
+	}
+
+	// Resume after the last entry returned. A digest no longer in the
+	// history ends the listing.
+	if lastEntry != "" {
+		start := len(history)
+		for i, entry := range history {
+			if entry.Digest.String() == lastEntry {
+				start = i + 1
+				break
+			}
+		}
+		history = history[start:]
+	}
+
+	moreEntries := false
+	if limit >= 0 && len(history) > limit {
+		history = history[:limit]
+		moreEntries = limit > 0
+	}
+
+	entries := make([]tagHistoryEntry, 0, len(history))
+	for _, entry := range history {
+		entries = append(entries, tagHistoryEntry{
+			Digest:       entry.Digest,
+			LastModified: entry.ModTime.UTC(),
+		})
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+
+	if moreEntries {
+		urlStr, err := createLinkEntry(r.URL.String(), limit, entries[len(entries)-1].Digest.String())
+		if err != nil {
+			th.Errors = append(th.Errors, errcode.ErrorCodeUnknown.WithDetail(err))
+			return
+		}
+		w.Header().Set("Link", urlStr)
+	}
+
+	enc := json.NewEncoder(w)
+	if err := enc.Encode(tagHistoryAPIResponse{
+		Name:    th.Repository.Named().Name(),
+		Tag:     th.Tag,
+		History: entries,
 	}); err != nil {
 		th.Errors = append(th.Errors, errcode.ErrorCodeUnknown.WithDetail(err))
 		return
@@ -0,0 +1,176 @@
+package handlers
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"path"
+	"slices"
+
+	"github.com/distribution/distribution/v3"
+	"github.com/distribution/distribution/v3/configuration"
+	"github.com/distribution/distribution/v3/internal/dcontext"
+	"github.com/distribution/distribution/v3/registry/api/errcode"
+	"github.com/distribution/distribution/v3/registry/storage"
+	memorycache "github.com/distribution/distribution/v3/registry/storage/cache/memory"
+)
+
+// tenancy routes the repositories to the registries of their tenant, each
+// storing its content under its own prefix.
+type tenancy struct {
+	namespace *storage.TenantNamespace
+	tenants   map[string]configuration.Tenant
+	quotas    map[string]*storage.Quotas
+}
+
+// newTenancy returns the tenancy of the configuration, whose registries are
+// created with the options over the storage driver of the app. The tenants
+// share no blob descriptor cache, so that each is given its own in memory
+// cache if a cache is configured.
+func newTenancy(app *App, config *configuration.Configuration, options []storage.RegistryOption) (*tenancy, error) {
+	var cached bool
+	if cc, ok := config.Storage["cache"]; ok {
+		v, ok := cc["blobdescriptor"]
+		if !ok {
+			// Backwards compatible: "layerinfo" == "blobdescriptor"
+			v = cc["layerinfo"]
+		}
+		switch v {
+		case "redis":
+			dcontext.GetLogger(app).Warnf("the redis blob descriptor cache is not shared by tenants, using an inmemory cache for each tenant")
+			cached = true
+		case "inmemory":
+			cached = true
+		}
+	}
+
+	t := &tenancy{
+		tenants: make(map[string]configuration.Tenant),
+		quotas:  make(map[string]*storage.Quotas),
+	}
+	var tenants []storage.Tenant
+	for _, tenant := range config.Tenancy.Tenants {
+		driver := storage.TenantDriver(app.driver, tenant.TenantPrefix())
+		tenantOptions := slices.Clone(options)
+		if cached {
+			tenantOptions = append(tenantOptions, storage.BlobDescriptorCacheProvider(memorycache.NewInMemoryBlobDescriptorCacheProvider(memorycache.DefaultSize)))
+		}
+		if tenant.Quota > 0 {
+			quota, err := storage.NewTenantQuota(storage.NewStorageQuotaUsageProvider(driver), tenant.Name, tenant.Quota)
+			if err != nil {
+				return nil, err
+			}
+			t.quotas[tenant.Name] = quota
+			tenantOptions = append(tenantOptions, storage.EnforceQuotas(quota))
+		}
+		registry, err := storage.NewRegistry(app, driver, tenantOptions...)
+		if err != nil {
+			return nil, fmt.Errorf("could not create the registry of tenant %s: %v", tenant.Name, err)
+		}
+		tenants = append(tenants, storage.Tenant{Name: tenant.Name, Registry: registry})
+		t.tenants[tenant.Name] = tenant
+		dcontext.GetLogger(app).Infof("tenant %s stored under %s", tenant.Name, tenant.TenantPrefix())
+	}
+
+	var err error
+	t.namespace, err = storage.NewTenantNamespace(tenants...)
+	if err != nil {
+		return nil, err
+	}
+	return t, nil
+}
+
+// TenantQuota returns the quota of the tenant, nil if it has none or if the
+// tenancy is not enabled.
+func (app *App) TenantQuota(name string) *storage.Quotas {
+	if app.tenancy == nil {
+		return nil
+	}
+	return app.tenancy.quotas[name]
+}
+
+// tenantAllowed returns whether the user of the context may access the
+// tenant, as matched by its subjects. The subjects are only enforced if an
+// access controller authenticates the users.
+func (app *App) tenantAllowed(ctx context.Context, tenant configuration.Tenant) bool {
+	if len(tenant.Subjects) == 0 {
+		return true
+	}
+	app.authMu.RLock()
+	authenticated := app.accessController != nil
+	app.authMu.RUnlock()
+	if !authenticated {
+		return true
+	}
+	user := dcontext.GetStringValue(ctx, userNameKey)
+	if user == "" {
+		return false
+	}
+	for _, pattern := range tenant.Subjects {
+		if ok, _ := path.Match(pattern, user); ok {
+			return true
+		}
+	}
+	return false
+}
+
+// repositoryTenantAllowed returns whether the user of the context may access
+// the tenant of the repository. The repositories of no tenant are left to be
+// refused by the namespace of the tenants.
+func (app *App) repositoryTenantAllowed(ctx context.Context, name string) bool {
+	if app.tenancy == nil {
+		return true
+	}
+	tenantName, ok := app.tenancy.namespace.TenantOf(name)
+	if !ok {
+		return true
+	}
+	return app.tenantAllowed(ctx, app.tenancy.tenants[tenantName])
+}
+
+// visibleTenants returns the names of the tenants the user of the context may
+// access.
+func (app *App) visibleTenants(ctx context.Context) []string {
+	tenants := []string{}
+	for name, tenant := range app.tenancy.tenants {
+		if app.tenantAllowed(ctx, tenant) {
+			tenants = append(tenants, name)
+		}
+	}
+	return tenants
+}
+
+// checkTenant refuses the requests for the repositories of no tenant, and for
+// those of a tenant whose subjects do not match the user, including the
+// repository a blob is mounted from.
+func (app *App) checkTenant(w http.ResponseWriter, r *http.Request, context *Context) error {
+	if app.tenancy == nil {
+		return nil
+	}
+	repo := getName(context)
+	if repo == "" {
+		return nil
+	}
+	if _, ok := app.tenancy.namespace.TenantOf(repo); !ok {
+		err := distribution.ErrRepositoryNameInvalid{Name: repo, Reason: errors.New("the first component of the name is not a tenant")}
+		if err := errcode.ServeJSON(w, errcode.ErrorCodeNameInvalid.WithDetail(err)); err != nil {
+			dcontext.GetLogger(context).Errorf("error serving error json: %v (from %v)", err, context.Errors)
+		}
+		return err
+	}
+	names := []string{repo}
+	if fromRepo := r.FormValue("from"); fromRepo != "" {
+		names = append(names, fromRepo)
+	}
+	for _, name := range names {
+		if app.repositoryTenantAllowed(context, name) {
+			continue
+		}
+		if err := errcode.ServeJSON(w, errcode.ErrorCodeDenied.WithDetail(map[string]string{"name": name})); err != nil {
+			dcontext.GetLogger(context).Errorf("error serving error json: %v (from %v)", err, context.Errors)
+		}
+		return fmt.Errorf("tenant of %s denied to %q", name, dcontext.GetStringValue(context, userNameKey))
+	}
+	return nil
+}
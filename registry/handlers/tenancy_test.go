@@ -0,0 +1,136 @@
+package handlers
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	"github.com/distribution/distribution/v3/configuration"
+	"github.com/distribution/distribution/v3/registry/api/errcode"
+	"github.com/distribution/reference"
+	"github.com/opencontainers/go-digest"
+)
+
+func TestTenancy(t *testing.T) {
+	root := t.TempDir()
+	newConfig := func() *configuration.Configuration {
+		config := &configuration.Configuration{
+			Storage: configuration.Storage{
+				"filesystem": configuration.Parameters{"rootdirectory": root},
+				"cache":      configuration.Parameters{"blobdescriptor": "inmemory"},
+				"maintenance": configuration.Parameters{"uploadpurging": map[any]any{
+					"enabled": false,
+				}},
+			},
+			Catalog: configuration.Catalog{MaxEntries: 10},
+			Tenancy: configuration.Tenancy{
+				Tenants: []configuration.Tenant{
+					{Name: "acme", Subjects: []string{"sil*"}},
+					{Name: "globex", Prefix: "/isolated/globex", Subjects: []string{"other"}},
+					{Name: "public"},
+				},
+			},
+		}
+		config.HTTP.Headers = headerConfig
+		return config
+	}
+
+	// The content is pushed without authorization, then accessed by the
+	// user of the silly access controller, a subject of acme only.
+	pushEnv := newTestEnvWithConfig(t, newConfig())
+	defer pushEnv.Shutdown()
+	for _, name := range []string{"acme/app", "globex/app", "public/app"} {
+		createRepository(pushEnv, t, name, "latest")
+	}
+
+	// A layer pushed by a tenant is stored under its prefix, and is neither
+	// found nor mounted by another tenant.
+	content := []byte("a layer of a tenant")
+	dgst := digest.FromBytes(content)
+	acmeName, _ := reference.WithName("acme/app")
+	globexName, _ := reference.WithName("globex/app")
+	uploadURLBase, _ := startPushLayer(t, pushEnv, acmeName)
+	pushLayer(t, pushEnv.builder, acmeName, dgst, uploadURLBase, bytes.NewReader(content))
+	blobPath := filepath.Join("docker", "registry", "v2", "blobs", "sha256", dgst.Encoded()[:2], dgst.Encoded(), "data")
+	if _, err := os.Stat(filepath.Join(root, "tenants", "acme", blobPath)); err != nil {
+		t.Fatalf("expected the layer under the prefix of the tenant: %v", err)
+	}
+	for _, p := range []string{filepath.Join(root, blobPath), filepath.Join(root, "isolated", "globex", blobPath)} {
+		if _, err := os.Stat(p); !os.IsNotExist(err) {
+			t.Fatalf("unexpected layer at %s: %v", p, err)
+		}
+	}
+
+	ref, _ := reference.WithDigest(globexName, dgst)
+	layerURL, err := pushEnv.builder.BuildBlobURL(ref)
+	checkErr(t, err, "building blob url")
+	resp, err := http.Head(layerURL)
+	checkErr(t, err, "checking blob of another tenant")
+	resp.Body.Close()
+	checkResponse(t, "checking blob of another tenant", resp, http.StatusNotFound)
+
+	mountURL, err := pushEnv.builder.BuildBlobUploadURL(globexName, url.Values{
+		"mount": []string{dgst.String()},
+		"from":  []string{acmeName.Name()},
+	})
+	checkErr(t, err, "building upload url")
+	resp, err = http.Post(mountURL, "", nil)
+	checkErr(t, err, "mounting blob of another tenant")
+	resp.Body.Close()
+	checkResponse(t, "mounting blob of another tenant", resp, http.StatusAccepted)
+
+	// The repositories of no tenant are refused.
+	noTenant, _ := reference.WithName("initech/app")
+	tagsURL, err := pushEnv.builder.BuildTagsURL(noTenant)
+	checkErr(t, err, "building tags url")
+	resp, err = http.Get(tagsURL)
+	checkErr(t, err, "listing tags of no tenant")
+	checkResponse(t, "listing tags of no tenant", resp, http.StatusBadRequest)
+	checkBodyHasErrorCodes(t, "listing tags of no tenant", resp, errcode.ErrorCodeNameInvalid)
+	resp.Body.Close()
+
+	config := newConfig()
+	config.Auth = configuration.Auth{"silly": configuration.Parameters{"realm": "realm-test", "service": "service-test"}}
+	env := newTestEnvWithConfig(t, config)
+	defer env.Shutdown()
+	get := func(u string) *http.Response {
+		t.Helper()
+		req, err := http.NewRequest(http.MethodGet, u, nil)
+		checkErr(t, err, "building request")
+		req.Header.Set("Authorization", "Bearer sillytoken")
+		resp, err := http.DefaultClient.Do(req)
+		checkErr(t, err, "sending request")
+		return resp
+	}
+
+	for name, status := range map[string]int{"acme/app": http.StatusOK, "public/app": http.StatusOK, "globex/app": http.StatusForbidden} {
+		named, _ := reference.WithName(name)
+		tagsURL, err := env.builder.BuildTagsURL(named)
+		checkErr(t, err, "building tags url")
+		resp := get(tagsURL)
+		checkResponse(t, "listing tags of "+name, resp, status)
+		if status == http.StatusForbidden {
+			checkBodyHasErrorCodes(t, "listing tags of "+name, resp, errcode.ErrorCodeDenied)
+		}
+		resp.Body.Close()
+	}
+
+	// Only the repositories of the tenants of the user are listed.
+	catalogURL, err := env.builder.BuildCatalogURL()
+	checkErr(t, err, "building catalog url")
+	resp = get(catalogURL)
+	defer resp.Body.Close()
+	checkResponse(t, "listing catalog", resp, http.StatusOK)
+	var catalog catalogAPIResponse
+	if err := json.NewDecoder(resp.Body).Decode(&catalog); err != nil {
+		t.Fatalf("error decoding the catalog: %v", err)
+	}
+	if expected := []string{"acme/app", "public/app"}; !reflect.DeepEqual(catalog.Repositories, expected) {
+		t.Fatalf("unexpected catalog %v, expected %v", catalog.Repositories, expected)
+	}
+}
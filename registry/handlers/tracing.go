@@ -0,0 +1,63 @@
+package handlers
+
+import (
+	"context"
+	"net/http"
+
+	"github.com/distribution/distribution/v3/registry/api/errcode"
+	"github.com/distribution/distribution/v3/tracing"
+	"github.com/gorilla/mux"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// tracer is the OpenTelemetry tracer of the API handlers.
+var tracer = otel.Tracer("github.com/distribution/distribution/v3/registry/handlers")
+
+// startSpan starts the span of the handler of the request, named after its
+// route. The request joins the trace of its traceparent header when it is not
+// already part of one.
+func startSpan(r *http.Request) (context.Context, trace.Span) {
+	ctx := r.Context()
+	if !trace.SpanContextFromContext(ctx).IsValid() {
+		ctx = otel.GetTextMapPropagator().Extract(ctx, propagation.HeaderCarrier(r.Header))
+	}
+
+	name := r.Method
+	if route := mux.CurrentRoute(r); route != nil && route.GetName() != "" {
+		name += " " + route.GetName()
+	}
+
+	vars := mux.Vars(r)
+	var attrs []attribute.KeyValue
+	for _, v := range []string{"name", "reference", "digest"} {
+		if value := vars[v]; value != "" {
+			key := v
+			if v == "name" {
+				key = "repository"
+			}
+			attrs = append(attrs, attribute.String(tracing.AttributePrefix+key, value))
+		}
+	}
+
+	return tracer.Start(ctx, name,
+		trace.WithSpanKind(trace.SpanKindServer),
+		trace.WithAttributes(attrs...))
+}
+
+// endSpan records the response status and errors of the request, and ends
+// its span.
+func endSpan(span trace.Span, status int, errs errcode.Errors) {
+	if status != 0 {
+		span.SetAttributes(attribute.Int("http.response.status_code", status))
+	}
+	if errs.Len() > 0 {
+		span.SetStatus(codes.Error, errs.Error())
+	} else if status >= http.StatusInternalServerError {
+		span.SetStatus(codes.Error, http.StatusText(status))
+	}
+	span.End()
+}
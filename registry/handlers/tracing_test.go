@@ -0,0 +1,182 @@
+package handlers
+
+import (
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/url"
+	"testing"
+	"time"
+
+	"github.com/distribution/distribution/v3/configuration"
+	"github.com/distribution/distribution/v3/manifest/schema2"
+	"github.com/distribution/distribution/v3/tracing"
+	"github.com/distribution/reference"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/propagation"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// spanTree indexes the recorded spans to check their hierarchy.
+type spanTree struct {
+	t     *testing.T
+	spans tracetest.SpanStubs
+}
+
+// child returns the span of the name whose parent is the given span.
+func (st spanTree) child(parent trace.SpanContext, name string) tracetest.SpanStub {
+	st.t.Helper()
+	for _, span := range st.spans {
+		if span.Name == name && span.Parent.SpanID() == parent.SpanID() && span.SpanContext.TraceID() == parent.TraceID() {
+			return span
+		}
+	}
+	st.t.Fatalf("no span %q child of %s", name, parent.SpanID())
+	return tracetest.SpanStub{}
+}
+
+// descendants returns the number of spans of the kind descending from the
+// given span.
+func (st spanTree) descendants(ancestor trace.SpanContext, kind trace.SpanKind) int {
+	parents := make(map[trace.SpanID]trace.SpanID)
+	for _, span := range st.spans {
+		parents[span.SpanContext.SpanID()] = span.Parent.SpanID()
+	}
+
+	var n int
+	for _, span := range st.spans {
+		if span.SpanKind != kind {
+			continue
+		}
+		for id := span.Parent.SpanID(); id.IsValid(); id = parents[id] {
+			if id == ancestor.SpanID() {
+				n++
+				break
+			}
+		}
+	}
+	return n
+}
+
+func checkSpanAttribute(t *testing.T, span tracetest.SpanStub, key string, expected attribute.Value) {
+	t.Helper()
+	for _, attr := range span.Attributes {
+		if string(attr.Key) == key {
+			if attr.Value != expected {
+				t.Fatalf("unexpected attribute %s of span %q: %v != %v", key, span.Name, attr.Value.Emit(), expected.Emit())
+			}
+			return
+		}
+	}
+	t.Fatalf("missing attribute %s of span %q", key, span.Name)
+}
+
+func TestProxyColdPullTracing(t *testing.T) {
+	exporter := tracetest.NewInMemoryExporter()
+	provider := sdktrace.NewTracerProvider(sdktrace.WithSyncer(exporter), sdktrace.WithSampler(sdktrace.AlwaysSample()))
+	defer provider.Shutdown(t.Context())
+	otel.SetTracerProvider(provider)
+	otel.SetTextMapPropagator(propagation.TraceContext{})
+
+	upstreamEnv := newTestEnv(t, false)
+	defer upstreamEnv.Shutdown()
+	createRepository(upstreamEnv, t, "foo/traced", "latest")
+	upstreamURL, err := url.Parse(upstreamEnv.server.URL)
+	checkErr(t, err, "parsing upstream URL")
+
+	config := configuration.Configuration{
+		Storage: configuration.Storage{
+			"inmemory": configuration.Parameters{},
+			"maintenance": configuration.Parameters{"uploadpurging": map[any]any{
+				"enabled": false,
+			}},
+		},
+		Proxy: configuration.Proxy{
+			RemoteURL: upstreamEnv.server.URL,
+		},
+	}
+	config.HTTP.Headers = headerConfig
+	env := newTestEnvWithConfig(t, &config)
+	defer env.Shutdown()
+	exporter.Reset()
+
+	// The caller of the pull is traced.
+	caller := trace.NewSpanContext(trace.SpanContextConfig{
+		TraceID:    trace.TraceID{0x0a},
+		SpanID:     trace.SpanID{0x0b},
+		TraceFlags: trace.FlagsSampled,
+	})
+	get := func(u string) *http.Response {
+		req, err := http.NewRequest(http.MethodGet, u, nil)
+		checkErr(t, err, "building request")
+		propagation.TraceContext{}.Inject(trace.ContextWithSpanContext(t.Context(), caller), propagation.HeaderCarrier(req.Header))
+		resp, err := http.DefaultClient.Do(req)
+		checkErr(t, err, "getting "+u)
+		return resp
+	}
+
+	imageName, _ := reference.WithName("foo/traced")
+	tagRef, _ := reference.WithTag(imageName, "latest")
+	manifestURL, err := env.builder.BuildManifestURL(tagRef)
+	checkErr(t, err, "building manifest url")
+	resp := get(manifestURL)
+	defer resp.Body.Close()
+	checkResponse(t, "pulling manifest", resp, http.StatusOK)
+	manifestDigest, manifestSize := resp.Header.Get("Docker-Content-Digest"), resp.ContentLength
+	var manifest schema2.Manifest
+	checkErr(t, json.NewDecoder(resp.Body).Decode(&manifest), "decoding manifest")
+
+	layer := manifest.Layers[0]
+	blobRef, _ := reference.WithDigest(imageName, layer.Digest)
+	blobURL, err := env.builder.BuildBlobURL(blobRef)
+	checkErr(t, err, "building blob url")
+	resp = get(blobURL)
+	defer resp.Body.Close()
+	checkResponse(t, "pulling blob", resp, http.StatusOK)
+	blobSize, err := io.Copy(io.Discard, resp.Body)
+	checkErr(t, err, "reading blob")
+
+	// The blob is cached once it is served, before the handler span ends.
+	deadline := time.Now().Add(5 * time.Second)
+	for recorded := exporter.GetSpans(); recorded[len(recorded)-1].Name != "GET blob"; recorded = exporter.GetSpans() {
+		if time.Now().After(deadline) {
+			t.Fatal("the blob handler span did not end")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	spans := spanTree{t: t, spans: exporter.GetSpans()}
+
+	// The handler joins the trace of the caller, and fetches the manifest
+	// from the upstream, whose requests are traced by the upstream handlers.
+	handler := spans.child(caller, "GET manifest")
+	checkSpanAttribute(t, handler, tracing.AttributePrefix+"repository", attribute.StringValue("foo/traced"))
+	checkSpanAttribute(t, handler, tracing.AttributePrefix+"reference", attribute.StringValue("latest"))
+	getManifest := spans.child(handler.SpanContext, "GetManifest")
+	checkSpanAttribute(t, getManifest, tracing.AttributePrefix+"proxy.cache.hit", attribute.BoolValue(false))
+	fetch := spans.child(getManifest.SpanContext, "FetchManifest")
+	checkSpanAttribute(t, fetch, tracing.AttributePrefix+"proxy.upstream", attribute.StringValue(upstreamURL.Host))
+	checkSpanAttribute(t, fetch, tracing.AttributePrefix+"digest", attribute.StringValue(manifestDigest))
+	checkSpanAttribute(t, fetch, tracing.AttributePrefix+"size", attribute.Int64Value(manifestSize))
+	client := spans.child(fetch.SpanContext, "GET /v2/foo/traced/manifests/latest")
+	if client.SpanKind != trace.SpanKindClient {
+		t.Fatalf("unexpected kind of upstream request span: %v", client.SpanKind)
+	}
+	spans.child(client.SpanContext, "GET manifest")
+	if n := spans.descendants(fetch.SpanContext, trace.SpanKindInternal); n == 0 {
+		t.Fatal("no storage driver span of the manifest fetch")
+	}
+
+	blobHandler := spans.child(caller, "GET blob")
+	checkSpanAttribute(t, blobHandler, tracing.AttributePrefix+"digest", attribute.StringValue(layer.Digest.String()))
+	serve := spans.child(blobHandler.SpanContext, "ServeBlob")
+	checkSpanAttribute(t, serve, tracing.AttributePrefix+"proxy.cache.hit", attribute.BoolValue(false))
+	fetchBlob := spans.child(serve.SpanContext, "FetchBlob")
+	checkSpanAttribute(t, fetchBlob, tracing.AttributePrefix+"size", attribute.Int64Value(blobSize))
+	checkSpanAttribute(t, fetchBlob, tracing.AttributePrefix+"proxy.upstream", attribute.StringValue(upstreamURL.Host))
+	if n := spans.descendants(fetchBlob.SpanContext, trace.SpanKindClient); n == 0 {
+		t.Fatal("no upstream request span of the blob fetch")
+	}
+}
@@ -0,0 +1,143 @@
+package handlers
+
+import (
+	"context"
+	"errors"
+	"expvar"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/distribution/distribution/v3/internal/dcontext"
+	prometheus "github.com/distribution/distribution/v3/metrics"
+	storagedriver "github.com/distribution/distribution/v3/registry/storage/driver"
+	"github.com/docker/go-metrics"
+)
+
+var (
+	// usageBytes is the number of bytes stored under the measured path.
+	usageBytes = prometheus.StorageNamespace.NewGauge("usage", "The number of bytes stored by the storage driver", metrics.Bytes)
+	// usageObjects is the number of files stored under the measured path.
+	usageObjects = prometheus.StorageNamespace.NewGauge("usage", "The number of files stored by the storage driver", metrics.Unit("objects"))
+)
+
+// usageConfig configures the measurement of the storage usage.
+type usageConfig struct {
+	interval     time.Duration
+	path         string
+	walkFallback bool
+}
+
+// usageReport is the storage usage last measured.
+type usageReport struct {
+	Path       string    `json:"path"`
+	Bytes      int64     `json:"bytes"`
+	Objects    int64     `json:"objects"`
+	MeasuredAt time.Time `json:"measuredAt,omitempty"`
+	Duration   string    `json:"duration,omitempty"`
+	Error      string    `json:"error,omitempty"`
+}
+
+func badUsageConfig(reason string) {
+	panic(fmt.Sprintf("Unable to parse storage usage configuration: %s", reason))
+}
+
+// parseUsageConfig parses the usage section of the storage maintenance
+// configuration. It returns nil if the storage usage is not measured.
+func parseUsageConfig(config map[any]any) *usageConfig {
+	enabled, ok := config["enabled"]
+	if !ok || enabled == false {
+		return nil
+	}
+	if _, ok := enabled.(bool); !ok {
+		badUsageConfig("enabled is not a boolean")
+	}
+
+	uc := &usageConfig{interval: time.Hour, path: "/"}
+	if interval, ok := config["interval"]; ok {
+		intervalStr, ok := interval.(string)
+		if !ok {
+			badUsageConfig("interval is not a string")
+		}
+		d, err := time.ParseDuration(intervalStr)
+		if err != nil {
+			badUsageConfig(fmt.Sprintf("Cannot parse interval: %s", err.Error()))
+		}
+		if d <= 0 {
+			badUsageConfig("interval must be positive")
+		}
+		uc.interval = d
+	}
+	if path, ok := config["path"]; ok {
+		pathStr, ok := path.(string)
+		if !ok || (!storagedriver.PathRegexp.MatchString(pathStr) && pathStr != "/") {
+			badUsageConfig(fmt.Sprintf("invalid path %v", path))
+		}
+		uc.path = pathStr
+	}
+	if walkFallback, ok := config["walkfallback"]; ok {
+		uc.walkFallback, ok = walkFallback.(bool)
+		if !ok {
+			badUsageConfig("cannot parse walkfallback")
+		}
+	}
+	return uc
+}
+
+// startUsageCollector schedules a goroutine which periodically measures the
+// space used by the storage driver, exported as metrics and on the registry
+// expvar.
+func startUsageCollector(ctx context.Context, storageDriver storagedriver.StorageDriver, log dcontext.Logger, config *usageConfig) {
+	var (
+		mu     sync.Mutex
+		report = usageReport{Path: config.path}
+	)
+
+	registry := expvar.Get("registry")
+	if registry == nil {
+		registry = expvar.NewMap("registry")
+	}
+	registry.(*expvar.Map).Set("storageusage", expvar.Func(func() any {
+		mu.Lock()
+		defer mu.Unlock()
+		return report
+	}))
+
+	go func() {
+		for {
+			start := time.Now()
+			bytes, objects, err := storagedriver.Usage(ctx, storageDriver, config.path, config.walkFallback)
+			if errors.As(err, new(storagedriver.ErrUnsupportedMethod)) {
+				log.Warnf("storage driver %s does not report its usage, set walkfallback to measure it by walking the storage", storageDriver.Name())
+				mu.Lock()
+				report.Error = err.Error()
+				mu.Unlock()
+				return
+			}
+
+			mu.Lock()
+			if err != nil {
+				log.Errorf("failed to measure storage usage: %v", err)
+				// The last measure is kept.
+				report.Error = err.Error()
+			} else {
+				usageBytes.Set(float64(bytes))
+				usageObjects.Set(float64(objects))
+				report = usageReport{
+					Path:       config.path,
+					Bytes:      bytes,
+					Objects:    objects,
+					MeasuredAt: start,
+					Duration:   time.Since(start).String(),
+				}
+			}
+			mu.Unlock()
+
+			select {
+			case <-time.After(config.interval):
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+}
@@ -0,0 +1,79 @@
+package registry
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+
+	"github.com/distribution/distribution/v3/configuration"
+	"github.com/distribution/distribution/v3/registry/auth/htpasswd"
+)
+
+// htpasswdHashOpts are the options of the htpasswd hash command. The
+// parameters unset are those of the minimum hash strength configured, or the
+// defaults.
+type htpasswdHashOpts struct {
+	Algorithm  string
+	BcryptCost int
+	Argon2id   htpasswd.Argon2idParams
+}
+
+// htpasswdEntry returns the htpasswd entry of the user, hashing the password
+// at least as strongly as the minimum hash strength of the htpasswd access
+// controller of the configuration, if any.
+func htpasswdEntry(config *configuration.Configuration, username, password string, opts htpasswdHashOpts) (string, error) {
+	if username == "" || strings.ContainsAny(username, ":\n") {
+		return "", fmt.Errorf("invalid user name %q", username)
+	}
+	if password == "" {
+		return "", errors.New("the password is empty")
+	}
+
+	var strength htpasswd.Strength
+	if config != nil {
+		if params, ok := config.Auth["htpasswd"]; ok {
+			var err error
+			if strength, err = htpasswd.ParseStrength(params["minhashstrength"]); err != nil {
+				return "", err
+			}
+		}
+	}
+
+	hashed := strength
+	if opts.BcryptCost != 0 {
+		if opts.BcryptCost < strength.BcryptCost {
+			return "", fmt.Errorf("bcrypt cost %d is below the minimum of %d", opts.BcryptCost, strength.BcryptCost)
+		}
+		hashed.BcryptCost = opts.BcryptCost
+	}
+	if opts.Argon2id.Memory != 0 {
+		if opts.Argon2id.Memory < strength.Argon2id.Memory {
+			return "", fmt.Errorf("argon2id memory %d KiB is below the minimum of %d KiB", opts.Argon2id.Memory, strength.Argon2id.Memory)
+		}
+		hashed.Argon2id.Memory = opts.Argon2id.Memory
+	}
+	if opts.Argon2id.Iterations != 0 {
+		if opts.Argon2id.Iterations < strength.Argon2id.Iterations {
+			return "", fmt.Errorf("argon2id iterations %d are below the minimum of %d", opts.Argon2id.Iterations, strength.Argon2id.Iterations)
+		}
+		hashed.Argon2id.Iterations = opts.Argon2id.Iterations
+	}
+	hashed.Argon2id.Parallelism = opts.Argon2id.Parallelism
+
+	hash, err := hashed.Hash(password, opts.Algorithm)
+	if err != nil {
+		return "", err
+	}
+	return username + ":" + hash, nil
+}
+
+// readPassword reads the password from the first line of r.
+func readPassword(r io.Reader) (string, error) {
+	line, err := bufio.NewReader(r).ReadString('\n')
+	if err != nil && err != io.EOF {
+		return "", err
+	}
+	return strings.TrimRight(line, "\r\n"), nil
+}
@@ -0,0 +1,73 @@
+package registry
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/distribution/distribution/v3/configuration"
+	"github.com/distribution/distribution/v3/registry/auth/htpasswd"
+	"golang.org/x/crypto/bcrypt"
+)
+
+func TestHtpasswdEntry(t *testing.T) {
+	config := &configuration.Configuration{Auth: configuration.Auth{
+		"htpasswd": configuration.Parameters{
+			"realm": "registry",
+			"path":  "/etc/distribution/htpasswd",
+			"minhashstrength": map[any]any{
+				"bcryptcost":         5,
+				"argon2idmemory":     1024,
+				"argon2iditerations": 2,
+			},
+		},
+	}}
+
+	// The parameters of the hash are the minimums configured, unless set.
+	entry, err := htpasswdEntry(config, "frodo", "baggins", htpasswdHashOpts{Algorithm: htpasswd.AlgorithmArgon2id, Argon2id: htpasswd.Argon2idParams{Parallelism: 1}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.HasPrefix(entry, "frodo:$argon2id$v=19$m=1024,t=2,p=1$") {
+		t.Fatalf("unexpected entry %q", entry)
+	}
+	entry, err = htpasswdEntry(config, "frodo", "baggins", htpasswdHashOpts{Algorithm: htpasswd.AlgorithmBcrypt, BcryptCost: 6})
+	if err != nil {
+		t.Fatal(err)
+	}
+	user, hash, _ := strings.Cut(entry, ":")
+	if user != "frodo" || bcrypt.CompareHashAndPassword([]byte(hash), []byte("baggins")) != nil {
+		t.Fatalf("unexpected entry %q", entry)
+	}
+	if cost, _ := bcrypt.Cost([]byte(hash)); cost != 6 {
+		t.Fatalf("expected a bcrypt cost of 6, got %d", cost)
+	}
+
+	for desc, tc := range map[string]struct {
+		user, password string
+		opts           htpasswdHashOpts
+	}{
+		"invalid user":   {"frodo:baggins", "baggins", htpasswdHashOpts{}},
+		"empty password": {"frodo", "", htpasswdHashOpts{}},
+		"weak bcrypt":    {"frodo", "baggins", htpasswdHashOpts{Algorithm: htpasswd.AlgorithmBcrypt, BcryptCost: 4}},
+		"weak argon2id":  {"frodo", "baggins", htpasswdHashOpts{Argon2id: htpasswd.Argon2idParams{Memory: 512}}},
+		"unknown":        {"frodo", "baggins", htpasswdHashOpts{Algorithm: "md5"}},
+	} {
+		if _, err := htpasswdEntry(config, tc.user, tc.password, tc.opts); err == nil {
+			t.Errorf("%s: expected an error", desc)
+		}
+	}
+}
+
+func TestReadPassword(t *testing.T) {
+	for input, want := range map[string]string{
+		"baggins\n":          "baggins",
+		"baggins\r\nignored": "baggins",
+		"baggins":            "baggins",
+		"":                   "",
+	} {
+		got, err := readPassword(strings.NewReader(input))
+		if err != nil || got != want {
+			t.Errorf("%q: expected %q, got %q, %v", input, want, got, err)
+		}
+	}
+}
@@ -0,0 +1,305 @@
+package registry
+
+import (
+	"archive/tar"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path"
+	"path/filepath"
+	"slices"
+	"strings"
+
+	"github.com/distribution/reference"
+	"github.com/opencontainers/go-digest"
+	v1 "github.com/opencontainers/image-spec/specs-go/v1"
+
+	"github.com/distribution/distribution/v3"
+	"github.com/distribution/distribution/v3/internal/dcontext"
+)
+
+// expiryScheduler is implemented by the registry of a pull through cache,
+// scheduling the expiry of the content imported into its storage.
+type expiryScheduler interface {
+	ScheduleExpiry(ref reference.Canonical, size int64, manifest bool) error
+}
+
+// importOpts configures an import.
+type importOpts struct {
+	// Scheduler, if set, schedules the expiry of the manifests and blobs
+	// imported.
+	Scheduler expiryScheduler
+}
+
+// importReport counts the content of an import. The content the repository
+// already had is skipped.
+type importReport struct {
+	Tags      int   `json:"tags"`
+	Manifests int   `json:"manifests"`
+	Blobs     int   `json:"blobs"`
+	Skipped   int   `json:"skipped"`
+	Bytes     int64 `json:"bytes"`
+}
+
+// layoutFileFunc is called with each file of a layout, and its content.
+type layoutFileFunc func(name string, size int64, r io.Reader) error
+
+// walkLayoutDir calls fn with each file of the layout of the directory.
+func walkLayoutDir(dir string, fn layoutFileFunc) error {
+	return filepath.WalkDir(dir, func(file string, entry fs.DirEntry, err error) error {
+		if err != nil || !entry.Type().IsRegular() {
+			return err
+		}
+		name, err := filepath.Rel(dir, file)
+		if err != nil {
+			return err
+		}
+		info, err := entry.Info()
+		if err != nil {
+			return err
+		}
+		f, err := os.Open(file)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		return fn(filepath.ToSlash(name), info.Size(), f)
+	})
+}
+
+// walkLayoutArchive calls fn with each file of the tar archive of a layout.
+func walkLayoutArchive(archive io.Reader, fn layoutFileFunc) error {
+	tr := tar.NewReader(archive)
+	for {
+		hdr, err := tr.Next()
+		if errors.Is(err, io.EOF) {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		if hdr.Typeflag != tar.TypeReg {
+			continue
+		}
+		name := strings.TrimPrefix(path.Clean("/"+hdr.Name), "/")
+		if err := fn(name, hdr.Size, tr); err != nil {
+			return err
+		}
+	}
+}
+
+// importLayout imports the OCI image layout walked into the repository. The
+// blobs of the layout are written to the repository as they are walked,
+// verified against their digest, then the manifests of its index are put,
+// after the manifests they reference, and tagged with the name of their
+// org.opencontainers.image.ref.name annotation, if any. The manifests and
+// blobs the repository already has are skipped, so that the import of a
+// layout is repeatable.
+func importLayout(ctx context.Context, repo distribution.Repository, walk func(layoutFileFunc) error, opts importOpts) (*importReport, error) {
+	manifests, err := repo.Manifests(ctx)
+	if err != nil {
+		return nil, err
+	}
+	i := &layoutImporter{
+		repo:      repo,
+		manifests: manifests,
+		opts:      opts,
+		imported:  make(map[digest.Digest]bool),
+		report:    &importReport{},
+	}
+
+	var layout *v1.ImageLayout
+	var index *v1.Index
+	err = walk(func(name string, size int64, r io.Reader) error {
+		switch {
+		case name == v1.ImageLayoutFile:
+			layout = &v1.ImageLayout{}
+			if err := json.NewDecoder(r).Decode(layout); err != nil {
+				return fmt.Errorf("invalid %s: %v", v1.ImageLayoutFile, err)
+			}
+		case name == v1.ImageIndexFile:
+			index = &v1.Index{}
+			if err := json.NewDecoder(r).Decode(index); err != nil {
+				return fmt.Errorf("invalid %s: %v", v1.ImageIndexFile, err)
+			}
+		case strings.HasPrefix(name, v1.ImageBlobsDir+"/"):
+			algorithm, encoded, _ := strings.Cut(strings.TrimPrefix(name, v1.ImageBlobsDir+"/"), "/")
+			dgst := digest.NewDigestFromEncoded(digest.Algorithm(algorithm), encoded)
+			if err := dgst.Validate(); err != nil {
+				return fmt.Errorf("invalid blob %s: %v", name, err)
+			}
+			return i.importBlob(ctx, dgst, size, r)
+		}
+		return nil
+	})
+	if err != nil {
+		return i.report, err
+	}
+	switch {
+	case layout == nil:
+		return i.report, fmt.Errorf("no %s in the layout", v1.ImageLayoutFile)
+	case layout.Version != v1.ImageLayoutVersion:
+		return i.report, fmt.Errorf("unsupported layout version %q", layout.Version)
+	case index == nil:
+		return i.report, fmt.Errorf("no %s in the layout", v1.ImageIndexFile)
+	case index.SchemaVersion != 2:
+		return i.report, fmt.Errorf("unsupported %s schema version %d", v1.ImageIndexFile, index.SchemaVersion)
+	}
+
+	for _, desc := range index.Manifests {
+		tag, err := layoutTag(repo.Named(), desc.Annotations[v1.AnnotationRefName])
+		if err != nil {
+			return i.report, err
+		}
+		if err := i.importManifest(ctx, desc, tag); err != nil {
+			return i.report, err
+		}
+		if tag != "" {
+			i.report.Tags++
+		}
+	}
+	return i.report, nil
+}
+
+// layoutTag returns the tag of the name of a manifest of a layout, a tag or a
+// reference with a tag as some tools write.
+func layoutTag(repo reference.Named, name string) (string, error) {
+	if name == "" {
+		return "", nil
+	}
+	if strings.ContainsAny(name, "/:") {
+		ref, err := reference.ParseNormalizedNamed(name)
+		if err != nil {
+			return "", fmt.Errorf("invalid reference %q: %v", name, err)
+		}
+		tagged, ok := ref.(reference.Tagged)
+		if !ok {
+			return "", fmt.Errorf("no tag in the reference %q", name)
+		}
+		return tagged.Tag(), nil
+	}
+	if _, err := reference.WithTag(repo, name); err != nil {
+		return "", fmt.Errorf("invalid tag %q: %v", name, err)
+	}
+	return name, nil
+}
+
+// layoutImporter writes the manifests and blobs of a layout to a repository.
+type layoutImporter struct {
+	repo      distribution.Repository
+	manifests distribution.ManifestService
+	opts      importOpts
+	// imported holds the manifests imported, or skipped.
+	imported map[digest.Digest]bool
+	report   *importReport
+}
+
+// importBlob writes the blob to the repository, unless it has it.
+func (i *layoutImporter) importBlob(ctx context.Context, dgst digest.Digest, size int64, r io.Reader) error {
+	if _, err := i.repo.Blobs(ctx).Stat(ctx, dgst); err == nil {
+		i.report.Skipped++
+		return nil
+	} else if !errors.Is(err, distribution.ErrBlobUnknown) {
+		return err
+	}
+	bw, err := i.repo.Blobs(ctx).Create(ctx)
+	if err != nil {
+		return err
+	}
+	n, err := io.Copy(bw, r)
+	if err != nil {
+		bw.Cancel(ctx)
+		return fmt.Errorf("blob %s: %v", dgst, err)
+	}
+	// The content is verified against the digest on commit.
+	if _, err := bw.Commit(ctx, v1.Descriptor{MediaType: "application/octet-stream", Digest: dgst, Size: n}); err != nil {
+		bw.Cancel(ctx)
+		return fmt.Errorf("blob %s: %v", dgst, err)
+	}
+	i.report.Blobs++
+	i.report.Bytes += n
+	return i.schedule(dgst, n, false)
+}
+
+// importManifest puts the manifest of the descriptor, after the manifests it
+// references, and tags it if tag is set. The images of an index the layout
+// lacks, as exported after a sync of some platforms, are skipped.
+func (i *layoutImporter) importManifest(ctx context.Context, desc v1.Descriptor, tag string) error {
+	if i.imported[desc.Digest] && tag == "" {
+		return nil
+	}
+	payload, err := i.repo.Blobs(ctx).Get(ctx, desc.Digest)
+	if err != nil {
+		return fmt.Errorf("manifest %s: %w", desc.Digest, err)
+	}
+	m, _, err := distribution.UnmarshalManifest(desc.MediaType, payload)
+	if err != nil {
+		return fmt.Errorf("manifest %s: %v", desc.Digest, err)
+	}
+	manifestTypes := distribution.ManifestMediaTypes()
+	for _, child := range m.References() {
+		if !slices.Contains(manifestTypes, child.MediaType) {
+			continue
+		}
+		if err := i.importManifest(ctx, child, ""); err != nil {
+			if !errors.Is(err, distribution.ErrBlobUnknown) {
+				return err
+			}
+			dcontext.GetLogger(ctx).Warnf("skipping the manifest %s of the index %s, not in the layout", child.Digest, desc.Digest)
+		}
+	}
+	i.imported[desc.Digest] = true
+
+	// A manifest the repository has is put again to move the tag, for its
+	// push to be notified with the tag.
+	exists, err := i.manifests.Exists(ctx, desc.Digest)
+	if err != nil {
+		return err
+	}
+	tagged := tag == ""
+	if exists && !tagged {
+		current, err := i.repo.Tags(ctx).Get(ctx, tag)
+		tagged = err == nil && current.Digest == desc.Digest
+	}
+	if exists && tagged {
+		i.report.Skipped++
+		return nil
+	}
+	var options []distribution.ManifestServiceOption
+	if tag != "" {
+		options = append(options, distribution.WithTag(tag))
+	}
+	dgst, err := i.manifests.Put(ctx, m, options...)
+	if err != nil {
+		return fmt.Errorf("manifest %s: %v", desc.Digest, err)
+	}
+	if dgst != desc.Digest {
+		return fmt.Errorf("manifest %s put as %s", desc.Digest, dgst)
+	}
+	if tag != "" {
+		mediaType, _, _ := m.Payload()
+		if err := i.repo.Tags(ctx).Tag(ctx, tag, v1.Descriptor{MediaType: mediaType, Digest: dgst, Size: int64(len(payload))}); err != nil {
+			return fmt.Errorf("tag %s: %v", tag, err)
+		}
+	}
+	if exists {
+		return nil
+	}
+	i.report.Manifests++
+	return i.schedule(dgst, int64(len(payload)), true)
+}
+
+func (i *layoutImporter) schedule(dgst digest.Digest, size int64, manifest bool) error {
+	if i.opts.Scheduler == nil {
+		return nil
+	}
+	ref, err := reference.WithDigest(i.repo.Named(), dgst)
+	if err != nil {
+		return err
+	}
+	return i.opts.Scheduler.ScheduleExpiry(ref, size, manifest)
+}
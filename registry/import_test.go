@@ -0,0 +1,280 @@
+package registry
+
+import (
+	"archive/tar"
+	"bytes"
+	"context"
+	"io"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/distribution/reference"
+	"github.com/opencontainers/go-digest"
+	"github.com/opencontainers/image-spec/specs-go"
+	v1 "github.com/opencontainers/image-spec/specs-go/v1"
+
+	"github.com/distribution/distribution/v3"
+	"github.com/distribution/distribution/v3/manifest/ocischema"
+	"github.com/distribution/distribution/v3/registry/storage"
+	"github.com/distribution/distribution/v3/registry/storage/driver/inmemory"
+)
+
+// recordingScheduler records the content scheduled to expire.
+type recordingScheduler struct {
+	manifests, blobs []digest.Digest
+}
+
+func (s *recordingScheduler) ScheduleExpiry(ref reference.Canonical, size int64, manifest bool) error {
+	if manifest {
+		s.manifests = append(s.manifests, ref.Digest())
+	} else {
+		s.blobs = append(s.blobs, ref.Digest())
+	}
+	return nil
+}
+
+// layoutFixture is an archive of the layout of a repository holding a plain
+// manifest, an index and a referrer.
+type layoutFixture struct {
+	archive                       []byte
+	image, other, index, referrer v1.Descriptor
+}
+
+func newLayoutFixture(t *testing.T) *layoutFixture {
+	ctx := context.Background()
+	registry, err := storage.NewRegistry(ctx, inmemory.New())
+	if err != nil {
+		t.Fatal(err)
+	}
+	repo := testRepository(t, registry, "team/app")
+	f := &layoutFixture{}
+	f.image = pushTestImage(t, repo, "v1", "image", &v1.Platform{Architecture: "amd64", OS: "linux"})
+	f.other = pushTestImage(t, repo, "", "other", &v1.Platform{Architecture: "arm64", OS: "linux"})
+	f.index = pushTestIndex(t, repo, "multi", f.image, f.other)
+
+	if _, err := repo.Blobs(ctx).Put(ctx, v1.MediaTypeEmptyJSON, v1.DescriptorEmptyJSON.Data); err != nil {
+		t.Fatal(err)
+	}
+	m, err := ocischema.FromStruct(ocischema.Manifest{
+		Versioned:    specs.Versioned{SchemaVersion: 2},
+		MediaType:    v1.MediaTypeImageManifest,
+		ArtifactType: "application/vnd.example.sbom",
+		Config:       v1.DescriptorEmptyJSON,
+		Layers:       []v1.Descriptor{v1.DescriptorEmptyJSON},
+		Subject:      &v1.Descriptor{MediaType: f.image.MediaType, Digest: f.image.Digest, Size: f.image.Size},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	f.referrer = putTestManifest(t, repo, m, "")
+
+	var archive bytes.Buffer
+	if _, err := exportLayout(ctx, registry, "team/app", exportOpts{Referrers: true}, &archive); err != nil {
+		t.Fatal(err)
+	}
+	f.archive = archive.Bytes()
+	return f
+}
+
+func (f *layoutFixture) walk(fn layoutFileFunc) error {
+	return walkLayoutArchive(bytes.NewReader(f.archive), fn)
+}
+
+// checkImported checks that the content of the fixture is in the repository,
+// with the same digests.
+func checkImported(t *testing.T, repo distribution.Repository, f *layoutFixture) {
+	t.Helper()
+	ctx := context.Background()
+	for tag, expected := range map[string]digest.Digest{"v1": f.image.Digest, "multi": f.index.Digest} {
+		desc, err := repo.Tags(ctx).Get(ctx, tag)
+		if err != nil || desc.Digest != expected {
+			t.Fatalf("unexpected digest %s of %s, expected %s: %v", desc.Digest, tag, expected, err)
+		}
+	}
+	manifests, err := repo.Manifests(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, dgst := range []digest.Digest{f.image.Digest, f.other.Digest, f.index.Digest, f.referrer.Digest} {
+		m, err := manifests.Get(ctx, dgst)
+		if err != nil {
+			t.Fatalf("manifest %s not imported: %v", dgst, err)
+		}
+		for _, ref := range m.References() {
+			if ref.MediaType == v1.MediaTypeImageManifest || ref.MediaType == v1.MediaTypeImageIndex {
+				continue
+			}
+			if _, err := repo.Blobs(ctx).Stat(ctx, ref.Digest); err != nil {
+				t.Fatalf("blob %s of %s not imported: %v", ref.Digest, dgst, err)
+			}
+		}
+	}
+	referrers, err := manifests.(distribution.ReferrersLister).Referrers(ctx, f.image.Digest, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(referrers) != 1 || referrers[0].Digest != f.referrer.Digest {
+		t.Fatalf("unexpected referrers %v", referrers)
+	}
+}
+
+func TestImportLayout(t *testing.T) {
+	ctx := context.Background()
+	f := newLayoutFixture(t)
+	registry, err := storage.NewRegistry(ctx, inmemory.New(), storage.EnableValidateImageIndexImagesExist)
+	if err != nil {
+		t.Fatal(err)
+	}
+	repo := testRepository(t, registry, "imported/app")
+
+	var scheduler recordingScheduler
+	report, err := importLayout(ctx, repo, f.walk, importOpts{Scheduler: &scheduler})
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkImported(t, repo, f)
+	if report.Tags != 2 || report.Manifests != 4 || report.Skipped != 0 {
+		t.Fatalf("unexpected report %+v", report)
+	}
+	if len(scheduler.manifests) != 4 || len(scheduler.blobs) != report.Blobs {
+		t.Fatalf("unexpected content scheduled %+v", scheduler)
+	}
+
+	// The import of the layout again skips everything.
+	report, err = importLayout(ctx, repo, f.walk, importOpts{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if report.Manifests != 0 || report.Blobs != 0 || report.Bytes != 0 {
+		t.Fatalf("unexpected report of the import again %+v", report)
+	}
+}
+
+func TestImportLayoutDir(t *testing.T) {
+	ctx := context.Background()
+	f := newLayoutFixture(t)
+	dir := t.TempDir()
+	if err := f.walk(func(name string, size int64, r io.Reader) error {
+		file := filepath.Join(dir, filepath.FromSlash(name))
+		if err := os.MkdirAll(filepath.Dir(file), 0o755); err != nil {
+			return err
+		}
+		content, err := io.ReadAll(r)
+		if err != nil {
+			return err
+		}
+		return os.WriteFile(file, content, 0o644)
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	registry, err := storage.NewRegistry(ctx, inmemory.New())
+	if err != nil {
+		t.Fatal(err)
+	}
+	repo := testRepository(t, registry, "imported/app")
+	if _, err := importLayout(ctx, repo, func(fn layoutFileFunc) error { return walkLayoutDir(dir, fn) }, importOpts{}); err != nil {
+		t.Fatal(err)
+	}
+	checkImported(t, repo, f)
+}
+
+func TestImportLayoutInvalid(t *testing.T) {
+	ctx := context.Background()
+	f := newLayoutFixture(t)
+
+	// rewrite returns the archive of the fixture with the content of the
+	// files rewritten, or removed if nil.
+	rewrite := func(edit func(name string, content []byte) []byte) func(layoutFileFunc) error {
+		var archive bytes.Buffer
+		tw := tar.NewWriter(&archive)
+		if err := f.walk(func(name string, size int64, r io.Reader) error {
+			content, err := io.ReadAll(r)
+			if err != nil {
+				return err
+			}
+			if content = edit(name, content); content == nil {
+				return nil
+			}
+			if err := tw.WriteHeader(&tar.Header{Typeflag: tar.TypeReg, Name: name, Size: int64(len(content)), Mode: 0o644}); err != nil {
+				return err
+			}
+			_, err = tw.Write(content)
+			return err
+		}); err != nil {
+			t.Fatal(err)
+		}
+		if err := tw.Close(); err != nil {
+			t.Fatal(err)
+		}
+		return func(fn layoutFileFunc) error { return walkLayoutArchive(bytes.NewReader(archive.Bytes()), fn) }
+	}
+
+	for _, tc := range []struct {
+		name string
+		walk func(layoutFileFunc) error
+	}{
+		{name: "no oci-layout", walk: rewrite(func(name string, content []byte) []byte {
+			if name == "oci-layout" {
+				return nil
+			}
+			return content
+		})},
+		{name: "unsupported version", walk: rewrite(func(name string, content []byte) []byte {
+			if name == "oci-layout" {
+				return []byte(`{"imageLayoutVersion":"2.0.0"}`)
+			}
+			return content
+		})},
+		{name: "no index", walk: rewrite(func(name string, content []byte) []byte {
+			if name == "index.json" {
+				return nil
+			}
+			return content
+		})},
+		{name: "corrupted blob", walk: rewrite(func(name string, content []byte) []byte {
+			if name == "blobs/sha256/"+f.image.Digest.Encoded() {
+				return append(content, ' ')
+			}
+			return content
+		})},
+		{name: "missing manifest", walk: rewrite(func(name string, content []byte) []byte {
+			if name == "blobs/sha256/"+f.index.Digest.Encoded() {
+				return nil
+			}
+			return content
+		})},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			registry, err := storage.NewRegistry(ctx, inmemory.New())
+			if err != nil {
+				t.Fatal(err)
+			}
+			if _, err := importLayout(ctx, testRepository(t, registry, "imported/app"), tc.walk, importOpts{}); err == nil {
+				t.Fatal("expected an error")
+			}
+		})
+	}
+}
+
+func TestLayoutTag(t *testing.T) {
+	named, _ := reference.WithName("imported/app")
+	for name, expected := range map[string]string{
+		"":                               "",
+		"v1.0":                           "v1.0",
+		"docker.io/library/alpine:3.20":  "3.20",
+		"registry.example.com/app:l8st":  "l8st",
+		"invalid tag":                    "error",
+		"registry.example.com/app":       "error",
+		"registry.example.com/app@sha25": "error",
+	} {
+		tag, err := layoutTag(named, name)
+		if err != nil {
+			tag = "error"
+		}
+		if tag != expected {
+			t.Errorf("unexpected tag %q of %q, expected %q", tag, name, expected)
+		}
+	}
+}
@@ -0,0 +1,417 @@
+package registry
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"slices"
+	"strings"
+	"sync"
+
+	"github.com/distribution/reference"
+	"github.com/opencontainers/go-digest"
+	v1 "github.com/opencontainers/image-spec/specs-go/v1"
+	"gopkg.in/yaml.v2"
+
+	"github.com/distribution/distribution/v3"
+	"github.com/distribution/distribution/v3/configuration"
+	"github.com/distribution/distribution/v3/internal/client"
+	"github.com/distribution/distribution/v3/internal/client/auth"
+	"github.com/distribution/distribution/v3/manifest/schema2"
+	"github.com/distribution/distribution/v3/registry/proxy"
+)
+
+// catalogPageSize is the number of repositories listed from the catalog of
+// the source at once.
+const catalogPageSize = 100
+
+// mirrorSpec selects the repositories, tags and platforms mirror sync copies
+// from a remote registry.
+type mirrorSpec struct {
+	// Source is the remote registry copied from, with its credentials as
+	// for the remotes of a pull through cache.
+	Source configuration.ProxyRemote `yaml:"source"`
+
+	// Repositories are the names of the repositories copied, or glob
+	// patterns matched against the catalog of the source.
+	Repositories []string `yaml:"repositories"`
+
+	// Tags are glob patterns of the tags copied, every tag if empty.
+	Tags []string `yaml:"tags,omitempty"`
+
+	// Platforms are the platforms of the images of the indexes copied,
+	// every platform if empty.
+	Platforms []configuration.Platform `yaml:"platforms,omitempty"`
+
+	// Verification verifies the cosign signatures of the manifests of the
+	// tags copied, as for a pull through cache, failing the tags whose
+	// signatures do not verify.
+	Verification configuration.ProxyVerification `yaml:"verification,omitempty"`
+}
+
+// readMirrorSpec reads and validates the sync spec of the file.
+func readMirrorSpec(file string) (*mirrorSpec, error) {
+	content, err := os.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+	var spec mirrorSpec
+	if err := yaml.UnmarshalStrict(content, &spec); err != nil {
+		return nil, fmt.Errorf("error parsing %s: %v", file, err)
+	}
+	if _, err := proxy.ValidateRemote(spec.Source); err != nil {
+		return nil, err
+	}
+	if len(spec.Repositories) == 0 {
+		return nil, fmt.Errorf("no repository to sync")
+	}
+	for _, pattern := range append(slices.Clone(spec.Repositories), spec.Tags...) {
+		if _, err := path.Match(pattern, ""); err != nil {
+			return nil, fmt.Errorf("invalid pattern %q: %v", pattern, err)
+		}
+	}
+	return &spec, nil
+}
+
+// mirrorOpts configures a sync.
+type mirrorOpts struct {
+	// IfChanged skips the tags already pointing to the digest of the source.
+	IfChanged bool
+	// Concurrency is the number of tags copied at once.
+	Concurrency int
+	// Progress, if set, is written a line per tag synced.
+	Progress io.Writer
+}
+
+// The statuses of the tags synced.
+const (
+	mirrorCopied    = "copied"
+	mirrorUnchanged = "unchanged"
+	mirrorFailed    = "failed"
+)
+
+// mirrorReport lists the tags synced, and the repositories whose tags could
+// not be listed.
+type mirrorReport struct {
+	Tags      []mirrorTag `json:"tags"`
+	Copied    int         `json:"copied"`
+	Unchanged int         `json:"unchanged"`
+	Failed    int         `json:"failed"`
+	// Bytes is the size of the blobs copied.
+	Bytes int64 `json:"bytes"`
+}
+
+// mirrorTag is a tag synced, or a repository whose tags could not be listed
+// if Tag is empty.
+type mirrorTag struct {
+	Repository string        `json:"repository"`
+	Tag        string        `json:"tag,omitempty"`
+	Digest     digest.Digest `json:"digest,omitempty"`
+	Status     string        `json:"status"`
+	Bytes      int64         `json:"bytes,omitempty"`
+	Error      string        `json:"error,omitempty"`
+}
+
+// mirrorSyncer copies the tags of the spec from the source to the local
+// registry.
+type mirrorSyncer struct {
+	spec   *mirrorSpec
+	opts   mirrorOpts
+	remote *proxy.Remote
+	local  distribution.Namespace
+	// verifier, if set, verifies the signatures of the manifests copied.
+	verifier *proxy.SignatureVerifier
+
+	// mu guards report and the progress.
+	mu     sync.Mutex
+	report mirrorReport
+}
+
+// mirrorSync copies the manifests of the tags selected by the spec, and the
+// blobs they reference, from the source into the local registry. The tags
+// which fail to be copied are reported, while the others are copied. An error
+// is returned if the source cannot be reached or its catalog listed.
+func mirrorSync(ctx context.Context, local distribution.Namespace, spec *mirrorSpec, opts mirrorOpts) (*mirrorReport, error) {
+	remote, err := proxy.NewRemote(ctx, spec.Source)
+	if err != nil {
+		return nil, err
+	}
+	s := &mirrorSyncer{spec: spec, opts: opts, remote: remote, local: local}
+	if spec.Verification.Enabled() {
+		if s.verifier, err = proxy.NewSignatureVerifier(spec.Verification); err != nil {
+			return nil, err
+		}
+	}
+	repositories, err := s.repositories(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	type item struct {
+		repository distribution.Repository
+		tag        string
+	}
+	items := make(chan item)
+	var wg sync.WaitGroup
+	for range max(opts.Concurrency, 1) {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for item := range items {
+				s.record(s.syncTag(ctx, item.repository, item.tag))
+			}
+		}()
+	}
+	for _, name := range repositories {
+		repository, tags, err := s.tags(ctx, name)
+		if err != nil {
+			s.record(mirrorTag{Repository: name, Status: mirrorFailed, Error: err.Error()})
+			continue
+		}
+		for _, tag := range tags {
+			items <- item{repository: repository, tag: tag}
+		}
+	}
+	close(items)
+	wg.Wait()
+	return &s.report, nil
+}
+
+// repositories returns the names of the repositories of the spec, matching
+// the patterns against the catalog of the source if any.
+func (s *mirrorSyncer) repositories(ctx context.Context) ([]string, error) {
+	var names, patterns []string
+	for _, name := range s.spec.Repositories {
+		if strings.ContainsAny(name, `*?[\`) {
+			patterns = append(patterns, name)
+		} else if !slices.Contains(names, name) {
+			names = append(names, name)
+		}
+	}
+	if len(patterns) == 0 {
+		return names, nil
+	}
+
+	transport, err := s.remote.Transport(ctx, auth.RegistryScope{Name: "catalog", Actions: []string{"*"}})
+	if err != nil {
+		return nil, err
+	}
+	u := s.remote.URL()
+	catalog, err := client.NewRegistry(u.String(), transport)
+	if err != nil {
+		return nil, err
+	}
+	entries := make([]string, catalogPageSize)
+	for last := ""; ; {
+		n, err := catalog.Repositories(ctx, entries, last)
+		if err != nil && err != io.EOF {
+			return nil, fmt.Errorf("failed to list the catalog of %s: %v", u.Redacted(), err)
+		}
+		for _, name := range entries[:n] {
+			if !slices.Contains(names, name) && slices.ContainsFunc(patterns, func(pattern string) bool {
+				ok, _ := path.Match(pattern, name)
+				return ok
+			}) {
+				names = append(names, name)
+			}
+		}
+		if err == io.EOF || n == 0 {
+			return names, nil
+		}
+		last = entries[n-1]
+	}
+}
+
+// tags returns the repository of the source, and its tags matching the
+// patterns of the spec and allowed by the tag filter of the source.
+func (s *mirrorSyncer) tags(ctx context.Context, name string) (distribution.Repository, []string, error) {
+	named, err := reference.WithName(name)
+	if err != nil {
+		return nil, nil, err
+	}
+	transport, err := s.remote.Transport(ctx, auth.RepositoryScope{Repository: name, Actions: []string{"pull"}})
+	if err != nil {
+		return nil, nil, err
+	}
+	u := s.remote.URL()
+	repository, err := client.NewRepository(named, u.String(), transport)
+	if err != nil {
+		return nil, nil, err
+	}
+	all, err := repository.Tags(ctx).All(ctx)
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to list the tags: %v", err)
+	}
+	var tags []string
+	for _, tag := range all {
+		if !s.remote.AllowsTag(tag) {
+			continue
+		}
+		if len(s.spec.Tags) == 0 || slices.ContainsFunc(s.spec.Tags, func(pattern string) bool {
+			ok, _ := path.Match(pattern, tag)
+			return ok
+		}) {
+			tags = append(tags, tag)
+		}
+	}
+	return repository, tags, nil
+}
+
+// record adds the tag synced to the report, and writes its progress.
+func (s *mirrorSyncer) record(tag mirrorTag) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.report.Tags = append(s.report.Tags, tag)
+	switch tag.Status {
+	case mirrorCopied:
+		s.report.Copied++
+	case mirrorUnchanged:
+		s.report.Unchanged++
+	default:
+		s.report.Failed++
+	}
+	s.report.Bytes += tag.Bytes
+
+	if s.opts.Progress == nil {
+		return
+	}
+	switch {
+	case tag.Tag == "":
+		fmt.Fprintf(s.opts.Progress, "%s: %s: %s\n", tag.Repository, tag.Status, tag.Error)
+	case tag.Error != "":
+		fmt.Fprintf(s.opts.Progress, "%s:%s: %s: %s\n", tag.Repository, tag.Tag, tag.Status, tag.Error)
+	default:
+		fmt.Fprintf(s.opts.Progress, "%s:%s: %s %s, %d bytes\n", tag.Repository, tag.Tag, tag.Status, tag.Digest, tag.Bytes)
+	}
+}
+
+// syncTag copies the manifest of the tag of the source repository, unless
+// unchanged, and reports the outcome.
+func (s *mirrorSyncer) syncTag(ctx context.Context, remote distribution.Repository, tag string) mirrorTag {
+	result := mirrorTag{Repository: remote.Named().Name(), Tag: tag, Status: mirrorFailed}
+	fail := func(err error) mirrorTag {
+		result.Error = err.Error()
+		return result
+	}
+
+	desc, err := remote.Tags(ctx).Get(ctx, tag)
+	if err != nil {
+		return fail(err)
+	}
+	result.Digest = desc.Digest
+	local, err := s.local.Repository(ctx, remote.Named())
+	if err != nil {
+		return fail(err)
+	}
+	if s.opts.IfChanged {
+		if current, err := local.Tags(ctx).Get(ctx, tag); err == nil && current.Digest == desc.Digest {
+			result.Status = mirrorUnchanged
+			return result
+		}
+	}
+
+	c := &mirrorCopy{syncer: s, remote: remote, local: local}
+	if err := c.copyManifest(ctx, desc.Digest, tag); err != nil {
+		result.Bytes = c.bytes
+		return fail(err)
+	}
+	result.Status = mirrorCopied
+	result.Bytes = c.bytes
+	return result
+}
+
+// mirrorCopy copies manifests from a repository of the source to the local
+// one.
+type mirrorCopy struct {
+	syncer *mirrorSyncer
+	remote distribution.Repository
+	local  distribution.Repository
+	// bytes is the size of the blobs copied.
+	bytes int64
+}
+
+// copyManifest copies the manifest, after the manifests of the platforms of
+// the spec it references and the blobs the local repository lacks, and tags
+// it if tag is set. The images of an index whose signatures verify are
+// trusted as it is.
+func (c *mirrorCopy) copyManifest(ctx context.Context, dgst digest.Digest, tag string) error {
+	remoteManifests, err := c.remote.Manifests(ctx)
+	if err != nil {
+		return err
+	}
+	m, err := remoteManifests.Get(ctx, dgst)
+	if err != nil {
+		return fmt.Errorf("manifest %s: %v", dgst, err)
+	}
+	if c.syncer.verifier != nil {
+		if err := c.syncer.verifier.Verify(ctx, c.remote, dgst, m); err != nil {
+			return err
+		}
+	}
+	manifestTypes := distribution.ManifestMediaTypes()
+	for _, desc := range m.References() {
+		switch {
+		case slices.Contains(manifestTypes, desc.MediaType):
+			if proxy.IncludesPlatform(c.syncer.spec.Platforms, desc.Platform) {
+				if err := c.copyManifest(ctx, desc.Digest, ""); err != nil {
+					return err
+				}
+			}
+		case desc.MediaType == schema2.MediaTypeForeignLayer, len(desc.URLs) > 0:
+			// The non-distributable layers are pulled from their urls.
+		default:
+			if err := c.copyBlob(ctx, desc); err != nil {
+				return err
+			}
+		}
+	}
+
+	localManifests, err := c.local.Manifests(ctx)
+	if err != nil {
+		return err
+	}
+	if _, err := localManifests.Put(ctx, m); err != nil {
+		return err
+	}
+	if tag == "" {
+		return nil
+	}
+	mediaType, payload, err := m.Payload()
+	if err != nil {
+		return err
+	}
+	return c.local.Tags(ctx).Tag(ctx, tag, v1.Descriptor{MediaType: mediaType, Digest: dgst, Size: int64(len(payload))})
+}
+
+// copyBlob copies the blob unless the local repository has it.
+func (c *mirrorCopy) copyBlob(ctx context.Context, desc v1.Descriptor) error {
+	if _, err := c.local.Blobs(ctx).Stat(ctx, desc.Digest); err == nil {
+		return nil
+	} else if !errors.Is(err, distribution.ErrBlobUnknown) {
+		return err
+	}
+
+	rc, err := c.remote.Blobs(ctx).Open(ctx, desc.Digest)
+	if err != nil {
+		return fmt.Errorf("blob %s: %v", desc.Digest, err)
+	}
+	defer rc.Close()
+	bw, err := c.local.Blobs(ctx).Create(ctx)
+	if err != nil {
+		return err
+	}
+	n, err := io.Copy(bw, rc)
+	if err != nil {
+		bw.Cancel(ctx)
+		return fmt.Errorf("blob %s: %v", desc.Digest, err)
+	}
+	if _, err := bw.Commit(ctx, v1.Descriptor{MediaType: desc.MediaType, Digest: desc.Digest, Size: n}); err != nil {
+		bw.Cancel(ctx)
+		return fmt.Errorf("blob %s: %v", desc.Digest, err)
+	}
+	c.bytes += n
+	return nil
+}
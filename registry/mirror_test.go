@@ -0,0 +1,402 @@
+package registry
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/pem"
+	"maps"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/distribution/reference"
+	"github.com/opencontainers/image-spec/specs-go"
+	v1 "github.com/opencontainers/image-spec/specs-go/v1"
+
+	"github.com/distribution/distribution/v3"
+	"github.com/distribution/distribution/v3/configuration"
+	"github.com/distribution/distribution/v3/manifest/ocischema"
+	"github.com/distribution/distribution/v3/manifest/schema2"
+	"github.com/distribution/distribution/v3/registry/handlers"
+	"github.com/distribution/distribution/v3/registry/storage"
+	"github.com/distribution/distribution/v3/registry/storage/driver/inmemory"
+)
+
+// mirrorUpstream is a registry served over http, whose content is pushed
+// through its storage.
+type mirrorUpstream struct {
+	t      *testing.T
+	app    *handlers.App
+	server *httptest.Server
+}
+
+func newMirrorUpstream(t *testing.T) *mirrorUpstream {
+	config := &configuration.Configuration{
+		Catalog: configuration.Catalog{MaxEntries: 1000},
+		Storage: configuration.Storage{
+			"inmemory": configuration.Parameters{},
+			"maintenance": configuration.Parameters{"uploadpurging": map[any]any{
+				"enabled": false,
+			}},
+		},
+	}
+	app := handlers.NewApp(context.Background(), config)
+	server := httptest.NewServer(app)
+	t.Cleanup(server.Close)
+	return &mirrorUpstream{t: t, app: app, server: server}
+}
+
+// push pushes an image with a layer of the content to the repository, tagged
+// if tag is set, and returns its descriptor.
+func (u *mirrorUpstream) push(name, tag, content string, platform *v1.Platform) v1.Descriptor {
+	u.t.Helper()
+	return pushTestImage(u.t, testRepository(u.t, u.app.Registry(), name), tag, content, platform)
+}
+
+// pushIndex pushes an index of the images to the repository, tagged.
+func (u *mirrorUpstream) pushIndex(name, tag string, images ...v1.Descriptor) v1.Descriptor {
+	u.t.Helper()
+	return pushTestIndex(u.t, testRepository(u.t, u.app.Registry(), name), tag, images...)
+}
+
+// pushTestImage pushes an image with a layer of the content to the
+// repository, tagged if tag is set, and returns its descriptor with the
+// platform.
+func pushTestImage(t *testing.T, repo distribution.Repository, tag, content string, platform *v1.Platform) v1.Descriptor {
+	t.Helper()
+	ctx := context.Background()
+	config, err := repo.Blobs(ctx).Put(ctx, schema2.MediaTypeImageConfig, []byte(`{"config": "`+content+`"}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	layer, err := repo.Blobs(ctx).Put(ctx, schema2.MediaTypeLayer, []byte(content))
+	if err != nil {
+		t.Fatal(err)
+	}
+	m, err := schema2.FromStruct(schema2.Manifest{
+		Versioned: specs.Versioned{SchemaVersion: 2},
+		MediaType: schema2.MediaTypeManifest,
+		Config:    config,
+		Layers:    []v1.Descriptor{layer},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	desc := putTestManifest(t, repo, m, tag)
+	desc.Platform = platform
+	return desc
+}
+
+// pushTestIndex pushes an index of the images to the repository, tagged.
+func pushTestIndex(t *testing.T, repo distribution.Repository, tag string, images ...v1.Descriptor) v1.Descriptor {
+	t.Helper()
+	m, err := ocischema.FromDescriptors(images, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return putTestManifest(t, repo, m, tag)
+}
+
+func putTestManifest(t *testing.T, repo distribution.Repository, m distribution.Manifest, tag string) v1.Descriptor {
+	t.Helper()
+	ctx := context.Background()
+	manifests, err := repo.Manifests(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	dgst, err := manifests.Put(ctx, m)
+	if err != nil {
+		t.Fatal(err)
+	}
+	mediaType, payload, err := m.Payload()
+	if err != nil {
+		t.Fatal(err)
+	}
+	desc := v1.Descriptor{MediaType: mediaType, Digest: dgst, Size: int64(len(payload))}
+	if tag != "" {
+		if err := repo.Tags(ctx).Tag(ctx, tag, desc); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return desc
+}
+
+func testRepository(t *testing.T, registry distribution.Namespace, name string) distribution.Repository {
+	t.Helper()
+	named, err := reference.WithName(name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	repo, err := registry.Repository(context.Background(), named)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return repo
+}
+
+// mirrorStatuses returns the statuses of the tags of the report, by tag.
+func mirrorStatuses(report *mirrorReport) map[string]string {
+	statuses := make(map[string]string)
+	for _, tag := range report.Tags {
+		statuses[tag.Repository+":"+tag.Tag] = tag.Status
+	}
+	return statuses
+}
+
+func TestMirrorSync(t *testing.T) {
+	ctx := context.Background()
+	upstream := newMirrorUpstream(t)
+	upstream.push("team/app", "v1", "app v1", nil)
+	upstream.push("team/app", "v1.1", "app v1.1", nil)
+	upstream.push("team/app", "v2", "app v2", nil)
+	upstream.push("team/lib", "v1", "lib v1", nil)
+	upstream.push("other/app", "v1", "other v1", nil)
+	amd64 := upstream.push("team/multi", "", "amd64", &v1.Platform{Architecture: "amd64", OS: "linux"})
+	arm64 := upstream.push("team/multi", "", "arm64", &v1.Platform{Architecture: "arm64", OS: "linux"})
+	upstream.pushIndex("team/multi", "v1", amd64, arm64)
+
+	local, err := storage.NewRegistry(ctx, inmemory.New())
+	if err != nil {
+		t.Fatal(err)
+	}
+	spec := &mirrorSpec{
+		Source:       configuration.ProxyRemote{RemoteURL: upstream.server.URL},
+		Repositories: []string{"team/*"},
+		Tags:         []string{"v1*"},
+		Platforms:    []configuration.Platform{{Architecture: "amd64", OS: "linux"}},
+	}
+	report, err := mirrorSync(ctx, local, spec, mirrorOpts{Concurrency: 2})
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := map[string]string{
+		"team/app:v1":   mirrorCopied,
+		"team/app:v1.1": mirrorCopied,
+		"team/lib:v1":   mirrorCopied,
+		"team/multi:v1": mirrorCopied,
+	}
+	if statuses := mirrorStatuses(report); !maps.Equal(statuses, expected) {
+		t.Fatalf("unexpected tags synced %v", statuses)
+	}
+	if report.Copied != 4 || report.Failed != 0 || report.Bytes == 0 {
+		t.Fatalf("unexpected report %+v", report)
+	}
+
+	// The manifests and blobs are copied, of the image of the platform only.
+	for _, name := range []string{"team/app", "team/lib"} {
+		repo := testRepository(t, local, name)
+		desc, err := repo.Tags(ctx).Get(ctx, "v1")
+		if err != nil {
+			t.Fatalf("%s:v1 not copied: %v", name, err)
+		}
+		manifests, err := repo.Manifests(ctx)
+		if err != nil {
+			t.Fatal(err)
+		}
+		m, err := manifests.Get(ctx, desc.Digest)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, ref := range m.References() {
+			if _, err := repo.Blobs(ctx).Stat(ctx, ref.Digest); err != nil {
+				t.Fatalf("blob %s of %s not copied: %v", ref.Digest, name, err)
+			}
+		}
+	}
+	multi, err := testRepository(t, local, "team/multi").Manifests(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ok, err := multi.Exists(ctx, amd64.Digest); err != nil || !ok {
+		t.Fatalf("image of the platform not copied: %v", err)
+	}
+	if ok, _ := multi.Exists(ctx, arm64.Digest); ok {
+		t.Fatal("unexpected image of another platform copied")
+	}
+}
+
+func TestMirrorSyncIfChanged(t *testing.T) {
+	ctx := context.Background()
+	upstream := newMirrorUpstream(t)
+	upstream.push("team/app", "v1", "app v1", nil)
+	upstream.push("team/app", "v2", "app v2", nil)
+
+	local, err := storage.NewRegistry(ctx, inmemory.New())
+	if err != nil {
+		t.Fatal(err)
+	}
+	spec := &mirrorSpec{
+		Source:       configuration.ProxyRemote{RemoteURL: upstream.server.URL},
+		Repositories: []string{"team/app"},
+	}
+	if _, err := mirrorSync(ctx, local, spec, mirrorOpts{IfChanged: true}); err != nil {
+		t.Fatal(err)
+	}
+
+	// Only the tag moved since is copied again.
+	moved := upstream.push("team/app", "v2", "app v2 rebuilt", nil)
+	report, err := mirrorSync(ctx, local, spec, mirrorOpts{IfChanged: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := map[string]string{
+		"team/app:v1": mirrorUnchanged,
+		"team/app:v2": mirrorCopied,
+	}
+	if statuses := mirrorStatuses(report); !maps.Equal(statuses, expected) {
+		t.Fatalf("unexpected tags synced %v", statuses)
+	}
+	desc, err := testRepository(t, local, "team/app").Tags(ctx).Get(ctx, "v2")
+	if err != nil || desc.Digest != moved.Digest {
+		t.Fatalf("unexpected digest %s of the moved tag, expected %s: %v", desc.Digest, moved.Digest, err)
+	}
+}
+
+func TestMirrorSyncPartialFailure(t *testing.T) {
+	ctx := context.Background()
+	upstream := newMirrorUpstream(t)
+	upstream.push("team/app", "v1", "app v1", nil)
+	upstream.push("team/broken", "v1", "broken v1", nil)
+
+	// The blobs of the broken repository are lost from the upstream.
+	upstream.server.Config.Handler = http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if strings.HasPrefix(r.URL.Path, "/v2/team/broken/blobs/") {
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		upstream.app.ServeHTTP(w, r)
+	})
+
+	local, err := storage.NewRegistry(ctx, inmemory.New())
+	if err != nil {
+		t.Fatal(err)
+	}
+	spec := &mirrorSpec{
+		Source:       configuration.ProxyRemote{RemoteURL: upstream.server.URL},
+		Repositories: []string{"team/app", "team/broken", "team/missing"},
+	}
+	report, err := mirrorSync(ctx, local, spec, mirrorOpts{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := map[string]string{
+		"team/app:v1":    mirrorCopied,
+		"team/broken:v1": mirrorFailed,
+		"team/missing:":  mirrorFailed,
+	}
+	if statuses := mirrorStatuses(report); !maps.Equal(statuses, expected) {
+		t.Fatalf("unexpected tags synced %v", statuses)
+	}
+	if report.Copied != 1 || report.Failed != 2 {
+		t.Fatalf("unexpected report %+v", report)
+	}
+}
+
+func TestMirrorSyncVerification(t *testing.T) {
+	ctx := context.Background()
+	upstream := newMirrorUpstream(t)
+	signed := upstream.push("prod/app", "v1", "app v1", nil)
+	upstream.push("prod/app", "v2", "app v2", nil)
+
+	// The signature of v1, tagged after its digest with the .sig suffix.
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	der, err := x509.MarshalPKIXPublicKey(key.Public())
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyFile := filepath.Join(t.TempDir(), "cosign.pub")
+	if err := os.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: der}), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	payload := []byte(`{"critical":{"identity":{"docker-reference":"prod/app"},"image":{"docker-manifest-digest":"` + signed.Digest.String() + `"},"type":"cosign container image signature"},"optional":null}`)
+	hash := sha256.Sum256(payload)
+	signature, err := ecdsa.SignASN1(rand.Reader, key, hash[:])
+	if err != nil {
+		t.Fatal(err)
+	}
+	repo := testRepository(t, upstream.app.Registry(), "prod/app")
+	layer, err := repo.Blobs(ctx).Put(ctx, "application/vnd.dev.cosign.simplesigning.v1+json", payload)
+	if err != nil {
+		t.Fatal(err)
+	}
+	layer.MediaType = "application/vnd.dev.cosign.simplesigning.v1+json"
+	layer.Annotations = map[string]string{"dev.cosignproject.cosign/signature": base64.StdEncoding.EncodeToString(signature)}
+	if _, err := repo.Blobs(ctx).Put(ctx, v1.MediaTypeEmptyJSON, v1.DescriptorEmptyJSON.Data); err != nil {
+		t.Fatal(err)
+	}
+	m, err := ocischema.FromStruct(ocischema.Manifest{
+		Versioned: specs.Versioned{SchemaVersion: 2},
+		MediaType: v1.MediaTypeImageManifest,
+		Config:    v1.DescriptorEmptyJSON,
+		Layers:    []v1.Descriptor{layer},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	putTestManifest(t, repo, m, strings.Replace(signed.Digest.String(), ":", "-", 1)+".sig")
+
+	local, err := storage.NewRegistry(ctx, inmemory.New())
+	if err != nil {
+		t.Fatal(err)
+	}
+	spec := &mirrorSpec{
+		Source:       configuration.ProxyRemote{RemoteURL: upstream.server.URL},
+		Repositories: []string{"prod/app"},
+		Tags:         []string{"v*"},
+		Verification: configuration.ProxyVerification{Keys: []string{keyFile}},
+	}
+	report, err := mirrorSync(ctx, local, spec, mirrorOpts{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := map[string]string{
+		"prod/app:v1": mirrorCopied,
+		"prod/app:v2": mirrorFailed,
+	}
+	if statuses := mirrorStatuses(report); !maps.Equal(statuses, expected) {
+		t.Fatalf("unexpected tags synced %v", statuses)
+	}
+	if _, err := testRepository(t, local, "prod/app").Tags(ctx).Get(ctx, "v2"); err == nil {
+		t.Fatal("unsigned tag copied")
+	}
+}
+
+func TestReadMirrorSpec(t *testing.T) {
+	dir := t.TempDir()
+	for _, tc := range []struct {
+		name  string
+		spec  string
+		valid bool
+	}{
+		{name: "valid", spec: "source: {remoteurl: https://registry.example.com}\nrepositories: [team/*]\ntags: [v*]\nplatforms: [{os: linux, architecture: amd64}]", valid: true},
+		{name: "no repository", spec: "source: {remoteurl: https://registry.example.com}"},
+		{name: "no source", spec: "repositories: [team/app]"},
+		{name: "invalid pattern", spec: "source: {remoteurl: https://registry.example.com}\nrepositories: [\"team/[\"]"},
+		{name: "unknown field", spec: "source: {remoteurl: https://registry.example.com}\nrepositories: [team/app]\ntag: [v1]"},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			file := filepath.Join(dir, tc.name+".yml")
+			if err := os.WriteFile(file, []byte(tc.spec), 0o644); err != nil {
+				t.Fatal(err)
+			}
+			_, err := readMirrorSpec(file)
+			if tc.valid && err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if !tc.valid && err == nil {
+				t.Fatal("expected an error")
+			}
+		})
+	}
+}
@@ -0,0 +1,517 @@
+package proxy
+
+import (
+	"bytes"
+	"context"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/asn1"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"os"
+	"path"
+	"regexp"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/hashicorp/golang-lru/arc/v2"
+	"github.com/opencontainers/go-digest"
+	v1 "github.com/opencontainers/image-spec/specs-go/v1"
+
+	"github.com/distribution/distribution/v3"
+	"github.com/distribution/distribution/v3/configuration"
+)
+
+// The conventions of the signatures of cosign.
+const (
+	cosignSignatureAnnotation   = "dev.cosignproject.cosign/signature"
+	cosignCertificateAnnotation = "dev.sigstore.cosign/certificate"
+	cosignChainAnnotation       = "dev.sigstore.cosign/chain"
+	cosignBundleAnnotation      = "dev.sigstore.cosign/bundle"
+
+	cosignPayloadMediaType = "application/vnd.dev.cosign.simplesigning.v1+json"
+	cosignArtifactType     = "application/vnd.dev.cosign.artifact.sig.v1+json"
+	cosignPayloadType      = "cosign container image signature"
+)
+
+const (
+	// maxSignatureSize is the maximum size of the payload of a signature
+	// fetched from the remote.
+	maxSignatureSize = 1 << 20
+
+	// defaultVerificationCacheSize is the number of digests whose
+	// verification is cached if not configured.
+	defaultVerificationCacheSize = 10000
+
+	// unverifiedTTL is how long the failure of the verification of a digest
+	// is cached, so that a signature pushed since is found.
+	unverifiedTTL = time.Minute
+)
+
+// The extensions of the Fulcio certificates holding the OIDC issuer of the
+// identity, as a raw string or as a DER UTF8String.
+var (
+	fulcioIssuerV1 = asn1.ObjectIdentifier{1, 3, 6, 1, 4, 1, 57264, 1, 1}
+	fulcioIssuerV2 = asn1.ObjectIdentifier{1, 3, 6, 1, 4, 1, 57264, 1, 8}
+)
+
+// SignatureVerifier verifies the cosign signatures of the manifests of remote
+// repositories, found with the referrers API or the tag of the digest with
+// the .sig suffix. The verifications are cached by digest, the images of an
+// index verified being verified.
+type SignatureVerifier struct {
+	repositories []string
+	keys         []crypto.PublicKey
+	keyless      *keylessVerifier
+	cache        *arc.ARCCache[digest.Digest, verification]
+	now          func() time.Time
+}
+
+// verification is the cached verification of a digest, failed if err is not
+// nil, until expires.
+type verification struct {
+	err     error
+	expires time.Time
+}
+
+// keylessVerifier verifies the signatures of Fulcio certificates.
+type keylessVerifier struct {
+	roots         *x509.CertPool
+	intermediates *x509.CertPool
+	rekorKey      crypto.PublicKey
+	identities    []keylessIdentity
+}
+
+type keylessIdentity struct {
+	issuer  string
+	subject *regexp.Regexp
+}
+
+// unverifiedError is the reason no signature of a manifest verifies, as
+// opposed to a failure to fetch them.
+type unverifiedError struct {
+	error
+}
+
+// NewSignatureVerifier returns a verifier of the signatures of the
+// configuration, reading its keys and certificates.
+func NewSignatureVerifier(config configuration.ProxyVerification) (*SignatureVerifier, error) {
+	if !config.Enabled() {
+		return nil, fmt.Errorf("no key or keyless identity to verify the signatures with")
+	}
+	for _, pattern := range config.Repositories {
+		if _, err := path.Match(pattern, ""); err != nil {
+			return nil, fmt.Errorf("invalid verification repository pattern %q: %v", pattern, err)
+		}
+	}
+	if config.CacheSize < 0 {
+		return nil, fmt.Errorf("verification cachesize must be a non-negative integer value")
+	}
+
+	v := &SignatureVerifier{repositories: config.Repositories, now: time.Now}
+	for _, file := range config.Keys {
+		key, err := readPublicKey(file)
+		if err != nil {
+			return nil, err
+		}
+		v.keys = append(v.keys, key)
+	}
+	if config.Keyless != nil {
+		keyless, err := newKeylessVerifier(*config.Keyless)
+		if err != nil {
+			return nil, err
+		}
+		v.keyless = keyless
+	}
+	size := config.CacheSize
+	if size == 0 {
+		size = defaultVerificationCacheSize
+	}
+	cache, err := arc.NewARC[digest.Digest, verification](size)
+	if err != nil {
+		return nil, err
+	}
+	v.cache = cache
+	return v, nil
+}
+
+func newKeylessVerifier(config configuration.ProxyKeyless) (*keylessVerifier, error) {
+	if config.Roots == "" || config.RekorKey == "" {
+		return nil, fmt.Errorf("keyless verification requires the fulcio roots and the rekor key")
+	}
+	if len(config.Identities) == 0 {
+		return nil, fmt.Errorf("keyless verification requires an identity")
+	}
+	content, err := os.ReadFile(config.Roots)
+	if err != nil {
+		return nil, err
+	}
+	certs, err := parseCertificates(content)
+	if err != nil {
+		return nil, fmt.Errorf("invalid fulcio roots %s: %v", config.Roots, err)
+	}
+	k := &keylessVerifier{roots: x509.NewCertPool(), intermediates: x509.NewCertPool()}
+	var roots int
+	for _, cert := range certs {
+		if bytes.Equal(cert.RawIssuer, cert.RawSubject) && cert.CheckSignatureFrom(cert) == nil {
+			k.roots.AddCert(cert)
+			roots++
+		} else {
+			k.intermediates.AddCert(cert)
+		}
+	}
+	if roots == 0 {
+		return nil, fmt.Errorf("no root certificate in the fulcio roots %s", config.Roots)
+	}
+	if k.rekorKey, err = readPublicKey(config.RekorKey); err != nil {
+		return nil, err
+	}
+	for _, identity := range config.Identities {
+		if identity.Issuer == "" || identity.Subject == "" {
+			return nil, fmt.Errorf("keyless identities require an issuer and a subject")
+		}
+		subject, err := regexp.Compile("^(?:" + identity.Subject + ")$")
+		if err != nil {
+			return nil, fmt.Errorf("invalid keyless identity subject %q: %v", identity.Subject, err)
+		}
+		k.identities = append(k.identities, keylessIdentity{issuer: identity.Issuer, subject: subject})
+	}
+	return k, nil
+}
+
+// readPublicKey reads the PEM public key of the file.
+func readPublicKey(file string) (crypto.PublicKey, error) {
+	content, err := os.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+	block, _ := pem.Decode(content)
+	if block == nil {
+		return nil, fmt.Errorf("no PEM public key in %s", file)
+	}
+	key, err := x509.ParsePKIXPublicKey(block.Bytes)
+	if err != nil {
+		return nil, fmt.Errorf("invalid public key %s: %v", file, err)
+	}
+	return key, nil
+}
+
+// parseCertificates parses the PEM certificates of the content.
+func parseCertificates(content []byte) ([]*x509.Certificate, error) {
+	var certs []*x509.Certificate
+	for {
+		var block *pem.Block
+		block, content = pem.Decode(content)
+		if block == nil {
+			break
+		}
+		cert, err := x509.ParseCertificate(block.Bytes)
+		if err != nil {
+			return nil, err
+		}
+		certs = append(certs, cert)
+	}
+	if len(certs) == 0 {
+		return nil, fmt.Errorf("no PEM certificate")
+	}
+	return certs, nil
+}
+
+// Verify verifies that a signature of the manifest of the remote repository
+// verifies, if its repository is verified, returning an
+// ErrManifestSignatureInvalid if none does.
+func (v *SignatureVerifier) Verify(ctx context.Context, remote distribution.Repository, dgst digest.Digest, manifest distribution.Manifest) error {
+	if len(v.repositories) > 0 && !slices.ContainsFunc(v.repositories, func(pattern string) bool {
+		matched, _ := path.Match(pattern, remote.Named().Name())
+		return matched
+	}) {
+		return nil
+	}
+	if cached, ok := v.cache.Get(dgst); ok && (cached.err == nil || v.now().Before(cached.expires)) {
+		return cached.err
+	}
+
+	err := v.verify(ctx, remote, dgst)
+	var unverified unverifiedError
+	switch {
+	case errors.As(err, &unverified):
+		err = distribution.ErrManifestSignatureInvalid{Digest: dgst, Reason: unverified.error}
+		v.cache.Add(dgst, verification{err: err, expires: v.now().Add(unverifiedTTL)})
+		return err
+	case err != nil:
+		return err
+	}
+	v.cache.Add(dgst, verification{})
+	// The images of an index signed are trusted as it is.
+	manifestTypes := distribution.ManifestMediaTypes()
+	for _, desc := range manifest.References() {
+		if slices.Contains(manifestTypes, desc.MediaType) {
+			v.cache.Add(desc.Digest, verification{})
+		}
+	}
+	return nil
+}
+
+// verify verifies the signatures of the manifest, returning an
+// unverifiedError if none does.
+func (v *SignatureVerifier) verify(ctx context.Context, remote distribution.Repository, dgst digest.Digest) error {
+	signatures, err := v.signatures(ctx, remote, dgst)
+	if err != nil {
+		return err
+	}
+	if len(signatures) == 0 {
+		return unverifiedError{errors.New("no signature")}
+	}
+	var reasons []error
+	for _, desc := range signatures {
+		if desc.Size > maxSignatureSize {
+			reasons = append(reasons, fmt.Errorf("signature payload of %d bytes too large", desc.Size))
+			continue
+		}
+		payload, err := remote.Blobs(ctx).Get(ctx, desc.Digest)
+		if err != nil {
+			return err
+		}
+		if digest.FromBytes(payload) != desc.Digest {
+			reasons = append(reasons, fmt.Errorf("signature payload %s does not match its digest", desc.Digest))
+			continue
+		}
+		if err := v.verifySignature(dgst, desc.Annotations, payload); err != nil {
+			reasons = append(reasons, err)
+			continue
+		}
+		return nil
+	}
+	return unverifiedError{errors.Join(reasons...)}
+}
+
+// signatures returns the descriptors of the payloads of the signatures of
+// the manifest, listed among its referrers and in the manifest of its .sig
+// tag.
+func (v *SignatureVerifier) signatures(ctx context.Context, remote distribution.Repository, dgst digest.Digest) ([]v1.Descriptor, error) {
+	manifests, err := remote.Manifests(ctx)
+	if err != nil {
+		return nil, err
+	}
+	var signatures []digest.Digest
+	if lister, ok := manifests.(distribution.ReferrersLister); ok {
+		referrers, err := lister.Referrers(ctx, dgst, cosignArtifactType)
+		if err != nil {
+			return nil, err
+		}
+		for _, referrer := range referrers {
+			signatures = append(signatures, referrer.Digest)
+		}
+	}
+	tag := strings.Replace(dgst.String(), ":", "-", 1) + ".sig"
+	desc, err := remote.Tags(ctx).Get(ctx, tag)
+	switch {
+	case err == nil:
+		signatures = append(signatures, desc.Digest)
+	case !errors.As(err, new(distribution.ErrTagUnknown)):
+		return nil, err
+	}
+
+	var payloads []v1.Descriptor
+	for _, signature := range signatures {
+		m, err := manifests.Get(ctx, signature)
+		if err != nil {
+			return nil, err
+		}
+		for _, desc := range m.References() {
+			if desc.MediaType == cosignPayloadMediaType && desc.Annotations[cosignSignatureAnnotation] != "" {
+				payloads = append(payloads, desc)
+			}
+		}
+	}
+	return payloads, nil
+}
+
+// cosignPayload is the simple signing payload of a cosign signature.
+type cosignPayload struct {
+	Critical struct {
+		Image struct {
+			DockerManifestDigest digest.Digest `json:"docker-manifest-digest"`
+		} `json:"image"`
+		Type string `json:"type"`
+	} `json:"critical"`
+}
+
+// verifySignature verifies the signature of the annotations over the payload
+// of the manifest with the keys, or its certificate.
+func (v *SignatureVerifier) verifySignature(dgst digest.Digest, annotations map[string]string, payload []byte) error {
+	var p cosignPayload
+	if err := json.Unmarshal(payload, &p); err != nil {
+		return fmt.Errorf("invalid signature payload: %v", err)
+	}
+	if p.Critical.Type != cosignPayloadType || p.Critical.Image.DockerManifestDigest != dgst {
+		return fmt.Errorf("signature payload of %s", p.Critical.Image.DockerManifestDigest)
+	}
+	signature, err := base64.StdEncoding.DecodeString(annotations[cosignSignatureAnnotation])
+	if err != nil {
+		return fmt.Errorf("invalid signature: %v", err)
+	}
+	for _, key := range v.keys {
+		if verifySignature(key, payload, signature) == nil {
+			return nil
+		}
+	}
+	if certificate := annotations[cosignCertificateAnnotation]; certificate != "" && v.keyless != nil {
+		return v.keyless.verify(certificate, annotations[cosignChainAnnotation], annotations[cosignBundleAnnotation], payload, signature)
+	}
+	return fmt.Errorf("signature not verified by any key")
+}
+
+// verifySignature verifies the signature over the sha256 digest of the
+// content with the key, or over the content for an ed25519 key.
+func verifySignature(key crypto.PublicKey, content, signature []byte) error {
+	hash := sha256.Sum256(content)
+	switch key := key.(type) {
+	case *ecdsa.PublicKey:
+		if ecdsa.VerifyASN1(key, hash[:], signature) {
+			return nil
+		}
+	case *rsa.PublicKey:
+		return rsa.VerifyPKCS1v15(key, crypto.SHA256, hash[:], signature)
+	case ed25519.PublicKey:
+		if ed25519.Verify(key, content, signature) {
+			return nil
+		}
+	default:
+		return fmt.Errorf("unsupported key type %T", key)
+	}
+	return fmt.Errorf("invalid signature")
+}
+
+// rekorBundle is the bundle of a signature logged to Rekor.
+type rekorBundle struct {
+	SignedEntryTimestamp []byte `json:"SignedEntryTimestamp"`
+	Payload              struct {
+		Body           string `json:"body"`
+		IntegratedTime int64  `json:"integratedTime"`
+		LogIndex       int64  `json:"logIndex"`
+		LogID          string `json:"logID"`
+	} `json:"Payload"`
+}
+
+// hashedRekord is the body of the entry of a signature in Rekor.
+type hashedRekord struct {
+	Spec struct {
+		Data struct {
+			Hash struct {
+				Algorithm string `json:"algorithm"`
+				Value     string `json:"value"`
+			} `json:"hash"`
+		} `json:"data"`
+		Signature struct {
+			Content   []byte `json:"content"`
+			PublicKey struct {
+				Content []byte `json:"content"`
+			} `json:"publicKey"`
+		} `json:"signature"`
+	} `json:"spec"`
+}
+
+// verify verifies the signature over the payload with the certificate, which
+// must chain to a root, have been valid when the signature was logged to
+// Rekor, as the signed entry timestamp of the bundle proves, and be issued to
+// an identity.
+func (k *keylessVerifier) verify(certificate, chain, bundle string, payload, signature []byte) error {
+	certs, err := parseCertificates([]byte(certificate))
+	if err != nil {
+		return fmt.Errorf("invalid signature certificate: %v", err)
+	}
+	cert := certs[0]
+	if bundle == "" {
+		return fmt.Errorf("no rekor bundle")
+	}
+	var b rekorBundle
+	if err := json.Unmarshal([]byte(bundle), &b); err != nil {
+		return fmt.Errorf("invalid rekor bundle: %v", err)
+	}
+	// The entry timestamp is signed over the canonical json of the payload,
+	// whose keys are sorted.
+	var canonical bytes.Buffer
+	enc := json.NewEncoder(&canonical)
+	enc.SetEscapeHTML(false)
+	if err := enc.Encode(map[string]any{
+		"body":           b.Payload.Body,
+		"integratedTime": b.Payload.IntegratedTime,
+		"logIndex":       b.Payload.LogIndex,
+		"logID":          b.Payload.LogID,
+	}); err != nil {
+		return err
+	}
+	if err := verifySignature(k.rekorKey, bytes.TrimSuffix(canonical.Bytes(), []byte("\n")), b.SignedEntryTimestamp); err != nil {
+		return fmt.Errorf("rekor bundle not verified: %v", err)
+	}
+	body, err := base64.StdEncoding.DecodeString(b.Payload.Body)
+	if err != nil {
+		return fmt.Errorf("invalid rekor entry: %v", err)
+	}
+	var entry hashedRekord
+	if err := json.Unmarshal(body, &entry); err != nil {
+		return fmt.Errorf("invalid rekor entry: %v", err)
+	}
+	hash := sha256.Sum256(payload)
+	logged, _ := parseCertificates(entry.Spec.Signature.PublicKey.Content)
+	if entry.Spec.Data.Hash.Algorithm != "sha256" || entry.Spec.Data.Hash.Value != hex.EncodeToString(hash[:]) ||
+		!bytes.Equal(entry.Spec.Signature.Content, signature) || len(logged) == 0 || !logged[0].Equal(cert) {
+		return fmt.Errorf("rekor entry of another signature")
+	}
+
+	intermediates := k.intermediates.Clone()
+	if chain != "" {
+		chainCerts, err := parseCertificates([]byte(chain))
+		if err != nil {
+			return fmt.Errorf("invalid signature certificate chain: %v", err)
+		}
+		for _, c := range chainCerts {
+			intermediates.AddCert(c)
+		}
+	}
+	if _, err := cert.Verify(x509.VerifyOptions{
+		Roots:         k.roots,
+		Intermediates: intermediates,
+		CurrentTime:   time.Unix(b.Payload.IntegratedTime, 0),
+		KeyUsages:     []x509.ExtKeyUsage{x509.ExtKeyUsageCodeSigning},
+	}); err != nil {
+		return fmt.Errorf("signature certificate not verified: %v", err)
+	}
+	if !k.trusted(cert) {
+		return fmt.Errorf("signature certificate of an untrusted identity")
+	}
+	return verifySignature(cert.PublicKey, payload, signature)
+}
+
+// trusted reports whether the certificate is issued to one of the
+// identities.
+func (k *keylessVerifier) trusted(cert *x509.Certificate) bool {
+	var issuer string
+	for _, ext := range cert.Extensions {
+		switch {
+		case ext.Id.Equal(fulcioIssuerV2):
+			if _, err := asn1.Unmarshal(ext.Value, &issuer); err != nil {
+				return false
+			}
+		case ext.Id.Equal(fulcioIssuerV1) && issuer == "":
+			issuer = string(ext.Value)
+		}
+	}
+	subjects := slices.Clone(cert.EmailAddresses)
+	for _, uri := range cert.URIs {
+		subjects = append(subjects, uri.String())
+	}
+	return slices.ContainsFunc(k.identities, func(identity keylessIdentity) bool {
+		return identity.issuer == issuer && slices.ContainsFunc(subjects, identity.subject.MatchString)
+	})
+}
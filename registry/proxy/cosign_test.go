@@ -0,0 +1,406 @@
+package proxy
+
+import (
+	"context"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/asn1"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"math/big"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/distribution/reference"
+	"github.com/opencontainers/go-digest"
+	"github.com/opencontainers/image-spec/specs-go"
+	v1 "github.com/opencontainers/image-spec/specs-go/v1"
+
+	"github.com/distribution/distribution/v3"
+	"github.com/distribution/distribution/v3/configuration"
+	"github.com/distribution/distribution/v3/manifest/ocischema"
+	"github.com/distribution/distribution/v3/registry/storage"
+	"github.com/distribution/distribution/v3/registry/storage/driver/inmemory"
+)
+
+// newSigningKey returns a key, and the file of its PEM public key.
+func newSigningKey(t *testing.T) (*ecdsa.PrivateKey, string) {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	der, err := x509.MarshalPKIXPublicKey(key.Public())
+	if err != nil {
+		t.Fatal(err)
+	}
+	return key, writePEM(t, "PUBLIC KEY", der)
+}
+
+func writePEM(t *testing.T, blockType string, der ...[]byte) string {
+	t.Helper()
+	var content []byte
+	for _, b := range der {
+		content = append(content, pem.EncodeToMemory(&pem.Block{Type: blockType, Bytes: b})...)
+	}
+	file := filepath.Join(t.TempDir(), "key.pem")
+	if err := os.WriteFile(file, content, 0o644); err != nil {
+		t.Fatal(err)
+	}
+	return file
+}
+
+func sign(t *testing.T, key crypto.Signer, content []byte) []byte {
+	t.Helper()
+	hash := sha256.Sum256(content)
+	signature, err := key.Sign(rand.Reader, hash[:], crypto.SHA256)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return signature
+}
+
+func newSignedRepository(t *testing.T, name string) distribution.Repository {
+	t.Helper()
+	ctx := context.Background()
+	registry, err := storage.NewRegistry(ctx, inmemory.New())
+	if err != nil {
+		t.Fatal(err)
+	}
+	named, err := reference.WithName(name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	repo, err := registry.Repository(ctx, named)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := repo.Blobs(ctx).Put(ctx, v1.MediaTypeEmptyJSON, v1.DescriptorEmptyJSON.Data); err != nil {
+		t.Fatal(err)
+	}
+	return repo
+}
+
+// putManifest puts the image manifest, with an empty config.
+func putManifest(t *testing.T, repo distribution.Repository, m ocischema.Manifest) (v1.Descriptor, distribution.Manifest) {
+	t.Helper()
+	ctx := context.Background()
+	m.Versioned = specs.Versioned{SchemaVersion: 2}
+	m.MediaType = v1.MediaTypeImageManifest
+	m.Config = v1.DescriptorEmptyJSON
+	dm, err := ocischema.FromStruct(m)
+	if err != nil {
+		t.Fatal(err)
+	}
+	manifests, err := repo.Manifests(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	dgst, err := manifests.Put(ctx, dm)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, payload, _ := dm.Payload()
+	return v1.Descriptor{MediaType: v1.MediaTypeImageManifest, Digest: dgst, Size: int64(len(payload))}, dm
+}
+
+func pushImage(t *testing.T, repo distribution.Repository, content string) (v1.Descriptor, distribution.Manifest) {
+	t.Helper()
+	layer, err := repo.Blobs(context.Background()).Put(context.Background(), v1.MediaTypeImageLayer, []byte(content))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return putManifest(t, repo, ocischema.Manifest{Layers: []v1.Descriptor{layer}})
+}
+
+func signaturePayload(dgst digest.Digest) []byte {
+	return []byte(fmt.Sprintf(`{"critical":{"identity":{"docker-reference":"registry.example.com/prod/app"},"image":{"docker-manifest-digest":%q},"type":"cosign container image signature"},"optional":null}`, dgst))
+}
+
+// pushSignature pushes a signature of the subject with the annotations, as a
+// referrer or tagged after the digest of the subject with the .sig suffix.
+func pushSignature(t *testing.T, repo distribution.Repository, subject v1.Descriptor, payload []byte, annotations map[string]string, referrer bool) {
+	t.Helper()
+	ctx := context.Background()
+	layer, err := repo.Blobs(ctx).Put(ctx, cosignPayloadMediaType, payload)
+	if err != nil {
+		t.Fatal(err)
+	}
+	layer.MediaType = cosignPayloadMediaType
+	layer.Annotations = annotations
+	if referrer {
+		putManifest(t, repo, ocischema.Manifest{ArtifactType: cosignArtifactType, Layers: []v1.Descriptor{layer}, Subject: &subject})
+		return
+	}
+	desc, _ := putManifest(t, repo, ocischema.Manifest{Layers: []v1.Descriptor{layer}})
+	if err := repo.Tags(ctx).Tag(ctx, strings.Replace(subject.Digest.String(), ":", "-", 1)+".sig", desc); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func pushKeySignature(t *testing.T, repo distribution.Repository, subject v1.Descriptor, key crypto.Signer, referrer bool) {
+	t.Helper()
+	payload := signaturePayload(subject.Digest)
+	pushSignature(t, repo, subject, payload, map[string]string{
+		cosignSignatureAnnotation: base64.StdEncoding.EncodeToString(sign(t, key, payload)),
+	}, referrer)
+}
+
+// expectVerified checks whether the manifest verifies, or is refused with an
+// ErrManifestSignatureInvalid.
+func expectVerified(t *testing.T, v *SignatureVerifier, repo distribution.Repository, desc v1.Descriptor, m distribution.Manifest, verified bool) {
+	t.Helper()
+	err := v.Verify(context.Background(), repo, desc.Digest, m)
+	switch {
+	case verified && err != nil:
+		t.Fatalf("manifest %s not verified: %v", desc.Digest, err)
+	case !verified && !errors.As(err, new(distribution.ErrManifestSignatureInvalid)):
+		t.Fatalf("expected ErrManifestSignatureInvalid verifying %s, got %v", desc.Digest, err)
+	}
+}
+
+func TestSignatureVerifierKeys(t *testing.T) {
+	key, keyFile := newSigningKey(t)
+	other, otherFile := newSigningKey(t)
+	v, err := NewSignatureVerifier(configuration.ProxyVerification{Keys: []string{otherFile, keyFile}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	repo := newSignedRepository(t, "prod/app")
+
+	tagged, taggedManifest := pushImage(t, repo, "tagged")
+	pushKeySignature(t, repo, tagged, key, false)
+	expectVerified(t, v, repo, tagged, taggedManifest, true)
+
+	referred, referredManifest := pushImage(t, repo, "referred")
+	pushKeySignature(t, repo, referred, other, true)
+	expectVerified(t, v, repo, referred, referredManifest, true)
+
+	missing, missingManifest := pushImage(t, repo, "missing")
+	expectVerified(t, v, repo, missing, missingManifest, false)
+
+	untrusted, untrustedManifest := pushImage(t, repo, "untrusted")
+	unknown, _ := newSigningKey(t)
+	pushKeySignature(t, repo, untrusted, unknown, false)
+	expectVerified(t, v, repo, untrusted, untrustedManifest, false)
+
+	// A signature of another manifest, copied.
+	copied, copiedManifest := pushImage(t, repo, "copied")
+	payload := signaturePayload(tagged.Digest)
+	pushSignature(t, repo, copied, payload, map[string]string{
+		cosignSignatureAnnotation: base64.StdEncoding.EncodeToString(sign(t, key, payload)),
+	}, true)
+	expectVerified(t, v, repo, copied, copiedManifest, false)
+}
+
+func TestSignatureVerifierCache(t *testing.T) {
+	key, keyFile := newSigningKey(t)
+	v, err := NewSignatureVerifier(configuration.ProxyVerification{Repositories: []string{"prod/*"}, Keys: []string{keyFile}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	now := time.Now()
+	v.now = func() time.Time { return now }
+
+	// The manifests of the repositories not matching are not verified.
+	dev := newSignedRepository(t, "dev/app")
+	desc, m := pushImage(t, dev, "unsigned")
+	expectVerified(t, v, dev, desc, m, true)
+
+	repo := newSignedRepository(t, "prod/app")
+	first, firstManifest := pushImage(t, repo, "first")
+	second, secondManifest := pushImage(t, repo, "second")
+	index, err := ocischema.FromDescriptors([]v1.Descriptor{first, second}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	manifests, err := repo.Manifests(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	indexDigest, err := manifests.Put(context.Background(), index)
+	if err != nil {
+		t.Fatal(err)
+	}
+	indexDesc := v1.Descriptor{MediaType: v1.MediaTypeImageIndex, Digest: indexDigest}
+
+	// The failure is cached until the signature pushed since is found.
+	expectVerified(t, v, repo, indexDesc, index, false)
+	pushKeySignature(t, repo, indexDesc, key, false)
+	expectVerified(t, v, repo, indexDesc, index, false)
+	now = now.Add(unverifiedTTL)
+	expectVerified(t, v, repo, indexDesc, index, true)
+
+	// The images of the index signed are trusted.
+	expectVerified(t, v, repo, first, firstManifest, true)
+	expectVerified(t, v, repo, second, secondManifest, true)
+}
+
+// fulcio issues certificates to identities, logged to rekor.
+type fulcio struct {
+	root, rekor *ecdsa.PrivateKey
+	rootCert    *x509.Certificate
+	config      configuration.ProxyKeyless
+}
+
+func newFulcio(t *testing.T) *fulcio {
+	t.Helper()
+	f := &fulcio{}
+	var err error
+	if f.root, err = ecdsa.GenerateKey(elliptic.P256(), rand.Reader); err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "fulcio"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		KeyUsage:              x509.KeyUsageCertSign,
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, f.root.Public(), f.root)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if f.rootCert, err = x509.ParseCertificate(der); err != nil {
+		t.Fatal(err)
+	}
+	var rekorFile string
+	f.rekor, rekorFile = newSigningKey(t)
+	f.config = configuration.ProxyKeyless{
+		Roots:    writePEM(t, "CERTIFICATE", der),
+		RekorKey: rekorFile,
+		Identities: []configuration.ProxyKeylessIdentity{
+			{Issuer: "https://accounts.example.com", Subject: `.*@example\.com`},
+		},
+	}
+	return f
+}
+
+// signature returns the annotations of a signature of the payload by the
+// identity, issued by the issuer, logged at the time.
+func (f *fulcio) signature(t *testing.T, issuer, email string, payload []byte, logged time.Time) map[string]string {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	issuerExt, err := asn1.MarshalWithParams(issuer, "utf8")
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber:    big.NewInt(2),
+		NotBefore:       time.Now().Add(-time.Minute),
+		NotAfter:        time.Now().Add(10 * time.Minute),
+		KeyUsage:        x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:     []x509.ExtKeyUsage{x509.ExtKeyUsageCodeSigning},
+		EmailAddresses:  []string{email},
+		ExtraExtensions: []pkix.Extension{{Id: fulcioIssuerV2, Value: issuerExt}},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, f.rootCert, key.Public(), f.root)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})
+	signature := sign(t, key, payload)
+
+	hash := sha256.Sum256(payload)
+	body, err := json.Marshal(map[string]any{
+		"apiVersion": "0.0.1",
+		"kind":       "hashedrekord",
+		"spec": map[string]any{
+			"data":      map[string]any{"hash": map[string]string{"algorithm": "sha256", "value": hex.EncodeToString(hash[:])}},
+			"signature": map[string]any{"content": signature, "publicKey": map[string]any{"content": cert}},
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	encodedBody := base64.StdEncoding.EncodeToString(body)
+	set := sign(t, f.rekor, []byte(fmt.Sprintf(`{"body":%q,"integratedTime":%d,"logID":"c0d23d6a","logIndex":42}`, encodedBody, logged.Unix())))
+	bundle, err := json.Marshal(map[string]any{
+		"SignedEntryTimestamp": set,
+		"Payload":              map[string]any{"body": encodedBody, "integratedTime": logged.Unix(), "logIndex": 42, "logID": "c0d23d6a"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return map[string]string{
+		cosignSignatureAnnotation:   base64.StdEncoding.EncodeToString(signature),
+		cosignCertificateAnnotation: string(cert),
+		cosignBundleAnnotation:      string(bundle),
+	}
+}
+
+func TestSignatureVerifierKeyless(t *testing.T) {
+	f := newFulcio(t)
+	v, err := NewSignatureVerifier(configuration.ProxyVerification{Keyless: &f.config})
+	if err != nil {
+		t.Fatal(err)
+	}
+	repo := newSignedRepository(t, "prod/app")
+
+	for _, tc := range []struct {
+		name     string
+		issuer   string
+		email    string
+		logged   time.Time
+		verified bool
+	}{
+		{name: "trusted", issuer: "https://accounts.example.com", email: "release@example.com", logged: time.Now(), verified: true},
+		{name: "other subject", issuer: "https://accounts.example.com", email: "release@example.org", logged: time.Now()},
+		{name: "other issuer", issuer: "https://issuer.example.org", email: "release@example.com", logged: time.Now()},
+		{name: "certificate expired", issuer: "https://accounts.example.com", email: "release@example.com", logged: time.Now().Add(time.Hour)},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			desc, m := pushImage(t, repo, tc.name)
+			payload := signaturePayload(desc.Digest)
+			pushSignature(t, repo, desc, payload, f.signature(t, tc.issuer, tc.email, payload, tc.logged), true)
+			expectVerified(t, v, repo, desc, m, tc.verified)
+		})
+	}
+
+	// A bundle logging another signature.
+	desc, m := pushImage(t, repo, "other bundle")
+	payload := signaturePayload(desc.Digest)
+	annotations := f.signature(t, "https://accounts.example.com", "release@example.com", payload, time.Now())
+	annotations[cosignBundleAnnotation] = f.signature(t, "https://accounts.example.com", "release@example.com", payload, time.Now())[cosignBundleAnnotation]
+	pushSignature(t, repo, desc, payload, annotations, false)
+	expectVerified(t, v, repo, desc, m, false)
+}
+
+func TestNewSignatureVerifierInvalid(t *testing.T) {
+	_, keyFile := newSigningKey(t)
+	f := newFulcio(t)
+	noIdentity := f.config
+	noIdentity.Identities = nil
+	notRoot := f.config
+	notRoot.Roots = keyFile
+
+	for name, config := range map[string]configuration.ProxyVerification{
+		"disabled":       {Repositories: []string{"prod/*"}},
+		"invalid key":    {Keys: []string{f.config.Roots}},
+		"missing key":    {Keys: []string{filepath.Join(t.TempDir(), "missing.pem")}},
+		"invalid glob":   {Repositories: []string{"prod/["}, Keys: []string{keyFile}},
+		"no identity":    {Keyless: &noIdentity},
+		"no fulcio root": {Keyless: &notRoot},
+	} {
+		if _, err := NewSignatureVerifier(config); err == nil {
+			t.Errorf("expected an error creating a verifier %s", name)
+		}
+	}
+}
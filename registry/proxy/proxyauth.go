@@ -1,6 +1,7 @@
 package proxy
 
 import (
+	"context"
 	"net"
 	"net/http"
 	"net/url"
@@ -45,11 +46,12 @@ func (c credentials) RefreshToken(u *url.URL, service string) string {
 func (c credentials) SetRefreshToken(u *url.URL, service, token string) {
 }
 
-// configureAuth stores credentials for challenge responses
-func configureAuth(username, password, remoteURL string) (auth.CredentialStore, auth.CredentialStore, error) {
+// configureAuth stores credentials for challenge responses, discovering the
+// token services of the remote with requests sent with tr.
+func configureAuth(username, password, remoteURL string, tr http.RoundTripper) (auth.CredentialStore, auth.CredentialStore, error) {
 	creds := map[string]userpass{}
 
-	authURLs, err := getAuthURLs(remoteURL)
+	authURLs, err := getAuthURLs(remoteURL, tr)
 	if err != nil {
 		return nil, nil, err
 	}
@@ -65,7 +67,20 @@ func configureAuth(username, password, remoteURL string) (auth.CredentialStore,
 	return credentials{creds: creds}, userpass{username: username, password: password}, nil
 }
 
-func getAuthURLs(remoteURL string) ([]string, error) {
+// basicChallengeManager presents a basic challenge for every endpoint, so that
+// the credentials are sent to a remote which requires them without challenging
+// the requests.
+type basicChallengeManager struct{}
+
+func (basicChallengeManager) GetChallenges(url.URL) ([]challenge.Challenge, error) {
+	return []challenge.Challenge{{Scheme: "basic", Parameters: map[string]string{}}}, nil
+}
+
+func (basicChallengeManager) AddResponse(*http.Response) error {
+	return nil
+}
+
+func getAuthURLs(remoteURL string, tr http.RoundTripper) ([]string, error) {
 	authURLs := []string{}
 
 	remote, err := url.Parse(remoteURL)
@@ -73,7 +88,7 @@ func getAuthURLs(remoteURL string) ([]string, error) {
 		return nil, err
 	}
 
-	resp, err := http.Get(remoteURL + "/v2/")
+	resp, err := (&http.Client{Transport: tr}).Get(remoteURL + "/v2/")
 	if err != nil {
 		return nil, err
 	}
@@ -131,8 +146,12 @@ func registrableDomain(host string) string {
 	return domain
 }
 
-func ping(manager challenge.Manager, endpoint, versionHeader string) error {
-	resp, err := http.Get(endpoint)
+func ping(ctx context.Context, tr http.RoundTripper, manager challenge.Manager, endpoint, versionHeader string) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, endpoint, nil)
+	if err != nil {
+		return err
+	}
+	resp, err := (&http.Client{Transport: tr}).Do(req)
 	if err != nil {
 		return err
 	}
@@ -1,8 +1,11 @@
 package proxy
 
 import (
+	"context"
 	"encoding/base64"
+	"errors"
 	"fmt"
+	"net/http"
 	"net/url"
 	"regexp"
 	"strings"
@@ -10,6 +13,7 @@ import (
 	"time"
 
 	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
 	awsCredentials "github.com/aws/aws-sdk-go/aws/credentials"
 	"github.com/aws/aws-sdk-go/aws/session"
 	"github.com/aws/aws-sdk-go/service/ecr"
@@ -19,16 +23,26 @@ import (
 	"github.com/distribution/distribution/v3/internal/client/auth"
 )
 
-var ecrURLPattern = regexp.MustCompile(`^(\d+)\.dkr\.ecr\.([^.]+)\.amazonaws\.com$`)
+// ecrURLPattern matches ECR registry hosts in the standard, FIPS, GovCloud
+// and China partitions, capturing the account ID and region.
+var ecrURLPattern = regexp.MustCompile(`^(\d+)\.dkr\.ecr(?:-fips)?\.([^.]+)\.amazonaws\.com(?:\.cn)?$`)
+
+// ecrClient is the part of the ECR client used to get the authorization
+// tokens.
+type ecrClient interface {
+	GetAuthorizationToken(*ecr.GetAuthorizationTokenInput) (*ecr.GetAuthorizationTokenOutput, error)
+}
 
 type ecrCredentials struct {
 	m          sync.Mutex
-	client     *ecr.ECR
+	client     ecrClient
 	registryID string
 	lifetime   *time.Duration
 	username   string
 	password   string
 	expiry     time.Time
+	// err is the error of the last refresh of Basic, if it failed.
+	err error
 }
 
 // Basic implements the auth.CredentialStore interface
@@ -41,7 +55,48 @@ func (c *ecrCredentials) Basic(url *url.URL) (string, string) {
 		return c.username, c.password
 	}
 
-	// Get authorization token from ECR
+	c.err = c.refresh(now)
+	if c.err != nil {
+		logrus.Errorf("failed to get ECR authorization token: %v", c.err)
+		return "", ""
+	}
+	return c.username, c.password
+}
+
+// failure returns the error getting the authorization token, if the last
+// call to Basic failed to.
+func (c *ecrCredentials) failure() error {
+	c.m.Lock()
+	defer c.m.Unlock()
+
+	return c.err
+}
+
+// Check returns an error if the cached token expires within margin and a new
+// one cannot be obtained, so that the loss of the permission to get tokens is
+// reported before the pulls fail. The token obtained is cached for the pulls,
+// so that the check does not add calls to the ECR API while the cached token
+// is valid for longer than margin.
+func (c *ecrCredentials) Check(_ context.Context, margin time.Duration) error {
+	c.m.Lock()
+	defer c.m.Unlock()
+
+	now := time.Now()
+	if c.username != "" && c.password != "" && now.Add(margin).Before(c.expiry) {
+		return nil
+	}
+	if err := c.refresh(now); err != nil {
+		var aerr awserr.Error
+		if errors.As(err, &aerr) {
+			return fmt.Errorf("failed to get ECR authorization token: %s: %s", aerr.Code(), aerr.Message())
+		}
+		return fmt.Errorf("failed to get ECR authorization token: %v", err)
+	}
+	return nil
+}
+
+// refresh gets a new authorization token from ECR.
+func (c *ecrCredentials) refresh(now time.Time) error {
 	input := &ecr.GetAuthorizationTokenInput{}
 	if c.registryID != "" {
 		input.RegistryIds = []*string{aws.String(c.registryID)}
@@ -49,13 +104,11 @@ func (c *ecrCredentials) Basic(url *url.URL) (string, string) {
 
 	result, err := c.client.GetAuthorizationToken(input)
 	if err != nil {
-		logrus.Errorf("failed to get ECR authorization token: %v", err)
-		return "", ""
+		return err
 	}
 
 	if len(result.AuthorizationData) == 0 {
-		logrus.Error("no authorization data returned from ECR")
-		return "", ""
+		return errors.New("no authorization data returned from ECR")
 	}
 
 	authData := result.AuthorizationData[0]
@@ -65,14 +118,12 @@ func (c *ecrCredentials) Basic(url *url.URL) (string, string) {
 	// Decode the base64 token to get username:password
 	decoded, err := base64.StdEncoding.DecodeString(token)
 	if err != nil {
-		logrus.Errorf("failed to decode ECR authorization token: %v", err)
-		return "", ""
+		return fmt.Errorf("failed to decode ECR authorization token: %v", err)
 	}
 
 	parts := strings.SplitN(string(decoded), ":", 2)
 	if len(parts) != 2 {
-		logrus.Error("invalid ECR authorization token format")
-		return "", ""
+		return errors.New("invalid ECR authorization token format")
 	}
 
 	c.username = parts[0]
@@ -87,7 +138,7 @@ func (c *ecrCredentials) Basic(url *url.URL) (string, string) {
 	}
 
 	logrus.Debugf("ECR credentials refreshed, expires at: %v", c.expiry)
-	return c.username, c.password
+	return nil
 }
 
 // RefreshToken implements the auth.CredentialStore interface
@@ -99,31 +150,67 @@ func (c *ecrCredentials) RefreshToken(_ *url.URL, _ string) string {
 func (c *ecrCredentials) SetRefreshToken(_ *url.URL, _, _ string) {
 }
 
-// parseECRURL extracts account ID and region from an ECR registry URL
+// parseECRURL extracts account ID and region from an ECR registry URL. The
+// scheme may be omitted, as in image references of the form host/repository.
 func parseECRURL(registryURL string) (accountID, region string, err error) {
-	u, err := url.Parse(registryURL)
+	host, err := registryHost(registryURL)
 	if err != nil {
-		return "", "", fmt.Errorf("invalid registry URL: %v", err)
+		return "", "", err
 	}
 
-	matches := ecrURLPattern.FindStringSubmatch(u.Host)
+	matches := ecrURLPattern.FindStringSubmatch(host)
 	if len(matches) != 3 {
-		return "", "", fmt.Errorf("URL does not match ECR registry pattern: %s", u.Host)
+		return "", "", fmt.Errorf("URL does not match ECR registry pattern: %s", host)
 	}
 
 	return matches[1], matches[2], nil
 }
 
-// configureECRAuth creates ECR credentials for the given configuration
-func configureECRAuth(cfg configuration.ECRConfig, remoteURL string) (auth.CredentialStore, error) {
+// registryHost returns the host of a registry URL, accepting URLs without a
+// scheme
+func registryHost(registryURL string) (string, error) {
+	if !strings.Contains(registryURL, "://") {
+		registryURL = "https://" + registryURL
+	}
+
+	u, err := url.Parse(registryURL)
+	if err != nil {
+		return "", fmt.Errorf("invalid registry URL: %v", err)
+	}
+
+	return u.Hostname(), nil
+}
+
+// configureECRAuth creates ECR credentials for the given configuration, whose
+// tokens are requested with tr.
+func configureECRAuth(cfg configuration.ECRConfig, remoteURL string, tr http.RoundTripper) (auth.CredentialStore, error) {
+	accountID, _, sess, err := ecrSession(cfg, remoteURL, tr)
+	if err != nil {
+		return nil, err
+	}
+
+	ecrClient := ecr.New(sess)
+
+	return &ecrCredentials{
+		client:     ecrClient,
+		registryID: accountID,
+		lifetime:   cfg.Lifetime,
+	}, nil
+}
+
+// ecrSession resolves the account ID and the region of the ECR registry, and
+// creates the AWS session its tokens are requested with: with the static keys
+// or the profile configured, otherwise with the AWS credential chain. The
+// requests of the session are sent with tr.
+func ecrSession(cfg configuration.ECRConfig, remoteURL string, tr http.RoundTripper) (accountID, region string, sess *session.Session, err error) {
 	// Parse account ID and region from remote URL if not provided
-	accountID := cfg.AccountID
-	region := cfg.Region
+	accountID = cfg.AccountID
+	region = cfg.Region
 
 	if accountID == "" || region == "" {
 		parsedAccountID, parsedRegion, err := parseECRURL(remoteURL)
 		if err != nil {
-			return nil, fmt.Errorf("failed to parse ECR URL %s: %v", remoteURL, err)
+			return "", "", nil, fmt.Errorf("failed to parse ECR URL %s: %v", remoteURL, err)
 		}
 		if accountID == "" {
 			accountID = parsedAccountID
@@ -135,7 +222,8 @@ func configureECRAuth(cfg configuration.ECRConfig, remoteURL string) (auth.Crede
 
 	// Create AWS session with the specified configuration
 	config := &aws.Config{
-		Region: aws.String(region),
+		Region:     aws.String(region),
+		HTTPClient: &http.Client{Transport: tr},
 	}
 
 	// Set up credentials if provided
@@ -150,25 +238,18 @@ func configureECRAuth(cfg configuration.ECRConfig, remoteURL string) (auth.Crede
 	}
 	// If no explicit credentials, will use AWS credential chain
 
-	sess, err := session.NewSession(config)
+	sess, err = session.NewSession(config)
 	if err != nil {
-		return nil, fmt.Errorf("failed to create AWS session: %v", err)
+		return "", "", nil, fmt.Errorf("failed to create AWS session: %v", err)
 	}
-
-	ecrClient := ecr.New(sess)
-
-	return &ecrCredentials{
-		client:     ecrClient,
-		registryID: accountID,
-		lifetime:   cfg.Lifetime,
-	}, nil
+	return accountID, region, sess, nil
 }
 
 // isECRURL determines if a URL is an AWS ECR registry URL
 func isECRURL(registryURL string) bool {
-	u, err := url.Parse(registryURL)
+	host, err := registryHost(registryURL)
 	if err != nil {
 		return false
 	}
-	return ecrURLPattern.MatchString(u.Host)
+	return ecrURLPattern.MatchString(host)
 }
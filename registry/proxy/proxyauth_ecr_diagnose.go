@@ -0,0 +1,133 @@
+package proxy
+
+import (
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/ecr"
+	"github.com/aws/aws-sdk-go/service/sts"
+
+	"github.com/distribution/distribution/v3/configuration"
+)
+
+// The steps of the diagnosis of ECR credentials.
+const (
+	ECRStepConfig      = "config"
+	ECRStepCredentials = "credentials"
+	ECRStepToken       = "token"
+)
+
+// stsClient is the part of the STS client used to get the identity of the
+// credentials.
+type stsClient interface {
+	GetCallerIdentity(*sts.GetCallerIdentityInput) (*sts.GetCallerIdentityOutput, error)
+}
+
+// newECRDiagnosisClients creates the ECR and STS clients of a diagnosis.
+var newECRDiagnosisClients = func(sess *session.Session) (ecrClient, stsClient) {
+	return ecr.New(sess), sts.New(sess)
+}
+
+// ECRDiagnosis reports which credentials the ECR authorization tokens of a
+// remote are requested with, and whether a token is granted.
+type ECRDiagnosis struct {
+	RemoteURL string `json:"remoteurl"`
+	AccountID string `json:"accountid,omitempty"`
+	Region    string `json:"region,omitempty"`
+
+	// Credentials are the credentials configured: "static keys",
+	// "profile <name>", or "default chain" for the AWS credential chain.
+	Credentials string `json:"credentials"`
+	// Provider is the provider which resolved the credentials, such as
+	// EnvConfigCredentials, SharedConfigCredentials, SSOProvider,
+	// WebIdentityCredentials or EC2RoleProvider in the default chain.
+	Provider    string `json:"provider,omitempty"`
+	AccessKeyID string `json:"accesskeyid,omitempty"`
+
+	// Identity is the ARN of the identity of the credentials, as returned
+	// by sts:GetCallerIdentity, or IdentityError why it is unknown.
+	Identity      string `json:"identity,omitempty"`
+	IdentityError string `json:"identityerror,omitempty"`
+
+	// TokenExpiry is the expiry of the authorization token granted.
+	TokenExpiry *time.Time `json:"tokenexpiry,omitempty"`
+
+	// FailedStep is the step which failed, one of ECRStepConfig,
+	// ECRStepCredentials or ECRStepToken, and Error its error.
+	FailedStep string `json:"failedstep,omitempty"`
+	Error      string `json:"error,omitempty"`
+}
+
+// DiagnoseECR resolves the credentials of the ECR remote as the pull through
+// cache does, reports the provider which resolved them and their identity,
+// and requests an authorization token for the account of the remote.
+func DiagnoseECR(remote configuration.ProxyRemote) ECRDiagnosis {
+	d := ECRDiagnosis{RemoteURL: remote.RemoteURL}
+	fail := func(step string, err error) ECRDiagnosis {
+		d.FailedStep = step
+		d.Error = awsErrorString(err)
+		return d
+	}
+	if remote.ECR == nil {
+		return fail(ECRStepConfig, errors.New("the remote has no ecr credentials"))
+	}
+	cfg := *remote.ECR
+	switch {
+	case cfg.AccessKeyID != "" && cfg.SecretAccessKey != "":
+		d.Credentials = "static keys"
+	case cfg.Profile != "":
+		d.Credentials = "profile " + cfg.Profile
+	default:
+		d.Credentials = "default chain"
+	}
+
+	accountID, region, sess, err := ecrSession(cfg, remote.RemoteURL, newRemoteTransport(remote))
+	if err != nil {
+		return fail(ECRStepConfig, err)
+	}
+	d.AccountID, d.Region = accountID, region
+
+	creds, err := sess.Config.Credentials.Get()
+	if err != nil {
+		return fail(ECRStepCredentials, err)
+	}
+	d.Provider = creds.ProviderName
+	d.AccessKeyID = creds.AccessKeyID
+
+	ecrClient, stsClient := newECRDiagnosisClients(sess)
+	if identity, err := stsClient.GetCallerIdentity(&sts.GetCallerIdentityInput{}); err != nil {
+		d.IdentityError = awsErrorString(err)
+	} else {
+		d.Identity = aws.StringValue(identity.Arn)
+	}
+
+	result, err := ecrClient.GetAuthorizationToken(&ecr.GetAuthorizationTokenInput{
+		RegistryIds: []*string{aws.String(accountID)},
+	})
+	if err != nil {
+		return fail(ECRStepToken, err)
+	}
+	if len(result.AuthorizationData) == 0 {
+		return fail(ECRStepToken, errors.New("no authorization data returned from ECR"))
+	}
+	d.TokenExpiry = result.AuthorizationData[0].ExpiresAt
+	return d
+}
+
+// awsErrorString describes the error with its AWS error code, and the status
+// and the id of the request it failed if any.
+func awsErrorString(err error) string {
+	var rerr awserr.RequestFailure
+	if errors.As(err, &rerr) {
+		return fmt.Sprintf("%s: %s (status %d, request id %s)", rerr.Code(), rerr.Message(), rerr.StatusCode(), rerr.RequestID())
+	}
+	var aerr awserr.Error
+	if errors.As(err, &aerr) {
+		return fmt.Sprintf("%s: %s", aerr.Code(), aerr.Message())
+	}
+	return err.Error()
+}
@@ -0,0 +1,205 @@
+package proxy
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/sts"
+
+	"github.com/distribution/distribution/v3/configuration"
+)
+
+// stubSTSClient returns the identity of an account, or fails.
+type stubSTSClient struct {
+	err error
+}
+
+func (c stubSTSClient) GetCallerIdentity(*sts.GetCallerIdentityInput) (*sts.GetCallerIdentityOutput, error) {
+	if c.err != nil {
+		return nil, c.err
+	}
+	return &sts.GetCallerIdentityOutput{Arn: aws.String("arn:aws:iam::123456789012:role/registry")}, nil
+}
+
+// isolateAWSEnvironment clears the environment of the AWS credential chain,
+// so that only the credentials set by the test are found.
+func isolateAWSEnvironment(t *testing.T) {
+	t.Helper()
+	for _, name := range []string{
+		"AWS_ACCESS_KEY_ID", "AWS_SECRET_ACCESS_KEY", "AWS_SESSION_TOKEN", "AWS_PROFILE",
+		"AWS_WEB_IDENTITY_TOKEN_FILE", "AWS_ROLE_ARN", "AWS_SDK_LOAD_CONFIG",
+		"AWS_CONTAINER_CREDENTIALS_RELATIVE_URI", "AWS_CONTAINER_CREDENTIALS_FULL_URI",
+	} {
+		t.Setenv(name, "")
+	}
+	missing := filepath.Join(t.TempDir(), "missing")
+	t.Setenv("AWS_SHARED_CREDENTIALS_FILE", missing)
+	t.Setenv("AWS_CONFIG_FILE", missing)
+	t.Setenv("AWS_EC2_METADATA_DISABLED", "true")
+}
+
+func TestDiagnoseECR(t *testing.T) {
+	const remoteURL = "https://123456789012.dkr.ecr.us-west-2.amazonaws.com"
+
+	for _, tc := range []struct {
+		name      string
+		remote    configuration.ProxyRemote
+		env       map[string]string
+		sharedIni string
+		ecr       *stubECRClient
+		sts       stubSTSClient
+		expected  ECRDiagnosis
+		// errContains is expected in the error of the failed step.
+		errContains string
+	}{
+		{
+			name:   "static keys",
+			remote: configuration.ProxyRemote{RemoteURL: remoteURL, ECR: &configuration.ECRConfig{AccessKeyID: "AKIASTATIC", SecretAccessKey: "secret"}},
+			expected: ECRDiagnosis{
+				Credentials: "static keys",
+				Provider:    "StaticProvider",
+				AccessKeyID: "AKIASTATIC",
+				Identity:    "arn:aws:iam::123456789012:role/registry",
+			},
+		},
+		{
+			name:      "profile",
+			remote:    configuration.ProxyRemote{RemoteURL: remoteURL, ECR: &configuration.ECRConfig{Profile: "ci"}},
+			sharedIni: "[ci]\naws_access_key_id = AKIAPROFILE\naws_secret_access_key = secret\n",
+			expected: ECRDiagnosis{
+				Credentials: "profile ci",
+				Provider:    "SharedCredentialsProvider",
+				AccessKeyID: "AKIAPROFILE",
+				Identity:    "arn:aws:iam::123456789012:role/registry",
+			},
+		},
+		{
+			name:   "default chain from the environment",
+			remote: configuration.ProxyRemote{RemoteURL: remoteURL, ECR: &configuration.ECRConfig{}},
+			env:    map[string]string{"AWS_ACCESS_KEY_ID": "AKIAENV", "AWS_SECRET_ACCESS_KEY": "secret"},
+			expected: ECRDiagnosis{
+				Credentials: "default chain",
+				Provider:    "EnvConfigCredentials",
+				AccessKeyID: "AKIAENV",
+				Identity:    "arn:aws:iam::123456789012:role/registry",
+			},
+		},
+		{
+			name:   "default chain from the shared credentials",
+			remote: configuration.ProxyRemote{RemoteURL: remoteURL, ECR: &configuration.ECRConfig{}},
+			env:    map[string]string{"AWS_PROFILE": "edge"},
+			// The profile of the environment is used, not the default one.
+			sharedIni: "[default]\naws_access_key_id = AKIADEFAULT\naws_secret_access_key = secret\n[edge]\naws_access_key_id = AKIAEDGE\naws_secret_access_key = secret\n",
+			expected: ECRDiagnosis{
+				Credentials: "default chain",
+				Provider:    "SharedConfigCredentials",
+				AccessKeyID: "AKIAEDGE",
+				Identity:    "arn:aws:iam::123456789012:role/registry",
+			},
+		},
+		{
+			name:   "no credentials in the default chain",
+			remote: configuration.ProxyRemote{RemoteURL: remoteURL, ECR: &configuration.ECRConfig{}},
+			expected: ECRDiagnosis{
+				Credentials: "default chain",
+				FailedStep:  ECRStepCredentials,
+			},
+			errContains: "NoCredentialProviders",
+		},
+		{
+			name:   "token denied",
+			remote: configuration.ProxyRemote{RemoteURL: remoteURL, ECR: &configuration.ECRConfig{AccessKeyID: "AKIASTATIC", SecretAccessKey: "secret"}},
+			ecr:    &stubECRClient{denied: true},
+			expected: ECRDiagnosis{
+				Credentials: "static keys",
+				Provider:    "StaticProvider",
+				AccessKeyID: "AKIASTATIC",
+				Identity:    "arn:aws:iam::123456789012:role/registry",
+				FailedStep:  ECRStepToken,
+			},
+			errContains: "AccessDeniedException: not authorized to perform ecr:GetAuthorizationToken (status 400, request id request-1)",
+		},
+		{
+			name:   "unknown identity",
+			remote: configuration.ProxyRemote{RemoteURL: remoteURL, ECR: &configuration.ECRConfig{AccessKeyID: "AKIASTATIC", SecretAccessKey: "secret"}},
+			sts:    stubSTSClient{err: awserr.New("InvalidClientTokenId", "The security token included in the request is invalid.", nil)},
+			expected: ECRDiagnosis{
+				Credentials:   "static keys",
+				Provider:      "StaticProvider",
+				AccessKeyID:   "AKIASTATIC",
+				IdentityError: "InvalidClientTokenId: The security token included in the request is invalid.",
+			},
+		},
+		{
+			name:   "not an ecr registry",
+			remote: configuration.ProxyRemote{RemoteURL: "https://registry.example.com", ECR: &configuration.ECRConfig{}},
+			expected: ECRDiagnosis{
+				Credentials: "default chain",
+				FailedStep:  ECRStepConfig,
+			},
+			errContains: "failed to parse ECR URL",
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			isolateAWSEnvironment(t)
+			if tc.sharedIni != "" {
+				file := filepath.Join(t.TempDir(), "credentials")
+				if err := os.WriteFile(file, []byte(tc.sharedIni), 0o600); err != nil {
+					t.Fatal(err)
+				}
+				t.Setenv("AWS_SHARED_CREDENTIALS_FILE", file)
+			}
+			for name, value := range tc.env {
+				t.Setenv(name, value)
+			}
+			ecrStub := tc.ecr
+			if ecrStub == nil {
+				ecrStub = &stubECRClient{}
+			}
+			defer func(f func(*session.Session) (ecrClient, stsClient)) { newECRDiagnosisClients = f }(newECRDiagnosisClients)
+			newECRDiagnosisClients = func(*session.Session) (ecrClient, stsClient) {
+				return ecrStub, tc.sts
+			}
+
+			d := DiagnoseECR(tc.remote)
+			if tc.errContains == "" && d.Error != "" || !strings.Contains(d.Error, tc.errContains) {
+				t.Fatalf("expected an error containing %q, got %q", tc.errContains, d.Error)
+			}
+			if d.FailedStep == "" && d.TokenExpiry == nil {
+				t.Fatal("expected the expiry of the token granted")
+			}
+			if d.FailedStep == "" && (d.AccountID != "123456789012" || d.Region != "us-west-2") {
+				t.Fatalf("unexpected account %q and region %q", d.AccountID, d.Region)
+			}
+			if d.FailedStep != ECRStepConfig && d.FailedStep != ECRStepCredentials && ecrStub.registryID != "123456789012" {
+				t.Fatalf("expected a token requested for the account of the remote, got %q", ecrStub.registryID)
+			}
+
+			got := ECRDiagnosis{
+				Credentials: d.Credentials,
+				// The providers of the shared config are named after
+				// their file.
+				Provider:      strings.SplitN(d.Provider, ":", 2)[0],
+				AccessKeyID:   d.AccessKeyID,
+				Identity:      d.Identity,
+				IdentityError: d.IdentityError,
+				FailedStep:    d.FailedStep,
+			}
+			if got != tc.expected {
+				t.Fatalf("expected %+v, got %+v", tc.expected, got)
+			}
+		})
+	}
+}
+
+func TestDiagnoseECRWithoutECR(t *testing.T) {
+	d := DiagnoseECR(configuration.ProxyRemote{RemoteURL: "https://registry.example.com"})
+	if d.FailedStep != ECRStepConfig {
+		t.Fatalf("expected the diagnosis of a remote without ecr credentials to fail, got %+v", d)
+	}
+}
@@ -1,10 +1,18 @@
 package proxy
 
 import (
+	"context"
+	"encoding/base64"
+	"net/http"
+	"strings"
 	"testing"
 	"time"
 
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/service/ecr"
 	"github.com/distribution/distribution/v3/configuration"
+	"github.com/distribution/distribution/v3/health"
 )
 
 func TestParseECRURL(t *testing.T) {
@@ -29,6 +37,36 @@ func TestParseECRURL(t *testing.T) {
 			wantRegion:  "eu-central-1",
 			wantErr:     false,
 		},
+		{
+			name:        "GovCloud ECR URL",
+			url:         "https://123456789012.dkr.ecr.us-gov-west-1.amazonaws.com",
+			wantAccount: "123456789012",
+			wantRegion:  "us-gov-west-1",
+		},
+		{
+			name:        "FIPS ECR URL",
+			url:         "https://123456789012.dkr.ecr-fips.us-gov-east-1.amazonaws.com",
+			wantAccount: "123456789012",
+			wantRegion:  "us-gov-east-1",
+		},
+		{
+			name:        "China ECR URL",
+			url:         "https://123456789012.dkr.ecr.cn-north-1.amazonaws.com.cn",
+			wantAccount: "123456789012",
+			wantRegion:  "cn-north-1",
+		},
+		{
+			name:        "ECR host without scheme",
+			url:         "123456789012.dkr.ecr.ap-southeast-2.amazonaws.com/team/app",
+			wantAccount: "123456789012",
+			wantRegion:  "ap-southeast-2",
+		},
+		{
+			name:        "ECR URL with port",
+			url:         "https://123456789012.dkr.ecr.eu-west-1.amazonaws.com:443",
+			wantAccount: "123456789012",
+			wantRegion:  "eu-west-1",
+		},
 		{
 			name:    "non-ECR URL",
 			url:     "https://registry-1.docker.io",
@@ -39,6 +77,11 @@ func TestParseECRURL(t *testing.T) {
 			url:     "not-a-url",
 			wantErr: true,
 		},
+		{
+			name:    "ECR lookalike host",
+			url:     "https://123456789012.dkr.ecr.us-west-2.amazonaws.com.evil.example",
+			wantErr: true,
+		},
 	}
 
 	for _, tt := range tests {
@@ -101,8 +144,84 @@ func TestConfigureECRAuth(t *testing.T) {
 		Lifetime:        func() *time.Duration { d := time.Hour; return &d }(),
 	}
 
-	_, err := configureECRAuth(cfg, "https://123456789012.dkr.ecr.us-west-2.amazonaws.com")
+	_, err := configureECRAuth(cfg, "https://123456789012.dkr.ecr.us-west-2.amazonaws.com", http.DefaultTransport)
 	if err != nil {
 		t.Errorf("configureECRAuth() error = %v", err)
 	}
 }
+
+// stubECRClient returns a token, or fails with AccessDenied while denied.
+type stubECRClient struct {
+	denied bool
+	calls  int
+	// registryID is the registry of the last token requested.
+	registryID string
+	// err, if set, is returned instead of a token.
+	err error
+}
+
+func (c *stubECRClient) GetAuthorizationToken(input *ecr.GetAuthorizationTokenInput) (*ecr.GetAuthorizationTokenOutput, error) {
+	c.calls++
+	if len(input.RegistryIds) > 0 {
+		c.registryID = aws.StringValue(input.RegistryIds[0])
+	}
+	if c.err != nil {
+		return nil, c.err
+	}
+	if c.denied {
+		return nil, awserr.NewRequestFailure(awserr.New("AccessDeniedException", "not authorized to perform ecr:GetAuthorizationToken", nil), 400, "request-1")
+	}
+	return &ecr.GetAuthorizationTokenOutput{
+		AuthorizationData: []*ecr.AuthorizationData{{
+			AuthorizationToken: aws.String(base64.StdEncoding.EncodeToString([]byte("AWS:password"))),
+			ExpiresAt:          aws.Time(time.Now().Add(12 * time.Hour)),
+		}},
+	}, nil
+}
+
+func TestECRCredentialsCheck(t *testing.T) {
+	ctx := context.Background()
+	client := &stubECRClient{}
+	lifetime := 30 * time.Minute
+	cs := &ecrCredentials{client: client, lifetime: &lifetime}
+	updater := health.NewThresholdStatusUpdater(2)
+	check := func(margin time.Duration) {
+		t.Helper()
+		updater.Update(cs.Check(ctx, margin))
+	}
+
+	// A token valid for longer than the margin is not refreshed, and is
+	// shared with the pulls.
+	check(time.Minute)
+	check(time.Minute)
+	if client.calls != 1 {
+		t.Fatalf("expected 1 call to ECR, got %d", client.calls)
+	}
+	if username, password := cs.Basic(nil); username != "AWS" || password != "password" || client.calls != 1 {
+		t.Fatalf("unexpected credentials %q:%q after %d calls", username, password, client.calls)
+	}
+	if err := updater.Check(ctx); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	// The token expiring within the margin is refreshed, failing the check
+	// once the threshold is reached.
+	client.denied = true
+	check(time.Hour)
+	if err := updater.Check(ctx); err != nil {
+		t.Fatalf("unexpected error below the threshold: %v", err)
+	}
+	check(time.Hour)
+	if err := updater.Check(ctx); err == nil || !strings.Contains(err.Error(), "AccessDeniedException") {
+		t.Fatalf("expected AccessDeniedException, got %v", err)
+	}
+
+	client.denied = false
+	check(time.Hour)
+	if err := updater.Check(ctx); err != nil {
+		t.Fatalf("unexpected error after recovery: %v", err)
+	}
+	if client.calls != 4 {
+		t.Fatalf("expected 4 calls to ECR, got %d", client.calls)
+	}
+}
@@ -0,0 +1,133 @@
+package proxy
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+
+	"github.com/aws/aws-sdk-go/aws/awserr"
+
+	"github.com/distribution/distribution/v3/internal/client"
+	"github.com/distribution/distribution/v3/internal/client/auth"
+	"github.com/distribution/distribution/v3/registry/api/errcode"
+)
+
+// UpstreamAuthError is returned when the upstream of a pull through cache, or
+// its token service, refuses the credentials of the remote, or when they
+// cannot be obtained. The clients of the cache being authorized by it
+// already, the error is served to them as a failure of the upstream naming
+// its host, rather than the error of the upstream.
+type UpstreamAuthError struct {
+	// Upstream is the host of the remote.
+	Upstream string
+	// Unavailable is set when the token service of the remote, or the
+	// service its credentials are obtained from, failed rather than refused
+	// the credentials.
+	Unavailable bool
+	// Err is the error of the upstream, which is logged but not served.
+	Err error
+}
+
+func newUpstreamAuthError(upstream string, unavailable bool, err error) *UpstreamAuthError {
+	reason := "denied"
+	if unavailable {
+		reason = "unavailable"
+	}
+	upstreamAuthFailures.WithValues(upstream, reason).Inc(1)
+	return &UpstreamAuthError{Upstream: upstream, Unavailable: unavailable, Err: err}
+}
+
+func (e *UpstreamAuthError) Error() string {
+	if e.Unavailable {
+		return fmt.Sprintf("authentication to upstream %s unavailable: %v", e.Upstream, e.Err)
+	}
+	return fmt.Sprintf("authentication to upstream %s failed: %v", e.Upstream, e.Err)
+}
+
+func (e *UpstreamAuthError) Unwrap() error {
+	return e.Err
+}
+
+// ClientError returns the error served to the clients of the cache, which
+// names the upstream but holds nothing of its response.
+func (e *UpstreamAuthError) ClientError() errcode.Error {
+	code := errcode.ErrorCodeUpstreamAuthFailed
+	if e.Unavailable {
+		code = errcode.ErrorCodeUpstreamAuthUnavailable
+	}
+	return code.WithDetail(map[string]string{"upstream": e.Upstream})
+}
+
+// upstreamAuthTransport returns the refusals of the requests to the remote as
+// UpstreamAuthError, the requests being authorized already.
+type upstreamAuthTransport struct {
+	http.RoundTripper
+	upstream string
+}
+
+func (t upstreamAuthTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	resp, err := t.RoundTripper.RoundTrip(req)
+	if err != nil || req.URL.Host != t.upstream {
+		return resp, err
+	}
+	if resp.StatusCode != http.StatusUnauthorized && resp.StatusCode != http.StatusForbidden {
+		return resp, nil
+	}
+	defer resp.Body.Close()
+	return nil, newUpstreamAuthError(t.upstream, false, client.HandleHTTPResponseError(resp))
+}
+
+// credentialFailer is implemented by the credential stores obtaining the
+// credentials from a service, which report why they could not.
+type credentialFailer interface {
+	// failure returns the error of the last attempt to obtain the
+	// credentials, if it failed.
+	failure() error
+}
+
+// upstreamAuthHandler returns the failures of an authentication handler to
+// authorize the requests to the remote as UpstreamAuthError.
+type upstreamAuthHandler struct {
+	auth.AuthenticationHandler
+	upstream string
+	creds    auth.CredentialStore
+}
+
+func (h upstreamAuthHandler) AuthorizeRequest(req *http.Request, params map[string]string) error {
+	err := h.AuthenticationHandler.AuthorizeRequest(req, params)
+	if err == nil || errors.Is(err, context.Canceled) {
+		return err
+	}
+	if failer, ok := h.creds.(credentialFailer); ok && errors.Is(err, auth.ErrNoBasicAuthCredentials) {
+		if failure := failer.failure(); failure != nil {
+			return newUpstreamAuthError(h.upstream, !credentialsRefused(failure), failure)
+		}
+	}
+	return newUpstreamAuthError(h.upstream, !credentialsRefused(err), err)
+}
+
+// credentialsRefused returns whether the error of a token service, or of the
+// service the credentials are obtained from, refuses the credentials, rather
+// than reports a failure of the service.
+func credentialsRefused(err error) bool {
+	if errors.Is(err, auth.ErrNoBasicAuthCredentials) {
+		return true
+	}
+
+	var errs errcode.Errors
+	if errors.As(err, &errs) && len(errs) > 0 {
+		err = errs[0]
+	}
+	var coded errcode.Error
+	if errors.As(err, &coded) {
+		return coded.Code == errcode.ErrorCodeUnauthorized || coded.Code == errcode.ErrorCodeDenied
+	}
+
+	var reqErr awserr.RequestFailure
+	if errors.As(err, &reqErr) {
+		return reqErr.StatusCode() >= 400 && reqErr.StatusCode() < 500 && reqErr.StatusCode() != http.StatusTooManyRequests
+	}
+	var aerr awserr.Error
+	return errors.As(err, &aerr) && aerr.Code() == "NoCredentialProviders"
+}
@@ -0,0 +1,192 @@
+package proxy
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/distribution/reference"
+	"github.com/opencontainers/go-digest"
+
+	"github.com/distribution/distribution/v3/configuration"
+	"github.com/distribution/distribution/v3/internal/client"
+	"github.com/distribution/distribution/v3/internal/client/auth"
+	"github.com/distribution/distribution/v3/internal/client/auth/challenge"
+	"github.com/distribution/distribution/v3/registry/api/errcode"
+)
+
+// authUpstream is an upstream challenging for a token, whose token service
+// and manifests respond with the statuses set.
+type authUpstream struct {
+	*httptest.Server
+
+	mu             sync.Mutex
+	tokenStatus    int
+	manifestStatus int
+}
+
+func newAuthUpstream(t *testing.T) *authUpstream {
+	t.Helper()
+
+	u := &authUpstream{tokenStatus: http.StatusOK, manifestStatus: http.StatusNotFound}
+	u.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		u.mu.Lock()
+		defer u.mu.Unlock()
+		switch {
+		case r.URL.Path == "/token":
+			if u.tokenStatus != http.StatusOK {
+				w.Header().Set("Content-Type", "application/json")
+				w.WriteHeader(u.tokenStatus)
+				fmt.Fprint(w, `{"errors": [{"code": "UNAUTHORIZED", "message": "secret upstream body"}]}`)
+				return
+			}
+			fmt.Fprint(w, `{"token": "upstream-token"}`)
+		case r.URL.Path == "/v2/" || r.Header.Get("Authorization") != "Bearer upstream-token":
+			w.Header().Set("WWW-Authenticate", fmt.Sprintf(`Bearer realm="http://%s/token",service="upstream"`, r.Host))
+			w.WriteHeader(http.StatusUnauthorized)
+		default:
+			w.WriteHeader(u.manifestStatus)
+		}
+	}))
+	t.Cleanup(u.Close)
+	return u
+}
+
+func (u *authUpstream) respond(tokenStatus, manifestStatus int) {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	u.tokenStatus, u.manifestStatus = tokenStatus, manifestStatus
+}
+
+// statManifest checks that the manifest exists through the transport of the
+// remote.
+func statManifest(ctx context.Context, t *testing.T, remote *proxyRemote) error {
+	t.Helper()
+
+	name, _ := reference.WithName("library/app")
+	if err := remote.authChallenger.tryEstablishChallenges(ctx); err != nil {
+		t.Fatal(err)
+	}
+	tr := remote.transport(ctx, auth.RepositoryScope{Repository: name.Name(), Actions: []string{"pull"}})
+	repo, err := client.NewRepository(name, remote.remoteURL.String(), tr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	manifests, err := repo.Manifests(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = manifests.Exists(ctx, digest.FromString("manifest"))
+	return err
+}
+
+func TestUpstreamAuthErrors(t *testing.T) {
+	ctx := context.Background()
+	upstream := newAuthUpstream(t)
+	remote, err := newProxyRemote(ctx, configuration.ProxyRemote{RemoteURL: upstream.URL, Username: "user", Password: "password"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	host := strings.TrimPrefix(upstream.URL, "http://")
+
+	for _, tc := range []struct {
+		name           string
+		tokenStatus    int
+		manifestStatus int
+		code           errcode.ErrorCode
+	}{
+		{"authorized", http.StatusOK, http.StatusNotFound, 0},
+		{"token refused", http.StatusUnauthorized, http.StatusNotFound, errcode.ErrorCodeUpstreamAuthFailed},
+		{"token service down", http.StatusServiceUnavailable, http.StatusNotFound, errcode.ErrorCodeUpstreamAuthUnavailable},
+		{"manifest denied", http.StatusOK, http.StatusForbidden, errcode.ErrorCodeUpstreamAuthFailed},
+	} {
+		upstream.respond(tc.tokenStatus, tc.manifestStatus)
+		err := statManifest(ctx, t, remote)
+		var authErr *UpstreamAuthError
+		if !errors.As(err, &authErr) {
+			if tc.code != 0 || err != nil {
+				t.Errorf("%s: unexpected error %v", tc.name, err)
+			}
+			continue
+		}
+		served := authErr.ClientError()
+		if served.Code != tc.code {
+			t.Errorf("%s: unexpected error code %v served for %v", tc.name, served.Code, err)
+		}
+		if detail, _ := served.Detail.(map[string]string); detail["upstream"] != host || len(detail) != 1 {
+			t.Errorf("%s: unexpected detail %v served", tc.name, served.Detail)
+		}
+	}
+
+	samples := scrapeUpstream(t, host)
+	for sample, expected := range map[string]float64{
+		`registry_proxy_upstream_auth_failures_total{reason="denied"}`:      2,
+		`registry_proxy_upstream_auth_failures_total{reason="unavailable"}`: 1,
+	} {
+		if samples[sample] != expected {
+			t.Errorf("unexpected value %v of %s, expected %v", samples[sample], sample, expected)
+		}
+	}
+}
+
+func TestUpstreamAuthErrorsECR(t *testing.T) {
+	ctx := context.Background()
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if _, _, ok := r.BasicAuth(); !ok || r.URL.Path == "/v2/" {
+			w.Header().Set("WWW-Authenticate", `Basic realm="upstream"`)
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		w.WriteHeader(http.StatusNotFound)
+	}))
+	defer upstream.Close()
+	remoteURL, _ := url.Parse(upstream.URL)
+
+	ecrClient := &stubECRClient{}
+	cs := &ecrCredentials{client: ecrClient}
+	tr := newUpstreamTransport(remoteURL.Host, http.DefaultTransport)
+	remote := &proxyRemote{
+		remoteURL: *remoteURL,
+		upstream:  tr,
+		authChallenger: &remoteAuthChallenger{
+			remoteURL: *remoteURL,
+			transport: tr,
+			cm:        challenge.NewSimpleManager(),
+			cs:        cs,
+		},
+		basicAuth: cs,
+	}
+
+	for _, tc := range []struct {
+		name string
+		err  error
+		code errcode.ErrorCode
+	}{
+		{"denied", awserr.NewRequestFailure(awserr.New("AccessDeniedException", "not authorized to perform ecr:GetAuthorizationToken", nil), 400, "request-1"), errcode.ErrorCodeUpstreamAuthFailed},
+		{"throttled", awserr.NewRequestFailure(awserr.New("ThrottlingException", "rate exceeded", nil), 429, "request-2"), errcode.ErrorCodeUpstreamAuthUnavailable},
+		{"authorized", nil, 0},
+	} {
+		ecrClient.err = tc.err
+		err := statManifest(ctx, t, remote)
+		var authErr *UpstreamAuthError
+		if !errors.As(err, &authErr) {
+			if tc.code != 0 || err != nil {
+				t.Errorf("%s: unexpected error %v", tc.name, err)
+			}
+			continue
+		}
+		if code := authErr.ClientError().Code; code != tc.code {
+			t.Errorf("%s: unexpected error code %v served for %v", tc.name, code, err)
+		}
+		if !errors.Is(err, tc.err) {
+			t.Errorf("%s: expected the error of ECR, got %v", tc.name, err)
+		}
+	}
+}
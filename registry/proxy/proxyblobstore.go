@@ -2,18 +2,24 @@ package proxy
 
 import (
 	"context"
+	"errors"
+	"fmt"
 	"io"
 	"net/http"
 	"strconv"
-	"sync"
 	"time"
 
 	"github.com/opencontainers/go-digest"
 	v1 "github.com/opencontainers/image-spec/specs-go/v1"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/trace"
 
 	"github.com/distribution/distribution/v3"
 	"github.com/distribution/distribution/v3/internal/dcontext"
+	"github.com/distribution/distribution/v3/registry/accesslog"
 	"github.com/distribution/distribution/v3/registry/proxy/scheduler"
+	"github.com/distribution/distribution/v3/registry/storage"
 	"github.com/distribution/reference"
 )
 
@@ -21,20 +27,32 @@ type proxyBlobStore struct {
 	localStore        distribution.BlobStore
 	remoteStore       distribution.BlobService
 	scheduler         *scheduler.TTLExpirationScheduler
-	ttl               *time.Duration
+	ttls              *ttlPolicy
 	cacheWriteTimeout time.Duration
 	repositoryName    reference.Named
 	authChallenger    authChallenger
+	quota             *cacheQuota
+	// maxBlobSize is the maximum size of a blob cached, the larger ones
+	// being streamed to the client without being cached. Unlimited if zero.
+	maxBlobSize int64
+	// prefetcher tracks the blobs prefetched, if prefetching is enabled.
+	prefetcher *prefetcher
+	// mediaTypes are the media types of the blobs learned from the
+	// manifests fetched, for their ttl.
+	mediaTypes *blobMediaTypes
+	// parallel fetches the large remote blobs in parts, if enabled.
+	parallel *parallelFetcher
+
+	// registry resolves the source repositories of blob mounts, which are
+	// not supported if it is nil.
+	registry *proxyingRegistry
+
+	// upstream is the host of the remote.
+	upstream string
 }
 
 var _ distribution.BlobStore = &proxyBlobStore{}
 
-// inflight tracks currently downloading blobs
-var inflight = make(map[digest.Digest]struct{})
-
-// mu protects inflight
-var mu sync.Mutex
-
 func setResponseHeaders(h http.Header, length int64, mediaType string, digest digest.Digest) {
 	h.Set("Content-Length", strconv.FormatInt(length, 10))
 	h.Set("Content-Type", mediaType)
@@ -42,30 +60,43 @@ func setResponseHeaders(h http.Header, length int64, mediaType string, digest di
 	h.Set("Etag", digest.String())
 }
 
-func (pbs *proxyBlobStore) copyContent(ctx context.Context, dgst digest.Digest, writer io.Writer, h http.Header) (v1.Descriptor, error) {
+func (pbs *proxyBlobStore) copyContent(ctx context.Context, dgst digest.Digest, writer io.Writer, h http.Header, push bool) (v1.Descriptor, error) {
 	desc, err := pbs.remoteStore.Stat(ctx, dgst)
 	if err != nil {
 		return v1.Descriptor{}, err
 	}
 
-	setResponseHeaders(h, desc.Size, desc.MediaType, dgst)
+	return desc, pbs.streamContent(ctx, desc, writer, h, push)
+}
 
-	remoteReader, err := pbs.remoteStore.Open(ctx, dgst)
-	if err != nil {
-		return v1.Descriptor{}, err
-	}
+// streamContent copies the remote blob described by desc into writer,
+// accounting for it as pushed to the client if push is set.
+func (pbs *proxyBlobStore) streamContent(ctx context.Context, desc v1.Descriptor, writer io.Writer, h http.Header, push bool) error {
+	setResponseHeaders(h, desc.Size, desc.MediaType, desc.Digest)
+	trace.SpanFromContext(ctx).SetAttributes(attribute.Int64(attributeSize, desc.Size))
 
-	defer remoteReader.Close()
+	if pbs.parallel.fetches(desc) {
+		if err := pbs.parallel.fetch(ctx, desc, writer); err != nil {
+			return err
+		}
+	} else {
+		remoteReader, err := pbs.remoteStore.Open(ctx, desc.Digest)
+		if err != nil {
+			return err
+		}
+		defer remoteReader.Close()
 
-	_, err = io.CopyN(writer, remoteReader, desc.Size)
-	if err != nil {
-		return v1.Descriptor{}, err
+		if _, err := io.CopyN(writer, remoteReader, desc.Size); err != nil {
+			return err
+		}
 	}
 
 	proxyMetrics.BlobPull(uint64(desc.Size))
-	proxyMetrics.BlobPush(uint64(desc.Size), false)
+	if push {
+		proxyMetrics.BlobPush(uint64(desc.Size), false)
+	}
 
-	return desc, nil
+	return nil
 }
 
 func (pbs *proxyBlobStore) serveLocal(ctx context.Context, w http.ResponseWriter, r *http.Request, dgst digest.Digest) (bool, error) {
@@ -77,42 +108,186 @@ func (pbs *proxyBlobStore) serveLocal(ctx context.Context, w http.ResponseWriter
 	}
 
 	proxyMetrics.BlobPush(uint64(localDesc.Size), true)
+	if pbs.prefetcher != nil {
+		pbs.prefetcher.requested(dgst)
+	}
 	return true, pbs.localStore.ServeBlob(ctx, w, r, dgst)
 }
 
 func (pbs *proxyBlobStore) ServeBlob(ctx context.Context, w http.ResponseWriter, r *http.Request, dgst digest.Digest) error {
+	ctx, span := tracer.Start(ctx, "ServeBlob", trace.WithAttributes(
+		attribute.String(attributeRepository, pbs.repositoryName.Name()),
+		attribute.String(attributeDigest, dgst.String())))
+	defer span.End()
+
 	served, err := pbs.serveLocal(ctx, w, r, dgst)
 	if err != nil {
 		dcontext.GetLogger(ctx).Errorf("Error serving blob from local storage: %s", err.Error())
+		span.SetStatus(codes.Error, err.Error())
 		return err
 	}
 
+	span.SetAttributes(attribute.Bool(attributeCacheHit, served))
+	record := accesslog.GetRecord(ctx)
+	record.SetCache(served)
 	if served {
 		return nil
 	}
 
+	start := time.Now()
+	err = pbs.fetchBlob(ctx, dgst, w, r)
+	record.AddUpstreamDuration(time.Since(start))
+	if err != nil {
+		span.SetStatus(codes.Error, err.Error())
+		return err
+	}
+	return nil
+}
+
+// fetchBlob serves the blob from the remote, caching it locally unless it is
+// already being fetched or is over the maximum size cached.
+func (pbs *proxyBlobStore) fetchBlob(ctx context.Context, dgst digest.Digest, w http.ResponseWriter, r *http.Request) error {
+	ctx, span := tracer.Start(ctx, "FetchBlob", trace.WithAttributes(
+		attribute.String(attributeRepository, pbs.repositoryName.Name()),
+		attribute.String(attributeDigest, dgst.String()),
+		attribute.String(attributeUpstream, pbs.upstream)))
+	defer span.End()
+
 	if err := pbs.authChallenger.tryEstablishChallenges(ctx); err != nil {
 		return err
 	}
 
-	mu.Lock()
-	_, ok := inflight[dgst]
-	if ok {
-		// If the blob has been serving in other requests.
-		// Will return the blob from the remote store directly.
-		// TODO Maybe we could reuse the these blobs are serving remotely and caching locally.
-		mu.Unlock()
-		_, err := pbs.copyContent(ctx, dgst, w, w.Header())
+	var remoteDesc *v1.Descriptor
+	if pbs.maxBlobSize > 0 {
+		desc, err := pbs.remoteStore.Stat(ctx, dgst)
+		if err != nil {
+			return err
+		}
+		if desc.Size > pbs.maxBlobSize {
+			dcontext.GetLogger(ctx).Infof("Blob %s of %d bytes is over the maximum size cached, serving it without caching", dgst, desc.Size)
+			return pbs.serveUncached(ctx, desc, w, r)
+		}
+		remoteDesc = &desc
+	}
+
+	blob, started := startInflight(dgst)
+	if !started {
+		// If the blob has been serving in other requests, a range is served
+		// from the content it stored, and the whole blob from the remote
+		// store directly.
+		if r.Header.Get("Range") != "" {
+			return pbs.serveInflightRange(ctx, blob, dgst, w, r)
+		}
+		_, err := pbs.copyContent(ctx, dgst, w, w.Header(), true)
 		return err
 	}
-	inflight[dgst] = struct{}{}
-	mu.Unlock()
+	defer finishInflight(dgst, blob)
 
-	defer func() {
-		mu.Lock()
-		delete(inflight, dgst)
-		mu.Unlock()
-	}()
+	return pbs.cacheContent(ctx, dgst, remoteDesc, w, w.Header())
+}
+
+// serveUncached serves the remote blob described by desc to the client
+// without caching it, verifying its digest as it is streamed. A range request
+// is forwarded to the remote, without verifying the digest.
+func (pbs *proxyBlobStore) serveUncached(ctx context.Context, desc v1.Descriptor, w http.ResponseWriter, r *http.Request) error {
+	if r.Header.Get("Range") == "" {
+		verifier := desc.Digest.Verifier()
+		if err := pbs.streamContent(ctx, desc, io.MultiWriter(w, verifier), w.Header(), true); err != nil {
+			return err
+		}
+		proxyMetrics.BlobStream(uint64(desc.Size))
+		if !verifier.Verified() {
+			dcontext.GetLogger(ctx).Errorf("Blob %s streamed from the remote does not match its digest", desc.Digest)
+			return distribution.ErrBlobInvalidDigest{Digest: desc.Digest, Reason: errors.New("content does not match digest")}
+		}
+		return nil
+	}
+
+	remoteReader, err := pbs.remoteStore.Open(ctx, desc.Digest)
+	if err != nil {
+		return err
+	}
+	defer remoteReader.Close()
+
+	setResponseHeaders(w.Header(), desc.Size, desc.MediaType, desc.Digest)
+	content := &sizedReadSeeker{remote: remoteReader, size: desc.Size}
+	http.ServeContent(w, r, "", time.Time{}, content)
+
+	proxyMetrics.BlobPull(uint64(content.read))
+	proxyMetrics.BlobPush(uint64(content.read), false)
+	proxyMetrics.BlobStream(uint64(content.read))
+	return nil
+}
+
+// sizedReadSeeker seeks in a remote blob of known size without requesting
+// the remote, which it only does once read from the offset sought, so that
+// the ranges requested are read from the remote. It counts the bytes read.
+type sizedReadSeeker struct {
+	remote  io.ReadSeeker
+	size    int64
+	offset  int64
+	pending bool
+	read    int64
+}
+
+func (s *sizedReadSeeker) Seek(offset int64, whence int) (int64, error) {
+	switch whence {
+	case io.SeekCurrent:
+		offset += s.offset
+	case io.SeekEnd:
+		offset += s.size
+	}
+	if offset < 0 {
+		return 0, errors.New("cannot seek to negative position")
+	}
+	s.offset = offset
+	s.pending = true
+	return offset, nil
+}
+
+func (s *sizedReadSeeker) Read(p []byte) (int, error) {
+	if s.pending {
+		if _, err := s.remote.Seek(s.offset, io.SeekStart); err != nil {
+			return 0, err
+		}
+		s.pending = false
+	}
+	n, err := s.remote.Read(p)
+	s.offset += int64(n)
+	s.read += int64(n)
+	return n, err
+}
+
+// cacheContent copies the remote blob into writer while storing it locally,
+// only streaming it if it does not fit in the cache quota. If writer is nil,
+// the blob is only stored, and is not fetched if it does not fit. The
+// descriptor of the remote blob is looked up if remoteDesc is nil.
+func (pbs *proxyBlobStore) cacheContent(ctx context.Context, dgst digest.Digest, remoteDesc *v1.Descriptor, w io.Writer, h http.Header) error {
+	push := w != nil
+	if pbs.quota != nil {
+		if remoteDesc == nil {
+			desc, err := pbs.remoteStore.Stat(ctx, dgst)
+			if err != nil {
+				return err
+			}
+			remoteDesc = &desc
+		}
+		desc := *remoteDesc
+
+		if !pbs.quota.reserve(ctx, desc.Size) {
+			if !push {
+				dcontext.GetLogger(ctx).Infof("Proxy cache quota exceeded, not caching %s", dgst)
+				return nil
+			}
+			dcontext.GetLogger(ctx).Infof("Proxy cache quota exceeded, serving %s without caching", dgst)
+			if err := pbs.streamContent(ctx, desc, w, h, push); err != nil {
+				return err
+			}
+			proxyMetrics.BlobStream(uint64(desc.Size))
+			return nil
+		}
+		defer pbs.quota.release(desc.Size)
+	}
 
 	// Create a detached context for the blob writer that won't be canceled
 	// when the HTTP request context is canceled. This allows the cache write
@@ -125,6 +300,9 @@ func (pbs *proxyBlobStore) ServeBlob(ctx context.Context, w http.ResponseWriter,
 	if err != nil {
 		return err
 	}
+	if stored, ok := bw.(storedContent); ok {
+		storeInflight(dgst, stored)
+	}
 
 	committed := false
 	// Ensure the writer is canceled if we return early with an error
@@ -138,8 +316,17 @@ func (pbs *proxyBlobStore) ServeBlob(ctx context.Context, w http.ResponseWriter,
 
 	// Serving client and storing locally over same fetching request.
 	// This can prevent a redundant blob fetching.
-	multiWriter := io.MultiWriter(w, bw)
-	desc, err := pbs.copyContent(ctx, dgst, multiWriter, w.Header())
+	var multiWriter io.Writer = bw
+	if push {
+		multiWriter = io.MultiWriter(w, bw)
+	}
+	var desc v1.Descriptor
+	if remoteDesc != nil {
+		desc = *remoteDesc
+		err = pbs.streamContent(ctx, desc, multiWriter, h, push)
+	} else {
+		desc, err = pbs.copyContent(ctx, dgst, multiWriter, h, push)
+	}
 	if err != nil {
 		return err
 	}
@@ -151,14 +338,21 @@ func (pbs *proxyBlobStore) ServeBlob(ctx context.Context, w http.ResponseWriter,
 
 	committed = true
 
+	return pbs.scheduleExpiry(ctx, dgst, desc.MediaType, desc.Size)
+}
+
+// scheduleExpiry schedules the expiry of the blob cached in the repository,
+// after the ttl of its media type.
+func (pbs *proxyBlobStore) scheduleExpiry(ctx context.Context, dgst digest.Digest, mediaType string, size int64) error {
 	blobRef, err := reference.WithDigest(pbs.repositoryName, dgst)
 	if err != nil {
 		dcontext.GetLogger(ctx).Errorf("Error creating reference: %s", err)
 		return err
 	}
 
-	if pbs.scheduler != nil && pbs.ttl != nil {
-		if err := pbs.scheduler.AddBlob(blobRef, *pbs.ttl); err != nil {
+	ttl := pbs.ttls.blobTTL(pbs.mediaTypes.mediaType(dgst, mediaType))
+	if pbs.scheduler != nil && (ttl != nil || pbs.quota != nil) {
+		if err := pbs.scheduler.AddBlobWithSize(blobRef, size, ttl); err != nil {
 			dcontext.GetLogger(ctx).Errorf("Error adding blob: %s", err)
 			return err
 		}
@@ -206,15 +400,159 @@ func (pbs *proxyBlobStore) Get(ctx context.Context, dgst digest.Digest) ([]byte,
 	return blob, nil
 }
 
+// Create mounts a blob from another proxied repository, the only blob write
+// supported by the cache. A blob which is not available to the source
+// repository is not mounted, and fails with ErrUnsupported like an upload.
+func (pbs *proxyBlobStore) Create(ctx context.Context, options ...distribution.BlobCreateOption) (distribution.BlobWriter, error) {
+	var opts distribution.CreateOptions
+	for _, option := range options {
+		if err := option.Apply(&opts); err != nil {
+			return nil, err
+		}
+	}
+	if !opts.Mount.ShouldMount || pbs.registry == nil {
+		return nil, distribution.ErrUnsupported
+	}
+
+	desc, err := pbs.mount(ctx, opts.Mount.From)
+	if err != nil {
+		if _, ok := err.(distribution.ErrRepositoryUnknown); ok || err == distribution.ErrBlobUnknown {
+			return nil, distribution.ErrUnsupported
+		}
+		return nil, err
+	}
+	return nil, distribution.ErrBlobMounted{From: opts.Mount.From, Descriptor: desc}
+}
+
+// mount links the blob of the proxied repository from into the repository.
+// The source repository must hold the blob, either cached locally or
+// upstream. A blob its upstream holds but which is not in the local blob
+// store yet is fetched through the source repository if fetchOnMount is set.
+func (pbs *proxyBlobStore) mount(ctx context.Context, from reference.Canonical) (v1.Descriptor, error) {
+	repo, err := pbs.registry.Repository(ctx, from)
+	if err != nil {
+		return v1.Descriptor{}, err
+	}
+	source, ok := repo.Blobs(ctx).(*proxyBlobStore)
+	if !ok {
+		return v1.Descriptor{}, distribution.ErrUnsupported
+	}
+	dgst := from.Digest()
+
+	desc, err := source.localStore.Stat(ctx, dgst)
+	if err == distribution.ErrBlobUnknown {
+		desc, err = source.fetchForMount(ctx, dgst)
+	}
+	if err != nil {
+		return v1.Descriptor{}, err
+	}
+
+	bw, err := pbs.localStore.Create(ctx, storage.WithMountFrom(from), mountStat{desc: desc})
+	if err == nil {
+		// Mounts are disabled in the local storage.
+		if err := bw.Cancel(ctx); err != nil {
+			dcontext.GetLogger(ctx).WithError(err).Errorf("Error canceling blob writer")
+		}
+		return v1.Descriptor{}, distribution.ErrUnsupported
+	}
+	ebm, ok := err.(distribution.ErrBlobMounted)
+	if !ok {
+		return v1.Descriptor{}, err
+	}
+
+	if err := pbs.scheduleExpiry(ctx, dgst, ebm.Descriptor.MediaType, ebm.Descriptor.Size); err != nil {
+		return v1.Descriptor{}, err
+	}
+	return ebm.Descriptor, nil
+}
+
+// fetchForMount checks the remote of the repository holds the blob, and
+// returns its descriptor once it is in the local blob store. The blob is
+// cached in the repository if it is not in the local blob store yet and
+// fetchOnMount is set; ErrBlobUnknown is returned otherwise.
+func (pbs *proxyBlobStore) fetchForMount(ctx context.Context, dgst digest.Digest) (v1.Descriptor, error) {
+	if err := pbs.authChallenger.tryEstablishChallenges(ctx); err != nil {
+		return v1.Descriptor{}, err
+	}
+	desc, err := pbs.remoteStore.Stat(ctx, dgst)
+	if err != nil {
+		return v1.Descriptor{}, err
+	}
+
+	if _, err := pbs.registry.BlobStatter().Stat(ctx, dgst); err != distribution.ErrBlobUnknown {
+		return desc, err
+	}
+	if !pbs.registry.fetchOnMount || (pbs.maxBlobSize > 0 && desc.Size > pbs.maxBlobSize) {
+		return v1.Descriptor{}, distribution.ErrBlobUnknown
+	}
+
+	blob, started := startInflight(dgst)
+	if !started {
+		// The blob is being cached by another request, and is not available
+		// until it completes.
+		return v1.Descriptor{}, distribution.ErrBlobUnknown
+	}
+	defer finishInflight(dgst, blob)
+
+	if err := pbs.cacheContent(ctx, dgst, &desc, io.Discard, http.Header{}); err != nil {
+		return v1.Descriptor{}, err
+	}
+	// The blob is not cached if it exceeds the cache quota.
+	return pbs.localStore.Stat(ctx, dgst)
+}
+
+// fetchToCache caches the remote blob described by desc, unless it is cached
+// already, being fetched by another request or over the maximum size cached,
+// returning the size cached. Zero is returned if the blob was not cached by
+// the call.
+func (pbs *proxyBlobStore) fetchToCache(ctx context.Context, desc v1.Descriptor) (int64, error) {
+	if pbs.maxBlobSize > 0 && desc.Size > pbs.maxBlobSize {
+		return 0, nil
+	}
+	if _, err := pbs.localStore.Stat(ctx, desc.Digest); err == nil {
+		return 0, nil
+	}
+	if err := pbs.authChallenger.tryEstablishChallenges(ctx); err != nil {
+		return 0, err
+	}
+
+	blob, started := startInflight(desc.Digest)
+	if !started {
+		return 0, nil
+	}
+	defer finishInflight(desc.Digest, blob)
+
+	if err := pbs.cacheContent(ctx, desc.Digest, nil, nil, http.Header{}); err != nil {
+		return 0, err
+	}
+	// The blob is not cached if it exceeds the cache quota.
+	cached, err := pbs.localStore.Stat(ctx, desc.Digest)
+	if err != nil {
+		return 0, nil
+	}
+	return cached.Size, nil
+}
+
+// mountStat passes the descriptor of the blob mounted, so that the local
+// storage does not look for the blob in the source repository.
+type mountStat struct {
+	desc v1.Descriptor
+}
+
+func (m mountStat) Apply(v any) error {
+	opts, ok := v.(*distribution.CreateOptions)
+	if !ok {
+		return fmt.Errorf("unexpected options type: %T", v)
+	}
+	opts.Mount.Stat = &m.desc
+	return nil
+}
+
 // Unsupported functions
 func (pbs *proxyBlobStore) Put(ctx context.Context, mediaType string, p []byte) (v1.Descriptor, error) {
 	return v1.Descriptor{}, distribution.ErrUnsupported
 }
 
-func (pbs *proxyBlobStore) Create(ctx context.Context, options ...distribution.BlobCreateOption) (distribution.BlobWriter, error) {
-	return nil, distribution.ErrUnsupported
-}
-
 func (pbs *proxyBlobStore) Resume(ctx context.Context, id string) (distribution.BlobWriter, error) {
 	return nil, distribution.ErrUnsupported
 }
@@ -1,16 +1,21 @@
 package proxy
 
 import (
+	"bytes"
 	"context"
 	"io"
 	"math/rand"
 	"net/http"
 	"net/http/httptest"
+	"path"
+	"strconv"
 	"sync"
+	"sync/atomic"
 	"testing"
 	"time"
 
 	"github.com/distribution/distribution/v3"
+	"github.com/distribution/distribution/v3/internal/client"
 	"github.com/distribution/distribution/v3/registry/proxy/scheduler"
 	"github.com/distribution/distribution/v3/registry/storage"
 	"github.com/distribution/distribution/v3/registry/storage/cache/memory"
@@ -416,6 +421,375 @@ func TestProxyStoreServeMetricsConcurrent(t *testing.T) {
 	}
 }
 
+func TestProxyStoreServeQuota(t *testing.T) {
+	for _, tc := range []struct {
+		name  string
+		evict bool
+	}{
+		{name: "evict", evict: true},
+		{name: "stream", evict: false},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			te := makeTestEnv(t, "foo/bar")
+			populate(t, te, 3, 100, 3)
+
+			var evicted []digest.Digest
+			s := te.store.scheduler
+			s.OnBlobExpire(func(ref reference.Reference) error {
+				evicted = append(evicted, ref.(reference.Canonical).Digest())
+				return nil
+			})
+			if err := s.Start(); err != nil {
+				t.Fatal(err)
+			}
+			defer s.Stop()
+
+			te.store.quota = &cacheQuota{
+				limit:     250,
+				evict:     tc.evict,
+				scheduler: s,
+			}
+
+			for _, remoteBlob := range te.inRemote {
+				w := httptest.NewRecorder()
+				r, err := http.NewRequest(http.MethodGet, "", nil)
+				if err != nil {
+					t.Fatal(err)
+				}
+
+				if err := te.store.ServeBlob(te.ctx, w, r, remoteBlob.Digest); err != nil {
+					t.Fatal(err)
+				}
+				if digest.FromBytes(w.Body.Bytes()) != remoteBlob.Digest {
+					t.Fatalf("Mismatching blob fetch from proxy")
+				}
+				time.Sleep(time.Millisecond)
+			}
+
+			if total := s.BlobBytes(); total != 200 {
+				t.Fatalf("unexpected cached bytes: %d", total)
+			}
+
+			_, err := te.store.localStore.Stat(te.ctx, te.inRemote[2].Digest)
+			if tc.evict {
+				if len(evicted) != 1 || evicted[0] != te.inRemote[0].Digest {
+					t.Fatalf("expected the oldest blob to be evicted, got %v", evicted)
+				}
+				if err != nil {
+					t.Fatalf("expected newest blob to be cached: %v", err)
+				}
+			} else {
+				if len(evicted) != 0 {
+					t.Fatalf("unexpected evictions: %v", evicted)
+				}
+				if err == nil {
+					t.Fatal("expected over-quota blob not to be cached")
+				}
+			}
+		})
+	}
+}
+
+func TestProxyQuotaReconcile(t *testing.T) {
+	name, err := reference.WithName("foo/bar")
+	if err != nil {
+		t.Fatal(err)
+	}
+	refs := make([]reference.Canonical, 2)
+	for i := range refs {
+		ref, err := reference.WithDigest(name, digest.FromString(strconv.Itoa(i)))
+		if err != nil {
+			t.Fatal(err)
+		}
+		refs[i] = ref
+	}
+
+	s := scheduler.New(context.Background(), inmemory.New(), "/scheduler-state.json")
+	if err := s.Start(); err != nil {
+		t.Fatal(err)
+	}
+	defer s.Stop()
+	for _, ref := range refs {
+		if err := s.AddBlobWithSize(ref, 100, nil); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// The second blob is deleted out of band after the first reconciliation.
+	var reconciled atomic.Int32
+	stat := func(ref reference.Reference) (int64, bool, error) {
+		if ref.String() == refs[1].String() {
+			return 100, reconciled.Add(1) == 1, nil
+		}
+		return 100, true, nil
+	}
+	quota := &cacheQuota{limit: 1000, scheduler: s, stop: make(chan struct{})}
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		quota.reconcile(context.Background(), 10*time.Millisecond, stat)
+	}()
+
+	deadline := time.Now().Add(5 * time.Second)
+	for s.BlobBytes() != 100 {
+		if time.Now().After(deadline) {
+			t.Fatalf("the usage was not reconciled: %d bytes", s.BlobBytes())
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	quota.close()
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("the reconciliation did not stop on close")
+	}
+}
+
+// blobUpstream serves blobs over http like a remote registry, recording the
+// ranges requested.
+type blobUpstream struct {
+	*httptest.Server
+	blobs map[digest.Digest][]byte
+	// hold, if set, holds the responses to the requests of whole blobs
+	// halfway until it is closed.
+	hold chan struct{}
+
+	mu     sync.Mutex
+	ranges []string
+}
+
+func newBlobUpstream(t *testing.T, blobs ...[]byte) *blobUpstream {
+	t.Helper()
+
+	u := &blobUpstream{blobs: make(map[digest.Digest][]byte)}
+	for _, blob := range blobs {
+		u.blobs[digest.FromBytes(blob)] = blob
+	}
+	u.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		blob, ok := u.blobs[digest.Digest(path.Base(r.URL.Path))]
+		if !ok {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		if r.Header.Get("Range") != "" {
+			u.mu.Lock()
+			u.ranges = append(u.ranges, r.Header.Get("Range"))
+			u.mu.Unlock()
+		}
+		w.Header().Set("Docker-Content-Digest", digest.FromBytes(blob).String())
+		if u.hold != nil && r.Method == http.MethodGet && r.Header.Get("Range") == "" {
+			w.Header().Set("Content-Length", strconv.Itoa(len(blob)))
+			w.Write(blob[:len(blob)/2])
+			w.(http.Flusher).Flush()
+			<-u.hold
+			w.Write(blob[len(blob)/2:])
+			return
+		}
+		http.ServeContent(w, r, "", time.Time{}, bytes.NewReader(blob))
+	}))
+	t.Cleanup(u.Close)
+	return u
+}
+
+func (u *blobUpstream) requestedRanges() []string {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	return append([]string(nil), u.ranges...)
+}
+
+func TestProxyStoreServeMaxBlobSize(t *testing.T) {
+	ctx := context.Background()
+	te := makeTestEnv(t, "foo/bar")
+	under, over := makeBlob(100), makeBlob(101)
+	upstream := newBlobUpstream(t, under, over)
+	remoteRepo, err := client.NewRepository(te.store.repositoryName, upstream.URL, http.DefaultTransport)
+	if err != nil {
+		t.Fatal(err)
+	}
+	te.store.remoteStore = remoteRepo.Blobs(ctx)
+	te.store.maxBlobSize = 100
+	ttl := time.Hour
+	te.store.ttls = &ttlPolicy{blob: &ttl}
+	if err := te.store.scheduler.Start(); err != nil {
+		t.Fatal(err)
+	}
+	defer te.store.scheduler.Stop()
+
+	serve := func(blob []byte, rangeHeader string) *httptest.ResponseRecorder {
+		t.Helper()
+		w := httptest.NewRecorder()
+		r := httptest.NewRequest(http.MethodGet, "/", nil)
+		if rangeHeader != "" {
+			r.Header.Set("Range", rangeHeader)
+		}
+		if err := te.store.ServeBlob(ctx, w, r, digest.FromBytes(blob)); err != nil {
+			t.Fatal(err)
+		}
+		return w
+	}
+	streamed := proxyMetrics.blobMetrics.BytesStreamed
+
+	// The blob over the limit is streamed without being cached.
+	if w := serve(over, ""); w.Code != http.StatusOK || !bytes.Equal(w.Body.Bytes(), over) {
+		t.Fatalf("unexpected blob over the limit served with status %d", w.Code)
+	}
+	if _, err := te.store.localStore.Stat(ctx, digest.FromBytes(over)); err != distribution.ErrBlobUnknown {
+		t.Fatalf("expected the blob over the limit not to be cached: %v", err)
+	}
+	if n := te.store.scheduler.Len(); n != 0 {
+		t.Fatalf("unexpected %d scheduler entries for the blob over the limit", n)
+	}
+	if n := proxyMetrics.blobMetrics.BytesStreamed - streamed; n != 101 {
+		t.Fatalf("expected 101 bytes streamed, got %d", n)
+	}
+
+	// The range requested is forwarded to the remote.
+	w := serve(over, "bytes=10-19")
+	if w.Code != http.StatusPartialContent || !bytes.Equal(w.Body.Bytes(), over[10:20]) {
+		t.Fatalf("unexpected range served with status %d: %q", w.Code, w.Body.Bytes())
+	}
+	if contentRange := w.Header().Get("Content-Range"); contentRange != "bytes 10-19/101" {
+		t.Fatalf("unexpected Content-Range %q", contentRange)
+	}
+	if ranges := upstream.requestedRanges(); len(ranges) != 1 || ranges[0] != "bytes=10-" {
+		t.Fatalf("expected the range to be forwarded to the remote, got %v", ranges)
+	}
+	if n := proxyMetrics.blobMetrics.BytesStreamed - streamed; n != 111 {
+		t.Fatalf("expected 111 bytes streamed, got %d", n)
+	}
+
+	// The blob at the limit is cached.
+	if w := serve(under, ""); w.Code != http.StatusOK || !bytes.Equal(w.Body.Bytes(), under) {
+		t.Fatalf("unexpected blob at the limit served with status %d", w.Code)
+	}
+	if _, err := te.store.localStore.Stat(ctx, digest.FromBytes(under)); err != nil {
+		t.Fatalf("expected the blob at the limit to be cached: %v", err)
+	}
+	if n := te.store.scheduler.Len(); n != 1 {
+		t.Fatalf("expected a scheduler entry for the blob at the limit, got %d", n)
+	}
+	if n := proxyMetrics.blobMetrics.BytesStreamed - streamed; n != 111 {
+		t.Fatalf("expected 111 bytes streamed, got %d", n)
+	}
+}
+
+func TestProxyStoreServeUncachedDigestMismatch(t *testing.T) {
+	ctx := context.Background()
+	te := makeTestEnv(t, "foo/bar")
+	blob := makeBlob(101)
+	upstream := newBlobUpstream(t)
+	// The remote serves other content under the digest of the blob.
+	upstream.blobs[digest.FromBytes(blob)] = makeBlob(101)
+	remoteRepo, err := client.NewRepository(te.store.repositoryName, upstream.URL, http.DefaultTransport)
+	if err != nil {
+		t.Fatal(err)
+	}
+	te.store.remoteStore = remoteRepo.Blobs(ctx)
+	te.store.maxBlobSize = 100
+
+	w := httptest.NewRecorder()
+	err = te.store.ServeBlob(ctx, w, httptest.NewRequest(http.MethodGet, "/", nil), digest.FromBytes(blob))
+	if _, ok := err.(distribution.ErrBlobInvalidDigest); !ok {
+		t.Fatalf("expected ErrBlobInvalidDigest streaming mismatching content, got %v", err)
+	}
+}
+
+func TestProxyStoreServeRangeInflight(t *testing.T) {
+	defer func(wait time.Duration) { inflightRangeWait = wait }(inflightRangeWait)
+	inflightRangeWait = 100 * time.Millisecond
+
+	ctx := context.Background()
+	te := makeTestEnv(t, "foo/bar")
+	blob := makeBlob(256 << 10)
+	dgst := digest.FromBytes(blob)
+	upstream := newBlobUpstream(t, blob)
+	upstream.hold = make(chan struct{})
+	remoteRepo, err := client.NewRepository(te.store.repositoryName, upstream.URL, http.DefaultTransport)
+	if err != nil {
+		t.Fatal(err)
+	}
+	te.store.remoteStore = remoteRepo.Blobs(ctx)
+	te.store.cacheWriteTimeout = time.Minute
+
+	serve := func(rangeHeader string) *httptest.ResponseRecorder {
+		t.Helper()
+		w := httptest.NewRecorder()
+		r := httptest.NewRequest(http.MethodGet, "/", nil)
+		if rangeHeader != "" {
+			r.Header.Set("Range", rangeHeader)
+		}
+		if err := te.store.ServeBlob(ctx, w, r, dgst); err != nil {
+			t.Fatal(err)
+		}
+		return w
+	}
+
+	// The upstream is slow to serve the second half of the blob fetched.
+	fetched := make(chan *httptest.ResponseRecorder)
+	go func() {
+		w := httptest.NewRecorder()
+		if err := te.store.ServeBlob(ctx, w, httptest.NewRequest(http.MethodGet, "/", nil), dgst); err != nil {
+			t.Error(err)
+		}
+		fetched <- w
+	}()
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		mu.Lock()
+		var stored storedContent
+		if b, ok := inflight[dgst]; ok {
+			stored = b.stored
+		}
+		mu.Unlock()
+		if stored != nil {
+			if size, err := stored.StoredSize(ctx); err == nil && size >= 64<<10 {
+				break
+			}
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("the fetch did not store the first half of the blob")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	// An early range is served from the content stored by the fetch.
+	if w := serve("bytes=100-1099"); w.Code != http.StatusPartialContent || !bytes.Equal(w.Body.Bytes(), blob[100:1100]) {
+		t.Fatalf("unexpected early range served with status %d", w.Code)
+	}
+	if ranges := upstream.requestedRanges(); len(ranges) != 0 {
+		t.Fatalf("expected the early range to be served locally, requested %v", ranges)
+	}
+
+	// A late range is requested from the remote after waiting for the fetch.
+	late := len(blob) - 1000
+	if w := serve("bytes=" + strconv.Itoa(late) + "-"); w.Code != http.StatusPartialContent || !bytes.Equal(w.Body.Bytes(), blob[late:]) {
+		t.Fatalf("unexpected late range served with status %d", w.Code)
+	}
+	if ranges := upstream.requestedRanges(); len(ranges) != 1 || ranges[0] != "bytes="+strconv.Itoa(late)+"-" {
+		t.Fatalf("expected the late range to be requested from the remote, requested %v", ranges)
+	}
+
+	// The blob fetched is cached once verified.
+	close(upstream.hold)
+	if w := <-fetched; !bytes.Equal(w.Body.Bytes(), blob) {
+		t.Fatal("unexpected blob fetched")
+	}
+	cached, err := te.store.localStore.Get(ctx, dgst)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if digest.FromBytes(cached) != dgst {
+		t.Fatal("the blob cached does not match its digest")
+	}
+	if w := serve("bytes=" + strconv.Itoa(late) + "-"); w.Code != http.StatusPartialContent || !bytes.Equal(w.Body.Bytes(), blob[late:]) {
+		t.Fatalf("unexpected range of the blob cached served with status %d", w.Code)
+	}
+	if ranges := upstream.requestedRanges(); len(ranges) != 1 {
+		t.Fatalf("expected the range of the blob cached to be served locally, requested %v", ranges)
+	}
+}
+
 // testProxyStoreServe will create clients to consume all blobs
 // populated in the truth store
 func testProxyStoreServe(t *testing.T, te *testEnv, numClients int) {
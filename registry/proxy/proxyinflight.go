@@ -0,0 +1,246 @@
+package proxy
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/opencontainers/go-digest"
+	v1 "github.com/opencontainers/image-spec/specs-go/v1"
+
+	"github.com/distribution/distribution/v3/internal/dcontext"
+)
+
+var (
+	// inflightRangeWait is how long a range of a blob being fetched waits
+	// for the fetch to store its offset, before it is requested from the
+	// remote instead.
+	inflightRangeWait = time.Second
+	// inflightRangePoll is the interval at which the content stored by the
+	// fetch is checked while waiting.
+	inflightRangePoll = 20 * time.Millisecond
+)
+
+// inflight tracks currently downloading blobs
+var inflight = make(map[digest.Digest]*inflightBlob)
+
+// mu protects inflight, and the content stored of its blobs
+var mu sync.Mutex
+
+// storedContent is implemented by the blob writers of the local storage, which
+// can read the content written before it is committed.
+type storedContent interface {
+	StoredSize(ctx context.Context) (int64, error)
+	StoredReader(ctx context.Context, offset int64) (io.ReadCloser, error)
+}
+
+// inflightBlob is a blob being fetched from the remote and cached.
+type inflightBlob struct {
+	// done is closed once the fetch completes, successfully or not.
+	done chan struct{}
+	// stored is the content written by the fetch, once it started writing
+	// it, if the local storage can read it.
+	stored storedContent
+}
+
+// startInflight marks the blob as being fetched, returning the blob fetched
+// already and false if it was.
+func startInflight(dgst digest.Digest) (*inflightBlob, bool) {
+	mu.Lock()
+	defer mu.Unlock()
+	if blob, ok := inflight[dgst]; ok {
+		return blob, false
+	}
+	blob := &inflightBlob{done: make(chan struct{})}
+	inflight[dgst] = blob
+	return blob, true
+}
+
+// finishInflight marks the blob started by startInflight as fetched.
+func finishInflight(dgst digest.Digest, blob *inflightBlob) {
+	mu.Lock()
+	delete(inflight, dgst)
+	mu.Unlock()
+	close(blob.done)
+}
+
+// storeInflight records the writer the blob being fetched is written to.
+func storeInflight(dgst digest.Digest, stored storedContent) {
+	mu.Lock()
+	defer mu.Unlock()
+	if blob, ok := inflight[dgst]; ok {
+		blob.stored = stored
+	}
+}
+
+// readStored reads the content stored by the fetch from the offset, waiting
+// up to inflightRangeWait for the fetch to store it. It returns nil if the
+// fetch did not store the offset in time, or completed.
+func (b *inflightBlob) readStored(ctx context.Context, offset int64) io.ReadCloser {
+	deadline := time.Now().Add(inflightRangeWait)
+	for {
+		mu.Lock()
+		stored := b.stored
+		mu.Unlock()
+		if stored != nil {
+			// The content is moved once committed, failing to be read.
+			if size, err := stored.StoredSize(ctx); err == nil && size > offset {
+				if reader, err := stored.StoredReader(ctx, offset); err == nil {
+					return reader
+				}
+			}
+		}
+		if !time.Now().Before(deadline) {
+			return nil
+		}
+		select {
+		case <-b.done:
+			return nil
+		case <-ctx.Done():
+			return nil
+		case <-time.After(inflightRangePoll):
+		}
+	}
+}
+
+// serveInflightRange serves the range requested of a blob being fetched by
+// another request. The range is read from the content the fetch stored, once
+// it stored its offset, from the local blob store once the fetch completed,
+// and is otherwise forwarded to the remote. The content served to the range
+// is not verified, the fetch verifying the blob cached.
+func (pbs *proxyBlobStore) serveInflightRange(ctx context.Context, blob *inflightBlob, dgst digest.Digest, w http.ResponseWriter, r *http.Request) error {
+	desc, err := pbs.remoteStore.Stat(ctx, dgst)
+	if err != nil {
+		return err
+	}
+
+	content := &inflightReadSeeker{ctx: ctx, pbs: pbs, blob: blob, desc: desc}
+	defer content.Close()
+
+	setResponseHeaders(w.Header(), desc.Size, desc.MediaType, desc.Digest)
+	http.ServeContent(w, r, "", time.Time{}, content)
+
+	proxyMetrics.BlobPull(uint64(content.remoteRead))
+	proxyMetrics.BlobPush(uint64(content.remoteRead), false)
+	proxyMetrics.BlobPush(uint64(content.localRead), true)
+	return nil
+}
+
+// inflightReadSeeker seeks in a blob being fetched, and reads from the offset
+// sought the content the fetch stored, the local blob store or the remote, as
+// available. It counts the bytes read locally and from the remote.
+type inflightReadSeeker struct {
+	ctx  context.Context
+	pbs  *proxyBlobStore
+	blob *inflightBlob
+	desc v1.Descriptor
+
+	offset int64
+	reader io.ReadCloser
+	// stored is set when the reader reads the content stored by the fetch,
+	// which ends where the fetch is.
+	stored bool
+	// remote is set once the remote is read, which it is until the end.
+	remote bool
+
+	localRead  int64
+	remoteRead int64
+}
+
+func (s *inflightReadSeeker) Seek(offset int64, whence int) (int64, error) {
+	switch whence {
+	case io.SeekCurrent:
+		offset += s.offset
+	case io.SeekEnd:
+		offset += s.desc.Size
+	}
+	if offset < 0 {
+		return 0, errors.New("cannot seek to negative position")
+	}
+	if offset != s.offset {
+		s.closeReader()
+		s.remote = false
+	}
+	s.offset = offset
+	return offset, nil
+}
+
+func (s *inflightReadSeeker) Read(p []byte) (int, error) {
+	if s.offset >= s.desc.Size {
+		return 0, io.EOF
+	}
+	for {
+		if s.reader == nil {
+			if err := s.open(); err != nil {
+				return 0, err
+			}
+		}
+		n, err := s.reader.Read(p)
+		s.offset += int64(n)
+		if s.remote {
+			s.remoteRead += int64(n)
+		} else {
+			s.localRead += int64(n)
+		}
+		if err == io.EOF && s.stored && s.offset < s.desc.Size {
+			// The fetch stored no more yet, the reader being opened again
+			// once it does.
+			s.closeReader()
+			if n == 0 {
+				continue
+			}
+			err = nil
+		}
+		return n, err
+	}
+}
+
+// open opens the reader at the offset, from the content stored by the fetch
+// or the local blob store, falling back to the remote.
+func (s *inflightReadSeeker) open() error {
+	if !s.remote {
+		if reader := s.blob.readStored(s.ctx, s.offset); reader != nil {
+			s.reader, s.stored = reader, true
+			return nil
+		}
+		select {
+		case <-s.blob.done:
+			if reader, err := s.pbs.localStore.Open(s.ctx, s.desc.Digest); err == nil {
+				if _, err := reader.Seek(s.offset, io.SeekStart); err == nil {
+					s.reader = reader
+					return nil
+				}
+				reader.Close()
+			}
+		default:
+		}
+	}
+
+	dcontext.GetLogger(s.ctx).Debugf("Requesting the range of %s from offset %d being fetched from the remote", s.desc.Digest, s.offset)
+	reader, err := s.pbs.remoteStore.Open(s.ctx, s.desc.Digest)
+	if err != nil {
+		return err
+	}
+	if _, err := reader.Seek(s.offset, io.SeekStart); err != nil {
+		reader.Close()
+		return err
+	}
+	s.reader, s.remote = reader, true
+	return nil
+}
+
+func (s *inflightReadSeeker) closeReader() {
+	if s.reader != nil {
+		s.reader.Close()
+		s.reader = nil
+	}
+	s.stored = false
+}
+
+func (s *inflightReadSeeker) Close() error {
+	s.closeReader()
+	return nil
+}
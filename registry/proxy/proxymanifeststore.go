@@ -5,9 +5,16 @@ import (
 	"time"
 
 	"github.com/opencontainers/go-digest"
+	v1 "github.com/opencontainers/image-spec/specs-go/v1"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/trace"
+	"golang.org/x/sync/singleflight"
 
 	"github.com/distribution/distribution/v3"
 	"github.com/distribution/distribution/v3/internal/dcontext"
+	"github.com/distribution/distribution/v3/manifest/schema1"
+	"github.com/distribution/distribution/v3/registry/accesslog"
 	"github.com/distribution/distribution/v3/registry/proxy/scheduler"
 	"github.com/distribution/reference"
 )
@@ -18,10 +25,37 @@ type proxyManifestStore struct {
 	remoteManifests distribution.ManifestService
 	repositoryName  reference.Named
 	scheduler       *scheduler.TTLExpirationScheduler
-	ttl             *time.Duration
+	ttls            *ttlPolicy
 	authChallenger  authChallenger
+	// maxSize is the maximum size of a manifest fetched from the remote,
+	// unlimited if zero.
+	maxSize int64
+	// upstream is the host of the remote.
+	upstream string
+	// onFetch, if set, is called once for each manifest fetched from the
+	// remote and cached.
+	onFetch func(context.Context, ManifestFetch)
+	// prefetch, if set, starts fetching the blobs referenced by the
+	// manifests fetched from the remote in the background.
+	prefetch func(context.Context, distribution.Manifest)
+	// verify, if set, verifies the signatures of the manifests fetched from
+	// the remote before they are cached.
+	verify func(context.Context, digest.Digest, distribution.Manifest) error
+	// schema1 applies the schema1 policy of the registry to the schema1
+	// manifests fetched from the remote.
+	schema1 schema1Policy
+	// tagFilter restricts the tags pulled from the remote. The manifests of
+	// the tags passed through are not cached.
+	tagFilter *tagFilter
+	// blobMediaTypes learns the media types of the blobs referenced by the
+	// manifests fetched, for their ttl.
+	blobMediaTypes *blobMediaTypes
 }
 
+// manifestFetches shares the fetch of a manifest from the remote between
+// the concurrent requests missing it.
+var manifestFetches singleflight.Group
+
 var _ distribution.ManifestService = &proxyManifestStore{}
 
 func (pms proxyManifestStore) Exists(ctx context.Context, dgst digest.Digest) (bool, error) {
@@ -41,17 +75,31 @@ func (pms proxyManifestStore) Exists(ctx context.Context, dgst digest.Digest) (b
 func (pms proxyManifestStore) Get(ctx context.Context, dgst digest.Digest, options ...distribution.ManifestServiceOption) (distribution.Manifest, error) {
 	// At this point `dgst` was either specified explicitly, or returned by the
 	// tagstore with the most recent association.
+	ctx, span := tracer.Start(ctx, "GetManifest", trace.WithAttributes(
+		attribute.String(attributeRepository, pms.repositoryName.Name()),
+		attribute.String(attributeDigest, dgst.String())))
+	defer span.End()
+
 	var fromRemote bool
 	manifest, err := pms.localManifests.Get(ctx, dgst, options...)
+	if converted, ok := pms.schema1.convertedDigest(pms.repositoryName, dgst); err != nil && ok {
+		manifest, err = pms.localManifests.Get(ctx, converted, options...)
+	}
 	if err != nil {
-		if err := pms.authChallenger.tryEstablishChallenges(ctx); err != nil {
-			return nil, err
+		start := time.Now()
+		key := pms.repositoryName.Name() + "@" + dgst.String()
+		if !pms.caches(options) {
+			key += " passthrough"
 		}
-
-		manifest, err = pms.remoteManifests.Get(ctx, dgst, options...)
+		v, err, _ := manifestFetches.Do(key, func() (any, error) {
+			return pms.fetch(ctx, dgst, options...)
+		})
+		accesslog.GetRecord(ctx).AddUpstreamDuration(time.Since(start))
 		if err != nil {
+			span.SetStatus(codes.Error, err.Error())
 			return nil, err
 		}
+		manifest = v.(distribution.Manifest)
 		fromRemote = true
 	}
 
@@ -60,35 +108,136 @@ func (pms proxyManifestStore) Get(ctx context.Context, dgst digest.Digest, optio
 		return nil, err
 	}
 
+	span.SetAttributes(
+		attribute.Bool(attributeCacheHit, !fromRemote),
+		attribute.Int(attributeSize, len(payload)))
 	proxyMetrics.ManifestPush(uint64(len(payload)), !fromRemote)
-	if fromRemote {
-		proxyMetrics.ManifestPull(uint64(len(payload)))
+	accesslog.GetRecord(ctx).SetCache(!fromRemote)
+	return manifest, nil
+}
 
-		_, err = pms.localManifests.Put(ctx, manifest)
+// fetch gets the manifest from the remote and caches it locally.
+func (pms proxyManifestStore) fetch(ctx context.Context, dgst digest.Digest, options ...distribution.ManifestServiceOption) (_ distribution.Manifest, err error) {
+	ctx, span := tracer.Start(ctx, "FetchManifest", trace.WithAttributes(
+		attribute.String(attributeRepository, pms.repositoryName.Name()),
+		attribute.String(attributeDigest, dgst.String()),
+		attribute.String(attributeUpstream, pms.upstream)))
+	defer func() {
 		if err != nil {
+			span.SetStatus(codes.Error, err.Error())
+		}
+		span.End()
+	}()
+
+	if err := pms.authChallenger.tryEstablishChallenges(ctx); err != nil {
+		return nil, err
+	}
+
+	start := time.Now()
+	manifest, err := pms.remoteManifests.Get(ctx, dgst, options...)
+	if err != nil {
+		return nil, err
+	}
+	duration := time.Since(start)
+
+	mediaType, payload, err := manifest.Payload()
+	if err != nil {
+		return nil, err
+	}
+	span.SetAttributes(attribute.Int(attributeSize, len(payload)))
+
+	if pms.maxSize > 0 && int64(len(payload)) > pms.maxSize {
+		dcontext.GetLogger(ctx).Warnf("Refusing to cache manifest %s of %d bytes, over the maximum size of %d bytes", dgst, len(payload), pms.maxSize)
+		return nil, distribution.ErrManifestTooLarge{Limit: pms.maxSize}
+	}
+
+	if pms.verify != nil {
+		if err := pms.verify(ctx, dgst, manifest); err != nil {
+			dcontext.GetLogger(ctx).Warnf("Refusing to cache manifest %s: %v", dgst, err)
 			return nil, err
 		}
+	}
 
-		// Schedule the manifest blob for removal
-		repoBlob, err := reference.WithDigest(pms.repositoryName, dgst)
-		if err != nil {
-			dcontext.GetLogger(ctx).Errorf("Error creating reference: %s", err)
+	// The schema1 manifests are cached as the schema2 manifests converted
+	// from them, if at all.
+	cached := dgst
+	if m, ok := manifest.(*schema1.DeserializedManifest); ok {
+		if manifest, cached, err = pms.schema1.apply(ctx, pms.repositoryName, dgst, m); err != nil {
+			dcontext.GetLogger(ctx).Warnf("Refusing to cache manifest %s: %v", dgst, err)
 			return nil, err
 		}
+	}
+
+	proxyMetrics.ManifestPull(uint64(len(payload)))
 
-		if pms.scheduler != nil && pms.ttl != nil {
-			if err := pms.scheduler.AddManifest(repoBlob, *pms.ttl); err != nil {
-				dcontext.GetLogger(ctx).Errorf("Error adding manifest: %s", err)
-				return nil, err
-			}
+	if !pms.caches(options) {
+		return manifest, nil
+	}
+
+	_, err = pms.localManifests.Put(ctx, manifest)
+	if err != nil {
+		return nil, err
+	}
+	if cached != dgst {
+		pms.schema1.recordConversion(pms.repositoryName, dgst, cached)
+	}
+
+	// Schedule the manifest blob for removal
+	repoBlob, err := reference.WithDigest(pms.repositoryName, cached)
+	if err != nil {
+		dcontext.GetLogger(ctx).Errorf("Error creating reference: %s", err)
+		return nil, err
+	}
+
+	cachedType, _, _ := manifest.Payload()
+	if ttl := pms.ttls.manifestTTL(cachedType); pms.scheduler != nil && ttl != nil {
+		if err := pms.scheduler.AddManifest(repoBlob, *ttl); err != nil {
+			dcontext.GetLogger(ctx).Errorf("Error adding manifest: %s", err)
+			return nil, err
 		}
+	}
+	pms.blobMediaTypes.learn(manifest)
 
-		// Ensure the manifest blob is cleaned up
-		// pms.scheduler.AddBlob(blobRef, repositoryTTL)
+	// Ensure the manifest blob is cleaned up
+	// pms.scheduler.AddBlob(blobRef, repositoryTTL)
 
+	if pms.prefetch != nil {
+		pms.prefetch(ctx, manifest)
 	}
 
-	return manifest, err
+	if pms.onFetch != nil {
+		fetch := ManifestFetch{
+			Repository: pms.repositoryName,
+			Descriptor: v1.Descriptor{
+				MediaType: mediaType,
+				Digest:    dgst,
+				Size:      int64(len(payload)),
+			},
+			Upstream: pms.upstream,
+			Duration: duration,
+		}
+		fetch.Tag = tagOption(options)
+		pms.onFetch(ctx, fetch)
+	}
+
+	return manifest, nil
+}
+
+// caches returns whether the manifest fetched with the options is cached,
+// unless its tag is passed through.
+func (pms proxyManifestStore) caches(options []distribution.ManifestServiceOption) bool {
+	tag := tagOption(options)
+	return tag == "" || pms.tagFilter.allows(tag)
+}
+
+// tagOption returns the tag of the options, if any.
+func tagOption(options []distribution.ManifestServiceOption) string {
+	for _, option := range options {
+		if opt, ok := option.(distribution.WithTagOption); ok {
+			return opt.Tag
+		}
+	}
+	return ""
 }
 
 func (pms proxyManifestStore) Put(ctx context.Context, manifest distribution.Manifest, options ...distribution.ManifestServiceOption) (digest.Digest, error) {
@@ -99,3 +248,12 @@ func (pms proxyManifestStore) Put(ctx context.Context, manifest distribution.Man
 func (pms proxyManifestStore) Delete(ctx context.Context, dgst digest.Digest) error {
 	return distribution.ErrUnsupported
 }
+
+// Referrers lists the referrers of the manifests stored locally.
+func (pms proxyManifestStore) Referrers(ctx context.Context, subject digest.Digest, artifactType string) ([]v1.Descriptor, error) {
+	lister, ok := pms.localManifests.(distribution.ReferrersLister)
+	if !ok {
+		return nil, distribution.ErrUnsupported
+	}
+	return lister.Referrers(ctx, subject, artifactType)
+}
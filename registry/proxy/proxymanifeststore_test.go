@@ -3,12 +3,17 @@ package proxy
 import (
 	"bytes"
 	"context"
+	"os"
+	"path/filepath"
 	"sync"
 	"testing"
+	"time"
 
 	"github.com/distribution/distribution/v3"
+	"github.com/distribution/distribution/v3/configuration"
 	"github.com/distribution/distribution/v3/internal/client/auth"
 	"github.com/distribution/distribution/v3/internal/client/auth/challenge"
+	"github.com/distribution/distribution/v3/manifest/schema1"
 	"github.com/distribution/distribution/v3/manifest/schema2"
 	"github.com/distribution/distribution/v3/registry/proxy/scheduler"
 	"github.com/distribution/distribution/v3/registry/storage"
@@ -16,6 +21,7 @@ import (
 	"github.com/distribution/distribution/v3/registry/storage/driver/inmemory"
 	"github.com/distribution/distribution/v3/testutil"
 	"github.com/distribution/reference"
+	"github.com/hashicorp/golang-lru/arc/v2"
 	"github.com/opencontainers/go-digest"
 	"github.com/opencontainers/image-spec/specs-go"
 	v1 "github.com/opencontainers/image-spec/specs-go/v1"
@@ -291,6 +297,190 @@ func TestProxyManifestsWithoutScheduler(t *testing.T) {
 	}
 }
 
+func TestProxyManifestsMaxSize(t *testing.T) {
+	name := "foo/bar"
+	env := newManifestStoreTestEnv(t, name, "latest")
+	localStats := env.LocalStats()
+
+	ctx := context.Background()
+	env.manifests.maxSize = int64(env.manifestSize) - 1
+	_, err := env.manifests.Get(ctx, env.manifestDigest)
+	if _, ok := err.(distribution.ErrManifestTooLarge); !ok {
+		t.Fatalf("expected ErrManifestTooLarge getting a manifest over the limit, got %v", err)
+	}
+	if (*localStats)["put"] != 0 {
+		t.Fatal("manifest over the limit was cached")
+	}
+
+	env.manifests.maxSize = int64(env.manifestSize)
+	if _, err := env.manifests.Get(ctx, env.manifestDigest); err != nil {
+		t.Fatal(err)
+	}
+	if (*localStats)["put"] != 1 {
+		t.Fatal("manifest within the limit was not cached")
+	}
+}
+
+func TestProxyManifestsVerification(t *testing.T) {
+	env := newManifestStoreTestEnv(t, "foo/bar", "latest")
+	localStats := env.LocalStats()
+
+	ctx := context.Background()
+	refused := distribution.ErrManifestSignatureInvalid{Digest: env.manifestDigest}
+	env.manifests.verify = func(ctx context.Context, dgst digest.Digest, manifest distribution.Manifest) error {
+		return refused
+	}
+	if _, err := env.manifests.Get(ctx, env.manifestDigest); err != refused {
+		t.Fatalf("expected ErrManifestSignatureInvalid getting an unverified manifest, got %v", err)
+	}
+	if (*localStats)["put"] != 0 {
+		t.Fatal("unverified manifest was cached")
+	}
+
+	env.manifests.verify = func(ctx context.Context, dgst digest.Digest, manifest distribution.Manifest) error {
+		return nil
+	}
+	if _, err := env.manifests.Get(ctx, env.manifestDigest); err != nil {
+		t.Fatal(err)
+	}
+	if (*localStats)["put"] != 1 {
+		t.Fatal("verified manifest was not cached")
+	}
+}
+
+func TestProxyManifestsMediaTypes(t *testing.T) {
+	name := "foo/bar"
+	env := newManifestStoreTestEnv(t, name, "latest")
+
+	ctx := context.Background()
+	localRegistry, err := storage.NewRegistry(ctx, inmemory.New(),
+		storage.AllowMediaTypes("", []string{v1.MediaTypeImageManifest}, nil))
+	if err != nil {
+		t.Fatalf("error creating registry: %v", err)
+	}
+	localRepo, err := localRegistry.Repository(ctx, env.manifests.repositoryName)
+	if err != nil {
+		t.Fatalf("unexpected error getting repo: %v", err)
+	}
+	lr, err := localRepo.Manifests(ctx, storage.SkipLayerVerification())
+	if err != nil {
+		t.Fatal(err)
+	}
+	env.manifests.localManifests = lr
+
+	_, err = env.manifests.Get(ctx, env.manifestDigest)
+	if _, ok := err.(distribution.ErrManifestVerification); !ok {
+		t.Fatalf("expected ErrManifestVerification getting a manifest of a disallowed media type, got %v", err)
+	}
+	if exists, err := lr.Exists(ctx, env.manifestDigest); err != nil || exists {
+		t.Fatalf("manifest of a disallowed media type was cached: %v", err)
+	}
+}
+
+// schema1Manifests serves a schema1 manifest, counting its gets.
+type schema1Manifests struct {
+	distribution.ManifestService
+	manifest distribution.Manifest
+	gets     int
+}
+
+func (sm *schema1Manifests) Get(ctx context.Context, dgst digest.Digest, options ...distribution.ManifestServiceOption) (distribution.Manifest, error) {
+	sm.gets++
+	return sm.manifest, nil
+}
+
+func TestProxyManifestsSchema1(t *testing.T) {
+	readFixture := func(name string) []byte {
+		p, err := os.ReadFile(filepath.Join("..", "..", "manifest", "schema1", "testdata", name))
+		if err != nil {
+			t.Fatal(err)
+		}
+		return p
+	}
+	m, desc, err := distribution.UnmarshalManifest(schema1.MediaTypeSignedManifest, readFixture("schema1-signed.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ctx := context.Background()
+	newRepository := func() distribution.Repository {
+		registry, err := storage.NewRegistry(ctx, inmemory.New())
+		if err != nil {
+			t.Fatalf("error creating registry: %v", err)
+		}
+		nameRef, _ := reference.WithName("library/motd")
+		repo, err := registry.Repository(ctx, nameRef)
+		if err != nil {
+			t.Fatalf("unexpected error getting repo: %v", err)
+		}
+		return repo
+	}
+	remoteRepo := newRepository()
+	for _, layer := range []string{"base.tar.gz", "motd.tar.gz"} {
+		if _, err := remoteRepo.Blobs(ctx).Put(ctx, schema2.MediaTypeLayer, readFixture(layer)); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	for _, policy := range []string{configuration.Schema1Allow, configuration.Schema1Reject, configuration.Schema1Convert} {
+		t.Run(policy, func(t *testing.T) {
+			env := newManifestStoreTestEnv(t, "library/motd", "latest")
+			localRepo := newRepository()
+			lr, err := localRepo.Manifests(ctx, storage.SkipLayerVerification())
+			if err != nil {
+				t.Fatal(err)
+			}
+			remote := &schema1Manifests{manifest: m}
+			env.manifests.localManifests = lr
+			env.manifests.remoteManifests = remote
+			env.manifests.schema1 = schema1Policy{
+				policy:  policy,
+				layers:  cachedOrRemoteBlobs{local: localRepo.Blobs(ctx), remote: remoteRepo.Blobs(ctx)},
+				configs: localRepo.Blobs(ctx),
+			}
+			if policy == configuration.Schema1Convert {
+				env.manifests.schema1.conversions, _ = arc.NewARC[string, digest.Digest](schema1ConversionsSize)
+			}
+
+			manifest, err := env.manifests.Get(ctx, desc.Digest)
+			switch policy {
+			case configuration.Schema1Allow:
+				if err == nil {
+					t.Fatal("expected an error getting a schema1 manifest")
+				}
+				return
+			case configuration.Schema1Reject:
+				if _, ok := err.(distribution.ErrManifestVerification); !ok {
+					t.Fatalf("expected ErrManifestVerification getting a schema1 manifest, got %v", err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			_, payload, err := manifest.Payload()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !bytes.Equal(payload, readFixture("schema2.json")) {
+				t.Fatalf("unexpected manifest converted:\n%s", payload)
+			}
+			converted := manifest.(*schema2.DeserializedManifest)
+			if _, err := localRepo.Blobs(ctx).Stat(ctx, converted.Config.Digest); err != nil {
+				t.Fatalf("the image configuration was not cached: %v", err)
+			}
+
+			// The conversion cached is served in place of the schema1 manifest.
+			if _, err := env.manifests.Get(ctx, desc.Digest); err != nil {
+				t.Fatal(err)
+			}
+			if remote.gets != 1 {
+				t.Fatalf("the schema1 manifest was fetched %d times", remote.gets)
+			}
+		})
+	}
+}
+
 func TestProxyManifestsMetrics(t *testing.T) {
 	proxyMetrics = &proxyMetricsCollector{}
 	name := "foo/bar"
@@ -341,3 +531,86 @@ func TestProxyManifestsMetrics(t *testing.T) {
 		t.Errorf("Expected manifestMetrics.BytesPushed %d but got %d", env.manifestSize*2, proxyMetrics.manifestMetrics.BytesPushed)
 	}
 }
+
+// blockingManifests counts the misses of the manifests it gets, which wait
+// for release.
+type blockingManifests struct {
+	distribution.ManifestService
+	release <-chan struct{}
+	mu      sync.Mutex
+	misses  int
+}
+
+func (bm *blockingManifests) Get(ctx context.Context, dgst digest.Digest, options ...distribution.ManifestServiceOption) (distribution.Manifest, error) {
+	manifest, err := bm.ManifestService.Get(ctx, dgst, options...)
+	if err != nil {
+		bm.mu.Lock()
+		bm.misses++
+		bm.mu.Unlock()
+		return nil, err
+	}
+	<-bm.release
+	return manifest, nil
+}
+
+func (bm *blockingManifests) missed() int {
+	bm.mu.Lock()
+	defer bm.mu.Unlock()
+	return bm.misses
+}
+
+func TestProxyManifestsFetchListener(t *testing.T) {
+	name := "foo/bar"
+	env := newManifestStoreTestEnv(t, name, "latest")
+
+	release := make(chan struct{})
+	local := &blockingManifests{ManifestService: env.manifests.localManifests.(statsManifest).manifests, release: release}
+	remote := &blockingManifests{ManifestService: env.manifests.remoteManifests.(statsManifest).manifests, release: release}
+	env.manifests.localManifests = local
+	env.manifests.remoteManifests = remote
+	env.manifests.upstream = "registry.example.com"
+
+	var mu sync.Mutex
+	var fetches []ManifestFetch
+	env.manifests.onFetch = func(ctx context.Context, fetch ManifestFetch) {
+		mu.Lock()
+		defer mu.Unlock()
+		fetches = append(fetches, fetch)
+	}
+
+	// Concurrent misses share a single fetch.
+	const n = 10
+	ctx := context.Background()
+	var wg sync.WaitGroup
+	for range n {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if _, err := env.manifests.Get(ctx, env.manifestDigest, distribution.WithTag("latest")); err != nil {
+				t.Error(err)
+			}
+		}()
+	}
+	for local.missed() < n {
+		time.Sleep(time.Millisecond)
+	}
+	time.Sleep(50 * time.Millisecond)
+	close(release)
+	wg.Wait()
+
+	// Hits do not fetch.
+	if _, err := env.manifests.Get(ctx, env.manifestDigest); err != nil {
+		t.Fatal(err)
+	}
+
+	if len(fetches) != 1 {
+		t.Fatalf("expected a single fetch, got %d", len(fetches))
+	}
+	fetch := fetches[0]
+	if fetch.Repository.Name() != name || fetch.Tag != "latest" || fetch.Upstream != "registry.example.com" {
+		t.Fatalf("unexpected fetch %+v", fetch)
+	}
+	if fetch.Descriptor.Digest != env.manifestDigest || fetch.Descriptor.Size != int64(env.manifestSize) || fetch.Duration <= 0 {
+		t.Fatalf("unexpected fetch %+v", fetch)
+	}
+}
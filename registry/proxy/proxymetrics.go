@@ -19,6 +19,20 @@ var (
 	pulledBytes = prometheus.ProxyNamespace.NewLabeledCounter("pulled_bytes", "The size of total bytes pulled from the upstream", "type")
 	// pushedBytes is the size of total bytes pushed to the client for blob/manifest
 	pushedBytes = prometheus.ProxyNamespace.NewLabeledCounter("pushed_bytes", "The size of total bytes pushed to the client", "type")
+	// streamedBytes is the size of total bytes of blobs streamed from the upstream to the client without being cached
+	streamedBytes = prometheus.ProxyNamespace.NewCounter("streamed_bytes", "The size of total bytes of blobs streamed to the client without being cached")
+	// prefetchedBlobs is the number of blobs prefetched from the upstream
+	prefetchedBlobs = prometheus.ProxyNamespace.NewCounter("prefetched_blobs", "The number of blobs prefetched from the upstream")
+	// prefetchedBytes is the size of total bytes prefetched from the upstream
+	prefetchedBytes = prometheus.ProxyNamespace.NewCounter("prefetched_bytes", "The size of total bytes prefetched from the upstream")
+	// prefetchHits is the number of prefetched blobs later requested by a client
+	prefetchHits = prometheus.ProxyNamespace.NewCounter("prefetch_hits", "The number of prefetched blobs requested by a client")
+	// upstreamRequests is the duration of the requests to the upstreams, by remote, type and status class
+	upstreamRequests = prometheus.ProxyNamespace.NewLabeledTimer("upstream_request", "The number of seconds the requests to the upstream take until their response", "remote", "type", "status")
+	// upstreamErrors is the number of requests to the upstreams which failed, by remote and category
+	upstreamErrors = prometheus.ProxyNamespace.NewLabeledCounter("upstream_errors", "The number of requests to the upstream which failed", "remote", "category")
+	// upstreamAuthFailures is the number of requests whose authentication to the upstreams failed, by remote and reason
+	upstreamAuthFailures = prometheus.ProxyNamespace.NewLabeledCounter("upstream_auth_failures", "The number of requests whose authentication to the upstream failed", "remote", "reason")
 )
 
 // Metrics is used to hold metric counters
@@ -29,11 +43,23 @@ type Metrics struct {
 	Misses      uint64
 	BytesPulled uint64
 	BytesPushed uint64
+	// BytesStreamed is the size of the blobs pushed to the clients without
+	// being cached
+	BytesStreamed uint64
+}
+
+// PrefetchMetrics is used to hold metric counters related to the prefetch
+// of blobs by the proxy. The hit rate is Hits over Blobs.
+type PrefetchMetrics struct {
+	Blobs uint64
+	Bytes uint64
+	Hits  uint64
 }
 
 type proxyMetricsCollector struct {
 	blobMetrics     Metrics
 	manifestMetrics Metrics
+	prefetchMetrics PrefetchMetrics
 }
 
 // proxyMetrics tracks metrics about the proxy cache.  This is
@@ -61,6 +87,10 @@ func init() {
 		return proxyMetrics.manifestMetrics
 	}))
 
+	pm.(*expvar.Map).Set("prefetch", expvar.Func(func() any {
+		return proxyMetrics.prefetchMetrics
+	}))
+
 	metrics.Register(prometheus.ProxyNamespace)
 	initPrometheusMetrics("blob")
 	initPrometheusMetrics("manifest")
@@ -98,6 +128,14 @@ func (pmc *proxyMetricsCollector) BlobPush(bytesPushed uint64, isHit bool) {
 	}
 }
 
+// BlobStream tracks the bytes of blobs streamed to clients without being
+// cached
+func (pmc *proxyMetricsCollector) BlobStream(bytesStreamed uint64) {
+	atomic.AddUint64(&pmc.blobMetrics.BytesStreamed, bytesStreamed)
+
+	streamedBytes.Inc(float64(bytesStreamed))
+}
+
 // ManifestPull tracks metrics related to Manifests pulled into the cache
 func (pmc *proxyMetricsCollector) ManifestPull(bytesPulled uint64) {
 	atomic.AddUint64(&pmc.manifestMetrics.Misses, 1)
@@ -121,3 +159,19 @@ func (pmc *proxyMetricsCollector) ManifestPush(bytesPushed uint64, isHit bool) {
 		hits.WithValues("manifest").Inc(1)
 	}
 }
+
+// BlobPrefetch tracks metrics about blobs prefetched into the cache
+func (pmc *proxyMetricsCollector) BlobPrefetch(bytesPrefetched uint64) {
+	atomic.AddUint64(&pmc.prefetchMetrics.Blobs, 1)
+	atomic.AddUint64(&pmc.prefetchMetrics.Bytes, bytesPrefetched)
+
+	prefetchedBlobs.Inc(1)
+	prefetchedBytes.Inc(float64(bytesPrefetched))
+}
+
+// PrefetchHit tracks the prefetched blobs requested by clients
+func (pmc *proxyMetricsCollector) PrefetchHit() {
+	atomic.AddUint64(&pmc.prefetchMetrics.Hits, 1)
+
+	prefetchHits.Inc(1)
+}
@@ -0,0 +1,229 @@
+package proxy
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"path"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/distribution/reference"
+	"github.com/opencontainers/go-digest"
+
+	"github.com/distribution/distribution/v3"
+	"github.com/distribution/distribution/v3/configuration"
+	"github.com/distribution/distribution/v3/internal/client"
+	"github.com/distribution/distribution/v3/internal/client/auth"
+	"github.com/distribution/distribution/v3/internal/dcontext"
+)
+
+// mirrorTagsPageSize is the number of tags listed from the remote at once.
+const mirrorTagsPageSize = 100
+
+// The statuses of the tags of a mirror, the others being those of a seed.
+const mirrorMirrored = "mirrored"
+
+// MirrorRequest selects the tags of a repository mirrored from its remote.
+type MirrorRequest struct {
+	// Repository is the name of the repository, as pulled through the
+	// cache.
+	Repository reference.Named
+	// TagPattern is a glob pattern of the tags mirrored, every tag if empty.
+	TagPattern string
+	// Platforms are the platforms of the images of the indexes mirrored,
+	// the seed platforms if empty.
+	Platforms []configuration.Platform
+}
+
+// MirrorReport is the outcome of the mirror of a repository.
+type MirrorReport struct {
+	Repository string `json:"repository"`
+	// Mirrored, Skipped and Failed count the tags pulled from the remote,
+	// cached already under the digest the remote resolves them to, and
+	// failed to be pulled.
+	Mirrored int `json:"mirrored"`
+	Skipped  int `json:"skipped"`
+	Failed   int `json:"failed"`
+	// Filtered counts the tags matching the pattern filtered out by the tag
+	// filter of the remote, which are not pulled.
+	Filtered int `json:"filtered"`
+	// Tags are the tags pulled, sorted by name.
+	Tags []MirroredTag `json:"tags"`
+}
+
+// MirroredTag is the outcome of the pull of a tag.
+type MirroredTag struct {
+	Tag    string        `json:"tag"`
+	Status string        `json:"status"`
+	Digest digest.Digest `json:"digest,omitempty"`
+	Error  string        `json:"error,omitempty"`
+}
+
+// Mirrorer is implemented by the pull through cache, which can mirror every
+// tag of a repository of its remotes.
+type Mirrorer interface {
+	Mirror(ctx context.Context, req MirrorRequest) (*MirrorReport, error)
+}
+
+// Mirror pulls the tags of the repository matching the pattern through the
+// cache, as Seed does, so that the content is cached, and expires, as pulled
+// by a client. The tags are listed from the remote page by page, each page
+// and each tag being attempted up to seedAttempts times, and seedConcurrency
+// tags are pulled at once. It fails if the tags cannot be listed, and reports
+// the outcome of each tag otherwise.
+func (pr *proxyingRegistry) Mirror(ctx context.Context, req MirrorRequest) (*MirrorReport, error) {
+	if pr.streamThrough {
+		return nil, fmt.Errorf("%w: the %s mode caches nothing", distribution.ErrUnsupported, configuration.ProxyModeStreamThrough)
+	}
+	if _, err := path.Match(req.TagPattern, ""); err != nil {
+		return nil, fmt.Errorf("invalid tag pattern %q: %v", req.TagPattern, err)
+	}
+	platforms := req.Platforms
+	if len(platforms) == 0 {
+		platforms = pr.seedPlatforms
+	}
+	remote, err := pr.remoteFor(req.Repository)
+	if err != nil {
+		return nil, err
+	}
+
+	start := time.Now()
+	tags, err := pr.listRemoteTags(ctx, remote, req.Repository)
+	if err != nil {
+		return nil, fmt.Errorf("listing the tags of %s: %w", req.Repository.Name(), err)
+	}
+	report := &MirrorReport{Repository: req.Repository.Name(), Tags: make([]MirroredTag, 0)}
+	var selected []string
+	for _, tag := range tags {
+		if matched, _ := path.Match(req.TagPattern, tag); req.TagPattern != "" && !matched {
+			continue
+		}
+		if !remote.tagFilter.allows(tag) {
+			report.Filtered++
+			continue
+		}
+		selected = append(selected, tag)
+	}
+
+	var mu sync.Mutex
+	items := make(chan string)
+	var wg sync.WaitGroup
+	for range min(seedConcurrency, max(len(selected), 1)) {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for tag := range items {
+				result := pr.mirrorTag(ctx, req.Repository, tag, platforms)
+
+				mu.Lock()
+				switch result.Status {
+				case mirrorMirrored:
+					report.Mirrored++
+				case seedSkipped:
+					report.Skipped++
+				default:
+					report.Failed++
+				}
+				report.Tags = append(report.Tags, result)
+				mu.Unlock()
+			}
+		}()
+	}
+	for _, tag := range selected {
+		select {
+		case items <- tag:
+		case <-ctx.Done():
+		}
+	}
+	close(items)
+	wg.Wait()
+	slices.SortFunc(report.Tags, func(a, b MirroredTag) int { return strings.Compare(a.Tag, b.Tag) })
+
+	dcontext.GetLogger(ctx).Infof("Mirrored %d tags of %s in %s: %d mirrored, %d skipped, %d failed, %d filtered",
+		len(selected), req.Repository.Name(), time.Since(start).Round(time.Millisecond), report.Mirrored, report.Skipped, report.Failed, report.Filtered)
+	return report, nil
+}
+
+// mirrorTag pulls the tag, retrying on failure, and returns its outcome.
+func (pr *proxyingRegistry) mirrorTag(ctx context.Context, name reference.Named, tag string, platforms []configuration.Platform) MirroredTag {
+	result := MirroredTag{Tag: tag}
+	ref, err := reference.WithTag(name, tag)
+	if err != nil {
+		result.Status = seedFailed
+		result.Error = err.Error()
+		return result
+	}
+	var status string
+	err = retrySeed(ctx, "mirroring "+ref.String(), func() (err error) {
+		status, result.Digest, err = pr.pullReference(ctx, ref, platforms)
+		return err
+	})
+	if err != nil {
+		dcontext.GetLogger(ctx).Errorf("Error mirroring %s: %v", ref, err)
+		result.Status = seedFailed
+		result.Error = err.Error()
+		return result
+	}
+	result.Status = status
+	if status == seedFetched {
+		result.Status = mirrorMirrored
+	}
+	return result
+}
+
+// listRemoteTags lists the tags of the repository from the remote, without
+// falling back to the tags cached.
+func (pr *proxyingRegistry) listRemoteTags(ctx context.Context, remote *proxyRemote, name reference.Named) ([]string, error) {
+	if err := remote.authChallenger.tryEstablishChallenges(ctx); err != nil {
+		return nil, err
+	}
+	upstreamName, err := remote.upstreamName(name)
+	if err != nil {
+		return nil, err
+	}
+	tr := remote.transport(ctx, auth.RepositoryScope{
+		Repository: upstreamName.Name(),
+		Actions:    []string{"pull"},
+	})
+	remoteRepo, err := client.NewRepository(upstreamName, remote.remoteURL.String(), tr)
+	if err != nil {
+		return nil, err
+	}
+	remoteTags := remoteRepo.Tags(ctx)
+
+	var tags []string
+	for {
+		var (
+			page []string
+			last bool
+		)
+		err := retrySeed(ctx, "listing the tags of "+name.Name(), func() (err error) {
+			page, err = remoteTags.List(ctx, mirrorTagsPageSize, lastTag(tags))
+			// The last page is not an error to retry.
+			last = errors.Is(err, io.EOF)
+			if last {
+				return nil
+			}
+			return err
+		})
+		if err != nil {
+			return nil, err
+		}
+		tags = append(tags, page...)
+		if last || len(page) == 0 {
+			return tags, nil
+		}
+	}
+}
+
+// lastTag returns the last of the tags, "" if there are none.
+func lastTag(tags []string) string {
+	if len(tags) == 0 {
+		return ""
+	}
+	return tags[len(tags)-1]
+}
@@ -0,0 +1,179 @@
+package proxy
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/distribution/reference"
+	"github.com/opencontainers/go-digest"
+	v1 "github.com/opencontainers/image-spec/specs-go/v1"
+
+	"github.com/distribution/distribution/v3/configuration"
+)
+
+func TestMirror(t *testing.T) {
+	defer func(delay time.Duration) { seedRetryDelay = delay }(seedRetryDelay)
+	seedRetryDelay = time.Millisecond
+
+	ctx := context.Background()
+	u := newSeedUpstream(t)
+	repo := u.repository("library/many")
+	images := make([]v1.Descriptor, 3)
+	for i := range images {
+		images[i], _ = pushImage(t, repo, fmt.Sprintf("image-%d", i))
+	}
+	// 300 tags, listed in 3 pages, of the 3 images.
+	for i := range 300 {
+		u.tag(repo, fmt.Sprintf("v%03d", i), images[i%3])
+	}
+	u.tag(repo, "debug", images[0])
+	broken, _ := pushImage(t, repo, "broken")
+	u.tag(repo, "broken", broken)
+
+	// The first attempts of the second page, after broken, debug and v000 to
+	// v097, and of the manifests of two tags fail, the broken tag failing
+	// every attempt.
+	var mu sync.Mutex
+	attempts := map[string]int{}
+	u.fail = func(r *http.Request) bool {
+		mu.Lock()
+		defer mu.Unlock()
+		key := r.URL.Path + "?" + r.URL.Query().Get("last")
+		attempts[key]++
+		switch key {
+		case "/v2/library/many/tags/list?v097", "/v2/library/many/manifests/v010?", "/v2/library/many/manifests/v200?":
+			return attempts[key] == 1
+		case "/v2/library/many/manifests/broken?":
+			return true
+		}
+		return false
+	}
+
+	pr, local := newSeededCache(t, configuration.Proxy{
+		RemoteURL: u.URL,
+		TagFilter: configuration.ProxyTagFilter{Deny: []string{"debug"}},
+	})
+	name, err := reference.WithName("library/many")
+	if err != nil {
+		t.Fatal(err)
+	}
+	report, err := pr.Mirror(ctx, MirrorRequest{Repository: name})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if report.Mirrored != 300 || report.Skipped != 0 || report.Failed != 1 || report.Filtered != 1 || len(report.Tags) != 301 {
+		t.Fatalf("unexpected report: %d mirrored, %d skipped, %d failed, %d filtered, %d tags", report.Mirrored, report.Skipped, report.Failed, report.Filtered, len(report.Tags))
+	}
+	mu.Lock()
+	if retried := attempts["/v2/library/many/tags/list?v097"]; retried != 2 {
+		t.Fatalf("expected the second page to be listed twice, listed %d times", retried)
+	}
+	mu.Unlock()
+	if tag := report.Tags[0]; tag.Tag != "broken" || tag.Status != seedFailed || tag.Error == "" {
+		t.Fatalf("unexpected outcome of the broken tag %+v", tag)
+	}
+	if tag := report.Tags[11]; tag.Tag != "v010" || tag.Status != mirrorMirrored || tag.Digest != images[1].Digest {
+		t.Fatalf("unexpected outcome of the retried tag %+v", tag)
+	}
+	for i := range images {
+		if !cachedBlob(t, local, digest.FromString(fmt.Sprintf("image-%d", i))) {
+			t.Fatalf("expected the layer of image %d to be cached", i)
+		}
+	}
+	localRepo, err := local.Repository(ctx, name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if desc, err := localRepo.Tags(ctx).Get(ctx, "v299"); err != nil || desc.Digest != images[2].Digest {
+		t.Fatalf("expected the last tag to be cached, got %v, %v", desc.Digest, err)
+	}
+
+	// The content mirrored expires as pulled through the cache.
+	expiring := map[string]bool{}
+	for _, expiration := range pr.Expirations(time.Time{}) {
+		if expiration.Repository == "library/many" {
+			expiring[expiration.Reference] = true
+		}
+	}
+	for i, image := range images {
+		if !expiring[image.Digest.String()] {
+			t.Fatalf("expected the manifest of image %d to be scheduled to expire", i)
+		}
+	}
+
+	// The tags cached under the digest the remote resolves them to are
+	// skipped.
+	u.push("library/many", "v001", "moved", nil)
+	report, err = pr.Mirror(ctx, MirrorRequest{Repository: name, TagPattern: "v00*"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if report.Mirrored != 1 || report.Skipped != 9 || report.Failed != 0 || report.Filtered != 0 {
+		t.Fatalf("unexpected report mirroring again: %+v", report)
+	}
+	if tag := report.Tags[1]; tag.Tag != "v001" || tag.Status != mirrorMirrored {
+		t.Fatalf("expected the moved tag to be mirrored, got %+v", tag)
+	}
+}
+
+func TestMirrorPlatforms(t *testing.T) {
+	ctx := context.Background()
+	u := newSeedUpstream(t)
+	amd64 := u.push("library/multi", "", "amd64", &v1.Platform{Architecture: "amd64", OS: "linux"})
+	arm64 := u.push("library/multi", "", "arm64", &v1.Platform{Architecture: "arm64", OS: "linux"})
+	u.pushIndex("library/multi", "1", amd64, arm64)
+
+	pr, local := newSeededCache(t, configuration.Proxy{RemoteURL: u.URL})
+	name, err := reference.WithName("library/multi")
+	if err != nil {
+		t.Fatal(err)
+	}
+	report, err := pr.Mirror(ctx, MirrorRequest{
+		Repository: name,
+		Platforms:  []configuration.Platform{{Architecture: "arm64"}},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if report.Mirrored != 1 {
+		t.Fatalf("unexpected report %+v", report)
+	}
+	if cachedBlob(t, local, digest.FromString("amd64")) || !cachedBlob(t, local, digest.FromString("arm64")) {
+		t.Fatal("expected only the layer of the arm64 image to be cached")
+	}
+}
+
+func TestMirrorErrors(t *testing.T) {
+	defer func(delay time.Duration) { seedRetryDelay = delay }(seedRetryDelay)
+	seedRetryDelay = time.Millisecond
+
+	ctx := context.Background()
+	u := newSeedUpstream(t)
+	u.push("library/alpine", "3.20", "alpine", nil)
+	u.failures["library/alpine"] = -1
+
+	pr, _ := newSeededCache(t, configuration.Proxy{
+		Remotes: []configuration.ProxyRemote{{Prefix: "library/", RemoteURL: u.URL}},
+	})
+	alpine, err := reference.WithName("library/alpine")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := pr.Mirror(ctx, MirrorRequest{Repository: alpine}); err == nil {
+		t.Fatal("expected the tags failing to be listed to fail the mirror")
+	}
+	if _, err := pr.Mirror(ctx, MirrorRequest{Repository: alpine, TagPattern: "["}); err == nil {
+		t.Fatal("expected an invalid pattern to fail the mirror")
+	}
+	other, err := reference.WithName("other/alpine")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := pr.Mirror(ctx, MirrorRequest{Repository: other}); err == nil {
+		t.Fatal("expected a repository of no remote to fail the mirror")
+	}
+}
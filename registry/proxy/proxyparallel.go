@@ -0,0 +1,212 @@
+package proxy
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+
+	"github.com/distribution/reference"
+	"github.com/opencontainers/go-digest"
+	v1 "github.com/opencontainers/image-spec/specs-go/v1"
+
+	"github.com/distribution/distribution/v3"
+	"github.com/distribution/distribution/v3/configuration"
+	"github.com/distribution/distribution/v3/internal/client"
+	"github.com/distribution/distribution/v3/internal/dcontext"
+	v2 "github.com/distribution/distribution/v3/registry/api/v2"
+)
+
+const (
+	// defaultParallelFetchThreshold is the size from which a blob is
+	// fetched in parts, unless set by the threshold option.
+	defaultParallelFetchThreshold = 64 << 20
+
+	// defaultParallelFetchPartSize is the size of the parts, unless set by
+	// the partsize option.
+	defaultParallelFetchPartSize = 16 << 20
+
+	// defaultParallelFetchConcurrency is the number of parts requested at
+	// once, unless set by the concurrency option.
+	defaultParallelFetchConcurrency = 4
+)
+
+// parallelFetcher fetches the large blobs of a remote repository in parts,
+// requested concurrently with ranged requests and reassembled in order.
+type parallelFetcher struct {
+	threshold   int64
+	partSize    int64
+	concurrency int
+
+	client *http.Client
+	// blobURL builds the url of a blob of the remote repository.
+	blobURL func(digest.Digest) (string, error)
+}
+
+func newParallelFetcher(config configuration.ProxyParallelFetch, tr http.RoundTripper, name reference.Named, remoteURL string) (*parallelFetcher, error) {
+	ub, err := v2.NewURLBuilderFromString(remoteURL, false)
+	if err != nil {
+		return nil, err
+	}
+	pf := &parallelFetcher{
+		threshold:   config.Threshold,
+		partSize:    config.PartSize,
+		concurrency: config.Concurrency,
+		client:      &http.Client{Transport: tr},
+		blobURL: func(dgst digest.Digest) (string, error) {
+			ref, err := reference.WithDigest(name, dgst)
+			if err != nil {
+				return "", err
+			}
+			return ub.BuildBlobURL(ref)
+		},
+	}
+	if pf.threshold <= 0 {
+		pf.threshold = defaultParallelFetchThreshold
+	}
+	if pf.partSize <= 0 {
+		pf.partSize = defaultParallelFetchPartSize
+	}
+	if pf.concurrency <= 0 {
+		pf.concurrency = defaultParallelFetchConcurrency
+	}
+	return pf, nil
+}
+
+// fetches reports whether the blob described by desc is fetched in parts.
+func (pf *parallelFetcher) fetches(desc v1.Descriptor) bool {
+	return pf != nil && desc.Size >= pf.threshold
+}
+
+// fetch copies the remote blob described by desc into w, verifying its
+// digest. The first part is requested from the blob url, and the others from
+// the url the remote redirected to. The blob is fetched in a single request
+// if the remote does not support ranges.
+func (pf *parallelFetcher) fetch(ctx context.Context, desc v1.Descriptor, w io.Writer) error {
+	verifier := desc.Digest.Verifier()
+	if err := pf.copyParts(ctx, desc, io.MultiWriter(w, verifier)); err != nil {
+		return err
+	}
+	if !verifier.Verified() {
+		dcontext.GetLogger(ctx).Errorf("Blob %s fetched in parts from the remote does not match its digest", desc.Digest)
+		return distribution.ErrBlobInvalidDigest{Digest: desc.Digest, Reason: errors.New("content does not match digest")}
+	}
+	return nil
+}
+
+// partResult is a part fetched, or the error fetching it.
+type partResult struct {
+	data []byte
+	err  error
+}
+
+func (pf *parallelFetcher) copyParts(ctx context.Context, desc v1.Descriptor, w io.Writer) error {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	blobURL, err := pf.blobURL(desc.Digest)
+	if err != nil {
+		return err
+	}
+	resp, err := pf.request(ctx, blobURL, 0, min(pf.partSize, desc.Size))
+	if err != nil {
+		return err
+	}
+	if resp.StatusCode == http.StatusOK {
+		defer resp.Body.Close()
+		dcontext.GetLogger(ctx).Debugf("Remote does not support range requests, fetching blob %s in a single request", desc.Digest)
+		_, err := io.CopyN(w, resp.Body, desc.Size)
+		return err
+	}
+	partURL := resp.Request.URL.String()
+	first, err := readPart(resp, 0, min(pf.partSize, desc.Size))
+	if err != nil {
+		return err
+	}
+	if _, err := w.Write(first); err != nil {
+		return err
+	}
+
+	// At most concurrency parts are requested or buffered at once: the
+	// pending ones and the one awaited.
+	pending := make(chan chan partResult, pf.concurrency-1)
+	go func() {
+		defer close(pending)
+		for offset := pf.partSize; offset < desc.Size; offset += pf.partSize {
+			result := make(chan partResult, 1)
+			select {
+			case pending <- result:
+			case <-ctx.Done():
+				return
+			}
+			go func(offset, length int64) {
+				data, err := pf.fetchPart(ctx, partURL, offset, length)
+				result <- partResult{data: data, err: err}
+			}(offset, min(pf.partSize, desc.Size-offset))
+		}
+	}()
+	for result := range pending {
+		part := <-result
+		if part.err != nil {
+			return part.err
+		}
+		if _, err := w.Write(part.data); err != nil {
+			return err
+		}
+	}
+	return ctx.Err()
+}
+
+// request requests length bytes from offset of the blob at url, returning the
+// response if it is partial, or whole if the remote ignored the range.
+func (pf *parallelFetcher) request(ctx context.Context, url string, offset, length int64) (*http.Response, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Range", fmt.Sprintf("bytes=%d-%d", offset, offset+length-1))
+	resp, err := pf.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	switch resp.StatusCode {
+	case http.StatusOK, http.StatusPartialContent:
+		return resp, nil
+	case http.StatusNotFound:
+		resp.Body.Close()
+		return nil, distribution.ErrBlobUnknown
+	default:
+		defer resp.Body.Close()
+		return nil, client.HandleHTTPResponseError(resp)
+	}
+}
+
+func (pf *parallelFetcher) fetchPart(ctx context.Context, url string, offset, length int64) ([]byte, error) {
+	resp, err := pf.request(ctx, url, offset, length)
+	if err != nil {
+		return nil, err
+	}
+	return readPart(resp, offset, length)
+}
+
+// readPart reads the length bytes from offset of a ranged response, and
+// closes it.
+func readPart(resp *http.Response, offset, length int64) ([]byte, error) {
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusPartialContent {
+		return nil, fmt.Errorf("expected a partial response for the range from %d, got %s", offset, resp.Status)
+	}
+	var start, end int64
+	if _, err := fmt.Sscanf(resp.Header.Get("Content-Range"), "bytes %d-%d/", &start, &end); err != nil {
+		return nil, fmt.Errorf("could not parse Content-Range header: %q", resp.Header.Get("Content-Range"))
+	}
+	if start != offset || end != offset+length-1 {
+		return nil, fmt.Errorf("received range %d-%d instead of the requested %d-%d", start, end, offset, offset+length-1)
+	}
+	data := make([]byte, length)
+	if _, err := io.ReadFull(resp.Body, data); err != nil {
+		return nil, err
+	}
+	return data, nil
+}
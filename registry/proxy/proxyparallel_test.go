@@ -0,0 +1,244 @@
+package proxy
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"path"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/distribution/reference"
+	"github.com/opencontainers/go-digest"
+	v1 "github.com/opencontainers/image-spec/specs-go/v1"
+
+	"github.com/distribution/distribution/v3"
+	"github.com/distribution/distribution/v3/configuration"
+	"github.com/distribution/distribution/v3/internal/client"
+)
+
+// rangedUpstream serves blobs like a remote registry redirecting the blob
+// requests to a storage, recording the requests to each.
+type rangedUpstream struct {
+	*httptest.Server
+	blobs map[digest.Digest][]byte
+	// noRanges serves the whole blobs, ignoring the ranges requested.
+	noRanges bool
+	// latency delays the responses of the storage.
+	latency time.Duration
+
+	mu        sync.Mutex
+	redirects int
+	// ranges are the ranges of the GET requests to the storage.
+	ranges []string
+}
+
+func newRangedUpstream(tb testing.TB, blobs ...[]byte) *rangedUpstream {
+	tb.Helper()
+
+	u := &rangedUpstream{blobs: make(map[digest.Digest][]byte)}
+	for _, blob := range blobs {
+		u.blobs[digest.FromBytes(blob)] = blob
+	}
+	u.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		dgst := digest.Digest(path.Base(r.URL.Path))
+		blob, ok := u.blobs[dgst]
+		if !ok {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		if strings.HasPrefix(r.URL.Path, "/v2/") {
+			u.mu.Lock()
+			u.redirects++
+			u.mu.Unlock()
+			http.Redirect(w, r, "/storage/"+dgst.String(), http.StatusTemporaryRedirect)
+			return
+		}
+		time.Sleep(u.latency)
+		if r.Method == http.MethodGet {
+			u.mu.Lock()
+			u.ranges = append(u.ranges, r.Header.Get("Range"))
+			u.mu.Unlock()
+		}
+		if u.noRanges {
+			w.Write(blob)
+			return
+		}
+		http.ServeContent(w, r, "", time.Time{}, bytes.NewReader(blob))
+	}))
+	tb.Cleanup(u.Close)
+	return u
+}
+
+func (u *rangedUpstream) requests() (redirects int, ranges []string) {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	return u.redirects, append([]string(nil), u.ranges...)
+}
+
+func newTestParallelFetcher(tb testing.TB, u *rangedUpstream, partSize int64, concurrency int) *parallelFetcher {
+	tb.Helper()
+
+	name, _ := reference.WithName("foo/bar")
+	pf, err := newParallelFetcher(configuration.ProxyParallelFetch{
+		Enabled:     true,
+		Threshold:   1,
+		PartSize:    partSize,
+		Concurrency: concurrency,
+	}, http.DefaultTransport, name, u.URL)
+	if err != nil {
+		tb.Fatal(err)
+	}
+	return pf
+}
+
+func TestParallelFetch(t *testing.T) {
+	for _, tc := range []struct {
+		size        int
+		partSize    int64
+		concurrency int
+	}{
+		{size: 10007, partSize: 1000, concurrency: 3},
+		{size: 10007, partSize: 1000, concurrency: 1},
+		{size: 3000, partSize: 1000, concurrency: 4},
+		{size: 999, partSize: 1000, concurrency: 4},
+		{size: 1001, partSize: 1000, concurrency: 4},
+		{size: 10007, partSize: 7, concurrency: 16},
+	} {
+		t.Run(fmt.Sprintf("%d bytes in parts of %d by %d", tc.size, tc.partSize, tc.concurrency), func(t *testing.T) {
+			blob := makeBlob(tc.size)
+			u := newRangedUpstream(t, blob)
+			pf := newTestParallelFetcher(t, u, tc.partSize, tc.concurrency)
+
+			var buf bytes.Buffer
+			desc := v1.Descriptor{Digest: digest.FromBytes(blob), Size: int64(tc.size)}
+			if err := pf.fetch(context.Background(), desc, &buf); err != nil {
+				t.Fatal(err)
+			}
+			if !bytes.Equal(buf.Bytes(), blob) {
+				t.Fatal("blob reassembled does not match the blob")
+			}
+
+			redirects, ranges := u.requests()
+			if redirects != 1 {
+				t.Fatalf("expected only the first part to be requested from the registry, got %d requests", redirects)
+			}
+			parts := (int64(tc.size) + tc.partSize - 1) / tc.partSize
+			if int64(len(ranges)) != parts {
+				t.Fatalf("expected %d parts requested, got %d", parts, len(ranges))
+			}
+			last := fmt.Sprintf("bytes=%d-%d", (parts-1)*tc.partSize, tc.size-1)
+			for _, r := range ranges {
+				if r == last {
+					return
+				}
+			}
+			t.Fatalf("expected the last part to be requested with %q, got %v", last, ranges)
+		})
+	}
+}
+
+func TestParallelFetchNoRanges(t *testing.T) {
+	blob := makeBlob(10007)
+	u := newRangedUpstream(t, blob)
+	u.noRanges = true
+	pf := newTestParallelFetcher(t, u, 1000, 4)
+
+	var buf bytes.Buffer
+	desc := v1.Descriptor{Digest: digest.FromBytes(blob), Size: int64(len(blob))}
+	if err := pf.fetch(context.Background(), desc, &buf); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(buf.Bytes(), blob) {
+		t.Fatal("blob fetched does not match the blob")
+	}
+	if _, ranges := u.requests(); len(ranges) != 1 {
+		t.Fatalf("expected the blob to be fetched in a single request, got %d", len(ranges))
+	}
+}
+
+func TestParallelFetchErrors(t *testing.T) {
+	blob := makeBlob(10007)
+	u := newRangedUpstream(t)
+	// The remote serves other content under the digest of the blob.
+	u.blobs[digest.FromBytes(blob)] = makeBlob(10007)
+	pf := newTestParallelFetcher(t, u, 1000, 4)
+
+	desc := v1.Descriptor{Digest: digest.FromBytes(blob), Size: int64(len(blob))}
+	err := pf.fetch(context.Background(), desc, &bytes.Buffer{})
+	if _, ok := err.(distribution.ErrBlobInvalidDigest); !ok {
+		t.Fatalf("expected ErrBlobInvalidDigest fetching mismatching content, got %v", err)
+	}
+
+	desc.Digest = digest.FromString("unknown")
+	if err := pf.fetch(context.Background(), desc, &bytes.Buffer{}); err != distribution.ErrBlobUnknown {
+		t.Fatalf("expected ErrBlobUnknown fetching an unknown blob, got %v", err)
+	}
+
+	// A part shorter than requested fails the fetch.
+	desc = v1.Descriptor{Digest: digest.FromBytes(blob), Size: int64(len(blob)) + 1}
+	if err := pf.fetch(context.Background(), desc, &bytes.Buffer{}); err == nil {
+		t.Fatal("expected an error fetching past the end of the blob")
+	}
+}
+
+func TestProxyStoreServeParallelFetch(t *testing.T) {
+	ctx := context.Background()
+	te := makeTestEnv(t, "foo/bar")
+	small, large := makeBlob(999), makeBlob(10007)
+	u := newRangedUpstream(t, small, large)
+	remoteRepo, err := client.NewRepository(te.store.repositoryName, u.URL, http.DefaultTransport)
+	if err != nil {
+		t.Fatal(err)
+	}
+	te.store.remoteStore = remoteRepo.Blobs(ctx)
+	te.store.parallel = newTestParallelFetcher(t, u, 1000, 3)
+	te.store.parallel.threshold = 1000
+
+	for _, blob := range [][]byte{small, large} {
+		w := httptest.NewRecorder()
+		if err := te.store.ServeBlob(ctx, w, httptest.NewRequest(http.MethodGet, "/", nil), digest.FromBytes(blob)); err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(w.Body.Bytes(), blob) {
+			t.Fatalf("unexpected blob of %d bytes served", len(blob))
+		}
+		cached, err := te.store.localStore.Get(ctx, digest.FromBytes(blob))
+		if err != nil {
+			t.Fatalf("expected the blob of %d bytes to be cached: %v", len(blob), err)
+		}
+		if !bytes.Equal(cached, blob) {
+			t.Fatalf("unexpected blob of %d bytes cached", len(blob))
+		}
+	}
+
+	// Only the large blob is fetched in parts.
+	if _, ranges := u.requests(); len(ranges) != 1+11 {
+		t.Fatalf("expected 12 requests to the storage, got %d: %v", len(ranges), ranges)
+	}
+}
+
+func BenchmarkParallelFetch(b *testing.B) {
+	blob := makeBlob(64 << 20)
+	desc := v1.Descriptor{Digest: digest.FromBytes(blob), Size: int64(len(blob))}
+	u := newRangedUpstream(b, blob)
+	// The latency of the storage is that of a remote object store.
+	u.latency = 10 * time.Millisecond
+
+	for _, concurrency := range []int{1, 4, 8} {
+		b.Run(fmt.Sprintf("concurrency %d", concurrency), func(b *testing.B) {
+			pf := newTestParallelFetcher(b, u, 4<<20, concurrency)
+			b.SetBytes(desc.Size)
+			for i := 0; i < b.N; i++ {
+				if err := pf.fetch(context.Background(), desc, io.Discard); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,147 @@
+package proxy
+
+import (
+	"context"
+	"slices"
+	"sync"
+
+	"github.com/opencontainers/go-digest"
+	v1 "github.com/opencontainers/image-spec/specs-go/v1"
+
+	"github.com/distribution/distribution/v3"
+	"github.com/distribution/distribution/v3/configuration"
+	"github.com/distribution/distribution/v3/internal/dcontext"
+)
+
+// defaultPrefetchConcurrency is the number of blobs prefetched at once,
+// unless set by the concurrency option.
+const defaultPrefetchConcurrency = 4
+
+// maxPrefetchedTracked bounds the number of prefetched blobs tracked until
+// they are requested, for the hit rate.
+const maxPrefetchedTracked = 10000
+
+// prefetcher fetches the blobs referenced by the manifests fetched from the
+// remote in the background, so that most are cached by the time the client
+// requests them.
+type prefetcher struct {
+	maxSize int64
+	// slots bounds the number of blobs fetched at once.
+	slots chan struct{}
+
+	// mu guards prefetched, the blobs prefetched which were not requested
+	// yet.
+	mu         sync.Mutex
+	prefetched map[digest.Digest]struct{}
+
+	// done is closed to cancel the fetches when the registry shuts down,
+	// and wg waits for them. closed is guarded by mu.
+	done   chan struct{}
+	closed bool
+	wg     sync.WaitGroup
+}
+
+func newPrefetcher(config configuration.ProxyPrefetch) *prefetcher {
+	concurrency := config.Concurrency
+	if concurrency <= 0 {
+		concurrency = defaultPrefetchConcurrency
+	}
+	return &prefetcher{
+		maxSize:    config.MaxSize,
+		slots:      make(chan struct{}, concurrency),
+		prefetched: make(map[digest.Digest]struct{}),
+		done:       make(chan struct{}),
+	}
+}
+
+// close cancels the fetches and waits for them to return.
+func (p *prefetcher) close() {
+	p.mu.Lock()
+	if !p.closed {
+		p.closed = true
+		close(p.done)
+	}
+	p.mu.Unlock()
+	p.wg.Wait()
+}
+
+// prefetch starts fetching the blobs referenced by the manifest into the
+// blob store, skipping the manifests referenced by an index and the blobs
+// over the maximum size. It does not wait for the fetches.
+func (p *prefetcher) prefetch(ctx context.Context, blobs *proxyBlobStore, manifest distribution.Manifest) {
+	manifestTypes := distribution.ManifestMediaTypes()
+	var refs []v1.Descriptor
+	for _, desc := range manifest.References() {
+		if !slices.Contains(manifestTypes, desc.MediaType) && (p.maxSize <= 0 || desc.Size <= p.maxSize) {
+			refs = append(refs, desc)
+		}
+	}
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.closed || len(refs) == 0 {
+		return
+	}
+	p.wg.Add(len(refs))
+
+	// The fetches outlive the request of the manifest, until the registry
+	// shuts down.
+	ctx, cancel := context.WithCancel(context.WithoutCancel(ctx))
+	var fetches sync.WaitGroup
+	fetches.Add(len(refs))
+	go func() {
+		select {
+		case <-p.done:
+		case <-ctx.Done():
+		}
+		cancel()
+	}()
+	go func() {
+		fetches.Wait()
+		cancel()
+	}()
+
+	for _, desc := range refs {
+		go func() {
+			defer p.wg.Done()
+			defer fetches.Done()
+			select {
+			case p.slots <- struct{}{}:
+			case <-ctx.Done():
+				return
+			}
+			defer func() { <-p.slots }()
+			if err := p.fetch(ctx, blobs, desc); err != nil {
+				dcontext.GetLogger(ctx).Warnf("Error prefetching blob %s: %v", desc.Digest, err)
+			}
+		}()
+	}
+}
+
+// fetch caches the blob unless it is cached already, being fetched by
+// another request or over the maximum size cached.
+func (p *prefetcher) fetch(ctx context.Context, blobs *proxyBlobStore, desc v1.Descriptor) error {
+	size, err := blobs.fetchToCache(ctx, desc)
+	if err != nil || size == 0 {
+		return err
+	}
+	proxyMetrics.BlobPrefetch(uint64(size))
+	p.mu.Lock()
+	if len(p.prefetched) < maxPrefetchedTracked {
+		p.prefetched[desc.Digest] = struct{}{}
+	}
+	p.mu.Unlock()
+	return nil
+}
+
+// requested records the request of a blob served from the cache, a hit if it
+// was prefetched.
+func (p *prefetcher) requested(dgst digest.Digest) {
+	p.mu.Lock()
+	_, ok := p.prefetched[dgst]
+	delete(p.prefetched, dgst)
+	p.mu.Unlock()
+	if ok {
+		proxyMetrics.PrefetchHit()
+	}
+}
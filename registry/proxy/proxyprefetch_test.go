@@ -0,0 +1,155 @@
+package proxy
+
+import (
+	"bytes"
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/distribution/reference"
+	"github.com/opencontainers/image-spec/specs-go"
+	v1 "github.com/opencontainers/image-spec/specs-go/v1"
+
+	"github.com/distribution/distribution/v3"
+	"github.com/distribution/distribution/v3/configuration"
+	"github.com/distribution/distribution/v3/manifest/schema2"
+	"github.com/distribution/distribution/v3/registry/storage"
+	"github.com/distribution/distribution/v3/registry/storage/driver/inmemory"
+)
+
+func TestProxyManifestsPrefetch(t *testing.T) {
+	ctx := context.Background()
+	name, _ := reference.WithName("foo/prefetch")
+	truthRegistry, err := storage.NewRegistry(ctx, inmemory.New())
+	if err != nil {
+		t.Fatal(err)
+	}
+	truthRepo, err := truthRegistry.Repository(ctx, name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	put := func(mediaType string, content []byte) v1.Descriptor {
+		desc, err := truthRepo.Blobs(ctx).Put(ctx, mediaType, content)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return desc
+	}
+	config := put(schema2.MediaTypeImageConfig, []byte(`{"name": "foo"}`))
+	layers := []v1.Descriptor{
+		put(schema2.MediaTypeLayer, makeBlob(64)),
+		put(schema2.MediaTypeLayer, makeBlob(64)),
+		// The last layer is over the maximum size of the blobs prefetched.
+		put(schema2.MediaTypeLayer, makeBlob(256)),
+	}
+	m, err := schema2.FromStruct(schema2.Manifest{
+		Versioned: specs.Versioned{SchemaVersion: 2},
+		MediaType: schema2.MediaTypeManifest,
+		Config:    config,
+		Layers:    layers,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	remoteManifests, err := truthRepo.Manifests(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	dgst, err := remoteManifests.Put(ctx, m)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	localRegistry, err := storage.NewRegistry(ctx, inmemory.New())
+	if err != nil {
+		t.Fatal(err)
+	}
+	localRepo, err := localRegistry.Repository(ctx, name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	localManifests, err := localRepo.Manifests(ctx, storage.SkipLayerVerification())
+	if err != nil {
+		t.Fatal(err)
+	}
+	remoteBlobs := statsBlobStore{stats: make(map[string]int), blobs: truthRepo.Blobs(ctx)}
+	p := newPrefetcher(configuration.ProxyPrefetch{Enabled: true, MaxSize: 128})
+	blobs := &proxyBlobStore{
+		localStore:        localRepo.Blobs(ctx),
+		remoteStore:       remoteBlobs,
+		cacheWriteTimeout: time.Minute,
+		repositoryName:    name,
+		authChallenger:    &mockChallenger{},
+		prefetcher:        p,
+	}
+	pms := proxyManifestStore{
+		ctx:             ctx,
+		localManifests:  localManifests,
+		remoteManifests: remoteManifests,
+		repositoryName:  name,
+		authChallenger:  &mockChallenger{},
+		prefetch: func(ctx context.Context, manifest distribution.Manifest) {
+			p.prefetch(ctx, blobs, manifest)
+		},
+	}
+	prefetched := func() PrefetchMetrics {
+		return PrefetchMetrics{
+			Blobs: atomic.LoadUint64(&proxyMetrics.prefetchMetrics.Blobs),
+			Bytes: atomic.LoadUint64(&proxyMetrics.prefetchMetrics.Bytes),
+			Hits:  atomic.LoadUint64(&proxyMetrics.prefetchMetrics.Hits),
+		}
+	}
+	start := prefetched()
+
+	if _, err := pms.Get(ctx, dgst); err != nil {
+		t.Fatal(err)
+	}
+	for deadline := time.Now().Add(10 * time.Second); prefetched().Blobs-start.Blobs < 3; time.Sleep(10 * time.Millisecond) {
+		if time.Now().After(deadline) {
+			t.Fatal("timed out waiting for the blobs to be prefetched")
+		}
+	}
+	for _, desc := range []v1.Descriptor{config, layers[0], layers[1]} {
+		if _, err := blobs.localStore.Stat(ctx, desc.Digest); err != nil {
+			t.Fatalf("blob %s not prefetched: %v", desc.Digest, err)
+		}
+	}
+	if _, err := blobs.localStore.Stat(ctx, layers[2].Digest); err == nil {
+		t.Fatal("unexpected blob over the maximum size prefetched")
+	}
+
+	// The second layer is served from the cache.
+	opened := func() int {
+		sbsMu.Lock()
+		defer sbsMu.Unlock()
+		return remoteBlobs.stats["open"]
+	}
+	before := opened()
+	w := httptest.NewRecorder()
+	if err := blobs.ServeBlob(ctx, w, httptest.NewRequest(http.MethodGet, "/", nil), layers[1].Digest); err != nil {
+		t.Fatal(err)
+	}
+	if opened() != before {
+		t.Fatal("unexpected fetch of a prefetched blob from the remote")
+	}
+	if !bytes.Equal(w.Body.Bytes(), mustGet(t, truthRepo.Blobs(ctx), layers[1])) {
+		t.Fatal("unexpected content of the prefetched blob")
+	}
+
+	after := prefetched()
+	if after.Blobs-start.Blobs != 3 || after.Bytes-start.Bytes != uint64(config.Size+layers[0].Size+layers[1].Size) || after.Hits-start.Hits != 1 {
+		t.Fatalf("unexpected prefetch metrics %+v, before %+v", after, start)
+	}
+}
+
+func mustGet(t *testing.T, blobs distribution.BlobStore, desc v1.Descriptor) []byte {
+	t.Helper()
+	content, err := blobs.Get(context.Background(), desc.Digest)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return content
+}
@@ -0,0 +1,100 @@
+package proxy
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"github.com/distribution/distribution/v3/internal/dcontext"
+	"github.com/distribution/distribution/v3/registry/proxy/scheduler"
+	"github.com/distribution/reference"
+)
+
+// quotaReconcileInterval is the interval at which the cache usage is
+// reconciled with the blobs in the storage.
+var quotaReconcileInterval = 10 * time.Minute
+
+// cacheQuota enforces an upper bound on the total size of blobs held in the
+// proxy cache. Cached blob sizes are accounted by the scheduler, which
+// persists them alongside its state; in-progress writes are tracked here until
+// they are committed and scheduled.
+type cacheQuota struct {
+	sync.Mutex
+	limit     int64
+	evict     bool
+	reserved  int64
+	scheduler *scheduler.TTLExpirationScheduler
+	// stop is closed by close, stopping the reconciliation of the usage.
+	stop      chan struct{}
+	closeOnce sync.Once
+}
+
+// reserve claims size bytes of cache space for a blob about to be written.
+// It returns false if the blob should be served without being persisted.
+// The space is claimed before the blobs are evicted to make room for it,
+// without holding the quota lock during the eviction, and given back if not
+// enough space is freed.
+func (q *cacheQuota) reserve(ctx context.Context, size int64) bool {
+	q.Lock()
+	used := q.scheduler.BlobBytes() + q.reserved
+	if used+size <= q.limit {
+		q.reserved += size
+		q.Unlock()
+		return true
+	}
+	if !q.evict || size > q.limit {
+		q.Unlock()
+		return false
+	}
+	need := used + size - q.limit
+	q.reserved += size
+	q.Unlock()
+
+	freed, err := q.scheduler.EvictBlobs(need)
+	if err != nil {
+		dcontext.GetLogger(ctx).Errorf("Error evicting cached blobs: %s", err)
+		q.release(size)
+		return false
+	}
+	if freed < need {
+		dcontext.GetLogger(ctx).Warnf("Unable to free enough cache space: freed %d of %d bytes", freed, need)
+		q.release(size)
+		return false
+	}
+
+	dcontext.GetLogger(ctx).Infof("Evicted %d bytes from the proxy cache", freed)
+	return true
+}
+
+// release returns size bytes previously claimed by reserve
+func (q *cacheQuota) release(size int64) {
+	q.Lock()
+	defer q.Unlock()
+
+	q.reserved -= size
+}
+
+// reconcile reconciles the cache usage with the blobs in the storage, checked
+// with stat, on start and then every interval until the quota is closed, so
+// that the blobs removed out of band, such as by garbage collection, stop
+// being accounted.
+func (q *cacheQuota) reconcile(ctx context.Context, interval time.Duration, stat func(reference.Reference) (int64, bool, error)) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		if err := q.scheduler.ReconcileBlobs(stat); err != nil {
+			dcontext.GetLogger(ctx).Errorf("Error reconciling proxy cache usage: %s", err)
+		}
+		select {
+		case <-ticker.C:
+		case <-q.stop:
+			return
+		}
+	}
+}
+
+// close stops the reconciliation of the usage.
+func (q *cacheQuota) close() {
+	q.closeOnce.Do(func() { close(q.stop) })
+}
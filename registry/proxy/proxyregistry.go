@@ -10,8 +10,12 @@ import (
 	"time"
 
 	"github.com/distribution/reference"
+	"github.com/hashicorp/golang-lru/arc/v2"
+	"github.com/opencontainers/go-digest"
+	v1 "github.com/opencontainers/image-spec/specs-go/v1"
 
 	"github.com/distribution/distribution/v3"
+	"github.com/distribution/distribution/v3/audit"
 	"github.com/distribution/distribution/v3/configuration"
 	"github.com/distribution/distribution/v3/internal/client"
 	"github.com/distribution/distribution/v3/internal/client/auth"
@@ -29,33 +33,143 @@ var repositoryTTL = 24 * 7 * time.Hour
 type proxyingRegistry struct {
 	embedded          distribution.Namespace // provides local registry functionality
 	scheduler         *scheduler.TTLExpirationScheduler
-	ttl               *time.Duration
+	ttls              *ttlPolicy // guarded by ttlMu, being replaced on reloads
+	ttlMu             sync.RWMutex
+	blobMediaTypes    *blobMediaTypes
 	cacheWriteTimeout time.Duration
-	remoteURL         url.URL
-	authChallenger    authChallenger
-	basicAuth         auth.CredentialStore
+	quota             *cacheQuota
+	maxCacheBlobSize  int64
+	remotes           []*proxyRemote
+	fetchOnMount      bool
+	prefetcher        *prefetcher
+	maxManifestSize   int64
+	onManifestFetch   func(context.Context, ManifestFetch)
+	inventory         *storage.BlobInventory
+	audit             *audit.Logger
+	verifier          *SignatureVerifier
+	schema1Policy     string
+	conversions       *arc.ARCCache[string, digest.Digest] // the schema1 manifests converted
+	// streamThrough streams the content from the remotes without caching
+	// anything, in the stream through mode.
+	streamThrough bool
+	// parallelFetch configures the fetch of the large blobs in parts.
+	parallelFetch configuration.ProxyParallelFetch
+	// seedPlatforms are the platforms of the images of the indexes seeded.
+	seedPlatforms []configuration.Platform
+}
+
+// proxyRemote holds the connection state for a single upstream registry
+type proxyRemote struct {
+	prefix         string
+	remoteURL      url.URL
+	upstream       http.RoundTripper // the transport of the requests to the remote
+	authChallenger authChallenger
+	basicAuth      auth.CredentialStore
+	tagFilter      *tagFilter
+}
+
+// RegistryOption is the type used for functional options for
+// NewRegistryPullThroughCache.
+type RegistryOption func(*proxyingRegistry)
+
+// WithMaxManifestSize refuses the manifests fetched from upstream over size
+// bytes, which are neither served nor cached. A size of zero disables the
+// limit.
+func WithMaxManifestSize(size int64) RegistryOption {
+	return func(pr *proxyingRegistry) {
+		pr.maxManifestSize = size
+	}
+}
+
+// ManifestFetch describes a manifest fetched from an upstream registry on a
+// miss of the cache.
+type ManifestFetch struct {
+	// Repository is the name of the repository of the manifest.
+	Repository reference.Named
+	// Tag is the tag the manifest was requested by, if any.
+	Tag string
+	// Descriptor describes the manifest fetched, its size being the number
+	// of bytes fetched.
+	Descriptor v1.Descriptor
+	// Upstream is the host of the upstream registry.
+	Upstream string
+	// Duration is the time taken to fetch the manifest.
+	Duration time.Duration
+}
+
+// WithManifestFetchListener calls listener once for each manifest fetched
+// from upstream and cached, with the context of the request which fetched
+// it. Concurrent requests for a missing manifest share a single fetch.
+func WithManifestFetchListener(listener func(context.Context, ManifestFetch)) RegistryOption {
+	return func(pr *proxyingRegistry) {
+		pr.onManifestFetch = listener
+	}
+}
+
+// WithBlobInventory accounts for the blobs expired from the cache in the
+// inventory of the blob store.
+func WithBlobInventory(inventory *storage.BlobInventory) RegistryOption {
+	return func(pr *proxyingRegistry) {
+		pr.inventory = inventory
+	}
+}
+
+// WithAuditLog records the content expired or evicted from the cache in the
+// audit log.
+func WithAuditLog(logger *audit.Logger) RegistryOption {
+	return func(pr *proxyingRegistry) {
+		pr.audit = logger
+	}
 }
 
 // NewRegistryPullThroughCache creates a registry acting as a pull through cache
-func NewRegistryPullThroughCache(ctx context.Context, registry distribution.Namespace, driver driver.StorageDriver, config configuration.Proxy) (distribution.Namespace, error) {
-	remoteURL, err := url.Parse(config.RemoteURL)
+func NewRegistryPullThroughCache(ctx context.Context, registry distribution.Namespace, driver driver.StorageDriver, config configuration.Proxy, options ...RegistryOption) (distribution.Namespace, error) {
+	warnings, err := Validate(config)
 	if err != nil {
 		return nil, err
 	}
+	for _, warning := range warnings {
+		dcontext.GetLogger(ctx).Warn(warning)
+	}
 
-	v := storage.NewVacuum(ctx, driver)
+	var remotes []*proxyRemote
+	for _, rc := range config.RemoteConfigs() {
+		remote, err := newProxyRemote(ctx, rc)
+		if err != nil {
+			return nil, err
+		}
+		remotes = append(remotes, remote)
+	}
 
-	var s *scheduler.TTLExpirationScheduler
-	var ttl *time.Duration
-	if config.TTL == nil {
-		// Default TTL is 7 days
-		ttl = &repositoryTTL
-	} else if *config.TTL > 0 {
-		ttl = config.TTL
-	} else {
-		// TTL is disabled, never expire
-		ttl = nil
+	pr := &proxyingRegistry{
+		embedded:         registry,
+		remotes:          remotes,
+		fetchOnMount:     config.FetchOnMount,
+		maxCacheBlobSize: config.MaxCacheBlobSize,
+		streamThrough:    config.Mode == configuration.ProxyModeStreamThrough,
+		parallelFetch:    config.ParallelFetch,
+		seedPlatforms:    config.SeedPlatforms,
+	}
+	if config.Prefetch.Enabled && !pr.streamThrough {
+		pr.prefetcher = newPrefetcher(config.Prefetch)
+	}
+	if config.Verification.Enabled() {
+		if pr.verifier, err = NewSignatureVerifier(config.Verification); err != nil {
+			return nil, err
+		}
+	}
+	for _, option := range options {
+		option(pr)
 	}
+	if pr.streamThrough {
+		// Nothing is cached, nor scheduled to expire.
+		return pr, nil
+	}
+
+	v := storage.NewVacuum(ctx, driver).WithBlobInventory(pr.inventory)
+
+	var s *scheduler.TTLExpirationScheduler
+	ttls := newTTLPolicy(config)
 
 	// Set default cache write timeout if not specified
 	cacheWriteTimeout := 5 * time.Minute
@@ -63,8 +177,18 @@ func NewRegistryPullThroughCache(ctx context.Context, registry distribution.Name
 		cacheWriteTimeout = *config.CacheWriteTimeout
 	}
 
-	if ttl != nil {
+	evict := config.QuotaPolicy != configuration.ProxyQuotaPolicyStream
+
+	if ttls.expires() || config.MaxCacheSize > 0 {
 		s = scheduler.New(ctx, driver, "/scheduler-state.json")
+		// The blobs referenced by a manifest cached are kept for as long.
+		s.RetainBlob(func(ref reference.Reference) (bool, error) {
+			r, ok := ref.(reference.Canonical)
+			if !ok {
+				return false, fmt.Errorf("unexpected reference type : %T", ref)
+			}
+			return referencedBlob(ctx, registry, r)
+		})
 		s.OnBlobExpire(func(ref reference.Reference) error {
 			var r reference.Canonical
 			var ok bool
@@ -72,25 +196,24 @@ func NewRegistryPullThroughCache(ctx context.Context, registry distribution.Name
 				return fmt.Errorf("unexpected reference type : %T", ref)
 			}
 
-			repo, err := registry.Repository(ctx, r)
-			if err != nil {
-				return err
-			}
-
-			blobs := repo.Blobs(ctx)
+			err := func() error {
+				repo, err := registry.Repository(ctx, r)
+				if err != nil {
+					return err
+				}
 
-			// Clear the repository reference and descriptor caches
-			err = blobs.Delete(ctx, r.Digest())
-			if err != nil {
-				return err
-			}
+				blobs := repo.Blobs(ctx)
 
-			err = v.RemoveBlob(r.Digest().String())
-			if err != nil {
-				return err
-			}
+				// Clear the repository reference and descriptor caches
+				err = blobs.Delete(ctx, r.Digest())
+				if err != nil {
+					return err
+				}
 
-			return nil
+				return v.RemoveBlob(r.Digest().String())
+			}()
+			pr.recordPurge(ctx, audit.ActionProxyBlobPurge, r, err)
+			return err
 		})
 
 		s.OnManifestExpire(func(ref reference.Reference) error {
@@ -100,66 +223,250 @@ func NewRegistryPullThroughCache(ctx context.Context, registry distribution.Name
 				return fmt.Errorf("unexpected reference type : %T", ref)
 			}
 
-			repo, err := registry.Repository(ctx, r)
-			if err != nil {
-				return err
-			}
+			err := func() error {
+				repo, err := registry.Repository(ctx, r)
+				if err != nil {
+					return err
+				}
+
+				manifests, err := repo.Manifests(ctx)
+				if err != nil {
+					return err
+				}
+				return manifests.Delete(ctx, r.Digest())
+			}()
+			pr.recordPurge(ctx, audit.ActionProxyManifestPurge, r, err)
+			return err
+		})
+
+		if err := s.Start(); err != nil {
+			return nil, err
+		}
+	}
 
-			manifests, err := repo.Manifests(ctx)
-			if err != nil {
-				return err
+	var quota *cacheQuota
+	if config.MaxCacheSize > 0 {
+		quota = &cacheQuota{
+			limit:     config.MaxCacheSize,
+			evict:     evict,
+			scheduler: s,
+			stop:      make(chan struct{}),
+		}
+
+		// Recompute the cache usage lazily, then periodically, dropping
+		// entries for content removed while the registry was not running
+		// or out of band
+		go quota.reconcile(ctx, quotaReconcileInterval, func(ref reference.Reference) (int64, bool, error) {
+			r, ok := ref.(reference.Canonical)
+			if !ok {
+				return 0, false, fmt.Errorf("unexpected reference type : %T", ref)
 			}
-			err = manifests.Delete(ctx, r.Digest())
-			if err != nil {
-				return err
+			desc, err := registry.BlobStatter().Stat(ctx, r.Digest())
+			switch err {
+			case nil:
+				return desc.Size, true, nil
+			case distribution.ErrBlobUnknown:
+				return 0, false, nil
+			default:
+				return 0, false, err
 			}
-			return nil
 		})
+	}
 
-		err = s.Start()
-		if err != nil {
-			return nil, err
-		}
+	pr.scheduler = s
+	pr.ttls = ttls
+	pr.blobMediaTypes = newBlobMediaTypes(config)
+	pr.cacheWriteTimeout = cacheWriteTimeout
+	pr.quota = quota
+	return pr, nil
+}
+
+// newProxyRemote configures the credentials and challenge state for a remote
+func newProxyRemote(ctx context.Context, config configuration.ProxyRemote) (*proxyRemote, error) {
+	if config.RemoteURL == "" {
+		return nil, fmt.Errorf("proxy remote with prefix %q has no remoteurl", config.Prefix)
+	}
+
+	remoteURL, err := url.Parse(config.RemoteURL)
+	if err != nil {
+		return nil, err
 	}
 
 	// Auto-detect ECR and configure if not explicitly set
 	if config.ECR == nil && config.Exec == nil && config.Username == "" && isECRURL(config.RemoteURL) {
 		// Auto-configure ECR with default settings
 		config.ECR = &configuration.ECRConfig{}
-		dcontext.GetLogger(ctx).Info("Auto-detected ECR registry, enabling ECR authentication")
+		dcontext.GetLogger(ctx).Infof("Auto-detected ECR registry %s, enabling ECR authentication", remoteURL.Host)
 	}
 
+	filter, err := newTagFilter(config.TagFilter)
+	if err != nil {
+		return nil, err
+	}
+	tr := newRemoteTransport(config)
+	upstream := newUpstreamTransport(remoteURL.Host, tr)
+
 	cs, b, err := func() (auth.CredentialStore, auth.CredentialStore, error) {
 		switch {
 		case config.ECR != nil:
-			cs, err := configureECRAuth(*config.ECR, config.RemoteURL)
+			cs, err := configureECRAuth(*config.ECR, config.RemoteURL, upstreamMetricsTransport{RoundTripper: tr, remote: remoteURL.Host})
 			return cs, cs, err
 		case config.Exec != nil:
 			cs, err := configureExecAuth(*config.Exec)
 			return cs, cs, err
+		case config.ForceBasic:
+			// The remote has no token service to discover.
+			if config.Username == "" {
+				return nil, nil, fmt.Errorf("forcebasic requires the credentials of remote %s", remoteURL.Redacted())
+			}
+			up := userpass{username: config.Username, password: config.Password}
+			return up, up, nil
 		default:
-			return configureAuth(config.Username, config.Password, config.RemoteURL)
+			return configureAuth(config.Username, config.Password, config.RemoteURL, upstream)
 		}
 	}()
 	if err != nil {
 		return nil, err
 	}
 
-	return &proxyingRegistry{
-		embedded:          registry,
-		scheduler:         s,
-		ttl:               ttl,
-		cacheWriteTimeout: cacheWriteTimeout,
-		remoteURL:         *remoteURL,
+	var cm challenge.Manager = challenge.NewSimpleManager()
+	if config.ForceBasic {
+		cm = basicChallengeManager{}
+	}
+	return &proxyRemote{
+		prefix:    config.Prefix,
+		remoteURL: *remoteURL,
+		upstream:  upstream,
 		authChallenger: &remoteAuthChallenger{
 			remoteURL: *remoteURL,
-			cm:        challenge.NewSimpleManager(),
+			transport: upstream,
+			cm:        cm,
 			cs:        cs,
 		},
 		basicAuth: b,
+		tagFilter: filter,
 	}, nil
 }
 
+// transport returns a transport authorizing the requests to the remote for
+// the scopes. The failures to authenticate to the remote are returned as
+// UpstreamAuthError.
+func (remote *proxyRemote) transport(ctx context.Context, scopes ...auth.Scope) http.RoundTripper {
+	c := remote.authChallenger
+	tkopts := auth.TokenHandlerOptions{
+		Transport:   remote.upstream,
+		Credentials: c.credentialStore(),
+		Scopes:      scopes,
+		Logger:      dcontext.GetLogger(ctx),
+	}
+
+	host := remote.remoteURL.Host
+	return upstreamAuthTransport{
+		RoundTripper: basicChallengeTransport{
+			RoundTripper: transport.NewTransport(remote.upstream,
+				auth.NewAuthorizer(c.challengeManager(),
+					upstreamAuthHandler{AuthenticationHandler: auth.NewTokenHandlerWithOptions(tkopts), upstream: host, creds: c.credentialStore()},
+					upstreamAuthHandler{AuthenticationHandler: auth.NewBasicHandler(remote.basicAuth), upstream: host, creds: remote.basicAuth})),
+			remote: remote,
+		},
+		upstream: host,
+	}
+}
+
+// basicChallengeTransport sends again with the credentials of the remote the
+// requests challenged with basic authentication, for an upstream which does
+// not challenge its base route, and records the challenge so that the later
+// requests are sent with the credentials.
+type basicChallengeTransport struct {
+	http.RoundTripper
+	remote *proxyRemote
+}
+
+func (t basicChallengeTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	resp, err := t.RoundTripper.RoundTrip(req)
+	if err != nil || resp.StatusCode != http.StatusUnauthorized || (req.Body != nil && req.Body != http.NoBody) {
+		return resp, err
+	}
+	if !t.remote.recordBasicChallenge(req, resp) {
+		return resp, nil
+	}
+	resp.Body.Close()
+	return t.RoundTripper.RoundTrip(req)
+}
+
+// recordBasicChallenge records the basic challenge of resp as the challenge of
+// the remote, if the remote presented none and has credentials, and returns
+// whether it did.
+func (remote *proxyRemote) recordBasicChallenge(req *http.Request, resp *http.Response) bool {
+	basic := false
+	for _, c := range challenge.ResponseChallenges(resp) {
+		basic = basic || c.Scheme == "basic"
+	}
+	if !basic || remote.basicAuth == nil {
+		return false
+	}
+	if username, _ := remote.basicAuth.Basic(req.URL); username == "" {
+		return false
+	}
+
+	base := remote.remoteURL
+	base.Path = "/v2/"
+	cm := remote.authChallenger.challengeManager()
+	if challenges, err := cm.GetChallenges(base); err != nil || len(challenges) > 0 {
+		return false
+	}
+	if err := cm.AddResponse(&http.Response{
+		StatusCode: http.StatusUnauthorized,
+		Header:     http.Header{"Www-Authenticate": []string{"Basic"}},
+		Request:    &http.Request{URL: &base},
+	}); err != nil {
+		return false
+	}
+	dcontext.GetLogger(req.Context()).Infof("Basic authentication established with upstream %s, challenging %s", base.Redacted(), req.URL.Path)
+	return true
+}
+
+// remoteFor returns the remote serving the named repository: the one with
+// the longest matching prefix, with ties going to the first configured.
+func (pr *proxyingRegistry) remoteFor(name reference.Named) (*proxyRemote, error) {
+	var match *proxyRemote
+	for _, remote := range pr.remotes {
+		if !matchesPrefix(name.Name(), remote.prefix) {
+			continue
+		}
+		if match == nil || len(strings.TrimSuffix(remote.prefix, "/")) > len(strings.TrimSuffix(match.prefix, "/")) {
+			match = remote
+		}
+	}
+	if match == nil {
+		return nil, distribution.ErrRepositoryUnknown{Name: name.Name()}
+	}
+	return match, nil
+}
+
+// upstreamName returns the name of the repository on the remote: its name
+// without the prefix of the remote, such as app for team/app on the remote
+// with the prefix team/.
+func (r *proxyRemote) upstreamName(name reference.Named) (reference.Named, error) {
+	prefix := strings.TrimSuffix(r.prefix, "/")
+	if prefix == "" {
+		return name, nil
+	}
+	rest, ok := strings.CutPrefix(name.Name(), prefix+"/")
+	if !ok {
+		return nil, distribution.ErrRepositoryNameInvalid{Name: name.Name(), Reason: fmt.Errorf("the name of the repository is the prefix %s of its remote", r.prefix)}
+	}
+	return reference.WithName(rest)
+}
+
+// matchesPrefix reports whether the repository name is under the prefix of a
+// remote, on a path component boundary: the prefix team matches team and
+// team/app, not teamfoo/app. An empty prefix matches every repository.
+func matchesPrefix(name, prefix string) bool {
+	prefix = strings.TrimSuffix(prefix, "/")
+	return prefix == "" || name == prefix || strings.HasPrefix(name, prefix+"/")
+}
+
 func (pr *proxyingRegistry) Scope() distribution.Scope {
 	return distribution.GlobalScope
 }
@@ -168,36 +475,44 @@ func (pr *proxyingRegistry) Repositories(ctx context.Context, repos []string, la
 	return pr.embedded.Repositories(ctx, repos, last)
 }
 
-func (pr *proxyingRegistry) Repository(ctx context.Context, name reference.Named) (distribution.Repository, error) {
-	c := pr.authChallenger
-
-	tkopts := auth.TokenHandlerOptions{
-		Transport:   http.DefaultTransport,
-		Credentials: c.credentialStore(),
-		Scopes: []auth.Scope{
-			auth.RepositoryScope{
-				Repository: name.Name(),
-				Actions:    []string{"pull"},
-			},
-		},
-		Logger: dcontext.GetLogger(ctx),
+func (pr *proxyingRegistry) RepositoriesWithPrefix(ctx context.Context, repos []string, last, prefix string) (n int, err error) {
+	lister, ok := pr.embedded.(distribution.RepositoryPrefixLister)
+	if !ok {
+		return 0, distribution.ErrUnsupported
 	}
+	return lister.RepositoriesWithPrefix(ctx, repos, last, prefix)
+}
 
-	tr := transport.NewTransport(http.DefaultTransport,
-		auth.NewAuthorizer(c.challengeManager(),
-			auth.NewTokenHandlerWithOptions(tkopts),
-			auth.NewBasicHandler(pr.basicAuth)))
+func (pr *proxyingRegistry) Repository(ctx context.Context, name reference.Named) (distribution.Repository, error) {
+	remote, err := pr.remoteFor(name)
+	if err != nil {
+		return nil, err
+	}
+	// The repository is cached under its name, and requested from the
+	// remote without the prefix of the remote.
+	upstreamName, err := remote.upstreamName(name)
+	if err != nil {
+		return nil, err
+	}
+	c := remote.authChallenger
+	tr := remote.transport(ctx, auth.RepositoryScope{
+		Repository: upstreamName.Name(),
+		Actions:    []string{"pull"},
+	})
 
 	localRepo, err := pr.embedded.Repository(ctx, name)
 	if err != nil {
 		return nil, err
 	}
+	pr.ttlMu.RLock()
+	ttls := pr.ttls
+	pr.ttlMu.RUnlock()
 	localManifests, err := localRepo.Manifests(ctx, storage.SkipLayerVerification())
 	if err != nil {
 		return nil, err
 	}
 
-	remoteRepo, err := client.NewRepository(name, pr.remoteURL.String(), tr)
+	remoteRepo, err := client.NewRepository(upstreamName, remote.remoteURL.String(), tr)
 	if err != nil {
 		return nil, err
 	}
@@ -207,30 +522,101 @@ func (pr *proxyingRegistry) Repository(ctx context.Context, name reference.Named
 		return nil, err
 	}
 
+	var verify func(context.Context, digest.Digest, distribution.Manifest) error
+	if pr.verifier != nil {
+		verify = func(ctx context.Context, dgst digest.Digest, manifest distribution.Manifest) error {
+			return pr.verifier.Verify(ctx, remoteRepo, dgst, manifest)
+		}
+	}
+
+	var parallel *parallelFetcher
+	if pr.parallelFetch.Enabled {
+		parallel, err = newParallelFetcher(pr.parallelFetch, tr, upstreamName, remote.remoteURL.String())
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	if pr.streamThrough {
+		return &proxiedRepository{
+			blobStore: streamThroughBlobStore{
+				remote: &proxyBlobStore{
+					remoteStore:    remoteRepo.Blobs(ctx),
+					repositoryName: name,
+					authChallenger: c,
+					parallel:       parallel,
+					upstream:       remote.remoteURL.Host,
+				},
+			},
+			manifests: streamThroughManifestStore{
+				remoteManifests: remoteManifests,
+				repositoryName:  name,
+				authChallenger:  c,
+				maxSize:         pr.maxManifestSize,
+				verify:          verify,
+				schema1:         streamThroughSchema1Policy(pr.schema1Policy),
+			},
+			name: name,
+			tags: streamThroughTagService{
+				remoteTags:     remoteRepo.Tags(ctx),
+				authChallenger: c,
+				tagFilter:      remote.tagFilter,
+			},
+		}, nil
+	}
+
+	blobStore := &proxyBlobStore{
+		localStore:        localRepo.Blobs(ctx),
+		remoteStore:       remoteRepo.Blobs(ctx),
+		scheduler:         pr.scheduler,
+		ttls:              ttls,
+		cacheWriteTimeout: pr.cacheWriteTimeout,
+		repositoryName:    name,
+		authChallenger:    c,
+		quota:             pr.quota,
+		maxBlobSize:       pr.maxCacheBlobSize,
+		prefetcher:        pr.prefetcher,
+		mediaTypes:        pr.blobMediaTypes,
+		parallel:          parallel,
+		registry:          pr,
+		upstream:          remote.remoteURL.Host,
+	}
+	var prefetch func(context.Context, distribution.Manifest)
+	if pr.prefetcher != nil {
+		prefetch = func(ctx context.Context, manifest distribution.Manifest) {
+			pr.prefetcher.prefetch(ctx, blobStore, manifest)
+		}
+	}
 	return &proxiedRepository{
-		blobStore: &proxyBlobStore{
-			localStore:        localRepo.Blobs(ctx),
-			remoteStore:       remoteRepo.Blobs(ctx),
-			scheduler:         pr.scheduler,
-			ttl:               pr.ttl,
-			cacheWriteTimeout: pr.cacheWriteTimeout,
-			repositoryName:    name,
-			authChallenger:    pr.authChallenger,
-		},
+		blobStore: blobStore,
 		manifests: &proxyManifestStore{
 			repositoryName:  name,
 			localManifests:  localManifests, // Options?
 			remoteManifests: remoteManifests,
 			ctx:             ctx,
 			scheduler:       pr.scheduler,
-			ttl:             pr.ttl,
-			authChallenger:  pr.authChallenger,
+			ttls:            ttls,
+			authChallenger:  c,
+			maxSize:         pr.maxManifestSize,
+			upstream:        remote.remoteURL.Host,
+			onFetch:         pr.onManifestFetch,
+			prefetch:        prefetch,
+			verify:          verify,
+			tagFilter:       remote.tagFilter,
+			blobMediaTypes:  pr.blobMediaTypes,
+			schema1: schema1Policy{
+				policy:      pr.schema1Policy,
+				conversions: pr.conversions,
+				layers:      cachedOrRemoteBlobs{local: localRepo.Blobs(ctx), remote: remoteRepo.Blobs(ctx)},
+				configs:     localRepo.Blobs(ctx),
+			},
 		},
 		name: name,
 		tags: &proxyTagService{
 			localTags:      localRepo.Tags(ctx),
 			remoteTags:     remoteRepo.Tags(ctx),
-			authChallenger: pr.authChallenger,
+			authChallenger: c,
+			tagFilter:      remote.tagFilter,
 		},
 	}, nil
 }
@@ -248,7 +634,148 @@ type Closer interface {
 	Close() error
 }
 
+// Seeder is implemented by the pull through cache, which can be seeded with
+// references pulled through it.
+type Seeder interface {
+	Seed(ctx context.Context, refs []reference.Named) SeedSummary
+}
+
+// recordPurge records the purge of the content from the cache in the audit
+// log, failed if err is not nil.
+func (pr *proxyingRegistry) recordPurge(ctx context.Context, action string, r reference.Canonical, err error) {
+	entry := audit.Entry{
+		Action:     action,
+		Repository: r.Name(),
+		Digest:     r.Digest(),
+		Outcome:    audit.OutcomeSuccess,
+	}
+	if err != nil {
+		entry.Outcome = audit.OutcomeFailure
+		entry.Error = err.Error()
+	}
+	if err := pr.audit.Log(entry); err != nil {
+		dcontext.GetLogger(ctx).Errorf("failed to record %s in the audit log: %v", action, err)
+	}
+}
+
+// resolveTTL returns the time the content is cached for, nil if it never
+// expires.
+func resolveTTL(ttl *time.Duration) *time.Duration {
+	if ttl == nil {
+		// Default TTL is 7 days
+		return &repositoryTTL
+	}
+	if *ttl > 0 {
+		return ttl
+	}
+	// TTL is disabled, never expire
+	return nil
+}
+
+// SetTTL replaces the times the content cached from now on is cached for by
+// the ttls of the config. The content already cached keeps its expiry. The expiry cannot be enabled if it
+// was disabled on startup without a maximum cache size, as the scheduler
+// expiring the content does not run.
+func (pr *proxyingRegistry) SetTTL(config configuration.Proxy) error {
+	ttls := newTTLPolicy(config)
+	if ttls.expires() && pr.scheduler == nil {
+		return fmt.Errorf("the proxy ttl cannot be enabled without a restart, as it was disabled on startup")
+	}
+	pr.ttlMu.Lock()
+	defer pr.ttlMu.Unlock()
+	pr.ttls = ttls
+	return nil
+}
+
+// SchedulerEntries returns the number of blobs and manifests scheduled to
+// expire from the cache.
+func (pr *proxyingRegistry) SchedulerEntries() int {
+	if pr.scheduler == nil {
+		return 0
+	}
+	return pr.scheduler.Len()
+}
+
+// Expirations returns the blobs and manifests scheduled to expire from the
+// cache until before, or all of them if before is zero, soonest first.
+func (pr *proxyingRegistry) Expirations(before time.Time) []scheduler.Expiration {
+	if pr.scheduler == nil {
+		return []scheduler.Expiration{}
+	}
+	return pr.scheduler.Expirations(before)
+}
+
+// Rename renames the repository in the storage of the cache, and moves its
+// entries in the scheduler so that its content expires under the new name.
+func (pr *proxyingRegistry) Rename(ctx context.Context, from, to reference.Named) error {
+	renamer, ok := pr.embedded.(distribution.RepositoryRenamer)
+	if !ok {
+		return fmt.Errorf("the storage of the cache does not support renaming repositories")
+	}
+	if err := renamer.Rename(ctx, from, to); err != nil {
+		return err
+	}
+	if pr.scheduler == nil {
+		return nil
+	}
+	return pr.scheduler.Rename(from, to)
+}
+
+// CredentialCheck checks that the credentials of a remote can still be
+// obtained, the cached ones being valid for longer than margin.
+type CredentialCheck struct {
+	Prefix    string
+	RemoteURL url.URL
+	Check     func(ctx context.Context, margin time.Duration) error
+}
+
+// ECRCredentialChecks returns the checks of the remotes authenticating with
+// ECR, sharing the tokens cached for the pulls.
+func (pr *proxyingRegistry) ECRCredentialChecks() []CredentialCheck {
+	var checks []CredentialCheck
+	for _, remote := range pr.remotes {
+		if cs, ok := remote.authChallenger.credentialStore().(*ecrCredentials); ok {
+			checks = append(checks, CredentialCheck{
+				Prefix:    remote.prefix,
+				RemoteURL: remote.remoteURL,
+				Check:     cs.Check,
+			})
+		}
+	}
+	return checks
+}
+
+// ScheduleExpiry schedules the expiry of the blob, or of the manifest, of the
+// repository written to the storage of the cache other than by a pull, such
+// as imported, as if it was pulled now.
+func (pr *proxyingRegistry) ScheduleExpiry(ref reference.Canonical, size int64, manifest bool) error {
+	if pr.scheduler == nil {
+		return nil
+	}
+	pr.ttlMu.RLock()
+	ttls := pr.ttls
+	pr.ttlMu.RUnlock()
+	if manifest {
+		if ttl := ttls.manifestTTL(""); ttl != nil {
+			return pr.scheduler.AddManifest(ref, *ttl)
+		}
+		return nil
+	}
+	if ttl := ttls.blobTTL(pr.blobMediaTypes.mediaType(ref.Digest(), "")); ttl != nil || pr.quota != nil {
+		return pr.scheduler.AddBlobWithSize(ref, size, ttl)
+	}
+	return nil
+}
+
+// Close cancels the blobs being prefetched, stops the reconciliation of the
+// cache usage and stops the scheduler.
 func (pr *proxyingRegistry) Close() error {
+	if pr.prefetcher != nil {
+		pr.prefetcher.close()
+	}
+	if pr.quota != nil {
+		pr.quota.close()
+	}
 	if pr.scheduler == nil {
 		return nil
 	}
@@ -264,9 +791,13 @@ type authChallenger interface {
 
 type remoteAuthChallenger struct {
 	remoteURL url.URL
+	transport http.RoundTripper
 	sync.Mutex
 	cm challenge.Manager
 	cs auth.CredentialStore
+	// established is set once the upstream answered the challenge request,
+	// so that an upstream which presents no challenge is not requested again.
+	established bool
 }
 
 func (r *remoteAuthChallenger) credentialStore() auth.CredentialStore {
@@ -291,15 +822,27 @@ func (r *remoteAuthChallenger) tryEstablishChallenges(ctx context.Context) error
 		return err
 	}
 
-	if len(challenges) > 0 {
+	if len(challenges) > 0 || r.established {
 		return nil
 	}
 
 	// establish challenge type with upstream
-	if err := ping(r.cm, remoteURL.String(), challengeHeader); err != nil {
+	if err := ping(ctx, r.transport, r.cm, remoteURL.String(), challengeHeader); err != nil {
 		return err
 	}
-	dcontext.GetLogger(ctx).Infof("Challenge established with upstream: %s", remoteURL.Redacted())
+	r.established = true
+	challenges, err = r.cm.GetChallenges(remoteURL)
+	if err != nil {
+		return err
+	}
+	switch {
+	case len(challenges) == 0:
+		dcontext.GetLogger(ctx).Infof("Upstream %s presents no challenge, its requests are sent without credentials unless forcebasic is set", remoteURL.Redacted())
+	case len(challenges) == 1 && challenges[0].Scheme == "basic":
+		dcontext.GetLogger(ctx).Infof("Basic authentication established with upstream: %s", remoteURL.Redacted())
+	default:
+		dcontext.GetLogger(ctx).Infof("Challenge established with upstream: %s", remoteURL.Redacted())
+	}
 
 	return nil
 }
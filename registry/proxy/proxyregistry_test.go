@@ -1,7 +1,23 @@
 package proxy
 
 import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"slices"
+	"sync"
 	"testing"
+	"time"
+
+	"github.com/distribution/reference"
+	"github.com/opencontainers/go-digest"
+
+	"github.com/distribution/distribution/v3"
+	"github.com/distribution/distribution/v3/configuration"
+	"github.com/distribution/distribution/v3/registry/storage"
+	"github.com/distribution/distribution/v3/registry/storage/driver/inmemory"
 )
 
 func TestProxyingRegistryCloseWithoutScheduler(t *testing.T) {
@@ -15,3 +31,414 @@ func TestProxyingRegistryCloseWithoutScheduler(t *testing.T) {
 		t.Fatalf("Close() returned unexpected error: %v", err)
 	}
 }
+
+func TestProxyingRegistrySetTTL(t *testing.T) {
+	ctx := context.Background()
+	d := inmemory.New()
+	localRegistry, err := storage.NewRegistry(ctx, d)
+	if err != nil {
+		t.Fatal(err)
+	}
+	upstream := httptest.NewServer(http.NotFoundHandler())
+	defer upstream.Close()
+	ns, err := NewRegistryPullThroughCache(ctx, localRegistry, d, configuration.Proxy{RemoteURL: upstream.URL})
+	if err != nil {
+		t.Fatal(err)
+	}
+	pr := ns.(*proxyingRegistry)
+	defer pr.Close()
+	ref, _ := reference.WithName("library/busybox")
+	ttlOf := func() *time.Duration {
+		repo, err := pr.Repository(ctx, ref)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return repo.(*proxiedRepository).manifests.(*proxyManifestStore).ttls.manifestTTL("")
+	}
+	if ttl := ttlOf(); ttl == nil || *ttl != repositoryTTL {
+		t.Fatalf("unexpected default ttl %v", ttl)
+	}
+
+	// The repositories opened after the change cache for the new ttl.
+	hour := time.Hour
+	if err := pr.SetTTL(configuration.Proxy{TTL: &hour}); err != nil {
+		t.Fatal(err)
+	}
+	if ttl := ttlOf(); ttl == nil || *ttl != hour {
+		t.Fatalf("unexpected ttl %v, expected %v", ttl, hour)
+	}
+	var disabled time.Duration
+	if err := pr.SetTTL(configuration.Proxy{TTL: &disabled}); err != nil {
+		t.Fatal(err)
+	}
+	if ttl := ttlOf(); ttl != nil {
+		t.Fatalf("unexpected ttl %v, expected the expiry disabled", *ttl)
+	}
+
+	// The expiry cannot be enabled without a scheduler.
+	withoutScheduler := &proxyingRegistry{}
+	if err := withoutScheduler.SetTTL(configuration.Proxy{TTL: &hour}); err == nil {
+		t.Fatal("expected an error enabling the expiry without a scheduler")
+	}
+}
+
+// basicAuthUpstream is a registry stub requiring basic auth that records the
+// credentials presented on each authenticated request, and its path
+type basicAuthUpstream struct {
+	*httptest.Server
+	mu    sync.Mutex
+	seen  []string
+	paths []string
+}
+
+func newBasicAuthUpstream(t *testing.T, username, password string) *basicAuthUpstream {
+	t.Helper()
+
+	u := &basicAuthUpstream{}
+	u.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		user, pass, ok := r.BasicAuth()
+		if !ok {
+			w.Header().Set("WWW-Authenticate", `Basic realm="upstream"`)
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		u.mu.Lock()
+		u.seen = append(u.seen, user+":"+pass)
+		u.paths = append(u.paths, r.URL.Path)
+		u.mu.Unlock()
+		if user != username || pass != password {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		w.WriteHeader(http.StatusNotFound)
+	}))
+	t.Cleanup(u.Close)
+	return u
+}
+
+func (u *basicAuthUpstream) credentials() []string {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	return append([]string(nil), u.seen...)
+}
+
+func (u *basicAuthUpstream) requestedPaths() []string {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	return append([]string(nil), u.paths...)
+}
+
+func TestProxyingRegistryPerRemoteCredentials(t *testing.T) {
+	ctx := context.Background()
+	upstreamA := newBasicAuthUpstream(t, "alice", "secret-a")
+	upstreamB := newBasicAuthUpstream(t, "bob", "secret-b")
+
+	d := inmemory.New()
+	localRegistry, err := storage.NewRegistry(ctx, d)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Disable expiry so no scheduler is started
+	var ttl time.Duration
+	ns, err := NewRegistryPullThroughCache(ctx, localRegistry, d, configuration.Proxy{
+		RemoteURL: upstreamA.URL,
+		Username:  "alice",
+		Password:  "secret-a",
+		TTL:       &ttl,
+		Remotes: []configuration.ProxyRemote{
+			{
+				RemoteURL: upstreamB.URL,
+				Prefix:    "teamb/",
+				Username:  "bob",
+				Password:  "secret-b",
+			},
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	dgst := digest.FromString("manifest")
+	for _, name := range []string{"library/busybox", "teamb/app"} {
+		ref, err := reference.WithName(name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		repo, err := ns.Repository(ctx, ref)
+		if err != nil {
+			t.Fatal(err)
+		}
+		manifests, err := repo.Manifests(ctx)
+		if err != nil {
+			t.Fatal(err)
+		}
+		exists, err := manifests.Exists(ctx, dgst)
+		if err != nil {
+			t.Fatalf("%s: unexpected error: %v", name, err)
+		}
+		if exists {
+			t.Fatalf("%s: unexpected manifest in upstream", name)
+		}
+	}
+
+	for _, tc := range []struct {
+		upstream *basicAuthUpstream
+		expected string
+	}{
+		{upstream: upstreamA, expected: "alice:secret-a"},
+		{upstream: upstreamB, expected: "bob:secret-b"},
+	} {
+		seen := tc.upstream.credentials()
+		if len(seen) == 0 {
+			t.Fatalf("upstream %s received no authenticated requests", tc.upstream.URL)
+		}
+		for _, creds := range seen {
+			if creds != tc.expected {
+				t.Errorf("upstream %s received credentials %q, expected %q", tc.upstream.URL, creds, tc.expected)
+			}
+		}
+	}
+
+	// The repositories are requested from the remotes without their prefix.
+	for _, tc := range []struct {
+		upstream *basicAuthUpstream
+		expected string
+	}{
+		{upstream: upstreamA, expected: "/v2/library/busybox/manifests/" + dgst.String()},
+		{upstream: upstreamB, expected: "/v2/app/manifests/" + dgst.String()},
+	} {
+		if paths := tc.upstream.requestedPaths(); !slices.Contains(paths, tc.expected) {
+			t.Errorf("upstream %s was requested %v, expected %s", tc.upstream.URL, paths, tc.expected)
+		}
+	}
+
+	// The repository named by the prefix of a remote has no name on it.
+	ref, _ := reference.WithName("teamb")
+	if _, err := ns.Repository(ctx, ref); !errors.As(err, new(distribution.ErrRepositoryNameInvalid)) {
+		t.Fatalf("unexpected error for the repository named by the prefix of its remote: %v", err)
+	}
+}
+
+func TestProxyingRegistryRemoteFor(t *testing.T) {
+	defaultRemote := &proxyRemote{}
+	teamRemote := &proxyRemote{prefix: "team/"}
+	subRemote := &proxyRemote{prefix: "team/sub/"}
+	pr := &proxyingRegistry{remotes: []*proxyRemote{defaultRemote, teamRemote, subRemote}}
+
+	for name, expected := range map[string]*proxyRemote{
+		"library/busybox": defaultRemote,
+		"team/app":        teamRemote,
+		"team/sub/app":    subRemote,
+	} {
+		ref, err := reference.WithName(name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		remote, err := pr.remoteFor(ref)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if remote != expected {
+			t.Errorf("%s routed to remote with prefix %q, expected %q", name, remote.prefix, expected.prefix)
+		}
+	}
+
+	pr = &proxyingRegistry{remotes: []*proxyRemote{teamRemote}}
+	ref, _ := reference.WithName("other/app")
+	if _, err := pr.remoteFor(ref); err == nil {
+		t.Fatal("expected error for repository matching no remote")
+	}
+
+	// A prefix matches on a path component boundary, with or without its
+	// trailing slash.
+	siblingRemote := &proxyRemote{prefix: "team"}
+	pr = &proxyingRegistry{remotes: []*proxyRemote{defaultRemote, siblingRemote}}
+	for name, expected := range map[string]*proxyRemote{
+		"team":        siblingRemote,
+		"team/app":    siblingRemote,
+		"teamfoo/app": defaultRemote,
+	} {
+		ref, err := reference.WithName(name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		remote, err := pr.remoteFor(ref)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if remote != expected {
+			t.Errorf("%s routed to remote with prefix %q, expected %q", name, remote.prefix, expected.prefix)
+		}
+	}
+	pr = &proxyingRegistry{remotes: []*proxyRemote{teamRemote}}
+	ref, _ = reference.WithName("teamfoo/app")
+	if _, err := pr.remoteFor(ref); err == nil {
+		t.Fatal("expected error for repository sharing the prefix of a remote outside of its path")
+	}
+}
+
+// challengeUpstream is a registry stub authenticating the requests in one of
+// the challenge styles of the upstreams, which counts the requests to its base
+// route and the requests to its repositories sent without credentials.
+type challengeUpstream struct {
+	*httptest.Server
+	mu              sync.Mutex
+	pings           int
+	unauthenticated int
+	authenticated   int
+}
+
+const (
+	// challengeBasic challenges every request with basic authentication.
+	challengeBasic = "basic"
+	// challengeRepository challenges the requests to the repositories with
+	// basic authentication, but not the base route.
+	challengeRepository = "repository"
+	// challengeNone requires basic authentication without challenging.
+	challengeNone = "none"
+	// challengeToken challenges every request with a token service.
+	challengeToken = "token"
+)
+
+func newChallengeUpstream(t *testing.T, style, username, password string) *challengeUpstream {
+	t.Helper()
+
+	u := &challengeUpstream{}
+	u.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		u.mu.Lock()
+		defer u.mu.Unlock()
+		user, pass, basic := r.BasicAuth()
+		challenge := func() {
+			switch style {
+			case challengeBasic, challengeRepository:
+				w.Header().Set("WWW-Authenticate", `Basic realm="upstream"`)
+			case challengeToken:
+				w.Header().Set("WWW-Authenticate", fmt.Sprintf(`Bearer realm="http://%s/token",service="upstream"`, r.Host))
+			}
+			w.WriteHeader(http.StatusUnauthorized)
+		}
+
+		switch {
+		case r.URL.Path == "/token" && style == challengeToken:
+			if !basic || user != username || pass != password {
+				w.WriteHeader(http.StatusUnauthorized)
+				return
+			}
+			fmt.Fprint(w, `{"token": "upstream-token"}`)
+		case r.URL.Path == "/v2/":
+			u.pings++
+			if style == challengeBasic || style == challengeToken {
+				challenge()
+			}
+		case style == challengeToken && r.Header.Get("Authorization") == "Bearer upstream-token",
+			style != challengeToken && basic && user == username && pass == password:
+			u.authenticated++
+			w.WriteHeader(http.StatusNotFound)
+		default:
+			u.unauthenticated++
+			challenge()
+		}
+	}))
+	t.Cleanup(u.Close)
+	return u
+}
+
+func (u *challengeUpstream) counts() (int, int, int) {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	return u.pings, u.unauthenticated, u.authenticated
+}
+
+func TestProxyingRegistryUpstreamChallenges(t *testing.T) {
+	ctx := context.Background()
+	upstreams := map[string]*challengeUpstream{}
+	var remotes []configuration.ProxyRemote
+	for _, style := range []string{challengeBasic, challengeRepository, challengeNone, challengeToken} {
+		upstreams[style] = newChallengeUpstream(t, style, style+"-user", style+"-password")
+		remotes = append(remotes, configuration.ProxyRemote{
+			RemoteURL:  upstreams[style].URL,
+			Prefix:     style + "/",
+			Username:   style + "-user",
+			Password:   style + "-password",
+			ForceBasic: style == challengeNone,
+		})
+	}
+	// An upstream requiring credentials without challenging them, whose
+	// requests fail without forcebasic.
+	unforced := newChallengeUpstream(t, challengeNone, "user", "password")
+	remotes = append(remotes, configuration.ProxyRemote{
+		RemoteURL: unforced.URL,
+		Prefix:    "unforced/",
+		Username:  "user",
+		Password:  "password",
+	})
+
+	d := inmemory.New()
+	localRegistry, err := storage.NewRegistry(ctx, d)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var ttl time.Duration
+	ns, err := NewRegistryPullThroughCache(ctx, localRegistry, d, configuration.Proxy{TTL: &ttl, Remotes: remotes})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	exists := func(name string) error {
+		ref, err := reference.WithName(name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		repo, err := ns.Repository(ctx, ref)
+		if err != nil {
+			t.Fatal(err)
+		}
+		manifests, err := repo.Manifests(ctx)
+		if err != nil {
+			t.Fatal(err)
+		}
+		exists, err := manifests.Exists(ctx, digest.FromString("manifest"))
+		if exists {
+			t.Fatalf("%s: unexpected manifest in upstream", name)
+		}
+		return err
+	}
+	const requests = 3
+	for range requests {
+		for style := range upstreams {
+			if err := exists(style + "/app"); err != nil {
+				t.Fatalf("%s: unexpected error: %v", style, err)
+			}
+		}
+		if err := exists("unforced/app"); err == nil {
+			t.Fatal("expected the request without credentials to fail")
+		}
+	}
+
+	// The base route is requested once to discover the token services, then
+	// once to establish the challenges, unless basic authentication is forced.
+	for style, expected := range map[string]struct{ pings, unauthenticated int }{
+		challengeBasic: {pings: 2},
+		// Only the first request to a repository is sent without credentials.
+		challengeRepository: {pings: 2, unauthenticated: 1},
+		challengeNone:       {},
+		challengeToken:      {pings: 2},
+	} {
+		pings, unauthenticated, authenticated := upstreams[style].counts()
+		if pings != expected.pings || unauthenticated != expected.unauthenticated || authenticated != requests {
+			t.Errorf("%s: %d pings, %d unauthenticated and %d authenticated requests, expected %d, %d and %d", style, pings, unauthenticated, authenticated, expected.pings, expected.unauthenticated, requests)
+		}
+	}
+	if pings, unauthenticated, _ := unforced.counts(); pings != 2 || unauthenticated != requests {
+		t.Errorf("unforced: %d pings and %d unauthenticated requests, expected 2 and %d", pings, unauthenticated, requests)
+	}
+
+	// The credentials are required to force basic authentication.
+	if _, err := NewRegistryPullThroughCache(ctx, localRegistry, d, configuration.Proxy{TTL: &ttl, Remotes: []configuration.ProxyRemote{{
+		RemoteURL:  unforced.URL,
+		ForceBasic: true,
+	}}}); err == nil {
+		t.Fatal("expected forcebasic without credentials to fail")
+	}
+}
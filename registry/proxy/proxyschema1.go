@@ -0,0 +1,117 @@
+package proxy
+
+import (
+	"context"
+	"fmt"
+	"io"
+
+	"github.com/distribution/reference"
+	"github.com/hashicorp/golang-lru/arc/v2"
+	"github.com/opencontainers/go-digest"
+
+	"github.com/distribution/distribution/v3"
+	"github.com/distribution/distribution/v3/configuration"
+	"github.com/distribution/distribution/v3/internal/dcontext"
+	"github.com/distribution/distribution/v3/manifest/schema1"
+	"github.com/distribution/distribution/v3/manifest/schema2"
+)
+
+// schema1ConversionsSize is the number of schema1 manifests whose conversion
+// is remembered. The conversions forgotten are made again on the next pull.
+const schema1ConversionsSize = 4096
+
+// WithSchema1Policy applies the policy of the registry for the schema1
+// manifests, configuration.Schema1Reject or configuration.Schema1Convert, to
+// the schema1 manifests fetched from upstream. The cache, which does not
+// store schema1 manifests, refuses them as unsupported otherwise.
+func WithSchema1Policy(policy string) RegistryOption {
+	return func(pr *proxyingRegistry) {
+		pr.schema1Policy = policy
+		if policy == configuration.Schema1Convert {
+			pr.conversions, _ = arc.NewARC[string, digest.Digest](schema1ConversionsSize)
+		}
+	}
+}
+
+// schema1Policy applies the schema1 policy of the registry to the schema1
+// manifests fetched from the remote for a repository.
+type schema1Policy struct {
+	policy string
+	// conversions maps the schema1 manifests converted, by repository and
+	// digest, to the digests of the schema2 manifests cached in their place.
+	// It is shared by the repositories.
+	conversions *arc.ARCCache[string, digest.Digest]
+	// layers provides the layers of the manifests converted.
+	layers distribution.BlobProvider
+	// configs stores the image configurations of the manifests converted.
+	configs distribution.BlobIngester
+}
+
+// apply returns the schema2 manifest to cache in place of a schema1 manifest
+// fetched from the remote, with its digest, or the error refusing it. The
+// image configuration of the schema2 manifest, which the remote does not
+// have, is stored along the blobs cached but does not expire with them: the
+// garbage collection removes it once the manifest has expired.
+func (p schema1Policy) apply(ctx context.Context, name reference.Named, dgst digest.Digest, m *schema1.DeserializedManifest) (distribution.Manifest, digest.Digest, error) {
+	mediaType, _, _ := m.Payload()
+	switch p.policy {
+	case configuration.Schema1Reject:
+		return nil, "", distribution.ErrManifestVerification{schema1.RejectedError{MediaType: mediaType}}
+	case configuration.Schema1Convert:
+	default:
+		return nil, "", fmt.Errorf("unsupported manifest media type %s", mediaType)
+	}
+
+	converted, config, err := schema1.Convert(ctx, m, p.layers)
+	if err != nil {
+		return nil, "", err
+	}
+	if _, err := p.configs.Put(ctx, schema2.MediaTypeImageConfig, config); err != nil {
+		return nil, "", err
+	}
+	_, payload, err := converted.Payload()
+	if err != nil {
+		return nil, "", err
+	}
+	convertedDigest := digest.FromBytes(payload)
+	dcontext.GetLogger(ctx).Infof("Converted schema1 manifest %s of %s to schema2 manifest %s", dgst, name.Name(), convertedDigest)
+	return converted, convertedDigest, nil
+}
+
+// recordConversion records that the schema2 manifest converted is cached in
+// place of the schema1 manifest.
+func (p schema1Policy) recordConversion(name reference.Named, dgst, converted digest.Digest) {
+	if p.conversions != nil {
+		p.conversions.Add(name.Name()+"@"+dgst.String(), converted)
+	}
+}
+
+// convertedDigest returns the digest of the schema2 manifest cached in place
+// of the schema1 manifest, if it was converted.
+func (p schema1Policy) convertedDigest(name reference.Named, dgst digest.Digest) (digest.Digest, bool) {
+	if p.conversions == nil {
+		return "", false
+	}
+	return p.conversions.Get(name.Name() + "@" + dgst.String())
+}
+
+// cachedOrRemoteBlobs provides the blobs cached, or else the blobs of the
+// remote, without caching them.
+type cachedOrRemoteBlobs struct {
+	local  distribution.BlobProvider
+	remote distribution.BlobProvider
+}
+
+func (b cachedOrRemoteBlobs) Get(ctx context.Context, dgst digest.Digest) ([]byte, error) {
+	if p, err := b.local.Get(ctx, dgst); err == nil {
+		return p, nil
+	}
+	return b.remote.Get(ctx, dgst)
+}
+
+func (b cachedOrRemoteBlobs) Open(ctx context.Context, dgst digest.Digest) (io.ReadSeekCloser, error) {
+	if rc, err := b.local.Open(ctx, dgst); err == nil {
+		return rc, nil
+	}
+	return b.remote.Open(ctx, dgst)
+}
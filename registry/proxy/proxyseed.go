@@ -0,0 +1,296 @@
+package proxy
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"slices"
+	"sync"
+	"time"
+
+	"github.com/distribution/reference"
+	"github.com/docker/go-metrics"
+	"github.com/opencontainers/go-digest"
+	v1 "github.com/opencontainers/image-spec/specs-go/v1"
+	"gopkg.in/yaml.v2"
+
+	"github.com/distribution/distribution/v3"
+	"github.com/distribution/distribution/v3/configuration"
+	"github.com/distribution/distribution/v3/internal/dcontext"
+	"github.com/distribution/distribution/v3/manifest/schema2"
+	prometheus "github.com/distribution/distribution/v3/metrics"
+)
+
+const (
+	// seedConcurrency is the number of references of a seed file pulled
+	// at once.
+	seedConcurrency = 4
+
+	// seedAttempts is the number of times a reference is pulled before it
+	// is reported as failed.
+	seedAttempts = 3
+)
+
+// seedRetryDelay is the delay before the second attempt to pull a reference,
+// doubled for each further attempt.
+var seedRetryDelay = 5 * time.Second
+
+// The statuses of the references of a seed file.
+const (
+	seedPending  = "pending"
+	seedFetched  = "fetched"
+	seedSkipped  = "skipped"
+	seedFiltered = "filtered"
+	seedFailed   = "failed"
+)
+
+var seedStatuses = []string{seedPending, seedFetched, seedSkipped, seedFiltered, seedFailed}
+
+// seedReferences is the number of references of the last seed, by status
+var seedReferences = prometheus.ProxyNamespace.NewLabeledGauge("seed", "The number of references of the seed of the cache, by status", metrics.Unit("references"), "status")
+
+func init() {
+	for _, status := range seedStatuses {
+		seedReferences.WithValues(status).Set(0)
+	}
+}
+
+// SeedSummary counts the references of a seed by outcome: fetched from the
+// remote, skipped as already cached, filtered out by the tag filter of their
+// remote, or failed.
+type SeedSummary struct {
+	Fetched  int
+	Skipped  int
+	Filtered int
+	Failed   int
+}
+
+// ReadSeedFile reads the image references of a seed file, a YAML or JSON list
+// of references such as "library/alpine:3.20", named as pulled through the
+// cache. A reference without a tag nor a digest is of the latest tag.
+func ReadSeedFile(file string) ([]reference.Named, error) {
+	content, err := os.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+	var entries []string
+	if err := yaml.UnmarshalStrict(content, &entries); err != nil {
+		return nil, fmt.Errorf("error parsing %s: %v", file, err)
+	}
+	refs := make([]reference.Named, 0, len(entries))
+	for _, entry := range entries {
+		ref, err := reference.Parse(entry)
+		if err != nil {
+			return nil, fmt.Errorf("invalid seed reference %q: %v", entry, err)
+		}
+		named, ok := ref.(reference.Named)
+		if !ok {
+			return nil, fmt.Errorf("seed reference %q has no repository name", entry)
+		}
+		refs = append(refs, reference.TagNameOnly(named))
+	}
+	return refs, nil
+}
+
+// IncludesPlatform reports whether the images of the platform are among the
+// platforms, every platform being included if there are none. The images
+// without a platform are included.
+func IncludesPlatform(platforms []configuration.Platform, platform *v1.Platform) bool {
+	if len(platforms) == 0 || platform == nil {
+		return true
+	}
+	return slices.ContainsFunc(platforms, func(p configuration.Platform) bool {
+		return (p.Architecture == "" || p.Architecture == platform.Architecture) && (p.OS == "" || p.OS == platform.OS)
+	})
+}
+
+// Seed pulls the references through the cache, their manifests and the blobs
+// they reference, as a client would. The references whose manifest is cached
+// already under the digest the remote resolves them to are skipped, the tags
+// filtered out by their remote are not pulled, and the others are attempted
+// up to seedAttempts times. The progress is reported by the seed gauge, and a
+// summary is logged once done.
+func (pr *proxyingRegistry) Seed(ctx context.Context, refs []reference.Named) SeedSummary {
+	var summary SeedSummary
+	if pr.streamThrough {
+		dcontext.GetLogger(ctx).Warnf("Not seeding the proxy cache in the %s mode, which caches nothing", configuration.ProxyModeStreamThrough)
+		return summary
+	}
+
+	start := time.Now()
+	for _, status := range seedStatuses {
+		seedReferences.WithValues(status).Set(0)
+	}
+	seedReferences.WithValues(seedPending).Set(float64(len(refs)))
+
+	var mu sync.Mutex
+	items := make(chan reference.Named)
+	var wg sync.WaitGroup
+	for range min(seedConcurrency, max(len(refs), 1)) {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for ref := range items {
+				status := pr.seedReference(ctx, ref)
+
+				mu.Lock()
+				switch status {
+				case seedFetched:
+					summary.Fetched++
+				case seedSkipped:
+					summary.Skipped++
+				case seedFiltered:
+					summary.Filtered++
+				default:
+					summary.Failed++
+				}
+				mu.Unlock()
+				seedReferences.WithValues(seedPending).Dec(1)
+				seedReferences.WithValues(status).Inc(1)
+			}
+		}()
+	}
+	for _, ref := range refs {
+		select {
+		case items <- ref:
+		case <-ctx.Done():
+		}
+	}
+	close(items)
+	wg.Wait()
+
+	dcontext.GetLogger(ctx).Infof("Seeded the proxy cache with %d references in %s: %d fetched, %d skipped, %d filtered, %d failed",
+		len(refs), time.Since(start).Round(time.Millisecond), summary.Fetched, summary.Skipped, summary.Filtered, summary.Failed)
+	return summary
+}
+
+// seedReference pulls the reference, retrying on failure, and returns its
+// status.
+func (pr *proxyingRegistry) seedReference(ctx context.Context, ref reference.Named) string {
+	var status string
+	err := retrySeed(ctx, "seeding the proxy cache with "+ref.String(), func() (err error) {
+		status, _, err = pr.pullReference(ctx, ref, pr.seedPlatforms)
+		return err
+	})
+	if err != nil {
+		dcontext.GetLogger(ctx).Errorf("Error seeding the proxy cache with %s: %v", ref, err)
+		return seedFailed
+	}
+	return status
+}
+
+// retrySeed calls fn until it succeeds, up to seedAttempts times, waiting
+// seedRetryDelay before the second attempt and twice as long before each
+// further one. It returns the error of the last attempt.
+func retrySeed(ctx context.Context, what string, fn func() error) error {
+	delay := seedRetryDelay
+	for attempt := 1; ; attempt++ {
+		err := fn()
+		if err == nil || attempt == seedAttempts || ctx.Err() != nil {
+			return err
+		}
+		dcontext.GetLogger(ctx).Warnf("Error %s, retrying in %s: %v", what, delay, err)
+		select {
+		case <-time.After(delay):
+		case <-ctx.Done():
+		}
+		delay *= 2
+	}
+}
+
+// pullReference pulls the manifest of the reference and the content it
+// references through the cache, with the images of the platforms of its
+// indexes, unless the manifest is cached already under the digest the
+// reference resolves to. It returns the status of the reference and this
+// digest.
+func (pr *proxyingRegistry) pullReference(ctx context.Context, ref reference.Named, platforms []configuration.Platform) (string, digest.Digest, error) {
+	if err := ctx.Err(); err != nil {
+		return "", "", err
+	}
+	remote, err := pr.remoteFor(ref)
+	if err != nil {
+		return "", "", err
+	}
+	name := reference.TrimNamed(ref)
+	repo, err := pr.Repository(ctx, name)
+	if err != nil {
+		return "", "", err
+	}
+	localRepo, err := pr.embedded.Repository(ctx, name)
+	if err != nil {
+		return "", "", err
+	}
+	localManifests, err := localRepo.Manifests(ctx)
+	if err != nil {
+		return "", "", err
+	}
+
+	var dgst, cached digest.Digest
+	if digested, ok := ref.(reference.Digested); ok {
+		dgst = digested.Digest()
+		cached = dgst
+	} else {
+		tagged, ok := ref.(reference.Tagged)
+		if !ok {
+			return "", "", fmt.Errorf("reference %s has no tag nor digest", ref)
+		}
+		tag := tagged.Tag()
+		if !remote.tagFilter.allows(tag) {
+			return seedFiltered, "", nil
+		}
+		if desc, err := localRepo.Tags(ctx).Get(ctx, tag); err == nil {
+			cached = desc.Digest
+		}
+		desc, err := repo.Tags(ctx).Get(ctx, tag)
+		if err != nil {
+			return "", "", err
+		}
+		dgst = desc.Digest
+	}
+	if dgst == cached {
+		if exists, err := localManifests.Exists(ctx, dgst); err == nil && exists {
+			return seedSkipped, dgst, nil
+		}
+	}
+
+	if err := pr.pullManifest(ctx, repo, dgst, platforms); err != nil {
+		return "", dgst, err
+	}
+	return seedFetched, dgst, nil
+}
+
+// pullManifest pulls the manifest through the cache, with the manifests of
+// the platforms it references and the blobs it references.
+func (pr *proxyingRegistry) pullManifest(ctx context.Context, repo distribution.Repository, dgst digest.Digest, platforms []configuration.Platform) error {
+	manifests, err := repo.Manifests(ctx)
+	if err != nil {
+		return err
+	}
+	m, err := manifests.Get(ctx, dgst)
+	if err != nil {
+		return fmt.Errorf("manifest %s: %w", dgst, err)
+	}
+	blobs, ok := repo.Blobs(ctx).(*proxyBlobStore)
+	if !ok {
+		return errors.New("the repository does not cache blobs")
+	}
+	manifestTypes := distribution.ManifestMediaTypes()
+	for _, desc := range m.References() {
+		switch {
+		case slices.Contains(manifestTypes, desc.MediaType):
+			if IncludesPlatform(platforms, desc.Platform) {
+				if err := pr.pullManifest(ctx, repo, desc.Digest, platforms); err != nil {
+					return err
+				}
+			}
+		case desc.MediaType == schema2.MediaTypeForeignLayer, len(desc.URLs) > 0:
+			// The non-distributable layers are pulled from their urls.
+		default:
+			if _, err := blobs.fetchToCache(ctx, desc); err != nil {
+				return fmt.Errorf("blob %s: %w", desc.Digest, err)
+			}
+		}
+	}
+	return nil
+}
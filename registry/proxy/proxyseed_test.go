@@ -0,0 +1,404 @@
+package proxy
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/distribution/reference"
+	"github.com/opencontainers/go-digest"
+	v1 "github.com/opencontainers/image-spec/specs-go/v1"
+
+	"github.com/distribution/distribution/v3"
+	"github.com/distribution/distribution/v3/configuration"
+	"github.com/distribution/distribution/v3/manifest/ocischema"
+	"github.com/distribution/distribution/v3/registry/storage"
+	"github.com/distribution/distribution/v3/registry/storage/driver/inmemory"
+)
+
+// seedUpstream serves the manifests and blobs of a registry like a remote
+// registry, counting the manifest requests and failing those of the
+// repositories set to fail.
+type seedUpstream struct {
+	*httptest.Server
+	t        *testing.T
+	registry distribution.Namespace
+
+	mu sync.Mutex
+	// manifestGets counts the GET requests of manifests by repository.
+	manifestGets map[string]int
+	// failures is the number of requests of a repository failed before
+	// they are served, -1 to fail them all.
+	failures map[string]int
+	// fail, if set, fails the requests it returns true for.
+	fail func(r *http.Request) bool
+}
+
+func newSeedUpstream(t *testing.T) *seedUpstream {
+	t.Helper()
+	registry, err := storage.NewRegistry(context.Background(), inmemory.New())
+	if err != nil {
+		t.Fatal(err)
+	}
+	u := &seedUpstream{t: t, registry: registry, manifestGets: make(map[string]int), failures: make(map[string]int)}
+	u.Server = httptest.NewServer(http.HandlerFunc(u.serve))
+	t.Cleanup(u.Close)
+	return u
+}
+
+func (u *seedUpstream) serve(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	if r.URL.Path == "/v2/" {
+		return
+	}
+	name, ref, ok := strings.Cut(strings.TrimPrefix(r.URL.Path, "/v2/"), "/manifests/")
+	isManifest := ok
+	if !ok {
+		name, ref, ok = strings.Cut(strings.TrimPrefix(r.URL.Path, "/v2/"), "/blobs/")
+	}
+	isTags := false
+	if !ok {
+		name, ok = strings.CutSuffix(strings.TrimPrefix(r.URL.Path, "/v2/"), "/tags/list")
+		isTags = ok
+	}
+	named, err := reference.WithName(name)
+	if !ok || err != nil {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+
+	u.mu.Lock()
+	if isManifest && r.Method == http.MethodGet {
+		u.manifestGets[name]++
+	}
+	failures := u.failures[name]
+	if failures > 0 {
+		u.failures[name]--
+	}
+	fail := u.fail
+	u.mu.Unlock()
+	if failures != 0 || (fail != nil && fail(r)) {
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	repo, err := u.registry.Repository(ctx, named)
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	if isTags {
+		u.serveTags(w, r, repo)
+		return
+	}
+	if !isManifest {
+		if err := repo.Blobs(ctx).ServeBlob(ctx, w, r, digest.Digest(ref)); err != nil {
+			w.WriteHeader(http.StatusNotFound)
+		}
+		return
+	}
+
+	dgst, err := digest.Parse(ref)
+	if err != nil {
+		desc, err := repo.Tags(ctx).Get(ctx, ref)
+		if err != nil {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		dgst = desc.Digest
+	}
+	manifests, err := repo.Manifests(ctx)
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	m, err := manifests.Get(ctx, dgst)
+	if err != nil {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+	mediaType, payload, _ := m.Payload()
+	w.Header().Set("Content-Type", mediaType)
+	w.Header().Set("Docker-Content-Digest", dgst.String())
+	w.Header().Set("Content-Length", strconv.Itoa(len(payload)))
+	if r.Method == http.MethodGet {
+		w.Write(payload)
+	}
+}
+
+// serveTags serves a page of the tags of the repository, of at most n tags
+// after last, with a link to the next page.
+func (u *seedUpstream) serveTags(w http.ResponseWriter, r *http.Request, repo distribution.Repository) {
+	n := 50
+	if limit := r.URL.Query().Get("n"); limit != "" {
+		n, _ = strconv.Atoi(limit)
+	}
+	last := r.URL.Query().Get("last")
+	tags, err := repo.Tags(r.Context()).List(r.Context(), n, last)
+	if err != nil && !errors.Is(err, io.EOF) {
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	if err == nil && len(tags) > 0 {
+		w.Header().Set("Link", fmt.Sprintf(`</v2/%s/tags/list?n=%d&last=%s>; rel="next"`, repo.Named().Name(), n, tags[len(tags)-1]))
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]any{"name": repo.Named().Name(), "tags": tags})
+}
+
+func (u *seedUpstream) repository(name string) distribution.Repository {
+	u.t.Helper()
+	ctx := context.Background()
+	named, err := reference.WithName(name)
+	if err != nil {
+		u.t.Fatal(err)
+	}
+	repo, err := u.registry.Repository(ctx, named)
+	if err != nil {
+		u.t.Fatal(err)
+	}
+	if _, err := repo.Blobs(ctx).Put(ctx, v1.MediaTypeEmptyJSON, v1.DescriptorEmptyJSON.Data); err != nil {
+		u.t.Fatal(err)
+	}
+	return repo
+}
+
+// push pushes an image with a layer of the content, tagged if tag is set,
+// and returns its descriptor with the platform.
+func (u *seedUpstream) push(name, tag, content string, platform *v1.Platform) v1.Descriptor {
+	u.t.Helper()
+	repo := u.repository(name)
+	desc, _ := pushImage(u.t, repo, content)
+	u.tag(repo, tag, desc)
+	desc.Platform = platform
+	return desc
+}
+
+// pushIndex pushes an index of the images, tagged.
+func (u *seedUpstream) pushIndex(name, tag string, images ...v1.Descriptor) v1.Descriptor {
+	u.t.Helper()
+	ctx := context.Background()
+	repo := u.repository(name)
+	m, err := ocischema.FromDescriptors(images, nil)
+	if err != nil {
+		u.t.Fatal(err)
+	}
+	manifests, err := repo.Manifests(ctx)
+	if err != nil {
+		u.t.Fatal(err)
+	}
+	dgst, err := manifests.Put(ctx, m)
+	if err != nil {
+		u.t.Fatal(err)
+	}
+	_, payload, _ := m.Payload()
+	desc := v1.Descriptor{MediaType: v1.MediaTypeImageIndex, Digest: dgst, Size: int64(len(payload))}
+	u.tag(repo, tag, desc)
+	return desc
+}
+
+func (u *seedUpstream) tag(repo distribution.Repository, tag string, desc v1.Descriptor) {
+	u.t.Helper()
+	if tag == "" {
+		return
+	}
+	if err := repo.Tags(context.Background()).Tag(context.Background(), tag, desc); err != nil {
+		u.t.Fatal(err)
+	}
+}
+
+func (u *seedUpstream) gets(name string) int {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	return u.manifestGets[name]
+}
+
+// newSeededCache returns a pull through cache of the upstream, and the local
+// registry it caches into.
+func newSeededCache(t *testing.T, config configuration.Proxy) (*proxyingRegistry, distribution.Namespace) {
+	t.Helper()
+	ctx := context.Background()
+	d := inmemory.New()
+	localRegistry, err := storage.NewRegistry(ctx, d)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ns, err := NewRegistryPullThroughCache(ctx, localRegistry, d, config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pr := ns.(*proxyingRegistry)
+	t.Cleanup(func() { pr.Close() })
+	return pr, localRegistry
+}
+
+func parseSeedReferences(t *testing.T, refs ...string) []reference.Named {
+	t.Helper()
+	var named []reference.Named
+	for _, ref := range refs {
+		n, err := reference.Parse(ref)
+		if err != nil {
+			t.Fatal(err)
+		}
+		named = append(named, n.(reference.Named))
+	}
+	return named
+}
+
+// cachedBlob reports whether the local registry holds the blob.
+func cachedBlob(t *testing.T, registry distribution.Namespace, dgst digest.Digest) bool {
+	t.Helper()
+	_, err := registry.BlobStatter().Stat(context.Background(), dgst)
+	return err == nil
+}
+
+func TestSeed(t *testing.T) {
+	ctx := context.Background()
+	u := newSeedUpstream(t)
+	u.push("library/alpine", "3.20", "alpine", nil)
+	busybox := u.push("library/busybox", "", "busybox", nil)
+	amd64 := u.push("library/multi", "", "amd64", &v1.Platform{Architecture: "amd64", OS: "linux"})
+	arm64 := u.push("library/multi", "", "arm64", &v1.Platform{Architecture: "arm64", OS: "linux"})
+	u.pushIndex("library/multi", "1", amd64, arm64)
+	u.push("library/alpine", "debug", "debug", nil)
+
+	pr, local := newSeededCache(t, configuration.Proxy{
+		RemoteURL:     u.URL,
+		TagFilter:     configuration.ProxyTagFilter{Deny: []string{"debug"}},
+		SeedPlatforms: []configuration.Platform{{Architecture: "amd64", OS: "linux"}},
+	})
+	refs := parseSeedReferences(t,
+		"library/alpine:3.20",
+		"library/busybox@"+busybox.Digest.String(),
+		"library/multi:1",
+		"library/alpine:debug",
+	)
+
+	summary := pr.Seed(ctx, refs)
+	if expected := (SeedSummary{Fetched: 3, Filtered: 1}); summary != expected {
+		t.Fatalf("expected %+v, got %+v", expected, summary)
+	}
+	layer := func(content string) digest.Digest { return digest.FromString(content) }
+	for _, content := range []string{"alpine", "busybox", "amd64"} {
+		if !cachedBlob(t, local, layer(content)) {
+			t.Fatalf("expected the layer of the %s image to be cached", content)
+		}
+	}
+	if cachedBlob(t, local, layer("arm64")) {
+		t.Fatal("expected the layer of the arm64 image not to be cached")
+	}
+	if cachedBlob(t, local, layer("debug")) {
+		t.Fatal("expected the layer of the tag filtered out not to be cached")
+	}
+
+	// The references cached under the digest the upstream resolves them to
+	// are skipped, without fetching their manifests.
+	gets := u.gets("library/alpine") + u.gets("library/busybox") + u.gets("library/multi")
+	summary = pr.Seed(ctx, refs)
+	if expected := (SeedSummary{Skipped: 3, Filtered: 1}); summary != expected {
+		t.Fatalf("expected %+v seeding again, got %+v", expected, summary)
+	}
+	if after := u.gets("library/alpine") + u.gets("library/busybox") + u.gets("library/multi"); after != gets {
+		t.Fatalf("expected no manifest fetched seeding again, got %d", after-gets)
+	}
+
+	// A tag moved upstream is fetched again.
+	u.push("library/alpine", "3.20", "alpine-updated", nil)
+	summary = pr.Seed(ctx, refs[:1])
+	if expected := (SeedSummary{Fetched: 1}); summary != expected {
+		t.Fatalf("expected %+v seeding a moved tag, got %+v", expected, summary)
+	}
+	if !cachedBlob(t, local, layer("alpine-updated")) {
+		t.Fatal("expected the layer of the moved tag to be cached")
+	}
+}
+
+func TestSeedPartialFailure(t *testing.T) {
+	defer func(delay time.Duration) { seedRetryDelay = delay }(seedRetryDelay)
+	seedRetryDelay = time.Millisecond
+
+	ctx := context.Background()
+	u := newSeedUpstream(t)
+	u.push("library/alpine", "3.20", "alpine", nil)
+	u.push("library/flaky", "1", "flaky", nil)
+	u.push("library/broken", "1", "broken", nil)
+	// The flaky repository fails the first two attempts, and the broken
+	// one every attempt.
+	u.failures["library/flaky"] = 2
+	u.failures["library/broken"] = -1
+
+	pr, local := newSeededCache(t, configuration.Proxy{RemoteURL: u.URL})
+	summary := pr.Seed(ctx, parseSeedReferences(t,
+		"library/alpine:3.20",
+		"library/flaky:1",
+		"library/broken:1",
+		"library/missing:1",
+	))
+	if expected := (SeedSummary{Fetched: 2, Failed: 2}); summary != expected {
+		t.Fatalf("expected %+v, got %+v", expected, summary)
+	}
+	for content, cached := range map[string]bool{"alpine": true, "flaky": true, "broken": false} {
+		if cachedBlob(t, local, digest.FromString(content)) != cached {
+			t.Fatalf("expected the layer of the %s image cached to be %t", content, cached)
+		}
+	}
+}
+
+func TestReadSeedFile(t *testing.T) {
+	dir := t.TempDir()
+	for _, tc := range []struct {
+		name     string
+		content  string
+		expected []string
+		err      string
+	}{
+		{
+			name:     "yaml",
+			content:  "- library/alpine:3.20\n- library/busybox\n- library/debian@sha256:" + strings.Repeat("a", 64) + "\n",
+			expected: []string{"library/alpine:3.20", "library/busybox:latest", "library/debian@sha256:" + strings.Repeat("a", 64)},
+		},
+		{
+			name:     "json",
+			content:  `["library/alpine:3.20", "library/busybox"]`,
+			expected: []string{"library/alpine:3.20", "library/busybox:latest"},
+		},
+		{name: "invalid reference", content: `["library/Alpine"]`, err: "invalid seed reference"},
+		{name: "not a list", content: `images: [library/alpine]`, err: "error parsing"},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			file := filepath.Join(dir, tc.name)
+			if err := os.WriteFile(file, []byte(tc.content), 0o644); err != nil {
+				t.Fatal(err)
+			}
+			refs, err := ReadSeedFile(file)
+			if tc.err != "" {
+				if err == nil || !strings.Contains(err.Error(), tc.err) {
+					t.Fatalf("expected an error containing %q, got %v", tc.err, err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(refs) != len(tc.expected) {
+				t.Fatalf("expected %d references, got %v", len(tc.expected), refs)
+			}
+			for i, ref := range refs {
+				if ref.String() != tc.expected[i] {
+					t.Fatalf("expected %s, got %s", tc.expected[i], ref)
+				}
+			}
+		})
+	}
+}
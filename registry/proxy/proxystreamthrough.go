@@ -0,0 +1,243 @@
+package proxy
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"time"
+
+	"github.com/distribution/reference"
+	"github.com/opencontainers/go-digest"
+	v1 "github.com/opencontainers/image-spec/specs-go/v1"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/trace"
+
+	"github.com/distribution/distribution/v3"
+	"github.com/distribution/distribution/v3/configuration"
+	"github.com/distribution/distribution/v3/internal/dcontext"
+	"github.com/distribution/distribution/v3/manifest/schema1"
+	"github.com/distribution/distribution/v3/registry/accesslog"
+)
+
+// streamThroughManifestStore fetches the manifests from the remote for each
+// request, without caching them, in the stream through mode.
+type streamThroughManifestStore struct {
+	remoteManifests distribution.ManifestService
+	repositoryName  reference.Named
+	authChallenger  authChallenger
+	// maxSize is the maximum size of a manifest fetched from the remote,
+	// unlimited if zero.
+	maxSize int64
+	// verify, if set, verifies the signatures of the manifests fetched from
+	// the remote before they are served.
+	verify func(context.Context, digest.Digest, distribution.Manifest) error
+	// schema1 refuses the schema1 manifests fetched from the remote, with
+	// the error of the schema1 policy of the registry. They cannot be
+	// converted, which requires storing their image configuration.
+	schema1 schema1Policy
+}
+
+var _ distribution.ManifestService = streamThroughManifestStore{}
+
+func (sms streamThroughManifestStore) Exists(ctx context.Context, dgst digest.Digest) (bool, error) {
+	if err := sms.authChallenger.tryEstablishChallenges(ctx); err != nil {
+		return false, err
+	}
+	return sms.remoteManifests.Exists(ctx, dgst)
+}
+
+func (sms streamThroughManifestStore) Get(ctx context.Context, dgst digest.Digest, options ...distribution.ManifestServiceOption) (_ distribution.Manifest, err error) {
+	ctx, span := tracer.Start(ctx, "GetManifest", trace.WithAttributes(
+		attribute.String(attributeRepository, sms.repositoryName.Name()),
+		attribute.String(attributeDigest, dgst.String())))
+	defer func() {
+		if err != nil {
+			span.SetStatus(codes.Error, err.Error())
+		}
+		span.End()
+	}()
+
+	if err := sms.authChallenger.tryEstablishChallenges(ctx); err != nil {
+		return nil, err
+	}
+
+	start := time.Now()
+	manifest, err := sms.remoteManifests.Get(ctx, dgst, options...)
+	accesslog.GetRecord(ctx).AddUpstreamDuration(time.Since(start))
+	if err != nil {
+		return nil, err
+	}
+
+	_, payload, err := manifest.Payload()
+	if err != nil {
+		return nil, err
+	}
+	if sms.maxSize > 0 && int64(len(payload)) > sms.maxSize {
+		dcontext.GetLogger(ctx).Warnf("Refusing to serve manifest %s of %d bytes, over the maximum size of %d bytes", dgst, len(payload), sms.maxSize)
+		return nil, distribution.ErrManifestTooLarge{Limit: sms.maxSize}
+	}
+	if sms.verify != nil {
+		if err := sms.verify(ctx, dgst, manifest); err != nil {
+			dcontext.GetLogger(ctx).Warnf("Refusing to serve manifest %s: %v", dgst, err)
+			return nil, err
+		}
+	}
+	if m, ok := manifest.(*schema1.DeserializedManifest); ok {
+		_, _, err := sms.schema1.apply(ctx, sms.repositoryName, dgst, m)
+		return nil, err
+	}
+
+	span.SetAttributes(
+		attribute.Bool(attributeCacheHit, false),
+		attribute.Int(attributeSize, len(payload)))
+	proxyMetrics.ManifestPull(uint64(len(payload)))
+	proxyMetrics.ManifestPush(uint64(len(payload)), false)
+	accesslog.GetRecord(ctx).SetCache(false)
+	return manifest, nil
+}
+
+func (sms streamThroughManifestStore) Put(ctx context.Context, manifest distribution.Manifest, options ...distribution.ManifestServiceOption) (digest.Digest, error) {
+	return "", distribution.ErrUnsupported
+}
+
+func (sms streamThroughManifestStore) Delete(ctx context.Context, dgst digest.Digest) error {
+	return distribution.ErrUnsupported
+}
+
+// streamThroughBlobStore streams the blobs from the remote for each request,
+// without caching them, in the stream through mode.
+type streamThroughBlobStore struct {
+	// remote serves the blobs of the remote store without caching them,
+	// its local store being unset.
+	remote *proxyBlobStore
+}
+
+var _ distribution.BlobStore = streamThroughBlobStore{}
+
+func (sbs streamThroughBlobStore) Stat(ctx context.Context, dgst digest.Digest) (v1.Descriptor, error) {
+	if err := sbs.remote.authChallenger.tryEstablishChallenges(ctx); err != nil {
+		return v1.Descriptor{}, err
+	}
+	return sbs.remote.remoteStore.Stat(ctx, dgst)
+}
+
+func (sbs streamThroughBlobStore) Get(ctx context.Context, dgst digest.Digest) ([]byte, error) {
+	if err := sbs.remote.authChallenger.tryEstablishChallenges(ctx); err != nil {
+		return nil, err
+	}
+	return sbs.remote.remoteStore.Get(ctx, dgst)
+}
+
+// ServeBlob streams the blob from the remote, forwarding the range requests.
+// The HEAD requests are answered from the descriptor of the remote blob.
+func (sbs streamThroughBlobStore) ServeBlob(ctx context.Context, w http.ResponseWriter, r *http.Request, dgst digest.Digest) (err error) {
+	ctx, span := tracer.Start(ctx, "ServeBlob", trace.WithAttributes(
+		attribute.String(attributeRepository, sbs.remote.repositoryName.Name()),
+		attribute.String(attributeDigest, dgst.String()),
+		attribute.Bool(attributeCacheHit, false)))
+	defer func() {
+		if err != nil {
+			span.SetStatus(codes.Error, err.Error())
+		}
+		span.End()
+	}()
+	record := accesslog.GetRecord(ctx)
+	record.SetCache(false)
+
+	start := time.Now()
+	defer func() { record.AddUpstreamDuration(time.Since(start)) }()
+	desc, err := sbs.Stat(ctx, dgst)
+	if err != nil {
+		return err
+	}
+	if r.Method == http.MethodHead {
+		setResponseHeaders(w.Header(), desc.Size, desc.MediaType, desc.Digest)
+		return nil
+	}
+	return sbs.remote.serveUncached(ctx, desc, w, r)
+}
+
+func (sbs streamThroughBlobStore) Open(ctx context.Context, dgst digest.Digest) (io.ReadSeekCloser, error) {
+	return nil, distribution.ErrUnsupported
+}
+
+func (sbs streamThroughBlobStore) Put(ctx context.Context, mediaType string, p []byte) (v1.Descriptor, error) {
+	return v1.Descriptor{}, distribution.ErrUnsupported
+}
+
+func (sbs streamThroughBlobStore) Create(ctx context.Context, options ...distribution.BlobCreateOption) (distribution.BlobWriter, error) {
+	return nil, distribution.ErrUnsupported
+}
+
+func (sbs streamThroughBlobStore) Resume(ctx context.Context, id string) (distribution.BlobWriter, error) {
+	return nil, distribution.ErrUnsupported
+}
+
+func (sbs streamThroughBlobStore) Delete(ctx context.Context, dgst digest.Digest) error {
+	return distribution.ErrUnsupported
+}
+
+// streamThroughTagService gets the tags from the remote for each request,
+// without caching them, in the stream through mode.
+type streamThroughTagService struct {
+	remoteTags     distribution.TagService
+	authChallenger authChallenger
+	// tagFilter restricts the tags pulled from the remote. The tags
+	// filtered out are unknown, since none is cached anyway.
+	tagFilter *tagFilter
+}
+
+var _ distribution.TagService = streamThroughTagService{}
+
+func (sts streamThroughTagService) Get(ctx context.Context, tag string) (v1.Descriptor, error) {
+	if !sts.tagFilter.allows(tag) && !sts.tagFilter.passthrough {
+		return v1.Descriptor{}, distribution.ErrTagUnknown{Tag: tag}
+	}
+	// As in the caching mode with nothing cached, the tag is unknown if it
+	// cannot be got from the remote.
+	if err := sts.authChallenger.tryEstablishChallenges(ctx); err != nil {
+		dcontext.GetLogger(ctx).Debugf("Error getting tag %s from the remote: %v", tag, err)
+		return v1.Descriptor{}, distribution.ErrTagUnknown{Tag: tag}
+	}
+	start := time.Now()
+	desc, err := sts.remoteTags.Get(ctx, tag)
+	accesslog.GetRecord(ctx).AddUpstreamDuration(time.Since(start))
+	if err != nil {
+		dcontext.GetLogger(ctx).Debugf("Error getting tag %s from the remote: %v", tag, err)
+		return v1.Descriptor{}, distribution.ErrTagUnknown{Tag: tag}
+	}
+	return desc, nil
+}
+
+func (sts streamThroughTagService) All(ctx context.Context) ([]string, error) {
+	if err := sts.authChallenger.tryEstablishChallenges(ctx); err != nil {
+		return nil, err
+	}
+	return sts.remoteTags.All(ctx)
+}
+
+func (sts streamThroughTagService) Tag(ctx context.Context, tag string, desc v1.Descriptor) error {
+	return distribution.ErrUnsupported
+}
+
+func (sts streamThroughTagService) Untag(ctx context.Context, tag string) error {
+	return distribution.ErrUnsupported
+}
+
+func (sts streamThroughTagService) Lookup(ctx context.Context, digest v1.Descriptor) ([]string, error) {
+	return []string{}, distribution.ErrUnsupported
+}
+
+func (sts streamThroughTagService) List(ctx context.Context, limit int, last string) ([]string, error) {
+	return []string{}, distribution.ErrUnsupported
+}
+
+// streamThroughSchema1Policy returns the schema1 policy of the stream through
+// mode, which refuses the schema1 manifests it would convert.
+func streamThroughSchema1Policy(policy string) schema1Policy {
+	if policy == configuration.Schema1Convert {
+		policy = ""
+	}
+	return schema1Policy{policy: policy}
+}
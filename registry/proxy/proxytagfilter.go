@@ -0,0 +1,67 @@
+package proxy
+
+import (
+	"fmt"
+	"regexp"
+
+	"github.com/distribution/distribution/v3/configuration"
+)
+
+// tagFilter restricts the tags pulled through a remote. A nil filter allows
+// every tag.
+type tagFilter struct {
+	allow []*regexp.Regexp
+	deny  []*regexp.Regexp
+	// passthrough serves the tags filtered out without caching them.
+	passthrough bool
+}
+
+// newTagFilter compiles the patterns of the configuration, anchored to match
+// the whole tag. It returns nil if there is no pattern.
+func newTagFilter(config configuration.ProxyTagFilter) (*tagFilter, error) {
+	if len(config.Allow) == 0 && len(config.Deny) == 0 {
+		return nil, nil
+	}
+	compile := func(patterns []string) ([]*regexp.Regexp, error) {
+		var compiled []*regexp.Regexp
+		for _, pattern := range patterns {
+			re, err := regexp.Compile("^(?:" + pattern + ")$")
+			if err != nil {
+				return nil, fmt.Errorf("invalid proxy tagfilter pattern %q: %v", pattern, err)
+			}
+			compiled = append(compiled, re)
+		}
+		return compiled, nil
+	}
+	allow, err := compile(config.Allow)
+	if err != nil {
+		return nil, err
+	}
+	deny, err := compile(config.Deny)
+	if err != nil {
+		return nil, err
+	}
+	return &tagFilter{allow: allow, deny: deny, passthrough: config.Passthrough}, nil
+}
+
+// allows returns whether the tag matches an allow pattern, if any, and no
+// deny pattern.
+func (f *tagFilter) allows(tag string) bool {
+	if f == nil {
+		return true
+	}
+	for _, re := range f.deny {
+		if re.MatchString(tag) {
+			return false
+		}
+	}
+	if len(f.allow) == 0 {
+		return true
+	}
+	for _, re := range f.allow {
+		if re.MatchString(tag) {
+			return true
+		}
+	}
+	return false
+}
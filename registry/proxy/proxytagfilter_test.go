@@ -0,0 +1,123 @@
+package proxy
+
+import (
+	"context"
+	"testing"
+
+	"github.com/distribution/distribution/v3"
+	"github.com/distribution/distribution/v3/configuration"
+	v1 "github.com/opencontainers/image-spec/specs-go/v1"
+)
+
+func TestTagFilter(t *testing.T) {
+	semver := `v?\d+\.\d+\.\d+`
+	for _, tc := range []struct {
+		name    string
+		config  configuration.ProxyTagFilter
+		allowed map[string]bool
+	}{
+		{
+			name:    "allow only",
+			config:  configuration.ProxyTagFilter{Allow: []string{semver}},
+			allowed: map[string]bool{"v1.2.3": true, "1.2.3": true, "v1.2.3-rc1": false, "latest": false, "main": false},
+		},
+		{
+			name:    "deny only",
+			config:  configuration.ProxyTagFilter{Deny: []string{"latest", "main|dev-.*"}},
+			allowed: map[string]bool{"v1.2.3": true, "latest": false, "latest-1": true, "main": false, "dev-feature": false},
+		},
+		{
+			name:    "allow and deny",
+			config:  configuration.ProxyTagFilter{Allow: []string{semver + `(-rc\d+)?`}, Deny: []string{`.*-rc\d+`}},
+			allowed: map[string]bool{"v1.2.3": true, "v1.2.3-rc1": false, "latest": false},
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			filter, err := newTagFilter(tc.config)
+			if err != nil {
+				t.Fatal(err)
+			}
+			for tag, allowed := range tc.allowed {
+				if filter.allows(tag) != allowed {
+					t.Errorf("expected tag %q allowed %t", tag, allowed)
+				}
+			}
+		})
+	}
+
+	if filter, err := newTagFilter(configuration.ProxyTagFilter{Passthrough: true}); err != nil || filter != nil || !filter.allows("latest") {
+		t.Fatalf("expected no filter without pattern, got %v: %v", filter, err)
+	}
+	if _, err := newTagFilter(configuration.ProxyTagFilter{Deny: []string{"latest("}}); err == nil {
+		t.Fatal("expected an error with an invalid pattern")
+	}
+}
+
+func TestProxyTagFilter(t *testing.T) {
+	ctx := context.Background()
+	for _, tc := range []struct {
+		name        string
+		config      configuration.ProxyTagFilter
+		passthrough bool
+	}{
+		{name: "allow only", config: configuration.ProxyTagFilter{Allow: []string{`v\d+\.\d+\.\d+`}}},
+		{name: "deny only", config: configuration.ProxyTagFilter{Deny: []string{"latest"}}},
+		{name: "passthrough", config: configuration.ProxyTagFilter{Allow: []string{`v\d+\.\d+\.\d+`}, Passthrough: true}, passthrough: true},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			filter, err := newTagFilter(tc.config)
+			if err != nil {
+				t.Fatal(err)
+			}
+			env := newManifestStoreTestEnv(t, "foo/bar", "latest")
+			env.manifests.tagFilter = filter
+			var prefetched int
+			env.manifests.prefetch = func(context.Context, distribution.Manifest) { prefetched++ }
+			localStats := env.LocalStats()
+
+			desc := v1.Descriptor{MediaType: "application/vnd.docker.distribution.manifest.v2+json", Digest: env.manifestDigest}
+			tags := testProxyTagService(nil, map[string]v1.Descriptor{"v1.2.3": desc, "latest": desc})
+			tags.tagFilter = filter
+
+			// The tag filtered out is not pulled, or only passed through
+			// without being cached.
+			got, err := tags.Get(ctx, "latest")
+			if !tc.passthrough {
+				if _, ok := err.(distribution.ErrTagUnknown); !ok {
+					t.Fatalf("expected ErrTagUnknown for a tag filtered out, got %v", err)
+				}
+				if count := tags.authChallenger.(*mockChallenger).count; count != 0 {
+					t.Fatalf("expected no request to the remote, got %d auth challenges", count)
+				}
+			} else {
+				if err != nil || got.Digest != desc.Digest {
+					t.Fatalf("unexpected tag passed through %v: %v", got, err)
+				}
+				if _, err := env.manifests.Get(ctx, env.manifestDigest, distribution.WithTag("latest")); err != nil {
+					t.Fatal(err)
+				}
+				if (*localStats)["put"] != 0 || prefetched != 0 {
+					t.Fatalf("manifest passed through was cached with %d puts and %d prefetches", (*localStats)["put"], prefetched)
+				}
+			}
+			if _, err := tags.localTags.Get(ctx, "latest"); err == nil {
+				t.Fatal("tag filtered out was cached")
+			}
+
+			// The tag allowed is cached, as are the manifests pulled by
+			// digest.
+			if _, err := tags.Get(ctx, "v1.2.3"); err != nil {
+				t.Fatal(err)
+			}
+			if _, err := tags.localTags.Get(ctx, "v1.2.3"); err != nil {
+				t.Fatal("tag allowed was not cached")
+			}
+			if _, err := env.manifests.Get(ctx, env.manifestDigest); err != nil {
+				t.Fatal(err)
+			}
+			if (*localStats)["put"] != 1 || prefetched != 1 {
+				t.Fatalf("manifest pulled by digest was not cached, with %d puts and %d prefetches", (*localStats)["put"], prefetched)
+			}
+		})
+	}
+}
@@ -2,8 +2,12 @@ package proxy
 
 import (
 	"context"
+	"errors"
+	"time"
 
 	"github.com/distribution/distribution/v3"
+	"github.com/distribution/distribution/v3/registry/accesslog"
+	"github.com/opencontainers/go-digest"
 	v1 "github.com/opencontainers/image-spec/specs-go/v1"
 )
 
@@ -12,33 +16,97 @@ type proxyTagService struct {
 	localTags      distribution.TagService
 	remoteTags     distribution.TagService
 	authChallenger authChallenger
+	// tagFilter restricts the tags pulled from the remote.
+	tagFilter *tagFilter
 }
 
 var _ distribution.TagService = proxyTagService{}
 
+// conditionalTagGetter is implemented by remote tag services which can get a
+// tag with a conditional request, returning ErrManifestNotModified if the tag
+// still references dgst.
+type conditionalTagGetter interface {
+	GetIfChanged(ctx context.Context, tag string, dgst digest.Digest) (v1.Descriptor, error)
+}
+
+// uncachedTagGetter is implemented by local tag services caching the tags,
+// which can get a tag from its current link.
+type uncachedTagGetter interface {
+	GetUncached(ctx context.Context, tag string) (v1.Descriptor, error)
+}
+
 // Get attempts to get the most recent digest for the tag by checking the remote
 // tag service first and then caching it locally.  If the remote is unavailable
-// the local association is returned
+// or reports that the local association is still current, the local
+// association is returned. The tags filtered out are unknown, unless passed
+// through from the remote without being cached. A tag not cached fails with
+// the UpstreamAuthError of a remote which could not be authenticated to.
 func (pt proxyTagService) Get(ctx context.Context, tag string) (v1.Descriptor, error) {
+	if !pt.tagFilter.allows(tag) {
+		if !pt.tagFilter.passthrough {
+			return v1.Descriptor{}, distribution.ErrTagUnknown{Tag: tag}
+		}
+		if err := pt.authChallenger.tryEstablishChallenges(ctx); err != nil {
+			return v1.Descriptor{}, err
+		}
+		return pt.remoteTags.Get(ctx, tag)
+	}
+
+	var remoteErr error
 	err := pt.authChallenger.tryEstablishChallenges(ctx)
 	if err == nil {
-		desc, err := pt.remoteTags.Get(ctx, tag)
-		if err == nil {
+		start := time.Now()
+		var desc v1.Descriptor
+		desc, remoteErr = pt.getRemote(ctx, tag)
+		accesslog.GetRecord(ctx).AddUpstreamDuration(time.Since(start))
+		if remoteErr == nil {
 			err := pt.localTags.Tag(ctx, tag, desc)
 			if err != nil {
 				return v1.Descriptor{}, err
 			}
 			return desc, nil
 		}
+		if remoteErr == distribution.ErrManifestNotModified {
+			return pt.getLocal(ctx, tag)
+		}
 	}
 
 	desc, err := pt.localTags.Get(ctx, tag)
 	if err != nil {
+		// A tag unknown locally is reported as unknown, unless the
+		// remote could not be authenticated to.
+		var authErr *UpstreamAuthError
+		if errors.As(remoteErr, &authErr) {
+			return v1.Descriptor{}, remoteErr
+		}
 		return v1.Descriptor{}, err
 	}
 	return desc, nil
 }
 
+// getRemote gets the tag from the remote tag service. A tag known locally is
+// revalidated with a conditional request, if the remote tag service makes them.
+func (pt proxyTagService) getRemote(ctx context.Context, tag string) (v1.Descriptor, error) {
+	getter, ok := pt.remoteTags.(conditionalTagGetter)
+	if !ok {
+		return pt.remoteTags.Get(ctx, tag)
+	}
+	local, err := pt.getLocal(ctx, tag)
+	if err != nil {
+		return pt.remoteTags.Get(ctx, tag)
+	}
+	return getter.GetIfChanged(ctx, tag, local.Digest)
+}
+
+// getLocal gets the tag revalidated against the remote from the local tag
+// service, bypassing the cache of the local tags.
+func (pt proxyTagService) getLocal(ctx context.Context, tag string) (v1.Descriptor, error) {
+	if getter, ok := pt.localTags.(uncachedTagGetter); ok {
+		return getter.GetUncached(ctx, tag)
+	}
+	return pt.localTags.Get(ctx, tag)
+}
+
 func (pt proxyTagService) Tag(ctx context.Context, tag string, desc v1.Descriptor) error {
 	return distribution.ErrUnsupported
 }
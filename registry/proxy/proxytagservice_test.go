@@ -8,6 +8,7 @@ import (
 	"testing"
 
 	"github.com/distribution/distribution/v3"
+	"github.com/opencontainers/go-digest"
 	v1 "github.com/opencontainers/image-spec/specs-go/v1"
 )
 
@@ -65,6 +66,23 @@ func (m *mockTagStore) Lookup(ctx context.Context, digest distribution.Descripto
 func (m *mockTagStore) List(ctx context.Context, limit int, last string) ([]string, error) {
 	panic("not implemented")
 }
+
+// mockConditionalTagStore is a mockTagStore which gets tags with conditional
+// requests, counting the tags which were not modified.
+type mockConditionalTagStore struct {
+	*mockTagStore
+	notModified int
+}
+
+func (m *mockConditionalTagStore) GetIfChanged(ctx context.Context, tag string, dgst digest.Digest) (v1.Descriptor, error) {
+	desc, err := m.Get(ctx, tag)
+	if err == nil && desc.Digest == dgst {
+		m.notModified++
+		return v1.Descriptor{}, distribution.ErrManifestNotModified
+	}
+	return desc, err
+}
+
 func testProxyTagService(local, remote map[string]distribution.Descriptor) *proxyTagService {
 	if local == nil {
 		local = make(map[string]v1.Descriptor)
@@ -183,3 +201,104 @@ func TestGet(t *testing.T) {
 		t.Fatalf("Expected 4 auth challenge calls, got %#v", proxyTags.authChallenger)
 	}
 }
+
+func TestGetRevalidate(t *testing.T) {
+	ctx := context.Background()
+	firstDesc := v1.Descriptor{Digest: digest.FromString("first"), Size: 42}
+	remote := &mockConditionalTagStore{mockTagStore: &mockTagStore{mapping: map[string]v1.Descriptor{"latest": firstDesc}}}
+	localTags := &mockTagStore{mapping: map[string]v1.Descriptor{}}
+	proxyTags := &proxyTagService{
+		localTags:      localTags,
+		remoteTags:     remote,
+		authChallenger: &mockChallenger{},
+	}
+
+	// The tag is not known locally, so it is fetched unconditionally.
+	d, err := proxyTags.Get(ctx, "latest")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(d, firstDesc) || remote.notModified != 0 {
+		t.Fatalf("unexpected tag %v, %d not modified", d, remote.notModified)
+	}
+
+	// The local association is revalidated.
+	d, err = proxyTags.Get(ctx, "latest")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(d, firstDesc) || remote.notModified != 1 {
+		t.Fatalf("unexpected tag %v, %d not modified", d, remote.notModified)
+	}
+
+	// A tag moved on the remote replaces the local association.
+	secondDesc := v1.Descriptor{Digest: digest.FromString("second"), Size: 43}
+	if err := remote.Tag(ctx, "latest", secondDesc); err != nil {
+		t.Fatal(err)
+	}
+	d, err = proxyTags.Get(ctx, "latest")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(d, secondDesc) || remote.notModified != 1 {
+		t.Fatalf("unexpected tag %v, %d not modified", d, remote.notModified)
+	}
+	if local, err := localTags.Get(ctx, "latest"); err != nil || !reflect.DeepEqual(local, secondDesc) {
+		t.Fatalf("unexpected local tag %v: %v", local, err)
+	}
+}
+
+// mockCachedTagStore is a mockTagStore whose Get resolves the tags from a
+// stale cache.
+type mockCachedTagStore struct {
+	*mockTagStore
+	cached map[string]v1.Descriptor
+}
+
+func (m *mockCachedTagStore) Get(ctx context.Context, tag string) (v1.Descriptor, error) {
+	if d, ok := m.cached[tag]; ok {
+		return d, nil
+	}
+	return m.mockTagStore.Get(ctx, tag)
+}
+
+func (m *mockCachedTagStore) GetUncached(ctx context.Context, tag string) (v1.Descriptor, error) {
+	return m.mockTagStore.Get(ctx, tag)
+}
+
+func TestGetRevalidateBypassesCache(t *testing.T) {
+	ctx := context.Background()
+	staleDesc := v1.Descriptor{Digest: digest.FromString("stale"), Size: 41}
+	currentDesc := v1.Descriptor{Digest: digest.FromString("current"), Size: 42}
+	remote := &mockConditionalTagStore{mockTagStore: &mockTagStore{mapping: map[string]v1.Descriptor{"latest": currentDesc}}}
+	localTags := &mockCachedTagStore{
+		mockTagStore: &mockTagStore{mapping: map[string]v1.Descriptor{"latest": currentDesc}},
+		cached:       map[string]v1.Descriptor{"latest": staleDesc},
+	}
+	proxyTags := &proxyTagService{
+		localTags:      localTags,
+		remoteTags:     remote,
+		authChallenger: &mockChallenger{},
+	}
+
+	// The tag is revalidated and returned from the link, not the cache.
+	d, err := proxyTags.Get(ctx, "latest")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(d, currentDesc) || remote.notModified != 1 {
+		t.Fatalf("unexpected tag %v, %d not modified", d, remote.notModified)
+	}
+
+	// The cache is used when the remote fails.
+	if err := remote.Untag(ctx, "latest"); err != nil {
+		t.Fatal(err)
+	}
+	d, err = proxyTags.Get(ctx, "latest")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(d, staleDesc) {
+		t.Fatalf("unexpected tag %v without the remote", d)
+	}
+}
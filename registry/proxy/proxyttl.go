@@ -0,0 +1,203 @@
+package proxy
+
+import (
+	"context"
+	"errors"
+	"path"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/distribution/reference"
+	"github.com/hashicorp/golang-lru/arc/v2"
+	"github.com/opencontainers/go-digest"
+
+	"github.com/distribution/distribution/v3"
+	"github.com/distribution/distribution/v3/configuration"
+	"github.com/distribution/distribution/v3/registry/storage/driver"
+)
+
+// blobMediaTypesSize is the number of blobs whose media type, learned from
+// the manifests fetched, is remembered for their ttl. The blobs forgotten
+// are cached for the ttl of the media type of their remote descriptor.
+const blobMediaTypesSize = 10000
+
+// ttlPolicy resolves the time the content cached is cached for: the ttl of
+// its media type if overridden, otherwise the manifest or blob ttl, otherwise
+// the proxy ttl. A nil ttl never expires, as does the content of a nil
+// policy.
+type ttlPolicy struct {
+	manifest *time.Duration
+	blob     *time.Duration
+	// mediaTypes are the ttls overriding those of the media types, exact
+	// or patterns.
+	mediaTypes map[string]*time.Duration
+}
+
+func newTTLPolicy(config configuration.Proxy) *ttlPolicy {
+	p := &ttlPolicy{
+		manifest: resolveTTL(config.TTL),
+		blob:     resolveTTL(config.TTL),
+	}
+	if config.ManifestTTL != nil {
+		p.manifest = resolveTTL(config.ManifestTTL)
+	}
+	if config.BlobTTL != nil {
+		p.blob = resolveTTL(config.BlobTTL)
+	}
+	if len(config.MediaTypeTTLs) > 0 {
+		p.mediaTypes = make(map[string]*time.Duration, len(config.MediaTypeTTLs))
+		for mediaType, ttl := range config.MediaTypeTTLs {
+			p.mediaTypes[mediaType] = resolveTTL(&ttl)
+		}
+	}
+	return p
+}
+
+// expires reports whether any content expires.
+func (p *ttlPolicy) expires() bool {
+	if p == nil {
+		return false
+	}
+	if p.manifest != nil || p.blob != nil {
+		return true
+	}
+	for _, ttl := range p.mediaTypes {
+		if ttl != nil {
+			return true
+		}
+	}
+	return false
+}
+
+// manifestTTL returns the ttl of a manifest of the media type.
+func (p *ttlPolicy) manifestTTL(mediaType string) *time.Duration {
+	if p == nil {
+		return nil
+	}
+	if ttl, ok := p.override(mediaType); ok {
+		return ttl
+	}
+	return p.manifest
+}
+
+// blobTTL returns the ttl of a blob of the media type.
+func (p *ttlPolicy) blobTTL(mediaType string) *time.Duration {
+	if p == nil {
+		return nil
+	}
+	if ttl, ok := p.override(mediaType); ok {
+		return ttl
+	}
+	return p.blob
+}
+
+// override returns the ttl overriding that of the media type: the ttl of the
+// media type itself, otherwise of the longest pattern matching it.
+func (p *ttlPolicy) override(mediaType string) (*time.Duration, bool) {
+	if mediaType == "" {
+		return nil, false
+	}
+	if ttl, ok := p.mediaTypes[mediaType]; ok {
+		return ttl, true
+	}
+	var match string
+	for pattern := range p.mediaTypes {
+		if !strings.ContainsAny(pattern, "*?[") {
+			continue
+		}
+		if ok, _ := path.Match(pattern, mediaType); !ok {
+			continue
+		}
+		if len(pattern) > len(match) || (len(pattern) == len(match) && pattern < match) {
+			match = pattern
+		}
+	}
+	if match == "" {
+		return nil, false
+	}
+	return p.mediaTypes[match], true
+}
+
+// blobMediaTypes remembers the media types of the blobs referenced by the
+// manifests fetched, which the remote does not describe them with, for the
+// ttl of their media type. It is nil if no media type ttl is overridden.
+type blobMediaTypes struct {
+	cache *arc.ARCCache[digest.Digest, string]
+}
+
+func newBlobMediaTypes(config configuration.Proxy) *blobMediaTypes {
+	if len(config.MediaTypeTTLs) == 0 {
+		return nil
+	}
+	cache, _ := arc.NewARC[digest.Digest, string](blobMediaTypesSize)
+	return &blobMediaTypes{cache: cache}
+}
+
+// learn remembers the media types of the blobs referenced by the manifest.
+func (bmt *blobMediaTypes) learn(manifest distribution.Manifest) {
+	if bmt == nil {
+		return
+	}
+	manifestTypes := distribution.ManifestMediaTypes()
+	for _, desc := range manifest.References() {
+		if desc.MediaType != "" && !slices.Contains(manifestTypes, desc.MediaType) {
+			bmt.cache.Add(desc.Digest, desc.MediaType)
+		}
+	}
+}
+
+// mediaType returns the media type of the blob learned, or fallback.
+func (bmt *blobMediaTypes) mediaType(dgst digest.Digest, fallback string) string {
+	if bmt == nil {
+		return fallback
+	}
+	if mediaType, ok := bmt.cache.Get(dgst); ok {
+		return mediaType
+	}
+	return fallback
+}
+
+// referencedBlob reports whether the blob is referenced by a manifest cached
+// in its repository, which it is then kept for.
+func referencedBlob(ctx context.Context, registry distribution.Namespace, r reference.Canonical) (bool, error) {
+	repo, err := registry.Repository(ctx, r)
+	if err != nil {
+		return false, err
+	}
+	manifests, err := repo.Manifests(ctx)
+	if err != nil {
+		return false, err
+	}
+	enumerator, ok := manifests.(distribution.ManifestEnumerator)
+	if !ok {
+		return false, nil
+	}
+
+	// The error stopping the walk is wrapped by the driver.
+	var referenced bool
+	err = enumerator.Enumerate(ctx, func(dgst digest.Digest) error {
+		manifest, err := manifests.Get(ctx, dgst)
+		if err != nil {
+			// The manifest removed since it was enumerated does not
+			// reference the blob anymore.
+			return nil
+		}
+		for _, desc := range manifest.References() {
+			if desc.Digest == r.Digest() {
+				referenced = true
+				return errors.New("referenced")
+			}
+		}
+		return nil
+	})
+	if referenced {
+		return true, nil
+	}
+	switch err.(type) {
+	case nil, driver.PathNotFoundError:
+		return false, nil
+	default:
+		return false, err
+	}
+}
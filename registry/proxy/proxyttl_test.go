@@ -0,0 +1,161 @@
+package proxy
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/distribution/reference"
+	"github.com/opencontainers/go-digest"
+	v1 "github.com/opencontainers/image-spec/specs-go/v1"
+
+	"github.com/distribution/distribution/v3/configuration"
+	"github.com/distribution/distribution/v3/manifest/ocischema"
+	"github.com/distribution/distribution/v3/registry/storage"
+	"github.com/distribution/distribution/v3/registry/storage/driver/inmemory"
+)
+
+func TestTTLPolicy(t *testing.T) {
+	d := func(d time.Duration) *time.Duration { return &d }
+	config := configuration.Proxy{
+		TTL:         d(time.Hour),
+		ManifestTTL: d(2 * time.Hour),
+		MediaTypeTTLs: map[string]time.Duration{
+			v1.MediaTypeImageLayerGzip:        3 * time.Hour,
+			"application/vnd.oci.image.*":     4 * time.Hour,
+			"application/vnd.oci.*":           5 * time.Hour,
+			"application/vnd.in-toto+json":    0,
+			"application/vnd.oci.image.ind?x": 6 * time.Hour,
+		},
+	}
+
+	for _, tc := range []struct {
+		name      string
+		config    configuration.Proxy
+		manifest  bool
+		mediaType string
+		expected  *time.Duration
+	}{
+		{name: "exact media type over patterns", mediaType: v1.MediaTypeImageLayerGzip, expected: d(3 * time.Hour)},
+		{name: "longest pattern", mediaType: v1.MediaTypeImageLayer, expected: d(4 * time.Hour)},
+		{name: "longest pattern of a manifest", manifest: true, mediaType: v1.MediaTypeImageManifest, expected: d(4 * time.Hour)},
+		{name: "equally long patterns", manifest: true, mediaType: v1.MediaTypeImageIndex, expected: d(4 * time.Hour)},
+		{name: "shorter pattern", mediaType: "application/vnd.oci.empty.v1+json", expected: d(5 * time.Hour)},
+		{name: "zero override never expires", mediaType: "application/vnd.in-toto+json"},
+		{name: "manifestttl", manifest: true, mediaType: "application/vnd.docker.distribution.manifest.v2+json", expected: d(2 * time.Hour)},
+		{name: "ttl without blobttl", mediaType: "application/vnd.docker.image.rootfs.diff.tar.gzip", expected: d(time.Hour)},
+		{name: "unknown media type", mediaType: "", expected: d(time.Hour)},
+		{name: "default ttl", config: configuration.Proxy{}, mediaType: v1.MediaTypeImageLayer, expected: d(repositoryTTL)},
+		{name: "zero ttl never expires", config: configuration.Proxy{TTL: d(0)}, mediaType: v1.MediaTypeImageLayer},
+		{name: "blobttl over ttl", config: configuration.Proxy{TTL: d(0), BlobTTL: d(time.Minute)}, mediaType: v1.MediaTypeImageLayer, expected: d(time.Minute)},
+		{name: "zero manifestttl over ttl", config: configuration.Proxy{TTL: d(time.Hour), ManifestTTL: d(0)}, manifest: true, mediaType: v1.MediaTypeImageManifest},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			if tc.config.TTL == nil && tc.config.MediaTypeTTLs == nil && tc.name != "default ttl" {
+				tc.config = config
+			}
+			p := newTTLPolicy(tc.config)
+			ttl := p.blobTTL(tc.mediaType)
+			if tc.manifest {
+				ttl = p.manifestTTL(tc.mediaType)
+			}
+			switch {
+			case tc.expected == nil && ttl != nil:
+				t.Fatalf("expected no expiry, got %s", *ttl)
+			case tc.expected != nil && ttl == nil:
+				t.Fatalf("expected a ttl of %s, got no expiry", *tc.expected)
+			case tc.expected != nil && *ttl != *tc.expected:
+				t.Fatalf("expected a ttl of %s, got %s", *tc.expected, *ttl)
+			}
+		})
+	}
+
+	var nilPolicy *ttlPolicy
+	if nilPolicy.expires() || nilPolicy.blobTTL(v1.MediaTypeImageLayer) != nil {
+		t.Fatal("expected nothing to expire with a nil policy")
+	}
+	if newTTLPolicy(configuration.Proxy{TTL: d(0)}).expires() {
+		t.Fatal("expected nothing to expire with a zero ttl")
+	}
+	if !newTTLPolicy(configuration.Proxy{TTL: d(0), MediaTypeTTLs: map[string]time.Duration{"*": time.Hour}}).expires() {
+		t.Fatal("expected the content of an overridden media type to expire")
+	}
+}
+
+func TestBlobMediaTypes(t *testing.T) {
+	layer := v1.Descriptor{MediaType: "application/vnd.in-toto+json", Digest: digest.FromString("layer"), Size: 5}
+	m, err := ocischema.FromStruct(ocischema.Manifest{
+		MediaType: v1.MediaTypeImageManifest,
+		Config:    v1.DescriptorEmptyJSON,
+		Layers:    []v1.Descriptor{layer},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if bmt := newBlobMediaTypes(configuration.Proxy{}); bmt != nil {
+		t.Fatal("expected no media types to be learned without media type ttls")
+	}
+	var bmt *blobMediaTypes
+	bmt.learn(m)
+	if mt := bmt.mediaType(layer.Digest, "fallback"); mt != "fallback" {
+		t.Fatalf("unexpected media type %q", mt)
+	}
+
+	bmt = newBlobMediaTypes(configuration.Proxy{MediaTypeTTLs: map[string]time.Duration{"*": time.Hour}})
+	bmt.learn(m)
+	if mt := bmt.mediaType(layer.Digest, "fallback"); mt != layer.MediaType {
+		t.Fatalf("expected the media type of the layer to be learned, got %q", mt)
+	}
+	if mt := bmt.mediaType(v1.DescriptorEmptyJSON.Digest, "fallback"); mt != v1.MediaTypeEmptyJSON {
+		t.Fatalf("expected the media type of the config to be learned, got %q", mt)
+	}
+	if mt := bmt.mediaType(digest.FromString("other"), "fallback"); mt != "fallback" {
+		t.Fatalf("expected the fallback for a blob not learned, got %q", mt)
+	}
+}
+
+func TestReferencedBlob(t *testing.T) {
+	ctx := context.Background()
+	registry, err := storage.NewRegistry(ctx, inmemory.New())
+	if err != nil {
+		t.Fatal(err)
+	}
+	name, _ := reference.WithName("foo/bar")
+	repo, err := registry.Repository(ctx, name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := repo.Blobs(ctx).Put(ctx, v1.MediaTypeEmptyJSON, v1.DescriptorEmptyJSON.Data); err != nil {
+		t.Fatal(err)
+	}
+	_, m := pushImage(t, repo, "referenced")
+	unreferenced, err := repo.Blobs(ctx).Put(ctx, v1.MediaTypeImageLayer, []byte("unreferenced"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	other, _ := reference.WithName("foo/other")
+
+	for _, tc := range []struct {
+		name       string
+		repository reference.Named
+		dgst       digest.Digest
+		referenced bool
+	}{
+		{name: "layer", repository: name, dgst: m.References()[1].Digest, referenced: true},
+		{name: "config", repository: name, dgst: v1.DescriptorEmptyJSON.Digest, referenced: true},
+		{name: "unreferenced blob", repository: name, dgst: unreferenced.Digest},
+		{name: "other repository", repository: other, dgst: m.References()[1].Digest},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			r, _ := reference.WithDigest(tc.repository, tc.dgst)
+			referenced, err := referencedBlob(ctx, registry, r)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if referenced != tc.referenced {
+				t.Fatalf("expected referenced to be %t, got %t", tc.referenced, referenced)
+			}
+		})
+	}
+}
@@ -0,0 +1,97 @@
+package proxy
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+
+	"github.com/distribution/distribution/v3"
+	"github.com/distribution/distribution/v3/configuration"
+	"github.com/distribution/distribution/v3/internal/client/auth"
+	v2 "github.com/distribution/distribution/v3/registry/api/v2"
+	"github.com/distribution/reference"
+)
+
+// Remote authorizes the requests to a remote registry with the credentials
+// of its configuration, for the components other than the pull through cache
+// which talk to remote registries, such as the replication to peers.
+type Remote struct {
+	remote *proxyRemote
+}
+
+// NewRemote configures the credentials of the remote. The token realms of the
+// remote are discovered from its base route, so it fails if the remote cannot
+// be reached.
+func NewRemote(ctx context.Context, config configuration.ProxyRemote) (*Remote, error) {
+	remote, err := newProxyRemote(ctx, config)
+	if err != nil {
+		return nil, err
+	}
+	return &Remote{remote: remote}, nil
+}
+
+// URL returns the url of the remote.
+func (r *Remote) URL() url.URL {
+	return r.remote.remoteURL
+}
+
+// AllowsTag returns whether the tag filter of the remote allows the tag.
+func (r *Remote) AllowsTag(tag string) bool {
+	return r.remote.tagFilter.allows(tag)
+}
+
+// Transport returns a transport authorizing the requests to the remote for
+// the scopes, once the challenges of the remote are established.
+func (r *Remote) Transport(ctx context.Context, scopes ...auth.Scope) (http.RoundTripper, error) {
+	if err := r.remote.authChallenger.tryEstablishChallenges(ctx); err != nil {
+		return nil, err
+	}
+	return r.remote.transport(ctx, scopes...), nil
+}
+
+// Ping requests the base route of the remote with its credentials, or the
+// manifest of the reference with a HEAD request if it is not nil, and returns
+// an error unless the remote answers with a 200. The reference must be tagged
+// or canonical.
+func (r *Remote) Ping(ctx context.Context, ref reference.Named) error {
+	remoteURL := r.remote.remoteURL
+	ub := v2.NewURLBuilder(&remoteURL, false)
+
+	method := http.MethodGet
+	var scopes []auth.Scope
+	var pingURL string
+	var err error
+	if ref == nil {
+		pingURL, err = ub.BuildBaseURL()
+	} else {
+		method = http.MethodHead
+		scopes = append(scopes, auth.RepositoryScope{Repository: ref.Name(), Actions: []string{"pull"}})
+		pingURL, err = ub.BuildManifestURL(ref)
+	}
+	if err != nil {
+		return err
+	}
+
+	tr, err := r.Transport(ctx, scopes...)
+	if err != nil {
+		return fmt.Errorf("%s: %w", remoteURL.Redacted(), err)
+	}
+	req, err := http.NewRequestWithContext(ctx, method, pingURL, nil)
+	if err != nil {
+		return err
+	}
+	if ref != nil {
+		req.Header.Set("Accept", strings.Join(distribution.ManifestMediaTypes(), ", "))
+	}
+	resp, err := (&http.Client{Transport: tr}).Do(req)
+	if err != nil {
+		return fmt.Errorf("%s: %w", remoteURL.Redacted(), err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("%s %s: unexpected status: %s", method, pingURL, resp.Status)
+	}
+	return nil
+}
@@ -4,23 +4,63 @@ import (
 	"context"
 	"encoding/json"
 	"fmt"
+	"sort"
 	"sync"
 	"time"
 
 	"github.com/distribution/distribution/v3/internal/dcontext"
+	prometheus "github.com/distribution/distribution/v3/metrics"
 	"github.com/distribution/distribution/v3/registry/storage/driver"
 	"github.com/distribution/reference"
+	"github.com/docker/go-metrics"
 )
 
 // onTTLExpiryFunc is called when a repository's TTL expires
 type expiryFunc func(reference.Reference) error
 
+// retainFunc reports whether an entry whose TTL expires is retained
+type retainFunc func(reference.Reference) (bool, error)
+
 const (
 	entryTypeBlob = iota
 	entryTypeManifest
 	indexSaveFrequency = 5 * time.Second
 )
 
+// statsInterval is the interval between refreshes of the scheduler gauges,
+// which are logged at the debug level.
+const statsInterval = 30 * time.Second
+
+var (
+	// queuedEntries is the number of entries scheduled, by type.
+	queuedEntries = prometheus.ProxyNamespace.NewLabeledGauge("scheduler_queue", "The number of entries scheduled to expire from the cache", metrics.Unit("entries"), "type")
+	// nextExpiry is the number of seconds until the next entry expires,
+	// negative if the expiries are running late.
+	nextExpiry = prometheus.ProxyNamespace.NewGauge("scheduler_next_expiry", "The number of seconds until the next entry scheduled expires", metrics.Seconds)
+	// evictions is the number of entries expired or evicted, by type.
+	evictions = prometheus.ProxyNamespace.NewLabeledCounter("scheduler_evictions", "The number of entries expired or evicted from the cache", "type")
+	// evictionErrors is the number of entries whose expiry failed, by type.
+	evictionErrors = prometheus.ProxyNamespace.NewLabeledCounter("scheduler_eviction_errors", "The number of entries whose expiry from the cache failed", "type")
+	// evictionDelay is how late the entries expired after their expiry time,
+	// by type.
+	evictionDelay = prometheus.ProxyNamespace.NewLabeledTimer("scheduler_eviction_delay", "The number of seconds an entry expired after its expiry time", "type")
+	// rescheduled is the number of blobs retained when they expired.
+	rescheduled = prometheus.ProxyNamespace.NewCounter("scheduler_rescheduled", "The number of blobs rescheduled to expire instead of expiring, being retained")
+)
+
+// entryTypeNames are the metric labels of the entry types.
+var entryTypeNames = map[int]string{
+	entryTypeBlob:     "blob",
+	entryTypeManifest: "manifest",
+}
+
+func init() {
+	for _, name := range entryTypeNames {
+		evictions.WithValues(name).Inc(0)
+		evictionErrors.WithValues(name).Inc(0)
+	}
+}
+
 // schedulerEntry represents an entry in the scheduler
 // fields are exported for serialization
 type schedulerEntry struct {
@@ -28,6 +68,14 @@ type schedulerEntry struct {
 	Expiry    time.Time `json:"ExpiryData"`
 	EntryType int       `json:"EntryType"`
 
+	// Size is the size in bytes of the cached content, if known
+	Size int64 `json:"Size,omitempty"`
+	// Added is the time the entry was scheduled, used to order evictions
+	Added time.Time `json:"Added,omitempty"`
+	// TTL is the ttl the entry was scheduled for, which it is scheduled for
+	// again if it is retained
+	TTL time.Duration `json:"TTL,omitempty"`
+
 	timer *time.Timer
 }
 
@@ -59,10 +107,33 @@ type TTLExpirationScheduler struct {
 
 	onBlobExpire     expiryFunc
 	onManifestExpire expiryFunc
+	retainBlob       retainFunc
 
 	indexDirty bool
 	saveTimer  *time.Ticker
 	doneChan   chan struct{}
+
+	// evictions and evictionErrors count the entries expired since the
+	// scheduler was created, and rescheduledBlobs the blobs retained.
+	evictions        uint64
+	evictionErrors   uint64
+	rescheduledBlobs uint64
+}
+
+// Stats are the statistics of a scheduler.
+type Stats struct {
+	Blobs     int
+	Manifests int
+	// NextExpiry is the expiry time of the next entry to expire, zero if
+	// none is scheduled to.
+	NextExpiry time.Time
+	// Evictions is the number of entries expired or evicted, and
+	// EvictionErrors the number of entries whose expiry failed.
+	Evictions      uint64
+	EvictionErrors uint64
+	// Rescheduled is the number of blobs rescheduled, being retained when
+	// their TTL expired.
+	Rescheduled uint64
 }
 
 // OnBlobExpire is called when a scheduled blob's TTL expires
@@ -81,6 +152,16 @@ func (ttles *TTLExpirationScheduler) OnManifestExpire(f expiryFunc) {
 	ttles.onManifestExpire = f
 }
 
+// RetainBlob is called when a scheduled blob's TTL expires, before it
+// expires: the blob is scheduled to expire again after the same TTL instead
+// if f retains it. The blobs evicted by EvictBlobs are not retained.
+func (ttles *TTLExpirationScheduler) RetainBlob(f retainFunc) {
+	ttles.Lock()
+	defer ttles.Unlock()
+
+	ttles.retainBlob = f
+}
+
 // AddBlob schedules a blob cleanup after ttl expires
 func (ttles *TTLExpirationScheduler) AddBlob(blobRef reference.Canonical, ttl time.Duration) error {
 	ttles.Lock()
@@ -90,7 +171,22 @@ func (ttles *TTLExpirationScheduler) AddBlob(blobRef reference.Canonical, ttl ti
 		return fmt.Errorf("scheduler not started")
 	}
 
-	ttles.add(blobRef, ttl, entryTypeBlob)
+	ttles.add(blobRef, 0, &ttl, entryTypeBlob)
+	return nil
+}
+
+// AddBlobWithSize schedules a blob cleanup after ttl expires and records its
+// size for cache usage accounting. A nil ttl tracks the blob without ever
+// expiring it.
+func (ttles *TTLExpirationScheduler) AddBlobWithSize(blobRef reference.Canonical, size int64, ttl *time.Duration) error {
+	ttles.Lock()
+	defer ttles.Unlock()
+
+	if ttles.stopped {
+		return fmt.Errorf("scheduler not started")
+	}
+
+	ttles.add(blobRef, size, ttl, entryTypeBlob)
 	return nil
 }
 
@@ -103,7 +199,7 @@ func (ttles *TTLExpirationScheduler) AddManifest(manifestRef reference.Canonical
 		return fmt.Errorf("scheduler not started")
 	}
 
-	ttles.add(manifestRef, ttl, entryTypeManifest)
+	ttles.add(manifestRef, 0, &ttl, entryTypeManifest)
 	return nil
 }
 
@@ -126,14 +222,24 @@ func (ttles *TTLExpirationScheduler) Start() error {
 
 	// Start timer for each deserialized entry
 	for _, entry := range ttles.entries {
+		if entry.Expiry.IsZero() {
+			continue
+		}
 		entry.timer = ttles.startTimer(entry, time.Until(entry.Expiry))
 	}
 
 	// Start a ticker to periodically save the entries index
 
 	go func() {
+		statsTicker := time.NewTicker(statsInterval)
+		defer statsTicker.Stop()
+		ttles.reportStats()
+
 		for {
 			select {
+			case <-statsTicker.C:
+				ttles.reportStats()
+
 			case <-ttles.saveTimer.C:
 				ttles.Lock()
 				if !ttles.indexDirty {
@@ -158,53 +264,378 @@ func (ttles *TTLExpirationScheduler) Start() error {
 	return nil
 }
 
-func (ttles *TTLExpirationScheduler) add(r reference.Reference, ttl time.Duration, eType int) {
+func (ttles *TTLExpirationScheduler) add(r reference.Reference, size int64, ttl *time.Duration, eType int) {
+	now := time.Now()
 	entry := &schedulerEntry{
 		Key:       r.String(),
-		Expiry:    time.Now().Add(ttl),
 		EntryType: eType,
+		Size:      size,
+		Added:     now,
 	}
-	dcontext.GetLogger(ttles.ctx).Infof("Adding new scheduler entry for %s with ttl=%s", entry.Key, time.Until(entry.Expiry))
-	if oldEntry, present := ttles.entries[entry.Key]; present && oldEntry.timer != nil {
-		oldEntry.timer.Stop()
+	if ttl != nil {
+		entry.Expiry = now.Add(*ttl)
+		entry.TTL = *ttl
+		dcontext.GetLogger(ttles.ctx).Infof("Adding new scheduler entry for %s with ttl=%s", entry.Key, *ttl)
+	} else {
+		dcontext.GetLogger(ttles.ctx).Infof("Adding new scheduler entry for %s without expiry", entry.Key)
+	}
+	if oldEntry, present := ttles.entries[entry.Key]; present {
+		if oldEntry.timer != nil {
+			oldEntry.timer.Stop()
+		}
+		if entry.Size == 0 {
+			entry.Size = oldEntry.Size
+		}
 	}
 	ttles.entries[entry.Key] = entry
-	entry.timer = ttles.startTimer(entry, ttl)
+	if ttl != nil {
+		entry.timer = ttles.startTimer(entry, *ttl)
+	}
 	ttles.indexDirty = true
 }
 
-func (ttles *TTLExpirationScheduler) startTimer(entry *schedulerEntry, ttl time.Duration) *time.Timer {
-	return time.AfterFunc(ttl, func() {
-		ttles.Lock()
-		defer ttles.Unlock()
+// Len returns the number of scheduled entries
+func (ttles *TTLExpirationScheduler) Len() int {
+	ttles.Lock()
+	defer ttles.Unlock()
+	return len(ttles.entries)
+}
 
-		var f expiryFunc
+// Stats returns the statistics of the scheduler.
+func (ttles *TTLExpirationScheduler) Stats() Stats {
+	ttles.Lock()
+	defer ttles.Unlock()
 
+	stats := Stats{
+		Evictions:      ttles.evictions,
+		EvictionErrors: ttles.evictionErrors,
+		Rescheduled:    ttles.rescheduledBlobs,
+	}
+	for _, entry := range ttles.entries {
 		switch entry.EntryType {
 		case entryTypeBlob:
-			f = ttles.onBlobExpire
+			stats.Blobs++
 		case entryTypeManifest:
-			f = ttles.onManifestExpire
-		default:
-			f = func(reference.Reference) error {
-				return fmt.Errorf("scheduler entry type")
-			}
+			stats.Manifests++
+		}
+		if !entry.Expiry.IsZero() && (stats.NextExpiry.IsZero() || entry.Expiry.Before(stats.NextExpiry)) {
+			stats.NextExpiry = entry.Expiry
 		}
+	}
+	return stats
+}
 
+// Expiration is an entry scheduled to expire from the cache.
+type Expiration struct {
+	// Repository is the name of the repository of the entry, and Reference
+	// the digest of its content.
+	Repository string
+	Reference  string
+	// Type is "blob" or "manifest".
+	Type   string
+	Expiry time.Time
+}
+
+// Expirations returns the entries scheduled to expire until before, or all of
+// them if before is zero, soonest first, then by reference. The entries
+// tracked without an expiry are not returned.
+func (ttles *TTLExpirationScheduler) Expirations(before time.Time) []Expiration {
+	ttles.Lock()
+	defer ttles.Unlock()
+
+	expirations := []Expiration{}
+	for _, entry := range ttles.entries {
+		if entry.Expiry.IsZero() || (!before.IsZero() && entry.Expiry.After(before)) {
+			continue
+		}
 		ref, err := reference.Parse(entry.Key)
-		if err == nil {
-			if err := f(ref); err != nil {
-				dcontext.GetLogger(ttles.ctx).Errorf("Scheduler error returned from OnExpire(%s): %s", entry.Key, err)
-			}
-		} else {
-			dcontext.GetLogger(ttles.ctx).Errorf("Error unpacking reference: %s", err)
+		if err != nil {
+			continue
+		}
+		expiration := Expiration{Reference: entry.Key, Type: entryTypeNames[entry.EntryType], Expiry: entry.Expiry}
+		if canonical, ok := ref.(reference.Canonical); ok {
+			expiration.Repository = canonical.Name()
+			expiration.Reference = canonical.Digest().String()
+		}
+		expirations = append(expirations, expiration)
+	}
+	sort.Slice(expirations, func(i, j int) bool {
+		if !expirations[i].Expiry.Equal(expirations[j].Expiry) {
+			return expirations[i].Expiry.Before(expirations[j].Expiry)
+		}
+		if expirations[i].Repository != expirations[j].Repository {
+			return expirations[i].Repository < expirations[j].Repository
 		}
+		return expirations[i].Reference < expirations[j].Reference
+	})
+	return expirations
+}
+
+// Rename moves the entries of the repository from to the repository to,
+// keeping their expiry, so that the content of a renamed repository expires
+// under its new name.
+func (ttles *TTLExpirationScheduler) Rename(from, to reference.Named) error {
+	ttles.Lock()
+	defer ttles.Unlock()
 
-		delete(ttles.entries, entry.Key)
+	now := time.Now()
+	for key, entry := range ttles.entries {
+		ref, err := reference.Parse(key)
+		if err != nil {
+			continue
+		}
+		canonical, ok := ref.(reference.Canonical)
+		if !ok || canonical.Name() != from.Name() {
+			continue
+		}
+		renamed, err := reference.WithDigest(to, canonical.Digest())
+		if err != nil {
+			return err
+		}
+		if entry.timer != nil {
+			entry.timer.Stop()
+		}
+		delete(ttles.entries, key)
+
+		moved := *entry
+		moved.Key = renamed.String()
+		moved.timer = nil
+		ttles.entries[moved.Key] = &moved
+		if !moved.Expiry.IsZero() {
+			moved.timer = ttles.startTimer(&moved, moved.Expiry.Sub(now))
+		}
 		ttles.indexDirty = true
+	}
+	return nil
+}
+
+// reportStats refreshes the scheduler gauges and logs them.
+func (ttles *TTLExpirationScheduler) reportStats() {
+	stats := ttles.Stats()
+	queuedEntries.WithValues(entryTypeNames[entryTypeBlob]).Set(float64(stats.Blobs))
+	queuedEntries.WithValues(entryTypeNames[entryTypeManifest]).Set(float64(stats.Manifests))
+	next := "none"
+	if stats.NextExpiry.IsZero() {
+		nextExpiry.Set(0)
+	} else {
+		until := time.Until(stats.NextExpiry)
+		nextExpiry.Set(until.Seconds())
+		next = until.Round(time.Second).String()
+	}
+	dcontext.GetLogger(ttles.ctx).Debugf("Scheduler has %d blobs and %d manifests scheduled, next expiry in %s, %d evictions, %d eviction errors and %d blobs rescheduled",
+		stats.Blobs, stats.Manifests, next, stats.Evictions, stats.EvictionErrors, stats.Rescheduled)
+}
+
+// BlobBytes returns the total size in bytes of all scheduled blobs
+func (ttles *TTLExpirationScheduler) BlobBytes() int64 {
+	ttles.Lock()
+	defer ttles.Unlock()
+
+	var total int64
+	for _, entry := range ttles.entries {
+		if entry.EntryType == entryTypeBlob {
+			total += entry.Size
+		}
+	}
+	return total
+}
+
+// EvictBlobs synchronously expires the oldest scheduled blobs until at least
+// n bytes have been freed or no sized blobs remain. It returns the number of
+// bytes freed. The blobs are picked and unscheduled under the scheduler lock,
+// then deleted without holding it.
+func (ttles *TTLExpirationScheduler) EvictBlobs(n int64) (int64, error) {
+	ttles.Lock()
+	if ttles.stopped {
+		ttles.Unlock()
+		return 0, fmt.Errorf("scheduler not started")
+	}
+
+	var candidates []*schedulerEntry
+	for _, entry := range ttles.entries {
+		if entry.EntryType == entryTypeBlob && entry.Size > 0 {
+			candidates = append(candidates, entry)
+		}
+	}
+	sort.Slice(candidates, func(i, j int) bool {
+		return candidates[i].age().Before(candidates[j].age())
+	})
+
+	var freed int64
+	var evicted []*schedulerEntry
+	for _, entry := range candidates {
+		if freed >= n {
+			break
+		}
+		if entry.timer != nil {
+			entry.timer.Stop()
+		}
+		ttles.remove(entry)
+		evicted = append(evicted, entry)
+		freed += entry.Size
+	}
+	ttles.Unlock()
+
+	for _, entry := range evicted {
+		ttles.expire(entry)
+	}
+	return freed, nil
+}
+
+// ReconcileBlobs checks every scheduled blob with stat, removing entries whose
+// content no longer exists and filling in sizes that were not recorded. It
+// keeps the cache usage accounting correct after content has been removed
+// out of band, for example by garbage collection.
+func (ttles *TTLExpirationScheduler) ReconcileBlobs(stat func(reference.Reference) (size int64, exists bool, err error)) error {
+	ttles.Lock()
+	var entries []*schedulerEntry
+	for _, entry := range ttles.entries {
+		if entry.EntryType == entryTypeBlob {
+			entries = append(entries, entry)
+		}
+	}
+	ttles.Unlock()
+
+	for _, entry := range entries {
+		ref, err := reference.Parse(entry.Key)
+		if err != nil {
+			dcontext.GetLogger(ttles.ctx).Errorf("Error unpacking reference: %s", err)
+			continue
+		}
+
+		size, exists, err := stat(ref)
+		if err != nil {
+			return err
+		}
+
+		ttles.Lock()
+		if current, ok := ttles.entries[entry.Key]; ok && current == entry {
+			if !exists {
+				if entry.timer != nil {
+					entry.timer.Stop()
+				}
+				delete(ttles.entries, entry.Key)
+				ttles.indexDirty = true
+			} else if entry.Size != size {
+				entry.Size = size
+				ttles.indexDirty = true
+			}
+		}
+		ttles.Unlock()
+	}
+	return nil
+}
+
+// age returns the time used to order the entry for eviction
+func (entry *schedulerEntry) age() time.Time {
+	if entry.Added.IsZero() {
+		return entry.Expiry
+	}
+	return entry.Added
+}
+
+func (ttles *TTLExpirationScheduler) startTimer(entry *schedulerEntry, ttl time.Duration) *time.Timer {
+	return time.AfterFunc(ttl, func() {
+		ttles.Lock()
+		if current, ok := ttles.entries[entry.Key]; !ok || current != entry || ttles.retain(entry) {
+			// The entry was replaced or already removed, or is retained
+			ttles.Unlock()
+			return
+		}
+		ttles.remove(entry)
+		ttles.Unlock()
+
+		evictionDelay.WithValues(entryTypeNames[entry.EntryType]).UpdateSince(entry.Expiry)
+		ttles.expire(entry)
 	})
 }
 
+// retain schedules the blob entry to expire again after its TTL if it is
+// retained, reporting whether it is. The caller must hold the scheduler lock.
+func (ttles *TTLExpirationScheduler) retain(entry *schedulerEntry) bool {
+	if entry.EntryType != entryTypeBlob || ttles.retainBlob == nil {
+		return false
+	}
+	ttl := entry.TTL
+	if ttl <= 0 && !entry.Added.IsZero() {
+		// The entries saved before their TTL was recorded
+		ttl = entry.Expiry.Sub(entry.Added)
+	}
+	if ttl <= 0 {
+		return false
+	}
+
+	ref, err := reference.Parse(entry.Key)
+	if err != nil {
+		return false
+	}
+	retained, err := ttles.retainBlob(ref)
+	if err != nil {
+		dcontext.GetLogger(ttles.ctx).Errorf("Scheduler error returned from RetainBlob(%s), expiring it: %s", entry.Key, err)
+		return false
+	}
+	if !retained {
+		return false
+	}
+
+	dcontext.GetLogger(ttles.ctx).Infof("Retaining scheduler entry for %s, rescheduled with ttl=%s", entry.Key, ttl)
+	entry.Expiry = time.Now().Add(ttl)
+	entry.TTL = ttl
+	entry.timer = ttles.startTimer(entry, ttl)
+	ttles.indexDirty = true
+	ttles.rescheduledBlobs++
+	rescheduled.Inc(1)
+	return true
+}
+
+// remove removes the entry from the index, unless it was replaced or already
+// removed. The caller must hold the scheduler lock.
+func (ttles *TTLExpirationScheduler) remove(entry *schedulerEntry) {
+	if current, ok := ttles.entries[entry.Key]; !ok || current != entry {
+		return
+	}
+	delete(ttles.entries, entry.Key)
+	ttles.indexDirty = true
+}
+
+// expire runs the expiry callback for the entry removed from the index. The
+// caller must not hold the scheduler lock, the callback deleting the content
+// from the storage.
+func (ttles *TTLExpirationScheduler) expire(entry *schedulerEntry) {
+	ttles.Lock()
+	var f expiryFunc
+	switch entry.EntryType {
+	case entryTypeBlob:
+		f = ttles.onBlobExpire
+	case entryTypeManifest:
+		f = ttles.onManifestExpire
+	default:
+		f = func(reference.Reference) error {
+			return fmt.Errorf("scheduler entry type")
+		}
+	}
+	ttles.Unlock()
+
+	ref, err := reference.Parse(entry.Key)
+	if err == nil {
+		if err = f(ref); err != nil {
+			dcontext.GetLogger(ttles.ctx).Errorf("Scheduler error returned from OnExpire(%s): %s", entry.Key, err)
+		}
+	} else {
+		dcontext.GetLogger(ttles.ctx).Errorf("Error unpacking reference: %s", err)
+	}
+
+	ttles.Lock()
+	defer ttles.Unlock()
+	if err != nil {
+		ttles.evictionErrors++
+		evictionErrors.WithValues(entryTypeNames[entry.EntryType]).Inc(1)
+	} else {
+		ttles.evictions++
+		evictions.WithValues(entryTypeNames[entry.EntryType]).Inc(1)
+	}
+}
+
 // Stop stops the scheduler.
 func (ttles *TTLExpirationScheduler) Stop() error {
 	ttles.Lock()
@@ -216,7 +647,9 @@ func (ttles *TTLExpirationScheduler) Stop() error {
 	}
 
 	for _, entry := range ttles.entries {
-		entry.timer.Stop()
+		if entry.timer != nil {
+			entry.timer.Stop()
+		}
 	}
 
 	close(ttles.doneChan)
@@ -195,8 +195,9 @@ func TestStopRestore(t *testing.T) {
 	if err != nil {
 		t.Fatal(err)
 	}
-	s.add(ref1, 300*timeUnit, entryTypeBlob)
-	s.add(ref2, 100*timeUnit, entryTypeBlob)
+	ttl1, ttl2 := 300*timeUnit, 100*timeUnit
+	s.add(ref1, 0, &ttl1, entryTypeBlob)
+	s.add(ref2, 0, &ttl2, entryTypeBlob)
 
 	// Start and stop before all operations complete
 	// state will be written to fs
@@ -233,3 +234,388 @@ func TestDoubleStart(t *testing.T) {
 		t.Fatal("Scheduler started twice without error")
 	}
 }
+
+func TestEvictBlobs(t *testing.T) {
+	refs := testRefsN(t, 3)
+
+	var evicted []string
+	s := New(dcontext.Background(), inmemory.New(), "/ttl")
+	s.OnBlobExpire(func(r reference.Reference) error {
+		evicted = append(evicted, r.String())
+		return nil
+	})
+	if err := s.Start(); err != nil {
+		t.Fatalf("Error starting ttlExpirationScheduler: %s", err)
+	}
+	defer s.Stop()
+
+	ttl := time.Hour
+	for _, ref := range refs {
+		if err := s.AddBlobWithSize(ref, 100, &ttl); err != nil {
+			t.Fatal(err)
+		}
+		time.Sleep(time.Millisecond)
+	}
+
+	if total := s.BlobBytes(); total != 300 {
+		t.Fatalf("unexpected blob bytes: %d", total)
+	}
+
+	freed, err := s.EvictBlobs(150)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if freed != 200 {
+		t.Fatalf("unexpected freed bytes: %d", freed)
+	}
+	if len(evicted) != 2 || evicted[0] != refs[0].String() || evicted[1] != refs[1].String() {
+		t.Fatalf("expected the two oldest blobs to be evicted, got %v", evicted)
+	}
+	if total := s.BlobBytes(); total != 100 {
+		t.Fatalf("unexpected blob bytes after eviction: %d", total)
+	}
+}
+
+func TestEvictBlobsUnlocked(t *testing.T) {
+	refs := testRefsN(t, 2)
+
+	s := New(dcontext.Background(), inmemory.New(), "/ttl")
+	// The blob is deleted without holding the scheduler lock, and is no
+	// longer accounted while it is.
+	var accounted int64
+	s.OnBlobExpire(func(r reference.Reference) error {
+		accounted = s.BlobBytes()
+		return nil
+	})
+	if err := s.Start(); err != nil {
+		t.Fatalf("Error starting ttlExpirationScheduler: %s", err)
+	}
+	defer s.Stop()
+
+	for _, ref := range refs {
+		if err := s.AddBlobWithSize(ref, 100, nil); err != nil {
+			t.Fatal(err)
+		}
+		time.Sleep(time.Millisecond)
+	}
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		if _, err := s.EvictBlobs(1); err != nil {
+			t.Error(err)
+		}
+	}()
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("the eviction holds the scheduler lock while deleting the blob")
+	}
+	if accounted != 100 {
+		t.Fatalf("unexpected blob bytes while evicting: %d", accounted)
+	}
+	if stats := s.Stats(); stats.Evictions != 1 || stats.Blobs != 1 {
+		t.Fatalf("unexpected stats after eviction: %+v", stats)
+	}
+}
+
+func TestBlobBytesPersisted(t *testing.T) {
+	refs := testRefsN(t, 2)
+
+	fs := inmemory.New()
+	s := New(dcontext.Background(), fs, "/ttl")
+	if err := s.Start(); err != nil {
+		t.Fatal(err)
+	}
+	ttl := time.Hour
+	if err := s.AddBlobWithSize(refs[0], 10, &ttl); err != nil {
+		t.Fatal(err)
+	}
+	// A nil TTL tracks the blob without expiring it
+	if err := s.AddBlobWithSize(refs[1], 20, nil); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Stop(); err != nil {
+		t.Fatal(err)
+	}
+
+	s2 := New(dcontext.Background(), fs, "/ttl")
+	if err := s2.Start(); err != nil {
+		t.Fatal(err)
+	}
+	defer s2.Stop()
+
+	if total := s2.BlobBytes(); total != 30 {
+		t.Fatalf("unexpected blob bytes after restore: %d", total)
+	}
+}
+
+func TestReconcileBlobs(t *testing.T) {
+	refs := testRefsN(t, 3)
+
+	s := New(dcontext.Background(), inmemory.New(), "/ttl")
+	if err := s.Start(); err != nil {
+		t.Fatal(err)
+	}
+	defer s.Stop()
+
+	for _, ref := range refs {
+		if err := s.AddBlob(ref, time.Hour); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	err := s.ReconcileBlobs(func(r reference.Reference) (int64, bool, error) {
+		switch r.String() {
+		case refs[0].String():
+			return 0, false, nil
+		default:
+			return 42, true, nil
+		}
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if total := s.BlobBytes(); total != 84 {
+		t.Fatalf("unexpected blob bytes after reconcile: %d", total)
+	}
+	if _, ok := s.entries[refs[0].String()]; ok {
+		t.Fatal("expected missing blob to be removed")
+	}
+}
+
+func TestStats(t *testing.T) {
+	refs := testRefsN(t, 4)
+	s := New(dcontext.Background(), inmemory.New(), "/ttl")
+	s.OnBlobExpire(func(r reference.Reference) error {
+		if r.String() == refs[1].String() {
+			return fmt.Errorf("failed to remove %s", r)
+		}
+		return nil
+	})
+	s.OnManifestExpire(func(reference.Reference) error {
+		return nil
+	})
+	if err := s.Start(); err != nil {
+		t.Fatalf("Error starting ttlExpirationScheduler: %s", err)
+	}
+	defer s.Stop()
+
+	if err := s.AddBlob(refs[0], 10*time.Millisecond); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.AddBlob(refs[1], 20*time.Millisecond); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.AddManifest(refs[2], 10*time.Millisecond); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.AddBlobWithSize(refs[3], 1, nil); err != nil {
+		t.Fatal(err)
+	}
+
+	stats := s.Stats()
+	if stats.Blobs != 3 || stats.Manifests != 1 {
+		t.Fatalf("expected 3 blobs and 1 manifest scheduled, got %d and %d", stats.Blobs, stats.Manifests)
+	}
+	if until := time.Until(stats.NextExpiry); until <= 0 || until > 10*time.Millisecond {
+		t.Fatalf("unexpected next expiry in %s", until)
+	}
+
+	deadline := time.Now().Add(5 * time.Second)
+	for stats = s.Stats(); stats.Evictions+stats.EvictionErrors < 3; stats = s.Stats() {
+		if time.Now().After(deadline) {
+			t.Fatalf("entries did not expire: %+v", stats)
+		}
+		time.Sleep(time.Millisecond)
+	}
+
+	// The entry without expiry is left, and the failed expiry is counted.
+	if stats.Blobs != 1 || stats.Manifests != 0 {
+		t.Fatalf("expected 1 blob and no manifest scheduled, got %d and %d", stats.Blobs, stats.Manifests)
+	}
+	if !stats.NextExpiry.IsZero() {
+		t.Fatalf("unexpected next expiry at %s", stats.NextExpiry)
+	}
+	if stats.Evictions != 2 || stats.EvictionErrors != 1 {
+		t.Fatalf("expected 2 evictions and 1 eviction error, got %d and %d", stats.Evictions, stats.EvictionErrors)
+	}
+
+	if _, err := s.EvictBlobs(1); err != nil {
+		t.Fatal(err)
+	}
+	if stats := s.Stats(); stats.Blobs != 0 || stats.Evictions != 3 {
+		t.Fatalf("expected the blob to be evicted, got %+v", stats)
+	}
+}
+
+func TestRetainBlob(t *testing.T) {
+	refs := testRefsN(t, 2)
+	s := New(dcontext.Background(), inmemory.New(), "/ttl")
+
+	var mu sync.Mutex
+	retained := map[string]bool{refs[0].String(): true, refs[1].String(): true}
+	var expired []string
+	s.OnBlobExpire(func(r reference.Reference) error {
+		expired = append(expired, r.String())
+		return nil
+	})
+	s.RetainBlob(func(r reference.Reference) (bool, error) {
+		mu.Lock()
+		defer mu.Unlock()
+		return retained[r.String()], nil
+	})
+	if err := s.Start(); err != nil {
+		t.Fatalf("Error starting ttlExpirationScheduler: %s", err)
+	}
+	defer s.Stop()
+
+	if err := s.AddBlobWithSize(refs[0], 100, nil); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.AddBlob(refs[1], 10*time.Millisecond); err != nil {
+		t.Fatal(err)
+	}
+
+	// The retained blob is rescheduled rather than expired.
+	deadline := time.Now().Add(5 * time.Second)
+	for s.Stats().Rescheduled < 2 {
+		if time.Now().After(deadline) {
+			t.Fatalf("retained blob was not rescheduled: %+v", s.Stats())
+		}
+		time.Sleep(time.Millisecond)
+	}
+	if stats := s.Stats(); stats.Evictions != 0 || stats.Blobs != 2 {
+		t.Fatalf("expected the retained blob to be kept, got %+v", stats)
+	}
+
+	mu.Lock()
+	retained[refs[1].String()] = false
+	mu.Unlock()
+	for s.Stats().Evictions < 1 {
+		if time.Now().After(deadline) {
+			t.Fatalf("blob no longer retained did not expire: %+v", s.Stats())
+		}
+		time.Sleep(time.Millisecond)
+	}
+
+	// Evicting for space does not consult the retain function.
+	if _, err := s.EvictBlobs(1); err != nil {
+		t.Fatal(err)
+	}
+	s.Lock()
+	defer s.Unlock()
+	if len(expired) != 2 || expired[0] != refs[1].String() || expired[1] != refs[0].String() {
+		t.Fatalf("unexpected blobs expired: %v", expired)
+	}
+}
+
+func TestExpirations(t *testing.T) {
+	refs := testRefsN(t, 5)
+	s := New(dcontext.Background(), inmemory.New(), "/ttl")
+	s.OnBlobExpire(func(reference.Reference) error { return nil })
+	s.OnManifestExpire(func(reference.Reference) error { return nil })
+	if err := s.Start(); err != nil {
+		t.Fatalf("Error starting ttlExpirationScheduler: %s", err)
+	}
+	defer s.Stop()
+
+	if err := s.AddBlob(refs[0], 3*time.Hour); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.AddManifest(refs[1], time.Hour); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.AddBlob(refs[2], 48*time.Hour); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.AddBlob(refs[3], 2*time.Hour); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.AddBlobWithSize(refs[4], 1, nil); err != nil {
+		t.Fatal(err)
+	}
+
+	// The entries due within the window are returned soonest first, and
+	// those without expiry never.
+	expirations := s.Expirations(time.Now().Add(24 * time.Hour))
+	if len(expirations) != 3 {
+		t.Fatalf("expected 3 expirations, got %+v", expirations)
+	}
+	for i, expected := range []struct {
+		ref       reference.Canonical
+		entryType string
+	}{{refs[1], "manifest"}, {refs[3], "blob"}, {refs[0], "blob"}} {
+		e := expirations[i]
+		if e.Repository != "testrepo" || e.Reference != expected.ref.Digest().String() || e.Type != expected.entryType {
+			t.Fatalf("expiration %d is %+v, expected %s %s", i, e, expected.entryType, expected.ref)
+		}
+		if i > 0 && !expirations[i-1].Expiry.Before(e.Expiry) {
+			t.Fatalf("expirations not ordered: %+v", expirations)
+		}
+	}
+	if expirations := s.Expirations(time.Now()); len(expirations) != 0 {
+		t.Fatalf("expected no expiration yet, got %+v", expirations)
+	}
+	if expirations := s.Expirations(time.Now().Add(72 * time.Hour)); len(expirations) != 4 || expirations[3].Reference != refs[2].Digest().String() {
+		t.Fatalf("unexpected expirations %+v", expirations)
+	}
+}
+
+func TestRename(t *testing.T) {
+	refs := testRefsN(t, 2)
+	expired := make(chan string, 2)
+	s := New(dcontext.Background(), inmemory.New(), "/ttl")
+	s.OnBlobExpire(func(ref reference.Reference) error {
+		expired <- ref.String()
+		return nil
+	})
+	s.OnManifestExpire(func(reference.Reference) error { return nil })
+	if err := s.Start(); err != nil {
+		t.Fatalf("Error starting ttlExpirationScheduler: %s", err)
+	}
+	defer s.Stop()
+
+	if err := s.AddBlob(refs[0], 100*time.Millisecond); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.AddBlobWithSize(refs[1], 1, nil); err != nil {
+		t.Fatal(err)
+	}
+	other, err := reference.Parse("otherrepo@" + refs[0].Digest().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := s.AddBlob(other.(reference.Canonical), time.Hour); err != nil {
+		t.Fatal(err)
+	}
+
+	renamed, err := reference.WithName("team/testrepo")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Rename(refs[0], renamed); err != nil {
+		t.Fatal(err)
+	}
+	if s.Len() != 3 {
+		t.Fatalf("expected the 3 entries to be kept, got %d", s.Len())
+	}
+	expirations := s.Expirations(time.Time{})
+	if len(expirations) != 2 || expirations[0].Repository != "team/testrepo" || expirations[1].Repository != "otherrepo" {
+		t.Fatalf("unexpected expirations %+v", expirations)
+	}
+
+	// The entries renamed expire under their new name.
+	select {
+	case ref := <-expired:
+		if ref != "team/testrepo@"+refs[0].Digest().String() {
+			t.Fatalf("unexpected expiry of %s", ref)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("the renamed entry did not expire")
+	}
+	if s.Len() != 2 {
+		t.Fatalf("expected 2 entries left, got %d", s.Len())
+	}
+}
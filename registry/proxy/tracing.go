@@ -0,0 +1,18 @@
+package proxy
+
+import (
+	"github.com/distribution/distribution/v3/tracing"
+	"go.opentelemetry.io/otel"
+)
+
+// tracer is the OpenTelemetry tracer of the pull through cache.
+var tracer = otel.Tracer("github.com/distribution/distribution/v3/registry/proxy")
+
+// The attributes of the spans of the pull through cache.
+const (
+	attributeRepository = tracing.AttributePrefix + "repository"
+	attributeDigest     = tracing.AttributePrefix + "digest"
+	attributeSize       = tracing.AttributePrefix + "size"
+	attributeCacheHit   = tracing.AttributePrefix + "proxy.cache.hit"
+	attributeUpstream   = tracing.AttributePrefix + "proxy.upstream"
+)
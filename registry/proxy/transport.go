@@ -0,0 +1,134 @@
+package proxy
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/distribution/distribution/v3/configuration"
+	"github.com/distribution/distribution/v3/internal/dcontext"
+	"go.opentelemetry.io/contrib/instrumentation/net/http/otelhttp"
+	"golang.org/x/net/http/httpproxy"
+)
+
+// newUpstreamTransport returns the transport of the requests to the upstream
+// remote sent with base, which are traced as children of the span of their
+// context, carry the id of the request they are made for, and are measured in
+// the metrics of the remote.
+func newUpstreamTransport(remote string, base http.RoundTripper) http.RoundTripper {
+	return requestIDTransport{otelhttp.NewTransport(upstreamMetricsTransport{RoundTripper: base, remote: remote},
+		otelhttp.WithSpanNameFormatter(func(_ string, r *http.Request) string { return r.Method + " " + r.URL.Path }))}
+}
+
+// newRemoteTransport returns the transport of the requests to a remote, which
+// go through the http proxies configured for the remote, or through those of
+// the environment if it has none.
+func newRemoteTransport(config configuration.ProxyRemote) http.RoundTripper {
+	if config.HTTPProxy == "" && config.HTTPSProxy == "" {
+		return http.DefaultTransport
+	}
+	proxies := (&httpproxy.Config{
+		HTTPProxy:  config.HTTPProxy,
+		HTTPSProxy: config.HTTPSProxy,
+		NoProxy:    config.NoProxy,
+	}).ProxyFunc()
+	tr := http.DefaultTransport.(*http.Transport).Clone()
+	tr.Proxy = func(req *http.Request) (*url.URL, error) {
+		return proxies(req.URL)
+	}
+	return tr
+}
+
+// forwardedRequestIDHeader is the header of the id of the request an upstream
+// request is made for.
+const forwardedRequestIDHeader = "X-Forwarded-Request-Id"
+
+// requestIDTransport sets the id of the request of their context on the
+// upstream requests.
+type requestIDTransport struct {
+	http.RoundTripper
+}
+
+func (t requestIDTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	if id := dcontext.GetRequestID(req.Context()); id != "" {
+		req = req.Clone(req.Context())
+		req.Header.Set(forwardedRequestIDHeader, id)
+	}
+	return t.RoundTripper.RoundTrip(req)
+}
+
+// upstreamMetricsTransport measures the duration of the requests to the
+// upstream remote, until their response headers, and counts their failures.
+// The requests to the token services of the remote are measured with it.
+type upstreamMetricsTransport struct {
+	http.RoundTripper
+	remote string
+}
+
+func (t upstreamMetricsTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	started := time.Now()
+	resp, err := t.RoundTripper.RoundTrip(req)
+
+	var status, category string
+	switch {
+	case errors.Is(err, context.Canceled):
+		// The client went away, the upstream did not fail.
+		status = "canceled"
+	case err != nil:
+		status = "error"
+		category = upstreamErrorCategory(err)
+	default:
+		status = fmt.Sprintf("%dxx", resp.StatusCode/100)
+		// The challenges are part of the authentication to the upstream.
+		if resp.StatusCode >= 400 && resp.StatusCode != http.StatusUnauthorized {
+			category = status
+		}
+	}
+	upstreamRequests.WithValues(t.remote, upstreamRequestType(req), status).UpdateSince(started)
+	if category != "" {
+		upstreamErrors.WithValues(t.remote, category).Inc(1)
+	}
+	return resp, err
+}
+
+// upstreamRequestType returns the type of the request to an upstream: the
+// ping of the API, a manifest or blob request by method, or a token request
+// for those outside the API.
+func upstreamRequestType(req *http.Request) string {
+	path := req.URL.Path
+	api := strings.Index(path, "/v2/")
+	switch {
+	case api < 0:
+		return "token"
+	case path[api:] == "/v2/":
+		return "ping"
+	}
+	// The repository names may have components named like the routes.
+	manifests, blobs := strings.LastIndex(path, "/manifests/"), strings.LastIndex(path, "/blobs/")
+	switch {
+	case manifests > blobs:
+		return "manifest_" + strings.ToLower(req.Method)
+	case blobs > manifests:
+		return "blob_" + strings.ToLower(req.Method)
+	}
+	return "other"
+}
+
+// upstreamErrorCategory returns the category of the failure of a request to
+// an upstream.
+func upstreamErrorCategory(err error) string {
+	var netErr net.Error
+	switch {
+	case errors.Is(err, context.DeadlineExceeded), errors.As(err, &netErr) && netErr.Timeout():
+		return "timeout"
+	case errors.Is(err, syscall.ECONNREFUSED):
+		return "connection_refused"
+	}
+	return "other"
+}
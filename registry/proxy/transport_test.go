@@ -0,0 +1,371 @@
+package proxy
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/distribution/distribution/v3/configuration"
+	"github.com/distribution/distribution/v3/registry/storage"
+	"github.com/distribution/distribution/v3/registry/storage/driver/inmemory"
+	"github.com/distribution/reference"
+	"github.com/docker/go-metrics"
+	"github.com/opencontainers/go-digest"
+)
+
+// recordingProxy is an http proxy, tunneling with CONNECT, which records the
+// requests it forwards and resolves their hosts to the addresses of the test
+// servers, the hosts of the upstreams being unreachable otherwise.
+type recordingProxy struct {
+	*httptest.Server
+	username, password string
+	hosts              map[string]string
+	mu                 sync.Mutex
+	requests           []string
+	denied             int
+}
+
+func newRecordingProxy(t *testing.T, username, password string, hosts map[string]string) *recordingProxy {
+	t.Helper()
+
+	p := &recordingProxy{username: username, password: password, hosts: hosts}
+	p.Server = httptest.NewServer(http.HandlerFunc(p.serve))
+	t.Cleanup(p.Close)
+	return p
+}
+
+// url returns the url of the proxy, with its credentials.
+func (p *recordingProxy) url() string {
+	u, _ := url.Parse(p.URL)
+	if p.username != "" {
+		u.User = url.UserPassword(p.username, p.password)
+	}
+	return u.String()
+}
+
+func (p *recordingProxy) serve(w http.ResponseWriter, r *http.Request) {
+	if p.username != "" {
+		username, password, _ := (&http.Request{Header: http.Header{"Authorization": r.Header.Values("Proxy-Authorization")}}).BasicAuth()
+		if username != p.username || password != p.password {
+			p.mu.Lock()
+			p.denied++
+			p.mu.Unlock()
+			w.Header().Set("Proxy-Authenticate", `Basic realm="proxy"`)
+			w.WriteHeader(http.StatusProxyAuthRequired)
+			return
+		}
+	}
+
+	host := r.Host
+	if _, _, err := net.SplitHostPort(host); err != nil {
+		host = net.JoinHostPort(host, "80")
+	}
+	addr, ok := p.hosts[host]
+	if !ok {
+		w.WriteHeader(http.StatusBadGateway)
+		return
+	}
+
+	p.mu.Lock()
+	if r.Method == http.MethodConnect {
+		p.requests = append(p.requests, "CONNECT "+host)
+	} else {
+		p.requests = append(p.requests, r.Method+" "+r.URL.String())
+	}
+	p.mu.Unlock()
+
+	if r.Method == http.MethodConnect {
+		upstream, err := net.Dial("tcp", addr)
+		if err != nil {
+			w.WriteHeader(http.StatusBadGateway)
+			return
+		}
+		w.WriteHeader(http.StatusOK)
+		conn, _, err := http.NewResponseController(w).Hijack()
+		if err != nil {
+			upstream.Close()
+			return
+		}
+		go func() {
+			_, _ = io.Copy(upstream, conn)
+			upstream.Close()
+		}()
+		_, _ = io.Copy(conn, upstream)
+		conn.Close()
+		return
+	}
+
+	req := r.Clone(r.Context())
+	req.RequestURI = ""
+	req.Header.Del("Proxy-Authorization")
+	resp, err := (&http.Transport{
+		DialContext: func(ctx context.Context, network, _ string) (net.Conn, error) {
+			return (&net.Dialer{}).DialContext(ctx, network, addr)
+		},
+	}).RoundTrip(req)
+	if err != nil {
+		w.WriteHeader(http.StatusBadGateway)
+		return
+	}
+	defer resp.Body.Close()
+	for k, v := range resp.Header {
+		w.Header()[k] = v
+	}
+	w.WriteHeader(resp.StatusCode)
+	_, _ = io.Copy(w, resp.Body)
+}
+
+func (p *recordingProxy) recorded() ([]string, int) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return append([]string(nil), p.requests...), p.denied
+}
+
+func TestRemoteTransportProxies(t *testing.T) {
+	upstream := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	}))
+	t.Cleanup(upstream.Close)
+	hosts := map[string]string{"example.com:443": upstream.Listener.Addr().String()}
+	httpsProxy := newRecordingProxy(t, "proxyuser", "proxypass", hosts)
+	httpProxy := newRecordingProxy(t, "", "", hosts)
+
+	if tr := newRemoteTransport(configuration.ProxyRemote{RemoteURL: "https://example.com"}); tr != http.DefaultTransport {
+		t.Fatalf("unexpected transport %T without proxies", tr)
+	}
+
+	tr := newRemoteTransport(configuration.ProxyRemote{
+		RemoteURL:  "https://example.com",
+		HTTPProxy:  httpProxy.url(),
+		HTTPSProxy: httpsProxy.url(),
+		NoProxy:    "internal.example.com",
+	}).(*http.Transport)
+	tr.TLSClientConfig = upstream.Client().Transport.(*http.Transport).TLSClientConfig
+
+	// The requests over https are tunneled through the authenticated proxy.
+	resp, err := (&http.Client{Transport: tr}).Get("https://example.com/v2/")
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("unexpected status %s", resp.Status)
+	}
+	if requests, denied := httpsProxy.recorded(); len(requests) != 1 || requests[0] != "CONNECT example.com:443" || denied != 0 {
+		t.Fatalf("unexpected requests %q through the https proxy, %d denied", requests, denied)
+	}
+	if requests, _ := httpProxy.recorded(); len(requests) != 0 {
+		t.Fatalf("unexpected requests %q through the http proxy", requests)
+	}
+
+	for target, expected := range map[string]string{
+		"http://example.com/v2/":                httpProxy.URL,
+		"https://example.com/v2/":               httpsProxy.URL,
+		"https://internal.example.com/v2/":      "",
+		"https://registry.internal.example.com": "",
+	} {
+		req := httptest.NewRequest(http.MethodGet, target, nil)
+		proxyURL, err := tr.Proxy(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		proxied := ""
+		if proxyURL != nil {
+			proxied = (&url.URL{Scheme: proxyURL.Scheme, Host: proxyURL.Host}).String()
+		}
+		if proxied != expected {
+			t.Errorf("%s: proxied through %q, expected %q", target, proxied, expected)
+		}
+	}
+
+	// The tokens of ECR are requested through the proxies of the remote.
+	_, _, sess, err := ecrSession(configuration.ECRConfig{AccessKeyID: "key", SecretAccessKey: "secret"}, "https://123456789012.dkr.ecr.us-west-2.amazonaws.com", tr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if sess.Config.HTTPClient.Transport != tr {
+		t.Fatal("expected the ECR session to use the transport of the remote")
+	}
+}
+
+func TestProxyingRegistryRemoteProxies(t *testing.T) {
+	ctx := context.Background()
+	hub := newChallengeUpstream(t, challengeToken, "hubuser", "hubpass")
+	quay := newChallengeUpstream(t, challengeBasic, "quayuser", "quaypass")
+	hosts := map[string]string{
+		"hub.upstream.test:80":  hub.Listener.Addr().String(),
+		"quay.upstream.test:80": quay.Listener.Addr().String(),
+	}
+	hubProxy := newRecordingProxy(t, "proxyuser", "proxypass", hosts)
+	quayProxy := newRecordingProxy(t, "", "", hosts)
+
+	d := inmemory.New()
+	localRegistry, err := storage.NewRegistry(ctx, d)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var ttl time.Duration
+	ns, err := NewRegistryPullThroughCache(ctx, localRegistry, d, configuration.Proxy{
+		TTL:       &ttl,
+		RemoteURL: "http://hub.upstream.test",
+		Username:  "hubuser",
+		Password:  "hubpass",
+		HTTPProxy: hubProxy.url(),
+		Remotes: []configuration.ProxyRemote{{
+			RemoteURL: "http://quay.upstream.test",
+			Prefix:    "quay/",
+			Username:  "quayuser",
+			Password:  "quaypass",
+			HTTPProxy: quayProxy.url(),
+		}},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, name := range []string{"library/app", "quay/app"} {
+		ref, err := reference.WithName(name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		repo, err := ns.Repository(ctx, ref)
+		if err != nil {
+			t.Fatal(err)
+		}
+		manifests, err := repo.Manifests(ctx)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := manifests.Exists(ctx, digest.FromString("manifest")); err != nil {
+			t.Fatalf("%s: unexpected error: %v", name, err)
+		}
+	}
+
+	// Each remote is reached through its own proxy only, including its token
+	// service.
+	manifest := "/v2/%s/manifests/" + digest.FromString("manifest").String()
+	for _, tc := range []struct {
+		proxy    *recordingProxy
+		host     string
+		expected []string
+	}{
+		{hubProxy, "http://hub.upstream.test", []string{"GET /v2/", "GET /v2/", "GET /token", "HEAD " + fmt.Sprintf(manifest, "library/app")}},
+		{quayProxy, "http://quay.upstream.test", []string{"GET /v2/", "GET /v2/", "HEAD " + fmt.Sprintf(manifest, "app")}},
+	} {
+		requests, denied := tc.proxy.recorded()
+		if denied != 0 {
+			t.Errorf("%s: %d requests denied by the proxy", tc.host, denied)
+		}
+		if len(requests) != len(tc.expected) {
+			t.Fatalf("%s: unexpected requests %q through the proxy", tc.host, requests)
+		}
+		for i, request := range requests {
+			method, path, _ := strings.Cut(tc.expected[i], " ")
+			u, err := url.Parse(strings.TrimPrefix(request, method+" "))
+			if err != nil || !strings.HasPrefix(request, method+" "+tc.host+"/") || u.Path != path {
+				t.Errorf("%s: unexpected request %q through the proxy, expected %s", tc.host, request, tc.expected[i])
+			}
+		}
+	}
+}
+
+// scrapeUpstream returns the values of the samples of the upstream metrics of
+// the remote.
+func scrapeUpstream(t *testing.T, remote string) map[string]float64 {
+	t.Helper()
+	rec := httptest.NewRecorder()
+	metrics.Handler().ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/metrics", nil))
+
+	samples := make(map[string]float64)
+	scanner := bufio.NewScanner(rec.Body)
+	for scanner.Scan() {
+		line := scanner.Text()
+		if !strings.HasPrefix(line, "registry_proxy_upstream_") || !strings.Contains(line, `remote="`+remote+`"`) {
+			continue
+		}
+		i := strings.LastIndexByte(line, ' ')
+		value, err := strconv.ParseFloat(line[i+1:], 64)
+		if err != nil {
+			t.Fatalf("error parsing sample %q: %v", line, err)
+		}
+		name := strings.NewReplacer(`remote="`+remote+`",`, "", `,remote="`+remote+`"`, "").Replace(line[:i])
+		samples[name] = value
+	}
+	return samples
+}
+
+func TestUpstreamMetrics(t *testing.T) {
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch {
+		case r.URL.Path == "/v2/":
+			w.WriteHeader(http.StatusUnauthorized)
+		case r.URL.Path == "/token":
+			fmt.Fprint(w, `{"token": "token"}`)
+		case strings.HasSuffix(r.URL.Path, "/manifests/slow"):
+			time.Sleep(300 * time.Millisecond)
+		case strings.HasSuffix(r.URL.Path, "/manifests/missing"):
+			w.WriteHeader(http.StatusNotFound)
+		case strings.Contains(r.URL.Path, "/blobs/"):
+			w.WriteHeader(http.StatusBadGateway)
+		}
+	}))
+	defer upstream.Close()
+	refused := httptest.NewServer(http.NotFoundHandler())
+	refused.Close()
+
+	remote := strings.TrimPrefix(upstream.URL, "http://")
+	client := &http.Client{Transport: newUpstreamTransport(remote, http.DefaultTransport)}
+	send := func(ctx context.Context, method, u string) {
+		t.Helper()
+		req, err := http.NewRequestWithContext(ctx, method, u, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp, err := client.Do(req)
+		if err == nil {
+			resp.Body.Close()
+		}
+	}
+	send(context.Background(), http.MethodGet, upstream.URL+"/v2/")
+	send(context.Background(), http.MethodGet, upstream.URL+"/token?scope=repository:library/app:pull")
+	send(context.Background(), http.MethodGet, upstream.URL+"/v2/library/app/manifests/slow")
+	send(context.Background(), http.MethodHead, upstream.URL+"/v2/library/app/manifests/missing")
+	send(context.Background(), http.MethodGet, upstream.URL+"/v2/library/manifests/app/blobs/"+digest.FromString("blob").String())
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	send(ctx, http.MethodGet, upstream.URL+"/v2/library/app/manifests/slow")
+	send(context.Background(), http.MethodGet, refused.URL+"/v2/library/app/manifests/latest")
+
+	samples := scrapeUpstream(t, remote)
+	for sample, expected := range map[string]float64{
+		`registry_proxy_upstream_request_seconds_count{status="4xx",type="ping"}`:                      1,
+		`registry_proxy_upstream_request_seconds_count{status="2xx",type="token"}`:                     1,
+		`registry_proxy_upstream_request_seconds_bucket{status="2xx",type="manifest_get",le="0.25"}`:   0,
+		`registry_proxy_upstream_request_seconds_bucket{status="2xx",type="manifest_get",le="0.5"}`:    1,
+		`registry_proxy_upstream_request_seconds_bucket{status="4xx",type="manifest_head",le="0.25"}`:  1,
+		`registry_proxy_upstream_request_seconds_bucket{status="5xx",type="blob_get",le="0.25"}`:       1,
+		`registry_proxy_upstream_request_seconds_bucket{status="error",type="manifest_get",le="0.25"}`: 2,
+		`registry_proxy_upstream_errors_total{category="4xx"}`:                                         1,
+		`registry_proxy_upstream_errors_total{category="5xx"}`:                                         1,
+		`registry_proxy_upstream_errors_total{category="timeout"}`:                                     1,
+		`registry_proxy_upstream_errors_total{category="connection_refused"}`:                          1,
+	} {
+		if samples[sample] != expected {
+			t.Errorf("unexpected value %v of %s, expected %v", samples[sample], sample, expected)
+		}
+	}
+	// The challenges are not counted as failures.
+	if _, ok := samples[`registry_proxy_upstream_errors_total{category="other"}`]; ok {
+		t.Errorf("unexpected failures %v", samples)
+	}
+}
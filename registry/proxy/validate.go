@@ -0,0 +1,194 @@
+package proxy
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/url"
+	"path"
+	"strings"
+
+	"github.com/distribution/distribution/v3/configuration"
+)
+
+// Validate checks the configuration of the pull through cache and of its
+// remotes, without contacting them. The returned warnings describe settings
+// which are valid but likely not what was meant.
+func Validate(config configuration.Proxy) (warnings []string, err error) {
+	remotes := config.RemoteConfigs()
+	if len(remotes) == 0 {
+		return nil, fmt.Errorf("no proxy remote configured")
+	}
+	for _, remote := range remotes {
+		w, err := ValidateRemote(remote)
+		if err != nil {
+			return nil, err
+		}
+		warnings = append(warnings, w...)
+	}
+
+	switch config.Mode {
+	case "", configuration.ProxyModeCache:
+	case configuration.ProxyModeStreamThrough:
+		var ignored []string
+		if config.TTL != nil || config.ManifestTTL != nil || config.BlobTTL != nil || len(config.MediaTypeTTLs) > 0 {
+			ignored = append(ignored, "ttl")
+		}
+		if config.MaxCacheSize > 0 {
+			ignored = append(ignored, "maxcachesize")
+		}
+		if config.MaxCacheBlobSize > 0 {
+			ignored = append(ignored, "maxcacheblobsize")
+		}
+		if config.FetchOnMount {
+			ignored = append(ignored, "fetchonmount")
+		}
+		if config.Prefetch.Enabled {
+			ignored = append(ignored, "prefetch")
+		}
+		if config.SeedFile != "" {
+			ignored = append(ignored, "seedfile")
+		}
+		if len(ignored) > 0 {
+			warnings = append(warnings, fmt.Sprintf("proxy %s ignored in the %s mode, which caches nothing", strings.Join(ignored, ", "), config.Mode))
+		}
+	default:
+		return nil, fmt.Errorf("unknown proxy mode %q", config.Mode)
+	}
+
+	switch config.QuotaPolicy {
+	case "", configuration.ProxyQuotaPolicyEvict, configuration.ProxyQuotaPolicyStream:
+	default:
+		return nil, fmt.Errorf("unknown proxy quota policy %q", config.QuotaPolicy)
+	}
+	if config.MaxCacheSize < 0 {
+		return nil, fmt.Errorf("proxy maxcachesize must be a non-negative integer value")
+	}
+	if config.MaxCacheBlobSize < 0 {
+		return nil, fmt.Errorf("proxy maxcacheblobsize must be a non-negative integer value")
+	}
+	if config.Prefetch.Concurrency < 0 || config.Prefetch.MaxSize < 0 {
+		return nil, fmt.Errorf("proxy prefetch concurrency and maxsize must be non-negative integer values")
+	}
+	for pattern := range config.MediaTypeTTLs {
+		if _, err := path.Match(pattern, ""); err != nil {
+			return nil, fmt.Errorf("invalid proxy mediatypettls pattern %q: %v", pattern, err)
+		}
+	}
+	if config.ParallelFetch.Threshold < 0 || config.ParallelFetch.PartSize < 0 || config.ParallelFetch.Concurrency < 0 {
+		return nil, fmt.Errorf("proxy parallelfetch threshold, partsize and concurrency must be non-negative integer values")
+	}
+	for _, pattern := range config.Verification.Repositories {
+		if _, err := path.Match(pattern, ""); err != nil {
+			return nil, fmt.Errorf("invalid proxy verification repository pattern %q: %v", pattern, err)
+		}
+	}
+	if len(config.Verification.Repositories) > 0 && !config.Verification.Enabled() {
+		warnings = append(warnings, "proxy verification repositories are set, but no keys nor keyless identities")
+	}
+	return warnings, nil
+}
+
+// ValidateRemote checks the url, the http proxies and the credentials of a
+// remote. The ecr
+// credentials are only valid for an ecr remote, unless both the account id
+// and the region are set. Of several credentials, the ecr ones are used
+// first, then the exec ones and then the username, which is warned about.
+func ValidateRemote(config configuration.ProxyRemote) (warnings []string, err error) {
+	if config.RemoteURL == "" {
+		return nil, fmt.Errorf("proxy remote with prefix %q has no remoteurl", config.Prefix)
+	}
+	remoteURL, err := url.Parse(config.RemoteURL)
+	if err != nil {
+		return nil, err
+	}
+	if remoteURL.Scheme != "http" && remoteURL.Scheme != "https" {
+		return nil, fmt.Errorf("proxy remoteurl %q must be an http or https url", config.RemoteURL)
+	}
+	if remoteURL.Host == "" {
+		return nil, fmt.Errorf("proxy remoteurl %q has no host", config.RemoteURL)
+	}
+
+	for _, proxy := range []struct{ name, url string }{
+		{"httpproxy", config.HTTPProxy},
+		{"httpsproxy", config.HTTPSProxy},
+	} {
+		if proxy.url == "" {
+			continue
+		}
+		// The url is left out of the errors, for the credentials it may hold.
+		proxyURL, err := url.Parse(proxy.url)
+		if err != nil {
+			return nil, fmt.Errorf("proxy remote %q has a malformed %s url", config.RemoteURL, proxy.name)
+		}
+		switch proxyURL.Scheme {
+		case "http", "https", "socks5":
+		default:
+			return nil, fmt.Errorf("proxy remote %q %s must be an http, https or socks5 url", config.RemoteURL, proxy.name)
+		}
+		if proxyURL.Host == "" {
+			return nil, fmt.Errorf("proxy remote %q %s has no host", config.RemoteURL, proxy.name)
+		}
+	}
+	if config.NoProxy != "" && config.HTTPProxy == "" && config.HTTPSProxy == "" {
+		warnings = append(warnings, fmt.Sprintf("proxy remote %q has a noproxy list, but no httpproxy nor httpsproxy", config.RemoteURL))
+	}
+
+	ecr := isECRURL(config.RemoteURL)
+	if config.ECR != nil && !ecr {
+		if config.ECR.AccountID == "" || config.ECR.Region == "" {
+			return nil, fmt.Errorf("proxy remoteurl %q is not an ecr registry, the ecr accountid and region must be set", config.RemoteURL)
+		}
+		warnings = append(warnings, fmt.Sprintf("proxy remoteurl %q is not an ecr registry, but ecr credentials are set", config.RemoteURL))
+	}
+
+	if _, err := newTagFilter(config.TagFilter); err != nil {
+		return nil, err
+	}
+	if config.TagFilter.Passthrough && len(config.TagFilter.Allow) == 0 && len(config.TagFilter.Deny) == 0 {
+		warnings = append(warnings, fmt.Sprintf("proxy remote %q passes through the tags filtered out, but has no tagfilter pattern", config.RemoteURL))
+	}
+
+	var methods []string
+	if config.ECR != nil {
+		methods = append(methods, "ecr")
+	}
+	if config.Exec != nil {
+		methods = append(methods, "exec")
+	}
+	if config.Username != "" {
+		methods = append(methods, "username")
+	}
+	if len(methods) > 1 {
+		warnings = append(warnings, fmt.Sprintf("proxy remote %q has %s credentials, only the %s ones are used", config.RemoteURL, strings.Join(methods, " and "), methods[0]))
+	}
+	return warnings, nil
+}
+
+// ProbeRemote checks that the remote can be reached and that its credentials
+// are accepted, requesting its base route.
+func ProbeRemote(ctx context.Context, config configuration.ProxyRemote) error {
+	remote, err := newProxyRemote(ctx, config)
+	if err != nil {
+		return err
+	}
+	if err := remote.authChallenger.tryEstablishChallenges(ctx); err != nil {
+		return fmt.Errorf("failed to reach proxy remote %s: %v", remote.remoteURL.Redacted(), err)
+	}
+
+	base := remote.remoteURL
+	base.Path = "/v2/"
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, base.String(), nil)
+	if err != nil {
+		return err
+	}
+	resp, err := (&http.Client{Transport: remote.transport(ctx)}).Do(req)
+	if err != nil {
+		return fmt.Errorf("failed to reach proxy remote %s: %v", remote.remoteURL.Redacted(), err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("unexpected status from proxy remote %s: %s", remote.remoteURL.Redacted(), resp.Status)
+	}
+	return nil
+}
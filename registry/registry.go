@@ -10,12 +10,13 @@ import (
 	"os"
 	"os/signal"
 	"strings"
+	"sync"
+	"sync/atomic"
 	"syscall"
 	"time"
 
 	logstash "github.com/bshuster-repo/logrus-logstash-hook"
 	"github.com/docker/go-metrics"
-	gorhandlers "github.com/gorilla/handlers"
 	"github.com/sirupsen/logrus"
 	"github.com/spf13/cobra"
 	"go.opentelemetry.io/contrib/instrumentation/net/http/otelhttp"
@@ -27,6 +28,7 @@ import (
 	"github.com/distribution/distribution/v3/configuration"
 	"github.com/distribution/distribution/v3/health"
 	"github.com/distribution/distribution/v3/internal/dcontext"
+	"github.com/distribution/distribution/v3/registry/accesslog"
 	"github.com/distribution/distribution/v3/registry/handlers"
 	"github.com/distribution/distribution/v3/registry/listener"
 	"github.com/distribution/distribution/v3/tracing"
@@ -73,6 +75,11 @@ var defaultCipherSuites = []uint16{
 
 const defaultTLSVersionStr = "tls1.2"
 
+// defaultDrainTimeout bounds the shutdown of the registry, unless set by
+// http.draintimeout. It is shorter than the 30 seconds orchestrators usually
+// wait for after the stop signal before killing the process.
+const defaultDrainTimeout = 20 * time.Second
+
 // tlsVersions maps user-specified values to tls version constants.
 var tlsVersions = map[string]uint16{
 	"tls1.2": tls.VersionTLS12,
@@ -121,6 +128,12 @@ var ServeCmd = &cobra.Command{
 			logrus.Fatalln(err)
 		}
 
+		if err := registry.enableReload(configurationPath(args)); err != nil {
+			logrus.Fatalln(err)
+		}
+		if config.HTTP.Debug.Addr != "" {
+			http.Handle(reloadPath, registry.reloadHandler())
+		}
 		configureDebugServer(config)
 
 		if err = registry.ListenAndServe(); err != nil {
@@ -137,6 +150,16 @@ type Registry struct {
 	app    *handlers.App
 	server *http.Server
 	quit   chan os.Signal
+	// draining fails the readiness checks once the registry shuts down.
+	draining *atomic.Bool
+
+	// configPath is the path of the configuration file reloaded, if any.
+	configPath string
+	// loaded is the configuration last loaded from the file, which the
+	// reloaded configuration is compared to. It is parsed apart from config,
+	// which the application modifies on startup.
+	loaded   *configuration.Configuration
+	reloadMu sync.Mutex
 }
 
 // NewRegistry creates a new registry from a context and configuration struct.
@@ -151,19 +174,24 @@ func NewRegistry(ctx context.Context, config *configuration.Configuration) (*Reg
 	// TODO(aaronl): The global scope of the health checks means NewRegistry
 	// can only be called once per process.
 	app.RegisterHealthChecks()
+	draining := new(atomic.Bool)
 	var handler http.Handler = app
 	handler = alive("/", handler)
+	handler = ready("/ready", draining, handler)
 	handler = health.Handler(handler)
 	handler = panicHandler(handler)
 	if !config.Log.AccessLog.Disabled {
-		handler = gorhandlers.CombinedLoggingHandler(os.Stdout, handler)
+		handler, err = accesslog.NewHandler(os.Stdout, config.Log.AccessLog, handler)
+		if err != nil {
+			return nil, fmt.Errorf("error configuring access log: %v", err)
+		}
 	}
 
 	for _, applyHandlerMiddleware := range handlerMiddlewares {
 		handler = applyHandlerMiddleware(config, handler)
 	}
 
-	err = tracing.InitOpenTelemetry(app.Context)
+	err = tracing.InitOpenTelemetry(app.Context, config.Tracing)
 	if err != nil {
 		return nil, fmt.Errorf("error during open telemetry initialization: %v", err)
 	}
@@ -177,10 +205,11 @@ func NewRegistry(ctx context.Context, config *configuration.Configuration) (*Reg
 	}
 
 	return &Registry{
-		app:    app,
-		config: config,
-		server: server,
-		quit:   make(chan os.Signal, 1),
+		app:      app,
+		config:   config,
+		server:   server,
+		quit:     make(chan os.Signal, 1),
+		draining: draining,
 	}, nil
 }
 
@@ -237,125 +266,116 @@ func (registry *Registry) ListenAndServe() error {
 		return err
 	}
 
+	if config.Log.Audit.Output != "" && len(reopenSignals) > 0 {
+		// The audit log is reopened once rotated by an external tool.
+		reopen := make(chan os.Signal, 1)
+		signal.Notify(reopen, reopenSignals...)
+		go func() {
+			for range reopen {
+				if err := registry.app.ReopenAuditLog(); err != nil {
+					dcontext.GetLogger(registry.app).Errorf("failed to reopen the audit log: %v", err)
+				}
+			}
+		}()
+	}
+
+	if registry.configPath != "" && len(reloadSignals) > 0 {
+		reload := make(chan os.Signal, 1)
+		signal.Notify(reload, reloadSignals...)
+		go func() {
+			for range reload {
+				if _, err := registry.Reload(); err != nil {
+					dcontext.GetLogger(registry.app).Errorf("failed to reload the configuration: %v", err)
+				}
+			}
+		}()
+	}
+
 	if config.HTTP.TLS.Certificate != "" || config.HTTP.TLS.LetsEncrypt.CacheFile != "" {
-		if config.HTTP.TLS.MinimumTLS == "" {
-			config.HTTP.TLS.MinimumTLS = defaultTLSVersionStr
+		tlsConf, err := newTLSConfig(config)
+		if err != nil {
+			return err
 		}
-		tlsMinVersion, ok := tlsVersions[config.HTTP.TLS.MinimumTLS]
-		if !ok {
-			return fmt.Errorf("unknown minimum TLS level '%s' specified for http.tls.minimumtls", config.HTTP.TLS.MinimumTLS)
+		logger := dcontext.GetLogger(registry.app)
+		minimumTLS := config.HTTP.TLS.MinimumTLS
+		if minimumTLS == "" {
+			minimumTLS = defaultTLSVersionStr
 		}
-		dcontext.GetLogger(registry.app).Infof("restricting TLS version to %s or higher", config.HTTP.TLS.MinimumTLS)
-
-		var tlsCipherSuites []uint16
+		logger.Infof("restricting TLS version to %s or higher", minimumTLS)
 		// configuring cipher suites are no longer supported after the tls1.3.
 		// (https://go.dev/blog/tls-cipher-suites)
-		if tlsMinVersion > tls.VersionTLS12 {
-			dcontext.GetLogger(registry.app).Warnf("restricting TLS cipher suites to empty. Because configuring cipher suites is no longer supported in %s", config.HTTP.TLS.MinimumTLS)
+		if tlsConf.MinVersion > tls.VersionTLS12 {
+			logger.Warnf("restricting TLS cipher suites to empty. Because configuring cipher suites is no longer supported in %s", minimumTLS)
 		} else {
-			tlsCipherSuites, err = getCipherSuites(config.HTTP.TLS.CipherSuites)
-			if err != nil {
-				return err
-			}
-			dcontext.GetLogger(registry.app).Infof("restricting TLS cipher suites to: %s", strings.Join(getCipherSuiteNames(tlsCipherSuites), ","))
-		}
-
-		tlsConf := &tls.Config{
-			ClientAuth:   tls.NoClientCert,
-			NextProtos:   nextProtos(config),
-			MinVersion:   tlsMinVersion,
-			CipherSuites: tlsCipherSuites,
+			logger.Infof("restricting TLS cipher suites to: %s", strings.Join(getCipherSuiteNames(tlsConf.CipherSuites), ","))
 		}
-
-		if config.HTTP.TLS.LetsEncrypt.CacheFile != "" {
-			if config.HTTP.TLS.Certificate != "" {
-				return fmt.Errorf("cannot specify both certificate and Let's Encrypt")
-			}
-			m := &autocert.Manager{
-				HostPolicy: autocert.HostWhitelist(config.HTTP.TLS.LetsEncrypt.Hosts...),
-				Cache:      autocert.DirCache(config.HTTP.TLS.LetsEncrypt.CacheFile),
-				Email:      config.HTTP.TLS.LetsEncrypt.Email,
-				Prompt:     autocert.AcceptTOS,
-				Client:     setDirectoryURL(config.HTTP.TLS.LetsEncrypt.DirectoryURL),
-			}
-			tlsConf.GetCertificate = m.GetCertificate
-			tlsConf.NextProtos = append(tlsConf.NextProtos, acme.ALPNProto)
-		} else {
-			tlsConf.Certificates = make([]tls.Certificate, 1)
-			tlsConf.Certificates[0], err = tls.LoadX509KeyPair(config.HTTP.TLS.Certificate, config.HTTP.TLS.Key)
-			if err != nil {
-				return err
+		if tlsConf.ClientCAs != nil {
+			for _, subj := range tlsConf.ClientCAs.Subjects() { //nolint:staticcheck // FIXME(thaJeztah): ignore SA1019: ac.(*accessController).rootCerts.Subjects has been deprecated since Go 1.18: if s was returned by SystemCertPool, Subjects will not include the system roots. (staticcheck)
+				logger.Debugf("CA Subject: %s", string(subj))
 			}
 		}
 
-		if len(config.HTTP.TLS.ClientCAs) != 0 {
-			pool := x509.NewCertPool()
-
-			for _, ca := range config.HTTP.TLS.ClientCAs {
-				caPem, err := os.ReadFile(ca)
-				if err != nil {
-					return err
-				}
-
-				if ok := pool.AppendCertsFromPEM(caPem); !ok {
-					return fmt.Errorf("could not add CA to pool")
-				}
-			}
-
-			for _, subj := range pool.Subjects() { //nolint:staticcheck // FIXME(thaJeztah): ignore SA1019: ac.(*accessController).rootCerts.Subjects has been deprecated since Go 1.18: if s was returned by SystemCertPool, Subjects will not include the system roots. (staticcheck)
-				dcontext.GetLogger(registry.app).Debugf("CA Subject: %s", string(subj))
-			}
-
-			if config.HTTP.TLS.ClientAuth != "" {
-				tlsClientAuthMod, ok := tlsClientAuth[string(config.HTTP.TLS.ClientAuth)]
-
-				if !ok {
-					return fmt.Errorf("unknown client auth mod '%s' specified for http.tls.clientauth", config.HTTP.TLS.ClientAuth)
-				}
-
-				tlsConf.ClientAuth = tlsClientAuthMod
-			} else {
-				tlsConf.ClientAuth = tls.RequireAndVerifyClientCert
-			}
-
-			tlsConf.ClientCAs = pool
-		}
-
 		ln = tls.NewListener(ln, tlsConf)
 		dcontext.GetLogger(registry.app).Infof("listening on %v, tls", ln.Addr())
 	} else {
 		dcontext.GetLogger(registry.app).Infof("listening on %v", ln.Addr())
 	}
 
-	if config.HTTP.DrainTimeout == 0 {
-		return registry.server.Serve(ln)
-	}
-
 	// setup channel to get notified on SIGTERM signal
 	signal.Notify(registry.quit, os.Interrupt, syscall.SIGTERM)
-	serveErr := make(chan error)
+	serveErr := make(chan error, 1)
 
 	// Start serving in goroutine and listen for stop signal in main thread
 	go func() {
 		serveErr <- registry.server.Serve(ln)
 	}()
 
+	if config.Proxy.SeedFile != "" {
+		// The cache is seeded in the background once the registry listens.
+		go func() {
+			if _, err := registry.app.SeedProxyCache(config.Proxy.SeedFile); err != nil {
+				dcontext.GetLogger(registry.app).Errorf("failed to seed the proxy cache: %v", err)
+			}
+		}()
+	}
+
 	select {
 	case err := <-serveErr:
 		return err
 	case <-registry.quit:
-		dcontext.GetLogger(registry.app).Info("stopping server gracefully. Draining connections for ", config.HTTP.DrainTimeout)
+		drainTimeout := config.HTTP.DrainTimeout
+		if drainTimeout == 0 {
+			drainTimeout = defaultDrainTimeout
+		}
+		dcontext.GetLogger(registry.app).Info("stopping server gracefully. Draining connections for ", drainTimeout)
 		// shutdown the server with a grace period of configured timeout
-		c, cancel := context.WithTimeout(context.Background(), config.HTTP.DrainTimeout)
+		c, cancel := context.WithTimeout(context.Background(), drainTimeout)
 		defer cancel()
+		// A second signal stops the registry without waiting.
+		go func() {
+			select {
+			case <-registry.quit:
+				dcontext.GetLogger(registry.app).Warn("stopping server immediately")
+				cancel()
+			case <-c.Done():
+			}
+		}()
 		return registry.Shutdown(c)
 	}
 }
 
-// Shutdown gracefully shuts down the registry's HTTP server and application object.
+// Shutdown gracefully shuts down the registry's HTTP server and application
+// object. The readiness checks fail and the listeners are closed at once, the
+// requests in flight are served until ctx is done, and then the application
+// flushes the notifications within what is left of ctx.
 func (registry *Registry) Shutdown(ctx context.Context) error {
+	registry.draining.Store(true)
 	err := registry.server.Shutdown(ctx)
-	if appErr := registry.app.Shutdown(); appErr != nil {
+	if err != nil {
+		// The requests still in flight are cut off.
+		registry.server.Close()
+	}
+	if appErr := registry.app.Shutdown(ctx); appErr != nil {
 		err = errors.Join(err, appErr)
 	}
 	return err
@@ -387,46 +407,57 @@ func configurePrometheus(config *configuration.Configuration) {
 // configureLogging prepares the context with a logger using the
 // configuration.
 func configureLogging(ctx context.Context, config *configuration.Configuration) (context.Context, error) {
-	logrus.SetLevel(logLevel(config.Log.Level))
-	logrus.SetReportCaller(config.Log.ReportCaller)
+	if err := configureLogger(config.Log); err != nil {
+		return ctx, err
+	}
+
+	if len(config.Log.Fields) > 0 {
+		// build up the static fields, if present.
+		var fields []any
+		for k := range config.Log.Fields {
+			fields = append(fields, k)
+		}
+
+		ctx = dcontext.WithValues(ctx, config.Log.Fields)
+		ctx = dcontext.WithLogger(ctx, dcontext.GetLogger(ctx, fields...))
+	}
+
+	dcontext.SetDefaultLogger(dcontext.GetLogger(ctx))
+	return ctx, nil
+}
 
-	formatter := config.Log.Formatter
+// configureLogger sets the level, formatter and caller reporting of the
+// logger, which are left unchanged if the formatter is not supported.
+func configureLogger(config configuration.Log) error {
+	formatter := config.Formatter
 	if formatter == "" {
 		formatter = defaultLogFormatter
 	}
 
+	var logFormatter logrus.Formatter
 	switch formatter {
 	case "json":
-		logrus.SetFormatter(&logrus.JSONFormatter{
+		logFormatter = &logrus.JSONFormatter{
 			TimestampFormat:   time.RFC3339Nano,
 			DisableHTMLEscape: true,
-		})
+		}
 	case "text":
-		logrus.SetFormatter(&logrus.TextFormatter{
+		logFormatter = &logrus.TextFormatter{
 			TimestampFormat: time.RFC3339Nano,
-		})
+		}
 	case "logstash":
-		logrus.SetFormatter(&logstash.LogstashFormatter{
+		logFormatter = &logstash.LogstashFormatter{
 			Formatter: &logrus.JSONFormatter{TimestampFormat: time.RFC3339Nano},
-		})
+		}
 	default:
-		return ctx, fmt.Errorf("unsupported logging formatter: %q", formatter)
+		return fmt.Errorf("unsupported logging formatter: %q", formatter)
 	}
 
+	logrus.SetLevel(logLevel(config.Level))
+	logrus.SetReportCaller(config.ReportCaller)
+	logrus.SetFormatter(logFormatter)
 	logrus.Debugf("using %q logging formatter", formatter)
-	if len(config.Log.Fields) > 0 {
-		// build up the static fields, if present.
-		var fields []any
-		for k := range config.Log.Fields {
-			fields = append(fields, k)
-		}
-
-		ctx = dcontext.WithValues(ctx, config.Log.Fields)
-		ctx = dcontext.WithLogger(ctx, dcontext.GetLogger(ctx, fields...))
-	}
-
-	dcontext.SetDefaultLogger(dcontext.GetLogger(ctx))
-	return ctx, nil
+	return nil
 }
 
 func logLevel(level configuration.Loglevel) logrus.Level {
@@ -470,20 +501,45 @@ func alive(path string, handler http.Handler) http.Handler {
 	})
 }
 
-func resolveConfiguration(args []string) (*configuration.Configuration, error) {
-	var configurationPath string
+// ready wraps the handler with a route for the readiness checks, which
+// returns an http 200 response until the registry shuts down, and an http 503
+// response while it drains the requests in flight. Unlike alive, it tells load
+// balancers to stop sending requests before the registry exits.
+func ready(path string, draining *atomic.Bool, handler http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == path {
+			w.Header().Set("Cache-Control", "no-cache")
+			if draining.Load() {
+				w.WriteHeader(http.StatusServiceUnavailable)
+				return
+			}
+			w.WriteHeader(http.StatusOK)
+			return
+		}
 
-	if len(args) > 0 {
-		configurationPath = args[0]
-	} else if os.Getenv("REGISTRY_CONFIGURATION_PATH") != "" {
-		configurationPath = os.Getenv("REGISTRY_CONFIGURATION_PATH")
-	}
+		handler.ServeHTTP(w, r)
+	})
+}
 
-	if configurationPath == "" {
+func resolveConfiguration(args []string) (*configuration.Configuration, error) {
+	path := configurationPath(args)
+	if path == "" {
 		return nil, fmt.Errorf("configuration path unspecified")
 	}
+	return parseConfigurationFile(path)
+}
 
-	fp, err := os.Open(configurationPath)
+// configurationPath returns the path of the configuration file, from the
+// arguments or the environment.
+func configurationPath(args []string) string {
+	if len(args) > 0 {
+		return args[0]
+	}
+	return os.Getenv("REGISTRY_CONFIGURATION_PATH")
+}
+
+func parseConfigurationFile(path string) (*configuration.Configuration, error) {
+	fp, err := os.Open(path)
 	if err != nil {
 		return nil, err
 	}
@@ -492,12 +548,92 @@ func resolveConfiguration(args []string) (*configuration.Configuration, error) {
 
 	config, err := configuration.Parse(fp)
 	if err != nil {
-		return nil, fmt.Errorf("error parsing %s: %v", configurationPath, err)
+		return nil, fmt.Errorf("error parsing %s: %v", path, err)
 	}
 
 	return config, nil
 }
 
+// newTLSConfig returns the TLS configuration of the http server, loading
+// its certificate and client CAs.
+func newTLSConfig(config *configuration.Configuration) (*tls.Config, error) {
+	minimumTLS := config.HTTP.TLS.MinimumTLS
+	if minimumTLS == "" {
+		minimumTLS = defaultTLSVersionStr
+	}
+	tlsMinVersion, ok := tlsVersions[minimumTLS]
+	if !ok {
+		return nil, fmt.Errorf("unknown minimum TLS level '%s' specified for http.tls.minimumtls", minimumTLS)
+	}
+
+	var tlsCipherSuites []uint16
+	if tlsMinVersion <= tls.VersionTLS12 {
+		var err error
+		tlsCipherSuites, err = getCipherSuites(config.HTTP.TLS.CipherSuites)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	tlsConf := &tls.Config{
+		ClientAuth:   tls.NoClientCert,
+		NextProtos:   nextProtos(config),
+		MinVersion:   tlsMinVersion,
+		CipherSuites: tlsCipherSuites,
+	}
+
+	if config.HTTP.TLS.LetsEncrypt.CacheFile != "" {
+		if config.HTTP.TLS.Certificate != "" {
+			return nil, fmt.Errorf("cannot specify both certificate and Let's Encrypt")
+		}
+		m := &autocert.Manager{
+			HostPolicy: autocert.HostWhitelist(config.HTTP.TLS.LetsEncrypt.Hosts...),
+			Cache:      autocert.DirCache(config.HTTP.TLS.LetsEncrypt.CacheFile),
+			Email:      config.HTTP.TLS.LetsEncrypt.Email,
+			Prompt:     autocert.AcceptTOS,
+			Client:     setDirectoryURL(config.HTTP.TLS.LetsEncrypt.DirectoryURL),
+		}
+		tlsConf.GetCertificate = m.GetCertificate
+		tlsConf.NextProtos = append(tlsConf.NextProtos, acme.ALPNProto)
+	} else {
+		cert, err := tls.LoadX509KeyPair(config.HTTP.TLS.Certificate, config.HTTP.TLS.Key)
+		if err != nil {
+			return nil, err
+		}
+		tlsConf.Certificates = []tls.Certificate{cert}
+	}
+
+	if len(config.HTTP.TLS.ClientCAs) != 0 {
+		pool := x509.NewCertPool()
+
+		for _, ca := range config.HTTP.TLS.ClientCAs {
+			caPem, err := os.ReadFile(ca)
+			if err != nil {
+				return nil, err
+			}
+
+			if ok := pool.AppendCertsFromPEM(caPem); !ok {
+				return nil, fmt.Errorf("could not add CA to pool")
+			}
+		}
+
+		if config.HTTP.TLS.ClientAuth != "" {
+			tlsClientAuthMod, ok := tlsClientAuth[string(config.HTTP.TLS.ClientAuth)]
+
+			if !ok {
+				return nil, fmt.Errorf("unknown client auth mod '%s' specified for http.tls.clientauth", config.HTTP.TLS.ClientAuth)
+			}
+
+			tlsConf.ClientAuth = tlsClientAuthMod
+		} else {
+			tlsConf.ClientAuth = tls.RequireAndVerifyClientCert
+		}
+
+		tlsConf.ClientCAs = pool
+	}
+	return tlsConf, nil
+}
+
 func nextProtos(config *configuration.Configuration) []string {
 	switch config.HTTP.HTTP2.Disabled {
 	case true:
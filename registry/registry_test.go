@@ -11,22 +11,28 @@ import (
 	"crypto/tls"
 	"crypto/x509"
 	"crypto/x509/pkix"
+	"encoding/json"
 	"encoding/pem"
 	"fmt"
 	"io"
 	"math/big"
 	"net"
 	"net/http"
+	"net/http/httptest"
 	"os"
 	"path"
 	"reflect"
 	"strings"
+	"syscall"
 	"testing"
 	"time"
 
+	"github.com/distribution/distribution/v3/audit"
 	"github.com/distribution/distribution/v3/configuration"
 	"github.com/distribution/distribution/v3/internal/dcontext"
+	"github.com/distribution/distribution/v3/registry/storage"
 	_ "github.com/distribution/distribution/v3/registry/storage/driver/inmemory"
+	"github.com/opencontainers/go-digest"
 	"github.com/sirupsen/logrus"
 	"gopkg.in/yaml.v2"
 )
@@ -133,6 +139,114 @@ func TestGracefulShutdown(t *testing.T) {
 	}
 }
 
+// TestGracefulShutdownUpload checks that an upload in flight when the stop
+// signal is received completes, while new connections are refused and the
+// registry is no longer ready.
+func TestGracefulShutdownUpload(t *testing.T) {
+	registry, err := setupRegistry(nil, "127.0.0.1:5003")
+	if err != nil {
+		t.Fatal(err)
+	}
+	active := make(chan struct{}, 10)
+	registry.server.ConnState = func(_ net.Conn, state http.ConnState) {
+		if state == http.StateActive {
+			active <- struct{}{}
+		}
+	}
+	errchan := make(chan error, 1)
+	go func() {
+		errchan <- registry.ListenAndServe()
+	}()
+	for deadline := time.Now().Add(10 * time.Second); ; time.Sleep(10 * time.Millisecond) {
+		conn, err := net.Dial("tcp", "127.0.0.1:5003")
+		if err == nil {
+			conn.Close()
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("registry not listening: %v", err)
+		}
+	}
+
+	resp, err := http.Post("http://127.0.0.1:5003/v2/foo/bar/blobs/uploads/", "", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusAccepted {
+		t.Fatalf("unexpected status starting the upload: %s", resp.Status)
+	}
+	<-active
+
+	content := make([]byte, 1<<20)
+	if _, err := rand.Read(content); err != nil {
+		t.Fatal(err)
+	}
+	dgst := digest.FromBytes(content)
+	body, w := io.Pipe()
+	req, err := http.NewRequest(http.MethodPut, resp.Header.Get("Location")+"&digest="+dgst.String(), body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.ContentLength = int64(len(content))
+	// The upload is sent on a connection of its own, which is never idle.
+	client := &http.Client{Transport: &http.Transport{}}
+	uploaded := make(chan *http.Response, 1)
+	go func() {
+		resp, err := client.Do(req)
+		if err != nil {
+			t.Errorf("upload failed: %v", err)
+		}
+		uploaded <- resp
+	}()
+	if _, err := w.Write(content[:len(content)/2]); err != nil {
+		t.Fatal(err)
+	}
+	<-active
+
+	registry.quit <- syscall.SIGTERM
+	for deadline := time.Now().Add(10 * time.Second); ; time.Sleep(10 * time.Millisecond) {
+		conn, err := net.Dial("tcp", "127.0.0.1:5003")
+		if err != nil {
+			break
+		}
+		conn.Close()
+		if time.Now().After(deadline) {
+			t.Fatal("managed to connect after stopping")
+		}
+	}
+	rec := httptest.NewRecorder()
+	registry.server.Handler.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/ready", nil))
+	if rec.Code != http.StatusServiceUnavailable {
+		t.Fatalf("unexpected readiness status %d while draining", rec.Code)
+	}
+
+	if _, err := w.Write(content[len(content)/2:]); err != nil {
+		t.Fatal(err)
+	}
+	w.Close()
+	resp = <-uploaded
+	if resp == nil {
+		t.FailNow()
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusCreated {
+		t.Fatalf("unexpected status completing the upload: %s", resp.Status)
+	}
+	if got := resp.Header.Get("Docker-Content-Digest"); got != dgst.String() {
+		t.Fatalf("unexpected digest %s, expected %s", got, dgst)
+	}
+
+	select {
+	case err := <-errchan:
+		if err != nil {
+			t.Fatalf("unexpected error shutting down: %v", err)
+		}
+	case <-time.After(10 * time.Second):
+		t.Fatal("registry not shut down")
+	}
+}
+
 func TestGetCipherSuite(t *testing.T) {
 	resp, err := getCipherSuites([]string{"TLS_RSA_WITH_AES_128_CBC_SHA"})
 	if err != nil || len(resp) != 1 || resp[0] != tls.TLS_RSA_WITH_AES_128_CBC_SHA {
@@ -434,3 +548,52 @@ log:
 		t.Error("field baz not configured correctly; expected 'xyzzy' got: ", val)
 	}
 }
+
+func TestRecordGarbageCollection(t *testing.T) {
+	auditPath := path.Join(t.TempDir(), "audit.log")
+	report := &storage.GCReport{
+		Repositories: []storage.GCRepositoryReport{{
+			Name:      "foo/bar",
+			Manifests: []storage.GCManifest{{Digest: digest.FromString("manifest")}},
+			Blobs:     []storage.GCBlob{{Digest: digest.FromString("layer")}},
+			Tags:      []storage.GCTag{{Name: "old", Digest: digest.FromString("manifest")}},
+		}},
+		Blobs: []storage.GCBlob{{Digest: digest.FromString("blob")}},
+		Failed: []storage.GCFailure{
+			{Kind: "blob", Digest: digest.FromString("failed"), Error: "permission denied"},
+			{Repository: "foo/bar", Kind: "layer", Digest: digest.FromString("link"), Error: "permission denied"},
+		},
+	}
+	err := recordGarbageCollection(configuration.AuditLog{Output: auditPath}, report, fmt.Errorf("failed to delete 1 objects"))
+	if err != nil {
+		t.Fatalf("unexpected error recording the garbage collection: %v", err)
+	}
+
+	f, err := os.Open(auditPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	var actions []string
+	var last audit.Entry
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		if err := json.Unmarshal(scanner.Bytes(), &last); err != nil {
+			t.Fatalf("invalid audit log entry %q: %v", scanner.Text(), err)
+		}
+		actions = append(actions, last.Action+" "+last.Outcome)
+	}
+	expected := []string{
+		"gc.tag.delete success",
+		"gc.manifest.delete success",
+		"gc.blob.delete success",
+		"gc.blob.delete failure",
+		"gc.run failure",
+	}
+	if !reflect.DeepEqual(actions, expected) {
+		t.Fatalf("unexpected audit log entries %v, expected %v", actions, expected)
+	}
+	if last.Error != "failed to delete 1 objects" {
+		t.Fatalf("unexpected error of the run: %q", last.Error)
+	}
+}
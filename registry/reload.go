@@ -0,0 +1,249 @@
+package registry
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"reflect"
+	"strings"
+
+	"github.com/distribution/distribution/v3/configuration"
+	"github.com/distribution/distribution/v3/internal/dcontext"
+)
+
+// reloadPath is the path of the debug server endpoint reloading the
+// configuration.
+const reloadPath = "/debug/reload"
+
+// reloadReport lists the sections of the configuration applied by a reload,
+// and the changes which were rejected.
+type reloadReport struct {
+	Applied  []string          `json:"applied"`
+	Rejected []reloadRejection `json:"rejected"`
+}
+
+type reloadRejection struct {
+	Section string `json:"section"`
+	Reason  string `json:"reason"`
+}
+
+// reloadableSection is a section of the configuration which can be applied
+// without a restart.
+type reloadableSection struct {
+	name string
+	// fields returns pointers to the fields of the section in the
+	// configuration.
+	fields func(config *configuration.Configuration) []any
+	// apply applies the section of the configuration to the registry,
+	// leaving the current one active on error.
+	apply func(registry *Registry, config *configuration.Configuration) error
+	// refresh, if set, applies the unchanged section again, reloading the
+	// files it refers to.
+	refresh func(registry *Registry, config *configuration.Configuration) error
+}
+
+var reloadableSections = []reloadableSection{
+	{
+		name: "log",
+		fields: func(config *configuration.Configuration) []any {
+			return []any{&config.Log.Level, &config.Log.Formatter, &config.Log.ReportCaller, &config.Log.Repositories}
+		},
+		apply: func(registry *Registry, config *configuration.Configuration) error {
+			if err := configureLogger(config.Log); err != nil {
+				return err
+			}
+			// The loggers of the repositories copy the formatter of the
+			// standard logger.
+			return registry.app.ReloadLogLevels(config.Log)
+		},
+	},
+	{
+		name: "notifications.endpoints",
+		fields: func(config *configuration.Configuration) []any {
+			return []any{&config.Notifications.Endpoints}
+		},
+		apply: func(registry *Registry, config *configuration.Configuration) error {
+			return registry.app.ReloadNotifications(config.Notifications)
+		},
+	},
+	{
+		name: "proxy.ttl",
+		fields: func(config *configuration.Configuration) []any {
+			return []any{&config.Proxy.TTL, &config.Proxy.ManifestTTL, &config.Proxy.BlobTTL, &config.Proxy.MediaTypeTTLs}
+		},
+		apply: func(registry *Registry, config *configuration.Configuration) error {
+			if !registry.loaded.Proxy.Enabled() || !config.Proxy.Enabled() {
+				return errors.New("enabling or disabling the pull through cache requires a restart")
+			}
+			return registry.app.ReloadProxyTTL(config.Proxy)
+		},
+	},
+	{
+		name: "auth",
+		fields: func(config *configuration.Configuration) []any {
+			return []any{&config.Auth}
+		},
+		apply: func(registry *Registry, config *configuration.Configuration) error {
+			if registry.loaded.Auth.Type() != "htpasswd" || config.Auth.Type() != "htpasswd" {
+				return errors.New("only the htpasswd authentication can be reloaded, other changes require a restart")
+			}
+			return registry.app.ReloadAuth(config.Auth)
+		},
+		// The htpasswd file is reloaded even if its path did not change.
+		refresh: func(registry *Registry, config *configuration.Configuration) error {
+			if config.Auth.Type() != "htpasswd" {
+				return nil
+			}
+			return registry.app.ReloadAuth(config.Auth)
+		},
+	},
+}
+
+// enableReload enables the reloads of the configuration file at path.
+func (registry *Registry) enableReload(path string) error {
+	loaded, err := parseConfigurationFile(path)
+	if err != nil {
+		return err
+	}
+	registry.reloadMu.Lock()
+	defer registry.reloadMu.Unlock()
+	registry.configPath = path
+	registry.loaded = loaded
+	return nil
+}
+
+// Reload parses the configuration file again and applies the changes to the
+// log level, formatter, caller reporting and repository log levels, the
+// notification endpoints, the proxy ttl and the htpasswd authentication,
+// whose file is reloaded even if the configuration did not change.
+// Each of these sections is applied entirely, or not at all if it fails to
+// apply. The changes to the other sections require a restart, and are
+// rejected.
+func (registry *Registry) Reload() (reloadReport, error) {
+	registry.reloadMu.Lock()
+	defer registry.reloadMu.Unlock()
+
+	var report reloadReport
+	if registry.configPath == "" {
+		return report, errors.New("the configuration was not loaded from a file")
+	}
+	config, err := parseConfigurationFile(registry.configPath)
+	if err != nil {
+		return report, err
+	}
+
+	logger := dcontext.GetLogger(registry.app)
+	// The reloadable sections are left out of the copies compared for
+	// the changes requiring a restart.
+	current, next := *registry.loaded, *config
+	for _, section := range reloadableSections {
+		changed := !sectionEqual(section.fields(&current), section.fields(&next))
+		clearSection(section.fields(&current))
+		clearSection(section.fields(&next))
+		if !changed {
+			if section.refresh != nil {
+				if err := section.refresh(registry, config); err != nil {
+					report.Rejected = append(report.Rejected, reloadRejection{Section: section.name, Reason: err.Error()})
+				}
+			}
+			continue
+		}
+		if err := section.apply(registry, config); err != nil {
+			report.Rejected = append(report.Rejected, reloadRejection{Section: section.name, Reason: err.Error()})
+			continue
+		}
+		copySection(section.fields(registry.loaded), section.fields(config))
+		report.Applied = append(report.Applied, section.name)
+	}
+	for _, name := range changedFields(reflect.ValueOf(current), reflect.ValueOf(next), "", 2) {
+		report.Rejected = append(report.Rejected, reloadRejection{Section: name, Reason: "changes require a restart"})
+	}
+
+	for _, name := range report.Applied {
+		logger.Infof("reloaded the %s configuration", name)
+	}
+	for _, rejection := range report.Rejected {
+		logger.Warnf("not reloading the %s configuration: %s, the current configuration stays active", rejection.Section, rejection.Reason)
+	}
+	return report, nil
+}
+
+// reloadHandler reloads the configuration on POST requests, answering with
+// the report of the reload. The status is 409 if any change was rejected.
+func (registry *Registry) reloadHandler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			w.Header().Set("Allow", http.MethodPost)
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		report, err := registry.Reload()
+		if err != nil {
+			http.Error(w, fmt.Sprintf("failed to reload the configuration: %v", err), http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		if len(report.Rejected) > 0 {
+			w.WriteHeader(http.StatusConflict)
+		}
+		if err := json.NewEncoder(w).Encode(report); err != nil {
+			dcontext.GetLogger(registry.app).Errorf("error encoding the reload report: %v", err)
+		}
+	})
+}
+
+func sectionEqual(a, b []any) bool {
+	for i := range a {
+		if !reflect.DeepEqual(reflect.ValueOf(a[i]).Elem().Interface(), reflect.ValueOf(b[i]).Elem().Interface()) {
+			return false
+		}
+	}
+	return true
+}
+
+func clearSection(fields []any) {
+	for _, field := range fields {
+		v := reflect.ValueOf(field).Elem()
+		v.Set(reflect.Zero(v.Type()))
+	}
+}
+
+func copySection(dst, src []any) {
+	for i := range dst {
+		reflect.ValueOf(dst[i]).Elem().Set(reflect.ValueOf(src[i]).Elem())
+	}
+}
+
+// changedFields returns the names of the fields which differ between the
+// structs a and b, such as "http.tls", descending up to depth levels.
+func changedFields(a, b reflect.Value, prefix string, depth int) []string {
+	var names []string
+	for i := 0; i < a.NumField(); i++ {
+		if !a.Type().Field(i).IsExported() {
+			continue
+		}
+		fa, fb := a.Field(i), b.Field(i)
+		if reflect.DeepEqual(fa.Interface(), fb.Interface()) {
+			continue
+		}
+		name := prefix + fieldName(a.Type().Field(i))
+		if fa.Kind() == reflect.Struct && depth > 1 {
+			if nested := changedFields(fa, fb, name+".", depth-1); len(nested) > 0 {
+				names = append(names, nested...)
+				continue
+			}
+		}
+		names = append(names, name)
+	}
+	return names
+}
+
+// fieldName returns the name of the field in the configuration file.
+func fieldName(field reflect.StructField) string {
+	name, _, _ := strings.Cut(field.Tag.Get("yaml"), ",")
+	if name == "" || name == "-" {
+		return strings.ToLower(field.Name)
+	}
+	return name
+}
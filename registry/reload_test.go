@@ -0,0 +1,271 @@
+package registry
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	_ "github.com/distribution/distribution/v3/registry/auth/htpasswd"
+	"github.com/opencontainers/go-digest"
+	"github.com/sirupsen/logrus"
+	"golang.org/x/crypto/bcrypt"
+)
+
+// reloadConfig is the configuration of the reloaded registries, formatted
+// with the listen address, storage, log level, htpasswd file and
+// notification endpoint.
+const reloadConfig = `version: 0.1
+http:
+  addr: %s
+  draintimeout: 1s
+log:
+  level: %s
+storage:
+  %s
+auth:
+  htpasswd:
+    realm: registry
+    path: %s
+notifications:
+  endpoints:
+    - name: listener
+      type: %s
+      url: %s
+      timeout: 1s
+      threshold: 3
+      backoff: 100ms
+`
+
+type reloadedRegistry struct {
+	*Registry
+	path string
+	addr string
+	// server serves the handler of the registry, which is not listening.
+	server *httptest.Server
+}
+
+// writeConfig writes the configuration file of the registry, listening on
+// its address.
+func (r *reloadedRegistry) writeConfig(t *testing.T, storage, level, htpasswd, endpointType, endpoint string) {
+	t.Helper()
+	config := fmt.Sprintf(reloadConfig, r.addr, level, storage, htpasswd, endpointType, endpoint)
+	if err := os.WriteFile(r.path, []byte(config), 0o600); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// get requests the base route as user, returning the status.
+func (r *reloadedRegistry) get(t *testing.T, user string) int {
+	t.Helper()
+	req, _ := http.NewRequest(http.MethodGet, r.server.URL+"/v2/", nil)
+	req.SetBasicAuth(user, "password")
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	return resp.StatusCode
+}
+
+// push pushes a blob as user, which is notified to the endpoints.
+func (r *reloadedRegistry) push(t *testing.T, user string, content []byte) {
+	t.Helper()
+	do := func(method, url string, body []byte, expected int) *http.Response {
+		req, _ := http.NewRequest(method, url, bytes.NewReader(body))
+		req.SetBasicAuth(user, "password")
+		req.Header.Set("Content-Type", "application/octet-stream")
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		if resp.StatusCode != expected {
+			t.Fatalf("unexpected status of %s %s: %d", method, url, resp.StatusCode)
+		}
+		return resp
+	}
+	resp := do(http.MethodPost, r.server.URL+"/v2/foo/blobs/uploads/", nil, http.StatusAccepted)
+	location, err := resp.Location()
+	if err != nil {
+		t.Fatal(err)
+	}
+	query := location.Query()
+	query.Set("digest", digest.FromBytes(content).String())
+	location.RawQuery = query.Encode()
+	do(http.MethodPut, location.String(), content, http.StatusCreated)
+}
+
+func writeHtpasswd(t *testing.T, path, user string) {
+	t.Helper()
+	hash, err := bcrypt.GenerateFromPassword([]byte("password"), bcrypt.MinCost)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(path, []byte(user+":"+string(hash)+"\n"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// newListener returns an endpoint counting the notifications it receives.
+func newListener(t *testing.T) (*httptest.Server, *atomic.Int64) {
+	var received atomic.Int64
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		received.Add(1)
+	}))
+	t.Cleanup(server.Close)
+	return server, &received
+}
+
+func waitFor(t *testing.T, what string, condition func() bool) {
+	t.Helper()
+	for deadline := time.Now().Add(10 * time.Second); time.Now().Before(deadline); time.Sleep(10 * time.Millisecond) {
+		if condition() {
+			return
+		}
+	}
+	t.Fatalf("timed out waiting for %s", what)
+}
+
+// newReloadedRegistry returns a registry configured from a file in dir to
+// listen on addr, with alice allowed by the htpasswd file and the
+// notifications sent to endpoint.
+func newReloadedRegistry(t *testing.T, dir, addr, endpoint string) *reloadedRegistry {
+	r := &reloadedRegistry{path: filepath.Join(dir, "config.yml"), addr: addr}
+	writeHtpasswd(t, filepath.Join(dir, "alice"), "alice")
+	r.writeConfig(t, "inmemory: {}", "info", filepath.Join(dir, "alice"), "http", endpoint)
+
+	config, err := parseConfigurationFile(r.path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	r.Registry, err = NewRegistry(context.Background(), config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := r.enableReload(r.path); err != nil {
+		t.Fatal(err)
+	}
+	r.server = httptest.NewServer(r.Registry.server.Handler)
+	t.Cleanup(r.server.Close)
+	return r
+}
+
+func TestReload(t *testing.T) {
+	defer logrus.SetLevel(logrus.GetLevel())
+	dir := t.TempDir()
+	first, _ := newListener(t)
+	second, received := newListener(t)
+	r := newReloadedRegistry(t, dir, "127.0.0.1:5000", first.URL)
+	if status := r.get(t, "bob"); status != http.StatusUnauthorized {
+		t.Fatalf("unexpected status of bob before the reload: %d", status)
+	}
+
+	// The log level, htpasswd file and notification endpoint are reloaded.
+	writeHtpasswd(t, filepath.Join(dir, "bob"), "bob")
+	r.writeConfig(t, "inmemory: {}", "debug", filepath.Join(dir, "bob"), "http", second.URL)
+	report, err := r.Reload()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if expected := []string{"log", "notifications.endpoints", "auth"}; !reflect.DeepEqual(report.Applied, expected) || len(report.Rejected) != 0 {
+		t.Fatalf("unexpected report %+v, expected %v applied", report, expected)
+	}
+	if logrus.GetLevel() != logrus.DebugLevel {
+		t.Fatalf("unexpected log level %s", logrus.GetLevel())
+	}
+	if status := r.get(t, "bob"); status != http.StatusOK {
+		t.Fatalf("unexpected status of bob after the reload: %d", status)
+	}
+	if status := r.get(t, "alice"); status != http.StatusUnauthorized {
+		t.Fatalf("unexpected status of alice after the reload: %d", status)
+	}
+	r.push(t, "bob", []byte("reloaded"))
+	waitFor(t, "the notification of the new endpoint", func() bool { return received.Load() > 0 })
+
+	// The htpasswd file is reloaded with an unchanged configuration.
+	writeHtpasswd(t, filepath.Join(dir, "bob"), "carol")
+	report, err = r.Reload()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(report.Applied) != 0 || len(report.Rejected) != 0 {
+		t.Fatalf("unexpected report of an unchanged configuration %+v", report)
+	}
+	if status := r.get(t, "carol"); status != http.StatusOK {
+		t.Fatalf("unexpected status of carol after the reload: %d", status)
+	}
+	writeHtpasswd(t, filepath.Join(dir, "bob"), "bob")
+	if _, err := r.Reload(); err != nil {
+		t.Fatal(err)
+	}
+
+	// The storage cannot change, and a section failing to apply leaves the
+	// current one active while the others are applied.
+	r.writeConfig(t, "filesystem: {rootdirectory: "+dir+"}", "info", filepath.Join(dir, "bob"), "unknown", first.URL)
+	report, err = r.Reload()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if expected := []string{"log"}; !reflect.DeepEqual(report.Applied, expected) {
+		t.Fatalf("unexpected sections applied %v, expected %v", report.Applied, expected)
+	}
+	var rejected []string
+	for _, rejection := range report.Rejected {
+		rejected = append(rejected, rejection.Section)
+	}
+	if expected := []string{"notifications.endpoints", "storage"}; !reflect.DeepEqual(rejected, expected) {
+		t.Fatalf("unexpected sections rejected %v, expected %v", rejected, expected)
+	}
+	if logrus.GetLevel() != logrus.InfoLevel {
+		t.Fatalf("unexpected log level %s", logrus.GetLevel())
+	}
+	if r.loaded.Storage.Type() != "inmemory" || r.loaded.Notifications.Endpoints[0].URL != second.URL {
+		t.Fatalf("unexpected configuration loaded after a rejected reload: %+v", r.loaded)
+	}
+	pushed := received.Load()
+	r.push(t, "bob", []byte("rejected"))
+	waitFor(t, "the notification of the current endpoint", func() bool { return received.Load() > pushed })
+}
+
+func TestReloadHandler(t *testing.T) {
+	dir := t.TempDir()
+	listener, _ := newListener(t)
+	r := newReloadedRegistry(t, dir, "127.0.0.1:5000", listener.URL)
+	handler := r.reloadHandler()
+
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, httptest.NewRequest(http.MethodGet, reloadPath, nil))
+	if w.Code != http.StatusMethodNotAllowed {
+		t.Fatalf("unexpected status of a get: %d", w.Code)
+	}
+
+	w = httptest.NewRecorder()
+	handler.ServeHTTP(w, httptest.NewRequest(http.MethodPost, reloadPath, nil))
+	if w.Code != http.StatusOK {
+		t.Fatalf("unexpected status of an unchanged reload: %d", w.Code)
+	}
+
+	r.addr = "127.0.0.1:5001"
+	r.writeConfig(t, "filesystem: {rootdirectory: "+dir+"}", "info", filepath.Join(dir, "alice"), "http", listener.URL)
+	w = httptest.NewRecorder()
+	handler.ServeHTTP(w, httptest.NewRequest(http.MethodPost, reloadPath, nil))
+	if w.Code != http.StatusConflict {
+		t.Fatalf("unexpected status of a rejected reload: %d", w.Code)
+	}
+	var report reloadReport
+	if err := json.NewDecoder(w.Body).Decode(&report); err != nil {
+		t.Fatal(err)
+	}
+	if len(report.Rejected) != 2 || report.Rejected[0].Section != "storage" || report.Rejected[1].Section != "http.addr" {
+		t.Fatalf("unexpected rejections %+v", report.Rejected)
+	}
+}
@@ -0,0 +1,447 @@
+package replication
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"path"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/distribution/reference"
+	"github.com/opencontainers/go-digest"
+	v1 "github.com/opencontainers/image-spec/specs-go/v1"
+
+	"github.com/distribution/distribution/v3"
+	"github.com/distribution/distribution/v3/configuration"
+	"github.com/distribution/distribution/v3/internal/client"
+	"github.com/distribution/distribution/v3/internal/client/auth"
+	"github.com/distribution/distribution/v3/internal/dcontext"
+	"github.com/distribution/distribution/v3/registry/proxy"
+	storagedriver "github.com/distribution/distribution/v3/registry/storage/driver"
+)
+
+// queueRoot is the path in the storage of the queues of the peers.
+const queueRoot = "/replication"
+
+// maxMountSources bounds the number of blobs whose repository on a peer is
+// remembered, to mount them in the other repositories pushed to.
+const maxMountSources = 10000
+
+// job is a manifest waiting to be replicated to a peer, with its tag if it
+// was pushed by tag. It is stored in the queue of the peer as JSON.
+type job struct {
+	Repository string        `json:"repository"`
+	Digest     digest.Digest `json:"digest"`
+	Tag        string        `json:"tag,omitempty"`
+	Pushed     time.Time     `json:"pushed"`
+
+	attempts  int
+	notBefore time.Time
+}
+
+// key identifies the replications superseding each other: the pushes of a
+// tag, or of an untagged manifest.
+func (j *job) key() string {
+	if j.Tag != "" {
+		return j.Repository + ":" + j.Tag
+	}
+	return j.Repository + "@" + j.Digest.String()
+}
+
+// permanentError is an error replicating a manifest which is not worth
+// trying again, such as its deletion since its push.
+type permanentError struct {
+	error
+}
+
+// peer replicates the manifests to a peer registry, one at a time, from a
+// queue stored in one file per manifest. A manifest failing to replicate is
+// attempted again after a backoff, while the others are replicated.
+type peer struct {
+	config     configuration.ReplicationPeer
+	actor      string
+	local      distribution.Namespace
+	driver     storagedriver.StorageDriver
+	backoff    time.Duration
+	maxBackoff time.Duration
+
+	// remote is created once the peer is reached, as its credentials are
+	// discovered from it.
+	remote *proxy.Remote
+
+	// mu guards jobs, the replications waiting by key, and mounts, the
+	// repositories the blobs were last replicated to.
+	mu     sync.Mutex
+	jobs   map[string]*job
+	mounts map[digest.Digest]string
+	// wake is signalled when a job is queued.
+	wake chan struct{}
+}
+
+func newPeer(config configuration.ReplicationPeer, actor string, local distribution.Namespace, driver storagedriver.StorageDriver, backoff, maxBackoff time.Duration) *peer {
+	return &peer{
+		config:     config,
+		actor:      actor,
+		local:      local,
+		driver:     driver,
+		backoff:    backoff,
+		maxBackoff: maxBackoff,
+		jobs:       make(map[string]*job),
+		mounts:     make(map[digest.Digest]string),
+		wake:       make(chan struct{}, 1),
+	}
+}
+
+// jobPath returns the path of the file of the job in the queue.
+func (p *peer) jobPath(key string) string {
+	return path.Join(queueRoot, p.config.Name, digest.FromString(key).Encoded())
+}
+
+// enqueue stores the job in the queue, superseding the replication of the
+// same key waiting, unless the repository is not replicated to the peer.
+func (p *peer) enqueue(ctx context.Context, j *job) {
+	if !strings.HasPrefix(j.Repository, p.config.Prefix) {
+		return
+	}
+	j = &job{Repository: j.Repository, Digest: j.Digest, Tag: j.Tag, Pushed: j.Pushed}
+	content, err := json.Marshal(j)
+	if err != nil {
+		dcontext.GetLogger(ctx).Errorf("replication: failed to queue %s@%s for peer %s: %v", j.Repository, j.Digest, p.config.Name, err)
+		return
+	}
+
+	// The file is written under the lock for a superseded job not to
+	// remove it once replicated.
+	p.mu.Lock()
+	if err := p.driver.PutContent(ctx, p.jobPath(j.key()), content); err != nil {
+		// The manifest is still replicated, unless the registry restarts
+		// before.
+		dcontext.GetLogger(ctx).Errorf("replication: failed to queue %s@%s for peer %s: %v", j.Repository, j.Digest, p.config.Name, err)
+	}
+	p.jobs[j.key()] = j
+	pending.WithValues(p.config.Name).Set(float64(len(p.jobs)))
+	p.mu.Unlock()
+	select {
+	case p.wake <- struct{}{}:
+	default:
+	}
+}
+
+// load reads the queue stored before the registry restarted. The jobs
+// queued since supersede the ones stored.
+func (p *peer) load(ctx context.Context) error {
+	files, err := p.driver.List(ctx, path.Join(queueRoot, p.config.Name))
+	if errors.As(err, new(storagedriver.PathNotFoundError)) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	for _, file := range files {
+		content, err := p.driver.GetContent(ctx, file)
+		if errors.As(err, new(storagedriver.PathNotFoundError)) {
+			continue
+		}
+		if err != nil {
+			return err
+		}
+		var j job
+		if err := json.Unmarshal(content, &j); err != nil {
+			dcontext.GetLogger(ctx).Errorf("replication: dropping invalid job %s: %v", file, err)
+			p.driver.Delete(ctx, file)
+			continue
+		}
+		p.mu.Lock()
+		if _, ok := p.jobs[j.key()]; !ok {
+			p.jobs[j.key()] = &j
+		}
+		pending.WithValues(p.config.Name).Set(float64(len(p.jobs)))
+		p.mu.Unlock()
+	}
+	return nil
+}
+
+// next returns the job to replicate next, the one ready the longest, and how
+// long to wait before replicating it.
+func (p *peer) next() (*job, time.Duration) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	var next *job
+	for _, j := range p.jobs {
+		if next == nil || j.notBefore.Before(next.notBefore) || (j.notBefore.Equal(next.notBefore) && j.Pushed.Before(next.Pushed)) {
+			next = j
+		}
+	}
+	if next == nil {
+		return nil, 0
+	}
+	return next, time.Until(next.notBefore)
+}
+
+// done removes the job from the queue, unless it was superseded while it was
+// replicated.
+func (p *peer) done(ctx context.Context, j *job) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.jobs[j.key()] != j {
+		return
+	}
+	delete(p.jobs, j.key())
+	pending.WithValues(p.config.Name).Set(float64(len(p.jobs)))
+	if err := p.driver.Delete(ctx, p.jobPath(j.key())); err != nil && !errors.As(err, new(storagedriver.PathNotFoundError)) {
+		dcontext.GetLogger(ctx).Errorf("replication: failed to remove %s@%s from the queue of peer %s: %v", j.Repository, j.Digest, p.config.Name, err)
+	}
+}
+
+// run replicates the queued manifests until ctx is done.
+func (p *peer) run(ctx context.Context) {
+	logger := dcontext.GetLoggerWithField(ctx, "peer", p.config.Name)
+	for {
+		err := p.load(ctx)
+		if err == nil {
+			break
+		}
+		if ctx.Err() != nil {
+			return
+		}
+		logger.Errorf("replication: failed to load the queue: %v", err)
+		select {
+		case <-time.After(p.maxBackoff):
+		case <-ctx.Done():
+			return
+		}
+	}
+
+	for {
+		j, wait := p.next()
+		if j == nil || wait > 0 {
+			var timer <-chan time.Time
+			if j != nil {
+				timer = time.After(wait)
+			}
+			select {
+			case <-timer:
+			case <-p.wake:
+			case <-ctx.Done():
+				return
+			}
+			continue
+		}
+
+		err := p.replicate(ctx, j)
+		if ctx.Err() != nil {
+			return
+		}
+		var permanent permanentError
+		switch {
+		case err == nil:
+			replicated.WithValues(p.config.Name).Inc(1)
+			lag.WithValues(p.config.Name).Set(time.Since(j.Pushed).Seconds())
+			p.done(ctx, j)
+		case errors.As(err, &permanent):
+			dropped.WithValues(p.config.Name).Inc(1)
+			logger.Warnf("replication: dropping %s@%s: %v", j.Repository, j.Digest, err)
+			p.done(ctx, j)
+		default:
+			failures.WithValues(p.config.Name).Inc(1)
+			p.mu.Lock()
+			j.attempts++
+			backoff := p.backoff << min(j.attempts-1, 30)
+			if backoff <= 0 || backoff > p.maxBackoff {
+				backoff = p.maxBackoff
+			}
+			j.notBefore = time.Now().Add(backoff)
+			p.mu.Unlock()
+			logger.Warnf("replication: failed to replicate %s@%s, retrying in %s: %v", j.Repository, j.Digest, backoff, err)
+		}
+	}
+}
+
+// replicate pushes the manifest of the job to the peer, after the manifests
+// it references and the blobs the peer lacks.
+func (p *peer) replicate(ctx context.Context, j *job) error {
+	name, err := reference.WithName(j.Repository)
+	if err != nil {
+		return permanentError{err}
+	}
+	repo, err := p.local.Repository(ctx, name)
+	if err != nil {
+		return err
+	}
+	manifests, err := repo.Manifests(ctx)
+	if err != nil {
+		return err
+	}
+
+	// The manifests referenced by an index are pushed before it, and the
+	// blobs before the manifests referencing them.
+	var order []digest.Digest
+	fetched := make(map[digest.Digest]distribution.Manifest)
+	var blobs []v1.Descriptor
+	var visit func(dgst digest.Digest) error
+	visit = func(dgst digest.Digest) error {
+		if _, ok := fetched[dgst]; ok {
+			return nil
+		}
+		m, err := manifests.Get(ctx, dgst)
+		if err != nil {
+			var unknown distribution.ErrManifestUnknownRevision
+			if errors.As(err, &unknown) {
+				return permanentError{err}
+			}
+			return err
+		}
+		fetched[dgst] = m
+		manifestTypes := distribution.ManifestMediaTypes()
+		for _, desc := range m.References() {
+			if slices.Contains(manifestTypes, desc.MediaType) {
+				if err := visit(desc.Digest); err != nil {
+					return err
+				}
+			} else if !slices.ContainsFunc(blobs, func(b v1.Descriptor) bool { return b.Digest == desc.Digest }) {
+				blobs = append(blobs, desc)
+			}
+		}
+		order = append(order, dgst)
+		return nil
+	}
+	if err := visit(j.Digest); err != nil {
+		return err
+	}
+
+	remote, err := p.remoteRepository(ctx, name, blobs)
+	if err != nil {
+		return err
+	}
+	for _, desc := range blobs {
+		if err := p.replicateBlob(ctx, repo.Blobs(ctx), remote.Blobs(ctx), name, desc); err != nil {
+			return err
+		}
+	}
+	remoteManifests, err := remote.Manifests(ctx)
+	if err != nil {
+		return err
+	}
+	for _, dgst := range order {
+		var options []distribution.ManifestServiceOption
+		if dgst == j.Digest && j.Tag != "" {
+			options = append(options, distribution.WithTag(j.Tag))
+		} else if exists, err := remoteManifests.Exists(ctx, dgst); err != nil {
+			return err
+		} else if exists {
+			continue
+		}
+		if _, err := remoteManifests.Put(ctx, fetched[dgst], options...); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// remoteRepository returns the repository on the peer, authorized to push to
+// it and to mount the blobs from the repositories they were replicated to.
+func (p *peer) remoteRepository(ctx context.Context, name reference.Named, blobs []v1.Descriptor) (distribution.Repository, error) {
+	if p.remote == nil {
+		remote, err := proxy.NewRemote(ctx, p.config.Remote())
+		if err != nil {
+			return nil, err
+		}
+		p.remote = remote
+	}
+
+	scopes := []auth.Scope{auth.RepositoryScope{Repository: name.Name(), Actions: []string{"pull", "push"}}}
+	p.mu.Lock()
+	for _, desc := range blobs {
+		if from, ok := p.mounts[desc.Digest]; ok && from != name.Name() {
+			scopes = append(scopes, auth.RepositoryScope{Repository: from, Actions: []string{"pull"}})
+		}
+	}
+	p.mu.Unlock()
+	transport, err := p.remote.Transport(ctx, scopes...)
+	if err != nil {
+		return nil, err
+	}
+	u := p.remote.URL()
+	return client.NewRepository(name, u.String(), actorTransport{actor: p.actor, base: transport})
+}
+
+// replicateBlob uploads the blob to the peer unless it has it already,
+// mounting it from another repository of the peer where possible.
+func (p *peer) replicateBlob(ctx context.Context, local, remote distribution.BlobStore, name reference.Named, desc v1.Descriptor) error {
+	if _, err := remote.Stat(ctx, desc.Digest); err == nil {
+		p.mounted(desc.Digest, name)
+		return nil
+	} else if !errors.Is(err, distribution.ErrBlobUnknown) {
+		return err
+	}
+
+	var options []distribution.BlobCreateOption
+	p.mu.Lock()
+	from, ok := p.mounts[desc.Digest]
+	p.mu.Unlock()
+	if ok && from != name.Name() {
+		fromName, err := reference.WithName(from)
+		if err == nil {
+			if canonical, err := reference.WithDigest(fromName, desc.Digest); err == nil {
+				options = append(options, client.WithMountFrom(canonical))
+			}
+		}
+	}
+
+	bw, err := remote.Create(ctx, options...)
+	if errors.As(err, new(distribution.ErrBlobMounted)) {
+		p.mounted(desc.Digest, name)
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	defer bw.Close()
+
+	rc, err := local.Open(ctx, desc.Digest)
+	if err != nil {
+		bw.Cancel(ctx)
+		if errors.Is(err, distribution.ErrBlobUnknown) {
+			return permanentError{fmt.Errorf("blob %s: %w", desc.Digest, err)}
+		}
+		return err
+	}
+	defer rc.Close()
+	if _, err := bw.ReadFrom(rc); err != nil {
+		bw.Cancel(ctx)
+		return err
+	}
+	if _, err := bw.Commit(ctx, v1.Descriptor{MediaType: desc.MediaType, Digest: desc.Digest, Size: desc.Size}); err != nil {
+		return err
+	}
+	p.mounted(desc.Digest, name)
+	return nil
+}
+
+// mounted records the repository of the peer the blob was replicated to.
+func (p *peer) mounted(dgst digest.Digest, name reference.Named) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if _, ok := p.mounts[dgst]; !ok && len(p.mounts) >= maxMountSources {
+		clear(p.mounts)
+	}
+	p.mounts[dgst] = name.Name()
+}
+
+// actorTransport announces the actor name of the replication in the requests
+// to the peer.
+type actorTransport struct {
+	actor string
+	base  http.RoundTripper
+}
+
+func (t actorTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	req = req.Clone(req.Context())
+	req.Header.Set(ActorHeader, t.actor)
+	return t.base.RoundTrip(req)
+}
@@ -0,0 +1,177 @@
+// Package replication replicates the manifests pushed to the registry, with
+// the blobs they reference, to peer registries.
+package replication
+
+import (
+	"context"
+	"fmt"
+	"regexp"
+	"slices"
+	"sync"
+	"time"
+
+	events "github.com/docker/go-events"
+	"github.com/docker/go-metrics"
+
+	"github.com/distribution/distribution/v3"
+	"github.com/distribution/distribution/v3/configuration"
+	prometheus "github.com/distribution/distribution/v3/metrics"
+	"github.com/distribution/distribution/v3/notifications"
+	"github.com/distribution/distribution/v3/registry/proxy"
+	storagedriver "github.com/distribution/distribution/v3/registry/storage/driver"
+)
+
+// ActorHeader is the header announcing the actor name of the pushes of the
+// replication to the peers. A peer records it as the actor of the pushes
+// authenticated as the user of one of its peers, for them not to be
+// replicated back.
+const ActorHeader = "Docker-Distribution-Replication-Actor"
+
+const (
+	defaultBackoff    = time.Second
+	defaultMaxBackoff = 5 * time.Minute
+)
+
+var (
+	// pending is the number of manifests waiting to be replicated to a peer.
+	pending = prometheus.ReplicationNamespace.NewLabeledGauge("pending", "The number of manifests waiting to be replicated to a peer", metrics.Unit("manifests"), "peer")
+	// lag is how long after its push the last manifest replicated to a peer
+	// was replicated.
+	lag = prometheus.ReplicationNamespace.NewLabeledGauge("lag", "How long after its push the last manifest replicated to a peer was replicated", metrics.Seconds, "peer")
+	// replicated is the number of manifests replicated to a peer.
+	replicated = prometheus.ReplicationNamespace.NewLabeledCounter("replicated", "The number of manifests replicated to a peer", "peer")
+	// failures is the number of attempts to replicate a manifest to a peer
+	// which failed, and are tried again.
+	failures = prometheus.ReplicationNamespace.NewLabeledCounter("failures", "The number of failed attempts to replicate a manifest to a peer", "peer")
+	// dropped is the number of manifests which cannot be replicated, as
+	// they were deleted since their push.
+	dropped = prometheus.ReplicationNamespace.NewLabeledCounter("dropped", "The number of manifests dropped as they cannot be replicated to a peer", "peer")
+)
+
+func init() {
+	metrics.Register(prometheus.ReplicationNamespace)
+}
+
+// peerNameRegexp matches the names of the peers, which are a component of
+// the path of their queue in the storage.
+var peerNameRegexp = regexp.MustCompile(`^[A-Za-z0-9._-]+$`)
+
+// Replicator is a sink of the registry events which replicates the pushed
+// manifests to the peers. The replications waiting for a peer are queued in
+// the storage, so that they survive a restart of the registry.
+type Replicator struct {
+	actor string
+	peers []*peer
+	// ctx is cancelled to stop the replication.
+	ctx context.Context
+
+	mu     sync.Mutex
+	closed bool
+	cancel context.CancelFunc
+	wg     sync.WaitGroup
+}
+
+var _ events.Sink = &Replicator{}
+
+// Validate checks the configuration of the replication and of its peers,
+// without contacting them.
+func Validate(config configuration.Replication) (warnings []string, err error) {
+	if len(config.Peers) == 0 {
+		return nil, fmt.Errorf("no replication peer configured")
+	}
+	if config.Backoff < 0 || config.MaxBackoff < 0 {
+		return nil, fmt.Errorf("replication backoff and maxbackoff must be non-negative durations")
+	}
+	var names []string
+	for _, p := range config.Peers {
+		if !peerNameRegexp.MatchString(p.Name) {
+			return nil, fmt.Errorf("invalid replication peer name %q, it must only contain letters, digits, dots, dashes and underscores", p.Name)
+		}
+		if slices.Contains(names, p.Name) {
+			return nil, fmt.Errorf("duplicate replication peer name %q", p.Name)
+		}
+		names = append(names, p.Name)
+		w, err := proxy.ValidateRemote(p.Remote())
+		if err != nil {
+			return nil, fmt.Errorf("replication peer %s: %v", p.Name, err)
+		}
+		warnings = append(warnings, w...)
+	}
+	return warnings, nil
+}
+
+// New returns a replicator of the manifests pushed to the local registry,
+// queuing the replications in the storage driver, and starts replicating the
+// manifests queued before the registry restarted.
+func New(ctx context.Context, local distribution.Namespace, driver storagedriver.StorageDriver, config configuration.Replication) (*Replicator, error) {
+	if _, err := Validate(config); err != nil {
+		return nil, err
+	}
+	r := &Replicator{actor: config.Actor}
+	if r.actor == "" {
+		r.actor = configuration.DefaultReplicationActor
+	}
+	backoff, maxBackoff := config.Backoff, config.MaxBackoff
+	if backoff == 0 {
+		backoff = defaultBackoff
+	}
+	if maxBackoff == 0 {
+		maxBackoff = defaultMaxBackoff
+	}
+
+	r.ctx, r.cancel = context.WithCancel(context.WithoutCancel(ctx))
+	for _, config := range config.Peers {
+		p := newPeer(config, r.actor, local, driver, backoff, maxBackoff)
+		r.peers = append(r.peers, p)
+		r.wg.Add(1)
+		go func() {
+			defer r.wg.Done()
+			p.run(r.ctx)
+		}()
+	}
+	return r, nil
+}
+
+// Write queues the replication of a pushed manifest to the peers, unless it
+// was pushed by the replication. The other events are ignored.
+func (r *Replicator) Write(event events.Event) error {
+	e, ok := event.(notifications.Event)
+	if !ok || e.Action != notifications.EventActionPush || e.Actor.Name == r.actor {
+		return nil
+	}
+	if !slices.Contains(distribution.ManifestMediaTypes(), e.Target.MediaType) {
+		return nil
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.closed {
+		return events.ErrSinkClosed
+	}
+	j := &job{
+		Repository: e.Target.Repository,
+		Digest:     e.Target.Digest,
+		Tag:        e.Target.Tag,
+		Pushed:     e.Timestamp,
+	}
+	for _, p := range r.peers {
+		p.enqueue(r.ctx, j)
+	}
+	return nil
+}
+
+// Close stops the replication. The replications in progress are cancelled,
+// and attempted again once the registry restarts.
+func (r *Replicator) Close() error {
+	r.mu.Lock()
+	if r.closed {
+		r.mu.Unlock()
+		return events.ErrSinkClosed
+	}
+	r.closed = true
+	r.mu.Unlock()
+
+	r.cancel()
+	r.wg.Wait()
+	return nil
+}
@@ -0,0 +1,129 @@
+package replication
+
+import (
+	"bufio"
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/docker/go-metrics"
+	"github.com/opencontainers/go-digest"
+
+	"github.com/distribution/distribution/v3/configuration"
+	"github.com/distribution/distribution/v3/manifest/schema2"
+	"github.com/distribution/distribution/v3/notifications"
+	"github.com/distribution/distribution/v3/registry/storage/driver/inmemory"
+)
+
+func TestValidate(t *testing.T) {
+	for _, tc := range []struct {
+		name  string
+		peers []configuration.ReplicationPeer
+		valid bool
+	}{
+		{name: "valid", peers: []configuration.ReplicationPeer{{Name: "a", URL: "https://a.example.com"}, {Name: "b", URL: "https://b.example.com"}}, valid: true},
+		{name: "no peer"},
+		{name: "invalid name", peers: []configuration.ReplicationPeer{{Name: "a/b", URL: "https://a.example.com"}}},
+		{name: "duplicate name", peers: []configuration.ReplicationPeer{{Name: "a", URL: "https://a.example.com"}, {Name: "a", URL: "https://b.example.com"}}},
+		{name: "no url", peers: []configuration.ReplicationPeer{{Name: "a"}}},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			_, err := Validate(configuration.Replication{Peers: tc.peers})
+			if tc.valid && err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if !tc.valid && err == nil {
+				t.Fatal("expected an error")
+			}
+		})
+	}
+}
+
+func TestReplicatorQueue(t *testing.T) {
+	ctx := context.Background()
+	driver := inmemory.New()
+	p := newPeer(configuration.ReplicationPeer{Name: "peer", URL: "http://127.0.0.1:0"}, configuration.DefaultReplicationActor, nil, driver, time.Second, time.Second)
+	r := &Replicator{actor: configuration.DefaultReplicationActor, peers: []*peer{p}, ctx: ctx}
+
+	push := func(actor, mediaType, tag string, dgst digest.Digest) {
+		var e notifications.Event
+		e.Action = notifications.EventActionPush
+		e.Actor.Name = actor
+		e.Target.MediaType = mediaType
+		e.Target.Repository = "foo/bar"
+		e.Target.Digest = dgst
+		e.Target.Tag = tag
+		e.Timestamp = time.Now()
+		if err := r.Write(e); err != nil {
+			t.Fatal(err)
+		}
+	}
+	first, second := digest.FromString("first"), digest.FromString("second")
+	push("", schema2.MediaTypeManifest, "latest", first)
+	// The pushes of the replication and of the blobs are not replicated,
+	// the second push of the tag supersedes the first.
+	push(configuration.DefaultReplicationActor, schema2.MediaTypeManifest, "other", first)
+	push("", schema2.MediaTypeLayer, "", first)
+	push("", schema2.MediaTypeManifest, "latest", second)
+	push("", schema2.MediaTypeManifest, "", first)
+
+	files, err := driver.List(ctx, "/replication/peer")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(files) != 2 {
+		t.Fatalf("unexpected queue %v", files)
+	}
+
+	// The queue is loaded by a new registry.
+	loaded := newPeer(p.config, p.actor, nil, driver, time.Second, time.Second)
+	if err := loaded.load(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if len(loaded.jobs) != 2 || loaded.jobs["foo/bar:latest"].Digest != second || loaded.jobs["foo/bar@"+first.String()] == nil {
+		t.Fatalf("unexpected jobs %v", loaded.jobs)
+	}
+
+	j, wait := loaded.next()
+	if j.Tag != "latest" || wait > 0 {
+		t.Fatalf("unexpected next job %+v in %s", j, wait)
+	}
+	loaded.done(ctx, j)
+	if files, err := driver.List(ctx, "/replication/peer"); err != nil || len(files) != 1 {
+		t.Fatalf("unexpected queue %v: %v", files, err)
+	}
+}
+
+func TestMetricsExported(t *testing.T) {
+	const peer = "metrics-peer"
+	pending.WithValues(peer).Set(1)
+	lag.WithValues(peer).Set(2)
+	replicated.WithValues(peer).Inc(1)
+	failures.WithValues(peer).Inc(1)
+	dropped.WithValues(peer).Inc(1)
+
+	rec := httptest.NewRecorder()
+	metrics.Handler().ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/metrics", nil))
+
+	found := make(map[string]bool)
+	scanner := bufio.NewScanner(rec.Body)
+	for scanner.Scan() {
+		line := scanner.Text()
+		if !strings.Contains(line, `peer="`+peer+`"`) {
+			continue
+		}
+		for _, name := range []string{"pending", "lag", "replicated", "failures", "dropped"} {
+			if strings.HasPrefix(line, "registry_replication_"+name) {
+				found[name] = true
+			}
+		}
+	}
+	for _, name := range []string{"pending", "lag", "replicated", "failures", "dropped"} {
+		if !found[name] {
+			t.Errorf("expected the registry_replication_%s series on /metrics", name)
+		}
+	}
+}
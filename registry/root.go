@@ -1,13 +1,26 @@
 package registry
 
 import (
+	"context"
+	"encoding/json"
 	"fmt"
 	"os"
+	"os/signal"
+	"os/user"
+	"slices"
+	"syscall"
+	"time"
 
+	"github.com/distribution/distribution/v3/audit"
+	"github.com/distribution/distribution/v3/configuration"
 	"github.com/distribution/distribution/v3/internal/dcontext"
+	"github.com/distribution/distribution/v3/notifications"
+	"github.com/distribution/distribution/v3/registry/auth/htpasswd"
+	"github.com/distribution/distribution/v3/registry/handlers"
 	"github.com/distribution/distribution/v3/registry/storage"
 	"github.com/distribution/distribution/v3/registry/storage/driver/factory"
 	"github.com/distribution/distribution/v3/version"
+	"github.com/distribution/reference"
 	"github.com/spf13/cobra"
 )
 
@@ -18,7 +31,85 @@ func init() {
 	RootCmd.AddCommand(GCCmd)
 	GCCmd.Flags().BoolVarP(&dryRun, "dry-run", "d", false, "do everything except remove the blobs")
 	GCCmd.Flags().BoolVarP(&removeUntagged, "delete-untagged", "m", false, "delete manifests that are not currently referenced via tag")
+	GCCmd.Flags().DurationVar(&untaggedOlderThan, "delete-untagged-older-than", 0, "delete manifests that are not currently referenced via tag, if they were pushed at least this long ago")
 	GCCmd.Flags().BoolVarP(&quiet, "quiet", "q", false, "silence output")
+	GCCmd.Flags().StringVarP(&output, "output", "o", "text", "output format, text or json to print a report of the deleted objects")
+	GCCmd.Flags().IntVarP(&parallelism, "parallelism", "p", 1, "number of storage directories listed concurrently")
+	GCCmd.Flags().IntVar(&deleteParallelism, "delete-parallelism", 1, "number of objects deleted concurrently, or of batches of blobs on the storage drivers deleting in batches")
+	GCCmd.Flags().StringArrayVar(&includeRepositories, "include-repositories", nil, "only delete from the repositories matching this glob pattern, repeatable")
+	GCCmd.Flags().StringArrayVar(&excludeRepositories, "exclude-repositories", nil, "never delete from the repositories matching this glob pattern, repeatable")
+	GCCmd.Flags().BoolVar(&online, "online", false, "run while the registry accepts pushes, keeping the content written since the cut-off")
+	GCCmd.Flags().DurationVar(&onlineGrace, "online-grace", time.Hour, "with --online, how long before garbage collection starts the cut-off is")
+	GCCmd.Flags().IntVar(&sweepBatchSize, "sweep-batch-size", 100, "with --online, number of objects deleted between two marks of the new manifests")
+	GCCmd.Flags().Float64Var(&sweepRate, "sweep-rate", 0, "with --online, maximum number of objects deleted per second, unlimited if 0")
+	GCCmd.Flags().DurationVar(&progressInterval, "progress-interval", time.Minute, "interval at which the progress is printed, never if 0")
+	GCCmd.Flags().StringVar(&stateFile, "state-file", "", "file the state is checkpointed to, so that an interrupted run can be resumed")
+	GCCmd.Flags().BoolVar(&resume, "resume", false, "with --state-file, resume from the checkpoint of an interrupted run, if any")
+	GCCmd.Flags().DurationVar(&stateMaxAge, "state-max-age", 24*time.Hour, "with --resume, refuse the checkpoints of runs started longer ago, unlimited if 0")
+	GCCmd.Flags().BoolVar(&gcNotify, "notify", true, "notify the manifests and layer links deleted to the notification endpoints")
+	GCCmd.Flags().DurationVar(&gcNotifyTimeout, "notify-timeout", time.Minute, "with --notify, how long the notifications are flushed for before exiting")
+	GCCmd.Flags().StringVar(&gcTenant, "tenant", "", "with tenancy, the tenant whose content is garbage collected")
+	RootCmd.AddCommand(PurgeUploadsCmd)
+	PurgeUploadsCmd.Flags().DurationVar(&uploadsOlderThan, "older-than", 168*time.Hour, "delete the uploads started at least this long ago")
+	PurgeUploadsCmd.Flags().BoolVarP(&dryRun, "dry-run", "d", false, "do everything except remove the uploads")
+	PurgeUploadsCmd.Flags().BoolVarP(&quiet, "quiet", "q", false, "silence output")
+	PurgeUploadsCmd.Flags().StringVarP(&output, "output", "o", "text", "output format, text or json to print a report of the deleted uploads")
+	RootCmd.AddCommand(ScrubCmd)
+	ScrubCmd.Flags().IntVarP(&scrubConcurrency, "concurrency", "c", 4, "number of blobs read concurrently")
+	ScrubCmd.Flags().Int64Var(&scrubRateLimit, "rate-limit", 0, "maximum number of bytes read per second, unlimited if 0")
+	ScrubCmd.Flags().StringVar(&scrubSample, "sample", "", "percentage of the blobs scrubbed, sampled at random, such as 5%, every blob if not set")
+	ScrubCmd.Flags().StringVar(&scrubRepair, "repair", "", "quarantine to move the blobs whose content does not match their digest out of the blob store")
+	ScrubCmd.Flags().BoolVarP(&quiet, "quiet", "q", false, "silence the progress and the problems found")
+	ScrubCmd.Flags().StringVarP(&output, "output", "o", "text", "output format, text or json to print a report of the problems found")
+	ScrubCmd.Flags().DurationVar(&progressInterval, "progress-interval", time.Minute, "interval at which the progress is printed, never if 0")
+	ScrubCmd.Flags().StringVar(&stateFile, "state-file", "", "file the progress is checkpointed to, so that an interrupted run can be resumed")
+	ScrubCmd.Flags().BoolVar(&resume, "resume", false, "with --state-file, resume from the checkpoint of an interrupted run, if any")
+	RootCmd.AddCommand(DuCmd)
+	DuCmd.Flags().IntVar(&duTop, "top", 0, "only list the repositories with the most exclusive bytes, every repository if 0")
+	DuCmd.Flags().BoolVarP(&quiet, "quiet", "q", false, "silence the progress")
+	DuCmd.Flags().StringVarP(&output, "output", "o", "text", "output format, text or json")
+	DuCmd.Flags().DurationVar(&progressInterval, "progress-interval", time.Minute, "interval at which the progress is printed, never if 0")
+	RootCmd.AddCommand(ReplayNotificationsCmd)
+	ReplayNotificationsCmd.Flags().StringVar(&replayEndpoint, "endpoint", "", "name of the notification endpoint the events are posted to")
+	ReplayNotificationsCmd.Flags().StringVar(&replayURL, "url", "", "url the events are posted to, instead of the url of the endpoint")
+	ReplayNotificationsCmd.Flags().IntVar(&replaySkip, "skip", 0, "number of lines of the file to skip, such as those replayed by a previous run")
+	RootCmd.AddCommand(ConfigCmd)
+	ConfigCmd.AddCommand(ValidateConfigCmd)
+	ValidateConfigCmd.Flags().BoolVar(&validateOnline, "online", false, "also probe the storage, and the upstream registries and token endpoints")
+	RootCmd.AddCommand(MirrorCmd)
+	MirrorCmd.AddCommand(MirrorSyncCmd)
+	MirrorSyncCmd.Flags().IntVarP(&mirrorConcurrency, "concurrency", "c", 4, "number of tags copied concurrently")
+	MirrorSyncCmd.Flags().BoolVar(&mirrorIfChanged, "if-changed", false, "skip the tags already pointing to the digest of the source")
+	MirrorSyncCmd.Flags().StringVar(&mirrorReportFile, "report", "", "file a JSON report of the tags synced is written to")
+	MirrorSyncCmd.Flags().BoolVarP(&quiet, "quiet", "q", false, "silence the progress output")
+	RootCmd.AddCommand(ExportCmd)
+	ExportCmd.Flags().StringVar(&exportRepository, "repo", "", "name of the repository exported")
+	ExportCmd.Flags().StringArrayVar(&exportTags, "tags", nil, "only export the tags matching this glob pattern, repeatable")
+	ExportCmd.Flags().StringVarP(&exportOutput, "output", "o", "-", "file the archive is written to, or - for the standard output")
+	ExportCmd.Flags().BoolVar(&exportReferrers, "referrers", false, "also export the manifests referring to the manifests exported")
+	ExportCmd.Flags().BoolVarP(&quiet, "quiet", "q", false, "silence the summary output")
+	RootCmd.AddCommand(ImportCmd)
+	ImportCmd.Flags().StringVar(&importRepository, "repo", "", "name of the repository imported into")
+	ImportCmd.Flags().BoolVar(&importNotify, "notify", false, "notify the pushes of the content imported to the notification endpoints")
+	ImportCmd.Flags().BoolVarP(&quiet, "quiet", "q", false, "silence the summary output")
+	RootCmd.AddCommand(QuotaCmd)
+	QuotaCmd.AddCommand(QuotaRecalcCmd)
+	QuotaRecalcCmd.Flags().BoolVarP(&quiet, "quiet", "q", false, "silence the usage output")
+	RootCmd.AddCommand(CatalogCmd)
+	CatalogCmd.AddCommand(CatalogRebuildCmd)
+	CatalogRebuildCmd.Flags().IntVarP(&parallelism, "parallelism", "p", 1, "number of storage directories listed concurrently")
+	CatalogRebuildCmd.Flags().BoolVarP(&quiet, "quiet", "q", false, "silence the repositories added and removed")
+	RootCmd.AddCommand(DiagnoseCmd)
+	DiagnoseCmd.AddCommand(DiagnoseECRCmd)
+	DiagnoseECRCmd.Flags().StringVar(&diagnoseConfig, "config", "", "path of the configuration, instead of the argument")
+	DiagnoseECRCmd.Flags().BoolVar(&diagnoseJSON, "json", false, "print the diagnoses as JSON")
+	RootCmd.AddCommand(HtpasswdCmd)
+	HtpasswdCmd.AddCommand(HtpasswdHashCmd)
+	HtpasswdHashCmd.Flags().StringVar(&htpasswdAlgorithm, "algorithm", htpasswd.AlgorithmArgon2id, "hash algorithm, argon2id or bcrypt")
+	HtpasswdHashCmd.Flags().IntVar(&htpasswdCost, "cost", 0, "cost of bcrypt hashes, instead of the configured minimum or 12")
+	HtpasswdHashCmd.Flags().Uint32Var(&htpasswdMemory, "memory", 0, "memory of argon2id hashes in KiB, instead of the configured minimum or 65536")
+	HtpasswdHashCmd.Flags().Uint32Var(&htpasswdIterations, "iterations", 0, "iterations of argon2id hashes, instead of the configured minimum or 3")
+	HtpasswdHashCmd.Flags().Uint8Var(&htpasswdParallelism, "parallelism", 0, "parallelism of argon2id hashes, instead of 4")
 	RootCmd.Flags().BoolVarP(&showVersion, "version", "v", false, "show the version and exit")
 }
 
@@ -41,8 +132,66 @@ var (
 	dryRun         bool
 	removeUntagged bool
 	quiet          bool
+	parallelism    int
+	output         string
+	online         bool
+	onlineGrace    time.Duration
+	sweepBatchSize int
+	sweepRate      float64
+
+	untaggedOlderThan time.Duration
+	progressInterval  time.Duration
+	stateFile         string
+	resume            bool
+	stateMaxAge       time.Duration
+	deleteParallelism int
+	gcNotify          bool
+	gcNotifyTimeout   time.Duration
+	gcTenant          string
+
+	includeRepositories []string
+	excludeRepositories []string
+
+	uploadsOlderThan time.Duration
+
+	scrubConcurrency int
+	scrubRateLimit   int64
+	scrubSample      string
+	scrubRepair      string
+
+	duTop int
+
+	replayEndpoint string
+	replayURL      string
+	replaySkip     int
+
+	validateOnline bool
+
+	mirrorConcurrency int
+	mirrorIfChanged   bool
+	mirrorReportFile  string
+
+	exportRepository string
+	exportTags       []string
+	exportOutput     string
+	exportReferrers  bool
+
+	importRepository string
+	importNotify     bool
+
+	diagnoseConfig string
+	diagnoseJSON   bool
+
+	htpasswdAlgorithm   string
+	htpasswdCost        int
+	htpasswdMemory      uint32
+	htpasswdIterations  uint32
+	htpasswdParallelism uint8
 )
 
+// gcActor is the actor of the events of the deletions of garbage collection.
+const gcActor = "garbage-collector"
+
 // GCCmd is the cobra command that corresponds to the garbage-collect subcommand
 var GCCmd = &cobra.Command{
 	Use:   "garbage-collect <config>",
@@ -70,20 +219,1055 @@ var GCCmd = &cobra.Command{
 			os.Exit(1)
 		}
 
-		registry, err := storage.NewRegistry(ctx, driver)
+		if parallelism < 1 {
+			fmt.Fprintf(os.Stderr, "parallelism must be at least 1, %d invalid\n", parallelism)
+			// nolint:errcheck
+			cmd.Usage()
+			os.Exit(1)
+		}
+
+		if deleteParallelism < 1 {
+			fmt.Fprintf(os.Stderr, "delete-parallelism must be at least 1, %d invalid\n", deleteParallelism)
+			// nolint:errcheck
+			cmd.Usage()
+			os.Exit(1)
+		}
+
+		if output != "text" && output != "json" {
+			fmt.Fprintf(os.Stderr, "output must be text or json, %s invalid\n", output)
+			// nolint:errcheck
+			cmd.Usage()
+			os.Exit(1)
+		}
+
+		if resume && stateFile == "" {
+			fmt.Fprintf(os.Stderr, "resume requires a state-file\n")
+			// nolint:errcheck
+			cmd.Usage()
+			os.Exit(1)
+		}
+
+		if untaggedOlderThan < 0 {
+			fmt.Fprintf(os.Stderr, "delete-untagged-older-than must not be negative, %v invalid\n", untaggedOlderThan)
+			// nolint:errcheck
+			cmd.Usage()
+			os.Exit(1)
+		}
+
+		var tenantQuota bool
+		if config.Tenancy.Enabled() != (gcTenant != "") {
+			fmt.Fprintf(os.Stderr, "tenant must be set if and only if tenancy is enabled\n")
+			// nolint:errcheck
+			cmd.Usage()
+			os.Exit(1)
+		}
+		if gcTenant != "" {
+			i := slices.IndexFunc(config.Tenancy.Tenants, func(tenant configuration.Tenant) bool {
+				return tenant.Name == gcTenant
+			})
+			if i < 0 {
+				fmt.Fprintf(os.Stderr, "unknown tenant %s\n", gcTenant)
+				os.Exit(1)
+			}
+			// The tenants share no blob, so that each is collected alone
+			// under its prefix.
+			driver = storage.TenantDriver(driver, config.Tenancy.Tenants[i].TenantPrefix())
+			tenantQuota = config.Tenancy.Tenants[i].Quota > 0
+		}
+
+		registry, err := storage.NewRegistry(ctx, driver, storage.WalkParallelism(parallelism))
 		if err != nil {
 			fmt.Fprintf(os.Stderr, "failed to construct registry: %v", err)
 			os.Exit(1)
 		}
 
-		err = storage.MarkAndSweep(ctx, driver, registry, storage.GCOpts{
+		opts := storage.GCOpts{
 			DryRun:         dryRun,
-			RemoveUntagged: removeUntagged,
+			RemoveUntagged: removeUntagged || untaggedOlderThan > 0,
 			Quiet:          quiet,
-		})
+			Retention:      retentionPolicy(config.Policy.Retention),
+
+			UntaggedOlderThan: untaggedOlderThan,
+			ProgressInterval:  progressInterval,
+			DeleteParallelism: deleteParallelism,
+		}
+		if len(includeRepositories) > 0 || len(excludeRepositories) > 0 {
+			opts.Repositories = &storage.RepositoryFilter{
+				Include: includeRepositories,
+				Exclude: excludeRepositories,
+			}
+			if err := opts.Repositories.Validate(); err != nil {
+				fmt.Fprintf(os.Stderr, "%v\n", err)
+				// nolint:errcheck
+				cmd.Usage()
+				os.Exit(1)
+			}
+		}
+		var app *handlers.App
+		if (config.Policy.Quotas.Enabled() || tenantQuota || config.Catalog.Index.Enabled || (gcNotify && len(config.Notifications.Endpoints) > 0)) && !dryRun {
+			// The usage of the quotas and the catalog index are kept where
+			// the registry keeps them, and the deletions are notified to
+			// its endpoints.
+			app = handlers.NewApp(ctx, config)
+			opts.Quotas = app.Quotas()
+			if gcTenant != "" {
+				opts.Quotas = app.TenantQuota(gcTenant)
+			}
+			opts.Catalog = app.CatalogIndex()
+			if gcNotify {
+				opts.Listener = app.EventListener(gcActor)
+			}
+		}
+		if stateFile != "" {
+			opts.Checkpoint = &storage.GCCheckpointOpts{
+				Path:   stateFile,
+				Resume: resume,
+				MaxAge: stateMaxAge,
+			}
+		}
+		if online {
+			if onlineGrace < 0 || sweepBatchSize < 1 || sweepRate < 0 {
+				fmt.Fprintf(os.Stderr, "online-grace and sweep-rate must not be negative, and sweep-batch-size must be at least 1\n")
+				// nolint:errcheck
+				cmd.Usage()
+				os.Exit(1)
+			}
+			opts.Online = &storage.OnlineGCOpts{
+				CutOff:    time.Now().Add(-onlineGrace),
+				BatchSize: sweepBatchSize,
+				Rate:      sweepRate,
+			}
+		}
+		if output == "json" {
+			// The standard output is left to the report.
+			opts.Output = os.Stderr
+		}
+		// An interrupted garbage collection stops once the deletions running
+		// complete, leaving its checkpoint to resume from.
+		ctx, stop := signal.NotifyContext(ctx, os.Interrupt, syscall.SIGTERM)
+		defer stop()
+		report, err := storage.GarbageCollect(ctx, driver, registry, opts)
+		if app != nil {
+			// The deletions notified are flushed to the endpoints, for no
+			// longer than the timeout.
+			shutdownCtx, cancel := context.WithTimeout(context.Background(), gcNotifyTimeout)
+			if shutdownErr := app.Shutdown(shutdownCtx); shutdownErr != nil {
+				fmt.Fprintf(os.Stderr, "failed to shut down: %v\n", shutdownErr)
+			}
+			cancel()
+		}
+		if config.Log.Audit.Output != "" && !dryRun {
+			if auditErr := recordGarbageCollection(config.Log.Audit, report, err); auditErr != nil {
+				fmt.Fprintf(os.Stderr, "failed to record the garbage collection in the audit log: %v\n", auditErr)
+				os.Exit(1)
+			}
+		}
+		// The report lists the objects which failed to be deleted, if any.
+		if output == "json" && report != nil {
+			enc := json.NewEncoder(os.Stdout)
+			enc.SetIndent("", "  ")
+			if err := enc.Encode(report); err != nil {
+				fmt.Fprintf(os.Stderr, "failed to write report: %v", err)
+				os.Exit(1)
+			}
+		}
 		if err != nil {
 			fmt.Fprintf(os.Stderr, "failed to garbage collect: %v", err)
 			os.Exit(1)
 		}
 	},
 }
+
+// PurgeUploadsCmd is the cobra command that corresponds to the purge-uploads
+// subcommand
+var PurgeUploadsCmd = &cobra.Command{
+	Use:   "purge-uploads <config>",
+	Short: "`purge-uploads` deletes the uploads started longer ago than an age",
+	Long:  "`purge-uploads` deletes the uploads started longer ago than an age. It may be run while the registry accepts pushes.",
+	Run: func(cmd *cobra.Command, args []string) {
+		config, err := resolveConfiguration(args)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "configuration error: %v\n", err)
+			// nolint:errcheck
+			cmd.Usage()
+			os.Exit(1)
+		}
+
+		if uploadsOlderThan <= 0 {
+			fmt.Fprintf(os.Stderr, "older-than must be positive, %v invalid\n", uploadsOlderThan)
+			// nolint:errcheck
+			cmd.Usage()
+			os.Exit(1)
+		}
+
+		if output != "text" && output != "json" {
+			fmt.Fprintf(os.Stderr, "output must be text or json, %s invalid\n", output)
+			// nolint:errcheck
+			cmd.Usage()
+			os.Exit(1)
+		}
+
+		ctx := dcontext.Background()
+		ctx, err = configureLogging(ctx, config)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "unable to configure logging with config: %s", err)
+			os.Exit(1)
+		}
+
+		driver, err := factory.Create(ctx, config.Storage.Type(), config.Storage.Parameters())
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "failed to construct %s driver: %v", config.Storage.Type(), err)
+			os.Exit(1)
+		}
+
+		report, errs := storage.PurgeStaleUploads(ctx, driver, time.Now().Add(-uploadsOlderThan), dryRun)
+		switch {
+		case output == "json":
+			enc := json.NewEncoder(os.Stdout)
+			enc.SetIndent("", "  ")
+			if err := enc.Encode(report); err != nil {
+				fmt.Fprintf(os.Stderr, "failed to write report: %v", err)
+				os.Exit(1)
+			}
+		case !quiet:
+			verb, reclaimed := "deleted", "reclaimed"
+			if dryRun {
+				verb, reclaimed = "eligible for deletion", "reclaimable"
+			}
+			for _, upload := range report.Uploads {
+				fmt.Printf("%s: upload %s started at %s %s, %d bytes\n", upload.Repository, upload.ID, upload.StartedAt.Format(time.RFC3339), verb, upload.Size)
+			}
+			fmt.Printf("%d uploads %s, %d bytes %s\n", len(report.Uploads), verb, report.ReclaimedBytes, reclaimed)
+		}
+		for _, err := range errs {
+			fmt.Fprintf(os.Stderr, "failed to purge uploads: %v\n", err)
+		}
+		if len(errs) > 0 {
+			os.Exit(1)
+		}
+	},
+}
+
+// ScrubCmd is the cobra command that corresponds to the scrub subcommand
+var ScrubCmd = &cobra.Command{
+	Use:   "scrub <config>",
+	Short: "`scrub` verifies that the content of the blobs matches their digest",
+	Long:  "`scrub` reads the content of the blobs of the storage and verifies that it matches their digest, reporting the blobs whose content does not match, is empty or cannot be read. It may be run while the registry serves requests, and exits non-zero if any problem is found.",
+	Run: func(cmd *cobra.Command, args []string) {
+		config, err := resolveConfiguration(args)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "configuration error: %v\n", err)
+			// nolint:errcheck
+			cmd.Usage()
+			os.Exit(1)
+		}
+
+		opts := storage.ScrubOpts{
+			Concurrency:      scrubConcurrency,
+			RateLimit:        scrubRateLimit,
+			Quarantine:       scrubRepair == "quarantine",
+			Quiet:            quiet,
+			ProgressInterval: progressInterval,
+		}
+		var usageErr error
+		switch {
+		case scrubConcurrency < 1:
+			usageErr = fmt.Errorf("concurrency must be at least 1, %d invalid", scrubConcurrency)
+		case scrubRateLimit < 0:
+			usageErr = fmt.Errorf("rate-limit must not be negative, %d invalid", scrubRateLimit)
+		case scrubRepair != "" && scrubRepair != "quarantine":
+			usageErr = fmt.Errorf("repair must be quarantine, %s invalid", scrubRepair)
+		case output != "text" && output != "json":
+			usageErr = fmt.Errorf("output must be text or json, %s invalid", output)
+		case resume && stateFile == "":
+			usageErr = fmt.Errorf("resume requires a state-file")
+		case scrubSample != "":
+			opts.Sample, usageErr = parseScrubSample(scrubSample)
+		}
+		if usageErr != nil {
+			fmt.Fprintln(os.Stderr, usageErr)
+			// nolint:errcheck
+			cmd.Usage()
+			os.Exit(1)
+		}
+		if stateFile != "" {
+			opts.Checkpoint = &storage.ScrubCheckpointOpts{
+				Path:   stateFile,
+				Resume: resume,
+			}
+		}
+		if output == "json" {
+			// The standard output is left to the report.
+			opts.Output = os.Stderr
+		}
+
+		ctx := dcontext.Background()
+		ctx, err = configureLogging(ctx, config)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "unable to configure logging with config: %s", err)
+			os.Exit(1)
+		}
+
+		driver, err := factory.Create(ctx, config.Storage.Type(), config.Storage.Parameters())
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "failed to construct %s driver: %v", config.Storage.Type(), err)
+			os.Exit(1)
+		}
+
+		// An interrupted scrub stops once the blobs being read are read,
+		// leaving its checkpoint to resume from.
+		ctx, stop := signal.NotifyContext(ctx, os.Interrupt, syscall.SIGTERM)
+		defer stop()
+		report, err := storage.Scrub(ctx, driver, opts)
+		if report != nil && (output == "json" || !quiet) {
+			if err := writeScrubReport(os.Stdout, report, output == "json"); err != nil {
+				fmt.Fprintf(os.Stderr, "failed to write report: %v\n", err)
+				os.Exit(1)
+			}
+		}
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "failed to scrub: %v\n", err)
+			os.Exit(1)
+		}
+		if len(report.Problems) > 0 {
+			os.Exit(1)
+		}
+	},
+}
+
+// DuCmd is the cobra command that corresponds to the du subcommand
+var DuCmd = &cobra.Command{
+	Use:   "du <config>",
+	Short: "`du` reports the storage used by each repository",
+	Long:  "`du` reports the number of tags and manifests of each repository, and the size of the blobs it links: exclusive bytes for the blobs linked only by the repository, which deleting it would reclaim, and shared bytes for those linked by other repositories as well. The repositories are sorted by exclusive bytes, the largest first.",
+	Run: func(cmd *cobra.Command, args []string) {
+		config, err := resolveConfiguration(args)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "configuration error: %v\n", err)
+			// nolint:errcheck
+			cmd.Usage()
+			os.Exit(1)
+		}
+
+		var usageErr error
+		switch {
+		case duTop < 0:
+			usageErr = fmt.Errorf("top must not be negative, %d invalid", duTop)
+		case output != "text" && output != "json":
+			usageErr = fmt.Errorf("output must be text or json, %s invalid", output)
+		}
+		if usageErr != nil {
+			fmt.Fprintln(os.Stderr, usageErr)
+			// nolint:errcheck
+			cmd.Usage()
+			os.Exit(1)
+		}
+		opts := storage.DiskUsageOpts{
+			Quiet:            quiet,
+			ProgressInterval: progressInterval,
+			// The standard output is left to the report.
+			Output: os.Stderr,
+		}
+
+		ctx := dcontext.Background()
+		ctx, err = configureLogging(ctx, config)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "unable to configure logging with config: %s", err)
+			os.Exit(1)
+		}
+
+		driver, err := factory.Create(ctx, config.Storage.Type(), config.Storage.Parameters())
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "failed to construct %s driver: %v", config.Storage.Type(), err)
+			os.Exit(1)
+		}
+
+		report, err := storage.DiskUsage(ctx, driver, opts)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "failed to measure the disk usage: %v\n", err)
+			os.Exit(1)
+		}
+		if err := writeDiskUsageReport(os.Stdout, report, duTop, output == "json"); err != nil {
+			fmt.Fprintf(os.Stderr, "failed to write report: %v\n", err)
+			os.Exit(1)
+		}
+	},
+}
+
+// ReplayNotificationsCmd is the cobra command that corresponds to the
+// replay-notifications subcommand
+var ReplayNotificationsCmd = &cobra.Command{
+	Use:   "replay-notifications <config> <file>",
+	Short: "`replay-notifications` posts the events of a dead-letter file to a notification endpoint",
+	Long:  "`replay-notifications` posts the events of a dead-letter file to a notification endpoint, in order, stopping at the first failure.",
+	Run: func(cmd *cobra.Command, args []string) {
+		if len(args) != 2 || replayEndpoint == "" {
+			fmt.Fprintln(os.Stderr, "a configuration, a dead-letter file and an endpoint are required")
+			// nolint:errcheck
+			cmd.Usage()
+			os.Exit(1)
+		}
+		config, err := resolveConfiguration(args)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "configuration error: %v\n", err)
+			// nolint:errcheck
+			cmd.Usage()
+			os.Exit(1)
+		}
+
+		i := slices.IndexFunc(config.Notifications.Endpoints, func(endpoint configuration.Endpoint) bool {
+			return endpoint.Name == replayEndpoint
+		})
+		if i < 0 {
+			fmt.Fprintf(os.Stderr, "unknown notification endpoint %s\n", replayEndpoint)
+			os.Exit(1)
+		}
+		endpoint := config.Notifications.Endpoints[i]
+		url := endpoint.URL
+		if replayURL != "" {
+			url = replayURL
+		}
+		if endpoint.Type != "" && endpoint.Type != "http" && replayURL == "" {
+			fmt.Fprintf(os.Stderr, "notification endpoint %s is not an http endpoint, a url is required\n", replayEndpoint)
+			os.Exit(1)
+		}
+
+		signingSecrets, err := notifications.LoadSigningSecrets(endpoint.Signing)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "failed to load the signing secrets: %v\n", err)
+			os.Exit(1)
+		}
+
+		f, err := os.Open(args[1])
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "failed to open dead-letter file: %v\n", err)
+			os.Exit(1)
+		}
+		defer f.Close()
+
+		n, err := notifications.ReplayDeadLetters(f, url, notifications.EndpointConfig{
+			Headers:        endpoint.Headers,
+			Timeout:        endpoint.Timeout,
+			SigningSecrets: signingSecrets,
+		}, replaySkip)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "failed to replay line %d, rerun with --skip %d to resume: %v\n", n+1, n, err)
+			os.Exit(1)
+		}
+		fmt.Printf("%d lines replayed to %s\n", max(n-replaySkip, 0), url)
+	},
+}
+
+// ConfigCmd is the cobra command that corresponds to the config subcommand
+var ConfigCmd = &cobra.Command{
+	Use:   "config",
+	Short: "`config` operates on the configuration",
+	Long:  "`config` operates on the configuration.",
+	Run: func(cmd *cobra.Command, args []string) {
+		// nolint:errcheck
+		cmd.Usage()
+	},
+}
+
+// ValidateConfigCmd is the cobra command that corresponds to the config
+// validate subcommand
+var ValidateConfigCmd = &cobra.Command{
+	Use:   "validate <config>",
+	Short: "`validate` checks the configuration without starting the registry",
+	Long:  "`validate` checks the configuration as the registry does on startup, without listening. It exits non-zero if any error is found.",
+	Run: func(cmd *cobra.Command, args []string) {
+		config, err := resolveConfiguration(args)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "configuration error: %v\n", err)
+			// nolint:errcheck
+			cmd.Usage()
+			os.Exit(1)
+		}
+
+		var failed bool
+		for _, problem := range validateConfiguration(dcontext.Background(), config, validateOnline) {
+			fmt.Fprintln(os.Stderr, problem)
+			failed = failed || !problem.Warning
+		}
+		if failed {
+			os.Exit(1)
+		}
+		fmt.Println("configuration is valid")
+	},
+}
+
+// MirrorCmd is the cobra command that corresponds to the mirror subcommand
+var MirrorCmd = &cobra.Command{
+	Use:   "mirror",
+	Short: "`mirror` copies content from other registries",
+	Long:  "`mirror` copies content from other registries.",
+	Run: func(cmd *cobra.Command, args []string) {
+		// nolint:errcheck
+		cmd.Usage()
+	},
+}
+
+// MirrorSyncCmd is the cobra command that corresponds to the mirror sync
+// subcommand
+var MirrorSyncCmd = &cobra.Command{
+	Use:   "sync <config> <spec>",
+	Short: "`sync` copies the repositories of a sync spec from a remote registry",
+	Long:  "`sync` copies the manifests of the tags selected by a sync spec, and their blobs, from a remote registry into the storage of the registry. It exits with 2 if some tags failed to be copied.",
+	Run: func(cmd *cobra.Command, args []string) {
+		if len(args) != 2 {
+			fmt.Fprintln(os.Stderr, "a configuration and a sync spec are required")
+			// nolint:errcheck
+			cmd.Usage()
+			os.Exit(1)
+		}
+		config, err := resolveConfiguration(args)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "configuration error: %v\n", err)
+			// nolint:errcheck
+			cmd.Usage()
+			os.Exit(1)
+		}
+		if config.Proxy.Enabled() {
+			fmt.Fprintln(os.Stderr, "cannot sync into a pull through cache")
+			os.Exit(1)
+		}
+		if mirrorConcurrency < 1 {
+			fmt.Fprintf(os.Stderr, "concurrency must be at least 1, %d invalid\n", mirrorConcurrency)
+			// nolint:errcheck
+			cmd.Usage()
+			os.Exit(1)
+		}
+		spec, err := readMirrorSpec(args[1])
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "sync spec error: %v\n", err)
+			os.Exit(1)
+		}
+
+		ctx := dcontext.Background()
+		ctx, err = configureLogging(ctx, config)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "unable to configure logging with config: %s", err)
+			os.Exit(1)
+		}
+		ctx, stop := signal.NotifyContext(ctx, os.Interrupt, syscall.SIGTERM)
+		defer stop()
+
+		// The content is written through the storage and registry
+		// middlewares and the validation of the configuration, as pushed.
+		app := handlers.NewApp(ctx, config)
+		opts := mirrorOpts{IfChanged: mirrorIfChanged, Concurrency: mirrorConcurrency}
+		if !quiet {
+			opts.Progress = os.Stdout
+		}
+		code := 0
+		report, err := mirrorSync(ctx, app.Registry(), spec, opts)
+		switch {
+		case err != nil:
+			fmt.Fprintf(os.Stderr, "failed to sync: %v\n", err)
+			code = 1
+		case report.Failed > 0:
+			code = 2
+		}
+		if report != nil && mirrorReportFile != "" {
+			content, err := json.MarshalIndent(report, "", "  ")
+			if err == nil {
+				err = os.WriteFile(mirrorReportFile, append(content, '\n'), 0o644)
+			}
+			if err != nil {
+				fmt.Fprintf(os.Stderr, "failed to write report: %v\n", err)
+				code = 1
+			}
+		}
+		if report != nil && !quiet {
+			fmt.Printf("%d tags copied, %d unchanged, %d failed, %d bytes copied\n", report.Copied, report.Unchanged, report.Failed, report.Bytes)
+		}
+		if err := app.Shutdown(context.Background()); err != nil {
+			fmt.Fprintf(os.Stderr, "failed to shut down: %v\n", err)
+		}
+		if code != 0 {
+			os.Exit(code)
+		}
+	},
+}
+
+// ExportCmd is the cobra command that corresponds to the export subcommand
+var ExportCmd = &cobra.Command{
+	Use:   "export <config>",
+	Short: "`export` writes the tags of a repository to an OCI image layout archive",
+	Long:  "`export` reads the manifests of the tags of a repository, and the manifests and blobs they reference, from the storage of the registry and writes them to a tar archive of an OCI image layout.",
+	Run: func(cmd *cobra.Command, args []string) {
+		config, err := resolveConfiguration(args)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "configuration error: %v\n", err)
+			// nolint:errcheck
+			cmd.Usage()
+			os.Exit(1)
+		}
+		if exportRepository == "" {
+			fmt.Fprintln(os.Stderr, "a repository is required")
+			// nolint:errcheck
+			cmd.Usage()
+			os.Exit(1)
+		}
+
+		ctx := dcontext.Background()
+		ctx, err = configureLogging(ctx, config)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "unable to configure logging with config: %s", err)
+			os.Exit(1)
+		}
+		driver, err := factory.Create(ctx, config.Storage.Type(), config.Storage.Parameters())
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "failed to construct %s driver: %v", config.Storage.Type(), err)
+			os.Exit(1)
+		}
+		registry, err := storage.NewRegistry(ctx, driver)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "failed to construct registry: %v", err)
+			os.Exit(1)
+		}
+
+		out := os.Stdout
+		if exportOutput != "-" {
+			out, err = os.Create(exportOutput)
+			if err != nil {
+				fmt.Fprintf(os.Stderr, "failed to create the archive: %v\n", err)
+				os.Exit(1)
+			}
+		}
+		opts := exportOpts{Tags: exportTags, Referrers: exportReferrers}
+		report, err := exportLayout(ctx, registry, exportRepository, opts, out)
+		if err == nil && out != os.Stdout {
+			err = out.Close()
+		}
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "failed to export: %v\n", err)
+			if out != os.Stdout {
+				out.Close()
+				os.Remove(exportOutput)
+			}
+			os.Exit(1)
+		}
+		if !quiet {
+			// The standard output may be the archive.
+			fmt.Fprintf(os.Stderr, "%d tags exported, %d manifests, %d blobs, %d bytes\n", report.Tags, report.Manifests, report.Blobs, report.Bytes)
+		}
+	},
+}
+
+// ImportCmd is the cobra command that corresponds to the import subcommand
+var ImportCmd = &cobra.Command{
+	Use:   "import <config> <layout>",
+	Short: "`import` writes an OCI image layout to a repository",
+	Long:  "`import` writes the blobs and manifests of an OCI image layout, a directory or a tar archive read from the standard input if -, to a repository of the storage of the registry, and tags the manifests named in its index. The content the repository already has is skipped.",
+	Run: func(cmd *cobra.Command, args []string) {
+		if len(args) != 2 {
+			fmt.Fprintln(os.Stderr, "a configuration and a layout are required")
+			// nolint:errcheck
+			cmd.Usage()
+			os.Exit(1)
+		}
+		config, err := resolveConfiguration(args)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "configuration error: %v\n", err)
+			// nolint:errcheck
+			cmd.Usage()
+			os.Exit(1)
+		}
+		named, err := reference.WithName(importRepository)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "invalid repository %q: %v\n", importRepository, err)
+			// nolint:errcheck
+			cmd.Usage()
+			os.Exit(1)
+		}
+
+		var walk func(layoutFileFunc) error
+		switch info, err := os.Stat(args[1]); {
+		case args[1] == "-":
+			walk = func(fn layoutFileFunc) error { return walkLayoutArchive(os.Stdin, fn) }
+		case err != nil:
+			fmt.Fprintf(os.Stderr, "failed to read the layout: %v\n", err)
+			os.Exit(1)
+		case info.IsDir():
+			walk = func(fn layoutFileFunc) error { return walkLayoutDir(args[1], fn) }
+		default:
+			walk = func(fn layoutFileFunc) error {
+				f, err := os.Open(args[1])
+				if err != nil {
+					return err
+				}
+				defer f.Close()
+				return walkLayoutArchive(f, fn)
+			}
+		}
+
+		ctx := dcontext.Background()
+		ctx, err = configureLogging(ctx, config)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "unable to configure logging with config: %s", err)
+			os.Exit(1)
+		}
+
+		// The content is written through the storage and registry
+		// middlewares and the validation of the configuration, as pushed.
+		app := handlers.NewApp(ctx, config)
+		var actor string
+		if u, err := user.Current(); err == nil {
+			actor = u.Username
+		}
+		code := 0
+		repo, err := app.StorageRepository(ctx, named, actor, importNotify)
+		var report *importReport
+		if err == nil {
+			var opts importOpts
+			// The content imported into a pull through cache expires as if
+			// pulled.
+			opts.Scheduler, _ = app.Registry().(expiryScheduler)
+			report, err = importLayout(ctx, repo, walk, opts)
+		}
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "failed to import: %v\n", err)
+			code = 1
+		}
+		if report != nil && !quiet {
+			fmt.Printf("%d tags imported, %d manifests, %d blobs, %d bytes, %d skipped\n", report.Tags, report.Manifests, report.Blobs, report.Bytes, report.Skipped)
+		}
+		// The notifications are flushed, and the schedule of the expiry
+		// saved, on shutdown.
+		if err := app.Shutdown(context.Background()); err != nil {
+			fmt.Fprintf(os.Stderr, "failed to shut down: %v\n", err)
+		}
+		if code != 0 {
+			os.Exit(code)
+		}
+	},
+}
+
+// QuotaCmd is the cobra command that corresponds to the quota subcommand
+var QuotaCmd = &cobra.Command{
+	Use:   "quota",
+	Short: "`quota` manages the quotas of the repositories",
+	Long:  "`quota` manages the quotas of the repositories.",
+	Run: func(cmd *cobra.Command, args []string) {
+		// nolint:errcheck
+		cmd.Usage()
+	},
+}
+
+// QuotaRecalcCmd is the cobra command that corresponds to the quota recalc
+// subcommand
+var QuotaRecalcCmd = &cobra.Command{
+	Use:   "recalc <config>",
+	Short: "`recalc` rebuilds the usage of the quotas from the storage",
+	Long:  "`recalc` replaces the usage of the quotas of the repositories by the total size of the layers they link, walking the storage of the registry. It should be run after quotas are enabled or changed.",
+	Run: func(cmd *cobra.Command, args []string) {
+		config, err := resolveConfiguration(args)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "configuration error: %v\n", err)
+			// nolint:errcheck
+			cmd.Usage()
+			os.Exit(1)
+		}
+		if !config.Policy.Quotas.Enabled() {
+			fmt.Fprintln(os.Stderr, "no quotas are configured")
+			os.Exit(1)
+		}
+		if config.Proxy.Enabled() {
+			fmt.Fprintln(os.Stderr, "cannot recalculate the quotas of a pull through cache")
+			os.Exit(1)
+		}
+
+		ctx := dcontext.Background()
+		ctx, err = configureLogging(ctx, config)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "unable to configure logging with config: %s", err)
+			os.Exit(1)
+		}
+
+		driver, err := factory.Create(ctx, config.Storage.Type(), config.Storage.Parameters())
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "failed to construct %s driver: %v\n", config.Storage.Type(), err)
+			os.Exit(1)
+		}
+		app := handlers.NewApp(ctx, config)
+		usages, err := app.Quotas().Recalculate(ctx, driver, app.Registry())
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "failed to recalculate the quotas: %v\n", err)
+			os.Exit(1)
+		}
+		if !quiet {
+			for _, usage := range usages {
+				fmt.Printf("%s: %d of %d bytes\n", usage.Repository, usage.Usage, usage.Limit)
+			}
+		}
+	},
+}
+
+// CatalogCmd is the cobra command that corresponds to the catalog subcommand
+var CatalogCmd = &cobra.Command{
+	Use:   "catalog",
+	Short: "`catalog` manages the index of the catalog",
+	Long:  "`catalog` manages the index of the repositories the catalog is listed from.",
+	Run: func(cmd *cobra.Command, args []string) {
+		// nolint:errcheck
+		cmd.Usage()
+	},
+}
+
+// CatalogRebuildCmd is the cobra command that corresponds to the catalog
+// rebuild subcommand
+var CatalogRebuildCmd = &cobra.Command{
+	Use:   "rebuild <config>",
+	Short: "`rebuild` reconciles the catalog index with the storage",
+	Long:  "`rebuild` adds the repositories of the storage missing from the catalog index, and removes those missing from the storage, walking the storage of the registry. It should be run after the index is enabled on an existing registry.",
+	Run: func(cmd *cobra.Command, args []string) {
+		config, err := resolveConfiguration(args)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "configuration error: %v\n", err)
+			// nolint:errcheck
+			cmd.Usage()
+			os.Exit(1)
+		}
+		if !config.Catalog.Index.Enabled {
+			fmt.Fprintln(os.Stderr, "the catalog index is not enabled")
+			os.Exit(1)
+		}
+		if parallelism < 1 {
+			fmt.Fprintf(os.Stderr, "parallelism must be at least 1, %d invalid\n", parallelism)
+			// nolint:errcheck
+			cmd.Usage()
+			os.Exit(1)
+		}
+
+		ctx := dcontext.Background()
+		ctx, err = configureLogging(ctx, config)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "unable to configure logging with config: %s", err)
+			os.Exit(1)
+		}
+
+		driver, err := factory.Create(ctx, config.Storage.Type(), config.Storage.Parameters())
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "failed to construct %s driver: %v\n", config.Storage.Type(), err)
+			os.Exit(1)
+		}
+		registry, err := storage.NewRegistry(ctx, driver, storage.WalkParallelism(parallelism))
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "failed to construct registry: %v\n", err)
+			os.Exit(1)
+		}
+		app := handlers.NewApp(ctx, config)
+		reconciliation, err := app.CatalogIndex().Reconcile(ctx, registry)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "failed to rebuild the catalog index: %v\n", err)
+			os.Exit(1)
+		}
+		if !quiet {
+			for _, name := range reconciliation.Added {
+				fmt.Printf("added %s\n", name)
+			}
+			for _, name := range reconciliation.Removed {
+				fmt.Printf("removed %s\n", name)
+			}
+		}
+		fmt.Printf("%d repositories indexed: %d added, %d removed\n", reconciliation.Repositories, len(reconciliation.Added), len(reconciliation.Removed))
+	},
+}
+
+// recordGarbageCollection appends the deletions of the garbage collection
+// reported, and its run, to the audit log, as done by the user running it.
+func recordGarbageCollection(config configuration.AuditLog, report *storage.GCReport, gcErr error) error {
+	logger, err := audit.New(config)
+	if err != nil {
+		return err
+	}
+	defer logger.Close()
+
+	var actor string
+	if u, err := user.Current(); err == nil {
+		actor = u.Username
+	}
+	var entries []audit.Entry
+	if report != nil {
+		for _, repository := range report.Repositories {
+			for _, tag := range repository.Tags {
+				entries = append(entries, audit.Entry{Action: audit.ActionGCTagDelete, Repository: repository.Name, Tag: tag.Name, Digest: tag.Digest})
+			}
+			for _, manifest := range repository.Manifests {
+				entries = append(entries, audit.Entry{Action: audit.ActionGCManifestDelete, Repository: repository.Name, Digest: manifest.Digest})
+			}
+		}
+		for _, blob := range report.Blobs {
+			entries = append(entries, audit.Entry{Action: audit.ActionGCBlobDelete, Digest: blob.Digest})
+		}
+		for i := range entries {
+			entries[i].Outcome = audit.OutcomeSuccess
+		}
+		for _, failure := range report.Failed {
+			// The layer links unlinked from the repositories are not recorded.
+			action := map[string]string{
+				"tag":      audit.ActionGCTagDelete,
+				"manifest": audit.ActionGCManifestDelete,
+				"blob":     audit.ActionGCBlobDelete,
+			}[failure.Kind]
+			if action == "" {
+				continue
+			}
+			entries = append(entries, audit.Entry{
+				Action:     action,
+				Repository: failure.Repository,
+				Tag:        failure.Tag,
+				Digest:     failure.Digest,
+				Outcome:    audit.OutcomeFailure,
+				Error:      failure.Error,
+			})
+		}
+	}
+	run := audit.Entry{Action: audit.ActionGarbageCollect, Outcome: audit.OutcomeSuccess}
+	if gcErr != nil {
+		run.Outcome = audit.OutcomeFailure
+		run.Error = gcErr.Error()
+	}
+	entries = append(entries, run)
+
+	for _, entry := range entries {
+		entry.Actor = actor
+		if err := logger.Log(entry); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// retentionPolicy returns the retention policy of garbage collection, or nil
+// if it deletes no tag.
+func retentionPolicy(config configuration.Retention) *storage.RetentionPolicy {
+	if !config.Enabled() {
+		return nil
+	}
+	policy := &storage.RetentionPolicy{
+		Default: storage.RetentionRule{
+			KeepLatest:         config.KeepLatest,
+			KeepWithin:         config.KeepWithinDuration,
+			KeepPulledWithin:   config.KeepPulledWithinDuration,
+			ProtectPatterns:    config.ProtectPatterns,
+			PruneReferrersTags: config.PruneReferrersTags,
+		},
+	}
+	for _, rule := range config.Repositories {
+		policy.Repositories = append(policy.Repositories, storage.RetentionRule{
+			Pattern:            rule.Pattern,
+			KeepLatest:         rule.KeepLatest,
+			KeepWithin:         rule.KeepWithinDuration,
+			KeepPulledWithin:   rule.KeepPulledWithinDuration,
+			ProtectPatterns:    append(slices.Clone(config.ProtectPatterns), rule.ProtectPatterns...),
+			PruneReferrersTags: rule.PruneReferrersTags,
+		})
+	}
+	return policy
+}
+
+// DiagnoseCmd is the cobra command that corresponds to the diagnose subcommand
+var DiagnoseCmd = &cobra.Command{
+	Use:   "diagnose",
+	Short: "`diagnose` troubleshoots the access to the upstream registries",
+	Long:  "`diagnose` troubleshoots the access to the upstream registries.",
+	Run: func(cmd *cobra.Command, args []string) {
+		// nolint:errcheck
+		cmd.Usage()
+	},
+}
+
+// DiagnoseECRCmd is the cobra command that corresponds to the diagnose ecr
+// subcommand
+var DiagnoseECRCmd = &cobra.Command{
+	Use:   "ecr [<config>]",
+	Short: "`ecr` reports the credentials the ECR remotes are accessed with",
+	Long:  "`ecr` resolves the AWS credentials of each ECR remote of the pull through cache as the registry does, prints the provider which resolved them and their identity, and requests an authorization token for the account of the remote. It exits non-zero if any token is not granted.",
+	Run: func(cmd *cobra.Command, args []string) {
+		if diagnoseConfig != "" {
+			args = []string{diagnoseConfig}
+		}
+		config, err := resolveConfiguration(args)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "configuration error: %v\n", err)
+			// nolint:errcheck
+			cmd.Usage()
+			os.Exit(1)
+		}
+
+		diagnoses, err := diagnoseECRRemotes(config)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(1)
+		}
+		if err := writeECRDiagnoses(os.Stdout, diagnoses, diagnoseJSON); err != nil {
+			fmt.Fprintf(os.Stderr, "failed to write the diagnoses: %v\n", err)
+			os.Exit(1)
+		}
+		for _, d := range diagnoses {
+			if d.FailedStep != "" {
+				os.Exit(1)
+			}
+		}
+	},
+}
+
+// HtpasswdCmd is the cobra command that corresponds to the htpasswd subcommand
+var HtpasswdCmd = &cobra.Command{
+	Use:   "htpasswd",
+	Short: "`htpasswd` manages the entries of htpasswd files",
+	Long:  "`htpasswd` manages the entries of the htpasswd files of the htpasswd access controller.",
+	Run: func(cmd *cobra.Command, args []string) {
+		// nolint:errcheck
+		cmd.Usage()
+	},
+}
+
+// HtpasswdHashCmd is the cobra command that corresponds to the htpasswd hash
+// subcommand
+var HtpasswdHashCmd = &cobra.Command{
+	Use:   "hash <user> [<config>]",
+	Short: "`hash` prints the htpasswd entry of a user",
+	Long:  "`hash` reads the password of the user from the first line of the standard input, and prints its htpasswd entry, hashed with argon2id or bcrypt. The parameters of the hash are at least those of the minimum hash strength of the htpasswd access controller of the configuration, if any.",
+	Run: func(cmd *cobra.Command, args []string) {
+		if len(args) < 1 || len(args) > 2 {
+			fmt.Fprintln(os.Stderr, "a user is required")
+			// nolint:errcheck
+			cmd.Usage()
+			os.Exit(1)
+		}
+		var config *configuration.Configuration
+		if configurationPath(args[1:]) != "" {
+			var err error
+			config, err = resolveConfiguration(args[1:])
+			if err != nil {
+				fmt.Fprintf(os.Stderr, "configuration error: %v\n", err)
+				// nolint:errcheck
+				cmd.Usage()
+				os.Exit(1)
+			}
+		}
+
+		password, err := readPassword(os.Stdin)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "failed to read the password: %v\n", err)
+			os.Exit(1)
+		}
+		entry, err := htpasswdEntry(config, args[0], password, htpasswdHashOpts{
+			Algorithm:  htpasswdAlgorithm,
+			BcryptCost: htpasswdCost,
+			Argon2id: htpasswd.Argon2idParams{
+				Memory:      htpasswdMemory,
+				Iterations:  htpasswdIterations,
+				Parallelism: htpasswdParallelism,
+			},
+		})
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(1)
+		}
+		fmt.Println(entry)
+	},
+}
@@ -0,0 +1,55 @@
+package registry
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+
+	"github.com/distribution/distribution/v3/registry/storage"
+)
+
+// parseScrubSample parses the fraction of the blobs scrubbed, a percentage
+// such as 5% or a fraction such as 0.05.
+func parseScrubSample(sample string) (float64, error) {
+	value, percent := strings.CutSuffix(strings.TrimSpace(sample), "%")
+	fraction, err := strconv.ParseFloat(value, 64)
+	if err != nil {
+		return 0, fmt.Errorf("sample must be a percentage or a fraction, %q invalid", sample)
+	}
+	if percent {
+		fraction /= 100
+	}
+	if fraction <= 0 || fraction > 1 {
+		return 0, fmt.Errorf("sample must be more than 0%% and at most 100%%, %q invalid", sample)
+	}
+	return fraction, nil
+}
+
+// writeScrubReport writes the problems of the report and a summary as text,
+// or the report as JSON if asJSON is set.
+func writeScrubReport(w io.Writer, report *storage.ScrubReport, asJSON bool) error {
+	if asJSON {
+		enc := json.NewEncoder(w)
+		enc.SetIndent("", "  ")
+		return enc.Encode(report)
+	}
+	for _, p := range report.Problems {
+		line := fmt.Sprintf("%s: %s, %d bytes read", p.Digest, p.Problem, p.Size)
+		if p.Actual != "" {
+			line += ", content " + p.Actual.String()
+		}
+		if p.Quarantined {
+			line += ", quarantined"
+		}
+		if p.Error != "" {
+			line += ": " + p.Error
+		}
+		if _, err := fmt.Fprintln(w, line); err != nil {
+			return err
+		}
+	}
+	_, err := fmt.Fprintf(w, "%d blobs scrubbed, %d bytes read, %d skipped, %d problems found\n", report.Blobs, report.Bytes, report.Skipped, len(report.Problems))
+	return err
+}
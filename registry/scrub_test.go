@@ -0,0 +1,63 @@
+package registry
+
+import (
+	"bytes"
+	"encoding/json"
+	"testing"
+
+	"github.com/distribution/distribution/v3/registry/storage"
+	"github.com/opencontainers/go-digest"
+)
+
+func TestParseScrubSample(t *testing.T) {
+	for sample, expected := range map[string]float64{
+		"5%":   0.05,
+		"100%": 1,
+		"0.25": 0.25,
+		" 1% ": 0.01,
+	} {
+		fraction, err := parseScrubSample(sample)
+		if err != nil || fraction != expected {
+			t.Errorf("%q: got %v, %v, expected %v", sample, fraction, err, expected)
+		}
+	}
+	for _, sample := range []string{"", "0%", "-5%", "150%", "1.5", "five"} {
+		if _, err := parseScrubSample(sample); err == nil {
+			t.Errorf("%q: expected an error", sample)
+		}
+	}
+}
+
+func TestWriteScrubReport(t *testing.T) {
+	report := &storage.ScrubReport{
+		Blobs: 3,
+		Bytes: 42,
+		Problems: []storage.ScrubProblem{
+			{Digest: digest.FromString("a"), Problem: storage.ScrubMismatch, Size: 9, Actual: digest.FromString("b"), Quarantined: true},
+			{Digest: digest.FromString("c"), Problem: storage.ScrubUnreadable, Error: "i/o error"},
+		},
+	}
+
+	var buf bytes.Buffer
+	if err := writeScrubReport(&buf, report, false); err != nil {
+		t.Fatal(err)
+	}
+	expected := digest.FromString("a").String() + ": mismatch, 9 bytes read, content " + digest.FromString("b").String() + ", quarantined\n" +
+		digest.FromString("c").String() + ": unreadable, 0 bytes read: i/o error\n" +
+		"3 blobs scrubbed, 42 bytes read, 0 skipped, 2 problems found\n"
+	if buf.String() != expected {
+		t.Fatalf("unexpected report:\n%s\nexpected:\n%s", buf.String(), expected)
+	}
+
+	buf.Reset()
+	if err := writeScrubReport(&buf, report, true); err != nil {
+		t.Fatal(err)
+	}
+	var decoded storage.ScrubReport
+	if err := json.Unmarshal(buf.Bytes(), &decoded); err != nil {
+		t.Fatal(err)
+	}
+	if decoded.Blobs != 3 || len(decoded.Problems) != 2 || !decoded.Problems[0].Quarantined {
+		t.Fatalf("unexpected report %+v", decoded)
+	}
+}
@@ -0,0 +1,13 @@
+//go:build !unix
+
+package registry
+
+import "os"
+
+// reopenSignals are the signals reopening the audit log. SIGUSR1 is not
+// available, so the audit log is only reopened by a restart.
+var reopenSignals []os.Signal
+
+// reloadSignals are the signals reloading the configuration. SIGHUP is not
+// available, so the configuration is only reloaded through the debug server.
+var reloadSignals []os.Signal
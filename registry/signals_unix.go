@@ -0,0 +1,14 @@
+//go:build unix
+
+package registry
+
+import (
+	"os"
+	"syscall"
+)
+
+// reopenSignals are the signals reopening the audit log.
+var reopenSignals = []os.Signal{syscall.SIGUSR1}
+
+// reloadSignals are the signals reloading the configuration.
+var reloadSignals = []os.Signal{syscall.SIGHUP}
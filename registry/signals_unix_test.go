@@ -0,0 +1,58 @@
+//go:build unix
+
+package registry
+
+import (
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"syscall"
+	"testing"
+	"time"
+)
+
+func TestReloadSignal(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr := ln.Addr().String()
+	ln.Close()
+
+	dir := t.TempDir()
+	listener, _ := newListener(t)
+	r := newReloadedRegistry(t, dir, addr, listener.URL)
+	errchan := make(chan error, 1)
+	go func() {
+		errchan <- r.ListenAndServe()
+	}()
+	get := func(user string) int {
+		req, _ := http.NewRequest(http.MethodGet, "http://"+addr+"/v2/", nil)
+		req.SetBasicAuth(user, "password")
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			return 0
+		}
+		resp.Body.Close()
+		return resp.StatusCode
+	}
+	waitFor(t, "the registry to listen", func() bool { return get("alice") == http.StatusOK })
+
+	writeHtpasswd(t, filepath.Join(dir, "bob"), "bob")
+	r.writeConfig(t, "inmemory: {}", "info", filepath.Join(dir, "bob"), "http", listener.URL)
+	if err := syscall.Kill(os.Getpid(), syscall.SIGHUP); err != nil {
+		t.Fatal(err)
+	}
+	waitFor(t, "the htpasswd file to be reloaded", func() bool { return get("bob") == http.StatusOK })
+
+	r.quit <- os.Interrupt
+	select {
+	case err := <-errchan:
+		if err != nil {
+			t.Fatal(err)
+		}
+	case <-time.After(10 * time.Second):
+		t.Fatal("timed out waiting for the registry to shut down")
+	}
+}
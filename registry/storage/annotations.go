@@ -0,0 +1,103 @@
+package storage
+
+import (
+	"fmt"
+	"maps"
+	"path"
+	"regexp"
+	"slices"
+	"strings"
+
+	"github.com/distribution/distribution/v3"
+	"github.com/distribution/distribution/v3/manifest/manifestlist"
+	"github.com/distribution/distribution/v3/manifest/ocischema"
+	"github.com/distribution/distribution/v3/manifest/schema2"
+)
+
+// annotationRule requires annotations of the OCI manifests and image indexes
+// accepted by the repositories matching pattern.
+type annotationRule struct {
+	pattern string
+	// required maps the keys of the annotations required to the expression
+	// their value must match, any value if nil.
+	required map[string]*regexp.Regexp
+	// rejectSchema2 rejects the Docker manifests and manifest lists, which
+	// have no annotations.
+	rejectSchema2 bool
+}
+
+// annotationRuleFor returns the annotation rule applying to the named
+// repository: the first rule whose pattern matches, or else the default rule.
+// It returns nil if no rule applies.
+func (reg *registry) annotationRuleFor(name string) *annotationRule {
+	var fallback *annotationRule
+	for i, rule := range reg.annotations {
+		if rule.pattern == "" {
+			if fallback == nil {
+				fallback = &reg.annotations[i]
+			}
+			continue
+		}
+		if ok, _ := path.Match(rule.pattern, name); ok {
+			return &reg.annotations[i]
+		}
+	}
+	return fallback
+}
+
+// verifyAnnotations checks the annotations of the manifest against the rule
+// applying to the named repository, naming the annotations missing.
+func (reg *registry) verifyAnnotations(name string, manifest distribution.Manifest) error {
+	rule := reg.annotationRuleFor(name)
+	if rule == nil {
+		return nil
+	}
+
+	var annotations map[string]string
+	switch m := manifest.(type) {
+	case *ocischema.DeserializedManifest:
+		annotations = m.Annotations
+	case *ocischema.DeserializedImageIndex:
+		annotations = m.Annotations
+	case *schema2.DeserializedManifest, *manifestlist.DeserializedManifestList:
+		if !rule.rejectSchema2 {
+			return nil
+		}
+		mediaType, _, err := manifest.Payload()
+		if err != nil {
+			return err
+		}
+		return distribution.ErrManifestVerification{distribution.ErrManifestFieldInvalid{
+			Field:  "mediaType",
+			Reason: fmt.Errorf("media type %q has no annotations, required by the repository", mediaType),
+		}}
+	default:
+		return nil
+	}
+
+	var errs distribution.ErrManifestVerification
+	var missing []string
+	for _, key := range slices.Sorted(maps.Keys(rule.required)) {
+		value, ok := annotations[key]
+		switch {
+		case !ok:
+			missing = append(missing, key)
+		case rule.required[key] != nil && !rule.required[key].MatchString(value):
+			errs = append(errs, distribution.ErrManifestFieldInvalid{
+				Field:  fmt.Sprintf("annotations[%s]", key),
+				Reason: fmt.Errorf("value %q does not match %q", value, rule.required[key]),
+			})
+		}
+	}
+	if len(missing) > 0 {
+		errs = append(distribution.ErrManifestVerification{distribution.ErrManifestFieldInvalid{
+			Field:  "annotations",
+			Reason: fmt.Errorf("missing required annotations %s", strings.Join(missing, ", ")),
+		}}, errs...)
+	}
+
+	if len(errs) != 0 {
+		return errs
+	}
+	return nil
+}
@@ -0,0 +1,188 @@
+package storage
+
+import (
+	"errors"
+	"regexp"
+	"strings"
+	"testing"
+
+	"github.com/distribution/distribution/v3"
+	"github.com/distribution/distribution/v3/internal/dcontext"
+	"github.com/distribution/distribution/v3/manifest/ocischema"
+	"github.com/distribution/distribution/v3/registry/storage/driver/inmemory"
+	"github.com/opencontainers/image-spec/specs-go"
+	v1 "github.com/opencontainers/image-spec/specs-go/v1"
+)
+
+// makeAnnotatedManifest returns an OCI image manifest referencing the config
+// and layer of the schema 2 manifest, with the annotations.
+func makeAnnotatedManifest(t *testing.T, docker distribution.Manifest, annotations map[string]string) distribution.Manifest {
+	t.Helper()
+	refs := docker.References()
+	m, err := ocischema.FromStruct(ocischema.Manifest{
+		Versioned:   specs.Versioned{SchemaVersion: 2},
+		MediaType:   v1.MediaTypeImageManifest,
+		Config:      v1.Descriptor{MediaType: v1.MediaTypeImageConfig, Digest: refs[0].Digest, Size: refs[0].Size},
+		Layers:      refs[1:],
+		Annotations: annotations,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return m
+}
+
+// checkAnnotationsRejected checks that err rejects the fields, with reasons
+// containing the strings.
+func checkAnnotationsRejected(t *testing.T, err error, fields map[string]string) {
+	t.Helper()
+	var verification distribution.ErrManifestVerification
+	if !errors.As(err, &verification) || len(verification) != len(fields) {
+		t.Fatalf("expected a manifest verification error of %d fields, got %v", len(fields), err)
+	}
+	for _, e := range verification {
+		var invalid distribution.ErrManifestFieldInvalid
+		if !errors.As(e, &invalid) {
+			t.Fatalf("unexpected error %v", e)
+		}
+		reason, ok := fields[invalid.Field]
+		if !ok || !strings.Contains(invalid.Reason.Error(), reason) {
+			t.Fatalf("unexpected invalid field %s: %v", invalid.Field, invalid.Reason)
+		}
+	}
+}
+
+func TestRequireAnnotationsKeys(t *testing.T) {
+	ctx := dcontext.Background()
+	registry := createRegistry(t, inmemory.New(), RequireAnnotations("", map[string]*regexp.Regexp{
+		v1.AnnotationSource:    nil,
+		"com.example.build-id": nil,
+	}, false))
+	repo := makeRepository(t, registry, "annotations")
+	manifests := makeManifestService(t, repo)
+	docker := makeMediaTypeManifests(t, repo, v1.MediaTypeImageLayerGzip)[0]
+
+	_, err := manifests.Put(ctx, makeAnnotatedManifest(t, docker, nil))
+	checkAnnotationsRejected(t, err, map[string]string{"annotations": "com.example.build-id, " + v1.AnnotationSource})
+
+	_, err = manifests.Put(ctx, makeAnnotatedManifest(t, docker, map[string]string{v1.AnnotationSource: "https://example.com/app"}))
+	checkAnnotationsRejected(t, err, map[string]string{"annotations": "missing required annotations com.example.build-id"})
+
+	if _, err := manifests.Put(ctx, makeAnnotatedManifest(t, docker, map[string]string{
+		v1.AnnotationSource:    "https://example.com/app",
+		"com.example.build-id": "",
+	})); err != nil {
+		t.Fatalf("unexpected error putting an annotated manifest: %v", err)
+	}
+}
+
+func TestRequireAnnotationsValues(t *testing.T) {
+	ctx := dcontext.Background()
+	registry := createRegistry(t, inmemory.New(), RequireAnnotations("", map[string]*regexp.Regexp{
+		v1.AnnotationSource:    regexp.MustCompile(`^(?:https://example\.com/.*)$`),
+		"com.example.build-id": regexp.MustCompile(`^(?:[0-9]+)$`),
+	}, false))
+	repo := makeRepository(t, registry, "annotations")
+	manifests := makeManifestService(t, repo)
+	docker := makeMediaTypeManifests(t, repo, v1.MediaTypeImageLayerGzip)[0]
+
+	_, err := manifests.Put(ctx, makeAnnotatedManifest(t, docker, map[string]string{
+		v1.AnnotationSource:    "https://example.org/app",
+		"com.example.build-id": "42",
+	}))
+	checkAnnotationsRejected(t, err, map[string]string{"annotations[" + v1.AnnotationSource + "]": "https://example.org/app"})
+
+	// The values missing and invalid are both reported.
+	_, err = manifests.Put(ctx, makeAnnotatedManifest(t, docker, map[string]string{"com.example.build-id": "42a"}))
+	checkAnnotationsRejected(t, err, map[string]string{
+		"annotations":                       v1.AnnotationSource,
+		"annotations[com.example.build-id]": "42a",
+	})
+
+	if _, err := manifests.Put(ctx, makeAnnotatedManifest(t, docker, map[string]string{
+		v1.AnnotationSource:    "https://example.com/app",
+		"com.example.build-id": "42",
+	})); err != nil {
+		t.Fatalf("unexpected error putting an annotated manifest: %v", err)
+	}
+}
+
+func TestRequireAnnotationsIndexes(t *testing.T) {
+	ctx := dcontext.Background()
+	registry := createRegistry(t, inmemory.New(), RequireAnnotations("", map[string]*regexp.Regexp{v1.AnnotationSource: nil}, false))
+	repo := makeRepository(t, registry, "annotations")
+	manifests := makeManifestService(t, repo)
+	docker := makeMediaTypeManifests(t, repo, v1.MediaTypeImageLayerGzip)[0]
+	image := makeAnnotatedManifest(t, docker, map[string]string{v1.AnnotationSource: "https://example.com/app"})
+	dgst, err := manifests.Put(ctx, image)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, payload, _ := image.Payload()
+	images := []v1.Descriptor{{MediaType: v1.MediaTypeImageManifest, Digest: dgst, Size: int64(len(payload))}}
+
+	index, err := ocischema.FromDescriptors(images, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = manifests.Put(ctx, index)
+	checkAnnotationsRejected(t, err, map[string]string{"annotations": v1.AnnotationSource})
+
+	if index, err = ocischema.FromDescriptors(images, map[string]string{v1.AnnotationSource: "https://example.com/app"}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := manifests.Put(ctx, index); err != nil {
+		t.Fatalf("unexpected error putting an annotated index: %v", err)
+	}
+}
+
+func TestRequireAnnotationsSchema2(t *testing.T) {
+	ctx := dcontext.Background()
+	registry := createRegistry(t, inmemory.New(),
+		RequireAnnotations("legacy/*", map[string]*regexp.Regexp{v1.AnnotationSource: nil}, false),
+		RequireAnnotations("", map[string]*regexp.Regexp{v1.AnnotationSource: nil}, true))
+
+	// The schema 2 manifests are exempt in the legacy repositories only.
+	legacy := makeRepository(t, registry, "legacy/image")
+	docker := makeMediaTypeManifests(t, legacy, v1.MediaTypeImageLayerGzip)[0]
+	if _, err := makeManifestService(t, legacy).Put(ctx, docker); err != nil {
+		t.Fatalf("unexpected error putting an exempt schema 2 manifest: %v", err)
+	}
+
+	repo := makeRepository(t, registry, "library/image")
+	docker = makeMediaTypeManifests(t, repo, v1.MediaTypeImageLayerGzip)[0]
+	_, err := makeManifestService(t, repo).Put(ctx, docker)
+	checkAnnotationsRejected(t, err, map[string]string{"mediaType": "has no annotations"})
+}
+
+func TestRequireAnnotationsRepositories(t *testing.T) {
+	ctx := dcontext.Background()
+	registry := createRegistry(t, inmemory.New(),
+		RequireAnnotations("sandbox/*", nil, false),
+		RequireAnnotations("prod/*", map[string]*regexp.Regexp{"com.example.build-id": nil}, false),
+		RequireAnnotations("", map[string]*regexp.Regexp{v1.AnnotationSource: nil}, false))
+
+	for _, tc := range []struct {
+		name    string
+		missing string
+	}{
+		{name: "prod/image", missing: "com.example.build-id"},
+		{name: "library/image", missing: v1.AnnotationSource},
+		{name: "sandbox/image"},
+	} {
+		repo := makeRepository(t, registry, tc.name)
+		docker := makeMediaTypeManifests(t, repo, v1.MediaTypeImageLayerGzip)[0]
+		_, err := makeManifestService(t, repo).Put(ctx, makeAnnotatedManifest(t, docker, map[string]string{"org.example.other": "value"}))
+		if tc.missing != "" {
+			checkAnnotationsRejected(t, err, map[string]string{"annotations": tc.missing})
+		} else if err != nil {
+			t.Fatalf("%s: unexpected error putting a manifest: %v", tc.name, err)
+		}
+	}
+}
+
+func TestRequireAnnotationsInvalidPattern(t *testing.T) {
+	if _, err := NewRegistry(dcontext.Background(), inmemory.New(), RequireAnnotations("[", nil, false)); err == nil {
+		t.Fatal("expected an error for an invalid repository pattern")
+	}
+}
@@ -6,12 +6,17 @@ import (
 	"crypto/sha256"
 	"fmt"
 	"io"
+	"os"
 	"path"
+	"path/filepath"
 	"reflect"
+	"sync"
 	"testing"
+	"time"
 
 	"github.com/distribution/distribution/v3"
 	"github.com/distribution/distribution/v3/registry/storage/cache/memory"
+	"github.com/distribution/distribution/v3/registry/storage/driver/filesystem"
 	"github.com/distribution/distribution/v3/registry/storage/driver/inmemory"
 	"github.com/distribution/distribution/v3/testutil"
 	"github.com/distribution/reference"
@@ -512,6 +517,62 @@ func TestBlobMount(t *testing.T) {
 	}
 }
 
+// TestBlobMountDisabled ensures mount requests start a regular upload when
+// blob mounts are disabled.
+func TestBlobMountDisabled(t *testing.T) {
+	randomDataReader, dgst, err := testutil.CreateRandomTarFile()
+	if err != nil {
+		t.Fatalf("error creating random reader: %v", err)
+	}
+
+	ctx := context.Background()
+	imageName, _ := reference.WithName("foo/bar")
+	sourceImageName, _ := reference.WithName("foo/source")
+	driver := inmemory.New()
+	registry, err := NewRegistry(ctx, driver, BlobDescriptorCacheProvider(memory.NewInMemoryBlobDescriptorCacheProvider(memory.UnlimitedSize)), EnableDelete, DisableBlobMounts)
+	if err != nil {
+		t.Fatalf("error creating registry: %v", err)
+	}
+
+	repository, err := registry.Repository(ctx, imageName)
+	if err != nil {
+		t.Fatalf("unexpected error getting repo: %v", err)
+	}
+	sourceRepository, err := registry.Repository(ctx, sourceImageName)
+	if err != nil {
+		t.Fatalf("unexpected error getting repo: %v", err)
+	}
+
+	sbs := sourceRepository.Blobs(ctx)
+	blobUpload, err := sbs.Create(ctx)
+	if err != nil {
+		t.Fatalf("unexpected error starting layer upload: %s", err)
+	}
+	if _, err := io.Copy(blobUpload, randomDataReader); err != nil {
+		t.Fatalf("unexpected error uploading layer data: %v", err)
+	}
+	desc, err := blobUpload.Commit(ctx, v1.Descriptor{Digest: dgst})
+	if err != nil {
+		t.Fatalf("unexpected error finishing layer upload: %v", err)
+	}
+
+	canonicalRef, err := reference.WithDigest(sourceRepository.Named(), desc.Digest)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	bs := repository.Blobs(ctx)
+	bw, err := bs.Create(ctx, WithMountFrom(canonicalRef))
+	if err != nil {
+		t.Fatalf("expected an upload session instead of a mount, got: %v", err)
+	}
+	defer bw.Cancel(ctx)
+
+	if _, err := bs.Stat(ctx, desc.Digest); err != distribution.ErrBlobUnknown {
+		t.Fatalf("expected blob not to be mounted, got: %v", err)
+	}
+}
+
 // TestLayerUploadZeroLength uploads zero-length
 func TestLayerUploadZeroLength(t *testing.T) {
 	ctx := context.Background()
@@ -530,6 +591,251 @@ func TestLayerUploadZeroLength(t *testing.T) {
 	simpleUpload(t, bs, []byte{}, digestSha256Empty)
 }
 
+// TestBlobCommitFilesystem tests that the uploads committed to the filesystem
+// become their blobs without a copy, and that the uploads of blobs already
+// stored leave them untouched.
+func TestBlobCommitFilesystem(t *testing.T) {
+	ctx := context.Background()
+	root := t.TempDir()
+	imageName, _ := reference.WithName("foo/bar")
+	registry, err := NewRegistry(ctx, filesystem.New(filesystem.DriverParameters{RootDirectory: root, MaxThreads: 100}))
+	if err != nil {
+		t.Fatalf("error creating registry: %v", err)
+	}
+	repository, err := registry.Repository(ctx, imageName)
+	if err != nil {
+		t.Fatalf("unexpected error getting repo: %v", err)
+	}
+	bs := repository.Blobs(ctx)
+
+	content := []byte("layer content")
+	dgst := digest.FromBytes(content)
+	blobPath, err := pathFor(blobDataPathSpec{digest: dgst})
+	if err != nil {
+		t.Fatal(err)
+	}
+	uploads := filepath.Join(root, "docker/registry/v2/repositories/foo/bar/_uploads")
+
+	// upload pushes the content and returns the files of the upload and of
+	// the blob.
+	upload := func() (os.FileInfo, os.FileInfo) {
+		bw, err := bs.Create(ctx)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := bw.Write(content); err != nil {
+			t.Fatal(err)
+		}
+		if err := bw.Close(); err != nil {
+			t.Fatal(err)
+		}
+		uploaded, err := os.Stat(filepath.Join(uploads, bw.ID(), "data"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		bw, err = bs.Resume(ctx, bw.ID())
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := bw.Commit(ctx, v1.Descriptor{Digest: dgst}); err != nil {
+			t.Fatal(err)
+		}
+		blob, err := os.Stat(filepath.Join(root, blobPath))
+		if err != nil {
+			t.Fatal(err)
+		}
+		return uploaded, blob
+	}
+
+	uploaded, first := upload()
+	if !os.SameFile(uploaded, first) {
+		t.Fatal("expected the upload to become the blob without a copy")
+	}
+	_, second := upload()
+	if !os.SameFile(first, second) || !second.ModTime().Equal(first.ModTime()) {
+		t.Fatal("expected the blob already stored to be left untouched")
+	}
+	if entries, err := os.ReadDir(uploads); err != nil || len(entries) != 0 {
+		t.Fatalf("expected the uploads to be removed, got %v: %v", entries, err)
+	}
+}
+
+// TestBlobUploadSessionResume tests that an upload is resumed from the session
+// persisted by another registry sharing the storage.
+func TestBlobUploadSessionResume(t *testing.T) {
+	ctx := context.Background()
+	imageName, _ := reference.WithName("foo/bar")
+	driver := inmemory.New()
+	blobs := func() distribution.BlobStore {
+		registry, err := NewRegistry(ctx, driver)
+		if err != nil {
+			t.Fatalf("error creating registry: %v", err)
+		}
+		repository, err := registry.Repository(ctx, imageName)
+		if err != nil {
+			t.Fatalf("unexpected error getting repo: %v", err)
+		}
+		return repository.Blobs(ctx)
+	}
+
+	content := bytes.Repeat([]byte("0123456789"), 1000)
+	bw, err := blobs().Create(ctx)
+	if err != nil {
+		t.Fatalf("unexpected error starting upload: %v", err)
+	}
+	if _, err := bw.Write(content[:4000]); err != nil {
+		t.Fatalf("unexpected error writing chunk: %v", err)
+	}
+	if err := bw.Close(); err != nil {
+		t.Fatalf("unexpected error closing upload: %v", err)
+	}
+
+	// The session suffices to resume the digest.
+	hashStatesPath, err := pathFor(uploadHashStatePathSpec{name: imageName.Name(), id: bw.ID(), alg: digest.Canonical, list: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := driver.Delete(ctx, hashStatesPath); err != nil {
+		t.Fatalf("unexpected error deleting hash states: %v", err)
+	}
+
+	resumed, err := blobs().Resume(ctx, bw.ID())
+	if err != nil {
+		t.Fatalf("unexpected error resuming upload: %v", err)
+	}
+	if offset, ok := resumed.(*blobWriter).SessionOffset(); !ok || offset != 4000 {
+		t.Fatalf("unexpected session offset %d, %v", offset, ok)
+	}
+	if !resumed.StartedAt().Equal(bw.StartedAt().Truncate(time.Second)) {
+		t.Fatalf("unexpected start %v, expected %v", resumed.StartedAt(), bw.StartedAt())
+	}
+	if _, err := resumed.Write(content[4000:]); err != nil {
+		t.Fatalf("unexpected error writing chunk: %v", err)
+	}
+	if written := resumed.(*blobWriter).written; written != int64(len(content)) {
+		t.Fatalf("digest not resumed from the session: %d bytes digested", written)
+	}
+
+	desc, err := resumed.Commit(ctx, v1.Descriptor{Digest: digest.FromBytes(content)})
+	if err != nil {
+		t.Fatalf("unexpected error committing upload: %v", err)
+	}
+	if desc.Digest != digest.FromBytes(content) || desc.Size != int64(len(content)) {
+		t.Fatalf("unexpected descriptor %v", desc)
+	}
+	if _, err := blobs().Resume(ctx, bw.ID()); err != distribution.ErrBlobUploadUnknown {
+		t.Fatalf("unexpected error resuming committed upload: %v", err)
+	}
+}
+
+// testUploadSessions keeps the upload sessions in memory.
+type testUploadSessions struct {
+	mu       sync.Mutex
+	sessions map[string][]byte
+	versions map[string]int64
+}
+
+func (s *testUploadSessions) Get(ctx context.Context, repo, id string) ([]byte, int64, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.sessions[repo+"/"+id], s.versions[repo+"/"+id], nil
+}
+
+func (s *testUploadSessions) Set(ctx context.Context, repo, id string, session []byte, version int64) (int64, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.versions[repo+"/"+id] != version {
+		return 0, distribution.ErrBlobUploadConflict
+	}
+	s.sessions[repo+"/"+id] = session
+	s.versions[repo+"/"+id] = version + 1
+	return version + 1, nil
+}
+
+func (s *testUploadSessions) Delete(ctx context.Context, repo, id string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.sessions, repo+"/"+id)
+	delete(s.versions, repo+"/"+id)
+	return nil
+}
+
+// TestBlobUploadSessionProvider tests that the sessions kept by a provider
+// resume the uploads, and that of two chunks written concurrently from the
+// same session, a single one is committed.
+func TestBlobUploadSessionProvider(t *testing.T) {
+	ctx := context.Background()
+	imageName, _ := reference.WithName("foo/bar")
+	driver := inmemory.New()
+	sessions := &testUploadSessions{sessions: make(map[string][]byte), versions: make(map[string]int64)}
+	registry, err := NewRegistry(ctx, driver, UploadSessionProvider(sessions))
+	if err != nil {
+		t.Fatalf("error creating registry: %v", err)
+	}
+	repository, err := registry.Repository(ctx, imageName)
+	if err != nil {
+		t.Fatalf("unexpected error getting repo: %v", err)
+	}
+	blobs := repository.Blobs(ctx)
+
+	content := bytes.Repeat([]byte("0123456789"), 1000)
+	bw, err := blobs.Create(ctx)
+	if err != nil {
+		t.Fatalf("unexpected error starting upload: %v", err)
+	}
+	if _, err := bw.Write(content[:4000]); err != nil {
+		t.Fatalf("unexpected error writing chunk: %v", err)
+	}
+	if err := bw.Close(); err != nil {
+		t.Fatalf("unexpected error closing upload: %v", err)
+	}
+	sessionPath, err := pathFor(uploadSessionPathSpec{name: imageName.Name(), id: bw.ID()})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := driver.Stat(ctx, sessionPath); err == nil {
+		t.Fatal("expected the session not to be persisted in the storage")
+	}
+
+	first, err := blobs.Resume(ctx, bw.ID())
+	if err != nil {
+		t.Fatalf("unexpected error resuming upload: %v", err)
+	}
+	second, err := blobs.Resume(ctx, bw.ID())
+	if err != nil {
+		t.Fatalf("unexpected error resuming upload: %v", err)
+	}
+	if offset, ok := first.(*blobWriter).SessionOffset(); !ok || offset != 4000 {
+		t.Fatalf("unexpected session offset %d, %v", offset, ok)
+	}
+	if _, err := first.Write(content[4000:]); err != nil {
+		t.Fatalf("unexpected error writing chunk: %v", err)
+	}
+	if err := first.Close(); err != nil {
+		t.Fatalf("unexpected error closing upload: %v", err)
+	}
+	if _, err := second.Write(content[4000:]); err != nil {
+		t.Fatalf("unexpected error writing chunk: %v", err)
+	}
+	if err := second.Close(); err != distribution.ErrBlobUploadConflict {
+		t.Fatalf("expected a conflict committing the concurrent chunk, got %v", err)
+	}
+
+	resumed, err := blobs.Resume(ctx, bw.ID())
+	if err != nil {
+		t.Fatalf("unexpected error resuming upload: %v", err)
+	}
+	if offset, ok := resumed.(*blobWriter).SessionOffset(); !ok || offset != int64(len(content)) {
+		t.Fatalf("unexpected session offset %d, %v", offset, ok)
+	}
+	if err := resumed.Cancel(ctx); err != nil {
+		t.Fatalf("unexpected error canceling upload: %v", err)
+	}
+	if session, _, _ := sessions.Get(ctx, imageName.Name(), bw.ID()); session != nil {
+		t.Fatalf("expected the session to be deleted, got %q", session)
+	}
+}
+
 func simpleUpload(t *testing.T, bs distribution.BlobIngester, blob []byte, expectedDigest digest.Digest) {
 	ctx := context.Background()
 	wr, err := bs.Create(ctx)
@@ -3,7 +3,9 @@ package storage
 import (
 	"context"
 	"fmt"
+	"io"
 	"net/http"
+	"os"
 	"time"
 
 	"github.com/distribution/distribution/v3"
@@ -21,6 +23,9 @@ type blobServer struct {
 	statter  distribution.BlobStatter
 	pathFn   func(dgst digest.Digest) (string, error)
 	redirect bool // allows disabling RedirectURL redirects
+	// verification, if set, verifies the content of the blobs before they
+	// are served or redirected to.
+	verification *blobReadVerification
 }
 
 func (bs *blobServer) ServeBlob(ctx context.Context, w http.ResponseWriter, r *http.Request, dgst digest.Digest) error {
@@ -34,24 +39,48 @@ func (bs *blobServer) ServeBlob(ctx context.Context, w http.ResponseWriter, r *h
 		return err
 	}
 
+	if err := bs.verification.verify(ctx, bs.driver, r, path, desc); err != nil {
+		return err
+	}
+
 	if bs.redirect {
-		redirectURL, err := bs.driver.RedirectURL(r, path)
+		var (
+			redirectURL string
+			cookies     []*http.Cookie
+		)
+		if cr, ok := bs.driver.(driver.CookieRedirector); ok {
+			redirectURL, cookies, err = cr.RedirectURLWithCookies(r, path)
+		} else {
+			redirectURL, err = bs.driver.RedirectURL(r, path)
+		}
 		if err != nil {
 			return err
 		}
 		if redirectURL != "" {
 			// Redirect to storage URL.
+			for _, cookie := range cookies {
+				http.SetCookie(w, cookie)
+			}
 			http.Redirect(w, r, redirectURL, http.StatusTemporaryRedirect)
 			return nil
 		}
 		// Fallback to serving the content directly.
 	}
 
-	br, err := newFileReader(ctx, bs.driver, path, desc.Size)
-	if err != nil {
-		return err
+	var content io.ReadSeeker
+	if f := bs.openFile(path); f != nil {
+		// An *os.File lets the content be sent without copying it through
+		// userspace buffers.
+		defer f.Close()
+		content = f
+	} else {
+		br, err := newFileReader(ctx, bs.driver, path, desc.Size)
+		if err != nil {
+			return err
+		}
+		defer br.Close()
+		content = br
 	}
-	defer br.Close()
 
 	w.Header().Set("ETag", fmt.Sprintf(`"%s"`, desc.Digest)) // If-None-Match handled by ServeContent
 	w.Header().Set("Cache-Control", fmt.Sprintf("max-age=%.f", blobCacheControlMaxAge.Seconds()))
@@ -70,6 +99,24 @@ func (bs *blobServer) ServeBlob(ctx context.Context, w http.ResponseWriter, r *h
 		w.Header().Set("Content-Length", fmt.Sprint(desc.Size))
 	}
 
-	http.ServeContent(w, r, desc.Digest.String(), time.Time{}, br)
+	http.ServeContent(w, r, desc.Digest.String(), time.Time{}, content)
 	return nil
 }
+
+// openFile opens the local file storing the content at path, if the driver
+// stores it in one, returning nil otherwise.
+func (bs *blobServer) openFile(path string) *os.File {
+	fr, ok := bs.driver.(driver.FilePathResolver)
+	if !ok {
+		return nil
+	}
+	filePath, err := fr.FilePathForContent(path)
+	if err != nil {
+		return nil
+	}
+	f, err := os.Open(filePath)
+	if err != nil {
+		return nil
+	}
+	return f
+}
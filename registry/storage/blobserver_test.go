@@ -0,0 +1,157 @@
+package storage
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+
+	"github.com/distribution/distribution/v3"
+	storagedriver "github.com/distribution/distribution/v3/registry/storage/driver"
+	"github.com/distribution/distribution/v3/registry/storage/driver/filesystem"
+	"github.com/distribution/reference"
+	v1 "github.com/opencontainers/image-spec/specs-go/v1"
+)
+
+// wrappedDriver hides the optional interfaces of the driver it wraps, as the
+// storage middlewares do.
+type wrappedDriver struct {
+	storagedriver.StorageDriver
+}
+
+// testBlobStores returns the blobs of a repository stored by the filesystem
+// driver in dir, served from the files and through a wrapping driver, along
+// with the descriptor of a blob of size bytes pushed.
+func testBlobStores(t testing.TB, dir string, size int) (direct, generic distribution.BlobStore, desc v1.Descriptor) {
+	ctx := context.Background()
+	d := filesystem.New(filesystem.DriverParameters{RootDirectory: dir, MaxThreads: 100})
+	name, _ := reference.WithName("foo/bar")
+	for _, driver := range []storagedriver.StorageDriver{d, wrappedDriver{d}} {
+		reg, err := NewRegistry(ctx, driver)
+		if err != nil {
+			t.Fatal(err)
+		}
+		repo, err := reg.Repository(ctx, name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if direct == nil {
+			direct = repo.Blobs(ctx)
+		} else {
+			generic = repo.Blobs(ctx)
+		}
+	}
+	content := make([]byte, size)
+	if _, err := rand.Read(content); err != nil {
+		t.Fatal(err)
+	}
+	desc, err := direct.Put(ctx, "application/octet-stream", content)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return direct, generic, desc
+}
+
+func TestServeBlobFromFile(t *testing.T) {
+	direct, generic, desc := testBlobStores(t, t.TempDir(), 64<<10)
+	if f := direct.(*linkedBlobStore).blobServer.(*blobServer).openFile("/docker/registry/v2/blobs/sha256/00/missing/data"); f != nil {
+		f.Close()
+		t.Fatal("unexpected file opened for missing content")
+	}
+	path, err := pathFor(blobDataPathSpec{digest: desc.Digest})
+	if err != nil {
+		t.Fatal(err)
+	}
+	f := direct.(*linkedBlobStore).blobServer.(*blobServer).openFile(path)
+	if f == nil {
+		t.Fatal("content not opened from its file")
+	}
+	f.Close()
+	if f := generic.(*linkedBlobStore).blobServer.(*blobServer).openFile(path); f != nil {
+		f.Close()
+		t.Fatal("unexpected file opened through a wrapping driver")
+	}
+
+	for _, tc := range []struct {
+		name   string
+		header http.Header
+	}{
+		{name: "full"},
+		{name: "range", header: http.Header{"Range": {"bytes=100-4195"}}},
+		{name: "suffix range", header: http.Header{"Range": {"bytes=-512"}}},
+		{name: "multiple ranges", header: http.Header{"Range": {"bytes=0-9,100-199"}}},
+		{name: "unsatisfiable range", header: http.Header{"Range": {"bytes=1000000-"}}},
+		{name: "not modified", header: http.Header{"If-None-Match": {`"` + desc.Digest.String() + `"`}}},
+		{name: "head"},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			serve := func(blobs distribution.BlobStore) *httptest.ResponseRecorder {
+				method := http.MethodGet
+				if tc.name == "head" {
+					method = http.MethodHead
+				}
+				r := httptest.NewRequest(method, "/", nil)
+				for k, v := range tc.header {
+					r.Header[k] = v
+				}
+				w := httptest.NewRecorder()
+				if err := blobs.ServeBlob(context.Background(), w, r, desc.Digest); err != nil {
+					t.Fatal(err)
+				}
+				return w
+			}
+			fromFile, fromReader := serve(direct), serve(generic)
+			if fromFile.Code != fromReader.Code {
+				t.Fatalf("unexpected status %d, expected %d", fromFile.Code, fromReader.Code)
+			}
+			// The boundaries of multipart responses are random.
+			if tc.name != "multiple ranges" {
+				if !reflect.DeepEqual(fromFile.Header(), fromReader.Header()) {
+					t.Fatalf("unexpected headers %v, expected %v", fromFile.Header(), fromReader.Header())
+				}
+				if !bytes.Equal(fromFile.Body.Bytes(), fromReader.Body.Bytes()) {
+					t.Fatal("unexpected content served from the file")
+				}
+			} else if fromFile.Body.Len() != fromReader.Body.Len() {
+				t.Fatalf("unexpected length %d, expected %d", fromFile.Body.Len(), fromReader.Body.Len())
+			}
+		})
+	}
+}
+
+func BenchmarkServeBlob(b *testing.B) {
+	const size = 64 << 20
+	direct, generic, desc := testBlobStores(b, b.TempDir(), size)
+	for _, bc := range []struct {
+		name  string
+		blobs distribution.BlobStore
+	}{
+		{name: "file", blobs: direct},
+		{name: "reader", blobs: generic},
+	} {
+		b.Run(bc.name, func(b *testing.B) {
+			server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				if err := bc.blobs.ServeBlob(r.Context(), w, r, desc.Digest); err != nil {
+					b.Error(err)
+				}
+			}))
+			defer server.Close()
+			b.SetBytes(size)
+			b.ResetTimer()
+			for b.Loop() {
+				resp, err := http.Get(server.URL)
+				if err != nil {
+					b.Fatal(err)
+				}
+				if _, err := io.Copy(io.Discard, resp.Body); err != nil {
+					b.Fatal(err)
+				}
+				resp.Body.Close()
+			}
+		})
+	}
+}
@@ -19,6 +19,11 @@ import (
 type blobStore struct {
 	driver  driver.StorageDriver
 	statter distribution.BlobStatter
+	// walkParallelism is the number of directories listed concurrently
+	// when enumerating.
+	walkParallelism int
+	// inventory, if set, counts the blobs committed to the blob store.
+	inventory *BlobInventory
 }
 
 var _ distribution.BlobProvider = &blobStore{}
@@ -77,6 +82,11 @@ func (bs *blobStore) Put(ctx context.Context, mediaType string, p []byte) (v1.De
 		return v1.Descriptor{}, err
 	}
 
+	if err := bs.driver.PutContent(ctx, bp, p); err != nil {
+		return v1.Descriptor{}, err
+	}
+	bs.inventory.added(int64(len(p)))
+
 	// TODO(stevvooe): Write out mediatype here, as well.
 	return v1.Descriptor{
 		Size: int64(len(p)),
@@ -86,7 +96,7 @@ func (bs *blobStore) Put(ctx context.Context, mediaType string, p []byte) (v1.De
 		// for the specific repository.
 		MediaType: "application/octet-stream",
 		Digest:    dgst,
-	}, bs.driver.PutContent(ctx, bp, p)
+	}, nil
 }
 
 func (bs *blobStore) Enumerate(ctx context.Context, ingester func(dgst digest.Digest) error) error {
@@ -114,7 +124,7 @@ func (bs *blobStore) Enumerate(ctx context.Context, ingester func(dgst digest.Di
 		}
 
 		return ingester(digest)
-	})
+	}, driver.WithParallelism(bs.walkParallelism))
 }
 
 // path returns the canonical path for the blob identified by digest. The blob
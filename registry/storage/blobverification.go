@@ -0,0 +1,143 @@
+package storage
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"sync"
+	"sync/atomic"
+
+	"github.com/distribution/distribution/v3"
+	"github.com/distribution/distribution/v3/internal/dcontext"
+	prometheus "github.com/distribution/distribution/v3/metrics"
+	"github.com/distribution/distribution/v3/registry/storage/driver"
+	"github.com/opencontainers/go-digest"
+	v1 "github.com/opencontainers/image-spec/specs-go/v1"
+)
+
+// blobReadVerifications counts the blobs whose content was hashed before it
+// was served, by outcome: verified or corrupted.
+var blobReadVerifications = prometheus.StorageNamespace.NewLabeledCounter("blob_read_verifications", "The number of blob reads verified against the digest of the blob", "outcome")
+
+// blobReadVerification verifies the content of the blobs served against
+// their digest. The blobs found corrupted are quarantined: a marker is
+// written next to their data, and they are not served until they are pushed
+// again.
+type blobReadVerification struct {
+	// maxSize is the size of the largest blob verified, 0 verifying the
+	// blobs of any size.
+	maxSize int64
+	// sampling verifies one in sampling reads, every read if it is 0 or 1.
+	sampling uint64
+	reads    atomic.Uint64
+
+	// quarantined holds the digests of the blobs this instance quarantined
+	// or found quarantined, so that the reads which are not verified do not
+	// serve them either. The reads verified check the quarantine markers,
+	// which the blobs pushed again through another instance no longer have.
+	quarantined sync.Map
+}
+
+// selected reports whether the read of a blob of the given size is verified.
+func (v *blobReadVerification) selected(size int64) bool {
+	if v.maxSize > 0 && size > v.maxSize {
+		return false
+	}
+	return v.sampling <= 1 || v.reads.Add(1)%v.sampling == 0
+}
+
+// verify returns an ErrBlobCorrupted error if the blob is quarantined, or if
+// the read is selected and the content at path does not match the digest of
+// the descriptor, quarantining the blob. The content is not read for HEAD
+// requests, which only report the quarantines this instance knows of.
+func (v *blobReadVerification) verify(ctx context.Context, storageDriver driver.StorageDriver, r *http.Request, path string, desc v1.Descriptor) error {
+	if v == nil {
+		return nil
+	}
+	if r.Method == http.MethodHead || !v.selected(desc.Size) {
+		if _, ok := v.quarantined.Load(desc.Digest); ok {
+			return distribution.ErrBlobCorrupted{Digest: desc.Digest}
+		}
+		return nil
+	}
+
+	quarantined, err := v.isQuarantined(ctx, storageDriver, desc.Digest)
+	if err != nil {
+		return err
+	}
+	if quarantined {
+		return distribution.ErrBlobCorrupted{Digest: desc.Digest}
+	}
+
+	fr, err := newFileReader(ctx, storageDriver, path, desc.Size)
+	if err != nil {
+		return err
+	}
+	defer fr.Close()
+	digester := desc.Digest.Algorithm().Digester()
+	if _, err := io.Copy(digester.Hash(), fr); err != nil {
+		return err
+	}
+	actual := digester.Digest()
+	if actual == desc.Digest {
+		blobReadVerifications.WithValues("verified").Inc()
+		return nil
+	}
+
+	blobReadVerifications.WithValues("corrupted").Inc()
+	dcontext.GetLoggerWithFields(ctx, map[any]any{"digest": desc.Digest, "actual": actual}).Errorf("blob content does not match its digest, quarantining the blob")
+	markerPath, err := pathFor(blobQuarantinePathSpec{digest: desc.Digest})
+	if err != nil {
+		return err
+	}
+	if err := storageDriver.PutContent(ctx, markerPath, []byte(actual.String())); err != nil {
+		dcontext.GetLogger(ctx).Errorf("error quarantining blob %s: %v", desc.Digest, err)
+	}
+	v.quarantined.Store(desc.Digest, struct{}{})
+	return distribution.ErrBlobCorrupted{Digest: desc.Digest, Actual: actual}
+}
+
+// isQuarantined reports whether the storage holds the quarantine marker of
+// the blob, and records the answer.
+func (v *blobReadVerification) isQuarantined(ctx context.Context, storageDriver driver.StorageDriver, dgst digest.Digest) (bool, error) {
+	if v == nil {
+		return false, nil
+	}
+	markerPath, err := pathFor(blobQuarantinePathSpec{digest: dgst})
+	if err != nil {
+		return false, err
+	}
+	switch _, err := storageDriver.Stat(ctx, markerPath); err.(type) {
+	case nil:
+		v.quarantined.Store(dgst, struct{}{})
+		return true, nil
+	case driver.PathNotFoundError:
+		v.quarantined.Delete(dgst)
+		return false, nil
+	default:
+		return false, err
+	}
+}
+
+// release lifts the quarantine of a blob whose content was pushed again.
+func (v *blobReadVerification) release(ctx context.Context, storageDriver driver.StorageDriver, dgst digest.Digest) error {
+	markerPath, err := pathFor(blobQuarantinePathSpec{digest: dgst})
+	if err != nil {
+		return err
+	}
+	if err := storageDriver.Delete(ctx, markerPath); err != nil {
+		if _, ok := err.(driver.PathNotFoundError); !ok {
+			return err
+		}
+	}
+	v.quarantined.Delete(dgst)
+	return nil
+}
+
+// forget drops the quarantine this instance knows of for a blob committed
+// anew, after the quarantined blob was removed from the storage.
+func (v *blobReadVerification) forget(dgst digest.Digest) {
+	if v != nil {
+		v.quarantined.Delete(dgst)
+	}
+}
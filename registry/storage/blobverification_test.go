@@ -0,0 +1,178 @@
+package storage
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/distribution/distribution/v3"
+	storagedriver "github.com/distribution/distribution/v3/registry/storage/driver"
+	"github.com/distribution/distribution/v3/registry/storage/driver/inmemory"
+	"github.com/distribution/reference"
+	"github.com/opencontainers/go-digest"
+	v1 "github.com/opencontainers/image-spec/specs-go/v1"
+)
+
+// testVerifiedBlobs returns the blobs of a repository of a registry verifying
+// the blob reads, and pushes content to it.
+func testVerifiedBlobs(t *testing.T, d storagedriver.StorageDriver, maxSize int64, sampling int, content []byte) (distribution.BlobStore, v1.Descriptor) {
+	ctx := context.Background()
+	registry := createRegistry(t, d, VerifyBlobReads(maxSize, sampling))
+	name, _ := reference.WithName("foo/bar")
+	repo, err := registry.Repository(ctx, name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	blobs := repo.Blobs(ctx)
+	return blobs, pushBlob(t, blobs, content)
+}
+
+func pushBlob(t *testing.T, blobs distribution.BlobStore, content []byte) v1.Descriptor {
+	ctx := context.Background()
+	bw, err := blobs.Create(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := bw.ReadFrom(bytes.NewReader(content)); err != nil {
+		t.Fatal(err)
+	}
+	desc, err := bw.Commit(ctx, v1.Descriptor{Digest: digest.FromBytes(content)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return desc
+}
+
+// corruptBlob replaces the stored content of the blob.
+func corruptBlob(t *testing.T, d storagedriver.StorageDriver, dgst digest.Digest, content []byte) {
+	path, err := pathFor(blobDataPathSpec{digest: dgst})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := d.PutContent(context.Background(), path, content); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func serveBlob(blobs distribution.BlobStore, method string, dgst digest.Digest) (*httptest.ResponseRecorder, error) {
+	w := httptest.NewRecorder()
+	err := blobs.ServeBlob(context.Background(), w, httptest.NewRequest(method, "/", nil), dgst)
+	return w, err
+}
+
+func TestVerifyBlobReads(t *testing.T) {
+	d := inmemory.New()
+	content := []byte("the content of the blob")
+	blobs, desc := testVerifiedBlobs(t, d, 0, 0, content)
+
+	w, err := serveBlob(blobs, http.MethodGet, desc.Digest)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(w.Body.Bytes(), content) {
+		t.Fatalf("unexpected content served: %q", w.Body.Bytes())
+	}
+
+	corrupted := []byte("the content of the bl0b")
+	corruptBlob(t, d, desc.Digest, corrupted)
+
+	// A HEAD request does not read the content.
+	if _, err := serveBlob(blobs, http.MethodHead, desc.Digest); err != nil {
+		t.Fatalf("unexpected error for a HEAD request: %v", err)
+	}
+
+	w, err = serveBlob(blobs, http.MethodGet, desc.Digest)
+	var corruption distribution.ErrBlobCorrupted
+	if !errors.As(err, &corruption) {
+		t.Fatalf("expected a corruption error, got %v", err)
+	}
+	if corruption.Digest != desc.Digest || corruption.Actual != digest.FromBytes(corrupted) {
+		t.Fatalf("unexpected corruption error: %#v", corruption)
+	}
+	if w.Body.Len() != 0 {
+		t.Fatalf("unexpected content served: %q", w.Body.Bytes())
+	}
+	markerPath, err := pathFor(blobQuarantinePathSpec{digest: desc.Digest})
+	if err != nil {
+		t.Fatal(err)
+	}
+	marker, err := d.GetContent(context.Background(), markerPath)
+	if err != nil {
+		t.Fatalf("blob not quarantined: %v", err)
+	}
+	if string(marker) != digest.FromBytes(corrupted).String() {
+		t.Fatalf("unexpected quarantine marker: %q", marker)
+	}
+
+	// The quarantine is reported to the later requests, including those of
+	// the other instances sharing the storage.
+	other, _ := testVerifiedBlobs(t, d, 0, 0, nil)
+	for _, blobs := range []distribution.BlobStore{blobs, other} {
+		for _, method := range []string{http.MethodGet, http.MethodHead} {
+			_, err := serveBlob(blobs, method, desc.Digest)
+			if !errors.As(err, &corruption) || corruption.Actual != "" {
+				t.Fatalf("expected a quarantine error for %s, got %v", method, err)
+			}
+		}
+	}
+
+	// Pushing the blob again replaces its content.
+	pushBlob(t, blobs, content)
+	for _, blobs := range []distribution.BlobStore{blobs, other} {
+		w, err := serveBlob(blobs, http.MethodGet, desc.Digest)
+		if err != nil {
+			t.Fatalf("unexpected error serving the blob pushed again: %v", err)
+		}
+		if !bytes.Equal(w.Body.Bytes(), content) {
+			t.Fatalf("unexpected content served: %q", w.Body.Bytes())
+		}
+	}
+	if _, err := d.Stat(context.Background(), markerPath); !errors.As(err, new(storagedriver.PathNotFoundError)) {
+		t.Fatalf("quarantine marker not removed: %v", err)
+	}
+}
+
+func TestVerifyBlobReadsSampling(t *testing.T) {
+	d := inmemory.New()
+	blobs, desc := testVerifiedBlobs(t, d, 0, 3, []byte("the content of the blob"))
+	corruptBlob(t, d, desc.Digest, []byte("corrupted"))
+
+	for i := 1; i < 3; i++ {
+		if _, err := serveBlob(blobs, http.MethodGet, desc.Digest); err != nil {
+			t.Fatalf("unexpected error for unverified read %d: %v", i, err)
+		}
+	}
+	if _, err := serveBlob(blobs, http.MethodGet, desc.Digest); !errors.As(err, new(distribution.ErrBlobCorrupted)) {
+		t.Fatalf("expected a corruption error for the sampled read, got %v", err)
+	}
+	// Once found, the quarantine applies to every read.
+	if _, err := serveBlob(blobs, http.MethodGet, desc.Digest); !errors.As(err, new(distribution.ErrBlobCorrupted)) {
+		t.Fatalf("expected a quarantine error, got %v", err)
+	}
+}
+
+func TestVerifyBlobReadsMaxSize(t *testing.T) {
+	d := inmemory.New()
+	large, larged := testVerifiedBlobs(t, d, 8, 0, []byte("larger than the size verified"))
+	corruptBlob(t, d, larged.Digest, []byte("corrupted, but larger than the size verified"))
+	if _, err := serveBlob(large, http.MethodGet, larged.Digest); err != nil {
+		t.Fatalf("unexpected error for a blob larger than the size verified: %v", err)
+	}
+
+	small := pushBlob(t, large, []byte("small"))
+	corruptBlob(t, d, small.Digest, []byte("smal1"))
+	if _, err := serveBlob(large, http.MethodGet, small.Digest); !errors.As(err, new(distribution.ErrBlobCorrupted)) {
+		t.Fatalf("expected a corruption error, got %v", err)
+	}
+}
+
+func TestVerifyBlobReadsInvalid(t *testing.T) {
+	for _, option := range []RegistryOption{VerifyBlobReads(-1, 0), VerifyBlobReads(0, -1)} {
+		if _, err := NewRegistry(context.Background(), inmemory.New(), option); err == nil {
+			t.Fatal("expected an error for an invalid verification")
+		}
+	}
+}
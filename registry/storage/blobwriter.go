@@ -2,6 +2,7 @@ package storage
 
 import (
 	"context"
+	"encoding/json"
 	"errors"
 	"fmt"
 	"io"
@@ -40,6 +41,27 @@ type blobWriter struct {
 
 	resumableDigestEnabled bool
 	committed              bool
+
+	// session is the session of the upload last persisted, if any.
+	session *uploadSession
+}
+
+// uploadSession is the state of an upload persisted when its writer is
+// closed, so that any registry instance sharing the storage can resume it,
+// whichever secret signed the state handed to the client.
+type uploadSession struct {
+	ID        string    `json:"id"`
+	Offset    int64     `json:"offset"`
+	StartedAt time.Time `json:"startedAt"`
+
+	// Algorithm and HashState are the algorithm of the digest and the state
+	// of its hash function at Offset, unless the digest is not resumable.
+	Algorithm digest.Algorithm `json:"algorithm,omitempty"`
+	HashState []byte           `json:"hashState,omitempty"`
+
+	// version is the version of the session kept by the provider of the
+	// sessions, if any.
+	version int64
 }
 
 var _ distribution.BlobWriter = &blobWriter{}
@@ -53,6 +75,15 @@ func (bw *blobWriter) StartedAt() time.Time {
 	return bw.startedAt
 }
 
+// SessionOffset returns the offset of the upload when its session was last
+// persisted, and whether it was.
+func (bw *blobWriter) SessionOffset() (int64, bool) {
+	if bw.session == nil {
+		return 0, false
+	}
+	return bw.session.Offset, true
+}
+
 // Commit marks the upload as completed, returning a valid descriptor. The
 // final size and digest are checked against the first descriptor provided.
 func (bw *blobWriter) Commit(ctx context.Context, desc v1.Descriptor) (v1.Descriptor, error) {
@@ -70,6 +101,11 @@ func (bw *blobWriter) Commit(ctx context.Context, desc v1.Descriptor) (v1.Descri
 		return v1.Descriptor{}, err
 	}
 
+	// The blob is not moved to the blob store if it cannot be linked.
+	if err := bw.blobStore.checkQuota(ctx, canonical); err != nil {
+		return v1.Descriptor{}, err
+	}
+
 	if err := bw.moveBlob(ctx, canonical); err != nil {
 		return v1.Descriptor{}, err
 	}
@@ -156,7 +192,75 @@ func (bw *blobWriter) Close() error {
 		return err
 	}
 
-	return bw.fileWriter.Close()
+	if err := bw.fileWriter.Close(); err != nil {
+		return err
+	}
+
+	// The content written is only all stored once the writer is closed.
+	return bw.storeSession(bw.blobStore.ctx)
+}
+
+// storeSession persists the session of the upload at its current offset,
+// unless it was persisted at that offset already.
+func (bw *blobWriter) storeSession(ctx context.Context) error {
+	offset := bw.fileWriter.Size()
+	if bw.session != nil && bw.session.Offset == offset {
+		return nil
+	}
+
+	session := uploadSession{
+		ID:        bw.id,
+		Offset:    offset,
+		StartedAt: bw.startedAt,
+	}
+	// The hash state is only that of the content if the digester has been
+	// written all of it.
+	if bw.written == offset {
+		state, err := bw.hashState()
+		switch err {
+		case nil:
+			session.Algorithm = bw.digester.Digest().Algorithm()
+			session.HashState = state
+		case errResumableDigestNotAvailable:
+		default:
+			return err
+		}
+	}
+
+	p, err := json.Marshal(session)
+	if err != nil {
+		return err
+	}
+
+	// The session kept by the provider is only updated from the version it
+	// was resumed at, so that of the chunks written concurrently from the
+	// same offset, a single one is committed.
+	if provider := bw.blobStore.uploadSessions(); provider != nil {
+		var version int64
+		if bw.session != nil {
+			version = bw.session.version
+		}
+		session.version, err = provider.Set(ctx, bw.blobStore.repository.Named().Name(), bw.id, p, version)
+		if err != nil {
+			return err
+		}
+		bw.session = &session
+		return nil
+	}
+
+	sessionPath, err := pathFor(uploadSessionPathSpec{
+		name: bw.blobStore.repository.Named().Name(),
+		id:   bw.id,
+	})
+	if err != nil {
+		return err
+	}
+
+	if err := bw.driver.PutContent(ctx, sessionPath, p); err != nil {
+		return err
+	}
+	bw.session = &session
+	return nil
 }
 
 // validateBlob checks the data against the digest, returning an error if it
@@ -300,6 +404,7 @@ func (bw *blobWriter) moveBlob(ctx context.Context, desc v1.Descriptor) error {
 	}
 
 	// Check for existence
+	var quarantined bool
 	if _, err := bw.blobStore.driver.Stat(ctx, blobPath); err != nil {
 		switch err := err.(type) {
 		case storagedriver.PathNotFoundError:
@@ -311,8 +416,12 @@ func (bw *blobWriter) moveBlob(ctx context.Context, desc v1.Descriptor) error {
 		// If the path exists, we can assume that the content has already
 		// been uploaded, since the blob storage is content-addressable.
 		// While it may be corrupted, detection of such corruption belongs
-		// elsewhere.
-		return nil
+		// elsewhere: the content of the blobs quarantined by the verification
+		// of the reads is replaced.
+		quarantined, err = bw.blobStore.registry.blobServer.verification.isQuarantined(ctx, bw.blobStore.driver, desc.Digest)
+		if err != nil || !quarantined {
+			return err
+		}
 	}
 
 	// If no data was received, we may not actually have a file on disk. Check
@@ -328,7 +437,11 @@ func (bw *blobWriter) moveBlob(ctx context.Context, desc v1.Descriptor) error {
 			// prevent this horrid thing, we employ the hack of only allowing
 			// to this happen for the digest of an empty blob.
 			if desc.Digest == digestSha256Empty {
-				return bw.blobStore.driver.PutContent(ctx, blobPath, []byte{})
+				if err := bw.blobStore.driver.PutContent(ctx, blobPath, []byte{}); err != nil {
+					return err
+				}
+				bw.blobStore.inventory.added(0)
+				return nil
 			}
 
 			// We let this fail during the move below.
@@ -342,7 +455,15 @@ func (bw *blobWriter) moveBlob(ctx context.Context, desc v1.Descriptor) error {
 
 	// TODO(stevvooe): We should also write the mediatype when executing this move.
 
-	return bw.blobStore.driver.Move(ctx, bw.path, blobPath)
+	if err := bw.blobStore.driver.Move(ctx, bw.path, blobPath); err != nil {
+		return err
+	}
+	if quarantined {
+		return bw.blobStore.registry.blobServer.verification.release(ctx, bw.blobStore.driver, desc.Digest)
+	}
+	bw.blobStore.registry.blobServer.verification.forget(desc.Digest)
+	bw.blobStore.inventory.added(desc.Size)
+	return nil
 }
 
 // removeResources should clean up all resources associated with the upload
@@ -357,6 +478,12 @@ func (bw *blobWriter) removeResources(ctx context.Context) error {
 		return err
 	}
 
+	if provider := bw.blobStore.uploadSessions(); provider != nil {
+		if err := provider.Delete(ctx, bw.blobStore.repository.Named().Name(), bw.id); err != nil {
+			dcontext.GetLogger(ctx).Errorf("unable to delete the session of upload %s: %v", bw.id, err)
+		}
+	}
+
 	// Resolve and delete the containing directory, which should include any
 	// upload related files.
 	dirPath := path.Dir(dataPath)
@@ -401,3 +528,24 @@ func (bw *blobWriter) Reader() (io.ReadCloser, error) {
 
 	return readCloser, nil
 }
+
+// StoredSize returns the size of the content written to the upload which is
+// stored already, and may be read by StoredReader before the upload is
+// committed. The drivers storing the content only once it is committed
+// report nothing stored.
+func (bw *blobWriter) StoredSize(ctx context.Context) (int64, error) {
+	fi, err := bw.driver.Stat(ctx, bw.path)
+	if err != nil {
+		if errors.As(err, new(storagedriver.PathNotFoundError)) {
+			return 0, nil
+		}
+		return 0, err
+	}
+	return fi.Size(), nil
+}
+
+// StoredReader reads the content of the upload stored already from the
+// offset, up to the size reported by StoredSize.
+func (bw *blobWriter) StoredReader(ctx context.Context, offset int64) (io.ReadCloser, error) {
+	return bw.driver.Reader(ctx, bw.path, offset)
+}
@@ -16,3 +16,8 @@ func (bw *blobWriter) resumeDigest(ctx context.Context) error {
 func (bw *blobWriter) storeHashState(ctx context.Context) error {
 	return errResumableDigestNotAvailable
 }
+
+// hashState is a noop when resumable digest support is disabled.
+func (bw *blobWriter) hashState() ([]byte, error) {
+	return nil, errResumableDigestNotAvailable
+}
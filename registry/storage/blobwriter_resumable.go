@@ -32,6 +32,16 @@ func (bw *blobWriter) resumeDigest(ctx context.Context) error {
 		return nil
 	}
 
+	// The session persisted holds the hash state at its offset, sparing the
+	// listing of the hash states.
+	if s := bw.session; s != nil && s.Offset == offset && s.HashState != nil && s.Algorithm == bw.digester.Digest().Algorithm() {
+		if err := h.UnmarshalBinary(s.HashState); err != nil {
+			return err
+		}
+		bw.written = offset
+		return nil
+	}
+
 	// List hash states from storage backend.
 	var hashStateMatch hashStateEntry
 	hashStates, err := bw.getStoredHashStates(ctx)
@@ -113,17 +123,22 @@ func (bw *blobWriter) getStoredHashStates(ctx context.Context) ([]hashStateEntry
 	return hashStateEntries, nil
 }
 
-func (bw *blobWriter) storeHashState(ctx context.Context) error {
+// hashState returns the state of the internal hash function.
+func (bw *blobWriter) hashState() ([]byte, error) {
 	if !bw.resumableDigestEnabled {
-		return errResumableDigestNotAvailable
+		return nil, errResumableDigestNotAvailable
 	}
 
 	h, ok := bw.digester.Hash().(encoding.BinaryMarshaler)
 	if !ok {
-		return errResumableDigestNotAvailable
+		return nil, errResumableDigestNotAvailable
 	}
 
-	state, err := h.MarshalBinary()
+	return h.MarshalBinary()
+}
+
+func (bw *blobWriter) storeHashState(ctx context.Context) error {
+	state, err := bw.hashState()
 	if err != nil {
 		return err
 	}
@@ -3,9 +3,11 @@
 package cache
 
 import (
+	"context"
 	"fmt"
 
 	"github.com/distribution/distribution/v3"
+	"github.com/opencontainers/go-digest"
 	v1 "github.com/opencontainers/image-spec/specs-go/v1"
 )
 
@@ -17,6 +19,79 @@ type BlobDescriptorCacheProvider interface {
 	RepositoryScoped(repo string) (distribution.BlobDescriptorService, error)
 }
 
+// TagCacheProvider caches the digests of the manifests referenced by the tags
+// of the repositories, for a time bounded by the provider.
+type TagCacheProvider interface {
+	// Get returns the digest cached for the tag of the repository, or
+	// distribution.ErrTagUnknown if it is not cached.
+	Get(ctx context.Context, repo, tag string) (digest.Digest, error)
+
+	// Set caches the digest referenced by the tag of the repository.
+	Set(ctx context.Context, repo, tag string, dgst digest.Digest) error
+
+	// Clear removes the tag of the repository from the cache.
+	Clear(ctx context.Context, repo, tag string) error
+}
+
+// QuotaUsageProvider keeps the usage of the quotas of the repositories, the
+// total size in bytes of the blobs they link.
+type QuotaUsageProvider interface {
+	// Usage returns the usage of the repository, zero if none was recorded.
+	Usage(ctx context.Context, repo string) (int64, error)
+
+	// Add adds delta, which may be negative, to the usage of the repository
+	// and returns the usage updated.
+	Add(ctx context.Context, repo string, delta int64) (int64, error)
+
+	// Set replaces the usage of the repository.
+	Set(ctx context.Context, repo string, usage int64) error
+}
+
+// CatalogProvider keeps the names of the repositories of the registry, in
+// the order of the catalog, where the separator of the path components sorts
+// before any other character.
+type CatalogProvider interface {
+	// List fills repos with the names of the repositories starting with
+	// prefix which follow last, and returns how many it filled, with io.EOF
+	// if no other repository follows them.
+	List(ctx context.Context, repos []string, last, prefix string) (int, error)
+
+	// Add adds the repositories to the catalog.
+	Add(ctx context.Context, repos ...string) error
+
+	// Remove removes the repositories from the catalog.
+	Remove(ctx context.Context, repos ...string) error
+}
+
+// PullCountProvider keeps the number of pulls of the manifests of the
+// repositories, by the tag or digest they were pulled by.
+type PullCountProvider interface {
+	// PullCounts returns the pull counts of the repository, empty if none
+	// was recorded.
+	PullCounts(ctx context.Context, repo string) (map[string]int64, error)
+
+	// AddPullCounts adds the counts to the pull counts of the repository.
+	AddPullCounts(ctx context.Context, repo string, counts map[string]int64) error
+}
+
+// UploadSessionProvider keeps the sessions of the uploads in progress, so
+// that any instance of the registry can resume them. Each session has a
+// version, incremented when it is updated.
+type UploadSessionProvider interface {
+	// Get returns the session of the upload of the repository and its
+	// version, or a nil session if none was kept.
+	Get(ctx context.Context, repo, id string) ([]byte, int64, error)
+
+	// Set replaces the session of the upload of the repository at version,
+	// zero if it has none yet, and returns the version updated. It returns
+	// distribution.ErrBlobUploadConflict if the session is at another
+	// version.
+	Set(ctx context.Context, repo, id string, session []byte, version int64) (int64, error)
+
+	// Delete removes the session of the upload of the repository.
+	Delete(ctx context.Context, repo, id string) error
+}
+
 // ValidateDescriptor provides a helper function to ensure that caches have
 // common criteria for admitting descriptors.
 func ValidateDescriptor(desc v1.Descriptor) error {
@@ -2,6 +2,8 @@ package cachecheck
 
 import (
 	"context"
+	"io"
+	"maps"
 	"reflect"
 	"testing"
 
@@ -186,3 +188,211 @@ func checkBlobDescriptorCacheClear(ctx context.Context, t *testing.T, provider c
 		t.Fatalf("expected error statting deleted blob: %v", err)
 	}
 }
+
+// CheckTagCache takes a tag cache implementation through a common set of
+// operations, with a ttl long enough for the tags not to expire.
+func CheckTagCache(t *testing.T, provider cache.TagCacheProvider) {
+	ctx := context.Background()
+	first := digest.FromString("first")
+	second := digest.FromString("second")
+
+	if _, err := provider.Get(ctx, "foo/bar", "latest"); !isTagUnknown(err) {
+		t.Fatalf("expected unknown tag error with empty cache: %v", err)
+	}
+	if err := provider.Set(ctx, "foo/bar", "latest", ""); err == nil {
+		t.Fatal("expected error setting an invalid digest")
+	}
+
+	if err := provider.Set(ctx, "foo/bar", "latest", first); err != nil {
+		t.Fatalf("unexpected error setting tag: %v", err)
+	}
+	if dgst, err := provider.Get(ctx, "foo/bar", "latest"); err != nil || dgst != first {
+		t.Fatalf("unexpected digest %s of tag: %v", dgst, err)
+	}
+	if _, err := provider.Get(ctx, "foo/other", "latest"); !isTagUnknown(err) {
+		t.Fatalf("expected unknown tag error in another repository: %v", err)
+	}
+
+	if err := provider.Set(ctx, "foo/bar", "latest", second); err != nil {
+		t.Fatalf("unexpected error overwriting tag: %v", err)
+	}
+	if dgst, err := provider.Get(ctx, "foo/bar", "latest"); err != nil || dgst != second {
+		t.Fatalf("unexpected digest %s of tag overwritten: %v", dgst, err)
+	}
+
+	if err := provider.Clear(ctx, "foo/bar", "latest"); err != nil {
+		t.Fatalf("unexpected error clearing tag: %v", err)
+	}
+	if _, err := provider.Get(ctx, "foo/bar", "latest"); !isTagUnknown(err) {
+		t.Fatalf("expected unknown tag error after clear: %v", err)
+	}
+	if err := provider.Clear(ctx, "foo/bar", "latest"); err != nil {
+		t.Fatalf("unexpected error clearing tag not cached: %v", err)
+	}
+}
+
+func isTagUnknown(err error) bool {
+	_, ok := err.(distribution.ErrTagUnknown)
+	return ok
+}
+
+// CheckQuotaUsage runs the tests of the usages kept by the provider.
+func CheckQuotaUsage(t *testing.T, provider cache.QuotaUsageProvider) {
+	ctx := context.Background()
+
+	if usage, err := provider.Usage(ctx, "foo/bar"); err != nil || usage != 0 {
+		t.Fatalf("unexpected usage %d of a repository not recorded: %v", usage, err)
+	}
+
+	if usage, err := provider.Add(ctx, "foo/bar", 1024); err != nil || usage != 1024 {
+		t.Fatalf("unexpected usage %d after adding: %v", usage, err)
+	}
+	if usage, err := provider.Add(ctx, "foo/bar", 512); err != nil || usage != 1536 {
+		t.Fatalf("unexpected usage %d after adding again: %v", usage, err)
+	}
+	if usage, err := provider.Add(ctx, "foo/bar", -1024); err != nil || usage != 512 {
+		t.Fatalf("unexpected usage %d after subtracting: %v", usage, err)
+	}
+	if usage, err := provider.Usage(ctx, "foo/bar"); err != nil || usage != 512 {
+		t.Fatalf("unexpected usage %d: %v", usage, err)
+	}
+	if usage, err := provider.Usage(ctx, "foo/other"); err != nil || usage != 0 {
+		t.Fatalf("unexpected usage %d of another repository: %v", usage, err)
+	}
+
+	if err := provider.Set(ctx, "foo/bar", 4096); err != nil {
+		t.Fatalf("unexpected error setting usage: %v", err)
+	}
+	if usage, err := provider.Usage(ctx, "foo/bar"); err != nil || usage != 4096 {
+		t.Fatalf("unexpected usage %d after set: %v", usage, err)
+	}
+	if usage, err := provider.Add(ctx, "foo/bar", 1); err != nil || usage != 4097 {
+		t.Fatalf("unexpected usage %d after adding to the usage set: %v", usage, err)
+	}
+}
+
+// CheckCatalog runs the tests of the catalog kept by the provider.
+func CheckCatalog(t *testing.T, provider cache.CatalogProvider) {
+	ctx := context.Background()
+
+	list := func(n int, last, prefix string) ([]string, error) {
+		repos := make([]string, n)
+		filled, err := provider.List(ctx, repos, last, prefix)
+		return repos[:filled], err
+	}
+
+	if repos, err := list(10, "", ""); err != io.EOF || len(repos) != 0 {
+		t.Fatalf("unexpected repositories %v of an empty catalog: %v", repos, err)
+	}
+
+	if err := provider.Add(ctx, "foo/bar", "foo-bar", "foo/bar/baz", "abc", "foo/bar"); err != nil {
+		t.Fatalf("unexpected error adding repositories: %v", err)
+	}
+	if err := provider.Add(ctx, "abc"); err != nil {
+		t.Fatalf("unexpected error adding a repository again: %v", err)
+	}
+
+	for _, tc := range []struct {
+		n            int
+		last, prefix string
+		expected     []string
+		more         bool
+	}{
+		{10, "", "", []string{"abc", "foo/bar", "foo/bar/baz", "foo-bar"}, false},
+		{2, "", "", []string{"abc", "foo/bar"}, true},
+		{2, "foo/bar", "", []string{"foo/bar/baz", "foo-bar"}, false},
+		{2, "foo-bar", "", nil, false},
+		{10, "", "foo/", []string{"foo/bar", "foo/bar/baz"}, false},
+		{1, "", "foo/", []string{"foo/bar"}, true},
+		{10, "foo/bar", "foo/", []string{"foo/bar/baz"}, false},
+		{10, "abc", "foo-", []string{"foo-bar"}, false},
+		{10, "", "bar", nil, false},
+	} {
+		repos, err := list(tc.n, tc.last, tc.prefix)
+		if (err == nil) != tc.more || (err != nil && err != io.EOF) {
+			t.Fatalf("unexpected error listing %d repositories after %q with prefix %q: %v", tc.n, tc.last, tc.prefix, err)
+		}
+		if !reflect.DeepEqual(repos, tc.expected) && (len(repos) != 0 || len(tc.expected) != 0) {
+			t.Fatalf("unexpected repositories %v listed after %q with prefix %q, expected %v", repos, tc.last, tc.prefix, tc.expected)
+		}
+	}
+
+	if err := provider.Remove(ctx, "foo/bar", "missing"); err != nil {
+		t.Fatalf("unexpected error removing repositories: %v", err)
+	}
+	if repos, err := list(10, "", ""); err != io.EOF || !reflect.DeepEqual(repos, []string{"abc", "foo/bar/baz", "foo-bar"}) {
+		t.Fatalf("unexpected repositories %v after remove: %v", repos, err)
+	}
+}
+
+// CheckPullCounts runs the tests of the pull counts kept by the provider.
+func CheckPullCounts(t *testing.T, provider cache.PullCountProvider) {
+	ctx := context.Background()
+
+	if counts, err := provider.PullCounts(ctx, "foo/bar"); err != nil || len(counts) != 0 {
+		t.Fatalf("unexpected pull counts %v of a repository not recorded: %v", counts, err)
+	}
+
+	if err := provider.AddPullCounts(ctx, "foo/bar", map[string]int64{"latest": 3, "sha256:abc": 1}); err != nil {
+		t.Fatalf("unexpected error adding pull counts: %v", err)
+	}
+	if err := provider.AddPullCounts(ctx, "foo/bar", map[string]int64{"latest": 2, "v1": 1}); err != nil {
+		t.Fatalf("unexpected error adding pull counts again: %v", err)
+	}
+	counts, err := provider.PullCounts(ctx, "foo/bar")
+	if err != nil {
+		t.Fatalf("unexpected error reading pull counts: %v", err)
+	}
+	if expected := map[string]int64{"latest": 5, "sha256:abc": 1, "v1": 1}; !maps.Equal(counts, expected) {
+		t.Fatalf("unexpected pull counts %v, expected %v", counts, expected)
+	}
+	if counts, err := provider.PullCounts(ctx, "foo/other"); err != nil || len(counts) != 0 {
+		t.Fatalf("unexpected pull counts %v of another repository: %v", counts, err)
+	}
+}
+
+// CheckUploadSessions runs the tests of the upload sessions kept by the
+// provider.
+func CheckUploadSessions(t *testing.T, provider cache.UploadSessionProvider) {
+	ctx := context.Background()
+
+	if session, version, err := provider.Get(ctx, "foo/bar", "upload"); err != nil || session != nil || version != 0 {
+		t.Fatalf("unexpected session %q at version %d of an upload not kept: %v", session, version, err)
+	}
+
+	version, err := provider.Set(ctx, "foo/bar", "upload", []byte("first"), 0)
+	if err != nil {
+		t.Fatalf("unexpected error setting session: %v", err)
+	}
+	if session, v, err := provider.Get(ctx, "foo/bar", "upload"); err != nil || string(session) != "first" || v != version {
+		t.Fatalf("unexpected session %q at version %d: %v", session, v, err)
+	}
+	if session, _, err := provider.Get(ctx, "foo/other", "upload"); err != nil || session != nil {
+		t.Fatalf("unexpected session %q of another repository: %v", session, err)
+	}
+
+	// Of two updates from the same version, only the first is kept.
+	updated, err := provider.Set(ctx, "foo/bar", "upload", []byte("second"), version)
+	if err != nil || updated == version {
+		t.Fatalf("unexpected version %d of the session updated: %v", updated, err)
+	}
+	if _, err := provider.Set(ctx, "foo/bar", "upload", []byte("concurrent"), version); err != distribution.ErrBlobUploadConflict {
+		t.Fatalf("expected a conflict updating the session from a stale version: %v", err)
+	}
+	if _, err := provider.Set(ctx, "foo/bar", "upload", []byte("concurrent"), 0); err != distribution.ErrBlobUploadConflict {
+		t.Fatalf("expected a conflict creating a session kept already: %v", err)
+	}
+	if session, v, err := provider.Get(ctx, "foo/bar", "upload"); err != nil || string(session) != "second" || v != updated {
+		t.Fatalf("unexpected session %q at version %d after the conflicts: %v", session, v, err)
+	}
+
+	if err := provider.Delete(ctx, "foo/bar", "upload"); err != nil {
+		t.Fatalf("unexpected error deleting session: %v", err)
+	}
+	if session, _, err := provider.Get(ctx, "foo/bar", "upload"); err != nil || session != nil {
+		t.Fatalf("unexpected session %q after delete: %v", session, err)
+	}
+	if err := provider.Delete(ctx, "foo/bar", "upload"); err != nil {
+		t.Fatalf("unexpected error deleting a session not kept: %v", err)
+	}
+}
@@ -1,13 +1,16 @@
 package memory
 
 import (
+	"container/list"
 	"context"
+	"hash/maphash"
 	"math"
+	"sync"
+	"sync/atomic"
 
 	"github.com/distribution/distribution/v3"
 	"github.com/distribution/distribution/v3/registry/storage/cache"
 	"github.com/distribution/reference"
-	"github.com/hashicorp/golang-lru/arc/v2"
 	"github.com/opencontainers/go-digest"
 	v1 "github.com/opencontainers/image-spec/specs-go/v1"
 )
@@ -19,6 +22,14 @@ const (
 
 	// UnlimitedSize indicates the cache size should not be limited.
 	UnlimitedSize = math.MaxInt
+
+	// maxShards is the number of shards of the caches, each locked
+	// separately, unless they can hold fewer descriptors.
+	maxShards = 32
+
+	// entryOverhead approximates the bytes taken by a descriptor in the
+	// cache, besides its strings.
+	entryOverhead = 256
 )
 
 type descriptorCacheKey struct {
@@ -26,24 +37,196 @@ type descriptorCacheKey struct {
 	repo   string
 }
 
+type descriptorCacheEntry struct {
+	key  descriptorCacheKey
+	desc v1.Descriptor
+	size int64
+}
+
+// entrySize approximates the bytes taken by the descriptor of the key.
+func entrySize(key descriptorCacheKey, desc v1.Descriptor) int64 {
+	size := entryOverhead + len(key.digest) + len(key.repo) + len(desc.MediaType) +
+		len(desc.Digest) + len(desc.ArtifactType) + len(desc.Data)
+	for _, url := range desc.URLs {
+		size += len(url)
+	}
+	for k, v := range desc.Annotations {
+		size += len(k) + len(v)
+	}
+	return int64(size)
+}
+
+// descriptorCacheShard is a least recently used list of the descriptors of
+// the digests hashed to the shard. The descriptors of a digest, global and
+// scoped to the repositories, are in the same shard, so that the scoped
+// descriptors are evicted along with the global one.
+type descriptorCacheShard struct {
+	mu      sync.Mutex
+	lru     *list.List
+	entries map[descriptorCacheKey]*list.Element
+	// repos are the repositories of the scoped descriptors of the digests.
+	repos      map[digest.Digest]map[string]struct{}
+	size       int64
+	maxEntries int
+	maxBytes   int64
+	evictions  *atomic.Int64
+}
+
+// get returns the descriptor of the key, keeping the global descriptor of a
+// scoped descriptor as recently used as the scoped one.
+func (s *descriptorCacheShard) get(key descriptorCacheKey) (v1.Descriptor, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	e, ok := s.entries[key]
+	if !ok {
+		return v1.Descriptor{}, false
+	}
+	s.lru.MoveToFront(e)
+	if key.repo != "" {
+		if global, ok := s.entries[descriptorCacheKey{digest: key.digest}]; ok {
+			s.lru.MoveToFront(global)
+		}
+	}
+	return e.Value.(*descriptorCacheEntry).desc, true
+}
+
+// add adds the descriptor of the key, evicting the least recently used
+// descriptors of the shard beyond its bounds.
+func (s *descriptorCacheShard) add(key descriptorCacheKey, desc v1.Descriptor) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	entry := &descriptorCacheEntry{key: key, desc: desc, size: entrySize(key, desc)}
+	if e, ok := s.entries[key]; ok {
+		s.size += entry.size - e.Value.(*descriptorCacheEntry).size
+		e.Value = entry
+		s.lru.MoveToFront(e)
+	} else {
+		s.entries[key] = s.lru.PushFront(entry)
+		s.size += entry.size
+		if key.repo != "" {
+			repos, ok := s.repos[key.digest]
+			if !ok {
+				repos = make(map[string]struct{})
+				s.repos[key.digest] = repos
+			}
+			repos[key.repo] = struct{}{}
+		}
+	}
+	for s.lru.Len() > s.maxEntries || (s.maxBytes > 0 && s.size > s.maxBytes) {
+		s.evictions.Add(int64(s.remove(s.lru.Back().Value.(*descriptorCacheEntry).key)))
+	}
+}
+
+// remove removes the descriptor of the key, with the scoped descriptors of
+// a global one, and returns the number of descriptors removed.
+func (s *descriptorCacheShard) remove(key descriptorCacheKey) int {
+	e, ok := s.entries[key]
+	if !ok {
+		return 0
+	}
+	s.lru.Remove(e)
+	delete(s.entries, key)
+	s.size -= e.Value.(*descriptorCacheEntry).size
+
+	removed := 1
+	if key.repo == "" {
+		for repo := range s.repos[key.digest] {
+			removed += s.remove(descriptorCacheKey{digest: key.digest, repo: repo})
+		}
+	} else if repos, ok := s.repos[key.digest]; ok {
+		delete(repos, key.repo)
+		if len(repos) == 0 {
+			delete(s.repos, key.digest)
+		}
+	}
+	return removed
+}
+
+func (s *descriptorCacheShard) clear(key descriptorCacheKey) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.remove(key)
+}
+
+func (s *descriptorCacheShard) len() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.lru.Len()
+}
+
 type inMemoryBlobDescriptorCacheProvider struct {
-	lru *arc.ARCCache[descriptorCacheKey, v1.Descriptor]
+	seed      maphash.Seed
+	shards    []*descriptorCacheShard
+	evictions atomic.Int64
+	maxBytes  int64
+}
+
+// Option configures the in-memory BlobDescriptorCacheProvider.
+type Option func(*inMemoryBlobDescriptorCacheProvider)
+
+// WithMaxBytes bounds the cache to approximately maxBytes of descriptors,
+// besides the number of descriptors. The bytes are not bounded if maxBytes
+// is zero.
+func WithMaxBytes(maxBytes int64) Option {
+	return func(imbdcp *inMemoryBlobDescriptorCacheProvider) {
+		imbdcp.maxBytes = maxBytes
+	}
 }
 
-// NewInMemoryBlobDescriptorCacheProvider returns a new mapped-based cache for
-// storing blob descriptor data.
-func NewInMemoryBlobDescriptorCacheProvider(size int) cache.BlobDescriptorCacheProvider {
+// NewInMemoryBlobDescriptorCacheProvider returns a new cache storing up to
+// size blob descriptors, evicting the least recently used ones. The cache is
+// sharded by digest, each shard holding an equal part of the descriptors.
+func NewInMemoryBlobDescriptorCacheProvider(size int, options ...Option) cache.BlobDescriptorCacheProvider {
 	if size <= 0 {
-		size = math.MaxInt
+		size = UnlimitedSize
 	}
-	lruCache, err := arc.NewARC[descriptorCacheKey, v1.Descriptor](size)
-	if err != nil {
-		// NewARC can only fail if size is <= 0, so this unreachable
-		panic(err)
+	imbdcp := &inMemoryBlobDescriptorCacheProvider{
+		seed: maphash.MakeSeed(),
 	}
-	return &inMemoryBlobDescriptorCacheProvider{
-		lru: lruCache,
+	for _, option := range options {
+		option(imbdcp)
 	}
+
+	n := min(maxShards, size)
+	var maxBytes int64
+	if imbdcp.maxBytes > 0 {
+		maxBytes = max(1, imbdcp.maxBytes/int64(n))
+	}
+	imbdcp.shards = make([]*descriptorCacheShard, n)
+	for i := range imbdcp.shards {
+		maxEntries := size / n
+		if i < size%n {
+			maxEntries++
+		}
+		imbdcp.shards[i] = &descriptorCacheShard{
+			lru:        list.New(),
+			entries:    make(map[descriptorCacheKey]*list.Element),
+			repos:      make(map[digest.Digest]map[string]struct{}),
+			maxEntries: maxEntries,
+			maxBytes:   maxBytes,
+			evictions:  &imbdcp.evictions,
+		}
+	}
+	return imbdcp
+}
+
+// shard returns the shard of the descriptors of the digest.
+func (imbdcp *inMemoryBlobDescriptorCacheProvider) shard(dgst digest.Digest) *descriptorCacheShard {
+	return imbdcp.shards[maphash.String(imbdcp.seed, string(dgst))%uint64(len(imbdcp.shards))]
+}
+
+// Len returns the number of descriptors in the cache.
+func (imbdcp *inMemoryBlobDescriptorCacheProvider) Len() int {
+	n := 0
+	for _, shard := range imbdcp.shards {
+		n += shard.len()
+	}
+	return n
+}
+
+// Evictions returns the number of descriptors evicted from the cache.
+func (imbdcp *inMemoryBlobDescriptorCacheProvider) Evictions() int64 {
+	return imbdcp.evictions.Load()
 }
 
 func (imbdcp *inMemoryBlobDescriptorCacheProvider) RepositoryScoped(repo string) (distribution.BlobDescriptorService, error) {
@@ -71,7 +254,7 @@ func (imbdcp *inMemoryBlobDescriptorCacheProvider) Stat(ctx context.Context, dgs
 	key := descriptorCacheKey{
 		digest: dgst,
 	}
-	descriptor, ok := imbdcp.lru.Get(key)
+	descriptor, ok := imbdcp.shard(dgst).get(key)
 	if ok {
 		return descriptor, nil
 	}
@@ -82,7 +265,7 @@ func (imbdcp *inMemoryBlobDescriptorCacheProvider) Clear(ctx context.Context, dg
 	key := descriptorCacheKey{
 		digest: dgst,
 	}
-	imbdcp.lru.Remove(key)
+	imbdcp.shard(dgst).clear(key)
 	return nil
 }
 
@@ -107,7 +290,7 @@ func (imbdcp *inMemoryBlobDescriptorCacheProvider) SetDescriptor(ctx context.Con
 		key := descriptorCacheKey{
 			digest: dgst,
 		}
-		imbdcp.lru.Add(key, desc)
+		imbdcp.shard(dgst).add(key, desc)
 		return nil
 	}
 	// we already know it, do nothing
@@ -131,7 +314,7 @@ func (rsimbdcp *repositoryScopedInMemoryBlobDescriptorCache) Stat(ctx context.Co
 		digest: dgst,
 		repo:   rsimbdcp.repo,
 	}
-	descriptor, ok := rsimbdcp.parent.lru.Get(key)
+	descriptor, ok := rsimbdcp.parent.shard(dgst).get(key)
 	if ok {
 		return descriptor, nil
 	}
@@ -143,7 +326,7 @@ func (rsimbdcp *repositoryScopedInMemoryBlobDescriptorCache) Clear(ctx context.C
 		digest: dgst,
 		repo:   rsimbdcp.repo,
 	}
-	rsimbdcp.parent.lru.Remove(key)
+	rsimbdcp.parent.shard(dgst).clear(key)
 	return nil
 }
 
@@ -160,6 +343,6 @@ func (rsimbdcp *repositoryScopedInMemoryBlobDescriptorCache) SetDescriptor(ctx c
 		digest: dgst,
 		repo:   rsimbdcp.repo,
 	}
-	rsimbdcp.parent.lru.Add(key, desc)
+	rsimbdcp.parent.shard(dgst).add(key, desc)
 	return rsimbdcp.parent.SetDescriptor(ctx, dgst, desc)
 }
@@ -1,9 +1,17 @@
 package memory
 
 import (
+	"context"
+	"fmt"
+	"strconv"
 	"testing"
+	"time"
 
+	"github.com/distribution/distribution/v3"
 	"github.com/distribution/distribution/v3/registry/storage/cache/cachecheck"
+	"github.com/hashicorp/golang-lru/arc/v2"
+	"github.com/opencontainers/go-digest"
+	v1 "github.com/opencontainers/image-spec/specs-go/v1"
 )
 
 // TestInMemoryBlobInfoCache checks the in memory implementation is working
@@ -11,3 +19,216 @@ import (
 func TestInMemoryBlobInfoCache(t *testing.T) {
 	cachecheck.CheckBlobDescriptorCache(t, NewInMemoryBlobDescriptorCacheProvider(UnlimitedSize))
 }
+
+// testDescriptor returns the descriptor of the ith blob.
+func testDescriptor(i int) v1.Descriptor {
+	return v1.Descriptor{
+		Digest:    digest.FromString(strconv.Itoa(i)),
+		Size:      int64(i),
+		MediaType: "application/octet-stream",
+	}
+}
+
+// checkScopedDescriptors checks that the scoped descriptors of the cache are
+// only cached along with their global descriptors.
+func checkScopedDescriptors(t *testing.T, imbdcp *inMemoryBlobDescriptorCacheProvider) {
+	t.Helper()
+	for _, shard := range imbdcp.shards {
+		for key := range shard.entries {
+			if _, ok := shard.entries[descriptorCacheKey{digest: key.digest}]; key.repo != "" && !ok {
+				t.Fatalf("descriptor of %s cached for %s without its global descriptor", key.digest, key.repo)
+			}
+		}
+	}
+}
+
+func TestInMemoryBlobDescriptorCacheBound(t *testing.T) {
+	ctx := context.Background()
+	provider := NewInMemoryBlobDescriptorCacheProvider(1000)
+	imbdcp := provider.(*inMemoryBlobDescriptorCacheProvider)
+	scoped, err := provider.RepositoryScoped("foo/bar")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for i := range 10000 {
+		desc := testDescriptor(i)
+		if err := scoped.SetDescriptor(ctx, desc.Digest, desc); err != nil {
+			t.Fatal(err)
+		}
+		// The first descriptor is kept in use.
+		if _, err := scoped.Stat(ctx, testDescriptor(0).Digest); err != nil {
+			t.Fatalf("unexpected eviction of the descriptor in use after %d descriptors: %v", i, err)
+		}
+		if n := imbdcp.Len(); n > 1000 {
+			t.Fatalf("unexpected number of descriptors %d after %d descriptors", n, i)
+		}
+	}
+	checkScopedDescriptors(t, imbdcp)
+	// Each descriptor is cached globally and for the repository.
+	if imbdcp.Evictions() < 19000 {
+		t.Fatalf("unexpected number of evictions: %d", imbdcp.Evictions())
+	}
+	if _, err := scoped.Stat(ctx, testDescriptor(1).Digest); err != distribution.ErrBlobUnknown {
+		t.Fatalf("expected the least recently used descriptor to be evicted: %v", err)
+	}
+	if _, err := scoped.Stat(ctx, testDescriptor(9999).Digest); err != nil {
+		t.Fatalf("unexpected eviction of the last descriptor: %v", err)
+	}
+}
+
+func TestInMemoryBlobDescriptorCacheMaxBytes(t *testing.T) {
+	ctx := context.Background()
+	maxBytes := int64(100 * maxShards * entrySize(descriptorCacheKey{digest: testDescriptor(0).Digest}, testDescriptor(0)))
+	provider := NewInMemoryBlobDescriptorCacheProvider(UnlimitedSize, WithMaxBytes(maxBytes))
+	imbdcp := provider.(*inMemoryBlobDescriptorCacheProvider)
+
+	annotated := testDescriptor(0)
+	annotated.Annotations = map[string]string{"description": string(make([]byte, 4096))}
+	for i := range 10000 {
+		desc := testDescriptor(i)
+		if i%10 == 0 {
+			annotated.Digest, annotated.Size = desc.Digest, desc.Size
+			desc = annotated
+		}
+		if err := provider.SetDescriptor(ctx, desc.Digest, desc); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	var size int64
+	for _, shard := range imbdcp.shards {
+		var shardSize int64
+		for key, e := range shard.entries {
+			shardSize += entrySize(key, e.Value.(*descriptorCacheEntry).desc)
+		}
+		if shardSize != shard.size || shard.size > shard.maxBytes {
+			t.Fatalf("unexpected size of shard %d, counted %d, bound %d", shardSize, shard.size, shard.maxBytes)
+		}
+		size += shard.size
+	}
+	if size > maxBytes || imbdcp.Len() == 0 || imbdcp.Evictions() == 0 {
+		t.Fatalf("unexpected size %d of %d descriptors after %d evictions", size, imbdcp.Len(), imbdcp.Evictions())
+	}
+}
+
+func TestInMemoryBlobDescriptorCacheClearScoped(t *testing.T) {
+	ctx := context.Background()
+	provider := NewInMemoryBlobDescriptorCacheProvider(UnlimitedSize)
+	desc := testDescriptor(0)
+	var repos []distribution.BlobDescriptorService
+	for i := range 3 {
+		scoped, err := provider.RepositoryScoped(fmt.Sprintf("foo/repo-%d", i))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := scoped.SetDescriptor(ctx, desc.Digest, desc); err != nil {
+			t.Fatal(err)
+		}
+		repos = append(repos, scoped)
+	}
+
+	// Clearing a scoped descriptor leaves the others.
+	if err := repos[0].Clear(ctx, desc.Digest); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := repos[0].Stat(ctx, desc.Digest); err != distribution.ErrBlobUnknown {
+		t.Fatalf("expected the scoped descriptor to be cleared: %v", err)
+	}
+	if _, err := repos[1].Stat(ctx, desc.Digest); err != nil {
+		t.Fatalf("unexpected error statting the descriptor of another repository: %v", err)
+	}
+
+	// Clearing the global descriptor clears the scoped ones.
+	if err := provider.Clear(ctx, desc.Digest); err != nil {
+		t.Fatal(err)
+	}
+	for _, scoped := range repos {
+		if _, err := scoped.Stat(ctx, desc.Digest); err != distribution.ErrBlobUnknown {
+			t.Fatalf("expected the scoped descriptor to be cleared with the global one: %v", err)
+		}
+	}
+	if n := provider.(*inMemoryBlobDescriptorCacheProvider).Len(); n != 0 {
+		t.Fatalf("unexpected descriptors left: %d", n)
+	}
+}
+
+// BenchmarkInMemoryBlobDescriptorCacheHit compares the hits of the cache
+// with the hits of the ARC cache it replaced, locked by a single mutex.
+func BenchmarkInMemoryBlobDescriptorCacheHit(b *testing.B) {
+	ctx := context.Background()
+	descs := make([]v1.Descriptor, 1024)
+	for i := range descs {
+		descs[i] = testDescriptor(i)
+	}
+
+	b.Run("arc", func(b *testing.B) {
+		lru, err := arc.NewARC[descriptorCacheKey, v1.Descriptor](DefaultSize)
+		if err != nil {
+			b.Fatal(err)
+		}
+		for _, desc := range descs {
+			lru.Add(descriptorCacheKey{digest: desc.Digest}, desc)
+		}
+		b.ResetTimer()
+		b.RunParallel(func(pb *testing.PB) {
+			i := 0
+			for pb.Next() {
+				dgst := descs[i%len(descs)].Digest
+				if err := dgst.Validate(); err != nil {
+					b.Fatal(err)
+				}
+				if _, ok := lru.Get(descriptorCacheKey{digest: dgst}); !ok {
+					b.Fatal("unexpected miss")
+				}
+				i++
+			}
+		})
+	})
+
+	b.Run("sharded", func(b *testing.B) {
+		provider := NewInMemoryBlobDescriptorCacheProvider(DefaultSize)
+		for _, desc := range descs {
+			if err := provider.SetDescriptor(ctx, desc.Digest, desc); err != nil {
+				b.Fatal(err)
+			}
+		}
+		b.ResetTimer()
+		b.RunParallel(func(pb *testing.PB) {
+			i := 0
+			for pb.Next() {
+				if _, err := provider.Stat(ctx, descs[i%len(descs)].Digest); err != nil {
+					b.Fatal(err)
+				}
+				i++
+			}
+		})
+	})
+}
+
+func TestInMemoryTagCache(t *testing.T) {
+	cachecheck.CheckTagCache(t, NewInMemoryTagCacheProvider(UnlimitedSize, time.Hour))
+}
+
+func TestInMemoryTagCacheExpiry(t *testing.T) {
+	ctx := context.Background()
+	provider := NewInMemoryTagCacheProvider(UnlimitedSize, time.Minute).(*inMemoryTagCacheProvider)
+	now := time.Now()
+	provider.now = func() time.Time { return now }
+
+	dgst := digest.FromString("expiring")
+	if err := provider.Set(ctx, "foo/bar", "latest", dgst); err != nil {
+		t.Fatal(err)
+	}
+	now = now.Add(59 * time.Second)
+	if cached, err := provider.Get(ctx, "foo/bar", "latest"); err != nil || cached != dgst {
+		t.Fatalf("unexpected digest %s before expiry: %v", cached, err)
+	}
+	now = now.Add(time.Second)
+	if _, err := provider.Get(ctx, "foo/bar", "latest"); err == nil {
+		t.Fatal("expected the tag to expire")
+	}
+	if provider.lru.Len() != 0 {
+		t.Fatal("expected the expired tag to be removed")
+	}
+}
@@ -0,0 +1,75 @@
+package memory
+
+import (
+	"context"
+	"time"
+
+	"github.com/distribution/distribution/v3"
+	"github.com/distribution/distribution/v3/registry/storage/cache"
+	"github.com/hashicorp/golang-lru/arc/v2"
+	"github.com/opencontainers/go-digest"
+)
+
+type tagCacheKey struct {
+	repo string
+	tag  string
+}
+
+type tagCacheEntry struct {
+	digest  digest.Digest
+	expires time.Time
+}
+
+type inMemoryTagCacheProvider struct {
+	lru *arc.ARCCache[tagCacheKey, tagCacheEntry]
+	ttl time.Duration
+	// now returns the current time, which is advanced by the tests.
+	now func() time.Time
+}
+
+// NewInMemoryTagCacheProvider returns a new map-based cache of the digests
+// referenced by up to size tags, each cached for ttl.
+func NewInMemoryTagCacheProvider(size int, ttl time.Duration) cache.TagCacheProvider {
+	if size <= 0 {
+		size = UnlimitedSize
+	}
+	lruCache, err := arc.NewARC[tagCacheKey, tagCacheEntry](size)
+	if err != nil {
+		// NewARC can only fail if size is <= 0, so this unreachable
+		panic(err)
+	}
+	return &inMemoryTagCacheProvider{
+		lru: lruCache,
+		ttl: ttl,
+		now: time.Now,
+	}
+}
+
+func (imtcp *inMemoryTagCacheProvider) Get(ctx context.Context, repo, tag string) (digest.Digest, error) {
+	key := tagCacheKey{repo: repo, tag: tag}
+	entry, ok := imtcp.lru.Get(key)
+	if !ok {
+		return "", distribution.ErrTagUnknown{Tag: tag}
+	}
+	if !imtcp.now().Before(entry.expires) {
+		imtcp.lru.Remove(key)
+		return "", distribution.ErrTagUnknown{Tag: tag}
+	}
+	return entry.digest, nil
+}
+
+func (imtcp *inMemoryTagCacheProvider) Set(ctx context.Context, repo, tag string, dgst digest.Digest) error {
+	if err := dgst.Validate(); err != nil {
+		return err
+	}
+	imtcp.lru.Add(tagCacheKey{repo: repo, tag: tag}, tagCacheEntry{
+		digest:  dgst,
+		expires: imtcp.now().Add(imtcp.ttl),
+	})
+	return nil
+}
+
+func (imtcp *inMemoryTagCacheProvider) Clear(ctx context.Context, repo, tag string) error {
+	imtcp.lru.Remove(tagCacheKey{repo: repo, tag: tag})
+	return nil
+}
@@ -0,0 +1,92 @@
+package redis
+
+import (
+	"context"
+	"io"
+	"strings"
+
+	"github.com/distribution/distribution/v3/registry/storage/cache"
+	"github.com/redis/go-redis/v9"
+)
+
+// catalogKey is the sorted set of the names of the repositories. Its members
+// all have the same score, so that they are sorted lexicographically, with
+// the separator of the path components replaced by a NUL byte to sort first.
+const catalogKey = "catalog::repositories"
+
+// catalogSeparator replaces the separator of the path components of the
+// names of the repositories in the members of the catalog, and catalogNames
+// restores it.
+var (
+	catalogSeparator = strings.NewReplacer("/", "\x00")
+	catalogNames     = strings.NewReplacer("\x00", "/")
+)
+
+// redisCatalog keeps the catalog in a sorted set, which the instances of the
+// registry sharing the redis instance update atomically.
+type redisCatalog struct {
+	pool redis.UniversalClient
+}
+
+var _ cache.CatalogProvider = &redisCatalog{}
+
+// NewRedisCatalogProvider returns a new redis-based CatalogProvider.
+func NewRedisCatalogProvider(pool redis.UniversalClient) cache.CatalogProvider {
+	return &redisCatalog{pool: pool}
+}
+
+func (rc *redisCatalog) List(ctx context.Context, repos []string, last, prefix string) (int, error) {
+	member, prefixMember := catalogSeparator.Replace(last), catalogSeparator.Replace(prefix)
+	lower := "-"
+	switch {
+	case last != "" && member >= prefixMember:
+		lower = "(" + member
+	case prefix != "":
+		lower = "[" + prefixMember
+	}
+	upper := "+"
+	if prefix != "" {
+		upper = "[" + prefixMember + "\xff"
+	}
+
+	// One more member is listed than repos holds, to tell whether any
+	// follows them.
+	members, err := rc.pool.ZRangeByLex(ctx, catalogKey, &redis.ZRangeBy{
+		Min:   lower,
+		Max:   upper,
+		Count: int64(len(repos)) + 1,
+	}).Result()
+	if err != nil {
+		return 0, err
+	}
+	n := copy(repos, members)
+	for i := range n {
+		repos[i] = catalogNames.Replace(repos[i])
+	}
+	if len(members) <= len(repos) {
+		return n, io.EOF
+	}
+	return n, nil
+}
+
+func (rc *redisCatalog) Add(ctx context.Context, repos ...string) error {
+	if len(repos) == 0 {
+		return nil
+	}
+	members := make([]redis.Z, 0, len(repos))
+	for _, repo := range repos {
+		members = append(members, redis.Z{Member: catalogSeparator.Replace(repo)})
+	}
+	return rc.pool.ZAdd(ctx, catalogKey, members...).Err()
+}
+
+func (rc *redisCatalog) Remove(ctx context.Context, repos ...string) error {
+	if len(repos) == 0 {
+		return nil
+	}
+	members := make([]any, 0, len(repos))
+	for _, repo := range repos {
+		members = append(members, catalogSeparator.Replace(repo))
+	}
+	return rc.pool.ZRem(ctx, catalogKey, members...).Err()
+}
@@ -0,0 +1,17 @@
+package redis
+
+import (
+	"testing"
+
+	"github.com/alicebob/miniredis/v2"
+	"github.com/distribution/distribution/v3/registry/storage/cache/cachecheck"
+	"github.com/redis/go-redis/v9"
+)
+
+func TestRedisCatalog(t *testing.T) {
+	server := miniredis.RunT(t)
+	pool := redis.NewClient(&redis.Options{Addr: server.Addr()})
+	defer pool.Close()
+
+	cachecheck.CheckCatalog(t, NewRedisCatalogProvider(pool))
+}
@@ -0,0 +1,58 @@
+package redis
+
+import (
+	"context"
+	"strconv"
+
+	"github.com/distribution/distribution/v3/registry/storage/cache"
+	"github.com/redis/go-redis/v9"
+)
+
+// redisPullCounts keeps the pull counts of each repository in a hash, which
+// the instances of the registry sharing the redis instance increment
+// atomically.
+//
+// The keys are in the following format:
+//
+//	repository::<repo>::pulls
+type redisPullCounts struct {
+	pool redis.UniversalClient
+}
+
+var _ cache.PullCountProvider = &redisPullCounts{}
+
+// NewRedisPullCountProvider returns a new redis-based PullCountProvider.
+func NewRedisPullCountProvider(pool redis.UniversalClient) cache.PullCountProvider {
+	return &redisPullCounts{pool: pool}
+}
+
+func (rpc *redisPullCounts) PullCounts(ctx context.Context, repo string) (map[string]int64, error) {
+	fields, err := rpc.pool.HGetAll(ctx, rpc.pullsKey(repo)).Result()
+	if err != nil {
+		return nil, err
+	}
+	counts := make(map[string]int64, len(fields))
+	for reference, value := range fields {
+		count, err := strconv.ParseInt(value, 10, 64)
+		if err != nil {
+			return nil, err
+		}
+		counts[reference] = count
+	}
+	return counts, nil
+}
+
+// AddPullCounts increments the counts in a single transaction.
+func (rpc *redisPullCounts) AddPullCounts(ctx context.Context, repo string, counts map[string]int64) error {
+	_, err := rpc.pool.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+		for reference, count := range counts {
+			pipe.HIncrBy(ctx, rpc.pullsKey(repo), reference, count)
+		}
+		return nil
+	})
+	return err
+}
+
+func (rpc *redisPullCounts) pullsKey(repo string) string {
+	return "repository::" + repo + "::pulls"
+}
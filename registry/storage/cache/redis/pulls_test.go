@@ -0,0 +1,35 @@
+package redis
+
+import (
+	"context"
+	"testing"
+
+	"github.com/alicebob/miniredis/v2"
+	"github.com/distribution/distribution/v3/registry/storage/cache/cachecheck"
+	"github.com/redis/go-redis/v9"
+)
+
+func TestRedisPullCounts(t *testing.T) {
+	server := miniredis.RunT(t)
+	pool := redis.NewClient(&redis.Options{Addr: server.Addr()})
+	defer pool.Close()
+
+	cachecheck.CheckPullCounts(t, NewRedisPullCountProvider(pool))
+}
+
+func TestRedisPullCountsShared(t *testing.T) {
+	ctx := context.Background()
+	server := miniredis.RunT(t)
+
+	// Each instance of the registry connects to the redis instance.
+	for range 2 {
+		pool := redis.NewClient(&redis.Options{Addr: server.Addr()})
+		defer pool.Close()
+		if err := NewRedisPullCountProvider(pool).AddPullCounts(ctx, "foo/bar", map[string]int64{"latest": 2}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if value := server.HGet("repository::foo/bar::pulls", "latest"); value != "4" {
+		t.Fatalf("unexpected value %q of the pull count of latest", value)
+	}
+}
@@ -0,0 +1,45 @@
+package redis
+
+import (
+	"context"
+
+	"github.com/distribution/distribution/v3/registry/storage/cache"
+	"github.com/redis/go-redis/v9"
+)
+
+// redisQuotaUsage keeps the usage of the quotas in integers, which the
+// instances of the registry sharing the redis instance update atomically.
+//
+// The keys are in the following format:
+//
+//	repository::<repo>::quota
+type redisQuotaUsage struct {
+	pool redis.UniversalClient
+}
+
+var _ cache.QuotaUsageProvider = &redisQuotaUsage{}
+
+// NewRedisQuotaUsageProvider returns a new redis-based QuotaUsageProvider.
+func NewRedisQuotaUsageProvider(pool redis.UniversalClient) cache.QuotaUsageProvider {
+	return &redisQuotaUsage{pool: pool}
+}
+
+func (rqu *redisQuotaUsage) Usage(ctx context.Context, repo string) (int64, error) {
+	usage, err := rqu.pool.Get(ctx, rqu.quotaKey(repo)).Int64()
+	if err == redis.Nil {
+		return 0, nil
+	}
+	return usage, err
+}
+
+func (rqu *redisQuotaUsage) Add(ctx context.Context, repo string, delta int64) (int64, error) {
+	return rqu.pool.IncrBy(ctx, rqu.quotaKey(repo), delta).Result()
+}
+
+func (rqu *redisQuotaUsage) Set(ctx context.Context, repo string, usage int64) error {
+	return rqu.pool.Set(ctx, rqu.quotaKey(repo), usage, 0).Err()
+}
+
+func (rqu *redisQuotaUsage) quotaKey(repo string) string {
+	return "repository::" + repo + "::quota"
+}
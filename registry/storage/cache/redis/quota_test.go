@@ -0,0 +1,43 @@
+package redis
+
+import (
+	"context"
+	"testing"
+
+	"github.com/alicebob/miniredis/v2"
+	"github.com/distribution/distribution/v3/registry/storage/cache/cachecheck"
+	"github.com/redis/go-redis/v9"
+)
+
+func TestRedisQuotaUsage(t *testing.T) {
+	server := miniredis.RunT(t)
+	pool := redis.NewClient(&redis.Options{Addr: server.Addr()})
+	defer pool.Close()
+
+	cachecheck.CheckQuotaUsage(t, NewRedisQuotaUsageProvider(pool))
+}
+
+func TestRedisQuotaUsageShared(t *testing.T) {
+	ctx := context.Background()
+	server := miniredis.RunT(t)
+
+	// Each instance of the registry connects to the redis instance.
+	var providers []*redisQuotaUsage
+	for range 2 {
+		pool := redis.NewClient(&redis.Options{Addr: server.Addr()})
+		defer pool.Close()
+		providers = append(providers, NewRedisQuotaUsageProvider(pool).(*redisQuotaUsage))
+	}
+
+	for _, provider := range providers {
+		if _, err := provider.Add(ctx, "foo/bar", 100); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if usage, err := providers[0].Usage(ctx, "foo/bar"); err != nil || usage != 200 {
+		t.Fatalf("unexpected usage %d added by the peers: %v", usage, err)
+	}
+	if value, err := server.Get("repository::foo/bar::quota"); err != nil || value != "200" {
+		t.Fatalf("unexpected value %q of the usage key: %v", value, err)
+	}
+}
@@ -4,6 +4,7 @@ import (
 	"context"
 	"fmt"
 	"strconv"
+	"time"
 
 	"github.com/distribution/distribution/v3"
 	"github.com/distribution/distribution/v3/registry/storage/cache"
@@ -28,6 +29,11 @@ import (
 type redisBlobDescriptorService struct {
 	pool redis.UniversalClient
 
+	// ttl is the expiry of the keys written, which never expire if zero.
+	ttl time.Duration
+	// refresh, if set, renews the expiry of the keys read.
+	refresh bool
+
 	// TODO(stevvooe): We use a pool because we don't have great control over
 	// the cache lifecycle to manage connections. A new connection if fetched
 	// for each operation. Once we have better lifecycle management of the
@@ -36,18 +42,63 @@ type redisBlobDescriptorService struct {
 
 var _ distribution.BlobDescriptorService = &redisBlobDescriptorService{}
 
+// Option configures the redis-based BlobDescriptorCacheProvider.
+type Option func(*redisBlobDescriptorService)
+
+// WithTTL makes the keys written by the cache expire after ttl, the sets of
+// the blobs of the repositories included. The keys never expire if ttl is
+// zero.
+func WithTTL(ttl time.Duration) Option {
+	return func(rbds *redisBlobDescriptorService) {
+		rbds.ttl = ttl
+	}
+}
+
+// WithTTLRefresh renews the expiry of the keys of the descriptors read, for
+// the descriptors in use to stay cached.
+func WithTTLRefresh() Option {
+	return func(rbds *redisBlobDescriptorService) {
+		rbds.refresh = true
+	}
+}
+
 // NewRedisBlobDescriptorCacheProvider returns a new redis-based
 // BlobDescriptorCacheProvider using the provided redis connection pool.
-func NewRedisBlobDescriptorCacheProvider(pool redis.UniversalClient) cache.BlobDescriptorCacheProvider {
+func NewRedisBlobDescriptorCacheProvider(pool redis.UniversalClient, options ...Option) cache.BlobDescriptorCacheProvider {
+	rbds := &redisBlobDescriptorService{
+		pool: pool,
+	}
+	for _, option := range options {
+		option(rbds)
+	}
 	return metrics.NewPrometheusCacheProvider(
-		&redisBlobDescriptorService{
-			pool: pool,
-		},
+		rbds,
 		"cache_redis",
 		"Number of seconds taken by redis",
 	)
 }
 
+// expire sets the expiry of the keys, if the keys expire.
+func (rbds *redisBlobDescriptorService) expire(ctx context.Context, keys ...string) error {
+	if rbds.ttl <= 0 {
+		return nil
+	}
+	pipe := rbds.pool.Pipeline()
+	for _, key := range keys {
+		pipe.Expire(ctx, key, rbds.ttl)
+	}
+	_, err := pipe.Exec(ctx)
+	return err
+}
+
+// refreshed renews the expiry of the keys read, if configured to.
+func (rbds *redisBlobDescriptorService) refreshed(ctx context.Context, keys ...string) error {
+	if !rbds.refresh {
+		return nil
+	}
+	return rbds.expire(ctx, keys...)
+}
+
 // RepositoryScoped returns the scoped cache.
 func (rbds *redisBlobDescriptorService) RepositoryScoped(repo string) (distribution.BlobDescriptorService, error) {
 	if _, err := reference.ParseNormalizedNamed(repo); err != nil {
@@ -72,7 +123,14 @@ func (rbds *redisBlobDescriptorService) Stat(ctx context.Context, dgst digest.Di
 		return v1.Descriptor{}, err
 	}
 
-	return rbds.stat(ctx, dgst)
+	desc, err := rbds.stat(ctx, dgst)
+	if err != nil {
+		return v1.Descriptor{}, err
+	}
+	if err := rbds.refreshed(ctx, rbds.blobDescriptorHashKey(dgst)); err != nil {
+		return v1.Descriptor{}, err
+	}
+	return desc, nil
 }
 
 func (rbds *redisBlobDescriptorService) Clear(ctx context.Context, dgst digest.Digest) error {
@@ -155,7 +213,7 @@ func (rbds *redisBlobDescriptorService) setDescriptor(ctx context.Context, dgst
 	if cmd.Err() != nil {
 		return cmd.Err()
 	}
-	return nil
+	return rbds.expire(ctx, rbds.blobDescriptorHashKey(dgst))
 }
 
 func (rbds *redisBlobDescriptorService) blobDescriptorHashKey(dgst digest.Digest) string {
@@ -189,6 +247,9 @@ func (rsrbds *repositoryScopedRedisBlobDescriptorService) Stat(ctx context.Conte
 
 	upstream, err := rsrbds.upstream.stat(ctx, dgst)
 	if err != nil {
+		if err == distribution.ErrBlobUnknown {
+			return v1.Descriptor{}, rsrbds.expired(ctx, dgst)
+		}
 		return v1.Descriptor{}, err
 	}
 
@@ -196,7 +257,7 @@ func (rsrbds *repositoryScopedRedisBlobDescriptorService) Stat(ctx context.Conte
 	mediatype, err := pool.HGet(ctx, rsrbds.blobDescriptorHashKey(dgst), "mediatype").Result()
 	if err != nil {
 		if err == redis.Nil {
-			return v1.Descriptor{}, distribution.ErrBlobUnknown
+			return v1.Descriptor{}, rsrbds.expired(ctx, dgst)
 		}
 		return v1.Descriptor{}, err
 	}
@@ -205,9 +266,30 @@ func (rsrbds *repositoryScopedRedisBlobDescriptorService) Stat(ctx context.Conte
 		upstream.MediaType = mediatype
 	}
 
+	err = rsrbds.upstream.refreshed(ctx,
+		rsrbds.repositoryBlobSetKey(rsrbds.repo),
+		rsrbds.blobDescriptorHashKey(dgst),
+		rsrbds.upstream.blobDescriptorHashKey(dgst))
+	if err != nil {
+		return v1.Descriptor{}, err
+	}
 	return upstream, nil
 }
 
+// expired removes the digest, whose descriptor expired, from the set of the
+// blobs of the repository, and returns ErrBlobUnknown. The members of the set
+// are only removed if the keys expire.
+func (rsrbds *repositoryScopedRedisBlobDescriptorService) expired(ctx context.Context, dgst digest.Digest) error {
+	if rsrbds.upstream.ttl <= 0 {
+		return distribution.ErrBlobUnknown
+	}
+	pool := rsrbds.upstream.pool
+	if err := pool.SRem(ctx, rsrbds.repositoryBlobSetKey(rsrbds.repo), dgst.String()).Err(); err != nil {
+		return err
+	}
+	return distribution.ErrBlobUnknown
+}
+
 // Clear removes the descriptor from the cache and forwards to the upstream descriptor store
 func (rsrbds *repositoryScopedRedisBlobDescriptorService) Clear(ctx context.Context, dgst digest.Digest) error {
 	if err := dgst.Validate(); err != nil {
@@ -269,6 +351,16 @@ func (rsrbds *repositoryScopedRedisBlobDescriptorService) setDescriptor(ctx cont
 		return err
 	}
 
+	// The set outlives the descriptors of its members, which are removed
+	// once found expired.
+	err = rsrbds.upstream.expire(ctx, rsrbds.repositoryBlobSetKey(rsrbds.repo), rsrbds.blobDescriptorHashKey(dgst))
+	if err != nil {
+		return err
+	}
+	if err := rsrbds.sweep(ctx); err != nil {
+		return err
+	}
+
 	// Also set the values for the primary descriptor, if they differ by
 	// algorithm (ie sha256 vs sha512).
 	if desc.Digest != "" && dgst != desc.Digest && dgst.Algorithm() != desc.Digest.Algorithm() {
@@ -280,6 +372,42 @@ func (rsrbds *repositoryScopedRedisBlobDescriptorService) setDescriptor(ctx cont
 	return nil
 }
 
+// sweepSamples is the number of members of the set of the blobs of a
+// repository checked for expiry on each write.
+const sweepSamples = 4
+
+// sweep removes the members of a sample of the set of the blobs of the
+// repository whose descriptors expired, for the members which are not read
+// anymore not to accumulate in the set.
+func (rsrbds *repositoryScopedRedisBlobDescriptorService) sweep(ctx context.Context) error {
+	if rsrbds.upstream.ttl <= 0 {
+		return nil
+	}
+	pool := rsrbds.upstream.pool
+	members, err := pool.SRandMemberN(ctx, rsrbds.repositoryBlobSetKey(rsrbds.repo), sweepSamples).Result()
+	if err != nil {
+		return err
+	}
+	pipe := pool.Pipeline()
+	exists := make([]*redis.IntCmd, len(members))
+	for i, member := range members {
+		exists[i] = pipe.Exists(ctx, rsrbds.blobDescriptorHashKey(digest.Digest(member)))
+	}
+	if _, err := pipe.Exec(ctx); err != nil {
+		return err
+	}
+	var expired []any
+	for i, member := range members {
+		if exists[i].Val() == 0 {
+			expired = append(expired, member)
+		}
+	}
+	if len(expired) == 0 {
+		return nil
+	}
+	return pool.SRem(ctx, rsrbds.repositoryBlobSetKey(rsrbds.repo), expired...).Err()
+}
+
 func (rsrbds *repositoryScopedRedisBlobDescriptorService) blobDescriptorHashKey(dgst digest.Digest) string {
 	return "repository::" + rsrbds.repo + "::blobs::" + dgst.String()
 }
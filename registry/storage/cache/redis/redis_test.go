@@ -5,6 +5,7 @@ import (
 	"flag"
 	"os"
 	"testing"
+	"time"
 
 	"github.com/alicebob/miniredis/v2"
 	"github.com/distribution/distribution/v3"
@@ -123,3 +124,175 @@ func TestRepositoryScopedClearRevokesRepositoryMembership(t *testing.T) {
 		t.Fatal("expected repo a descriptor hash to be removed during clear")
 	}
 }
+
+func TestRedisBlobDescriptorCacheProviderTTL(t *testing.T) {
+	server := miniredis.RunT(t)
+	pool := redis.NewClient(&redis.Options{Addr: server.Addr()})
+	defer pool.Close()
+
+	cachecheck.CheckBlobDescriptorCache(t, NewRedisBlobDescriptorCacheProvider(pool, WithTTL(time.Hour)))
+}
+
+// setDescriptor caches the descriptor of dgst for the repository.
+func setDescriptor(t *testing.T, repo *repositoryScopedRedisBlobDescriptorService, dgst digest.Digest) {
+	t.Helper()
+	desc := v1.Descriptor{
+		Digest:    dgst,
+		Size:      1337,
+		MediaType: "application/vnd.oci.image.layer.v1.tar",
+	}
+	if err := repo.SetDescriptor(context.Background(), dgst, desc); err != nil {
+		t.Fatalf("unexpected error setting descriptor: %v", err)
+	}
+}
+
+func TestRepositoryScopedTTL(t *testing.T) {
+	ctx := context.Background()
+	server := miniredis.RunT(t)
+	pool := redis.NewClient(&redis.Options{Addr: server.Addr()})
+	defer pool.Close()
+
+	cache := &redisBlobDescriptorService{pool: pool, ttl: time.Minute}
+	repo := &repositoryScopedRedisBlobDescriptorService{repo: "foo/expiring", upstream: cache}
+	dgst := digest.FromString("expiring")
+	setDescriptor(t, repo, dgst)
+
+	keys := []string{
+		cache.blobDescriptorHashKey(dgst),
+		repo.blobDescriptorHashKey(dgst),
+		repo.repositoryBlobSetKey(repo.repo),
+	}
+	for _, key := range keys {
+		if ttl := server.TTL(key); ttl != time.Minute {
+			t.Fatalf("unexpected ttl of %s: %v", key, ttl)
+		}
+	}
+
+	// The expiry is left untouched by the reads.
+	server.FastForward(30 * time.Second)
+	if _, err := repo.Stat(ctx, dgst); err != nil {
+		t.Fatalf("unexpected error statting descriptor: %v", err)
+	}
+	if ttl := server.TTL(repo.blobDescriptorHashKey(dgst)); ttl != 30*time.Second {
+		t.Fatalf("unexpected ttl after stat: %v", ttl)
+	}
+
+	server.FastForward(30 * time.Second)
+	for _, key := range keys {
+		if server.Exists(key) {
+			t.Fatalf("expected %s to expire", key)
+		}
+	}
+	if _, err := repo.Stat(ctx, dgst); err != distribution.ErrBlobUnknown {
+		t.Fatalf("expected stat of expired descriptor to return ErrBlobUnknown, got: %v", err)
+	}
+	if _, err := cache.Stat(ctx, dgst); err != distribution.ErrBlobUnknown {
+		t.Fatalf("expected global stat of expired descriptor to return ErrBlobUnknown, got: %v", err)
+	}
+}
+
+func TestRepositoryScopedTTLRefresh(t *testing.T) {
+	ctx := context.Background()
+	server := miniredis.RunT(t)
+	pool := redis.NewClient(&redis.Options{Addr: server.Addr()})
+	defer pool.Close()
+
+	cache := &redisBlobDescriptorService{pool: pool, ttl: time.Minute, refresh: true}
+	repo := &repositoryScopedRedisBlobDescriptorService{repo: "foo/hot", upstream: cache}
+	dgst := digest.FromString("hot")
+	setDescriptor(t, repo, dgst)
+
+	// The descriptor read stays cached past its first expiry.
+	for range 3 {
+		server.FastForward(45 * time.Second)
+		if _, err := repo.Stat(ctx, dgst); err != nil {
+			t.Fatalf("unexpected error statting descriptor: %v", err)
+		}
+		for _, key := range []string{
+			cache.blobDescriptorHashKey(dgst),
+			repo.blobDescriptorHashKey(dgst),
+			repo.repositoryBlobSetKey(repo.repo),
+		} {
+			if ttl := server.TTL(key); ttl != time.Minute {
+				t.Fatalf("unexpected ttl of %s after stat: %v", key, ttl)
+			}
+		}
+	}
+
+	server.FastForward(45 * time.Second)
+	if _, err := cache.Stat(ctx, dgst); err != nil {
+		t.Fatalf("unexpected error statting global descriptor: %v", err)
+	}
+	if ttl := server.TTL(cache.blobDescriptorHashKey(dgst)); ttl != time.Minute {
+		t.Fatalf("unexpected ttl of global descriptor after stat: %v", ttl)
+	}
+}
+
+func TestRepositoryScopedTTLRemovesExpiredMembers(t *testing.T) {
+	ctx := context.Background()
+	server := miniredis.RunT(t)
+	pool := redis.NewClient(&redis.Options{Addr: server.Addr()})
+	defer pool.Close()
+
+	cache := &redisBlobDescriptorService{pool: pool, ttl: time.Minute}
+	repo := &repositoryScopedRedisBlobDescriptorService{repo: "foo/members", upstream: cache}
+	stale := []digest.Digest{digest.FromString("stale-a"), digest.FromString("stale-b")}
+	for _, dgst := range stale {
+		setDescriptor(t, repo, dgst)
+	}
+
+	// The descriptors expire while the set is kept alive by the writes.
+	setKey := repo.repositoryBlobSetKey(repo.repo)
+	for _, dgst := range stale {
+		server.Del(repo.blobDescriptorHashKey(dgst))
+	}
+
+	// The member read is removed by the stat.
+	if _, err := repo.Stat(ctx, stale[0]); err != distribution.ErrBlobUnknown {
+		t.Fatalf("expected stat of expired descriptor to return ErrBlobUnknown, got: %v", err)
+	}
+	if member, _ := server.SIsMember(setKey, stale[0].String()); member {
+		t.Fatal("expected the member of the expired descriptor to be removed by the stat")
+	}
+
+	// The member left is removed by the next write.
+	fresh := digest.FromString("fresh")
+	setDescriptor(t, repo, fresh)
+	members, err := server.Members(setKey)
+	if err != nil {
+		t.Fatalf("unexpected error reading the set: %v", err)
+	}
+	if len(members) != 1 || members[0] != fresh.String() {
+		t.Fatalf("unexpected members after write: %v", members)
+	}
+}
+
+func TestRepositoryScopedNoTTL(t *testing.T) {
+	ctx := context.Background()
+	server := miniredis.RunT(t)
+	pool := redis.NewClient(&redis.Options{Addr: server.Addr()})
+	defer pool.Close()
+
+	cache := &redisBlobDescriptorService{pool: pool, refresh: true}
+	repo := &repositoryScopedRedisBlobDescriptorService{repo: "foo/immortal", upstream: cache}
+	dgst := digest.FromString("immortal")
+	setDescriptor(t, repo, dgst)
+	if _, err := repo.Stat(ctx, dgst); err != nil {
+		t.Fatalf("unexpected error statting descriptor: %v", err)
+	}
+
+	for _, key := range server.Keys() {
+		if ttl := server.TTL(key); ttl != 0 {
+			t.Fatalf("unexpected ttl of %s: %v", key, ttl)
+		}
+	}
+
+	// The members are left in the set without a ttl, as before.
+	server.Del(repo.blobDescriptorHashKey(dgst))
+	if _, err := repo.Stat(ctx, dgst); err != distribution.ErrBlobUnknown {
+		t.Fatalf("expected stat to return ErrBlobUnknown, got: %v", err)
+	}
+	if member, _ := server.SIsMember(repo.repositoryBlobSetKey(repo.repo), dgst.String()); !member {
+		t.Fatal("expected the member to be kept without a ttl")
+	}
+}
@@ -0,0 +1,60 @@
+package redis
+
+import (
+	"context"
+	"time"
+
+	"github.com/distribution/distribution/v3"
+	"github.com/distribution/distribution/v3/registry/storage/cache"
+	"github.com/opencontainers/go-digest"
+	"github.com/redis/go-redis/v9"
+)
+
+// redisTagCache caches the digests referenced by the tags in strings, which
+// expire after the ttl. The tags are cleared for all the registries sharing
+// the redis instance.
+//
+// The keys are in the following format:
+//
+//	repository::<repo>::tags::<tag>
+type redisTagCache struct {
+	pool redis.UniversalClient
+	ttl  time.Duration
+}
+
+var _ cache.TagCacheProvider = &redisTagCache{}
+
+// NewRedisTagCacheProvider returns a new redis-based TagCacheProvider caching
+// each tag for ttl.
+func NewRedisTagCacheProvider(pool redis.UniversalClient, ttl time.Duration) cache.TagCacheProvider {
+	return &redisTagCache{
+		pool: pool,
+		ttl:  ttl,
+	}
+}
+
+func (rtc *redisTagCache) Get(ctx context.Context, repo, tag string) (digest.Digest, error) {
+	v, err := rtc.pool.Get(ctx, rtc.tagKey(repo, tag)).Result()
+	if err != nil {
+		if err == redis.Nil {
+			return "", distribution.ErrTagUnknown{Tag: tag}
+		}
+		return "", err
+	}
+	return digest.Parse(v)
+}
+
+func (rtc *redisTagCache) Set(ctx context.Context, repo, tag string, dgst digest.Digest) error {
+	if err := dgst.Validate(); err != nil {
+		return err
+	}
+	return rtc.pool.Set(ctx, rtc.tagKey(repo, tag), dgst.String(), rtc.ttl).Err()
+}
+
+func (rtc *redisTagCache) Clear(ctx context.Context, repo, tag string) error {
+	return rtc.pool.Del(ctx, rtc.tagKey(repo, tag)).Err()
+}
+
+func (rtc *redisTagCache) tagKey(repo, tag string) string {
+	return "repository::" + repo + "::tags::" + tag
+}
@@ -0,0 +1,67 @@
+package redis
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/alicebob/miniredis/v2"
+	"github.com/distribution/distribution/v3/registry/storage/cache/cachecheck"
+	"github.com/opencontainers/go-digest"
+	"github.com/redis/go-redis/v9"
+)
+
+func TestRedisTagCache(t *testing.T) {
+	server := miniredis.RunT(t)
+	pool := redis.NewClient(&redis.Options{Addr: server.Addr()})
+	defer pool.Close()
+
+	cachecheck.CheckTagCache(t, NewRedisTagCacheProvider(pool, time.Hour))
+}
+
+func TestRedisTagCacheExpiry(t *testing.T) {
+	ctx := context.Background()
+	server := miniredis.RunT(t)
+	pool := redis.NewClient(&redis.Options{Addr: server.Addr()})
+	defer pool.Close()
+	provider := NewRedisTagCacheProvider(pool, 5*time.Second)
+
+	dgst := digest.FromString("expiring")
+	if err := provider.Set(ctx, "foo/bar", "latest", dgst); err != nil {
+		t.Fatal(err)
+	}
+	if ttl := server.TTL("repository::foo/bar::tags::latest"); ttl != 5*time.Second {
+		t.Fatalf("unexpected ttl of the tag: %v", ttl)
+	}
+	server.FastForward(5 * time.Second)
+	if _, err := provider.Get(ctx, "foo/bar", "latest"); err == nil {
+		t.Fatal("expected the tag to expire")
+	}
+}
+
+func TestRedisTagCacheSharedClear(t *testing.T) {
+	ctx := context.Background()
+	server := miniredis.RunT(t)
+
+	// Each instance of the registry connects to the redis instance.
+	var providers []*redisTagCache
+	for range 2 {
+		pool := redis.NewClient(&redis.Options{Addr: server.Addr()})
+		defer pool.Close()
+		providers = append(providers, NewRedisTagCacheProvider(pool, time.Hour).(*redisTagCache))
+	}
+
+	dgst := digest.FromString("shared")
+	if err := providers[0].Set(ctx, "foo/bar", "latest", dgst); err != nil {
+		t.Fatal(err)
+	}
+	if cached, err := providers[1].Get(ctx, "foo/bar", "latest"); err != nil || cached != dgst {
+		t.Fatalf("unexpected digest %s cached by the peer: %v", cached, err)
+	}
+	if err := providers[1].Clear(ctx, "foo/bar", "latest"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := providers[0].Get(ctx, "foo/bar", "latest"); err == nil {
+		t.Fatal("expected the tag cleared by the peer to be gone")
+	}
+}
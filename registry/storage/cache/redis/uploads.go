@@ -0,0 +1,91 @@
+package redis
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+	"time"
+
+	"github.com/distribution/distribution/v3"
+	"github.com/distribution/distribution/v3/registry/storage/cache"
+	"github.com/redis/go-redis/v9"
+)
+
+// redisUploadSessions keeps the session of each upload in a hash, with its
+// version, which the instances of the registry sharing the redis instance
+// update with optimistic transactions. The sessions expire after the ttl,
+// unless updated.
+//
+// The keys are in the following format:
+//
+//	repository::<repo>::uploads::<id>
+type redisUploadSessions struct {
+	pool redis.UniversalClient
+	ttl  time.Duration
+}
+
+var _ cache.UploadSessionProvider = &redisUploadSessions{}
+
+// NewRedisUploadSessionProvider returns a new redis-based
+// UploadSessionProvider, whose sessions expire after ttl, or never if it is
+// zero.
+func NewRedisUploadSessionProvider(pool redis.UniversalClient, ttl time.Duration) cache.UploadSessionProvider {
+	return &redisUploadSessions{pool: pool, ttl: ttl}
+}
+
+func (rus *redisUploadSessions) Get(ctx context.Context, repo, id string) ([]byte, int64, error) {
+	values, err := rus.pool.HMGet(ctx, rus.sessionKey(repo, id), "session", "version").Result()
+	if err != nil {
+		return nil, 0, err
+	}
+	session, ok := values[0].(string)
+	if !ok {
+		return nil, 0, nil
+	}
+	version, _ := values[1].(string)
+	parsed, err := strconv.ParseInt(version, 10, 64)
+	if err != nil {
+		return nil, 0, fmt.Errorf("invalid version %q of upload session %s: %v", version, id, err)
+	}
+	return []byte(session), parsed, nil
+}
+
+// Set replaces the session in a transaction watching its key, so that the
+// session updated concurrently since its version was read is not replaced.
+func (rus *redisUploadSessions) Set(ctx context.Context, repo, id string, session []byte, version int64) (int64, error) {
+	key := rus.sessionKey(repo, id)
+	err := rus.pool.Watch(ctx, func(tx *redis.Tx) error {
+		current, err := tx.HGet(ctx, key, "version").Int64()
+		if err == redis.Nil {
+			current = 0
+		} else if err != nil {
+			return err
+		}
+		if current != version {
+			return distribution.ErrBlobUploadConflict
+		}
+		_, err = tx.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+			pipe.HSet(ctx, key, "session", session, "version", version+1)
+			if rus.ttl > 0 {
+				pipe.Expire(ctx, key, rus.ttl)
+			}
+			return nil
+		})
+		return err
+	}, key)
+	if err == redis.TxFailedErr {
+		return 0, distribution.ErrBlobUploadConflict
+	}
+	if err != nil {
+		return 0, err
+	}
+	return version + 1, nil
+}
+
+func (rus *redisUploadSessions) Delete(ctx context.Context, repo, id string) error {
+	return rus.pool.Del(ctx, rus.sessionKey(repo, id)).Err()
+}
+
+func (rus *redisUploadSessions) sessionKey(repo, id string) string {
+	return "repository::" + repo + "::uploads::" + id
+}
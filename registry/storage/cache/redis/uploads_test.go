@@ -0,0 +1,44 @@
+package redis
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/alicebob/miniredis/v2"
+	"github.com/distribution/distribution/v3/registry/storage/cache/cachecheck"
+	"github.com/redis/go-redis/v9"
+)
+
+func TestRedisUploadSessions(t *testing.T) {
+	server := miniredis.RunT(t)
+	pool := redis.NewClient(&redis.Options{Addr: server.Addr()})
+	defer pool.Close()
+
+	cachecheck.CheckUploadSessions(t, NewRedisUploadSessionProvider(pool, time.Hour))
+}
+
+func TestRedisUploadSessionsExpiry(t *testing.T) {
+	ctx := context.Background()
+	server := miniredis.RunT(t)
+	pool := redis.NewClient(&redis.Options{Addr: server.Addr()})
+	defer pool.Close()
+	provider := NewRedisUploadSessionProvider(pool, time.Hour)
+
+	version, err := provider.Set(ctx, "foo/bar", "upload", []byte("first"), 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Each update pushes the expiry back.
+	server.FastForward(45 * time.Minute)
+	if _, err := provider.Set(ctx, "foo/bar", "upload", []byte("second"), version); err != nil {
+		t.Fatal(err)
+	}
+	if ttl := server.TTL("repository::foo/bar::uploads::upload"); ttl != time.Hour {
+		t.Fatalf("unexpected ttl %v of the session", ttl)
+	}
+	server.FastForward(time.Hour)
+	if session, _, err := provider.Get(ctx, "foo/bar", "upload"); err != nil || session != nil {
+		t.Fatalf("expected the session to expire, got %q: %v", session, err)
+	}
+}
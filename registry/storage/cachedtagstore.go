@@ -0,0 +1,75 @@
+package storage
+
+import (
+	"context"
+
+	"github.com/distribution/distribution/v3"
+	"github.com/distribution/distribution/v3/internal/dcontext"
+	"github.com/distribution/distribution/v3/registry/storage/cache"
+	v1 "github.com/opencontainers/image-spec/specs-go/v1"
+)
+
+var (
+	_ distribution.TagService         = &cachedTagStore{}
+	_ distribution.TagDetailLister    = &cachedTagStore{}
+	_ distribution.TagHistoryProvider = &cachedTagStore{}
+)
+
+// cachedTagStore resolves the tags from the cache, reading the current links
+// of the tags which are not cached. The tags are cleared from the cache once
+// their links are written or removed, so that a tag resolved from the cache
+// is at most stale for the ttl of the cache between the write of its link and
+// its clearing.
+type cachedTagStore struct {
+	*tagStore
+	cache cache.TagCacheProvider
+}
+
+// Get returns the current revision of the tag, from the cache if possible.
+func (ts *cachedTagStore) Get(ctx context.Context, tag string) (v1.Descriptor, error) {
+	name := ts.repository.Named().Name()
+	dgst, err := ts.cache.Get(ctx, name, tag)
+	if err == nil {
+		return v1.Descriptor{Digest: dgst}, nil
+	}
+	if _, ok := err.(distribution.ErrTagUnknown); !ok {
+		dcontext.GetLogger(ctx).Errorf("error reading tag %s from the cache: %v", tag, err)
+	}
+
+	desc, err := ts.tagStore.Get(ctx, tag)
+	if err != nil {
+		return v1.Descriptor{}, err
+	}
+	if err := ts.cache.Set(ctx, name, tag, desc.Digest); err != nil {
+		dcontext.GetLogger(ctx).Errorf("error caching tag %s: %v", tag, err)
+	}
+	return desc, nil
+}
+
+// GetUncached returns the current revision of the tag from its link, for the
+// callers which must not resolve a stale tag.
+func (ts *cachedTagStore) GetUncached(ctx context.Context, tag string) (v1.Descriptor, error) {
+	return ts.tagStore.Get(ctx, tag)
+}
+
+// Tag tags the digest with the given tag and clears the tag from the cache.
+func (ts *cachedTagStore) Tag(ctx context.Context, tag string, desc v1.Descriptor) error {
+	err := ts.tagStore.Tag(ctx, tag, desc)
+	ts.clear(ctx, tag)
+	return err
+}
+
+// Untag removes the tag association and clears the tag from the cache.
+func (ts *cachedTagStore) Untag(ctx context.Context, tag string) error {
+	err := ts.tagStore.Untag(ctx, tag)
+	ts.clear(ctx, tag)
+	return err
+}
+
+// clear removes the tag from the cache. A tag which could not be cleared
+// expires from the cache after its ttl.
+func (ts *cachedTagStore) clear(ctx context.Context, tag string) {
+	if err := ts.cache.Clear(ctx, ts.repository.Named().Name(), tag); err != nil {
+		dcontext.GetLogger(ctx).Errorf("error clearing tag %s from the cache: %v", tag, err)
+	}
+}
@@ -0,0 +1,122 @@
+package storage
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/distribution/distribution/v3"
+	"github.com/distribution/distribution/v3/registry/storage/cache"
+	"github.com/distribution/distribution/v3/registry/storage/cache/memory"
+	"github.com/distribution/distribution/v3/registry/storage/driver"
+	"github.com/distribution/distribution/v3/registry/storage/driver/inmemory"
+	"github.com/distribution/reference"
+	"github.com/opencontainers/go-digest"
+	v1 "github.com/opencontainers/image-spec/specs-go/v1"
+)
+
+// testTags returns the tags of the repository of a registry on the driver,
+// cached by the provider if not nil.
+func testTags(t *testing.T, d driver.StorageDriver, provider cache.TagCacheProvider) distribution.TagService {
+	ctx := context.Background()
+	var options []RegistryOption
+	if provider != nil {
+		options = append(options, TagCacheProvider(provider))
+	}
+	reg, err := NewRegistry(ctx, d, options...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	repoRef, _ := reference.WithName("a/cached")
+	repo, err := reg.Repository(ctx, repoRef)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return repo.Tags(ctx)
+}
+
+func expectTag(t *testing.T, tags distribution.TagService, tag string, dgst digest.Digest) {
+	t.Helper()
+	desc, err := tags.Get(context.Background(), tag)
+	if err != nil {
+		t.Fatalf("unexpected error getting tag %s: %v", tag, err)
+	}
+	if desc.Digest != dgst {
+		t.Fatalf("unexpected digest of tag %s: %s, expected %s", tag, desc.Digest, dgst)
+	}
+}
+
+func TestCachedTagStore(t *testing.T) {
+	ctx := context.Background()
+	d := inmemory.New()
+	provider := memory.NewInMemoryTagCacheProvider(memory.DefaultSize, time.Hour)
+	tags := testTags(t, d, provider)
+	// peer shares the cache, as the registries sharing a redis instance do.
+	peer := testTags(t, d, provider)
+	// uncached writes the links behind the back of the cache.
+	uncached := testTags(t, d, nil)
+
+	first := digest.FromString("first")
+	if _, err := tags.Get(ctx, "latest"); err == nil {
+		t.Fatal("expected an error getting an unknown tag")
+	}
+	if _, err := provider.Get(ctx, "a/cached", "latest"); err == nil {
+		t.Fatal("unexpected unknown tag cached")
+	}
+
+	// A miss is resolved from the link and cached.
+	if err := tags.Tag(ctx, "latest", v1.Descriptor{Digest: first}); err != nil {
+		t.Fatal(err)
+	}
+	expectTag(t, tags, "latest", first)
+	if dgst, err := provider.Get(ctx, "a/cached", "latest"); err != nil || dgst != first {
+		t.Fatalf("unexpected digest cached %s: %v", dgst, err)
+	}
+
+	// A hit is resolved from the cache, until its link is written through
+	// the tags cached.
+	second := digest.FromString("second")
+	if err := uncached.Tag(ctx, "latest", v1.Descriptor{Digest: second}); err != nil {
+		t.Fatal(err)
+	}
+	expectTag(t, tags, "latest", first)
+	if desc, err := tags.(*cachedTagStore).GetUncached(ctx, "latest"); err != nil || desc.Digest != second {
+		t.Fatalf("unexpected uncached digest %s: %v", desc.Digest, err)
+	}
+
+	// An overwrite clears the tag from the cache of the peers.
+	third := digest.FromString("third")
+	if err := peer.Tag(ctx, "latest", v1.Descriptor{Digest: third}); err != nil {
+		t.Fatal(err)
+	}
+	expectTag(t, tags, "latest", third)
+
+	// So does a removal.
+	if err := peer.Untag(ctx, "latest"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := tags.Get(ctx, "latest"); err == nil {
+		t.Fatal("expected an error getting an untagged tag")
+	}
+}
+
+func TestCachedTagStoreExpiry(t *testing.T) {
+	ctx := context.Background()
+	d := inmemory.New()
+	tags := testTags(t, d, memory.NewInMemoryTagCacheProvider(memory.DefaultSize, 10*time.Millisecond))
+	uncached := testTags(t, d, nil)
+
+	first := digest.FromString("first")
+	if err := tags.Tag(ctx, "latest", v1.Descriptor{Digest: first}); err != nil {
+		t.Fatal(err)
+	}
+	expectTag(t, tags, "latest", first)
+
+	// The tag is stale for at most the ttl.
+	second := digest.FromString("second")
+	if err := uncached.Tag(ctx, "latest", v1.Descriptor{Digest: second}); err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(20 * time.Millisecond)
+	expectTag(t, tags, "latest", second)
+}
@@ -7,6 +7,7 @@ import (
 	"path"
 	"strings"
 
+	"github.com/distribution/distribution/v3/internal/dcontext"
 	"github.com/distribution/distribution/v3/registry/storage/driver"
 	"github.com/distribution/reference"
 )
@@ -15,6 +16,13 @@ import (
 // Because it's a quite expensive operation, it should only be used when building up
 // an initial set of repositories.
 func (reg *registry) Repositories(ctx context.Context, repos []string, last string) (int, error) {
+	return reg.RepositoriesWithPrefix(ctx, repos, last, "")
+}
+
+// RepositoriesWithPrefix returns a list, or partial list, of the repositories
+// whose name starts with prefix. Only the directory of the repositories up to
+// the last slash of prefix is walked, unless the catalog is indexed.
+func (reg *registry) RepositoriesWithPrefix(ctx context.Context, repos []string, last, prefix string) (int, error) {
 	filledBuffer := false
 	foundRepos := 0
 
@@ -22,6 +30,10 @@ func (reg *registry) Repositories(ctx context.Context, repos []string, last stri
 		return 0, errors.New("attempted to list 0 repositories")
 	}
 
+	if reg.catalog != nil {
+		return reg.catalog.Repositories(ctx, repos, last, prefix)
+	}
+
 	root, err := pathFor(repositoriesRootPathSpec{})
 	if err != nil {
 		return 0, err
@@ -35,8 +47,21 @@ func (reg *registry) Repositories(ctx context.Context, repos []string, last stri
 		}
 	}
 
-	err = reg.blobStore.driver.Walk(ctx, root, func(fileInfo driver.FileInfo) error {
+	walkRoot := root
+	if i := strings.LastIndex(prefix, "/"); i >= 0 {
+		walkRoot = path.Join(root, prefix[:i])
+	}
+
+	err = reg.blobStore.driver.Walk(ctx, walkRoot, func(fileInfo driver.FileInfo) error {
+		// The directories which neither hold nor lead to the repositories
+		// starting with prefix are skipped.
+		if dir := fileInfo.Path()[len(root)+1:]; fileInfo.IsDir() && !strings.HasPrefix(dir, prefix) && !strings.HasPrefix(prefix, dir+"/") {
+			return driver.ErrSkipDir
+		}
 		err := handleRepository(fileInfo, root, last, func(repoPath string) error {
+			if !strings.HasPrefix(repoPath, prefix) {
+				return nil
+			}
 			repos[foundRepos] = repoPath
 			foundRepos += 1
 			return nil
@@ -52,7 +77,7 @@ func (reg *registry) Repositories(ctx context.Context, repos []string, last stri
 		}
 
 		return nil
-	}, driver.WithStartAfterHint(startAfter))
+	}, driver.WithStartAfterHint(startAfter), driver.WithParallelism(reg.blobStore.walkParallelism))
 
 	if err != nil {
 		return foundRepos, err
@@ -76,7 +101,7 @@ func (reg *registry) Enumerate(ctx context.Context, ingester func(string) error)
 
 	err = reg.blobStore.driver.Walk(ctx, root, func(fileInfo driver.FileInfo) error {
 		return handleRepository(fileInfo, root, "", ingester)
-	})
+	}, driver.WithParallelism(reg.blobStore.walkParallelism))
 
 	return err
 }
@@ -88,7 +113,13 @@ func (reg *registry) Remove(ctx context.Context, name reference.Named) error {
 		return err
 	}
 	repoDir := path.Join(root, name.Name())
-	return reg.driver.Delete(ctx, repoDir)
+	if err := reg.driver.Delete(ctx, repoDir); err != nil {
+		return err
+	}
+	if err := reg.catalog.remove(ctx, name.Name()); err != nil {
+		dcontext.GetLogger(ctx).Errorf("failed to remove %s from the catalog index: %v", name.Name(), err)
+	}
+	return nil
 }
 
 // lessPath returns true if one path a is less than path b.
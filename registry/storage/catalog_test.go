@@ -175,6 +175,48 @@ func TestCatalogInParts(t *testing.T) {
 	}
 }
 
+func TestCatalogWithPrefix(t *testing.T) {
+	env := setupFS(t)
+	lister := env.registry.(distribution.RepositoryPrefixLister)
+
+	for _, tc := range []struct {
+		prefix   string
+		expected []string
+	}{
+		{prefix: "foo", expected: []string{"foo/a", "foo/b", "foo/d/in", "foo-bar/a", "foo-bar/b"}},
+		{prefix: "foo/", expected: []string{"foo/a", "foo/b", "foo/d/in"}},
+		{prefix: "foo/d", expected: []string{"foo/d/in"}},
+		{prefix: "foo-bar/b", expected: []string{"foo-bar/b"}},
+		{prefix: "te", expected: []string{"test"}},
+		{prefix: "baz", expected: []string{}},
+		{prefix: "baz/", expected: []string{}},
+	} {
+		p := make([]string, 50)
+		numFilled, err := lister.RepositoriesWithPrefix(env.ctx, p, "", tc.prefix)
+		if _, ok := err.(driver.PathNotFoundError); err != io.EOF && !ok {
+			t.Errorf("prefix %q: expected the end of the catalog: %v", tc.prefix, err)
+		}
+		if numFilled != len(tc.expected) || !testEq(p, tc.expected, numFilled) {
+			t.Errorf("prefix %q: unexpected repositories %v, expected %v", tc.prefix, p[:numFilled], tc.expected)
+		}
+	}
+
+	// The catalog is still paginated in parts.
+	p := make([]string, 2)
+	numFilled, err := lister.RepositoriesWithPrefix(env.ctx, p, "", "foo")
+	if err != nil || !testEq(p, []string{"foo/a", "foo/b"}, numFilled) {
+		t.Fatalf("unexpected first chunk %v: %v", p[:numFilled], err)
+	}
+	numFilled, err = lister.RepositoriesWithPrefix(env.ctx, p, p[1], "foo")
+	if err != nil || !testEq(p, []string{"foo/d/in", "foo-bar/a"}, numFilled) {
+		t.Fatalf("unexpected second chunk %v: %v", p[:numFilled], err)
+	}
+	numFilled, err = lister.RepositoriesWithPrefix(env.ctx, p, p[1], "foo")
+	if err != io.EOF || !testEq(p, []string{"foo-bar/b"}, numFilled) {
+		t.Fatalf("unexpected last chunk %v: %v", p[:numFilled], err)
+	}
+}
+
 func TestCatalogEnumerate(t *testing.T) {
 	env := setupFS(t)
 
@@ -197,6 +239,44 @@ func TestCatalogEnumerate(t *testing.T) {
 	}
 }
 
+func TestCatalogParallel(t *testing.T) {
+	env := setupFS(t)
+	registry, err := NewRegistry(env.ctx, env.driver, WalkParallelism(4))
+	if err != nil {
+		t.Fatalf("error creating registry: %v", err)
+	}
+
+	var repos []string
+	err = registry.(distribution.RepositoryEnumerator).Enumerate(env.ctx, func(repoName string) error {
+		repos = append(repos, repoName)
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("unexpected error enumerating: %v", err)
+	}
+	if fmt.Sprint(repos) != fmt.Sprint(env.expected) {
+		t.Errorf("unexpected repositories enumerated: %v", repos)
+	}
+
+	repos = nil
+	p := make([]string, 2)
+	last := ""
+	for {
+		numFilled, err := registry.Repositories(env.ctx, p, last)
+		repos = append(repos, p[:numFilled]...)
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			t.Fatalf("unexpected error listing: %v", err)
+		}
+		last = p[numFilled-1]
+	}
+	if fmt.Sprint(repos) != fmt.Sprint(env.expected) {
+		t.Errorf("unexpected repositories listed: %v", repos)
+	}
+}
+
 func testEq(a, b []string, size int) bool {
 	for cnt := 0; cnt < size-1; cnt++ {
 		if a[cnt] != b[cnt] {
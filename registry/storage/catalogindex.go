@@ -0,0 +1,331 @@
+package storage
+
+import (
+	"context"
+	"errors"
+	"io"
+	"slices"
+	"strings"
+	"sync"
+
+	"github.com/distribution/distribution/v3"
+	"github.com/distribution/distribution/v3/registry/storage/cache"
+	"github.com/distribution/distribution/v3/registry/storage/driver"
+)
+
+// maxIndexedRepositories bounds the repositories CatalogIndex remembers
+// adding. Past it, the repositories pushed to are added to the index again,
+// which the providers ignore.
+const maxIndexedRepositories = 10000
+
+// catalogIndexPageSize is the number of repositories listed at once from the
+// index when it is reconciled.
+const catalogIndexPageSize = 1000
+
+// CatalogIndex keeps the names of the repositories of the registry in a
+// provider, so that the catalog is listed without walking the storage. A
+// repository is added to the index when a manifest is put to it, and removed
+// when it is removed or renamed, or when the offline garbage collection
+// deletes its last manifest. The index may drift from the storage, when it is
+// written to by a registry not indexing it, or when an update of the index
+// fails, which Reconcile repairs.
+type CatalogIndex struct {
+	provider cache.CatalogProvider
+
+	mu sync.Mutex
+	// indexed holds the repositories added to the index since the last
+	// reconciliation, so that they are not added on each push.
+	indexed map[string]struct{}
+}
+
+// NewCatalogIndex returns a CatalogIndex keeping the names of the
+// repositories in the provider.
+func NewCatalogIndex(provider cache.CatalogProvider) *CatalogIndex {
+	return &CatalogIndex{provider: provider, indexed: map[string]struct{}{}}
+}
+
+// IndexCatalog is a functional option for NewRegistry. It lists the
+// repositories of the catalog from the index, and keeps the index updated as
+// the repositories are pushed to, removed and renamed.
+func IndexCatalog(index *CatalogIndex) RegistryOption {
+	return func(registry *registry) error {
+		registry.catalog = index
+		return nil
+	}
+}
+
+// Repositories fills repos with the names of the repositories of the index
+// starting with prefix which follow last, in the order of the catalog, and
+// returns how many it filled, with io.EOF if no other repository follows
+// them.
+func (ci *CatalogIndex) Repositories(ctx context.Context, repos []string, last, prefix string) (int, error) {
+	return ci.provider.List(ctx, repos, last, prefix)
+}
+
+// add adds the repository to the index, unless it was added since the last
+// reconciliation.
+func (ci *CatalogIndex) add(ctx context.Context, name string) error {
+	if ci == nil {
+		return nil
+	}
+	ci.mu.Lock()
+	_, ok := ci.indexed[name]
+	ci.mu.Unlock()
+	if ok {
+		return nil
+	}
+	if err := ci.provider.Add(ctx, name); err != nil {
+		return err
+	}
+	ci.mu.Lock()
+	if len(ci.indexed) >= maxIndexedRepositories {
+		clear(ci.indexed)
+	}
+	ci.indexed[name] = struct{}{}
+	ci.mu.Unlock()
+	return nil
+}
+
+// remove removes the repositories from the index.
+func (ci *CatalogIndex) remove(ctx context.Context, names ...string) error {
+	if ci == nil {
+		return nil
+	}
+	ci.mu.Lock()
+	for _, name := range names {
+		delete(ci.indexed, name)
+	}
+	ci.mu.Unlock()
+	return ci.provider.Remove(ctx, names...)
+}
+
+// prune removes the repository from the index if it has no manifest revision
+// nor tag left, along with its manifests directory, so that the walk of the
+// storage does not list it either. It returns whether the repository was
+// pruned.
+func (ci *CatalogIndex) prune(ctx context.Context, storageDriver driver.StorageDriver, name string) (bool, error) {
+	if ci == nil {
+		return false, nil
+	}
+	for _, spec := range []pathSpec{manifestRevisionsPathSpec{name: name}, manifestTagsPathSpec{name: name}} {
+		dir, err := pathFor(spec)
+		if err != nil {
+			return false, err
+		}
+		found := false
+		err = storageDriver.Walk(ctx, dir, func(fileInfo driver.FileInfo) error {
+			if !fileInfo.IsDir() {
+				found = true
+				return driver.ErrFilledBuffer
+			}
+			return nil
+		})
+		if err != nil && !errors.As(err, new(driver.PathNotFoundError)) {
+			return false, err
+		}
+		if found {
+			return false, nil
+		}
+	}
+
+	manifestsPath, err := pathFor(manifestsPathSpec{name: name})
+	if err != nil {
+		return false, err
+	}
+	if err := storageDriver.Delete(ctx, manifestsPath); err != nil && !errors.As(err, new(driver.PathNotFoundError)) {
+		return false, err
+	}
+	return true, ci.remove(ctx, name)
+}
+
+// CatalogReconciliation is the outcome of the reconciliation of the catalog
+// index with the repositories of the storage.
+type CatalogReconciliation struct {
+	// Repositories is the number of repositories walked in the storage.
+	Repositories int
+	// Added are the repositories of the storage the index was missing.
+	Added []string
+	// Removed are the repositories of the index missing from the storage.
+	Removed []string
+}
+
+// Reconcile adds the repositories of the storage missing from the index, and
+// removes those of the index missing from the storage, walking the
+// repositories of the registry. The index is listed before the walk, so that
+// the repositories pushed to during the walk are kept.
+func (ci *CatalogIndex) Reconcile(ctx context.Context, registry distribution.Namespace) (CatalogReconciliation, error) {
+	var reconciliation CatalogReconciliation
+	enumerator, ok := registry.(distribution.RepositoryEnumerator)
+	if !ok {
+		return reconciliation, errors.New("unable to convert Namespace to RepositoryEnumerator")
+	}
+
+	indexed := make(map[string]struct{})
+	page := make([]string, catalogIndexPageSize)
+	last := ""
+	for {
+		n, err := ci.provider.List(ctx, page, last, "")
+		for _, name := range page[:n] {
+			indexed[name] = struct{}{}
+		}
+		if err == io.EOF || (err == nil && n == 0) {
+			break
+		}
+		if err != nil {
+			return reconciliation, err
+		}
+		last = page[n-1]
+	}
+
+	err := enumerator.Enumerate(ctx, func(name string) error {
+		reconciliation.Repositories++
+		if _, ok := indexed[name]; ok {
+			delete(indexed, name)
+		} else {
+			reconciliation.Added = append(reconciliation.Added, name)
+		}
+		return nil
+	})
+	if err != nil && !errors.As(err, new(driver.PathNotFoundError)) {
+		return reconciliation, err
+	}
+	for name := range indexed {
+		reconciliation.Removed = append(reconciliation.Removed, name)
+	}
+	slices.SortFunc(reconciliation.Removed, compareCatalog)
+
+	if err := ci.provider.Add(ctx, reconciliation.Added...); err != nil {
+		return reconciliation, err
+	}
+	if err := ci.provider.Remove(ctx, reconciliation.Removed...); err != nil {
+		return reconciliation, err
+	}
+
+	// The repositories removed from the index by another instance are added
+	// again on their next push.
+	ci.mu.Lock()
+	clear(ci.indexed)
+	ci.mu.Unlock()
+	return reconciliation, nil
+}
+
+// compareCatalog compares the names of two repositories in the order of the
+// catalog.
+func compareCatalog(a, b string) int {
+	return compareReplaceInline(a, b, '/', '\x00')
+}
+
+// storageCatalog keeps the catalog in a file of the storage, holding the
+// names of the repositories one per line, in the order of the catalog. Its
+// updates are only serialized within the process, so that the instances of
+// the registry sharing the storage should keep the catalog in redis instead.
+type storageCatalog struct {
+	driver driver.StorageDriver
+	mu     sync.Mutex
+}
+
+// NewStorageCatalogProvider returns a CatalogProvider keeping the catalog in
+// the storage.
+func NewStorageCatalogProvider(storageDriver driver.StorageDriver) cache.CatalogProvider {
+	return &storageCatalog{driver: storageDriver}
+}
+
+func (sc *storageCatalog) List(ctx context.Context, repos []string, last, prefix string) (int, error) {
+	sc.mu.Lock()
+	names, err := sc.read(ctx)
+	sc.mu.Unlock()
+	if err != nil {
+		return 0, err
+	}
+
+	// The names starting with prefix follow one another.
+	i, _ := slices.BinarySearchFunc(names, prefix, compareCatalog)
+	if last != "" {
+		j, found := slices.BinarySearchFunc(names, last, compareCatalog)
+		if found {
+			j++
+		}
+		i = max(i, j)
+	}
+	n := 0
+	for ; i < len(names) && strings.HasPrefix(names[i], prefix); i++ {
+		if n == len(repos) {
+			return n, nil
+		}
+		repos[n] = names[i]
+		n++
+	}
+	return n, io.EOF
+}
+
+func (sc *storageCatalog) Add(ctx context.Context, repos ...string) error {
+	if len(repos) == 0 {
+		return nil
+	}
+	sc.mu.Lock()
+	defer sc.mu.Unlock()
+	names, err := sc.read(ctx)
+	if err != nil {
+		return err
+	}
+	updated := false
+	for _, repo := range repos {
+		if i, found := slices.BinarySearchFunc(names, repo, compareCatalog); !found {
+			names = slices.Insert(names, i, repo)
+			updated = true
+		}
+	}
+	if !updated {
+		return nil
+	}
+	return sc.write(ctx, names)
+}
+
+func (sc *storageCatalog) Remove(ctx context.Context, repos ...string) error {
+	if len(repos) == 0 {
+		return nil
+	}
+	sc.mu.Lock()
+	defer sc.mu.Unlock()
+	names, err := sc.read(ctx)
+	if err != nil {
+		return err
+	}
+	updated := false
+	for _, repo := range repos {
+		if i, found := slices.BinarySearchFunc(names, repo, compareCatalog); found {
+			names = slices.Delete(names, i, i+1)
+			updated = true
+		}
+	}
+	if !updated {
+		return nil
+	}
+	return sc.write(ctx, names)
+}
+
+func (sc *storageCatalog) read(ctx context.Context) ([]string, error) {
+	indexPath, err := pathFor(catalogIndexPathSpec{})
+	if err != nil {
+		return nil, err
+	}
+	content, err := sc.driver.GetContent(ctx, indexPath)
+	if err != nil {
+		if _, ok := err.(driver.PathNotFoundError); ok {
+			return nil, nil
+		}
+		return nil, err
+	}
+	if len(content) == 0 {
+		return nil, nil
+	}
+	return strings.Split(string(content), "\n"), nil
+}
+
+func (sc *storageCatalog) write(ctx context.Context, names []string) error {
+	indexPath, err := pathFor(catalogIndexPathSpec{})
+	if err != nil {
+		return err
+	}
+	return sc.driver.PutContent(ctx, indexPath, []byte(strings.Join(names, "\n")))
+}
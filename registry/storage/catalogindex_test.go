@@ -0,0 +1,202 @@
+package storage
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"reflect"
+	"sync"
+	"testing"
+
+	"github.com/distribution/distribution/v3"
+	"github.com/distribution/distribution/v3/internal/dcontext"
+	"github.com/distribution/distribution/v3/registry/storage/cache/cachecheck"
+	"github.com/distribution/distribution/v3/registry/storage/driver"
+	"github.com/distribution/distribution/v3/registry/storage/driver/inmemory"
+	v1 "github.com/opencontainers/image-spec/specs-go/v1"
+)
+
+func TestStorageCatalog(t *testing.T) {
+	cachecheck.CheckCatalog(t, NewStorageCatalogProvider(inmemory.New()))
+}
+
+// listCatalog returns the whole catalog of the registry, listed n
+// repositories at a time.
+func listCatalog(t *testing.T, registry distribution.Namespace, n int) []string {
+	t.Helper()
+	var catalog []string
+	last := ""
+	for {
+		repos := make([]string, n)
+		filled, err := registry.Repositories(dcontext.Background(), repos, last)
+		catalog = append(catalog, repos[:filled]...)
+		if err == io.EOF {
+			return catalog
+		}
+		if err != nil {
+			t.Fatalf("unexpected error listing the catalog after %q: %v", last, err)
+		}
+		last = repos[filled-1]
+	}
+}
+
+func TestCatalogIndex(t *testing.T) {
+	d := inmemory.New()
+	registry := createRegistry(t, d, IndexCatalog(NewCatalogIndex(NewStorageCatalogProvider(d))))
+
+	for _, name := range []string{"foo/b", "foo/a", "foo-c", "bar", "foo/a/nested"} {
+		uploadRandomSchema2Image(t, makeRepository(t, registry, name))
+	}
+	expected := []string{"bar", "foo/a", "foo/a/nested", "foo/b", "foo-c"}
+	for _, n := range []int{1, 2, 10} {
+		if catalog := listCatalog(t, registry, n); !reflect.DeepEqual(catalog, expected) {
+			t.Fatalf("unexpected catalog %v listed %d at a time, expected %v", catalog, n, expected)
+		}
+	}
+	// The catalog is listed in the order of the walk of the storage.
+	walked := listCatalog(t, createRegistry(t, d), 10)
+	if !reflect.DeepEqual(walked, expected) {
+		t.Fatalf("unexpected catalog %v walked, expected %v", walked, expected)
+	}
+
+	repos := make([]string, 10)
+	n, err := registry.(distribution.RepositoryPrefixLister).RepositoriesWithPrefix(dcontext.Background(), repos, "foo/a", "foo/")
+	if err != io.EOF || !reflect.DeepEqual(repos[:n], []string{"foo/a/nested", "foo/b"}) {
+		t.Fatalf("unexpected repositories %v listed with a prefix: %v", repos[:n], err)
+	}
+
+	if err := renameRepository(t, registry, "foo/b", "baz"); err != nil {
+		t.Fatal(err)
+	}
+	if err := registry.(distribution.RepositoryRemover).Remove(dcontext.Background(), makeRepository(t, registry, "bar").Named()); err != nil {
+		t.Fatal(err)
+	}
+	expected = []string{"baz", "foo/a", "foo/a/nested", "foo-c"}
+	if catalog := listCatalog(t, registry, 10); !reflect.DeepEqual(catalog, expected) {
+		t.Fatalf("unexpected catalog %v after the rename and the remove, expected %v", catalog, expected)
+	}
+}
+
+func TestCatalogIndexConcurrentPushes(t *testing.T) {
+	ctx := dcontext.Background()
+	d := inmemory.New()
+	index := NewCatalogIndex(NewStorageCatalogProvider(d))
+	registry := createRegistry(t, d, IndexCatalog(index))
+
+	// The repositories pushed to concurrently are all indexed, the updates
+	// of the index being serialized.
+	var expected []string
+	var wg sync.WaitGroup
+	errs := make(chan error, 50)
+	for i := range 50 {
+		name := fmt.Sprintf("repo/%02d", i)
+		expected = append(expected, name)
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			errs <- index.add(ctx, name)
+		}()
+	}
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		if err != nil {
+			t.Fatalf("unexpected error adding a repository: %v", err)
+		}
+	}
+	if catalog := listCatalog(t, registry, 7); !reflect.DeepEqual(catalog, expected) {
+		t.Fatalf("unexpected catalog %v after the concurrent pushes, expected %v", catalog, expected)
+	}
+}
+
+// walkHookDriver calls onWalk once, the first time the walk of the storage
+// reaches a file.
+type walkHookDriver struct {
+	driver.StorageDriver
+	once   sync.Once
+	onWalk func()
+}
+
+func (d *walkHookDriver) Walk(ctx context.Context, path string, f driver.WalkFn, options ...func(*driver.WalkOptions)) error {
+	return d.StorageDriver.Walk(ctx, path, func(fileInfo driver.FileInfo) error {
+		d.once.Do(d.onWalk)
+		return f(fileInfo)
+	}, options...)
+}
+
+func TestCatalogIndexReconcile(t *testing.T) {
+	ctx := dcontext.Background()
+	d := inmemory.New()
+	provider := NewStorageCatalogProvider(d)
+	index := NewCatalogIndex(provider)
+
+	// A repository pushed to before the index was enabled, and one removed
+	// without updating it.
+	uploadRandomSchema2Image(t, makeRepository(t, createRegistry(t, d), "before/index"))
+	if err := provider.Add(ctx, "stale/repo"); err != nil {
+		t.Fatal(err)
+	}
+
+	hooked := &walkHookDriver{StorageDriver: d}
+	registry := createRegistry(t, hooked, IndexCatalog(index))
+	uploadRandomSchema2Image(t, makeRepository(t, registry, "indexed"))
+	// A repository is pushed to while the storage is walked, which the
+	// reconciliation must not remove from the index.
+	hooked.onWalk = func() {
+		uploadRandomSchema2Image(t, makeRepository(t, registry, "during/walk"))
+	}
+
+	reconciliation, err := index.Reconcile(ctx, registry)
+	if err != nil {
+		t.Fatalf("unexpected error reconciling the index: %v", err)
+	}
+	if !reflect.DeepEqual(reconciliation.Removed, []string{"stale/repo"}) {
+		t.Fatalf("unexpected repositories %v removed from the index", reconciliation.Removed)
+	}
+	for _, name := range reconciliation.Added {
+		if name != "before/index" && name != "during/walk" {
+			t.Fatalf("unexpected repository %s added to the index", name)
+		}
+	}
+	expected := []string{"before/index", "during/walk", "indexed"}
+	if catalog := listCatalog(t, registry, 10); !reflect.DeepEqual(catalog, expected) {
+		t.Fatalf("unexpected catalog %v after the reconciliation, expected %v", catalog, expected)
+	}
+
+	// Reconciling again finds no drift.
+	reconciliation, err = index.Reconcile(ctx, registry)
+	if err != nil || len(reconciliation.Added) != 0 || len(reconciliation.Removed) != 0 || reconciliation.Repositories != 3 {
+		t.Fatalf("unexpected reconciliation %+v of an index in sync: %v", reconciliation, err)
+	}
+}
+
+func TestGCPrunesCatalogIndex(t *testing.T) {
+	ctx := dcontext.Background()
+	d := inmemory.New()
+	index := NewCatalogIndex(NewStorageCatalogProvider(d))
+	registry := createRegistry(t, d, IndexCatalog(index))
+
+	for _, name := range []string{"untagged/app", "tagged/app"} {
+		repo := makeRepository(t, registry, name)
+		image := uploadRandomSchema2Image(t, repo)
+		if err := repo.Tags(ctx).Tag(ctx, "latest", v1.Descriptor{Digest: image.manifestDigest}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// The last manifest of the repository is left untagged.
+	if err := makeRepository(t, registry, "untagged/app").Tags(ctx).Untag(ctx, "latest"); err != nil {
+		t.Fatal(err)
+	}
+
+	opts := GCOpts{RemoveUntagged: true, Quiet: true, Catalog: index}
+	if _, err := GarbageCollect(ctx, d, registry, opts); err != nil {
+		t.Fatalf("unexpected error garbage collecting: %v", err)
+	}
+	expected := []string{"tagged/app"}
+	if catalog := listCatalog(t, registry, 10); !reflect.DeepEqual(catalog, expected) {
+		t.Fatalf("unexpected catalog %v after the garbage collection, expected %v", catalog, expected)
+	}
+	if walked := listCatalog(t, createRegistry(t, d), 10); !reflect.DeepEqual(walked, expected) {
+		t.Fatalf("unexpected catalog %v walked after the garbage collection, expected %v", walked, expected)
+	}
+}
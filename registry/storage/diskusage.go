@@ -0,0 +1,204 @@
+package storage
+
+import (
+	"cmp"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/distribution/distribution/v3/registry/storage/driver"
+	"github.com/opencontainers/go-digest"
+)
+
+// DiskUsageOpts configures a measure of the storage used by the repositories.
+type DiskUsageOpts struct {
+	// Quiet silences the progress.
+	Quiet bool
+	// Output is where the progress is printed, the standard output if nil.
+	Output io.Writer
+	// ProgressInterval is the interval at which the progress is printed,
+	// never if zero.
+	ProgressInterval time.Duration
+}
+
+func (opts DiskUsageOpts) emit(format string, a ...any) {
+	if opts.Quiet {
+		return
+	}
+	w := opts.Output
+	if w == nil {
+		w = os.Stdout
+	}
+	fmt.Fprintf(w, format+"\n", a...)
+}
+
+// DiskUsageReport is the storage used by the repositories.
+type DiskUsageReport struct {
+	// Repositories are sorted by exclusive bytes, the largest first.
+	Repositories []RepositoryUsage `json:"repositories"`
+	// Blobs is the number of blobs of the blob store, and Bytes their size.
+	Blobs int   `json:"blobs"`
+	Bytes int64 `json:"bytes"`
+	// UnlinkedBlobs is the number of blobs linked by no repository, which
+	// garbage collection deletes, and UnlinkedBytes their size.
+	UnlinkedBlobs int   `json:"unlinkedBlobs"`
+	UnlinkedBytes int64 `json:"unlinkedBytes"`
+}
+
+// RepositoryUsage is the storage used by a repository.
+type RepositoryUsage struct {
+	Name      string `json:"name"`
+	Tags      int    `json:"tags"`
+	Manifests int    `json:"manifests"`
+	// ExclusiveBytes is the size of the blobs linked only by the repository,
+	// which deleting it would reclaim, and SharedBytes the size of those
+	// linked by other repositories as well.
+	ExclusiveBytes int64 `json:"exclusiveBytes"`
+	SharedBytes    int64 `json:"sharedBytes"`
+}
+
+// blobLinks are the repositories linking a blob, by their index in the
+// report. The others are only set for the shared blobs, so that the index
+// holds a single integer for most blobs.
+type blobLinks struct {
+	first  int32
+	others []int32
+}
+
+// DiskUsage measures the storage used by the repositories, the blobs being
+// the layers, configurations and manifests they link. It walks the links of
+// the repositories once to index the repositories linking each blob, then the
+// blob store once to add up their sizes, keeping a small record per blob in
+// memory. It may be run while the registry serves requests, the content
+// pushed or deleted during the walks being miscounted.
+func DiskUsage(ctx context.Context, storageDriver driver.StorageDriver, opts DiskUsageOpts) (*DiskUsageReport, error) {
+	report := &DiskUsageReport{Repositories: make([]RepositoryUsage, 0)}
+	links, err := indexBlobLinks(ctx, storageDriver, report, opts)
+	if err != nil {
+		return nil, err
+	}
+
+	root, err := pathFor(blobsPathSpec{})
+	if err != nil {
+		return nil, err
+	}
+	printed := time.Now()
+	err = storageDriver.Walk(ctx, root, func(fileInfo driver.FileInfo) error {
+		if fileInfo.IsDir() || path.Base(fileInfo.Path()) != "data" {
+			return nil
+		}
+		dir := path.Dir(fileInfo.Path())
+		dgst := digest.NewDigestFromEncoded(digest.Algorithm(path.Base(path.Dir(path.Dir(dir)))), path.Base(dir))
+		size := fileInfo.Size()
+		report.Blobs++
+		report.Bytes += size
+
+		blob, ok := links[dgst]
+		switch {
+		case !ok:
+			report.UnlinkedBlobs++
+			report.UnlinkedBytes += size
+		case len(blob.others) == 0:
+			report.Repositories[blob.first].ExclusiveBytes += size
+		default:
+			report.Repositories[blob.first].SharedBytes += size
+			for _, other := range blob.others {
+				report.Repositories[other].SharedBytes += size
+			}
+		}
+
+		if now := time.Now(); opts.ProgressInterval > 0 && now.Sub(printed) >= opts.ProgressInterval {
+			printed = now
+			opts.emit("progress: %d blobs measured, %d bytes", report.Blobs, report.Bytes)
+		}
+		return nil
+	})
+	if err != nil && !errors.As(err, new(driver.PathNotFoundError)) {
+		return nil, err
+	}
+
+	slices.SortFunc(report.Repositories, func(a, b RepositoryUsage) int {
+		if c := cmp.Compare(b.ExclusiveBytes, a.ExclusiveBytes); c != 0 {
+			return c
+		}
+		return strings.Compare(a.Name, b.Name)
+	})
+	return report, nil
+}
+
+// indexBlobLinks walks the repositories once, counting their tags and
+// manifests in the report, and returns the repositories linking each blob.
+func indexBlobLinks(ctx context.Context, storageDriver driver.StorageDriver, report *DiskUsageReport, opts DiskUsageOpts) (map[digest.Digest]*blobLinks, error) {
+	root, err := pathFor(repositoriesRootPathSpec{})
+	if err != nil {
+		return nil, err
+	}
+
+	links := make(map[digest.Digest]*blobLinks)
+	repositories := make(map[string]int32)
+	var walked int
+	printed := time.Now()
+	link := func(repo int32, dgst digest.Digest) {
+		walked++
+		blob, ok := links[dgst]
+		switch {
+		case !ok:
+			links[dgst] = &blobLinks{first: repo}
+		case blob.first != repo && !slices.Contains(blob.others, repo):
+			blob.others = append(blob.others, repo)
+		}
+	}
+
+	err = storageDriver.Walk(ctx, root, func(fileInfo driver.FileInfo) error {
+		// The names of the repositories have no component starting with an
+		// underscore, unlike their directories.
+		components := strings.Split(strings.TrimPrefix(fileInfo.Path(), root+"/"), "/")
+		i := slices.IndexFunc(components, func(c string) bool { return strings.HasPrefix(c, "_") })
+		if i <= 0 {
+			return nil
+		}
+		name, rest := strings.Join(components[:i], "/"), components[i:]
+		if fileInfo.IsDir() && (rest[0] == "_uploads" || (len(rest) == 4 && rest[1] == "tags" && rest[3] == "index")) {
+			// Neither the uploads nor the history of the tags are linked.
+			return driver.ErrSkipDir
+		}
+		if fileInfo.IsDir() || rest[len(rest)-1] != "link" {
+			return nil
+		}
+
+		repo, ok := repositories[name]
+		if !ok {
+			repo = int32(len(report.Repositories))
+			repositories[name] = repo
+			report.Repositories = append(report.Repositories, RepositoryUsage{Name: name})
+		}
+		switch {
+		case rest[0] == "_layers" && len(rest) == 4:
+			// _layers/<algorithm>/<hex>/link
+			link(repo, digest.NewDigestFromEncoded(digest.Algorithm(rest[1]), rest[2]))
+		case rest[0] == "_manifests" && len(rest) == 5 && rest[1] == "revisions":
+			// _manifests/revisions/<algorithm>/<hex>/link
+			report.Repositories[repo].Manifests++
+			link(repo, digest.NewDigestFromEncoded(digest.Algorithm(rest[2]), rest[3]))
+		case rest[0] == "_manifests" && len(rest) == 5 && rest[1] == "tags" && rest[3] == "current":
+			// _manifests/tags/<tag>/current/link
+			report.Repositories[repo].Tags++
+		}
+
+		if now := time.Now(); opts.ProgressInterval > 0 && now.Sub(printed) >= opts.ProgressInterval {
+			printed = now
+			opts.emit("progress: %d links of %d repositories indexed, %d blobs", walked, len(report.Repositories), len(links))
+		}
+		return nil
+	})
+	if err != nil && !errors.As(err, new(driver.PathNotFoundError)) {
+		return nil, err
+	}
+	return links, nil
+}
@@ -0,0 +1,112 @@
+package storage
+
+import (
+	"bytes"
+	"context"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/distribution/distribution/v3/registry/storage/driver"
+	"github.com/distribution/distribution/v3/registry/storage/driver/inmemory"
+	"github.com/opencontainers/go-digest"
+)
+
+// putDiskUsageFixture writes the path of spec with the content, failing the
+// test on error.
+func putDiskUsageFixture(t *testing.T, d driver.StorageDriver, spec pathSpec, content []byte) {
+	t.Helper()
+	p, err := pathFor(spec)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := d.PutContent(context.Background(), p, content); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// putDiskUsageBlob stores a blob of the given size, returning its digest.
+func putDiskUsageBlob(t *testing.T, d driver.StorageDriver, size int) digest.Digest {
+	t.Helper()
+	content := bytes.Repeat([]byte{byte(size)}, size)
+	dgst := digest.FromBytes(content)
+	putDiskUsageFixture(t, d, blobDataPathSpec{digest: dgst}, content)
+	return dgst
+}
+
+func TestDiskUsage(t *testing.T) {
+	d := inmemory.New()
+
+	base := putDiskUsageBlob(t, d, 100)
+	shared := putDiskUsageBlob(t, d, 40)
+	appLayer := putDiskUsageBlob(t, d, 30)
+	appManifest := putDiskUsageBlob(t, d, 3)
+	toolsLayer := putDiskUsageBlob(t, d, 20)
+	toolsManifest := putDiskUsageBlob(t, d, 2)
+	putDiskUsageBlob(t, d, 7) // unlinked
+
+	// base is linked by the three repositories, shared by two of them, the
+	// others by a single one.
+	for _, link := range []struct {
+		name  string
+		layer digest.Digest
+	}{
+		{"library/base", base},
+		{"team/app", base},
+		{"team/app", shared},
+		{"team/app", appLayer},
+		{"team/tools", base},
+		{"team/tools", shared},
+		{"team/tools", toolsLayer},
+	} {
+		putDiskUsageFixture(t, d, layerLinkPathSpec{name: link.name, digest: link.layer}, []byte(link.layer))
+	}
+	putDiskUsageFixture(t, d, manifestRevisionLinkPathSpec{name: "team/app", revision: appManifest}, []byte(appManifest))
+	putDiskUsageFixture(t, d, manifestTagCurrentPathSpec{name: "team/app", tag: "latest"}, []byte(appManifest))
+	putDiskUsageFixture(t, d, manifestTagIndexEntryLinkPathSpec{name: "team/app", tag: "latest", revision: appManifest}, []byte(appManifest))
+	putDiskUsageFixture(t, d, manifestTagCurrentPathSpec{name: "team/app", tag: "v1"}, []byte(appManifest))
+	putDiskUsageFixture(t, d, manifestRevisionLinkPathSpec{name: "team/tools", revision: toolsManifest}, []byte(toolsManifest))
+	// The tools manifest is linked by app as well, without a tag.
+	putDiskUsageFixture(t, d, manifestRevisionLinkPathSpec{name: "team/app", revision: toolsManifest}, []byte(toolsManifest))
+	// The uploads are not linked.
+	putDiskUsageFixture(t, d, uploadDataPathSpec{name: "team/app", id: "upload"}, []byte("partial"))
+
+	var progress bytes.Buffer
+	report, err := DiskUsage(context.Background(), d, DiskUsageOpts{Output: &progress, ProgressInterval: time.Nanosecond})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expected := []RepositoryUsage{
+		{Name: "team/app", Tags: 2, Manifests: 2, ExclusiveBytes: 30 + 3, SharedBytes: 100 + 40 + 2},
+		{Name: "team/tools", Tags: 0, Manifests: 1, ExclusiveBytes: 20, SharedBytes: 100 + 40 + 2},
+		{Name: "library/base", Tags: 0, Manifests: 0, ExclusiveBytes: 0, SharedBytes: 100},
+	}
+	if len(report.Repositories) != len(expected) {
+		t.Fatalf("unexpected repositories %+v", report.Repositories)
+	}
+	for i, usage := range expected {
+		if report.Repositories[i] != usage {
+			t.Errorf("repository %d: got %+v, expected %+v", i, report.Repositories[i], usage)
+		}
+	}
+	if report.Blobs != 7 || report.Bytes != 100+40+30+3+20+2+7 {
+		t.Errorf("unexpected blob store usage: %d blobs, %d bytes", report.Blobs, report.Bytes)
+	}
+	if report.UnlinkedBlobs != 1 || report.UnlinkedBytes != 7 {
+		t.Errorf("unexpected unlinked blobs: %d blobs, %d bytes", report.UnlinkedBlobs, report.UnlinkedBytes)
+	}
+	if !strings.Contains(progress.String(), "progress: ") {
+		t.Errorf("expected the progress to be printed, got %q", progress.String())
+	}
+}
+
+func TestDiskUsageEmpty(t *testing.T) {
+	report, err := DiskUsage(context.Background(), inmemory.New(), DiskUsageOpts{Quiet: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(report.Repositories) != 0 || report.Blobs != 0 {
+		t.Fatalf("unexpected report of an empty storage %+v", report)
+	}
+}
@@ -46,39 +46,25 @@ type clientTokenSigner struct {
 type azureClient struct {
 	container string
 	client    *azblob.Client
-	signer    signer
+	// signer is nil if the credentials cannot sign blob URLs
+	signer signer
+	// sas is set if requests are authorized with a SAS token
+	sas *sasTokenSource
 }
 
 func newClient(params *DriverParameters) (*azureClient, error) {
 	switch params.Credentials.Type {
-	case CredentialsTypeClientSecret, CredentialsTypeDefault:
+	case CredentialsTypeClientSecret, CredentialsTypeDefault, CredentialsTypeMSI:
 		return newTokenClient(params)
 	case CredentialsTypeSharedKey:
 		return newSharedKeyCredentialsClient(params)
+	case CredentialsTypeSAS:
+		return newSASClient(params)
 	}
 	return nil, fmt.Errorf("invalid credentials type: %q", params.Credentials.Type)
 }
 
-func newTokenClient(params *DriverParameters) (*azureClient, error) {
-	var (
-		cred azcore.TokenCredential
-		err  error
-	)
-
-	switch params.Credentials.Type {
-	case CredentialsTypeClientSecret:
-		creds := &params.Credentials
-		cred, err = azidentity.NewClientSecretCredential(creds.TenantID, creds.ClientID, creds.Secret, nil)
-		if err != nil {
-			return nil, fmt.Errorf("client secret credentials: %v", err)
-		}
-	default:
-		cred, err = azidentity.NewDefaultAzureCredential(nil)
-		if err != nil {
-			return nil, fmt.Errorf("default credentials: %v", err)
-		}
-	}
-
+func newClientOptions(params *DriverParameters) *azblob.ClientOptions {
 	azBlobOpts := &azblob.ClientOptions{
 		ClientOptions: azcore.ClientOptions{
 			PerRetryPolicies: []policy.Policy{newRetryNotificationPolicy()},
@@ -101,6 +87,42 @@ func newTokenClient(params *DriverParameters) (*azureClient, error) {
 			Transport: httpTransport,
 		}
 	}
+	return azBlobOpts
+}
+
+func newTokenClient(params *DriverParameters) (*azureClient, error) {
+	var (
+		cred azcore.TokenCredential
+		err  error
+	)
+
+	switch params.Credentials.Type {
+	case CredentialsTypeClientSecret:
+		creds := &params.Credentials
+		cred, err = azidentity.NewClientSecretCredential(creds.TenantID, creds.ClientID, creds.Secret, nil)
+		if err != nil {
+			return nil, fmt.Errorf("client secret credentials: %v", err)
+		}
+	case CredentialsTypeMSI:
+		if params.Credentials.ClientID != "" {
+			// a user-assigned managed identity
+			cred, err = azidentity.NewManagedIdentityCredential(&azidentity.ManagedIdentityCredentialOptions{
+				ID: azidentity.ClientID(params.Credentials.ClientID),
+			})
+			if err != nil {
+				return nil, fmt.Errorf("managed identity credentials: %v", err)
+			}
+			break
+		}
+		fallthrough
+	default:
+		cred, err = azidentity.NewDefaultAzureCredential(nil)
+		if err != nil {
+			return nil, fmt.Errorf("default credentials: %v", err)
+		}
+	}
+
+	azBlobOpts := newClientOptions(params)
 	client, err := azblob.NewClient(params.ServiceURL, cred, azBlobOpts)
 	if err != nil {
 		return nil, fmt.Errorf("new azure token client: %v", err)
@@ -121,28 +143,7 @@ func newSharedKeyCredentialsClient(params *DriverParameters) (*azureClient, erro
 	if err != nil {
 		return nil, fmt.Errorf("shared key credentials: %v", err)
 	}
-	azBlobOpts := &azblob.ClientOptions{
-		ClientOptions: azcore.ClientOptions{
-			PerRetryPolicies: []policy.Policy{newRetryNotificationPolicy()},
-			Logging: policy.LogOptions{
-				AllowedHeaders: []string{
-					"x-ms-error-code",
-					"Retry-After",
-					"Retry-After-Ms",
-					"If-Match",
-					"x-ms-blob-condition-appendpos",
-				},
-				AllowedQueryParams: []string{"comp"},
-			},
-		},
-	}
-	if params.SkipVerify {
-		httpTransport := http.DefaultTransport.(*http.Transport).Clone()
-		httpTransport.TLSClientConfig = &tls.Config{InsecureSkipVerify: true}
-		azBlobOpts.Transport = &http.Client{
-			Transport: httpTransport,
-		}
-	}
+	azBlobOpts := newClientOptions(params)
 	client, err := azblob.NewClientWithSharedKeyCredential(params.ServiceURL, cred, azBlobOpts)
 	if err != nil {
 		return nil, fmt.Errorf("new azure client with shared credentials: %v", err)
@@ -157,11 +158,44 @@ func newSharedKeyCredentialsClient(params *DriverParameters) (*azureClient, erro
 	}, nil
 }
 
+func newSASClient(params *DriverParameters) (*azureClient, error) {
+	creds := &params.Credentials
+	if creds.SASToken == "" && creds.SASTokenFile == "" {
+		return nil, fmt.Errorf("sas credentials: one of sastoken or sastokenfile must be provided")
+	}
+	if creds.SASToken != "" && creds.SASTokenFile != "" {
+		return nil, fmt.Errorf("sas credentials: only one of sastoken or sastokenfile may be provided")
+	}
+	source, err := newSASTokenSource(creds.SASToken, creds.SASTokenFile)
+	if err != nil {
+		return nil, fmt.Errorf("sas credentials: %v", err)
+	}
+
+	azBlobOpts := newClientOptions(params)
+	azBlobOpts.PerCallPolicies = append(azBlobOpts.PerCallPolicies, &sasPolicy{source: source})
+	client, err := azblob.NewClientWithNoCredential(params.ServiceURL, azBlobOpts)
+	if err != nil {
+		return nil, fmt.Errorf("new azure client with sas credentials: %v", err)
+	}
+
+	return &azureClient{
+		container: params.Container,
+		client:    client,
+		sas:       source,
+	}, nil
+}
+
 func (a *azureClient) ContainerClient() *container.Client {
 	return a.client.ServiceClient().NewContainerClient(a.container)
 }
 
+// SignBlobURL returns a read-only SAS URL for blobURL, or an empty string if
+// the credentials cannot sign URLs, in which case blobs are served through
+// the registry.
 func (a *azureClient) SignBlobURL(ctx context.Context, blobURL string, expires time.Time) (string, error) {
+	if a.signer == nil {
+		return "", nil
+	}
 	urlParts, err := sas.ParseURL(blobURL)
 	if err != nil {
 		return "", err
@@ -182,6 +216,15 @@ func (a *azureClient) SignBlobURL(ctx context.Context, blobURL string, expires t
 	return urlParts.String(), nil
 }
 
+// CopySourceURL returns blobURL authorized for use as the source of a copy
+// within the storage account.
+func (a *azureClient) CopySourceURL(blobURL string) (string, error) {
+	if a.sas == nil {
+		return blobURL, nil
+	}
+	return a.sas.AuthorizeURL(blobURL)
+}
+
 func (s *sharedKeySigner) Sign(ctx context.Context, signatureValues *sas.BlobSignatureValues) (sas.QueryParameters, error) {
 	return signatureValues.SignWithSharedKey(s.cred)
 }
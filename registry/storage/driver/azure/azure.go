@@ -58,6 +58,9 @@ type driver struct {
 	rootDirectory string
 	maxRetries    int
 	retryDelay    time.Duration
+
+	blockSize         int64
+	uploadConcurrency int
 }
 
 type baseEmbed struct {
@@ -89,6 +92,9 @@ func New(ctx context.Context, params *DriverParameters) (*Driver, error) {
 		rootDirectory: params.RootDirectory,
 		maxRetries:    params.MaxRetries,
 		retryDelay:    retryDelay,
+
+		blockSize:         params.BlockSize,
+		uploadConcurrency: params.UploadConcurrency,
 	}
 	return &Driver{
 		baseEmbed: baseEmbed{
@@ -214,6 +220,7 @@ func (d *driver) Reader(ctx context.Context, path string, offset int64) (io.Read
 func (d *driver) Writer(ctx context.Context, path string, appendMode bool) (storagedriver.FileWriter, error) {
 	blobName := d.blobName(path)
 	blobRef := d.client.NewBlobClient(blobName)
+	blockBlobRef := d.client.NewBlockBlobClient(blobName)
 
 	props, err := blobRef.GetProperties(ctx, nil)
 	blobExists := true
@@ -223,37 +230,37 @@ func (d *driver) Writer(ctx context.Context, path string, appendMode bool) (stor
 		}
 		blobExists = false
 	}
-	eTag := props.ETag
 
-	var size int64
-	if blobExists {
-		if appendMode {
-			if props.ContentLength == nil {
-				return nil, fmt.Errorf("missing ContentLength: %s", blobName)
-			}
-			size = *props.ContentLength
-		} else {
+	if !appendMode {
+		if blobExists {
 			if _, err := blobRef.Delete(ctx, nil); err != nil && !is404(err) {
 				return nil, fmt.Errorf("deleting existing blob before write: %w", err)
 			}
-			res, err := d.client.NewAppendBlobClient(blobName).Create(ctx, nil)
-			if err != nil {
-				return nil, fmt.Errorf("creating new append blob: %w", err)
-			}
-			eTag = res.ETag
 		}
-	} else {
-		if appendMode {
-			return nil, storagedriver.PathNotFoundError{Path: path, DriverName: driverName}
-		}
-		res, err := d.client.NewAppendBlobClient(blobName).Create(ctx, nil)
-		if err != nil {
-			return nil, fmt.Errorf("creating new append blob: %w", err)
-		}
-		eTag = res.ETag
+		return d.newBlockBlobWriter(ctx, blockBlobRef, blobName, nil, 0, nil), nil
+	}
+	if !blobExists {
+		return nil, storagedriver.PathNotFoundError{Path: path, DriverName: driverName}
 	}
+	if props.ContentLength == nil {
+		return nil, fmt.Errorf("missing ContentLength: %s", blobName)
+	}
+	size := *props.ContentLength
 
-	return d.newWriter(ctx, blobName, size, eTag), nil
+	// The blobs written before the writes staged blocks are append blobs,
+	// which are still appended to.
+	if props.BlobType != nil && *props.BlobType == blob.BlobTypeAppendBlob {
+		return d.newWriter(ctx, blobName, size, props.ETag), nil
+	}
+	blocks, err := blockBlobRef.GetBlockList(ctx, blockblob.BlockListTypeCommitted, nil)
+	if err != nil {
+		return nil, fmt.Errorf("getting the block list of %s: %w", blobName, err)
+	}
+	var committed []string
+	for _, block := range blocks.CommittedBlocks {
+		committed = append(committed, *block.Name)
+	}
+	return d.newBlockBlobWriter(ctx, blockBlobRef, blobName, committed, size, props.ETag), nil
 }
 
 // Stat retrieves the FileInfo for the given path, including the current size
@@ -340,7 +347,10 @@ func (d *driver) List(ctx context.Context, path string) ([]string, error) {
 // object.
 func (d *driver) Move(ctx context.Context, sourcePath string, destPath string) error {
 	srcBlobRef := d.client.NewBlobClient(d.blobName(sourcePath))
-	sourceBlobURL := srcBlobRef.URL()
+	sourceBlobURL, err := d.azClient.CopySourceURL(srcBlobRef.URL())
+	if err != nil {
+		return err
+	}
 
 	destBlobRef := d.client.NewBlockBlobClient(d.blobName(destPath))
 	resp, err := destBlobRef.StartCopyFromURL(ctx, sourceBlobURL, nil)
@@ -2,6 +2,8 @@ package azure
 
 import (
 	"context"
+	"fmt"
+	"maps"
 	"math/rand"
 	"os"
 	"strconv"
@@ -16,6 +18,8 @@ const (
 	envCredentialsType = "AZURE_STORAGE_CREDENTIALS_TYPE"
 	envAccountName     = "AZURE_STORAGE_ACCOUNT_NAME"
 	envAccountKey      = "AZURE_STORAGE_ACCOUNT_KEY"
+	envSASToken        = "AZURE_STORAGE_SAS_TOKEN"
+	envClientID        = "AZURE_STORAGE_CLIENT_ID"
 	envContainer       = "AZURE_STORAGE_CONTAINER"
 	envServiceURL      = "AZURE_SERVICE_URL"
 	envRootDirectory   = "AZURE_ROOT_DIRECTORY"
@@ -24,13 +28,18 @@ const (
 
 var (
 	azureDriverConstructor func() (storagedriver.StorageDriver, error)
-	skipCheck              func(tb testing.TB)
+	// azureDriverWithParameters constructs a driver with the parameters set
+	// in addition to the parameters of the environment.
+	azureDriverWithParameters func(extra map[string]any) (storagedriver.StorageDriver, error)
+	skipCheck                 func(tb testing.TB)
 )
 
 func init() {
 	var (
 		accountName     string
 		accountKey      string
+		sasToken        string
+		clientID        string
 		container       string
 		serviceURL      string
 		rootDirectory   string
@@ -45,6 +54,8 @@ func init() {
 	}{
 		{envAccountName, &accountName, false},
 		{envAccountKey, &accountKey, true},
+		{envSASToken, &sasToken, true},
+		{envClientID, &clientID, true},
 		{envContainer, &container, true},
 		{envServiceURL, &serviceURL, false},
 		{envRootDirectory, &rootDirectory, true},
@@ -67,7 +78,7 @@ func init() {
 		skipVerifyBool = false
 	}
 
-	azureDriverConstructor = func() (storagedriver.StorageDriver, error) {
+	azureDriverWithParameters = func(extra map[string]any) (storagedriver.StorageDriver, error) {
 		parameters := map[string]any{
 			"container":     container,
 			"accountname":   accountName,
@@ -75,16 +86,22 @@ func init() {
 			"serviceurl":    serviceURL,
 			"rootdirectory": rootDirectory,
 			"credentials": map[string]any{
-				"type": credentialsType,
+				"type":     credentialsType,
+				"sastoken": sasToken,
+				"clientid": clientID,
 			},
 			"skipverify": skipVerifyBool,
 		}
+		maps.Copy(parameters, extra)
 		params, err := NewParameters(parameters)
 		if err != nil {
 			return nil, err
 		}
 		return New(context.Background(), params)
 	}
+	azureDriverConstructor = func() (storagedriver.StorageDriver, error) {
+		return azureDriverWithParameters(nil)
+	}
 
 	// Skip Azure storage driver tests if environment variable parameters are not provided
 	skipCheck = func(tb testing.TB) {
@@ -110,6 +127,50 @@ func BenchmarkAzureDriverSuite(b *testing.B) {
 	testsuites.BenchDriver(b, azureDriverConstructor)
 }
 
+// BenchmarkAzureWriter writes a blob with the block sizes and the upload
+// concurrencies, such as against Azurite.
+func BenchmarkAzureWriter(b *testing.B) {
+	skipCheck(b)
+	const size = 128 << 20
+	contents := []byte(randStringRunes(size))
+
+	for _, blockSize := range []int{minBlockSize, defaultBlockSize, 32 << 20} {
+		for _, concurrency := range []int{1, defaultUploadConcurrency, 16} {
+			b.Run(fmt.Sprintf("blocksize=%dMiB/uploadconcurrency=%d", blockSize>>20, concurrency), func(b *testing.B) {
+				driver, err := azureDriverWithParameters(map[string]any{
+					"blocksize":         blockSize,
+					"uploadconcurrency": concurrency,
+				})
+				if err != nil {
+					b.Fatalf("unexpected error creating azure driver: %v", err)
+				}
+				ctx := context.Background()
+				path := "/bench/" + randStringRunes(16)
+				// nolint:errcheck
+				defer driver.Delete(ctx, path)
+
+				b.SetBytes(size)
+				b.ResetTimer()
+				for range b.N {
+					writer, err := driver.Writer(ctx, path, false)
+					if err != nil {
+						b.Fatal(err)
+					}
+					if _, err := writer.Write(contents); err != nil {
+						b.Fatal(err)
+					}
+					if err := writer.Commit(ctx); err != nil {
+						b.Fatal(err)
+					}
+					if err := writer.Close(); err != nil {
+						b.Fatal(err)
+					}
+				}
+			})
+		}
+	}
+}
+
 var letterRunes = []rune("abcdefghijklmnopqrstuvwxyzABCDEFGHIJKLMNOPQRSTUVWXYZ")
 
 func randStringRunes(n int) string {
@@ -178,6 +239,9 @@ func TestParamParsing(t *testing.T) {
 	expectErrors := []map[string]any{
 		{},
 		{"accountname": "acc1"},
+		{"accountname": "acc1", "container": "c1", "blocksize": 1024},
+		{"accountname": "acc1", "container": "c1", "uploadconcurrency": -1},
+		{"accountname": "acc1", "container": "c1", "uploadconcurrency": maxUploadConcurrency + 1},
 	}
 	for _, parameters := range expectErrors {
 		if _, err := NewParameters(parameters); err == nil {
@@ -185,26 +249,37 @@ func TestParamParsing(t *testing.T) {
 		}
 	}
 	input := []map[string]any{
-		{"accountname": "acc1", "accountkey": "k1", "container": "c1", "max_retries": 1, "retry_delay": "10ms"},
+		{"accountname": "acc1", "accountkey": "k1", "container": "c1", "max_retries": 1, "retry_delay": "10ms", "blocksize": 4 << 20, "uploadconcurrency": 16},
 		{"accountname": "acc1", "container": "c1", "credentials": map[string]any{"type": "default"}},
 		{"accountname": "acc1", "container": "c1", "credentials": map[string]any{"type": "client_secret", "clientid": "c1", "tenantid": "t1", "secret": "s1"}},
+		{"accountname": "acc1", "container": "c1", "credentials": map[string]any{"type": "sas", "sastokenfile": "/run/secrets/sas"}},
 	}
 	expecteds := []DriverParameters{
 		{
 			Container: "c1", AccountName: "acc1", AccountKey: "k1",
 			Realm: "core.windows.net", ServiceURL: "https://acc1.blob.core.windows.net",
 			MaxRetries: 1, RetryDelay: "10ms",
+			BlockSize: 4 << 20, UploadConcurrency: 16,
 		},
 		{
 			Container: "c1", AccountName: "acc1", Credentials: Credentials{Type: "default"},
 			Realm: "core.windows.net", ServiceURL: "https://acc1.blob.core.windows.net",
 			MaxRetries: 5, RetryDelay: "100ms",
+			BlockSize: defaultBlockSize, UploadConcurrency: defaultUploadConcurrency,
 		},
 		{
 			Container: "c1", AccountName: "acc1",
 			Credentials: Credentials{Type: "client_secret", ClientID: "c1", TenantID: "t1", Secret: "s1"},
 			Realm:       "core.windows.net", ServiceURL: "https://acc1.blob.core.windows.net",
 			MaxRetries: 5, RetryDelay: "100ms",
+			BlockSize: defaultBlockSize, UploadConcurrency: defaultUploadConcurrency,
+		},
+		{
+			Container: "c1", AccountName: "acc1",
+			Credentials: Credentials{Type: "sas", SASTokenFile: "/run/secrets/sas"},
+			Realm:       "core.windows.net", ServiceURL: "https://acc1.blob.core.windows.net",
+			MaxRetries: 5, RetryDelay: "100ms",
+			BlockSize: defaultBlockSize, UploadConcurrency: defaultUploadConcurrency,
 		},
 	}
 	for i, expected := range expecteds {
@@ -0,0 +1,255 @@
+package azure
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"sync"
+
+	"github.com/Azure/azure-sdk-for-go/sdk/azcore"
+	"github.com/Azure/azure-sdk-for-go/sdk/azcore/streaming"
+	"github.com/Azure/azure-sdk-for-go/sdk/storage/azblob/blob"
+	"github.com/Azure/azure-sdk-for-go/sdk/storage/azblob/blockblob"
+
+	storagedriver "github.com/distribution/distribution/v3/registry/storage/driver"
+)
+
+// blocksPerDoubling is the number of blocks after which the size of the
+// blocks of a blob of unknown size doubles, so that a blob of up to about a
+// hundred terabytes fits in the blocks of a block blob.
+const blocksPerDoubling = blockblob.MaxBlocks / 20
+
+// blockSize returns the size of the block at index of a blob, of at least
+// minSize: the size doubles every blocksPerDoubling blocks, and is large
+// enough for the remaining bytes expected, if known, to fit in half of the
+// blocks left, keeping the other half for the bytes appended later. It is
+// rounded up to a mebibyte, up to the maximum size of a block.
+func blockSize(minSize int64, index int, remaining int64) int64 {
+	size := minSize << min(index/blocksPerDoubling, 32)
+	if left := int64(blockblob.MaxBlocks-index) / 2; remaining > 0 && left > 0 {
+		size = max(size, (remaining+left-1)/left)
+	}
+	size = (size + minBlockSize - 1) / minBlockSize * minBlockSize
+	return min(size, blockblob.MaxStageBlockBytes)
+}
+
+// blockStager stages and commits the blocks of a block blob.
+type blockStager interface {
+	StageBlock(ctx context.Context, base64BlockID string, body io.ReadSeekCloser, options *blockblob.StageBlockOptions) (blockblob.StageBlockResponse, error)
+	CommitBlockList(ctx context.Context, base64BlockIDs []string, options *blockblob.CommitBlockListOptions) (blockblob.CommitBlockListResponse, error)
+}
+
+var _ storagedriver.FileWriter = &blockBlobWriter{}
+
+// blockBlobWriter writes a block blob, staging up to concurrency blocks at
+// once, so that a writer holds at most concurrency blocks and the one it
+// fills in memory. Close and Commit commit the blocks staged after the blocks
+// of the blob, which an append mode writer resumes from.
+type blockBlobWriter struct {
+	ctx         context.Context
+	driver      *driver
+	stager      blockStager
+	path        string
+	minSize     int64
+	concurrency chan struct{}
+
+	// session prefixes the IDs of the blocks staged by the writer, which
+	// all have the same length.
+	session   string
+	committed []string
+	staged    []string
+	eTag      *azcore.ETag
+	size      int64
+	// expected is the number of bytes the writer is expected to receive,
+	// zero if unknown.
+	expected int64
+	written  int64
+	// buf holds the bytes of the block filled, up to limit.
+	buf   []byte
+	limit int
+
+	pending sync.WaitGroup
+	mu      sync.Mutex
+	err     error
+
+	closed      bool
+	isCommitted bool
+	cancelled   bool
+}
+
+func (d *driver) newBlockBlobWriter(ctx context.Context, stager blockStager, path string, committed []string, size int64, eTag *azcore.ETag) *blockBlobWriter {
+	session := make([]byte, 8)
+	_, _ = rand.Read(session)
+	expected, _ := storagedriver.SizeHint(ctx)
+	return &blockBlobWriter{
+		ctx:         ctx,
+		driver:      d,
+		stager:      stager,
+		path:        path,
+		minSize:     d.blockSize,
+		concurrency: make(chan struct{}, d.uploadConcurrency),
+		session:     hex.EncodeToString(session),
+		committed:   committed,
+		eTag:        eTag,
+		size:        size,
+		expected:    expected,
+	}
+}
+
+// blockID returns the ID of the block at index of the blob.
+func (w *blockBlobWriter) blockID(index int) string {
+	return base64.StdEncoding.EncodeToString([]byte(fmt.Sprintf("%s-%08d", w.session, index)))
+}
+
+// nextBlockSize returns the size of the next block the writer stages.
+func (w *blockBlobWriter) nextBlockSize() int64 {
+	return blockSize(w.minSize, len(w.committed)+len(w.staged), max(w.expected-w.written, 0))
+}
+
+func (w *blockBlobWriter) Write(p []byte) (int, error) {
+	if w.closed {
+		return 0, fmt.Errorf("already closed")
+	} else if w.isCommitted {
+		return 0, fmt.Errorf("already committed")
+	} else if w.cancelled {
+		return 0, fmt.Errorf("already cancelled")
+	}
+
+	n := 0
+	for n < len(p) {
+		if err := w.stageErr(); err != nil {
+			return n, err
+		}
+		if len(w.buf) == 0 {
+			w.limit = int(w.nextBlockSize())
+		}
+		chunk := min(w.limit-len(w.buf), len(p)-n)
+		w.buf = append(w.buf, p[n:n+chunk]...)
+		n += chunk
+		w.size += int64(chunk)
+		w.written += int64(chunk)
+		if len(w.buf) == w.limit {
+			if err := w.stage(); err != nil {
+				return n, err
+			}
+		}
+	}
+	return n, nil
+}
+
+// stage stages the block of the buffer in the background, once one of the
+// concurrency slots is free.
+func (w *blockBlobWriter) stage() error {
+	index := len(w.committed) + len(w.staged)
+	if index >= blockblob.MaxBlocks {
+		return fmt.Errorf("blob %s exceeds the %d blocks of a block blob", w.path, blockblob.MaxBlocks)
+	}
+	id := w.blockID(index)
+	w.staged = append(w.staged, id)
+	block := w.buf
+	w.buf = nil
+
+	select {
+	case w.concurrency <- struct{}{}:
+	case <-w.ctx.Done():
+		return w.ctx.Err()
+	}
+	w.pending.Add(1)
+	go func() {
+		defer func() {
+			<-w.concurrency
+			w.pending.Done()
+		}()
+		if _, err := w.stager.StageBlock(w.ctx, id, streaming.NopCloser(bytes.NewReader(block)), nil); err != nil {
+			w.mu.Lock()
+			if w.err == nil {
+				w.err = fmt.Errorf("staging block of %s: %w", w.path, err)
+			}
+			w.mu.Unlock()
+		}
+	}()
+	return nil
+}
+
+func (w *blockBlobWriter) stageErr() error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	return w.err
+}
+
+// commit stages the last block, waits for the blocks staged and commits them
+// after the blocks of the blob.
+func (w *blockBlobWriter) commit() error {
+	if len(w.buf) > 0 {
+		if err := w.stage(); err != nil {
+			return err
+		}
+	}
+	w.pending.Wait()
+	if err := w.stageErr(); err != nil {
+		return err
+	}
+
+	blocks := append(w.committed[:len(w.committed):len(w.committed)], w.staged...)
+	var options *blockblob.CommitBlockListOptions
+	if w.eTag != nil {
+		options = &blockblob.CommitBlockListOptions{
+			AccessConditions: &blob.AccessConditions{
+				ModifiedAccessConditions: &blob.ModifiedAccessConditions{IfMatch: w.eTag},
+			},
+		}
+	}
+	resp, err := w.stager.CommitBlockList(w.ctx, blocks, options)
+	if err != nil {
+		return fmt.Errorf("committing the blocks of %s: %w", w.path, err)
+	}
+	w.committed, w.staged, w.eTag = blocks, nil, resp.ETag
+	return nil
+}
+
+func (w *blockBlobWriter) Size() int64 {
+	return w.size
+}
+
+func (w *blockBlobWriter) Close() error {
+	if w.closed {
+		return fmt.Errorf("already closed")
+	}
+	w.closed = true
+	if w.isCommitted || w.cancelled {
+		return nil
+	}
+	return w.commit()
+}
+
+func (w *blockBlobWriter) Cancel(ctx context.Context) error {
+	if w.closed {
+		return fmt.Errorf("already closed")
+	} else if w.isCommitted {
+		return fmt.Errorf("already committed")
+	}
+	w.cancelled = true
+	w.pending.Wait()
+	_, err := w.driver.client.NewBlobClient(w.path).Delete(ctx, nil)
+	if err != nil && is404(err) {
+		return nil
+	}
+	return err
+}
+
+// Commit succeeds once the block list of the blob is committed.
+func (w *blockBlobWriter) Commit(ctx context.Context) error {
+	if w.closed {
+		return fmt.Errorf("already closed")
+	} else if w.isCommitted {
+		return fmt.Errorf("already committed")
+	} else if w.cancelled {
+		return fmt.Errorf("already cancelled")
+	}
+	w.isCommitted = true
+	return w.commit()
+}
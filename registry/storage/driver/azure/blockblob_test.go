@@ -0,0 +1,247 @@
+package azure
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"slices"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/Azure/azure-sdk-for-go/sdk/azcore"
+	"github.com/Azure/azure-sdk-for-go/sdk/storage/azblob/blockblob"
+)
+
+const (
+	mebibyte = 1 << 20
+	tebibyte = 1 << 40
+)
+
+// fakeStager stages the blocks in memory, recording the concurrent stages
+// and the block lists committed.
+type fakeStager struct {
+	mu        sync.Mutex
+	blocks    map[string][]byte
+	inFlight  int
+	maxFlight int
+	commits   [][]string
+	ifMatch   []*azcore.ETag
+	commitErr error
+}
+
+func newFakeStager() *fakeStager {
+	return &fakeStager{blocks: map[string][]byte{}}
+}
+
+func (s *fakeStager) StageBlock(ctx context.Context, id string, body io.ReadSeekCloser, options *blockblob.StageBlockOptions) (blockblob.StageBlockResponse, error) {
+	s.mu.Lock()
+	s.inFlight++
+	s.maxFlight = max(s.maxFlight, s.inFlight)
+	s.mu.Unlock()
+
+	time.Sleep(10 * time.Millisecond)
+	data, err := io.ReadAll(body)
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.inFlight--
+	s.blocks[id] = data
+	return blockblob.StageBlockResponse{}, err
+}
+
+func (s *fakeStager) CommitBlockList(ctx context.Context, ids []string, options *blockblob.CommitBlockListOptions) (blockblob.CommitBlockListResponse, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.commitErr != nil {
+		return blockblob.CommitBlockListResponse{}, s.commitErr
+	}
+	var ifMatch *azcore.ETag
+	if options != nil {
+		ifMatch = options.AccessConditions.ModifiedAccessConditions.IfMatch
+	}
+	s.commits = append(s.commits, ids)
+	s.ifMatch = append(s.ifMatch, ifMatch)
+	eTag := azcore.ETag(fmt.Sprintf("commit-%d", len(s.commits)))
+	return blockblob.CommitBlockListResponse{ETag: &eTag}, nil
+}
+
+// content returns the content of the blob committed last.
+func (s *fakeStager) content() []byte {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var content []byte
+	for _, id := range s.commits[len(s.commits)-1] {
+		content = append(content, s.blocks[id]...)
+	}
+	return content
+}
+
+func TestBlockBlobWriterCommit(t *testing.T) {
+	ctx := context.Background()
+	d := &driver{blockSize: minBlockSize, uploadConcurrency: 2}
+	stager := newFakeStager()
+	w := d.newBlockBlobWriter(ctx, stager, "blob", nil, 0, nil)
+
+	contents := bytes.Repeat([]byte("0123456789abcdef"), 11*mebibyte/32)
+	for chunk := range slices.Chunk(contents, 100*1024) {
+		if _, err := w.Write(chunk); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if len(stager.commits) != 0 {
+		t.Fatal("expected no block list committed before the commit")
+	}
+	if err := w.Commit(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	if w.Size() != int64(len(contents)) {
+		t.Fatalf("expected size %d, got %d", len(contents), w.Size())
+	}
+	if len(stager.commits) != 1 || len(stager.commits[0]) != 6 {
+		t.Fatalf("expected one block list of 6 blocks committed, got %v", stager.commits)
+	}
+	if !bytes.Equal(stager.content(), contents) {
+		t.Fatal("the blocks committed do not match the contents written")
+	}
+	if stager.maxFlight > 2 {
+		t.Fatalf("expected at most 2 blocks staged concurrently, got %d", stager.maxFlight)
+	}
+	// The IDs of the blocks of a blob must all have the same length.
+	for _, id := range stager.commits[0] {
+		if len(id) != len(stager.commits[0][0]) {
+			t.Fatalf("block IDs of different lengths %q", stager.commits[0])
+		}
+	}
+}
+
+func TestBlockBlobWriterCommitFailure(t *testing.T) {
+	ctx := context.Background()
+	d := &driver{blockSize: minBlockSize, uploadConcurrency: 2}
+	stager := newFakeStager()
+	stager.commitErr = errors.New("conflict")
+	w := d.newBlockBlobWriter(ctx, stager, "blob", nil, 0, nil)
+
+	if _, err := w.Write([]byte("layer")); err != nil {
+		t.Fatal(err)
+	}
+	if err := w.Commit(ctx); !errors.Is(err, stager.commitErr) {
+		t.Fatalf("expected the commit to fail with the block list, got %v", err)
+	}
+}
+
+func TestBlockBlobWriterAppend(t *testing.T) {
+	ctx := context.Background()
+	d := &driver{blockSize: minBlockSize, uploadConcurrency: 2}
+	stager := newFakeStager()
+	w := d.newBlockBlobWriter(ctx, stager, "blob", nil, 0, nil)
+	if _, err := w.Write([]byte("first")); err != nil {
+		t.Fatal(err)
+	}
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	// The blocks of the blob are committed again, before the blocks appended,
+	// if the blob was not modified.
+	committed := stager.commits[0]
+	eTag := azcore.ETag("commit-1")
+	w = d.newBlockBlobWriter(ctx, stager, "blob", committed, w.Size(), &eTag)
+	if _, err := w.Write([]byte(" second")); err != nil {
+		t.Fatal(err)
+	}
+	if err := w.Commit(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if got := string(stager.content()); got != "first second" {
+		t.Fatalf("unexpected content %q", got)
+	}
+	if w.Size() != int64(len("first second")) {
+		t.Fatalf("unexpected size %d", w.Size())
+	}
+	if stager.ifMatch[1] == nil || *stager.ifMatch[1] != eTag {
+		t.Fatalf("expected the commit to match %s, got %v", eTag, stager.ifMatch[1])
+	}
+}
+
+func TestBlockBlobWriterBlockLimit(t *testing.T) {
+	ctx := context.Background()
+	d := &driver{blockSize: minBlockSize, uploadConcurrency: 2}
+	committed := make([]string, blockblob.MaxBlocks-1)
+	for i := range committed {
+		committed[i] = fmt.Sprintf("block-%08d", i)
+	}
+
+	// The last block of a block blob can be appended, but not the next one.
+	stager := newFakeStager()
+	w := d.newBlockBlobWriter(ctx, stager, "blob", committed, 0, nil)
+	if _, err := w.Write([]byte("last")); err != nil {
+		t.Fatal(err)
+	}
+	if err := w.Commit(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if len(stager.commits[0]) != blockblob.MaxBlocks {
+		t.Fatalf("expected %d blocks, got %d", blockblob.MaxBlocks, len(stager.commits[0]))
+	}
+
+	w = d.newBlockBlobWriter(ctx, stager, "blob", stager.commits[0], 0, nil)
+	if _, err := w.Write([]byte("more")); err != nil {
+		t.Fatal(err)
+	}
+	if err := w.Commit(ctx); err == nil {
+		t.Fatal("expected an error appending a block past the limit")
+	}
+	if len(stager.commits) != 1 {
+		t.Fatal("expected no block list committed past the limit")
+	}
+}
+
+// plannedBlocks returns the number of blocks of a stream of size bytes, of
+// which hint bytes are expected, appended to a blob of committed blocks.
+func plannedBlocks(minSize int64, committed int, size, hint int64) int {
+	index := committed
+	for written := int64(0); written < size; index++ {
+		written += blockSize(minSize, index, max(hint-written, 0))
+	}
+	return index - committed
+}
+
+func TestBlockSizeSyntheticStream(t *testing.T) {
+	for _, tc := range []struct {
+		name      string
+		minSize   int64
+		committed int
+		size      int64
+		hint      int64
+	}{
+		{name: "small", minSize: defaultBlockSize, size: 100 * mebibyte},
+		{name: "unknown size", minSize: minBlockSize, size: 64 * tebibyte},
+		{name: "unknown size by default", minSize: defaultBlockSize, size: 100 * tebibyte},
+		{name: "hint", minSize: minBlockSize, size: 150 * tebibyte, hint: 150 * tebibyte},
+		{name: "hint appended", minSize: minBlockSize, committed: blockblob.MaxBlocks - 1000, size: tebibyte, hint: tebibyte},
+		{name: "hint short", minSize: minBlockSize, size: 64 * tebibyte, hint: tebibyte},
+	} {
+		blocks := plannedBlocks(tc.minSize, tc.committed, tc.size, tc.hint)
+		if tc.committed+blocks > blockblob.MaxBlocks {
+			t.Errorf("%s: %d bytes take %d blocks after %d, more than %d", tc.name, tc.size, blocks, tc.committed, blockblob.MaxBlocks)
+		}
+	}
+
+	// The blocks of the blobs of a known size are as small as possible.
+	if size := blockSize(minBlockSize, 0, 200*mebibyte); size != minBlockSize {
+		t.Fatalf("expected blocks of %d bytes, got %d", minBlockSize, size)
+	}
+	if size := blockSize(minBlockSize, 0, 100*tebibyte); size%minBlockSize != 0 || size*blockblob.MaxBlocks < 100*tebibyte {
+		t.Fatalf("unexpected block size %d", size)
+	}
+	if size := blockSize(defaultBlockSize, blockblob.MaxBlocks-1, 0); size != blockblob.MaxStageBlockBytes {
+		t.Fatalf("expected blocks of at most %d bytes, got %d", blockblob.MaxStageBlockBytes, size)
+	}
+}
@@ -4,13 +4,18 @@ import (
 	"errors"
 	"fmt"
 
+	"github.com/Azure/azure-sdk-for-go/sdk/storage/azblob/blockblob"
 	"github.com/mitchellh/mapstructure"
 )
 
 const (
-	defaultRealm      = "core.windows.net"
-	defaultMaxRetries = 5
-	defaultRetryDelay = "100ms"
+	defaultRealm             = "core.windows.net"
+	defaultMaxRetries        = 5
+	defaultRetryDelay        = "100ms"
+	defaultBlockSize         = 8 * 1024 * 1024
+	minBlockSize             = 1024 * 1024
+	defaultUploadConcurrency = 4
+	maxUploadConcurrency     = 64
 )
 
 type CredentialsType string
@@ -19,13 +24,17 @@ const (
 	CredentialsTypeClientSecret = "client_secret"
 	CredentialsTypeSharedKey    = "shared_key"
 	CredentialsTypeDefault      = "default_credentials"
+	CredentialsTypeMSI          = "msi"
+	CredentialsTypeSAS          = "sas"
 )
 
 type Credentials struct {
-	Type     CredentialsType `mapstructure:"type"`
-	ClientID string          `mapstructure:"clientid"`
-	TenantID string          `mapstructure:"tenantid"`
-	Secret   string          `mapstructure:"secret"`
+	Type         CredentialsType `mapstructure:"type"`
+	ClientID     string          `mapstructure:"clientid"`
+	TenantID     string          `mapstructure:"tenantid"`
+	Secret       string          `mapstructure:"secret"`
+	SASToken     string          `mapstructure:"sastoken"`
+	SASTokenFile string          `mapstructure:"sastokenfile"`
 }
 
 type DriverParameters struct {
@@ -40,6 +49,12 @@ type DriverParameters struct {
 	MaxRetries       int         `mapstructure:"max_retries"`
 	RetryDelay       string      `mapstructure:"retry_delay"`
 	SkipVerify       bool        `mapstructure:"skipverify"`
+	// BlockSize is the minimum size of the blocks the writers stage, which
+	// grows for large blobs to fit their blocks in the limit of a block blob.
+	BlockSize int64 `mapstructure:"blocksize"`
+	// UploadConcurrency is the number of blocks each writer stages
+	// concurrently.
+	UploadConcurrency int `mapstructure:"uploadconcurrency"`
 }
 
 func NewParameters(parameters map[string]any) (*DriverParameters, error) {
@@ -64,5 +79,17 @@ func NewParameters(parameters map[string]any) (*DriverParameters, error) {
 	if params.RetryDelay == "" {
 		params.RetryDelay = defaultRetryDelay
 	}
+	if params.BlockSize == 0 {
+		params.BlockSize = defaultBlockSize
+	}
+	if params.BlockSize < minBlockSize || params.BlockSize > blockblob.MaxStageBlockBytes {
+		return nil, fmt.Errorf("the blocksize parameter must be between %d and %d bytes, %d invalid", minBlockSize, blockblob.MaxStageBlockBytes, params.BlockSize)
+	}
+	if params.UploadConcurrency == 0 {
+		params.UploadConcurrency = defaultUploadConcurrency
+	}
+	if params.UploadConcurrency < 1 || params.UploadConcurrency > maxUploadConcurrency {
+		return nil, fmt.Errorf("the uploadconcurrency parameter must be between 1 and %d, %d invalid", maxUploadConcurrency, params.UploadConcurrency)
+	}
 	return &params, nil
 }
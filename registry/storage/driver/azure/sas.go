@@ -0,0 +1,175 @@
+package azure
+
+import (
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/Azure/azure-sdk-for-go/sdk/azcore/policy"
+)
+
+const (
+	// sasRefreshInterval is how often a file-backed SAS token is checked for
+	// changes on disk.
+	sasRefreshInterval = time.Minute
+
+	// sasExpiryGracePeriod is how long before its expiry a SAS token is
+	// considered stale and re-read.
+	sasExpiryGracePeriod = 5 * time.Minute
+)
+
+// sasTokenSource provides the SAS token used to authorize requests. A token
+// read from a file is re-read when the file changes or the token is about to
+// expire, so it can be rotated without restarting the registry.
+type sasTokenSource struct {
+	path string
+	now  func() time.Time
+
+	mu        sync.Mutex
+	token     url.Values
+	expiry    time.Time
+	modTime   time.Time
+	checkedAt time.Time
+}
+
+func newSASTokenSource(token, path string) (*sasTokenSource, error) {
+	s := &sasTokenSource{
+		path: path,
+		now:  time.Now,
+	}
+	if path != "" {
+		if err := s.load(); err != nil {
+			return nil, err
+		}
+		return s, nil
+	}
+	if err := s.set(token); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+// set parses and stores token.
+func (s *sasTokenSource) set(token string) error {
+	values, err := url.ParseQuery(strings.TrimPrefix(strings.TrimSpace(token), "?"))
+	if err != nil {
+		return fmt.Errorf("invalid SAS token: %v", err)
+	}
+	if values.Get("sig") == "" {
+		return fmt.Errorf("invalid SAS token: missing signature")
+	}
+
+	var expiry time.Time
+	if se := values.Get("se"); se != "" {
+		expiry, err = parseSASTime(se)
+		if err != nil {
+			return fmt.Errorf("invalid SAS token expiry %q: %v", se, err)
+		}
+	}
+
+	s.token = values
+	s.expiry = expiry
+	return nil
+}
+
+// load reads the token from the file at s.path.
+func (s *sasTokenSource) load() error {
+	fi, err := os.Stat(s.path)
+	if err != nil {
+		return fmt.Errorf("SAS token file: %v", err)
+	}
+	contents, err := os.ReadFile(s.path)
+	if err != nil {
+		return fmt.Errorf("SAS token file: %v", err)
+	}
+	if err := s.set(string(contents)); err != nil {
+		return fmt.Errorf("SAS token file %s: %v", s.path, err)
+	}
+	s.modTime = fi.ModTime()
+	s.checkedAt = s.now()
+	return nil
+}
+
+// Token returns the current SAS token, re-reading it from file if it was
+// rotated or is about to expire.
+func (s *sasTokenSource) Token() (url.Values, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.path == "" {
+		return s.token, nil
+	}
+
+	now := s.now()
+	expiring := !s.expiry.IsZero() && s.expiry.Sub(now) < sasExpiryGracePeriod
+	if expiring || now.Sub(s.checkedAt) >= sasRefreshInterval {
+		s.checkedAt = now
+		fi, err := os.Stat(s.path)
+		if err != nil {
+			return nil, fmt.Errorf("SAS token file: %v", err)
+		}
+		if expiring || !fi.ModTime().Equal(s.modTime) {
+			if err := s.load(); err != nil {
+				return nil, err
+			}
+		}
+	}
+
+	if !s.expiry.IsZero() && !now.Before(s.expiry) {
+		return nil, fmt.Errorf("SAS token expired at %s", s.expiry.Format(time.RFC3339))
+	}
+	return s.token, nil
+}
+
+// AuthorizeURL returns rawURL with the current SAS token added to its query.
+func (s *sasTokenSource) AuthorizeURL(rawURL string) (string, error) {
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return "", err
+	}
+	if err := s.authorize(u); err != nil {
+		return "", err
+	}
+	return u.String(), nil
+}
+
+func (s *sasTokenSource) authorize(u *url.URL) error {
+	token, err := s.Token()
+	if err != nil {
+		return err
+	}
+	query := u.Query()
+	for k, v := range token {
+		query[k] = v
+	}
+	u.RawQuery = query.Encode()
+	return nil
+}
+
+// parseSASTime parses a start or expiry time of a SAS token, which may or may
+// not include seconds.
+func parseSASTime(v string) (time.Time, error) {
+	for _, layout := range []string{time.RFC3339, "2006-01-02T15:04Z", "2006-01-02"} {
+		if t, err := time.Parse(layout, v); err == nil {
+			return t, nil
+		}
+	}
+	return time.Time{}, fmt.Errorf("unrecognized time format")
+}
+
+// sasPolicy authorizes every request with the current token of a
+// [sasTokenSource].
+type sasPolicy struct {
+	source *sasTokenSource
+}
+
+func (p *sasPolicy) Do(req *policy.Request) (*http.Response, error) {
+	if err := p.source.authorize(req.Raw().URL); err != nil {
+		return nil, err
+	}
+	return req.Next()
+}
@@ -0,0 +1,94 @@
+package azure
+
+import (
+	"net/url"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func sasToken(sig string, expiry time.Time) string {
+	return url.Values{
+		"sv":  {"2022-11-02"},
+		"sp":  {"racwdl"},
+		"se":  {expiry.UTC().Format(time.RFC3339)},
+		"sig": {sig},
+	}.Encode()
+}
+
+func TestSASTokenSourceInline(t *testing.T) {
+	source, err := newSASTokenSource("?"+sasToken("inline", time.Now().Add(time.Hour)), "")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	authorized, err := source.AuthorizeURL("https://acc1.blob.core.windows.net/c1/blob?comp=block")
+	if err != nil {
+		t.Fatal(err)
+	}
+	u, err := url.Parse(authorized)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := u.Query().Get("sig"); got != "inline" {
+		t.Fatalf("expected signature to be added, got %q", got)
+	}
+	if got := u.Query().Get("comp"); got != "block" {
+		t.Fatalf("expected existing query to be kept, got %q", got)
+	}
+
+	if _, err := newSASTokenSource("sv=2022-11-02", ""); err == nil {
+		t.Fatal("expected an error for a token without a signature")
+	}
+}
+
+func TestSASTokenSourceRotation(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "sas")
+	now := time.Now()
+	if err := os.WriteFile(path, []byte(sasToken("first", now.Add(time.Hour))+"\n"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	source, err := newSASTokenSource("", path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	source.now = func() time.Time { return now }
+
+	assertSig := func(expected string) {
+		t.Helper()
+		token, err := source.Token()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := token.Get("sig"); got != expected {
+			t.Fatalf("expected signature %q, got %q", expected, got)
+		}
+	}
+	assertSig("first")
+
+	// A rotated file is picked up after the refresh interval.
+	if err := os.WriteFile(path, []byte(sasToken("second", now.Add(2*time.Hour))), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Chtimes(path, now.Add(time.Second), now.Add(time.Second)); err != nil {
+		t.Fatal(err)
+	}
+	assertSig("first")
+	now = now.Add(sasRefreshInterval + time.Second)
+	assertSig("second")
+
+	// A token about to expire is re-read immediately.
+	if err := os.WriteFile(path, []byte(sasToken("third", now.Add(4*time.Hour))), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	now = now.Add(2*time.Hour - sasExpiryGracePeriod/2)
+	assertSig("third")
+
+	// An expired token that was not rotated is an error.
+	now = now.Add(5 * time.Hour)
+	if _, err := source.Token(); err == nil {
+		t.Fatal("expected an error for an expired token")
+	}
+}
@@ -0,0 +1,744 @@
+// Package b2 provides a storagedriver.StorageDriver implementation to
+// store blobs in Backblaze B2 cloud storage, using the B2 native API.
+//
+// Because B2 is a key, value store the Stat call does not support last
+// modification time for directories (directories are an abstraction for
+// key, value stores).
+//
+// B2 keeps every version of a file. The driver removes superseded versions
+// whenever it overwrites or deletes a file, so only the latest version of a
+// file is retained.
+package b2
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"reflect"
+	"strconv"
+	"strings"
+	"time"
+
+	storagedriver "github.com/distribution/distribution/v3/registry/storage/driver"
+	"github.com/distribution/distribution/v3/registry/storage/driver/base"
+	"github.com/distribution/distribution/v3/registry/storage/driver/factory"
+)
+
+const (
+	driverName = "b2"
+
+	defaultAPIURL = "https://api.backblazeb2.com"
+
+	// minChunkSize is the smallest part of a large file accepted by B2,
+	// apart from the last one.
+	minChunkSize     = 5 * 1024 * 1024
+	maxChunkSize     = 5 * 1024 * 1024 * 1024
+	defaultChunkSize = 16 * 1024 * 1024
+
+	// maxCopySize is the largest file which b2_copy_file can copy. Larger
+	// files are copied part by part.
+	maxCopySize = 5 * 1024 * 1024 * 1024
+
+	defaultMaxConcurrency = 50
+	minConcurrency        = 25
+
+	uploadSessionContentType = "application/x-docker-upload-session"
+	blobContentType          = "application/octet-stream"
+
+	// File info keys of upload sessions.
+	infoLargeFileID = "large_file_id"
+	infoOffset      = "offset"
+	infoParts       = "parts"
+
+	redirectExpiry = 20 * time.Minute
+)
+
+// DriverParameters is a struct that encapsulates all of the driver parameters after all values have been set
+type DriverParameters struct {
+	ApplicationKeyID string
+	ApplicationKey   string
+	Bucket           string
+	RootDirectory    string
+	APIURL           string
+	ChunkSize        int
+	HTTPClient       *http.Client
+
+	// MaxConcurrency limits the number of concurrent driver operations
+	// to B2.
+	MaxConcurrency uint64
+}
+
+func init() {
+	factory.Register(driverName, &b2DriverFactory{})
+}
+
+// b2DriverFactory implements the factory.StorageDriverFactory interface
+type b2DriverFactory struct{}
+
+// Create StorageDriver from parameters
+func (factory *b2DriverFactory) Create(ctx context.Context, parameters map[string]any) (storagedriver.StorageDriver, error) {
+	return FromParameters(ctx, parameters)
+}
+
+var _ storagedriver.StorageDriver = &driver{}
+
+// driver is a storagedriver.StorageDriver implementation backed by B2.
+// Objects are stored at absolute keys in the provided bucket.
+type driver struct {
+	client        *client
+	rootDirectory string
+	chunkSize     int
+
+	// copyPartSize is the size of the parts used to copy files which are
+	// too large for b2_copy_file.
+	copyPartSize int64
+}
+
+// Wrapper wraps `driver` with a throttler, ensuring that no more than N
+// B2 actions can occur concurrently.
+type Wrapper struct {
+	baseEmbed
+}
+
+type baseEmbed struct {
+	base.Base
+}
+
+// FromParameters constructs a new Driver with a given parameters map
+// Required parameters:
+// - applicationkeyid
+// - applicationkey
+// - bucket
+func FromParameters(ctx context.Context, parameters map[string]any) (storagedriver.StorageDriver, error) {
+	params := DriverParameters{
+		APIURL:    defaultAPIURL,
+		ChunkSize: defaultChunkSize,
+	}
+
+	for name, dst := range map[string]*string{
+		"applicationkeyid": &params.ApplicationKeyID,
+		"applicationkey":   &params.ApplicationKey,
+		"bucket":           &params.Bucket,
+	} {
+		v, ok := parameters[name]
+		if !ok || fmt.Sprint(v) == "" {
+			return nil, fmt.Errorf("no %s parameter provided", name)
+		}
+		*dst = fmt.Sprint(v)
+	}
+
+	if rootDirectory, ok := parameters["rootdirectory"]; ok {
+		params.RootDirectory = fmt.Sprint(rootDirectory)
+	}
+	if apiURL, ok := parameters["apiurl"]; ok && fmt.Sprint(apiURL) != "" {
+		params.APIURL = fmt.Sprint(apiURL)
+	}
+
+	if chunkSizeParam, ok := parameters["chunksize"]; ok {
+		switch v := chunkSizeParam.(type) {
+		case string:
+			vv, err := strconv.Atoi(v)
+			if err != nil {
+				return nil, fmt.Errorf("chunksize must be an integer, %v invalid", chunkSizeParam)
+			}
+			params.ChunkSize = vv
+		case int, uint, int32, uint32, uint64, int64:
+			params.ChunkSize = int(reflect.ValueOf(v).Convert(reflect.TypeFor[int]()).Int())
+		default:
+			return nil, fmt.Errorf("invalid value for chunksize: %#v", chunkSizeParam)
+		}
+	}
+
+	maxConcurrency, err := base.GetLimitFromParameter(parameters["maxconcurrency"], minConcurrency, defaultMaxConcurrency)
+	if err != nil {
+		return nil, fmt.Errorf("maxconcurrency config error: %s", err)
+	}
+	params.MaxConcurrency = maxConcurrency
+
+	return New(ctx, params)
+}
+
+// New constructs a new driver
+func New(ctx context.Context, params DriverParameters) (storagedriver.StorageDriver, error) {
+	if params.ChunkSize < minChunkSize || params.ChunkSize > maxChunkSize {
+		return nil, fmt.Errorf("chunksize %d must be between %d and %d", params.ChunkSize, minChunkSize, maxChunkSize)
+	}
+	if params.MaxConcurrency == 0 {
+		params.MaxConcurrency = defaultMaxConcurrency
+	}
+
+	rootDirectory := strings.Trim(params.RootDirectory, "/")
+	if rootDirectory != "" {
+		rootDirectory += "/"
+	}
+
+	d := &driver{
+		client:        newClient(params.HTTPClient, params.APIURL, params.ApplicationKeyID, params.ApplicationKey, params.Bucket),
+		rootDirectory: rootDirectory,
+		chunkSize:     params.ChunkSize,
+		copyPartSize:  maxCopySize,
+	}
+
+	return &Wrapper{
+		baseEmbed: baseEmbed{
+			Base: base.Base{
+				StorageDriver: base.NewRegulator(d, params.MaxConcurrency),
+			},
+		},
+	}, nil
+}
+
+// Implement the storagedriver.StorageDriver interface
+
+func (d *driver) Name() string {
+	return driverName
+}
+
+// GetContent retrieves the content stored at "path" as a []byte.
+// This should primarily be used for small objects.
+func (d *driver) GetContent(ctx context.Context, path string) ([]byte, error) {
+	r, err := d.Reader(ctx, path, 0)
+	if err != nil {
+		return nil, err
+	}
+	defer r.Close()
+
+	return io.ReadAll(r)
+}
+
+// PutContent stores the []byte content at a location designated by "path".
+// This should primarily be used for small objects.
+func (d *driver) PutContent(ctx context.Context, path string, contents []byte) error {
+	key := d.pathToKey(path)
+	f, err := d.client.uploadFile(ctx, key, blobContentType, nil, contents)
+	if err != nil {
+		return err
+	}
+	return d.deleteVersions(ctx, key, f.FileID)
+}
+
+// Reader retrieves an io.ReadCloser for the content stored at "path"
+// with a given byte offset.
+// May be used to resume reading a stream by providing a nonzero offset.
+func (d *driver) Reader(ctx context.Context, path string, offset int64) (io.ReadCloser, error) {
+	if offset < 0 {
+		return nil, storagedriver.InvalidOffsetError{Path: path, Offset: offset}
+	}
+
+	resp, err := d.client.downloadFile(ctx, d.pathToKey(path), offset)
+	if err != nil {
+		if isNotFound(err) {
+			return nil, storagedriver.PathNotFoundError{Path: path}
+		}
+		var apiErr *apiError
+		if errors.As(err, &apiErr) && apiErr.Status == http.StatusRequestedRangeNotSatisfiable {
+			// Reading from the end of the file, or past it, yields no content.
+			return io.NopCloser(bytes.NewReader(nil)), nil
+		}
+		return nil, err
+	}
+	if resp.Header.Get("Content-Type") == uploadSessionContentType {
+		resp.Body.Close()
+		return nil, storagedriver.PathNotFoundError{Path: path}
+	}
+	return resp.Body, nil
+}
+
+// Writer returns a FileWriter which will store the content written to it
+// at the location designated by "path" after the call to Commit.
+func (d *driver) Writer(ctx context.Context, path string, appendMode bool) (storagedriver.FileWriter, error) {
+	w := &writer{
+		ctx:    ctx,
+		driver: d,
+		key:    d.pathToKey(path),
+		buffer: make([]byte, 0, d.chunkSize),
+	}
+
+	if appendMode {
+		err := w.init(ctx, path)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return w, nil
+}
+
+// Stat retrieves the FileInfo for the given path, including the current
+// size in bytes and the creation time.
+func (d *driver) Stat(ctx context.Context, path string) (storagedriver.FileInfo, error) {
+	key := d.pathToKey(path)
+	if key != "" {
+		// try to get as file
+		f, err := d.lookup(ctx, key)
+		if err != nil {
+			return nil, err
+		}
+		if f != nil {
+			if f.ContentType == uploadSessionContentType {
+				return nil, storagedriver.PathNotFoundError{Path: path}
+			}
+			return storagedriver.FileInfoInternal{FileInfoFields: storagedriver.FileInfoFields{
+				Path:    path,
+				Size:    f.ContentLength,
+				ModTime: time.UnixMilli(f.UploadTimestamp),
+			}}, nil
+		}
+	}
+
+	// try to get as folder
+	files, _, err := d.client.listFileNames(ctx, d.pathToDirKey(path), "", "", 1)
+	if err != nil {
+		return nil, err
+	}
+	if len(files) == 0 {
+		return nil, storagedriver.PathNotFoundError{Path: path}
+	}
+	return storagedriver.FileInfoInternal{FileInfoFields: storagedriver.FileInfoFields{
+		Path:  path,
+		IsDir: true,
+	}}, nil
+}
+
+// List returns a list of the objects that are direct descendants of the
+// given path.
+func (d *driver) List(ctx context.Context, path string) ([]string, error) {
+	prefix := d.pathToDirKey(path)
+
+	list := make([]string, 0, 64)
+	var start string
+	for {
+		files, next, err := d.client.listFileNames(ctx, prefix, "/", start, maxFileCount)
+		if err != nil {
+			return nil, err
+		}
+		for _, f := range files {
+			if f.Action == "folder" || f.ContentType != uploadSessionContentType {
+				list = append(list, d.keyToPath(f.FileName))
+			}
+		}
+		if next == "" {
+			break
+		}
+		start = next
+	}
+
+	if path != "/" && len(list) == 0 {
+		// Treat empty response as missing directory, since we don't actually
+		// have directories in B2.
+		return nil, storagedriver.PathNotFoundError{Path: path}
+	}
+	return list, nil
+}
+
+// Move moves an object stored at sourcePath to destPath, removing the
+// original object.
+func (d *driver) Move(ctx context.Context, sourcePath string, destPath string) error {
+	srcKey, dstKey := d.pathToKey(sourcePath), d.pathToKey(destPath)
+	src, err := d.lookup(ctx, srcKey)
+	if err != nil {
+		return err
+	}
+	if src == nil || src.ContentType == uploadSessionContentType {
+		return storagedriver.PathNotFoundError{Path: sourcePath}
+	}
+
+	var dst *file
+	if src.ContentLength <= min(d.copyPartSize, maxCopySize) {
+		dst, err = d.client.copyFile(ctx, src.FileID, dstKey)
+	} else {
+		dst, err = d.copyLargeFile(ctx, src, dstKey)
+	}
+	if err != nil {
+		return fmt.Errorf("move %q to %q: %v", srcKey, dstKey, err)
+	}
+
+	if err := d.deleteVersions(ctx, dstKey, dst.FileID); err != nil {
+		return err
+	}
+	return d.deleteVersions(ctx, srcKey, "")
+}
+
+// copyLargeFile copies src to name part by part.
+func (d *driver) copyLargeFile(ctx context.Context, src *file, name string) (*file, error) {
+	large, err := d.client.startLargeFile(ctx, name, src.ContentType)
+	if err != nil {
+		return nil, err
+	}
+
+	var checksums []string
+	for start := int64(0); start < src.ContentLength; start += d.copyPartSize {
+		end := min(start+d.copyPartSize, src.ContentLength) - 1
+		checksum, err := d.client.copyPart(ctx, src.FileID, large.FileID, len(checksums)+1, start, end)
+		if err != nil {
+			_ = d.client.cancelLargeFile(ctx, large.FileID)
+			return nil, err
+		}
+		checksums = append(checksums, checksum)
+	}
+
+	f, err := d.client.finishLargeFile(ctx, large.FileID, checksums)
+	if err != nil {
+		_ = d.client.cancelLargeFile(ctx, large.FileID)
+		return nil, err
+	}
+	return f, nil
+}
+
+// Delete recursively deletes all objects stored at "path" and its subpaths.
+func (d *driver) Delete(ctx context.Context, path string) error {
+	var found bool
+	deleteVersion := func(f file) (bool, error) {
+		if f.Action == "upload" {
+			found = true
+		}
+		return true, d.deleteVersion(ctx, f)
+	}
+
+	if err := d.versions(ctx, d.pathToDirKey(path), "", deleteVersion); err != nil {
+		return err
+	}
+	if key := d.pathToKey(path); key != "" {
+		err := d.versions(ctx, key, key, func(f file) (bool, error) {
+			if f.FileName != key {
+				return false, nil
+			}
+			return deleteVersion(f)
+		})
+		if err != nil {
+			return err
+		}
+	}
+
+	if !found {
+		return storagedriver.PathNotFoundError{Path: path}
+	}
+	return nil
+}
+
+// RedirectURL returns a URL which may be used to retrieve the content stored at
+// the given path, possibly using the given options.
+func (d *driver) RedirectURL(r *http.Request, path string) (string, error) {
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		return "", nil
+	}
+	return d.client.downloadAuthorization(r.Context(), d.pathToKey(path), redirectExpiry)
+}
+
+// Walk traverses a filesystem defined within driver, starting
+// from the given path, calling f on each file
+func (d *driver) Walk(ctx context.Context, path string, f storagedriver.WalkFn, options ...func(*storagedriver.WalkOptions)) error {
+	return storagedriver.WalkFallback(ctx, d, path, f, options...)
+}
+
+// lookup returns the latest version of the file key, or nil if there is none.
+func (d *driver) lookup(ctx context.Context, key string) (*file, error) {
+	files, _, err := d.client.listFileNames(ctx, key, "", key, 1)
+	if err != nil {
+		return nil, err
+	}
+	if len(files) == 0 || files[0].FileName != key {
+		return nil, nil
+	}
+	return &files[0], nil
+}
+
+// versions calls fn on all versions of the files starting with prefix,
+// beginning at start, until fn returns false.
+func (d *driver) versions(ctx context.Context, prefix, start string, fn func(f file) (bool, error)) error {
+	var startID string
+	for {
+		files, nextName, nextID, err := d.client.listFileVersions(ctx, prefix, start, startID)
+		if err != nil {
+			return err
+		}
+		for _, f := range files {
+			ok, err := fn(f)
+			if err != nil || !ok {
+				return err
+			}
+		}
+		if nextName == "" {
+			return nil
+		}
+		start, startID = nextName, nextID
+	}
+}
+
+// deleteVersions deletes all versions of the file key except keepID.
+// Unfinished large files are left alone, as they may belong to an
+// upload in progress.
+func (d *driver) deleteVersions(ctx context.Context, key, keepID string) error {
+	return d.versions(ctx, key, key, func(f file) (bool, error) {
+		if f.FileName != key {
+			return false, nil
+		}
+		if f.FileID == keepID || f.Action == "start" {
+			return true, nil
+		}
+		return true, d.deleteVersion(ctx, f)
+	})
+}
+
+// deleteVersion deletes a version of a file, cancelling it if it is an
+// unfinished large file.
+func (d *driver) deleteVersion(ctx context.Context, f file) error {
+	var err error
+	if f.Action == "start" {
+		err = d.client.cancelLargeFile(ctx, f.FileID)
+	} else {
+		err = d.client.deleteFileVersion(ctx, f.FileName, f.FileID)
+	}
+	// Another request may have deleted the same version concurrently.
+	if isNotFound(err) {
+		err = nil
+	}
+	return err
+}
+
+func (d *driver) pathToKey(path string) string {
+	return strings.TrimSpace(strings.TrimRight(d.rootDirectory+strings.TrimLeft(path, "/"), "/"))
+}
+
+func (d *driver) pathToDirKey(path string) string {
+	if key := d.pathToKey(path); key != "" {
+		return key + "/"
+	}
+	return ""
+}
+
+func (d *driver) keyToPath(key string) string {
+	return "/" + strings.Trim(strings.TrimPrefix(key, d.rootDirectory), "/")
+}
+
+var _ storagedriver.FileWriter = &writer{}
+
+// writer uploads content as the parts of a B2 large file. Content is
+// buffered until a full chunk is written and more content follows, so
+// the buffer is never empty once a large file is started and every large
+// file has at least the two parts B2 requires.
+//
+// On Close, the buffered content is stored at the path of the writer as an
+// upload session, along with the ID of the large file and the number of
+// parts uploaded so far, so the upload can be resumed.
+type writer struct {
+	ctx       context.Context
+	driver    *driver
+	key       string
+	size      int64
+	offset    int64
+	closed    bool
+	cancelled bool
+	committed bool
+
+	largeFileID string
+	checksums   []string
+	partURL     *uploadURL
+	buffer      []byte
+}
+
+// Cancel removes any written content from this FileWriter.
+func (w *writer) Cancel(ctx context.Context) error {
+	w.closed = true
+	w.cancelled = true
+
+	if w.largeFileID != "" {
+		err := w.driver.client.cancelLargeFile(ctx, w.largeFileID)
+		if err != nil && !isNotFound(err) {
+			return err
+		}
+	}
+	return w.driver.deleteVersions(ctx, w.key, "")
+}
+
+func (w *writer) Close() error {
+	if w.closed {
+		return nil
+	}
+	w.closed = true
+
+	// store the remaining bytes in the upload session
+	info := map[string]string{
+		infoOffset: strconv.FormatInt(w.offset, 10),
+		infoParts:  strconv.Itoa(len(w.checksums)),
+	}
+	if w.largeFileID != "" {
+		info[infoLargeFileID] = w.largeFileID
+	}
+	f, err := w.driver.client.uploadFile(w.ctx, w.key, uploadSessionContentType, info, w.buffer)
+	if err != nil {
+		return err
+	}
+	w.size = w.offset + int64(len(w.buffer))
+	return w.driver.deleteVersions(w.ctx, w.key, f.FileID)
+}
+
+// Commit flushes all content written to this FileWriter and makes it
+// available for future calls to StorageDriver.GetContent and
+// StorageDriver.Reader.
+func (w *writer) Commit(ctx context.Context) error {
+	if w.closed {
+		return fmt.Errorf("already closed")
+	}
+	w.closed = true
+
+	var (
+		f   *file
+		err error
+	)
+	if w.largeFileID == "" {
+		// no large file started yet just perform a simple upload
+		f, err = w.driver.client.uploadFile(ctx, w.key, blobContentType, nil, w.buffer)
+		if err != nil {
+			return err
+		}
+	} else {
+		if err := w.uploadPart(ctx); err != nil {
+			return err
+		}
+		f, err = w.driver.client.finishLargeFile(ctx, w.largeFileID, w.checksums)
+		if err != nil {
+			return err
+		}
+	}
+	w.committed = true
+	w.size = w.offset + int64(len(w.buffer))
+	w.buffer = w.buffer[:0]
+	return w.driver.deleteVersions(ctx, w.key, f.FileID)
+}
+
+// uploadPart uploads the buffer as the next part of the large file,
+// starting the large file if needed.
+func (w *writer) uploadPart(ctx context.Context) error {
+	if w.largeFileID == "" {
+		f, err := w.driver.client.startLargeFile(ctx, w.key, blobContentType)
+		if err != nil {
+			return err
+		}
+		w.largeFileID = f.FileID
+	}
+	checksum, err := w.driver.client.uploadPart(ctx, &w.partURL, w.largeFileID, len(w.checksums)+1, w.buffer)
+	if err != nil {
+		return err
+	}
+	w.checksums = append(w.checksums, checksum)
+	w.offset += int64(len(w.buffer))
+	w.buffer = w.buffer[:0]
+	return nil
+}
+
+func (w *writer) Write(p []byte) (int, error) {
+	if w.closed {
+		return 0, fmt.Errorf("already closed")
+	} else if w.cancelled {
+		return 0, fmt.Errorf("already cancelled")
+	}
+
+	var (
+		written int
+		err     error
+	)
+	for written < len(p) {
+		if len(w.buffer) == w.driver.chunkSize {
+			if err = w.uploadPart(w.ctx); err != nil {
+				break
+			}
+		}
+		n := min(w.driver.chunkSize-len(w.buffer), len(p)-written)
+		w.buffer = append(w.buffer, p[written:written+n]...)
+		written += n
+	}
+	w.size = w.offset + int64(len(w.buffer))
+	return written, err
+}
+
+// Size returns the number of bytes written to this FileWriter.
+func (w *writer) Size() int64 {
+	return w.size
+}
+
+// init resumes the upload session, or the committed file, stored at the
+// path of the writer.
+func (w *writer) init(ctx context.Context, path string) error {
+	f, err := w.driver.lookup(ctx, w.key)
+	if err != nil {
+		return err
+	}
+	if f == nil {
+		return storagedriver.PathNotFoundError{Path: path}
+	}
+
+	switch f.ContentType {
+	case uploadSessionContentType:
+		if f.FileInfo[infoOffset] != "" {
+			w.offset, err = strconv.ParseInt(f.FileInfo[infoOffset], 10, 64)
+			if err != nil {
+				return err
+			}
+		}
+		if id := f.FileInfo[infoLargeFileID]; id != "" {
+			parts, err := strconv.Atoi(f.FileInfo[infoParts])
+			if err != nil {
+				return err
+			}
+			if err := w.resumeLargeFile(ctx, id, parts); err != nil {
+				return err
+			}
+		}
+	case blobContentType:
+		// A committed file can only be appended to while it fits in the
+		// buffer, as the parts of B2 large files cannot be changed.
+		if f.ContentLength > int64(w.driver.chunkSize) {
+			return fmt.Errorf("cannot append to %s: committed file exceeds chunksize", path)
+		}
+	default:
+		return storagedriver.PathNotFoundError{Path: path}
+	}
+
+	if f.ContentLength > 0 {
+		resp, err := w.driver.client.downloadFile(ctx, w.key, 0)
+		if err != nil {
+			return err
+		}
+		defer resp.Body.Close()
+		w.buffer, err = io.ReadAll(io.LimitReader(resp.Body, int64(w.driver.chunkSize)))
+		if err != nil {
+			return err
+		}
+		w.buffer = append(make([]byte, 0, w.driver.chunkSize), w.buffer...)
+	}
+	w.size = w.offset + int64(len(w.buffer))
+	return nil
+}
+
+// resumeLargeFile restores the checksums of the first parts uploaded to the
+// large file id.
+func (w *writer) resumeLargeFile(ctx context.Context, id string, parts int) error {
+	uploaded, err := w.driver.client.listParts(ctx, id)
+	if err != nil {
+		return err
+	}
+
+	var size int64
+	checksums := make([]string, 0, parts)
+	for _, p := range uploaded {
+		if p.PartNumber > parts {
+			break
+		}
+		if p.PartNumber != len(checksums)+1 {
+			return fmt.Errorf("large file %s is missing part %d", id, len(checksums)+1)
+		}
+		checksums = append(checksums, p.ContentSha1)
+		size += p.ContentLength
+	}
+	if len(checksums) != parts || size != w.offset {
+		return fmt.Errorf("large file %s does not match upload session: %d bytes in %d parts, expected %d bytes in %d parts",
+			id, size, len(checksums), w.offset, parts)
+	}
+
+	w.largeFileID = id
+	w.checksums = checksums
+	return nil
+}
@@ -0,0 +1,569 @@
+package b2
+
+import (
+	"bytes"
+	"crypto/sha1"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+const (
+	stubKeyID    = "stub-key-id"
+	stubKey      = "stub-key"
+	stubBucket   = "stub-bucket"
+	stubBucketID = "stub-bucket-id"
+)
+
+// stubVersion is a version of a file stored by b2Stub.
+type stubVersion struct {
+	id          string
+	name        string
+	action      string
+	contentType string
+	info        map[string]string
+	data        []byte
+	timestamp   int64
+	parts       map[int][]byte
+}
+
+func (v *stubVersion) file() file {
+	return file{
+		FileID:          v.id,
+		FileName:        v.name,
+		Action:          v.action,
+		ContentLength:   int64(len(v.data)),
+		ContentType:     v.contentType,
+		FileInfo:        v.info,
+		UploadTimestamp: v.timestamp,
+	}
+}
+
+// b2Stub is an in-memory implementation of the parts of the B2 native API
+// used by the driver.
+type b2Stub struct {
+	t      *testing.T
+	server *httptest.Server
+
+	// minPartSize is the smallest part accepted by b2_finish_large_file,
+	// apart from the last one.
+	minPartSize int
+
+	mu       sync.Mutex
+	token    string
+	tokens   int
+	nextID   int
+	versions []*stubVersion
+	calls    []string
+	// failHook, if set, is called before every API call and upload, and
+	// fails the call if it returns an error.
+	failHook func(op string) *apiError
+}
+
+func newB2Stub(t *testing.T) *b2Stub {
+	s := &b2Stub{t: t, minPartSize: minChunkSize}
+	s.server = httptest.NewServer(http.HandlerFunc(s.serveHTTP))
+	t.Cleanup(s.server.Close)
+	return s
+}
+
+// driverParameters returns the parameters of a driver using the stub.
+func (s *b2Stub) driverParameters() DriverParameters {
+	return DriverParameters{
+		ApplicationKeyID: stubKeyID,
+		ApplicationKey:   stubKey,
+		Bucket:           stubBucket,
+		RootDirectory:    "/root",
+		APIURL:           s.server.URL,
+		ChunkSize:        minChunkSize,
+	}
+}
+
+// newDriver returns an unwrapped driver using the stub.
+func (s *b2Stub) newDriver() *driver {
+	params := s.driverParameters()
+	d := &driver{
+		client:        newClient(nil, params.APIURL, params.ApplicationKeyID, params.ApplicationKey, params.Bucket),
+		rootDirectory: "root/",
+		chunkSize:     params.ChunkSize,
+		copyPartSize:  maxCopySize,
+	}
+	d.client.backoff = time.Millisecond
+	return d
+}
+
+// recorded returns the names of the operations called so far.
+func (s *b2Stub) recorded() []string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([]string(nil), s.calls...)
+}
+
+// count returns how many times op was called.
+func (s *b2Stub) count(op string) int {
+	var n int
+	for _, c := range s.recorded() {
+		if c == op {
+			n++
+		}
+	}
+	return n
+}
+
+// fileVersions returns all versions of the file name, including unfinished
+// large files.
+func (s *b2Stub) fileVersions(name string) []*stubVersion {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var versions []*stubVersion
+	for _, v := range s.versions {
+		if v.name == name {
+			versions = append(versions, v)
+		}
+	}
+	return versions
+}
+
+// expireToken invalidates the current account authorization token.
+func (s *b2Stub) expireToken() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.token = ""
+}
+
+func (s *b2Stub) serveHTTP(w http.ResponseWriter, r *http.Request) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	op := strings.TrimPrefix(r.URL.Path, "/"+apiVersion+"/")
+	switch {
+	case strings.HasPrefix(r.URL.Path, "/file/"):
+		op = "download"
+	case r.URL.Path == "/upload":
+		op = "upload"
+	case strings.HasPrefix(r.URL.Path, "/upload_part/"):
+		op = "upload_part"
+	}
+	s.calls = append(s.calls, op)
+	if s.failHook != nil {
+		if apiErr := s.failHook(op); apiErr != nil {
+			writeJSON(w, apiErr.Status, apiErr)
+			return
+		}
+	}
+
+	switch op {
+	case "b2_authorize_account":
+		s.authorizeAccount(w, r)
+		return
+	case "download":
+		s.download(w, r)
+		return
+	case "upload", "upload_part":
+		if r.Header.Get("Authorization") != "upload-"+s.token || s.token == "" {
+			writeError(w, http.StatusUnauthorized, "expired_auth_token", "upload token expired")
+			return
+		}
+		if op == "upload" {
+			s.upload(w, r)
+		} else {
+			s.uploadPart(w, r)
+		}
+		return
+	}
+
+	if s.token == "" || r.Header.Get("Authorization") != s.token {
+		writeError(w, http.StatusUnauthorized, "expired_auth_token", "authorization token expired")
+		return
+	}
+	var req map[string]any
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeError(w, http.StatusBadRequest, "bad_request", err.Error())
+		return
+	}
+	str := func(k string) string {
+		v, _ := req[k].(string)
+		return v
+	}
+	num := func(k string) int {
+		v, _ := req[k].(float64)
+		return int(v)
+	}
+
+	switch op {
+	case "b2_list_buckets":
+		writeJSON(w, http.StatusOK, map[string]any{
+			"buckets": []map[string]string{{"bucketId": stubBucketID, "bucketName": stubBucket}},
+		})
+	case "b2_get_upload_url":
+		writeJSON(w, http.StatusOK, uploadURL{URL: s.server.URL + "/upload", Token: "upload-" + s.token})
+	case "b2_get_upload_part_url":
+		writeJSON(w, http.StatusOK, uploadURL{URL: s.server.URL + "/upload_part/" + str("fileId"), Token: "upload-" + s.token})
+	case "b2_list_file_names":
+		s.listFileNames(w, str("prefix"), str("delimiter"), str("startFileName"), num("maxFileCount"))
+	case "b2_list_file_versions":
+		s.listFileVersions(w, str("prefix"), str("startFileName"), str("startFileId"), num("maxFileCount"))
+	case "b2_start_large_file":
+		v := s.addVersion(str("fileName"), "start", str("contentType"), nil, nil)
+		v.parts = map[int][]byte{}
+		writeJSON(w, http.StatusOK, v.file())
+	case "b2_list_parts":
+		v := s.largeFile(str("fileId"))
+		if v == nil {
+			writeError(w, http.StatusBadRequest, "bad_request", "no such large file")
+			return
+		}
+		parts := []part{}
+		for _, n := range sortedParts(v) {
+			sum := sha1.Sum(v.parts[n])
+			parts = append(parts, part{PartNumber: n, ContentLength: int64(len(v.parts[n])), ContentSha1: hex.EncodeToString(sum[:])})
+		}
+		writeJSON(w, http.StatusOK, map[string]any{"parts": parts, "nextPartNumber": nil})
+	case "b2_finish_large_file":
+		s.finishLargeFile(w, str("fileId"), req["partSha1Array"])
+	case "b2_cancel_large_file":
+		v := s.largeFile(str("fileId"))
+		if v == nil {
+			writeError(w, http.StatusBadRequest, "bad_request", "no such large file")
+			return
+		}
+		s.remove(v)
+		writeJSON(w, http.StatusOK, map[string]string{"fileId": v.id})
+	case "b2_copy_file":
+		src := s.version(str("sourceFileId"))
+		if src == nil || src.action != "upload" {
+			writeError(w, http.StatusNotFound, "not_found", "source not found")
+			return
+		}
+		v := s.addVersion(str("fileName"), "upload", src.contentType, src.info, src.data)
+		writeJSON(w, http.StatusOK, v.file())
+	case "b2_copy_part":
+		src, dst := s.version(str("sourceFileId")), s.largeFile(str("largeFileId"))
+		if src == nil || dst == nil {
+			writeError(w, http.StatusBadRequest, "bad_request", "no such file")
+			return
+		}
+		var start, end int
+		if _, err := fmt.Sscanf(str("range"), "bytes=%d-%d", &start, &end); err != nil || end >= len(src.data) {
+			writeError(w, http.StatusBadRequest, "bad_request", "invalid range")
+			return
+		}
+		dst.parts[num("partNumber")] = src.data[start : end+1]
+		sum := sha1.Sum(src.data[start : end+1])
+		writeJSON(w, http.StatusOK, part{PartNumber: num("partNumber"), ContentLength: int64(end + 1 - start), ContentSha1: hex.EncodeToString(sum[:])})
+	case "b2_delete_file_version":
+		v := s.version(str("fileId"))
+		if v == nil || v.name != str("fileName") || v.action == "start" {
+			writeError(w, http.StatusBadRequest, "file_not_present", "file not present")
+			return
+		}
+		s.remove(v)
+		writeJSON(w, http.StatusOK, map[string]string{"fileId": v.id, "fileName": v.name})
+	case "b2_get_download_authorization":
+		writeJSON(w, http.StatusOK, map[string]string{"authorizationToken": "download-" + str("fileNamePrefix")})
+	default:
+		writeError(w, http.StatusBadRequest, "bad_request", "unsupported operation "+op)
+	}
+}
+
+func (s *b2Stub) authorizeAccount(w http.ResponseWriter, r *http.Request) {
+	if id, key, ok := r.BasicAuth(); !ok || id != stubKeyID || key != stubKey {
+		writeError(w, http.StatusUnauthorized, "unauthorized", "invalid application key")
+		return
+	}
+	s.tokens++
+	s.token = "token-" + strconv.Itoa(s.tokens)
+	writeJSON(w, http.StatusOK, map[string]any{
+		"accountId":               "stub-account",
+		"authorizationToken":      s.token,
+		"apiUrl":                  s.server.URL,
+		"downloadUrl":             s.server.URL,
+		"absoluteMinimumPartSize": s.minPartSize,
+		"allowed":                 map[string]any{"bucketId": nil, "bucketName": nil},
+	})
+}
+
+func (s *b2Stub) upload(w http.ResponseWriter, r *http.Request) {
+	name, err := url.PathUnescape(r.Header.Get("X-Bz-File-Name"))
+	if err != nil {
+		writeError(w, http.StatusBadRequest, "bad_request", err.Error())
+		return
+	}
+	data, ok := readChecked(w, r)
+	if !ok {
+		return
+	}
+	info := map[string]string{}
+	for k := range r.Header {
+		if strings.HasPrefix(k, "X-Bz-Info-") {
+			v, _ := url.PathUnescape(r.Header.Get(k))
+			info[strings.ToLower(strings.TrimPrefix(k, "X-Bz-Info-"))] = v
+		}
+	}
+	v := s.addVersion(name, "upload", r.Header.Get("Content-Type"), info, data)
+	writeJSON(w, http.StatusOK, v.file())
+}
+
+func (s *b2Stub) uploadPart(w http.ResponseWriter, r *http.Request) {
+	v := s.largeFile(strings.TrimPrefix(r.URL.Path, "/upload_part/"))
+	if v == nil {
+		writeError(w, http.StatusBadRequest, "bad_request", "no such large file")
+		return
+	}
+	n, err := strconv.Atoi(r.Header.Get("X-Bz-Part-Number"))
+	if err != nil || n < 1 || n > 10000 {
+		writeError(w, http.StatusBadRequest, "bad_request", "invalid part number")
+		return
+	}
+	data, ok := readChecked(w, r)
+	if !ok {
+		return
+	}
+	v.parts[n] = data
+	writeJSON(w, http.StatusOK, map[string]any{"fileId": v.id, "partNumber": n})
+}
+
+func (s *b2Stub) finishLargeFile(w http.ResponseWriter, fileID string, checksums any) {
+	v := s.largeFile(fileID)
+	if v == nil {
+		writeError(w, http.StatusBadRequest, "bad_request", "no such large file")
+		return
+	}
+	sums, _ := checksums.([]any)
+	numbers := sortedParts(v)
+	if len(numbers) < 2 || len(sums) != len(numbers) {
+		writeError(w, http.StatusBadRequest, "bad_request", fmt.Sprintf("large file has %d parts, %d checksums given", len(numbers), len(sums)))
+		return
+	}
+	var data []byte
+	for i, n := range numbers {
+		if n != i+1 {
+			writeError(w, http.StatusBadRequest, "bad_request", fmt.Sprintf("missing part %d", i+1))
+			return
+		}
+		p := v.parts[n]
+		if i < len(numbers)-1 && len(p) < s.minPartSize {
+			writeError(w, http.StatusBadRequest, "bad_request", fmt.Sprintf("part %d is too small", n))
+			return
+		}
+		sum := sha1.Sum(p)
+		if sums[i] != hex.EncodeToString(sum[:]) {
+			writeError(w, http.StatusBadRequest, "bad_request", fmt.Sprintf("checksum mismatch for part %d", n))
+			return
+		}
+		data = append(data, p...)
+	}
+	v.action = "upload"
+	v.data = data
+	v.parts = nil
+	writeJSON(w, http.StatusOK, v.file())
+}
+
+func (s *b2Stub) download(w http.ResponseWriter, r *http.Request) {
+	name := strings.TrimPrefix(r.URL.Path, "/file/"+stubBucket+"/")
+	if r.Header.Get("Authorization") != s.token || s.token == "" {
+		token := r.URL.Query().Get("Authorization")
+		if !strings.HasPrefix(token, "download-") || !strings.HasPrefix(name, strings.TrimPrefix(token, "download-")) {
+			writeError(w, http.StatusUnauthorized, "expired_auth_token", "authorization token expired")
+			return
+		}
+	}
+
+	v := s.latest(name)
+	if v == nil {
+		writeError(w, http.StatusNotFound, "not_found", "file not present: "+name)
+		return
+	}
+	data, status := v.data, http.StatusOK
+	if rng := r.Header.Get("Range"); rng != "" {
+		var offset int
+		if _, err := fmt.Sscanf(rng, "bytes=%d-", &offset); err != nil {
+			writeError(w, http.StatusBadRequest, "bad_request", err.Error())
+			return
+		}
+		if offset >= len(data) {
+			writeError(w, http.StatusRequestedRangeNotSatisfiable, "range_not_satisfiable", "range not satisfiable")
+			return
+		}
+		data, status = data[offset:], http.StatusPartialContent
+	}
+	w.Header().Set("Content-Type", v.contentType)
+	w.Header().Set("Content-Length", strconv.Itoa(len(data)))
+	w.Header().Set("X-Bz-File-Id", v.id)
+	w.WriteHeader(status)
+	if r.Method != http.MethodHead {
+		_, _ = w.Write(data)
+	}
+}
+
+func (s *b2Stub) listFileNames(w http.ResponseWriter, prefix, delimiter, start string, count int) {
+	var names []string
+	latest := map[string]*stubVersion{}
+	for _, v := range s.sorted() {
+		if v.action != "upload" || !strings.HasPrefix(v.name, prefix) || v.name < start {
+			continue
+		}
+		if _, ok := latest[v.name]; !ok {
+			latest[v.name] = v
+			names = append(names, v.name)
+		}
+	}
+
+	files := []file{}
+	var next any
+	for _, name := range names {
+		entry := latest[name].file()
+		if delimiter != "" {
+			if i := strings.Index(name[len(prefix):], delimiter); i >= 0 {
+				folder := name[:len(prefix)+i+1]
+				if len(files) > 0 && files[len(files)-1].FileName == folder {
+					continue
+				}
+				entry = file{FileName: folder, Action: "folder"}
+			}
+		}
+		if len(files) == count {
+			next = entry.FileName
+			break
+		}
+		files = append(files, entry)
+	}
+	writeJSON(w, http.StatusOK, map[string]any{"files": files, "nextFileName": next})
+}
+
+func (s *b2Stub) listFileVersions(w http.ResponseWriter, prefix, startName, startID string, count int) {
+	var versions []*stubVersion
+	for _, v := range s.sorted() {
+		if strings.HasPrefix(v.name, prefix) {
+			versions = append(versions, v)
+		}
+	}
+	i := sort.Search(len(versions), func(i int) bool { return versions[i].name >= startName })
+	if startID != "" {
+		for i < len(versions) && versions[i].id != startID {
+			i++
+		}
+	}
+	versions = versions[i:]
+
+	files := []file{}
+	var nextName, nextID any
+	for _, v := range versions {
+		if len(files) == count {
+			nextName, nextID = v.name, v.id
+			break
+		}
+		files = append(files, v.file())
+	}
+	writeJSON(w, http.StatusOK, map[string]any{"files": files, "nextFileName": nextName, "nextFileId": nextID})
+}
+
+func (s *b2Stub) addVersion(name, action, contentType string, info map[string]string, data []byte) *stubVersion {
+	s.nextID++
+	if info == nil {
+		info = map[string]string{}
+	}
+	v := &stubVersion{
+		id:          fmt.Sprintf("file-%06d", s.nextID),
+		name:        name,
+		action:      action,
+		contentType: contentType,
+		info:        info,
+		data:        data,
+		timestamp:   time.Now().UnixMilli(),
+	}
+	s.versions = append(s.versions, v)
+	return v
+}
+
+// sorted returns all versions sorted by name, newest first.
+func (s *b2Stub) sorted() []*stubVersion {
+	versions := append([]*stubVersion(nil), s.versions...)
+	sort.SliceStable(versions, func(i, j int) bool {
+		if versions[i].name != versions[j].name {
+			return versions[i].name < versions[j].name
+		}
+		return versions[i].id > versions[j].id
+	})
+	return versions
+}
+
+func (s *b2Stub) latest(name string) *stubVersion {
+	for _, v := range s.sorted() {
+		if v.name == name && v.action == "upload" {
+			return v
+		}
+	}
+	return nil
+}
+
+func (s *b2Stub) version(id string) *stubVersion {
+	for _, v := range s.versions {
+		if v.id == id {
+			return v
+		}
+	}
+	return nil
+}
+
+func (s *b2Stub) largeFile(id string) *stubVersion {
+	if v := s.version(id); v != nil && v.action == "start" {
+		return v
+	}
+	return nil
+}
+
+func (s *b2Stub) remove(v *stubVersion) {
+	for i, other := range s.versions {
+		if other == v {
+			s.versions = append(s.versions[:i], s.versions[i+1:]...)
+			return
+		}
+	}
+}
+
+func sortedParts(v *stubVersion) []int {
+	numbers := make([]int, 0, len(v.parts))
+	for n := range v.parts {
+		numbers = append(numbers, n)
+	}
+	sort.Ints(numbers)
+	return numbers
+}
+
+// readChecked reads the request body and verifies its SHA1 checksum.
+func readChecked(w http.ResponseWriter, r *http.Request) ([]byte, bool) {
+	data, err := io.ReadAll(r.Body)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, "bad_request", err.Error())
+		return nil, false
+	}
+	sum := sha1.Sum(data)
+	if r.Header.Get("X-Bz-Content-Sha1") != hex.EncodeToString(sum[:]) {
+		writeError(w, http.StatusBadRequest, "bad_request", "checksum did not match data received")
+		return nil, false
+	}
+	return data, true
+}
+
+func writeError(w http.ResponseWriter, status int, code, message string) {
+	writeJSON(w, status, &apiError{Status: status, Code: code, Message: message})
+}
+
+func writeJSON(w http.ResponseWriter, status int, v any) {
+	var buf bytes.Buffer
+	_ = json.NewEncoder(&buf).Encode(v)
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	_, _ = w.Write(buf.Bytes())
+}
@@ -0,0 +1,267 @@
+package b2
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"io"
+	"net/http"
+	"testing"
+
+	storagedriver "github.com/distribution/distribution/v3/registry/storage/driver"
+	"github.com/distribution/distribution/v3/registry/storage/driver/testsuites"
+)
+
+func TestB2DriverSuite(t *testing.T) {
+	stub := newB2Stub(t)
+	testsuites.Driver(t, func() (storagedriver.StorageDriver, error) {
+		return New(context.Background(), stub.driverParameters())
+	}, false)
+}
+
+func TestFromParameters(t *testing.T) {
+	valid := func() map[string]any {
+		return map[string]any{
+			"applicationkeyid": "id",
+			"applicationkey":   "key",
+			"bucket":           "bucket",
+		}
+	}
+
+	for _, tc := range []struct {
+		name    string
+		modify  func(map[string]any)
+		wantErr bool
+	}{
+		{name: "defaults", modify: func(map[string]any) {}},
+		{name: "missing key id", modify: func(p map[string]any) { delete(p, "applicationkeyid") }, wantErr: true},
+		{name: "missing key", modify: func(p map[string]any) { p["applicationkey"] = "" }, wantErr: true},
+		{name: "missing bucket", modify: func(p map[string]any) { delete(p, "bucket") }, wantErr: true},
+		{name: "chunksize string", modify: func(p map[string]any) { p["chunksize"] = "10485760" }},
+		{name: "chunksize too small", modify: func(p map[string]any) { p["chunksize"] = 1024 }, wantErr: true},
+		{name: "chunksize invalid", modify: func(p map[string]any) { p["chunksize"] = "big" }, wantErr: true},
+		{name: "with prefix", modify: func(p map[string]any) { p["rootdirectory"] = "/registry/" }},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			params := valid()
+			tc.modify(params)
+			_, err := FromParameters(context.Background(), params)
+			if tc.wantErr && err == nil {
+				t.Fatal("expected an error")
+			}
+			if !tc.wantErr && err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+		})
+	}
+}
+
+// TestWriterResumeLargeFile closes a writer in the middle of a large file,
+// resumes it and checks that the committed file is complete.
+func TestWriterResumeLargeFile(t *testing.T) {
+	stub := newB2Stub(t)
+	d := stub.newDriver()
+	ctx := context.Background()
+	path := "/upload/data"
+
+	contents := make([]byte, 3*d.chunkSize+1024)
+	if _, err := rand.Read(contents); err != nil {
+		t.Fatal(err)
+	}
+	first := contents[:d.chunkSize+d.chunkSize/2]
+
+	w, err := d.Writer(ctx, path, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := w.Write(first); err != nil {
+		t.Fatal(err)
+	}
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if w.Size() != int64(len(first)) {
+		t.Fatalf("size = %d, want %d", w.Size(), len(first))
+	}
+
+	// The upload session is not visible as a file.
+	if _, err := d.Stat(ctx, path); err == nil {
+		t.Fatal("expected the upload session to be hidden from Stat")
+	}
+	if _, err := d.Reader(ctx, path, 0); err == nil {
+		t.Fatal("expected the upload session to be hidden from Reader")
+	}
+
+	w, err = d.Writer(ctx, path, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if w.Size() != int64(len(first)) {
+		t.Fatalf("resumed size = %d, want %d", w.Size(), len(first))
+	}
+	if _, err := w.Write(contents[len(first):]); err != nil {
+		t.Fatal(err)
+	}
+	if err := w.Commit(ctx); err != nil {
+		t.Fatal(err)
+	}
+
+	got, err := d.GetContent(ctx, path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got, contents) {
+		t.Fatal("committed content does not match written content")
+	}
+	if n := stub.count("b2_finish_large_file"); n != 1 {
+		t.Fatalf("b2_finish_large_file called %d times, want 1", n)
+	}
+
+	// Only the committed version is kept.
+	versions := stub.fileVersions("root/upload/data")
+	if len(versions) != 1 || versions[0].action != "upload" || versions[0].contentType != blobContentType {
+		t.Fatalf("unexpected versions after commit: %d", len(versions))
+	}
+}
+
+// TestWriterCancel checks that cancelling a writer removes its upload
+// session and unfinished large file.
+func TestWriterCancel(t *testing.T) {
+	stub := newB2Stub(t)
+	d := stub.newDriver()
+	ctx := context.Background()
+
+	w, err := d.Writer(ctx, "/upload/cancel", false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := w.Write(make([]byte, 2*d.chunkSize)); err != nil {
+		t.Fatal(err)
+	}
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if n := len(stub.fileVersions("root/upload/cancel")); n != 2 {
+		t.Fatalf("expected an upload session and a large file, got %d versions", n)
+	}
+
+	w, err = d.Writer(ctx, "/upload/cancel", true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := w.Cancel(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if n := len(stub.fileVersions("root/upload/cancel")); n != 0 {
+		t.Fatalf("expected no versions after cancel, got %d", n)
+	}
+}
+
+// TestMoveLargeFile checks that files too large for b2_copy_file are copied
+// part by part.
+func TestMoveLargeFile(t *testing.T) {
+	stub := newB2Stub(t)
+	stub.minPartSize = 1024
+	d := stub.newDriver()
+	d.copyPartSize = 1024
+	ctx := context.Background()
+
+	contents := make([]byte, 2500)
+	if _, err := rand.Read(contents); err != nil {
+		t.Fatal(err)
+	}
+	if err := d.PutContent(ctx, "/src", contents); err != nil {
+		t.Fatal(err)
+	}
+	if err := d.Move(ctx, "/src", "/dst"); err != nil {
+		t.Fatal(err)
+	}
+
+	if n := stub.count("b2_copy_part"); n != 3 {
+		t.Fatalf("b2_copy_part called %d times, want 3", n)
+	}
+	got, err := d.GetContent(ctx, "/dst")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got, contents) {
+		t.Fatal("moved content does not match")
+	}
+	if _, err := d.Stat(ctx, "/src"); err == nil {
+		t.Fatal("expected the source to be removed")
+	}
+}
+
+// TestExpiredAuthToken checks that the account is authorized again once its
+// authorization token expires.
+func TestExpiredAuthToken(t *testing.T) {
+	stub := newB2Stub(t)
+	d := stub.newDriver()
+	ctx := context.Background()
+
+	if err := d.PutContent(ctx, "/file", []byte("content")); err != nil {
+		t.Fatal(err)
+	}
+	stub.expireToken()
+	got, err := d.GetContent(ctx, "/file")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(got) != "content" {
+		t.Fatalf("content = %q", got)
+	}
+	if n := stub.count("b2_authorize_account"); n != 2 {
+		t.Fatalf("b2_authorize_account called %d times, want 2", n)
+	}
+}
+
+// TestRetryServiceUnavailable checks that uploads are retried with a new
+// upload URL when B2 is busy.
+func TestRetryServiceUnavailable(t *testing.T) {
+	stub := newB2Stub(t)
+	d := stub.newDriver()
+	ctx := context.Background()
+
+	failures := 2
+	stub.failHook = func(op string) *apiError {
+		if op == "upload" && failures > 0 {
+			failures--
+			return &apiError{Status: http.StatusServiceUnavailable, Code: "service_unavailable", Message: "busy"}
+		}
+		return nil
+	}
+	if err := d.PutContent(ctx, "/file", []byte("content")); err != nil {
+		t.Fatal(err)
+	}
+	if n := stub.count("b2_get_upload_url"); n != 3 {
+		t.Fatalf("b2_get_upload_url called %d times, want 3", n)
+	}
+}
+
+func TestRedirectURL(t *testing.T) {
+	stub := newB2Stub(t)
+	d := stub.newDriver()
+	ctx := context.Background()
+
+	if err := d.PutContent(ctx, "/blob", []byte("content")); err != nil {
+		t.Fatal(err)
+	}
+	u, err := d.RedirectURL(&http.Request{Method: http.MethodGet}, "/blob")
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp, err := http.Get(u)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	got, _ := io.ReadAll(resp.Body)
+	if resp.StatusCode != http.StatusOK || string(got) != "content" {
+		t.Fatalf("redirect got %d %q", resp.StatusCode, got)
+	}
+
+	u, err = d.RedirectURL(&http.Request{Method: http.MethodPut}, "/blob")
+	if err != nil || u != "" {
+		t.Fatalf("expected no redirect for PUT, got %q, %v", u, err)
+	}
+}
@@ -0,0 +1,622 @@
+package b2
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha1"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"math/rand"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	apiVersion = "b2api/v2"
+
+	// maxFileCount is the largest page size accepted by the list calls.
+	maxFileCount = 1000
+
+	maxTries = 5
+)
+
+// apiError is an error returned by the B2 API.
+type apiError struct {
+	Status  int    `json:"status"`
+	Code    string `json:"code"`
+	Message string `json:"message"`
+}
+
+func (e *apiError) Error() string {
+	return fmt.Sprintf("b2: %d %s: %s", e.Status, e.Code, e.Message)
+}
+
+// isNotFound reports whether err means that the requested file does not exist.
+func isNotFound(err error) bool {
+	var apiErr *apiError
+	if !errors.As(err, &apiErr) {
+		return false
+	}
+	return apiErr.Status == http.StatusNotFound || apiErr.Code == "not_found" || apiErr.Code == "file_not_present"
+}
+
+// authorization is the result of b2_authorize_account.
+type authorization struct {
+	AccountID               string `json:"accountId"`
+	AuthorizationToken      string `json:"authorizationToken"`
+	APIURL                  string `json:"apiUrl"`
+	DownloadURL             string `json:"downloadUrl"`
+	AbsoluteMinimumPartSize int64  `json:"absoluteMinimumPartSize"`
+	Allowed                 struct {
+		BucketID   string `json:"bucketId"`
+		BucketName string `json:"bucketName"`
+	} `json:"allowed"`
+
+	// bucketID is the ID of the configured bucket, resolved after
+	// authorizing.
+	bucketID string
+}
+
+// file describes a version of a file stored in B2.
+type file struct {
+	FileID          string            `json:"fileId"`
+	FileName        string            `json:"fileName"`
+	Action          string            `json:"action"`
+	ContentLength   int64             `json:"contentLength"`
+	ContentType     string            `json:"contentType"`
+	FileInfo        map[string]string `json:"fileInfo"`
+	UploadTimestamp int64             `json:"uploadTimestamp"`
+}
+
+// part describes an uploaded part of an unfinished large file.
+type part struct {
+	PartNumber    int    `json:"partNumber"`
+	ContentLength int64  `json:"contentLength"`
+	ContentSha1   string `json:"contentSha1"`
+}
+
+// uploadURL is an upload endpoint along with the token authorizing it. An
+// upload URL may only be used by one upload at a time.
+type uploadURL struct {
+	URL   string `json:"uploadUrl"`
+	Token string `json:"authorizationToken"`
+}
+
+// client is a minimal client of the B2 native API.
+type client struct {
+	httpClient *http.Client
+	authURL    string
+	keyID      string
+	key        string
+	bucketName string
+
+	// backoff is the delay before the first retry of a failed request.
+	backoff time.Duration
+
+	mu         sync.Mutex
+	auth       *authorization
+	uploadURLs []*uploadURL
+}
+
+func newClient(httpClient *http.Client, authURL, keyID, key, bucketName string) *client {
+	if httpClient == nil {
+		httpClient = http.DefaultClient
+	}
+	return &client{
+		httpClient: httpClient,
+		authURL:    strings.TrimRight(authURL, "/"),
+		keyID:      keyID,
+		key:        key,
+		bucketName: bucketName,
+		backoff:    time.Second,
+	}
+}
+
+// authorization returns the current account authorization, authorizing the
+// account and resolving the bucket ID if needed.
+func (c *client) authorization(ctx context.Context) (*authorization, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.auth != nil {
+		return c.auth, nil
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, c.authURL+"/"+apiVersion+"/b2_authorize_account", nil)
+	if err != nil {
+		return nil, err
+	}
+	req.SetBasicAuth(c.keyID, c.key)
+	auth := &authorization{}
+	if err := c.do(req, auth); err != nil {
+		return nil, err
+	}
+	auth.APIURL = strings.TrimRight(auth.APIURL, "/")
+	auth.DownloadURL = strings.TrimRight(auth.DownloadURL, "/")
+
+	if auth.Allowed.BucketID != "" {
+		// The application key is restricted to a single bucket.
+		if auth.Allowed.BucketName != c.bucketName {
+			return nil, fmt.Errorf("b2: application key is restricted to bucket %q", auth.Allowed.BucketName)
+		}
+		auth.bucketID = auth.Allowed.BucketID
+	} else {
+		var buckets struct {
+			Buckets []struct {
+				BucketID   string `json:"bucketId"`
+				BucketName string `json:"bucketName"`
+			} `json:"buckets"`
+		}
+		err := c.post(ctx, auth, "b2_list_buckets", map[string]any{
+			"accountId":  auth.AccountID,
+			"bucketName": c.bucketName,
+		}, &buckets)
+		if err != nil {
+			return nil, err
+		}
+		for _, b := range buckets.Buckets {
+			if b.BucketName == c.bucketName {
+				auth.bucketID = b.BucketID
+			}
+		}
+		if auth.bucketID == "" {
+			return nil, fmt.Errorf("b2: bucket %q does not exist", c.bucketName)
+		}
+	}
+
+	c.auth = auth
+	c.uploadURLs = nil
+	return auth, nil
+}
+
+// deauthorize discards auth so the next request authorizes again.
+func (c *client) deauthorize(auth *authorization) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.auth == auth {
+		c.auth = nil
+		c.uploadURLs = nil
+	}
+}
+
+// retry calls fn until it succeeds, fails with an error that cannot be
+// retried, or maxTries is reached. Expired authorizations are renewed.
+func (c *client) retry(ctx context.Context, fn func(auth *authorization) error) error {
+	backoff := c.backoff
+	var err error
+	for range maxTries {
+		var auth *authorization
+		auth, err = c.authorization(ctx)
+		if err != nil {
+			return err
+		}
+		err = fn(auth)
+		if err == nil {
+			return nil
+		}
+
+		var apiErr *apiError
+		if errors.As(err, &apiErr) {
+			switch {
+			case apiErr.Status == http.StatusUnauthorized && (apiErr.Code == "expired_auth_token" || apiErr.Code == "bad_auth_token"):
+				c.deauthorize(auth)
+				continue
+			case apiErr.Status == http.StatusRequestTimeout,
+				apiErr.Status == http.StatusTooManyRequests,
+				apiErr.Status >= http.StatusInternalServerError:
+			default:
+				return err
+			}
+		} else if ctx.Err() != nil {
+			return err
+		} else if _, ok := err.(*url.Error); !ok {
+			return err
+		}
+
+		select {
+		case <-ctx.Done():
+			return err
+		case <-time.After(backoff + time.Duration(rand.Int63n(int64(backoff)/2+1))):
+		}
+		backoff *= 2
+	}
+	return err
+}
+
+// do sends req and decodes the JSON response into v, if v is not nil.
+func (c *client) do(req *http.Request, v any) error {
+	resp, err := c.httpClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return decodeError(resp)
+	}
+	if v == nil {
+		_, err = io.Copy(io.Discard, resp.Body)
+		return err
+	}
+	return json.NewDecoder(resp.Body).Decode(v)
+}
+
+// decodeError returns the apiError described by a failed response.
+func decodeError(resp *http.Response) error {
+	apiErr := &apiError{}
+	body, _ := io.ReadAll(io.LimitReader(resp.Body, 64*1024))
+	if err := json.Unmarshal(body, apiErr); err != nil || apiErr.Status == 0 {
+		apiErr.Status = resp.StatusCode
+		apiErr.Message = strings.TrimSpace(string(body))
+	}
+	return apiErr
+}
+
+// post calls the API operation op with the JSON request body in and decodes
+// the response into out.
+func (c *client) post(ctx context.Context, auth *authorization, op string, in, out any) error {
+	body, err := json.Marshal(in)
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, auth.APIURL+"/"+apiVersion+"/"+op, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Authorization", auth.AuthorizationToken)
+	req.Header.Set("Content-Type", "application/json")
+	return c.do(req, out)
+}
+
+// call calls the API operation op, retrying as needed.
+func (c *client) call(ctx context.Context, op string, in func(auth *authorization) any, out any) error {
+	return c.retry(ctx, func(auth *authorization) error {
+		return c.post(ctx, auth, op, in(auth), out)
+	})
+}
+
+// listFileNames lists the names of files starting with prefix, beginning at
+// start. With a delimiter, files beyond it are rolled up into folders.
+func (c *client) listFileNames(ctx context.Context, prefix, delimiter, start string, count int) ([]file, string, error) {
+	var resp struct {
+		Files        []file  `json:"files"`
+		NextFileName *string `json:"nextFileName"`
+	}
+	err := c.call(ctx, "b2_list_file_names", func(auth *authorization) any {
+		req := map[string]any{
+			"bucketId":     auth.bucketID,
+			"prefix":       prefix,
+			"maxFileCount": count,
+		}
+		if delimiter != "" {
+			req["delimiter"] = delimiter
+		}
+		if start != "" {
+			req["startFileName"] = start
+		}
+		return req
+	}, &resp)
+	if err != nil {
+		return nil, "", err
+	}
+	var next string
+	if resp.NextFileName != nil {
+		next = *resp.NextFileName
+	}
+	return resp.Files, next, nil
+}
+
+// listFileVersions lists all versions of the files starting with prefix,
+// beginning at startName and startID. This includes unfinished large files.
+func (c *client) listFileVersions(ctx context.Context, prefix, startName, startID string) ([]file, string, string, error) {
+	var resp struct {
+		Files        []file  `json:"files"`
+		NextFileName *string `json:"nextFileName"`
+		NextFileID   *string `json:"nextFileId"`
+	}
+	err := c.call(ctx, "b2_list_file_versions", func(auth *authorization) any {
+		req := map[string]any{
+			"bucketId":     auth.bucketID,
+			"prefix":       prefix,
+			"maxFileCount": maxFileCount,
+		}
+		if startName != "" {
+			req["startFileName"] = startName
+		}
+		if startID != "" {
+			req["startFileId"] = startID
+		}
+		return req
+	}, &resp)
+	if err != nil {
+		return nil, "", "", err
+	}
+	var nextName, nextID string
+	if resp.NextFileName != nil {
+		nextName = *resp.NextFileName
+	}
+	if resp.NextFileID != nil {
+		nextID = *resp.NextFileID
+	}
+	return resp.Files, nextName, nextID, nil
+}
+
+// getUploadURL returns an idle upload URL for the bucket.
+func (c *client) getUploadURL(ctx context.Context, auth *authorization) (*uploadURL, error) {
+	c.mu.Lock()
+	if n := len(c.uploadURLs); n > 0 && c.auth == auth {
+		u := c.uploadURLs[n-1]
+		c.uploadURLs = c.uploadURLs[:n-1]
+		c.mu.Unlock()
+		return u, nil
+	}
+	c.mu.Unlock()
+
+	u := &uploadURL{}
+	err := c.post(ctx, auth, "b2_get_upload_url", map[string]any{"bucketId": auth.bucketID}, u)
+	return u, err
+}
+
+// putUploadURL returns an upload URL to the idle pool once its upload
+// has succeeded.
+func (c *client) putUploadURL(auth *authorization, u *uploadURL) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.auth == auth {
+		c.uploadURLs = append(c.uploadURLs, u)
+	}
+}
+
+// uploadFile stores data as a new version of the file name.
+func (c *client) uploadFile(ctx context.Context, name, contentType string, info map[string]string, data []byte) (*file, error) {
+	sum := sha1.Sum(data)
+	f := &file{}
+	err := c.retry(ctx, func(auth *authorization) error {
+		u, err := c.getUploadURL(ctx, auth)
+		if err != nil {
+			return err
+		}
+		req, err := http.NewRequestWithContext(ctx, http.MethodPost, u.URL, bytes.NewReader(data))
+		if err != nil {
+			return err
+		}
+		req.ContentLength = int64(len(data))
+		req.Header.Set("Authorization", u.Token)
+		req.Header.Set("X-Bz-File-Name", escapeName(name))
+		req.Header.Set("Content-Type", contentType)
+		req.Header.Set("X-Bz-Content-Sha1", hex.EncodeToString(sum[:]))
+		for k, v := range info {
+			req.Header.Set("X-Bz-Info-"+k, url.PathEscape(v))
+		}
+		if err := c.do(req, f); err != nil {
+			// Failed upload URLs are discarded, as recommended by B2.
+			return err
+		}
+		c.putUploadURL(auth, u)
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return f, nil
+}
+
+// startLargeFile starts a large file upload to name.
+func (c *client) startLargeFile(ctx context.Context, name, contentType string) (*file, error) {
+	f := &file{}
+	err := c.call(ctx, "b2_start_large_file", func(auth *authorization) any {
+		return map[string]any{
+			"bucketId":    auth.bucketID,
+			"fileName":    name,
+			"contentType": contentType,
+		}
+	}, f)
+	if err != nil {
+		return nil, err
+	}
+	return f, nil
+}
+
+// getUploadPartURL returns an upload URL for the parts of a large file.
+func (c *client) getUploadPartURL(ctx context.Context, fileID string) (*uploadURL, error) {
+	u := &uploadURL{}
+	err := c.call(ctx, "b2_get_upload_part_url", func(*authorization) any {
+		return map[string]any{"fileId": fileID}
+	}, u)
+	if err != nil {
+		return nil, err
+	}
+	return u, nil
+}
+
+// uploadPart uploads data as part partNumber of the large file fileID and
+// returns its SHA1 checksum. u is the part upload URL to use; it is
+// replaced if it fails.
+func (c *client) uploadPart(ctx context.Context, u **uploadURL, fileID string, partNumber int, data []byte) (string, error) {
+	sum := sha1.Sum(data)
+	checksum := hex.EncodeToString(sum[:])
+	err := c.retry(ctx, func(*authorization) error {
+		if *u == nil {
+			pu, err := c.getUploadPartURL(ctx, fileID)
+			if err != nil {
+				return err
+			}
+			*u = pu
+		}
+		req, err := http.NewRequestWithContext(ctx, http.MethodPost, (*u).URL, bytes.NewReader(data))
+		if err != nil {
+			return err
+		}
+		req.ContentLength = int64(len(data))
+		req.Header.Set("Authorization", (*u).Token)
+		req.Header.Set("X-Bz-Part-Number", strconv.Itoa(partNumber))
+		req.Header.Set("X-Bz-Content-Sha1", checksum)
+		if err := c.do(req, nil); err != nil {
+			*u = nil
+			return err
+		}
+		return nil
+	})
+	return checksum, err
+}
+
+// copyPart copies the byte range [start, end] of the file sourceID into part
+// partNumber of the large file fileID and returns its SHA1 checksum.
+func (c *client) copyPart(ctx context.Context, sourceID, fileID string, partNumber int, start, end int64) (string, error) {
+	var p part
+	err := c.call(ctx, "b2_copy_part", func(*authorization) any {
+		return map[string]any{
+			"sourceFileId": sourceID,
+			"largeFileId":  fileID,
+			"partNumber":   partNumber,
+			"range":        fmt.Sprintf("bytes=%d-%d", start, end),
+		}
+	}, &p)
+	return p.ContentSha1, err
+}
+
+// listParts lists the parts uploaded to the large file fileID, in order.
+func (c *client) listParts(ctx context.Context, fileID string) ([]part, error) {
+	var (
+		parts []part
+		start int
+	)
+	for {
+		var resp struct {
+			Parts          []part `json:"parts"`
+			NextPartNumber *int   `json:"nextPartNumber"`
+		}
+		err := c.call(ctx, "b2_list_parts", func(*authorization) any {
+			req := map[string]any{
+				"fileId":       fileID,
+				"maxPartCount": maxFileCount,
+			}
+			if start > 0 {
+				req["startPartNumber"] = start
+			}
+			return req
+		}, &resp)
+		if err != nil {
+			return nil, err
+		}
+		parts = append(parts, resp.Parts...)
+		if resp.NextPartNumber == nil {
+			return parts, nil
+		}
+		start = *resp.NextPartNumber
+	}
+}
+
+// finishLargeFile assembles the uploaded parts of the large file fileID.
+func (c *client) finishLargeFile(ctx context.Context, fileID string, checksums []string) (*file, error) {
+	f := &file{}
+	err := c.call(ctx, "b2_finish_large_file", func(*authorization) any {
+		return map[string]any{
+			"fileId":        fileID,
+			"partSha1Array": checksums,
+		}
+	}, f)
+	if err != nil {
+		return nil, err
+	}
+	return f, nil
+}
+
+// cancelLargeFile cancels the large file upload fileID and discards its parts.
+func (c *client) cancelLargeFile(ctx context.Context, fileID string) error {
+	return c.call(ctx, "b2_cancel_large_file", func(*authorization) any {
+		return map[string]any{"fileId": fileID}
+	}, nil)
+}
+
+// copyFile copies the file sourceID to name, keeping its content type and
+// file info.
+func (c *client) copyFile(ctx context.Context, sourceID, name string) (*file, error) {
+	f := &file{}
+	err := c.call(ctx, "b2_copy_file", func(*authorization) any {
+		return map[string]any{
+			"sourceFileId":      sourceID,
+			"fileName":          name,
+			"metadataDirective": "COPY",
+		}
+	}, f)
+	if err != nil {
+		return nil, err
+	}
+	return f, nil
+}
+
+// deleteFileVersion deletes one version of the file name.
+func (c *client) deleteFileVersion(ctx context.Context, name, fileID string) error {
+	return c.call(ctx, "b2_delete_file_version", func(*authorization) any {
+		return map[string]any{
+			"fileName": name,
+			"fileId":   fileID,
+		}
+	}, nil)
+}
+
+// downloadFile downloads the latest version of the file name from offset
+// onwards. The caller must close the body of the returned response.
+func (c *client) downloadFile(ctx context.Context, name string, offset int64) (*http.Response, error) {
+	var resp *http.Response
+	err := c.retry(ctx, func(auth *authorization) error {
+		req, err := http.NewRequestWithContext(ctx, http.MethodGet, c.downloadURL(auth, name), nil)
+		if err != nil {
+			return err
+		}
+		req.Header.Set("Authorization", auth.AuthorizationToken)
+		if offset > 0 {
+			req.Header.Set("Range", fmt.Sprintf("bytes=%d-", offset))
+		}
+		r, err := c.httpClient.Do(req)
+		if err != nil {
+			return err
+		}
+		if r.StatusCode != http.StatusOK && r.StatusCode != http.StatusPartialContent {
+			defer r.Body.Close()
+			return decodeError(r)
+		}
+		resp = r
+		return nil
+	})
+	return resp, err
+}
+
+// downloadURL returns the URL to download the file name from.
+func (c *client) downloadURL(auth *authorization, name string) string {
+	return auth.DownloadURL + "/file/" + url.PathEscape(c.bucketName) + "/" + escapeName(name)
+}
+
+// downloadAuthorization returns a URL to download the file name which is
+// authorized for the given duration.
+func (c *client) downloadAuthorization(ctx context.Context, name string, expiry time.Duration) (string, error) {
+	var (
+		resp struct {
+			AuthorizationToken string `json:"authorizationToken"`
+		}
+		downloadURL string
+	)
+	err := c.retry(ctx, func(auth *authorization) error {
+		downloadURL = c.downloadURL(auth, name)
+		return c.post(ctx, auth, "b2_get_download_authorization", map[string]any{
+			"bucketId":               auth.bucketID,
+			"fileNamePrefix":         name,
+			"validDurationInSeconds": int(expiry.Seconds()),
+		}, &resp)
+	})
+	if err != nil {
+		return "", err
+	}
+	return downloadURL + "?Authorization=" + url.QueryEscape(resp.AuthorizationToken), nil
+}
+
+// escapeName percent-encodes a file name for use in headers and URLs.
+func escapeName(name string) string {
+	return strings.ReplaceAll(url.PathEscape(name), "%2F", "/")
+}
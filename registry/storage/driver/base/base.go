@@ -53,8 +53,22 @@ import (
 	"go.opentelemetry.io/otel/trace"
 )
 
-// storageAction is the metrics of blob related operations
-var storageAction = prometheus.StorageNamespace.NewLabeledTimer("action", "The number of seconds that the storage action takes", "driver", "action")
+var (
+	// storageAction is the metrics of blob related operations
+	storageAction = prometheus.StorageNamespace.NewLabeledTimer("action", "The number of seconds that the storage action takes", "driver", "action", "outcome")
+
+	// bytesRead and bytesWritten count the bytes read from and written to
+	// the storage.
+	bytesRead    = prometheus.StorageNamespace.NewLabeledCounter("read_bytes", "The number of bytes read from the storage", "driver")
+	bytesWritten = prometheus.StorageNamespace.NewLabeledCounter("written_bytes", "The number of bytes written to the storage", "driver")
+)
+
+// The outcomes of the storage actions.
+const (
+	outcomeSuccess  = "success"
+	outcomeNotFound = "notfound"
+	outcomeError    = "error"
+)
 
 // tracer is the OpenTelemetry tracer utilized for tracing operations within
 // this package's code.
@@ -70,6 +84,20 @@ type Base struct {
 	storagedriver.StorageDriver
 }
 
+// observe records the duration of the action started at start, by its
+// outcome.
+func (base *Base) observe(action string, start time.Time, err error) {
+	outcome := outcomeSuccess
+	switch err.(type) {
+	case nil:
+	case storagedriver.PathNotFoundError:
+		outcome = outcomeNotFound
+	default:
+		outcome = outcomeError
+	}
+	storageAction.WithValues(base.Name(), action, outcome).UpdateSince(start)
+}
+
 // Format errors received from the storage driver
 func (base *Base) setDriverName(e error) error {
 	switch actual := e.(type) {
@@ -87,6 +115,9 @@ func (base *Base) setDriverName(e error) error {
 	case storagedriver.InvalidOffsetError:
 		actual.DriverName = base.StorageDriver.Name()
 		return actual
+	case storagedriver.RetryableError:
+		actual.DriverName = base.StorageDriver.Name()
+		return actual
 	default:
 		return storagedriver.Error{
 			DriverName: base.StorageDriver.Name(),
@@ -114,8 +145,10 @@ func (base *Base) GetContent(ctx context.Context, path string) ([]byte, error) {
 
 	start := time.Now()
 	b, e := base.StorageDriver.GetContent(ctx, path)
-	storageAction.WithValues(base.Name(), "GetContent").UpdateSince(start)
-	return b, base.setDriverName(e)
+	e = base.setDriverName(e)
+	base.observe("GetContent", start, e)
+	bytesRead.WithValues(base.Name()).Inc(float64(len(b)))
+	return b, e
 }
 
 // PutContent wraps PutContent of underlying storage driver.
@@ -138,7 +171,10 @@ func (base *Base) PutContent(ctx context.Context, path string, content []byte) e
 
 	start := time.Now()
 	err := base.setDriverName(base.StorageDriver.PutContent(ctx, path, content))
-	storageAction.WithValues(base.Name(), "PutContent").UpdateSince(start)
+	base.observe("PutContent", start, err)
+	if err == nil {
+		bytesWritten.WithValues(base.Name()).Inc(float64(len(content)))
+	}
 	return err
 }
 
@@ -164,8 +200,14 @@ func (base *Base) Reader(ctx context.Context, path string, offset int64) (io.Rea
 		return nil, storagedriver.InvalidPathError{Path: path, DriverName: base.StorageDriver.Name()}
 	}
 
+	start := time.Now()
 	rc, e := base.StorageDriver.Reader(ctx, path, offset)
-	return rc, base.setDriverName(e)
+	e = base.setDriverName(e)
+	base.observe("Reader", start, e)
+	if e != nil {
+		return nil, e
+	}
+	return &countingReader{ReadCloser: rc, driver: base.Name()}, nil
 }
 
 // Writer wraps Writer of underlying storage driver.
@@ -186,8 +228,14 @@ func (base *Base) Writer(ctx context.Context, path string, append bool) (storage
 		return nil, storagedriver.InvalidPathError{Path: path, DriverName: base.StorageDriver.Name()}
 	}
 
+	start := time.Now()
 	writer, e := base.StorageDriver.Writer(ctx, path, append)
-	return writer, base.setDriverName(e)
+	e = base.setDriverName(e)
+	base.observe("Writer", start, e)
+	if e != nil {
+		return nil, e
+	}
+	return &countingWriter{FileWriter: writer, base: base}, nil
 }
 
 // Stat wraps Stat of underlying storage driver.
@@ -209,8 +257,9 @@ func (base *Base) Stat(ctx context.Context, path string) (storagedriver.FileInfo
 
 	start := time.Now()
 	fi, e := base.StorageDriver.Stat(ctx, path)
-	storageAction.WithValues(base.Name(), "Stat").UpdateSince(start)
-	return fi, base.setDriverName(e)
+	e = base.setDriverName(e)
+	base.observe("Stat", start, e)
+	return fi, e
 }
 
 // List wraps List of underlying storage driver.
@@ -232,8 +281,9 @@ func (base *Base) List(ctx context.Context, path string) ([]string, error) {
 
 	start := time.Now()
 	str, e := base.StorageDriver.List(ctx, path)
-	storageAction.WithValues(base.Name(), "List").UpdateSince(start)
-	return str, base.setDriverName(e)
+	e = base.setDriverName(e)
+	base.observe("List", start, e)
+	return str, e
 }
 
 // Move wraps Move of underlying storage driver.
@@ -261,7 +311,7 @@ func (base *Base) Move(ctx context.Context, sourcePath string, destPath string)
 
 	start := time.Now()
 	err := base.setDriverName(base.StorageDriver.Move(ctx, sourcePath, destPath))
-	storageAction.WithValues(base.Name(), "Move").UpdateSince(start)
+	base.observe("Move", start, err)
 	return err
 }
 
@@ -284,10 +334,55 @@ func (base *Base) Delete(ctx context.Context, path string) error {
 
 	start := time.Now()
 	err := base.setDriverName(base.StorageDriver.Delete(ctx, path))
-	storageAction.WithValues(base.Name(), "Delete").UpdateSince(start)
+	base.observe("Delete", start, err)
 	return err
 }
 
+// DeleteBatch wraps DeleteBatch of the underlying storage driver, returning
+// ErrUnsupportedMethod if it does not implement BatchDeleter.
+func (base *Base) DeleteBatch(ctx context.Context, paths []string) ([]error, error) {
+	attrs := []attribute.KeyValue{
+		attribute.String(tracing.AttributePrefix+"storage.driver.name", base.Name()),
+		attribute.Int(tracing.AttributePrefix+"storage.paths", len(paths)),
+	}
+	ctx, span := tracer.Start(
+		ctx,
+		"DeleteBatch",
+		trace.WithAttributes(attrs...))
+
+	defer span.End()
+
+	bd, ok := base.StorageDriver.(storagedriver.BatchDeleter)
+	if !ok {
+		return nil, storagedriver.ErrUnsupportedMethod{DriverName: base.StorageDriver.Name()}
+	}
+
+	// The invalid paths are not deleted along with the others.
+	errs := make([]error, len(paths))
+	valid := make([]string, 0, len(paths))
+	indexes := make([]int, 0, len(paths))
+	for i, path := range paths {
+		if !storagedriver.PathRegexp.MatchString(path) {
+			errs[i] = storagedriver.InvalidPathError{Path: path, DriverName: base.StorageDriver.Name()}
+			continue
+		}
+		valid = append(valid, path)
+		indexes = append(indexes, i)
+	}
+
+	start := time.Now()
+	validErrs, err := bd.DeleteBatch(ctx, valid)
+	err = base.setDriverName(err)
+	base.observe("DeleteBatch", start, err)
+	if err != nil {
+		return nil, err
+	}
+	for j, e := range validErrs {
+		errs[indexes[j]] = base.setDriverName(e)
+	}
+	return errs, nil
+}
+
 // RedirectURL wraps RedirectURL of the underlying storage driver.
 func (base *Base) RedirectURL(r *http.Request, path string) (string, error) {
 	attrs := []attribute.KeyValue{
@@ -307,8 +402,9 @@ func (base *Base) RedirectURL(r *http.Request, path string) (string, error) {
 
 	start := time.Now()
 	str, e := base.StorageDriver.RedirectURL(r.WithContext(ctx), path)
-	storageAction.WithValues(base.Name(), "RedirectURL").UpdateSince(start)
-	return str, base.setDriverName(e)
+	e = base.setDriverName(e)
+	base.observe("RedirectURL", start, e)
+	return str, e
 }
 
 // Walk wraps Walk of underlying storage driver.
@@ -328,5 +424,112 @@ func (base *Base) Walk(ctx context.Context, path string, f storagedriver.WalkFn,
 		return storagedriver.InvalidPathError{Path: path, DriverName: base.StorageDriver.Name()}
 	}
 
-	return base.setDriverName(base.StorageDriver.Walk(ctx, path, f, options...))
+	start := time.Now()
+	err := base.setDriverName(base.StorageDriver.Walk(ctx, path, f, options...))
+	base.observe("Walk", start, err)
+	return err
+}
+
+// Usage wraps Usage of underlying storage driver, returning
+// ErrUnsupportedMethod if it does not implement UsageReporter.
+func (base *Base) Usage(ctx context.Context, path string) (int64, int64, error) {
+	attrs := []attribute.KeyValue{
+		attribute.String(tracing.AttributePrefix+"storage.driver.name", base.Name()),
+		attribute.String(tracing.AttributePrefix+"storage.path", path),
+	}
+	ctx, span := tracer.Start(
+		ctx,
+		"Usage",
+		trace.WithAttributes(attrs...))
+
+	defer span.End()
+
+	if !storagedriver.PathRegexp.MatchString(path) && path != "/" {
+		return 0, 0, storagedriver.InvalidPathError{Path: path, DriverName: base.StorageDriver.Name()}
+	}
+
+	ur, ok := base.StorageDriver.(storagedriver.UsageReporter)
+	if !ok {
+		return 0, 0, storagedriver.ErrUnsupportedMethod{DriverName: base.StorageDriver.Name()}
+	}
+
+	start := time.Now()
+	bytes, objects, e := ur.Usage(ctx, path)
+	e = base.setDriverName(e)
+	base.observe("Usage", start, e)
+	return bytes, objects, e
+}
+
+// FilePathForContent wraps FilePathForContent of the underlying storage
+// driver, returning ErrUnsupportedMethod if it does not implement
+// FilePathResolver. The bytes read from the file are not counted as read
+// from the storage.
+func (base *Base) FilePathForContent(path string) (string, error) {
+	if !storagedriver.PathRegexp.MatchString(path) {
+		return "", storagedriver.InvalidPathError{Path: path, DriverName: base.StorageDriver.Name()}
+	}
+
+	fr, ok := base.StorageDriver.(storagedriver.FilePathResolver)
+	if !ok {
+		return "", storagedriver.ErrUnsupportedMethod{DriverName: base.StorageDriver.Name()}
+	}
+
+	filePath, err := fr.FilePathForContent(path)
+	return filePath, base.setDriverName(err)
+}
+
+// Close wraps Close of the underlying storage driver, if it implements Closer.
+func (base *Base) Close() error {
+	c, ok := base.StorageDriver.(storagedriver.Closer)
+	if !ok {
+		return nil
+	}
+	return base.setDriverName(c.Close())
+}
+
+// countingReader counts the bytes read from the storage, adding them up
+// when it is closed.
+type countingReader struct {
+	io.ReadCloser
+	driver string
+	n      int64
+}
+
+func (r *countingReader) Read(p []byte) (int, error) {
+	n, err := r.ReadCloser.Read(p)
+	r.n += int64(n)
+	return n, err
+}
+
+func (r *countingReader) Close() error {
+	bytesRead.WithValues(r.driver).Inc(float64(r.n))
+	r.n = 0
+	return r.ReadCloser.Close()
+}
+
+// countingWriter counts the bytes written to the storage, adding them up
+// when it is closed, and records the duration of its commit.
+type countingWriter struct {
+	storagedriver.FileWriter
+	base *Base
+	n    int64
+}
+
+func (w *countingWriter) Write(p []byte) (int, error) {
+	n, err := w.FileWriter.Write(p)
+	w.n += int64(n)
+	return n, err
+}
+
+func (w *countingWriter) Commit(ctx context.Context) error {
+	start := time.Now()
+	err := w.FileWriter.Commit(ctx)
+	w.base.observe("Writer.Commit", start, err)
+	return err
+}
+
+func (w *countingWriter) Close() error {
+	bytesWritten.WithValues(w.base.Name()).Inc(float64(w.n))
+	w.n = 0
+	return w.FileWriter.Close()
 }
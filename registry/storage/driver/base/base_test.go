@@ -0,0 +1,98 @@
+package base_test
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+
+	storagedriver "github.com/distribution/distribution/v3/registry/storage/driver"
+	"github.com/distribution/distribution/v3/registry/storage/driver/inmemory"
+	"github.com/docker/go-metrics"
+)
+
+// scrape returns the values of the samples of the metrics endpoint.
+func scrape(t *testing.T) map[string]float64 {
+	t.Helper()
+	rec := httptest.NewRecorder()
+	metrics.Handler().ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/metrics", nil))
+
+	samples := make(map[string]float64)
+	scanner := bufio.NewScanner(rec.Body)
+	for scanner.Scan() {
+		line := scanner.Text()
+		if !strings.HasPrefix(line, "registry_storage_") {
+			continue
+		}
+		i := strings.LastIndexByte(line, ' ')
+		value, err := strconv.ParseFloat(line[i+1:], 64)
+		if err != nil {
+			t.Fatalf("error parsing sample %q: %v", line, err)
+		}
+		samples[line[:i]] = value
+	}
+	return samples
+}
+
+func TestStorageMetrics(t *testing.T) {
+	ctx := context.Background()
+	driver := inmemory.New()
+	before := scrape(t)
+
+	content := []byte("some content")
+	if err := driver.PutContent(ctx, "/metrics/content", content); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := driver.GetContent(ctx, "/metrics/content"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := driver.Stat(ctx, "/metrics/missing"); !errors.As(err, new(storagedriver.PathNotFoundError)) {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	fw, err := driver.Writer(ctx, "/metrics/written", false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := fw.Write(content); err != nil {
+		t.Fatal(err)
+	}
+	if err := fw.Commit(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if err := fw.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	rc, err := driver.Reader(ctx, "/metrics/written", 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := io.Copy(io.Discard, rc); err != nil {
+		t.Fatal(err)
+	}
+	if err := rc.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	after := scrape(t)
+	for sample, expected := range map[string]float64{
+		`registry_storage_action_seconds_count{action="PutContent",driver="inmemory",outcome="success"}`:    1,
+		`registry_storage_action_seconds_count{action="GetContent",driver="inmemory",outcome="success"}`:    1,
+		`registry_storage_action_seconds_count{action="Stat",driver="inmemory",outcome="notfound"}`:         1,
+		`registry_storage_action_seconds_count{action="Writer",driver="inmemory",outcome="success"}`:        1,
+		`registry_storage_action_seconds_count{action="Writer.Commit",driver="inmemory",outcome="success"}`: 1,
+		`registry_storage_action_seconds_count{action="Reader",driver="inmemory",outcome="success"}`:        1,
+		`registry_storage_read_bytes_total{driver="inmemory"}`:                                              float64(2 * len(content)),
+		`registry_storage_written_bytes_total{driver="inmemory"}`:                                           float64(2 * len(content)),
+	} {
+		if observed := after[sample] - before[sample]; observed != expected {
+			t.Errorf("unexpected %s: %v != %v", sample, observed, expected)
+		}
+	}
+}
@@ -173,6 +173,20 @@ func (r *regulator) Delete(ctx context.Context, path string) error {
 	return r.StorageDriver.Delete(ctx, path)
 }
 
+// DeleteBatch deletes the files at paths in a request, if the regulated driver
+// implements BatchDeleter.
+func (r *regulator) DeleteBatch(ctx context.Context, paths []string) ([]error, error) {
+	bd, ok := r.StorageDriver.(storagedriver.BatchDeleter)
+	if !ok {
+		return nil, storagedriver.ErrUnsupportedMethod{}
+	}
+
+	r.enter()
+	defer r.exit()
+
+	return bd.DeleteBatch(ctx, paths)
+}
+
 // RedirectURL returns a URL which may be used to retrieve the content stored at
 // the given path.
 func (r *regulator) RedirectURL(req *http.Request, path string) (string, error) {
@@ -181,3 +195,39 @@ func (r *regulator) RedirectURL(req *http.Request, path string) (string, error)
 
 	return r.StorageDriver.RedirectURL(req, path)
 }
+
+// Usage returns the number of bytes stored under path and the number of files
+// storing them, if the regulated driver implements UsageReporter.
+func (r *regulator) Usage(ctx context.Context, path string) (int64, int64, error) {
+	ur, ok := r.StorageDriver.(storagedriver.UsageReporter)
+	if !ok {
+		return 0, 0, storagedriver.ErrUnsupportedMethod{}
+	}
+
+	r.enter()
+	defer r.exit()
+
+	return ur.Usage(ctx, path)
+}
+
+// FilePathForContent returns the path of the local file storing the content at
+// path, if the regulated driver implements FilePathResolver. Resolving the path
+// does not take a slot, the file being read outside of the driver.
+func (r *regulator) FilePathForContent(path string) (string, error) {
+	fr, ok := r.StorageDriver.(storagedriver.FilePathResolver)
+	if !ok {
+		return "", storagedriver.ErrUnsupportedMethod{}
+	}
+
+	return fr.FilePathForContent(path)
+}
+
+// Close closes the regulated driver, if it implements Closer.
+func (r *regulator) Close() error {
+	c, ok := r.StorageDriver.(storagedriver.Closer)
+	if !ok {
+		return nil
+	}
+
+	return c.Close()
+}
@@ -10,6 +10,7 @@ import (
 	"net/http"
 	"os"
 	"path/filepath"
+	"strconv"
 	"time"
 
 	"github.com/distribution/distribution/v3/internal/uuid"
@@ -34,6 +35,12 @@ const (
 type DriverParameters struct {
 	RootDirectory string
 	MaxThreads    uint64
+	// Fsync makes renames durable by syncing the directories they change,
+	// and writes the files stored by PutContent with O_DSYNC.
+	Fsync bool
+	// ForceCopy makes the moves which cannot rename copy the files instead
+	// of hard linking them, for the filesystems without hard links.
+	ForceCopy bool
 }
 
 func init() {
@@ -49,6 +56,19 @@ func (factory *filesystemDriverFactory) Create(ctx context.Context, parameters m
 
 type driver struct {
 	rootDirectory string
+	fsync         bool
+	forceCopy     bool
+
+	// syncFile and syncDir flush files and directories to stable storage.
+	syncFile func(*os.File) error
+	syncDir  func(dir string) error
+
+	// rename and link rename and hard link files.
+	rename func(oldpath, newpath string) error
+	link   func(oldpath, newpath string) error
+
+	// usage caches the directories walked by Usage.
+	usage usageCache
 }
 
 type baseEmbed struct {
@@ -65,6 +85,8 @@ type Driver struct {
 // Optional Parameters:
 // - rootdirectory
 // - maxthreads
+// - fsync
+// - forcecopy
 func FromParameters(parameters map[string]any) (*Driver, error) {
 	params, err := fromParametersImpl(parameters)
 	if err != nil || params == nil {
@@ -78,6 +100,8 @@ func fromParametersImpl(parameters map[string]any) (*DriverParameters, error) {
 		err           error
 		maxThreads    = defaultMaxThreads
 		rootDirectory = defaultRootDirectory
+		fsync         bool
+		forceCopy     bool
 	)
 
 	if parameters != nil {
@@ -89,18 +113,55 @@ func fromParametersImpl(parameters map[string]any) (*DriverParameters, error) {
 		if err != nil {
 			return nil, fmt.Errorf("maxthreads config error: %s", err.Error())
 		}
+
+		fsync, err = getBoolParameter(parameters, "fsync")
+		if err != nil {
+			return nil, err
+		}
+		forceCopy, err = getBoolParameter(parameters, "forcecopy")
+		if err != nil {
+			return nil, err
+		}
 	}
 
 	params := &DriverParameters{
 		RootDirectory: rootDirectory,
 		MaxThreads:    maxThreads,
+		Fsync:         fsync,
+		ForceCopy:     forceCopy,
 	}
 	return params, nil
 }
 
+// getBoolParameter returns the boolean parameter, false if unset.
+func getBoolParameter(parameters map[string]any, name string) (bool, error) {
+	switch v := parameters[name].(type) {
+	case nil:
+		return false, nil
+	case bool:
+		return v, nil
+	case string:
+		b, err := strconv.ParseBool(v)
+		if err != nil {
+			return false, fmt.Errorf("%s config error: %v is not a boolean", name, v)
+		}
+		return b, nil
+	default:
+		return false, fmt.Errorf("%s config error: %v is not a boolean", name, v)
+	}
+}
+
 // New constructs a new Driver with a given rootDirectory
 func New(params DriverParameters) *Driver {
-	fsDriver := &driver{rootDirectory: params.RootDirectory}
+	fsDriver := &driver{
+		rootDirectory: params.RootDirectory,
+		fsync:         params.Fsync,
+		forceCopy:     params.ForceCopy,
+		syncFile:      (*os.File).Sync,
+		syncDir:       syncDir,
+		rename:        os.Rename,
+		link:          os.Link,
+	}
 
 	return &Driver{
 		baseEmbed: baseEmbed{
@@ -137,8 +198,13 @@ func (d *driver) GetContent(ctx context.Context, path string) ([]byte, error) {
 func (d *driver) PutContent(ctx context.Context, subPath string, contents []byte) error {
 	tempPath := fmt.Sprintf("%s.%s.tmp", subPath, uuid.NewString())
 
-	// Write to a temporary file to prevent partial writes.
-	writer, err := d.Writer(ctx, tempPath, false)
+	// Write to a temporary file to prevent partial writes. With fsync, the
+	// file is written with O_DSYNC, so it is durable once written.
+	var flag int
+	if d.fsync {
+		flag = dsyncFlag
+	}
+	writer, err := d.writer(tempPath, false, flag)
 	if err != nil {
 		return err
 	}
@@ -164,7 +230,11 @@ func (d *driver) PutContent(ctx context.Context, subPath string, contents []byte
 		dErr := d.Delete(ctx, tempPath)
 		return errors.Join(err, dErr)
 	}
-	return syncDir(filepath.Dir(d.fullPath(subPath)))
+	if d.fsync {
+		// Move already synced the directory.
+		return nil
+	}
+	return d.syncDir(filepath.Dir(d.fullPath(subPath)))
 }
 
 func syncDir(dir string) (retErr error) {
@@ -211,13 +281,18 @@ func (d *driver) Reader(ctx context.Context, path string, offset int64) (io.Read
 }
 
 func (d *driver) Writer(ctx context.Context, subPath string, append bool) (storagedriver.FileWriter, error) {
+	return d.writer(subPath, append, 0)
+}
+
+// writer opens a FileWriter with the given additional flags.
+func (d *driver) writer(subPath string, append bool, flag int) (*fileWriter, error) {
 	fullPath := d.fullPath(subPath)
 	parentDir := filepath.Dir(fullPath)
 	if err := os.MkdirAll(parentDir, 0o777); err != nil {
 		return nil, err
 	}
 
-	fp, err := os.OpenFile(fullPath, os.O_WRONLY|os.O_CREATE, 0o666)
+	fp, err := os.OpenFile(fullPath, os.O_WRONLY|os.O_CREATE|flag, 0o666)
 	if err != nil {
 		return nil, err
 	}
@@ -239,7 +314,14 @@ func (d *driver) Writer(ctx context.Context, subPath string, append bool) (stora
 		offset = n
 	}
 
-	return newFileWriter(fp, offset), nil
+	fw := newFileWriter(fp, offset)
+	fw.sync = d.syncFile
+	fw.written = func() { d.usage.invalidate(parentDir) }
+	if flag&dsyncFlag != 0 {
+		// Every write is already synced.
+		fw.sync = func(*os.File) error { return nil }
+	}
+	return fw, nil
 }
 
 // Stat retrieves the FileInfo for the given path, including the current size
@@ -300,12 +382,107 @@ func (d *driver) Move(ctx context.Context, sourcePath string, destPath string) e
 		return storagedriver.PathNotFoundError{Path: sourcePath}
 	}
 
-	if err := os.MkdirAll(filepath.Dir(dest), 0o777); err != nil {
+	destDir := filepath.Dir(dest)
+	var created []string
+	if d.fsync {
+		created = missingDirs(destDir)
+	}
+	if err := os.MkdirAll(destDir, 0o777); err != nil {
 		return err
 	}
 
-	err := os.Rename(source, dest)
-	return err
+	if err := d.move(source, dest); err != nil {
+		return err
+	}
+	if !d.fsync {
+		return nil
+	}
+
+	// Sync the directory holding the new name, and the parents of any
+	// directories created for it, so the rename survives a power loss.
+	dirs := []string{destDir}
+	for _, dir := range created {
+		dirs = append(dirs, filepath.Dir(dir))
+	}
+	for _, dir := range dirs {
+		if err := d.syncDir(dir); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// move renames source to dest. When it cannot, such as across mounts, source
+// is hard linked to dest and unlinked, or copied to dest and removed if that
+// fails too or forceCopy is set, so that dest is replaced atomically.
+func (d *driver) move(source, dest string) error {
+	err := d.rename(source, dest)
+	if err == nil {
+		return nil
+	}
+	if !d.forceCopy {
+		if err = d.replace(dest, func(tmp string) error { return d.link(source, tmp) }); err == nil {
+			return os.Remove(source)
+		}
+	}
+	if err := d.replace(dest, func(tmp string) error { return d.copyFile(source, tmp) }); err != nil {
+		return fmt.Errorf("moving %s to %s: %w", source, dest, err)
+	}
+	return os.Remove(source)
+}
+
+// replace creates dest with create, through a temporary file renamed over it.
+func (d *driver) replace(dest string, create func(tmp string) error) error {
+	tmp := fmt.Sprintf("%s.%s.tmp", dest, uuid.NewString())
+	if err := create(tmp); err != nil {
+		_ = os.Remove(tmp)
+		return err
+	}
+	if err := d.rename(tmp, dest); err != nil {
+		_ = os.Remove(tmp)
+		return err
+	}
+	return nil
+}
+
+// copyFile copies the content of source to the new file dest, synced as the
+// uploads committed are.
+func (d *driver) copyFile(source, dest string) error {
+	src, err := os.Open(source)
+	if err != nil {
+		return err
+	}
+	defer src.Close()
+	dst, err := os.OpenFile(dest, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0o666)
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(dst, src); err != nil {
+		dst.Close()
+		return err
+	}
+	if err := d.syncFile(dst); err != nil {
+		dst.Close()
+		return err
+	}
+	return dst.Close()
+}
+
+// missingDirs returns dir and its ancestors which do not exist yet, deepest
+// first.
+func missingDirs(dir string) []string {
+	var missing []string
+	for {
+		if _, err := os.Stat(dir); !os.IsNotExist(err) {
+			return missing
+		}
+		missing = append(missing, dir)
+		parent := filepath.Dir(dir)
+		if parent == dir {
+			return missing
+		}
+		dir = parent
+	}
 }
 
 // Delete recursively deletes all objects stored at "path" and its subpaths.
@@ -328,6 +505,12 @@ func (d *driver) RedirectURL(*http.Request, string) (string, error) {
 	return "", nil
 }
 
+// FilePathForContent returns the path of the file storing the content at
+// path, under the root directory.
+func (d *driver) FilePathForContent(path string) (string, error) {
+	return d.fullPath(path), nil
+}
+
 // Walk traverses a filesystem defined within driver, starting
 // from the given path, calling f on each file and directory
 func (d *driver) Walk(ctx context.Context, path string, f storagedriver.WalkFn, options ...func(*storagedriver.WalkOptions)) error {
@@ -374,7 +557,10 @@ func (fi fileInfo) IsDir() bool {
 }
 
 type fileWriter struct {
-	file      *os.File
+	file *os.File
+	sync func(*os.File) error
+	// written is called once the content written is flushed.
+	written   func()
 	size      int64
 	bw        *bufio.Writer
 	closed    bool
@@ -385,6 +571,7 @@ type fileWriter struct {
 func newFileWriter(file *os.File, size int64) *fileWriter {
 	return &fileWriter{
 		file: file,
+		sync: (*os.File).Sync,
 		size: size,
 		bw:   bufio.NewWriter(file),
 	}
@@ -426,8 +613,9 @@ func (fw *fileWriter) Close() (retErr error) {
 	if err := fw.bw.Flush(); err != nil {
 		return err
 	}
+	fw.flushed()
 
-	return fw.file.Sync()
+	return fw.sync(fw.file)
 }
 
 func (fw *fileWriter) Cancel(ctx context.Context) error {
@@ -453,11 +641,18 @@ func (fw *fileWriter) Commit(ctx context.Context) error {
 	if err := fw.bw.Flush(); err != nil {
 		return err
 	}
+	fw.flushed()
 
-	if err := fw.file.Sync(); err != nil {
+	if err := fw.sync(fw.file); err != nil {
 		return err
 	}
 
 	fw.committed = true
 	return nil
 }
+
+func (fw *fileWriter) flushed() {
+	if fw.written != nil {
+		fw.written()
+	}
+}
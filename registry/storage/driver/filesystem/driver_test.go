@@ -1,7 +1,14 @@
 package filesystem
 
 import (
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
 	"reflect"
+	"slices"
+	"strings"
+	"syscall"
 	"testing"
 
 	storagedriver "github.com/distribution/distribution/v3/registry/storage/driver"
@@ -49,6 +56,24 @@ func TestFromParametersImpl(t *testing.T) {
 			expected: DriverParameters{},
 			pass:     false,
 		},
+		{
+			params: map[string]any{
+				"fsync": "true",
+			},
+			expected: DriverParameters{
+				RootDirectory: defaultRootDirectory,
+				MaxThreads:    defaultMaxThreads,
+				Fsync:         true,
+			},
+			pass: true,
+		},
+		{
+			params: map[string]any{
+				"fsync": "sometimes",
+			},
+			expected: DriverParameters{},
+			pass:     false,
+		},
 		{
 			params: map[string]any{
 				"maxthreads": "100",
@@ -69,6 +94,24 @@ func TestFromParametersImpl(t *testing.T) {
 			},
 			pass: true,
 		},
+		{
+			params: map[string]any{
+				"forcecopy": true,
+			},
+			expected: DriverParameters{
+				RootDirectory: defaultRootDirectory,
+				MaxThreads:    defaultMaxThreads,
+				ForceCopy:     true,
+			},
+			pass: true,
+		},
+		{
+			params: map[string]any{
+				"forcecopy": "sometimes",
+			},
+			expected: DriverParameters{},
+			pass:     false,
+		},
 		// check that we use minimum thread counts
 		{
 			params: map[string]any{
@@ -102,3 +145,196 @@ func TestFromParametersImpl(t *testing.T) {
 		}
 	}
 }
+
+// syncRecorder records the syncs made by a driver.
+type syncRecorder struct {
+	syncs []string
+}
+
+func (r *syncRecorder) syncFile(f *os.File) error {
+	r.syncs = append(r.syncs, "file "+f.Name())
+	return f.Sync()
+}
+
+func (r *syncRecorder) syncDir(dir string) error {
+	r.syncs = append(r.syncs, "dir "+dir)
+	return syncDir(dir)
+}
+
+func (r *syncRecorder) take() []string {
+	syncs := r.syncs
+	r.syncs = nil
+	return syncs
+}
+
+func newRecordingDriver(t *testing.T, fsync bool) (*driver, *syncRecorder, string) {
+	root := t.TempDir()
+	rec := &syncRecorder{}
+	return &driver{
+		rootDirectory: root,
+		fsync:         fsync,
+		syncFile:      rec.syncFile,
+		syncDir:       rec.syncDir,
+		rename:        os.Rename,
+		link:          os.Link,
+	}, rec, root
+}
+
+func TestFsync(t *testing.T) {
+	d, rec, root := newRecordingDriver(t, true)
+	ctx := context.Background()
+
+	w, err := d.Writer(ctx, "/uploads/id/data", false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for range 2 {
+		if _, err := w.Write([]byte("content")); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if syncs := rec.take(); len(syncs) != 0 {
+		t.Fatalf("expected no syncs while writing, got %v", syncs)
+	}
+	if err := w.Commit(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+	expected := []string{"file " + filepath.Join(root, "uploads/id/data")}
+	if syncs := rec.take(); !reflect.DeepEqual(syncs, expected) {
+		t.Fatalf("commit: expected syncs %v, got %v", expected, syncs)
+	}
+
+	// Renaming into new directories syncs the destination directory and
+	// the parents of the created directories.
+	if err := d.Move(ctx, "/uploads/id/data", "/blobs/ab/data"); err != nil {
+		t.Fatal(err)
+	}
+	expected = []string{
+		"dir " + filepath.Join(root, "blobs/ab"),
+		"dir " + filepath.Join(root, "blobs"),
+		"dir " + root,
+	}
+	if syncs := rec.take(); !reflect.DeepEqual(syncs, expected) {
+		t.Fatalf("move: expected syncs %v, got %v", expected, syncs)
+	}
+
+	// PutContent writes with O_DSYNC, so only the rename is synced.
+	if err := d.PutContent(ctx, "/blobs/ab/link", []byte("link")); err != nil {
+		t.Fatal(err)
+	}
+	expected = []string{"dir " + filepath.Join(root, "blobs/ab")}
+	if syncs := rec.take(); !reflect.DeepEqual(syncs, expected) {
+		t.Fatalf("put content: expected syncs %v, got %v", expected, syncs)
+	}
+}
+
+func TestFsyncDisabled(t *testing.T) {
+	d, rec, root := newRecordingDriver(t, false)
+	ctx := context.Background()
+
+	if err := d.PutContent(ctx, "/uploads/id/data", []byte("content")); err != nil {
+		t.Fatal(err)
+	}
+	syncs := rec.take()
+	if len(syncs) != 2 || !strings.HasPrefix(syncs[0], "file ") || syncs[1] != "dir "+filepath.Join(root, "uploads/id") {
+		t.Fatalf("put content: unexpected syncs %v", syncs)
+	}
+
+	if err := d.Move(ctx, "/uploads/id/data", "/blobs/ab/data"); err != nil {
+		t.Fatal(err)
+	}
+	if syncs := rec.take(); len(syncs) != 0 {
+		t.Fatalf("move: expected no syncs, got %v", syncs)
+	}
+}
+
+// crossDevice fails the renames and links between directories, as across
+// mounts.
+func crossDevice(rename func(oldpath, newpath string) error) func(oldpath, newpath string) error {
+	return func(oldpath, newpath string) error {
+		if filepath.Dir(oldpath) != filepath.Dir(newpath) {
+			return &os.LinkError{Op: "rename", Old: oldpath, New: newpath, Err: syscall.EXDEV}
+		}
+		return rename(oldpath, newpath)
+	}
+}
+
+// moveFile moves the upload to the blob, replacing a blob of other content,
+// and reports whether the blob is the file of the upload rather than a copy.
+func moveFile(t *testing.T, d *driver, root string) bool {
+	t.Helper()
+	ctx := context.Background()
+	if err := d.PutContent(ctx, "/uploads/id/data", []byte("content")); err != nil {
+		t.Fatal(err)
+	}
+	if err := d.PutContent(ctx, "/blobs/ab/data", []byte("other")); err != nil {
+		t.Fatal(err)
+	}
+	upload, err := os.Stat(filepath.Join(root, "uploads/id/data"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := d.Move(ctx, "/uploads/id/data", "/blobs/ab/data"); err != nil {
+		t.Fatal(err)
+	}
+	content, err := d.GetContent(ctx, "/blobs/ab/data")
+	if err != nil || string(content) != "content" {
+		t.Fatalf("unexpected content moved %q: %v", content, err)
+	}
+	if _, err := d.Stat(ctx, "/uploads/id/data"); !errors.As(err, &storagedriver.PathNotFoundError{}) {
+		t.Fatalf("expected the upload to be removed, got %v", err)
+	}
+	entries, err := os.ReadDir(filepath.Join(root, "blobs/ab"))
+	if err != nil || len(entries) != 1 {
+		t.Fatalf("unexpected files left %v: %v", entries, err)
+	}
+	blob, err := os.Stat(filepath.Join(root, "blobs/ab/data"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return os.SameFile(upload, blob)
+}
+
+func TestMoveRename(t *testing.T) {
+	d, _, root := newRecordingDriver(t, false)
+	if !moveFile(t, d, root) {
+		t.Fatal("expected the upload to be renamed, not copied")
+	}
+}
+
+func TestMoveLink(t *testing.T) {
+	d, _, root := newRecordingDriver(t, false)
+	d.rename = crossDevice(os.Rename)
+	if !moveFile(t, d, root) {
+		t.Fatal("expected the upload to be hard linked, not copied")
+	}
+}
+
+func TestMoveCopy(t *testing.T) {
+	// The files are copied when they can be neither renamed nor linked, or
+	// with forcecopy.
+	d, rec, root := newRecordingDriver(t, false)
+	d.rename = crossDevice(os.Rename)
+	d.link = crossDevice(os.Link)
+	if moveFile(t, d, root) {
+		t.Fatal("expected the upload to be copied")
+	}
+	if syncs := rec.take(); !slices.ContainsFunc(syncs, func(s string) bool { return strings.HasPrefix(s, "file "+filepath.Join(root, "blobs/ab/data.")) }) {
+		t.Fatalf("expected the copy to be synced, got %v", syncs)
+	}
+
+	d, _, root = newRecordingDriver(t, false)
+	d.forceCopy = true
+	d.rename = crossDevice(os.Rename)
+	d.link = func(oldpath, newpath string) error {
+		t.Fatalf("unexpected link of %s with forcecopy", oldpath)
+		return nil
+	}
+	if moveFile(t, d, root) {
+		t.Fatal("expected the upload to be copied")
+	}
+}
@@ -0,0 +1,9 @@
+//go:build !unix
+
+package filesystem
+
+import "os"
+
+// dsyncFlag opens files so that each write is durable once it returns.
+// O_DSYNC is not available, so O_SYNC is used instead.
+const dsyncFlag = os.O_SYNC
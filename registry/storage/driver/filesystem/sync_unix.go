@@ -0,0 +1,8 @@
+//go:build unix
+
+package filesystem
+
+import "syscall"
+
+// dsyncFlag opens files so that each write is durable once it returns.
+const dsyncFlag = syscall.O_DSYNC
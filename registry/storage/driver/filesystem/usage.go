@@ -0,0 +1,183 @@
+package filesystem
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"slices"
+	"sync"
+	"time"
+)
+
+// racyWindow is how long after its last modification a directory is not
+// cached, since changes made within the resolution of its modification time
+// would not change it.
+const racyWindow = 2 * time.Second
+
+// Usage returns the number of bytes stored under path and the number of files
+// storing them. The files of each directory walked are cached along with its
+// modification time, so that a directory is only read again once entries are
+// added to or removed from it, or once a file in it is written by the driver.
+func (d *driver) Usage(ctx context.Context, subPath string) (int64, int64, error) {
+	fi, err := os.Stat(d.fullPath(subPath))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return 0, 0, nil
+		}
+		return 0, 0, err
+	}
+	if !fi.IsDir() {
+		return fi.Size(), 1, nil
+	}
+	return d.usage.walk(ctx, d.fullPath(subPath), fi.ModTime())
+}
+
+// usageCache caches the files of the directories walked by Usage. Its zero
+// value is ready to use.
+type usageCache struct {
+	mu   sync.Mutex
+	dirs map[string]*dirUsage
+}
+
+// dirUsage is the usage of the files directly in a directory.
+type dirUsage struct {
+	modTime time.Time
+	bytes   int64
+	objects int64
+	subdirs []string
+}
+
+// walk returns the usage of the directory dir, last modified at modTime, and
+// of its subdirectories.
+func (c *usageCache) walk(ctx context.Context, dir string, modTime time.Time) (int64, int64, error) {
+	if err := ctx.Err(); err != nil {
+		return 0, 0, err
+	}
+
+	du := c.get(dir, modTime)
+	if du == nil {
+		var err error
+		du, err = readDirUsage(dir, modTime)
+		if err != nil {
+			if os.IsNotExist(err) {
+				c.forget(dir)
+				return 0, 0, nil
+			}
+			return 0, 0, err
+		}
+		c.put(dir, du)
+	}
+
+	bytes, objects := du.bytes, du.objects
+	for _, name := range du.subdirs {
+		subdir := filepath.Join(dir, name)
+		fi, err := os.Stat(subdir)
+		if err != nil {
+			if os.IsNotExist(err) {
+				continue
+			}
+			return 0, 0, err
+		}
+		b, o, err := c.walk(ctx, subdir, fi.ModTime())
+		if err != nil {
+			return 0, 0, err
+		}
+		bytes += b
+		objects += o
+	}
+	return bytes, objects, nil
+}
+
+func readDirUsage(dir string, modTime time.Time) (*dirUsage, error) {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+
+	du := &dirUsage{modTime: modTime}
+	for _, entry := range entries {
+		if entry.IsDir() {
+			du.subdirs = append(du.subdirs, entry.Name())
+			continue
+		}
+		if !entry.Type().IsRegular() {
+			continue
+		}
+		fi, err := entry.Info()
+		if err != nil {
+			if os.IsNotExist(err) {
+				continue
+			}
+			return nil, err
+		}
+		du.bytes += fi.Size()
+		du.objects++
+	}
+	return du, nil
+}
+
+// get returns the cached usage of dir if it was not modified since.
+func (c *usageCache) get(dir string, modTime time.Time) *dirUsage {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	du := c.dirs[dir]
+	if du == nil || !du.modTime.Equal(modTime) {
+		return nil
+	}
+	return du
+}
+
+func (c *usageCache) put(dir string, du *dirUsage) {
+	if time.Since(du.modTime) < racyWindow {
+		// Keep the subdirectories of dir to forget them once removed, but
+		// read it again.
+		du.modTime = time.Time{}
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.dirs == nil {
+		c.dirs = make(map[string]*dirUsage)
+	}
+	if previous := c.dirs[dir]; previous != nil {
+		// Forget the subdirectories removed since dir was last read.
+		for _, name := range previous.subdirs {
+			if !slices.Contains(du.subdirs, name) {
+				c.forgetLocked(filepath.Join(dir, name))
+			}
+		}
+	}
+	c.dirs[dir] = du
+}
+
+// invalidate marks the cached usage of dir, whose files were written, as
+// stale.
+func (c *usageCache) invalidate(dir string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if du := c.dirs[dir]; du != nil {
+		du.modTime = time.Time{}
+	}
+}
+
+// forget drops the cached usage of dir and of its subdirectories.
+func (c *usageCache) forget(dir string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.forgetLocked(dir)
+}
+
+func (c *usageCache) forgetLocked(dir string) {
+	du := c.dirs[dir]
+	if du == nil {
+		return
+	}
+	delete(c.dirs, dir)
+	for _, name := range du.subdirs {
+		c.forgetLocked(filepath.Join(dir, name))
+	}
+}
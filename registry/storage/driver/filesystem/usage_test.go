@@ -0,0 +1,132 @@
+package filesystem
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	storagedriver "github.com/distribution/distribution/v3/registry/storage/driver"
+)
+
+// writeFixture writes files, mapping paths under root to their contents, and
+// backdates all the directories under root so that they can be cached.
+func writeFixture(t *testing.T, root string, files map[string]string) {
+	for path, content := range files {
+		fullPath := filepath.Join(root, path)
+		if err := os.MkdirAll(filepath.Dir(fullPath), 0o777); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(fullPath, []byte(content), 0o666); err != nil {
+			t.Fatal(err)
+		}
+	}
+	backdate(t, root)
+}
+
+func backdate(t *testing.T, root string) {
+	past := time.Now().Add(-time.Hour)
+	err := filepath.WalkDir(root, func(path string, d os.DirEntry, err error) error {
+		if err != nil || !d.IsDir() {
+			return err
+		}
+		return os.Chtimes(path, past, past)
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func expectUsage(t *testing.T, d *Driver, path string, bytes, objects int64) {
+	t.Helper()
+	b, o, err := storagedriver.Usage(context.Background(), d, path, false)
+	if err != nil {
+		t.Fatalf("%s: unexpected error: %v", path, err)
+	}
+	if b != bytes || o != objects {
+		t.Fatalf("%s: expected %d bytes in %d files, got %d bytes in %d files", path, bytes, objects, b, o)
+	}
+}
+
+func TestUsage(t *testing.T) {
+	root := t.TempDir()
+	writeFixture(t, root, map[string]string{
+		"docker/registry/v2/blobs/sha256/ab/abc/data":                     "layer content",
+		"docker/registry/v2/blobs/sha256/cd/cde/data":                     "config",
+		"docker/registry/v2/repositories/app/_layers/sha256/abc/link":     "sha256:abc",
+		"docker/registry/v2/repositories/app/_manifests/tags/latest/link": "sha256:cde",
+		"docker/registry/v2/repositories/app/_uploads/1/data":             "",
+	})
+	d := New(DriverParameters{RootDirectory: root, MaxThreads: minThreads})
+
+	expectUsage(t, d, "/", 39, 5)
+	expectUsage(t, d, "/docker/registry/v2/blobs", 19, 2)
+	expectUsage(t, d, "/docker/registry/v2/blobs/sha256/ab/abc/data", 13, 1)
+	expectUsage(t, d, "/missing", 0, 0)
+
+	// The usage matches the one found by walking the storage.
+	bytes, objects, err := storagedriver.WalkUsage(context.Background(), d, "/")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if bytes != 39 || objects != 5 {
+		t.Fatalf("walk: expected 39 bytes in 5 files, got %d bytes in %d files", bytes, objects)
+	}
+}
+
+func TestUsageCache(t *testing.T) {
+	d, _, root := newRecordingDriver(t, false)
+	writeFixture(t, root, map[string]string{
+		"blobs/ab/data":   "0123456789",
+		"blobs/cd/data":   "0123456789",
+		"uploads/1/data":  "",
+		"uploads/1/state": "x",
+	})
+	ctx := context.Background()
+	usage := func() (int64, int64) {
+		t.Helper()
+		bytes, objects, err := d.Usage(ctx, "/")
+		if err != nil {
+			t.Fatal(err)
+		}
+		return bytes, objects
+	}
+
+	if bytes, objects := usage(); bytes != 21 || objects != 4 {
+		t.Fatalf("expected 21 bytes in 4 files, got %d bytes in %d files", bytes, objects)
+	}
+
+	// Files changed in place by another process are not seen until their
+	// directory is modified.
+	if err := os.WriteFile(filepath.Join(root, "blobs/ab/data"), []byte("0"), 0o666); err != nil {
+		t.Fatal(err)
+	}
+	if bytes, _ := usage(); bytes != 21 {
+		t.Fatalf("expected the cached usage of 21 bytes, got %d", bytes)
+	}
+
+	// Files written by the driver are seen, and so are directories removed.
+	w, err := d.Writer(ctx, "/uploads/1/data", true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := w.Write([]byte("abc")); err != nil {
+		t.Fatal(err)
+	}
+	if err := w.Commit(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if err := d.Delete(ctx, "/blobs/cd"); err != nil {
+		t.Fatal(err)
+	}
+	if bytes, objects := usage(); bytes != 14 || objects != 3 {
+		t.Fatalf("expected 14 bytes in 3 files, got %d bytes in %d files", bytes, objects)
+	}
+	if d.usage.dirs[filepath.Join(root, "blobs/cd")] != nil {
+		t.Fatal("expected the removed directory to be forgotten")
+	}
+}
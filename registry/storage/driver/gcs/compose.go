@@ -0,0 +1,320 @@
+package gcs
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"sync"
+
+	"cloud.google.com/go/storage"
+	storagedriver "github.com/distribution/distribution/v3/registry/storage/driver"
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	// maxComposeSources is the maximum number of objects a single compose
+	// request concatenates.
+	maxComposeSources = 32
+
+	// composedMetadataKey marks the uploads written by a composeWriter, whose
+	// object holds all the bytes written so far.
+	composedMetadataKey = "Composed"
+)
+
+var _ storagedriver.FileWriter = &composeWriter{}
+
+// composeStep composes the sources, in order, into the destination.
+type composeStep struct {
+	dst  string
+	srcs []string
+}
+
+// composePlan returns the levels of the compose tree concatenating the
+// sources into dst, each step of a level composing at most maxComposeSources
+// objects, into the intermediate objects named after the prefix or, for the
+// single step of the last level, into dst. The steps of a level only depend on
+// the steps of the levels before it.
+func composePlan(dst, prefix string, srcs []string) [][]composeStep {
+	var levels [][]composeStep
+	for depth := 0; len(srcs) > maxComposeSources; depth++ {
+		var (
+			level []composeStep
+			next  []string
+		)
+		for i := 0; i < len(srcs); i += maxComposeSources {
+			batch := srcs[i:min(i+maxComposeSources, len(srcs))]
+			if len(batch) == 1 {
+				next = append(next, batch[0])
+				continue
+			}
+			intermediate := fmt.Sprintf("%scompose-%d-%08d", prefix, depth, len(level))
+			level = append(level, composeStep{dst: intermediate, srcs: batch})
+			next = append(next, intermediate)
+		}
+		levels = append(levels, level)
+		srcs = next
+	}
+	return append(levels, []composeStep{{dst: dst, srcs: srcs}})
+}
+
+// composeWriter uploads the bytes written as component objects of chunkSize
+// bytes, up to the compose concurrency at once, and composes them into the
+// object on Close and Commit, after the bytes the object holds when appended
+// to. The writes smaller than a chunk are uploaded as a single object.
+type composeWriter struct {
+	ctx    context.Context
+	driver *driver
+	object *storage.ObjectHandle
+	// prefix names the component and intermediate objects of the writer.
+	prefix string
+	// base is set when the object holds bytes written before.
+	base       bool
+	components []string
+	size       int64
+	buffer     []byte
+
+	uploads chan struct{}
+	pending sync.WaitGroup
+	mu      sync.Mutex
+	err     error
+
+	closed    bool
+	cancelled bool
+	committed bool
+}
+
+func (d *driver) newComposeWriter(ctx context.Context, object *storage.ObjectHandle, attrs *storage.ObjectAttrs) *composeWriter {
+	session := make([]byte, 8)
+	_, _ = rand.Read(session)
+	w := &composeWriter{
+		ctx:     ctx,
+		driver:  d,
+		object:  object,
+		prefix:  fmt.Sprintf("%s.compose/%s/", object.ObjectName(), hex.EncodeToString(session)),
+		buffer:  make([]byte, 0, d.chunkSize),
+		uploads: make(chan struct{}, max(d.composeConcurrency, 1)),
+	}
+	if attrs != nil {
+		w.base = true
+		w.size = attrs.Size
+	}
+	return w
+}
+
+func (w *composeWriter) Write(p []byte) (int, error) {
+	if w.closed {
+		return 0, fmt.Errorf("already closed")
+	} else if w.cancelled {
+		return 0, fmt.Errorf("already cancelled")
+	}
+
+	written := 0
+	for written < len(p) {
+		if err := w.uploadErr(); err != nil {
+			return written, err
+		}
+		n := min(cap(w.buffer)-len(w.buffer), len(p)-written)
+		w.buffer = append(w.buffer, p[written:written+n]...)
+		written += n
+		w.size += int64(n)
+		if len(w.buffer) == cap(w.buffer) {
+			if err := w.upload(); err != nil {
+				return written, err
+			}
+		}
+	}
+	return written, nil
+}
+
+// upload uploads the buffer as the next component in the background, once
+// fewer than the compose concurrency components are being uploaded.
+func (w *composeWriter) upload() error {
+	name := fmt.Sprintf("%s%08d", w.prefix, len(w.components))
+	w.components = append(w.components, name)
+	chunk := w.buffer
+	w.buffer = make([]byte, 0, w.driver.chunkSize)
+
+	select {
+	case w.uploads <- struct{}{}:
+	case <-w.ctx.Done():
+		return w.ctx.Err()
+	}
+	w.pending.Add(1)
+	go func() {
+		defer func() {
+			<-w.uploads
+			w.pending.Done()
+		}()
+		err := retry(func() error {
+			return w.driver.putContent(w.ctx, w.driver.bucket.Object(name), chunk, uploadSessionContentType, nil)
+		})
+		if err != nil {
+			w.setErr(fmt.Errorf("uploading component %s: %w", name, err))
+		}
+	}()
+	return nil
+}
+
+func (w *composeWriter) setErr(err error) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if w.err == nil {
+		w.err = err
+	}
+}
+
+func (w *composeWriter) uploadErr() error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	return w.err
+}
+
+// Size returns the number of bytes written to the object, including the
+// bytes it held before.
+func (w *composeWriter) Size() int64 {
+	return w.size
+}
+
+// Close composes the bytes written into the object, as an upload in progress
+// an appending writer resumes from.
+func (w *composeWriter) Close() error {
+	if w.closed {
+		return nil
+	}
+	w.closed = true
+	return w.compose(w.ctx, uploadSessionContentType, map[string]string{composedMetadataKey: "true"})
+}
+
+// Commit composes the bytes written into the object and makes it available
+// for future calls to StorageDriver.GetContent and StorageDriver.Reader.
+func (w *composeWriter) Commit(ctx context.Context) error {
+	if w.closed {
+		return fmt.Errorf("already closed")
+	}
+	w.closed = true
+	if err := w.compose(ctx, blobContentType, nil); err != nil {
+		return err
+	}
+	w.committed = true
+	return nil
+}
+
+// Cancel removes the components and the object written.
+func (w *composeWriter) Cancel(ctx context.Context) error {
+	w.closed = true
+	w.cancelled = true
+	w.pending.Wait()
+	w.deleteTemporaries(ctx, w.components)
+
+	err := w.object.Delete(ctx)
+	if err == storage.ErrObjectNotExist {
+		err = nil
+	}
+	return err
+}
+
+// compose uploads the rest of the buffer and composes the object of the
+// bytes it held and of the components, deleting them afterwards. The writes
+// smaller than a chunk are uploaded directly to the object.
+func (w *composeWriter) compose(ctx context.Context, contentType string, metadata map[string]string) error {
+	if !w.base && len(w.components) == 0 {
+		return retry(func() error {
+			return w.driver.putContent(ctx, w.object, w.buffer, contentType, metadata)
+		})
+	}
+	if len(w.buffer) > 0 {
+		if err := w.upload(); err != nil {
+			return err
+		}
+	}
+	w.pending.Wait()
+
+	var temporaries []string
+	defer func() {
+		w.deleteTemporaries(ctx, temporaries)
+	}()
+	temporaries = append(temporaries, w.components...)
+	if err := w.uploadErr(); err != nil {
+		return err
+	}
+
+	srcs := w.components
+	if w.base {
+		srcs = append([]string{w.object.ObjectName()}, srcs...)
+	}
+	for _, level := range composePlan(w.object.ObjectName(), w.prefix, srcs) {
+		for _, step := range level {
+			if step.dst != w.object.ObjectName() {
+				temporaries = append(temporaries, step.dst)
+			}
+		}
+		err := w.forEach(len(level), func(i int) error {
+			step := level[i]
+			handles := make([]*storage.ObjectHandle, len(step.srcs))
+			for j, src := range step.srcs {
+				handles[j] = w.driver.bucket.Object(src)
+			}
+			composer := w.driver.bucket.Object(step.dst).ComposerFrom(handles...)
+			composer.ContentType = uploadSessionContentType
+			if step.dst == w.object.ObjectName() {
+				composer.ContentType = contentType
+				composer.Metadata = metadata
+			}
+			return retry(func() error {
+				_, err := composer.Run(ctx)
+				return err
+			})
+		})
+		if err != nil {
+			return fmt.Errorf("composing %s: %w", w.object.ObjectName(), err)
+		}
+	}
+
+	w.base = true
+	w.components = nil
+	return nil
+}
+
+// deleteTemporaries deletes the component and intermediate objects, logging
+// the errors: the objects left behind are removed with the upload directory
+// they are stored in.
+func (w *composeWriter) deleteTemporaries(ctx context.Context, names []string) {
+	_ = w.forEach(len(names), func(i int) error {
+		err := w.driver.bucket.Object(names[i]).Delete(ctx)
+		if err != nil && err != storage.ErrObjectNotExist {
+			logrus.Infof("error deleting %v: %v", names[i], err)
+		}
+		return nil
+	})
+}
+
+// forEach calls f for the indexes up to n, up to the compose concurrency at
+// once, returning the first error.
+func (w *composeWriter) forEach(n int, f func(i int) error) error {
+	var (
+		wg    sync.WaitGroup
+		mu    sync.Mutex
+		first error
+	)
+	sem := make(chan struct{}, cap(w.uploads))
+	for i := range n {
+		sem <- struct{}{}
+		wg.Add(1)
+		go func() {
+			defer func() {
+				<-sem
+				wg.Done()
+			}()
+			if err := f(i); err != nil {
+				mu.Lock()
+				if first == nil {
+					first = err
+				}
+				mu.Unlock()
+			}
+		}()
+	}
+	wg.Wait()
+	return first
+}
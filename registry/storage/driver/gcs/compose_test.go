@@ -0,0 +1,252 @@
+package gcs
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"slices"
+	"strings"
+	"testing"
+
+	"cloud.google.com/go/storage"
+	"google.golang.org/api/googleapi"
+	"google.golang.org/api/iterator"
+	"google.golang.org/api/option"
+)
+
+// expandPlan returns the sources the plan concatenates into dst, in order.
+func expandPlan(t *testing.T, levels [][]composeStep, dst string) []string {
+	steps := map[string][]string{}
+	for i, level := range levels {
+		for _, step := range level {
+			if len(step.srcs) > maxComposeSources {
+				t.Fatalf("step of %d sources, more than %d", len(step.srcs), maxComposeSources)
+			}
+			if _, ok := steps[step.dst]; ok {
+				t.Fatalf("%s composed twice", step.dst)
+			}
+			for _, src := range step.srcs {
+				if strings.Contains(src, "compose-") && steps[src] == nil {
+					t.Fatalf("%s composed in level %d from %s before it is composed", step.dst, i, src)
+				}
+			}
+			steps[step.dst] = step.srcs
+		}
+	}
+	var expand func(name string) []string
+	expand = func(name string) []string {
+		srcs, ok := steps[name]
+		if !ok {
+			return []string{name}
+		}
+		var leaves []string
+		for _, src := range srcs {
+			leaves = append(leaves, expand(src)...)
+		}
+		return leaves
+	}
+	return expand(dst)
+}
+
+func TestComposePlan(t *testing.T) {
+	for _, n := range []int{1, 2, maxComposeSources, maxComposeSources + 1, maxComposeSources*maxComposeSources + 1, 5000} {
+		srcs := make([]string, n)
+		for i := range srcs {
+			srcs[i] = fmt.Sprintf("upload.compose/session/%08d", i)
+		}
+		levels := composePlan("upload", "upload.compose/session/", srcs)
+		last := levels[len(levels)-1]
+		if len(last) != 1 || last[0].dst != "upload" {
+			t.Fatalf("%d sources: expected the last level to compose the destination, got %v", n, last)
+		}
+		if leaves := expandPlan(t, levels, "upload"); !slices.Equal(leaves, srcs) {
+			t.Fatalf("%d sources: the plan does not concatenate the sources in order", n)
+		}
+	}
+}
+
+func TestComposeConcurrencyParameter(t *testing.T) {
+	keyfile := writeJSON(t, "key.json", serviceAccountKey(t, "keyfile@project.iam.gserviceaccount.com"))
+	for _, value := range []any{"8", 8, 0, nil} {
+		if _, err := FromParameters(context.Background(), map[string]any{"bucket": "bucket", "keyfile": keyfile, "composeconcurrency": value}); err != nil {
+			t.Fatalf("composeconcurrency %v: unexpected error: %v", value, err)
+		}
+	}
+	if _, err := FromParameters(context.Background(), map[string]any{"bucket": "bucket", "keyfile": keyfile, "composeconcurrency": "many"}); err == nil {
+		t.Fatal("expected an error for an invalid composeconcurrency")
+	}
+}
+
+// newEmulatorDriver returns a driver uploading in chunks of minChunkSize,
+// composed with the concurrency, against the GCS emulator set by
+// STORAGE_EMULATOR_HOST, such as fake-gcs-server.
+func newEmulatorDriver(t *testing.T, composeConcurrency int) *driver {
+	t.Helper()
+	if os.Getenv("STORAGE_EMULATOR_HOST") == "" {
+		t.Skip("STORAGE_EMULATOR_HOST must be set to run the tests against the GCS emulator")
+	}
+	ctx := context.Background()
+	gcs, err := storage.NewClient(ctx, option.WithoutAuthentication())
+	if err != nil {
+		t.Fatal(err)
+	}
+	bucket := gcs.Bucket("registry-compose")
+	var status *googleapi.Error
+	if err := bucket.Create(ctx, "project", nil); err != nil && !(errors.As(err, &status) && status.Code == http.StatusConflict) {
+		t.Fatalf("creating the bucket: %v", err)
+	}
+	return &driver{
+		bucket:             bucket,
+		rootDirectory:      strings.TrimLeft(t.TempDir(), "/") + "/",
+		client:             http.DefaultClient,
+		chunkSize:          minChunkSize,
+		composeConcurrency: composeConcurrency,
+	}
+}
+
+// temporaries returns the names of the component and intermediate objects
+// left behind by the writers of the path.
+func (d *driver) temporaries(t *testing.T, path string) []string {
+	t.Helper()
+	var names []string
+	objects := d.bucket.Objects(context.Background(), &storage.Query{Prefix: d.pathToKey(path) + ".compose/"})
+	for {
+		object, err := objects.Next()
+		if err == iterator.Done {
+			return names
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		names = append(names, object.Name)
+	}
+}
+
+func randomContents(t *testing.T, size int) []byte {
+	t.Helper()
+	contents := make([]byte, size)
+	if _, err := rand.Read(contents); err != nil {
+		t.Fatal(err)
+	}
+	return contents
+}
+
+func writeChunks(t *testing.T, w interface{ Write([]byte) (int, error) }, contents []byte) {
+	t.Helper()
+	for chunk := range slices.Chunk(contents, 100*1024) {
+		if _, err := w.Write(chunk); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func TestComposeWriterTree(t *testing.T) {
+	d := newEmulatorDriver(t, 4)
+	ctx := context.Background()
+	path := "/upload/data"
+
+	// The first write composes a tree of more than 32 components, and the
+	// upload resumed is composed after it.
+	first := randomContents(t, 40*minChunkSize+1000)
+	w, err := d.Writer(ctx, path, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	writeChunks(t, w, first)
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if w.Size() != int64(len(first)) {
+		t.Fatalf("expected size %d, got %d", len(first), w.Size())
+	}
+
+	second := randomContents(t, 3*minChunkSize+7)
+	w, err = d.Writer(ctx, path, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := w.(*composeWriter); !ok {
+		t.Fatalf("expected the upload composed to be resumed by composing, got %T", w)
+	}
+	writeChunks(t, w, second)
+	if err := w.Commit(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	contents, err := d.GetContent(ctx, path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(contents, append(first, second...)) {
+		t.Fatal("the object composed does not match the contents written")
+	}
+	if temporaries := d.temporaries(t, path); len(temporaries) != 0 {
+		t.Fatalf("unexpected temporary objects left %v", temporaries)
+	}
+}
+
+func TestComposeWriterSmall(t *testing.T) {
+	d := newEmulatorDriver(t, 4)
+	ctx := context.Background()
+	path := "/small/data"
+
+	// A write smaller than a chunk is uploaded directly.
+	contents := randomContents(t, minChunkSize-1)
+	w, err := d.Writer(ctx, path, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := w.Write(contents); err != nil {
+		t.Fatal(err)
+	}
+	if len(w.(*composeWriter).components) != 0 {
+		t.Fatal("expected no component uploaded for a small write")
+	}
+	if err := w.Commit(ctx); err != nil {
+		t.Fatal(err)
+	}
+	got, err := d.GetContent(ctx, path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got, contents) {
+		t.Fatal("the object does not match the contents written")
+	}
+}
+
+func TestComposeWriterCancel(t *testing.T) {
+	d := newEmulatorDriver(t, 4)
+	ctx := context.Background()
+	path := "/cancelled/data"
+
+	w, err := d.Writer(ctx, path, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	writeChunks(t, w, randomContents(t, 10*minChunkSize))
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+	w, err = d.Writer(ctx, path, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	writeChunks(t, w, randomContents(t, 10*minChunkSize))
+	if err := w.Cancel(ctx); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := d.bucket.Object(d.pathToKey(path)).Attrs(ctx); err != storage.ErrObjectNotExist {
+		t.Fatalf("expected the object cancelled to be deleted, got %v", err)
+	}
+	if temporaries := d.temporaries(t, path); len(temporaries) != 0 {
+		t.Fatalf("unexpected temporary objects left %v", temporaries)
+	}
+}
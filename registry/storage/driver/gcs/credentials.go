@@ -0,0 +1,222 @@
+package gcs
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"strings"
+
+	"cloud.google.com/go/compute/metadata"
+	"cloud.google.com/go/storage"
+	"golang.org/x/oauth2"
+	"golang.org/x/oauth2/google"
+	"google.golang.org/api/iamcredentials/v1"
+	"google.golang.org/api/impersonate"
+	"google.golang.org/api/option"
+)
+
+// Sources of the driver credentials, in order of precedence.
+const (
+	credentialsSourceKeyfile         = "keyfile"
+	credentialsSourceCredentialsFile = "credentialsfile"
+	credentialsSourceCredentials     = "credentials"
+	credentialsSourceDefault         = "default"
+)
+
+// driverCredentials holds the credentials resolved from the driver parameters.
+type driverCredentials struct {
+	// source is where the credentials were resolved from
+	source string
+	// tokenSource authorizes requests made by the driver
+	tokenSource oauth2.TokenSource
+	// options configure the storage client with the same credentials
+	options []option.ClientOption
+	// email is the service account used to sign URLs, if known
+	email string
+	// privateKey signs URLs locally. If empty, URLs are signed with the IAM
+	// SignBlob API.
+	privateKey []byte
+}
+
+// resolveCredentials resolves the driver credentials from parameters. An
+// explicit keyfile takes precedence over a credentialsfile, which takes
+// precedence over inline credentials; without any of them the Application
+// Default Credentials are used. If a serviceaccount is provided, the resolved
+// credentials are used to impersonate it.
+func resolveCredentials(ctx context.Context, parameters map[string]any) (*driverCredentials, error) {
+	var (
+		creds  *google.Credentials
+		source string
+		err    error
+	)
+
+	keyfile, hasKeyfile := parameters["keyfile"]
+	credentialsFile, hasCredentialsFile := parameters["credentialsfile"]
+	if hasKeyfile && hasCredentialsFile {
+		return nil, fmt.Errorf("only one of keyfile and credentialsfile may be provided")
+	}
+
+	switch {
+	case hasKeyfile, hasCredentialsFile:
+		source, path := credentialsSourceKeyfile, fmt.Sprint(keyfile)
+		if hasCredentialsFile {
+			source, path = credentialsSourceCredentialsFile, fmt.Sprint(credentialsFile)
+		}
+		data, err := os.ReadFile(path)
+		if err != nil {
+			return nil, err
+		}
+		allowed := []google.CredentialsType{google.ServiceAccount}
+		if hasCredentialsFile {
+			allowed = append(allowed, google.ExternalAccount, google.ImpersonatedServiceAccount)
+		}
+		creds, err = credentialsFromJSON(ctx, data, allowed...)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %v", source, err)
+		}
+		return finishCredentials(ctx, parameters, source, creds)
+	}
+
+	if credentials, ok := parameters["credentials"]; ok {
+		credentialMap, ok := credentials.(map[any]any)
+		if !ok {
+			return nil, fmt.Errorf("the credentials were not specified in the correct format")
+		}
+
+		stringMap := map[string]any{}
+		for k, v := range credentialMap {
+			key, ok := k.(string)
+			if !ok {
+				return nil, fmt.Errorf("one of the credential keys was not a string: %s", fmt.Sprint(k))
+			}
+			stringMap[key] = v
+		}
+
+		data, err := json.Marshal(stringMap)
+		if err != nil {
+			return nil, fmt.Errorf("failed to marshal gcs credentials to json")
+		}
+		creds, err = credentialsFromJSON(ctx, data, google.ServiceAccount)
+		if err != nil {
+			return nil, err
+		}
+		source = credentialsSourceCredentials
+	} else {
+		// FindDefaultCredentials walks the Application Default Credentials
+		// chain, which covers GKE workload identity and the metadata server.
+		// https://pkg.go.dev/golang.org/x/oauth2/google#hdr-Credentials
+		creds, err = google.FindDefaultCredentials(ctx, storage.ScopeFullControl)
+		if err != nil {
+			return nil, err
+		}
+		source = credentialsSourceDefault
+	}
+
+	return finishCredentials(ctx, parameters, source, creds)
+}
+
+// credentialsFromJSON loads credentials of one of the allowed types from data.
+func credentialsFromJSON(ctx context.Context, data []byte, allowed ...google.CredentialsType) (*google.Credentials, error) {
+	var f struct {
+		Type google.CredentialsType `json:"type"`
+	}
+	if err := json.Unmarshal(data, &f); err != nil {
+		return nil, err
+	}
+	for _, t := range allowed {
+		if f.Type == t {
+			return google.CredentialsFromJSONWithType(ctx, data, t, storage.ScopeFullControl)
+		}
+	}
+	return nil, fmt.Errorf("unsupported credentials type %q", f.Type)
+}
+
+func finishCredentials(ctx context.Context, parameters map[string]any, source string, creds *google.Credentials) (*driverCredentials, error) {
+	dc := &driverCredentials{
+		source:      source,
+		tokenSource: creds.TokenSource,
+		options:     []option.ClientOption{option.WithCredentials(creds)},
+	}
+
+	var key struct {
+		Type                           string `json:"type"`
+		ServiceAccountImpersonationURL string `json:"service_account_impersonation_url"`
+	}
+	if len(creds.JSON) > 0 {
+		if err := json.Unmarshal(creds.JSON, &key); err != nil {
+			return nil, err
+		}
+	}
+	switch key.Type {
+	case "service_account":
+		jwtConf, err := google.JWTConfigFromJSON(creds.JSON, storage.ScopeFullControl)
+		if err != nil {
+			return nil, err
+		}
+		dc.email = jwtConf.Email
+		dc.privateKey = jwtConf.PrivateKey
+	case "external_account", "impersonated_service_account":
+		// The service account is the one named in the impersonation URL,
+		// e.g. .../serviceAccounts/name@project.iam.gserviceaccount.com:generateAccessToken
+		u := key.ServiceAccountImpersonationURL
+		if start, end := strings.LastIndex(u, "/"), strings.LastIndex(u, ":"); end > start {
+			dc.email = u[start+1 : end]
+		}
+	}
+
+	if serviceAccount, ok := parameters["serviceaccount"]; ok && fmt.Sprint(serviceAccount) != "" {
+		ts, err := impersonate.CredentialsTokenSource(ctx, impersonate.CredentialsConfig{
+			TargetPrincipal: fmt.Sprint(serviceAccount),
+			Scopes:          []string{storage.ScopeFullControl},
+		}, option.WithCredentials(creds))
+		if err != nil {
+			return nil, fmt.Errorf("impersonating %s: %v", serviceAccount, err)
+		}
+		dc.tokenSource = ts
+		dc.options = []option.ClientOption{option.WithTokenSource(ts)}
+		dc.email = fmt.Sprint(serviceAccount)
+		dc.privateKey = nil
+	}
+
+	return dc, nil
+}
+
+// signBlobFunc signs payload as the given service account.
+type signBlobFunc func(ctx context.Context, email string, payload []byte) ([]byte, error)
+
+// iamSignBlob returns a signBlobFunc which signs with the IAM Credentials
+// SignBlob API, authorized by client. This allows signing URLs without a
+// private key, as is the case for workload identity.
+func iamSignBlob(client *http.Client) signBlobFunc {
+	return func(ctx context.Context, email string, payload []byte) ([]byte, error) {
+		svc, err := iamcredentials.NewService(ctx, option.WithHTTPClient(client))
+		if err != nil {
+			return nil, fmt.Errorf("iamcredentials client: %v", err)
+		}
+		resp, err := svc.Projects.ServiceAccounts.SignBlob("projects/-/serviceAccounts/"+email, &iamcredentials.SignBlobRequest{
+			Payload: base64.StdEncoding.EncodeToString(payload),
+		}).Context(ctx).Do()
+		if err != nil {
+			return nil, fmt.Errorf("sign blob: %v", err)
+		}
+		return base64.StdEncoding.DecodeString(resp.SignedBlob)
+	}
+}
+
+// signingEmail returns the service account used to sign URLs, falling back
+// to the default service account of the metadata server.
+func (d *driver) signingEmail() (string, error) {
+	if d.email != "" {
+		return d.email, nil
+	}
+	if metadata.OnGCE() {
+		email, err := metadata.Email("default")
+		if err == nil && email != "" {
+			return email, nil
+		}
+	}
+	return "", fmt.Errorf("unable to sign URLs: no service account email is known, set the serviceaccount parameter")
+}
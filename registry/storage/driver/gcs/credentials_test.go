@@ -0,0 +1,193 @@
+package gcs
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/json"
+	"encoding/pem"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"cloud.google.com/go/storage"
+	"google.golang.org/api/option"
+)
+
+func writeJSON(t *testing.T, name string, v any) string {
+	t.Helper()
+	data, err := json.Marshal(v)
+	if err != nil {
+		t.Fatal(err)
+	}
+	path := filepath.Join(t.TempDir(), name)
+	if err := os.WriteFile(path, data, 0o600); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func serviceAccountKey(t *testing.T, email string) map[string]any {
+	t.Helper()
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	der, err := x509.MarshalPKCS8PrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return map[string]any{
+		"type":           "service_account",
+		"project_id":     "project",
+		"private_key_id": "key-id",
+		"private_key":    string(pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: der})),
+		"client_email":   email,
+		"client_id":      "1234",
+		"token_uri":      "https://oauth2.googleapis.com/token",
+	}
+}
+
+func externalAccount(t *testing.T, email string) map[string]any {
+	t.Helper()
+	tokenFile := filepath.Join(t.TempDir(), "token")
+	if err := os.WriteFile(tokenFile, []byte("subject-token"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	return map[string]any{
+		"type":                              "external_account",
+		"audience":                          "//iam.googleapis.com/projects/1/locations/global/workloadIdentityPools/pool/providers/provider",
+		"subject_token_type":                "urn:ietf:params:oauth:token-type:jwt",
+		"token_url":                         "https://sts.googleapis.com/v1/token",
+		"service_account_impersonation_url": "https://iamcredentials.googleapis.com/v1/projects/-/serviceAccounts/" + email + ":generateAccessToken",
+		"credential_source":                 map[string]any{"file": tokenFile},
+	}
+}
+
+func TestResolveCredentials(t *testing.T) {
+	ctx := context.Background()
+	keyfile := writeJSON(t, "key.json", serviceAccountKey(t, "keyfile@project.iam.gserviceaccount.com"))
+	external := writeJSON(t, "external.json", externalAccount(t, "federated@project.iam.gserviceaccount.com"))
+	inline := map[any]any{}
+	for k, v := range serviceAccountKey(t, "inline@project.iam.gserviceaccount.com") {
+		inline[k] = v
+	}
+	t.Setenv("GOOGLE_APPLICATION_CREDENTIALS", writeJSON(t, "adc.json", serviceAccountKey(t, "adc@project.iam.gserviceaccount.com")))
+
+	for _, tc := range []struct {
+		name       string
+		parameters map[string]any
+		source     string
+		email      string
+		privateKey bool
+	}{
+		{
+			name:       "keyfile over credentials",
+			parameters: map[string]any{"keyfile": keyfile, "credentials": inline},
+			source:     credentialsSourceKeyfile,
+			email:      "keyfile@project.iam.gserviceaccount.com",
+			privateKey: true,
+		},
+		{
+			name:       "credentialsfile with external account",
+			parameters: map[string]any{"credentialsfile": external, "credentials": inline},
+			source:     credentialsSourceCredentialsFile,
+			email:      "federated@project.iam.gserviceaccount.com",
+		},
+		{
+			name:       "inline credentials",
+			parameters: map[string]any{"credentials": inline},
+			source:     credentialsSourceCredentials,
+			email:      "inline@project.iam.gserviceaccount.com",
+			privateKey: true,
+		},
+		{
+			name:       "application default credentials",
+			parameters: map[string]any{},
+			source:     credentialsSourceDefault,
+			email:      "adc@project.iam.gserviceaccount.com",
+			privateKey: true,
+		},
+		{
+			name:       "impersonation",
+			parameters: map[string]any{"keyfile": keyfile, "serviceaccount": "target@project.iam.gserviceaccount.com"},
+			source:     credentialsSourceKeyfile,
+			email:      "target@project.iam.gserviceaccount.com",
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			creds, err := resolveCredentials(ctx, tc.parameters)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if creds.source != tc.source {
+				t.Errorf("expected source %q, got %q", tc.source, creds.source)
+			}
+			if creds.email != tc.email {
+				t.Errorf("expected email %q, got %q", tc.email, creds.email)
+			}
+			if got := len(creds.privateKey) > 0; got != tc.privateKey {
+				t.Errorf("expected private key: %v, got %v", tc.privateKey, got)
+			}
+		})
+	}
+
+	for _, parameters := range []map[string]any{
+		{"keyfile": keyfile, "credentialsfile": external},
+		// keyfile only accepts service account keys
+		{"keyfile": external},
+	} {
+		if _, err := resolveCredentials(ctx, parameters); err == nil {
+			t.Errorf("expected an error for parameters %v", parameters)
+		}
+	}
+}
+
+func TestRedirectURLWithIAMSigner(t *testing.T) {
+	ctx := context.Background()
+	gcs, err := storage.NewClient(ctx, option.WithoutAuthentication())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var signedAs string
+	d, err := New(ctx, driverParameters{
+		bucket:         "bucket",
+		email:          "signer@project.iam.gserviceaccount.com",
+		chunkSize:      defaultChunkSize,
+		maxConcurrency: minConcurrency,
+		gcs:            gcs,
+		signBlob: func(ctx context.Context, email string, payload []byte) ([]byte, error) {
+			signedAs = email
+			return []byte("signature"), nil
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	redirect, err := d.RedirectURL(httptest.NewRequest("GET", "/v2/foo/blobs/sha256:abc", nil), "/docker/registry/v2/blobs/data")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if signedAs != "signer@project.iam.gserviceaccount.com" {
+		t.Fatalf("expected URL to be signed as the service account, got %q", signedAs)
+	}
+	u, err := url.Parse(redirect)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.HasSuffix(u.Path, "/bucket/docker/registry/v2/blobs/data") {
+		t.Fatalf("unexpected redirect path: %s", u.Path)
+	}
+	if got := u.Query().Get("GoogleAccessId"); got != "signer@project.iam.gserviceaccount.com" {
+		t.Fatalf("unexpected GoogleAccessId: %q", got)
+	}
+	if u.Query().Get("Signature") == "" {
+		t.Fatal("expected a signature")
+	}
+}
@@ -15,14 +15,12 @@ import (
 	"bytes"
 	"context"
 	"crypto/md5"
-	"encoding/json"
 	"errors"
 	"fmt"
 	"io"
 	"math/rand"
 	"net/http"
 	"net/url"
-	"os"
 	"reflect"
 	"regexp"
 	"strconv"
@@ -35,8 +33,6 @@ import (
 	"github.com/distribution/distribution/v3/registry/storage/driver/factory"
 	"github.com/sirupsen/logrus"
 	"golang.org/x/oauth2"
-	"golang.org/x/oauth2/google"
-	"golang.org/x/oauth2/jwt"
 	"google.golang.org/api/googleapi"
 	"google.golang.org/api/iterator"
 	"google.golang.org/api/option"
@@ -71,11 +67,20 @@ type driverParameters struct {
 	chunkSize     int
 	gcs           *storage.Client
 
+	// signBlob signs URLs if privateKey is empty. It defaults to the IAM
+	// SignBlob API.
+	signBlob signBlobFunc
+
 	// maxConcurrency limits the number of concurrent driver operations
 	// to GCS, which ultimately increases reliability of many simultaneous
 	// pushes by ensuring we aren't DoSing our own server with many
 	// connections.
 	maxConcurrency uint64
+
+	// composeConcurrency is the number of chunks each writer uploads
+	// concurrently as component objects composed on commit. Zero streams
+	// the chunks to a single resumable upload instead.
+	composeConcurrency int
 }
 
 func init() {
@@ -99,14 +104,18 @@ type driver struct {
 	bucket        *storage.BucketHandle
 	email         string
 	privateKey    []byte
+	signBlob      signBlobFunc
 	rootDirectory string
 	chunkSize     int
+
+	composeConcurrency int
 }
 
 // Wrapper wraps `driver` with a throttler, ensuring that no more than N
 // GCS actions can occur concurrently. The default limit is 75.
 type Wrapper struct {
 	baseEmbed
+	driver *driver
 }
 
 type baseEmbed struct {
@@ -152,58 +161,11 @@ func FromParameters(ctx context.Context, parameters map[string]any) (storagedriv
 		}
 	}
 
-	var ts oauth2.TokenSource
-	jwtConf := new(jwt.Config)
-	var err error
-	var gcs *storage.Client
-	var options []option.ClientOption
-	if keyfile, ok := parameters["keyfile"]; ok {
-		jsonKey, err := os.ReadFile(fmt.Sprint(keyfile))
-		if err != nil {
-			return nil, err
-		}
-		jwtConf, err = google.JWTConfigFromJSON(jsonKey, storage.ScopeFullControl)
-		if err != nil {
-			return nil, err
-		}
-		ts = jwtConf.TokenSource(ctx)
-		options = append(options, option.WithCredentialsFile(fmt.Sprint(keyfile)))
-	} else if credentials, ok := parameters["credentials"]; ok {
-		credentialMap, ok := credentials.(map[any]any)
-		if !ok {
-			return nil, fmt.Errorf("the credentials were not specified in the correct format")
-		}
-
-		stringMap := map[string]any{}
-		for k, v := range credentialMap {
-			key, ok := k.(string)
-			if !ok {
-				return nil, fmt.Errorf("one of the credential keys was not a string: %s", fmt.Sprint(k))
-			}
-			stringMap[key] = v
-		}
-
-		data, err := json.Marshal(stringMap)
-		if err != nil {
-			return nil, fmt.Errorf("failed to marshal gcs credentials to json")
-		}
-
-		jwtConf, err = google.JWTConfigFromJSON(data, storage.ScopeFullControl)
-		if err != nil {
-			return nil, err
-		}
-		ts = jwtConf.TokenSource(ctx)
-		options = append(options, option.WithCredentialsJSON(data))
-	} else {
-		var err error
-		// DefaultTokenSource is a convenience method. It first calls FindDefaultCredentials,
-		// then uses the credentials to construct an http.Client or an oauth2.TokenSource.
-		// https://pkg.go.dev/golang.org/x/oauth2/google#hdr-Credentials
-		ts, err = google.DefaultTokenSource(ctx, storage.ScopeFullControl)
-		if err != nil {
-			return nil, err
-		}
+	creds, err := resolveCredentials(ctx, parameters)
+	if err != nil {
+		return nil, err
 	}
+	options := creds.options
 
 	if userAgent, ok := parameters["useragent"]; ok {
 		if ua, ok := userAgent.(string); ok && ua != "" {
@@ -211,7 +173,7 @@ func FromParameters(ctx context.Context, parameters map[string]any) (storagedriv
 		}
 	}
 
-	gcs, err = storage.NewClient(ctx, options...)
+	gcs, err := storage.NewClient(ctx, options...)
 	if err != nil {
 		return nil, err
 	}
@@ -221,15 +183,21 @@ func FromParameters(ctx context.Context, parameters map[string]any) (storagedriv
 		return nil, fmt.Errorf("maxconcurrency config error: %s", err)
 	}
 
+	composeConcurrency, err := base.GetLimitFromParameter(parameters["composeconcurrency"], 0, 0)
+	if err != nil {
+		return nil, fmt.Errorf("composeconcurrency config error: %s", err)
+	}
+
 	params := driverParameters{
-		bucket:         fmt.Sprint(bucket),
-		rootDirectory:  fmt.Sprint(rootDirectory),
-		email:          jwtConf.Email,
-		privateKey:     jwtConf.PrivateKey,
-		client:         oauth2.NewClient(ctx, ts),
-		chunkSize:      chunkSize,
-		maxConcurrency: maxConcurrency,
-		gcs:            gcs,
+		bucket:             fmt.Sprint(bucket),
+		rootDirectory:      fmt.Sprint(rootDirectory),
+		email:              creds.email,
+		privateKey:         creds.privateKey,
+		client:             oauth2.NewClient(ctx, creds.tokenSource),
+		chunkSize:          chunkSize,
+		maxConcurrency:     maxConcurrency,
+		composeConcurrency: int(composeConcurrency),
+		gcs:                gcs,
 	}
 
 	return New(ctx, params)
@@ -249,8 +217,14 @@ func New(ctx context.Context, params driverParameters) (storagedriver.StorageDri
 		rootDirectory: rootDirectory,
 		email:         params.email,
 		privateKey:    params.privateKey,
+		signBlob:      params.signBlob,
 		client:        params.client,
 		chunkSize:     params.chunkSize,
+
+		composeConcurrency: params.composeConcurrency,
+	}
+	if d.signBlob == nil {
+		d.signBlob = iamSignBlob(params.client)
 	}
 
 	return &Wrapper{
@@ -259,9 +233,16 @@ func New(ctx context.Context, params driverParameters) (storagedriver.StorageDri
 				StorageDriver: base.NewRegulator(d, params.maxConcurrency),
 			},
 		},
+		driver: d,
 	}, nil
 }
 
+// GCSObjectKey returns the name of the object of the bucket for the given
+// storage driver path.
+func (w *Wrapper) GCSObjectKey(path string) string {
+	return w.driver.pathToKey(path)
+}
+
 // Implement the storagedriver.StorageDriver interface
 
 func (d *driver) Name() string {
@@ -337,22 +318,49 @@ func (d *driver) Reader(ctx context.Context, path string, offset int64) (io.Read
 // Writer returns a FileWriter which will store the content written to it
 // at the location designated by "path" after the call to Commit.
 func (d *driver) Writer(ctx context.Context, path string, appendMode bool) (storagedriver.FileWriter, error) {
-	w := &writer{
-		ctx:    ctx,
-		driver: d,
-		object: d.bucket.Object(d.pathToKey(path)),
-		buffer: make([]byte, d.chunkSize),
+	object := d.bucket.Object(d.pathToKey(path))
+	if !appendMode {
+		if d.composeConcurrency > 0 {
+			return d.newComposeWriter(ctx, object, nil), nil
+		}
+		return d.newWriter(ctx, object), nil
 	}
 
-	if appendMode {
-		err := w.init(ctx)
-		if err != nil {
-			return nil, err
-		}
+	attrs, err := object.Attrs(ctx)
+	if err != nil {
+		return nil, err
+	}
+	// NOTE(milosgajdos): when PUSH abruptly finishes by
+	// calling a single commit and then closes the stream
+	// attrs.ContentType ends up being set to application/octet-stream
+	// We must handle this case so the upload can resume.
+	if attrs.ContentType != uploadSessionContentType &&
+		attrs.ContentType != blobContentType {
+		return nil, storagedriver.PathNotFoundError{Path: object.ObjectName()}
+	}
+	// The uploads composed, and the uploads holding all their bytes without
+	// a resumable upload session, are appended to by composing.
+	if attrs.Metadata[composedMetadataKey] != "" ||
+		(d.composeConcurrency > 0 && attrs.Metadata["Session-URI"] == "" && (attrs.Metadata["Offset"] == "" || attrs.Metadata["Offset"] == "0")) {
+		return d.newComposeWriter(ctx, object, attrs), nil
+	}
+
+	w := d.newWriter(ctx, object)
+	if err := w.init(ctx, attrs); err != nil {
+		return nil, err
 	}
 	return w, nil
 }
 
+func (d *driver) newWriter(ctx context.Context, object *storage.ObjectHandle) *writer {
+	return &writer{
+		ctx:    ctx,
+		driver: d,
+		object: object,
+		buffer: make([]byte, d.chunkSize),
+	}
+}
+
 type writer struct {
 	ctx        context.Context
 	object     *storage.ObjectHandle
@@ -540,21 +548,8 @@ func (w *writer) Size() int64 {
 	return w.size
 }
 
-func (w *writer) init(ctx context.Context) error {
-	attrs, err := w.object.Attrs(ctx)
-	if err != nil {
-		return err
-	}
-
-	// NOTE(milosgajdos): when PUSH abruptly finishes by
-	// calling a single commit and then closes the stream
-	// attrs.ContentType ends up being set to application/octet-stream
-	// We must handle this case so the upload can resume.
-	if attrs.ContentType != uploadSessionContentType &&
-		attrs.ContentType != blobContentType {
-		return storagedriver.PathNotFoundError{Path: w.object.ObjectName()}
-	}
-
+func (w *writer) init(ctx context.Context, attrs *storage.ObjectAttrs) error {
+	var err error
 	offset := int64(0)
 	// NOTE(milosgajdos): if a client creates an empty blob, then
 	// closes the stream and then attempts to append to it, the offset
@@ -804,15 +799,87 @@ func (d *driver) RedirectURL(r *http.Request, path string) (string, error) {
 		Method:         r.Method,
 		Expires:        time.Now().Add(20 * time.Minute),
 	}
+	if len(d.privateKey) == 0 {
+		// Without a private key, such as with workload identity, sign with
+		// the IAM API instead.
+		email, err := d.signingEmail()
+		if err != nil {
+			return "", err
+		}
+		ctx := r.Context()
+		opts.GoogleAccessID = email
+		opts.SignBytes = func(b []byte) ([]byte, error) {
+			return d.signBlob(ctx, email, b)
+		}
+	}
 	return d.bucket.SignedURL(d.pathToKey(path), opts)
 }
 
 // Walk traverses a filesystem defined within driver, starting
 // from the given path, calling f on each file
 func (d *driver) Walk(ctx context.Context, path string, f storagedriver.WalkFn, options ...func(*storagedriver.WalkOptions)) error {
+	walkOptions := &storagedriver.WalkOptions{}
+	for _, o := range options {
+		o(walkOptions)
+	}
+	if walkOptions.Parallelism > 1 {
+		// Listing each directory with a delimiter returns the attributes of
+		// its objects, sparing a Stat for each of them.
+		return storagedriver.WalkParallel(ctx, path, d.listFileInfos, f, options...)
+	}
 	return storagedriver.WalkFallback(ctx, d, path, f, options...)
 }
 
+// listFileInfos returns the files and directories directly within path,
+// listed with a delimiter.
+func (d *driver) listFileInfos(ctx context.Context, path string) ([]storagedriver.FileInfo, error) {
+	dirKey := d.pathToDirKey(path)
+	query := &storage.Query{
+		Delimiter: "/",
+		Prefix:    dirKey,
+	}
+	objects := d.bucket.Objects(ctx, query)
+
+	var (
+		fileInfos []storagedriver.FileInfo
+		found     bool
+	)
+	for {
+		object, err := objects.Next()
+		if err != nil {
+			if err == iterator.Done {
+				break
+			}
+			return nil, err
+		}
+		found = true
+		// GCS does not guarantee strong consistency between
+		// DELETE and LIST operations. Check that the object is not deleted,
+		// and filter out any objects with a non-zero time-deleted
+		if object.Deleted.IsZero() && object.ContentType != uploadSessionContentType && object.Name != "" && object.Name != dirKey {
+			fileInfos = append(fileInfos, storagedriver.FileInfoInternal{FileInfoFields: storagedriver.FileInfoFields{
+				Path:    d.keyToPath(object.Name),
+				Size:    object.Size,
+				ModTime: object.Updated,
+			}})
+		}
+
+		if object.Name == "" && object.Prefix != "" {
+			fileInfos = append(fileInfos, storagedriver.FileInfoInternal{FileInfoFields: storagedriver.FileInfoFields{
+				Path:  d.keyToPath(object.Prefix),
+				IsDir: true,
+			}})
+		}
+	}
+
+	if path != "/" && !found {
+		// Treat empty response as missing directory, since we don't actually
+		// have directories in Google Cloud Storage.
+		return nil, storagedriver.PathNotFoundError{Path: path}
+	}
+	return fileInfos, nil
+}
+
 func (w *writer) newSession() (uri string, err error) {
 	u := &url.URL{
 		Scheme:   "https",
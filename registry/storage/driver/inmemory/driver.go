@@ -244,6 +244,22 @@ func (d *driver) RedirectURL(*http.Request, string) (string, error) {
 	return "", nil
 }
 
+// Usage returns the number of bytes stored under path and the number of files
+// storing them.
+func (d *driver) Usage(ctx context.Context, path string) (int64, int64, error) {
+	d.mutex.RLock()
+	defer d.mutex.RUnlock()
+
+	normalized := normalize(path)
+	found := d.root.find(normalized)
+	if found.path() != normalized {
+		return 0, 0, nil
+	}
+
+	bytes, objects := usage(found)
+	return bytes, objects, nil
+}
+
 // Walk traverses a filesystem defined within driver, starting
 // from the given path, calling f on each file and directory
 func (d *driver) Walk(ctx context.Context, path string, f storagedriver.WalkFn, options ...func(*storagedriver.WalkOptions)) error {
@@ -110,6 +110,20 @@ func (d *dir) list(p string) ([]string, error) {
 	return children, nil
 }
 
+// usage returns the number of bytes stored under n and the number of files
+// storing them.
+func usage(n node) (bytes, objects int64) {
+	if !n.isdir() {
+		return int64(len(n.(*file).data)), 1
+	}
+	for _, child := range n.(*dir).children {
+		b, o := usage(child)
+		bytes += b
+		objects += o
+	}
+	return bytes, objects
+}
+
 // mkfile or return the existing one. returns an error if it exists and is a
 // directory. Essentially, this is open or create.
 func (d *dir) mkfile(p string) (*file, error) {
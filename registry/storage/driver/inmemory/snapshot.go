@@ -0,0 +1,93 @@
+package inmemory
+
+import (
+	"bytes"
+	"encoding/gob"
+	"fmt"
+	"path"
+	"sort"
+	"time"
+)
+
+// snapshotNode is a file or directory of a snapshot, along with the
+// directories and files under it.
+type snapshotNode struct {
+	Name     string
+	ModTime  time.Time
+	IsDir    bool
+	Data     []byte
+	Children []snapshotNode
+}
+
+// Snapshot returns the content of the driver, encoded with gob, so that it can
+// be restored with Restore on this driver or another one.
+func (d *Driver) Snapshot() ([]byte, error) {
+	md := d.StorageDriver.(*driver)
+	md.mutex.RLock()
+	root := snapshot(md.root, "")
+	md.mutex.RUnlock()
+
+	var buf bytes.Buffer
+	if err := gob.NewEncoder(&buf).Encode(root); err != nil {
+		return nil, fmt.Errorf("unable to encode snapshot: %v", err)
+	}
+	return buf.Bytes(), nil
+}
+
+// Restore replaces the content of the driver with the content of a snapshot
+// returned by Snapshot. The writers opened before Restore no longer change the
+// content of the driver.
+func (d *Driver) Restore(p []byte) error {
+	var root snapshotNode
+	if err := gob.NewDecoder(bytes.NewReader(p)).Decode(&root); err != nil {
+		return fmt.Errorf("unable to decode snapshot: %v", err)
+	}
+	if !root.IsDir {
+		return fmt.Errorf("invalid snapshot: the root is not a directory")
+	}
+
+	restored := restore(root, "/").(*dir)
+	md := d.StorageDriver.(*driver)
+	md.mutex.Lock()
+	md.root = restored
+	md.mutex.Unlock()
+	return nil
+}
+
+// snapshot copies n, named name, and the nodes under it. The names of the
+// children are the keys of their parent, rather than their paths.
+func snapshot(n node, name string) snapshotNode {
+	sn := snapshotNode{Name: name, ModTime: n.modtime(), IsDir: n.isdir()}
+	if !sn.IsDir {
+		sn.Data = bytes.Clone(n.(*file).data)
+		return sn
+	}
+
+	children := n.(*dir).children
+	names := make([]string, 0, len(children))
+	for childName := range children {
+		names = append(names, childName)
+	}
+	sort.Strings(names)
+	for _, childName := range names {
+		sn.Children = append(sn.Children, snapshot(children[childName], childName))
+	}
+	return sn
+}
+
+// restore returns the node at p copied from sn, and the nodes under it.
+func restore(sn snapshotNode, p string) node {
+	c := common{p: p, mod: sn.ModTime}
+	if !sn.IsDir {
+		return &file{common: c, data: sn.Data}
+	}
+
+	d := &dir{common: c}
+	if len(sn.Children) > 0 {
+		d.children = make(map[string]node, len(sn.Children))
+	}
+	for _, child := range sn.Children {
+		d.children[child.Name] = restore(child, path.Join(p, child.Name))
+	}
+	return d
+}
@@ -0,0 +1,111 @@
+package inmemory
+
+import (
+	"context"
+	"maps"
+	"testing"
+
+	storagedriver "github.com/distribution/distribution/v3/registry/storage/driver"
+	"github.com/distribution/distribution/v3/registry/storage/driver/testsuites"
+)
+
+// listFiles returns the content of all the files stored by d.
+func listFiles(t *testing.T, d storagedriver.StorageDriver) map[string]string {
+	ctx := context.Background()
+	files := make(map[string]string)
+	err := d.Walk(ctx, "/", func(fi storagedriver.FileInfo) error {
+		if fi.IsDir() {
+			return nil
+		}
+		content, err := d.GetContent(ctx, fi.Path())
+		if err != nil {
+			return err
+		}
+		files[fi.Path()] = string(content)
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return files
+}
+
+func TestSnapshotRestore(t *testing.T) {
+	ctx := context.Background()
+	d := New()
+	for path, content := range map[string]string{
+		"/docker/registry/v2/blobs/sha256/ab/abc/data":                 "layer",
+		"/docker/registry/v2/repositories/app/_layers/sha256/abc/link": "sha256:abc",
+		"/docker/registry/v2/repositories/app/_uploads/1/startedat":    "",
+	} {
+		if err := d.PutContent(ctx, path, []byte(content)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// Moved directories keep their content.
+	if err := d.Move(ctx, "/docker/registry/v2/repositories/app", "/docker/registry/v2/repositories/moved"); err != nil {
+		t.Fatal(err)
+	}
+	expected := map[string]string{
+		"/docker/registry/v2/blobs/sha256/ab/abc/data":                   "layer",
+		"/docker/registry/v2/repositories/moved/_layers/sha256/abc/link": "sha256:abc",
+		"/docker/registry/v2/repositories/moved/_uploads/1/startedat":    "",
+	}
+
+	snapshot, err := d.Snapshot()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Restoring a driver which has seen writes replaces its content.
+	if err := d.PutContent(ctx, "/docker/registry/v2/blobs/sha256/ab/abc/data", []byte("changed")); err != nil {
+		t.Fatal(err)
+	}
+	if err := d.PutContent(ctx, "/extra", []byte("extra")); err != nil {
+		t.Fatal(err)
+	}
+	if err := d.Restore(snapshot); err != nil {
+		t.Fatal(err)
+	}
+	if files := listFiles(t, d); !maps.Equal(files, expected) {
+		t.Fatalf("expected %v after restore, got %v", expected, files)
+	}
+	fi, err := d.Stat(ctx, "/docker/registry/v2/repositories/moved/_layers/sha256/abc/link")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if fi.Path() != "/docker/registry/v2/repositories/moved/_layers/sha256/abc/link" || fi.Size() != int64(len("sha256:abc")) {
+		t.Fatalf("unexpected file info %v", fi)
+	}
+
+	if err := d.Restore([]byte("not a snapshot")); err == nil {
+		t.Fatal("expected an error restoring an invalid snapshot")
+	}
+}
+
+func TestFixture(t *testing.T) {
+	ctx := context.Background()
+	d := New()
+	if err := d.PutContent(ctx, "/fixture", []byte("fixture")); err != nil {
+		t.Fatal(err)
+	}
+	fixture, err := testsuites.NewFixture(d, func() (storagedriver.StorageDriver, error) {
+		return New(), nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The copies of the fixture are independent.
+	first, second := fixture.Driver(t), fixture.Driver(t)
+	if err := first.PutContent(ctx, "/fixture", []byte("changed")); err != nil {
+		t.Fatal(err)
+	}
+	content, err := second.GetContent(ctx, "/fixture")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(content) != "fixture" {
+		t.Fatalf("expected the content of the fixture, got %q", content)
+	}
+}
@@ -10,6 +10,7 @@ import (
 	"net/http"
 	"net/url"
 	"os"
+	"strconv"
 	"strings"
 	"time"
 
@@ -27,18 +28,33 @@ func init() {
 	}
 }
 
+// acceptCookiesHeader is the request header with which a client may signal
+// that it does not accept cookies, by setting it to false.
+const acceptCookiesHeader = "X-Registry-Accept-Cookies"
+
 // cloudFrontStorageMiddleware provides a simple implementation of layerHandler that
 // constructs temporary signed CloudFront URLs from the storagedriver layer URL,
-// then issues HTTP Temporary Redirects to this CloudFront content URL.
+// then issues HTTP Temporary Redirects to this CloudFront content URL. In the
+// cookie signing mode, the redirect is to the unsigned URL, and the signature
+// is carried by CloudFront signed cookies set on the redirect response.
 type cloudFrontStorageMiddleware struct {
 	storagedriver.StorageDriver
 	awsIPs    *awsIPs
 	urlSigner *sign.URLSigner
 	baseURL   string
 	duration  time.Duration
+
+	// cookieSigner is set in the cookie signing mode.
+	cookieSigner   *sign.CookieSigner
+	cookieDomain   string
+	cookiePath     string
+	cookieLifetime time.Duration
 }
 
-var _ storagedriver.StorageDriver = &cloudFrontStorageMiddleware{}
+var (
+	_ storagedriver.StorageDriver    = &cloudFrontStorageMiddleware{}
+	_ storagedriver.CookieRedirector = &cloudFrontStorageMiddleware{}
+)
 
 // newCloudFrontStorageMiddleware constructs and returns a new CloudFront
 // LayerHandler implementation.
@@ -57,6 +73,15 @@ var _ storagedriver.StorageDriver = &cloudFrontStorageMiddleware{}
 //     default value. "aws", only aws IP goes to S3 directly. "awsregion", only
 //     regions listed in awsregion options goes to S3 directly
 //   - awsregion: a comma separated string of AWS regions.
+//   - signingmode: valid value "url|cookie". "url", redirect to signed URLs,
+//     default value. "cookie", redirect to unsigned URLs and set CloudFront
+//     signed cookies on the redirect response.
+//   - cookiedomain: the domain of the signed cookies, required in the cookie
+//     signing mode.
+//   - cookiepath: the path of the signed cookies, defaults to the path of
+//     the object redirected to.
+//   - cookielifetime: how long the signed cookies are valid, defaults to
+//     duration.
 func newCloudFrontStorageMiddleware(ctx context.Context, storageDriver storagedriver.StorageDriver, options map[string]any) (storagedriver.StorageDriver, error) {
 	// parse baseurl
 	base, ok := options["baseurl"]
@@ -195,13 +220,67 @@ func newCloudFrontStorageMiddleware(ctx context.Context, storageDriver storagedr
 		}
 	}
 
-	return &cloudFrontStorageMiddleware{
+	lh := &cloudFrontStorageMiddleware{
 		StorageDriver: storageDriver,
 		urlSigner:     urlSigner,
 		baseURL:       baseURL,
 		duration:      duration,
 		awsIPs:        awsIPs,
-	}, nil
+	}
+
+	// parse signingmode
+	signingMode := "url"
+	if m, ok := options["signingmode"]; ok {
+		if signingMode, ok = m.(string); !ok {
+			return nil, fmt.Errorf("signingmode must be a string")
+		}
+	}
+	switch strings.ToLower(strings.TrimSpace(signingMode)) {
+	case "", "url":
+		return lh, nil
+	case "cookie":
+	default:
+		return nil, fmt.Errorf("signingmode only allows a string with the following value: url|cookie")
+	}
+
+	// parse cookiedomain
+	cd, ok := options["cookiedomain"]
+	if !ok {
+		return nil, fmt.Errorf("no cookiedomain provided")
+	}
+	if lh.cookieDomain, ok = cd.(string); !ok || lh.cookieDomain == "" {
+		return nil, fmt.Errorf("cookiedomain must be a non-empty string")
+	}
+
+	// parse cookiepath
+	if cp, ok := options["cookiepath"]; ok {
+		if lh.cookiePath, ok = cp.(string); !ok || !strings.HasPrefix(lh.cookiePath, "/") {
+			return nil, fmt.Errorf("cookiepath must be an absolute path")
+		}
+	}
+
+	// parse cookielifetime
+	lh.cookieLifetime = duration
+	if l, ok := options["cookielifetime"]; ok {
+		switch l := l.(type) {
+		case time.Duration:
+			lh.cookieLifetime = l
+		case string:
+			lifetime, err := time.ParseDuration(l)
+			if err != nil {
+				return nil, fmt.Errorf("invalid cookielifetime: %s", err)
+			}
+			lh.cookieLifetime = lifetime
+		default:
+			return nil, fmt.Errorf("cookielifetime must be a duration")
+		}
+	}
+	if lh.cookieLifetime <= 0 {
+		return nil, fmt.Errorf("cookielifetime must be positive, %v invalid", lh.cookieLifetime)
+	}
+
+	lh.cookieSigner = sign.NewCookieSigner(keypairID, privateKey)
+	return lh, nil
 }
 
 // S3BucketKeyer is any type that is capable of returning the S3 bucket key
@@ -231,3 +310,50 @@ func (lh *cloudFrontStorageMiddleware) RedirectURL(r *http.Request, path string)
 	}
 	return cfURL, nil
 }
+
+// RedirectURLWithCookies returns the URL to redirect to along with the
+// CloudFront signed cookies granting access to it, in the cookie signing
+// mode. Otherwise, and for clients which do not accept cookies, it returns
+// the URL returned by RedirectURL.
+func (lh *cloudFrontStorageMiddleware) RedirectURLWithCookies(r *http.Request, path string) (string, []*http.Cookie, error) {
+	keyer, ok := lh.StorageDriver.(S3BucketKeyer)
+	if lh.cookieSigner == nil || !ok || !acceptsCookies(r) || eligibleForS3(r, lh.awsIPs) {
+		redirectURL, err := lh.RedirectURL(r, path)
+		return redirectURL, nil, err
+	}
+
+	resource := lh.baseURL + keyer.S3BucketKey(path)
+	cookiePath := lh.cookiePath
+	if cookiePath == "" {
+		u, err := url.Parse(resource)
+		if err != nil {
+			return "", nil, err
+		}
+		cookiePath = u.EscapedPath()
+	}
+
+	expires := time.Now().Add(lh.cookieLifetime)
+	cookies, err := lh.cookieSigner.SignWithPolicy(sign.NewCannedPolicy(resource, expires), func(o *sign.CookieOptions) {
+		o.Domain = lh.cookieDomain
+		o.Path = cookiePath
+		o.Secure = strings.HasPrefix(resource, "https://")
+	})
+	if err != nil {
+		return "", nil, err
+	}
+	for _, cookie := range cookies {
+		cookie.Expires = expires
+		cookie.MaxAge = int(lh.cookieLifetime.Seconds())
+	}
+	return resource, cookies, nil
+}
+
+// acceptsCookies reports whether the client of the request r accepts cookies.
+func acceptsCookies(r *http.Request) bool {
+	v := r.Header.Get(acceptCookiesHeader)
+	if v == "" {
+		return true
+	}
+	accepts, err := strconv.ParseBool(v)
+	return err != nil || accepts
+}
@@ -0,0 +1,90 @@
+package middleware
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"io"
+)
+
+// A compressed object is a sequence of zstd frames between two skippable
+// frames, so that it remains a valid zstd stream:
+//
+//	header: skippable frame | "RGZ1"
+//	zstd frames
+//	footer: skippable frame | "RGZS" | plaintext size
+//
+// Objects which do not start with the header are stored uncompressed. Each
+// write appends independent frames, and committing it appends a footer whose
+// size covers everything written before it.
+const (
+	headerSize = 4 + 4 + len(headerMagic)
+	footerSize = 4 + 4 + len(footerMagic) + 8
+
+	headerMagic = "RGZ1"
+	footerMagic = "RGZS"
+
+	// skippableFrame is the magic number of the skippable frames, in
+	// little endian.
+	skippableFrame = 0x184D2A5E
+)
+
+var errNoFooter = errors.New("compress: object has no footer")
+
+// header is the start of every compressed object.
+var header = func() []byte {
+	b := binary.LittleEndian.AppendUint32(nil, skippableFrame)
+	b = binary.LittleEndian.AppendUint32(b, uint32(len(headerMagic)))
+	return append(b, headerMagic...)
+}()
+
+func isCompressed(prefix []byte) bool {
+	return bytes.Equal(prefix, header)
+}
+
+func footer(size int64) []byte {
+	b := binary.LittleEndian.AppendUint32(nil, skippableFrame)
+	b = binary.LittleEndian.AppendUint32(b, uint32(len(footerMagic)+8))
+	b = append(b, footerMagic...)
+	return binary.LittleEndian.AppendUint64(b, uint64(size))
+}
+
+// parseFooter returns the plaintext size held in the footer read from r.
+func parseFooter(r io.Reader) (int64, error) {
+	b := make([]byte, footerSize)
+	if _, err := io.ReadFull(r, b); err != nil {
+		return 0, errNoFooter
+	}
+	if !bytes.Equal(b[:footerSize-8], footer(0)[:footerSize-8]) {
+		return 0, errNoFooter
+	}
+	return int64(binary.LittleEndian.Uint64(b[footerSize-8:])), nil
+}
+
+// compressedMagic holds the magic numbers of formats which are not worth
+// compressing again.
+var compressedMagic = [][]byte{
+	{0x1f, 0x8b},                      // gzip
+	{0x28, 0xb5, 0x2f, 0xfd},          // zstd
+	{0xfd, '7', 'z', 'X', 'Z', 0x00},  // xz
+	{'B', 'Z', 'h'},                   // bzip2
+	{0x04, 0x22, 0x4d, 0x18},          // lz4
+	{'P', 'K', 0x03, 0x04},            // zip
+	{0x89, 'P', 'N', 'G', '\r', '\n'}, // png
+	{0xff, 0xd8, 0xff},                // jpeg
+}
+
+// sniffSize is the number of bytes needed to recognize compressed content.
+const sniffSize = 6
+
+// alreadyCompressed reports whether content starting with prefix is already
+// compressed. A prefix shorter than sniffSize is only checked against the
+// magic numbers it can hold entirely.
+func alreadyCompressed(prefix []byte) bool {
+	for _, magic := range compressedMagic {
+		if bytes.HasPrefix(prefix, magic) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,346 @@
+// Package middleware - compress wrapper for storage drivers, compressing the
+// content stored through it with zstd.
+package middleware
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+
+	storagedriver "github.com/distribution/distribution/v3/registry/storage/driver"
+	storagemiddleware "github.com/distribution/distribution/v3/registry/storage/driver/middleware"
+	"github.com/klauspost/compress/zstd"
+	"github.com/sirupsen/logrus"
+)
+
+// pendingSuffix is appended to the path of an object to name the object
+// holding the state of an unfinished write.
+const pendingSuffix = ".zstpending"
+
+func init() {
+	if err := storagemiddleware.Register("compress", newCompressStorageMiddleware); err != nil {
+		logrus.Errorf("failed to register compress storage middleware: %v", err)
+	}
+}
+
+// compressStorageMiddleware compresses the content written through it with
+// zstd before it is passed to the storage driver, and decompresses the
+// content read through it. Content which is already compressed, and paths
+// which are excluded, are stored as they are.
+type compressStorageMiddleware struct {
+	storagedriver.StorageDriver
+	level   zstd.EncoderLevel
+	encoder *zstd.Encoder
+	exclude []string
+	sniff   bool
+}
+
+var _ storagedriver.StorageDriver = &compressStorageMiddleware{}
+
+// newCompressStorageMiddleware constructs and returns a new compress storage
+// middleware.
+//
+// Optional options:
+//
+//   - level: the zstd compression level, either fastest, default, better,
+//     best or a zstd level between 1 and 22
+//   - exclude: a list of path prefixes which are not compressed
+//   - sniff: whether to leave content recognized as compressed uncompressed,
+//     defaults to true
+func newCompressStorageMiddleware(ctx context.Context, sd storagedriver.StorageDriver, options map[string]any) (storagedriver.StorageDriver, error) {
+	level := zstd.SpeedDefault
+	switch v := options["level"].(type) {
+	case nil:
+	case int:
+		if v < 1 || v > 22 {
+			return nil, fmt.Errorf("level must be between 1 and 22, %d invalid", v)
+		}
+		level = zstd.EncoderLevelFromZstd(v)
+	case string:
+		ok, l := zstd.EncoderLevelFromString(v)
+		if !ok {
+			return nil, fmt.Errorf("level must be fastest, default, better or best, %s invalid", v)
+		}
+		level = l
+	default:
+		return nil, fmt.Errorf("level must be a string or an integer, %v invalid", v)
+	}
+
+	var exclude []string
+	switch v := options["exclude"].(type) {
+	case nil:
+	case []string:
+		exclude = v
+	case []any:
+		for _, e := range v {
+			s, ok := e.(string)
+			if !ok {
+				return nil, fmt.Errorf("exclude must be a list of paths, %v invalid", e)
+			}
+			exclude = append(exclude, s)
+		}
+	default:
+		return nil, fmt.Errorf("exclude must be a list of paths, %v invalid", v)
+	}
+	for _, prefix := range exclude {
+		if !strings.HasPrefix(prefix, "/") {
+			return nil, fmt.Errorf("exclude must be a list of absolute paths, %s invalid", prefix)
+		}
+	}
+
+	sniff := true
+	switch v := options["sniff"].(type) {
+	case nil:
+	case bool:
+		sniff = v
+	case string:
+		var err error
+		sniff, err = strconv.ParseBool(v)
+		if err != nil {
+			return nil, fmt.Errorf("sniff must be a boolean, %s invalid", v)
+		}
+	default:
+		return nil, fmt.Errorf("sniff must be a boolean, %v invalid", v)
+	}
+
+	encoder, err := zstd.NewWriter(nil, zstd.WithEncoderLevel(level))
+	if err != nil {
+		return nil, err
+	}
+	return &compressStorageMiddleware{
+		StorageDriver: sd,
+		level:         level,
+		encoder:       encoder,
+		exclude:       exclude,
+		sniff:         sniff,
+	}, nil
+}
+
+func (m *compressStorageMiddleware) excluded(path string) bool {
+	for _, prefix := range m.exclude {
+		if strings.HasPrefix(path, prefix) {
+			return true
+		}
+	}
+	return false
+}
+
+// compressible reports whether content at path starting with prefix is
+// stored compressed.
+func (m *compressStorageMiddleware) compressible(path string, prefix []byte) bool {
+	if m.excluded(path) {
+		return false
+	}
+	return !m.sniff || !alreadyCompressed(prefix)
+}
+
+func (m *compressStorageMiddleware) newEncoder(w io.Writer) (*zstd.Encoder, error) {
+	return zstd.NewWriter(w, zstd.WithEncoderLevel(m.level), zstd.WithEncoderConcurrency(1))
+}
+
+// GetContent retrieves the content stored at "path" as a []byte.
+func (m *compressStorageMiddleware) GetContent(ctx context.Context, path string) ([]byte, error) {
+	object, err := m.StorageDriver.GetContent(ctx, path)
+	if err != nil {
+		return nil, err
+	}
+	if len(object) < headerSize || !isCompressed(object[:headerSize]) {
+		return object, nil
+	}
+	d, err := zstd.NewReader(bytes.NewReader(object), zstd.WithDecoderConcurrency(1))
+	if err != nil {
+		return nil, err
+	}
+	defer d.Close()
+	return io.ReadAll(d)
+}
+
+// PutContent stores the []byte content at a location designated by "path".
+func (m *compressStorageMiddleware) PutContent(ctx context.Context, path string, content []byte) error {
+	if !m.compressible(path, content[:min(len(content), sniffSize)]) {
+		return m.StorageDriver.PutContent(ctx, path, content)
+	}
+	object := append([]byte{}, header...)
+	object = m.encoder.EncodeAll(content, object)
+	object = append(object, footer(int64(len(content)))...)
+	return m.StorageDriver.PutContent(ctx, path, object)
+}
+
+// Reader retrieves an io.ReadCloser for the content stored at "path" with a
+// given byte offset. Compressed objects are decompressed from the start, up
+// to the offset.
+func (m *compressStorageMiddleware) Reader(ctx context.Context, path string, offset int64) (io.ReadCloser, error) {
+	if offset < 0 {
+		return nil, storagedriver.InvalidOffsetError{Path: path, Offset: offset, DriverName: m.Name()}
+	}
+	rc, prefix, err := m.open(ctx, path)
+	if err != nil {
+		return nil, err
+	}
+	if !isCompressed(prefix) {
+		if offset == 0 {
+			return &readCloser{Reader: io.MultiReader(bytes.NewReader(prefix), rc), Closer: rc}, nil
+		}
+		rc.Close()
+		return m.StorageDriver.Reader(ctx, path, offset)
+	}
+
+	d, err := zstd.NewReader(rc, zstd.WithDecoderConcurrency(1))
+	if err != nil {
+		rc.Close()
+		return nil, err
+	}
+	r := &decompressReader{Decoder: d, rc: rc}
+	if offset > 0 {
+		if _, err := io.CopyN(io.Discard, d, offset); err != nil && err != io.EOF {
+			r.Close()
+			return nil, err
+		}
+	}
+	return r, nil
+}
+
+// open returns a reader of the object at path along with the first bytes
+// read from it, which are the header of compressed objects.
+func (m *compressStorageMiddleware) open(ctx context.Context, path string) (io.ReadCloser, []byte, error) {
+	rc, err := m.StorageDriver.Reader(ctx, path, 0)
+	if err != nil {
+		return nil, nil, err
+	}
+	prefix := make([]byte, headerSize)
+	n, err := io.ReadFull(rc, prefix)
+	if err != nil && err != io.EOF && err != io.ErrUnexpectedEOF {
+		rc.Close()
+		return nil, nil, err
+	}
+	return rc, prefix[:n], nil
+}
+
+// Writer returns a FileWriter which will store the content written to it
+// at the location designated by "path" after the call to Commit.
+func (m *compressStorageMiddleware) Writer(ctx context.Context, path string, append bool) (storagedriver.FileWriter, error) {
+	if m.excluded(path) {
+		return m.StorageDriver.Writer(ctx, path, append)
+	}
+	if !append {
+		return m.newWriter(ctx, path)
+	}
+
+	pending, err := m.StorageDriver.GetContent(ctx, pendingPath(path))
+	if err == nil {
+		return m.resumeWriter(ctx, path, pending)
+	}
+	if !errors.As(err, &storagedriver.PathNotFoundError{}) {
+		return nil, err
+	}
+	return m.appendWriter(ctx, path)
+}
+
+// Stat retrieves the FileInfo for the given path, reporting the size of
+// the plaintext of compressed objects.
+func (m *compressStorageMiddleware) Stat(ctx context.Context, path string) (storagedriver.FileInfo, error) {
+	fi, err := m.StorageDriver.Stat(ctx, path)
+	if err != nil || fi.IsDir() {
+		return fi, err
+	}
+	size, compressed, err := m.plaintextSize(ctx, path, fi.Size())
+	if err != nil || !compressed {
+		return fi, err
+	}
+	return storagedriver.FileInfoInternal{FileInfoFields: storagedriver.FileInfoFields{
+		Path:    fi.Path(),
+		Size:    size,
+		ModTime: fi.ModTime(),
+	}}, nil
+}
+
+// plaintextSize returns the size of the plaintext of the object at path, given
+// the size of the object, if it is compressed.
+func (m *compressStorageMiddleware) plaintextSize(ctx context.Context, path string, objectSize int64) (int64, bool, error) {
+	rc, prefix, err := m.open(ctx, path)
+	if err != nil {
+		return 0, false, err
+	}
+	rc.Close()
+	if !isCompressed(prefix) {
+		return 0, false, nil
+	}
+	if objectSize < int64(headerSize+footerSize) {
+		return 0, true, errNoFooter
+	}
+	rc, err = m.StorageDriver.Reader(ctx, path, objectSize-int64(footerSize))
+	if err != nil {
+		return 0, true, err
+	}
+	defer rc.Close()
+	size, err := parseFooter(rc)
+	return size, true, err
+}
+
+// List returns a list of the objects that are direct descendants of the
+// given path, leaving out the state of unfinished writes.
+func (m *compressStorageMiddleware) List(ctx context.Context, path string) ([]string, error) {
+	children, err := m.StorageDriver.List(ctx, path)
+	if err != nil {
+		return nil, err
+	}
+	filtered := children[:0]
+	for _, child := range children {
+		if !strings.HasSuffix(child, pendingSuffix) {
+			filtered = append(filtered, child)
+		}
+	}
+	return filtered, nil
+}
+
+// Walk traverses a filesystem defined within driver, leaving out the state
+// of unfinished writes. The sizes reported are those of the stored objects.
+func (m *compressStorageMiddleware) Walk(ctx context.Context, path string, f storagedriver.WalkFn, options ...func(*storagedriver.WalkOptions)) error {
+	return m.StorageDriver.Walk(ctx, path, func(fi storagedriver.FileInfo) error {
+		if strings.HasSuffix(fi.Path(), pendingSuffix) {
+			return nil
+		}
+		return f(fi)
+	}, options...)
+}
+
+// RedirectURL returns a URL which may be used to retrieve the content stored
+// at the given path, unless it is stored compressed.
+func (m *compressStorageMiddleware) RedirectURL(r *http.Request, path string) (string, error) {
+	if !m.excluded(path) {
+		rc, prefix, err := m.open(r.Context(), path)
+		if err != nil {
+			return "", err
+		}
+		rc.Close()
+		if isCompressed(prefix) {
+			return "", nil
+		}
+	}
+	return m.StorageDriver.RedirectURL(r, path)
+}
+
+func pendingPath(path string) string {
+	return path + pendingSuffix
+}
+
+type readCloser struct {
+	io.Reader
+	io.Closer
+}
+
+// decompressReader decompresses the content read from an object.
+type decompressReader struct {
+	*zstd.Decoder
+	rc io.ReadCloser
+}
+
+func (r *decompressReader) Close() error {
+	r.Decoder.Close()
+	return r.rc.Close()
+}
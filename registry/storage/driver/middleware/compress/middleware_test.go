@@ -0,0 +1,382 @@
+package middleware
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"crypto/rand"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	storagedriver "github.com/distribution/distribution/v3/registry/storage/driver"
+	"github.com/distribution/distribution/v3/registry/storage/driver/inmemory"
+	"github.com/distribution/distribution/v3/registry/storage/driver/testsuites"
+	"github.com/stretchr/testify/require"
+)
+
+func newTestMiddleware(t testing.TB, sd storagedriver.StorageDriver, options map[string]any) *compressStorageMiddleware {
+	t.Helper()
+	m, err := newCompressStorageMiddleware(context.Background(), sd, options)
+	require.NoError(t, err)
+	return m.(*compressStorageMiddleware)
+}
+
+// jsonContent returns compressible content of the given size.
+func jsonContent(size int) []byte {
+	var b bytes.Buffer
+	for i := 0; b.Len() < size; i++ {
+		fmt.Fprintf(&b, `{"mediaType":"application/vnd.oci.image.layer.v1.tar","size":%d},`, i)
+	}
+	return b.Bytes()[:size]
+}
+
+func gzipContent(t testing.TB, size int) []byte {
+	t.Helper()
+	var b bytes.Buffer
+	zw := gzip.NewWriter(&b)
+	_, err := zw.Write(jsonContent(size))
+	require.NoError(t, err)
+	require.NoError(t, zw.Close())
+	return b.Bytes()
+}
+
+func TestCompressDriverSuite(t *testing.T) {
+	testsuites.Driver(t, func() (storagedriver.StorageDriver, error) {
+		return newCompressStorageMiddleware(context.Background(), inmemory.New(), nil)
+	}, false)
+}
+
+func TestOptions(t *testing.T) {
+	for _, tc := range []struct {
+		name    string
+		options map[string]any
+		err     string
+	}{
+		{name: "defaults", options: map[string]any{}},
+		{name: "level name", options: map[string]any{"level": "best"}},
+		{name: "level number", options: map[string]any{"level": 19}},
+		{name: "invalid level name", options: map[string]any{"level": "max"}, err: "level must be fastest"},
+		{name: "invalid level number", options: map[string]any{"level": 23}, err: "level must be between 1 and 22"},
+		{name: "exclude", options: map[string]any{"exclude": []any{"/docker/registry/v2/blobs/"}}},
+		{name: "relative exclude", options: map[string]any{"exclude": []any{"blobs"}}, err: "absolute paths"},
+		{name: "exclude not a list", options: map[string]any{"exclude": "/blobs"}, err: "exclude must be a list"},
+		{name: "sniff string", options: map[string]any{"sniff": "false"}},
+		{name: "invalid sniff", options: map[string]any{"sniff": "maybe"}, err: "sniff must be a boolean"},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			_, err := newCompressStorageMiddleware(context.Background(), inmemory.New(), tc.options)
+			if tc.err == "" {
+				require.NoError(t, err)
+			} else {
+				require.ErrorContains(t, err, tc.err)
+			}
+		})
+	}
+}
+
+// TestRoundTrip writes compressible and already compressed content and
+// checks how it is stored and that Stat reports its size.
+func TestRoundTrip(t *testing.T) {
+	ctx := context.Background()
+	backend := inmemory.New()
+	m := newTestMiddleware(t, backend, map[string]any{"exclude": []any{"/excluded/"}})
+
+	random := make([]byte, 4096)
+	_, err := rand.Read(random)
+	require.NoError(t, err)
+
+	for _, tc := range []struct {
+		name       string
+		path       string
+		content    []byte
+		compressed bool
+	}{
+		{name: "json", path: "/json", content: jsonContent(100 << 10), compressed: true},
+		{name: "empty", path: "/empty", content: []byte{}, compressed: true},
+		{name: "short", path: "/short", content: []byte("{}"), compressed: true},
+		{name: "random", path: "/random", content: random, compressed: true},
+		{name: "gzip", path: "/gzip", content: gzipContent(t, 100<<10)},
+		{name: "excluded", path: "/excluded/json", content: jsonContent(100 << 10)},
+	} {
+		for _, method := range []string{"PutContent", "Writer"} {
+			t.Run(tc.name+"/"+method, func(t *testing.T) {
+				path := tc.path + "-" + method
+				if method == "PutContent" {
+					require.NoError(t, m.PutContent(ctx, path, tc.content))
+				} else {
+					w, err := m.Writer(ctx, path, false)
+					require.NoError(t, err)
+					// Write a byte at a time first, so that the content
+					// is sniffed across writes.
+					for i := 0; i < len(tc.content) && i < 3; i++ {
+						_, err = w.Write(tc.content[i : i+1])
+						require.NoError(t, err)
+					}
+					if len(tc.content) > 3 {
+						_, err = w.Write(tc.content[3:])
+						require.NoError(t, err)
+					}
+					if !strings.HasPrefix(path, "/excluded/") {
+						// Excluded paths are written by the storage
+						// driver, which may only count flushed content.
+						require.Equal(t, int64(len(tc.content)), w.Size())
+					}
+					require.NoError(t, w.Commit(ctx))
+					require.NoError(t, w.Close())
+				}
+
+				got, err := m.GetContent(ctx, path)
+				require.NoError(t, err)
+				require.Equal(t, tc.content, append([]byte{}, got...))
+
+				fi, err := m.Stat(ctx, path)
+				require.NoError(t, err)
+				require.Equal(t, int64(len(tc.content)), fi.Size())
+
+				stored, err := backend.GetContent(ctx, path)
+				require.NoError(t, err)
+				if tc.compressed {
+					require.True(t, isCompressed(stored[:headerSize]), "expected the object to be compressed")
+				} else {
+					require.Equal(t, tc.content, stored)
+				}
+			})
+		}
+	}
+
+	stored, err := backend.Stat(ctx, "/json-PutContent")
+	require.NoError(t, err)
+	require.Less(t, stored.Size(), int64(10<<10), "expected json to compress well")
+}
+
+// TestRangedReads checks that reads from an offset of compressed objects
+// decompress from the start and skip to the offset, including in objects
+// made of several frames.
+func TestRangedReads(t *testing.T) {
+	ctx := context.Background()
+	m := newTestMiddleware(t, inmemory.New(), nil)
+	content := jsonContent(64 << 10)
+	require.NoError(t, m.PutContent(ctx, "/put", content))
+
+	// Write in several sessions, each appending a frame.
+	var written int
+	for i, n := range []int{3, 10 << 10, 20<<10 + 7, len(content) - (30<<10 + 10)} {
+		w, err := m.Writer(ctx, "/writer", i > 0)
+		require.NoError(t, err)
+		require.Equal(t, int64(written), w.Size())
+		_, err = w.Write(content[written : written+n])
+		require.NoError(t, err)
+		written += n
+		if written == len(content) {
+			require.NoError(t, w.Commit(ctx))
+		}
+		require.NoError(t, w.Close())
+	}
+
+	gz := gzipContent(t, 16<<10)
+	require.NoError(t, m.PutContent(ctx, "/gzip", gz))
+
+	for _, tc := range []struct {
+		path    string
+		content []byte
+	}{{"/put", content}, {"/writer", content}, {"/gzip", gz}} {
+		for _, offset := range []int{0, 1, 3, 4, 10 << 10, 10<<10 + 3, 30<<10 + 10, len(tc.content) - 1, len(tc.content), len(tc.content) + 10} {
+			rc, err := m.Reader(ctx, tc.path, int64(offset))
+			require.NoError(t, err)
+			got, err := io.ReadAll(rc)
+			require.NoError(t, err)
+			require.NoError(t, rc.Close())
+			want := []byte{}
+			if offset < len(tc.content) {
+				want = tc.content[offset:]
+			}
+			require.Equal(t, want, append([]byte{}, got...), "reading %s at %d", tc.path, offset)
+		}
+	}
+
+	_, err := m.Reader(ctx, "/put", -1)
+	require.ErrorAs(t, err, &storagedriver.InvalidOffsetError{})
+}
+
+// TestAppend resumes unfinished writes and appends to committed objects.
+func TestAppend(t *testing.T) {
+	ctx := context.Background()
+	backend := inmemory.New()
+	m := newTestMiddleware(t, backend, nil)
+
+	for _, tc := range []struct {
+		name    string
+		content []byte
+	}{
+		{name: "compressed", content: jsonContent(32 << 10)},
+		{name: "raw", content: gzipContent(t, 32<<10)},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			path := "/upload/" + tc.name
+			half := len(tc.content) / 2
+
+			w, err := m.Writer(ctx, path, false)
+			require.NoError(t, err)
+			_, err = w.Write(tc.content[:half/2])
+			require.NoError(t, err)
+			require.NoError(t, w.Close())
+			children, err := m.List(ctx, "/upload")
+			require.NoError(t, err)
+			require.NotContains(t, strings.Join(children, " "), pendingSuffix)
+
+			w, err = m.Writer(ctx, path, true)
+			require.NoError(t, err)
+			require.Equal(t, int64(half/2), w.Size())
+			_, err = w.Write(tc.content[half/2 : half])
+			require.NoError(t, err)
+			require.NoError(t, w.Commit(ctx))
+			require.NoError(t, w.Close())
+			_, err = backend.Stat(ctx, pendingPath(path))
+			require.ErrorAs(t, err, &storagedriver.PathNotFoundError{})
+
+			w, err = m.Writer(ctx, path, true)
+			require.NoError(t, err)
+			require.Equal(t, int64(half), w.Size())
+			_, err = w.Write(tc.content[half:])
+			require.NoError(t, err)
+			require.NoError(t, w.Commit(ctx))
+			require.NoError(t, w.Close())
+
+			got, err := m.GetContent(ctx, path)
+			require.NoError(t, err)
+			require.Equal(t, tc.content, got)
+			fi, err := m.Stat(ctx, path)
+			require.NoError(t, err)
+			require.Equal(t, int64(len(tc.content)), fi.Size())
+		})
+	}
+}
+
+func TestSniffDisabled(t *testing.T) {
+	ctx := context.Background()
+	backend := inmemory.New()
+	m := newTestMiddleware(t, backend, map[string]any{"sniff": false})
+	gz := gzipContent(t, 1024)
+
+	require.NoError(t, m.PutContent(ctx, "/gzip", gz))
+	stored, err := backend.GetContent(ctx, "/gzip")
+	require.NoError(t, err)
+	require.True(t, isCompressed(stored[:headerSize]))
+	got, err := m.GetContent(ctx, "/gzip")
+	require.NoError(t, err)
+	require.Equal(t, gz, got)
+}
+
+// TestUncompressedObjects checks that objects stored before the middleware
+// was enabled are read as they are.
+func TestUncompressedObjects(t *testing.T) {
+	ctx := context.Background()
+	backend := inmemory.New()
+	m := newTestMiddleware(t, backend, nil)
+	require.NoError(t, backend.PutContent(ctx, "/plain", []byte("plain content")))
+
+	got, err := m.GetContent(ctx, "/plain")
+	require.NoError(t, err)
+	require.Equal(t, "plain content", string(got))
+	rc, err := m.Reader(ctx, "/plain", 6)
+	require.NoError(t, err)
+	got, err = io.ReadAll(rc)
+	require.NoError(t, err)
+	rc.Close()
+	require.Equal(t, "content", string(got))
+	fi, err := m.Stat(ctx, "/plain")
+	require.NoError(t, err)
+	require.Equal(t, int64(13), fi.Size())
+}
+
+// redirectDriver returns a redirect URL for every path.
+type redirectDriver struct {
+	storagedriver.StorageDriver
+}
+
+func (d *redirectDriver) RedirectURL(r *http.Request, path string) (string, error) {
+	return "https://storage.example.com" + path, nil
+}
+
+func TestRedirectURL(t *testing.T) {
+	ctx := context.Background()
+	m := newTestMiddleware(t, &redirectDriver{StorageDriver: inmemory.New()}, map[string]any{"exclude": []any{"/excluded/"}})
+	require.NoError(t, m.PutContent(ctx, "/json", jsonContent(1024)))
+	require.NoError(t, m.PutContent(ctx, "/gzip", gzipContent(t, 1024)))
+
+	req := httptest.NewRequest(http.MethodGet, "/", nil)
+	url, err := m.RedirectURL(req, "/json")
+	require.NoError(t, err)
+	require.Empty(t, url, "expected no redirect to a compressed object")
+
+	url, err = m.RedirectURL(req, "/gzip")
+	require.NoError(t, err)
+	require.Equal(t, "https://storage.example.com/gzip", url)
+
+	url, err = m.RedirectURL(req, "/excluded/blob")
+	require.NoError(t, err)
+	require.Equal(t, "https://storage.example.com/excluded/blob", url)
+}
+
+func BenchmarkPutContent(b *testing.B) {
+	ctx := context.Background()
+	m := newTestMiddleware(b, inmemory.New(), nil)
+	content := jsonContent(1 << 20)
+	b.SetBytes(int64(len(content)))
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if err := m.PutContent(ctx, "/bench", content); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func BenchmarkWriter(b *testing.B) {
+	ctx := context.Background()
+	m := newTestMiddleware(b, inmemory.New(), nil)
+	content := jsonContent(1 << 20)
+	b.SetBytes(int64(len(content)))
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		w, err := m.Writer(ctx, "/bench", false)
+		if err != nil {
+			b.Fatal(err)
+		}
+		if _, err := w.Write(content); err != nil {
+			b.Fatal(err)
+		}
+		if err := w.Commit(ctx); err != nil {
+			b.Fatal(err)
+		}
+		w.Close()
+	}
+}
+
+func BenchmarkReader(b *testing.B) {
+	ctx := context.Background()
+	m := newTestMiddleware(b, inmemory.New(), nil)
+	content := jsonContent(1 << 20)
+	if err := m.PutContent(ctx, "/bench", content); err != nil {
+		b.Fatal(err)
+	}
+
+	for _, offset := range []int64{0, 1 << 19} {
+		b.Run(fmt.Sprintf("offset=%d", offset), func(b *testing.B) {
+			b.SetBytes(int64(len(content)) - offset)
+			for i := 0; i < b.N; i++ {
+				rc, err := m.Reader(ctx, "/bench", offset)
+				if err != nil {
+					b.Fatal(err)
+				}
+				if _, err := io.Copy(io.Discard, rc); err != nil {
+					b.Fatal(err)
+				}
+				rc.Close()
+			}
+		})
+	}
+}
@@ -0,0 +1,238 @@
+package middleware
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+
+	storagedriver "github.com/distribution/distribution/v3/registry/storage/driver"
+	"github.com/klauspost/compress/zstd"
+)
+
+// pendingState is the state of an unfinished write, kept in the pending
+// object of its path. The compressed content written so far is a
+// sequence of complete zstd frames.
+type pendingState struct {
+	// Size is the size of the plaintext written.
+	Size int64 `json:"size"`
+	// Raw is set when the content is stored uncompressed.
+	Raw bool `json:"raw"`
+}
+
+// writer compresses the content written to it. Whether the content is
+// compressed is decided from its first bytes, and each session of a write
+// appends an independent zstd frame.
+type writer struct {
+	m    *compressStorageMiddleware
+	ctx  context.Context
+	path string
+	fw   storagedriver.FileWriter
+	enc  *zstd.Encoder
+	// sniff holds the first bytes written, until it is decided whether
+	// the content is compressed.
+	sniff     []byte
+	decided   bool
+	raw       bool
+	size      int64
+	closed    bool
+	committed bool
+	cancelled bool
+}
+
+func (m *compressStorageMiddleware) newWriter(ctx context.Context, path string) (*writer, error) {
+	fw, err := m.StorageDriver.Writer(ctx, path, false)
+	if err != nil {
+		return nil, err
+	}
+	w := &writer{m: m, ctx: ctx, path: path, fw: fw}
+	if !m.sniff {
+		if err := w.decide(); err != nil {
+			fw.Cancel(ctx)
+			return nil, err
+		}
+	}
+	return w, nil
+}
+
+// resumeWriter resumes the write whose state is held in pending.
+func (m *compressStorageMiddleware) resumeWriter(ctx context.Context, path string, pending []byte) (*writer, error) {
+	var state pendingState
+	if err := json.Unmarshal(pending, &state); err != nil {
+		return nil, fmt.Errorf("compress: invalid pending state for %s: %v", path, err)
+	}
+	return m.continueWriter(ctx, path, state.Size, state.Raw)
+}
+
+// appendWriter appends to the committed object at path, or starts a new one.
+func (m *compressStorageMiddleware) appendWriter(ctx context.Context, path string) (*writer, error) {
+	fi, err := m.StorageDriver.Stat(ctx, path)
+	if errors.As(err, &storagedriver.PathNotFoundError{}) {
+		return m.newWriter(ctx, path)
+	}
+	if err != nil {
+		return nil, err
+	}
+	size, compressed, err := m.plaintextSize(ctx, path, fi.Size())
+	if err != nil {
+		return nil, err
+	}
+	if !compressed {
+		size = fi.Size()
+	}
+	// The footer is left in place; the footer written on commit holds
+	// the size of all the content.
+	return m.continueWriter(ctx, path, size, !compressed)
+}
+
+func (m *compressStorageMiddleware) continueWriter(ctx context.Context, path string, size int64, raw bool) (*writer, error) {
+	fw, err := m.StorageDriver.Writer(ctx, path, true)
+	if err != nil {
+		return nil, err
+	}
+	w := &writer{m: m, ctx: ctx, path: path, fw: fw, decided: true, raw: raw, size: size}
+	if raw {
+		w.size = fw.Size()
+	} else if w.enc, err = m.newEncoder(fw); err != nil {
+		fw.Close()
+		return nil, err
+	}
+	return w, nil
+}
+
+// decide decides whether the content is compressed from its first bytes,
+// and writes them.
+func (w *writer) decide() error {
+	w.decided = true
+	w.raw = !w.m.compressible(w.path, w.sniff)
+	if !w.raw {
+		if _, err := w.fw.Write(header); err != nil {
+			return err
+		}
+		var err error
+		if w.enc, err = w.m.newEncoder(w.fw); err != nil {
+			return err
+		}
+	}
+	sniffed := w.sniff
+	w.sniff = nil
+	_, err := w.write(sniffed)
+	return err
+}
+
+func (w *writer) write(p []byte) (int, error) {
+	if w.raw {
+		return w.fw.Write(p)
+	}
+	return w.enc.Write(p)
+}
+
+func (w *writer) Write(p []byte) (int, error) {
+	if w.closed {
+		return 0, fmt.Errorf("already closed")
+	} else if w.committed {
+		return 0, fmt.Errorf("already committed")
+	} else if w.cancelled {
+		return 0, fmt.Errorf("already cancelled")
+	}
+
+	var n int
+	if !w.decided {
+		n = min(len(p), sniffSize-len(w.sniff))
+		w.sniff = append(w.sniff, p[:n]...)
+		w.size += int64(n)
+		p = p[n:]
+		if len(w.sniff) < sniffSize {
+			return n, nil
+		}
+		if err := w.decide(); err != nil {
+			return 0, err
+		}
+	}
+	nn, err := w.write(p)
+	w.size += int64(nn)
+	return n + nn, err
+}
+
+func (w *writer) Size() int64 {
+	return w.size
+}
+
+// finish ends the frame being written.
+func (w *writer) finish() error {
+	if !w.decided {
+		if err := w.decide(); err != nil {
+			return err
+		}
+	}
+	if w.enc != nil {
+		return w.enc.Close()
+	}
+	return nil
+}
+
+func (w *writer) Close() error {
+	if w.closed {
+		return fmt.Errorf("already closed")
+	}
+	w.closed = true
+	if !w.committed && !w.cancelled {
+		err := w.finish()
+		if err == nil {
+			var state []byte
+			state, err = json.Marshal(pendingState{Size: w.size, Raw: w.raw})
+			if err == nil {
+				err = w.m.StorageDriver.PutContent(w.ctx, pendingPath(w.path), state)
+			}
+		}
+		if err != nil {
+			w.fw.Close()
+			return err
+		}
+	}
+	return w.fw.Close()
+}
+
+func (w *writer) Cancel(ctx context.Context) error {
+	if w.closed {
+		return fmt.Errorf("already closed")
+	} else if w.committed {
+		return fmt.Errorf("already committed")
+	}
+	w.cancelled = true
+	if err := w.fw.Cancel(ctx); err != nil {
+		return err
+	}
+	return w.deletePending(ctx)
+}
+
+func (w *writer) Commit(ctx context.Context) error {
+	if w.closed {
+		return fmt.Errorf("already closed")
+	} else if w.committed {
+		return fmt.Errorf("already committed")
+	} else if w.cancelled {
+		return fmt.Errorf("already cancelled")
+	}
+	if err := w.finish(); err != nil {
+		return err
+	}
+	if !w.raw {
+		if _, err := w.fw.Write(footer(w.size)); err != nil {
+			return err
+		}
+	}
+	if err := w.fw.Commit(ctx); err != nil {
+		return err
+	}
+	w.committed = true
+	return w.deletePending(ctx)
+}
+
+func (w *writer) deletePending(ctx context.Context) error {
+	err := w.m.StorageDriver.Delete(ctx, pendingPath(w.path))
+	if errors.As(err, &storagedriver.PathNotFoundError{}) {
+		return nil
+	}
+	return err
+}
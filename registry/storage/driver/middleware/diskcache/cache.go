@@ -0,0 +1,363 @@
+package middleware
+
+import (
+	"container/list"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	pathpkg "path"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// tmpDir is the directory, relative to the cache root, in which blobs are
+// written while they are added to the cache.
+const tmpDir = ".tmp"
+
+// cache is a size bounded set of files on local disk, evicted in least
+// recently used order. Files are stored under root at their storage path.
+type cache struct {
+	root    string
+	maxSize int64
+
+	mu      sync.Mutex
+	entries map[string]*entry
+	// dirs maps each directory holding cached files, at any depth, to the
+	// paths of its children holding them, so that a subtree is removed
+	// without scanning every entry.
+	dirs map[string]map[string]struct{}
+	lru  *list.List // of *entry, most recently used first
+	// size is the size of the cached files plus the space reserved for
+	// the files being added.
+	size    int64
+	filling map[string]*fill
+}
+
+type entry struct {
+	path string
+	size int64
+	elem *list.Element
+}
+
+// newCache returns a cache of the files already present in root, evicting
+// the least recently modified ones if they exceed maxSize.
+func newCache(root string, maxSize int64) (*cache, error) {
+	c := &cache{
+		root:    root,
+		maxSize: maxSize,
+		entries: make(map[string]*entry),
+		dirs:    make(map[string]map[string]struct{}),
+		lru:     list.New(),
+		filling: make(map[string]*fill),
+	}
+
+	// Files left in the temporary directory were never completed.
+	if err := os.RemoveAll(filepath.Join(root, tmpDir)); err != nil {
+		return nil, err
+	}
+	if err := os.MkdirAll(filepath.Join(root, tmpDir), 0o755); err != nil {
+		return nil, err
+	}
+
+	type existing struct {
+		path    string
+		size    int64
+		modTime time.Time
+	}
+	var files []existing
+	err := filepath.WalkDir(root, func(p string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if d.IsDir() {
+			if p == filepath.Join(root, tmpDir) {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		if !d.Type().IsRegular() {
+			return nil
+		}
+		fi, err := d.Info()
+		if err != nil {
+			return err
+		}
+		rel, err := filepath.Rel(root, p)
+		if err != nil {
+			return err
+		}
+		files = append(files, existing{path: "/" + filepath.ToSlash(rel), size: fi.Size(), modTime: fi.ModTime()})
+		return nil
+	})
+	if err != nil {
+		return nil, fmt.Errorf("diskcache: loading %s: %v", root, err)
+	}
+
+	sort.Slice(files, func(i, j int) bool { return files[i].modTime.Before(files[j].modTime) })
+	for _, f := range files {
+		c.addEntry(f.path, f.size)
+		c.size += f.size
+	}
+	var unlink []string
+	for c.size > c.maxSize && c.lru.Len() > 0 {
+		unlink = append(unlink, c.evict())
+	}
+	cacheSize.Set(float64(c.size))
+	removeFiles(unlink)
+	return c, nil
+}
+
+func (c *cache) filePath(path string) string {
+	return filepath.Join(c.root, filepath.FromSlash(path))
+}
+
+// open returns a reader of the cached file at path from offset, or nil if
+// the file is not cached.
+func (c *cache) open(path string, offset int64) io.ReadCloser {
+	c.mu.Lock()
+	e, ok := c.entries[path]
+	if ok {
+		c.lru.MoveToFront(e.elem)
+	}
+	c.mu.Unlock()
+	if !ok || offset > e.size {
+		return nil
+	}
+
+	f, err := os.Open(c.filePath(path))
+	if err != nil {
+		c.drop(e)
+		return nil
+	}
+	if fi, err := f.Stat(); err != nil || fi.Size() != e.size {
+		f.Close()
+		c.drop(e)
+		return nil
+	}
+	if _, err := f.Seek(offset, io.SeekStart); err != nil {
+		f.Close()
+		return nil
+	}
+	// Touch the file so that the order is kept across restarts.
+	now := time.Now()
+	_ = os.Chtimes(f.Name(), now, now)
+	return f
+}
+
+// drop removes e from the cache if it is still the entry at its path.
+func (c *cache) drop(e *entry) {
+	c.mu.Lock()
+	if c.entries[e.path] != e {
+		c.mu.Unlock()
+		return
+	}
+	file := c.removeEntry(e)
+	cacheSize.Set(float64(c.size))
+	c.mu.Unlock()
+	removeFiles([]string{file})
+}
+
+// startFill reserves space for a file of the given size at path and returns
+// a fill writing it, or nil if the file cannot be added to the cache now.
+func (c *cache) startFill(path string, size int64) *fill {
+	// The evicted files are removed once mu is released, as deferred calls
+	// run in reverse order.
+	var unlink []string
+	defer func() { removeFiles(unlink) }()
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if size > c.maxSize {
+		return nil
+	}
+	if _, ok := c.filling[path]; ok {
+		return nil
+	}
+	if _, ok := c.entries[path]; ok {
+		return nil
+	}
+	for c.size+size > c.maxSize {
+		if c.lru.Len() == 0 {
+			// The space is reserved by other fills.
+			return nil
+		}
+		unlink = append(unlink, c.evict())
+	}
+
+	file, err := os.CreateTemp(filepath.Join(c.root, tmpDir), "blob-")
+	if err != nil {
+		cacheSize.Set(float64(c.size))
+		return nil
+	}
+	f := &fill{cache: c, path: path, size: size, file: file}
+	c.filling[path] = f
+	c.size += size
+	cacheSize.Set(float64(c.size))
+	return f
+}
+
+// remove removes the files at path and below it from the cache. Files being
+// added there are discarded once complete.
+func (c *cache) remove(path string) {
+	if path != "/" {
+		path = strings.TrimSuffix(path, "/")
+	}
+	var unlink []string
+	c.mu.Lock()
+	if e, ok := c.entries[path]; ok {
+		unlink = append(unlink, c.removeEntry(e))
+	} else if _, ok := c.dirs[path]; ok {
+		unlink = c.removeDir(path, unlink)
+	}
+	prefix := strings.TrimSuffix(path, "/") + "/"
+	for p, f := range c.filling {
+		if p == path || strings.HasPrefix(p, prefix) {
+			f.stale = true
+		}
+	}
+	cacheSize.Set(float64(c.size))
+	c.mu.Unlock()
+	removeFiles(unlink)
+}
+
+// removeDir removes the entries below dir, appending their files to unlink.
+// It must be called with mu held.
+func (c *cache) removeDir(dir string, unlink []string) []string {
+	for child := range c.dirs[dir] {
+		if e, ok := c.entries[child]; ok {
+			unlink = append(unlink, c.removeEntry(e))
+		} else {
+			unlink = c.removeDir(child, unlink)
+		}
+	}
+	return unlink
+}
+
+// evict removes the least recently used entry and returns the path of its
+// file. It must be called with mu held.
+func (c *cache) evict() string {
+	cacheEvictions.Inc(1)
+	return c.removeEntry(c.lru.Back().Value.(*entry))
+}
+
+// addEntry adds the file at path to the cache as the most recently used
+// entry. It must be called with mu held.
+func (c *cache) addEntry(path string, size int64) {
+	e := &entry{path: path, size: size}
+	e.elem = c.lru.PushFront(e)
+	c.entries[path] = e
+	for child, dir := path, pathpkg.Dir(path); ; child, dir = dir, pathpkg.Dir(dir) {
+		children, ok := c.dirs[dir]
+		if !ok {
+			children = make(map[string]struct{})
+			c.dirs[dir] = children
+		}
+		if _, ok := children[child]; ok {
+			break
+		}
+		children[child] = struct{}{}
+		if dir == "/" {
+			break
+		}
+	}
+}
+
+// removeEntry removes e from the cache and returns the path of its file, to
+// be removed once mu is released. It must be called with mu held.
+func (c *cache) removeEntry(e *entry) string {
+	c.lru.Remove(e.elem)
+	delete(c.entries, e.path)
+	c.size -= e.size
+	for child, dir := e.path, pathpkg.Dir(e.path); ; child, dir = dir, pathpkg.Dir(dir) {
+		children := c.dirs[dir]
+		delete(children, child)
+		if len(children) > 0 {
+			break
+		}
+		delete(c.dirs, dir)
+		if dir == "/" {
+			break
+		}
+	}
+	return c.filePath(e.path)
+}
+
+// removeFiles removes the files of the entries removed from the cache. An
+// entry added at the same path in the meantime loses its file, and is
+// dropped when it is next opened.
+func removeFiles(files []string) {
+	for _, file := range files {
+		_ = os.Remove(file)
+	}
+}
+
+// fill writes a file being added to the cache.
+type fill struct {
+	cache   *cache
+	path    string
+	size    int64
+	written int64
+	file    *os.File
+	// stale is set, with cache.mu held, when the file is removed from
+	// storage while being added.
+	stale bool
+}
+
+func (f *fill) write(p []byte) error {
+	f.written += int64(len(p))
+	if f.written > f.size {
+		return fmt.Errorf("read %d bytes, more than the %d bytes reported by Stat", f.written, f.size)
+	}
+	_, err := f.file.Write(p)
+	return err
+}
+
+// finish adds the file to the cache if it is complete.
+func (f *fill) finish() error {
+	c := f.cache
+	closeErr := f.file.Close()
+
+	c.mu.Lock()
+	delete(c.filling, f.path)
+
+	err := closeErr
+	switch {
+	case err != nil:
+	case f.written != f.size:
+		err = fmt.Errorf("read %d bytes, want the %d bytes reported by Stat", f.written, f.size)
+	case f.stale:
+	default:
+		dest := c.filePath(f.path)
+		if err = os.MkdirAll(filepath.Dir(dest), 0o755); err == nil {
+			err = os.Rename(f.file.Name(), dest)
+		}
+		if err == nil {
+			c.addEntry(f.path, f.size)
+			c.mu.Unlock()
+			return nil
+		}
+	}
+
+	c.size -= f.size
+	cacheSize.Set(float64(c.size))
+	c.mu.Unlock()
+	_ = os.Remove(f.file.Name())
+	return err
+}
+
+// abort discards the file.
+func (f *fill) abort() {
+	c := f.cache
+	f.file.Close()
+
+	c.mu.Lock()
+	delete(c.filling, f.path)
+	c.size -= f.size
+	cacheSize.Set(float64(c.size))
+	c.mu.Unlock()
+	_ = os.Remove(f.file.Name())
+}
@@ -0,0 +1,239 @@
+// Package middleware - diskcache wrapper for storage drivers, caching blob
+// data read from remote storage on a local disk.
+package middleware
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+
+	prometheus "github.com/distribution/distribution/v3/metrics"
+	storagedriver "github.com/distribution/distribution/v3/registry/storage/driver"
+	storagemiddleware "github.com/distribution/distribution/v3/registry/storage/driver/middleware"
+	"github.com/docker/go-metrics"
+	"github.com/sirupsen/logrus"
+)
+
+// defaultPathPrefix is where the registry stores blob data. Blobs are
+// content addressed and never modified, so they can be cached safely.
+const defaultPathPrefix = "/docker/registry/v2/blobs/"
+
+var (
+	// cacheHits is the number of blob reads served from the disk cache.
+	cacheHits = prometheus.StorageNamespace.NewCounter("diskcache_hits", "The number of blob reads served from the disk cache")
+	// cacheMisses is the number of blob reads served from the storage driver.
+	cacheMisses = prometheus.StorageNamespace.NewCounter("diskcache_misses", "The number of blob reads that missed the disk cache")
+	// cacheEvictions is the number of blobs evicted from the disk cache.
+	cacheEvictions = prometheus.StorageNamespace.NewCounter("diskcache_evictions", "The number of blobs evicted from the disk cache")
+	// cacheSize is the space used by the disk cache.
+	cacheSize = prometheus.StorageNamespace.NewGauge("diskcache_size", "The space used by the disk cache", metrics.Bytes)
+)
+
+func init() {
+	if err := storagemiddleware.Register("diskcache", newDiskCacheStorageMiddleware); err != nil {
+		logrus.Errorf("failed to register diskcache storage middleware: %v", err)
+	}
+}
+
+// diskCacheStorageMiddleware caches the blob data read through it on a local
+// disk. Writes, and reads of paths outside of pathPrefix, are passed through.
+type diskCacheStorageMiddleware struct {
+	storagedriver.StorageDriver
+	cache      *cache
+	pathPrefix string
+}
+
+var _ storagedriver.StorageDriver = &diskCacheStorageMiddleware{}
+
+// newDiskCacheStorageMiddleware constructs and returns a new disk cache
+// storage middleware.
+//
+// Required options:
+//
+//   - path: the directory in which blobs are cached
+//   - maxsize: the size budget of the cache in bytes
+//
+// Optional options:
+//
+//   - pathprefix: the storage paths to cache, defaults to the blob store
+func newDiskCacheStorageMiddleware(ctx context.Context, sd storagedriver.StorageDriver, options map[string]any) (storagedriver.StorageDriver, error) {
+	p, ok := options["path"]
+	if !ok {
+		return nil, fmt.Errorf("no path provided")
+	}
+	root, ok := p.(string)
+	if !ok || root == "" {
+		return nil, fmt.Errorf("path must be a non-empty string")
+	}
+
+	var maxSize int64
+	switch v := options["maxsize"].(type) {
+	case int:
+		maxSize = int64(v)
+	case int64:
+		maxSize = v
+	case uint64:
+		maxSize = int64(v)
+	case string:
+		var err error
+		maxSize, err = strconv.ParseInt(v, 10, 64)
+		if err != nil {
+			return nil, fmt.Errorf("maxsize must be an integer, %v invalid", v)
+		}
+	case nil:
+		return nil, fmt.Errorf("no maxsize provided")
+	default:
+		return nil, fmt.Errorf("maxsize must be an integer, %v invalid", v)
+	}
+	if maxSize <= 0 {
+		return nil, fmt.Errorf("maxsize must be positive, %d invalid", maxSize)
+	}
+
+	pathPrefix := defaultPathPrefix
+	if o, ok := options["pathprefix"]; ok {
+		s, ok := o.(string)
+		if !ok || !strings.HasPrefix(s, "/") {
+			return nil, fmt.Errorf("pathprefix must be an absolute path")
+		}
+		pathPrefix = s
+	}
+
+	c, err := newCache(root, maxSize)
+	if err != nil {
+		return nil, err
+	}
+	return &diskCacheStorageMiddleware{StorageDriver: sd, cache: c, pathPrefix: pathPrefix}, nil
+}
+
+func (m *diskCacheStorageMiddleware) cacheable(path string) bool {
+	return strings.HasPrefix(path, m.pathPrefix)
+}
+
+// invalidates reports whether a change to path may remove cached files, that
+// is whether path is cacheable or a directory above pathPrefix.
+func (m *diskCacheStorageMiddleware) invalidates(path string) bool {
+	return m.cacheable(path) || strings.HasPrefix(m.pathPrefix, strings.TrimSuffix(path, "/")+"/")
+}
+
+// GetContent retrieves the content stored at "path" as a []byte.
+func (m *diskCacheStorageMiddleware) GetContent(ctx context.Context, path string) ([]byte, error) {
+	if !m.cacheable(path) {
+		return m.StorageDriver.GetContent(ctx, path)
+	}
+	rc, err := m.Reader(ctx, path, 0)
+	if err != nil {
+		return nil, err
+	}
+	defer rc.Close()
+	return io.ReadAll(rc)
+}
+
+// Reader serves the content stored at "path" from the cache. On a miss, the
+// content read from the storage driver is added to the cache as it is
+// streamed to the caller.
+func (m *diskCacheStorageMiddleware) Reader(ctx context.Context, path string, offset int64) (io.ReadCloser, error) {
+	if !m.cacheable(path) {
+		return m.StorageDriver.Reader(ctx, path, offset)
+	}
+	if rc := m.cache.open(path, offset); rc != nil {
+		cacheHits.Inc(1)
+		return rc, nil
+	}
+	cacheMisses.Inc(1)
+
+	// Only reads of the whole blob populate the cache.
+	if offset != 0 {
+		return m.StorageDriver.Reader(ctx, path, offset)
+	}
+	fi, err := m.StorageDriver.Stat(ctx, path)
+	if err != nil || fi.IsDir() {
+		return m.StorageDriver.Reader(ctx, path, offset)
+	}
+	f := m.cache.startFill(path, fi.Size())
+	rc, err := m.StorageDriver.Reader(ctx, path, offset)
+	if err != nil {
+		if f != nil {
+			f.abort()
+		}
+		return nil, err
+	}
+	if f == nil {
+		// The blob does not fit in the cache, or another reader is
+		// already adding it.
+		return rc, nil
+	}
+	return &fillReader{ReadCloser: rc, fill: f}, nil
+}
+
+// PutContent stores the []byte content at a location designated by "path".
+func (m *diskCacheStorageMiddleware) PutContent(ctx context.Context, path string, content []byte) error {
+	if m.invalidates(path) {
+		m.cache.remove(path)
+	}
+	return m.StorageDriver.PutContent(ctx, path, content)
+}
+
+// Writer returns a FileWriter which will store the content written to it
+// at the location designated by "path" after the call to Commit.
+func (m *diskCacheStorageMiddleware) Writer(ctx context.Context, path string, append bool) (storagedriver.FileWriter, error) {
+	if m.invalidates(path) {
+		m.cache.remove(path)
+	}
+	return m.StorageDriver.Writer(ctx, path, append)
+}
+
+// Move moves an object stored at sourcePath to destPath, removing the
+// original object.
+func (m *diskCacheStorageMiddleware) Move(ctx context.Context, sourcePath string, destPath string) error {
+	if m.invalidates(sourcePath) {
+		m.cache.remove(sourcePath)
+	}
+	if m.invalidates(destPath) {
+		m.cache.remove(destPath)
+	}
+	return m.StorageDriver.Move(ctx, sourcePath, destPath)
+}
+
+// Delete recursively deletes all objects stored at "path" and its subpaths.
+func (m *diskCacheStorageMiddleware) Delete(ctx context.Context, path string) error {
+	if m.invalidates(path) {
+		m.cache.remove(path)
+	}
+	return m.StorageDriver.Delete(ctx, path)
+}
+
+// fillReader adds the content read from the storage driver to the cache.
+type fillReader struct {
+	io.ReadCloser
+	fill *fill
+}
+
+func (r *fillReader) Read(p []byte) (int, error) {
+	n, err := r.ReadCloser.Read(p)
+	if n > 0 && r.fill != nil {
+		if werr := r.fill.write(p[:n]); werr != nil {
+			// Failing to cache the blob must not fail the read.
+			logrus.Warnf("diskcache: failed to cache %s: %v", r.fill.path, werr)
+			r.fill.abort()
+			r.fill = nil
+		}
+	}
+	if err == io.EOF && r.fill != nil {
+		if ferr := r.fill.finish(); ferr != nil {
+			logrus.Warnf("diskcache: failed to cache %s: %v", r.fill.path, ferr)
+		}
+		r.fill = nil
+	}
+	return n, err
+}
+
+func (r *fillReader) Close() error {
+	if r.fill != nil {
+		// The blob was not read to the end, so it cannot be cached.
+		r.fill.abort()
+		r.fill = nil
+	}
+	return r.ReadCloser.Close()
+}
@@ -0,0 +1,333 @@
+package middleware
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"io"
+	"os"
+	"path/filepath"
+	"sync"
+	"sync/atomic"
+	"testing"
+
+	storagedriver "github.com/distribution/distribution/v3/registry/storage/driver"
+	"github.com/distribution/distribution/v3/registry/storage/driver/inmemory"
+	"github.com/stretchr/testify/require"
+)
+
+// countingDriver counts the reads that reach the storage driver.
+type countingDriver struct {
+	storagedriver.StorageDriver
+	readers atomic.Int64
+	// readerHook, if set, is called by Reader before it returns.
+	readerHook func()
+	// statDelta is added to the sizes reported by Stat.
+	statDelta int64
+}
+
+func (d *countingDriver) Reader(ctx context.Context, path string, offset int64) (io.ReadCloser, error) {
+	d.readers.Add(1)
+	if d.readerHook != nil {
+		d.readerHook()
+	}
+	return d.StorageDriver.Reader(ctx, path, offset)
+}
+
+func (d *countingDriver) Stat(ctx context.Context, path string) (storagedriver.FileInfo, error) {
+	fi, err := d.StorageDriver.Stat(ctx, path)
+	if err != nil || d.statDelta == 0 {
+		return fi, err
+	}
+	return storagedriver.FileInfoInternal{FileInfoFields: storagedriver.FileInfoFields{
+		Path:    fi.Path(),
+		Size:    fi.Size() + d.statDelta,
+		ModTime: fi.ModTime(),
+	}}, nil
+}
+
+func newTestMiddleware(t *testing.T, root string, maxSize int) (*diskCacheStorageMiddleware, *countingDriver) {
+	t.Helper()
+	backend := &countingDriver{StorageDriver: inmemory.New()}
+	sd, err := newDiskCacheStorageMiddleware(context.Background(), backend, map[string]any{
+		"path":    root,
+		"maxsize": maxSize,
+	})
+	require.NoError(t, err)
+	return sd.(*diskCacheStorageMiddleware), backend
+}
+
+func blobPath(name string) string {
+	return defaultPathPrefix + "sha256/" + name[:2] + "/" + name + "/data"
+}
+
+func putBlob(t *testing.T, sd storagedriver.StorageDriver, name string, size int) []byte {
+	t.Helper()
+	content := make([]byte, size)
+	_, err := rand.Read(content)
+	require.NoError(t, err)
+	require.NoError(t, sd.PutContent(context.Background(), blobPath(name), content))
+	return content
+}
+
+func readAll(t *testing.T, sd storagedriver.StorageDriver, path string, offset int64) []byte {
+	t.Helper()
+	rc, err := sd.Reader(context.Background(), path, offset)
+	require.NoError(t, err)
+	defer rc.Close()
+	b, err := io.ReadAll(rc)
+	require.NoError(t, err)
+	return b
+}
+
+func tmpFiles(t *testing.T, root string) []os.DirEntry {
+	t.Helper()
+	entries, err := os.ReadDir(filepath.Join(root, tmpDir))
+	require.NoError(t, err)
+	return entries
+}
+
+func TestOptions(t *testing.T) {
+	for _, tc := range []struct {
+		name    string
+		options map[string]any
+		err     string
+	}{
+		{name: "no path", options: map[string]any{"maxsize": 10}, err: "no path provided"},
+		{name: "no maxsize", options: map[string]any{"path": t.TempDir()}, err: "no maxsize provided"},
+		{name: "invalid maxsize", options: map[string]any{"path": t.TempDir(), "maxsize": "big"}, err: "maxsize must be an integer"},
+		{name: "zero maxsize", options: map[string]any{"path": t.TempDir(), "maxsize": 0}, err: "maxsize must be positive"},
+		{name: "relative pathprefix", options: map[string]any{"path": t.TempDir(), "maxsize": 10, "pathprefix": "blobs"}, err: "pathprefix must be an absolute path"},
+		{name: "maxsize string", options: map[string]any{"path": t.TempDir(), "maxsize": "1024"}},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			_, err := newDiskCacheStorageMiddleware(context.Background(), inmemory.New(), tc.options)
+			if tc.err == "" {
+				require.NoError(t, err)
+			} else {
+				require.ErrorContains(t, err, tc.err)
+			}
+		})
+	}
+}
+
+func TestCacheHit(t *testing.T) {
+	root := t.TempDir()
+	sd, backend := newTestMiddleware(t, root, 1<<20)
+	content := putBlob(t, sd, "abcdef", 4096)
+
+	require.Equal(t, content, readAll(t, sd, blobPath("abcdef"), 0))
+	require.EqualValues(t, 1, backend.readers.Load())
+
+	require.Equal(t, content, readAll(t, sd, blobPath("abcdef"), 0))
+	require.Equal(t, content[1000:], readAll(t, sd, blobPath("abcdef"), 1000))
+	got, err := sd.GetContent(context.Background(), blobPath("abcdef"))
+	require.NoError(t, err)
+	require.Equal(t, content, got)
+	require.EqualValues(t, 1, backend.readers.Load(), "expected the reads to be served from the cache")
+
+	cached, err := os.ReadFile(filepath.Join(root, filepath.FromSlash(blobPath("abcdef"))))
+	require.NoError(t, err)
+	require.Equal(t, content, cached)
+	require.Empty(t, tmpFiles(t, root))
+}
+
+func TestPartialReadNotCached(t *testing.T) {
+	root := t.TempDir()
+	sd, backend := newTestMiddleware(t, root, 1<<20)
+	content := putBlob(t, sd, "abcdef", 4096)
+
+	rc, err := sd.Reader(context.Background(), blobPath("abcdef"), 0)
+	require.NoError(t, err)
+	buf := make([]byte, 100)
+	_, err = io.ReadFull(rc, buf)
+	require.NoError(t, err)
+	require.NoError(t, rc.Close())
+	require.Empty(t, tmpFiles(t, root))
+
+	require.Equal(t, content[10:], readAll(t, sd, blobPath("abcdef"), 10))
+	require.EqualValues(t, 2, backend.readers.Load())
+	require.Equal(t, int64(0), sd.cache.size)
+}
+
+// TestConcurrentFill starts several readers of the same uncached blob at
+// once and checks that the blob is cached a single time.
+func TestConcurrentFill(t *testing.T) {
+	const readers = 8
+	root := t.TempDir()
+	sd, backend := newTestMiddleware(t, root, 1<<20)
+	content := putBlob(t, sd, "abcdef", 64*1024)
+
+	// Hold every read at the storage driver until all readers reached it.
+	var arrived sync.WaitGroup
+	arrived.Add(readers)
+	backend.readerHook = func() {
+		arrived.Done()
+		arrived.Wait()
+	}
+
+	var wg sync.WaitGroup
+	results := make([][]byte, readers)
+	errs := make([]error, readers)
+	for i := 0; i < readers; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			rc, err := sd.Reader(context.Background(), blobPath("abcdef"), 0)
+			if err != nil {
+				errs[i] = err
+				return
+			}
+			defer rc.Close()
+			results[i], errs[i] = io.ReadAll(rc)
+		}(i)
+	}
+	wg.Wait()
+	backend.readerHook = nil
+
+	for i := 0; i < readers; i++ {
+		require.NoError(t, errs[i])
+		require.True(t, bytes.Equal(content, results[i]), "reader %d got different content", i)
+	}
+	require.EqualValues(t, readers, backend.readers.Load())
+	require.Len(t, sd.cache.entries, 1)
+	require.Equal(t, int64(len(content)), sd.cache.size)
+	require.Empty(t, sd.cache.filling)
+	require.Empty(t, tmpFiles(t, root))
+
+	require.Equal(t, content, readAll(t, sd, blobPath("abcdef"), 0))
+	require.EqualValues(t, readers, backend.readers.Load(), "expected the blob to be served from the cache")
+}
+
+// TestEviction fills the cache past its budget and checks that the least
+// recently used blobs are evicted.
+func TestEviction(t *testing.T) {
+	root := t.TempDir()
+	sd, backend := newTestMiddleware(t, root, 3000)
+	blobs := map[string][]byte{}
+	for _, name := range []string{"aaaaaa", "bbbbbb", "cccccc", "dddddd"} {
+		blobs[name] = putBlob(t, sd, name, 1000)
+	}
+
+	readAll(t, sd, blobPath("aaaaaa"), 0)
+	readAll(t, sd, blobPath("bbbbbb"), 0)
+	readAll(t, sd, blobPath("cccccc"), 0)
+	// Use a again so that b is the least recently used blob.
+	readAll(t, sd, blobPath("aaaaaa"), 0)
+	require.EqualValues(t, 3, backend.readers.Load())
+
+	readAll(t, sd, blobPath("dddddd"), 0)
+	require.Equal(t, int64(3000), sd.cache.size)
+	require.NotContains(t, sd.cache.entries, blobPath("bbbbbb"))
+	_, err := os.Stat(filepath.Join(root, filepath.FromSlash(blobPath("bbbbbb"))))
+	require.True(t, os.IsNotExist(err), "expected the evicted blob to be removed from disk")
+
+	before := backend.readers.Load()
+	for _, name := range []string{"aaaaaa", "cccccc", "dddddd"} {
+		require.Equal(t, blobs[name], readAll(t, sd, blobPath(name), 0))
+	}
+	require.Equal(t, before, backend.readers.Load())
+
+	require.Equal(t, blobs["bbbbbb"], readAll(t, sd, blobPath("bbbbbb"), 0))
+	require.Equal(t, before+1, backend.readers.Load())
+	require.Equal(t, int64(3000), sd.cache.size)
+}
+
+func TestOversizeBlobNotCached(t *testing.T) {
+	root := t.TempDir()
+	sd, backend := newTestMiddleware(t, root, 1000)
+	small := putBlob(t, sd, "aaaaaa", 500)
+	large := putBlob(t, sd, "bbbbbb", 2000)
+
+	readAll(t, sd, blobPath("aaaaaa"), 0)
+	require.Equal(t, large, readAll(t, sd, blobPath("bbbbbb"), 0))
+	require.NotContains(t, sd.cache.entries, blobPath("bbbbbb"))
+
+	// The small blob is not evicted to make room for the large one.
+	require.Equal(t, small, readAll(t, sd, blobPath("aaaaaa"), 0))
+	require.EqualValues(t, 2, backend.readers.Load())
+}
+
+func TestLengthMismatchNotCached(t *testing.T) {
+	root := t.TempDir()
+	sd, backend := newTestMiddleware(t, root, 1<<20)
+	content := putBlob(t, sd, "abcdef", 1000)
+
+	for _, delta := range []int64{1, -1} {
+		backend.statDelta = delta
+		got := readAll(t, sd, blobPath("abcdef"), 0)
+		require.Equal(t, content, got)
+		require.Empty(t, sd.cache.entries)
+		require.Equal(t, int64(0), sd.cache.size)
+		require.Empty(t, tmpFiles(t, root))
+	}
+}
+
+func TestPassThrough(t *testing.T) {
+	root := t.TempDir()
+	sd, backend := newTestMiddleware(t, root, 1<<20)
+	ctx := context.Background()
+	path := "/docker/registry/v2/repositories/foo/_manifests/tags/latest/current/link"
+
+	require.NoError(t, sd.PutContent(ctx, path, []byte("sha256:abc")))
+	for i := 0; i < 2; i++ {
+		got, err := sd.GetContent(ctx, path)
+		require.NoError(t, err)
+		require.Equal(t, "sha256:abc", string(got))
+		readAll(t, sd, path, 0)
+	}
+	require.EqualValues(t, 2, backend.readers.Load())
+	require.Empty(t, sd.cache.entries)
+}
+
+func TestInvalidation(t *testing.T) {
+	root := t.TempDir()
+	sd, backend := newTestMiddleware(t, root, 1<<20)
+	ctx := context.Background()
+	putBlob(t, sd, "aaaaaa", 100)
+	putBlob(t, sd, "bbbbbb", 100)
+	readAll(t, sd, blobPath("aaaaaa"), 0)
+	readAll(t, sd, blobPath("bbbbbb"), 0)
+	require.Len(t, sd.cache.entries, 2)
+
+	require.NoError(t, sd.Delete(ctx, defaultPathPrefix+"sha256/aa"))
+	require.NotContains(t, sd.cache.entries, blobPath("aaaaaa"))
+	_, err := sd.Reader(ctx, blobPath("aaaaaa"), 0)
+	require.ErrorAs(t, err, &storagedriver.PathNotFoundError{})
+
+	replaced := []byte("replaced")
+	require.NoError(t, sd.PutContent(ctx, blobPath("bbbbbb"), replaced))
+	require.Equal(t, replaced, readAll(t, sd, blobPath("bbbbbb"), 0))
+	require.EqualValues(t, 4, backend.readers.Load())
+	require.Equal(t, int64(len(replaced)), sd.cache.size)
+
+	// Deleting a directory above the cached paths removes them all.
+	require.NoError(t, sd.Delete(ctx, "/docker/registry"))
+	require.Empty(t, sd.cache.entries)
+	require.Empty(t, sd.cache.dirs)
+	require.Equal(t, int64(0), sd.cache.size)
+	_, err = os.Stat(filepath.Join(root, filepath.FromSlash(blobPath("bbbbbb"))))
+	require.True(t, os.IsNotExist(err), "expected the deleted blob to be removed from disk")
+}
+
+// TestReload checks that the blobs cached on disk are used after a restart.
+func TestReload(t *testing.T) {
+	root := t.TempDir()
+	sd, _ := newTestMiddleware(t, root, 1<<20)
+	content := putBlob(t, sd, "abcdef", 1000)
+	readAll(t, sd, blobPath("abcdef"), 0)
+
+	leftover := filepath.Join(root, tmpDir, "blob-leftover")
+	require.NoError(t, os.WriteFile(leftover, []byte("partial"), 0o644))
+
+	reloaded, backend := newTestMiddleware(t, root, 1<<20)
+	require.NoError(t, backend.PutContent(context.Background(), blobPath("abcdef"), content))
+	require.Equal(t, content, readAll(t, reloaded, blobPath("abcdef"), 0))
+	require.EqualValues(t, 0, backend.readers.Load())
+	require.Empty(t, tmpFiles(t, root))
+
+	// A smaller budget evicts the cached blobs that no longer fit.
+	shrunk, _ := newTestMiddleware(t, root, 500)
+	require.Empty(t, shrunk.cache.entries)
+	require.Equal(t, int64(0), shrunk.cache.size)
+}
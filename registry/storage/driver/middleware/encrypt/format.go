@@ -0,0 +1,345 @@
+package middleware
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+)
+
+// An encrypted object is a header followed by frames of ciphertext:
+//
+//	header: magic | version | chunk size | plaintext size | key ID | wrapped data key
+//	frame:  AES-256-GCM(data key, nonce(index, flag), chunk)
+//
+// Every object is encrypted with its own random data key, which is wrapped
+// with the master key named by the key ID. The header is authenticated as
+// the additional data of the wrapped data key.
+//
+// Each frame holds chunkSize bytes of plaintext, except for the last one which
+// holds less and is sealed with the final flag, so that truncating an object
+// is detected. The plaintext size is -1 in the header of objects written with
+// a Writer, and is then computed from the size of the object.
+const (
+	formatVersion = 1
+
+	// fixedHeaderSize is the size of the header up to the key ID.
+	fixedHeaderSize = len(magic) + 1 + 4 + 8 + 1
+	dataKeySize     = 32
+	nonceSize       = 12
+	tagSize         = 16
+)
+
+const magic = "REGENC"
+
+// Nonce flags distinguish the last frame of an object, and the partial frame
+// kept in the pending object of an unfinished write, from the other frames.
+const (
+	flagChunk   = 0
+	flagFinal   = 1
+	flagPending = 2
+)
+
+var (
+	errNotEncrypted = errors.New("encrypt: object is not encrypted")
+	errTruncated    = errors.New("encrypt: object is truncated")
+	errCorrupt      = errors.New("encrypt: object is corrupt")
+)
+
+// header is the decoded header of an encrypted object.
+type header struct {
+	chunkSize int64
+	size      int64
+	keyID     string
+	wrapped   []byte
+	// raw is the encoded header.
+	raw []byte
+}
+
+func (h *header) len() int64 {
+	return int64(len(h.raw))
+}
+
+func (h *header) frameSize() int64 {
+	return h.chunkSize + tagSize
+}
+
+// plaintextSize returns the size of the plaintext of an object of the given
+// size.
+func (h *header) plaintextSize(objectSize int64) (int64, error) {
+	if h.size >= 0 {
+		return h.size, nil
+	}
+	body := objectSize - h.len()
+	if body < tagSize {
+		return 0, errTruncated
+	}
+	frames, rem := body/h.frameSize(), body%h.frameSize()
+	if rem < tagSize {
+		return 0, errTruncated
+	}
+	return frames*h.chunkSize + rem - tagSize, nil
+}
+
+// The sizes of an object are kept next to it, so that they are known without
+// reading its header:
+//
+//	sizes: object size | key ID | AES-256-GCM(master key, nonce, plaintext size)
+//
+// The object size and key ID are authenticated as the additional data of the
+// plaintext size, and tell whether the sizes match the object.
+
+// sealSizes returns the sizes of an object of the given size holding size
+// bytes of plaintext.
+func sealSizes(key *masterKey, objectSize, size int64) ([]byte, error) {
+	sizes := binary.BigEndian.AppendUint64(nil, uint64(objectSize))
+	sizes = append(sizes, byte(len(key.id)))
+	sizes = append(sizes, key.id...)
+	aad := len(sizes)
+	nonce := make([]byte, nonceSize)
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, err
+	}
+	sizes = append(sizes, nonce...)
+	return key.aead.Seal(sizes, nonce, binary.BigEndian.AppendUint64(nil, uint64(size)), sizes[:aad]), nil
+}
+
+// openSizes returns the plaintext size held in sizes, and whether sizes are
+// those of an object of the given size.
+func openSizes(keys map[string]*masterKey, sizes []byte, objectSize int64) (int64, bool, error) {
+	if len(sizes) < 9 || int64(binary.BigEndian.Uint64(sizes)) != objectSize {
+		return 0, false, nil
+	}
+	aad := 9 + int(sizes[8])
+	if len(sizes) != aad+nonceSize+8+tagSize {
+		return 0, false, errCorrupt
+	}
+	keyID := string(sizes[9:aad])
+	key, ok := keys[keyID]
+	if !ok {
+		return 0, false, fmt.Errorf("encrypt: unknown key %q", keyID)
+	}
+	size, err := key.aead.Open(nil, sizes[aad:aad+nonceSize], sizes[aad+nonceSize:], sizes[:aad])
+	if err != nil {
+		return 0, false, errCorrupt
+	}
+	return int64(binary.BigEndian.Uint64(size)), true, nil
+}
+
+// newHeader generates a data key and returns it with the header of an object
+// encrypted with it.
+func newHeader(key *masterKey, chunkSize, size int64) (*header, cipher.AEAD, error) {
+	dataKey := make([]byte, dataKeySize)
+	if _, err := rand.Read(dataKey); err != nil {
+		return nil, nil, err
+	}
+	aead, err := newAEAD(dataKey)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	raw := make([]byte, 0, fixedHeaderSize+len(key.id)+1+nonceSize+dataKeySize+tagSize)
+	raw = append(raw, magic...)
+	raw = append(raw, formatVersion)
+	raw = binary.BigEndian.AppendUint32(raw, uint32(chunkSize))
+	raw = binary.BigEndian.AppendUint64(raw, uint64(size))
+	raw = append(raw, byte(len(key.id)))
+	raw = append(raw, key.id...)
+
+	nonce := make([]byte, nonceSize)
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, nil, err
+	}
+	wrapped := key.aead.Seal(nonce, nonce, dataKey, raw)
+	raw = append(raw, byte(len(wrapped)))
+	raw = append(raw, wrapped...)
+
+	return &header{chunkSize: chunkSize, size: size, keyID: key.id, wrapped: wrapped, raw: raw}, aead, nil
+}
+
+// readHeader reads the header at the start of r.
+func readHeader(r io.Reader) (*header, error) {
+	raw := make([]byte, fixedHeaderSize)
+	if _, err := io.ReadFull(r, raw); err != nil {
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			return nil, errNotEncrypted
+		}
+		return nil, err
+	}
+	if string(raw[:len(magic)]) != magic {
+		return nil, errNotEncrypted
+	}
+	if v := raw[len(magic)]; v != formatVersion {
+		return nil, fmt.Errorf("encrypt: unsupported format version %d", v)
+	}
+	h := &header{
+		chunkSize: int64(binary.BigEndian.Uint32(raw[len(magic)+1:])),
+		size:      int64(binary.BigEndian.Uint64(raw[len(magic)+5:])),
+	}
+	if h.chunkSize == 0 {
+		return nil, errCorrupt
+	}
+
+	keyID := make([]byte, int(raw[fixedHeaderSize-1])+1)
+	if _, err := io.ReadFull(r, keyID); err != nil {
+		return nil, errCorrupt
+	}
+	h.keyID = string(keyID[:len(keyID)-1])
+	raw = append(raw, keyID...)
+
+	h.wrapped = make([]byte, keyID[len(keyID)-1])
+	if _, err := io.ReadFull(r, h.wrapped); err != nil {
+		return nil, errCorrupt
+	}
+	h.raw = append(raw, h.wrapped...)
+	return h, nil
+}
+
+// unwrap returns the cipher of the data key of the object.
+func (h *header) unwrap(keys map[string]*masterKey) (cipher.AEAD, error) {
+	key, ok := keys[h.keyID]
+	if !ok {
+		return nil, fmt.Errorf("encrypt: unknown key %q", h.keyID)
+	}
+	if len(h.wrapped) < nonceSize {
+		return nil, errCorrupt
+	}
+	aad := h.raw[:len(h.raw)-len(h.wrapped)-1]
+	dataKey, err := key.aead.Open(nil, h.wrapped[:nonceSize], h.wrapped[nonceSize:], aad)
+	if err != nil {
+		return nil, fmt.Errorf("encrypt: unwrapping data key with key %q: %v", h.keyID, err)
+	}
+	return newAEAD(dataKey)
+}
+
+func newAEAD(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+func frameNonce(index int64, flag byte) []byte {
+	nonce := make([]byte, nonceSize)
+	binary.BigEndian.PutUint64(nonce, uint64(index))
+	nonce[nonceSize-1] = flag
+	return nonce
+}
+
+func sealFrame(aead cipher.AEAD, dst, plaintext []byte, index int64, flag byte) []byte {
+	return aead.Seal(dst, frameNonce(index, flag), plaintext, nil)
+}
+
+func openFrame(aead cipher.AEAD, dst, frame []byte, index int64, flag byte) ([]byte, error) {
+	plaintext, err := aead.Open(dst, frameNonce(index, flag), frame, nil)
+	if err != nil {
+		return nil, errCorrupt
+	}
+	return plaintext, nil
+}
+
+// encrypt returns the object holding content.
+func encrypt(key *masterKey, chunkSize int64, content []byte) ([]byte, error) {
+	h, aead, err := newHeader(key, chunkSize, int64(len(content)))
+	if err != nil {
+		return nil, err
+	}
+	frames := int64(len(content))/chunkSize + 1
+	out := make([]byte, 0, h.len()+int64(len(content))+frames*tagSize)
+	out = append(out, h.raw...)
+	for index := int64(0); ; index++ {
+		if int64(len(content)) < chunkSize {
+			return sealFrame(aead, out, content, index, flagFinal), nil
+		}
+		out = sealFrame(aead, out, content[:chunkSize], index, flagChunk)
+		content = content[chunkSize:]
+	}
+}
+
+// frameReader decrypts the frames read from an object.
+type frameReader struct {
+	rc    io.ReadCloser
+	aead  cipher.AEAD
+	index int64
+	frame []byte
+	// skip is the number of plaintext bytes to discard from the first
+	// frame.
+	skip int64
+	// seeked is set when the first frame read is not the first frame of
+	// the object.
+	seeked bool
+	buf    []byte
+	err    error
+}
+
+func newFrameReader(rc io.ReadCloser, h *header, aead cipher.AEAD, offset int64) *frameReader {
+	index := offset / h.chunkSize
+	return &frameReader{
+		rc:     rc,
+		aead:   aead,
+		index:  index,
+		frame:  make([]byte, h.frameSize()),
+		skip:   offset % h.chunkSize,
+		seeked: index > 0,
+	}
+}
+
+func (r *frameReader) Read(p []byte) (int, error) {
+	for len(r.buf) == 0 {
+		if r.err != nil {
+			return 0, r.err
+		}
+		r.err = r.next()
+	}
+	n := copy(p, r.buf)
+	r.buf = r.buf[n:]
+	return n, nil
+}
+
+// next decrypts the next frame into buf, and returns io.EOF after the last
+// frame.
+func (r *frameReader) next() error {
+	n, err := io.ReadFull(r.rc, r.frame)
+	flag := byte(flagChunk)
+	switch err {
+	case nil:
+	case io.ErrUnexpectedEOF:
+		flag = flagFinal
+	case io.EOF:
+		if r.seeked {
+			// The offset is past the end of the object.
+			return io.EOF
+		}
+		return errTruncated
+	default:
+		return err
+	}
+	r.seeked = false
+	if n < tagSize {
+		return errTruncated
+	}
+
+	plaintext, err := openFrame(r.aead, r.frame[:0], r.frame[:n], r.index, flag)
+	if err != nil {
+		return err
+	}
+	r.index++
+	if r.skip > 0 {
+		plaintext = plaintext[min(r.skip, int64(len(plaintext))):]
+		r.skip = 0
+	}
+	r.buf = plaintext
+	if flag == flagFinal {
+		// Read returns the remaining plaintext before io.EOF.
+		return io.EOF
+	}
+	return nil
+}
+
+func (r *frameReader) Close() error {
+	return r.rc.Close()
+}
@@ -0,0 +1,106 @@
+package middleware
+
+import (
+	"bufio"
+	"context"
+	"crypto/cipher"
+	"encoding/base64"
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/kms"
+)
+
+// masterKey is a key wrapping the data keys of objects.
+type masterKey struct {
+	id   string
+	aead cipher.AEAD
+}
+
+// kmsDecrypt decrypts a data key wrapped by AWS KMS. It is replaced in tests.
+var kmsDecrypt = func(ctx context.Context, region, endpoint string, wrapped []byte) ([]byte, error) {
+	config := aws.NewConfig()
+	if region != "" {
+		config.WithRegion(region)
+	}
+	if endpoint != "" {
+		config.WithEndpoint(endpoint)
+	}
+	sess, err := session.NewSessionWithOptions(session.Options{
+		Config:            *config,
+		SharedConfigState: session.SharedConfigEnable,
+	})
+	if err != nil {
+		return nil, err
+	}
+	out, err := kms.New(sess).DecryptWithContext(ctx, &kms.DecryptInput{CiphertextBlob: wrapped})
+	if err != nil {
+		return nil, err
+	}
+	return out.Plaintext, nil
+}
+
+// loadKeys reads a key file. Each line of the file holds a key ID and a
+// base64 encoded key separated by whitespace; blank lines and lines starting
+// with # are ignored. If unwrap is set, the keys are decrypted with it.
+//
+// The keys are returned by ID along with the ID of the first key, which
+// encrypts the objects written through the middleware.
+func loadKeys(path string, unwrap func([]byte) ([]byte, error)) (map[string]*masterKey, string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, "", err
+	}
+	defer f.Close()
+
+	keys := make(map[string]*masterKey)
+	var current string
+	scanner := bufio.NewScanner(f)
+	for line := 1; scanner.Scan(); line++ {
+		text := strings.TrimSpace(scanner.Text())
+		if text == "" || strings.HasPrefix(text, "#") {
+			continue
+		}
+		fields := strings.Fields(text)
+		if len(fields) != 2 {
+			return nil, "", fmt.Errorf("%s:%d: expected a key ID and a key", path, line)
+		}
+		id := fields[0]
+		if len(id) > 255 {
+			return nil, "", fmt.Errorf("%s:%d: key ID is longer than 255 bytes", path, line)
+		}
+		if _, ok := keys[id]; ok {
+			return nil, "", fmt.Errorf("%s:%d: duplicate key ID %q", path, line, id)
+		}
+		key, err := base64.StdEncoding.DecodeString(fields[1])
+		if err != nil {
+			return nil, "", fmt.Errorf("%s:%d: invalid key %q: %v", path, line, id, err)
+		}
+		if unwrap != nil {
+			if key, err = unwrap(key); err != nil {
+				return nil, "", fmt.Errorf("%s:%d: unwrapping key %q: %v", path, line, id, err)
+			}
+		}
+		if len(key) != dataKeySize {
+			return nil, "", fmt.Errorf("%s:%d: key %q must be %d bytes, not %d", path, line, id, dataKeySize, len(key))
+		}
+		aead, err := newAEAD(key)
+		if err != nil {
+			return nil, "", err
+		}
+		keys[id] = &masterKey{id: id, aead: aead}
+		if current == "" {
+			current = id
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, "", err
+	}
+	if current == "" {
+		return nil, "", fmt.Errorf("%s: no keys", path)
+	}
+	return keys, current, nil
+}
@@ -0,0 +1,391 @@
+// Package middleware - encrypt wrapper for storage drivers, encrypting the
+// content stored through it with keys held by the registry.
+package middleware
+
+import (
+	"bytes"
+	"context"
+	"crypto/cipher"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+
+	storagedriver "github.com/distribution/distribution/v3/registry/storage/driver"
+	storagemiddleware "github.com/distribution/distribution/v3/registry/storage/driver/middleware"
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	defaultChunkSize = 64 << 10
+	maxChunkSize     = 16 << 20
+
+	// pendingSuffix is appended to the path of an object to name the
+	// object holding the state of an unfinished write.
+	pendingSuffix = ".encpending"
+
+	// sizeSuffix is appended to the path of an object to name the object
+	// holding its sizes, so that Stat does not read its header.
+	sizeSuffix = ".encsize"
+)
+
+func init() {
+	if err := storagemiddleware.Register("encrypt", newEncryptStorageMiddleware); err != nil {
+		logrus.Errorf("failed to register encrypt storage middleware: %v", err)
+	}
+}
+
+// encryptStorageMiddleware encrypts the content written through it with
+// AES-256-GCM before it is passed to the storage driver, and decrypts the
+// content read through it.
+type encryptStorageMiddleware struct {
+	storagedriver.StorageDriver
+	keys map[string]*masterKey
+	// current is the key with which new objects are encrypted.
+	current   *masterKey
+	chunkSize int64
+}
+
+var _ storagedriver.StorageDriver = &encryptStorageMiddleware{}
+
+// newEncryptStorageMiddleware constructs and returns a new encrypt storage
+// middleware.
+//
+// Required options, one of:
+//
+//   - keyfile: a file of IDs and base64 encoded 256 bit keys
+//   - kmskeyfile: a file of IDs and base64 encoded data keys wrapped by AWS KMS
+//
+// Optional options:
+//
+//   - kmsregion: the AWS region of the KMS keys
+//   - kmsendpoint: the endpoint of AWS KMS
+//   - chunksize: the size of the encrypted frames
+func newEncryptStorageMiddleware(ctx context.Context, sd storagedriver.StorageDriver, options map[string]any) (storagedriver.StorageDriver, error) {
+	keyFile, err := stringOption(options, "keyfile")
+	if err != nil {
+		return nil, err
+	}
+	kmsKeyFile, err := stringOption(options, "kmskeyfile")
+	if err != nil {
+		return nil, err
+	}
+	kmsRegion, err := stringOption(options, "kmsregion")
+	if err != nil {
+		return nil, err
+	}
+	kmsEndpoint, err := stringOption(options, "kmsendpoint")
+	if err != nil {
+		return nil, err
+	}
+
+	var (
+		keys    map[string]*masterKey
+		current string
+	)
+	switch {
+	case keyFile != "" && kmsKeyFile != "":
+		return nil, fmt.Errorf("only one of keyfile and kmskeyfile may be provided")
+	case keyFile != "":
+		keys, current, err = loadKeys(keyFile, nil)
+	case kmsKeyFile != "":
+		keys, current, err = loadKeys(kmsKeyFile, func(wrapped []byte) ([]byte, error) {
+			return kmsDecrypt(ctx, kmsRegion, kmsEndpoint, wrapped)
+		})
+	default:
+		return nil, fmt.Errorf("no keyfile or kmskeyfile provided")
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	chunkSize := int64(defaultChunkSize)
+	switch v := options["chunksize"].(type) {
+	case nil:
+	case int:
+		chunkSize = int64(v)
+	case int64:
+		chunkSize = v
+	case uint64:
+		chunkSize = int64(v)
+	case string:
+		chunkSize, err = strconv.ParseInt(v, 10, 64)
+		if err != nil {
+			return nil, fmt.Errorf("chunksize must be an integer, %v invalid", v)
+		}
+	default:
+		return nil, fmt.Errorf("chunksize must be an integer, %v invalid", v)
+	}
+	if chunkSize <= 0 || chunkSize > maxChunkSize {
+		return nil, fmt.Errorf("chunksize must be between 1 and %d, %d invalid", maxChunkSize, chunkSize)
+	}
+
+	return &encryptStorageMiddleware{
+		StorageDriver: sd,
+		keys:          keys,
+		current:       keys[current],
+		chunkSize:     chunkSize,
+	}, nil
+}
+
+func stringOption(options map[string]any, name string) (string, error) {
+	o, ok := options[name]
+	if !ok {
+		return "", nil
+	}
+	s, ok := o.(string)
+	if !ok {
+		return "", fmt.Errorf("%s must be a string", name)
+	}
+	return s, nil
+}
+
+// GetContent retrieves the content stored at "path" as a []byte.
+func (m *encryptStorageMiddleware) GetContent(ctx context.Context, path string) ([]byte, error) {
+	object, err := m.StorageDriver.GetContent(ctx, path)
+	if err != nil {
+		return nil, err
+	}
+	h, err := readHeader(bytes.NewReader(object))
+	if err != nil {
+		return nil, err
+	}
+	aead, err := h.unwrap(m.keys)
+	if err != nil {
+		return nil, err
+	}
+	return io.ReadAll(newFrameReader(io.NopCloser(bytes.NewReader(object[h.len():])), h, aead, 0))
+}
+
+// PutContent stores the []byte content at a location designated by "path".
+func (m *encryptStorageMiddleware) PutContent(ctx context.Context, path string, content []byte) error {
+	object, err := encrypt(m.current, m.chunkSize, content)
+	if err != nil {
+		return err
+	}
+	if err := deleteSizes(ctx, m.StorageDriver, path); err != nil {
+		return err
+	}
+	if err := m.StorageDriver.PutContent(ctx, path, object); err != nil {
+		return err
+	}
+	return putSizes(ctx, m.StorageDriver, m.current, path, int64(len(object)), int64(len(content)))
+}
+
+// Reader retrieves an io.ReadCloser for the content stored at "path" with a
+// given byte offset. The object is read from the start of the frame holding
+// the offset.
+func (m *encryptStorageMiddleware) Reader(ctx context.Context, path string, offset int64) (io.ReadCloser, error) {
+	if offset < 0 {
+		return nil, storagedriver.InvalidOffsetError{Path: path, Offset: offset, DriverName: m.Name()}
+	}
+	h, aead, rc, err := m.open(ctx, path)
+	if err != nil {
+		return nil, err
+	}
+	if offset < h.chunkSize {
+		return newFrameReader(rc, h, aead, offset), nil
+	}
+
+	rc.Close()
+	frameOffset := h.len() + offset/h.chunkSize*h.frameSize()
+	rc, err = m.StorageDriver.Reader(ctx, path, frameOffset)
+	if err != nil {
+		if errors.As(err, &storagedriver.InvalidOffsetError{}) {
+			// The offset is past the end of the object.
+			return io.NopCloser(bytes.NewReader(nil)), nil
+		}
+		return nil, err
+	}
+	return newFrameReader(rc, h, aead, offset), nil
+}
+
+// open reads the header of the object at path, and returns it along with
+// the cipher of the object and a reader positioned after the header.
+func (m *encryptStorageMiddleware) open(ctx context.Context, path string) (*header, cipher.AEAD, io.ReadCloser, error) {
+	rc, err := m.StorageDriver.Reader(ctx, path, 0)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	h, err := readHeader(rc)
+	if err == nil {
+		var aead cipher.AEAD
+		if aead, err = h.unwrap(m.keys); err == nil {
+			return h, aead, rc, nil
+		}
+	}
+	rc.Close()
+	return nil, nil, nil, err
+}
+
+// Writer returns a FileWriter which will store the content written to it
+// at the location designated by "path" after the call to Commit.
+func (m *encryptStorageMiddleware) Writer(ctx context.Context, path string, append bool) (storagedriver.FileWriter, error) {
+	if !append {
+		return m.newWriter(ctx, path)
+	}
+
+	pending, err := m.StorageDriver.GetContent(ctx, pendingPath(path))
+	if err == nil {
+		return m.resumeWriter(ctx, path, pending)
+	}
+	if !errors.As(err, &storagedriver.PathNotFoundError{}) {
+		return nil, err
+	}
+
+	// The final frame of a committed object cannot be extended, so the
+	// object is written again.
+	content, err := m.GetContent(ctx, path)
+	if err != nil && !errors.As(err, &storagedriver.PathNotFoundError{}) {
+		return nil, err
+	}
+	w, err := m.newWriter(ctx, path)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := w.Write(content); err != nil {
+		w.Cancel(ctx)
+		return nil, err
+	}
+	return w, nil
+}
+
+// Stat retrieves the FileInfo for the given path, reporting the size of
+// the plaintext of objects.
+func (m *encryptStorageMiddleware) Stat(ctx context.Context, path string) (storagedriver.FileInfo, error) {
+	fi, err := m.StorageDriver.Stat(ctx, path)
+	if err != nil || fi.IsDir() {
+		return fi, err
+	}
+	size, err := m.plaintextSize(ctx, path, fi.Size())
+	if err != nil {
+		return nil, err
+	}
+	return storagedriver.FileInfoInternal{FileInfoFields: storagedriver.FileInfoFields{
+		Path:    fi.Path(),
+		Size:    size,
+		ModTime: fi.ModTime(),
+	}}, nil
+}
+
+// plaintextSize returns the size of the plaintext of the object at path,
+// given the size of the object. The size is read from the sizes object of
+// the path, and from the header of the object when the sizes object is
+// missing or does not match the object.
+func (m *encryptStorageMiddleware) plaintextSize(ctx context.Context, path string, objectSize int64) (int64, error) {
+	sizes, err := m.StorageDriver.GetContent(ctx, sizePath(path))
+	switch {
+	case err == nil:
+		size, ok, err := openSizes(m.keys, sizes, objectSize)
+		if ok || err != nil {
+			return size, err
+		}
+	case !errors.As(err, &storagedriver.PathNotFoundError{}):
+		return 0, err
+	}
+
+	rc, err := m.StorageDriver.Reader(ctx, path, 0)
+	if err != nil {
+		return 0, err
+	}
+	defer rc.Close()
+	h, err := readHeader(rc)
+	if err != nil {
+		return 0, err
+	}
+	// Unwrapping the data key authenticates the header.
+	if _, err := h.unwrap(m.keys); err != nil {
+		return 0, err
+	}
+	return h.plaintextSize(objectSize)
+}
+
+// Move moves an object stored at sourcePath to destPath, along with its
+// sizes.
+func (m *encryptStorageMiddleware) Move(ctx context.Context, sourcePath string, destPath string) error {
+	if err := m.StorageDriver.Move(ctx, sourcePath, destPath); err != nil {
+		return err
+	}
+	err := m.StorageDriver.Move(ctx, sizePath(sourcePath), sizePath(destPath))
+	if errors.As(err, &storagedriver.PathNotFoundError{}) {
+		return deleteSizes(ctx, m.StorageDriver, destPath)
+	}
+	return err
+}
+
+// Delete recursively deletes all objects stored at "path" and its subpaths,
+// along with the sizes of the object stored at "path".
+func (m *encryptStorageMiddleware) Delete(ctx context.Context, path string) error {
+	if err := m.StorageDriver.Delete(ctx, path); err != nil {
+		return err
+	}
+	return deleteSizes(ctx, m.StorageDriver, path)
+}
+
+// List returns a list of the objects that are direct descendants of the
+// given path, leaving out the sizes of objects and the state of unfinished
+// writes.
+func (m *encryptStorageMiddleware) List(ctx context.Context, path string) ([]string, error) {
+	children, err := m.StorageDriver.List(ctx, path)
+	if err != nil {
+		return nil, err
+	}
+	filtered := children[:0]
+	for _, child := range children {
+		if !hidden(child) {
+			filtered = append(filtered, child)
+		}
+	}
+	return filtered, nil
+}
+
+// Walk traverses a filesystem defined within driver, leaving out the sizes
+// of objects and the state of unfinished writes. The sizes reported are those of the stored objects.
+func (m *encryptStorageMiddleware) Walk(ctx context.Context, path string, f storagedriver.WalkFn, options ...func(*storagedriver.WalkOptions)) error {
+	return m.StorageDriver.Walk(ctx, path, func(fi storagedriver.FileInfo) error {
+		if hidden(fi.Path()) {
+			return nil
+		}
+		return f(fi)
+	}, options...)
+}
+
+// RedirectURL returns no URL, as the objects served by the storage provider
+// are encrypted.
+func (m *encryptStorageMiddleware) RedirectURL(r *http.Request, path string) (string, error) {
+	return "", nil
+}
+
+func pendingPath(path string) string {
+	return path + pendingSuffix
+}
+
+func sizePath(path string) string {
+	return path + sizeSuffix
+}
+
+// hidden returns whether the object at path is kept by the middleware next
+// to the objects stored through it.
+func hidden(path string) bool {
+	return strings.HasSuffix(path, pendingSuffix) || strings.HasSuffix(path, sizeSuffix)
+}
+
+// putSizes stores the size of the object at path and the size of its
+// plaintext.
+func putSizes(ctx context.Context, driver storagedriver.StorageDriver, key *masterKey, path string, objectSize, size int64) error {
+	sizes, err := sealSizes(key, objectSize, size)
+	if err != nil {
+		return err
+	}
+	return driver.PutContent(ctx, sizePath(path), sizes)
+}
+
+func deleteSizes(ctx context.Context, driver storagedriver.StorageDriver, path string) error {
+	err := driver.Delete(ctx, sizePath(path))
+	if errors.As(err, &storagedriver.PathNotFoundError{}) {
+		return nil
+	}
+	return err
+}
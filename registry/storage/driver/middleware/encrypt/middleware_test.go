@@ -0,0 +1,423 @@
+package middleware
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/base64"
+	"fmt"
+	"io"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	storagedriver "github.com/distribution/distribution/v3/registry/storage/driver"
+	"github.com/distribution/distribution/v3/registry/storage/driver/inmemory"
+	"github.com/distribution/distribution/v3/registry/storage/driver/testsuites"
+	"github.com/stretchr/testify/require"
+)
+
+const testChunkSize = 16
+
+// writeKeyFile writes a key file holding a random key for each ID.
+func writeKeyFile(t *testing.T, ids ...string) string {
+	t.Helper()
+	var b strings.Builder
+	b.WriteString("# test keys\n\n")
+	for _, id := range ids {
+		key := make([]byte, dataKeySize)
+		_, err := rand.Read(key)
+		require.NoError(t, err)
+		fmt.Fprintf(&b, "%s %s\n", id, base64.StdEncoding.EncodeToString(key))
+	}
+	path := filepath.Join(t.TempDir(), "keys")
+	require.NoError(t, os.WriteFile(path, []byte(b.String()), 0o600))
+	return path
+}
+
+func newTestMiddleware(t *testing.T, sd storagedriver.StorageDriver, options map[string]any) *encryptStorageMiddleware {
+	t.Helper()
+	m, err := newEncryptStorageMiddleware(context.Background(), sd, options)
+	require.NoError(t, err)
+	return m.(*encryptStorageMiddleware)
+}
+
+func randomContent(t *testing.T, size int) []byte {
+	t.Helper()
+	content := make([]byte, size)
+	_, err := rand.Read(content)
+	require.NoError(t, err)
+	return content
+}
+
+func TestEncryptDriverSuite(t *testing.T) {
+	keyFile := writeKeyFile(t, "key")
+	testsuites.Driver(t, func() (storagedriver.StorageDriver, error) {
+		return newEncryptStorageMiddleware(context.Background(), inmemory.New(), map[string]any{
+			"keyfile": keyFile,
+		})
+	}, false)
+}
+
+func TestOptions(t *testing.T) {
+	keyFile := writeKeyFile(t, "key")
+	shortKey := filepath.Join(t.TempDir(), "short")
+	require.NoError(t, os.WriteFile(shortKey, []byte("key "+base64.StdEncoding.EncodeToString([]byte("short"))+"\n"), 0o600))
+	duplicate := filepath.Join(t.TempDir(), "duplicate")
+	keys, err := os.ReadFile(keyFile)
+	require.NoError(t, err)
+	require.NoError(t, os.WriteFile(duplicate, append(keys, keys...), 0o600))
+
+	for _, tc := range []struct {
+		name    string
+		options map[string]any
+		err     string
+	}{
+		{name: "no keys", options: map[string]any{}, err: "no keyfile or kmskeyfile provided"},
+		{name: "both key files", options: map[string]any{"keyfile": keyFile, "kmskeyfile": keyFile}, err: "only one of keyfile and kmskeyfile"},
+		{name: "missing key file", options: map[string]any{"keyfile": filepath.Join(t.TempDir(), "missing")}, err: "no such file"},
+		{name: "short key", options: map[string]any{"keyfile": shortKey}, err: "must be 32 bytes"},
+		{name: "duplicate key", options: map[string]any{"keyfile": duplicate}, err: "duplicate key ID"},
+		{name: "invalid chunksize", options: map[string]any{"keyfile": keyFile, "chunksize": "big"}, err: "chunksize must be an integer"},
+		{name: "zero chunksize", options: map[string]any{"keyfile": keyFile, "chunksize": 0}, err: "chunksize must be between"},
+		{name: "chunksize string", options: map[string]any{"keyfile": keyFile, "chunksize": "4096"}},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			_, err := newEncryptStorageMiddleware(context.Background(), inmemory.New(), tc.options)
+			if tc.err == "" {
+				require.NoError(t, err)
+			} else {
+				require.ErrorContains(t, err, tc.err)
+			}
+		})
+	}
+}
+
+// TestRoundTrip writes content of sizes around the frame boundaries and
+// checks that it is read back, that Stat reports its size and that it is not
+// stored in plaintext.
+func TestRoundTrip(t *testing.T) {
+	ctx := context.Background()
+	backend := inmemory.New()
+	m := newTestMiddleware(t, backend, map[string]any{"keyfile": writeKeyFile(t, "key"), "chunksize": testChunkSize})
+
+	for _, size := range []int{0, 1, testChunkSize - 1, testChunkSize, testChunkSize + 1, 3 * testChunkSize, 3*testChunkSize + 7} {
+		for _, method := range []string{"PutContent", "Writer"} {
+			t.Run(fmt.Sprintf("%s/%d", method, size), func(t *testing.T) {
+				path := fmt.Sprintf("/%s/%d", method, size)
+				content := randomContent(t, size)
+				if method == "PutContent" {
+					require.NoError(t, m.PutContent(ctx, path, content))
+				} else {
+					w, err := m.Writer(ctx, path, false)
+					require.NoError(t, err)
+					_, err = w.Write(content)
+					require.NoError(t, err)
+					require.Equal(t, int64(size), w.Size())
+					require.NoError(t, w.Commit(ctx))
+					require.NoError(t, w.Close())
+				}
+
+				got, err := m.GetContent(ctx, path)
+				require.NoError(t, err)
+				require.Equal(t, content, append([]byte{}, got...))
+
+				fi, err := m.Stat(ctx, path)
+				require.NoError(t, err)
+				require.Equal(t, int64(size), fi.Size())
+
+				stored, err := backend.GetContent(ctx, path)
+				require.NoError(t, err)
+				if size >= 8 {
+					require.False(t, bytes.Contains(stored, content[:8]), "found plaintext in the stored object")
+				}
+			})
+		}
+	}
+}
+
+// TestRangedReads reads objects from every offset, across frame boundaries
+// and past the end of the objects.
+func TestRangedReads(t *testing.T) {
+	ctx := context.Background()
+	m := newTestMiddleware(t, inmemory.New(), map[string]any{"keyfile": writeKeyFile(t, "key"), "chunksize": testChunkSize})
+
+	content := randomContent(t, 5*testChunkSize+3)
+	require.NoError(t, m.PutContent(ctx, "/put", content))
+	w, err := m.Writer(ctx, "/writer", false)
+	require.NoError(t, err)
+	_, err = w.Write(content)
+	require.NoError(t, err)
+	require.NoError(t, w.Commit(ctx))
+	require.NoError(t, w.Close())
+
+	for _, path := range []string{"/put", "/writer"} {
+		for offset := 0; offset <= len(content)+2*testChunkSize; offset++ {
+			rc, err := m.Reader(ctx, path, int64(offset))
+			require.NoError(t, err)
+			got, err := io.ReadAll(rc)
+			require.NoError(t, err, "reading %s at %d", path, offset)
+			rc.Close()
+			want := []byte{}
+			if offset < len(content) {
+				want = content[offset:]
+			}
+			require.Equal(t, want, append([]byte{}, got...), "reading %s at %d", path, offset)
+		}
+	}
+
+	_, err = m.Reader(ctx, "/put", -1)
+	require.ErrorAs(t, err, &storagedriver.InvalidOffsetError{})
+}
+
+// TestResumeWriter closes a writer in the middle of frames several times and
+// checks that resuming it preserves the content.
+func TestResumeWriter(t *testing.T) {
+	ctx := context.Background()
+	backend := inmemory.New()
+	m := newTestMiddleware(t, backend, map[string]any{"keyfile": writeKeyFile(t, "key"), "chunksize": testChunkSize})
+	content := randomContent(t, 4*testChunkSize+5)
+
+	var written int
+	for i, n := range []int{5, testChunkSize, 2*testChunkSize - 5, 0, 5} {
+		w, err := m.Writer(ctx, "/upload/data", i > 0)
+		require.NoError(t, err)
+		require.Equal(t, int64(written), w.Size())
+		_, err = w.Write(content[written : written+n])
+		require.NoError(t, err)
+		written += n
+		require.NoError(t, w.Close())
+
+		children, err := m.List(ctx, "/upload")
+		require.NoError(t, err)
+		require.Equal(t, []string{"/upload/data"}, children)
+	}
+
+	w, err := m.Writer(ctx, "/upload/data", true)
+	require.NoError(t, err)
+	require.Equal(t, int64(written), w.Size())
+	require.NoError(t, w.Commit(ctx))
+	require.NoError(t, w.Close())
+
+	got, err := m.GetContent(ctx, "/upload/data")
+	require.NoError(t, err)
+	require.Equal(t, content[:written], got)
+	_, err = backend.Stat(ctx, pendingPath("/upload/data"))
+	require.ErrorAs(t, err, &storagedriver.PathNotFoundError{})
+
+	// Appending to a committed object writes it again.
+	w, err = m.Writer(ctx, "/upload/data", true)
+	require.NoError(t, err)
+	require.Equal(t, int64(written), w.Size())
+	_, err = w.Write(content[written:])
+	require.NoError(t, err)
+	require.NoError(t, w.Commit(ctx))
+	require.NoError(t, w.Close())
+	got, err = m.GetContent(ctx, "/upload/data")
+	require.NoError(t, err)
+	require.Equal(t, content, got)
+}
+
+func TestCancelWriter(t *testing.T) {
+	ctx := context.Background()
+	backend := inmemory.New()
+	m := newTestMiddleware(t, backend, map[string]any{"keyfile": writeKeyFile(t, "key"), "chunksize": testChunkSize})
+
+	w, err := m.Writer(ctx, "/upload/data", false)
+	require.NoError(t, err)
+	_, err = w.Write(randomContent(t, 20))
+	require.NoError(t, err)
+	require.NoError(t, w.Close())
+
+	w, err = m.Writer(ctx, "/upload/data", true)
+	require.NoError(t, err)
+	require.NoError(t, w.Cancel(ctx))
+	_, err = backend.Stat(ctx, pendingPath("/upload/data"))
+	require.ErrorAs(t, err, &storagedriver.PathNotFoundError{})
+}
+
+// readerCountingDriver counts the readers opened on the driver.
+type readerCountingDriver struct {
+	storagedriver.StorageDriver
+	readers int
+}
+
+func (d *readerCountingDriver) Reader(ctx context.Context, path string, offset int64) (io.ReadCloser, error) {
+	d.readers++
+	return d.StorageDriver.Reader(ctx, path, offset)
+}
+
+// TestStatSizes checks that Stat reports the plaintext size of objects
+// without reading them, and falls back to their header when their sizes are
+// missing or do not match them.
+func TestStatSizes(t *testing.T) {
+	ctx := context.Background()
+	backend := &readerCountingDriver{StorageDriver: inmemory.New()}
+	m := newTestMiddleware(t, backend, map[string]any{"keyfile": writeKeyFile(t, "key"), "chunksize": testChunkSize})
+	content := randomContent(t, 3*testChunkSize+5)
+
+	require.NoError(t, m.PutContent(ctx, "/put", content))
+	w, err := m.Writer(ctx, "/upload/data", false)
+	require.NoError(t, err)
+	_, err = w.Write(content)
+	require.NoError(t, err)
+	require.NoError(t, w.Commit(ctx))
+	require.NoError(t, w.Close())
+	require.NoError(t, m.Move(ctx, "/upload/data", "/blob"))
+
+	for _, path := range []string{"/put", "/blob"} {
+		fi, err := m.Stat(ctx, path)
+		require.NoError(t, err)
+		require.Equal(t, int64(len(content)), fi.Size())
+	}
+	require.Zero(t, backend.readers)
+
+	children, err := m.List(ctx, "/")
+	require.NoError(t, err)
+	require.ElementsMatch(t, []string{"/put", "/blob", "/upload"}, children)
+	require.NoError(t, m.Walk(ctx, "/", func(fi storagedriver.FileInfo) error {
+		require.NotContains(t, fi.Path(), sizeSuffix)
+		return nil
+	}))
+
+	// Sizes left behind by an object stored around the middleware are not
+	// used.
+	object, err := backend.GetContent(ctx, "/put")
+	require.NoError(t, err)
+	h, err := readHeader(bytes.NewReader(object))
+	require.NoError(t, err)
+	require.NoError(t, backend.PutContent(ctx, "/put", object[:h.len()+h.frameSize()+tagSize+1]))
+	fi, err := m.Stat(ctx, "/put")
+	require.NoError(t, err)
+	require.Equal(t, int64(len(content)), fi.Size(), "the size in the header of an object stored with PutContent")
+	require.Equal(t, 1, backend.readers)
+
+	require.NoError(t, m.Delete(ctx, "/blob"))
+	_, err = backend.Stat(ctx, sizePath("/blob"))
+	require.ErrorAs(t, err, &storagedriver.PathNotFoundError{})
+}
+
+// TestKeyRotation checks that objects remain readable once the key with
+// which they were encrypted is no longer the current key.
+func TestKeyRotation(t *testing.T) {
+	ctx := context.Background()
+	backend := inmemory.New()
+	dir := t.TempDir()
+	key1 := readLines(t, writeKeyFile(t, "key1"))
+	key2 := readLines(t, writeKeyFile(t, "key2"))
+	writeKeys := func(lines ...string) string {
+		path := filepath.Join(dir, fmt.Sprint(len(lines)))
+		require.NoError(t, os.WriteFile(path, []byte(strings.Join(lines, "\n")), 0o600))
+		return path
+	}
+
+	old := newTestMiddleware(t, backend, map[string]any{"keyfile": writeKeys(key1)})
+	require.NoError(t, old.PutContent(ctx, "/old", []byte("old content")))
+
+	rotated := newTestMiddleware(t, backend, map[string]any{"keyfile": writeKeys(key2, key1)})
+	require.Equal(t, "key2", rotated.current.id)
+	require.NoError(t, rotated.PutContent(ctx, "/new", []byte("new content")))
+	got, err := rotated.GetContent(ctx, "/old")
+	require.NoError(t, err)
+	require.Equal(t, "old content", string(got))
+
+	_, err = old.GetContent(ctx, "/new")
+	require.ErrorContains(t, err, `unknown key "key2"`)
+	_, err = old.Stat(ctx, "/new")
+	require.ErrorContains(t, err, `unknown key "key2"`)
+}
+
+func readLines(t *testing.T, path string) string {
+	t.Helper()
+	b, err := os.ReadFile(path)
+	require.NoError(t, err)
+	lines := strings.Split(strings.TrimSpace(string(b)), "\n")
+	return lines[len(lines)-1]
+}
+
+// TestTampering checks that modified and truncated objects are rejected.
+func TestTampering(t *testing.T) {
+	ctx := context.Background()
+	backend := inmemory.New()
+	m := newTestMiddleware(t, backend, map[string]any{"keyfile": writeKeyFile(t, "key"), "chunksize": testChunkSize})
+	require.NoError(t, m.PutContent(ctx, "/blob", randomContent(t, 3*testChunkSize+1)))
+	object, err := backend.GetContent(ctx, "/blob")
+	require.NoError(t, err)
+	h, err := readHeader(bytes.NewReader(object))
+	require.NoError(t, err)
+
+	modified := bytes.Clone(object)
+	modified[h.len()+h.frameSize()+1] ^= 1
+	require.NoError(t, backend.PutContent(ctx, "/blob", modified))
+	_, err = m.GetContent(ctx, "/blob")
+	require.ErrorIs(t, err, errCorrupt)
+
+	// Dropping the final frame.
+	require.NoError(t, backend.PutContent(ctx, "/blob", object[:h.len()+3*h.frameSize()]))
+	_, err = m.GetContent(ctx, "/blob")
+	require.ErrorIs(t, err, errTruncated)
+
+	// Changing the plaintext size in the sizes of the object.
+	require.NoError(t, backend.PutContent(ctx, "/blob", object))
+	sizes, err := backend.GetContent(ctx, sizePath("/blob"))
+	require.NoError(t, err)
+	modified = bytes.Clone(sizes)
+	modified[len(modified)-tagSize-1] ^= 1
+	require.NoError(t, backend.PutContent(ctx, sizePath("/blob"), modified))
+	_, err = m.Stat(ctx, "/blob")
+	require.ErrorIs(t, err, errCorrupt)
+
+	// Changing the plaintext size in the header of an object without sizes.
+	require.NoError(t, backend.Delete(ctx, sizePath("/blob")))
+	modified = bytes.Clone(object)
+	modified[len(magic)+1+4+7] ^= 1
+	require.NoError(t, backend.PutContent(ctx, "/blob", modified))
+	_, err = m.Stat(ctx, "/blob")
+	require.ErrorContains(t, err, "unwrapping data key")
+
+	require.NoError(t, backend.PutContent(ctx, "/plain", []byte("not encrypted")))
+	_, err = m.GetContent(ctx, "/plain")
+	require.ErrorIs(t, err, errNotEncrypted)
+}
+
+func TestKMSKeyFile(t *testing.T) {
+	wrapped := make(map[string][]byte)
+	restore := kmsDecrypt
+	t.Cleanup(func() { kmsDecrypt = restore })
+	kmsDecrypt = func(ctx context.Context, region, endpoint string, blob []byte) ([]byte, error) {
+		require.Equal(t, "us-east-1", region)
+		key, ok := wrapped[string(blob)]
+		if !ok {
+			return nil, fmt.Errorf("InvalidCiphertextException")
+		}
+		return key, nil
+	}
+
+	blob := randomContent(t, 64)
+	wrapped[string(blob)] = randomContent(t, dataKeySize)
+	path := filepath.Join(t.TempDir(), "kmskeys")
+	require.NoError(t, os.WriteFile(path, []byte("kms-key "+base64.StdEncoding.EncodeToString(blob)+"\n"), 0o600))
+
+	ctx := context.Background()
+	m := newTestMiddleware(t, inmemory.New(), map[string]any{"kmskeyfile": path, "kmsregion": "us-east-1"})
+	require.NoError(t, m.PutContent(ctx, "/blob", []byte("content")))
+	got, err := m.GetContent(ctx, "/blob")
+	require.NoError(t, err)
+	require.Equal(t, "content", string(got))
+
+	require.NoError(t, os.WriteFile(path, []byte("kms-key "+base64.StdEncoding.EncodeToString([]byte("unknown"))+"\n"), 0o600))
+	_, err = newEncryptStorageMiddleware(ctx, inmemory.New(), map[string]any{"kmskeyfile": path, "kmsregion": "us-east-1"})
+	require.ErrorContains(t, err, "InvalidCiphertextException")
+}
+
+func TestRedirectURL(t *testing.T) {
+	ctx := context.Background()
+	m := newTestMiddleware(t, inmemory.New(), map[string]any{"keyfile": writeKeyFile(t, "key")})
+	require.NoError(t, m.PutContent(ctx, "/blob", []byte("content")))
+
+	url, err := m.RedirectURL(httptest.NewRequest("GET", "/blob", nil), "/blob")
+	require.NoError(t, err)
+	require.Empty(t, url)
+}
@@ -0,0 +1,190 @@
+package middleware
+
+import (
+	"bytes"
+	"context"
+	"crypto/cipher"
+	"errors"
+	"fmt"
+
+	storagedriver "github.com/distribution/distribution/v3/registry/storage/driver"
+)
+
+// writer encrypts the content written to it in frames. The frame being
+// filled is kept, encrypted, in the pending object of the path when the
+// writer is closed before it is committed, so that the write can be resumed.
+type writer struct {
+	driver storagedriver.StorageDriver
+	ctx    context.Context
+	path   string
+	fw     storagedriver.FileWriter
+	header *header
+	aead   cipher.AEAD
+	// key is the key with which the sizes of the object are sealed.
+	key       *masterKey
+	index     int64
+	buf       []byte
+	frame     []byte
+	size      int64
+	closed    bool
+	committed bool
+	cancelled bool
+}
+
+func (m *encryptStorageMiddleware) newWriter(ctx context.Context, path string) (*writer, error) {
+	h, aead, err := newHeader(m.current, m.chunkSize, -1)
+	if err != nil {
+		return nil, err
+	}
+	if err := deleteSizes(ctx, m.StorageDriver, path); err != nil {
+		return nil, err
+	}
+	fw, err := m.StorageDriver.Writer(ctx, path, false)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := fw.Write(h.raw); err != nil {
+		fw.Cancel(ctx)
+		return nil, err
+	}
+	return &writer{
+		driver: m.StorageDriver,
+		ctx:    ctx,
+		path:   path,
+		fw:     fw,
+		header: h,
+		aead:   aead,
+		key:    m.current,
+		buf:    make([]byte, 0, h.chunkSize),
+	}, nil
+}
+
+// resumeWriter resumes the write whose state is held in pending.
+func (m *encryptStorageMiddleware) resumeWriter(ctx context.Context, path string, pending []byte) (*writer, error) {
+	h, err := readHeader(bytes.NewReader(pending))
+	if err != nil {
+		return nil, err
+	}
+	aead, err := h.unwrap(m.keys)
+	if err != nil {
+		return nil, err
+	}
+	fw, err := m.StorageDriver.Writer(ctx, path, true)
+	if err != nil {
+		return nil, err
+	}
+	body := fw.Size() - h.len()
+	if body < 0 || body%h.frameSize() != 0 {
+		fw.Close()
+		return nil, fmt.Errorf("encrypt: unfinished write of %s does not match its pending state", path)
+	}
+	index := body / h.frameSize()
+	buf := make([]byte, 0, h.chunkSize)
+	buf, err = openFrame(aead, buf, pending[h.len():], index, flagPending)
+	if err != nil {
+		fw.Close()
+		return nil, err
+	}
+	return &writer{
+		driver: m.StorageDriver,
+		ctx:    ctx,
+		path:   path,
+		fw:     fw,
+		header: h,
+		aead:   aead,
+		key:    m.current,
+		index:  index,
+		buf:    buf,
+		size:   index*h.chunkSize + int64(len(buf)),
+	}, nil
+}
+
+func (w *writer) Write(p []byte) (int, error) {
+	if w.closed {
+		return 0, fmt.Errorf("already closed")
+	} else if w.committed {
+		return 0, fmt.Errorf("already committed")
+	} else if w.cancelled {
+		return 0, fmt.Errorf("already cancelled")
+	}
+
+	var n int
+	for len(p) > 0 {
+		c := min(len(p), int(w.header.chunkSize)-len(w.buf))
+		w.buf = append(w.buf, p[:c]...)
+		p = p[c:]
+		n += c
+		w.size += int64(c)
+		if int64(len(w.buf)) == w.header.chunkSize {
+			w.frame = sealFrame(w.aead, w.frame[:0], w.buf, w.index, flagChunk)
+			if _, err := w.fw.Write(w.frame); err != nil {
+				return n, err
+			}
+			w.index++
+			w.buf = w.buf[:0]
+		}
+	}
+	return n, nil
+}
+
+func (w *writer) Size() int64 {
+	return w.size
+}
+
+func (w *writer) Close() error {
+	if w.closed {
+		return fmt.Errorf("already closed")
+	}
+	w.closed = true
+	if !w.committed && !w.cancelled {
+		pending := sealFrame(w.aead, bytes.Clone(w.header.raw), w.buf, w.index, flagPending)
+		if err := w.driver.PutContent(w.ctx, pendingPath(w.path), pending); err != nil {
+			w.fw.Close()
+			return err
+		}
+	}
+	return w.fw.Close()
+}
+
+func (w *writer) Cancel(ctx context.Context) error {
+	if w.closed {
+		return fmt.Errorf("already closed")
+	} else if w.committed {
+		return fmt.Errorf("already committed")
+	}
+	w.cancelled = true
+	if err := w.fw.Cancel(ctx); err != nil {
+		return err
+	}
+	return w.deletePending(ctx)
+}
+
+func (w *writer) Commit(ctx context.Context) error {
+	if w.closed {
+		return fmt.Errorf("already closed")
+	} else if w.committed {
+		return fmt.Errorf("already committed")
+	} else if w.cancelled {
+		return fmt.Errorf("already cancelled")
+	}
+	w.frame = sealFrame(w.aead, w.frame[:0], w.buf, w.index, flagFinal)
+	if _, err := w.fw.Write(w.frame); err != nil {
+		return err
+	}
+	if err := w.fw.Commit(ctx); err != nil {
+		return err
+	}
+	w.committed = true
+	if err := putSizes(ctx, w.driver, w.key, w.path, w.fw.Size(), w.size); err != nil {
+		return err
+	}
+	return w.deletePending(ctx)
+}
+
+func (w *writer) deletePending(ctx context.Context) error {
+	err := w.driver.Delete(ctx, pendingPath(w.path))
+	if errors.As(err, &storagedriver.PathNotFoundError{}) {
+		return nil
+	}
+	return err
+}
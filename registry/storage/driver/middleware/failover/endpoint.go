@@ -0,0 +1,82 @@
+package middleware
+
+import (
+	"context"
+	"errors"
+	"sync/atomic"
+	"time"
+
+	"github.com/distribution/distribution/v3/internal/dcontext"
+	prometheus "github.com/distribution/distribution/v3/metrics"
+	storagedriver "github.com/distribution/distribution/v3/registry/storage/driver"
+)
+
+var (
+	// endpointAvailable is 1 for the available endpoints, and 0 for the
+	// others.
+	endpointAvailable = prometheus.StorageNamespace.NewLabeledGauge("failover_available", "Whether the endpoint of the failover storage middleware is available", "", "endpoint")
+	// failovers is the number of operations tried on an endpoint after the
+	// previous ones were unavailable.
+	failovers = prometheus.StorageNamespace.NewLabeledCounter("failover_failovers", "The number of operations which failed over to the next endpoint", "operation")
+)
+
+// endpoint is the storage driver or one of its replicas.
+type endpoint struct {
+	name      string
+	driver    storagedriver.StorageDriver
+	available atomic.Bool
+}
+
+func newEndpoint(name string, driver storagedriver.StorageDriver) *endpoint {
+	e := &endpoint{name: name, driver: driver}
+	e.available.Store(true)
+	endpointAvailable.WithValues(name).Set(1)
+	return e
+}
+
+// markUnavailable records that e failed with the availability error err.
+func (e *endpoint) markUnavailable(ctx context.Context, err error) {
+	if e.available.Swap(false) {
+		endpointAvailable.WithValues(e.name).Set(0)
+		dcontext.GetLogger(ctx).Errorf("failover: %s storage driver is unavailable: %v", e.name, err)
+	}
+}
+
+// markAvailable records that e answered a probe.
+func (e *endpoint) markAvailable(ctx context.Context) {
+	if !e.available.Swap(true) {
+		endpointAvailable.WithValues(e.name).Set(1)
+		dcontext.GetLogger(ctx).Infof("failover: %s storage driver is available again", e.name)
+	}
+}
+
+// probe checks whether e is available every interval, until ctx is done.
+func (e *endpoint) probe(ctx context.Context, interval, timeout time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			e.check(ctx, timeout)
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// check probes e once, by stating the root of the storage. A probe
+// interrupted by ctx being done does not change the availability of e.
+func (e *endpoint) check(ctx context.Context, timeout time.Duration) {
+	probeCtx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+
+	_, err := e.driver.Stat(probeCtx, "/")
+	if ctx.Err() != nil {
+		return
+	}
+	if err == nil || errors.As(err, new(storagedriver.PathNotFoundError)) {
+		e.markAvailable(ctx)
+		return
+	}
+	e.markUnavailable(ctx, err)
+}
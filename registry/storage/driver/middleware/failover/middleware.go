@@ -0,0 +1,318 @@
+// Package middleware - failover wrapper for storage drivers, serving reads
+// from replicas of the storage while it is unavailable.
+package middleware
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"time"
+
+	storagedriver "github.com/distribution/distribution/v3/registry/storage/driver"
+	storagemiddleware "github.com/distribution/distribution/v3/registry/storage/driver/middleware"
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	defaultProbeInterval = 10 * time.Second
+	defaultProbeTimeout  = 5 * time.Second
+)
+
+func init() {
+	if err := storagemiddleware.Register("failover", newFailoverStorageMiddleware); err != nil {
+		logrus.Errorf("failed to register failover storage middleware: %v", err)
+	}
+}
+
+// failoverStorageMiddleware serves reads from the first available of the
+// storage driver and its replicas, in order. An endpoint becomes unavailable
+// when it fails with a retryable error, such as a server error or a network
+// failure, and available again once it answers a probe. Other errors, such as
+// a missing path, are returned without failing over.
+//
+// Writes go to the storage driver, or with writefailover to the first
+// available endpoint.
+//
+// The endpoints are probed until the context the middleware is created with
+// is done, or the middleware is closed.
+type failoverStorageMiddleware struct {
+	storagedriver.StorageDriver
+	endpoints     []*endpoint
+	writeFailover bool
+	// cancel stops the probes of the endpoints.
+	cancel context.CancelFunc
+}
+
+var (
+	_ storagedriver.StorageDriver = &failoverStorageMiddleware{}
+	_ storagedriver.Closer        = &failoverStorageMiddleware{}
+)
+
+// newFailoverStorageMiddleware constructs and returns a new failover storage
+// middleware.
+//
+// Required options:
+//
+//   - replicas: the storage drivers the reads fail over to, in order, as a
+//     list of maps of the name of a driver to its parameters
+//
+// Optional options:
+//
+//   - probeinterval: the interval between probes of each endpoint, defaults
+//     to 10s
+//   - probetimeout: how long a probe may take, defaults to 5s
+//   - writefailover: whether writes go to the first available endpoint when
+//     the storage driver is unavailable, defaults to false
+func newFailoverStorageMiddleware(ctx context.Context, sd storagedriver.StorageDriver, options map[string]any) (storagedriver.StorageDriver, error) {
+	r, ok := options["replicas"]
+	if !ok {
+		return nil, fmt.Errorf("no replicas provided")
+	}
+	replicas, ok := r.([]any)
+	if !ok || len(replicas) == 0 {
+		return nil, fmt.Errorf("replicas must be a list of storage drivers, %v invalid", r)
+	}
+
+	endpoints := []*endpoint{newEndpoint("primary", sd)}
+	for i, replica := range replicas {
+		d, err := storagemiddleware.CreateDriver(ctx, replica)
+		if err != nil {
+			return nil, fmt.Errorf("unable to create replica %d storage driver: %v", i+1, err)
+		}
+		endpoints = append(endpoints, newEndpoint(fmt.Sprintf("replica%d", i+1), d))
+	}
+
+	probeInterval, err := durationOption(options, "probeinterval", defaultProbeInterval)
+	if err != nil {
+		return nil, err
+	}
+	probeTimeout, err := durationOption(options, "probetimeout", defaultProbeTimeout)
+	if err != nil {
+		return nil, err
+	}
+
+	writeFailover := false
+	switch v := options["writefailover"].(type) {
+	case nil:
+	case bool:
+		writeFailover = v
+	case string:
+		writeFailover, err = strconv.ParseBool(v)
+		if err != nil {
+			return nil, fmt.Errorf("writefailover must be a boolean, %v invalid", v)
+		}
+	default:
+		return nil, fmt.Errorf("writefailover must be a boolean, %v invalid", v)
+	}
+
+	probeCtx, cancel := context.WithCancel(ctx)
+	for _, e := range endpoints {
+		go e.probe(probeCtx, probeInterval, probeTimeout)
+	}
+	return &failoverStorageMiddleware{StorageDriver: sd, endpoints: endpoints, writeFailover: writeFailover, cancel: cancel}, nil
+}
+
+// Close stops the probes of the endpoints, and closes the replicas which
+// implement Closer. As the other storage middlewares, it does not close the
+// storage driver it wraps.
+func (m *failoverStorageMiddleware) Close() error {
+	m.cancel()
+	var errs []error
+	for _, e := range m.endpoints[1:] {
+		if c, ok := e.driver.(storagedriver.Closer); ok {
+			errs = append(errs, c.Close())
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// durationOption returns the positive duration option name, or defaultValue
+// if it is not set.
+func durationOption(options map[string]any, name string, defaultValue time.Duration) (time.Duration, error) {
+	d := defaultValue
+	switch v := options[name].(type) {
+	case nil:
+	case time.Duration:
+		d = v
+	case string:
+		var err error
+		d, err = time.ParseDuration(v)
+		if err != nil {
+			return 0, fmt.Errorf("%s must be a duration, %v invalid", name, v)
+		}
+	default:
+		return 0, fmt.Errorf("%s must be a duration, %v invalid", name, v)
+	}
+	if d <= 0 {
+		return 0, fmt.Errorf("%s must be positive, %v invalid", name, d)
+	}
+	return d, nil
+}
+
+// available returns the available endpoints in order, or all of them if none
+// is known to be available.
+func (m *failoverStorageMiddleware) available() []*endpoint {
+	var available []*endpoint
+	for _, e := range m.endpoints {
+		if e.available.Load() {
+			available = append(available, e)
+		}
+	}
+	if len(available) == 0 {
+		return m.endpoints
+	}
+	return available
+}
+
+// read calls fn on the available endpoints in order, until it does not fail
+// with an availability error.
+func (m *failoverStorageMiddleware) read(ctx context.Context, operation string, fn func(storagedriver.StorageDriver) error) error {
+	var err error
+	for i, e := range m.available() {
+		if i > 0 {
+			failovers.WithValues(operation).Inc(1)
+		}
+		err = fn(e.driver)
+		if !storagedriver.IsRetryable(err) {
+			return err
+		}
+		e.markUnavailable(ctx, err)
+	}
+	return err
+}
+
+// writeTarget returns the endpoint the writes go to.
+func (m *failoverStorageMiddleware) writeTarget() *endpoint {
+	if m.writeFailover {
+		return m.available()[0]
+	}
+	return m.endpoints[0]
+}
+
+// write calls fn on the endpoint the writes go to.
+func (m *failoverStorageMiddleware) write(ctx context.Context, fn func(storagedriver.StorageDriver) error) error {
+	e := m.writeTarget()
+	err := fn(e.driver)
+	if storagedriver.IsRetryable(err) {
+		e.markUnavailable(ctx, err)
+	}
+	return err
+}
+
+// GetContent retrieves the content stored at "path" as a []byte.
+func (m *failoverStorageMiddleware) GetContent(ctx context.Context, path string) ([]byte, error) {
+	var content []byte
+	err := m.read(ctx, "GetContent", func(d storagedriver.StorageDriver) error {
+		var err error
+		content, err = d.GetContent(ctx, path)
+		return err
+	})
+	return content, err
+}
+
+// Reader retrieves an io.ReadCloser for the content stored at "path" with a
+// given byte offset. Only opening the content fails over: an error while
+// reading it is returned to the reader.
+func (m *failoverStorageMiddleware) Reader(ctx context.Context, path string, offset int64) (io.ReadCloser, error) {
+	var rc io.ReadCloser
+	err := m.read(ctx, "Reader", func(d storagedriver.StorageDriver) error {
+		var err error
+		rc, err = d.Reader(ctx, path, offset)
+		return err
+	})
+	return rc, err
+}
+
+// Stat retrieves the FileInfo for the given path, including the current size
+// in bytes and the creation time.
+func (m *failoverStorageMiddleware) Stat(ctx context.Context, path string) (storagedriver.FileInfo, error) {
+	var fi storagedriver.FileInfo
+	err := m.read(ctx, "Stat", func(d storagedriver.StorageDriver) error {
+		var err error
+		fi, err = d.Stat(ctx, path)
+		return err
+	})
+	return fi, err
+}
+
+// List returns a list of the objects that are direct descendants of the given
+// path.
+func (m *failoverStorageMiddleware) List(ctx context.Context, path string) ([]string, error) {
+	var entries []string
+	err := m.read(ctx, "List", func(d storagedriver.StorageDriver) error {
+		var err error
+		entries, err = d.List(ctx, path)
+		return err
+	})
+	return entries, err
+}
+
+// Walk traverses a filesystem defined within driver, starting from the given
+// path, calling f on each file. A walk only fails over until f is first
+// called, so that f is not called twice on the same files.
+func (m *failoverStorageMiddleware) Walk(ctx context.Context, path string, f storagedriver.WalkFn, options ...func(*storagedriver.WalkOptions)) error {
+	var err error
+	for i, e := range m.available() {
+		if i > 0 {
+			failovers.WithValues("Walk").Inc(1)
+		}
+		walked := false
+		var walkErr error
+		err = e.driver.Walk(ctx, path, func(fi storagedriver.FileInfo) error {
+			walked = true
+			walkErr = f(fi)
+			return walkErr
+		}, options...)
+		if !storagedriver.IsRetryable(err) || err == walkErr {
+			return err
+		}
+		e.markUnavailable(ctx, err)
+		if walked {
+			return err
+		}
+	}
+	return err
+}
+
+// RedirectURL returns a URL which the client of the request r may use to
+// retrieve the content stored at path, from the endpoint serving the reads.
+func (m *failoverStorageMiddleware) RedirectURL(r *http.Request, path string) (string, error) {
+	return m.available()[0].driver.RedirectURL(r, path)
+}
+
+// PutContent stores the []byte content at a location designated by "path".
+func (m *failoverStorageMiddleware) PutContent(ctx context.Context, path string, content []byte) error {
+	return m.write(ctx, func(d storagedriver.StorageDriver) error {
+		return d.PutContent(ctx, path, content)
+	})
+}
+
+// Writer returns a FileWriter which will store the content written to it at
+// the location designated by "path" after the call to Commit.
+func (m *failoverStorageMiddleware) Writer(ctx context.Context, path string, append bool) (storagedriver.FileWriter, error) {
+	var fw storagedriver.FileWriter
+	err := m.write(ctx, func(d storagedriver.StorageDriver) error {
+		var err error
+		fw, err = d.Writer(ctx, path, append)
+		return err
+	})
+	return fw, err
+}
+
+// Move moves an object stored at sourcePath to destPath, removing the
+// original object.
+func (m *failoverStorageMiddleware) Move(ctx context.Context, sourcePath string, destPath string) error {
+	return m.write(ctx, func(d storagedriver.StorageDriver) error {
+		return d.Move(ctx, sourcePath, destPath)
+	})
+}
+
+// Delete recursively deletes all objects stored at "path" and its subpaths.
+func (m *failoverStorageMiddleware) Delete(ctx context.Context, path string) error {
+	return m.write(ctx, func(d storagedriver.StorageDriver) error {
+		return d.Delete(ctx, path)
+	})
+}
@@ -0,0 +1,329 @@
+package middleware
+
+import (
+	"context"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	storagedriver "github.com/distribution/distribution/v3/registry/storage/driver"
+	"github.com/distribution/distribution/v3/registry/storage/driver/inmemory"
+	s3 "github.com/distribution/distribution/v3/registry/storage/driver/s3-aws"
+	"github.com/stretchr/testify/require"
+)
+
+// fakeS3 stubs the S3 object and listing API for a single bucket, and fails
+// all the requests made while it is down.
+type fakeS3 struct {
+	mu       sync.Mutex
+	objects  map[string][]byte
+	down     atomic.Bool
+	requests atomic.Int32
+	url      string
+}
+
+type listBucketResult struct {
+	XMLName        xml.Name `xml:"ListBucketResult"`
+	Name           string
+	Prefix         string
+	KeyCount       int
+	IsTruncated    bool
+	Contents       []listObject
+	CommonPrefixes []commonPrefix
+}
+
+type listObject struct {
+	Key          string
+	Size         int
+	LastModified string
+}
+
+type commonPrefix struct {
+	Prefix string
+}
+
+func newFakeS3(t *testing.T) (*fakeS3, *httptest.Server) {
+	f := &fakeS3{objects: make(map[string][]byte)}
+	server := httptest.NewServer(f)
+	t.Cleanup(server.Close)
+	f.url = server.URL
+	return f, server
+}
+
+func (f *fakeS3) put(key, content string) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.objects[key] = []byte(content)
+}
+
+func (f *fakeS3) get(key string) (string, bool) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	content, ok := f.objects[key]
+	return string(content), ok
+}
+
+func (f *fakeS3) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	f.requests.Add(1)
+	if f.down.Load() {
+		writeError(w, http.StatusInternalServerError, "InternalError")
+		return
+	}
+
+	key := strings.TrimPrefix(strings.TrimPrefix(r.URL.Path, "/bucket"), "/")
+	switch {
+	case r.Method == http.MethodGet && r.URL.Query().Get("list-type") == "2":
+		f.list(w, r.URL.Query().Get("prefix"), r.URL.Query().Get("delimiter"))
+	case r.Method == http.MethodGet || r.Method == http.MethodHead:
+		content, ok := f.get(key)
+		if !ok {
+			writeError(w, http.StatusNotFound, "NoSuchKey")
+			return
+		}
+		w.Header().Set("Content-Length", strconv.Itoa(len(content)))
+		w.Header().Set("Last-Modified", time.Now().UTC().Format(http.TimeFormat))
+		if r.Method == http.MethodGet {
+			_, _ = io.WriteString(w, content)
+		}
+	case r.Method == http.MethodPut:
+		content, err := io.ReadAll(r.Body)
+		if err != nil {
+			writeError(w, http.StatusInternalServerError, "InternalError")
+			return
+		}
+		f.put(key, string(content))
+		w.Header().Set("ETag", `"etag"`)
+	default:
+		writeError(w, http.StatusNotImplemented, "NotImplemented")
+	}
+}
+
+func (f *fakeS3) list(w http.ResponseWriter, prefix, delimiter string) {
+	f.mu.Lock()
+	keys := make([]string, 0, len(f.objects))
+	sizes := make(map[string]int)
+	for key, content := range f.objects {
+		keys = append(keys, key)
+		sizes[key] = len(content)
+	}
+	f.mu.Unlock()
+	sort.Strings(keys)
+
+	result := listBucketResult{Name: "bucket", Prefix: prefix}
+	seen := make(map[string]bool)
+	for _, key := range keys {
+		if !strings.HasPrefix(key, prefix) {
+			continue
+		}
+		if delimiter != "" {
+			if i := strings.Index(key[len(prefix):], delimiter); i >= 0 {
+				p := key[:len(prefix)+i+1]
+				if !seen[p] {
+					seen[p] = true
+					result.CommonPrefixes = append(result.CommonPrefixes, commonPrefix{Prefix: p})
+				}
+				continue
+			}
+		}
+		result.Contents = append(result.Contents, listObject{Key: key, Size: sizes[key], LastModified: time.Now().UTC().Format(time.RFC3339)})
+	}
+	result.KeyCount = len(result.Contents) + len(result.CommonPrefixes)
+	w.Header().Set("Content-Type", "application/xml")
+	_ = xml.NewEncoder(w).Encode(result)
+}
+
+func writeError(w http.ResponseWriter, status int, code string) {
+	w.Header().Set("Content-Type", "application/xml")
+	w.WriteHeader(status)
+	_, _ = fmt.Fprintf(w, "<Error><Code>%s</Code><Message>%s</Message></Error>", code, code)
+}
+
+func s3Parameters(server *httptest.Server) map[any]any {
+	return map[any]any{
+		"accesskey":      "accesskey",
+		"secretkey":      "secretkey",
+		"region":         "us-east-1",
+		"regionendpoint": server.URL,
+		"bucket":         "bucket",
+		"forcepathstyle": true,
+		"secure":         false,
+	}
+}
+
+// newMiddleware returns a failover middleware over two stubbed S3 backends.
+func newMiddleware(t *testing.T, options map[string]any) (m *failoverStorageMiddleware, primary, replica *fakeS3) {
+	// Creating a session with a CA bundle modifies the default HTTP client,
+	// which the probes of the previous tests may be using.
+	t.Setenv("AWS_CA_BUNDLE", "")
+	primary, primaryServer := newFakeS3(t)
+	replica, replicaServer := newFakeS3(t)
+
+	params := make(map[string]any)
+	for k, v := range s3Parameters(primaryServer) {
+		params[k.(string)] = v
+	}
+	sd, err := s3.FromParameters(context.Background(), params)
+	require.NoError(t, err)
+
+	options["replicas"] = []any{map[any]any{"s3": s3Parameters(replicaServer)}}
+	if _, ok := options["probeinterval"]; !ok {
+		options["probeinterval"] = "10ms"
+	}
+	fd, err := newFailoverStorageMiddleware(context.Background(), sd, options)
+	require.NoError(t, err)
+	m = fd.(*failoverStorageMiddleware)
+	t.Cleanup(func() { require.NoError(t, m.Close()) })
+	return m, primary, replica
+}
+
+func TestOptions(t *testing.T) {
+	for _, tc := range []struct {
+		name    string
+		options map[string]any
+		wantErr string
+	}{
+		{name: "missing replicas", options: map[string]any{}, wantErr: "no replicas provided"},
+		{name: "replicas not a list", options: map[string]any{"replicas": map[any]any{"inmemory": nil}}, wantErr: "replicas must be a list of storage drivers, map[inmemory:<nil>] invalid"},
+		{name: "unknown replica", options: map[string]any{"replicas": []any{map[any]any{"nonexistent": nil}}}, wantErr: "unable to create replica 1 storage driver: StorageDriver not registered: nonexistent"},
+		{name: "probeinterval invalid", options: map[string]any{"replicas": []any{map[any]any{"inmemory": nil}}, "probeinterval": "often"}, wantErr: "probeinterval must be a duration, often invalid"},
+		{name: "probetimeout negative", options: map[string]any{"replicas": []any{map[any]any{"inmemory": nil}}, "probetimeout": "-1s"}, wantErr: "probetimeout must be positive, -1s invalid"},
+		{name: "writefailover invalid", options: map[string]any{"replicas": []any{map[any]any{"inmemory": nil}}, "writefailover": "maybe"}, wantErr: "writefailover must be a boolean, maybe invalid"},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			_, err := newFailoverStorageMiddleware(context.Background(), inmemory.New(), tc.options)
+			require.EqualError(t, err, tc.wantErr)
+		})
+	}
+}
+
+// TestFailoverAndFailback checks that reads fail over to the replica while
+// the primary is unavailable, and come back to the primary once it is
+// available again.
+func TestFailoverAndFailback(t *testing.T) {
+	m, primary, replica := newMiddleware(t, map[string]any{})
+	ctx := context.Background()
+	primary.put("endpoint", "primary")
+	replica.put("endpoint", "replica")
+
+	content, err := m.GetContent(ctx, "/endpoint")
+	require.NoError(t, err)
+	require.Equal(t, "primary", string(content))
+
+	primary.down.Store(true)
+	content, err = m.GetContent(ctx, "/endpoint")
+	require.NoError(t, err)
+	require.Equal(t, "replica", string(content))
+	require.False(t, m.endpoints[0].available.Load())
+
+	// Redirects come from the replica while it serves the reads.
+	fi, err := m.Stat(ctx, "/endpoint")
+	require.NoError(t, err)
+	require.Equal(t, int64(len("replica")), fi.Size())
+	redirectURL, err := m.RedirectURL(httptest.NewRequest(http.MethodGet, "/v2/", nil), "/endpoint")
+	require.NoError(t, err)
+	require.True(t, strings.HasPrefix(redirectURL, replica.url), redirectURL)
+
+	// Writes still go to the primary, and fail.
+	require.Error(t, m.PutContent(ctx, "/new", []byte("new")))
+	_, ok := replica.get("new")
+	require.False(t, ok)
+
+	primary.down.Store(false)
+	require.Eventually(t, func() bool {
+		content, err := m.GetContent(ctx, "/endpoint")
+		return err == nil && string(content) == "primary"
+	}, 10*time.Second, 10*time.Millisecond)
+	require.True(t, m.endpoints[0].available.Load())
+}
+
+// TestNotFoundDoesNotFailOver checks that a path missing from the primary is
+// not read from the replica.
+func TestNotFoundDoesNotFailOver(t *testing.T) {
+	m, _, replica := newMiddleware(t, map[string]any{"probeinterval": "1h"})
+	ctx := context.Background()
+	replica.put("replicated", "content")
+
+	_, err := m.GetContent(ctx, "/replicated")
+	require.ErrorAs(t, err, new(storagedriver.PathNotFoundError))
+	require.Zero(t, replica.requests.Load())
+	require.True(t, m.endpoints[0].available.Load())
+}
+
+// TestUnavailableEverywhere checks that the error of the last endpoint is
+// returned when none is available.
+func TestUnavailableEverywhere(t *testing.T) {
+	m, primary, replica := newMiddleware(t, map[string]any{"probeinterval": "1h"})
+	primary.down.Store(true)
+	replica.down.Store(true)
+
+	_, err := m.GetContent(context.Background(), "/endpoint")
+	require.True(t, storagedriver.IsRetryable(err))
+	var retryable storagedriver.RetryableError
+	require.True(t, errors.As(err, &retryable))
+}
+
+func TestWriteFailover(t *testing.T) {
+	m, primary, replica := newMiddleware(t, map[string]any{"writefailover": true, "probeinterval": "1h"})
+	ctx := context.Background()
+
+	primary.down.Store(true)
+	// The primary is only known to be unavailable once an operation failed
+	// on it.
+	require.Error(t, m.PutContent(ctx, "/first", []byte("first")))
+	require.NoError(t, m.PutContent(ctx, "/second", []byte("second")))
+	content, ok := replica.get("second")
+	require.True(t, ok)
+	require.Equal(t, "second", content)
+}
+
+// TestCloseStopsProbes checks that the endpoints are no longer probed once
+// the middleware is closed, or the context it was created with is done.
+func TestCloseStopsProbes(t *testing.T) {
+	m, primary, replica := newMiddleware(t, map[string]any{})
+	require.Eventually(t, func() bool {
+		return primary.requests.Load() > 0 && replica.requests.Load() > 0
+	}, 10*time.Second, 10*time.Millisecond)
+
+	require.NoError(t, m.Close())
+	// A probe may be in progress while closing.
+	time.Sleep(50 * time.Millisecond)
+	probes := primary.requests.Load() + replica.requests.Load()
+	time.Sleep(100 * time.Millisecond)
+	require.Equal(t, probes, primary.requests.Load()+replica.requests.Load())
+
+	ctx, cancel := context.WithCancel(context.Background())
+	counting := &countingDriver{StorageDriver: inmemory.New()}
+	fd, err := newFailoverStorageMiddleware(ctx, counting, map[string]any{
+		"replicas":      []any{map[any]any{"inmemory": nil}},
+		"probeinterval": "10ms",
+	})
+	require.NoError(t, err)
+	require.Eventually(t, func() bool { return counting.stats.Load() > 0 }, 10*time.Second, 10*time.Millisecond)
+	cancel()
+	time.Sleep(50 * time.Millisecond)
+	stats := counting.stats.Load()
+	time.Sleep(100 * time.Millisecond)
+	require.Equal(t, stats, counting.stats.Load())
+	require.NoError(t, fd.(*failoverStorageMiddleware).Close())
+}
+
+// countingDriver counts the Stat calls of the storage driver.
+type countingDriver struct {
+	storagedriver.StorageDriver
+	stats atomic.Int32
+}
+
+func (d *countingDriver) Stat(ctx context.Context, path string) (storagedriver.FileInfo, error) {
+	d.stats.Add(1)
+	return d.StorageDriver.Stat(ctx, path)
+}
@@ -0,0 +1,199 @@
+// Package middleware - fallbackread wrapper for storage drivers, reading the
+// content missing from the storage driver from a secondary storage driver.
+package middleware
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"slices"
+	"strconv"
+
+	"github.com/distribution/distribution/v3/internal/dcontext"
+	prometheus "github.com/distribution/distribution/v3/metrics"
+	storagedriver "github.com/distribution/distribution/v3/registry/storage/driver"
+	storagemiddleware "github.com/distribution/distribution/v3/registry/storage/driver/middleware"
+	"github.com/sirupsen/logrus"
+	"golang.org/x/sync/singleflight"
+)
+
+var (
+	// fallbackReads is the number of reads served by the secondary.
+	fallbackReads = prometheus.StorageNamespace.NewCounter("fallbackread_hits", "The number of reads served by the secondary storage driver")
+	// copiedForward is the number of files copied from the secondary.
+	copiedForward = prometheus.StorageNamespace.NewCounter("fallbackread_copies", "The number of files copied from the secondary storage driver")
+)
+
+func init() {
+	if err := storagemiddleware.Register("fallbackread", newFallbackReadStorageMiddleware); err != nil {
+		logrus.Errorf("failed to register fallbackread storage middleware: %v", err)
+	}
+}
+
+// fallbackReadStorageMiddleware reads the files missing from the storage
+// driver from a secondary storage driver, optionally copying them to the
+// storage driver as they are read. Listings merge the entries of both, and
+// writes only go to the storage driver.
+type fallbackReadStorageMiddleware struct {
+	storagedriver.StorageDriver
+	secondary   storagedriver.StorageDriver
+	copyForward bool
+	copies      singleflight.Group
+}
+
+var _ storagedriver.StorageDriver = &fallbackReadStorageMiddleware{}
+
+// newFallbackReadStorageMiddleware constructs and returns a new fallbackread
+// storage middleware.
+//
+// Required options:
+//
+//   - secondary: the storage driver the missing files are read from, as a
+//     map of the name of the driver to its parameters
+//
+// Optional options:
+//
+//   - copyforward: whether to copy the files read from the secondary to the
+//     storage driver, defaults to false
+func newFallbackReadStorageMiddleware(ctx context.Context, sd storagedriver.StorageDriver, options map[string]any) (storagedriver.StorageDriver, error) {
+	s, ok := options["secondary"]
+	if !ok {
+		return nil, fmt.Errorf("no secondary provided")
+	}
+	secondary, err := storagemiddleware.CreateDriver(ctx, s)
+	if err != nil {
+		return nil, fmt.Errorf("unable to create secondary storage driver: %v", err)
+	}
+
+	copyForward := false
+	switch v := options["copyforward"].(type) {
+	case nil:
+	case bool:
+		copyForward = v
+	case string:
+		copyForward, err = strconv.ParseBool(v)
+		if err != nil {
+			return nil, fmt.Errorf("copyforward must be a boolean, %v invalid", v)
+		}
+	default:
+		return nil, fmt.Errorf("copyforward must be a boolean, %v invalid", v)
+	}
+
+	return &fallbackReadStorageMiddleware{StorageDriver: sd, secondary: secondary, copyForward: copyForward}, nil
+}
+
+func isNotFound(err error) bool {
+	return errors.As(err, new(storagedriver.PathNotFoundError))
+}
+
+// GetContent retrieves the content stored at "path" as a []byte.
+func (m *fallbackReadStorageMiddleware) GetContent(ctx context.Context, path string) ([]byte, error) {
+	content, err := m.StorageDriver.GetContent(ctx, path)
+	if !isNotFound(err) {
+		return content, err
+	}
+	if m.copyForward && m.copy(ctx, path) {
+		return m.StorageDriver.GetContent(ctx, path)
+	}
+	content, err = m.secondary.GetContent(ctx, path)
+	if err == nil {
+		fallbackReads.Inc(1)
+	}
+	return content, err
+}
+
+// Reader retrieves an io.ReadCloser for the content stored at "path" with a
+// given byte offset.
+func (m *fallbackReadStorageMiddleware) Reader(ctx context.Context, path string, offset int64) (io.ReadCloser, error) {
+	rc, err := m.StorageDriver.Reader(ctx, path, offset)
+	if !isNotFound(err) {
+		return rc, err
+	}
+	if m.copyForward && m.copy(ctx, path) {
+		return m.StorageDriver.Reader(ctx, path, offset)
+	}
+	rc, err = m.secondary.Reader(ctx, path, offset)
+	if err == nil {
+		fallbackReads.Inc(1)
+	}
+	return rc, err
+}
+
+// Stat retrieves the FileInfo for the given path, from the secondary if it is
+// not found on the storage driver. Stat does not copy files forward.
+func (m *fallbackReadStorageMiddleware) Stat(ctx context.Context, path string) (storagedriver.FileInfo, error) {
+	fi, err := m.StorageDriver.Stat(ctx, path)
+	if !isNotFound(err) {
+		return fi, err
+	}
+	return m.secondary.Stat(ctx, path)
+}
+
+// List returns the objects that are direct descendants of the given path on
+// either the storage driver or the secondary.
+func (m *fallbackReadStorageMiddleware) List(ctx context.Context, path string) ([]string, error) {
+	entries, err := m.StorageDriver.List(ctx, path)
+	if err != nil && !isNotFound(err) {
+		return nil, err
+	}
+	primaryErr := err
+	secondaryEntries, err := m.secondary.List(ctx, path)
+	if isNotFound(err) {
+		return entries, primaryErr
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	entries = append(entries, secondaryEntries...)
+	slices.Sort(entries)
+	return slices.Compact(entries), nil
+}
+
+// Walk traverses the merged listings of the storage driver and the secondary,
+// starting from the given path, calling f on each file.
+func (m *fallbackReadStorageMiddleware) Walk(ctx context.Context, path string, f storagedriver.WalkFn, options ...func(*storagedriver.WalkOptions)) error {
+	return storagedriver.WalkFallback(ctx, m, path, f, options...)
+}
+
+// copy copies the file stored at path from the secondary to the storage
+// driver, once for all the concurrent reads of path, and reports whether the
+// file is now on the storage driver.
+func (m *fallbackReadStorageMiddleware) copy(ctx context.Context, path string) bool {
+	_, err, _ := m.copies.Do(path, func() (any, error) {
+		// The copy is shared by the reads of path, and must not be
+		// interrupted when the read which started it is cancelled.
+		return nil, m.copyFile(context.WithoutCancel(ctx), path)
+	})
+	if err != nil && !isNotFound(err) {
+		dcontext.GetLoggerWithField(ctx, "path", path).Errorf("fallbackread: unable to copy from the secondary storage driver: %v", err)
+	}
+	return err == nil
+}
+
+func (m *fallbackReadStorageMiddleware) copyFile(ctx context.Context, path string) error {
+	rc, err := m.secondary.Reader(ctx, path, 0)
+	if err != nil {
+		return err
+	}
+	defer rc.Close()
+
+	fw, err := m.StorageDriver.Writer(ctx, path, false)
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(fw, rc); err != nil {
+		fw.Cancel(ctx)
+		return err
+	}
+	if err := fw.Commit(ctx); err != nil {
+		fw.Cancel(ctx)
+		return err
+	}
+	if err := fw.Close(); err != nil {
+		return err
+	}
+	copiedForward.Inc(1)
+	return nil
+}
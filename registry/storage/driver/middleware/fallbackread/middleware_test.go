@@ -0,0 +1,196 @@
+package middleware
+
+import (
+	"context"
+	"io"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	storagedriver "github.com/distribution/distribution/v3/registry/storage/driver"
+	"github.com/distribution/distribution/v3/registry/storage/driver/inmemory"
+	"github.com/stretchr/testify/require"
+)
+
+// countingDriver counts the reads made on it, and holds the readers opened
+// until released when release is set.
+type countingDriver struct {
+	storagedriver.StorageDriver
+	gets    atomic.Int32
+	readers atomic.Int32
+	release chan struct{}
+}
+
+func (d *countingDriver) GetContent(ctx context.Context, path string) ([]byte, error) {
+	d.gets.Add(1)
+	return d.StorageDriver.GetContent(ctx, path)
+}
+
+func (d *countingDriver) Reader(ctx context.Context, path string, offset int64) (io.ReadCloser, error) {
+	d.readers.Add(1)
+	if d.release != nil {
+		<-d.release
+	}
+	return d.StorageDriver.Reader(ctx, path, offset)
+}
+
+func newMiddleware(t *testing.T, copyForward bool) (m *fallbackReadStorageMiddleware, primary, secondary *countingDriver) {
+	primary = &countingDriver{StorageDriver: inmemory.New()}
+	sd, err := newFallbackReadStorageMiddleware(context.Background(), primary, map[string]any{
+		"secondary":   map[any]any{"inmemory": nil},
+		"copyforward": copyForward,
+	})
+	require.NoError(t, err)
+	m = sd.(*fallbackReadStorageMiddleware)
+	secondary = &countingDriver{StorageDriver: m.secondary}
+	m.secondary = secondary
+	return m, primary, secondary
+}
+
+func TestOptions(t *testing.T) {
+	for _, tc := range []struct {
+		name    string
+		options map[string]any
+		wantErr string
+	}{
+		{name: "missing secondary", options: map[string]any{}, wantErr: "no secondary provided"},
+		{name: "invalid secondary", options: map[string]any{"secondary": "inmemory"}, wantErr: "unable to create secondary storage driver: storage driver must be a map of a driver name to its parameters, inmemory invalid"},
+		{name: "copyforward invalid", options: map[string]any{"secondary": map[any]any{"inmemory": nil}, "copyforward": "sometimes"}, wantErr: "copyforward must be a boolean, sometimes invalid"},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			_, err := newFallbackReadStorageMiddleware(context.Background(), inmemory.New(), tc.options)
+			require.EqualError(t, err, tc.wantErr)
+		})
+	}
+}
+
+// TestMissThenHit checks that files missing from the storage driver are read
+// from the secondary, and that files on the storage driver take precedence.
+func TestMissThenHit(t *testing.T) {
+	m, primary, secondary := newMiddleware(t, false)
+	ctx := context.Background()
+	require.NoError(t, secondary.PutContent(ctx, "/old", []byte("old")))
+	require.NoError(t, secondary.PutContent(ctx, "/both", []byte("secondary")))
+	require.NoError(t, m.PutContent(ctx, "/both", []byte("primary")))
+
+	content, err := m.GetContent(ctx, "/old")
+	require.NoError(t, err)
+	require.Equal(t, []byte("old"), content)
+	rc, err := m.Reader(ctx, "/old", 1)
+	require.NoError(t, err)
+	content, err = io.ReadAll(rc)
+	rc.Close()
+	require.NoError(t, err)
+	require.Equal(t, []byte("ld"), content)
+	fi, err := m.Stat(ctx, "/old")
+	require.NoError(t, err)
+	require.Equal(t, int64(3), fi.Size())
+
+	content, err = m.GetContent(ctx, "/both")
+	require.NoError(t, err)
+	require.Equal(t, []byte("primary"), content)
+
+	// Without copyforward, the storage driver is left unchanged.
+	_, err = primary.Stat(ctx, "/old")
+	require.ErrorAs(t, err, new(storagedriver.PathNotFoundError))
+
+	_, err = m.GetContent(ctx, "/missing")
+	require.ErrorAs(t, err, new(storagedriver.PathNotFoundError))
+}
+
+func TestWritesOnlyToPrimary(t *testing.T) {
+	m, primary, secondary := newMiddleware(t, false)
+	ctx := context.Background()
+
+	require.NoError(t, m.PutContent(ctx, "/new", []byte("new")))
+	_, err := primary.Stat(ctx, "/new")
+	require.NoError(t, err)
+	_, err = secondary.Stat(ctx, "/new")
+	require.ErrorAs(t, err, new(storagedriver.PathNotFoundError))
+}
+
+// TestCopyForward checks that a file read from the secondary is copied to
+// the storage driver once, even when it is read concurrently.
+func TestCopyForward(t *testing.T) {
+	m, primary, secondary := newMiddleware(t, true)
+	ctx := context.Background()
+	require.NoError(t, secondary.PutContent(ctx, "/blob", []byte("content")))
+
+	secondary.release = make(chan struct{})
+	var wg sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			content, err := m.GetContent(ctx, "/blob")
+			if err != nil {
+				t.Error(err)
+				return
+			}
+			if string(content) != "content" {
+				t.Errorf("content = %q", content)
+			}
+		}()
+	}
+	// Let all the reads miss the storage driver and wait for the copy
+	// before it completes.
+	for primary.gets.Load() < 8 {
+		time.Sleep(time.Millisecond)
+	}
+	time.Sleep(50 * time.Millisecond)
+	close(secondary.release)
+	wg.Wait()
+
+	content, err := primary.GetContent(ctx, "/blob")
+	require.NoError(t, err)
+	require.Equal(t, []byte("content"), content)
+	require.Equal(t, int32(1), secondary.readers.Load())
+
+	// Later reads are served by the storage driver.
+	_, err = m.GetContent(ctx, "/blob")
+	require.NoError(t, err)
+	require.Equal(t, int32(1), secondary.readers.Load())
+}
+
+// TestMergedListings checks that listings and walks include the entries of
+// both storage drivers once.
+func TestMergedListings(t *testing.T) {
+	m, _, secondary := newMiddleware(t, false)
+	ctx := context.Background()
+	for _, path := range []string{"/repos/a/link", "/repos/b/link", "/repos/shared/link"} {
+		require.NoError(t, m.PutContent(ctx, path, []byte("primary")))
+	}
+	for _, path := range []string{"/repos/c/link", "/repos/shared/link", "/repos/shared/old"} {
+		require.NoError(t, secondary.PutContent(ctx, path, []byte("secondary")))
+	}
+	require.NoError(t, secondary.PutContent(ctx, "/archive/link", []byte("secondary")))
+
+	entries, err := m.List(ctx, "/repos")
+	require.NoError(t, err)
+	require.Equal(t, []string{"/repos/a", "/repos/b", "/repos/c", "/repos/shared"}, entries)
+
+	entries, err = m.List(ctx, "/archive")
+	require.NoError(t, err)
+	require.Equal(t, []string{"/archive/link"}, entries)
+
+	_, err = m.List(ctx, "/missing")
+	require.ErrorAs(t, err, new(storagedriver.PathNotFoundError))
+
+	files := make(map[string]int64)
+	err = m.Walk(ctx, "/", func(fi storagedriver.FileInfo) error {
+		if !fi.IsDir() {
+			files[fi.Path()] = fi.Size()
+		}
+		return nil
+	})
+	require.NoError(t, err)
+	require.Equal(t, map[string]int64{
+		"/archive/link":      int64(len("secondary")),
+		"/repos/a/link":      int64(len("primary")),
+		"/repos/b/link":      int64(len("primary")),
+		"/repos/c/link":      int64(len("secondary")),
+		"/repos/shared/link": int64(len("primary")),
+		"/repos/shared/old":  int64(len("secondary")),
+	}, files)
+}
@@ -0,0 +1,370 @@
+// Package middleware - Google Cloud CDN wrapper for storage libs
+// N.B. currently only works with GCS, not arbitrary sites
+package middleware
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha1"
+	"encoding/base64"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"cloud.google.com/go/storage"
+	"github.com/distribution/distribution/v3/internal/dcontext"
+	"github.com/distribution/distribution/v3/internal/requestutil"
+	storagedriver "github.com/distribution/distribution/v3/registry/storage/driver"
+	storagemiddleware "github.com/distribution/distribution/v3/registry/storage/driver/middleware"
+	"github.com/sirupsen/logrus"
+	"golang.org/x/oauth2/google"
+)
+
+// init registers the gcloudcdn storage middleware.
+func init() {
+	if err := storagemiddleware.Register("gcloudcdn", newGCloudCDNStorageMiddleware); err != nil {
+		logrus.Errorf("failed to register gcloudcdn middleware: %v", err)
+	}
+}
+
+// blobsPathPrefix is the prefix of the paths of the blobs in the storage.
+const blobsPathPrefix = "/docker/registry/v2/blobs/"
+
+// GCSObjectKeyer is any type that is capable of returning the name of the
+// object of the GCS bucket which should be cached by Cloud CDN.
+type GCSObjectKeyer interface {
+	GCSObjectKey(path string) string
+}
+
+// gcloudCDNStorageMiddleware redirects the reads of the blobs to temporary
+// signed URLs of the Cloud CDN in front of the GCS bucket, signed either
+// with a Cloud CDN signing key or, in the gcs signing mode, as V4 GCS signed
+// URLs of the hostname of the CDN.
+type gcloudCDNStorageMiddleware struct {
+	storagedriver.StorageDriver
+	baseURL  *url.URL
+	duration time.Duration
+
+	// keyName and key sign the URLs in the cdn signing mode.
+	keyName string
+	key     []byte
+
+	// bucket, email and privateKey sign the URLs in the gcs signing mode.
+	bucket     string
+	email      string
+	privateKey []byte
+
+	bypassIPRanges []*net.IPNet
+	bypassPaths    []string
+}
+
+var _ storagedriver.StorageDriver = &gcloudCDNStorageMiddleware{}
+
+// newGCloudCDNStorageMiddleware constructs and returns a new Cloud CDN
+// storage middleware.
+//
+// Required options:
+//
+//   - baseurl
+//   - keyname and key or keyfile, in the cdn signing mode
+//   - bucket and credentials, in the gcs signing mode
+//
+// Optional options:
+//
+//   - signingmode: valid value "cdn|gcs". "cdn", sign the URLs with a Cloud
+//     CDN signing key, default value. "gcs", sign V4 GCS signed URLs with a
+//     service account, for a CDN whose origin checks them.
+//   - keyname: the name of the Cloud CDN signing key.
+//   - key: the Cloud CDN signing key, base64url encoded as by gcloud.
+//   - keyfile: a file holding the key, instead of key.
+//   - bucket: the name of the GCS bucket.
+//   - credentials: the JSON key file of the service account signing the GCS
+//     signed URLs.
+//   - duration: how long the signed URLs are valid, 20m by default.
+//   - bypassipranges: the CIDR ranges of the clients served without the CDN,
+//     such as the traffic within the cluster.
+//   - bypasspaths: the prefixes of the paths of the requests served without
+//     the CDN, such as /v2/internal/.
+func newGCloudCDNStorageMiddleware(ctx context.Context, storageDriver storagedriver.StorageDriver, options map[string]any) (storagedriver.StorageDriver, error) {
+	// parse baseurl
+	base, ok := options["baseurl"]
+	if !ok {
+		return nil, fmt.Errorf("no baseurl provided")
+	}
+	baseURL, ok := base.(string)
+	if !ok {
+		return nil, fmt.Errorf("baseurl must be a string")
+	}
+	if !strings.Contains(baseURL, "://") {
+		baseURL = "https://" + baseURL
+	}
+	u, err := url.Parse(strings.TrimSuffix(baseURL, "/"))
+	if err != nil {
+		return nil, fmt.Errorf("invalid baseurl: %v", err)
+	}
+	if u.Host == "" {
+		return nil, fmt.Errorf("no host specified for baseurl")
+	}
+
+	m := &gcloudCDNStorageMiddleware{
+		StorageDriver: storageDriver,
+		baseURL:       u,
+		duration:      20 * time.Minute,
+	}
+
+	// parse duration
+	if d, ok := options["duration"]; ok {
+		switch d := d.(type) {
+		case time.Duration:
+			m.duration = d
+		case string:
+			dur, err := time.ParseDuration(d)
+			if err != nil {
+				return nil, fmt.Errorf("invalid duration: %s", err)
+			}
+			m.duration = dur
+		default:
+			return nil, fmt.Errorf("duration must be a duration")
+		}
+	}
+	if m.duration <= 0 {
+		return nil, fmt.Errorf("duration must be positive, %v invalid", m.duration)
+	}
+
+	// parse signingmode
+	signingMode := "cdn"
+	if s, ok := options["signingmode"]; ok {
+		if signingMode, ok = s.(string); !ok {
+			return nil, fmt.Errorf("signingmode must be a string")
+		}
+	}
+	switch strings.ToLower(strings.TrimSpace(signingMode)) {
+	case "", "cdn":
+		if err := m.parseCDNKey(options); err != nil {
+			return nil, err
+		}
+	case "gcs":
+		if err := m.parseGCSCredentials(options); err != nil {
+			return nil, err
+		}
+	default:
+		return nil, fmt.Errorf("signingmode only allows a string with the following value: cdn|gcs")
+	}
+
+	// parse bypassipranges
+	ranges, err := stringList(options, "bypassipranges")
+	if err != nil {
+		return nil, err
+	}
+	for _, r := range ranges {
+		_, ipNet, err := net.ParseCIDR(r)
+		if err != nil {
+			return nil, fmt.Errorf("invalid bypassipranges: %v", err)
+		}
+		m.bypassIPRanges = append(m.bypassIPRanges, ipNet)
+	}
+
+	// parse bypasspaths
+	if m.bypassPaths, err = stringList(options, "bypasspaths"); err != nil {
+		return nil, err
+	}
+	for _, p := range m.bypassPaths {
+		if !strings.HasPrefix(p, "/") {
+			return nil, fmt.Errorf("bypasspaths must be absolute paths, %q invalid", p)
+		}
+	}
+
+	return m, nil
+}
+
+// parseCDNKey parses the name and the value of the Cloud CDN signing key.
+func (m *gcloudCDNStorageMiddleware) parseCDNKey(options map[string]any) error {
+	kn, ok := options["keyname"]
+	if !ok {
+		return fmt.Errorf("no keyname provided")
+	}
+	if m.keyName, ok = kn.(string); !ok || m.keyName == "" {
+		return fmt.Errorf("keyname must be a non-empty string")
+	}
+
+	var encoded string
+	if k, ok := options["key"]; ok {
+		if encoded, ok = k.(string); !ok {
+			return fmt.Errorf("key must be a string")
+		}
+	} else if kf, ok := options["keyfile"]; ok {
+		keyFile, ok := kf.(string)
+		if !ok {
+			return fmt.Errorf("keyfile must be a string")
+		}
+		content, err := os.ReadFile(keyFile)
+		if err != nil {
+			return fmt.Errorf("failed to read keyfile: %s", err)
+		}
+		encoded = string(content)
+	} else {
+		return fmt.Errorf("no key or keyfile provided")
+	}
+	key, err := base64.URLEncoding.DecodeString(strings.TrimSpace(encoded))
+	if err != nil {
+		return fmt.Errorf("key must be base64url encoded: %v", err)
+	}
+	if len(key) == 0 {
+		return fmt.Errorf("key must not be empty")
+	}
+	m.key = key
+	return nil
+}
+
+// parseGCSCredentials parses the bucket and the service account signing the
+// GCS signed URLs.
+func (m *gcloudCDNStorageMiddleware) parseGCSCredentials(options map[string]any) error {
+	b, ok := options["bucket"]
+	if !ok {
+		return fmt.Errorf("no bucket provided")
+	}
+	if m.bucket, ok = b.(string); !ok || m.bucket == "" {
+		return fmt.Errorf("bucket must be a non-empty string")
+	}
+
+	c, ok := options["credentials"]
+	if !ok {
+		return fmt.Errorf("no credentials provided")
+	}
+	credentialsFile, ok := c.(string)
+	if !ok {
+		return fmt.Errorf("credentials must be a string")
+	}
+	content, err := os.ReadFile(credentialsFile)
+	if err != nil {
+		return fmt.Errorf("failed to read credentials file: %s", err)
+	}
+	jwtConfig, err := google.JWTConfigFromJSON(content)
+	if err != nil {
+		return fmt.Errorf("invalid credentials: %v", err)
+	}
+	m.email = jwtConfig.Email
+	m.privateKey = jwtConfig.PrivateKey
+	return nil
+}
+
+// stringList returns the strings of the option key, a list or a comma
+// separated string.
+func stringList(options map[string]any, key string) ([]string, error) {
+	var values []string
+	switch v := options[key].(type) {
+	case nil:
+	case string:
+		for value := range strings.SplitSeq(v, ",") {
+			if value = strings.TrimSpace(value); value != "" {
+				values = append(values, value)
+			}
+		}
+	case []string:
+		values = v
+	case []any:
+		for _, value := range v {
+			s, ok := value.(string)
+			if !ok {
+				return nil, fmt.Errorf("%s must be a list of strings", key)
+			}
+			values = append(values, s)
+		}
+	default:
+		return nil, fmt.Errorf("%s must be a list of strings", key)
+	}
+	return values, nil
+}
+
+// RedirectURL returns a signed URL of the CDN for the blobs, unless the
+// request bypasses the CDN, and the URL of the storage driver for the other
+// paths. The blob is served by the registry if its URL cannot be signed.
+func (m *gcloudCDNStorageMiddleware) RedirectURL(r *http.Request, path string) (string, error) {
+	if !strings.HasPrefix(path, blobsPathPrefix) {
+		return m.StorageDriver.RedirectURL(r, path)
+	}
+	keyer, ok := m.StorageDriver.(GCSObjectKeyer)
+	if !ok {
+		dcontext.GetLogger(r.Context()).Warn("the gcloudcdn middleware does not support this backend storage driver")
+		return m.StorageDriver.RedirectURL(r, path)
+	}
+	if m.bypass(r) {
+		return m.StorageDriver.RedirectURL(r, path)
+	}
+
+	object := keyer.GCSObjectKey(path)
+	expires := time.Now().Add(m.duration)
+	var signed string
+	var err error
+	if m.key != nil {
+		signed, err = m.signCDNURL(object, expires)
+	} else {
+		signed, err = m.signGCSURL(r, object, expires)
+	}
+	if err != nil {
+		dcontext.GetLogger(r.Context()).WithError(err).Errorf("failed to sign the Cloud CDN URL of %s, serving it directly", path)
+		return "", nil
+	}
+	return signed, nil
+}
+
+// bypass returns whether the request is served without the CDN, for its
+// path or the IP of its client.
+func (m *gcloudCDNStorageMiddleware) bypass(r *http.Request) bool {
+	for _, prefix := range m.bypassPaths {
+		if strings.HasPrefix(r.URL.Path, prefix) {
+			return true
+		}
+	}
+	if len(m.bypassIPRanges) == 0 {
+		return false
+	}
+	ip := net.ParseIP(requestutil.RemoteIP(r))
+	if ip == nil {
+		return false
+	}
+	for _, ipNet := range m.bypassIPRanges {
+		if ipNet.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// signCDNURL signs the URL of the object with the Cloud CDN signing key,
+// appending the Expires, KeyName and Signature parameters, the signature
+// being the base64url encoded HMAC-SHA1 of the URL up to it.
+func (m *gcloudCDNStorageMiddleware) signCDNURL(object string, expires time.Time) (string, error) {
+	u := *m.baseURL
+	u.Path += "/" + object
+	u.RawQuery = ""
+	toSign := u.String() + "?Expires=" + strconv.FormatInt(expires.Unix(), 10) + "&KeyName=" + url.QueryEscape(m.keyName)
+	mac := hmac.New(sha1.New, m.key)
+	if _, err := mac.Write([]byte(toSign)); err != nil {
+		return "", err
+	}
+	return toSign + "&Signature=" + base64.URLEncoding.EncodeToString(mac.Sum(nil)), nil
+}
+
+// signGCSURL signs a V4 GCS signed URL of the object, with the hostname of
+// the CDN.
+func (m *gcloudCDNStorageMiddleware) signGCSURL(r *http.Request, object string, expires time.Time) (string, error) {
+	method := r.Method
+	if method != http.MethodHead {
+		method = http.MethodGet
+	}
+	return storage.SignedURL(m.bucket, object, &storage.SignedURLOptions{
+		GoogleAccessID: m.email,
+		PrivateKey:     m.privateKey,
+		Method:         method,
+		Expires:        expires,
+		Scheme:         storage.SigningSchemeV4,
+		Style:          storage.BucketBoundHostname(m.baseURL.Host),
+		Insecure:       m.baseURL.Scheme == "http",
+	})
+}
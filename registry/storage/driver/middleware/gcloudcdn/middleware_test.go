@@ -0,0 +1,196 @@
+package middleware
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha1"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	storagedriver "github.com/distribution/distribution/v3/registry/storage/driver"
+	"github.com/stretchr/testify/require"
+)
+
+// testKey is a Cloud CDN signing key, base64url encoded as by gcloud.
+var testKey = base64.URLEncoding.EncodeToString([]byte("0123456789abcdef"))
+
+const blobPath = "/docker/registry/v2/blobs/sha256/ab/abcdef/data"
+
+// keyerDriver is a storage driver returning the names of the objects, as the
+// GCS driver does, and redirecting to the storage.
+type keyerDriver struct {
+	storagedriver.StorageDriver
+}
+
+func (keyerDriver) GCSObjectKey(path string) string {
+	return "registry" + path
+}
+
+func (keyerDriver) RedirectURL(r *http.Request, path string) (string, error) {
+	return "https://storage.example.com" + path, nil
+}
+
+func newMiddleware(t *testing.T, options map[string]any) *gcloudCDNStorageMiddleware {
+	t.Helper()
+	d, err := newGCloudCDNStorageMiddleware(context.Background(), keyerDriver{}, options)
+	require.NoError(t, err)
+	return d.(*gcloudCDNStorageMiddleware)
+}
+
+func TestOptions(t *testing.T) {
+	keyFile := filepath.Join(t.TempDir(), "key")
+	require.NoError(t, os.WriteFile(keyFile, []byte(testKey+"\n"), 0o600))
+	for _, tc := range []struct {
+		name    string
+		options map[string]any
+		err     string
+	}{
+		{name: "no baseurl", options: map[string]any{}, err: "no baseurl provided"},
+		{name: "no keyname", options: map[string]any{"baseurl": "cdn.example.com", "key": testKey}, err: "no keyname provided"},
+		{name: "no key", options: map[string]any{"baseurl": "cdn.example.com", "keyname": "registry"}, err: "no key or keyfile provided"},
+		{name: "invalid key", options: map[string]any{"baseurl": "cdn.example.com", "keyname": "registry", "key": "not base64!"}, err: "key must be base64url encoded"},
+		{name: "keyfile", options: map[string]any{"baseurl": "cdn.example.com", "keyname": "registry", "keyfile": keyFile}},
+		{name: "invalid duration", options: map[string]any{"baseurl": "cdn.example.com", "keyname": "registry", "key": testKey, "duration": "-1m"}, err: "duration must be positive"},
+		{name: "invalid mode", options: map[string]any{"baseurl": "cdn.example.com", "signingmode": "cookie"}, err: "signingmode only allows"},
+		{name: "no bucket", options: map[string]any{"baseurl": "cdn.example.com", "signingmode": "gcs"}, err: "no bucket provided"},
+		{name: "invalid range", options: map[string]any{"baseurl": "cdn.example.com", "keyname": "registry", "key": testKey, "bypassipranges": "10.0.0.0"}, err: "invalid bypassipranges"},
+		{name: "relative path", options: map[string]any{"baseurl": "cdn.example.com", "keyname": "registry", "key": testKey, "bypasspaths": []any{"v2/internal/"}}, err: "bypasspaths must be absolute paths"},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			_, err := newGCloudCDNStorageMiddleware(context.Background(), keyerDriver{}, tc.options)
+			if tc.err == "" {
+				require.NoError(t, err)
+			} else {
+				require.ErrorContains(t, err, tc.err)
+			}
+		})
+	}
+}
+
+func TestCDNSignedURL(t *testing.T) {
+	m := newMiddleware(t, map[string]any{
+		"baseurl":  "https://cdn.example.com/",
+		"keyname":  "registry-key",
+		"key":      testKey,
+		"duration": "10m",
+	})
+
+	r := httptest.NewRequest(http.MethodGet, "/v2/foo/blobs/sha256:abcdef", nil)
+	redirectURL, err := m.RedirectURL(r, blobPath)
+	require.NoError(t, err)
+
+	// The signature is the HMAC-SHA1 of the URL up to it.
+	signed, signature, ok := strings.Cut(redirectURL, "&Signature=")
+	require.True(t, ok, "no signature in %s", redirectURL)
+	require.True(t, strings.HasPrefix(signed, "https://cdn.example.com/registry"+blobPath+"?Expires="), "unexpected url %s", signed)
+	mac := hmac.New(sha1.New, []byte("0123456789abcdef"))
+	mac.Write([]byte(signed))
+	require.Equal(t, base64.URLEncoding.EncodeToString(mac.Sum(nil)), signature)
+
+	u, err := url.Parse(redirectURL)
+	require.NoError(t, err)
+	require.Equal(t, "registry-key", u.Query().Get("KeyName"))
+	expires, err := strconv.ParseInt(u.Query().Get("Expires"), 10, 64)
+	require.NoError(t, err)
+	require.WithinDuration(t, time.Now().Add(10*time.Minute), time.Unix(expires, 0), time.Minute)
+
+	// The other paths are left to the storage driver.
+	redirectURL, err = m.RedirectURL(r, "/docker/registry/v2/repositories/foo/_layers/sha256/abcdef/link")
+	require.NoError(t, err)
+	require.Equal(t, "https://storage.example.com/docker/registry/v2/repositories/foo/_layers/sha256/abcdef/link", redirectURL)
+}
+
+func TestBypass(t *testing.T) {
+	m := newMiddleware(t, map[string]any{
+		"baseurl":        "cdn.example.com",
+		"keyname":        "registry-key",
+		"key":            testKey,
+		"bypassipranges": []any{"10.0.0.0/8", "fd00::/8"},
+		"bypasspaths":    "/v2/internal/, /v2/mirror/",
+	})
+
+	for _, tc := range []struct {
+		name          string
+		path          string
+		remoteAddr    string
+		forwardedFor  string
+		expectedStore bool
+	}{
+		{name: "public client", path: "/v2/foo/blobs/sha256:abcdef", remoteAddr: "203.0.113.7:4321"},
+		{name: "cluster client", path: "/v2/foo/blobs/sha256:abcdef", remoteAddr: "10.1.2.3:4321", expectedStore: true},
+		{name: "cluster ipv6 client", path: "/v2/foo/blobs/sha256:abcdef", remoteAddr: "[fd00::1]:4321", expectedStore: true},
+		{name: "forwarded cluster client", path: "/v2/foo/blobs/sha256:abcdef", remoteAddr: "203.0.113.1:4321", forwardedFor: "10.1.2.3", expectedStore: true},
+		{name: "forwarded public client", path: "/v2/foo/blobs/sha256:abcdef", remoteAddr: "10.1.2.3:4321", forwardedFor: "203.0.113.7"},
+		{name: "bypassed path", path: "/v2/internal/app/blobs/sha256:abcdef", remoteAddr: "203.0.113.7:4321", expectedStore: true},
+		{name: "other path", path: "/v2/internalapp/blobs/sha256:abcdef", remoteAddr: "203.0.113.7:4321"},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			r := httptest.NewRequest(http.MethodGet, tc.path, nil)
+			r.RemoteAddr = tc.remoteAddr
+			if tc.forwardedFor != "" {
+				r.Header.Set("X-Forwarded-For", tc.forwardedFor)
+			}
+			redirectURL, err := m.RedirectURL(r, blobPath)
+			require.NoError(t, err)
+			if tc.expectedStore {
+				require.Equal(t, "https://storage.example.com"+blobPath, redirectURL)
+			} else {
+				require.True(t, strings.HasPrefix(redirectURL, "https://cdn.example.com/"), "unexpected url %s", redirectURL)
+			}
+		})
+	}
+}
+
+func TestGCSSignedURL(t *testing.T) {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	require.NoError(t, err)
+	pkcs8, err := x509.MarshalPKCS8PrivateKey(key)
+	require.NoError(t, err)
+	credentials, err := json.Marshal(map[string]string{
+		"type":         "service_account",
+		"client_email": "registry@example.iam.gserviceaccount.com",
+		"private_key":  string(pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: pkcs8})),
+	})
+	require.NoError(t, err)
+	credentialsFile := filepath.Join(t.TempDir(), "credentials.json")
+	require.NoError(t, os.WriteFile(credentialsFile, credentials, 0o600))
+
+	m := newMiddleware(t, map[string]any{
+		"baseurl":     "https://cdn.example.com",
+		"signingmode": "gcs",
+		"bucket":      "registry-bucket",
+		"credentials": credentialsFile,
+	})
+	r := httptest.NewRequest(http.MethodHead, "/v2/foo/blobs/sha256:abcdef", nil)
+	redirectURL, err := m.RedirectURL(r, blobPath)
+	require.NoError(t, err)
+	u, err := url.Parse(redirectURL)
+	require.NoError(t, err)
+	require.Equal(t, "cdn.example.com", u.Host)
+	require.Equal(t, "/registry"+blobPath, u.Path)
+	require.Equal(t, "GOOG4-RSA-SHA256", u.Query().Get("X-Goog-Algorithm"))
+	require.True(t, strings.HasPrefix(u.Query().Get("X-Goog-Credential"), "registry@example.iam.gserviceaccount.com/"))
+	expires, err := strconv.Atoi(u.Query().Get("X-Goog-Expires"))
+	require.NoError(t, err)
+	require.InDelta(t, 1200, expires, 60)
+	require.NotEmpty(t, u.Query().Get("X-Goog-Signature"))
+
+	// The blobs whose URL cannot be signed are served directly.
+	m.privateKey = []byte("invalid")
+	redirectURL, err = m.RedirectURL(r, blobPath)
+	require.NoError(t, err)
+	require.Empty(t, redirectURL)
+}
@@ -0,0 +1,186 @@
+// Package middleware - mirrorwrite wrapper for storage drivers, replaying the
+// writes made to the storage driver on a secondary storage driver.
+package middleware
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"strconv"
+	"time"
+
+	storagedriver "github.com/distribution/distribution/v3/registry/storage/driver"
+	storagemiddleware "github.com/distribution/distribution/v3/registry/storage/driver/middleware"
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	defaultQueueSize   = 10000
+	defaultMaxAttempts = 5
+	defaultBackoff     = time.Second
+	maxBackoff         = time.Minute
+)
+
+func init() {
+	if err := storagemiddleware.Register("mirrorwrite", newMirrorWriteStorageMiddleware); err != nil {
+		logrus.Errorf("failed to register mirrorwrite storage middleware: %v", err)
+	}
+}
+
+// mirrorWriteStorageMiddleware applies the writes made through it to the
+// storage driver, and replays them on a secondary storage driver in the
+// background. Reads are always served by the storage driver.
+//
+// The writes are replayed in order by a single worker, from a bounded queue.
+// A write which does not fit in the queue, or which still fails on the
+// secondary after its attempts, is dropped: it is logged and counted, but
+// never fails the request which made it.
+type mirrorWriteStorageMiddleware struct {
+	storagedriver.StorageDriver
+	mirror *mirror
+}
+
+var _ storagedriver.StorageDriver = &mirrorWriteStorageMiddleware{}
+
+// newMirrorWriteStorageMiddleware constructs and returns a new mirrorwrite
+// storage middleware.
+//
+// Required options:
+//
+//   - secondary: the storage driver the writes are replayed on, as a map of
+//     the name of the driver to its parameters
+//
+// Optional options:
+//
+//   - queuesize: the number of writes waiting to be replayed above which
+//     writes are dropped, defaults to 10000
+//   - maxattempts: the number of times a write is tried on the secondary,
+//     defaults to 5
+//   - backoff: the wait before a write is tried again, doubled for each
+//     following attempt, defaults to 1s
+func newMirrorWriteStorageMiddleware(ctx context.Context, sd storagedriver.StorageDriver, options map[string]any) (storagedriver.StorageDriver, error) {
+	s, ok := options["secondary"]
+	if !ok {
+		return nil, fmt.Errorf("no secondary provided")
+	}
+	secondary, err := storagemiddleware.CreateDriver(ctx, s)
+	if err != nil {
+		return nil, fmt.Errorf("unable to create secondary storage driver: %v", err)
+	}
+
+	queueSize, err := intOption(options, "queuesize", defaultQueueSize)
+	if err != nil {
+		return nil, err
+	}
+	maxAttempts, err := intOption(options, "maxattempts", defaultMaxAttempts)
+	if err != nil {
+		return nil, err
+	}
+
+	backoff := defaultBackoff
+	switch v := options["backoff"].(type) {
+	case nil:
+	case time.Duration:
+		backoff = v
+	case string:
+		backoff, err = time.ParseDuration(v)
+		if err != nil {
+			return nil, fmt.Errorf("backoff must be a duration, %v invalid", v)
+		}
+	default:
+		return nil, fmt.Errorf("backoff must be a duration, %v invalid", v)
+	}
+	if backoff <= 0 {
+		return nil, fmt.Errorf("backoff must be positive, %v invalid", backoff)
+	}
+
+	m := newMirror(sd, secondary, queueSize, maxAttempts, backoff)
+	go m.run()
+	return &mirrorWriteStorageMiddleware{StorageDriver: sd, mirror: m}, nil
+}
+
+// intOption returns the positive integer option name, or defaultValue if it
+// is not set.
+func intOption(options map[string]any, name string, defaultValue int) (int, error) {
+	n := defaultValue
+	switch v := options[name].(type) {
+	case nil:
+	case int:
+		n = v
+	case string:
+		var err error
+		n, err = strconv.Atoi(v)
+		if err != nil {
+			return 0, fmt.Errorf("%s must be an integer, %v invalid", name, v)
+		}
+	default:
+		return 0, fmt.Errorf("%s must be an integer, %v invalid", name, v)
+	}
+	if n < 1 {
+		return 0, fmt.Errorf("%s must be at least 1, %d invalid", name, n)
+	}
+	return n, nil
+}
+
+// PutContent stores the []byte content at a location designated by "path".
+func (m *mirrorWriteStorageMiddleware) PutContent(ctx context.Context, path string, content []byte) error {
+	if err := m.StorageDriver.PutContent(ctx, path, content); err != nil {
+		return err
+	}
+	m.mirror.enqueue(ctx, &op{kind: opPut, path: path, content: bytes.Clone(content)})
+	return nil
+}
+
+// Writer returns a FileWriter which will store the content written to it at
+// the location designated by "path" after the call to Commit. The content is
+// replayed on the secondary once it is committed.
+func (m *mirrorWriteStorageMiddleware) Writer(ctx context.Context, path string, append bool) (storagedriver.FileWriter, error) {
+	fw, err := m.StorageDriver.Writer(ctx, path, append)
+	if err != nil {
+		return nil, err
+	}
+	return &writer{FileWriter: fw, mirror: m.mirror, path: path}, nil
+}
+
+// Move moves an object stored at sourcePath to destPath, removing the
+// original object.
+func (m *mirrorWriteStorageMiddleware) Move(ctx context.Context, sourcePath string, destPath string) error {
+	if err := m.StorageDriver.Move(ctx, sourcePath, destPath); err != nil {
+		return err
+	}
+	m.mirror.enqueue(ctx, &op{kind: opMove, path: sourcePath, dest: destPath})
+	return nil
+}
+
+// Delete recursively deletes all objects stored at "path" and its subpaths.
+func (m *mirrorWriteStorageMiddleware) Delete(ctx context.Context, path string) error {
+	if err := m.StorageDriver.Delete(ctx, path); err != nil {
+		return err
+	}
+	m.mirror.enqueue(ctx, &op{kind: opDelete, path: path})
+	return nil
+}
+
+// Flush waits until the writes made before it was called are replayed on the
+// secondary, or dropped, or until ctx is done.
+func (m *mirrorWriteStorageMiddleware) Flush(ctx context.Context) error {
+	return m.mirror.flush(ctx)
+}
+
+// writer replays the content it committed on the secondary.
+type writer struct {
+	storagedriver.FileWriter
+	mirror *mirror
+	path   string
+}
+
+// Commit flushes all content written to this FileWriter and makes it
+// available for future calls to StorageDriver.GetContent and
+// StorageDriver.Reader.
+func (w *writer) Commit(ctx context.Context) error {
+	if err := w.FileWriter.Commit(ctx); err != nil {
+		return err
+	}
+	w.mirror.enqueue(ctx, &op{kind: opCopy, path: w.path})
+	return nil
+}
@@ -0,0 +1,251 @@
+package middleware
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"testing"
+	"time"
+
+	storagedriver "github.com/distribution/distribution/v3/registry/storage/driver"
+	"github.com/distribution/distribution/v3/registry/storage/driver/inmemory"
+	"github.com/docker/go-metrics"
+	"github.com/stretchr/testify/require"
+)
+
+// counter records the increments of a labeled counter.
+type counter struct {
+	mu     sync.Mutex
+	counts map[string]float64
+}
+
+func (c *counter) WithValues(vs ...string) metrics.Counter {
+	return counterFunc(func(v ...float64) {
+		c.mu.Lock()
+		defer c.mu.Unlock()
+		for _, n := range v {
+			c.counts[vs[0]] += n
+		}
+	})
+}
+
+func (c *counter) count(operation string) float64 {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.counts[operation]
+}
+
+type counterFunc func(vs ...float64)
+
+func (f counterFunc) Inc(vs ...float64) { f(vs...) }
+
+// recordMetrics replaces the counters of the mirror for the duration of the
+// test.
+func recordMetrics(t *testing.T) (replicatedWrites, failedWrites, droppedWrites *counter) {
+	replicatedWrites = &counter{counts: make(map[string]float64)}
+	failedWrites = &counter{counts: make(map[string]float64)}
+	droppedWrites = &counter{counts: make(map[string]float64)}
+	origReplicated, origFailures, origDropped := replicated, failures, dropped
+	replicated, failures, dropped = replicatedWrites, failedWrites, droppedWrites
+	t.Cleanup(func() {
+		replicated, failures, dropped = origReplicated, origFailures, origDropped
+	})
+	return replicatedWrites, failedWrites, droppedWrites
+}
+
+func newMiddleware(t *testing.T, options map[string]any) (*mirrorWriteStorageMiddleware, storagedriver.StorageDriver) {
+	if _, ok := options["secondary"]; !ok {
+		options["secondary"] = map[any]any{"inmemory": nil}
+	}
+	sd, err := newMirrorWriteStorageMiddleware(context.Background(), inmemory.New(), options)
+	require.NoError(t, err)
+	m := sd.(*mirrorWriteStorageMiddleware)
+	return m, m.mirror.secondary
+}
+
+// newMirrorFor returns a middleware replaying writes on secondary.
+func newMirrorFor(t *testing.T, secondary storagedriver.StorageDriver, queueSize, maxAttempts int) *mirrorWriteStorageMiddleware {
+	primary := inmemory.New()
+	m := newMirror(primary, secondary, queueSize, maxAttempts, time.Millisecond)
+	go m.run()
+	return &mirrorWriteStorageMiddleware{StorageDriver: primary, mirror: m}
+}
+
+func flush(t *testing.T, m *mirrorWriteStorageMiddleware) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	require.NoError(t, m.Flush(ctx))
+}
+
+// contents returns the content of all the files stored by d.
+func contents(t *testing.T, d storagedriver.StorageDriver) map[string]string {
+	ctx := context.Background()
+	files := make(map[string]string)
+	err := d.Walk(ctx, "/", func(fi storagedriver.FileInfo) error {
+		if fi.IsDir() {
+			return nil
+		}
+		content, err := d.GetContent(ctx, fi.Path())
+		if err != nil {
+			return err
+		}
+		files[fi.Path()] = string(content)
+		return nil
+	})
+	if errors.As(err, new(storagedriver.PathNotFoundError)) {
+		return files
+	}
+	require.NoError(t, err)
+	return files
+}
+
+func TestOptions(t *testing.T) {
+	for _, tc := range []struct {
+		name    string
+		options map[string]any
+		wantErr string
+	}{
+		{name: "missing secondary", options: map[string]any{}, wantErr: "no secondary provided"},
+		{name: "unknown secondary", options: map[string]any{"secondary": map[any]any{"nonexistent": nil}}, wantErr: "unable to create secondary storage driver: StorageDriver not registered: nonexistent"},
+		{name: "two secondaries", options: map[string]any{"secondary": map[string]any{"inmemory": nil, "filesystem": nil}}, wantErr: "unable to create secondary storage driver: exactly one storage driver must be configured, 2 provided"},
+		{name: "queuesize invalid", options: map[string]any{"secondary": map[any]any{"inmemory": nil}, "queuesize": "big"}, wantErr: "queuesize must be an integer, big invalid"},
+		{name: "maxattempts zero", options: map[string]any{"secondary": map[any]any{"inmemory": nil}, "maxattempts": 0}, wantErr: "maxattempts must be at least 1, 0 invalid"},
+		{name: "backoff invalid", options: map[string]any{"secondary": map[any]any{"inmemory": nil}, "backoff": "soon"}, wantErr: "backoff must be a duration, soon invalid"},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			_, err := newMirrorWriteStorageMiddleware(context.Background(), inmemory.New(), tc.options)
+			require.EqualError(t, err, tc.wantErr)
+		})
+	}
+}
+
+// TestConvergence checks that the secondary ends up with the same content as
+// the primary after a sequence of writes like those of a push.
+func TestConvergence(t *testing.T) {
+	replicatedWrites, failedWrites, _ := recordMetrics(t)
+	m, secondary := newMiddleware(t, map[string]any{})
+	ctx := context.Background()
+
+	require.NoError(t, m.PutContent(ctx, "/repositories/link", []byte("sha256:abc")))
+	require.NoError(t, m.PutContent(ctx, "/repositories/stale", []byte("stale")))
+
+	w, err := m.Writer(ctx, "/uploads/1/data", false)
+	require.NoError(t, err)
+	_, err = w.Write([]byte("layer"))
+	require.NoError(t, err)
+	require.NoError(t, w.Close())
+	w, err = m.Writer(ctx, "/uploads/1/data", true)
+	require.NoError(t, err)
+	_, err = w.Write([]byte(" content"))
+	require.NoError(t, err)
+	require.NoError(t, w.Commit(ctx))
+	require.NoError(t, w.Close())
+
+	require.NoError(t, m.Move(ctx, "/uploads/1/data", "/blobs/abc/data"))
+	require.NoError(t, m.Delete(ctx, "/repositories/stale"))
+	require.NoError(t, m.Delete(ctx, "/uploads"))
+
+	flush(t, m)
+	require.Equal(t, map[string]string{
+		"/repositories/link": "sha256:abc",
+		"/blobs/abc/data":    "layer content",
+	}, contents(t, secondary))
+	require.Equal(t, contents(t, m.StorageDriver), contents(t, secondary))
+	require.Equal(t, float64(2), replicatedWrites.count("PutContent"))
+	require.Equal(t, float64(1), replicatedWrites.count("Commit"))
+	require.Equal(t, float64(1), replicatedWrites.count("Move"))
+	require.Equal(t, float64(2), replicatedWrites.count("Delete"))
+	require.Zero(t, failedWrites.count("Delete"))
+}
+
+// blockingDriver blocks its writes until released.
+type blockingDriver struct {
+	storagedriver.StorageDriver
+	started chan struct{}
+	release chan struct{}
+}
+
+func (d *blockingDriver) PutContent(ctx context.Context, path string, content []byte) error {
+	select {
+	case d.started <- struct{}{}:
+	default:
+	}
+	<-d.release
+	return d.StorageDriver.PutContent(ctx, path, content)
+}
+
+// TestMoveBeforeCommitReplayed checks that an upload moved on the primary
+// before its commit is replayed reaches the secondary at its destination.
+func TestMoveBeforeCommitReplayed(t *testing.T) {
+	secondary := &blockingDriver{StorageDriver: inmemory.New(), started: make(chan struct{}, 1), release: make(chan struct{})}
+	m := newMirrorFor(t, secondary, 10, 1)
+	ctx := context.Background()
+
+	// Hold the worker on a first write while the upload is committed and
+	// moved on the primary.
+	require.NoError(t, m.PutContent(ctx, "/first", []byte("first")))
+	<-secondary.started
+	w, err := m.Writer(ctx, "/uploads/1/data", false)
+	require.NoError(t, err)
+	_, err = w.Write([]byte("layer"))
+	require.NoError(t, err)
+	require.NoError(t, w.Commit(ctx))
+	require.NoError(t, m.Move(ctx, "/uploads/1/data", "/blobs/abc/data"))
+	close(secondary.release)
+
+	flush(t, m)
+	require.Equal(t, contents(t, m.StorageDriver), contents(t, secondary))
+}
+
+func TestQueueOverflow(t *testing.T) {
+	_, _, droppedWrites := recordMetrics(t)
+	secondary := &blockingDriver{StorageDriver: inmemory.New(), started: make(chan struct{}, 1), release: make(chan struct{})}
+	m := newMirrorFor(t, secondary, 2, 1)
+	ctx := context.Background()
+
+	// The first write is taken by the worker, the next two fill the queue
+	// and the last one is dropped, without blocking or failing.
+	require.NoError(t, m.PutContent(ctx, "/a", []byte("a")))
+	<-secondary.started
+	for _, path := range []string{"/b", "/c", "/d"} {
+		require.NoError(t, m.PutContent(ctx, path, []byte(path)))
+	}
+	require.Equal(t, float64(1), droppedWrites.count("PutContent"))
+	close(secondary.release)
+
+	flush(t, m)
+	require.Equal(t, map[string]string{"/a": "a", "/b": "/b", "/c": "/c"}, contents(t, secondary))
+	require.Len(t, contents(t, m.StorageDriver), 4)
+}
+
+// failingDriver fails all its writes.
+type failingDriver struct {
+	storagedriver.StorageDriver
+	mu    sync.Mutex
+	calls int
+}
+
+func (d *failingDriver) PutContent(ctx context.Context, path string, content []byte) error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.calls++
+	return errors.New("secondary unavailable")
+}
+
+func TestSecondaryFailures(t *testing.T) {
+	_, failedWrites, _ := recordMetrics(t)
+	secondary := &failingDriver{StorageDriver: inmemory.New()}
+	m := newMirrorFor(t, secondary, 10, 3)
+	ctx := context.Background()
+
+	require.NoError(t, m.PutContent(ctx, "/a", []byte("a")))
+	content, err := m.GetContent(ctx, "/a")
+	require.NoError(t, err)
+	require.Equal(t, []byte("a"), content)
+
+	flush(t, m)
+	require.Equal(t, float64(1), failedWrites.count("PutContent"))
+	secondary.mu.Lock()
+	defer secondary.mu.Unlock()
+	require.Equal(t, 3, secondary.calls)
+}
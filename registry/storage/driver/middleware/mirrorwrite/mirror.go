@@ -0,0 +1,199 @@
+package middleware
+
+import (
+	"context"
+	"errors"
+	"io"
+	"sync/atomic"
+	"time"
+
+	"github.com/distribution/distribution/v3/internal/dcontext"
+	prometheus "github.com/distribution/distribution/v3/metrics"
+	storagedriver "github.com/distribution/distribution/v3/registry/storage/driver"
+	"github.com/docker/go-metrics"
+)
+
+var (
+	// pendingWrites is the number of writes waiting to be replayed.
+	pendingWrites = prometheus.StorageNamespace.NewGauge("mirrorwrite_pending", "The number of writes waiting to be replayed on the secondary storage driver", metrics.Unit("writes"))
+	// replicationLag is how long the last write replayed waited in the queue.
+	replicationLag = prometheus.StorageNamespace.NewGauge("mirrorwrite_lag", "How long the last write replayed on the secondary storage driver waited to be replayed", metrics.Seconds)
+	// replicated is the number of writes replayed on the secondary.
+	replicated = prometheus.StorageNamespace.NewLabeledCounter("mirrorwrite_replicated", "The number of writes replayed on the secondary storage driver", "operation")
+	// failures is the number of writes which failed on the secondary after
+	// all their attempts.
+	failures = prometheus.StorageNamespace.NewLabeledCounter("mirrorwrite_failures", "The number of writes which failed on the secondary storage driver", "operation")
+	// dropped is the number of writes which did not fit in the queue.
+	dropped = prometheus.StorageNamespace.NewLabeledCounter("mirrorwrite_dropped", "The number of writes dropped because the queue was full", "operation")
+)
+
+type opKind int
+
+const (
+	opPut opKind = iota
+	opCopy
+	opMove
+	opDelete
+	opFlush
+)
+
+// String returns the name of the storage driver operation replayed.
+func (k opKind) String() string {
+	switch k {
+	case opPut:
+		return "PutContent"
+	case opCopy:
+		return "Commit"
+	case opMove:
+		return "Move"
+	case opDelete:
+		return "Delete"
+	default:
+		return "Flush"
+	}
+}
+
+// op is a write to replay on the secondary.
+type op struct {
+	kind    opKind
+	path    string
+	dest    string
+	content []byte
+	queued  time.Time
+	// done is closed once a flush is reached.
+	done chan struct{}
+}
+
+// mirror replays writes on the secondary from a bounded queue.
+type mirror struct {
+	primary     storagedriver.StorageDriver
+	secondary   storagedriver.StorageDriver
+	queue       chan *op
+	pending     atomic.Int64
+	maxAttempts int
+	backoff     time.Duration
+}
+
+func newMirror(primary, secondary storagedriver.StorageDriver, queueSize, maxAttempts int, backoff time.Duration) *mirror {
+	return &mirror{
+		primary:     primary,
+		secondary:   secondary,
+		queue:       make(chan *op, queueSize),
+		maxAttempts: maxAttempts,
+		backoff:     backoff,
+	}
+}
+
+// enqueue queues o, or drops it if the queue is full.
+func (m *mirror) enqueue(ctx context.Context, o *op) {
+	o.queued = time.Now()
+	select {
+	case m.queue <- o:
+		pendingWrites.Set(float64(m.pending.Add(1)))
+	default:
+		dropped.WithValues(o.kind.String()).Inc(1)
+		dcontext.GetLoggerWithField(ctx, "path", o.path).Errorf("mirrorwrite: queue full, %s not replayed on the secondary storage driver", o.kind)
+	}
+}
+
+// flush waits until the writes queued before it are replayed.
+func (m *mirror) flush(ctx context.Context) error {
+	o := &op{kind: opFlush, done: make(chan struct{})}
+	select {
+	case m.queue <- o:
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+	select {
+	case <-o.done:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// run replays the queued writes in order.
+func (m *mirror) run() {
+	for o := range m.queue {
+		if o.kind == opFlush {
+			close(o.done)
+			continue
+		}
+		pendingWrites.Set(float64(m.pending.Add(-1)))
+		replicationLag.Set(time.Since(o.queued).Seconds())
+		m.replay(o)
+	}
+}
+
+// replay applies o to the secondary, trying again with an exponential
+// backoff when it fails.
+func (m *mirror) replay(o *op) {
+	ctx := context.Background()
+	backoff := m.backoff
+	for attempt := 1; ; attempt++ {
+		err := m.apply(ctx, o)
+		if err == nil {
+			replicated.WithValues(o.kind.String()).Inc(1)
+			return
+		}
+		if attempt == m.maxAttempts {
+			failures.WithValues(o.kind.String()).Inc(1)
+			dcontext.GetLoggerWithField(ctx, "path", o.path).Errorf("mirrorwrite: %s failed on the secondary storage driver: %v", o.kind, err)
+			return
+		}
+		time.Sleep(backoff)
+		backoff = min(2*backoff, maxBackoff)
+	}
+}
+
+func (m *mirror) apply(ctx context.Context, o *op) error {
+	switch o.kind {
+	case opPut:
+		return m.secondary.PutContent(ctx, o.path, o.content)
+	case opCopy:
+		return m.copy(ctx, o.path)
+	case opMove:
+		err := m.secondary.Move(ctx, o.path, o.dest)
+		if errors.As(err, new(storagedriver.PathNotFoundError)) {
+			// The source never reached the secondary, for example because
+			// it was moved on the primary before its commit was replayed.
+			return m.copy(ctx, o.dest)
+		}
+		return err
+	case opDelete:
+		err := m.secondary.Delete(ctx, o.path)
+		if errors.As(err, new(storagedriver.PathNotFoundError)) {
+			return nil
+		}
+		return err
+	}
+	return nil
+}
+
+// copy copies the content stored at path on the primary to the secondary.
+// Content which is no longer on the primary was moved or deleted since, and
+// is left to the replay of that move or delete.
+func (m *mirror) copy(ctx context.Context, path string) error {
+	rc, err := m.primary.Reader(ctx, path, 0)
+	if errors.As(err, new(storagedriver.PathNotFoundError)) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	defer rc.Close()
+
+	fw, err := m.secondary.Writer(ctx, path, false)
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(fw, rc); err != nil {
+		fw.Cancel(ctx)
+		return err
+	}
+	if err := fw.Commit(ctx); err != nil {
+		fw.Cancel(ctx)
+		return err
+	}
+	return fw.Close()
+}
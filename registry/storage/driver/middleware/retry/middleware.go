@@ -0,0 +1,259 @@
+// Package middleware - retry wrapper for storage drivers, retrying the
+// operations which failed for a transient reason.
+package middleware
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"math/rand/v2"
+	"net/http"
+	"strconv"
+	"time"
+
+	prometheus "github.com/distribution/distribution/v3/metrics"
+	storagedriver "github.com/distribution/distribution/v3/registry/storage/driver"
+	storagemiddleware "github.com/distribution/distribution/v3/registry/storage/driver/middleware"
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	defaultMaxAttempts    = 3
+	defaultInitialBackoff = 100 * time.Millisecond
+	defaultMaxBackoff     = 5 * time.Second
+	defaultDeadline       = 30 * time.Second
+)
+
+var (
+	// retries is the number of storage driver operations tried again.
+	retries = prometheus.StorageNamespace.NewLabeledCounter("retries", "The number of storage driver operations retried", "operation")
+	// retriesExhausted is the number of storage driver operations which
+	// failed with a retryable error on their last attempt.
+	retriesExhausted = prometheus.StorageNamespace.NewLabeledCounter("retries_exhausted", "The number of storage driver operations which failed after they were retried", "operation")
+)
+
+func init() {
+	if err := storagemiddleware.Register("retry", newRetryStorageMiddleware); err != nil {
+		logrus.Errorf("failed to register retry storage middleware: %v", err)
+	}
+}
+
+// retryStorageMiddleware tries again the operations which failed with an
+// error the storage driver marked as retryable, with an exponential backoff.
+//
+// Only operations which can be repeated safely are retried: GetContent,
+// PutContent, Reader, Stat, List, Delete, RedirectURL and FileWriter.Commit.
+// Writes to a FileWriter are never retried, since the part of the content
+// which reached the storage driver is unknown, nor are Move and Walk.
+type retryStorageMiddleware struct {
+	storagedriver.StorageDriver
+	maxAttempts    int
+	initialBackoff time.Duration
+	maxBackoff     time.Duration
+	deadline       time.Duration
+}
+
+var _ storagedriver.StorageDriver = &retryStorageMiddleware{}
+
+// newRetryStorageMiddleware constructs and returns a new retry storage
+// middleware.
+//
+// Optional options:
+//
+//   - maxattempts: the number of times an operation is tried, defaults to 3
+//   - initialbackoff: the wait before the first retry, doubled for each
+//     following retry, defaults to 100ms
+//   - maxbackoff: the longest wait between two attempts, defaults to 5s
+//   - deadline: the time after which a failed operation is no longer
+//     retried, counted from its first attempt, defaults to 30s
+func newRetryStorageMiddleware(ctx context.Context, sd storagedriver.StorageDriver, options map[string]any) (storagedriver.StorageDriver, error) {
+	m := &retryStorageMiddleware{
+		StorageDriver:  sd,
+		maxAttempts:    defaultMaxAttempts,
+		initialBackoff: defaultInitialBackoff,
+		maxBackoff:     defaultMaxBackoff,
+		deadline:       defaultDeadline,
+	}
+
+	switch v := options["maxattempts"].(type) {
+	case nil:
+	case int:
+		m.maxAttempts = v
+	case string:
+		n, err := strconv.Atoi(v)
+		if err != nil {
+			return nil, fmt.Errorf("maxattempts must be an integer, %v invalid", v)
+		}
+		m.maxAttempts = n
+	default:
+		return nil, fmt.Errorf("maxattempts must be an integer, %v invalid", v)
+	}
+	if m.maxAttempts < 1 {
+		return nil, fmt.Errorf("maxattempts must be at least 1, %d invalid", m.maxAttempts)
+	}
+
+	for _, o := range []struct {
+		name  string
+		value *time.Duration
+	}{
+		{"initialbackoff", &m.initialBackoff},
+		{"maxbackoff", &m.maxBackoff},
+		{"deadline", &m.deadline},
+	} {
+		switch v := options[o.name].(type) {
+		case nil:
+		case time.Duration:
+			*o.value = v
+		case string:
+			d, err := time.ParseDuration(v)
+			if err != nil {
+				return nil, fmt.Errorf("%s must be a duration, %v invalid", o.name, v)
+			}
+			*o.value = d
+		default:
+			return nil, fmt.Errorf("%s must be a duration, %v invalid", o.name, v)
+		}
+		if *o.value <= 0 {
+			return nil, fmt.Errorf("%s must be positive, %v invalid", o.name, *o.value)
+		}
+	}
+	if m.maxBackoff < m.initialBackoff {
+		return nil, fmt.Errorf("maxbackoff %v must not be shorter than initialbackoff %v", m.maxBackoff, m.initialBackoff)
+	}
+
+	return m, nil
+}
+
+// do calls fn until it succeeds, fails with an error which is not
+// retryable, or the attempts or the deadline are exhausted.
+func (m *retryStorageMiddleware) do(ctx context.Context, operation string, fn func() error) error {
+	deadline := time.Now().Add(m.deadline)
+	backoff := m.initialBackoff
+	for attempt := 1; ; attempt++ {
+		err := fn()
+		if err == nil || !storagedriver.IsRetryable(err) {
+			return err
+		}
+		// Wait between half and all of the backoff, so that the retries of
+		// operations which failed together are spread out.
+		wait := backoff/2 + rand.N(backoff/2+1)
+		if attempt == m.maxAttempts || time.Now().Add(wait).After(deadline) {
+			retriesExhausted.WithValues(operation).Inc(1)
+			return err
+		}
+
+		timer := time.NewTimer(wait)
+		select {
+		case <-timer.C:
+		case <-ctx.Done():
+			timer.Stop()
+			return err
+		}
+		retries.WithValues(operation).Inc(1)
+		backoff = min(2*backoff, m.maxBackoff)
+	}
+}
+
+// GetContent retrieves the content stored at "path" as a []byte.
+func (m *retryStorageMiddleware) GetContent(ctx context.Context, path string) ([]byte, error) {
+	var content []byte
+	err := m.do(ctx, "GetContent", func() error {
+		var err error
+		content, err = m.StorageDriver.GetContent(ctx, path)
+		return err
+	})
+	return content, err
+}
+
+// PutContent stores the []byte content at a location designated by "path".
+func (m *retryStorageMiddleware) PutContent(ctx context.Context, path string, content []byte) error {
+	return m.do(ctx, "PutContent", func() error {
+		return m.StorageDriver.PutContent(ctx, path, content)
+	})
+}
+
+// Reader retrieves an io.ReadCloser for the content stored at "path" with a
+// given byte offset. Only opening the reader is retried, not reading from it.
+func (m *retryStorageMiddleware) Reader(ctx context.Context, path string, offset int64) (io.ReadCloser, error) {
+	var rc io.ReadCloser
+	err := m.do(ctx, "Reader", func() error {
+		var err error
+		rc, err = m.StorageDriver.Reader(ctx, path, offset)
+		return err
+	})
+	return rc, err
+}
+
+// Writer returns a FileWriter which will store the content written to it at
+// the location designated by "path" after the call to Commit. Opening the
+// writer is not retried, since it may start an upload.
+func (m *retryStorageMiddleware) Writer(ctx context.Context, path string, append bool) (storagedriver.FileWriter, error) {
+	fw, err := m.StorageDriver.Writer(ctx, path, append)
+	if err != nil {
+		return nil, err
+	}
+	return &writer{FileWriter: fw, middleware: m}, nil
+}
+
+// Stat retrieves the FileInfo for the given path.
+func (m *retryStorageMiddleware) Stat(ctx context.Context, path string) (storagedriver.FileInfo, error) {
+	var fi storagedriver.FileInfo
+	err := m.do(ctx, "Stat", func() error {
+		var err error
+		fi, err = m.StorageDriver.Stat(ctx, path)
+		return err
+	})
+	return fi, err
+}
+
+// List returns a list of the objects that are direct descendants of the
+// given path.
+func (m *retryStorageMiddleware) List(ctx context.Context, path string) ([]string, error) {
+	var entries []string
+	err := m.do(ctx, "List", func() error {
+		var err error
+		entries, err = m.StorageDriver.List(ctx, path)
+		return err
+	})
+	return entries, err
+}
+
+// Delete recursively deletes all objects stored at "path" and its subpaths.
+func (m *retryStorageMiddleware) Delete(ctx context.Context, path string) error {
+	return m.do(ctx, "Delete", func() error {
+		return m.StorageDriver.Delete(ctx, path)
+	})
+}
+
+// RedirectURL returns a URL which may be used to retrieve the content stored
+// at the given path.
+func (m *retryStorageMiddleware) RedirectURL(r *http.Request, path string) (string, error) {
+	ctx := context.Background()
+	if r != nil {
+		ctx = r.Context()
+	}
+	var url string
+	err := m.do(ctx, "RedirectURL", func() error {
+		var err error
+		url, err = m.StorageDriver.RedirectURL(r, path)
+		return err
+	})
+	return url, err
+}
+
+// writer retries the Commit of the FileWriter it wraps. A storage driver only
+// marks an error of Commit as retryable when the writer can be committed
+// again.
+type writer struct {
+	storagedriver.FileWriter
+	middleware *retryStorageMiddleware
+}
+
+// Commit flushes all content written to this FileWriter and makes it
+// available for future calls to StorageDriver.GetContent and
+// StorageDriver.Reader.
+func (w *writer) Commit(ctx context.Context) error {
+	return w.middleware.do(ctx, "Commit", func() error {
+		return w.FileWriter.Commit(ctx)
+	})
+}
@@ -0,0 +1,312 @@
+package middleware
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"sync"
+	"testing"
+	"time"
+
+	storagedriver "github.com/distribution/distribution/v3/registry/storage/driver"
+	"github.com/distribution/distribution/v3/registry/storage/driver/inmemory"
+	"github.com/docker/go-metrics"
+	"github.com/stretchr/testify/require"
+)
+
+var errTransient = storagedriver.RetryableError{DriverName: "flaky", Detail: errors.New("transient failure")}
+
+// flakyDriver fails the next failures calls of each operation with err.
+type flakyDriver struct {
+	storagedriver.StorageDriver
+	err error
+
+	mu       sync.Mutex
+	failures map[string]int
+	calls    map[string]int
+}
+
+func newFlakyDriver() *flakyDriver {
+	return &flakyDriver{
+		StorageDriver: inmemory.New(),
+		err:           errTransient,
+		failures:      make(map[string]int),
+		calls:         make(map[string]int),
+	}
+}
+
+func (d *flakyDriver) fail(operation string, n int) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.failures[operation] = n
+}
+
+func (d *flakyDriver) callCount(operation string) int {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return d.calls[operation]
+}
+
+func (d *flakyDriver) call(operation string) error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.calls[operation]++
+	if d.failures[operation] > 0 {
+		d.failures[operation]--
+		return d.err
+	}
+	return nil
+}
+
+func (d *flakyDriver) GetContent(ctx context.Context, path string) ([]byte, error) {
+	if err := d.call("GetContent"); err != nil {
+		return nil, err
+	}
+	return d.StorageDriver.GetContent(ctx, path)
+}
+
+func (d *flakyDriver) Stat(ctx context.Context, path string) (storagedriver.FileInfo, error) {
+	if err := d.call("Stat"); err != nil {
+		return nil, err
+	}
+	return d.StorageDriver.Stat(ctx, path)
+}
+
+func (d *flakyDriver) Move(ctx context.Context, sourcePath string, destPath string) error {
+	if err := d.call("Move"); err != nil {
+		return err
+	}
+	return d.StorageDriver.Move(ctx, sourcePath, destPath)
+}
+
+func (d *flakyDriver) RedirectURL(r *http.Request, path string) (string, error) {
+	if err := d.call("RedirectURL"); err != nil {
+		return "", err
+	}
+	return "https://example.com" + path, nil
+}
+
+func (d *flakyDriver) Writer(ctx context.Context, path string, append bool) (storagedriver.FileWriter, error) {
+	fw, err := d.StorageDriver.Writer(ctx, path, append)
+	if err != nil {
+		return nil, err
+	}
+	return &flakyWriter{FileWriter: fw, driver: d}, nil
+}
+
+type flakyWriter struct {
+	storagedriver.FileWriter
+	driver *flakyDriver
+}
+
+func (w *flakyWriter) Write(p []byte) (int, error) {
+	if err := w.driver.call("Write"); err != nil {
+		return 0, err
+	}
+	return w.FileWriter.Write(p)
+}
+
+func (w *flakyWriter) Commit(ctx context.Context) error {
+	if err := w.driver.call("Commit"); err != nil {
+		return err
+	}
+	return w.FileWriter.Commit(ctx)
+}
+
+// counter records the increments of a labeled counter.
+type counter struct {
+	mu     sync.Mutex
+	counts map[string]float64
+}
+
+func (c *counter) WithValues(vs ...string) metrics.Counter {
+	return counterFunc(func(v ...float64) {
+		c.mu.Lock()
+		defer c.mu.Unlock()
+		for _, n := range v {
+			c.counts[vs[0]] += n
+		}
+	})
+}
+
+func (c *counter) count(operation string) float64 {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.counts[operation]
+}
+
+type counterFunc func(vs ...float64)
+
+func (f counterFunc) Inc(vs ...float64) { f(vs...) }
+
+// recordMetrics replaces the retry counters for the duration of the test.
+func recordMetrics(t *testing.T) (retried, exhausted *counter) {
+	retried = &counter{counts: make(map[string]float64)}
+	exhausted = &counter{counts: make(map[string]float64)}
+	origRetries, origExhausted := retries, retriesExhausted
+	retries, retriesExhausted = retried, exhausted
+	t.Cleanup(func() {
+		retries, retriesExhausted = origRetries, origExhausted
+	})
+	return retried, exhausted
+}
+
+func newMiddleware(t *testing.T, d storagedriver.StorageDriver, options map[string]any) storagedriver.StorageDriver {
+	if _, ok := options["initialbackoff"]; !ok {
+		options["initialbackoff"] = "1ms"
+	}
+	m, err := newRetryStorageMiddleware(context.Background(), d, options)
+	require.NoError(t, err)
+	return m
+}
+
+func TestOptions(t *testing.T) {
+	for _, tc := range []struct {
+		name    string
+		options map[string]any
+		wantErr string
+	}{
+		{name: "defaults", options: map[string]any{}},
+		{name: "valid", options: map[string]any{"maxattempts": 5, "initialbackoff": "50ms", "maxbackoff": time.Second, "deadline": "1m"}},
+		{name: "maxattempts string", options: map[string]any{"maxattempts": "5"}},
+		{name: "maxattempts invalid", options: map[string]any{"maxattempts": "many"}, wantErr: "maxattempts must be an integer, many invalid"},
+		{name: "maxattempts zero", options: map[string]any{"maxattempts": 0}, wantErr: "maxattempts must be at least 1, 0 invalid"},
+		{name: "initialbackoff invalid", options: map[string]any{"initialbackoff": "soon"}, wantErr: "initialbackoff must be a duration, soon invalid"},
+		{name: "deadline negative", options: map[string]any{"deadline": "-1s"}, wantErr: "deadline must be positive, -1s invalid"},
+		{name: "maxbackoff too short", options: map[string]any{"initialbackoff": "1s", "maxbackoff": "10ms"}, wantErr: "maxbackoff 10ms must not be shorter than initialbackoff 1s"},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			_, err := newRetryStorageMiddleware(context.Background(), inmemory.New(), tc.options)
+			if tc.wantErr == "" {
+				require.NoError(t, err)
+				return
+			}
+			require.EqualError(t, err, tc.wantErr)
+		})
+	}
+}
+
+func TestRetryTransientErrors(t *testing.T) {
+	retried, exhausted := recordMetrics(t)
+	d := newFlakyDriver()
+	m := newMiddleware(t, d, map[string]any{"maxattempts": 3})
+	ctx := context.Background()
+	require.NoError(t, m.PutContent(ctx, "/blob", []byte("content")))
+
+	d.fail("GetContent", 2)
+	content, err := m.GetContent(ctx, "/blob")
+	require.NoError(t, err)
+	require.Equal(t, []byte("content"), content)
+	require.Equal(t, 3, d.callCount("GetContent"))
+	require.Equal(t, float64(2), retried.count("GetContent"))
+
+	d.fail("Stat", 1)
+	fi, err := m.Stat(ctx, "/blob")
+	require.NoError(t, err)
+	require.Equal(t, int64(len("content")), fi.Size())
+	require.Equal(t, float64(1), retried.count("Stat"))
+
+	d.fail("RedirectURL", 1)
+	url, err := m.RedirectURL(nil, "/blob")
+	require.NoError(t, err)
+	require.Equal(t, "https://example.com/blob", url)
+
+	require.Zero(t, exhausted.count("GetContent"))
+	require.Zero(t, exhausted.count("Stat"))
+}
+
+func TestRetryMaxAttempts(t *testing.T) {
+	retried, exhausted := recordMetrics(t)
+	d := newFlakyDriver()
+	m := newMiddleware(t, d, map[string]any{"maxattempts": 3})
+
+	d.fail("GetContent", 5)
+	_, err := m.GetContent(context.Background(), "/blob")
+	require.ErrorIs(t, err, errTransient)
+	require.Equal(t, 3, d.callCount("GetContent"))
+	require.Equal(t, float64(2), retried.count("GetContent"))
+	require.Equal(t, float64(1), exhausted.count("GetContent"))
+}
+
+func TestNoRetryOfPermanentErrors(t *testing.T) {
+	d := newFlakyDriver()
+	m := newMiddleware(t, d, map[string]any{})
+
+	_, err := m.Stat(context.Background(), "/missing")
+	require.ErrorAs(t, err, new(storagedriver.PathNotFoundError))
+	require.Equal(t, 1, d.callCount("Stat"))
+
+	d.err = errors.New("permanent failure")
+	d.fail("GetContent", 1)
+	_, err = m.GetContent(context.Background(), "/missing")
+	require.EqualError(t, err, "permanent failure")
+	require.Equal(t, 1, d.callCount("GetContent"))
+}
+
+func TestNoRetryOfMove(t *testing.T) {
+	d := newFlakyDriver()
+	m := newMiddleware(t, d, map[string]any{})
+	ctx := context.Background()
+	require.NoError(t, m.PutContent(ctx, "/source", []byte("content")))
+
+	d.fail("Move", 1)
+	require.ErrorIs(t, m.Move(ctx, "/source", "/dest"), errTransient)
+	require.Equal(t, 1, d.callCount("Move"))
+}
+
+func TestRetryDeadline(t *testing.T) {
+	d := newFlakyDriver()
+	m := newMiddleware(t, d, map[string]any{
+		"maxattempts":    100,
+		"initialbackoff": "20ms",
+		"maxbackoff":     "20ms",
+		"deadline":       "50ms",
+	})
+
+	d.fail("GetContent", 100)
+	start := time.Now()
+	_, err := m.GetContent(context.Background(), "/blob")
+	require.ErrorIs(t, err, errTransient)
+	require.Less(t, time.Since(start), time.Second)
+	// Waits of 10ms to 20ms fit at most 5 retries within the deadline.
+	require.LessOrEqual(t, d.callCount("GetContent"), 6)
+}
+
+func TestRetryContextCancelled(t *testing.T) {
+	d := newFlakyDriver()
+	m := newMiddleware(t, d, map[string]any{"initialbackoff": "1h", "maxbackoff": "1h", "deadline": "2h"})
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	d.fail("Stat", 1)
+	_, err := m.Stat(ctx, "/blob")
+	require.ErrorIs(t, err, errTransient)
+	require.Equal(t, 1, d.callCount("Stat"))
+}
+
+// TestWriterRetriesCommitOnly checks that writes are passed through once, and
+// that a retryable failure of Commit is retried.
+func TestWriterRetriesCommitOnly(t *testing.T) {
+	retried, _ := recordMetrics(t)
+	d := newFlakyDriver()
+	m := newMiddleware(t, d, map[string]any{})
+	ctx := context.Background()
+
+	w, err := m.Writer(ctx, "/upload", false)
+	require.NoError(t, err)
+	d.fail("Write", 1)
+	_, err = w.Write([]byte("content"))
+	require.ErrorIs(t, err, errTransient)
+	require.Equal(t, 1, d.callCount("Write"))
+
+	_, err = w.Write([]byte("content"))
+	require.NoError(t, err)
+	d.fail("Commit", 1)
+	require.NoError(t, w.Commit(ctx))
+	require.Equal(t, 2, d.callCount("Commit"))
+	require.Equal(t, float64(1), retried.count("Commit"))
+
+	content, err := m.GetContent(ctx, "/upload")
+	require.NoError(t, err)
+	require.Equal(t, []byte("content"), content)
+}
@@ -5,6 +5,7 @@ import (
 	"fmt"
 
 	storagedriver "github.com/distribution/distribution/v3/registry/storage/driver"
+	"github.com/distribution/distribution/v3/registry/storage/driver/factory"
 )
 
 // InitFunc is the type of a StorageMiddleware factory function and is
@@ -38,3 +39,52 @@ func Get(ctx context.Context, name string, options map[string]any, storageDriver
 
 	return nil, fmt.Errorf("no storage middleware registered with name: %s", name)
 }
+
+// CreateDriver constructs the storage driver configured by a middleware
+// option. As in the storage section of the configuration, the option maps the
+// name of a single storage driver to its parameters.
+func CreateDriver(ctx context.Context, option any) (storagedriver.StorageDriver, error) {
+	drivers := make(map[string]any)
+	switch v := option.(type) {
+	case map[string]any:
+		drivers = v
+	case map[any]any:
+		for k, params := range v {
+			name, ok := k.(string)
+			if !ok {
+				return nil, fmt.Errorf("storage driver name must be a string, %v invalid", k)
+			}
+			drivers[name] = params
+		}
+	default:
+		return nil, fmt.Errorf("storage driver must be a map of a driver name to its parameters, %v invalid", option)
+	}
+	if len(drivers) != 1 {
+		return nil, fmt.Errorf("exactly one storage driver must be configured, %d provided", len(drivers))
+	}
+
+	var (
+		name string
+		p    any
+	)
+	for n, params := range drivers {
+		name, p = n, params
+	}
+	params := make(map[string]any)
+	switch v := p.(type) {
+	case nil:
+	case map[string]any:
+		params = v
+	case map[any]any:
+		for k, param := range v {
+			key, ok := k.(string)
+			if !ok {
+				return nil, fmt.Errorf("parameter names of storage driver %s must be strings, %v invalid", name, k)
+			}
+			params[key] = param
+		}
+	default:
+		return nil, fmt.Errorf("parameters of storage driver %s must be a map, %v invalid", name, p)
+	}
+	return factory.Create(ctx, name, params)
+}
@@ -0,0 +1,988 @@
+// Package ocios provides a storagedriver.StorageDriver implementation to
+// store blobs in Oracle Cloud Infrastructure (OCI) Object Storage.
+//
+// Because OCI Object Storage is a key, value store the Stat call does not
+// support last modification time for directories (directories are an
+// abstraction for key, value stores).
+//
+// Unfinished uploads are kept as upload session objects at their path. They
+// cannot be read or stat'ed, but as object listings do not carry the content
+// type of objects, they are listed until they are committed or cancelled.
+package ocios
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strconv"
+	"strings"
+	"time"
+
+	storagedriver "github.com/distribution/distribution/v3/registry/storage/driver"
+	"github.com/distribution/distribution/v3/registry/storage/driver/base"
+	"github.com/distribution/distribution/v3/registry/storage/driver/factory"
+	"github.com/oracle/oci-go-sdk/v65/common"
+	"github.com/oracle/oci-go-sdk/v65/common/auth"
+	"github.com/oracle/oci-go-sdk/v65/objectstorage"
+)
+
+const (
+	driverName = "ocios"
+
+	// minChunkSize is the smallest part of a multipart upload the driver
+	// uses. OCI accepts smaller parts, but recommends against them.
+	minChunkSize     = 10 * 1024 * 1024
+	maxChunkSize     = 50 * 1024 * 1024 * 1024
+	defaultChunkSize = 16 * 1024 * 1024
+
+	// listMax is the largest number of objects returned by a listing.
+	listMax = 1000
+
+	defaultMaxConcurrency = 50
+	minConcurrency        = 25
+
+	uploadSessionContentType = "application/x-docker-upload-session"
+	blobContentType          = "application/octet-stream"
+
+	// Metadata keys of upload sessions.
+	metaUploadID = "upload-id"
+	metaOffset   = "offset"
+	metaParts    = "parts"
+
+	redirectExpiry = 20 * time.Minute
+)
+
+// Authentication methods.
+const (
+	authConfigFile        = "configfile"
+	authInstancePrincipal = "instanceprincipal"
+)
+
+// DriverParameters is a struct that encapsulates all of the driver parameters after all values have been set
+type DriverParameters struct {
+	Namespace     string
+	Bucket        string
+	Region        string
+	RootDirectory string
+	ChunkSize     int
+
+	// Endpoint overrides the endpoint of the region, e.g. to reach
+	// Object Storage through a private endpoint.
+	Endpoint string
+
+	// ConfigurationProvider provides the credentials used to sign requests.
+	ConfigurationProvider common.ConfigurationProvider
+
+	// MaxConcurrency limits the number of concurrent driver operations
+	// to OCI.
+	MaxConcurrency uint64
+}
+
+func init() {
+	factory.Register(driverName, &ociosDriverFactory{})
+}
+
+// ociosDriverFactory implements the factory.StorageDriverFactory interface
+type ociosDriverFactory struct{}
+
+// Create StorageDriver from parameters
+func (factory *ociosDriverFactory) Create(ctx context.Context, parameters map[string]any) (storagedriver.StorageDriver, error) {
+	return FromParameters(ctx, parameters)
+}
+
+var _ storagedriver.StorageDriver = &driver{}
+
+// driver is a storagedriver.StorageDriver implementation backed by OCI
+// Object Storage. Objects are stored at absolute keys in the provided
+// bucket.
+type driver struct {
+	client        objectstorage.ObjectStorageClient
+	namespace     string
+	bucket        string
+	rootDirectory string
+	chunkSize     int
+}
+
+// Wrapper wraps `driver` with a throttler, ensuring that no more than N
+// OCI actions can occur concurrently.
+type Wrapper struct {
+	baseEmbed
+}
+
+type baseEmbed struct {
+	base.Base
+}
+
+// FromParameters constructs a new Driver with a given parameters map
+// Required parameters:
+// - namespace
+// - bucket
+func FromParameters(ctx context.Context, parameters map[string]any) (storagedriver.StorageDriver, error) {
+	params := DriverParameters{
+		ChunkSize: defaultChunkSize,
+	}
+
+	for name, dst := range map[string]*string{
+		"namespace": &params.Namespace,
+		"bucket":    &params.Bucket,
+	} {
+		v, ok := parameters[name]
+		if !ok || fmt.Sprint(v) == "" {
+			return nil, fmt.Errorf("no %s parameter provided", name)
+		}
+		*dst = fmt.Sprint(v)
+	}
+
+	for name, dst := range map[string]*string{
+		"region":        &params.Region,
+		"rootdirectory": &params.RootDirectory,
+		"endpoint":      &params.Endpoint,
+	} {
+		if v, ok := parameters[name]; ok && v != nil {
+			*dst = fmt.Sprint(v)
+		}
+	}
+
+	if chunkSizeParam, ok := parameters["chunksize"]; ok {
+		switch v := chunkSizeParam.(type) {
+		case string:
+			vv, err := strconv.Atoi(v)
+			if err != nil {
+				return nil, fmt.Errorf("chunksize must be an integer, %v invalid", chunkSizeParam)
+			}
+			params.ChunkSize = vv
+		case int, uint, int32, uint32, uint64, int64:
+			params.ChunkSize = int(reflect.ValueOf(v).Convert(reflect.TypeFor[int]()).Int())
+		default:
+			return nil, fmt.Errorf("invalid value for chunksize: %#v", chunkSizeParam)
+		}
+	}
+
+	maxConcurrency, err := base.GetLimitFromParameter(parameters["maxconcurrency"], minConcurrency, defaultMaxConcurrency)
+	if err != nil {
+		return nil, fmt.Errorf("maxconcurrency config error: %s", err)
+	}
+	params.MaxConcurrency = maxConcurrency
+
+	params.ConfigurationProvider, err = configurationProvider(parameters)
+	if err != nil {
+		return nil, err
+	}
+
+	return New(ctx, params)
+}
+
+// configurationProvider returns the provider of the credentials selected by
+// the auth parameter.
+func configurationProvider(parameters map[string]any) (common.ConfigurationProvider, error) {
+	method := authConfigFile
+	if v, ok := parameters["auth"]; ok && fmt.Sprint(v) != "" {
+		method = strings.ToLower(fmt.Sprint(v))
+	}
+
+	switch method {
+	case authConfigFile:
+		path := ""
+		if v, ok := parameters["configfile"]; ok && v != nil {
+			path = fmt.Sprint(v)
+		}
+		if path == "" {
+			home, err := os.UserHomeDir()
+			if err != nil {
+				return nil, fmt.Errorf("no configfile parameter provided: %v", err)
+			}
+			path = filepath.Join(home, ".oci", "config")
+		}
+		profile := "DEFAULT"
+		if v, ok := parameters["profile"]; ok && fmt.Sprint(v) != "" {
+			profile = fmt.Sprint(v)
+		}
+		passphrase := ""
+		if v, ok := parameters["keypassphrase"]; ok && v != nil {
+			passphrase = fmt.Sprint(v)
+		}
+		return common.ConfigurationProviderFromFileWithProfile(path, profile, passphrase)
+	case authInstancePrincipal:
+		provider, err := auth.InstancePrincipalConfigurationProvider()
+		if err != nil {
+			return nil, fmt.Errorf("instance principal authentication: %v", err)
+		}
+		return provider, nil
+	default:
+		return nil, fmt.Errorf("auth must be %s or %s, %s invalid", authConfigFile, authInstancePrincipal, method)
+	}
+}
+
+// New constructs a new driver
+func New(ctx context.Context, params DriverParameters) (storagedriver.StorageDriver, error) {
+	if params.Namespace == "" || params.Bucket == "" {
+		return nil, fmt.Errorf("namespace and bucket must be provided")
+	}
+	if params.ChunkSize < minChunkSize || params.ChunkSize > maxChunkSize {
+		return nil, fmt.Errorf("chunksize %d must be between %d and %d", params.ChunkSize, minChunkSize, maxChunkSize)
+	}
+	if params.ConfigurationProvider == nil {
+		return nil, fmt.Errorf("no configuration provider provided")
+	}
+	if params.MaxConcurrency == 0 {
+		params.MaxConcurrency = defaultMaxConcurrency
+	}
+
+	d, err := newDriver(params)
+	if err != nil {
+		return nil, err
+	}
+
+	return &Wrapper{
+		baseEmbed: baseEmbed{
+			Base: base.Base{
+				StorageDriver: base.NewRegulator(d, params.MaxConcurrency),
+			},
+		},
+	}, nil
+}
+
+// newDriver constructs the driver behind the throttler.
+func newDriver(params DriverParameters) (*driver, error) {
+	client, err := objectstorage.NewObjectStorageClientWithConfigurationProvider(params.ConfigurationProvider)
+	if err != nil {
+		return nil, err
+	}
+	if params.Region != "" {
+		client.SetRegion(params.Region)
+	}
+	if params.Endpoint != "" {
+		client.Host = params.Endpoint
+	}
+
+	rootDirectory := strings.Trim(params.RootDirectory, "/")
+	if rootDirectory != "" {
+		rootDirectory += "/"
+	}
+
+	return &driver{
+		client:        client,
+		namespace:     params.Namespace,
+		bucket:        params.Bucket,
+		rootDirectory: rootDirectory,
+		chunkSize:     params.ChunkSize,
+	}, nil
+}
+
+// Implement the storagedriver.StorageDriver interface
+
+func (d *driver) Name() string {
+	return driverName
+}
+
+// GetContent retrieves the content stored at "path" as a []byte.
+// This should primarily be used for small objects.
+func (d *driver) GetContent(ctx context.Context, path string) ([]byte, error) {
+	r, err := d.Reader(ctx, path, 0)
+	if err != nil {
+		return nil, err
+	}
+	defer r.Close()
+
+	return io.ReadAll(r)
+}
+
+// PutContent stores the []byte content at a location designated by "path".
+// This should primarily be used for small objects.
+func (d *driver) PutContent(ctx context.Context, path string, contents []byte) error {
+	return d.putObject(ctx, d.pathToKey(path), blobContentType, nil, contents)
+}
+
+// Reader retrieves an io.ReadCloser for the content stored at "path"
+// with a given byte offset.
+// May be used to resume reading a stream by providing a nonzero offset.
+func (d *driver) Reader(ctx context.Context, path string, offset int64) (io.ReadCloser, error) {
+	if offset < 0 {
+		return nil, storagedriver.InvalidOffsetError{Path: path, Offset: offset}
+	}
+
+	req := objectstorage.GetObjectRequest{
+		NamespaceName: &d.namespace,
+		BucketName:    &d.bucket,
+		ObjectName:    common.String(d.pathToKey(path)),
+	}
+	if offset > 0 {
+		req.Range = common.String("bytes=" + strconv.FormatInt(offset, 10) + "-")
+	}
+	resp, err := d.client.GetObject(ctx, req)
+	if err != nil {
+		if isNotFound(err) {
+			return nil, storagedriver.PathNotFoundError{Path: path}
+		}
+		if statusCode(err) == http.StatusRequestedRangeNotSatisfiable {
+			// Reading from the end of the object, or past it, yields no content.
+			return io.NopCloser(bytes.NewReader(nil)), nil
+		}
+		return nil, err
+	}
+	if deref(resp.ContentType) == uploadSessionContentType {
+		resp.Content.Close()
+		return nil, storagedriver.PathNotFoundError{Path: path}
+	}
+	return resp.Content, nil
+}
+
+// Writer returns a FileWriter which will store the content written to it
+// at the location designated by "path" after the call to Commit.
+func (d *driver) Writer(ctx context.Context, path string, appendMode bool) (storagedriver.FileWriter, error) {
+	w := &writer{
+		ctx:    ctx,
+		driver: d,
+		key:    d.pathToKey(path),
+		buffer: make([]byte, 0, d.chunkSize),
+	}
+
+	if appendMode {
+		err := w.init(ctx, path)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return w, nil
+}
+
+// Stat retrieves the FileInfo for the given path, including the current
+// size in bytes and the creation time.
+func (d *driver) Stat(ctx context.Context, path string) (storagedriver.FileInfo, error) {
+	key := d.pathToKey(path)
+	if key != "" {
+		// try to get as file
+		head, err := d.headObject(ctx, key)
+		if err != nil {
+			return nil, err
+		}
+		if head != nil {
+			if deref(head.ContentType) == uploadSessionContentType {
+				return nil, storagedriver.PathNotFoundError{Path: path}
+			}
+			fi := storagedriver.FileInfoFields{
+				Path: path,
+				Size: deref(head.ContentLength),
+			}
+			if head.LastModified != nil {
+				fi.ModTime = head.LastModified.Time
+			}
+			return storagedriver.FileInfoInternal{FileInfoFields: fi}, nil
+		}
+	}
+
+	// try to get as folder
+	resp, err := d.client.ListObjects(ctx, objectstorage.ListObjectsRequest{
+		NamespaceName: &d.namespace,
+		BucketName:    &d.bucket,
+		Prefix:        common.String(d.pathToDirKey(path)),
+		Limit:         common.Int(1),
+	})
+	if err != nil {
+		return nil, err
+	}
+	if len(resp.Objects) == 0 {
+		return nil, storagedriver.PathNotFoundError{Path: path}
+	}
+	return storagedriver.FileInfoInternal{FileInfoFields: storagedriver.FileInfoFields{
+		Path:  path,
+		IsDir: true,
+	}}, nil
+}
+
+// List returns a list of the objects that are direct descendants of the
+// given path.
+func (d *driver) List(ctx context.Context, path string) ([]string, error) {
+	infos, err := d.listFileInfos(ctx, path)
+	if err != nil {
+		return nil, err
+	}
+	list := make([]string, 0, len(infos))
+	for _, fi := range infos {
+		list = append(list, fi.Path())
+	}
+	return list, nil
+}
+
+// listFileInfos returns the FileInfo of the direct descendants of the
+// given path, from a single delimited listing.
+func (d *driver) listFileInfos(ctx context.Context, path string) ([]storagedriver.FileInfo, error) {
+	prefix := d.pathToDirKey(path)
+
+	infos := make([]storagedriver.FileInfo, 0, 64)
+	var start *string
+	for {
+		resp, err := d.client.ListObjects(ctx, objectstorage.ListObjectsRequest{
+			NamespaceName: &d.namespace,
+			BucketName:    &d.bucket,
+			Prefix:        &prefix,
+			Start:         start,
+			Delimiter:     common.String("/"),
+			Fields:        common.String("name,size,timeModified"),
+			Limit:         common.Int(listMax),
+		})
+		if err != nil {
+			return nil, err
+		}
+		for _, p := range resp.Prefixes {
+			infos = append(infos, storagedriver.FileInfoInternal{FileInfoFields: storagedriver.FileInfoFields{
+				Path:  d.keyToPath(p),
+				IsDir: true,
+			}})
+		}
+		for _, o := range resp.Objects {
+			name := deref(o.Name)
+			if name == prefix {
+				// A directory marker, created by another tool.
+				continue
+			}
+			fi := storagedriver.FileInfoFields{
+				Path: d.keyToPath(name),
+				Size: deref(o.Size),
+			}
+			if o.TimeModified != nil {
+				fi.ModTime = o.TimeModified.Time
+			}
+			infos = append(infos, storagedriver.FileInfoInternal{FileInfoFields: fi})
+		}
+		if resp.NextStartWith == nil {
+			break
+		}
+		start = resp.NextStartWith
+	}
+
+	if path != "/" && len(infos) == 0 {
+		// Treat empty response as missing directory, since we don't actually
+		// have directories in OCI Object Storage.
+		return nil, storagedriver.PathNotFoundError{Path: path}
+	}
+	return infos, nil
+}
+
+// Move moves an object stored at sourcePath to destPath, removing the
+// original object.
+func (d *driver) Move(ctx context.Context, sourcePath string, destPath string) error {
+	srcKey, dstKey := d.pathToKey(sourcePath), d.pathToKey(destPath)
+	src, err := d.headObject(ctx, srcKey)
+	if err != nil {
+		return err
+	}
+	if src == nil || deref(src.ContentType) == uploadSessionContentType {
+		return storagedriver.PathNotFoundError{Path: sourcePath}
+	}
+
+	_, err = d.client.RenameObject(ctx, objectstorage.RenameObjectRequest{
+		NamespaceName: &d.namespace,
+		BucketName:    &d.bucket,
+		RenameObjectDetails: objectstorage.RenameObjectDetails{
+			SourceName: &srcKey,
+			NewName:    &dstKey,
+		},
+	})
+	if isNotFound(err) {
+		return storagedriver.PathNotFoundError{Path: sourcePath}
+	}
+	if err != nil {
+		return fmt.Errorf("move %q to %q: %v", srcKey, dstKey, err)
+	}
+	return nil
+}
+
+// Delete recursively deletes all objects stored at "path" and its subpaths,
+// and aborts the multipart uploads of the unfinished uploads among them.
+func (d *driver) Delete(ctx context.Context, path string) error {
+	var keys []string
+	prefix := d.pathToDirKey(path)
+	if key := d.pathToKey(path); key != "" {
+		head, err := d.headObject(ctx, key)
+		if err != nil {
+			return err
+		}
+		if head != nil {
+			keys = append(keys, key)
+		}
+	}
+
+	var start *string
+	for {
+		resp, err := d.client.ListObjects(ctx, objectstorage.ListObjectsRequest{
+			NamespaceName: &d.namespace,
+			BucketName:    &d.bucket,
+			Prefix:        &prefix,
+			Start:         start,
+			Limit:         common.Int(listMax),
+		})
+		if err != nil {
+			return err
+		}
+		for _, o := range resp.Objects {
+			keys = append(keys, deref(o.Name))
+		}
+		if resp.NextStartWith == nil {
+			break
+		}
+		start = resp.NextStartWith
+	}
+
+	if len(keys) == 0 {
+		return storagedriver.PathNotFoundError{Path: path}
+	}
+
+	if err := d.abortUploads(ctx, d.pathToKey(path)); err != nil {
+		return err
+	}
+	for _, key := range keys {
+		if err := d.deleteObject(ctx, key); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// abortUploads aborts the multipart uploads of the object key and of the
+// objects below it.
+func (d *driver) abortUploads(ctx context.Context, key string) error {
+	var page *string
+	for {
+		resp, err := d.client.ListMultipartUploads(ctx, objectstorage.ListMultipartUploadsRequest{
+			NamespaceName: &d.namespace,
+			BucketName:    &d.bucket,
+			Page:          page,
+			Limit:         common.Int(listMax),
+		})
+		if err != nil {
+			return err
+		}
+		for _, u := range resp.Items {
+			object := deref(u.Object)
+			if key != "" && object != key && !strings.HasPrefix(object, key+"/") {
+				continue
+			}
+			if err := d.abortUpload(ctx, object, deref(u.UploadId)); err != nil {
+				return err
+			}
+		}
+		if resp.OpcNextPage == nil {
+			return nil
+		}
+		page = resp.OpcNextPage
+	}
+}
+
+// RedirectURL returns a URL which may be used to retrieve the content stored at
+// the given path, possibly using the given options. The URL is that of a
+// pre-authenticated request, which expires after redirectExpiry.
+func (d *driver) RedirectURL(r *http.Request, path string) (string, error) {
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		return "", nil
+	}
+
+	name := make([]byte, 8)
+	if _, err := rand.Read(name); err != nil {
+		return "", err
+	}
+	resp, err := d.client.CreatePreauthenticatedRequest(r.Context(), objectstorage.CreatePreauthenticatedRequestRequest{
+		NamespaceName: &d.namespace,
+		BucketName:    &d.bucket,
+		CreatePreauthenticatedRequestDetails: objectstorage.CreatePreauthenticatedRequestDetails{
+			Name:        common.String("registry-" + hex.EncodeToString(name)),
+			ObjectName:  common.String(d.pathToKey(path)),
+			AccessType:  objectstorage.CreatePreauthenticatedRequestDetailsAccessTypeObjectread,
+			TimeExpires: &common.SDKTime{Time: time.Now().Add(redirectExpiry)},
+		},
+	})
+	if err != nil {
+		return "", err
+	}
+	return strings.TrimRight(d.client.Host, "/") + deref(resp.AccessUri), nil
+}
+
+// Walk traverses a filesystem defined within driver, starting
+// from the given path, calling f on each file
+func (d *driver) Walk(ctx context.Context, path string, f storagedriver.WalkFn, options ...func(*storagedriver.WalkOptions)) error {
+	walkOptions := &storagedriver.WalkOptions{}
+	for _, o := range options {
+		o(walkOptions)
+	}
+	if walkOptions.Parallelism > 1 {
+		return storagedriver.WalkParallel(ctx, path, d.listFileInfos, f, options...)
+	}
+	return storagedriver.WalkFallback(ctx, d, path, f, options...)
+}
+
+// headObject returns the metadata of the object key, or nil if there is none.
+func (d *driver) headObject(ctx context.Context, key string) (*objectstorage.HeadObjectResponse, error) {
+	resp, err := d.client.HeadObject(ctx, objectstorage.HeadObjectRequest{
+		NamespaceName: &d.namespace,
+		BucketName:    &d.bucket,
+		ObjectName:    &key,
+	})
+	if isNotFound(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &resp, nil
+}
+
+func (d *driver) putObject(ctx context.Context, key, contentType string, meta map[string]string, contents []byte) error {
+	_, err := d.client.PutObject(ctx, objectstorage.PutObjectRequest{
+		NamespaceName: &d.namespace,
+		BucketName:    &d.bucket,
+		ObjectName:    &key,
+		ContentLength: common.Int64(int64(len(contents))),
+		ContentType:   &contentType,
+		OpcMeta:       meta,
+		PutObjectBody: io.NopCloser(bytes.NewReader(contents)),
+	})
+	return err
+}
+
+func (d *driver) deleteObject(ctx context.Context, key string) error {
+	_, err := d.client.DeleteObject(ctx, objectstorage.DeleteObjectRequest{
+		NamespaceName: &d.namespace,
+		BucketName:    &d.bucket,
+		ObjectName:    &key,
+	})
+	// Another request may have deleted the same object concurrently.
+	if isNotFound(err) {
+		err = nil
+	}
+	return err
+}
+
+func (d *driver) abortUpload(ctx context.Context, key, uploadID string) error {
+	_, err := d.client.AbortMultipartUpload(ctx, objectstorage.AbortMultipartUploadRequest{
+		NamespaceName: &d.namespace,
+		BucketName:    &d.bucket,
+		ObjectName:    &key,
+		UploadId:      &uploadID,
+	})
+	if isNotFound(err) {
+		err = nil
+	}
+	return err
+}
+
+func (d *driver) pathToKey(path string) string {
+	return strings.TrimSpace(strings.TrimRight(d.rootDirectory+strings.TrimLeft(path, "/"), "/"))
+}
+
+func (d *driver) pathToDirKey(path string) string {
+	if key := d.pathToKey(path); key != "" {
+		return key + "/"
+	}
+	return ""
+}
+
+func (d *driver) keyToPath(key string) string {
+	return "/" + strings.Trim(strings.TrimPrefix(key, d.rootDirectory), "/")
+}
+
+// statusCode returns the HTTP status code of a service error, or 0.
+func statusCode(err error) int {
+	if serviceErr, ok := common.IsServiceError(err); ok {
+		return serviceErr.GetHTTPStatusCode()
+	}
+	return 0
+}
+
+func isNotFound(err error) bool {
+	return statusCode(err) == http.StatusNotFound
+}
+
+var _ storagedriver.FileWriter = &writer{}
+
+// writer uploads content as the parts of a multipart upload. Content is
+// buffered until a full chunk is written and more content follows, so the
+// buffer is never empty once a multipart upload is started.
+//
+// On Close, the buffered content is stored at the path of the writer as an
+// upload session, along with the ID of the multipart upload and the number
+// of parts uploaded so far, so the upload can be resumed.
+type writer struct {
+	ctx       context.Context
+	driver    *driver
+	key       string
+	size      int64
+	offset    int64
+	closed    bool
+	cancelled bool
+	committed bool
+
+	uploadID string
+	parts    []objectstorage.CommitMultipartUploadPartDetails
+	buffer   []byte
+}
+
+// Cancel removes any written content from this FileWriter.
+func (w *writer) Cancel(ctx context.Context) error {
+	w.closed = true
+	w.cancelled = true
+
+	if w.uploadID != "" {
+		if err := w.driver.abortUpload(ctx, w.key, w.uploadID); err != nil {
+			return err
+		}
+	}
+	return w.driver.deleteObject(ctx, w.key)
+}
+
+func (w *writer) Close() error {
+	if w.closed {
+		return nil
+	}
+	w.closed = true
+
+	// store the remaining bytes in the upload session
+	meta := map[string]string{
+		metaOffset: strconv.FormatInt(w.offset, 10),
+		metaParts:  strconv.Itoa(len(w.parts)),
+	}
+	if w.uploadID != "" {
+		meta[metaUploadID] = w.uploadID
+	}
+	if err := w.driver.putObject(w.ctx, w.key, uploadSessionContentType, meta, w.buffer); err != nil {
+		return err
+	}
+	w.size = w.offset + int64(len(w.buffer))
+	return nil
+}
+
+// Commit flushes all content written to this FileWriter and makes it
+// available for future calls to StorageDriver.GetContent and
+// StorageDriver.Reader.
+func (w *writer) Commit(ctx context.Context) error {
+	if w.closed {
+		return fmt.Errorf("already closed")
+	}
+	w.closed = true
+
+	if w.uploadID == "" {
+		// no multipart upload started yet just perform a simple upload
+		if err := w.driver.putObject(ctx, w.key, blobContentType, nil, w.buffer); err != nil {
+			return err
+		}
+	} else {
+		if err := w.uploadPart(ctx); err != nil {
+			return err
+		}
+		_, err := w.driver.client.CommitMultipartUpload(ctx, objectstorage.CommitMultipartUploadRequest{
+			NamespaceName: &w.driver.namespace,
+			BucketName:    &w.driver.bucket,
+			ObjectName:    &w.key,
+			UploadId:      &w.uploadID,
+			CommitMultipartUploadDetails: objectstorage.CommitMultipartUploadDetails{
+				PartsToCommit: w.parts,
+			},
+		})
+		if err != nil {
+			return err
+		}
+	}
+	w.committed = true
+	w.size = w.offset + int64(len(w.buffer))
+	w.buffer = w.buffer[:0]
+	return nil
+}
+
+// uploadPart uploads the buffer as the next part of the multipart upload,
+// starting the multipart upload if needed.
+func (w *writer) uploadPart(ctx context.Context) error {
+	if w.uploadID == "" {
+		resp, err := w.driver.client.CreateMultipartUpload(ctx, objectstorage.CreateMultipartUploadRequest{
+			NamespaceName: &w.driver.namespace,
+			BucketName:    &w.driver.bucket,
+			CreateMultipartUploadDetails: objectstorage.CreateMultipartUploadDetails{
+				Object:      &w.key,
+				ContentType: common.String(blobContentType),
+			},
+		})
+		if err != nil {
+			return err
+		}
+		w.uploadID = deref(resp.UploadId)
+	}
+
+	partNum := len(w.parts) + 1
+	resp, err := w.driver.client.UploadPart(ctx, objectstorage.UploadPartRequest{
+		NamespaceName:  &w.driver.namespace,
+		BucketName:     &w.driver.bucket,
+		ObjectName:     &w.key,
+		UploadId:       &w.uploadID,
+		UploadPartNum:  &partNum,
+		ContentLength:  common.Int64(int64(len(w.buffer))),
+		UploadPartBody: io.NopCloser(bytes.NewReader(w.buffer)),
+	})
+	if err != nil {
+		return err
+	}
+	w.parts = append(w.parts, objectstorage.CommitMultipartUploadPartDetails{
+		PartNum: &partNum,
+		Etag:    resp.ETag,
+	})
+	w.offset += int64(len(w.buffer))
+	w.buffer = w.buffer[:0]
+	return nil
+}
+
+func (w *writer) Write(p []byte) (int, error) {
+	if w.closed {
+		return 0, fmt.Errorf("already closed")
+	} else if w.cancelled {
+		return 0, fmt.Errorf("already cancelled")
+	}
+
+	var (
+		written int
+		err     error
+	)
+	for written < len(p) {
+		if len(w.buffer) == w.driver.chunkSize {
+			if err = w.uploadPart(w.ctx); err != nil {
+				break
+			}
+		}
+		n := min(w.driver.chunkSize-len(w.buffer), len(p)-written)
+		w.buffer = append(w.buffer, p[written:written+n]...)
+		written += n
+	}
+	w.size = w.offset + int64(len(w.buffer))
+	return written, err
+}
+
+// Size returns the number of bytes written to this FileWriter.
+func (w *writer) Size() int64 {
+	return w.size
+}
+
+// init resumes the upload session, or the committed object, stored at the
+// path of the writer.
+func (w *writer) init(ctx context.Context, path string) error {
+	head, err := w.driver.headObject(ctx, w.key)
+	if err != nil {
+		return err
+	}
+	if head == nil {
+		return storagedriver.PathNotFoundError{Path: path}
+	}
+
+	size := deref(head.ContentLength)
+	if deref(head.ContentType) == uploadSessionContentType {
+		meta := lowerKeys(head.OpcMeta)
+		if meta[metaOffset] != "" {
+			w.offset, err = strconv.ParseInt(meta[metaOffset], 10, 64)
+			if err != nil {
+				return err
+			}
+		}
+		if id := meta[metaUploadID]; id != "" {
+			parts, err := strconv.Atoi(meta[metaParts])
+			if err != nil {
+				return err
+			}
+			if err := w.resumeUpload(ctx, id, parts); err != nil {
+				return err
+			}
+		}
+	} else if size > int64(w.driver.chunkSize) {
+		// A committed object can only be appended to while it fits in the
+		// buffer, as the parts of a committed multipart upload cannot be
+		// changed.
+		return fmt.Errorf("cannot append to %s: committed object exceeds chunksize", path)
+	}
+
+	if size > 0 {
+		resp, err := w.driver.client.GetObject(ctx, objectstorage.GetObjectRequest{
+			NamespaceName: &w.driver.namespace,
+			BucketName:    &w.driver.bucket,
+			ObjectName:    &w.key,
+		})
+		if err != nil {
+			return err
+		}
+		defer resp.Content.Close()
+		w.buffer, err = io.ReadAll(io.LimitReader(resp.Content, int64(w.driver.chunkSize)))
+		if err != nil {
+			return err
+		}
+		w.buffer = append(make([]byte, 0, w.driver.chunkSize), w.buffer...)
+	}
+	w.size = w.offset + int64(len(w.buffer))
+	return nil
+}
+
+// resumeUpload restores the first parts uploaded to the multipart upload id.
+func (w *writer) resumeUpload(ctx context.Context, id string, parts int) error {
+	var (
+		size     int64
+		uploaded []objectstorage.CommitMultipartUploadPartDetails
+		page     *string
+	)
+	for {
+		resp, err := w.driver.client.ListMultipartUploadParts(ctx, objectstorage.ListMultipartUploadPartsRequest{
+			NamespaceName: &w.driver.namespace,
+			BucketName:    &w.driver.bucket,
+			ObjectName:    &w.key,
+			UploadId:      &id,
+			Page:          page,
+			Limit:         common.Int(listMax),
+		})
+		if err != nil {
+			return err
+		}
+		for _, p := range resp.Items {
+			num := deref(p.PartNumber)
+			if num > parts {
+				continue
+			}
+			if num != len(uploaded)+1 {
+				return fmt.Errorf("multipart upload %s is missing part %d", id, len(uploaded)+1)
+			}
+			uploaded = append(uploaded, objectstorage.CommitMultipartUploadPartDetails{
+				PartNum: common.Int(num),
+				Etag:    p.Etag,
+			})
+			size += deref(p.Size)
+		}
+		if resp.OpcNextPage == nil {
+			break
+		}
+		page = resp.OpcNextPage
+	}
+	if len(uploaded) != parts || size != w.offset {
+		return fmt.Errorf("multipart upload %s does not match upload session: %d bytes in %d parts, expected %d bytes in %d parts",
+			id, size, len(uploaded), w.offset, parts)
+	}
+
+	w.uploadID = id
+	w.parts = uploaded
+	return nil
+}
+
+// lowerKeys returns meta with lower case keys, as the case of metadata keys
+// is not preserved by HTTP headers.
+func lowerKeys(meta map[string]string) map[string]string {
+	lower := make(map[string]string, len(meta))
+	for k, v := range meta {
+		lower[strings.ToLower(k)] = v
+	}
+	return lower
+}
+
+// deref returns the value p points to, or the zero value if p is nil.
+func deref[T any](p *T) T {
+	if p == nil {
+		var zero T
+		return zero
+	}
+	return *p
+}
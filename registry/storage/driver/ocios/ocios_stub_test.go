@@ -0,0 +1,537 @@
+package ocios
+
+import (
+	"bytes"
+	"crypto/md5"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/oracle/oci-go-sdk/v65/common"
+)
+
+const (
+	stubNamespace = "stub-namespace"
+	stubBucket    = "stub-bucket"
+
+	// stubPageSize is the largest page of a listing returned by the stub,
+	// so that the pagination of the driver is exercised.
+	stubPageSize = 3
+)
+
+// stubObject is an object stored by ociStub.
+type stubObject struct {
+	data        []byte
+	contentType string
+	meta        map[string]string
+	modified    time.Time
+}
+
+// stubUpload is a multipart upload in progress in ociStub.
+type stubUpload struct {
+	object      string
+	contentType string
+	created     time.Time
+	parts       map[int][]byte
+}
+
+// ociStub is an in-memory implementation of the parts of the OCI Object
+// Storage API used by the driver.
+type ociStub struct {
+	t        *testing.T
+	server   *httptest.Server
+	provider common.ConfigurationProvider
+
+	mu      sync.Mutex
+	nextID  int
+	objects map[string]*stubObject
+	uploads map[string]*stubUpload
+	pars    map[string]string
+	calls   []string
+}
+
+func newOCIStub(t *testing.T) *ociStub {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyPEM := pem.EncodeToMemory(&pem.Block{Type: "RSA PRIVATE KEY", Bytes: x509.MarshalPKCS1PrivateKey(key)})
+
+	s := &ociStub{
+		t:        t,
+		provider: common.NewRawConfigurationProvider("ocid1.tenancy.oc1..stub", "ocid1.user.oc1..stub", "us-ashburn-1", "00:00", string(keyPEM), nil),
+		objects:  make(map[string]*stubObject),
+		uploads:  make(map[string]*stubUpload),
+		pars:     make(map[string]string),
+	}
+	s.server = httptest.NewServer(http.HandlerFunc(s.serveHTTP))
+	t.Cleanup(s.server.Close)
+	return s
+}
+
+// driverParameters returns the parameters of a driver using the stub.
+func (s *ociStub) driverParameters() DriverParameters {
+	return DriverParameters{
+		Namespace:             stubNamespace,
+		Bucket:                stubBucket,
+		RootDirectory:         "/root",
+		Endpoint:              s.server.URL,
+		ChunkSize:             minChunkSize,
+		ConfigurationProvider: s.provider,
+	}
+}
+
+// newDriver returns an unwrapped driver using the stub.
+func (s *ociStub) newDriver() *driver {
+	d, err := newDriver(s.driverParameters())
+	if err != nil {
+		s.t.Fatal(err)
+	}
+	return d
+}
+
+// count returns how many times op was called.
+func (s *ociStub) count(op string) int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var n int
+	for _, c := range s.calls {
+		if c == op {
+			n++
+		}
+	}
+	return n
+}
+
+// object returns the object name, or nil if there is none.
+func (s *ociStub) object(name string) *stubObject {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.objects[name]
+}
+
+// uploadCount returns the number of multipart uploads in progress.
+func (s *ociStub) uploadCount() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return len(s.uploads)
+}
+
+func (s *ociStub) serveHTTP(w http.ResponseWriter, r *http.Request) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if strings.HasPrefix(r.URL.Path, "/p/") {
+		s.readPAR(w, r)
+		return
+	}
+	if r.Header.Get("Authorization") == "" {
+		writeError(w, http.StatusUnauthorized, "NotAuthenticated", "missing signature")
+		return
+	}
+
+	bucketPath := "/n/" + stubNamespace + "/b/" + stubBucket + "/"
+	if !strings.HasPrefix(r.URL.Path, bucketPath) {
+		writeError(w, http.StatusNotFound, "BucketNotFound", r.URL.Path)
+		return
+	}
+	kind, name, _ := strings.Cut(strings.TrimPrefix(r.URL.Path, bucketPath), "/")
+	query := r.URL.Query()
+
+	var op string
+	switch {
+	case kind == "o" && name == "" && r.Method == http.MethodGet:
+		op = "ListObjects"
+		s.listObjects(w, query.Get("prefix"), query.Get("start"), query.Get("delimiter"))
+	case kind == "o" && r.Method == http.MethodGet:
+		op = "GetObject"
+		s.getObject(w, r, name)
+	case kind == "o" && r.Method == http.MethodHead:
+		op = "HeadObject"
+		s.headObject(w, name)
+	case kind == "o" && r.Method == http.MethodPut:
+		op = "PutObject"
+		s.putObject(w, r, name)
+	case kind == "o" && r.Method == http.MethodDelete:
+		op = "DeleteObject"
+		if _, ok := s.objects[name]; !ok {
+			writeError(w, http.StatusNotFound, "ObjectNotFound", name)
+			break
+		}
+		delete(s.objects, name)
+		w.WriteHeader(http.StatusNoContent)
+	case kind == "actions" && name == "renameObject":
+		op = "RenameObject"
+		s.renameObject(w, r)
+	case kind == "u" && name == "" && r.Method == http.MethodPost:
+		op = "CreateMultipartUpload"
+		s.createMultipartUpload(w, r)
+	case kind == "u" && name == "" && r.Method == http.MethodGet:
+		op = "ListMultipartUploads"
+		s.listMultipartUploads(w)
+	case kind == "u":
+		upload, ok := s.uploads[query.Get("uploadId")]
+		if !ok || upload.object != name {
+			writeError(w, http.StatusNotFound, "NoSuchUpload", query.Get("uploadId"))
+			break
+		}
+		switch r.Method {
+		case http.MethodPut:
+			op = "UploadPart"
+			s.uploadPart(w, r, upload, query.Get("uploadPartNum"))
+		case http.MethodPost:
+			op = "CommitMultipartUpload"
+			s.commitMultipartUpload(w, r, query.Get("uploadId"), upload)
+		case http.MethodDelete:
+			op = "AbortMultipartUpload"
+			delete(s.uploads, query.Get("uploadId"))
+			w.WriteHeader(http.StatusNoContent)
+		case http.MethodGet:
+			op = "ListMultipartUploadParts"
+			s.listParts(w, upload, query.Get("page"))
+		}
+	case kind == "p" && r.Method == http.MethodPost:
+		op = "CreatePreauthenticatedRequest"
+		s.createPAR(w, r)
+	default:
+		writeError(w, http.StatusNotImplemented, "NotImplemented", r.Method+" "+r.URL.Path)
+	}
+	s.calls = append(s.calls, op)
+}
+
+func (s *ociStub) listObjects(w http.ResponseWriter, prefix, start, delimiter string) {
+	type entry struct {
+		key    string
+		object *stubObject
+	}
+	var entries []entry
+	seen := make(map[string]bool)
+	for name, o := range s.objects {
+		if !strings.HasPrefix(name, prefix) {
+			continue
+		}
+		if delimiter != "" {
+			if i := strings.Index(name[len(prefix):], delimiter); i >= 0 {
+				p := name[:len(prefix)+i+len(delimiter)]
+				if !seen[p] {
+					seen[p] = true
+					entries = append(entries, entry{key: p})
+				}
+				continue
+			}
+		}
+		entries = append(entries, entry{key: name, object: o})
+	}
+	sort.Slice(entries, func(i, j int) bool { return entries[i].key < entries[j].key })
+
+	type summary struct {
+		Name         string          `json:"name"`
+		Size         int64           `json:"size"`
+		TimeModified *common.SDKTime `json:"timeModified"`
+	}
+	resp := struct {
+		Objects       []summary `json:"objects"`
+		Prefixes      []string  `json:"prefixes,omitempty"`
+		NextStartWith string    `json:"nextStartWith,omitempty"`
+	}{Objects: []summary{}}
+	var n int
+	for _, e := range entries {
+		if e.key < start {
+			continue
+		}
+		if n == stubPageSize {
+			resp.NextStartWith = e.key
+			break
+		}
+		n++
+		if e.object == nil {
+			resp.Prefixes = append(resp.Prefixes, e.key)
+			continue
+		}
+		resp.Objects = append(resp.Objects, summary{
+			Name:         e.key,
+			Size:         int64(len(e.object.data)),
+			TimeModified: &common.SDKTime{Time: e.object.modified},
+		})
+	}
+	writeJSON(w, http.StatusOK, resp)
+}
+
+func (s *ociStub) getObject(w http.ResponseWriter, r *http.Request, name string) {
+	o, ok := s.objects[name]
+	if !ok {
+		writeError(w, http.StatusNotFound, "ObjectNotFound", name)
+		return
+	}
+	data := o.data
+	status := http.StatusOK
+	if rng := r.Header.Get("Range"); rng != "" {
+		offset, err := strconv.Atoi(strings.TrimSuffix(strings.TrimPrefix(rng, "bytes="), "-"))
+		if err != nil {
+			writeError(w, http.StatusBadRequest, "InvalidRange", rng)
+			return
+		}
+		if offset >= len(data) {
+			writeError(w, http.StatusRequestedRangeNotSatisfiable, "InvalidRange", rng)
+			return
+		}
+		w.Header().Set("Content-Range", fmt.Sprintf("bytes %d-%d/%d", offset, len(data)-1, len(data)))
+		data = data[offset:]
+		status = http.StatusPartialContent
+	}
+	s.writeObjectHeaders(w, o)
+	w.Header().Set("Content-Length", strconv.Itoa(len(data)))
+	w.WriteHeader(status)
+	_, _ = w.Write(data)
+}
+
+func (s *ociStub) headObject(w http.ResponseWriter, name string) {
+	o, ok := s.objects[name]
+	if !ok {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+	s.writeObjectHeaders(w, o)
+	w.Header().Set("Content-Length", strconv.Itoa(len(o.data)))
+	w.WriteHeader(http.StatusOK)
+}
+
+func (s *ociStub) writeObjectHeaders(w http.ResponseWriter, o *stubObject) {
+	w.Header().Set("Content-Type", o.contentType)
+	w.Header().Set("Last-Modified", o.modified.UTC().Format(http.TimeFormat))
+	for k, v := range o.meta {
+		w.Header().Set("opc-meta-"+k, v)
+	}
+}
+
+func (s *ociStub) putObject(w http.ResponseWriter, r *http.Request, name string) {
+	data, err := io.ReadAll(r.Body)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, "InvalidRequest", err.Error())
+		return
+	}
+	meta := make(map[string]string)
+	for k := range r.Header {
+		if strings.HasPrefix(strings.ToLower(k), "opc-meta-") {
+			meta[strings.ToLower(strings.TrimPrefix(strings.ToLower(k), "opc-meta-"))] = r.Header.Get(k)
+		}
+	}
+	s.objects[name] = &stubObject{
+		data:        data,
+		contentType: r.Header.Get("Content-Type"),
+		meta:        meta,
+		modified:    time.Now(),
+	}
+	w.Header().Set("ETag", s.newID())
+	w.WriteHeader(http.StatusOK)
+}
+
+func (s *ociStub) renameObject(w http.ResponseWriter, r *http.Request) {
+	var details struct {
+		SourceName string `json:"sourceName"`
+		NewName    string `json:"newName"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&details); err != nil {
+		writeError(w, http.StatusBadRequest, "InvalidRequest", err.Error())
+		return
+	}
+	o, ok := s.objects[details.SourceName]
+	if !ok {
+		writeError(w, http.StatusNotFound, "ObjectNotFound", details.SourceName)
+		return
+	}
+	delete(s.objects, details.SourceName)
+	s.objects[details.NewName] = o
+	w.WriteHeader(http.StatusOK)
+}
+
+func (s *ociStub) createMultipartUpload(w http.ResponseWriter, r *http.Request) {
+	var details struct {
+		Object      string `json:"object"`
+		ContentType string `json:"contentType"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&details); err != nil {
+		writeError(w, http.StatusBadRequest, "InvalidRequest", err.Error())
+		return
+	}
+	id := s.newID()
+	upload := &stubUpload{
+		object:      details.Object,
+		contentType: details.ContentType,
+		created:     time.Now(),
+		parts:       make(map[int][]byte),
+	}
+	s.uploads[id] = upload
+	writeJSON(w, http.StatusOK, s.multipartUpload(id, upload))
+}
+
+func (s *ociStub) multipartUpload(id string, upload *stubUpload) any {
+	return map[string]any{
+		"namespace":   stubNamespace,
+		"bucket":      stubBucket,
+		"object":      upload.object,
+		"uploadId":    id,
+		"timeCreated": common.SDKTime{Time: upload.created},
+	}
+}
+
+func (s *ociStub) listMultipartUploads(w http.ResponseWriter) {
+	uploads := []any{}
+	for id, upload := range s.uploads {
+		uploads = append(uploads, s.multipartUpload(id, upload))
+	}
+	writeJSON(w, http.StatusOK, uploads)
+}
+
+func (s *ociStub) uploadPart(w http.ResponseWriter, r *http.Request, upload *stubUpload, partNum string) {
+	num, err := strconv.Atoi(partNum)
+	if err != nil || num < 1 || num > 10000 {
+		writeError(w, http.StatusBadRequest, "InvalidPartNumber", partNum)
+		return
+	}
+	data, err := io.ReadAll(r.Body)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, "InvalidRequest", err.Error())
+		return
+	}
+	upload.parts[num] = data
+	w.Header().Set("ETag", etag(data))
+	w.WriteHeader(http.StatusOK)
+}
+
+func (s *ociStub) commitMultipartUpload(w http.ResponseWriter, r *http.Request, id string, upload *stubUpload) {
+	var details struct {
+		PartsToCommit []struct {
+			PartNum int    `json:"partNum"`
+			Etag    string `json:"etag"`
+		} `json:"partsToCommit"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&details); err != nil {
+		writeError(w, http.StatusBadRequest, "InvalidRequest", err.Error())
+		return
+	}
+	var data []byte
+	for i, p := range details.PartsToCommit {
+		part, ok := upload.parts[p.PartNum]
+		if !ok || etag(part) != p.Etag || (i > 0 && p.PartNum <= details.PartsToCommit[i-1].PartNum) {
+			writeError(w, http.StatusBadRequest, "InvalidPart", strconv.Itoa(p.PartNum))
+			return
+		}
+		data = append(data, part...)
+	}
+	delete(s.uploads, id)
+	s.objects[upload.object] = &stubObject{
+		data:        data,
+		contentType: upload.contentType,
+		meta:        map[string]string{},
+		modified:    time.Now(),
+	}
+	w.Header().Set("ETag", s.newID())
+	w.WriteHeader(http.StatusOK)
+}
+
+func (s *ociStub) listParts(w http.ResponseWriter, upload *stubUpload, page string) {
+	numbers := make([]int, 0, len(upload.parts))
+	for num := range upload.parts {
+		numbers = append(numbers, num)
+	}
+	sort.Ints(numbers)
+
+	start := 0
+	if page != "" {
+		start, _ = strconv.Atoi(page)
+	}
+	parts := []map[string]any{}
+	for _, num := range numbers {
+		if num < start {
+			continue
+		}
+		if len(parts) == stubPageSize {
+			w.Header().Set("opc-next-page", strconv.Itoa(num))
+			break
+		}
+		data := upload.parts[num]
+		parts = append(parts, map[string]any{
+			"partNumber": num,
+			"etag":       etag(data),
+			"md5":        etag(data),
+			"size":       len(data),
+		})
+	}
+	writeJSON(w, http.StatusOK, parts)
+}
+
+func (s *ociStub) createPAR(w http.ResponseWriter, r *http.Request) {
+	var details struct {
+		Name        string         `json:"name"`
+		ObjectName  string         `json:"objectName"`
+		AccessType  string         `json:"accessType"`
+		TimeExpires common.SDKTime `json:"timeExpires"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&details); err != nil {
+		writeError(w, http.StatusBadRequest, "InvalidRequest", err.Error())
+		return
+	}
+	if details.AccessType != "ObjectRead" || details.ObjectName == "" || !details.TimeExpires.After(time.Now()) {
+		writeError(w, http.StatusBadRequest, "InvalidRequest", "invalid pre-authenticated request")
+		return
+	}
+	token := s.newID()
+	s.pars[token] = details.ObjectName
+	writeJSON(w, http.StatusOK, map[string]any{
+		"id":          token,
+		"name":        details.Name,
+		"accessUri":   "/p/" + token + "/n/" + stubNamespace + "/b/" + stubBucket + "/o/" + details.ObjectName,
+		"objectName":  details.ObjectName,
+		"accessType":  details.AccessType,
+		"timeCreated": common.SDKTime{Time: time.Now()},
+		"timeExpires": details.TimeExpires,
+	})
+}
+
+// readPAR serves the object of a pre-authenticated request.
+func (s *ociStub) readPAR(w http.ResponseWriter, r *http.Request) {
+	token, _, _ := strings.Cut(strings.TrimPrefix(r.URL.Path, "/p/"), "/")
+	name, ok := s.pars[token]
+	if !ok {
+		writeError(w, http.StatusNotFound, "NotAuthorizedOrNotFound", token)
+		return
+	}
+	s.calls = append(s.calls, "ReadPAR")
+	s.getObject(w, r, name)
+}
+
+func (s *ociStub) newID() string {
+	s.nextID++
+	return "id-" + strconv.Itoa(s.nextID)
+}
+
+func etag(data []byte) string {
+	sum := md5.Sum(data)
+	return base64.StdEncoding.EncodeToString(sum[:])
+}
+
+func writeError(w http.ResponseWriter, status int, code, message string) {
+	writeJSON(w, status, map[string]string{"code": code, "message": message})
+}
+
+func writeJSON(w http.ResponseWriter, status int, v any) {
+	var buf bytes.Buffer
+	_ = json.NewEncoder(&buf).Encode(v)
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	_, _ = w.Write(buf.Bytes())
+}
@@ -0,0 +1,250 @@
+package ocios
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"io"
+	"net/http"
+	"testing"
+
+	storagedriver "github.com/distribution/distribution/v3/registry/storage/driver"
+	"github.com/distribution/distribution/v3/registry/storage/driver/testsuites"
+)
+
+func TestOCIDriverSuite(t *testing.T) {
+	stub := newOCIStub(t)
+	testsuites.Driver(t, func() (storagedriver.StorageDriver, error) {
+		return New(context.Background(), stub.driverParameters())
+	}, false)
+}
+
+func TestFromParameters(t *testing.T) {
+	valid := func() map[string]any {
+		return map[string]any{
+			"namespace": "namespace",
+			"bucket":    "bucket",
+			"auth":      "unknown",
+		}
+	}
+
+	for _, tc := range []struct {
+		name    string
+		modify  func(map[string]any)
+		wantErr string
+	}{
+		{name: "missing namespace", modify: func(p map[string]any) { delete(p, "namespace") }, wantErr: "no namespace parameter provided"},
+		{name: "missing bucket", modify: func(p map[string]any) { p["bucket"] = "" }, wantErr: "no bucket parameter provided"},
+		{name: "chunksize invalid", modify: func(p map[string]any) { p["chunksize"] = "big" }, wantErr: "chunksize must be an integer, big invalid"},
+		{name: "unknown auth", modify: func(map[string]any) {}, wantErr: "auth must be configfile or instanceprincipal, unknown invalid"},
+		{name: "missing config file", modify: func(p map[string]any) {
+			p["auth"] = "configfile"
+			p["configfile"] = "/nonexistent/oci/config"
+		}, wantErr: "can not read config file"},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			params := valid()
+			tc.modify(params)
+			_, err := FromParameters(context.Background(), params)
+			if err == nil || !bytes.Contains([]byte(err.Error()), []byte(tc.wantErr)) {
+				t.Fatalf("expected error %q, got %v", tc.wantErr, err)
+			}
+		})
+	}
+}
+
+func TestNewChunkSize(t *testing.T) {
+	stub := newOCIStub(t)
+	params := stub.driverParameters()
+	params.ChunkSize = minChunkSize - 1
+	if _, err := New(context.Background(), params); err == nil {
+		t.Fatal("expected an error for a chunksize below the minimum")
+	}
+}
+
+// TestWriterResumeMultipartUpload closes a writer in the middle of a
+// multipart upload, resumes it and checks that the committed object is
+// complete.
+func TestWriterResumeMultipartUpload(t *testing.T) {
+	stub := newOCIStub(t)
+	d := stub.newDriver()
+	ctx := context.Background()
+	path := "/upload/data"
+
+	contents := make([]byte, 4*d.chunkSize+1024)
+	if _, err := rand.Read(contents); err != nil {
+		t.Fatal(err)
+	}
+	first := contents[:d.chunkSize+d.chunkSize/2]
+
+	w, err := d.Writer(ctx, path, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := w.Write(first); err != nil {
+		t.Fatal(err)
+	}
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := d.Stat(ctx, path); err == nil {
+		t.Fatal("expected an upload session to be hidden from Stat")
+	}
+
+	w, err = d.Writer(ctx, path, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if w.Size() != int64(len(first)) {
+		t.Fatalf("resumed size = %d, want %d", w.Size(), len(first))
+	}
+	if _, err := w.Write(contents[len(first):]); err != nil {
+		t.Fatal(err)
+	}
+	if err := w.Commit(ctx); err != nil {
+		t.Fatal(err)
+	}
+
+	got, err := d.GetContent(ctx, path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got, contents) {
+		t.Fatal("committed content does not match")
+	}
+	if n := stub.count("ListMultipartUploadParts"); n != 1 {
+		t.Fatalf("ListMultipartUploadParts called %d times, want 1", n)
+	}
+	if n := stub.uploadCount(); n != 0 {
+		t.Fatalf("%d multipart uploads left in progress", n)
+	}
+}
+
+// TestWriterCancel checks that cancelling a writer removes its upload
+// session and multipart upload.
+func TestWriterCancel(t *testing.T) {
+	stub := newOCIStub(t)
+	d := stub.newDriver()
+	ctx := context.Background()
+
+	w, err := d.Writer(ctx, "/upload/cancel", false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := w.Write(make([]byte, 2*d.chunkSize)); err != nil {
+		t.Fatal(err)
+	}
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if stub.object("root/upload/cancel") == nil || stub.uploadCount() != 1 {
+		t.Fatal("expected an upload session and a multipart upload")
+	}
+
+	w, err = d.Writer(ctx, "/upload/cancel", true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := w.Cancel(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if stub.object("root/upload/cancel") != nil || stub.uploadCount() != 0 {
+		t.Fatal("expected no upload session and no multipart upload after cancel")
+	}
+}
+
+// TestDeleteAbortsUploads checks that deleting a directory aborts the
+// multipart uploads of the unfinished uploads below it, and only those.
+func TestDeleteAbortsUploads(t *testing.T) {
+	stub := newOCIStub(t)
+	d := stub.newDriver()
+	ctx := context.Background()
+
+	for _, path := range []string{"/uploads/a/data", "/uploads-other/data"} {
+		w, err := d.Writer(ctx, path, false)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := w.Write(make([]byte, 2*d.chunkSize)); err != nil {
+			t.Fatal(err)
+		}
+		if err := w.Close(); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if err := d.Delete(ctx, "/uploads"); err != nil {
+		t.Fatal(err)
+	}
+	if stub.object("root/uploads/a/data") != nil {
+		t.Fatal("expected the upload session to be deleted")
+	}
+	if n := stub.uploadCount(); n != 1 {
+		t.Fatalf("%d multipart uploads left in progress, want 1", n)
+	}
+}
+
+func TestRedirectURL(t *testing.T) {
+	stub := newOCIStub(t)
+	d := stub.newDriver()
+	ctx := context.Background()
+
+	if err := d.PutContent(ctx, "/blob", []byte("content")); err != nil {
+		t.Fatal(err)
+	}
+	u, err := d.RedirectURL(&http.Request{Method: http.MethodGet}, "/blob")
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp, err := http.Get(u)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	got, _ := io.ReadAll(resp.Body)
+	if resp.StatusCode != http.StatusOK || string(got) != "content" {
+		t.Fatalf("redirect got %d %q", resp.StatusCode, got)
+	}
+
+	u, err = d.RedirectURL(&http.Request{Method: http.MethodPut}, "/blob")
+	if err != nil || u != "" {
+		t.Fatalf("expected no redirect for PUT, got %q, %v", u, err)
+	}
+}
+
+func TestWalkParallel(t *testing.T) {
+	stub := newOCIStub(t)
+	d := stub.newDriver()
+	ctx := context.Background()
+
+	files := []string{"/a/1", "/a/2", "/a/b/3", "/a/b/4", "/a/c/5", "/d"}
+	for _, f := range files {
+		if err := d.PutContent(ctx, f, []byte(f)); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	walk := func(options ...func(*storagedriver.WalkOptions)) []string {
+		var walked []string
+		err := d.Walk(ctx, "/", func(fi storagedriver.FileInfo) error {
+			if !fi.IsDir() {
+				walked = append(walked, fi.Path())
+			}
+			return nil
+		}, options...)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return walked
+	}
+	sequential := walk()
+	parallel := walk(storagedriver.WithParallelism(4))
+	if len(sequential) != len(files) || len(parallel) != len(files) {
+		t.Fatalf("walked %v sequentially and %v in parallel, want %v", sequential, parallel, files)
+	}
+	for i := range sequential {
+		if sequential[i] != parallel[i] {
+			t.Fatalf("walked %v sequentially and %v in parallel", sequential, parallel)
+		}
+	}
+}
@@ -0,0 +1,137 @@
+package s3
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/service/s3"
+
+	"github.com/distribution/distribution/v3/internal/dcontext"
+	storagedriver "github.com/distribution/distribution/v3/registry/storage/driver"
+)
+
+// checksumAlgorithmSHA256 is the value of the checksumalgorithm parameter
+// enabling the SHA-256 checksums of the objects uploaded.
+const checksumAlgorithmSHA256 = "sha256"
+
+// getChecksumAlgorithm returns the checksum algorithm of the objects
+// uploaded, nil if the checksums are not enabled or were disabled since the
+// endpoint rejects them.
+func (d *driver) getChecksumAlgorithm() *string {
+	if d.ChecksumAlgorithm == "" || d.checksumsDisabled.Load() {
+		return nil
+	}
+	return aws.String(d.ChecksumAlgorithm)
+}
+
+// withChecksums calls upload with the checksum algorithm of the objects
+// uploaded. If the endpoint rejects the checksums, as some S3 compatible
+// stores do, they are disabled for the driver and upload is called again
+// without them.
+func (d *driver) withChecksums(ctx context.Context, upload func(algorithm *string) error) error {
+	algorithm := d.getChecksumAlgorithm()
+	err := upload(algorithm)
+	if algorithm == nil || !isChecksumUnsupported(err) {
+		return err
+	}
+	if d.checksumsDisabled.CompareAndSwap(false, true) {
+		dcontext.GetLogger(ctx).Warnf("s3aws: the endpoint does not support %s checksums, uploading without them: %v", *algorithm, err)
+	}
+	return upload(nil)
+}
+
+// isChecksumUnsupported reports whether err rejects the checksum parameters
+// of a request, rather than a checksum which does not match the content.
+func isChecksumUnsupported(err error) bool {
+	var awsErr awserr.Error
+	if !errors.As(err, &awsErr) {
+		return false
+	}
+	switch awsErr.Code() {
+	case "NotImplemented":
+		return true
+	case "InvalidArgument", "InvalidRequest":
+		return strings.Contains(strings.ToLower(awsErr.Message()), "checksum")
+	}
+	return false
+}
+
+// contentChecksum returns the SHA-256 checksum of the content, encoded as S3
+// expects it.
+func contentChecksum(content []byte) string {
+	sum := sha256.Sum256(content)
+	return base64.StdEncoding.EncodeToString(sum[:])
+}
+
+// compositeChecksum returns the checksum of a multipart upload of the parts,
+// the checksum of their concatenated checksums, and false if a part has no
+// checksum.
+func compositeChecksum(parts []*s3.CompletedPart) (string, bool) {
+	h := sha256.New()
+	for _, part := range parts {
+		if part.ChecksumSHA256 == nil {
+			return "", false
+		}
+		sum, err := base64.StdEncoding.DecodeString(*part.ChecksumSHA256)
+		if err != nil {
+			return "", false
+		}
+		h.Write(sum)
+	}
+	return base64.StdEncoding.EncodeToString(h.Sum(nil)) + "-" + strconv.Itoa(len(parts)), true
+}
+
+// blobChecksum returns the SHA-256 checksum of the blob whose data is stored
+// at the key or driver path, known from its digest, and false if the path is
+// not the data of a sha256 blob.
+func blobChecksum(path string) (string, bool) {
+	_, rest, ok := strings.Cut(path, registryPathPrefix+"blobs/sha256/")
+	if !ok {
+		return "", false
+	}
+	components := strings.Split(rest, "/")
+	if len(components) != 3 || components[2] != "data" {
+		return "", false
+	}
+	sum, err := hex.DecodeString(components[1])
+	if err != nil || len(sum) != sha256.Size {
+		return "", false
+	}
+	return base64.StdEncoding.EncodeToString(sum), true
+}
+
+// checkChecksum deletes the object stored at key and returns an error if S3
+// reports a checksum other than expected for it. A composite checksum is
+// compared without its number of parts, which S3 does not always report. A
+// checksum S3 does not report is not checked.
+func (d *driver) checkChecksum(ctx context.Context, key string, reported *string, expected string) error {
+	if reported == nil {
+		return nil
+	}
+	reportedSum, _, _ := strings.Cut(*reported, "-")
+	expectedSum, _, _ := strings.Cut(expected, "-")
+	if reportedSum == expectedSum {
+		return nil
+	}
+
+	err := storagedriver.Error{
+		DriverName: driverName,
+		Detail:     fmt.Errorf("S3 reports the checksum %s for %s, expected %s", *reported, key, expected),
+	}
+	if _, dErr := d.S3.DeleteObjectWithContext(ctx, &s3.DeleteObjectInput{
+		RequestPayer: d.getRequestPayer(),
+		Bucket:       aws.String(d.Bucket),
+		Key:          aws.String(key),
+	}); dErr != nil {
+		return errors.Join(err, dErr)
+	}
+	return err
+}
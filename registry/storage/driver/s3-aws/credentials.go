@@ -0,0 +1,73 @@
+package s3
+
+import (
+	"context"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/aws/credentials/processcreds"
+	"github.com/aws/aws-sdk-go/aws/request"
+	"github.com/aws/aws-sdk-go/aws/session"
+)
+
+// credentialsExpiryWindow is how long before their expiration the
+// credentials of a credential_process are refreshed, so that a request
+// signed with them does not reach S3 once they expired.
+const credentialsExpiryWindow = time.Minute
+
+// newSession returns the session of the driver. Without static keys, the
+// credentials of a profile are resolved from the shared configuration as the
+// AWS CLI does: credential_process, SSO cache and source_profile role
+// chaining. They are refreshed whenever they expire.
+func newSession(awsConfig *aws.Config, params DriverParameters) (*session.Session, error) {
+	if params.Profile == "" || (params.AccessKey != "" && params.SecretKey != "") {
+		return session.NewSession(awsConfig)
+	}
+	return session.NewSessionWithOptions(session.Options{
+		Config:            *awsConfig,
+		Profile:           params.Profile,
+		SharedConfigState: session.SharedConfigEnable,
+		CredentialsProviderOptions: &session.CredentialsProviderOptions{
+			ProcessProviderOptions: func(p *processcreds.ProcessProvider) {
+				p.ExpiryWindow = credentialsExpiryWindow
+			},
+		},
+	})
+}
+
+// credentialsRefreshedKey marks the context of a request already retried with
+// refreshed credentials.
+type credentialsRefreshedKey struct{}
+
+// refreshExpiredCredentialsHandler retries once, with refreshed credentials,
+// a request failing because its credentials expired, as those of a
+// credential_process may in the middle of an upload. A request failing again
+// is not retried: its credentials are not the problem.
+var refreshExpiredCredentialsHandler = request.NamedHandler{
+	Name: "s3.RefreshExpiredCredentialsHandler",
+	Fn: func(r *request.Request) {
+		if !isExpiredCredentials(r.Error) {
+			return
+		}
+		if r.Context().Value(credentialsRefreshedKey{}) != nil {
+			r.Retryable = aws.Bool(false)
+			return
+		}
+		if r.Config.Credentials != nil {
+			r.Config.Credentials.Expire()
+		}
+		r.SetContext(context.WithValue(r.Context(), credentialsRefreshedKey{}, true))
+		r.Retryable = aws.Bool(true)
+	},
+}
+
+// isExpiredCredentials reports whether err is the refusal of expired
+// credentials.
+func isExpiredCredentials(err error) bool {
+	if request.IsErrorExpiredCreds(err) {
+		return true
+	}
+	aerr, ok := err.(awserr.Error)
+	return ok && aerr.Code() == "TokenRefreshRequired"
+}
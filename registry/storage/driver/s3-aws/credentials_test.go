@@ -0,0 +1,211 @@
+package s3
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// credentialProcess is a fake credential_process of the profile registry,
+// returning the access key process-key-<n> on its nth run.
+type credentialProcess struct {
+	t   *testing.T
+	dir string
+}
+
+func newCredentialProcess(t *testing.T) *credentialProcess {
+	t.Helper()
+	if runtime.GOOS == "windows" {
+		t.Skip("the fake credential_process is a shell script")
+	}
+
+	p := &credentialProcess{t: t, dir: t.TempDir()}
+	script := filepath.Join(p.dir, "credential-process")
+	err := os.WriteFile(script, []byte(fmt.Sprintf(`#!/bin/sh
+dir=%q
+n=$(( $(cat "$dir/count" 2>/dev/null || echo 0) + 1 ))
+echo $n > "$dir/count"
+printf '{"Version": 1, "AccessKeyId": "process-key-%%d", "SecretAccessKey": "secret", "SessionToken": "token", "Expiration": "%%s"}' $n "$(cat "$dir/expiration")"
+`, p.dir)), 0o700)
+	if err != nil {
+		t.Fatal(err)
+	}
+	config := fmt.Sprintf("[profile registry]\ncredential_process = %s\n", script)
+	if err := os.WriteFile(filepath.Join(p.dir, "config"), []byte(config), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	t.Setenv("AWS_CONFIG_FILE", filepath.Join(p.dir, "config"))
+	t.Setenv("AWS_SHARED_CREDENTIALS_FILE", filepath.Join(p.dir, "credentials"))
+	p.expireIn(time.Hour)
+	return p
+}
+
+// expireIn sets the expiration of the credentials returned from now on.
+func (p *credentialProcess) expireIn(d time.Duration) {
+	expiration := time.Now().Add(d).UTC().Format(time.RFC3339)
+	if err := os.WriteFile(filepath.Join(p.dir, "expiration"), []byte(expiration), 0o600); err != nil {
+		p.t.Fatal(err)
+	}
+}
+
+// runs returns how many times the process was run.
+func (p *credentialProcess) runs() int {
+	count, err := os.ReadFile(filepath.Join(p.dir, "count"))
+	if os.IsNotExist(err) {
+		return 0
+	}
+	if err != nil {
+		p.t.Fatal(err)
+	}
+	n, err := strconv.Atoi(strings.TrimSpace(string(count)))
+	if err != nil {
+		p.t.Fatal(err)
+	}
+	return n
+}
+
+// newProfileDriver returns a driver of the stub without static keys, taking
+// its credentials from the profile registry.
+func newProfileDriver(t *testing.T, stub *s3Stub) *Driver {
+	return stub.newDriver(t, func(p *DriverParameters) {
+		p.AccessKey = ""
+		p.SecretKey = ""
+		p.Profile = "registry"
+	})
+}
+
+// lastAccessKey returns the access key signing the last request to the stub.
+func lastAccessKey(stub *s3Stub) string {
+	requests := stub.recorded()
+	if len(requests) == 0 {
+		return ""
+	}
+	return accessKeyOf(requests[len(requests)-1])
+}
+
+func TestProfileCredentialProcess(t *testing.T) {
+	process := newCredentialProcess(t)
+	stub := newS3Stub(t)
+	d := newProfileDriver(t, stub)
+	ctx := context.Background()
+
+	// The credentials are resolved from the process, once until they expire.
+	for i := 0; i < 2; i++ {
+		if err := d.PutContent(ctx, "/content", []byte("content")); err != nil {
+			t.Fatal(err)
+		}
+		if key := lastAccessKey(stub); key != "process-key-1" {
+			t.Fatalf("unexpected access key %q", key)
+		}
+	}
+	if runs := process.runs(); runs != 1 {
+		t.Fatalf("expected the process to run once, ran %d times", runs)
+	}
+
+	// The static keys take precedence over the profile.
+	static := stub.newDriver(t, func(p *DriverParameters) { p.Profile = "registry" })
+	if err := static.PutContent(ctx, "/content", []byte("content")); err != nil {
+		t.Fatal(err)
+	}
+	if key := lastAccessKey(stub); key != "stub-access-key" {
+		t.Fatalf("unexpected access key %q", key)
+	}
+}
+
+func TestProfileCredentialsRefresh(t *testing.T) {
+	process := newCredentialProcess(t)
+	// The credentials expiring within the expiry window are refreshed
+	// before the next request.
+	process.expireIn(credentialsExpiryWindow / 2)
+	stub := newS3Stub(t)
+	d := newProfileDriver(t, stub)
+	ctx := context.Background()
+
+	if err := d.PutContent(ctx, "/content", []byte("content")); err != nil {
+		t.Fatal(err)
+	}
+	if key := lastAccessKey(stub); key != "process-key-1" {
+		t.Fatalf("unexpected access key %q", key)
+	}
+	process.expireIn(time.Hour)
+	for i := 0; i < 2; i++ {
+		if _, err := d.GetContent(ctx, "/content"); err != nil {
+			t.Fatal(err)
+		}
+		if key := lastAccessKey(stub); key != "process-key-2" {
+			t.Fatalf("unexpected access key %q", key)
+		}
+	}
+	if runs := process.runs(); runs != 2 {
+		t.Fatalf("expected the process to run twice, ran %d times", runs)
+	}
+}
+
+func TestExpiredCredentialsRetry(t *testing.T) {
+	process := newCredentialProcess(t)
+	stub := newS3Stub(t)
+	var (
+		mu      sync.Mutex
+		expired = map[string]bool{}
+	)
+	stub.authHook = func(accessKey string) string {
+		mu.Lock()
+		defer mu.Unlock()
+		if expired[accessKey] {
+			return "ExpiredToken"
+		}
+		return ""
+	}
+	expire := func(accessKey string) {
+		mu.Lock()
+		defer mu.Unlock()
+		expired[accessKey] = true
+	}
+	d := newProfileDriver(t, stub)
+	ctx := context.Background()
+
+	// S3 refusing the credentials in the middle of an upload, they are
+	// refreshed and the part retried.
+	w, err := d.Writer(ctx, "/upload", false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	contents := make([]byte, 2*minChunkSize)
+	if _, err := w.Write(contents[:minChunkSize]); err != nil {
+		t.Fatal(err)
+	}
+	expire("process-key-1")
+	if _, err := w.Write(contents[minChunkSize:]); err != nil {
+		t.Fatal(err)
+	}
+	if err := w.Commit(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if o, ok := stub.object("root/upload"); !ok || len(o.data) != len(contents) {
+		t.Fatal("expected the upload to be stored")
+	}
+	if key := lastAccessKey(stub); key != "process-key-2" {
+		t.Fatalf("unexpected access key %q", key)
+	}
+
+	// Refused again once refreshed, the request is retried only once.
+	expire("process-key-2")
+	expire("process-key-3")
+	stub.reset()
+	if err := d.PutContent(ctx, "/content", []byte("content")); err == nil {
+		t.Fatal("expected the expired credentials to fail the request")
+	}
+	if requests := stub.recorded(); len(requests) != 2 {
+		t.Fatalf("expected the request to be retried once, got %d requests", len(requests))
+	}
+	if runs := process.runs(); runs != 3 {
+		t.Fatalf("expected the process to run three times, ran %d times", runs)
+	}
+}
@@ -0,0 +1,184 @@
+package s3
+
+import (
+	"fmt"
+	"net/url"
+	"slices"
+	"sort"
+	"strings"
+	"unicode/utf8"
+)
+
+// The limits of the tags of an S3 object.
+const (
+	maxObjectTags     = 10
+	maxTagKeyLength   = 128
+	maxTagValueLength = 256
+)
+
+// The computed object tags, whose values are derived from the path of the
+// object.
+const (
+	// objectTagRepository is the name of the repository of the objects
+	// stored under a repository, and of the blobs moved there from an upload.
+	objectTagRepository = "repository"
+	// objectTagContentType is the kind of content of the object: blob,
+	// manifest or upload.
+	objectTagContentType = "contenttype"
+)
+
+// registryPathPrefix is the prefix of the paths the registry stores objects
+// under, which follows the root directory in their keys.
+const registryPathPrefix = "docker/registry/v2/"
+
+// objectTags are the tags set on the objects written.
+type objectTags struct {
+	static   map[string]string
+	computed []string
+}
+
+// newObjectTags returns the object tags of the static tags and of the names
+// of the computed tags, or nil if there are none. The tags must fit the
+// limits of S3 in number and length.
+func newObjectTags(static map[string]string, computed []string) (*objectTags, error) {
+	if len(static) == 0 && len(computed) == 0 {
+		return nil, nil
+	}
+	if n := len(static) + len(computed); n > maxObjectTags {
+		return nil, fmt.Errorf("the objecttags parameter sets %d tags, more than the %d tags of an object", n, maxObjectTags)
+	}
+	for key, value := range static {
+		if err := validTagKey(key); err != nil {
+			return nil, err
+		}
+		if utf8.RuneCountInString(value) > maxTagValueLength {
+			return nil, fmt.Errorf("the value of the object tag %q is longer than %d characters", key, maxTagValueLength)
+		}
+	}
+	for i, name := range computed {
+		if name != objectTagRepository && name != objectTagContentType {
+			return nil, fmt.Errorf("unknown computed object tag %q, must be one of %q", name, []string{objectTagRepository, objectTagContentType})
+		}
+		if _, ok := static[name]; ok || slices.Contains(computed[:i], name) {
+			return nil, fmt.Errorf("the object tag %q is set more than once", name)
+		}
+	}
+	return &objectTags{static: static, computed: computed}, nil
+}
+
+func validTagKey(key string) error {
+	if key == "" || utf8.RuneCountInString(key) > maxTagKeyLength {
+		return fmt.Errorf("the object tag key %q must have 1 to %d characters", key, maxTagKeyLength)
+	}
+	if strings.HasPrefix(key, "aws:") {
+		return fmt.Errorf("the object tag key %q uses the reserved aws: prefix", key)
+	}
+	return nil
+}
+
+// pathTags returns the tags of the object stored at the key or driver path:
+// the static tags, and the computed tags which have a value for the path.
+func (t *objectTags) pathTags(path string) map[string]string {
+	tags := make(map[string]string, len(t.static)+len(t.computed))
+	for key, value := range t.static {
+		tags[key] = value
+	}
+	repository, contentType := classifyPath(path)
+	for _, name := range t.computed {
+		var value string
+		switch name {
+		case objectTagRepository:
+			value = repository
+		case objectTagContentType:
+			value = contentType
+		}
+		if value != "" {
+			tags[name] = truncateTagValue(value)
+		}
+	}
+	return tags
+}
+
+// classifyPath returns the repository of the object stored at the key or
+// driver path, if it is stored under a repository, and its kind of content.
+func classifyPath(path string) (repository, contentType string) {
+	_, rest, ok := strings.Cut(path, registryPathPrefix)
+	if !ok {
+		return "", ""
+	}
+	if strings.HasPrefix(rest, "blobs/") {
+		return "", "blob"
+	}
+	rest, ok = strings.CutPrefix(rest, "repositories/")
+	if !ok {
+		return "", ""
+	}
+
+	// The name of the repository is made of the components up to the first
+	// one starting with an underscore, such as _uploads.
+	components := strings.Split(rest, "/")
+	for i, component := range components {
+		if !strings.HasPrefix(component, "_") {
+			continue
+		}
+		repository = strings.Join(components[:i], "/")
+		switch component {
+		case "_uploads":
+			contentType = "upload"
+		case "_manifests":
+			contentType = "manifest"
+		case "_layers":
+			contentType = "blob"
+		}
+		return repository, contentType
+	}
+	return "", ""
+}
+
+// truncateTagValue truncates the value to the length limit of the values of
+// the tags, keeping its start.
+func truncateTagValue(value string) string {
+	if utf8.RuneCountInString(value) <= maxTagValueLength {
+		return value
+	}
+	runes := []rune(value)
+	return string(runes[:maxTagValueLength])
+}
+
+// copyTags returns the tags of an object copied to the key or driver path:
+// the tags of the path, then the computed tags of the source the path does
+// not set, such as the repository of an upload moved to the blobs, and then
+// the other tags of the source in the order of their keys, until the limit of
+// the number of tags is reached.
+func (t *objectTags) copyTags(source map[string]string, path string) map[string]string {
+	tags := t.pathTags(path)
+	keys := make([]string, 0, len(source))
+	for key := range source {
+		if !slices.Contains(t.computed, key) {
+			keys = append(keys, key)
+		}
+	}
+	sort.Strings(keys)
+	for _, key := range append(slices.Clone(t.computed), keys...) {
+		value, ok := source[key]
+		if !ok {
+			continue
+		}
+		if len(tags) >= maxObjectTags {
+			break
+		}
+		if _, ok := tags[key]; !ok {
+			tags[key] = value
+		}
+	}
+	return tags
+}
+
+// encodeTags encodes the tags as the URL query of the tagging of S3 requests.
+func encodeTags(tags map[string]string) string {
+	values := url.Values{}
+	for key, value := range tags {
+		values.Set(key, value)
+	}
+	return values.Encode()
+}
@@ -0,0 +1,240 @@
+package s3
+
+import (
+	"context"
+	"fmt"
+	"maps"
+	"strings"
+	"testing"
+)
+
+func TestObjectTagsOfPaths(t *testing.T) {
+	tags, err := newObjectTags(map[string]string{"team": "platform"}, []string{objectTagRepository, objectTagContentType})
+	if err != nil {
+		t.Fatal(err)
+	}
+	long := strings.Repeat("a", 300)
+
+	for _, tc := range []struct {
+		path     string
+		expected map[string]string
+	}{
+		{
+			path:     "/docker/registry/v2/repositories/team-a/app/_uploads/id/data",
+			expected: map[string]string{"team": "platform", "repository": "team-a/app", "contenttype": "upload"},
+		},
+		{
+			path:     "/docker/registry/v2/repositories/team-a/app/_manifests/tags/latest/current/link",
+			expected: map[string]string{"team": "platform", "repository": "team-a/app", "contenttype": "manifest"},
+		},
+		{
+			path:     "/docker/registry/v2/repositories/app/_layers/sha256/abcd/link",
+			expected: map[string]string{"team": "platform", "repository": "app", "contenttype": "blob"},
+		},
+		{
+			path:     "/docker/registry/v2/blobs/sha256/ab/abcd/data",
+			expected: map[string]string{"team": "platform", "contenttype": "blob"},
+		},
+		{
+			// The keys of the objects start with the root directory.
+			path:     "root/docker/registry/v2/repositories/app/_uploads/id/startedat",
+			expected: map[string]string{"team": "platform", "repository": "app", "contenttype": "upload"},
+		},
+		{
+			path:     "/docker/registry/v2/repositories/" + long + "/_uploads/id/data",
+			expected: map[string]string{"team": "platform", "repository": long[:maxTagValueLength], "contenttype": "upload"},
+		},
+		{
+			path:     "/docker/registry/v2/repositories/app",
+			expected: map[string]string{"team": "platform"},
+		},
+		{
+			path:     "/other/file",
+			expected: map[string]string{"team": "platform"},
+		},
+	} {
+		if got := tags.pathTags(tc.path); !maps.Equal(got, tc.expected) {
+			t.Errorf("%s: expected tags %v, got %v", tc.path, tc.expected, got)
+		}
+	}
+}
+
+func TestObjectTagsCopy(t *testing.T) {
+	tags, err := newObjectTags(map[string]string{"team": "platform"}, []string{objectTagRepository, objectTagContentType})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The tags of the destination win, and the other tags of the source are
+	// kept in the order of their keys until the limit is reached.
+	source := map[string]string{"team": "other", "repository": "app", "contenttype": "upload"}
+	for i := range 9 {
+		source[fmt.Sprintf("extra%d", i)] = "x"
+	}
+	got := tags.copyTags(source, "/docker/registry/v2/blobs/sha256/ab/abcd/data")
+	expected := map[string]string{
+		"team":        "platform",
+		"contenttype": "blob",
+		"repository":  "app",
+	}
+	for i := range 7 {
+		expected[fmt.Sprintf("extra%d", i)] = "x"
+	}
+	if !maps.Equal(got, expected) {
+		t.Fatalf("expected tags %v, got %v", expected, got)
+	}
+}
+
+func TestObjectTagsLimits(t *testing.T) {
+	tooMany := map[string]string{}
+	for i := range 9 {
+		tooMany[fmt.Sprintf("tag%d", i)] = "x"
+	}
+	for name, tc := range map[string]struct {
+		static   map[string]string
+		computed []string
+	}{
+		"count":          {static: tooMany, computed: []string{objectTagRepository, objectTagContentType}},
+		"key length":     {static: map[string]string{strings.Repeat("k", maxTagKeyLength+1): "x"}},
+		"value length":   {static: map[string]string{"team": strings.Repeat("v", maxTagValueLength+1)}},
+		"empty key":      {static: map[string]string{"": "x"}},
+		"reserved key":   {static: map[string]string{"aws:team": "x"}},
+		"unknown":        {computed: []string{"digest"}},
+		"duplicate":      {computed: []string{objectTagRepository, objectTagRepository}},
+		"static and key": {static: map[string]string{"repository": "x"}, computed: []string{objectTagRepository}},
+	} {
+		if _, err := newObjectTags(tc.static, tc.computed); err == nil {
+			t.Errorf("%s: expected an error", name)
+		}
+	}
+
+	if tags, err := newObjectTags(tooMany, []string{objectTagRepository}); err != nil || tags == nil {
+		t.Fatalf("unexpected error with %d tags: %v", maxObjectTags, err)
+	}
+	if tags, err := newObjectTags(nil, nil); err != nil || tags != nil {
+		t.Fatalf("expected no tags, got %v, %v", tags, err)
+	}
+}
+
+func TestObjectTagsParameter(t *testing.T) {
+	d, err := FromParameters(context.Background(), map[string]any{
+		"region":         "us-east-1",
+		"regionendpoint": "http://localhost",
+		"bucket":         stubBucket,
+		"objecttags": map[any]any{
+			"static":   map[any]any{"team": "platform"},
+			"computed": []any{"repository"},
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	tags := d.StorageDriver.(*driver).ObjectTags
+	if tags == nil || tags.static["team"] != "platform" || len(tags.computed) != 1 {
+		t.Fatalf("unexpected object tags %+v", tags)
+	}
+
+	_, err = FromParameters(context.Background(), map[string]any{
+		"region":     "us-east-1",
+		"bucket":     stubBucket,
+		"objecttags": map[any]any{"computed": []any{"size"}},
+	})
+	if err == nil {
+		t.Fatal("expected an error for an unknown computed tag")
+	}
+}
+
+func TestObjectTagsUploads(t *testing.T) {
+	stub := newS3Stub(t)
+	d := stub.newDriver(t, func(p *DriverParameters) {
+		p.ObjectTags = map[string]string{"team": "platform"}
+		p.ComputedObjectTags = []string{objectTagRepository, objectTagContentType}
+	})
+	ctx := context.Background()
+
+	// The tags are set by PutObject, and by the multipart uploads on completion.
+	startedAt := "/docker/registry/v2/repositories/team-a/app/_uploads/id/startedat"
+	if err := d.PutContent(ctx, startedAt, []byte("now")); err != nil {
+		t.Fatal(err)
+	}
+	upload := "/docker/registry/v2/repositories/team-a/app/_uploads/id/data"
+	w, err := d.Writer(ctx, upload, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := w.Write([]byte("layer")); err != nil {
+		t.Fatal(err)
+	}
+	if err := w.Commit(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+	expected := map[string]string{"team": "platform", "repository": "team-a/app", "contenttype": "upload"}
+	for _, path := range []string{startedAt, upload} {
+		if got, _ := stub.tags(d.S3BucketKey(path)); !maps.Equal(got, expected) {
+			t.Fatalf("%s: expected tags %v, got %v", path, expected, got)
+		}
+	}
+
+	// A blob moved from an upload keeps the repository of the upload.
+	blob := "/docker/registry/v2/blobs/sha256/ab/abcd/data"
+	if err := d.Move(ctx, upload, blob); err != nil {
+		t.Fatal(err)
+	}
+	expected = map[string]string{"team": "platform", "repository": "team-a/app", "contenttype": "blob"}
+	if got, _ := stub.tags(d.S3BucketKey(blob)); !maps.Equal(got, expected) {
+		t.Fatalf("expected the tags of the blob moved %v, got %v", expected, got)
+	}
+}
+
+func TestObjectTagsMultipartCopy(t *testing.T) {
+	stub := newS3Stub(t)
+	d := stub.newDriver(t, func(p *DriverParameters) {
+		p.ComputedObjectTags = []string{objectTagRepository, objectTagContentType}
+		p.MultipartCopyThresholdSize = 0
+		p.MultipartCopyChunkSize = minChunkSize
+	})
+	ctx := context.Background()
+
+	upload := "/docker/registry/v2/repositories/app/_uploads/id/data"
+	if err := d.PutContent(ctx, upload, []byte("layer")); err != nil {
+		t.Fatal(err)
+	}
+	blob := "/docker/registry/v2/blobs/sha256/ab/abcd/data"
+	stub.reset()
+	if err := d.Move(ctx, upload, blob); err != nil {
+		t.Fatal(err)
+	}
+	var multipart bool
+	for _, r := range stub.recorded() {
+		multipart = multipart || r.Type() == "UploadPartCopy"
+	}
+	if !multipart {
+		t.Fatal("expected the move to use a multipart copy")
+	}
+	expected := map[string]string{"repository": "app", "contenttype": "blob"}
+	if got, _ := stub.tags(d.S3BucketKey(blob)); !maps.Equal(got, expected) {
+		t.Fatalf("expected the tags of the blob moved %v, got %v", expected, got)
+	}
+}
+
+func TestObjectTagsDisabled(t *testing.T) {
+	stub := newS3Stub(t)
+	d := stub.newDriver(t, nil)
+	ctx := context.Background()
+
+	path := "/docker/registry/v2/repositories/app/_uploads/id/data"
+	if err := d.PutContent(ctx, path, []byte("layer")); err != nil {
+		t.Fatal(err)
+	}
+	if err := d.Move(ctx, path, "/docker/registry/v2/blobs/sha256/ab/abcd/data"); err != nil {
+		t.Fatal(err)
+	}
+	for _, r := range stub.recorded() {
+		if r.Type() == "GetObjectTagging" || r.Header.Get("X-Amz-Tagging") != "" || r.Header.Get("X-Amz-Tagging-Directive") != "" {
+			t.Fatalf("unexpected tagging of %s %s", r.Type(), r.Key)
+		}
+	}
+}
@@ -26,6 +26,7 @@ import (
 	"strconv"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/aws/aws-sdk-go/aws"
@@ -33,7 +34,6 @@ import (
 	"github.com/aws/aws-sdk-go/aws/credentials"
 	"github.com/aws/aws-sdk-go/aws/endpoints"
 	"github.com/aws/aws-sdk-go/aws/request"
-	"github.com/aws/aws-sdk-go/aws/session"
 	"github.com/aws/aws-sdk-go/service/s3"
 
 	"github.com/distribution/distribution/v3/internal/dcontext"
@@ -64,11 +64,22 @@ const (
 	// above which multipart copy will be used. (PUT Object - Copy is used
 	// for objects at or below this size.)  Empirically, 32 MB is optimal.
 	defaultMultipartCopyThresholdSize = 32 * 1024 * 1024
+
+	// defaultMultipartConcurrency defines the default number of parts a
+	// writer uploads concurrently
+	defaultMultipartConcurrency = 1
+
+	// maxMultipartConcurrency defines the maximum number of parts a writer
+	// uploads concurrently
+	maxMultipartConcurrency = 64
 )
 
 // listMax is the largest amount of objects you can request from S3 in a list call
 const listMax = 1000
 
+// deleteMax is the largest amount of objects you can delete from S3 in a delete call
+const deleteMax = 1000
+
 // noStorageClass defines the value to be used if storage class is not supported by the S3 endpoint
 const noStorageClass = "NONE"
 
@@ -94,16 +105,19 @@ var validObjectACLs = map[string]struct{}{}
 type DriverParameters struct {
 	AccessKey                   string
 	SecretKey                   string
+	Profile                     string
 	Bucket                      string
 	Region                      string
 	RegionEndpoint              string
 	ForcePathStyle              bool
 	Encrypt                     bool
 	KeyID                       string
+	KMSKeys                     map[string]string
 	Secure                      bool
 	SkipVerify                  bool
 	V4Auth                      bool
 	ChunkSize                   int
+	MultipartConcurrency        int
 	MultipartCopyChunkSize      int64
 	MultipartCopyMaxConcurrency int64
 	MultipartCopyThresholdSize  int64
@@ -111,11 +125,20 @@ type DriverParameters struct {
 	StorageClass                string
 	UserAgent                   string
 	ObjectACL                   string
+	RequestPayer                string
 	SessionToken                string
 	UseDualStack                bool
 	Accelerate                  bool
+	AccelerateRedirects         bool
 	UseFIPSEndpoint             bool
 	LogLevel                    aws.LogLevelType
+	// ChecksumAlgorithm is the S3 checksum algorithm of the objects
+	// uploaded, empty if their checksums are not sent.
+	ChecksumAlgorithm string
+	// ObjectTags are the static tags of the objects written, and
+	// ComputedObjectTags the names of the tags computed from their path.
+	ObjectTags         map[string]string
+	ComputedObjectTags []string
 }
 
 func init() {
@@ -158,13 +181,32 @@ type driver struct {
 	ChunkSize                   int
 	Encrypt                     bool
 	KeyID                       string
+	KMSKeys                     []kmsKey
+	MultipartConcurrency        int
 	MultipartCopyChunkSize      int64
 	MultipartCopyMaxConcurrency int64
 	MultipartCopyThresholdSize  int64
 	RootDirectory               string
 	StorageClass                string
 	ObjectACL                   string
+	RequestPayer                string
+	Accelerate                  bool
+	AccelerateRedirects         bool
+	ObjectTags                  *objectTags
+	ChecksumAlgorithm           string
 	pool                        *sync.Pool
+	partPool                    *sync.Pool
+
+	// checksumsDisabled is set once the endpoint rejects the checksums.
+	checksumsDisabled atomic.Bool
+}
+
+// kmsKey is an SSE-KMS key applied to objects stored under a key prefix.
+type kmsKey struct {
+	// prefix is the path of a directory, without trailing slash, or empty
+	// for the whole bucket.
+	prefix string
+	keyID  string
 }
 
 type baseEmbed struct {
@@ -196,6 +238,12 @@ func FromParameters(ctx context.Context, parameters map[string]any) (*Driver, er
 	if secretKey == nil {
 		secretKey = ""
 	}
+	// Without keys, the credentials of the profile are resolved from the
+	// shared configuration, such as those of its credential_process.
+	profile := parameters["profile"]
+	if profile == nil {
+		profile = ""
+	}
 
 	regionEndpoint := parameters["regionendpoint"]
 	if regionEndpoint == nil {
@@ -250,11 +298,24 @@ func FromParameters(ctx context.Context, parameters map[string]any) (*Driver, er
 		keyID = ""
 	}
 
+	kmsKeys, err := getParameterAsStringMap(parameters, "kmskeys")
+	if err != nil {
+		return nil, err
+	}
+	if len(kmsKeys) > 0 && !encryptBool {
+		return nil, fmt.Errorf("the kmskeys parameter requires encrypt to be enabled")
+	}
+
 	chunkSize, err := getParameterAsInteger(parameters, "chunksize", defaultChunkSize, minChunkSize, maxChunkSize)
 	if err != nil {
 		return nil, err
 	}
 
+	multipartConcurrency, err := getParameterAsInteger(parameters, "multipartconcurrency", defaultMultipartConcurrency, 1, maxMultipartConcurrency)
+	if err != nil {
+		return nil, err
+	}
+
 	multipartCopyChunkSize, err := getParameterAsInteger[int64](parameters, "multipartcopychunksize", defaultMultipartCopyChunkSize, minChunkSize, maxChunkSize)
 	if err != nil {
 		return nil, err
@@ -324,6 +385,15 @@ func FromParameters(ctx context.Context, parameters map[string]any) (*Driver, er
 		objectACL = objectACLString
 	}
 
+	requestPayer := ""
+	if requestPayerParam := parameters["requestpayer"]; requestPayerParam != nil {
+		requestPayerString, ok := requestPayerParam.(string)
+		if !ok || (requestPayerString != "" && requestPayerString != s3.RequestPayerRequester) {
+			return nil, fmt.Errorf("the requestpayer parameter must be %q or empty, %v invalid", s3.RequestPayerRequester, requestPayerParam)
+		}
+		requestPayer = requestPayerString
+	}
+
 	useDualStackBool, err := getParameterAsBool(parameters, "usedualstack", false)
 	if err != nil {
 		return nil, err
@@ -336,24 +406,52 @@ func FromParameters(ctx context.Context, parameters map[string]any) (*Driver, er
 		return nil, err
 	}
 
+	accelerateRedirectsBool, err := getParameterAsBool(parameters, "accelerateredirects", false)
+	if err != nil {
+		return nil, err
+	}
+
 	useFIPSEndpointBool, err := getParameterAsBool(parameters, "usefipsendpoint", false)
 	if err != nil {
 		return nil, err
 	}
 
+	objectTags, computedObjectTags, err := getObjectTagsParameter(parameters)
+	if err != nil {
+		return nil, err
+	}
+
+	checksumAlgorithm := ""
+	if checksumAlgorithmParam := parameters["checksumalgorithm"]; checksumAlgorithmParam != nil {
+		checksumAlgorithmString, ok := checksumAlgorithmParam.(string)
+		if !ok {
+			return nil, fmt.Errorf("the checksumalgorithm parameter must be %q or empty, %v invalid", checksumAlgorithmSHA256, checksumAlgorithmParam)
+		}
+		switch strings.ToLower(checksumAlgorithmString) {
+		case "":
+		case checksumAlgorithmSHA256:
+			checksumAlgorithm = s3.ChecksumAlgorithmSha256
+		default:
+			return nil, fmt.Errorf("the checksumalgorithm parameter must be %q or empty, %v invalid", checksumAlgorithmSHA256, checksumAlgorithmParam)
+		}
+	}
+
 	params := DriverParameters{
 		AccessKey:                   fmt.Sprint(accessKey),
 		SecretKey:                   fmt.Sprint(secretKey),
+		Profile:                     fmt.Sprint(profile),
 		Bucket:                      fmt.Sprint(bucket),
 		Region:                      region,
 		RegionEndpoint:              fmt.Sprint(regionEndpoint),
 		ForcePathStyle:              forcePathStyleBool,
 		Encrypt:                     encryptBool,
 		KeyID:                       fmt.Sprint(keyID),
+		KMSKeys:                     kmsKeys,
 		Secure:                      secureBool,
 		SkipVerify:                  skipVerifyBool,
 		V4Auth:                      v4Bool,
 		ChunkSize:                   chunkSize,
+		MultipartConcurrency:        multipartConcurrency,
 		MultipartCopyChunkSize:      multipartCopyChunkSize,
 		MultipartCopyMaxConcurrency: multipartCopyMaxConcurrency,
 		MultipartCopyThresholdSize:  multipartCopyThresholdSize,
@@ -361,11 +459,16 @@ func FromParameters(ctx context.Context, parameters map[string]any) (*Driver, er
 		StorageClass:                storageClass,
 		UserAgent:                   fmt.Sprint(userAgent),
 		ObjectACL:                   objectACL,
+		RequestPayer:                requestPayer,
 		SessionToken:                fmt.Sprint(sessionToken),
 		UseDualStack:                useDualStackBool,
 		Accelerate:                  accelerateBool,
+		AccelerateRedirects:         accelerateRedirectsBool,
 		UseFIPSEndpoint:             useFIPSEndpointBool,
 		LogLevel:                    getS3LogLevelFromParam(parameters["loglevel"]),
+		ObjectTags:                  objectTags,
+		ComputedObjectTags:          computedObjectTags,
+		ChecksumAlgorithm:           checksumAlgorithm,
 	}
 
 	return New(ctx, params)
@@ -432,6 +535,47 @@ func getParameterAsInteger[T integer](parameters map[string]any, name string, de
 	return v, nil
 }
 
+// getObjectTagsParameter returns the static tags and the names of the
+// computed tags of the objecttags parameter.
+func getObjectTagsParameter(parameters map[string]any) (map[string]string, []string, error) {
+	var objectTags map[string]any
+	switch v := parameters["objecttags"].(type) {
+	case nil:
+		return nil, nil, nil
+	case map[string]any:
+		objectTags = v
+	case map[any]any:
+		objectTags = make(map[string]any, len(v))
+		for k, val := range v {
+			objectTags[fmt.Sprint(k)] = val
+		}
+	default:
+		return nil, nil, fmt.Errorf("the objecttags parameter should be a map: %#v", v)
+	}
+
+	static, err := getParameterAsStringMap(objectTags, "static")
+	if err != nil {
+		return nil, nil, err
+	}
+	var computed []string
+	switch v := objectTags["computed"].(type) {
+	case nil:
+	case []string:
+		computed = v
+	case []any:
+		for _, name := range v {
+			s, ok := name.(string)
+			if !ok {
+				return nil, nil, fmt.Errorf("the computed object tags must be strings: %#v", name)
+			}
+			computed = append(computed, s)
+		}
+	default:
+		return nil, nil, fmt.Errorf("the computed object tags should be a list: %#v", v)
+	}
+	return static, computed, nil
+}
+
 // getParameterAsBool converts parameters[name] to a boolean (using defaultValue if
 // nil). It accepts both string and bool types.
 func getParameterAsBool(parameters map[string]any, name string, defaultValue bool) (bool, error) {
@@ -452,6 +596,42 @@ func getParameterAsBool(parameters map[string]any, name string, defaultValue boo
 	return defaultValue, nil
 }
 
+// getParameterAsStringMap returns the named parameter as a map of strings, or
+// nil if the parameter is unset.
+func getParameterAsStringMap(parameters map[string]any, name string) (map[string]string, error) {
+	result := map[string]string{}
+
+	switch v := parameters[name].(type) {
+	case nil:
+		return nil, nil
+	case map[string]string:
+		for k, val := range v {
+			result[k] = val
+		}
+	case map[string]any:
+		for k, val := range v {
+			s, ok := val.(string)
+			if !ok {
+				return nil, fmt.Errorf("the %s parameter values must be strings: %#v", name, val)
+			}
+			result[k] = s
+		}
+	case map[any]any:
+		for k, val := range v {
+			ks, ok := k.(string)
+			s, vok := val.(string)
+			if !ok || !vok {
+				return nil, fmt.Errorf("the %s parameter must map strings to strings: %#v", name, v)
+			}
+			result[ks] = s
+		}
+	default:
+		return nil, fmt.Errorf("the %s parameter should be a map of strings: %#v", name, v)
+	}
+
+	return result, nil
+}
+
 // New constructs a new Driver with the given AWS credentials, region, encryption flag, and
 // bucketName
 func New(ctx context.Context, params DriverParameters) (*Driver, error) {
@@ -460,6 +640,15 @@ func New(ctx context.Context, params DriverParameters) (*Driver, error) {
 			strings.Contains(params.RegionEndpoint, "s3.amazonaws.com")) {
 		return nil, fmt.Errorf("on Amazon S3 this storage driver can only be used with v4 authentication")
 	}
+	if params.Accelerate && params.RegionEndpoint != "" {
+		return nil, fmt.Errorf("the accelerate parameter can not be used with a regionendpoint")
+	}
+	if params.AccelerateRedirects && !params.Accelerate {
+		return nil, fmt.Errorf("the accelerateredirects parameter requires accelerate")
+	}
+	if params.ChecksumAlgorithm != "" && params.ChecksumAlgorithm != s3.ChecksumAlgorithmSha256 {
+		return nil, fmt.Errorf("unsupported checksum algorithm %q, must be %q", params.ChecksumAlgorithm, s3.ChecksumAlgorithmSha256)
+	}
 
 	awsConfig := aws.NewConfig().WithLogLevel(params.LogLevel)
 
@@ -477,7 +666,6 @@ func New(ctx context.Context, params DriverParameters) (*Driver, error) {
 	}
 
 	awsConfig.WithS3ForcePathStyle(params.ForcePathStyle)
-	awsConfig.WithS3UseAccelerate(params.Accelerate)
 	awsConfig.WithRegion(params.Region)
 	awsConfig.WithDisableSSL(!params.Secure)
 	if params.UseDualStack {
@@ -495,7 +683,7 @@ func New(ctx context.Context, params DriverParameters) (*Driver, error) {
 		})
 	}
 
-	sess, err := session.NewSession(awsConfig)
+	sess, err := newSession(awsConfig, params)
 	if err != nil {
 		return nil, fmt.Errorf("failed to create new session with aws config: %v", err)
 	}
@@ -505,6 +693,7 @@ func New(ctx context.Context, params DriverParameters) (*Driver, error) {
 	}
 
 	s3obj := s3.New(sess)
+	s3obj.Handlers.AfterRetry.PushFrontNamed(refreshExpiredCredentialsHandler)
 
 	// enable S3 compatible signature v2 signing instead
 	if !params.V4Auth {
@@ -526,21 +715,57 @@ func New(ctx context.Context, params DriverParameters) (*Driver, error) {
 	// 	}
 	// }
 
+	kmsKeys := make([]kmsKey, 0, len(params.KMSKeys))
+	for prefix, keyID := range params.KMSKeys {
+		if keyID == "" {
+			return nil, fmt.Errorf("no KMS key provided for prefix %q", prefix)
+		}
+		kmsKeys = append(kmsKeys, kmsKey{
+			prefix: strings.Trim(strings.TrimRight(params.RootDirectory, "/")+"/"+strings.Trim(prefix, "/"), "/"),
+			keyID:  keyID,
+		})
+	}
+	objectTags, err := newObjectTags(params.ObjectTags, params.ComputedObjectTags)
+	if err != nil {
+		return nil, err
+	}
+
+	// Order prefixes longest first so the most specific mapping wins.
+	sort.Slice(kmsKeys, func(i, j int) bool {
+		if len(kmsKeys[i].prefix) != len(kmsKeys[j].prefix) {
+			return len(kmsKeys[i].prefix) > len(kmsKeys[j].prefix)
+		}
+		return kmsKeys[i].prefix < kmsKeys[j].prefix
+	})
+
 	d := &driver{
 		S3:                          s3obj,
 		Bucket:                      params.Bucket,
 		ChunkSize:                   params.ChunkSize,
 		Encrypt:                     params.Encrypt,
 		KeyID:                       params.KeyID,
+		KMSKeys:                     kmsKeys,
+		MultipartConcurrency:        max(params.MultipartConcurrency, 1),
 		MultipartCopyChunkSize:      params.MultipartCopyChunkSize,
 		MultipartCopyMaxConcurrency: params.MultipartCopyMaxConcurrency,
 		MultipartCopyThresholdSize:  params.MultipartCopyThresholdSize,
 		RootDirectory:               params.RootDirectory,
 		StorageClass:                params.StorageClass,
 		ObjectACL:                   params.ObjectACL,
+		RequestPayer:                params.RequestPayer,
+		Accelerate:                  params.Accelerate,
+		AccelerateRedirects:         params.AccelerateRedirects,
+		ObjectTags:                  objectTags,
+		ChecksumAlgorithm:           params.ChecksumAlgorithm,
 		pool: &sync.Pool{
 			New: func() any { return &bytes.Buffer{} },
 		},
+		partPool: &sync.Pool{
+			New: func() any {
+				b := make([]byte, 0, params.ChunkSize)
+				return &b
+			},
+		},
 	}
 
 	return &Driver{
@@ -568,16 +793,28 @@ func (d *driver) GetContent(ctx context.Context, path string) ([]byte, error) {
 }
 
 // PutContent stores the []byte content at a location designated by "path".
+// With checksums, S3 verifies the content against its checksum.
 func (d *driver) PutContent(ctx context.Context, path string, contents []byte) error {
-	_, err := d.S3.PutObjectWithContext(ctx, &s3.PutObjectInput{
-		Bucket:               aws.String(d.Bucket),
-		Key:                  aws.String(d.s3Path(path)),
-		ContentType:          d.getContentType(),
-		ACL:                  d.getACL(),
-		ServerSideEncryption: d.getEncryptionMode(),
-		SSEKMSKeyId:          d.getSSEKMSKeyID(),
-		StorageClass:         d.getStorageClass(),
-		Body:                 bytes.NewReader(contents),
+	err := d.withChecksums(ctx, func(algorithm *string) error {
+		var checksum *string
+		if algorithm != nil {
+			checksum = aws.String(contentChecksum(contents))
+		}
+		_, err := d.S3.PutObjectWithContext(ctx, &s3.PutObjectInput{
+			RequestPayer:         d.getRequestPayer(),
+			Bucket:               aws.String(d.Bucket),
+			Key:                  aws.String(d.s3Path(path)),
+			ContentType:          d.getContentType(),
+			ACL:                  d.getACL(),
+			ServerSideEncryption: d.getEncryptionMode(d.s3Path(path)),
+			SSEKMSKeyId:          d.getSSEKMSKeyID(d.s3Path(path)),
+			StorageClass:         d.getStorageClass(),
+			Tagging:              d.getTagging(d.s3Path(path)),
+			ChecksumAlgorithm:    algorithm,
+			ChecksumSHA256:       checksum,
+			Body:                 bytes.NewReader(contents),
+		}, d.uploadOptions()...)
+		return err
 	})
 	return parseError(path, err)
 }
@@ -586,9 +823,10 @@ func (d *driver) PutContent(ctx context.Context, path string, contents []byte) e
 // given byte offset.
 func (d *driver) Reader(ctx context.Context, path string, offset int64) (io.ReadCloser, error) {
 	resp, err := d.S3.GetObjectWithContext(ctx, &s3.GetObjectInput{
-		Bucket: aws.String(d.Bucket),
-		Key:    aws.String(d.s3Path(path)),
-		Range:  aws.String("bytes=" + strconv.FormatInt(offset, 10) + "-"),
+		RequestPayer: d.getRequestPayer(),
+		Bucket:       aws.String(d.Bucket),
+		Key:          aws.String(d.s3Path(path)),
+		Range:        aws.String("bytes=" + strconv.FormatInt(offset, 10) + "-"),
 	})
 	if err != nil {
 		if s3Err, ok := err.(awserr.Error); ok && s3Err.Code() == "InvalidRange" {
@@ -610,27 +848,20 @@ func (d *driver) Writer(ctx context.Context, path string, appendMode bool) (stor
 	key := d.s3Path(path)
 	if !appendMode {
 		// TODO (brianbland): cancel other uploads at this path
-		resp, err := d.S3.CreateMultipartUploadWithContext(ctx, &s3.CreateMultipartUploadInput{
-			Bucket:               aws.String(d.Bucket),
-			Key:                  aws.String(key),
-			ContentType:          d.getContentType(),
-			ACL:                  d.getACL(),
-			ServerSideEncryption: d.getEncryptionMode(),
-			SSEKMSKeyId:          d.getSSEKMSKeyID(),
-			StorageClass:         d.getStorageClass(),
-		})
+		uploadID, algorithm, err := d.createMultipartUpload(ctx, key)
 		if err != nil {
 			return nil, err
 		}
-		return d.newWriter(ctx, key, *resp.UploadId, nil), nil
+		return d.newWriter(ctx, key, uploadID, nil, algorithm), nil
 	}
 
 	listMultipartUploadsInput := &s3.ListMultipartUploadsInput{
-		Bucket: aws.String(d.Bucket),
-		Prefix: aws.String(key),
+		RequestPayer: d.getRequestPayer(),
+		Bucket:       aws.String(d.Bucket),
+		Prefix:       aws.String(key),
 	}
 	for {
-		resp, err := d.S3.ListMultipartUploadsWithContext(ctx, listMultipartUploadsInput)
+		resp, err := d.S3.ListMultipartUploadsWithContext(ctx, listMultipartUploadsInput, d.uploadOptions()...)
 		if err != nil {
 			return nil, parseError(path, err)
 		}
@@ -645,19 +876,11 @@ func (d *driver) Writer(ctx context.Context, path string, appendMode bool) (stor
 			}
 
 			if fi.Size() == 0 {
-				resp, err := d.S3.CreateMultipartUploadWithContext(ctx, &s3.CreateMultipartUploadInput{
-					Bucket:               aws.String(d.Bucket),
-					Key:                  aws.String(key),
-					ContentType:          d.getContentType(),
-					ACL:                  d.getACL(),
-					ServerSideEncryption: d.getEncryptionMode(),
-					SSEKMSKeyId:          d.getSSEKMSKeyID(),
-					StorageClass:         d.getStorageClass(),
-				})
+				uploadID, algorithm, err := d.createMultipartUpload(ctx, key)
 				if err != nil {
 					return nil, err
 				}
-				return d.newWriter(ctx, key, *resp.UploadId, nil), nil
+				return d.newWriter(ctx, key, uploadID, nil, algorithm), nil
 			}
 			return nil, storagedriver.Error{
 				DriverName: driverName,
@@ -672,27 +895,31 @@ func (d *driver) Writer(ctx context.Context, path string, appendMode bool) (stor
 			}
 
 			partsList, err := d.S3.ListPartsWithContext(ctx, &s3.ListPartsInput{
-				Bucket:   aws.String(d.Bucket),
-				Key:      aws.String(key),
-				UploadId: multi.UploadId,
-			})
+				RequestPayer: d.getRequestPayer(),
+				Bucket:       aws.String(d.Bucket),
+				Key:          aws.String(key),
+				UploadId:     multi.UploadId,
+			}, d.uploadOptions()...)
 			if err != nil {
 				return nil, parseError(path, err)
 			}
 			allParts = append(allParts, partsList.Parts...)
 			for *partsList.IsTruncated {
 				partsList, err = d.S3.ListPartsWithContext(ctx, &s3.ListPartsInput{
+					RequestPayer:     d.getRequestPayer(),
 					Bucket:           aws.String(d.Bucket),
 					Key:              aws.String(key),
 					UploadId:         multi.UploadId,
 					PartNumberMarker: partsList.NextPartNumberMarker,
-				})
+				}, d.uploadOptions()...)
 				if err != nil {
 					return nil, parseError(path, err)
 				}
 				allParts = append(allParts, partsList.Parts...)
 			}
-			return d.newWriter(ctx, key, *multi.UploadId, allParts), nil
+			// The parts of the upload are completed with the checksums of the
+			// algorithm it was created with.
+			return d.newWriter(ctx, key, *multi.UploadId, allParts, multi.ChecksumAlgorithm), nil
 		}
 
 		// resp.NextUploadIdMarker must have at least one element or we would have returned not found
@@ -707,10 +934,41 @@ func (d *driver) Writer(ctx context.Context, path string, appendMode bool) (stor
 	return nil, storagedriver.PathNotFoundError{Path: path}
 }
 
+// createMultipartUpload creates a multipart upload of the object stored at
+// key, and returns its ID and the checksum algorithm of its parts.
+func (d *driver) createMultipartUpload(ctx context.Context, key string) (string, *string, error) {
+	var (
+		resp     *s3.CreateMultipartUploadOutput
+		uploaded *string
+	)
+	err := d.withChecksums(ctx, func(algorithm *string) error {
+		var err error
+		resp, err = d.S3.CreateMultipartUploadWithContext(ctx, &s3.CreateMultipartUploadInput{
+			RequestPayer:         d.getRequestPayer(),
+			Bucket:               aws.String(d.Bucket),
+			Key:                  aws.String(key),
+			ContentType:          d.getContentType(),
+			ACL:                  d.getACL(),
+			ServerSideEncryption: d.getEncryptionMode(key),
+			SSEKMSKeyId:          d.getSSEKMSKeyID(key),
+			StorageClass:         d.getStorageClass(),
+			Tagging:              d.getTagging(key),
+			ChecksumAlgorithm:    algorithm,
+		}, d.uploadOptions()...)
+		uploaded = algorithm
+		return err
+	})
+	if err != nil {
+		return "", nil, err
+	}
+	return *resp.UploadId, uploaded, nil
+}
+
 func (d *driver) statHead(ctx context.Context, path string) (*storagedriver.FileInfoFields, error) {
 	resp, err := d.S3.HeadObjectWithContext(ctx, &s3.HeadObjectInput{
-		Bucket: aws.String(d.Bucket),
-		Key:    aws.String(d.s3Path(path)),
+		RequestPayer: d.getRequestPayer(),
+		Bucket:       aws.String(d.Bucket),
+		Key:          aws.String(d.s3Path(path)),
 	})
 	if err != nil {
 		return nil, err
@@ -726,9 +984,10 @@ func (d *driver) statHead(ctx context.Context, path string) (*storagedriver.File
 func (d *driver) statList(ctx context.Context, path string) (*storagedriver.FileInfoFields, error) {
 	s3Path := d.s3Path(path)
 	resp, err := d.S3.ListObjectsV2WithContext(ctx, &s3.ListObjectsV2Input{
-		Bucket:  aws.String(d.Bucket),
-		Prefix:  aws.String(s3Path),
-		MaxKeys: aws.Int64(1),
+		RequestPayer: d.getRequestPayer(),
+		Bucket:       aws.String(d.Bucket),
+		Prefix:       aws.String(s3Path),
+		MaxKeys:      aws.Int64(1),
 	})
 	if err != nil {
 		return nil, err
@@ -774,7 +1033,7 @@ func (d *driver) Stat(ctx context.Context, path string) (storagedriver.FileInfo,
 			return storagedriver.FileInfoInternal{FileInfoFields: *fi}, nil
 		}
 		// For non-AWS errors, return the error directly
-		return nil, err
+		return nil, parseError(path, err)
 	}
 	return storagedriver.FileInfoInternal{FileInfoFields: *fi}, nil
 }
@@ -795,10 +1054,11 @@ func (d *driver) List(ctx context.Context, opath string) ([]string, error) {
 	}
 
 	resp, err := d.S3.ListObjectsV2WithContext(ctx, &s3.ListObjectsV2Input{
-		Bucket:    aws.String(d.Bucket),
-		Prefix:    aws.String(d.s3Path(path)),
-		Delimiter: aws.String("/"),
-		MaxKeys:   aws.Int64(listMax),
+		RequestPayer: d.getRequestPayer(),
+		Bucket:       aws.String(d.Bucket),
+		Prefix:       aws.String(d.s3Path(path)),
+		Delimiter:    aws.String("/"),
+		MaxKeys:      aws.Int64(listMax),
 	})
 	if err != nil {
 		return nil, parseError(opath, err)
@@ -822,6 +1082,7 @@ func (d *driver) List(ctx context.Context, opath string) ([]string, error) {
 		}
 
 		resp, err = d.S3.ListObjectsV2WithContext(ctx, &s3.ListObjectsV2Input{
+			RequestPayer:      d.getRequestPayer(),
 			Bucket:            aws.String(d.Bucket),
 			Prefix:            aws.String(d.s3Path(path)),
 			Delimiter:         aws.String("/"),
@@ -829,7 +1090,7 @@ func (d *driver) List(ctx context.Context, opath string) ([]string, error) {
 			ContinuationToken: resp.NextContinuationToken,
 		})
 		if err != nil {
-			return nil, err
+			return nil, parseError(opath, err)
 		}
 	}
 
@@ -867,31 +1128,70 @@ func (d *driver) copy(ctx context.Context, sourcePath, destPath string) error {
 		return parseError(sourcePath, err)
 	}
 
+	tagging, err := d.copyTagging(ctx, sourcePath, destPath)
+	if err != nil {
+		return parseError(sourcePath, err)
+	}
+	var taggingDirective *string
+	if tagging != nil {
+		taggingDirective = aws.String(s3.TaggingDirectiveReplace)
+	}
+
 	if fileInfo.Size() <= d.MultipartCopyThresholdSize {
-		_, err := d.S3.CopyObjectWithContext(ctx, &s3.CopyObjectInput{
-			Bucket:               aws.String(d.Bucket),
-			Key:                  aws.String(d.s3Path(destPath)),
-			ContentType:          d.getContentType(),
-			ACL:                  d.getACL(),
-			ServerSideEncryption: d.getEncryptionMode(),
-			SSEKMSKeyId:          d.getSSEKMSKeyID(),
-			StorageClass:         d.getStorageClass(),
-			CopySource:           aws.String(d.Bucket + "/" + d.s3Path(sourcePath)),
+		var (
+			resp     *s3.CopyObjectOutput
+			uploaded *string
+		)
+		err := d.withChecksums(ctx, func(algorithm *string) error {
+			var err error
+			resp, err = d.S3.CopyObjectWithContext(ctx, &s3.CopyObjectInput{
+				RequestPayer:         d.getRequestPayer(),
+				Bucket:               aws.String(d.Bucket),
+				Key:                  aws.String(d.s3Path(destPath)),
+				ContentType:          d.getContentType(),
+				ACL:                  d.getACL(),
+				ServerSideEncryption: d.getEncryptionMode(d.s3Path(destPath)),
+				SSEKMSKeyId:          d.getSSEKMSKeyID(d.s3Path(destPath)),
+				StorageClass:         d.getStorageClass(),
+				Tagging:              tagging,
+				TaggingDirective:     taggingDirective,
+				ChecksumAlgorithm:    algorithm,
+				CopySource:           aws.String(d.Bucket + "/" + d.s3Path(sourcePath)),
+			})
+			uploaded = algorithm
+			return err
 		})
 		if err != nil {
 			return parseError(sourcePath, err)
 		}
+		// S3 computes the checksum of the whole copy, which is the digest
+		// of a blob moved to its data from an upload.
+		if expected, ok := blobChecksum(destPath); ok && uploaded != nil && resp.CopyObjectResult != nil {
+			return d.checkChecksum(ctx, d.s3Path(destPath), resp.CopyObjectResult.ChecksumSHA256, expected)
+		}
 		return nil
 	}
 
-	createResp, err := d.S3.CreateMultipartUploadWithContext(ctx, &s3.CreateMultipartUploadInput{
-		Bucket:               aws.String(d.Bucket),
-		Key:                  aws.String(d.s3Path(destPath)),
-		ContentType:          d.getContentType(),
-		ACL:                  d.getACL(),
-		SSEKMSKeyId:          d.getSSEKMSKeyID(),
-		ServerSideEncryption: d.getEncryptionMode(),
-		StorageClass:         d.getStorageClass(),
+	var (
+		createResp *s3.CreateMultipartUploadOutput
+		uploaded   *string
+	)
+	err = d.withChecksums(ctx, func(algorithm *string) error {
+		var err error
+		createResp, err = d.S3.CreateMultipartUploadWithContext(ctx, &s3.CreateMultipartUploadInput{
+			RequestPayer:         d.getRequestPayer(),
+			Bucket:               aws.String(d.Bucket),
+			Key:                  aws.String(d.s3Path(destPath)),
+			ContentType:          d.getContentType(),
+			ACL:                  d.getACL(),
+			SSEKMSKeyId:          d.getSSEKMSKeyID(d.s3Path(destPath)),
+			ServerSideEncryption: d.getEncryptionMode(d.s3Path(destPath)),
+			StorageClass:         d.getStorageClass(),
+			Tagging:              tagging,
+			ChecksumAlgorithm:    algorithm,
+		})
+		uploaded = algorithm
+		return err
 	})
 	if err != nil {
 		return err
@@ -912,6 +1212,7 @@ func (d *driver) copy(ctx context.Context, sourcePath, destPath string) error {
 				lastByte = fileInfo.Size() - 1
 			}
 			uploadResp, err := d.S3.UploadPartCopyWithContext(ctx, &s3.UploadPartCopyInput{
+				RequestPayer:    d.getRequestPayer(),
 				Bucket:          aws.String(d.Bucket),
 				CopySource:      aws.String(d.Bucket + "/" + d.s3Path(sourcePath)),
 				Key:             aws.String(d.s3Path(destPath)),
@@ -921,8 +1222,9 @@ func (d *driver) copy(ctx context.Context, sourcePath, destPath string) error {
 			})
 			if err == nil {
 				completedParts[i] = &s3.CompletedPart{
-					ETag:       uploadResp.CopyPartResult.ETag,
-					PartNumber: aws.Int64(i + 1),
+					ETag:           uploadResp.CopyPartResult.ETag,
+					ChecksumSHA256: uploadResp.CopyPartResult.ChecksumSHA256,
+					PartNumber:     aws.Int64(i + 1),
 				}
 			}
 			errChan <- err
@@ -937,13 +1239,22 @@ func (d *driver) copy(ctx context.Context, sourcePath, destPath string) error {
 		}
 	}
 
-	_, err = d.S3.CompleteMultipartUploadWithContext(ctx, &s3.CompleteMultipartUploadInput{
+	completeResp, err := d.S3.CompleteMultipartUploadWithContext(ctx, &s3.CompleteMultipartUploadInput{
+		RequestPayer:    d.getRequestPayer(),
 		Bucket:          aws.String(d.Bucket),
 		Key:             aws.String(d.s3Path(destPath)),
 		UploadId:        createResp.UploadId,
 		MultipartUpload: &s3.CompletedMultipartUpload{Parts: completedParts},
 	})
-	return err
+	if err != nil {
+		return err
+	}
+	// The checksum of a multipart copy is composite, so that it can not be
+	// compared with the digest of a blob.
+	if expected, ok := compositeChecksum(completedParts); ok && uploaded != nil {
+		return d.checkChecksum(ctx, d.s3Path(destPath), completeResp.ChecksumSHA256, expected)
+	}
+	return nil
 }
 
 // Delete recursively deletes all objects stored at "path" and its subpaths.
@@ -952,15 +1263,16 @@ func (d *driver) Delete(ctx context.Context, path string) error {
 	s3Objects := make([]*s3.ObjectIdentifier, 0, listMax)
 	s3Path := d.s3Path(path)
 	listObjectsInput := &s3.ListObjectsV2Input{
-		Bucket: aws.String(d.Bucket),
-		Prefix: aws.String(s3Path),
+		RequestPayer: d.getRequestPayer(),
+		Bucket:       aws.String(d.Bucket),
+		Prefix:       aws.String(s3Path),
 	}
 
 	for {
 		// list all the objects
 		resp, err := d.S3.ListObjectsV2WithContext(ctx, listObjectsInput)
 		if err != nil {
-			return err
+			return parseError(path, err)
 		}
 		// resp.Contents can only be empty on the first call
 		// if there were no more results to return after the first call, resp.IsTruncated would have been false
@@ -986,14 +1298,15 @@ func (d *driver) Delete(ctx context.Context, path string) error {
 			// 10000 keys is coincidentally (?) also the max number of keys that can be deleted in a single Delete operation, so we'll just smack
 			// Delete here straight away and reset the object slice when successful.
 			resp, err := d.S3.DeleteObjectsWithContext(ctx, &s3.DeleteObjectsInput{
-				Bucket: aws.String(d.Bucket),
+				RequestPayer: d.getRequestPayer(),
+				Bucket:       aws.String(d.Bucket),
 				Delete: &s3.Delete{
 					Objects: s3Objects,
 					Quiet:   aws.Bool(false),
 				},
 			})
 			if err != nil {
-				return err
+				return parseError(path, err)
 			}
 
 			if len(resp.Errors) > 0 {
@@ -1026,6 +1339,43 @@ func (d *driver) Delete(ctx context.Context, path string) error {
 	return nil
 }
 
+// DeleteBatch deletes the objects at paths, with a delete call per deleteMax
+// objects. Deleting an object which does not exist succeeds.
+func (d *driver) DeleteBatch(ctx context.Context, paths []string) ([]error, error) {
+	errs := make([]error, len(paths))
+	for start := 0; start < len(paths); start += deleteMax {
+		end := min(start+deleteMax, len(paths))
+		s3Objects := make([]*s3.ObjectIdentifier, 0, end-start)
+		indexes := make(map[string]int, end-start)
+		for i := start; i < end; i++ {
+			key := d.s3Path(paths[i])
+			s3Objects = append(s3Objects, &s3.ObjectIdentifier{Key: aws.String(key)})
+			indexes[key] = i
+		}
+
+		resp, err := d.S3.DeleteObjectsWithContext(ctx, &s3.DeleteObjectsInput{
+			RequestPayer: d.getRequestPayer(),
+			Bucket:       aws.String(d.Bucket),
+			Delete: &s3.Delete{
+				Objects: s3Objects,
+				Quiet:   aws.Bool(true),
+			},
+		})
+		if err != nil {
+			for i := start; i < end; i++ {
+				errs[i] = parseError(paths[i], err)
+			}
+			continue
+		}
+		for _, e := range resp.Errors {
+			if i, ok := indexes[aws.StringValue(e.Key)]; ok {
+				errs[i] = errors.New(e.String())
+			}
+		}
+	}
+	return errs, nil
+}
+
 // RedirectURL returns a URL which may be used to retrieve the content stored at the given path.
 func (d *driver) RedirectURL(r *http.Request, path string) (string, error) {
 	expiresIn := 20 * time.Minute
@@ -1047,9 +1397,67 @@ func (d *driver) RedirectURL(r *http.Request, path string) (string, error) {
 		return "", nil
 	}
 
+	if d.AccelerateRedirects {
+		useAccelerate(req)
+	}
+
+	if d.RequestPayer != "" {
+		// As a header, x-amz-request-payer would have to be sent by the
+		// client, so presigned URLs carry it as a signed query parameter.
+		req.Handlers.Build.PushBack(func(r *request.Request) {
+			query := r.HTTPRequest.URL.Query()
+			query.Set("x-amz-request-payer", d.RequestPayer)
+			r.HTTPRequest.URL.RawQuery = query.Encode()
+		})
+	}
+
 	return req.Presign(expiresIn)
 }
 
+// Usage returns the number of bytes stored under path and the number of
+// objects storing them, summing the sizes of the objects listed under path.
+func (d *driver) Usage(ctx context.Context, path string) (int64, int64, error) {
+	prefix := path
+	if !strings.HasSuffix(prefix, "/") {
+		prefix = prefix + "/"
+	}
+
+	var bytes, objects int64
+	err := d.S3.ListObjectsV2PagesWithContext(ctx, &s3.ListObjectsV2Input{
+		RequestPayer: d.getRequestPayer(),
+		Bucket:       aws.String(d.Bucket),
+		Prefix:       aws.String(d.s3Path(prefix)),
+		MaxKeys:      aws.Int64(listMax),
+	}, func(resp *s3.ListObjectsV2Output, lastPage bool) bool {
+		for _, key := range resp.Contents {
+			if strings.HasSuffix(*key.Key, "/") {
+				continue
+			}
+			bytes += *key.Size
+			objects++
+		}
+		return true
+	})
+	if err != nil {
+		return 0, 0, parseError(path, err)
+	}
+
+	if objects == 0 && path != "/" {
+		// path may be an object rather than a directory.
+		fi, err := d.Stat(ctx, path)
+		if err != nil {
+			if errors.As(err, new(storagedriver.PathNotFoundError)) {
+				return 0, 0, nil
+			}
+			return 0, 0, err
+		}
+		if !fi.IsDir() {
+			return fi.Size(), 1, nil
+		}
+	}
+	return bytes, objects, nil
+}
+
 // Walk traverses a filesystem defined within driver, starting
 // from the given path, calling f on each file
 func (d *driver) Walk(ctx context.Context, from string, f storagedriver.WalkFn, options ...func(*storagedriver.WalkOptions)) error {
@@ -1058,6 +1466,14 @@ func (d *driver) Walk(ctx context.Context, from string, f storagedriver.WalkFn,
 		o(walkOptions)
 	}
 
+	if walkOptions.Parallelism > 1 {
+		// Listing each directory with a delimiter allows sibling directories
+		// to be listed concurrently, and skipped directories not to be listed.
+		// The entries of each directory are walked in sorted order, rather
+		// than in the order of the keys.
+		return storagedriver.WalkParallel(ctx, from, d.listFileInfos, f, options...)
+	}
+
 	var objectCount int64
 	if err := d.doWalk(ctx, &objectCount, from, walkOptions.StartAfterHint, f); err != nil {
 		return err
@@ -1087,10 +1503,11 @@ func (d *driver) doWalk(parentCtx context.Context, objectCount *int64, from, sta
 	}
 
 	listObjectsInput := &s3.ListObjectsV2Input{
-		Bucket:     aws.String(d.Bucket),
-		Prefix:     aws.String(d.s3Path(path)),
-		MaxKeys:    aws.Int64(listMax),
-		StartAfter: aws.String(d.s3Path(startAfter)),
+		RequestPayer: d.getRequestPayer(),
+		Bucket:       aws.String(d.Bucket),
+		Prefix:       aws.String(d.s3Path(path)),
+		MaxKeys:      aws.Int64(listMax),
+		StartAfter:   aws.String(d.s3Path(startAfter)),
 	}
 
 	ctx, done := dcontext.WithTrace(parentCtx)
@@ -1178,6 +1595,70 @@ func (d *driver) doWalk(parentCtx context.Context, objectCount *int64, from, sta
 	return nil
 }
 
+// listFileInfos returns the files and directories directly within opath,
+// listed with a delimiter.
+func (d *driver) listFileInfos(ctx context.Context, opath string) ([]storagedriver.FileInfo, error) {
+	path := opath
+	if path != "/" && path[len(path)-1] != '/' {
+		path = path + "/"
+	}
+
+	prefix := ""
+	if d.s3Path("") == "" {
+		prefix = "/"
+	}
+
+	listObjectsInput := &s3.ListObjectsV2Input{
+		RequestPayer: d.getRequestPayer(),
+		Bucket:       aws.String(d.Bucket),
+		Prefix:       aws.String(d.s3Path(path)),
+		Delimiter:    aws.String("/"),
+		MaxKeys:      aws.Int64(listMax),
+	}
+
+	var (
+		fileInfos []storagedriver.FileInfo
+		found     bool
+	)
+	err := d.S3.ListObjectsV2PagesWithContext(ctx, listObjectsInput, func(objects *s3.ListObjectsV2Output, lastPage bool) bool {
+		found = found || len(objects.Contents) > 0 || len(objects.CommonPrefixes) > 0
+		for _, file := range objects.Contents {
+			filePath := strings.Replace(*file.Key, d.s3Path(""), prefix, 1)
+			// skip the objects standing for the directory itself
+			if strings.HasSuffix(filePath, "/") {
+				continue
+			}
+			fileInfos = append(fileInfos, storagedriver.FileInfoInternal{
+				FileInfoFields: storagedriver.FileInfoFields{
+					Size:    *file.Size,
+					ModTime: *file.LastModified,
+					Path:    filePath,
+				},
+			})
+		}
+		for _, commonPrefix := range objects.CommonPrefixes {
+			commonPrefix := *commonPrefix.Prefix
+			fileInfos = append(fileInfos, storagedriver.FileInfoInternal{
+				FileInfoFields: storagedriver.FileInfoFields{
+					IsDir: true,
+					Path:  strings.Replace(commonPrefix[0:len(commonPrefix)-1], d.s3Path(""), prefix, 1),
+				},
+			})
+		}
+		return true
+	})
+	if err != nil {
+		return nil, parseError(opath, err)
+	}
+
+	if opath != "/" && !found {
+		// Treat empty response as missing directory, since we don't actually
+		// have directories in s3.
+		return nil, storagedriver.PathNotFoundError{Path: opath}
+	}
+	return fileInfos, nil
+}
+
 // directoryDiff finds all directories that are not in common between
 // the previous and current paths in sorted order.
 //
@@ -1229,23 +1710,54 @@ func parseError(path string, err error) error {
 	if s3Err, ok := err.(awserr.Error); ok && s3Err.Code() == "NoSuchKey" {
 		return storagedriver.PathNotFoundError{Path: path}
 	}
+	if isRetryable(err) {
+		return storagedriver.RetryableError{DriverName: driverName, Detail: err}
+	}
 
 	return err
 }
 
-func (d *driver) getEncryptionMode() *string {
+// isRetryable reports whether err is transient: a server error, a request
+// timeout, throttling, or a failure to send the request or read its
+// response, such as a reset connection. The SDK has already retried such
+// errors by the time they are returned.
+func isRetryable(err error) bool {
+	var awsErr awserr.Error
+	if !errors.As(err, &awsErr) {
+		return false
+	}
+	var reqErr awserr.RequestFailure
+	if errors.As(err, &reqErr) && reqErr.StatusCode() >= http.StatusInternalServerError {
+		return true
+	}
+	return request.IsErrorRetryable(awsErr) || request.IsErrorThrottle(awsErr)
+}
+
+// kmsKeyID returns the KMS key for the object stored at key: the key mapped to
+// the longest prefix in KMSKeys which key is, or is under, or KeyID otherwise.
+// A prefix matches whole path components, so team does not match teamfoo.
+func (d *driver) kmsKeyID(key string) string {
+	for _, k := range d.KMSKeys {
+		if k.prefix == "" || key == k.prefix || strings.HasPrefix(key, k.prefix+"/") {
+			return k.keyID
+		}
+	}
+	return d.KeyID
+}
+
+func (d *driver) getEncryptionMode(key string) *string {
 	if !d.Encrypt {
 		return nil
 	}
-	if d.KeyID == "" {
+	if d.kmsKeyID(key) == "" {
 		return aws.String("AES256")
 	}
 	return aws.String("aws:kms")
 }
 
-func (d *driver) getSSEKMSKeyID() *string {
-	if d.KeyID != "" {
-		return aws.String(d.KeyID)
+func (d *driver) getSSEKMSKeyID(key string) *string {
+	if keyID := d.kmsKeyID(key); keyID != "" {
+		return aws.String(keyID)
 	}
 	return nil
 }
@@ -1258,6 +1770,62 @@ func (d *driver) getACL() *string {
 	return aws.String(d.ObjectACL)
 }
 
+// uploadOptions returns the options of the requests uploading content,
+// which go through the S3 Transfer Acceleration endpoint when it is enabled.
+// Other requests, such as listings, use the standard endpoint.
+func (d *driver) uploadOptions() []request.Option {
+	if !d.Accelerate {
+		return nil
+	}
+	return []request.Option{useAccelerate}
+}
+
+// useAccelerate sends r through the S3 Transfer Acceleration endpoint.
+func useAccelerate(r *request.Request) {
+	r.Config.S3UseAccelerate = aws.Bool(true)
+}
+
+// getRequestPayer returns the RequestPayer of requests, which must be set
+// to access requester pays buckets owned by another account.
+func (d *driver) getRequestPayer() *string {
+	if d.RequestPayer == "" {
+		return nil
+	}
+	return aws.String(d.RequestPayer)
+}
+
+// getTagging returns the tagging of the object written at key, nil if the
+// objects are not tagged.
+func (d *driver) getTagging(key string) *string {
+	if d.ObjectTags == nil {
+		return nil
+	}
+	return aws.String(encodeTags(d.ObjectTags.pathTags(key)))
+}
+
+// copyTagging returns the tagging of the object copied from sourcePath to
+// destPath, which keeps the tags of the source the destination does not set.
+// It is nil if the objects are not tagged, and S3 copies the tags of the
+// source as they are.
+func (d *driver) copyTagging(ctx context.Context, sourcePath, destPath string) (*string, error) {
+	if d.ObjectTags == nil {
+		return nil, nil
+	}
+	resp, err := d.S3.GetObjectTaggingWithContext(ctx, &s3.GetObjectTaggingInput{
+		RequestPayer: d.getRequestPayer(),
+		Bucket:       aws.String(d.Bucket),
+		Key:          aws.String(d.s3Path(sourcePath)),
+	})
+	if err != nil {
+		return nil, err
+	}
+	source := make(map[string]string, len(resp.TagSet))
+	for _, tag := range resp.TagSet {
+		source[aws.StringValue(tag.Key)] = aws.StringValue(tag.Value)
+	}
+	return aws.String(encodeTags(d.ObjectTags.copyTags(source, d.s3Path(destPath)))), nil
+}
+
 func (d *driver) getStorageClass() *string {
 	if d.StorageClass == noStorageClass {
 		return nil
@@ -1270,6 +1838,13 @@ func (d *driver) getStorageClass() *string {
 // smaller than the configured chunk size and never larger. This allows the
 // multipart upload to be cleanly resumed in future. This is violated if
 // [writer.Close] is called before at least one chunk is written.
+//
+// Up to [writer.driver.MultipartConcurrency] parts are uploaded concurrently,
+// each held in its own buffer until S3 acknowledges it, so memory use per
+// writer is bounded by the concurrency multiplied by the chunk size.
+//
+// With a checksum algorithm, each part is uploaded with its checksum, and the
+// composite checksum S3 reports for the completed upload is validated.
 type writer struct {
 	ctx       context.Context
 	driver    *driver
@@ -1281,9 +1856,20 @@ type writer struct {
 	closed    bool
 	committed bool
 	cancelled bool
+
+	// inflight limits the number of concurrent part uploads
+	inflight chan struct{}
+	pending  sync.WaitGroup
+
+	mu        sync.Mutex
+	uploadErr error
+
+	// checksumAlgorithm is the checksum algorithm of the parts of the
+	// upload, nil if they have no checksum.
+	checksumAlgorithm *string
 }
 
-func (d *driver) newWriter(ctx context.Context, key, uploadID string, parts []*s3.Part) storagedriver.FileWriter {
+func (d *driver) newWriter(ctx context.Context, key, uploadID string, parts []*s3.Part, checksumAlgorithm *string) storagedriver.FileWriter {
 	var size int64
 	for _, part := range parts {
 		size += *part.Size
@@ -1296,6 +1882,9 @@ func (d *driver) newWriter(ctx context.Context, key, uploadID string, parts []*s
 		parts:    parts,
 		size:     size,
 		buf:      d.pool.Get().(*bytes.Buffer),
+		inflight: make(chan struct{}, d.MultipartConcurrency),
+
+		checksumAlgorithm: checksumAlgorithm,
 	}
 }
 
@@ -1305,6 +1894,32 @@ func (a completedParts) Len() int           { return len(a) }
 func (a completedParts) Swap(i, j int)      { a[i], a[j] = a[j], a[i] }
 func (a completedParts) Less(i, j int) bool { return *a[i].PartNumber < *a[j].PartNumber }
 
+// completedParts returns the parts uploaded, with their checksums.
+func (w *writer) completedParts() completedParts {
+	completedUploadedParts := make(completedParts, len(w.parts))
+	for i, part := range w.parts {
+		completedUploadedParts[i] = &s3.CompletedPart{
+			ETag:           part.ETag,
+			ChecksumSHA256: part.ChecksumSHA256,
+			PartNumber:     part.PartNumber,
+		}
+	}
+	return completedUploadedParts
+}
+
+// checkCompleted validates the checksum S3 reports for the upload completed
+// with the parts, deleting the object if it does not match.
+func (w *writer) checkCompleted(parts completedParts, resp *s3.CompleteMultipartUploadOutput) error {
+	if w.checksumAlgorithm == nil {
+		return nil
+	}
+	expected, ok := compositeChecksum(parts)
+	if !ok {
+		return nil
+	}
+	return w.driver.checkChecksum(w.ctx, w.key, resp.ChecksumSHA256, expected)
+}
+
 func (w *writer) Write(p []byte) (int, error) {
 	if err := w.done(); err != nil {
 		return 0, err
@@ -1313,54 +1928,52 @@ func (w *writer) Write(p []byte) (int, error) {
 	// If the last written part is smaller than minChunkSize, we need to make a
 	// new multipart upload :sadface:
 	if len(w.parts) > 0 && int(*w.parts[len(w.parts)-1].Size) < minChunkSize {
-		completedUploadedParts := make(completedParts, len(w.parts))
-		for i, part := range w.parts {
-			completedUploadedParts[i] = &s3.CompletedPart{
-				ETag:       part.ETag,
-				PartNumber: part.PartNumber,
-			}
+		if err := w.wait(); err != nil {
+			return 0, err
 		}
 
+		completedUploadedParts := w.completedParts()
+
 		sort.Sort(completedUploadedParts)
 
-		_, err := w.driver.S3.CompleteMultipartUploadWithContext(w.ctx, &s3.CompleteMultipartUploadInput{
-			Bucket:   aws.String(w.driver.Bucket),
-			Key:      aws.String(w.key),
-			UploadId: aws.String(w.uploadID),
+		completeResp, err := w.driver.S3.CompleteMultipartUploadWithContext(w.ctx, &s3.CompleteMultipartUploadInput{
+			RequestPayer: w.driver.getRequestPayer(),
+			Bucket:       aws.String(w.driver.Bucket),
+			Key:          aws.String(w.key),
+			UploadId:     aws.String(w.uploadID),
 			MultipartUpload: &s3.CompletedMultipartUpload{
 				Parts: completedUploadedParts,
 			},
-		})
+		}, w.driver.uploadOptions()...)
 		if err != nil {
 			if _, aErr := w.driver.S3.AbortMultipartUploadWithContext(w.ctx, &s3.AbortMultipartUploadInput{
-				Bucket:   aws.String(w.driver.Bucket),
-				Key:      aws.String(w.key),
-				UploadId: aws.String(w.uploadID),
-			}); aErr != nil {
+				RequestPayer: w.driver.getRequestPayer(),
+				Bucket:       aws.String(w.driver.Bucket),
+				Key:          aws.String(w.key),
+				UploadId:     aws.String(w.uploadID),
+			}, w.driver.uploadOptions()...); aErr != nil {
 				return 0, errors.Join(err, aErr)
 			}
 			return 0, err
 		}
+		if err := w.checkCompleted(completedUploadedParts, completeResp); err != nil {
+			return 0, err
+		}
 
-		resp, err := w.driver.S3.CreateMultipartUploadWithContext(w.ctx, &s3.CreateMultipartUploadInput{
-			Bucket:               aws.String(w.driver.Bucket),
-			Key:                  aws.String(w.key),
-			ContentType:          w.driver.getContentType(),
-			ACL:                  w.driver.getACL(),
-			ServerSideEncryption: w.driver.getEncryptionMode(),
-			StorageClass:         w.driver.getStorageClass(),
-		})
+		uploadID, algorithm, err := w.driver.createMultipartUpload(w.ctx, w.key)
 		if err != nil {
 			return 0, err
 		}
-		w.uploadID = *resp.UploadId
+		w.uploadID = uploadID
+		w.checksumAlgorithm = algorithm
 
 		// If the entire written file is smaller than minChunkSize, we need to make
 		// a new part from scratch :double sad face:
 		if w.size < minChunkSize {
 			resp, err := w.driver.S3.GetObjectWithContext(w.ctx, &s3.GetObjectInput{
-				Bucket: aws.String(w.driver.Bucket),
-				Key:    aws.String(w.key),
+				RequestPayer: w.driver.getRequestPayer(),
+				Bucket:       aws.String(w.driver.Bucket),
+				Key:          aws.String(w.key),
 			})
 			if err != nil {
 				return 0, err
@@ -1375,19 +1988,21 @@ func (w *writer) Write(p []byte) (int, error) {
 		} else {
 			// Otherwise we can use the old file as the new first part
 			copyPartResp, err := w.driver.S3.UploadPartCopyWithContext(w.ctx, &s3.UploadPartCopyInput{
-				Bucket:     aws.String(w.driver.Bucket),
-				CopySource: aws.String(w.driver.Bucket + "/" + w.key),
-				Key:        aws.String(w.key),
-				PartNumber: aws.Int64(1),
-				UploadId:   resp.UploadId,
+				RequestPayer: w.driver.getRequestPayer(),
+				Bucket:       aws.String(w.driver.Bucket),
+				CopySource:   aws.String(w.driver.Bucket + "/" + w.key),
+				Key:          aws.String(w.key),
+				PartNumber:   aws.Int64(1),
+				UploadId:     aws.String(w.uploadID),
 			})
 			if err != nil {
 				return 0, err
 			}
 			w.parts = []*s3.Part{{
-				ETag:       copyPartResp.CopyPartResult.ETag,
-				PartNumber: aws.Int64(1),
-				Size:       aws.Int64(w.size),
+				ETag:           copyPartResp.CopyPartResult.ETag,
+				ChecksumSHA256: copyPartResp.CopyPartResult.ChecksumSHA256,
+				PartNumber:     aws.Int64(1),
+				Size:           aws.Int64(w.size),
 			}}
 		}
 	}
@@ -1417,7 +2032,15 @@ func (w *writer) Close() error {
 
 	defer w.releaseBuffer()
 
-	return w.flush()
+	if err := w.flush(); err != nil {
+		return w.abort(err)
+	}
+	if err := w.wait(); err != nil {
+		// A failed part leaves a hole in the upload, so it must not be
+		// resumed.
+		return w.abort(err)
+	}
+	return nil
 }
 
 func (w *writer) reset() {
@@ -1428,45 +2051,72 @@ func (w *writer) reset() {
 
 // releaseBuffer resets the buffer and returns it to the pool.
 func (w *writer) releaseBuffer() {
+	if w.buf == nil {
+		return
+	}
 	w.buf.Reset()
 	w.driver.pool.Put(w.buf)
+	w.buf = nil
 }
 
-// Cancel aborts the multipart upload and closes the writer.
+// Cancel aborts the multipart upload, releases the buffer and closes the
+// writer.
 func (w *writer) Cancel(ctx context.Context) error {
 	if err := w.done(); err != nil {
 		return err
 	}
 
 	w.cancelled = true
+
+	// Parts still in flight must finish before the abort, otherwise they may
+	// be stored after it and linger until the upload is purged.
+	_ = w.wait()
+	w.releaseBuffer()
+
 	_, err := w.driver.S3.AbortMultipartUploadWithContext(ctx, &s3.AbortMultipartUploadInput{
-		Bucket:   aws.String(w.driver.Bucket),
-		Key:      aws.String(w.key),
-		UploadId: aws.String(w.uploadID),
-	})
+		RequestPayer: w.driver.getRequestPayer(),
+		Bucket:       aws.String(w.driver.Bucket),
+		Key:          aws.String(w.key),
+		UploadId:     aws.String(w.uploadID),
+	}, w.driver.uploadOptions()...)
+	return err
+}
+
+// abort aborts the multipart upload after err occurred and returns err,
+// joined with any error from the abort itself.
+func (w *writer) abort(err error) error {
+	_ = w.wait()
+	if _, aErr := w.driver.S3.AbortMultipartUploadWithContext(w.ctx, &s3.AbortMultipartUploadInput{
+		RequestPayer: w.driver.getRequestPayer(),
+		Bucket:       aws.String(w.driver.Bucket),
+		Key:          aws.String(w.key),
+		UploadId:     aws.String(w.uploadID),
+	}, w.driver.uploadOptions()...); aErr != nil {
+		return errors.Join(err, aErr)
+	}
 	return err
 }
 
 // Commit flushes any remaining data in the buffer and completes the multipart
-// upload.
+// upload. It fails if S3 reports a checksum of the upload other than the one
+// of its parts.
 func (w *writer) Commit(ctx context.Context) error {
 	if err := w.done(); err != nil {
 		return err
 	}
 
-	if err := w.flush(); err != nil {
-		return err
-	}
-
 	w.committed = true
 
-	completedUploadedParts := make(completedParts, len(w.parts))
-	for i, part := range w.parts {
-		completedUploadedParts[i] = &s3.CompletedPart{
-			ETag:       part.ETag,
-			PartNumber: part.PartNumber,
-		}
+	defer w.releaseBuffer()
+
+	if err := w.flush(); err != nil {
+		return w.abort(err)
 	}
+	if err := w.wait(); err != nil {
+		return w.abort(err)
+	}
+
+	completedUploadedParts := w.completedParts()
 
 	// This is an edge case when we are trying to upload an empty file as part of
 	// the MultiPart upload. We get a PUT with Content-Length: 0 and sad things happen.
@@ -1476,80 +2126,131 @@ func (w *writer) Commit(ctx context.Context) error {
 	// Solution: we upload the empty i.e. 0 byte part as a single part and then append it
 	// to the completedUploadedParts slice used to complete the Multipart upload.
 	if len(w.parts) == 0 {
+		checksum := w.partChecksum(nil)
 		resp, err := w.driver.S3.UploadPartWithContext(w.ctx, &s3.UploadPartInput{
-			Bucket:     aws.String(w.driver.Bucket),
-			Key:        aws.String(w.key),
-			PartNumber: aws.Int64(1),
-			UploadId:   aws.String(w.uploadID),
-			Body:       bytes.NewReader(nil),
-		})
+			RequestPayer:      w.driver.getRequestPayer(),
+			Bucket:            aws.String(w.driver.Bucket),
+			Key:               aws.String(w.key),
+			PartNumber:        aws.Int64(1),
+			UploadId:          aws.String(w.uploadID),
+			ChecksumAlgorithm: w.checksumAlgorithm,
+			ChecksumSHA256:    checksum,
+			Body:              bytes.NewReader(nil),
+		}, w.driver.uploadOptions()...)
 		if err != nil {
-			return err
+			return w.abort(err)
 		}
 
 		completedUploadedParts = append(completedUploadedParts, &s3.CompletedPart{
-			ETag:       resp.ETag,
-			PartNumber: aws.Int64(1),
+			ETag:           resp.ETag,
+			ChecksumSHA256: checksum,
+			PartNumber:     aws.Int64(1),
 		})
 	}
 
 	sort.Sort(completedUploadedParts)
 
-	if _, err := w.driver.S3.CompleteMultipartUploadWithContext(w.ctx, &s3.CompleteMultipartUploadInput{
-		Bucket:   aws.String(w.driver.Bucket),
-		Key:      aws.String(w.key),
-		UploadId: aws.String(w.uploadID),
+	resp, err := w.driver.S3.CompleteMultipartUploadWithContext(w.ctx, &s3.CompleteMultipartUploadInput{
+		RequestPayer: w.driver.getRequestPayer(),
+		Bucket:       aws.String(w.driver.Bucket),
+		Key:          aws.String(w.key),
+		UploadId:     aws.String(w.uploadID),
 		MultipartUpload: &s3.CompletedMultipartUpload{
 			Parts: completedUploadedParts,
 		},
-	}); err != nil {
-		if _, aErr := w.driver.S3.AbortMultipartUploadWithContext(w.ctx, &s3.AbortMultipartUploadInput{
-			Bucket:   aws.String(w.driver.Bucket),
-			Key:      aws.String(w.key),
-			UploadId: aws.String(w.uploadID),
-		}); aErr != nil {
-			return errors.Join(err, aErr)
-		}
-		return err
+	}, w.driver.uploadOptions()...)
+	if err != nil {
+		return w.abort(err)
 	}
-	return nil
+	return w.checkCompleted(completedUploadedParts, resp)
+}
+
+// partChecksum returns the checksum of the content of a part, nil if the
+// parts of the upload have no checksum.
+func (w *writer) partChecksum(content []byte) *string {
+	if w.checksumAlgorithm == nil {
+		return nil
+	}
+	return aws.String(contentChecksum(content))
 }
 
 // flush writes at most [w.driver.ChunkSize] of the buffer to S3. flush is only
 // called by [writer.Write] if the buffer is full, and always by [writer.Close]
 // and [writer.Commit].
+//
+// The part is copied out of the buffer and uploaded in the background once
+// one of [writer.inflight] slots is free. With a concurrency of one, flush
+// waits for the upload to complete before returning.
 func (w *writer) flush() error {
-	if w.buf.Len() == 0 {
+	if err := w.err(); err != nil {
+		return err
+	}
+	if w.buf == nil || w.buf.Len() == 0 {
 		return nil
 	}
 
-	r := bytes.NewReader(w.buf.Next(w.driver.ChunkSize))
+	partBuf := w.driver.partPool.Get().(*[]byte)
+	*partBuf = append((*partBuf)[:0], w.buf.Next(w.driver.ChunkSize)...)
 
-	partSize := r.Len()
-	partNumber := aws.Int64(int64(len(w.parts)) + 1)
-
-	resp, err := w.driver.S3.UploadPartWithContext(w.ctx, &s3.UploadPartInput{
-		Bucket:     aws.String(w.driver.Bucket),
-		Key:        aws.String(w.key),
-		PartNumber: partNumber,
-		UploadId:   aws.String(w.uploadID),
-		Body:       r,
-	})
-	if err != nil {
-		return fmt.Errorf("upload part: %w", err)
+	part := &s3.Part{
+		PartNumber:     aws.Int64(int64(len(w.parts)) + 1),
+		Size:           aws.Int64(int64(len(*partBuf))),
+		ChecksumSHA256: w.partChecksum(*partBuf),
 	}
+	w.parts = append(w.parts, part)
+	w.size += *part.Size
 
-	w.parts = append(w.parts, &s3.Part{
-		ETag:       resp.ETag,
-		PartNumber: partNumber,
-		Size:       aws.Int64(int64(partSize)),
-	})
+	w.inflight <- struct{}{}
+	w.pending.Add(1)
+	go func() {
+		defer func() {
+			w.driver.partPool.Put(partBuf)
+			<-w.inflight
+			w.pending.Done()
+		}()
 
-	w.size += int64(partSize)
+		resp, err := w.driver.S3.UploadPartWithContext(w.ctx, &s3.UploadPartInput{
+			RequestPayer:      w.driver.getRequestPayer(),
+			Bucket:            aws.String(w.driver.Bucket),
+			Key:               aws.String(w.key),
+			PartNumber:        part.PartNumber,
+			UploadId:          aws.String(w.uploadID),
+			ChecksumAlgorithm: w.checksumAlgorithm,
+			ChecksumSHA256:    part.ChecksumSHA256,
+			Body:              bytes.NewReader(*partBuf),
+		}, w.driver.uploadOptions()...)
+
+		w.mu.Lock()
+		defer w.mu.Unlock()
+		if err != nil {
+			if w.uploadErr == nil {
+				w.uploadErr = fmt.Errorf("upload part %d: %w", *part.PartNumber, err)
+			}
+			return
+		}
+		part.ETag = resp.ETag
+	}()
 
+	if w.driver.MultipartConcurrency <= 1 {
+		return w.wait()
+	}
 	return nil
 }
 
+// wait blocks until all in-flight part uploads have completed and returns
+// the first error encountered by any of them.
+func (w *writer) wait() error {
+	w.pending.Wait()
+	return w.err()
+}
+
+// err returns the first error encountered by a part upload.
+func (w *writer) err() error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	return w.uploadErr
+}
+
 // done returns an error if the writer is in an invalid state.
 func (w *writer) done() error {
 	switch {
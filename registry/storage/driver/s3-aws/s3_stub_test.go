@@ -0,0 +1,1269 @@
+package s3
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"slices"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/opencontainers/go-digest"
+
+	storagedriver "github.com/distribution/distribution/v3/registry/storage/driver"
+	"github.com/distribution/distribution/v3/registry/storage/driver/testsuites"
+)
+
+const stubBucket = "stub-bucket"
+
+// stubRequest records a request received by the S3 stub
+type stubRequest struct {
+	Method string
+	Key    string
+	Query  map[string][]string
+	Header http.Header
+}
+
+// Type returns a short name for the S3 operation performed by the request
+func (r stubRequest) Type() string {
+	_, partNumber := r.Query["partNumber"]
+	_, uploadID := r.Query["uploadId"]
+	_, uploads := r.Query["uploads"]
+	_, del := r.Query["delete"]
+	_, tagging := r.Query["tagging"]
+	copySource := r.Header.Get("X-Amz-Copy-Source") != ""
+
+	switch {
+	case r.Method == http.MethodPut && partNumber && copySource:
+		return "UploadPartCopy"
+	case r.Method == http.MethodPut && partNumber:
+		return "UploadPart"
+	case r.Method == http.MethodPut && copySource:
+		return "CopyObject"
+	case r.Method == http.MethodPut:
+		return "PutObject"
+	case r.Method == http.MethodPost && uploads:
+		return "CreateMultipartUpload"
+	case r.Method == http.MethodPost && uploadID:
+		return "CompleteMultipartUpload"
+	case r.Method == http.MethodPost && del:
+		return "DeleteObjects"
+	case r.Method == http.MethodDelete && uploadID:
+		return "AbortMultipartUpload"
+	case r.Method == http.MethodDelete:
+		return "DeleteObject"
+	case r.Method == http.MethodHead:
+		return "HeadObject"
+	case r.Method == http.MethodGet && uploads:
+		return "ListMultipartUploads"
+	case r.Method == http.MethodGet && uploadID:
+		return "ListParts"
+	case r.Method == http.MethodGet && tagging:
+		return "GetObjectTagging"
+	case r.Method == http.MethodGet && r.Key == "":
+		return "ListObjectsV2"
+	default:
+		return "GetObject"
+	}
+}
+
+type stubObject struct {
+	data    []byte
+	header  http.Header
+	modTime time.Time
+}
+
+type stubUpload struct {
+	key    string
+	header http.Header
+	parts  map[int64][]byte
+}
+
+// checksummed reports whether the parts of the upload have checksums
+func (u *stubUpload) checksummed() bool {
+	return u.header.Get("X-Amz-Checksum-Algorithm") == "SHA256"
+}
+
+// s3Stub is a minimal in-memory, path-style S3 API used to exercise the
+// driver without access to AWS
+type s3Stub struct {
+	*httptest.Server
+
+	mu       sync.Mutex
+	objects  map[string]*stubObject
+	uploads  map[string]*stubUpload
+	requests []stubRequest
+	nextID   int
+
+	// partHook, if set, is called before an UploadPart is stored. A non-nil
+	// error fails the part with an internal error.
+	partHook func(partNumber int64) error
+
+	// authHook, if set, is called with the access key signing each request.
+	// A non-empty error code fails the request with a bad request of it.
+	authHook func(accessKey string) string
+
+	// rejectChecksums fails the requests with checksum parameters as not
+	// implemented, as some S3 compatible stores do.
+	rejectChecksums bool
+
+	// corruptChecksums reports checksums of other content for the objects
+	// completed or copied.
+	corruptChecksums bool
+}
+
+func newS3Stub(t *testing.T) *s3Stub {
+	t.Helper()
+
+	s := &s3Stub{
+		objects: make(map[string]*stubObject),
+		uploads: make(map[string]*stubUpload),
+	}
+	s.Server = httptest.NewServer(http.HandlerFunc(s.serveHTTP))
+	t.Cleanup(s.Close)
+	return s
+}
+
+// driverParameters returns parameters for a driver talking to the stub
+func (s *s3Stub) driverParameters() DriverParameters {
+	return DriverParameters{
+		AccessKey:                   "stub-access-key",
+		SecretKey:                   "stub-secret-key",
+		Bucket:                      stubBucket,
+		Region:                      "us-east-1",
+		RegionEndpoint:              s.URL,
+		ForcePathStyle:              true,
+		Secure:                      false,
+		V4Auth:                      true,
+		ChunkSize:                   minChunkSize,
+		MultipartConcurrency:        1,
+		MultipartCopyChunkSize:      defaultMultipartCopyChunkSize,
+		MultipartCopyMaxConcurrency: defaultMultipartCopyMaxConcurrency,
+		MultipartCopyThresholdSize:  defaultMultipartCopyThresholdSize,
+		RootDirectory:               "/root",
+		StorageClass:                "STANDARD",
+		ObjectACL:                   "private",
+		LogLevel:                    aws.LogOff,
+	}
+}
+
+func (s *s3Stub) newDriver(t *testing.T, configure func(*DriverParameters)) *Driver {
+	t.Helper()
+
+	params := s.driverParameters()
+	if configure != nil {
+		configure(&params)
+	}
+	d, err := New(context.Background(), params)
+	if err != nil {
+		t.Fatalf("unexpected error creating driver: %v", err)
+	}
+	return d
+}
+
+// recorded returns the requests received so far
+func (s *s3Stub) recorded() []stubRequest {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([]stubRequest(nil), s.requests...)
+}
+
+// reset clears the recorded requests
+func (s *s3Stub) reset() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.requests = nil
+}
+
+func (s *s3Stub) object(key string) (*stubObject, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	o, ok := s.objects[key]
+	return o, ok
+}
+
+// tags returns the tags of the object stored at key
+func (s *s3Stub) tags(key string) (map[string]string, bool) {
+	o, ok := s.object(key)
+	if !ok {
+		return nil, false
+	}
+	values, _ := url.ParseQuery(o.header.Get("X-Amz-Tagging"))
+	tags := make(map[string]string, len(values))
+	for k := range values {
+		tags[k] = values.Get(k)
+	}
+	return tags, true
+}
+
+func (s *s3Stub) pendingUploads() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return len(s.uploads)
+}
+
+// accessKeyOf returns the access key signing the request
+func accessKeyOf(r stubRequest) string {
+	_, credential, _ := strings.Cut(r.Header.Get("Authorization"), "Credential=")
+	accessKey, _, _ := strings.Cut(credential, "/")
+	return accessKey
+}
+
+func stubError(w http.ResponseWriter, status int, code string) {
+	w.Header().Set("Content-Type", "application/xml")
+	w.WriteHeader(status)
+	fmt.Fprintf(w, "<Error><Code>%s</Code><Message>%s</Message></Error>", code, code)
+}
+
+func writeXML(w http.ResponseWriter, v any) {
+	w.Header().Set("Content-Type", "application/xml")
+	out, err := xml.Marshal(v)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	_, _ = w.Write(out)
+}
+
+func etag(data []byte) string {
+	return `"` + digest.FromBytes(data).Encoded()[:32] + `"`
+}
+
+// checksum returns the SHA-256 checksum of data, as S3 reports it
+func checksum(data []byte) string {
+	sum := sha256.Sum256(data)
+	return base64.StdEncoding.EncodeToString(sum[:])
+}
+
+// reportedChecksum returns the checksum the stub reports for data
+func (s *s3Stub) reportedChecksum(data []byte) string {
+	if s.corruptChecksums {
+		return checksum(append(slices.Clone(data), 0))
+	}
+	return checksum(data)
+}
+
+func (s *s3Stub) serveHTTP(w http.ResponseWriter, r *http.Request) {
+	key := strings.TrimPrefix(strings.TrimPrefix(r.URL.Path, "/"+stubBucket), "/")
+	body, err := io.ReadAll(r.Body)
+	if err != nil {
+		stubError(w, http.StatusBadRequest, "IncompleteBody")
+		return
+	}
+
+	req := stubRequest{Method: r.Method, Key: key, Query: r.URL.Query(), Header: r.Header.Clone()}
+	s.mu.Lock()
+	s.requests = append(s.requests, req)
+	s.mu.Unlock()
+
+	if s.authHook != nil {
+		if code := s.authHook(accessKeyOf(req)); code != "" {
+			stubError(w, http.StatusBadRequest, code)
+			return
+		}
+	}
+	if s.rejectChecksums && (r.Header.Get("X-Amz-Checksum-Algorithm") != "" || r.Header.Get("X-Amz-Sdk-Checksum-Algorithm") != "") {
+		stubError(w, http.StatusNotImplemented, "NotImplemented")
+		return
+	}
+	if sum := r.Header.Get("X-Amz-Checksum-Sha256"); sum != "" && sum != checksum(body) {
+		stubError(w, http.StatusBadRequest, "BadDigest")
+		return
+	}
+
+	q := r.URL.Query()
+	switch req.Type() {
+	case "PutObject":
+		s.mu.Lock()
+		s.objects[key] = &stubObject{data: body, header: r.Header.Clone(), modTime: time.Now()}
+		s.mu.Unlock()
+		w.Header().Set("ETag", etag(body))
+	case "CopyObject":
+		source := strings.TrimPrefix(r.Header.Get("X-Amz-Copy-Source"), stubBucket+"/")
+		s.mu.Lock()
+		src, ok := s.objects[source]
+		if ok {
+			header := r.Header.Clone()
+			if r.Header.Get("X-Amz-Tagging-Directive") != "REPLACE" {
+				header.Set("X-Amz-Tagging", src.header.Get("X-Amz-Tagging"))
+			}
+			s.objects[key] = &stubObject{data: src.data, header: header, modTime: time.Now()}
+		}
+		s.mu.Unlock()
+		if !ok {
+			stubError(w, http.StatusNotFound, "NoSuchKey")
+			return
+		}
+		var sum string
+		if r.Header.Get("X-Amz-Checksum-Algorithm") == "SHA256" {
+			sum = s.reportedChecksum(src.data)
+		}
+		writeXML(w, struct {
+			XMLName        xml.Name `xml:"CopyObjectResult"`
+			ETag           string
+			LastModified   string
+			ChecksumSHA256 string `xml:",omitempty"`
+		}{ETag: etag(src.data), LastModified: time.Now().UTC().Format(time.RFC3339), ChecksumSHA256: sum})
+	case "CreateMultipartUpload":
+		s.mu.Lock()
+		s.nextID++
+		id := strconv.Itoa(s.nextID)
+		s.uploads[id] = &stubUpload{key: key, header: r.Header.Clone(), parts: make(map[int64][]byte)}
+		s.mu.Unlock()
+		writeXML(w, struct {
+			XMLName  xml.Name `xml:"InitiateMultipartUploadResult"`
+			Bucket   string
+			Key      string
+			UploadId string
+		}{Bucket: stubBucket, Key: key, UploadId: id})
+	case "UploadPart", "UploadPartCopy":
+		partNumber, _ := strconv.ParseInt(q.Get("partNumber"), 10, 64)
+		if s.partHook != nil && req.Type() == "UploadPart" {
+			if err := s.partHook(partNumber); err != nil {
+				stubError(w, http.StatusInternalServerError, "InternalError")
+				return
+			}
+		}
+		data := body
+		if req.Type() == "UploadPartCopy" {
+			source := strings.TrimPrefix(r.Header.Get("X-Amz-Copy-Source"), stubBucket+"/")
+			o, ok := s.object(source)
+			if !ok {
+				stubError(w, http.StatusNotFound, "NoSuchKey")
+				return
+			}
+			data = o.data
+			if rng := r.Header.Get("X-Amz-Copy-Source-Range"); rng != "" {
+				var first, last int
+				fmt.Sscanf(rng, "bytes=%d-%d", &first, &last)
+				data = data[first : last+1]
+			}
+		}
+		s.mu.Lock()
+		upload, ok := s.uploads[q.Get("uploadId")]
+		if ok {
+			upload.parts[partNumber] = data
+		}
+		s.mu.Unlock()
+		if !ok {
+			stubError(w, http.StatusNotFound, "NoSuchUpload")
+			return
+		}
+		if req.Type() == "UploadPartCopy" {
+			var sum string
+			if upload.checksummed() {
+				sum = checksum(data)
+			}
+			writeXML(w, struct {
+				XMLName        xml.Name `xml:"CopyPartResult"`
+				ETag           string
+				ChecksumSHA256 string `xml:",omitempty"`
+			}{ETag: etag(data), ChecksumSHA256: sum})
+			return
+		}
+		w.Header().Set("ETag", etag(data))
+	case "CompleteMultipartUpload":
+		var complete struct {
+			Parts []struct {
+				PartNumber     int64
+				ETag           string
+				ChecksumSHA256 string
+			} `xml:"Part"`
+		}
+		if err := xml.Unmarshal(body, &complete); err != nil {
+			stubError(w, http.StatusBadRequest, "MalformedXML")
+			return
+		}
+		s.mu.Lock()
+		upload, ok := s.uploads[q.Get("uploadId")]
+		var data, sums []byte
+		if ok {
+			for _, part := range complete.Parts {
+				p, ok := upload.parts[part.PartNumber]
+				if !ok || etag(p) != part.ETag || (upload.checksummed() && checksum(p) != part.ChecksumSHA256) {
+					s.mu.Unlock()
+					stubError(w, http.StatusBadRequest, "InvalidPart")
+					return
+				}
+				data = append(data, p...)
+				sum := sha256.Sum256(p)
+				sums = append(sums, sum[:]...)
+			}
+			delete(s.uploads, q.Get("uploadId"))
+			s.objects[upload.key] = &stubObject{data: data, header: upload.header, modTime: time.Now()}
+		}
+		s.mu.Unlock()
+		if !ok {
+			stubError(w, http.StatusNotFound, "NoSuchUpload")
+			return
+		}
+		var sum string
+		if upload.checksummed() {
+			sum = s.reportedChecksum(sums) + "-" + strconv.Itoa(len(complete.Parts))
+		}
+		writeXML(w, struct {
+			XMLName        xml.Name `xml:"CompleteMultipartUploadResult"`
+			Bucket         string
+			Key            string
+			ETag           string
+			ChecksumSHA256 string `xml:",omitempty"`
+		}{Bucket: stubBucket, Key: key, ETag: etag(data), ChecksumSHA256: sum})
+	case "AbortMultipartUpload":
+		s.mu.Lock()
+		delete(s.uploads, q.Get("uploadId"))
+		s.mu.Unlock()
+		w.WriteHeader(http.StatusNoContent)
+	case "DeleteObjects":
+		var del struct {
+			Objects []struct {
+				Key string
+			} `xml:"Object"`
+		}
+		if err := xml.Unmarshal(body, &del); err != nil {
+			stubError(w, http.StatusBadRequest, "MalformedXML")
+			return
+		}
+		type deleted struct {
+			Key string
+		}
+		result := struct {
+			XMLName xml.Name  `xml:"DeleteResult"`
+			Deleted []deleted `xml:"Deleted"`
+		}{}
+		s.mu.Lock()
+		for _, o := range del.Objects {
+			delete(s.objects, o.Key)
+			result.Deleted = append(result.Deleted, deleted{Key: o.Key})
+		}
+		s.mu.Unlock()
+		writeXML(w, result)
+	case "DeleteObject":
+		s.mu.Lock()
+		delete(s.objects, key)
+		s.mu.Unlock()
+		w.WriteHeader(http.StatusNoContent)
+	case "HeadObject", "GetObject":
+		o, ok := s.object(key)
+		if !ok {
+			stubError(w, http.StatusNotFound, "NoSuchKey")
+			return
+		}
+		w.Header().Set("Last-Modified", o.modTime.UTC().Format(http.TimeFormat))
+		w.Header().Set("ETag", etag(o.data))
+		data := o.data
+		status := http.StatusOK
+		if rng := r.Header.Get("Range"); rng != "" && r.Method == http.MethodGet {
+			var offset int
+			fmt.Sscanf(rng, "bytes=%d-", &offset)
+			if offset >= len(data) {
+				stubError(w, http.StatusRequestedRangeNotSatisfiable, "InvalidRange")
+				return
+			}
+			w.Header().Set("Content-Range", fmt.Sprintf("bytes %d-%d/%d", offset, len(data)-1, len(data)))
+			data = data[offset:]
+			status = http.StatusPartialContent
+		}
+		w.Header().Set("Content-Length", strconv.Itoa(len(data)))
+		w.WriteHeader(status)
+		if r.Method == http.MethodGet {
+			_, _ = w.Write(data)
+		}
+	case "ListMultipartUploads":
+		type upload struct {
+			Key               string
+			UploadId          string
+			ChecksumAlgorithm string `xml:",omitempty"`
+		}
+		result := struct {
+			XMLName     xml.Name `xml:"ListMultipartUploadsResult"`
+			Bucket      string
+			IsTruncated bool
+			Uploads     []upload `xml:"Upload"`
+		}{Bucket: stubBucket}
+		s.mu.Lock()
+		for id, u := range s.uploads {
+			if strings.HasPrefix(u.key, q.Get("prefix")) {
+				result.Uploads = append(result.Uploads, upload{Key: u.key, UploadId: id, ChecksumAlgorithm: u.header.Get("X-Amz-Checksum-Algorithm")})
+			}
+		}
+		s.mu.Unlock()
+		writeXML(w, result)
+	case "ListParts":
+		type part struct {
+			PartNumber     int64
+			ETag           string
+			Size           int
+			ChecksumSHA256 string `xml:",omitempty"`
+		}
+		result := struct {
+			XMLName     xml.Name `xml:"ListPartsResult"`
+			IsTruncated bool
+			Parts       []part `xml:"Part"`
+		}{}
+		s.mu.Lock()
+		if u, ok := s.uploads[q.Get("uploadId")]; ok {
+			for n, p := range u.parts {
+				var sum string
+				if u.checksummed() {
+					sum = checksum(p)
+				}
+				result.Parts = append(result.Parts, part{PartNumber: n, ETag: etag(p), Size: len(p), ChecksumSHA256: sum})
+			}
+		}
+		s.mu.Unlock()
+		sort.Slice(result.Parts, func(i, j int) bool { return result.Parts[i].PartNumber < result.Parts[j].PartNumber })
+		writeXML(w, result)
+	case "ListObjectsV2":
+		s.listObjects(w, q)
+	case "GetObjectTagging":
+		tags, ok := s.tags(key)
+		if !ok {
+			stubError(w, http.StatusNotFound, "NoSuchKey")
+			return
+		}
+		type tag struct {
+			Key   string
+			Value string
+		}
+		result := struct {
+			XMLName xml.Name `xml:"Tagging"`
+			TagSet  []tag    `xml:"TagSet>Tag"`
+		}{}
+		for k, v := range tags {
+			result.TagSet = append(result.TagSet, tag{Key: k, Value: v})
+		}
+		writeXML(w, result)
+	}
+}
+
+func (s *s3Stub) listObjects(w http.ResponseWriter, q map[string][]string) {
+	get := func(k string) string {
+		if v := q[k]; len(v) > 0 {
+			return v[0]
+		}
+		return ""
+	}
+	prefix, delimiter := get("prefix"), get("delimiter")
+	startAfter := get("start-after")
+	if token := get("continuation-token"); token != "" {
+		startAfter = token
+	}
+	maxKeys := listMax
+	if mk := get("max-keys"); mk != "" {
+		maxKeys, _ = strconv.Atoi(mk)
+	}
+
+	s.mu.Lock()
+	keys := make([]string, 0, len(s.objects))
+	for k := range s.objects {
+		keys = append(keys, k)
+	}
+	objects := s.objects
+	sort.Strings(keys)
+
+	type content struct {
+		Key          string
+		LastModified string
+		ETag         string
+		Size         int
+		StorageClass string
+	}
+	type commonPrefix struct {
+		Prefix string
+	}
+	result := struct {
+		XMLName               xml.Name `xml:"ListBucketResult"`
+		Name                  string
+		Prefix                string
+		KeyCount              int
+		MaxKeys               int
+		IsTruncated           bool
+		NextContinuationToken string         `xml:",omitempty"`
+		Contents              []content      `xml:"Contents"`
+		CommonPrefixes        []commonPrefix `xml:"CommonPrefixes"`
+	}{Name: stubBucket, Prefix: prefix, MaxKeys: maxKeys}
+
+	seenPrefixes := map[string]bool{}
+	last := ""
+	for _, k := range keys {
+		if !strings.HasPrefix(k, prefix) || k <= startAfter {
+			continue
+		}
+		if result.KeyCount >= maxKeys {
+			result.IsTruncated = true
+			result.NextContinuationToken = last
+			break
+		}
+		if delimiter != "" {
+			if i := strings.Index(k[len(prefix):], delimiter); i >= 0 {
+				p := k[:len(prefix)+i+1]
+				if !seenPrefixes[p] {
+					seenPrefixes[p] = true
+					result.CommonPrefixes = append(result.CommonPrefixes, commonPrefix{Prefix: p})
+					result.KeyCount++
+				}
+				last = k
+				continue
+			}
+		}
+		o := objects[k]
+		result.Contents = append(result.Contents, content{
+			Key:          k,
+			LastModified: o.modTime.UTC().Format(time.RFC3339),
+			ETag:         etag(o.data),
+			Size:         len(o.data),
+			StorageClass: "STANDARD",
+		})
+		result.KeyCount++
+		last = k
+	}
+	s.mu.Unlock()
+
+	writeXML(w, result)
+}
+
+func TestS3StubDriverSuite(t *testing.T) {
+
+	stub := newS3Stub(t)
+	testsuites.Driver(t, func() (storagedriver.StorageDriver, error) {
+		params := stub.driverParameters()
+		params.MultipartConcurrency = 4
+		return New(context.Background(), params)
+	}, false)
+}
+
+func TestWriterParallelPartsOutOfOrder(t *testing.T) {
+	stub := newS3Stub(t)
+	d := stub.newDriver(t, func(p *DriverParameters) {
+		p.MultipartConcurrency = 3
+	})
+
+	// Hold back the first part until the later ones have been stored, so
+	// parts are acknowledged out of order.
+	release := make(chan struct{})
+	var stored sync.WaitGroup
+	stored.Add(2)
+	stub.partHook = func(partNumber int64) error {
+		switch partNumber {
+		case 1:
+			<-release
+		case 2, 3:
+			stored.Done()
+		}
+		return nil
+	}
+	go func() {
+		stored.Wait()
+		close(release)
+	}()
+
+	ctx := context.Background()
+	contents := make([]byte, 3*minChunkSize+1024)
+	for i := range contents {
+		contents[i] = byte(i % 251)
+	}
+
+	w, err := d.Writer(ctx, "/parallel", false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := w.Write(contents); err != nil {
+		t.Fatal(err)
+	}
+	if err := w.Commit(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	got, err := d.GetContent(ctx, "/parallel")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got, contents) {
+		t.Fatalf("content mismatch: got %d bytes, want %d", len(got), len(contents))
+	}
+	if n := stub.pendingUploads(); n != 0 {
+		t.Fatalf("expected no pending uploads, got %d", n)
+	}
+}
+
+func TestWriterFailedPartAborts(t *testing.T) {
+	stub := newS3Stub(t)
+	d := stub.newDriver(t, func(p *DriverParameters) {
+		p.MultipartConcurrency = 3
+	})
+	stub.partHook = func(partNumber int64) error {
+		if partNumber == 2 {
+			return errors.New("injected failure")
+		}
+		return nil
+	}
+
+	ctx := context.Background()
+	w, err := d.Writer(ctx, "/failing", false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// A write may or may not observe the failure depending on timing, but
+	// Commit must.
+	_, _ = w.Write(make([]byte, 3*minChunkSize))
+	if err := w.Commit(ctx); err == nil {
+		t.Fatal("expected commit to fail")
+	}
+
+	var aborted, completed bool
+	for _, r := range stub.recorded() {
+		switch r.Type() {
+		case "AbortMultipartUpload":
+			aborted = true
+		case "CompleteMultipartUpload":
+			completed = true
+		}
+	}
+	if !aborted {
+		t.Fatal("expected multipart upload to be aborted")
+	}
+	if completed {
+		t.Fatal("expected multipart upload not to be completed")
+	}
+	if n := stub.pendingUploads(); n != 0 {
+		t.Fatalf("expected no pending uploads, got %d", n)
+	}
+	if _, ok := stub.object("root/failing"); ok {
+		t.Fatal("expected no object to be stored")
+	}
+}
+
+func TestWriterCancelWaitsForParts(t *testing.T) {
+	stub := newS3Stub(t)
+	d := stub.newDriver(t, func(p *DriverParameters) {
+		p.MultipartConcurrency = 2
+	})
+
+	ctx := context.Background()
+	w, err := d.Writer(ctx, "/cancelled", false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := w.Write(make([]byte, 2*minChunkSize)); err != nil {
+		t.Fatal(err)
+	}
+	if err := w.Cancel(ctx); err != nil {
+		t.Fatal(err)
+	}
+
+	requests := stub.recorded()
+	if last := requests[len(requests)-1]; last.Type() != "AbortMultipartUpload" {
+		t.Fatalf("expected abort to be the last request, got %s", last.Type())
+	}
+	if n := stub.pendingUploads(); n != 0 {
+		t.Fatalf("expected no pending uploads, got %d", n)
+	}
+}
+
+func TestKMSKeysByPrefix(t *testing.T) {
+	stub := newS3Stub(t)
+	d := stub.newDriver(t, func(p *DriverParameters) {
+		p.Encrypt = true
+		p.KeyID = "default-key"
+		p.KMSKeys = map[string]string{
+			"/docker/registry/v2/repositories/tenant-a/":        "tenant-a-key",
+			"/docker/registry/v2/repositories/tenant-a/secret/": "tenant-a-secret-key",
+			"/docker/registry/v2/repositories/tenant-b/":        "tenant-b-key",
+			"/docker/registry/v2/repositories/team":             "team-key",
+		}
+	})
+
+	const (
+		keyHeader = "X-Amz-Server-Side-Encryption-Aws-Kms-Key-Id"
+		sseHeader = "X-Amz-Server-Side-Encryption"
+	)
+	ctx := context.Background()
+	for _, tc := range []struct {
+		path string
+		key  string
+	}{
+		{path: "/docker/registry/v2/repositories/tenant-a/app/_layers/link", key: "tenant-a-key"},
+		{path: "/docker/registry/v2/repositories/tenant-a/secret/_layers/link", key: "tenant-a-secret-key"},
+		{path: "/docker/registry/v2/repositories/tenant-b/app/_layers/link", key: "tenant-b-key"},
+		// The prefixes match whole path components.
+		{path: "/docker/registry/v2/repositories/team/app/_layers/link", key: "team-key"},
+		{path: "/docker/registry/v2/repositories/teamfoo/app/_layers/link", key: "default-key"},
+		{path: "/docker/registry/v2/blobs/sha256/ab/abcd/data", key: "default-key"},
+	} {
+		stub.reset()
+		if err := d.PutContent(ctx, tc.path, []byte("content")); err != nil {
+			t.Fatal(err)
+		}
+
+		w, err := d.Writer(ctx, tc.path+".upload", false)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := w.Write([]byte("content")); err != nil {
+			t.Fatal(err)
+		}
+		if err := w.Commit(ctx); err != nil {
+			t.Fatal(err)
+		}
+		if err := w.Close(); err != nil {
+			t.Fatal(err)
+		}
+
+		for _, r := range stub.recorded() {
+			switch r.Type() {
+			case "PutObject", "CreateMultipartUpload":
+				if got := r.Header.Get(keyHeader); got != tc.key {
+					t.Errorf("%s %s: expected key %q, got %q", r.Type(), tc.path, tc.key, got)
+				}
+				if got := r.Header.Get(sseHeader); got != "aws:kms" {
+					t.Errorf("%s %s: expected aws:kms encryption, got %q", r.Type(), tc.path, got)
+				}
+			}
+		}
+	}
+
+	// Moves must be encrypted with the key of the destination.
+	stub.reset()
+	src := "/docker/registry/v2/repositories/tenant-a/app/_uploads/id/data"
+	dst := "/docker/registry/v2/repositories/tenant-b/app/_layers/data"
+	if err := d.PutContent(ctx, src, []byte("content")); err != nil {
+		t.Fatal(err)
+	}
+	if err := d.Move(ctx, src, dst); err != nil {
+		t.Fatal(err)
+	}
+	var copied bool
+	for _, r := range stub.recorded() {
+		if r.Type() == "CopyObject" {
+			copied = true
+			if got := r.Header.Get(keyHeader); got != "tenant-b-key" {
+				t.Errorf("expected copy to use the destination key, got %q", got)
+			}
+		}
+	}
+	if !copied {
+		t.Fatal("expected move to copy the object")
+	}
+}
+
+func TestKMSKeysRequireEncrypt(t *testing.T) {
+	_, err := FromParameters(context.Background(), map[string]any{
+		"region":  "us-east-1",
+		"bucket":  stubBucket,
+		"kmskeys": map[any]any{"/docker/registry/v2/repositories/tenant-a/": "tenant-a-key"},
+	})
+	if err == nil {
+		t.Fatal("expected an error when kmskeys is set without encrypt")
+	}
+}
+
+func TestRequestPayer(t *testing.T) {
+	stub := newS3Stub(t)
+	d := stub.newDriver(t, func(p *DriverParameters) {
+		p.RequestPayer = "requester"
+		p.MultipartCopyThresholdSize = minChunkSize
+		p.MultipartCopyChunkSize = minChunkSize
+	})
+
+	ctx := context.Background()
+	contents := make([]byte, minChunkSize+1024)
+	if _, err := rand.Read(contents); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := d.PutContent(ctx, "/small", []byte("content")); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := d.GetContent(ctx, "/small"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := d.Stat(ctx, "/small"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := d.List(ctx, "/"); err != nil {
+		t.Fatal(err)
+	}
+	if err := d.Move(ctx, "/small", "/moved"); err != nil {
+		t.Fatal(err)
+	}
+
+	w, err := d.Writer(ctx, "/large", false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := w.Write(contents[:minChunkSize+1]); err != nil {
+		t.Fatal(err)
+	}
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+	w, err = d.Writer(ctx, "/large", true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := w.Write(contents[minChunkSize+1:]); err != nil {
+		t.Fatal(err)
+	}
+	if err := w.Commit(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if err := d.Move(ctx, "/large", "/large-moved"); err != nil {
+		t.Fatal(err)
+	}
+
+	w, err = d.Writer(ctx, "/cancelled", false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := w.Write(contents); err != nil {
+		t.Fatal(err)
+	}
+	if err := w.Cancel(ctx); err != nil {
+		t.Fatal(err)
+	}
+	for _, path := range []string{"/moved", "/large-moved"} {
+		if err := d.Delete(ctx, path); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	seen := map[string]bool{}
+	for _, r := range stub.recorded() {
+		seen[r.Type()] = true
+		if got := r.Header.Get("X-Amz-Request-Payer"); got != "requester" {
+			t.Errorf("%s %s: expected x-amz-request-payer requester, got %q", r.Type(), r.Key, got)
+		}
+	}
+	for _, typ := range []string{
+		"PutObject", "GetObject", "HeadObject", "ListObjectsV2", "CopyObject",
+		"CreateMultipartUpload", "UploadPart", "UploadPartCopy", "CompleteMultipartUpload",
+		"AbortMultipartUpload", "ListMultipartUploads", "ListParts", "DeleteObjects",
+	} {
+		if !seen[typ] {
+			t.Errorf("expected a %s request", typ)
+		}
+	}
+}
+
+func TestRequestPayerRedirectURL(t *testing.T) {
+	stub := newS3Stub(t)
+	d := stub.newDriver(t, func(p *DriverParameters) {
+		p.RequestPayer = "requester"
+	})
+	if err := d.PutContent(context.Background(), "/blob", []byte("content")); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, method := range []string{http.MethodGet, http.MethodHead} {
+		redirect, err := d.RedirectURL(httptest.NewRequest(method, "/blob", nil), "/blob")
+		if err != nil {
+			t.Fatal(err)
+		}
+		u, err := url.Parse(redirect)
+		if err != nil {
+			t.Fatal(err)
+		}
+		query := u.Query()
+		if got := query.Get("x-amz-request-payer"); got != "requester" {
+			t.Errorf("%s: expected x-amz-request-payer=requester in the presigned URL, got %q", method, got)
+		}
+		// The client cannot send the header, so it must not be signed as one.
+		if signed := query.Get("X-Amz-SignedHeaders"); strings.Contains(signed, "x-amz-request-payer") {
+			t.Errorf("%s: x-amz-request-payer is a signed header: %s", method, signed)
+		}
+	}
+}
+
+func TestRequestPayerValidation(t *testing.T) {
+	for _, tc := range []struct {
+		value   any
+		wantErr bool
+	}{
+		{value: "requester"},
+		{value: ""},
+		{value: "owner", wantErr: true},
+		{value: true, wantErr: true},
+	} {
+		_, err := FromParameters(context.Background(), map[string]any{
+			"region":       "us-east-1",
+			"bucket":       stubBucket,
+			"requestpayer": tc.value,
+		})
+		if tc.wantErr != (err != nil) {
+			t.Errorf("requestpayer %v: unexpected error %v", tc.value, err)
+		}
+	}
+}
+
+func TestWalkParallel(t *testing.T) {
+	stub := newS3Stub(t)
+	d := stub.newDriver(t, nil)
+	ctx := context.Background()
+
+	for _, p := range []string{
+		"/a/file", "/a/b/c/file1", "/a/b/c/file2", "/a/b-c/file", "/a/b/d/e/file",
+		"/a/f/file", "/a/f/g/file", "/a-b/file", "/a/skip/file", "/a/skip/h/file", "/z",
+	} {
+		if err := d.PutContent(ctx, p, []byte(p)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// a directory marker of an empty directory
+	stub.mu.Lock()
+	stub.objects["root/a/empty/"] = &stubObject{modTime: time.Now()}
+	stub.mu.Unlock()
+
+	walk := func(from string, options ...func(*storagedriver.WalkOptions)) []string {
+		var walked []string
+		err := d.Walk(ctx, from, func(fileInfo storagedriver.FileInfo) error {
+			if fileInfo.IsDir() {
+				walked = append(walked, fileInfo.Path()+"/")
+			} else {
+				walked = append(walked, fmt.Sprintf("%s:%d", fileInfo.Path(), fileInfo.Size()))
+			}
+			if fileInfo.Path() == "/a/skip" {
+				return storagedriver.ErrSkipDir
+			}
+			return nil
+		}, options...)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return walked
+	}
+
+	for _, from := range []string{"/", "/a", "/a/b"} {
+		// The sequential walk follows the order of the keys, while the
+		// parallel walk orders the entries of each directory.
+		expected := walk(from)
+		sort.Strings(expected)
+		stub.reset()
+		walked := walk(from, storagedriver.WithParallelism(4))
+		sort.Strings(walked)
+		if strings.Join(walked, " ") != strings.Join(expected, " ") {
+			t.Fatalf("walk of %s mismatched:\nexpected %v\nwalked   %v", from, expected, walked)
+		}
+		for _, r := range stub.recorded() {
+			if r.Type() == "ListObjectsV2" && len(r.Query["delimiter"]) == 0 {
+				t.Fatalf("parallel walk of %s listed without a delimiter: %v", from, r.Query)
+			}
+		}
+	}
+}
+
+// blobDataPath returns the driver path of the data of the blob of content
+func blobDataPath(content []byte) string {
+	dgst := digest.FromBytes(content)
+	return "/docker/registry/v2/blobs/sha256/" + dgst.Encoded()[:2] + "/" + dgst.Encoded() + "/data"
+}
+
+func TestChecksums(t *testing.T) {
+	stub := newS3Stub(t)
+	d := stub.newDriver(t, func(p *DriverParameters) {
+		p.ChecksumAlgorithm = "SHA256"
+		p.MultipartCopyThresholdSize = minChunkSize
+		p.MultipartCopyChunkSize = minChunkSize
+	})
+
+	ctx := context.Background()
+	small := []byte("content")
+	large := make([]byte, 2*minChunkSize+1024)
+	if _, err := rand.Read(large); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := d.PutContent(ctx, "/small", small); err != nil {
+		t.Fatal(err)
+	}
+	if err := d.Move(ctx, "/small", blobDataPath(small)); err != nil {
+		t.Fatal(err)
+	}
+
+	// The parts of a resumed upload keep their checksums.
+	w, err := d.Writer(ctx, "/large", false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := w.Write(large[:minChunkSize]); err != nil {
+		t.Fatal(err)
+	}
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+	w, err = d.Writer(ctx, "/large", true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := w.Write(large[minChunkSize:]); err != nil {
+		t.Fatal(err)
+	}
+	if err := w.Commit(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if err := d.Move(ctx, "/large", blobDataPath(large)); err != nil {
+		t.Fatal(err)
+	}
+
+	for content, path := range map[string]string{string(small): blobDataPath(small), string(large): blobDataPath(large)} {
+		got, err := d.GetContent(ctx, path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(got, []byte(content)) {
+			t.Fatalf("content mismatch at %s: got %d bytes, want %d", path, len(got), len(content))
+		}
+	}
+
+	seen := map[string]bool{}
+	for _, r := range stub.recorded() {
+		seen[r.Type()] = true
+		switch r.Type() {
+		case "PutObject":
+			if got := r.Header.Get("X-Amz-Sdk-Checksum-Algorithm"); got != "SHA256" {
+				t.Errorf("PutObject %s: expected checksum algorithm SHA256, got %q", r.Key, got)
+			}
+			if got, want := r.Header.Get("X-Amz-Checksum-Sha256"), checksum(small); got != want {
+				t.Errorf("PutObject %s: expected checksum %s, got %q", r.Key, want, got)
+			}
+		case "UploadPart":
+			if got := r.Header.Get("X-Amz-Sdk-Checksum-Algorithm"); got != "SHA256" {
+				t.Errorf("UploadPart %s: expected checksum algorithm SHA256, got %q", r.Key, got)
+			}
+			if r.Header.Get("X-Amz-Checksum-Sha256") == "" {
+				t.Errorf("UploadPart %s: expected a checksum", r.Key)
+			}
+		case "CreateMultipartUpload", "CopyObject":
+			if got := r.Header.Get("X-Amz-Checksum-Algorithm"); got != "SHA256" {
+				t.Errorf("%s %s: expected checksum algorithm SHA256, got %q", r.Type(), r.Key, got)
+			}
+		}
+	}
+	for _, typ := range []string{"PutObject", "CopyObject", "CreateMultipartUpload", "UploadPart", "UploadPartCopy", "CompleteMultipartUpload"} {
+		if !seen[typ] {
+			t.Errorf("expected a %s request", typ)
+		}
+	}
+}
+
+func TestChecksumMismatch(t *testing.T) {
+	stub := newS3Stub(t)
+	d := stub.newDriver(t, func(p *DriverParameters) {
+		p.ChecksumAlgorithm = "SHA256"
+	})
+
+	ctx := context.Background()
+	stub.corruptChecksums = true
+	w, err := d.Writer(ctx, "/corrupt", false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := w.Write(make([]byte, minChunkSize+1024)); err != nil {
+		t.Fatal(err)
+	}
+	if err := w.Commit(ctx); err == nil {
+		t.Fatal("expected commit to fail on a checksum mismatch")
+	}
+	if _, ok := stub.object("root/corrupt"); ok {
+		t.Fatal("expected the object of a checksum mismatch to be deleted")
+	}
+	if n := stub.pendingUploads(); n != 0 {
+		t.Fatalf("expected no pending uploads, got %d", n)
+	}
+
+	// A blob is moved to its data only if S3 reports its digest as the
+	// checksum of the copy.
+	stub.corruptChecksums = false
+	content := []byte("content")
+	if err := d.PutContent(ctx, "/upload", content); err != nil {
+		t.Fatal(err)
+	}
+	wrongPath := blobDataPath([]byte("other content"))
+	if err := d.Move(ctx, "/upload", wrongPath); err == nil {
+		t.Fatal("expected the move to the data of another blob to fail")
+	}
+	if _, ok := stub.object("root" + wrongPath); ok {
+		t.Fatal("expected the copy of a checksum mismatch to be deleted")
+	}
+	if _, ok := stub.object("root/upload"); !ok {
+		t.Fatal("expected the source of a failed move to be kept")
+	}
+}
+
+func TestChecksumsUnsupported(t *testing.T) {
+	stub := newS3Stub(t)
+	stub.rejectChecksums = true
+	d := stub.newDriver(t, func(p *DriverParameters) {
+		p.ChecksumAlgorithm = "SHA256"
+	})
+
+	ctx := context.Background()
+	if err := d.PutContent(ctx, "/small", []byte("content")); err != nil {
+		t.Fatal(err)
+	}
+	w, err := d.Writer(ctx, "/large", false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := w.Write(make([]byte, minChunkSize+1024)); err != nil {
+		t.Fatal(err)
+	}
+	if err := w.Commit(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if err := d.Move(ctx, "/small", "/moved"); err != nil {
+		t.Fatal(err)
+	}
+
+	// Only the first request is rejected, the checksums are disabled after.
+	var checksummed int
+	for _, r := range stub.recorded() {
+		if r.Header.Get("X-Amz-Checksum-Algorithm") != "" || r.Header.Get("X-Amz-Sdk-Checksum-Algorithm") != "" {
+			checksummed++
+		}
+	}
+	if checksummed != 1 {
+		t.Fatalf("expected a single request with checksums, got %d", checksummed)
+	}
+	if _, ok := stub.object("root/large"); !ok {
+		t.Fatal("expected the object to be stored without checksums")
+	}
+}
+
+func TestChecksumAlgorithmValidation(t *testing.T) {
+	for _, tc := range []struct {
+		value   any
+		wantErr bool
+	}{
+		{value: "sha256"},
+		{value: "SHA256"},
+		{value: ""},
+		{value: "md5", wantErr: true},
+		{value: true, wantErr: true},
+	} {
+		_, err := FromParameters(context.Background(), map[string]any{
+			"region":            "us-east-1",
+			"bucket":            stubBucket,
+			"checksumalgorithm": tc.value,
+		})
+		if tc.wantErr != (err != nil) {
+			t.Errorf("checksumalgorithm %v: unexpected error %v", tc.value, err)
+		}
+	}
+}
@@ -6,7 +6,9 @@ import (
 	"crypto/rand"
 	"errors"
 	"fmt"
+	"io"
 	"net/http"
+	"net/url"
 	"os"
 	"path"
 	"reflect"
@@ -14,9 +16,12 @@ import (
 	"sort"
 	"strconv"
 	"strings"
+	"syscall"
 	"testing"
 
 	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/aws/request"
 	"github.com/aws/aws-sdk-go/service/s3"
 	"github.com/distribution/distribution/v3/internal/dcontext"
 	storagedriver "github.com/distribution/distribution/v3/registry/storage/driver"
@@ -128,6 +133,7 @@ func init() {
 			SkipVerify:                  skipVerifyBool,
 			V4Auth:                      v4Bool,
 			ChunkSize:                   minChunkSize,
+			MultipartConcurrency:        defaultMultipartConcurrency,
 			MultipartCopyChunkSize:      defaultMultipartCopyChunkSize,
 			MultipartCopyMaxConcurrency: defaultMultipartCopyMaxConcurrency,
 			MultipartCopyThresholdSize:  defaultMultipartCopyThresholdSize,
@@ -674,8 +680,8 @@ func TestWalkEmptyUploadsDir(t *testing.T) {
 			Key:                  aws.String(d.s3Path(p)),
 			ContentType:          d.getContentType(),
 			ACL:                  d.getACL(),
-			ServerSideEncryption: d.getEncryptionMode(),
-			SSEKMSKeyId:          d.getSSEKMSKeyID(),
+			ServerSideEncryption: d.getEncryptionMode(d.s3Path(p)),
+			SSEKMSKeyId:          d.getSSEKMSKeyID(d.s3Path(p)),
 			StorageClass:         d.getStorageClass(),
 			Body:                 bytes.NewReader([]byte("content " + p)),
 		})
@@ -1127,3 +1133,160 @@ func compareWalked(t *testing.T, expected, walked []string) {
 		}
 	}
 }
+
+func TestParseErrorRetryable(t *testing.T) {
+	for _, tc := range []struct {
+		name      string
+		err       error
+		retryable bool
+	}{
+		{name: "internal error", err: awserr.NewRequestFailure(awserr.New("InternalError", "internal error", nil), http.StatusInternalServerError, "id"), retryable: true},
+		{name: "service unavailable", err: awserr.NewRequestFailure(awserr.New("ServiceUnavailable", "unavailable", nil), http.StatusServiceUnavailable, "id"), retryable: true},
+		{name: "request timeout", err: awserr.NewRequestFailure(awserr.New("RequestTimeout", "timeout", nil), http.StatusBadRequest, "id"), retryable: true},
+		{name: "throttled", err: awserr.NewRequestFailure(awserr.New("SlowDown", "slow down", nil), http.StatusServiceUnavailable, "id"), retryable: true},
+		{name: "connection reset", err: awserr.New(request.ErrCodeRequestError, "send request failed", syscall.ECONNRESET), retryable: true},
+		{name: "access denied", err: awserr.NewRequestFailure(awserr.New("AccessDenied", "access denied", nil), http.StatusForbidden, "id")},
+		{name: "cancelled", err: awserr.New(request.CanceledErrorCode, "request canceled", context.Canceled)},
+		{name: "not an AWS error", err: errors.New("unexpected")},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			err := parseError("/path", tc.err)
+			if got := storagedriver.IsRetryable(err); got != tc.retryable {
+				t.Fatalf("IsRetryable(%v) = %v, want %v", err, got, tc.retryable)
+			}
+			if !errors.Is(err, tc.err) {
+				t.Fatalf("expected %v to wrap %v", err, tc.err)
+			}
+		})
+	}
+
+	var notFound storagedriver.PathNotFoundError
+	err := parseError("/path", awserr.NewRequestFailure(awserr.New("NoSuchKey", "no such key", nil), http.StatusNotFound, "id"))
+	if !errors.As(err, &notFound) || storagedriver.IsRetryable(err) {
+		t.Fatalf("expected a path not found error, got %v", err)
+	}
+}
+
+func TestAccelerate(t *testing.T) {
+	const (
+		standardHost    = "registry-bucket.s3.amazonaws.com"
+		accelerateHost  = "registry-bucket.s3-accelerate.amazonaws.com"
+		uploadID        = "upload-id"
+		initiatedUpload = "<InitiateMultipartUploadResult><UploadId>" + uploadID + "</UploadId></InitiateMultipartUploadResult>"
+	)
+	params := func() DriverParameters {
+		return DriverParameters{
+			AccessKey:                   "access-key",
+			SecretKey:                   "secret-key",
+			Bucket:                      "registry-bucket",
+			Region:                      "us-east-1",
+			Secure:                      true,
+			V4Auth:                      true,
+			ChunkSize:                   minChunkSize,
+			MultipartConcurrency:        1,
+			MultipartCopyChunkSize:      defaultMultipartCopyChunkSize,
+			MultipartCopyMaxConcurrency: defaultMultipartCopyMaxConcurrency,
+			MultipartCopyThresholdSize:  defaultMultipartCopyThresholdSize,
+			RootDirectory:               "/root",
+			StorageClass:                s3.StorageClassStandard,
+			ObjectACL:                   s3.ObjectCannedACLPrivate,
+			LogLevel:                    aws.LogOff,
+			Accelerate:                  true,
+		}
+	}
+
+	for _, tc := range []struct {
+		name         string
+		redirects    bool
+		redirectHost string
+	}{
+		{name: "standard redirects", redirectHost: standardHost},
+		{name: "accelerated redirects", redirects: true, redirectHost: accelerateHost},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			p := params()
+			p.AccelerateRedirects = tc.redirects
+			d, err := New(context.Background(), p)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			// Answer the requests of the driver without sending them,
+			// recording the host each operation was sent to.
+			hosts := make(map[string]string)
+			s3obj := d.StorageDriver.(*driver).S3
+			s3obj.Handlers.Send.Clear()
+			s3obj.Handlers.Send.PushBack(func(r *request.Request) {
+				hosts[r.Operation.Name] = r.HTTPRequest.URL.Host
+				body := ""
+				switch r.Operation.Name {
+				case "CreateMultipartUpload":
+					body = initiatedUpload
+				case "ListObjectsV2":
+					body = "<ListBucketResult></ListBucketResult>"
+				case "CompleteMultipartUpload":
+					body = "<CompleteMultipartUploadResult></CompleteMultipartUploadResult>"
+				}
+				r.HTTPResponse = &http.Response{
+					StatusCode: http.StatusOK,
+					Header:     http.Header{"Etag": []string{`"etag"`}},
+					Body:       io.NopCloser(strings.NewReader(body)),
+				}
+			})
+
+			ctx := context.Background()
+			if err := d.PutContent(ctx, "/content", []byte("content")); err != nil {
+				t.Fatal(err)
+			}
+			w, err := d.Writer(ctx, "/upload", false)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if _, err := w.Write([]byte("upload")); err != nil {
+				t.Fatal(err)
+			}
+			if err := w.Commit(ctx); err != nil {
+				t.Fatal(err)
+			}
+			if _, err := d.List(ctx, "/"); err != nil {
+				t.Fatal(err)
+			}
+
+			for op, want := range map[string]string{
+				"PutObject":               accelerateHost,
+				"CreateMultipartUpload":   accelerateHost,
+				"UploadPart":              accelerateHost,
+				"CompleteMultipartUpload": accelerateHost,
+				"ListObjectsV2":           standardHost,
+			} {
+				if hosts[op] != want {
+					t.Errorf("%s sent to %q, want %q", op, hosts[op], want)
+				}
+			}
+
+			redirectURL, err := d.RedirectURL(&http.Request{Method: http.MethodGet}, "/content")
+			if err != nil {
+				t.Fatal(err)
+			}
+			u, err := url.Parse(redirectURL)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if u.Host != tc.redirectHost {
+				t.Fatalf("redirected to %q, want %q", u.Host, tc.redirectHost)
+			}
+		})
+	}
+
+	p := params()
+	p.RegionEndpoint = "https://s3.example.com"
+	if _, err := New(context.Background(), p); err == nil || !strings.Contains(err.Error(), "can not be used with a regionendpoint") {
+		t.Fatalf("expected accelerate to be rejected with a regionendpoint, got %v", err)
+	}
+	p = params()
+	p.Accelerate = false
+	p.AccelerateRedirects = true
+	if _, err := New(context.Background(), p); err == nil || !strings.Contains(err.Error(), "requires accelerate") {
+		t.Fatalf("expected accelerateredirects to be rejected without accelerate, got %v", err)
+	}
+}
@@ -0,0 +1,177 @@
+package sftp
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net"
+	"sync/atomic"
+	"time"
+
+	"github.com/pkg/sftp"
+	"golang.org/x/crypto/ssh"
+)
+
+// session is an SFTP session on its own SSH connection.
+type session struct {
+	*sftp.Client
+	conn *ssh.Client
+	// lost is closed once the SSH connection is closed.
+	lost chan struct{}
+}
+
+func newSession(conn *ssh.Client) (*session, error) {
+	client, err := sftp.NewClient(conn, sftp.UseConcurrentWrites(true))
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	s := &session{Client: client, conn: conn, lost: make(chan struct{})}
+	go func() {
+		_ = conn.Wait()
+		close(s.lost)
+	}()
+	return s, nil
+}
+
+// isLost reports whether the connection of the session was closed.
+func (s *session) isLost() bool {
+	select {
+	case <-s.lost:
+		return true
+	default:
+		return false
+	}
+}
+
+// connectionLost reports whether err was caused by the loss of the
+// connection of the session.
+func (s *session) connectionLost(err error) bool {
+	if err == nil {
+		return false
+	}
+	return s.isLost() || errors.Is(err, sftp.ErrSSHFxConnectionLost) || errors.Is(err, io.EOF) || errors.Is(err, net.ErrClosed)
+}
+
+func (s *session) close() {
+	s.Client.Close()
+	s.conn.Close()
+}
+
+// slot holds a session of the pool, dialed on first use and dialed again
+// once its connection is lost.
+type slot struct {
+	// lock is a mutex which can be given up when the context of the
+	// operation waiting for it is done.
+	lock    chan struct{}
+	session *session
+}
+
+// pool spreads the operations of the driver over a fixed number of SFTP
+// sessions. Sessions are shared rather than checked out: SFTP multiplexes
+// concurrent requests over a session, so an operation never waits for
+// another to give a session back, and open readers and writers, which keep
+// using their session until they are closed, cannot exhaust the pool.
+type pool struct {
+	dial  func(ctx context.Context) (*ssh.Client, error)
+	slots []*slot
+	next  atomic.Uint64
+}
+
+func newPool(size int, dial func(ctx context.Context) (*ssh.Client, error)) *pool {
+	p := &pool{dial: dial, slots: make([]*slot, size)}
+	for i := range p.slots {
+		p.slots[i] = &slot{lock: make(chan struct{}, 1)}
+	}
+	return p
+}
+
+// get returns the session of the next slot, connecting it if it is not
+// connected.
+func (p *pool) get(ctx context.Context) (*session, error) {
+	sl := p.slots[p.next.Add(1)%uint64(len(p.slots))]
+	select {
+	case sl.lock <- struct{}{}:
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+	defer func() { <-sl.lock }()
+
+	if sl.session != nil && !sl.session.isLost() {
+		return sl.session, nil
+	}
+	conn, err := p.dial(ctx)
+	if err != nil {
+		return nil, err
+	}
+	s, err := newSession(conn)
+	if err != nil {
+		return nil, err
+	}
+	sl.session = s
+	return s, nil
+}
+
+// close closes the sessions of the slots.
+func (p *pool) close() {
+	for _, sl := range p.slots {
+		sl.lock <- struct{}{}
+		if sl.session != nil {
+			sl.session.close()
+			sl.session = nil
+		}
+		<-sl.lock
+	}
+}
+
+// do calls fn with a session, and once more with a new session if the
+// connection of the first one was lost. fn must be safe to call again.
+func (p *pool) do(ctx context.Context, fn func(s *session) error) error {
+	for attempt := 0; ; attempt++ {
+		s, err := p.get(ctx)
+		if err != nil {
+			return err
+		}
+		err = fn(s)
+		if attempt > 0 || !s.connectionLost(err) {
+			return err
+		}
+		// Close the session so that its slot connects again.
+		s.close()
+	}
+}
+
+// dialer connects to an SSH server.
+type dialer struct {
+	addr    string
+	config  *ssh.ClientConfig
+	timeout time.Duration
+}
+
+// dial connects to the SSH server, within the deadline of ctx if it has one.
+func (d *dialer) dial(ctx context.Context) (*ssh.Client, error) {
+	nd := net.Dialer{Timeout: d.timeout}
+	conn, err := nd.DialContext(ctx, "tcp", d.addr)
+	if err != nil {
+		return nil, err
+	}
+
+	deadline := time.Now().Add(d.timeout)
+	if ctxDeadline, ok := ctx.Deadline(); ok && ctxDeadline.Before(deadline) {
+		deadline = ctxDeadline
+	}
+	if err := conn.SetDeadline(deadline); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	c, chans, reqs, err := ssh.NewClientConn(conn, d.addr, d.config)
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	if err := conn.SetDeadline(time.Time{}); err != nil {
+		c.Close()
+		return nil, err
+	}
+	return ssh.NewClient(c, chans, reqs), nil
+}
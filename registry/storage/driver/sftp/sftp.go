@@ -0,0 +1,645 @@
+// Package sftp provides a storagedriver.StorageDriver implementation to
+// store blobs on a remote filesystem reached over SFTP.
+//
+// The driver keeps a pool of SSH connections, each carrying an SFTP session
+// shared by concurrent operations. A connection which is lost is dialed
+// again on its next use, and operations which can safely be repeated are
+// retried once on a new connection.
+package sftp
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"net"
+	"net/http"
+	"os"
+	"path"
+	"reflect"
+	"strconv"
+	"time"
+
+	"github.com/distribution/distribution/v3/internal/uuid"
+	storagedriver "github.com/distribution/distribution/v3/registry/storage/driver"
+	"github.com/distribution/distribution/v3/registry/storage/driver/base"
+	"github.com/distribution/distribution/v3/registry/storage/driver/factory"
+	"github.com/pkg/sftp"
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/knownhosts"
+)
+
+const (
+	driverName = "sftp"
+
+	defaultPort        = 22
+	defaultPoolSize    = 4
+	defaultDialTimeout = 30 * time.Second
+
+	// writeBufferSize is the size of the buffer of writers, large enough
+	// for the SFTP client to write it with concurrent requests.
+	writeBufferSize = 1 << 20
+
+	// posixRename is the OpenSSH extension which renames over an existing
+	// file.
+	posixRename = "posix-rename@openssh.com"
+)
+
+// DriverParameters is a struct that encapsulates all of the driver parameters after all values have been set
+type DriverParameters struct {
+	Host     string
+	Port     int
+	User     string
+	Password string
+	// Signer signs with the private key of the user.
+	Signer ssh.Signer
+	// HostKeyCallback verifies the host key of the server.
+	HostKeyCallback ssh.HostKeyCallback
+	// HostKeyAlgorithms are the host key algorithms accepted from the
+	// server, those of the known keys of the host by default.
+	HostKeyAlgorithms []string
+	RootDirectory     string
+	PoolSize          int
+	DialTimeout       time.Duration
+}
+
+func init() {
+	factory.Register(driverName, &sftpDriverFactory{})
+}
+
+// sftpDriverFactory implements the factory.StorageDriverFactory interface
+type sftpDriverFactory struct{}
+
+// Create StorageDriver from parameters
+func (factory *sftpDriverFactory) Create(ctx context.Context, parameters map[string]any) (storagedriver.StorageDriver, error) {
+	return FromParameters(parameters)
+}
+
+var _ storagedriver.StorageDriver = &driver{}
+
+// driver is a storagedriver.StorageDriver implementation backed by a remote
+// filesystem reached over SFTP. All provided paths will be subpaths of the
+// RootDirectory.
+type driver struct {
+	pool          *pool
+	rootDirectory string
+}
+
+// Driver wraps `driver` with the checks of base.Base.
+type Driver struct {
+	baseEmbed
+}
+
+type baseEmbed struct {
+	base.Base
+}
+
+// FromParameters constructs a new Driver with a given parameters map
+// Required parameters:
+// - host
+// - user
+// - password or privatekey
+// - knownhosts
+func FromParameters(parameters map[string]any) (*Driver, error) {
+	params := DriverParameters{
+		Port:          defaultPort,
+		RootDirectory: ".",
+		PoolSize:      defaultPoolSize,
+		DialTimeout:   defaultDialTimeout,
+	}
+
+	for name, dst := range map[string]*string{
+		"host": &params.Host,
+		"user": &params.User,
+	} {
+		v, ok := parameters[name]
+		if !ok || fmt.Sprint(v) == "" {
+			return nil, fmt.Errorf("no %s parameter provided", name)
+		}
+		*dst = fmt.Sprint(v)
+	}
+	if v, ok := parameters["password"]; ok && v != nil {
+		params.Password = fmt.Sprint(v)
+	}
+	if v, ok := parameters["rootdirectory"]; ok && fmt.Sprint(v) != "" {
+		params.RootDirectory = fmt.Sprint(v)
+	}
+
+	var err error
+	for name, dst := range map[string]*int{
+		"port":     &params.Port,
+		"poolsize": &params.PoolSize,
+	} {
+		if *dst, err = intParameter(parameters, name, *dst); err != nil {
+			return nil, err
+		}
+	}
+	if v, ok := parameters["dialtimeout"]; ok {
+		params.DialTimeout, err = time.ParseDuration(fmt.Sprint(v))
+		if err != nil {
+			return nil, fmt.Errorf("dialtimeout must be a duration, %v invalid", v)
+		}
+	}
+
+	if v, ok := parameters["privatekey"]; ok && fmt.Sprint(v) != "" {
+		key, err := os.ReadFile(fmt.Sprint(v))
+		if err != nil {
+			return nil, fmt.Errorf("unable to read privatekey: %v", err)
+		}
+		if passphrase, ok := parameters["privatekeypassphrase"]; ok && fmt.Sprint(passphrase) != "" {
+			params.Signer, err = ssh.ParsePrivateKeyWithPassphrase(key, []byte(fmt.Sprint(passphrase)))
+		} else {
+			params.Signer, err = ssh.ParsePrivateKey(key)
+		}
+		if err != nil {
+			return nil, fmt.Errorf("unable to parse privatekey: %v", err)
+		}
+	}
+	if params.Password == "" && params.Signer == nil {
+		return nil, fmt.Errorf("no password or privatekey parameter provided")
+	}
+
+	knownHosts, ok := parameters["knownhosts"]
+	if !ok || fmt.Sprint(knownHosts) == "" {
+		return nil, fmt.Errorf("no knownhosts parameter provided")
+	}
+	params.HostKeyCallback, err = knownhosts.New(fmt.Sprint(knownHosts))
+	if err != nil {
+		return nil, fmt.Errorf("unable to read knownhosts: %v", err)
+	}
+
+	return New(params)
+}
+
+// intParameter returns the integer parameter name, or def if it is not set.
+func intParameter(parameters map[string]any, name string, def int) (int, error) {
+	param, ok := parameters[name]
+	if !ok {
+		return def, nil
+	}
+	switch v := param.(type) {
+	case string:
+		vv, err := strconv.Atoi(v)
+		if err != nil {
+			return 0, fmt.Errorf("%s must be an integer, %v invalid", name, param)
+		}
+		return vv, nil
+	case int, uint, int32, uint32, uint64, int64:
+		return int(reflect.ValueOf(v).Convert(reflect.TypeFor[int]()).Int()), nil
+	default:
+		return 0, fmt.Errorf("invalid value for %s: %#v", name, param)
+	}
+}
+
+// New constructs a new Driver
+func New(params DriverParameters) (*Driver, error) {
+	if params.Port <= 0 || params.Port > 65535 {
+		return nil, fmt.Errorf("port %d must be between 1 and 65535", params.Port)
+	}
+	if params.PoolSize < 1 {
+		return nil, fmt.Errorf("poolsize %d must be at least 1", params.PoolSize)
+	}
+	if params.Password == "" && params.Signer == nil {
+		return nil, fmt.Errorf("no password or signer provided")
+	}
+	if params.HostKeyCallback == nil {
+		return nil, fmt.Errorf("no host key callback provided")
+	}
+	if params.DialTimeout <= 0 {
+		params.DialTimeout = defaultDialTimeout
+	}
+	if params.RootDirectory == "" {
+		params.RootDirectory = "."
+	}
+
+	config := &ssh.ClientConfig{
+		User:              params.User,
+		HostKeyCallback:   params.HostKeyCallback,
+		HostKeyAlgorithms: params.HostKeyAlgorithms,
+		Timeout:           params.DialTimeout,
+	}
+	if params.Signer != nil {
+		config.Auth = append(config.Auth, ssh.PublicKeys(params.Signer))
+	}
+	if params.Password != "" {
+		config.Auth = append(config.Auth, ssh.Password(params.Password))
+	}
+
+	addr := net.JoinHostPort(params.Host, strconv.Itoa(params.Port))
+	if config.HostKeyAlgorithms == nil {
+		config.HostKeyAlgorithms = knownKeyAlgorithms(params.HostKeyCallback, addr)
+	}
+	d := &driver{
+		pool: newPool(params.PoolSize, (&dialer{
+			addr:    addr,
+			config:  config,
+			timeout: params.DialTimeout,
+		}).dial),
+		rootDirectory: params.RootDirectory,
+	}
+
+	return &Driver{
+		baseEmbed: baseEmbed{
+			Base: base.Base{
+				StorageDriver: d,
+			},
+		},
+	}, nil
+}
+
+// knownKeyAlgorithms returns the algorithms of the keys the host key callback
+// knows for addr, so that the server is asked for a key which can be
+// verified rather than the one it prefers.
+func knownKeyAlgorithms(callback ssh.HostKeyCallback, addr string) []string {
+	// A callback from knownhosts.New lists the known keys of a host
+	// when it is given a key it does not know.
+	var keyErr *knownhosts.KeyError
+	err := callback(addr, &net.TCPAddr{IP: net.IPv4zero}, unknownKey{})
+	if !errors.As(err, &keyErr) {
+		return nil
+	}
+
+	var algorithms []string
+	for _, known := range keyErr.Want {
+		switch known.Key.Type() {
+		case ssh.KeyAlgoRSA:
+			algorithms = append(algorithms, ssh.KeyAlgoRSASHA512, ssh.KeyAlgoRSASHA256, ssh.KeyAlgoRSA)
+		default:
+			algorithms = append(algorithms, known.Key.Type())
+		}
+	}
+	return algorithms
+}
+
+// unknownKey is a public key which no host has.
+type unknownKey struct{}
+
+func (unknownKey) Type() string                        { return "unknown" }
+func (unknownKey) Marshal() []byte                     { return []byte("unknown") }
+func (unknownKey) Verify([]byte, *ssh.Signature) error { return errors.New("unknown key") }
+
+// Implement the storagedriver.StorageDriver interface
+
+func (d *driver) Name() string {
+	return driverName
+}
+
+// Close closes the SSH connections of the pool.
+func (d *driver) Close() error {
+	d.pool.close()
+	return nil
+}
+
+// GetContent retrieves the content stored at "path" as a []byte.
+func (d *driver) GetContent(ctx context.Context, subPath string) ([]byte, error) {
+	var content []byte
+	err := d.pool.do(ctx, func(s *session) error {
+		f, err := s.Open(d.fullPath(subPath))
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		content, err = io.ReadAll(f)
+		return err
+	})
+	if err != nil {
+		return nil, d.pathError(subPath, err)
+	}
+	return content, nil
+}
+
+// PutContent stores the []byte content at a location designated by "path".
+// The content is written to a temporary file, which is then renamed, so
+// that a partial write is never visible.
+func (d *driver) PutContent(ctx context.Context, subPath string, contents []byte) error {
+	fullPath := d.fullPath(subPath)
+	return d.pool.do(ctx, func(s *session) error {
+		if err := s.MkdirAll(path.Dir(fullPath)); err != nil {
+			return err
+		}
+		tempPath := fmt.Sprintf("%s.%s.tmp", fullPath, uuid.NewString())
+		f, err := s.OpenFile(tempPath, os.O_WRONLY|os.O_CREATE|os.O_TRUNC)
+		if err != nil {
+			return err
+		}
+		_, err = f.Write(contents)
+		if cErr := f.Close(); err == nil {
+			err = cErr
+		}
+		if err == nil {
+			err = rename(s, tempPath, fullPath)
+		}
+		if err != nil && !s.connectionLost(err) {
+			// Attempt to clean up the temporary file on error.
+			_ = s.Remove(tempPath)
+		}
+		return err
+	})
+}
+
+// Reader retrieves an io.ReadCloser for the content stored at "path" with a
+// given byte offset.
+func (d *driver) Reader(ctx context.Context, subPath string, offset int64) (io.ReadCloser, error) {
+	if offset < 0 {
+		return nil, storagedriver.InvalidOffsetError{Path: subPath, Offset: offset}
+	}
+
+	var file *sftp.File
+	err := d.pool.do(ctx, func(s *session) error {
+		f, err := s.Open(d.fullPath(subPath))
+		if err != nil {
+			return err
+		}
+		if _, err := f.Seek(offset, io.SeekStart); err != nil {
+			f.Close()
+			return err
+		}
+		file = f
+		return nil
+	})
+	if err != nil {
+		return nil, d.pathError(subPath, err)
+	}
+	return file, nil
+}
+
+// Writer returns a FileWriter which will store the content written to it
+// at the location designated by "path" after the call to Commit.
+func (d *driver) Writer(ctx context.Context, subPath string, append bool) (storagedriver.FileWriter, error) {
+	fullPath := d.fullPath(subPath)
+
+	var (
+		file   *sftp.File
+		client *sftp.Client
+		offset int64
+	)
+	err := d.pool.do(ctx, func(s *session) error {
+		if err := s.MkdirAll(path.Dir(fullPath)); err != nil {
+			return err
+		}
+		flag := os.O_WRONLY | os.O_CREATE
+		if !append {
+			flag |= os.O_TRUNC
+		}
+		f, err := s.OpenFile(fullPath, flag)
+		if err != nil {
+			return err
+		}
+		var n int64
+		if append {
+			if n, err = f.Seek(0, io.SeekEnd); err != nil {
+				f.Close()
+				return err
+			}
+		}
+		file, client, offset = f, s.Client, n
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return newFileWriter(file, client, offset), nil
+}
+
+// Stat retrieves the FileInfo for the given path, including the current size
+// in bytes and the creation time.
+func (d *driver) Stat(ctx context.Context, subPath string) (storagedriver.FileInfo, error) {
+	var fi os.FileInfo
+	err := d.pool.do(ctx, func(s *session) error {
+		var err error
+		fi, err = s.Stat(d.fullPath(subPath))
+		return err
+	})
+	if err != nil {
+		return nil, d.pathError(subPath, err)
+	}
+	return fileInfo{path: subPath, FileInfo: fi}, nil
+}
+
+// List returns a list of the objects that are direct descendants of the given
+// path.
+func (d *driver) List(ctx context.Context, subPath string) ([]string, error) {
+	infos, err := d.listFileInfos(ctx, subPath)
+	if err != nil {
+		return nil, err
+	}
+	keys := make([]string, 0, len(infos))
+	for _, fi := range infos {
+		keys = append(keys, fi.Path())
+	}
+	return keys, nil
+}
+
+// listFileInfos returns the FileInfo of the direct descendants of the given
+// path, from a single directory listing.
+func (d *driver) listFileInfos(ctx context.Context, subPath string) ([]storagedriver.FileInfo, error) {
+	var entries []os.FileInfo
+	err := d.pool.do(ctx, func(s *session) error {
+		var err error
+		entries, err = s.ReadDirContext(ctx, d.fullPath(subPath))
+		return err
+	})
+	if err != nil {
+		return nil, d.pathError(subPath, err)
+	}
+
+	infos := make([]storagedriver.FileInfo, 0, len(entries))
+	for _, entry := range entries {
+		infos = append(infos, fileInfo{path: path.Join(subPath, entry.Name()), FileInfo: entry})
+	}
+	return infos, nil
+}
+
+// Move moves an object stored at sourcePath to destPath, removing the original
+// object. It is not retried on a new connection, as the rename may have
+// happened before the connection was lost.
+func (d *driver) Move(ctx context.Context, sourcePath string, destPath string) error {
+	source := d.fullPath(sourcePath)
+	dest := d.fullPath(destPath)
+
+	s, err := d.pool.get(ctx)
+	if err != nil {
+		return err
+	}
+	if _, err := s.Stat(source); err != nil {
+		return d.pathError(sourcePath, err)
+	}
+	if err := s.MkdirAll(path.Dir(dest)); err != nil {
+		return err
+	}
+	return rename(s, source, dest)
+}
+
+// Delete recursively deletes all objects stored at "path" and its subpaths.
+func (d *driver) Delete(ctx context.Context, subPath string) error {
+	fullPath := d.fullPath(subPath)
+	err := d.pool.do(ctx, func(s *session) error {
+		return s.RemoveAll(fullPath)
+	})
+	return d.pathError(subPath, err)
+}
+
+// RedirectURL returns a URL which may be used to retrieve the content stored at the given path.
+func (d *driver) RedirectURL(*http.Request, string) (string, error) {
+	return "", nil
+}
+
+// Walk traverses a filesystem defined within driver, starting
+// from the given path, calling f on each file and directory
+func (d *driver) Walk(ctx context.Context, path string, f storagedriver.WalkFn, options ...func(*storagedriver.WalkOptions)) error {
+	walkOptions := &storagedriver.WalkOptions{}
+	for _, o := range options {
+		o(walkOptions)
+	}
+	if walkOptions.Parallelism > 1 {
+		return storagedriver.WalkParallel(ctx, path, d.listFileInfos, f, options...)
+	}
+	return storagedriver.WalkFallback(ctx, d, path, f, options...)
+}
+
+// fullPath returns the remote path of a key within the Driver's storage.
+func (d *driver) fullPath(subPath string) string {
+	return path.Join(d.rootDirectory, subPath)
+}
+
+// pathError returns a PathNotFoundError for subPath if err reports that a
+// file does not exist, and err otherwise.
+func (d *driver) pathError(subPath string, err error) error {
+	if errors.Is(err, fs.ErrNotExist) {
+		return storagedriver.PathNotFoundError{Path: subPath, DriverName: driverName}
+	}
+	return err
+}
+
+// rename renames oldname to newname, replacing newname if it exists.
+func rename(s *session, oldname, newname string) error {
+	if _, ok := s.HasExtension(posixRename); ok {
+		return s.PosixRename(oldname, newname)
+	}
+	// SFTP renames fail when the target exists.
+	if err := s.Remove(newname); err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return err
+	}
+	return s.Rename(oldname, newname)
+}
+
+type fileInfo struct {
+	os.FileInfo
+	path string
+}
+
+var _ storagedriver.FileInfo = fileInfo{}
+
+// Path provides the full path of the target of this file info.
+func (fi fileInfo) Path() string {
+	return fi.path
+}
+
+// Size returns current length in bytes of the file. The return value can
+// be used to write to the end of the file at path. The value is
+// meaningless if IsDir returns true.
+func (fi fileInfo) Size() int64 {
+	if fi.IsDir() {
+		return 0
+	}
+
+	return fi.FileInfo.Size()
+}
+
+// ModTime returns the modification time for the file. For backends that
+// don't have a modification time, the creation time should be returned.
+func (fi fileInfo) ModTime() time.Time {
+	return fi.FileInfo.ModTime()
+}
+
+// IsDir returns true if the path is a directory.
+func (fi fileInfo) IsDir() bool {
+	return fi.FileInfo.IsDir()
+}
+
+// fileWriter writes to a remote file. It keeps using the session the file
+// was opened on, so a writer whose connection is lost fails, and the upload
+// has to be resumed with a new writer.
+type fileWriter struct {
+	file      *sftp.File
+	client    *sftp.Client
+	size      int64
+	bw        *bufio.Writer
+	closed    bool
+	committed bool
+	cancelled bool
+}
+
+func newFileWriter(file *sftp.File, client *sftp.Client, size int64) *fileWriter {
+	return &fileWriter{
+		file:   file,
+		client: client,
+		size:   size,
+		bw:     bufio.NewWriterSize(file, writeBufferSize),
+	}
+}
+
+func (fw *fileWriter) Write(p []byte) (int, error) {
+	if fw.closed {
+		return 0, fmt.Errorf("already closed")
+	} else if fw.committed {
+		return 0, fmt.Errorf("already committed")
+	} else if fw.cancelled {
+		return 0, fmt.Errorf("already cancelled")
+	}
+	n, err := fw.bw.Write(p)
+	fw.size += int64(n)
+	return n, err
+}
+
+func (fw *fileWriter) Size() int64 {
+	return fw.size
+}
+
+func (fw *fileWriter) Close() (retErr error) {
+	if fw.closed {
+		return fmt.Errorf("already closed")
+	}
+	fw.closed = true
+	defer func() {
+		if err := fw.file.Close(); err != nil {
+			retErr = errors.Join(retErr, err)
+		}
+	}()
+
+	if fw.committed {
+		// Already flushed
+		return nil
+	}
+	return fw.bw.Flush()
+}
+
+func (fw *fileWriter) Cancel(ctx context.Context) error {
+	if fw.closed {
+		return fmt.Errorf("already closed")
+	}
+
+	fw.cancelled = true
+	fw.closed = true
+	_ = fw.file.Close()
+	return fw.client.Remove(fw.file.Name())
+}
+
+func (fw *fileWriter) Commit(ctx context.Context) error {
+	if fw.closed {
+		return fmt.Errorf("already closed")
+	} else if fw.committed {
+		return fmt.Errorf("already committed")
+	} else if fw.cancelled {
+		return fmt.Errorf("already cancelled")
+	}
+
+	if err := fw.bw.Flush(); err != nil {
+		return err
+	}
+
+	fw.committed = true
+	return nil
+}
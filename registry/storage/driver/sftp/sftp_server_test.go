@@ -0,0 +1,170 @@
+package sftp
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"errors"
+	"net"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+
+	"github.com/pkg/sftp"
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/knownhosts"
+)
+
+const (
+	testUser     = "distribution"
+	testPassword = "password"
+)
+
+// sftpServer is an in-process SSH server serving the SFTP subsystem from a
+// temporary directory.
+type sftpServer struct {
+	t        *testing.T
+	listener net.Listener
+	hostKey  ssh.Signer
+	root     string
+
+	mu    sync.Mutex
+	conns []*ssh.ServerConn
+	dials int
+}
+
+func newSFTPServer(t *testing.T) *sftpServer {
+	signer := newSigner(t)
+	config := &ssh.ServerConfig{
+		PasswordCallback: func(conn ssh.ConnMetadata, password []byte) (*ssh.Permissions, error) {
+			if conn.User() == testUser && string(password) == testPassword {
+				return nil, nil
+			}
+			return nil, errors.New("invalid credentials")
+		},
+	}
+	config.AddHostKey(signer)
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := &sftpServer{t: t, listener: listener, hostKey: signer, root: t.TempDir()}
+	t.Cleanup(s.close)
+	go s.serve(config)
+	return s
+}
+
+func newSigner(t *testing.T) ssh.Signer {
+	_, key, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	signer, err := ssh.NewSignerFromKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return signer
+}
+
+func (s *sftpServer) serve(config *ssh.ServerConfig) {
+	for {
+		conn, err := s.listener.Accept()
+		if err != nil {
+			return
+		}
+		go s.serveConn(conn, config)
+	}
+}
+
+func (s *sftpServer) serveConn(conn net.Conn, config *ssh.ServerConfig) {
+	sconn, chans, reqs, err := ssh.NewServerConn(conn, config)
+	if err != nil {
+		conn.Close()
+		return
+	}
+	s.mu.Lock()
+	s.conns = append(s.conns, sconn)
+	s.dials++
+	s.mu.Unlock()
+
+	go ssh.DiscardRequests(reqs)
+	for newChannel := range chans {
+		if newChannel.ChannelType() != "session" {
+			_ = newChannel.Reject(ssh.UnknownChannelType, "unknown channel type")
+			continue
+		}
+		channel, requests, err := newChannel.Accept()
+		if err != nil {
+			continue
+		}
+		go func() {
+			for req := range requests {
+				ok := req.Type == "subsystem" && string(req.Payload[4:]) == "sftp"
+				_ = req.Reply(ok, nil)
+				if ok {
+					go s.serveSFTP(channel)
+				}
+			}
+		}()
+	}
+}
+
+func (s *sftpServer) serveSFTP(channel ssh.Channel) {
+	defer channel.Close()
+	server, err := sftp.NewServer(channel, sftp.WithServerWorkingDirectory(s.root))
+	if err != nil {
+		return
+	}
+	_ = server.Serve()
+}
+
+// dropConnections closes the connections of all clients.
+func (s *sftpServer) dropConnections() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, conn := range s.conns {
+		conn.Close()
+	}
+	s.conns = nil
+}
+
+// dialCount returns the number of connections established so far.
+func (s *sftpServer) dialCount() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.dials
+}
+
+func (s *sftpServer) close() {
+	s.listener.Close()
+	s.dropConnections()
+}
+
+// knownHosts writes a known_hosts file holding the host key of the server
+// and returns its path.
+func (s *sftpServer) knownHosts() string {
+	return s.writeKnownHosts(s.hostKey.PublicKey())
+}
+
+func (s *sftpServer) writeKnownHosts(key ssh.PublicKey) string {
+	path := filepath.Join(s.t.TempDir(), "known_hosts")
+	line := knownhosts.Line([]string{knownhosts.Normalize(s.listener.Addr().String())}, key)
+	if err := os.WriteFile(path, []byte(line+"\n"), 0o600); err != nil {
+		s.t.Fatal(err)
+	}
+	return path
+}
+
+// parameters returns the parameters of a driver using the server.
+func (s *sftpServer) parameters() map[string]any {
+	host, port, _ := net.SplitHostPort(s.listener.Addr().String())
+	return map[string]any{
+		"host":          host,
+		"port":          port,
+		"user":          testUser,
+		"password":      testPassword,
+		"knownhosts":    s.knownHosts(),
+		"rootdirectory": "registry",
+	}
+}
@@ -0,0 +1,258 @@
+package sftp
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"os"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	storagedriver "github.com/distribution/distribution/v3/registry/storage/driver"
+	"github.com/distribution/distribution/v3/registry/storage/driver/testsuites"
+	"golang.org/x/crypto/ssh"
+)
+
+// TestSFTPDriverSuite runs the driver suite against the SFTP server
+// configured by the SFTP_* environment variables, such as the one started
+// by `make start-sftp-storage`.
+func TestSFTPDriverSuite(t *testing.T) {
+	host := os.Getenv("SFTP_HOST")
+	if host == "" {
+		t.Skip("Must set SFTP_HOST, SFTP_USER, SFTP_PASSWORD or SFTP_PRIVATE_KEY, and SFTP_KNOWN_HOSTS to run SFTP tests")
+	}
+	parameters := map[string]any{
+		"host":          host,
+		"user":          os.Getenv("SFTP_USER"),
+		"password":      os.Getenv("SFTP_PASSWORD"),
+		"privatekey":    os.Getenv("SFTP_PRIVATE_KEY"),
+		"knownhosts":    os.Getenv("SFTP_KNOWN_HOSTS"),
+		"rootdirectory": os.Getenv("SFTP_ROOT_DIRECTORY"),
+	}
+	if port := os.Getenv("SFTP_PORT"); port != "" {
+		parameters["port"] = port
+	}
+	testsuites.Driver(t, func() (storagedriver.StorageDriver, error) {
+		return FromParameters(parameters)
+	}, false)
+}
+
+func TestSFTPDriverSuiteInProcess(t *testing.T) {
+	server := newSFTPServer(t)
+	testsuites.Driver(t, func() (storagedriver.StorageDriver, error) {
+		return FromParameters(server.parameters())
+	}, false)
+}
+
+func TestFromParameters(t *testing.T) {
+	server := newSFTPServer(t)
+
+	for _, tc := range []struct {
+		name    string
+		modify  func(map[string]any)
+		wantErr string
+	}{
+		{name: "valid", modify: func(map[string]any) {}},
+		{name: "missing host", modify: func(p map[string]any) { delete(p, "host") }, wantErr: "no host parameter provided"},
+		{name: "missing user", modify: func(p map[string]any) { p["user"] = "" }, wantErr: "no user parameter provided"},
+		{name: "missing credentials", modify: func(p map[string]any) { delete(p, "password") }, wantErr: "no password or privatekey parameter provided"},
+		{name: "missing knownhosts", modify: func(p map[string]any) { delete(p, "knownhosts") }, wantErr: "no knownhosts parameter provided"},
+		{name: "unreadable knownhosts", modify: func(p map[string]any) { p["knownhosts"] = "/nonexistent/known_hosts" }, wantErr: "unable to read knownhosts"},
+		{name: "unreadable privatekey", modify: func(p map[string]any) { p["privatekey"] = "/nonexistent/id_ed25519" }, wantErr: "unable to read privatekey"},
+		{name: "port invalid", modify: func(p map[string]any) { p["port"] = "ssh" }, wantErr: "port must be an integer, ssh invalid"},
+		{name: "port out of range", modify: func(p map[string]any) { p["port"] = 70000 }, wantErr: "port 70000 must be between 1 and 65535"},
+		{name: "poolsize too small", modify: func(p map[string]any) { p["poolsize"] = 0 }, wantErr: "poolsize 0 must be at least 1"},
+		{name: "dialtimeout invalid", modify: func(p map[string]any) { p["dialtimeout"] = "soon" }, wantErr: "dialtimeout must be a duration, soon invalid"},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			params := server.parameters()
+			tc.modify(params)
+			_, err := FromParameters(params)
+			if tc.wantErr == "" {
+				if err != nil {
+					t.Fatalf("unexpected error: %v", err)
+				}
+				return
+			}
+			if err == nil || !strings.Contains(err.Error(), tc.wantErr) {
+				t.Fatalf("expected error %q, got %v", tc.wantErr, err)
+			}
+		})
+	}
+}
+
+func TestHostKeyMismatch(t *testing.T) {
+	server := newSFTPServer(t)
+	params := server.parameters()
+	params["knownhosts"] = server.writeKnownHosts(newSigner(t).PublicKey())
+
+	d, err := FromParameters(params)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = d.PutContent(context.Background(), "/file", []byte("content"))
+	if err == nil || !strings.Contains(err.Error(), "key mismatch") {
+		t.Fatalf("expected a host key mismatch, got %v", err)
+	}
+	if n := server.dialCount(); n != 0 {
+		t.Fatalf("%d connections established with an unknown host key", n)
+	}
+}
+
+// TestPoolExhaustion checks that more readers and writers than there are
+// connections in the pool can be open at once, and that other operations
+// go on meanwhile.
+func TestPoolExhaustion(t *testing.T) {
+	server := newSFTPServer(t)
+	params := server.parameters()
+	params["poolsize"] = 2
+	d, err := FromParameters(params)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+
+	if err := d.PutContent(ctx, "/blob", []byte("content")); err != nil {
+		t.Fatal(err)
+	}
+
+	var (
+		wg      sync.WaitGroup
+		mu      sync.Mutex
+		closers []io.Closer
+		errs    []error
+	)
+	for i := 0; i < 8; i++ {
+		wg.Add(2)
+		go func() {
+			defer wg.Done()
+			r, err := d.Reader(ctx, "/blob", 0)
+			mu.Lock()
+			defer mu.Unlock()
+			if err != nil {
+				errs = append(errs, err)
+				return
+			}
+			closers = append(closers, r)
+		}()
+		go func() {
+			defer wg.Done()
+			w, err := d.Writer(ctx, "/uploads/"+string(rune('a'+i)), false)
+			mu.Lock()
+			defer mu.Unlock()
+			if err != nil {
+				errs = append(errs, err)
+				return
+			}
+			closers = append(closers, w)
+		}()
+	}
+	wg.Wait()
+	if err := errors.Join(errs...); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := d.Stat(ctx, "/blob"); err != nil {
+		t.Fatalf("stat with all readers and writers open: %v", err)
+	}
+	for _, c := range closers {
+		if err := c.Close(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if n := server.dialCount(); n > 2 {
+		t.Fatalf("%d connections established, want at most 2", n)
+	}
+}
+
+// TestReconnect checks that operations go on once the connections of the
+// pool are lost.
+func TestReconnect(t *testing.T) {
+	server := newSFTPServer(t)
+	d, err := FromParameters(server.parameters())
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx := context.Background()
+
+	if err := d.PutContent(ctx, "/file", []byte("content")); err != nil {
+		t.Fatal(err)
+	}
+	dials := server.dialCount()
+
+	server.dropConnections()
+	for i := 0; i < defaultPoolSize; i++ {
+		got, err := d.GetContent(ctx, "/file")
+		if err != nil {
+			t.Fatalf("get after losing the connections: %v", err)
+		}
+		if !bytes.Equal(got, []byte("content")) {
+			t.Fatalf("content = %q", got)
+		}
+	}
+	if n := server.dialCount(); n <= dials {
+		t.Fatal("expected new connections to be established")
+	}
+}
+
+// TestClose checks that closing the driver closes the connections of the
+// pool.
+func TestClose(t *testing.T) {
+	server := newSFTPServer(t)
+	d, err := FromParameters(server.parameters())
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx := context.Background()
+
+	if err := d.PutContent(ctx, "/file", []byte("content")); err != nil {
+		t.Fatal(err)
+	}
+	var sessions []*session
+	for _, sl := range d.Base.StorageDriver.(*driver).pool.slots {
+		if sl.session != nil {
+			sessions = append(sessions, sl.session)
+		}
+	}
+	if len(sessions) == 0 {
+		t.Fatal("expected a connected session")
+	}
+
+	if err := d.Close(); err != nil {
+		t.Fatal(err)
+	}
+	for _, s := range sessions {
+		select {
+		case <-s.lost:
+		case <-time.After(5 * time.Second):
+			t.Fatal("connection not closed")
+		}
+	}
+}
+
+// TestDialContextCancelled checks that an operation waiting for a
+// connection gives up when its context is done.
+func TestDialContextCancelled(t *testing.T) {
+	p := newPool(1, func(ctx context.Context) (*ssh.Client, error) {
+		<-ctx.Done()
+		return nil, ctx.Err()
+	})
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+
+	var wg sync.WaitGroup
+	for i := 0; i < 3; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if _, err := p.get(ctx); !errors.Is(err, context.DeadlineExceeded) {
+				t.Errorf("expected the deadline to be exceeded, got %v", err)
+			}
+		}()
+	}
+	wg.Wait()
+}
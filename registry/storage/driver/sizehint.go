@@ -0,0 +1,20 @@
+package driver
+
+import "context"
+
+type sizeHintKey struct{}
+
+// WithSizeHint returns a context telling the storage drivers how many bytes
+// the writers created with it are expected to receive, such as the
+// Content-Length of the request uploading them. The drivers may size their
+// uploads from it, but must accept more or fewer bytes.
+func WithSizeHint(ctx context.Context, size int64) context.Context {
+	return context.WithValue(ctx, sizeHintKey{}, size)
+}
+
+// SizeHint returns the number of bytes the writers created with the context
+// are expected to receive, if known.
+func SizeHint(ctx context.Context) (int64, bool) {
+	size, ok := ctx.Value(sizeHintKey{}).(int64)
+	return size, ok && size > 0
+}
@@ -3,6 +3,7 @@ package driver
 import (
 	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
 	"net/http"
@@ -39,6 +40,10 @@ type WalkOptions struct {
 	// If StartAfterHint is set, the walk may start with the first item lexographically
 	// after the hint, but it is not guaranteed and drivers may start the walk from the path.
 	StartAfterHint string
+	// If Parallelism is greater than one, up to that many directories may be
+	// listed concurrently. The WalkFn is still called from a single goroutine,
+	// in the same order as a sequential walk.
+	Parallelism int
 }
 
 func WithStartAfterHint(startAfterHint string) func(*WalkOptions) {
@@ -47,6 +52,12 @@ func WithStartAfterHint(startAfterHint string) func(*WalkOptions) {
 	}
 }
 
+func WithParallelism(parallelism int) func(*WalkOptions) {
+	return func(s *WalkOptions) {
+		s.Parallelism = parallelism
+	}
+}
+
 // StorageDriver defines methods that a Storage Driver must implement for a
 // filesystem-like key/value object storage. Storage Drivers are automatically
 // registered via an internal registration mechanism, and generally created
@@ -112,6 +123,55 @@ type StorageDriver interface {
 	Walk(ctx context.Context, path string, f WalkFn, options ...func(*WalkOptions)) error
 }
 
+// CookieRedirector is implemented by storage drivers whose redirect URLs may
+// rely on cookies set on the redirect response.
+type CookieRedirector interface {
+	// RedirectURLWithCookies returns a URL which the client of the request
+	// r may use to retrieve the content stored at path, along with the
+	// cookies to set on the redirect response. Returning the empty string
+	// signals that the request may not be redirected.
+	RedirectURLWithCookies(r *http.Request, path string) (string, []*http.Cookie, error)
+}
+
+// UsageReporter is implemented by storage drivers which can report the space
+// used under a path more efficiently than by walking it.
+type UsageReporter interface {
+	// Usage returns the number of bytes stored under path and the number of
+	// files storing them. Nothing is stored under a nonexistent path.
+	// Drivers wrapping another driver return ErrUnsupportedMethod when the
+	// wrapped driver does not report its usage.
+	Usage(ctx context.Context, path string) (bytes, objects int64, err error)
+}
+
+// BatchDeleter is implemented by storage drivers which can delete several
+// files in a request.
+type BatchDeleter interface {
+	// DeleteBatch deletes the files at paths, which are not directories,
+	// and returns the error deleting each of them, nil if it was deleted or
+	// did not exist. Drivers wrapping another driver return
+	// ErrUnsupportedMethod, even for no path, when the wrapped driver does
+	// not delete files in batches.
+	DeleteBatch(ctx context.Context, paths []string) ([]error, error)
+}
+
+// FilePathResolver is implemented by storage drivers storing the content in
+// files of the local filesystem, which can be served from the file directly.
+type FilePathResolver interface {
+	// FilePathForContent returns the path of the local file storing the
+	// content at path. The content is stored unchanged in the file. Drivers
+	// wrapping another driver return ErrUnsupportedMethod when the wrapped
+	// driver does not store the content in local files.
+	FilePathForContent(path string) (string, error)
+}
+
+// Closer is implemented by storage drivers holding resources, such as
+// connections, which are released when the registry shuts down.
+type Closer interface {
+	// Close releases the resources of the driver, which is not used after.
+	// Drivers wrapping another driver close it, if it implements Closer.
+	Close() error
+}
+
 // FileWriter provides an abstraction for an opened writable file-like object in
 // the storage backend. The FileWriter must flush all content written to it on
 // the call to Close, but is only required to make its content readable on a
@@ -179,6 +239,30 @@ func (err InvalidOffsetError) Error() string {
 	return fmt.Sprintf("%s: invalid offset: %d for path: %s", err.DriverName, err.Offset, err.Path)
 }
 
+// RetryableError is returned when an operation failed for a transient
+// reason, such as a server error or a lost connection, and may succeed if it
+// is tried again unchanged. A driver returning it from FileWriter.Commit must
+// leave the writer in a state in which Commit can be called again.
+type RetryableError struct {
+	DriverName string
+	Detail     error
+}
+
+func (err RetryableError) Error() string {
+	return fmt.Sprintf("%s: %s", err.DriverName, err.Detail)
+}
+
+func (err RetryableError) Unwrap() error {
+	return err.Detail
+}
+
+// IsRetryable reports whether err, or an error it wraps, is a
+// RetryableError.
+func IsRetryable(err error) bool {
+	var retryable RetryableError
+	return errors.As(err, &retryable)
+}
+
 // Error is a catch-all error type which captures an error string and
 // the driver type on which it occurred.
 type Error struct {
@@ -0,0 +1,56 @@
+package testsuites
+
+import (
+	"testing"
+
+	storagedriver "github.com/distribution/distribution/v3/registry/storage/driver"
+)
+
+// Snapshotter is implemented by storage drivers whose content can be saved
+// and restored, such as the inmemory driver.
+type Snapshotter interface {
+	// Snapshot returns the content of the driver.
+	Snapshot() ([]byte, error)
+	// Restore replaces the content of the driver with a snapshot.
+	Restore(snapshot []byte) error
+}
+
+// Fixture is the content of a storage driver built once, which each test can
+// start from without building it again.
+type Fixture struct {
+	snapshot    []byte
+	constructor DriverConstructor
+}
+
+// NewFixture saves the content of driver, so that the drivers returned by
+// constructor can be restored to it. It returns ErrUnsupportedMethod if driver
+// does not support snapshots, in which case the tests have to build their
+// content again.
+func NewFixture(driver storagedriver.StorageDriver, constructor DriverConstructor) (*Fixture, error) {
+	s, ok := driver.(Snapshotter)
+	if !ok {
+		return nil, storagedriver.ErrUnsupportedMethod{DriverName: driver.Name()}
+	}
+	snapshot, err := s.Snapshot()
+	if err != nil {
+		return nil, err
+	}
+	return &Fixture{snapshot: snapshot, constructor: constructor}, nil
+}
+
+// Driver returns a new storage driver holding the content of the fixture.
+func (f *Fixture) Driver(tb testing.TB) storagedriver.StorageDriver {
+	tb.Helper()
+	driver, err := f.constructor()
+	if err != nil {
+		tb.Fatalf("unable to create storage driver: %v", err)
+	}
+	s, ok := driver.(Snapshotter)
+	if !ok {
+		tb.Fatalf("storage driver %s does not support snapshots", driver.Name())
+	}
+	if err := s.Restore(f.snapshot); err != nil {
+		tb.Fatalf("unable to restore storage driver: %v", err)
+	}
+	return driver
+}
@@ -6,6 +6,7 @@ import (
 	crand "crypto/rand"
 	"crypto/sha256"
 	"crypto/tls"
+	"errors"
 	"io"
 	"math/rand"
 	"net/http"
@@ -613,6 +614,51 @@ func (suite *DriverSuite) TestList() {
 	// 3. Ensure that we only respond to directory listings that end with a slash (maybe?).
 }
 
+// TestUsage checks that the usage reported by the driver, if any, matches the
+// files stored.
+func (suite *DriverSuite) TestUsage() {
+	ur, ok := suite.StorageDriver.(storagedriver.UsageReporter)
+	if !ok {
+		suite.T().Skip("storage driver does not report its usage")
+	}
+
+	rootDirectory := "/" + randomFilename(int64(8+rand.Intn(8)))
+	defer suite.deletePath(rootDirectory)
+
+	_, _, err := ur.Usage(suite.ctx, rootDirectory)
+	if errors.As(err, new(storagedriver.ErrUnsupportedMethod)) {
+		suite.T().Skip("storage driver does not report its usage")
+	}
+	suite.Require().NoError(err)
+
+	var size int64
+	files := []string{
+		rootDirectory + "/file",
+		rootDirectory + "/dir/file",
+		rootDirectory + "/dir/subdir/file",
+	}
+	for i, file := range files {
+		contents := randomContents(int64(32 * (i + 1)))
+		size += int64(len(contents))
+		suite.Require().NoError(suite.StorageDriver.PutContent(suite.ctx, file, contents))
+	}
+
+	used, objects, err := ur.Usage(suite.ctx, rootDirectory)
+	suite.Require().NoError(err)
+	suite.Require().Equal(size, used)
+	suite.Require().Equal(int64(len(files)), objects)
+
+	used, objects, err = ur.Usage(suite.ctx, rootDirectory+"/dir/subdir/file")
+	suite.Require().NoError(err)
+	suite.Require().Equal(int64(96), used)
+	suite.Require().Equal(int64(1), objects)
+
+	used, objects, err = ur.Usage(suite.ctx, rootDirectory+"/nonexistent")
+	suite.Require().NoError(err)
+	suite.Require().Zero(used)
+	suite.Require().Zero(objects)
+}
+
 // TestMove checks that a moved object no longer exists at the source path and
 // does exist at the destination.
 func (suite *DriverSuite) TestMove() {
@@ -0,0 +1,39 @@
+package driver
+
+import (
+	"context"
+	"errors"
+)
+
+// Usage returns the number of bytes stored under path and the number of files
+// storing them. The usage is reported by the driver when it implements
+// UsageReporter. Otherwise, path is walked if walkFallback is set, which lists
+// and stats every file under it, and ErrUnsupportedMethod is returned if not.
+func Usage(ctx context.Context, driver StorageDriver, path string, walkFallback bool) (bytes, objects int64, err error) {
+	if ur, ok := driver.(UsageReporter); ok {
+		bytes, objects, err = ur.Usage(ctx, path)
+		if !errors.As(err, new(ErrUnsupportedMethod)) {
+			return bytes, objects, err
+		}
+	}
+	if !walkFallback {
+		return 0, 0, ErrUnsupportedMethod{DriverName: driver.Name()}
+	}
+	return WalkUsage(ctx, driver, path)
+}
+
+// WalkUsage returns the number of bytes stored under path and the number of
+// files storing them, by walking path.
+func WalkUsage(ctx context.Context, driver StorageDriver, path string) (bytes, objects int64, err error) {
+	err = driver.Walk(ctx, path, func(fi FileInfo) error {
+		if !fi.IsDir() {
+			bytes += fi.Size()
+			objects++
+		}
+		return nil
+	})
+	if errors.As(err, new(PathNotFoundError)) {
+		return 0, 0, nil
+	}
+	return bytes, objects, err
+}
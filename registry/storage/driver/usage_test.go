@@ -0,0 +1,99 @@
+package driver
+
+import (
+	"context"
+	"errors"
+	"testing"
+)
+
+// treeFileSystem is a fileSystem which implements Walk with WalkFallback.
+type treeFileSystem struct {
+	fileSystem
+}
+
+func (tfs *treeFileSystem) Name() string {
+	return "tree"
+}
+
+func (tfs *treeFileSystem) Walk(ctx context.Context, path string, f WalkFn, options ...func(*WalkOptions)) error {
+	return WalkFallback(ctx, tfs, path, f, options...)
+}
+
+// reportingFileSystem reports a fixed usage, or ErrUnsupportedMethod.
+type reportingFileSystem struct {
+	treeFileSystem
+	supported bool
+}
+
+func (rfs *reportingFileSystem) Usage(ctx context.Context, path string) (int64, int64, error) {
+	if !rfs.supported {
+		return 0, 0, ErrUnsupportedMethod{}
+	}
+	return 42, 7, nil
+}
+
+func newTreeFileSystem() treeFileSystem {
+	return treeFileSystem{fileSystem{
+		fileset: map[string][]string{
+			"/":                  {"/file1", "/folder1", "/folder2"},
+			"/folder1":           {"/folder1/file1", "/folder1/subfolder"},
+			"/folder1/subfolder": {"/folder1/subfolder/file1"},
+			"/folder2":           {"/folder2/file1"},
+		},
+	}}
+}
+
+func TestUsageWalkFallback(t *testing.T) {
+	ctx := context.Background()
+	d := newTreeFileSystem()
+
+	// The fake sizes are the lengths of the paths.
+	for _, tc := range []struct {
+		path    string
+		bytes   int64
+		objects int64
+	}{
+		{path: "/", bytes: int64(len("/file1") + len("/folder1/file1") + len("/folder1/subfolder/file1") + len("/folder2/file1")), objects: 4},
+		{path: "/folder1", bytes: int64(len("/folder1/file1") + len("/folder1/subfolder/file1")), objects: 2},
+		{path: "/missing", bytes: 0, objects: 0},
+	} {
+		bytes, objects, err := Usage(ctx, &d, tc.path, true)
+		if err != nil {
+			t.Fatalf("%s: unexpected error: %v", tc.path, err)
+		}
+		if bytes != tc.bytes || objects != tc.objects {
+			t.Errorf("%s: expected %d bytes in %d objects, got %d bytes in %d objects", tc.path, tc.bytes, tc.objects, bytes, objects)
+		}
+	}
+
+	if _, _, err := Usage(ctx, &d, "/", false); !errors.As(err, new(ErrUnsupportedMethod)) {
+		t.Errorf("expected ErrUnsupportedMethod without the walk fallback, got %v", err)
+	}
+}
+
+func TestUsageReporter(t *testing.T) {
+	ctx := context.Background()
+
+	d := &reportingFileSystem{treeFileSystem: newTreeFileSystem(), supported: true}
+	bytes, objects, err := Usage(ctx, d, "/", false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if bytes != 42 || objects != 7 {
+		t.Errorf("expected the reported usage, got %d bytes in %d objects", bytes, objects)
+	}
+
+	// A driver wrapping one which does not report its usage falls back to
+	// walking it.
+	d.supported = false
+	if _, _, err := Usage(ctx, d, "/", false); !errors.As(err, new(ErrUnsupportedMethod)) {
+		t.Errorf("expected ErrUnsupportedMethod without the walk fallback, got %v", err)
+	}
+	_, objects, err = Usage(ctx, d, "/", true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if objects != 4 {
+		t.Errorf("expected the walked usage, got %d objects", objects)
+	}
+}
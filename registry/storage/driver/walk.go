@@ -8,6 +8,7 @@ import (
 	"strings"
 
 	"github.com/sirupsen/logrus"
+	"golang.org/x/sync/errgroup"
 )
 
 // ErrSkipDir is used as a return value from onFileFunc to indicate that
@@ -23,18 +24,62 @@ var ErrFilledBuffer = errors.New("we have enough entries")
 // WalkFn is called once per file by Walk
 type WalkFn func(fileInfo FileInfo) error
 
+// ListFn returns the files and directories directly within the given path.
+type ListFn func(ctx context.Context, path string) ([]FileInfo, error)
+
 // WalkFallback traverses a filesystem defined within driver, starting
 // from the given path, calling f on each file. It uses the List method and Stat to drive itself.
 // If the returned error from the WalkFn is ErrSkipDir the directory will not be entered and Walk
 // will continue the traversal. If the returned error from the WalkFn is ErrFilledBuffer, the walk
-// stops.
+// stops. If the Parallelism option is set, sibling directories are listed and their entries
+// stated concurrently.
 func WalkFallback(ctx context.Context, driver StorageDriver, from string, f WalkFn, options ...func(*WalkOptions)) error {
 	walkOptions := &WalkOptions{}
 	for _, o := range options {
 		o(walkOptions)
 	}
 
-	startAfterHint := walkOptions.StartAfterHint
+	walkDir := func(from, startAfterHint string) (bool, error) {
+		return doWalkFallback(ctx, driver, from, startAfterHint, f)
+	}
+	if walkOptions.Parallelism > 1 {
+		w := newParallelWalker(f, walkOptions.Parallelism)
+		w.list = w.fallbackList(driver)
+		walkDir = func(from, startAfterHint string) (bool, error) {
+			return w.walk(ctx, from, startAfterHint)
+		}
+	}
+	return walkFrom(from, walkOptions.StartAfterHint, walkDir)
+}
+
+// WalkParallel traverses a filesystem starting from the given path, calling f
+// on each file in the same order and with the same handling of ErrSkipDir and
+// ErrFilledBuffer as WalkFallback. It uses list to retrieve the contents of
+// each directory, listing up to the Parallelism option of them concurrently.
+// Drivers which can list the FileInfo of the contents of a directory in one
+// call, such as with a delimiter, use it to implement Walk.
+func WalkParallel(ctx context.Context, from string, list ListFn, f WalkFn, options ...func(*WalkOptions)) error {
+	walkOptions := &WalkOptions{}
+	for _, o := range options {
+		o(walkOptions)
+	}
+
+	w := newParallelWalker(f, walkOptions.Parallelism)
+	w.list = func(ctx context.Context, path, _ string) ([]FileInfo, error) {
+		var children []FileInfo
+		err := w.call(ctx, func() (err error) {
+			children, err = list(ctx, path)
+			return err
+		})
+		return children, err
+	}
+	return walkFrom(from, walkOptions.StartAfterHint, func(from, startAfterHint string) (bool, error) {
+		return w.walk(ctx, from, startAfterHint)
+	})
+}
+
+// walkFrom walks from with walkDir, starting after startAfterHint.
+func walkFrom(from, startAfterHint string, walkDir func(from, startAfterHint string) (bool, error)) error {
 	// Ensure that we are checking the hint is contained within from by adding a "/".
 	// Add to both in case the hint and form are the same, which would still count.
 	rel, err := filepath.Rel(from, startAfterHint)
@@ -42,18 +87,18 @@ func WalkFallback(ctx context.Context, driver StorageDriver, from string, f Walk
 		// The startAfterHint is outside from, so check if we even need to walk anything
 		// Replace any path separators with \x00 so that the sort works in a depth-first way
 		if strings.ReplaceAll(startAfterHint, "/", "\x00") < strings.ReplaceAll(from, "/", "\x00") {
-			_, err := doWalkFallback(ctx, driver, from, "", f)
+			_, err := walkDir(from, "")
 			return err
 		}
 	} else {
 		// The startAfterHint is within from.
 		// Walk up the tree until we hit from - we know it is contained.
 		// Ensure startAfterHint is never deeper than a child of the base
-		// directory so that doWalkFallback doesn't have to worry about
+		// directory so that walkDir doesn't have to worry about
 		// depth-first comparisons
 		base := startAfterHint
 		for strings.HasPrefix(base, from) {
-			_, err = doWalkFallback(ctx, driver, base, startAfterHint, f)
+			_, err = walkDir(base, startAfterHint)
 			switch err.(type) {
 			case nil:
 				// No error
@@ -123,3 +168,149 @@ func doWalkFallback(ctx context.Context, driver StorageDriver, from string, star
 	}
 	return true, nil
 }
+
+// parallelWalker performs a depth first walk, listing the directories ahead
+// of the one being walked while f is called on its entries. The calls to f
+// are made from the walking goroutine, in the order of a sequential walk.
+type parallelWalker struct {
+	f WalkFn
+	// list returns the entries of a directory. Entries up to startAfterHint
+	// may be left out.
+	list func(ctx context.Context, path, startAfterHint string) ([]FileInfo, error)
+	// sem bounds the number of storage driver calls in flight.
+	sem chan struct{}
+}
+
+func newParallelWalker(f WalkFn, parallelism int) *parallelWalker {
+	return &parallelWalker{
+		f:   f,
+		sem: make(chan struct{}, max(parallelism, 1)),
+	}
+}
+
+// call calls fn once a storage driver call may be made.
+func (w *parallelWalker) call(ctx context.Context, fn func() error) error {
+	select {
+	case w.sem <- struct{}{}:
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+	defer func() { <-w.sem }()
+	return fn()
+}
+
+// fallbackList returns a list function using the List method and Stat of
+// driver, stating the entries of a directory concurrently.
+func (w *parallelWalker) fallbackList(driver StorageDriver) func(ctx context.Context, path, startAfterHint string) ([]FileInfo, error) {
+	return func(ctx context.Context, path, startAfterHint string) ([]FileInfo, error) {
+		var children []string
+		if err := w.call(ctx, func() (err error) {
+			children, err = driver.List(ctx, path)
+			return err
+		}); err != nil {
+			return nil, err
+		}
+
+		fileInfos := make([]FileInfo, len(children))
+		g, gctx := errgroup.WithContext(ctx)
+		g.SetLimit(cap(w.sem))
+		for i, child := range children {
+			if child <= startAfterHint {
+				continue
+			}
+			g.Go(func() error {
+				return w.call(gctx, func() error {
+					fileInfo, err := driver.Stat(gctx, child)
+					if _, ok := err.(PathNotFoundError); ok {
+						// repository was removed in between listing and enumeration. Ignore it.
+						logrus.WithField("path", child).Infof("ignoring deleted path")
+						return nil
+					}
+					fileInfos[i] = fileInfo
+					return err
+				})
+			})
+		}
+		if err := g.Wait(); err != nil {
+			return nil, err
+		}
+
+		found := fileInfos[:0]
+		for _, fileInfo := range fileInfos {
+			if fileInfo != nil {
+				found = append(found, fileInfo)
+			}
+		}
+		return found, nil
+	}
+}
+
+// listing is the result of listing a directory ahead of walking it.
+type listing struct {
+	done     chan struct{}
+	children []FileInfo
+	err      error
+}
+
+func (w *parallelWalker) prefetch(ctx context.Context, path, startAfterHint string) *listing {
+	l := &listing{done: make(chan struct{})}
+	go func() {
+		defer close(l.done)
+		l.children, l.err = w.list(ctx, path, startAfterHint)
+	}()
+	return l
+}
+
+// walk walks from, as doWalkFallback does.
+func (w *parallelWalker) walk(ctx context.Context, from string, startAfterHint string) (bool, error) {
+	children, err := w.list(ctx, from, startAfterHint)
+	if err != nil {
+		return false, err
+	}
+	return w.walkChildren(ctx, children, startAfterHint)
+}
+
+func (w *parallelWalker) walkChildren(ctx context.Context, children []FileInfo, startAfterHint string) (bool, error) {
+	sort.Slice(children, func(i, j int) bool {
+		return children[i].Path() < children[j].Path()
+	})
+
+	// The listings still in flight are abandoned when the walk of this
+	// directory stops.
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	listings := make(map[int]*listing)
+	next := 0
+	for i, fileInfo := range children {
+		if fileInfo.Path() <= startAfterHint {
+			continue
+		}
+		// List the next directories while this entry is walked.
+		for ; next < len(children) && next <= i+cap(w.sem); next++ {
+			if child := children[next]; child.IsDir() && child.Path() > startAfterHint {
+				listings[next] = w.prefetch(ctx, child.Path(), startAfterHint)
+			}
+		}
+		l := listings[i]
+		delete(listings, i)
+
+		err := w.f(fileInfo)
+		if err == nil && fileInfo.IsDir() {
+			<-l.done
+			if l.err != nil {
+				return false, l.err
+			}
+			if ok, err := w.walkChildren(ctx, l.children, startAfterHint); err != nil || !ok {
+				return ok, err
+			}
+		} else if err == ErrSkipDir {
+			// don't traverse into this directory
+		} else if err == ErrFilledBuffer {
+			return false, nil // no error but stop iteration
+		} else if err != nil {
+			return false, err
+		}
+	}
+	return true, nil
+}
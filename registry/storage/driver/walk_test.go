@@ -3,7 +3,12 @@ package driver
 import (
 	"context"
 	"errors"
+	"fmt"
+	"hash/fnv"
+	"strings"
+	"sync"
 	"testing"
+	"time"
 )
 
 type changingFileSystem struct {
@@ -289,30 +294,216 @@ func TestWalkFallback(t *testing.T) {
 		},
 	}
 
+	for _, parallelism := range []int{1, 4} {
+		for _, tc := range tcs {
+			var walked []string
+			if tc.from == "" {
+				tc.from = "/"
+			}
+			options := append([]func(*WalkOptions){WithParallelism(parallelism)}, tc.options...)
+			t.Run(fmt.Sprintf("%s/parallelism=%d", tc.name, parallelism), func(t *testing.T) {
+				err := WalkFallback(context.Background(), d, tc.from, func(fileInfo FileInfo) error {
+					walked = append(walked, fileInfo.Path())
+					if fileInfo.IsDir() != d.isDir(fileInfo.Path()) {
+						t.Fatalf("fileInfo isDir not matching file system: expected %t actual %t", d.isDir(fileInfo.Path()), fileInfo.IsDir())
+					}
+					return tc.fn(fileInfo)
+				}, options...)
+				if tc.err && err == nil {
+					t.Fatal("expected err")
+				}
+				if !tc.err && err != nil {
+					t.Fatal(err)
+				}
+				compareWalked(t, tc.expected, walked)
+			})
+		}
+	}
+}
+
+// deepFileSystem builds a tree of the given depth in which each directory
+// holds fanout directories and fanout files.
+func deepFileSystem(depth, fanout int) *fileSystem {
+	d := &fileSystem{fileset: map[string][]string{}}
+	var build func(dir string, depth int)
+	build = func(dir string, depth int) {
+		prefix := strings.TrimSuffix(dir, "/")
+		var children []string
+		for i := 0; i < fanout; i++ {
+			children = append(children, fmt.Sprintf("%s/file%d", prefix, i))
+			if depth > 0 {
+				child := fmt.Sprintf("%s/dir%d", prefix, i)
+				children = append(children, child)
+				build(child, depth-1)
+			}
+		}
+		d.fileset[dir] = children
+	}
+	build("/", depth)
+	return d
+}
+
+// list lists the files of a fileSystem with their info, as drivers using
+// WalkParallel do.
+func (cfs *fileSystem) list(ctx context.Context, path string) ([]FileInfo, error) {
+	children, err := cfs.List(ctx, path)
+	if err != nil {
+		return nil, err
+	}
+	fileInfos := make([]FileInfo, 0, len(children))
+	for _, child := range children {
+		fileInfo, _ := cfs.Stat(ctx, child)
+		fileInfos = append(fileInfos, fileInfo)
+	}
+	return fileInfos, nil
+}
+
+func TestWalkParallelMatchesSequential(t *testing.T) {
+	d := deepFileSystem(5, 4)
+
+	// skipSome skips about a fifth of the directories and stops after limit
+	// entries, when limit is set.
+	skipSome := func(limit int) func(walked []string, fileInfo FileInfo) error {
+		return func(walked []string, fileInfo FileInfo) error {
+			if limit > 0 && len(walked) == limit {
+				return ErrFilledBuffer
+			}
+			h := fnv.New32a()
+			h.Write([]byte(fileInfo.Path()))
+			if fileInfo.IsDir() && h.Sum32()%5 == 0 {
+				return ErrSkipDir
+			}
+			return nil
+		}
+	}
+
+	tcs := []struct {
+		name    string
+		from    string
+		fn      func(walked []string, fileInfo FileInfo) error
+		options []func(*WalkOptions)
+	}{
+		{name: "walk all", fn: func([]string, FileInfo) error { return nil }},
+		{name: "skip directories", fn: skipSome(0)},
+		{name: "stop early", fn: skipSome(1000)},
+		{name: "from directory", from: "/dir2/dir1", fn: skipSome(0)},
+		{name: "start after hint", fn: skipSome(0), options: []func(*WalkOptions){WithStartAfterHint("/dir1/dir3/dir0/file2")}},
+		{name: "start after hint stop early", fn: skipSome(500), options: []func(*WalkOptions){WithStartAfterHint("/dir3/dir2")}},
+	}
+
 	for _, tc := range tcs {
-		var walked []string
 		if tc.from == "" {
 			tc.from = "/"
 		}
-		t.Run(tc.name, func(t *testing.T) {
-			err := WalkFallback(context.Background(), d, tc.from, func(fileInfo FileInfo) error {
-				walked = append(walked, fileInfo.Path())
-				if fileInfo.IsDir() != d.isDir(fileInfo.Path()) {
-					t.Fatalf("fileInfo isDir not matching file system: expected %t actual %t", d.isDir(fileInfo.Path()), fileInfo.IsDir())
+		walk := func(t *testing.T, walkFn func(f WalkFn, options ...func(*WalkOptions)) error, options ...func(*WalkOptions)) []string {
+			var walked []string
+			seen := map[string]bool{}
+			err := walkFn(func(fileInfo FileInfo) error {
+				if seen[fileInfo.Path()] {
+					t.Fatalf("%s walked twice", fileInfo.Path())
 				}
-				return tc.fn(fileInfo)
-			}, tc.options...)
-			if tc.err && err == nil {
-				t.Fatal("expected err")
-			}
-			if !tc.err && err != nil {
+				seen[fileInfo.Path()] = true
+				walked = append(walked, fileInfo.Path())
+				return tc.fn(walked, fileInfo)
+			}, append(options, tc.options...)...)
+			if err != nil {
 				t.Fatal(err)
 			}
-			compareWalked(t, tc.expected, walked)
+			return walked
+		}
+
+		t.Run(tc.name, func(t *testing.T) {
+			expected := walk(t, func(f WalkFn, options ...func(*WalkOptions)) error {
+				return WalkFallback(context.Background(), d, tc.from, f, options...)
+			})
+			if len(expected) == 0 {
+				t.Fatal("nothing walked")
+			}
+			for _, parallelism := range []int{1, 2, 8, 64} {
+				walked := walk(t, func(f WalkFn, options ...func(*WalkOptions)) error {
+					return WalkFallback(context.Background(), d, tc.from, f, options...)
+				}, WithParallelism(parallelism))
+				compareWalked(t, expected, walked)
+
+				walked = walk(t, func(f WalkFn, options ...func(*WalkOptions)) error {
+					return WalkParallel(context.Background(), tc.from, d.list, f, options...)
+				}, WithParallelism(parallelism))
+				compareWalked(t, expected, walked)
+			}
 		})
 	}
 }
 
+// slowFileSystem records the number of calls to the fileSystem in flight.
+type slowFileSystem struct {
+	*fileSystem
+	mu          sync.Mutex
+	inFlight    int
+	maxInFlight int
+}
+
+func (sfs *slowFileSystem) enter() func() {
+	sfs.mu.Lock()
+	sfs.inFlight++
+	sfs.maxInFlight = max(sfs.maxInFlight, sfs.inFlight)
+	sfs.mu.Unlock()
+	time.Sleep(time.Millisecond)
+	return func() {
+		sfs.mu.Lock()
+		sfs.inFlight--
+		sfs.mu.Unlock()
+	}
+}
+
+func (sfs *slowFileSystem) List(ctx context.Context, path string) ([]string, error) {
+	defer sfs.enter()()
+	return sfs.fileSystem.List(ctx, path)
+}
+
+func (sfs *slowFileSystem) Stat(ctx context.Context, path string) (FileInfo, error) {
+	defer sfs.enter()()
+	return sfs.fileSystem.Stat(ctx, path)
+}
+
+func TestWalkParallelBounded(t *testing.T) {
+	d := &slowFileSystem{fileSystem: deepFileSystem(3, 4)}
+	walked := 0
+	err := WalkFallback(context.Background(), d, "/", func(fileInfo FileInfo) error {
+		walked++
+		return nil
+	}, WithParallelism(4))
+	if err != nil {
+		t.Fatal(err)
+	}
+	entries := 0
+	for _, children := range d.fileset {
+		entries += len(children)
+	}
+	if walked != entries {
+		t.Fatalf("unexpected number of entries walked: %d", walked)
+	}
+	if d.maxInFlight > 4 {
+		t.Fatalf("%d calls in flight, expected at most 4", d.maxInFlight)
+	}
+	if d.maxInFlight < 2 {
+		t.Fatalf("%d calls in flight, expected the walk to be parallel", d.maxInFlight)
+	}
+}
+
+func TestWalkParallelListError(t *testing.T) {
+	d := deepFileSystem(2, 3)
+	// The directory is stated, but listing it fails.
+	d.fileset["/dir1/dir2"] = nil
+	for _, parallelism := range []int{1, 4} {
+		err := WalkFallback(context.Background(), d, "/", func(fileInfo FileInfo) error {
+			return nil
+		}, WithParallelism(parallelism))
+		if !errors.As(err, &PathNotFoundError{}) {
+			t.Fatalf("parallelism %d: expected PathNotFoundError, got %v", parallelism, err)
+		}
+	}
+}
+
 func compareWalked(t *testing.T, expected, walked []string) {
 	if len(walked) != len(expected) {
 		t.Fatalf("Mismatch number of fileInfo walked %d expected %d; walked %s; expected %s;", len(walked), len(expected), walked, expected)
@@ -4,23 +4,93 @@ import (
 	"context"
 	"errors"
 	"fmt"
+	"io"
+	"os"
+	"sort"
+	"time"
 
 	"github.com/distribution/distribution/v3"
+	"github.com/distribution/distribution/v3/internal/dcontext"
 	"github.com/distribution/distribution/v3/registry/storage/driver"
 	"github.com/distribution/reference"
 	"github.com/opencontainers/go-digest"
 	v1 "github.com/opencontainers/image-spec/specs-go/v1"
 )
 
-func emit(format string, a ...any) {
-	fmt.Printf(format+"\n", a...)
-}
+// mtimeGranularity is the coarsest resolution of the modification times
+// reported by the storage drivers, by which the age of a file may be
+// overstated.
+const mtimeGranularity = time.Second
 
 // GCOpts contains options for garbage collector
 type GCOpts struct {
 	DryRun         bool
 	RemoveUntagged bool
-	Quiet          bool
+	// UntaggedOlderThan restricts RemoveUntagged to the manifests linked to
+	// their repository at least this long ago.
+	UntaggedOlderThan time.Duration
+	Quiet             bool
+	// Output is where the progress is printed, the standard output if nil.
+	Output io.Writer
+	// Retention selects the tags deleted, none if nil.
+	Retention *RetentionPolicy
+	// Repositories selects the repositories deleted from, all of them if
+	// nil.
+	Repositories *RepositoryFilter
+	// Online configures a garbage collection running while the registry
+	// accepts pushes, nil if it is read-only.
+	Online *OnlineGCOpts
+	// ProgressInterval is the interval at which the progress is printed,
+	// never if zero.
+	ProgressInterval time.Duration
+	// Checkpoint configures the checkpoints the garbage collection resumes
+	// from if it is interrupted, none if nil.
+	Checkpoint *GCCheckpointOpts
+	// DeleteParallelism is the maximum number of deletions run concurrently
+	// during the sweep, one if zero.
+	DeleteParallelism int
+	// Quotas are released the size of the layer links deleted, none if nil.
+	Quotas *Quotas
+	// Catalog is the index the repositories whose last manifest is deleted
+	// are removed from, none if nil. The repositories are only removed by
+	// an offline garbage collection, with their manifests directory.
+	Catalog *CatalogIndex
+	// Listener is notified of the manifests and the layer links deleted,
+	// none if nil.
+	Listener GCListener
+}
+
+// GCListener is notified of the manifests and the layer links garbage
+// collection deletes from the repositories, once deleted.
+type GCListener interface {
+	ManifestDeleted(repo reference.Named, dgst digest.Digest) error
+	BlobDeleted(repo reference.Named, dgst digest.Digest) error
+}
+
+func (opts GCOpts) emit(format string, a ...any) {
+	if opts.Quiet {
+		return
+	}
+	w := opts.Output
+	if w == nil {
+		w = os.Stdout
+	}
+	fmt.Fprintf(w, format+"\n", a...)
+}
+
+// notify notifies the listener, if any, of the deletion of dgst from the
+// repository. A failure to notify is logged, since the object is deleted.
+func (opts GCOpts) notify(ctx context.Context, repoName string, dgst digest.Digest, deleted func(GCListener, reference.Named, digest.Digest) error) {
+	if opts.Listener == nil {
+		return
+	}
+	named, err := reference.WithName(repoName)
+	if err == nil {
+		err = deleted(opts.Listener, named, dgst)
+	}
+	if err != nil {
+		dcontext.GetLogger(ctx).Errorf("failed to notify the deletion of %s from %s: %v", dgst, repoName, err)
+	}
 }
 
 // ManifestDel contains manifest structure which will be deleted
@@ -28,22 +98,342 @@ type ManifestDel struct {
 	Name   string
 	Digest digest.Digest
 	Tags   []string
+	// LinkedAt is when the manifest was linked to the repository, if known.
+	LinkedAt time.Time
+	// Subject is the manifest the manifest refers to, if any.
+	Subject digest.Digest
 }
 
 // MarkAndSweep performs a mark and sweep of registry data
 func MarkAndSweep(ctx context.Context, storageDriver driver.StorageDriver, registry distribution.Namespace, opts GCOpts) error {
+	_, err := GarbageCollect(ctx, storageDriver, registry, opts)
+	return err
+}
+
+// GarbageCollect performs a mark and sweep of registry data, and returns a
+// report of the objects deleted, or eligible for deletion with a dry run. The
+// report of a garbage collection resumed from a checkpoint includes the
+// objects deleted before it was interrupted.
+func GarbageCollect(ctx context.Context, storageDriver driver.StorageDriver, registry distribution.Namespace, opts GCOpts) (*GCReport, error) {
 	repositoryEnumerator, ok := registry.(distribution.RepositoryEnumerator)
 	if !ok {
-		return fmt.Errorf("unable to convert Namespace to RepositoryEnumerator")
+		return nil, fmt.Errorf("unable to convert Namespace to RepositoryEnumerator")
+	}
+	if opts.Retention != nil {
+		if err := opts.Retention.Validate(); err != nil {
+			return nil, err
+		}
+	}
+	if opts.Repositories != nil {
+		if err := opts.Repositories.Validate(); err != nil {
+			return nil, err
+		}
+	}
+	if opts.Online != nil && opts.Online.CutOff.IsZero() {
+		return nil, fmt.Errorf("online garbage collection requires a cut-off")
+	}
+	now := time.Now()
+	checkpoint, state, err := newCheckpointer(opts.Checkpoint, opts, now)
+	if err != nil {
+		return nil, err
+	}
+	// A resumed online garbage collection keeps its cut-off, since the
+	// content written after it was not marked.
+	cutOff := state.Options.CutOff
+	if opts.Online != nil {
+		online := *opts.Online
+		online.CutOff = cutOff
+		opts.Online = &online
 	}
 
 	// mark
-	markSet := make(map[digest.Digest]struct{})
-	deleteLayerSet := make(map[string][]digest.Digest)
-	manifestArr := make([]ManifestDel, 0)
-	err := repositoryEnumerator.Enumerate(ctx, func(repoName string) error {
-		if !opts.Quiet {
-			emit(repoName)
+	markSet := state.MarkSet
+	sweep := newSweeper(opts.Online, registry, storageDriver, markSet)
+	if state.Report == nil {
+		if err := markRepositories(ctx, storageDriver, registry, repositoryEnumerator, opts, state, checkpoint, sweep, now); err != nil {
+			return nil, fmt.Errorf("failed to mark: %v", err)
+		}
+
+		report, err := planSweep(ctx, registry, opts, state, sweep, now)
+		if err != nil {
+			return nil, err
+		}
+		state.Report = report
+		if err := checkpoint.save(time.Now()); err != nil {
+			return nil, err
+		}
+	}
+	report := state.Report
+	eligibleBlobs := len(report.Blobs)
+	eligibleManifests := 0
+	sweepTotal := eligibleBlobs
+	for _, r := range report.Repositories {
+		eligibleManifests += len(r.Manifests)
+		sweepTotal += len(r.Tags) + len(r.Manifests) + len(r.Blobs)
+	}
+
+	// sweep
+	vacuum := NewVacuum(ctx, storageDriver)
+	progress := newGCProgress(opts, "sweep: objects", sweepTotal, checkpoint.resumedObjects(), time.Now())
+	deleter := newGCSweep(ctx, sweep, checkpoint, progress, opts.DeleteParallelism)
+	var failures []error
+	fail := func(failure GCFailure, err error) {
+		failure.Error = err.Error()
+		report.Failed = append(report.Failed, failure)
+		failures = append(failures, fmt.Errorf("failed to delete %s: %v", failure, err))
+	}
+
+	// The tags are deleted first, so that no tag is left referencing a
+	// deleted manifest if the sweep fails.
+	var tags []sweepObject
+	for _, r := range report.Repositories {
+		for _, tag := range r.Tags {
+			opts.emit("%s: tag %s eligible for deletion by retention rule %s", r.Name, tag.Name, tag.Rule)
+			tagPath, err := pathFor(manifestTagCurrentPathSpec{name: r.Name, tag: tag.Name})
+			if err != nil {
+				return nil, err
+			}
+			// A tag pushed again is kept along with its new manifest.
+			tags = append(tags, sweepObject{path: tagPath, remove: func() error {
+				return vacuum.RemoveTag(r.Name, tag.Name)
+			}})
+		}
+	}
+	if !opts.DryRun {
+		outcomes, err := deleter.run(tags, nil)
+		if err != nil {
+			return nil, err
+		}
+		for i := range report.Repositories {
+			r := &report.Repositories[i]
+			deletedTags := r.Tags[:0]
+			for _, tag := range r.Tags {
+				outcome := outcomes[0]
+				outcomes = outcomes[1:]
+				if outcome.err != nil {
+					fail(GCFailure{Repository: r.Name, Kind: "tag", Tag: tag.Name, Digest: tag.Digest}, outcome.err)
+					// The manifest of the tag is kept along with its
+					// references.
+					if err := markLive(ctx, registry, r.Name, tag.Digest, markSet); err != nil {
+						return nil, err
+					}
+					continue
+				}
+				if !outcome.spared {
+					deletedTags = append(deletedTags, tag)
+				}
+			}
+			r.Tags = deletedTags
+		}
+
+		var manifests []sweepObject
+		for _, r := range report.Repositories {
+			for _, m := range r.Manifests {
+				linkPath, err := pathFor(manifestRevisionLinkPathSpec{name: r.Name, revision: m.Digest})
+				if err != nil {
+					return nil, err
+				}
+				manifests = append(manifests, sweepObject{digest: m.Digest, path: linkPath, remove: func() error {
+					if err := vacuum.RemoveManifest(r.Name, m.Digest, m.Tags); err != nil {
+						return err
+					}
+					if m.Subject != "" {
+						return vacuum.RemoveReferrer(r.Name, m.Subject, m.Digest)
+					}
+					return nil
+				}})
+			}
+		}
+		outcomes, err = deleter.run(manifests, nil)
+		if err != nil {
+			return nil, err
+		}
+		for i := range report.Repositories {
+			r := &report.Repositories[i]
+			deletedManifests := r.Manifests[:0]
+			for _, m := range r.Manifests {
+				outcome := outcomes[0]
+				outcomes = outcomes[1:]
+				if outcome.err != nil {
+					fail(GCFailure{Repository: r.Name, Kind: "manifest", Digest: m.Digest}, outcome.err)
+					// The blobs the manifest references are kept.
+					if err := markLive(ctx, registry, r.Name, m.Digest, markSet); err != nil {
+						return nil, err
+					}
+				}
+				if outcome.err != nil || outcome.spared {
+					r.Retained.Manifests++
+					report.Retained.Manifests++
+					continue
+				}
+				deletedManifests = append(deletedManifests, m)
+				opts.notify(ctx, r.Name, m.Digest, GCListener.ManifestDeleted)
+			}
+			r.Manifests = deletedManifests
+			if len(r.Manifests) > 0 && opts.Online == nil {
+				pruned, err := opts.Catalog.prune(ctx, storageDriver, r.Name)
+				if err != nil {
+					dcontext.GetLogger(ctx).Errorf("failed to remove %s from the catalog index: %v", r.Name, err)
+				} else if pruned {
+					opts.emit("%s: removed from the catalog, no manifest left", r.Name)
+				}
+			}
+		}
+	}
+	opts.emit("\n%d blobs marked, %d blobs and %d manifests eligible for deletion", len(markSet), eligibleBlobs, eligibleManifests)
+
+	blobs := make([]sweepObject, 0, len(report.Blobs))
+	for _, blob := range report.Blobs {
+		opts.emit("blob eligible for deletion: %s", blob.Digest)
+		dataPath, err := pathFor(blobDataPathSpec{digest: blob.Digest})
+		if err != nil {
+			return nil, err
+		}
+		blobs = append(blobs, sweepObject{digest: blob.Digest, path: dataPath, blob: true, size: blob.Size, remove: func() error {
+			return vacuum.RemoveBlob(string(blob.Digest))
+		}})
+	}
+	if !opts.DryRun {
+		// The drivers deleting files in batches delete the blobs with as
+		// few requests as possible.
+		var removeBatch func([]int) ([]error, error)
+		if vacuum.deletesBatches() {
+			removeBatch = func(indexes []int) ([]error, error) {
+				dgsts := make([]digest.Digest, 0, len(indexes))
+				for _, i := range indexes {
+					dgsts = append(dgsts, report.Blobs[i].Digest)
+				}
+				return vacuum.RemoveBlobs(dgsts)
+			}
+		}
+		outcomes, err := deleter.run(blobs, removeBatch)
+		if err != nil {
+			return nil, err
+		}
+		deletedBlobs := report.Blobs[:0]
+		for i, blob := range report.Blobs {
+			if outcomes[i].err != nil {
+				fail(GCFailure{Kind: "blob", Digest: blob.Digest}, outcomes[i].err)
+			}
+			if outcomes[i].err != nil || outcomes[i].spared {
+				report.Retained.Blobs++
+				report.ReclaimableBytes -= blob.Size
+				continue
+			}
+			deletedBlobs = append(deletedBlobs, blob)
+		}
+		report.Blobs = deletedBlobs
+	}
+
+	var links []sweepObject
+	for _, r := range report.Repositories {
+		for _, blob := range r.Blobs {
+			opts.emit("%s: layer link eligible for deletion: %s", r.Name, blob.Digest)
+			linkPath, err := pathFor(layerLinkPathSpec{name: r.Name, digest: blob.Digest})
+			if err != nil {
+				return nil, err
+			}
+			links = append(links, sweepObject{digest: blob.Digest, path: linkPath, remove: func() error {
+				if err := vacuum.RemoveLayer(r.Name, blob.Digest); err != nil {
+					return err
+				}
+				return opts.Quotas.release(ctx, r.Name, blob.Size)
+			}})
+		}
+	}
+	if !opts.DryRun {
+		outcomes, err := deleter.run(links, nil)
+		if err != nil {
+			return nil, err
+		}
+		for i := range report.Repositories {
+			r := &report.Repositories[i]
+			deletedLinks := r.Blobs[:0]
+			for _, blob := range r.Blobs {
+				outcome := outcomes[0]
+				outcomes = outcomes[1:]
+				if outcome.err != nil {
+					fail(GCFailure{Repository: r.Name, Kind: "layer", Digest: blob.Digest}, outcome.err)
+				}
+				if outcome.err != nil || outcome.spared {
+					r.Retained.Blobs++
+					continue
+				}
+				deletedLinks = append(deletedLinks, blob)
+				opts.notify(ctx, r.Name, blob.Digest, GCListener.BlobDeleted)
+			}
+			r.Blobs = deletedLinks
+		}
+	}
+
+	if err := checkpoint.done(); err != nil {
+		return nil, err
+	}
+	report.Summary = report.summarize()
+	opts.emitSummary(report.Summary)
+	if len(failures) > 0 {
+		return report, fmt.Errorf("failed to delete %d objects: %w", len(failures), errors.Join(failures...))
+	}
+	return report, nil
+}
+
+// markLive marks the manifest dgst of the repository repoName, which failed to
+// be deleted, along with its references, so that they are kept.
+func markLive(ctx context.Context, registry distribution.Namespace, repoName string, dgst digest.Digest, markSet map[digest.Digest]struct{}) error {
+	named, err := reference.WithName(repoName)
+	if err != nil {
+		return fmt.Errorf("failed to parse repo name %s: %v", repoName, err)
+	}
+	repository, err := registry.Repository(ctx, named)
+	if err != nil {
+		return fmt.Errorf("failed to construct repository: %v", err)
+	}
+	manifestService, err := repository.Manifests(ctx)
+	if err != nil {
+		return fmt.Errorf("failed to construct manifest service: %v", err)
+	}
+	markSet[dgst] = struct{}{}
+	return markManifestReferences(dgst, manifestService, ctx, func(d digest.Digest) bool {
+		_, marked := markSet[d]
+		markSet[d] = struct{}{}
+		return marked
+	})
+}
+
+// markRepositories marks the manifests and the blobs referenced by the
+// repositories not marked yet, and records the manifests and the layer links
+// eligible for deletion.
+func markRepositories(ctx context.Context, storageDriver driver.StorageDriver, registry distribution.Namespace, repositoryEnumerator distribution.RepositoryEnumerator, opts GCOpts, state *gcState, checkpoint *checkpointer, sweep *sweeper, now time.Time) error {
+	markSet := state.MarkSet
+	cutOff := state.Options.CutOff
+	marked := make(map[string]struct{}, len(state.Marked))
+	for _, repoName := range state.Marked {
+		marked[repoName] = struct{}{}
+	}
+	total := 0
+	if opts.ProgressInterval > 0 {
+		err := repositoryEnumerator.Enumerate(ctx, func(string) error {
+			total++
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+	}
+	progress := newGCProgress(opts, "mark: repositories", total, len(marked), time.Now())
+	markDetails := func() string {
+		return fmt.Sprintf("%d blobs marked", len(markSet))
+	}
+
+	return repositoryEnumerator.Enumerate(ctx, func(repoName string) error {
+		if _, ok := marked[repoName]; ok {
+			progress.step(markDetails)
+			return nil
+		}
+		opts.emit(repoName)
+		included, rule := opts.Repositories.match(repoName)
+		if rule != "" {
+			opts.emit("%s: %s", repoName, rule)
 		}
 
 		var err error
@@ -66,8 +456,100 @@ func MarkAndSweep(ctx context.Context, storageDriver driver.StorageDriver, regis
 			return fmt.Errorf("unable to convert ManifestService into ManifestEnumerator")
 		}
 
+		var (
+			retention     *repositoryRetention
+			prunedIndexed map[digest.Digest]struct{}
+		)
+		if opts.Retention != nil && included {
+			retention, err = applyRetention(ctx, storageDriver, repository, opts.Retention, now, cutOff)
+			if err != nil {
+				return err
+			}
+			prunedIndexed, err = retention.prunedManifests(ctx, manifestService)
+			if err != nil {
+				return err
+			}
+			tags := make([]GCTag, 0)
+			for _, tag := range retention.tags {
+				if !tag.kept {
+					tags = append(tags, GCTag{Name: tag.name, Digest: tag.digest, PushedAt: tag.pushedAt, PulledAt: tag.pulledAt, Rule: retention.rule})
+				}
+			}
+			state.Tags[repoName] = tags
+		}
+
+		manifestCount := 0
+		var manifests []ManifestDel
+		// deleteManifest records the manifest for deletion, unless it was
+		// linked less than minAge ago, or an online garbage collection keeps
+		// it as linked since the cut-off.
+		deleteManifest := func(dgst digest.Digest, subject *v1.Descriptor, tags []string, minAge time.Duration) (bool, error) {
+			var linkedAt time.Time
+			if opts.Online != nil || minAge > 0 {
+				linkPath, err := pathFor(manifestRevisionLinkPathSpec{name: repoName, revision: dgst})
+				if err != nil {
+					return false, err
+				}
+				fi, err := storageDriver.Stat(ctx, linkPath)
+				if err == nil {
+					linkedAt = fi.ModTime()
+				} else if _, ok := err.(driver.PathNotFoundError); !ok {
+					return false, fmt.Errorf("failed to stat manifest %s: %v", dgst, err)
+				}
+				if opts.Online != nil && !linkedAt.IsZero() && !linkedAt.Before(cutOff) {
+					return false, nil
+				}
+				// The age is only known if the driver reports a
+				// modification time, and up to its granularity.
+				if minAge > 0 && (linkedAt.IsZero() || now.Sub(linkedAt)-mtimeGranularity < minAge) {
+					opts.emit("%s: keeping untagged manifest %s, linked %s ago", repoName, dgst, linkedAge(now, linkedAt))
+					return false, nil
+				}
+			}
+			del := ManifestDel{Name: repoName, Digest: dgst, Tags: tags, LinkedAt: linkedAt}
+			if subject != nil {
+				del.Subject = subject.Digest
+			}
+			manifests = append(manifests, del)
+			return true, nil
+		}
+		// markManifest marks a manifest kept, along with the blobs it
+		// references.
+		markManifest := func(dgst digest.Digest) error {
+			opts.emit("%s: marking manifest %s ", repoName, dgst)
+			markSet[dgst] = struct{}{}
+
+			return markManifestReferences(dgst, manifestService, ctx, func(d digest.Digest) bool {
+				_, marked := markSet[d]
+				if !marked {
+					markSet[d] = struct{}{}
+					opts.emit("%s: marking blob %s", repoName, d)
+				}
+				return marked
+			})
+		}
+		// enumerated holds the manifests of the repository, and referrers
+		// the untagged ones with a subject, which are only deleted once the
+		// others are marked, if their subject is not kept.
+		enumerated := make(map[digest.Digest]struct{})
+		referrers := make(map[digest.Digest]untaggedReferrer)
 		err = manifestEnumerator.Enumerate(ctx, func(dgst digest.Digest) error {
-			if opts.RemoveUntagged {
+			manifestCount++
+			enumerated[dgst] = struct{}{}
+			if retention != nil {
+				// The manifests only referenced by deleted tags are deleted
+				// along with them, unless a kept manifest references them.
+				_, kept := retention.kept[dgst]
+				_, pruned := retention.pruned[dgst]
+				_, indexed := prunedIndexed[dgst]
+				if !kept && (pruned || indexed) {
+					deleted, err := deleteManifest(dgst, referrerSubject(ctx, manifestService, dgst), retention.tagNames(), 0)
+					if err != nil || deleted {
+						return err
+					}
+				}
+			}
+			if opts.RemoveUntagged && included {
 				// fetch all tags where this manifest is the latest one
 				tags, err := repository.Tags(ctx).Lookup(ctx, v1.Descriptor{Digest: dgst})
 				if err != nil {
@@ -80,33 +562,22 @@ func MarkAndSweep(ctx context.Context, storageDriver driver.StorageDriver, regis
 					allTags, err := repository.Tags(ctx).All(ctx)
 					if err != nil {
 						if _, ok := err.(distribution.ErrRepositoryUnknown); ok {
-							if !opts.Quiet {
-								emit("manifest tags path of repository %s does not exist", repoName)
-							}
+							opts.emit("manifest tags path of repository %s does not exist", repoName)
 							return nil
 						}
 						return fmt.Errorf("failed to retrieve tags %v", err)
 					}
-					manifestArr = append(manifestArr, ManifestDel{Name: repoName, Digest: dgst, Tags: allTags})
-					return nil
-				}
-			}
-			// Mark the manifest's blob
-			if !opts.Quiet {
-				emit("%s: marking manifest %s ", repoName, dgst)
-			}
-			markSet[dgst] = struct{}{}
-
-			return markManifestReferences(dgst, manifestService, ctx, func(d digest.Digest) bool {
-				_, marked := markSet[d]
-				if !marked {
-					markSet[d] = struct{}{}
-					if !opts.Quiet {
-						emit("%s: marking blob %s", repoName, d)
+					if subject := referrerSubject(ctx, manifestService, dgst); subject != nil {
+						referrers[dgst] = untaggedReferrer{subject: subject, tags: allTags}
+						return nil
+					}
+					deleted, err := deleteManifest(dgst, nil, allTags, opts.UntaggedOlderThan)
+					if err != nil || deleted {
+						return err
 					}
 				}
-				return marked
-			})
+			}
+			return markManifest(dgst)
 		})
 
 		if err != nil {
@@ -119,93 +590,205 @@ func MarkAndSweep(ctx context.Context, storageDriver driver.StorageDriver, regis
 				return err
 			}
 		}
+
+		// An untagged referrer is kept as long as its subject is, and
+		// deleted along with it otherwise. resolve returns whether the
+		// manifest is deleted, resolving the referrers of the chain first.
+		var resolve func(dgst digest.Digest) (bool, error)
+		resolve = func(dgst digest.Digest) (bool, error) {
+			if _, ok := enumerated[dgst]; !ok {
+				return true, nil
+			}
+			if _, ok := markSet[dgst]; ok {
+				return false, nil
+			}
+			referrer, ok := referrers[dgst]
+			if !ok {
+				return true, nil
+			}
+			delete(referrers, dgst)
+			subjectDeleted, err := resolve(referrer.subject.Digest)
+			if err != nil {
+				return false, err
+			}
+			if !subjectDeleted {
+				opts.emit("%s: keeping untagged manifest %s, referring to manifest %s", repoName, dgst, referrer.subject.Digest)
+				return false, markManifest(dgst)
+			}
+			deleted, err := deleteManifest(dgst, referrer.subject, referrer.tags, opts.UntaggedOlderThan)
+			if err != nil || deleted {
+				return deleted, err
+			}
+			return false, markManifest(dgst)
+		}
+		pending := make([]digest.Digest, 0, len(referrers))
+		for dgst := range referrers {
+			pending = append(pending, dgst)
+		}
+		sort.Slice(pending, func(i, j int) bool { return pending[i] < pending[j] })
+		for _, dgst := range pending {
+			if _, err := resolve(dgst); err != nil {
+				return err
+			}
+		}
+
 		blobService := repository.Blobs(ctx)
 		layerEnumerator, ok := blobService.(distribution.ManifestEnumerator)
 		if !ok {
 			return errors.New("unable to convert BlobService into ManifestEnumerator")
 		}
 
+		layerCount := 0
 		var deleteLayers []digest.Digest
 		err = layerEnumerator.Enumerate(ctx, func(dgst digest.Digest) error {
+			layerCount++
+			if !included {
+				// The blobs linked to the repositories excluded are kept,
+				// even if no manifest references them.
+				markSet[dgst] = struct{}{}
+				return nil
+			}
 			if _, ok := markSet[dgst]; !ok {
+				linkPath, err := pathFor(layerLinkPathSpec{name: repoName, digest: dgst})
+				if err != nil {
+					return err
+				}
+				recent, err := sweep.recent(ctx, linkPath)
+				if err != nil {
+					return err
+				}
+				if recent {
+					// The manifest referencing a blob linked since the
+					// cut-off may still be pushed.
+					markSet[dgst] = struct{}{}
+					return nil
+				}
 				deleteLayers = append(deleteLayers, dgst)
 			}
 			return nil
 		})
+		if err != nil {
+			return err
+		}
+
+		// The state of the repository is only recorded once it is marked,
+		// so that a checkpoint never includes a repository partially marked.
+		state.Manifests = append(state.Manifests, manifests...)
 		if len(deleteLayers) > 0 {
-			deleteLayerSet[repoName] = deleteLayers
+			state.Layers[repoName] = deleteLayers
 		}
-		return err
+		state.ManifestCounts[repoName] = manifestCount
+		state.LayerCounts[repoName] = layerCount
+		state.Marked = append(state.Marked, repoName)
+		progress.step(markDetails)
+		return checkpoint.mark(time.Now())
 	})
-	if err != nil {
-		return fmt.Errorf("failed to mark: %v", err)
-	}
+}
 
-	manifestArr = unmarkReferencedManifest(manifestArr, markSet, opts.Quiet)
+// planSweep returns the report of the objects eligible for deletion once all
+// the repositories are marked.
+func planSweep(ctx context.Context, registry distribution.Namespace, opts GCOpts, state *gcState, sweep *sweeper, now time.Time) (*GCReport, error) {
+	markSet := state.MarkSet
+	manifestArr := unmarkReferencedManifest(state.Manifests, markSet, opts, now)
 
-	// sweep
-	vacuum := NewVacuum(ctx, storageDriver)
-	if !opts.DryRun {
-		for _, obj := range manifestArr {
-			err = vacuum.RemoveManifest(obj.Name, obj.Digest, obj.Tags)
-			if err != nil {
-				return fmt.Errorf("failed to delete manifest %s: %v", obj.Digest, err)
-			}
-		}
-	}
 	blobService := registry.Blobs()
-	deleteSet := make(map[digest.Digest]struct{})
-	err = blobService.Enumerate(ctx, func(dgst digest.Digest) error {
+	var deleteSet []digest.Digest
+	retainedBlobs := 0
+	err := blobService.Enumerate(ctx, func(dgst digest.Digest) error {
 		// check if digest is in markSet. If not, delete it!
-		if _, ok := markSet[dgst]; !ok {
-			deleteSet[dgst] = struct{}{}
+		if _, ok := markSet[dgst]; ok {
+			retainedBlobs++
+			return nil
+		}
+		dataPath, err := pathFor(blobDataPathSpec{digest: dgst})
+		if err != nil {
+			return err
+		}
+		recent, err := sweep.recent(ctx, dataPath)
+		if err != nil {
+			return err
+		}
+		if recent {
+			retainedBlobs++
+			return nil
 		}
+		deleteSet = append(deleteSet, dgst)
 		return nil
 	})
 	if err != nil {
-		return fmt.Errorf("error enumerating blobs: %v", err)
-	}
-	if !opts.Quiet {
-		emit("\n%d blobs marked, %d blobs and %d manifests eligible for deletion", len(markSet), len(deleteSet), len(manifestArr))
+		return nil, fmt.Errorf("error enumerating blobs: %v", err)
 	}
-	for dgst := range deleteSet {
-		if !opts.Quiet {
-			emit("blob eligible for deletion: %s", dgst)
-		}
-		if opts.DryRun {
-			continue
-		}
-		err = vacuum.RemoveBlob(string(dgst))
+
+	// The sizes are known only until the blobs are deleted.
+	report := newGCReport(opts.DryRun, state.Marked)
+	sizes := blobSizes{statter: registry.BlobStatter(), sizes: make(map[digest.Digest]int64)}
+	for _, obj := range manifestArr {
+		size, err := sizes.size(ctx, obj.Digest)
 		if err != nil {
-			return fmt.Errorf("failed to delete blob %s: %v", dgst, err)
+			return nil, err
 		}
+		r := report.repository(obj.Name)
+		r.Manifests = append(r.Manifests, GCManifest{Digest: obj.Digest, Size: size, Tags: obj.Tags, LinkedAt: obj.LinkedAt, Subject: obj.Subject})
 	}
-
-	for repo, dgsts := range deleteLayerSet {
+	for repo, dgsts := range state.Layers {
+		r := report.repository(repo)
 		for _, dgst := range dgsts {
-			if !opts.Quiet {
-				emit("%s: layer link eligible for deletion: %s", repo, dgst)
-			}
-			if opts.DryRun {
-				continue
-			}
-			err = vacuum.RemoveLayer(repo, dgst)
+			size, err := sizes.size(ctx, dgst)
 			if err != nil {
-				return fmt.Errorf("failed to delete layer link %s of repo %s: %v", dgst, repo, err)
+				return nil, err
 			}
+			r.Blobs = append(r.Blobs, GCBlob{Digest: dgst, Size: size})
 		}
 	}
+	for _, dgst := range deleteSet {
+		size, err := sizes.size(ctx, dgst)
+		if err != nil {
+			return nil, err
+		}
+		report.Blobs = append(report.Blobs, GCBlob{Digest: dgst, Size: size})
+		report.ReclaimableBytes += size
+	}
+	for i := range report.Repositories {
+		r := &report.Repositories[i]
+		r.Retained.Manifests = state.ManifestCounts[r.Name] - len(r.Manifests)
+		r.Retained.Blobs = state.LayerCounts[r.Name] - len(r.Blobs)
+		report.Retained.Manifests += r.Retained.Manifests
+	}
+	report.Retained.Blobs = retainedBlobs
+	for repo, tags := range state.Tags {
+		r := report.repository(repo)
+		r.Tags = append(r.Tags, tags...)
+	}
+	report.sort()
+	return report, nil
+}
 
-	return err
+// untaggedReferrer is an untagged manifest with a subject, along with the tags
+// of its repository, whose history it is removed from.
+type untaggedReferrer struct {
+	subject *v1.Descriptor
+	tags    []string
+}
+
+// referrerSubject returns the subject of a manifest, nil if it has none or
+// cannot be read.
+func referrerSubject(ctx context.Context, manifestService distribution.ManifestService, dgst digest.Digest) *v1.Descriptor {
+	manifest, err := manifestService.Get(ctx, dgst)
+	if err != nil {
+		return nil
+	}
+	return manifestSubject(manifest)
 }
 
 // unmarkReferencedManifest filters out manifest present in markSet
-func unmarkReferencedManifest(manifestArr []ManifestDel, markSet map[digest.Digest]struct{}, quietOutput bool) []ManifestDel {
+func unmarkReferencedManifest(manifestArr []ManifestDel, markSet map[digest.Digest]struct{}, opts GCOpts, now time.Time) []ManifestDel {
 	filtered := make([]ManifestDel, 0)
 	for _, obj := range manifestArr {
 		if _, ok := markSet[obj.Digest]; !ok {
-			if !quietOutput {
-				emit("manifest eligible for deletion: %s", obj)
+			if obj.LinkedAt.IsZero() {
+				opts.emit("manifest eligible for deletion: {%s %s %v}", obj.Name, obj.Digest, obj.Tags)
+			} else {
+				opts.emit("manifest eligible for deletion: {%s %s %v}, linked %s ago", obj.Name, obj.Digest, obj.Tags, linkedAge(now, obj.LinkedAt))
 			}
 
 			filtered = append(filtered, obj)
@@ -214,6 +797,15 @@ func unmarkReferencedManifest(manifestArr []ManifestDel, markSet map[digest.Dige
 	return filtered
 }
 
+// linkedAge returns how long ago a manifest was linked at linkedAt, to the
+// second, or "an unknown time" if the driver does not report it.
+func linkedAge(now, linkedAt time.Time) string {
+	if linkedAt.IsZero() {
+		return "an unknown time"
+	}
+	return now.Sub(linkedAt).Round(time.Second).String()
+}
+
 // markManifestReferences marks the manifest references
 func markManifestReferences(dgst digest.Digest, manifestService distribution.ManifestService, ctx context.Context, ingester func(digest.Digest) bool) error {
 	manifest, err := manifestService.Get(ctx, dgst)
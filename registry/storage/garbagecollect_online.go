@@ -0,0 +1,213 @@
+package storage
+
+import (
+	"context"
+	"fmt"
+	"path"
+	"strings"
+	"time"
+
+	"github.com/distribution/distribution/v3"
+	"github.com/distribution/distribution/v3/registry/storage/driver"
+	"github.com/distribution/reference"
+	"github.com/opencontainers/go-digest"
+	"golang.org/x/time/rate"
+)
+
+const defaultSweepBatchSize = 100
+
+// OnlineGCOpts configures a garbage collection running while the registry
+// accepts pushes.
+//
+// The manifests, layer links and blobs written at or after CutOff are live,
+// regardless of references. Since a manifest may be pushed during the sweep,
+// referencing blobs which were unreferenced when they were marked, the
+// manifests linked at or after CutOff are marked again before each batch of
+// deletions, and each object is checked again right before its deletion. The
+// manifest revisions are all listed before the first batch only: the next
+// marks list the revisions not seen yet, so a manifest pushed again during the
+// sweep is not marked again. A
+// manifest whose push verified its blobs just before they were checked, but
+// which is only linked after they are deleted, may still reference deleted
+// blobs, which CutOff shortens to the pushes lasting longer than the
+// garbage collection has been running for.
+type OnlineGCOpts struct {
+	// CutOff is the time from which the content written is live.
+	CutOff time.Time
+	// BatchSize is the number of objects deleted between two marks of the
+	// new manifests, 100 if zero.
+	BatchSize int
+	// Rate is the maximum number of objects deleted per second, unlimited
+	// if zero.
+	Rate float64
+}
+
+// sweeper checks, before each deletion of an online garbage collection, that
+// the object deleted is still unreferenced.
+type sweeper struct {
+	online   *OnlineGCOpts
+	registry distribution.Namespace
+	driver   driver.StorageDriver
+	markSet  map[digest.Digest]struct{}
+	limiter  *rate.Limiter
+	// seen are the manifest revision directories already listed.
+	seen map[string]struct{}
+	// marked is whether the new manifests were marked, and unmarked the
+	// number of objects deleted since.
+	marked   bool
+	unmarked int
+}
+
+func newSweeper(online *OnlineGCOpts, registry distribution.Namespace, storageDriver driver.StorageDriver, markSet map[digest.Digest]struct{}) *sweeper {
+	s := &sweeper{
+		online:   online,
+		registry: registry,
+		driver:   storageDriver,
+		markSet:  markSet,
+		seen:     make(map[string]struct{}),
+	}
+	if online != nil && online.Rate > 0 {
+		s.limiter = rate.NewLimiter(rate.Limit(online.Rate), 1)
+	}
+	return s
+}
+
+// recent returns whether the file at p was written at or after the cut-off of
+// an online garbage collection.
+func (s *sweeper) recent(ctx context.Context, p string) (bool, error) {
+	if s.online == nil {
+		return false, nil
+	}
+	fi, err := s.driver.Stat(ctx, p)
+	if err != nil {
+		if _, ok := err.(driver.PathNotFoundError); ok {
+			return false, nil
+		}
+		return false, err
+	}
+	return !fi.ModTime().Before(s.online.CutOff), nil
+}
+
+// spare returns whether the object dgst, stored at p, is to be kept rather
+// than deleted: because it was marked during the sweep, or during an online
+// garbage collection, because a manifest pushed since it was marked references
+// it, or because it was written again.
+func (s *sweeper) spare(ctx context.Context, dgst digest.Digest, p string) (bool, error) {
+	if s.online == nil {
+		// The references of the manifests which failed to be deleted are
+		// marked during the sweep.
+		_, ok := s.markSet[dgst]
+		return ok, nil
+	}
+	batchSize := s.online.BatchSize
+	if batchSize <= 0 {
+		batchSize = defaultSweepBatchSize
+	}
+	if !s.marked || s.unmarked >= batchSize {
+		if err := s.markLinked(ctx); err != nil {
+			return false, fmt.Errorf("failed to mark new manifests: %v", err)
+		}
+		s.marked = true
+		s.unmarked = 0
+	}
+	if _, ok := s.markSet[dgst]; ok {
+		return true, nil
+	}
+	recent, err := s.recent(ctx, p)
+	if err != nil || recent {
+		return recent, err
+	}
+
+	if s.limiter != nil {
+		if err := s.limiter.Wait(ctx); err != nil {
+			return false, err
+		}
+	}
+	s.unmarked++
+	return false, nil
+}
+
+// markLinked marks the manifests linked at or after the cut-off, along with
+// the blobs they reference. It walks the repositories once, skipping the
+// layers, the uploads, the tags and the revisions already seen, so that only
+// the repositories and the revisions added since the previous mark are listed.
+func (s *sweeper) markLinked(ctx context.Context) error {
+	root, err := pathFor(repositoriesRootPathSpec{})
+	if err != nil {
+		return err
+	}
+	linked := make(map[string][]digest.Digest)
+	err = s.driver.Walk(ctx, root, func(fi driver.FileInfo) error {
+		repoName, manifestPath, ok := strings.Cut(strings.TrimPrefix(fi.Path(), root+"/")+"/", "/_manifests/")
+		if !ok {
+			if fi.IsDir() && strings.HasPrefix(path.Base(fi.Path()), "_") {
+				return driver.ErrSkipDir
+			}
+			return nil
+		}
+		var components []string
+		if manifestPath = strings.TrimSuffix(manifestPath, "/"); manifestPath != "" {
+			components = strings.Split(manifestPath, "/")
+		}
+		switch {
+		case len(components) == 0:
+			return nil
+		case components[0] != "revisions":
+			// The tags.
+			return driver.ErrSkipDir
+		case len(components) == 3:
+			// The revision is at <algorithm>/<hex digest>.
+			if _, ok := s.seen[fi.Path()]; ok {
+				return driver.ErrSkipDir
+			}
+			return nil
+		case len(components) == 4 && fi.IsDir():
+			// The referrers.
+			return driver.ErrSkipDir
+		case len(components) != 4 || components[3] != "link":
+			return nil
+		}
+		s.seen[path.Dir(fi.Path())] = struct{}{}
+		if fi.ModTime().Before(s.online.CutOff) {
+			return nil
+		}
+		dgst := digest.NewDigestFromEncoded(digest.Algorithm(components[1]), components[2])
+		if dgst.Validate() == nil {
+			linked[repoName] = append(linked[repoName], dgst)
+		}
+		return nil
+	})
+	if err != nil {
+		if _, ok := err.(driver.PathNotFoundError); ok {
+			return nil
+		}
+		return err
+	}
+
+	for repoName, dgsts := range linked {
+		named, err := reference.WithName(repoName)
+		if err != nil {
+			return fmt.Errorf("failed to parse repo name %s: %v", repoName, err)
+		}
+		repository, err := s.registry.Repository(ctx, named)
+		if err != nil {
+			return fmt.Errorf("failed to construct repository: %v", err)
+		}
+		manifestService, err := repository.Manifests(ctx)
+		if err != nil {
+			return fmt.Errorf("failed to construct manifest service: %v", err)
+		}
+		for _, dgst := range dgsts {
+			s.markSet[dgst] = struct{}{}
+			err := markManifestReferences(dgst, manifestService, ctx, func(d digest.Digest) bool {
+				_, marked := s.markSet[d]
+				s.markSet[d] = struct{}{}
+				return marked
+			})
+			if err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
@@ -0,0 +1,256 @@
+package storage
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/distribution/distribution/v3/internal/dcontext"
+	storagedriver "github.com/distribution/distribution/v3/registry/storage/driver"
+	"github.com/distribution/distribution/v3/registry/storage/driver/inmemory"
+	"github.com/distribution/distribution/v3/testutil"
+	"github.com/opencontainers/go-digest"
+	v1 "github.com/opencontainers/image-spec/specs-go/v1"
+)
+
+// deleteHookDriver calls onDelete, once set, before the next deletion.
+type deleteHookDriver struct {
+	storagedriver.StorageDriver
+	once     sync.Once
+	onDelete func()
+}
+
+func (d *deleteHookDriver) Delete(ctx context.Context, path string) error {
+	if d.onDelete != nil {
+		d.once.Do(d.onDelete)
+	}
+	return d.StorageDriver.Delete(ctx, path)
+}
+
+// listCountingDriver counts the listings of each directory, including those
+// of its walks.
+type listCountingDriver struct {
+	storagedriver.StorageDriver
+	mu    sync.Mutex
+	lists map[string]int
+}
+
+func (d *listCountingDriver) List(ctx context.Context, path string) ([]string, error) {
+	d.mu.Lock()
+	d.lists[path]++
+	d.mu.Unlock()
+	return d.StorageDriver.List(ctx, path)
+}
+
+func (d *listCountingDriver) Walk(ctx context.Context, path string, f storagedriver.WalkFn, options ...func(*storagedriver.WalkOptions)) error {
+	return storagedriver.WalkFallback(ctx, d, path, f, options...)
+}
+
+// cutOff returns a cut-off after all the content written so far.
+func cutOff() time.Time {
+	time.Sleep(time.Millisecond)
+	defer time.Sleep(time.Millisecond)
+	return time.Now()
+}
+
+func TestOnlineGCKeepsRecentContent(t *testing.T) {
+	ctx := dcontext.Background()
+	inmemoryDriver := inmemory.New()
+	registry := createRegistry(t, inmemoryDriver)
+	repo := makeRepository(t, registry, "online/app")
+
+	keptDigest := uploadGoldenImage(t, repo, "kept layer")
+	if err := repo.Tags(ctx).Tag(ctx, "latest", v1.Descriptor{Digest: keptDigest}); err != nil {
+		t.Fatalf("failed to tag manifest: %v", err)
+	}
+	uploadGoldenImage(t, repo, "old untagged layer")
+	for _, content := range []string{"old orphan layer", "other old orphan layer"} {
+		if err := testutil.UploadBlobs(repo, map[digest.Digest]io.ReadSeeker{digest.FromString(content): strings.NewReader(content)}); err != nil {
+			t.Fatalf("layer upload failed: %v", err)
+		}
+	}
+
+	cutOff := cutOff()
+	recentDigest := uploadGoldenImage(t, repo, "recent untagged layer")
+	if err := testutil.UploadBlobs(repo, map[digest.Digest]io.ReadSeeker{digest.FromString("recent orphan layer"): strings.NewReader("recent orphan layer")}); err != nil {
+		t.Fatalf("layer upload failed: %v", err)
+	}
+
+	const deletionRate = 100
+	start := time.Now()
+	report, err := GarbageCollect(ctx, inmemoryDriver, registry, GCOpts{
+		RemoveUntagged: true,
+		Quiet:          true,
+		Online:         &OnlineGCOpts{CutOff: cutOff, Rate: deletionRate},
+	})
+	if err != nil {
+		t.Fatalf("Failed mark and sweep: %v", err)
+	}
+
+	blobs := allBlobs(t, registry)
+	for content, kept := range map[string]bool{
+		"kept layer":             true,
+		"old untagged layer":     false,
+		"old orphan layer":       false,
+		"other old orphan layer": false,
+		"recent untagged layer":  true,
+		"recent orphan layer":    true,
+	} {
+		if _, ok := blobs[digest.FromString(content)]; ok != kept {
+			t.Fatalf("layer %q kept: %v, expected %v", content, ok, kept)
+		}
+	}
+	if _, ok := allManifests(t, makeManifestService(t, repo))[recentDigest]; !ok {
+		t.Fatal("manifest pushed after the cut-off was deleted")
+	}
+
+	// The deletions are rate limited.
+	deletions := len(report.Blobs) + len(report.Repositories[0].Blobs) + len(report.Repositories[0].Manifests)
+	if elapsed, minimum := time.Since(start), time.Duration(deletions-1)*time.Second/deletionRate; elapsed < minimum {
+		t.Fatalf("%d deletions took %v, expected at least %v", deletions, elapsed, minimum)
+	}
+}
+
+// TestOnlineGCManifestPushedDuringSweep checks that a blob unreferenced when
+// it was marked survives the sweep if a manifest referencing it is pushed in
+// the meantime.
+func TestOnlineGCManifestPushedDuringSweep(t *testing.T) {
+	ctx := dcontext.Background()
+	d := &deleteHookDriver{StorageDriver: inmemory.New()}
+	registry := createRegistry(t, d)
+	repo := makeRepository(t, registry, "online/race")
+
+	keptDigest := uploadGoldenImage(t, repo, "kept layer")
+	if err := repo.Tags(ctx).Tag(ctx, "latest", v1.Descriptor{Digest: keptDigest}); err != nil {
+		t.Fatalf("failed to tag manifest: %v", err)
+	}
+	untaggedDigest := uploadGoldenImage(t, repo, "old untagged layer")
+	unreferenced := digest.FromString("old unreferenced layer")
+	if err := testutil.UploadBlobs(repo, map[digest.Digest]io.ReadSeeker{unreferenced: strings.NewReader("old unreferenced layer")}); err != nil {
+		t.Fatalf("layer upload failed: %v", err)
+	}
+	cutOff := cutOff()
+
+	// The manifest is pushed once the sweep started, by the deletion of the
+	// untagged manifest.
+	var pushedDigest digest.Digest
+	d.onDelete = func() {
+		manifest, err := testutil.MakeSchema2Manifest(repo, []digest.Digest{unreferenced})
+		if err != nil {
+			t.Errorf("%v", err)
+			return
+		}
+		pushedDigest, err = makeManifestService(t, repo).Put(ctx, manifest)
+		if err != nil {
+			t.Errorf("manifest upload failed: %v", err)
+		}
+	}
+
+	report, err := GarbageCollect(ctx, d, registry, GCOpts{
+		RemoveUntagged: true,
+		Quiet:          true,
+		Online:         &OnlineGCOpts{CutOff: cutOff, BatchSize: 1},
+	})
+	if err != nil {
+		t.Fatalf("Failed mark and sweep: %v", err)
+	}
+	if pushedDigest == "" {
+		t.Fatal("no manifest was pushed during the sweep")
+	}
+
+	manifests := allManifests(t, makeManifestService(t, repo))
+	if _, ok := manifests[untaggedDigest]; ok {
+		t.Fatal("untagged manifest was not deleted")
+	}
+	if _, ok := manifests[pushedDigest]; !ok {
+		t.Fatal("manifest pushed during the sweep was deleted")
+	}
+	blobs := allBlobs(t, registry)
+	if _, ok := blobs[digest.FromString("old untagged layer")]; ok {
+		t.Fatal("layer of the untagged manifest was not deleted")
+	}
+	if _, ok := blobs[unreferenced]; !ok {
+		t.Fatal("blob referenced by the manifest pushed during the sweep was deleted")
+	}
+	if _, err := repo.Blobs(ctx).Stat(ctx, unreferenced); err != nil {
+		t.Fatalf("layer link referenced by the manifest pushed during the sweep was deleted: %v", err)
+	}
+	if _, err := makeManifestService(t, repo).Get(ctx, pushedDigest); err != nil {
+		t.Fatalf("manifest pushed during the sweep is unreadable: %v", err)
+	}
+	for _, blob := range report.Blobs {
+		if blob.Digest == unreferenced {
+			t.Fatal("spared blob is reported as deleted")
+		}
+	}
+}
+
+// TestOnlineGCListsRevisionsOnce checks that the marks of the new manifests
+// before each batch of deletions do not list the revisions seen before.
+func TestOnlineGCListsRevisionsOnce(t *testing.T) {
+	ctx := dcontext.Background()
+	d := &listCountingDriver{StorageDriver: inmemory.New(), lists: make(map[string]int)}
+	registry := createRegistry(t, d)
+	repo := makeRepository(t, registry, "online/lists")
+
+	var revisions []string
+	for i := range 5 {
+		dgst := uploadGoldenImage(t, repo, fmt.Sprintf("kept layer %d", i))
+		if err := repo.Tags(ctx).Tag(ctx, fmt.Sprintf("v%d", i), v1.Descriptor{Digest: dgst}); err != nil {
+			t.Fatalf("failed to tag manifest: %v", err)
+		}
+		revision, err := pathFor(manifestRevisionPathSpec{name: repo.Named().Name(), revision: dgst})
+		if err != nil {
+			t.Fatal(err)
+		}
+		revisions = append(revisions, strings.TrimSuffix(revision, "/"))
+	}
+	for i := range 10 {
+		content := fmt.Sprintf("old orphan layer %d", i)
+		if err := testutil.UploadBlobs(repo, map[digest.Digest]io.ReadSeeker{digest.FromString(content): strings.NewReader(content)}); err != nil {
+			t.Fatalf("layer upload failed: %v", err)
+		}
+	}
+	cutOff := cutOff()
+	recentDigest := uploadGoldenImage(t, repo, "recent untagged layer")
+
+	d.mu.Lock()
+	clear(d.lists)
+	d.mu.Unlock()
+	report, err := GarbageCollect(ctx, d, registry, GCOpts{
+		Quiet:  true,
+		Online: &OnlineGCOpts{CutOff: cutOff, BatchSize: 1},
+	})
+	if err != nil {
+		t.Fatalf("Failed mark and sweep: %v", err)
+	}
+	if len(report.Blobs) != 10 {
+		t.Fatalf("%d blobs deleted, expected 10", len(report.Blobs))
+	}
+	if _, ok := allBlobs(t, registry)[digest.FromString("recent untagged layer")]; !ok {
+		t.Fatalf("layer of the manifest %s pushed after the cut-off was deleted", recentDigest)
+	}
+
+	// Each revision is listed by the mark, and by the first mark of the new
+	// manifests only.
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	for _, revision := range revisions {
+		if n := d.lists[revision]; n > 2 {
+			t.Fatalf("revision %s listed %d times, expected at most 2", revision, n)
+		}
+	}
+}
+
+func TestOnlineGCRequiresCutOff(t *testing.T) {
+	inmemoryDriver := inmemory.New()
+	registry := createRegistry(t, inmemoryDriver)
+	_, err := GarbageCollect(dcontext.Background(), inmemoryDriver, registry, GCOpts{Quiet: true, Online: &OnlineGCOpts{}})
+	if err == nil {
+		t.Fatal("expected an error without a cut-off")
+	}
+}
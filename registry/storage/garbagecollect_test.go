@@ -1,9 +1,18 @@
 package storage
 
 import (
+	"bytes"
+	"encoding/json"
+	"flag"
+	"fmt"
 	"io"
+	"os"
 	"path"
+	"path/filepath"
+	"reflect"
+	"strings"
 	"testing"
+	"time"
 
 	"github.com/distribution/distribution/v3"
 	"github.com/distribution/distribution/v3/internal/dcontext"
@@ -417,6 +426,258 @@ func TestDeleteManifestIndexIfTagNotFound(t *testing.T) {
 	}
 }
 
+func TestDeleteUntaggedOlderThan(t *testing.T) {
+	ctx := dcontext.Background()
+	d := newHistoryDriver()
+	registry := createRegistry(t, d)
+	repo := makeRepository(t, registry, "untagged/app")
+	now := time.Now()
+
+	taggedDigest := uploadGoldenImage(t, repo, "tagged layer")
+	if err := repo.Tags(ctx).Tag(ctx, "latest", v1.Descriptor{Digest: taggedDigest}); err != nil {
+		t.Fatalf("failed to tag manifest: %v", err)
+	}
+	oldDigest := uploadGoldenImage(t, repo, "old untagged layer")
+	freshDigest := uploadGoldenImage(t, repo, "fresh untagged layer")
+	// A manifest linked within the granularity of the modification times
+	// may be younger than it looks, and is kept.
+	borderlineDigest := uploadGoldenImage(t, repo, "borderline untagged layer")
+	for dgst, linkedAt := range map[digest.Digest]time.Time{
+		oldDigest:        now.Add(-48 * time.Hour),
+		borderlineDigest: now.Add(-24*time.Hour - mtimeGranularity/2),
+	} {
+		linkPath, err := pathFor(manifestRevisionLinkPathSpec{name: repo.Named().Name(), revision: dgst})
+		if err != nil {
+			t.Fatal(err)
+		}
+		d.pushedAt[linkPath] = linkedAt
+	}
+
+	var out bytes.Buffer
+	opts := GCOpts{
+		DryRun:            true,
+		RemoveUntagged:    true,
+		UntaggedOlderThan: 24 * time.Hour,
+		Output:            &out,
+	}
+	report, err := GarbageCollect(ctx, d, registry, opts)
+	if err != nil {
+		t.Fatalf("Failed mark and sweep: %v", err)
+	}
+	if manifests := report.Repositories[0].Manifests; len(manifests) != 1 || manifests[0].Digest != oldDigest || !manifests[0].LinkedAt.Equal(now.Add(-48*time.Hour)) {
+		t.Fatalf("unexpected manifests eligible for deletion: %v", manifests)
+	}
+	if !strings.Contains(out.String(), oldDigest.String()+" [latest]}, linked 48h0m0s ago") {
+		t.Fatalf("dry run output does not show the age of the manifest:\n%s", out.String())
+	}
+
+	opts.DryRun = false
+	opts.Quiet = true
+	if _, err := GarbageCollect(ctx, d, registry, opts); err != nil {
+		t.Fatalf("Failed mark and sweep: %v", err)
+	}
+	manifests := allManifests(t, makeManifestService(t, repo))
+	for dgst, kept := range map[digest.Digest]bool{taggedDigest: true, oldDigest: false, freshDigest: true, borderlineDigest: true} {
+		if _, ok := manifests[dgst]; ok != kept {
+			t.Fatalf("manifest %s kept: %v, expected %v", dgst, ok, kept)
+		}
+	}
+	blobs := allBlobs(t, registry)
+	if _, ok := blobs[digest.FromString("old untagged layer")]; ok {
+		t.Fatal("layer of the old untagged manifest was not deleted")
+	}
+	if _, ok := blobs[digest.FromString("fresh untagged layer")]; !ok {
+		t.Fatal("layer of the fresh untagged manifest was deleted")
+	}
+}
+
+// TestGCRepositoryFilter checks that a layer shared by an included and an
+// excluded repository is kept, and that nothing is deleted from the excluded
+// repository.
+func TestGCRepositoryFilter(t *testing.T) {
+	ctx := dcontext.Background()
+	d := inmemory.New()
+	registry := createRegistry(t, d)
+
+	ci := makeRepository(t, registry, "ci/app")
+	ciDigest := uploadGoldenImage(t, ci, "shared layer", "ci layer")
+	prod := makeRepository(t, registry, "prod/app")
+	prodDigest := uploadGoldenImage(t, prod, "shared layer", "prod layer")
+	orphan := "prod orphan layer"
+	if err := testutil.UploadBlobs(prod, map[digest.Digest]io.ReadSeeker{digest.FromString(orphan): strings.NewReader(orphan)}); err != nil {
+		t.Fatalf("layer upload failed: %v", err)
+	}
+
+	var out bytes.Buffer
+	opts := GCOpts{
+		DryRun:         true,
+		RemoveUntagged: true,
+		Output:         &out,
+		Repositories:   &RepositoryFilter{Include: []string{"*/app"}, Exclude: []string{"prod/*"}},
+	}
+	if _, err := GarbageCollect(ctx, d, registry, opts); err != nil {
+		t.Fatalf("Failed mark and sweep: %v", err)
+	}
+	for _, line := range []string{
+		`ci/app: included by pattern "*/app"`,
+		`prod/app: excluded by pattern "prod/*"`,
+	} {
+		if !strings.Contains(out.String(), line) {
+			t.Fatalf("dry run output does not contain %q:\n%s", line, out.String())
+		}
+	}
+
+	opts.DryRun = false
+	opts.Quiet = true
+	report, err := GarbageCollect(ctx, d, registry, opts)
+	if err != nil {
+		t.Fatalf("Failed mark and sweep: %v", err)
+	}
+	for _, r := range report.Repositories {
+		if r.Name == "prod/app" && (len(r.Manifests) != 0 || len(r.Blobs) != 0) {
+			t.Fatalf("objects deleted from the excluded repository: %+v", r)
+		}
+	}
+	if _, ok := allManifests(t, makeManifestService(t, ci))[ciDigest]; ok {
+		t.Fatal("untagged manifest of the included repository was not deleted")
+	}
+	if _, ok := allManifests(t, makeManifestService(t, prod))[prodDigest]; !ok {
+		t.Fatal("untagged manifest of the excluded repository was deleted")
+	}
+	blobs := allBlobs(t, registry)
+	if _, ok := blobs[digest.FromString("ci layer")]; ok {
+		t.Fatal("layer of the included repository was not deleted")
+	}
+	for _, layer := range []string{"shared layer", "prod layer", orphan} {
+		if _, ok := blobs[digest.FromString(layer)]; !ok {
+			t.Fatalf("layer %q referenced by the excluded repository was deleted", layer)
+		}
+	}
+	if _, err := prod.Blobs(ctx).Stat(ctx, digest.FromString(orphan)); err != nil {
+		t.Fatalf("layer link of the excluded repository was deleted: %v", err)
+	}
+
+	// Without an included pattern matching it, a repository is excluded.
+	out.Reset()
+	opts = GCOpts{DryRun: true, RemoveUntagged: true, Output: &out, Repositories: &RepositoryFilter{Include: []string{"ci/*"}}}
+	if _, err := GarbageCollect(ctx, d, registry, opts); err != nil {
+		t.Fatalf("Failed mark and sweep: %v", err)
+	}
+	if !strings.Contains(out.String(), "prod/app: excluded, matching no included pattern") {
+		t.Fatalf("dry run output does not label the excluded repository:\n%s", out.String())
+	}
+}
+
+// TestGCReferrers checks that the untagged referrers are kept as long as their
+// subject is, and deleted along with it.
+func TestGCReferrers(t *testing.T) {
+	ctx := dcontext.Background()
+	d := inmemory.New()
+	registry := createRegistry(t, d)
+	repo := makeRepository(t, registry, "gcreferrers")
+
+	subject := uploadGoldenImage(t, repo, "subject layer")
+	if err := repo.Tags(ctx).Tag(ctx, "latest", v1.Descriptor{Digest: subject}); err != nil {
+		t.Fatalf("failed to tag manifest: %v", err)
+	}
+	signature := uploadReferrer(t, repo, subject, "application/vnd.example.signature", v1.MediaTypeEmptyJSON, nil)
+	// A referrer of a referrer is kept along with the chain.
+	attestation := uploadReferrer(t, repo, signature, "application/vnd.example.attestation", v1.MediaTypeEmptyJSON, nil)
+	untagged := uploadGoldenImage(t, repo, "untagged layer")
+	untaggedSignature := uploadReferrer(t, repo, untagged, "application/vnd.example.signature", v1.MediaTypeEmptyJSON, nil)
+	orphan := uploadReferrer(t, repo, digest.FromString("missing subject"), "application/vnd.example.signature", v1.MediaTypeEmptyJSON, nil)
+
+	report, err := GarbageCollect(ctx, d, registry, GCOpts{RemoveUntagged: true, Quiet: true})
+	if err != nil {
+		t.Fatalf("Failed mark and sweep: %v", err)
+	}
+	manifests := allManifests(t, makeManifestService(t, repo))
+	for _, dgst := range []digest.Digest{subject, signature, attestation} {
+		if _, ok := manifests[dgst]; !ok {
+			t.Fatalf("manifest %s of the tagged subject was deleted", dgst)
+		}
+	}
+	for _, dgst := range []digest.Digest{untagged, untaggedSignature, orphan} {
+		if _, ok := manifests[dgst]; ok {
+			t.Fatalf("manifest %s without a kept subject was not deleted", dgst)
+		}
+	}
+	subjects := map[digest.Digest]digest.Digest{}
+	for _, m := range report.Repositories[0].Manifests {
+		subjects[m.Digest] = m.Subject
+	}
+	if subjects[untaggedSignature] != untagged {
+		t.Fatalf("subject of the deleted referrer is not reported: %v", subjects)
+	}
+	if referrers := listReferrers(t, repo, signature, ""); len(referrers) != 1 || referrers[0].Digest != attestation {
+		t.Fatalf("unexpected referrers of the signature: %v", referrers)
+	}
+	linkPath, err := pathFor(manifestReferrerLinkPathSpec{name: "gcreferrers", subject: digest.FromString("missing subject"), revision: orphan})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := d.Stat(ctx, linkPath); err == nil {
+		t.Fatal("link of the deleted referrer was not removed")
+	}
+
+	if err := repo.Tags(ctx).Untag(ctx, "latest"); err != nil {
+		t.Fatalf("failed to untag manifest: %v", err)
+	}
+	if _, err := GarbageCollect(ctx, d, registry, GCOpts{RemoveUntagged: true, Quiet: true}); err != nil {
+		t.Fatalf("Failed mark and sweep: %v", err)
+	}
+	if manifests := allManifests(t, makeManifestService(t, repo)); len(manifests) != 0 {
+		t.Fatalf("referrers of the untagged subject were not deleted: %v", manifests)
+	}
+}
+
+func TestGCTagHistory(t *testing.T) {
+	ctx := dcontext.Background()
+	d := inmemory.New()
+	registry := createRegistry(t, d)
+	repo := makeRepository(t, registry, "gchistory")
+
+	var dgsts []digest.Digest
+	for range 3 {
+		dgst := uploadRandomOCIImage(t, repo).manifestDigest
+		if err := repo.Tags(ctx).Tag(ctx, "latest", v1.Descriptor{Digest: dgst}); err != nil {
+			t.Fatalf("failed to tag manifest: %v", err)
+		}
+		dgsts = append(dgsts, dgst)
+	}
+	// The first manifest is kept by another tag.
+	if err := repo.Tags(ctx).Tag(ctx, "pinned", v1.Descriptor{Digest: dgsts[0]}); err != nil {
+		t.Fatalf("failed to tag manifest: %v", err)
+	}
+
+	history := func() []digest.Digest {
+		entries, err := repo.Tags(ctx).(distribution.TagHistoryProvider).History(ctx, "latest")
+		if err != nil {
+			t.Fatalf("failed to get the tag history: %v", err)
+		}
+		var history []digest.Digest
+		for _, entry := range entries {
+			history = append(history, entry.Digest)
+		}
+		return history
+	}
+
+	if _, err := GarbageCollect(ctx, d, registry, GCOpts{Quiet: true}); err != nil {
+		t.Fatalf("Failed mark and sweep: %v", err)
+	}
+	if got := history(); len(got) != 3 {
+		t.Fatalf("history was pruned without removing untagged manifests: %v", got)
+	}
+
+	if _, err := GarbageCollect(ctx, d, registry, GCOpts{RemoveUntagged: true, Quiet: true}); err != nil {
+		t.Fatalf("Failed mark and sweep: %v", err)
+	}
+	// Only the entry of the deleted manifest is pruned.
+	if got, expected := history(), []digest.Digest{dgsts[2], dgsts[0]}; !reflect.DeepEqual(got, expected) {
+		t.Fatalf("unexpected history after garbage collection: %v != %v", got, expected)
+	}
+}
+
 func TestGCWithUnusedLayerLinkPath(t *testing.T) {
 	ctx := dcontext.Background()
 	d := inmemory.New()
@@ -581,6 +842,54 @@ func TestDeletionHasEffect(t *testing.T) {
 	}
 }
 
+func TestDeletionHasEffectParallel(t *testing.T) {
+	ctx := dcontext.Background()
+	inmemoryDriver := inmemory.New()
+
+	registry := createRegistry(t, inmemoryDriver, WalkParallelism(4))
+	var kept, deleted []image
+	for _, name := range []string{"komnenos", "doukas", "angelos/alexios", "angelos/isaac"} {
+		repo := makeRepository(t, registry, name)
+		manifests, _ := repo.Manifests(ctx)
+
+		kept = append(kept, uploadRandomSchema2Image(t, repo))
+		image := uploadRandomSchema2Image(t, repo)
+		if err := manifests.Delete(ctx, image.manifestDigest); err != nil {
+			t.Fatalf("failed deleting manifest digest: %v", err)
+		}
+		deleted = append(deleted, image)
+	}
+
+	// Run GC
+	err := MarkAndSweep(dcontext.Background(), inmemoryDriver, registry, GCOpts{
+		DryRun:         false,
+		RemoveUntagged: false,
+		Quiet:          true,
+	})
+	if err != nil {
+		t.Fatalf("Failed mark and sweep: %v", err)
+	}
+
+	blobs := allBlobs(t, registry)
+	for _, image := range kept {
+		if _, ok := blobs[image.manifestDigest]; !ok {
+			t.Fatalf("manifest is missing: %v", image.manifestDigest)
+		}
+		for layer := range image.layers {
+			if _, ok := blobs[layer]; !ok {
+				t.Fatalf("layer is missing: %v", layer)
+			}
+		}
+	}
+	for _, image := range deleted {
+		for layer := range image.layers {
+			if _, ok := blobs[layer]; ok {
+				t.Fatalf("layer of deleted manifest is present: %v", layer)
+			}
+		}
+	}
+}
+
 func getAnyKey(digests map[digest.Digest]io.ReadSeeker) (d digest.Digest) {
 	for d = range digests {
 		break
@@ -922,3 +1231,138 @@ func TestTaggedManifestlistWithDeletedReference(t *testing.T) {
 		t.Fatalf("Garbage collection affected storage: %d != %d", len(after), 0)
 	}
 }
+
+var updateGolden = flag.Bool("update", false, "update the golden files in testdata")
+
+// uploadGoldenImage uploads an image with layers of the given contents, so
+// that its digests do not change between runs.
+func uploadGoldenImage(t *testing.T, repository distribution.Repository, contents ...string) digest.Digest {
+	layers := make(map[digest.Digest]io.ReadSeeker)
+	digests := make([]digest.Digest, 0, len(contents))
+	for _, content := range contents {
+		dgst := digest.FromString(content)
+		layers[dgst] = strings.NewReader(content)
+		digests = append(digests, dgst)
+	}
+	manifest, err := testutil.MakeSchema2Manifest(repository, digests)
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	return uploadImage(t, repository, image{manifest: manifest, layers: layers})
+}
+
+func checkGoldenReport(t *testing.T, name string, report *GCReport) {
+	p, err := json.MarshalIndent(report, "", "  ")
+	if err != nil {
+		t.Fatal(err)
+	}
+	golden := filepath.Join("testdata", name)
+	if *updateGolden {
+		if err := os.WriteFile(golden, p, 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	expected, err := os.ReadFile(golden)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(p, expected) {
+		t.Fatalf("report differs from %s:\n%s", golden, p)
+	}
+}
+
+func TestGCReport(t *testing.T) {
+	ctx := dcontext.Background()
+	inmemoryDriver := inmemory.New()
+	registry := createRegistry(t, inmemoryDriver)
+
+	tagged := makeRepository(t, registry, "fixture/tagged")
+	taggedDigest := uploadGoldenImage(t, tagged, "shared layer", "tagged layer")
+	if err := tagged.Tags(ctx).Tag(ctx, "latest", v1.Descriptor{Digest: taggedDigest}); err != nil {
+		t.Fatalf("failed to tag manifest: %v", err)
+	}
+
+	untagged := makeRepository(t, registry, "fixture/untagged")
+	uploadGoldenImage(t, untagged, "shared layer", "untagged layer")
+	newDigest := uploadGoldenImage(t, untagged, "shared layer", "new layer")
+	if err := untagged.Tags(ctx).Tag(ctx, "latest", v1.Descriptor{Digest: newDigest}); err != nil {
+		t.Fatalf("failed to tag manifest: %v", err)
+	}
+	if err := testutil.UploadBlobs(untagged, map[digest.Digest]io.ReadSeeker{
+		digest.FromString("orphan layer"): strings.NewReader("orphan layer"),
+	}); err != nil {
+		t.Fatalf("layer upload failed: %v", err)
+	}
+
+	opts := GCOpts{DryRun: true, RemoveUntagged: true, Quiet: true}
+	report, err := GarbageCollect(ctx, inmemoryDriver, registry, opts)
+	if err != nil {
+		t.Fatalf("Failed mark and sweep: %v", err)
+	}
+	checkGoldenReport(t, "gc-dry-run.json", report)
+
+	opts.DryRun = false
+	deleted, err := GarbageCollect(ctx, inmemoryDriver, registry, opts)
+	if err != nil {
+		t.Fatalf("Failed mark and sweep: %v", err)
+	}
+	checkGoldenReport(t, "gc.json", deleted)
+	for _, blob := range deleted.Blobs {
+		if _, ok := allBlobs(t, registry)[blob.Digest]; ok {
+			t.Fatalf("reported blob %s was not deleted", blob.Digest)
+		}
+	}
+
+	// Nothing is left to delete.
+	report, err = GarbageCollect(ctx, inmemoryDriver, registry, opts)
+	if err != nil {
+		t.Fatalf("Failed mark and sweep: %v", err)
+	}
+	if len(report.Blobs) != 0 || report.ReclaimableBytes != 0 || report.Retained != deleted.Retained {
+		t.Fatalf("unexpected report after garbage collection: %+v", report)
+	}
+}
+
+func TestGCSummary(t *testing.T) {
+	report := newGCReport(false, nil)
+	shared := GCBlob{Digest: digest.FromString("shared"), Size: 100}
+	report.Blobs = append(report.Blobs, shared)
+	report.ReclaimableBytes = shared.Size
+	for i := range gcSummaryRepositories + 5 {
+		r := report.repository(fmt.Sprintf("repo/%02d", i))
+		blob := GCBlob{Digest: digest.FromString(fmt.Sprintf("layer %d", i)), Size: int64(i + 1)}
+		r.Blobs = append(r.Blobs, blob)
+		report.Blobs = append(report.Blobs, blob)
+		report.ReclaimableBytes += blob.Size
+	}
+	// The manifest of the first repository is linked as a layer too, and
+	// the blob shared by two repositories is counted in each of them.
+	first := &report.Repositories[0]
+	first.Manifests = append(first.Manifests, GCManifest{Digest: first.Blobs[0].Digest, Size: first.Blobs[0].Size})
+	first.Blobs = append(first.Blobs, shared)
+	report.Repositories[1].Blobs = append(report.Repositories[1].Blobs, shared)
+	// A layer link whose blob is kept is not counted.
+	report.Repositories[2].Blobs = append(report.Repositories[2].Blobs, GCBlob{Digest: digest.FromString("kept"), Size: 1000})
+	report.repository("repo/untouched")
+
+	summary := report.summarize()
+	if summary.Estimated || summary.ReclaimedBytes != 100+25*26/2 || summary.Blobs != gcSummaryRepositories+6 || summary.Manifests != 1 || summary.Layers != gcSummaryRepositories+8 {
+		t.Fatalf("unexpected summary %+v", summary)
+	}
+	if len(summary.Repositories) != gcSummaryRepositories {
+		t.Fatalf("%d repositories listed, expected %d", len(summary.Repositories), gcSummaryRepositories)
+	}
+	expected := []GCRepositorySummary{
+		{Name: "repo/01", ReclaimedBytes: 102, Layers: 2},
+		{Name: "repo/00", ReclaimedBytes: 101, Manifests: 1, Layers: 2},
+		{Name: "repo/24", ReclaimedBytes: 25, Layers: 1},
+	}
+	for i, r := range expected {
+		if summary.Repositories[i] != r {
+			t.Fatalf("repository %d is %+v, expected %+v", i, summary.Repositories[i], r)
+		}
+	}
+	if last := summary.Repositories[gcSummaryRepositories-1]; last.Name != "repo/07" {
+		t.Fatalf("unexpected last repository %+v", last)
+	}
+}
@@ -0,0 +1,317 @@
+package storage
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"reflect"
+	"time"
+
+	"github.com/distribution/distribution/v3/registry/storage/driver"
+	"github.com/opencontainers/go-digest"
+)
+
+const (
+	// gcCheckpointVersion is the version of the format of the checkpoints,
+	// which a garbage collection only resumes from if it has the same.
+	gcCheckpointVersion = 1
+
+	defaultCheckpointInterval = time.Minute
+)
+
+// GCCheckpointOpts configures the checkpoints of a garbage collection, from
+// which it resumes if it is interrupted.
+//
+// The mark set is saved once the mark of a repository completes, at most once
+// per Interval, and the garbage collection resumes with the repositories it
+// did not mark yet. Once the mark phase completes, the objects to delete are
+// saved, and each deletion is then recorded, so that the garbage collection
+// resumes with the objects it did not delete yet.
+type GCCheckpointOpts struct {
+	// Path is the file the checkpoints are saved to. It is removed once the
+	// garbage collection completes.
+	Path string
+	// Resume resumes the garbage collection from the checkpoint saved to
+	// Path, if any, rather than starting over.
+	Resume bool
+	// MaxAge is the age, from the start of its garbage collection, beyond
+	// which a checkpoint is refused, unlimited if zero.
+	MaxAge time.Duration
+	// Interval is the minimum time between two checkpoints of the mark
+	// phase, one minute if zero.
+	Interval time.Duration
+}
+
+// gcState is the state of a garbage collection saved to its checkpoints.
+type gcState struct {
+	Version   int            `json:"version"`
+	StartedAt time.Time      `json:"startedAt"`
+	Options   gcStateOptions `json:"options"`
+	// Marked lists the repositories marked.
+	Marked         []string                   `json:"marked"`
+	MarkSet        map[digest.Digest]struct{} `json:"markSet"`
+	Manifests      []ManifestDel              `json:"manifests"`
+	Layers         map[string][]digest.Digest `json:"layers"`
+	ManifestCounts map[string]int             `json:"manifestCounts"`
+	LayerCounts    map[string]int             `json:"layerCounts"`
+	Tags           map[string][]GCTag         `json:"tags"`
+	// Report lists the objects to delete, once the mark phase completes.
+	Report *GCReport `json:"report,omitempty"`
+}
+
+// gcStateOptions are the options a garbage collection only resumes with if
+// they are unchanged.
+type gcStateOptions struct {
+	DryRun            bool              `json:"dryRun"`
+	RemoveUntagged    bool              `json:"removeUntagged"`
+	UntaggedOlderThan time.Duration     `json:"untaggedOlderThan"`
+	Retention         *RetentionPolicy  `json:"retention,omitempty"`
+	Repositories      *RepositoryFilter `json:"repositories,omitempty"`
+	Online            bool              `json:"online"`
+	// CutOff is the cut-off of an online garbage collection, which it keeps
+	// when it is resumed.
+	CutOff time.Time `json:"cutOff,omitzero"`
+}
+
+// sweptObject records the deletion of an object of the sweep, by its index in
+// the order of deletion.
+type sweptObject struct {
+	Object int  `json:"object"`
+	Spared bool `json:"spared,omitempty"`
+}
+
+func newGCState(opts GCOpts, now time.Time) *gcState {
+	options := gcStateOptions{
+		DryRun:            opts.DryRun,
+		RemoveUntagged:    opts.RemoveUntagged,
+		UntaggedOlderThan: opts.UntaggedOlderThan,
+		Retention:         opts.Retention,
+		Repositories:      opts.Repositories,
+		Online:            opts.Online != nil,
+	}
+	if opts.Online != nil {
+		options.CutOff = opts.Online.CutOff
+	}
+	return &gcState{
+		Version:        gcCheckpointVersion,
+		StartedAt:      now,
+		Options:        options,
+		MarkSet:        make(map[digest.Digest]struct{}),
+		Manifests:      make([]ManifestDel, 0),
+		Layers:         make(map[string][]digest.Digest),
+		ManifestCounts: make(map[string]int),
+		LayerCounts:    make(map[string]int),
+		Tags:           make(map[string][]GCTag),
+	}
+}
+
+// checkpointer saves the state of a garbage collection to a file: the state
+// on the first line, followed by a line per object swept, in the order the
+// objects were deleted in.
+type checkpointer struct {
+	opts  *GCCheckpointOpts
+	state *gcState
+	saved time.Time
+	// resumedSweep is whether the garbage collection resumed from a
+	// checkpoint of the sweep, which recorded the objects of swept, and
+	// whether they were spared. object is the next object of the sweep.
+	resumedSweep bool
+	swept        map[int]bool
+	object       int
+	log          *os.File
+	// err is the first error recording an object swept.
+	err error
+}
+
+// newCheckpointer returns the checkpointer of a garbage collection, which
+// resumes from the state it returns if opts.Resume is set and a checkpoint was
+// saved. It returns a nil checkpointer, saving no checkpoint, if opts is nil.
+func newCheckpointer(opts *GCCheckpointOpts, gcOpts GCOpts, now time.Time) (*checkpointer, *gcState, error) {
+	state := newGCState(gcOpts, now)
+	if opts == nil {
+		return nil, state, nil
+	}
+	c := &checkpointer{opts: opts, state: state, swept: make(map[int]bool)}
+	if !opts.Resume {
+		if err := os.Remove(opts.Path); err != nil && !errors.Is(err, fs.ErrNotExist) {
+			return nil, nil, fmt.Errorf("failed to remove checkpoint: %v", err)
+		}
+		return c, state, nil
+	}
+
+	f, err := os.Open(opts.Path)
+	if err != nil {
+		if errors.Is(err, fs.ErrNotExist) {
+			return c, state, nil
+		}
+		return nil, nil, fmt.Errorf("failed to open checkpoint: %v", err)
+	}
+	defer f.Close()
+	dec := json.NewDecoder(bufio.NewReader(f))
+	var saved gcState
+	if err := dec.Decode(&saved); err != nil {
+		return nil, nil, fmt.Errorf("failed to read checkpoint %s: %v", opts.Path, err)
+	}
+	if saved.Version != gcCheckpointVersion {
+		return nil, nil, fmt.Errorf("checkpoint %s has version %d, expected %d", opts.Path, saved.Version, gcCheckpointVersion)
+	}
+	if opts.MaxAge > 0 && now.Sub(saved.StartedAt) > opts.MaxAge {
+		return nil, nil, fmt.Errorf("checkpoint %s of a garbage collection started at %v is older than %v", opts.Path, saved.StartedAt, opts.MaxAge)
+	}
+	resumed := saved.Options
+	resumed.CutOff = state.Options.CutOff
+	if !reflect.DeepEqual(resumed, state.Options) {
+		return nil, nil, fmt.Errorf("checkpoint %s was saved with other options", opts.Path)
+	}
+	for {
+		var object sweptObject
+		if err := dec.Decode(&object); err != nil {
+			if err == io.EOF {
+				break
+			}
+			// The last line is incomplete if the garbage collection was
+			// interrupted while it was written.
+			if errors.Is(err, io.ErrUnexpectedEOF) {
+				break
+			}
+			return nil, nil, fmt.Errorf("failed to read checkpoint %s: %v", opts.Path, err)
+		}
+		c.swept[object.Object] = object.Spared
+	}
+	c.state = &saved
+	c.resumedSweep = saved.Report != nil
+	return c, &saved, nil
+}
+
+// mark saves the state of the mark phase, if the interval since the last
+// checkpoint elapsed.
+func (c *checkpointer) mark(now time.Time) error {
+	if c == nil {
+		return nil
+	}
+	interval := c.opts.Interval
+	if interval <= 0 {
+		interval = defaultCheckpointInterval
+	}
+	if now.Sub(c.saved) < interval {
+		return nil
+	}
+	return c.save(now)
+}
+
+// save replaces the checkpoint with the state of the garbage collection,
+// without the objects swept.
+func (c *checkpointer) save(now time.Time) error {
+	if c == nil {
+		return nil
+	}
+	// The checkpoint is replaced at once, so that a garbage collection
+	// interrupted while it is written resumes from the previous one.
+	f, err := os.CreateTemp(filepath.Dir(c.opts.Path), filepath.Base(c.opts.Path)+".*")
+	if err != nil {
+		return fmt.Errorf("failed to save checkpoint: %v", err)
+	}
+	w := bufio.NewWriter(f)
+	err = json.NewEncoder(w).Encode(c.state)
+	if err == nil {
+		err = w.Flush()
+	}
+	if err == nil {
+		err = f.Sync()
+	}
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Rename(f.Name(), c.opts.Path)
+	}
+	if err != nil {
+		os.Remove(f.Name())
+		return fmt.Errorf("failed to save checkpoint: %v", err)
+	}
+	c.saved = now
+	return nil
+}
+
+// resumedObjects returns the number of objects of the sweep deleted or spared
+// before the garbage collection resumed.
+func (c *checkpointer) resumedObjects() int {
+	if c == nil {
+		return 0
+	}
+	return len(c.swept)
+}
+
+// next returns the index of the next object of the sweep, and whether the
+// checkpoint the garbage collection resumed from recorded it, in which case
+// it returns whether the object was spared rather than deleted.
+func (c *checkpointer) next() (object int, recorded, spared bool) {
+	if c == nil {
+		return 0, false, false
+	}
+	object = c.object
+	c.object++
+	spared, recorded = c.swept[object]
+	return object, recorded, spared
+}
+
+// record records that object was deleted, or spared, unless deleting it
+// failed with err, which it returns. It must not be called concurrently.
+func (c *checkpointer) record(object int, spared bool, err error) error {
+	if c == nil {
+		return err
+	}
+	if err != nil {
+		// The objects the garbage collection was deleting when it was
+		// interrupted may have been deleted without being recorded.
+		if _, ok := err.(driver.PathNotFoundError); !ok || !c.resumedSweep {
+			return err
+		}
+	}
+	if c.err != nil {
+		return nil
+	}
+	if c.log == nil {
+		c.log, c.err = os.OpenFile(c.opts.Path, os.O_WRONLY|os.O_APPEND, 0)
+		if c.err != nil {
+			c.err = fmt.Errorf("failed to open checkpoint: %v", c.err)
+			return nil
+		}
+	}
+	p, err := json.Marshal(sweptObject{Object: object, Spared: spared})
+	if err == nil {
+		_, err = c.log.Write(append(p, '\n'))
+	}
+	if err != nil {
+		c.err = fmt.Errorf("failed to save checkpoint: %v", err)
+	}
+	return nil
+}
+
+// failed returns the error which prevented an object swept from being
+// recorded, which stops the sweep.
+func (c *checkpointer) failed() error {
+	if c == nil {
+		return nil
+	}
+	return c.err
+}
+
+// done removes the checkpoint of the garbage collection once it completes.
+func (c *checkpointer) done() error {
+	if c == nil {
+		return nil
+	}
+	if c.log != nil {
+		c.log.Close()
+	}
+	if err := os.Remove(c.opts.Path); err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return fmt.Errorf("failed to remove checkpoint: %v", err)
+	}
+	return nil
+}
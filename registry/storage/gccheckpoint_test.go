@@ -0,0 +1,297 @@
+package storage
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/distribution/distribution/v3/internal/dcontext"
+	storagedriver "github.com/distribution/distribution/v3/registry/storage/driver"
+	"github.com/distribution/distribution/v3/registry/storage/driver/inmemory"
+	"github.com/distribution/distribution/v3/testutil"
+	"github.com/opencontainers/go-digest"
+	v1 "github.com/opencontainers/image-spec/specs-go/v1"
+)
+
+var errKilled = errors.New("killed")
+
+// killDriver records the paths deleted, and interrupts the garbage collection
+// once kill returns true for an operation on a path: a deletion cancels its
+// context, as a signal does, and a walk fails.
+type killDriver struct {
+	storagedriver.StorageDriver
+	deleted []string
+	kill    func(op, path string) bool
+	cancel  context.CancelFunc
+}
+
+func (d *killDriver) Delete(ctx context.Context, path string) error {
+	if d.kill != nil && d.kill("delete", path) {
+		d.cancel()
+		return ctx.Err()
+	}
+	if err := d.StorageDriver.Delete(ctx, path); err != nil {
+		return err
+	}
+	d.deleted = append(d.deleted, path)
+	return nil
+}
+
+func (d *killDriver) Walk(ctx context.Context, path string, f storagedriver.WalkFn, options ...func(*storagedriver.WalkOptions)) error {
+	if d.kill != nil && d.kill("walk", path) {
+		return errKilled
+	}
+	return d.StorageDriver.Walk(ctx, path, f, options...)
+}
+
+// gcFixture returns a snapshot of a storage with repositories holding
+// untagged manifests and unreferenced layers.
+func gcFixture(t *testing.T) []byte {
+	ctx := dcontext.Background()
+	d := inmemory.New()
+	registry := createRegistry(t, d)
+	for _, name := range []string{"resume/a", "resume/b", "resume/c"} {
+		repo := makeRepository(t, registry, name)
+		taggedDigest := uploadGoldenImage(t, repo, name+" base layer", name+" tagged layer")
+		if err := repo.Tags(ctx).Tag(ctx, "latest", v1.Descriptor{Digest: taggedDigest}); err != nil {
+			t.Fatalf("failed to tag manifest: %v", err)
+		}
+		for i := range 3 {
+			uploadGoldenImage(t, repo, name+" base layer", fmt.Sprintf("%s untagged layer %d", name, i))
+		}
+		orphan := name + " orphan layer"
+		if err := testutil.UploadBlobs(repo, map[digest.Digest]io.ReadSeeker{digest.FromString(orphan): strings.NewReader(orphan)}); err != nil {
+			t.Fatalf("layer upload failed: %v", err)
+		}
+	}
+	snapshot, err := d.Snapshot()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return snapshot
+}
+
+func restoreFixture(t *testing.T, snapshot []byte) *killDriver {
+	d := inmemory.New()
+	if err := d.Restore(snapshot); err != nil {
+		t.Fatal(err)
+	}
+	return &killDriver{StorageDriver: d}
+}
+
+func storedPaths(t *testing.T, d storagedriver.StorageDriver) []string {
+	var paths []string
+	err := d.Walk(dcontext.Background(), "/", func(fi storagedriver.FileInfo) error {
+		if !fi.IsDir() {
+			paths = append(paths, fi.Path())
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	sort.Strings(paths)
+	return paths
+}
+
+func marshalReport(t *testing.T, report *GCReport) []byte {
+	p, err := json.Marshal(report)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return p
+}
+
+// TestGCResumeSweep interrupts a garbage collection in the middle of its sweep,
+// and checks that it resumes with exactly the objects left to delete.
+func TestGCResumeSweep(t *testing.T) {
+	ctx := dcontext.Background()
+	snapshot := gcFixture(t)
+	opts := GCOpts{RemoveUntagged: true, Quiet: true}
+
+	reference := restoreFixture(t, snapshot)
+	expected, err := GarbageCollect(ctx, reference, createRegistry(t, reference), opts)
+	if err != nil {
+		t.Fatalf("Failed mark and sweep: %v", err)
+	}
+	if len(reference.deleted) < 10 {
+		t.Fatalf("too few objects deleted to interrupt the sweep: %d", len(reference.deleted))
+	}
+
+	statePath := filepath.Join(t.TempDir(), "gc.state")
+	opts.Checkpoint = &GCCheckpointOpts{Path: statePath, Resume: true}
+	d := restoreFixture(t, snapshot)
+	killAt := len(reference.deleted) / 2
+	d.kill = func(op, _ string) bool {
+		return op == "delete" && len(d.deleted) == killAt
+	}
+	killCtx, cancel := context.WithCancel(ctx)
+	d.cancel = cancel
+	if _, err := GarbageCollect(killCtx, d, createRegistry(t, d), opts); !errors.Is(err, context.Canceled) {
+		t.Fatalf("expected the garbage collection to be canceled, got %v", err)
+	}
+	if _, err := os.Stat(statePath); err != nil {
+		t.Fatalf("no checkpoint was saved: %v", err)
+	}
+
+	deletedBeforeKill := d.deleted
+	d = &killDriver{StorageDriver: d.StorageDriver}
+	report, err := GarbageCollect(ctx, d, createRegistry(t, d), opts)
+	if err != nil {
+		t.Fatalf("Failed to resume mark and sweep: %v", err)
+	}
+
+	remaining := reference.deleted[killAt:]
+	if fmt.Sprint(d.deleted) != fmt.Sprint(remaining) {
+		t.Fatalf("resumed garbage collection deleted %v, expected %v", d.deleted, remaining)
+	}
+	if fmt.Sprint(deletedBeforeKill) != fmt.Sprint(reference.deleted[:killAt]) {
+		t.Fatalf("interrupted garbage collection deleted %v, expected %v", deletedBeforeKill, reference.deleted[:killAt])
+	}
+	if fmt.Sprint(storedPaths(t, d)) != fmt.Sprint(storedPaths(t, reference)) {
+		t.Fatal("resumed garbage collection left other paths than an uninterrupted one")
+	}
+	if !bytes.Equal(marshalReport(t, report), marshalReport(t, expected)) {
+		t.Fatalf("report of the resumed garbage collection differs:\n%s\n%s", marshalReport(t, report), marshalReport(t, expected))
+	}
+	if _, err := os.Stat(statePath); !errors.Is(err, os.ErrNotExist) {
+		t.Fatalf("checkpoint was not removed: %v", err)
+	}
+}
+
+// TestGCResumeMark interrupts a garbage collection in the middle of its mark
+// phase, and checks that it resumes with the repositories left to mark.
+func TestGCResumeMark(t *testing.T) {
+	ctx := dcontext.Background()
+	snapshot := gcFixture(t)
+	opts := GCOpts{RemoveUntagged: true, Quiet: true}
+
+	reference := restoreFixture(t, snapshot)
+	expected, err := GarbageCollect(ctx, reference, createRegistry(t, reference), opts)
+	if err != nil {
+		t.Fatalf("Failed mark and sweep: %v", err)
+	}
+
+	statePath := filepath.Join(t.TempDir(), "gc.state")
+	opts.Checkpoint = &GCCheckpointOpts{Path: statePath, Resume: true, Interval: time.Nanosecond}
+	d := restoreFixture(t, snapshot)
+	d.kill = func(op, path string) bool {
+		return op == "walk" && strings.Contains(path, "/repositories/resume/b/_manifests")
+	}
+	if _, err := GarbageCollect(ctx, d, createRegistry(t, d), opts); err == nil {
+		t.Fatal("expected the garbage collection to be killed")
+	}
+	if len(d.deleted) != 0 {
+		t.Fatalf("interrupted mark phase deleted %v", d.deleted)
+	}
+
+	var out bytes.Buffer
+	opts.Quiet = false
+	opts.Output = &out
+	d.kill = nil
+	report, err := GarbageCollect(ctx, d, createRegistry(t, d), opts)
+	if err != nil {
+		t.Fatalf("Failed to resume mark and sweep: %v", err)
+	}
+	if strings.Contains(out.String(), "resume/a: marking") || !strings.Contains(out.String(), "resume/b: marking") {
+		t.Fatalf("resumed garbage collection did not resume with the repositories left to mark:\n%s", out.String())
+	}
+	if fmt.Sprint(storedPaths(t, d)) != fmt.Sprint(storedPaths(t, reference)) {
+		t.Fatal("resumed garbage collection left other paths than an uninterrupted one")
+	}
+	if !bytes.Equal(marshalReport(t, report), marshalReport(t, expected)) {
+		t.Fatalf("report of the resumed garbage collection differs:\n%s\n%s", marshalReport(t, report), marshalReport(t, expected))
+	}
+}
+
+func TestGCResumeRefusesCheckpoint(t *testing.T) {
+	ctx := dcontext.Background()
+	snapshot := gcFixture(t)
+	statePath := filepath.Join(t.TempDir(), "gc.state")
+	opts := GCOpts{RemoveUntagged: true, Quiet: true, Checkpoint: &GCCheckpointOpts{Path: statePath, Resume: true}}
+
+	d := restoreFixture(t, snapshot)
+	d.kill = func(op, _ string) bool { return op == "delete" }
+	killCtx, cancel := context.WithCancel(ctx)
+	d.cancel = cancel
+	if _, err := GarbageCollect(killCtx, d, createRegistry(t, d), opts); !errors.Is(err, context.Canceled) {
+		t.Fatalf("expected the garbage collection to be canceled, got %v", err)
+	}
+	saved, err := os.ReadFile(statePath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	d.kill = nil
+
+	stale := opts
+	stale.Checkpoint = &GCCheckpointOpts{Path: statePath, Resume: true, MaxAge: time.Nanosecond}
+	if _, err := GarbageCollect(ctx, d, createRegistry(t, d), stale); err == nil || !strings.Contains(err.Error(), "older than") {
+		t.Fatalf("expected a stale checkpoint to be refused, got %v", err)
+	}
+
+	other := opts
+	other.RemoveUntagged = false
+	if _, err := GarbageCollect(ctx, d, createRegistry(t, d), other); err == nil || !strings.Contains(err.Error(), "other options") {
+		t.Fatalf("expected a checkpoint saved with other options to be refused, got %v", err)
+	}
+
+	var state map[string]any
+	line, _, _ := bytes.Cut(saved, []byte("\n"))
+	if err := json.Unmarshal(line, &state); err != nil {
+		t.Fatal(err)
+	}
+	state["version"] = gcCheckpointVersion + 1
+	p, err := json.Marshal(state)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(statePath, p, 0o644); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := GarbageCollect(ctx, d, createRegistry(t, d), opts); err == nil || !strings.Contains(err.Error(), "version") {
+		t.Fatalf("expected a checkpoint of another version to be refused, got %v", err)
+	}
+	if len(d.deleted) != 0 {
+		t.Fatalf("refused checkpoints deleted %v", d.deleted)
+	}
+
+	// Without resuming, the garbage collection starts over.
+	fresh := opts
+	fresh.Checkpoint = &GCCheckpointOpts{Path: statePath}
+	if _, err := GarbageCollect(ctx, d, createRegistry(t, d), fresh); err != nil {
+		t.Fatalf("Failed mark and sweep: %v", err)
+	}
+}
+
+func TestGCProgress(t *testing.T) {
+	ctx := dcontext.Background()
+	d := restoreFixture(t, gcFixture(t))
+	var out bytes.Buffer
+	_, err := GarbageCollect(ctx, d, createRegistry(t, d), GCOpts{
+		RemoveUntagged:   true,
+		Output:           &out,
+		ProgressInterval: time.Nanosecond,
+	})
+	if err != nil {
+		t.Fatalf("Failed mark and sweep: %v", err)
+	}
+	for _, progress := range []string{
+		"progress: mark: repositories 3/3, ",
+		"progress: sweep: objects ",
+		" blobs deleted, ",
+		" bytes reclaimed, ETA ",
+	} {
+		if !strings.Contains(out.String(), progress) {
+			t.Fatalf("output does not contain %q:\n%s", progress, out.String())
+		}
+	}
+}
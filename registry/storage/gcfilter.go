@@ -0,0 +1,52 @@
+package storage
+
+import (
+	"fmt"
+	"path"
+)
+
+// RepositoryFilter selects the repositories a garbage collection deletes
+// from. The repositories it excludes are still marked, so that the blobs they
+// reference or link are kept, but none of their tags, manifests or layer links
+// is deleted.
+type RepositoryFilter struct {
+	// Include lists the patterns of the repositories included, using the
+	// syntax of path.Match. All the repositories are included if it is
+	// empty.
+	Include []string
+	// Exclude lists the patterns of the repositories excluded, even if
+	// Include matches them.
+	Exclude []string
+}
+
+// Validate returns an error if a pattern of the filter is malformed.
+func (f *RepositoryFilter) Validate() error {
+	for _, pattern := range append(append([]string(nil), f.Include...), f.Exclude...) {
+		if _, err := path.Match(pattern, ""); err != nil {
+			return fmt.Errorf("invalid repository pattern %q: %v", pattern, err)
+		}
+	}
+	return nil
+}
+
+// match returns whether the repository name is included, along with the rule
+// which included or excluded it, empty if the filter is nil.
+func (f *RepositoryFilter) match(name string) (bool, string) {
+	if f == nil {
+		return true, ""
+	}
+	for _, pattern := range f.Exclude {
+		if ok, _ := path.Match(pattern, name); ok {
+			return false, fmt.Sprintf("excluded by pattern %q", pattern)
+		}
+	}
+	if len(f.Include) == 0 {
+		return true, "included, matching no excluded pattern"
+	}
+	for _, pattern := range f.Include {
+		if ok, _ := path.Match(pattern, name); ok {
+			return true, fmt.Sprintf("included by pattern %q", pattern)
+		}
+	}
+	return false, "excluded, matching no included pattern"
+}
@@ -0,0 +1,56 @@
+package storage
+
+import (
+	"time"
+)
+
+// gcProgress prints the progress of a phase of a garbage collection, at most
+// once per interval.
+type gcProgress struct {
+	opts  GCOpts
+	phase string
+	total int
+	// done is the number of objects of the phase processed, the first
+	// resumed of which were processed before the garbage collection resumed.
+	done    int
+	resumed int
+	started time.Time
+	printed time.Time
+}
+
+func newGCProgress(opts GCOpts, phase string, total, resumed int, now time.Time) *gcProgress {
+	return &gcProgress{
+		opts:    opts,
+		phase:   phase,
+		total:   total,
+		resumed: resumed,
+		started: now,
+		printed: now,
+	}
+}
+
+// step records that an object of the phase was processed, and prints the
+// progress along with details if the interval since it was last printed
+// elapsed.
+func (p *gcProgress) step(details func() string) {
+	p.done++
+	if p.opts.ProgressInterval <= 0 {
+		return
+	}
+	now := time.Now()
+	if now.Sub(p.printed) < p.opts.ProgressInterval {
+		return
+	}
+	p.printed = now
+	p.opts.emit("progress: %s %d/%d, %s, ETA %s", p.phase, p.done, p.total, details(), p.eta(now))
+}
+
+// eta estimates the time left from the rate at which the objects were
+// processed since the garbage collection started or resumed.
+func (p *gcProgress) eta(now time.Time) string {
+	if p.done <= p.resumed || p.done > p.total {
+		return "unknown"
+	}
+	perObject := now.Sub(p.started) / time.Duration(p.done-p.resumed)
+	return (perObject * time.Duration(p.total-p.done)).Round(time.Second).String()
+}
@@ -0,0 +1,272 @@
+package storage
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sort"
+	"time"
+
+	"github.com/distribution/distribution/v3"
+	"github.com/opencontainers/go-digest"
+)
+
+// GCReport summarizes a garbage collection: the objects it deleted, or would
+// delete with a dry run, and the number of objects it retained.
+type GCReport struct {
+	DryRun bool `json:"dryRun"`
+	// Repositories lists the repositories garbage collected, by name.
+	Repositories []GCRepositoryReport `json:"repositories"`
+	// Blobs lists the blobs deleted from the storage, by digest.
+	Blobs []GCBlob `json:"blobs"`
+	// ReclaimableBytes is the total size of Blobs.
+	ReclaimableBytes int64     `json:"reclaimableBytes"`
+	Retained         GCObjects `json:"retained"`
+	// Failed lists the objects which failed to be deleted, counted as
+	// retained, which a later garbage collection deletes again.
+	Failed []GCFailure `json:"failed,omitempty"`
+	// Summary totals the objects deleted and the bytes reclaimed.
+	Summary GCSummary `json:"summary"`
+}
+
+// gcSummaryRepositories is the number of repositories listed by the summary of
+// a garbage collection.
+const gcSummaryRepositories = 20
+
+// GCSummary totals the objects a garbage collection deleted, or would delete
+// with a dry run, in which case the bytes reclaimed are estimated.
+type GCSummary struct {
+	Estimated bool `json:"estimated"`
+	// ReclaimedBytes is the total size of the blobs deleted from the storage,
+	// not counting those which failed to be deleted.
+	ReclaimedBytes int64 `json:"reclaimedBytes"`
+	Tags           int   `json:"tags"`
+	Manifests      int   `json:"manifests"`
+	Layers         int   `json:"layers"`
+	Blobs          int   `json:"blobs"`
+	// Repositories lists the repositories the most bytes were reclaimed
+	// from, at most 20, in decreasing order of bytes reclaimed.
+	Repositories []GCRepositorySummary `json:"repositories"`
+}
+
+// GCRepositorySummary totals the objects deleted from a repository. The bytes
+// reclaimed from the repository are the size of the blobs deleted from the
+// storage which its deleted manifests and layer links referenced, so that a
+// blob shared by several repositories is counted in each of them.
+type GCRepositorySummary struct {
+	Name           string `json:"name"`
+	ReclaimedBytes int64  `json:"reclaimedBytes"`
+	Tags           int    `json:"tags"`
+	Manifests      int    `json:"manifests"`
+	Layers         int    `json:"layers"`
+}
+
+// GCRepositoryReport lists the manifests and the layer links deleted from a
+// repository, by digest.
+type GCRepositoryReport struct {
+	Name      string       `json:"name"`
+	Manifests []GCManifest `json:"manifests"`
+	// Blobs lists the blobs unlinked from the repository, which are only
+	// deleted from the storage if no other repository references them.
+	Blobs []GCBlob `json:"blobs"`
+	// Tags lists the tags deleted by the retention policy, by name.
+	Tags     []GCTag   `json:"tags"`
+	Retained GCObjects `json:"retained"`
+}
+
+// GCManifest is a manifest deleted from a repository.
+type GCManifest struct {
+	Digest digest.Digest `json:"digest"`
+	Size   int64         `json:"size"`
+	// Tags lists the tags of the repository, whose history the manifest is
+	// removed from.
+	Tags []string `json:"tags,omitempty"`
+	// LinkedAt is when the manifest was linked to the repository, if the
+	// age of the manifests was checked.
+	LinkedAt time.Time `json:"linkedAt,omitzero"`
+	// Subject is the manifest the manifest refers to, whose referrers it is
+	// removed from.
+	Subject digest.Digest `json:"subject,omitempty"`
+}
+
+// GCTag is a tag deleted by a rule of the retention policy, named after the
+// pattern of its repositories or "default".
+type GCTag struct {
+	Name     string        `json:"name"`
+	Digest   digest.Digest `json:"digest"`
+	PushedAt time.Time     `json:"pushedAt"`
+	// PulledAt is the last pull of the tag, if the rule keeps the tags
+	// pulled recently and it was pulled.
+	PulledAt time.Time `json:"pulledAt,omitzero"`
+	Rule     string    `json:"rule"`
+}
+
+// GCFailure is an object which failed to be deleted: a tag, a manifest or a
+// layer link of a repository, or a blob.
+type GCFailure struct {
+	Repository string        `json:"repository,omitempty"`
+	Kind       string        `json:"kind"`
+	Tag        string        `json:"tag,omitempty"`
+	Digest     digest.Digest `json:"digest"`
+	Error      string        `json:"error"`
+}
+
+func (f GCFailure) String() string {
+	switch {
+	case f.Tag != "":
+		return fmt.Sprintf("tag %s of repo %s", f.Tag, f.Repository)
+	case f.Repository != "":
+		return fmt.Sprintf("%s %s of repo %s", f.Kind, f.Digest, f.Repository)
+	default:
+		return fmt.Sprintf("%s %s", f.Kind, f.Digest)
+	}
+}
+
+// GCBlob is a blob deleted from the storage or from a repository.
+type GCBlob struct {
+	Digest digest.Digest `json:"digest"`
+	Size   int64         `json:"size"`
+}
+
+// GCObjects counts manifests and blobs.
+type GCObjects struct {
+	Manifests int `json:"manifests"`
+	Blobs     int `json:"blobs"`
+}
+
+func newGCReport(dryRun bool, repositories []string) *GCReport {
+	report := &GCReport{
+		DryRun:       dryRun,
+		Repositories: make([]GCRepositoryReport, 0, len(repositories)),
+		Blobs:        []GCBlob{},
+	}
+	for _, name := range repositories {
+		report.Repositories = append(report.Repositories, GCRepositoryReport{
+			Name:      name,
+			Manifests: []GCManifest{},
+			Blobs:     []GCBlob{},
+			Tags:      []GCTag{},
+		})
+	}
+	return report
+}
+
+// repository returns the report of the repository name, which is added to the
+// report if it was not garbage collected.
+func (r *GCReport) repository(name string) *GCRepositoryReport {
+	for i := range r.Repositories {
+		if r.Repositories[i].Name == name {
+			return &r.Repositories[i]
+		}
+	}
+	r.Repositories = append(r.Repositories, GCRepositoryReport{Name: name, Manifests: []GCManifest{}, Blobs: []GCBlob{}, Tags: []GCTag{}})
+	return &r.Repositories[len(r.Repositories)-1]
+}
+
+// sort orders the report, so that it does not depend on the order in which
+// the storage was walked.
+func (r *GCReport) sort() {
+	sort.Slice(r.Repositories, func(i, j int) bool {
+		return r.Repositories[i].Name < r.Repositories[j].Name
+	})
+	for _, repository := range r.Repositories {
+		sort.Slice(repository.Manifests, func(i, j int) bool {
+			return repository.Manifests[i].Digest < repository.Manifests[j].Digest
+		})
+		sortBlobs(repository.Blobs)
+		sort.Slice(repository.Tags, func(i, j int) bool {
+			return repository.Tags[i].Name < repository.Tags[j].Name
+		})
+	}
+	sortBlobs(r.Blobs)
+}
+
+// summarize totals the objects of the report, which only lists the objects
+// deleted once swept.
+func (r *GCReport) summarize() GCSummary {
+	summary := GCSummary{
+		Estimated:      r.DryRun,
+		ReclaimedBytes: r.ReclaimableBytes,
+		Blobs:          len(r.Blobs),
+		Repositories:   []GCRepositorySummary{},
+	}
+	deleted := make(map[digest.Digest]int64, len(r.Blobs))
+	for _, blob := range r.Blobs {
+		deleted[blob.Digest] = blob.Size
+	}
+	for _, repository := range r.Repositories {
+		if len(repository.Tags) == 0 && len(repository.Manifests) == 0 && len(repository.Blobs) == 0 {
+			continue
+		}
+		s := GCRepositorySummary{
+			Name:      repository.Name,
+			Tags:      len(repository.Tags),
+			Manifests: len(repository.Manifests),
+			Layers:    len(repository.Blobs),
+		}
+		// A manifest may be linked as a layer too.
+		counted := make(map[digest.Digest]struct{})
+		reclaim := func(dgst digest.Digest) {
+			size, ok := deleted[dgst]
+			if _, seen := counted[dgst]; ok && !seen {
+				counted[dgst] = struct{}{}
+				s.ReclaimedBytes += size
+			}
+		}
+		for _, m := range repository.Manifests {
+			reclaim(m.Digest)
+		}
+		for _, blob := range repository.Blobs {
+			reclaim(blob.Digest)
+		}
+		summary.Tags += s.Tags
+		summary.Manifests += s.Manifests
+		summary.Layers += s.Layers
+		summary.Repositories = append(summary.Repositories, s)
+	}
+	sort.SliceStable(summary.Repositories, func(i, j int) bool {
+		return summary.Repositories[i].ReclaimedBytes > summary.Repositories[j].ReclaimedBytes
+	})
+	if len(summary.Repositories) > gcSummaryRepositories {
+		summary.Repositories = summary.Repositories[:gcSummaryRepositories]
+	}
+	return summary
+}
+
+// emitSummary prints the summary of a garbage collection.
+func (opts GCOpts) emitSummary(s GCSummary) {
+	if s.Estimated {
+		opts.emit("\nestimated %d bytes reclaimable: %d tags, %d manifests, %d layer links and %d blobs eligible for deletion", s.ReclaimedBytes, s.Tags, s.Manifests, s.Layers, s.Blobs)
+	} else {
+		opts.emit("\n%d bytes reclaimed: %d tags, %d manifests, %d layer links and %d blobs deleted", s.ReclaimedBytes, s.Tags, s.Manifests, s.Layers, s.Blobs)
+	}
+	for _, r := range s.Repositories {
+		opts.emit("%s: %d bytes, %d tags, %d manifests and %d layer links", r.Name, r.ReclaimedBytes, r.Tags, r.Manifests, r.Layers)
+	}
+}
+
+func sortBlobs(blobs []GCBlob) {
+	sort.Slice(blobs, func(i, j int) bool {
+		return blobs[i].Digest < blobs[j].Digest
+	})
+}
+
+// blobSizes caches the sizes of the blobs reported.
+type blobSizes struct {
+	statter distribution.BlobStatter
+	sizes   map[digest.Digest]int64
+}
+
+// size returns the size of the blob dgst, or 0 if it is missing from the
+// storage.
+func (b blobSizes) size(ctx context.Context, dgst digest.Digest) (int64, error) {
+	if size, ok := b.sizes[dgst]; ok {
+		return size, nil
+	}
+	desc, err := b.statter.Stat(ctx, dgst)
+	if err != nil && !errors.Is(err, distribution.ErrBlobUnknown) {
+		return 0, fmt.Errorf("failed to stat blob %s: %v", dgst, err)
+	}
+	b.sizes[dgst] = desc.Size
+	return desc.Size, nil
+}
@@ -0,0 +1,174 @@
+package storage
+
+import (
+	"context"
+	"fmt"
+	"sync"
+
+	"github.com/opencontainers/go-digest"
+)
+
+// blobDeleteBatchSize is the number of blobs deleted in a batch by the drivers
+// deleting files in batches, the largest number of objects S3 deletes in a
+// request.
+const blobDeleteBatchSize = 1000
+
+// sweepObject is an object deleted by the sweep.
+type sweepObject struct {
+	// digest and path are checked by the sweeper right before the object is
+	// deleted.
+	digest digest.Digest
+	path   string
+	// blob is set for the blobs deleted from the storage, of size bytes.
+	blob   bool
+	size   int64
+	remove func() error
+}
+
+// sweepOutcome is whether an object of the sweep was spared rather than
+// deleted, or the error deleting it.
+type sweepOutcome struct {
+	spared bool
+	err    error
+}
+
+// gcSweep deletes the objects of the sweep, up to parallelism at a time.
+type gcSweep struct {
+	ctx        context.Context
+	sweeper    *sweeper
+	checkpoint *checkpointer
+	progress   *gcProgress
+	sem        chan struct{}
+	wg         sync.WaitGroup
+	// mu guards the checkpoint, the progress and the counts of the blobs
+	// deleted, updated as the deletions complete.
+	mu             sync.Mutex
+	blobsDeleted   int
+	bytesReclaimed int64
+}
+
+func newGCSweep(ctx context.Context, sweeper *sweeper, checkpoint *checkpointer, progress *gcProgress, parallelism int) *gcSweep {
+	return &gcSweep{
+		ctx:        ctx,
+		sweeper:    sweeper,
+		checkpoint: checkpoint,
+		progress:   progress,
+		sem:        make(chan struct{}, max(parallelism, 1)),
+	}
+}
+
+// run deletes objects and returns the outcome of each of them once they are
+// all deleted. If removeBatch is not nil, the objects are deleted in batches
+// by removeBatch, which returns the error deleting each of the objects of a
+// batch, by index. It only returns an error if the context is canceled, in
+// which case it stops once the deletions running complete, or if the objects
+// swept could not be recorded to the checkpoint.
+func (s *gcSweep) run(objects []sweepObject, removeBatch func(indexes []int) ([]error, error)) ([]sweepOutcome, error) {
+	outcomes := make([]sweepOutcome, len(objects))
+	var batch, batchObjects []int
+	flush := func() {
+		if len(batch) == 0 {
+			return
+		}
+		indexes, checkpointObjects := batch, batchObjects
+		batch, batchObjects = nil, nil
+		s.sem <- struct{}{}
+		s.wg.Add(1)
+		go func() {
+			defer s.wg.Done()
+			defer func() { <-s.sem }()
+			errs, err := removeBatch(indexes)
+			s.mu.Lock()
+			defer s.mu.Unlock()
+			for j, i := range indexes {
+				deleteErr := err
+				if deleteErr == nil {
+					deleteErr = errs[j]
+				}
+				s.finish(objects[i], &outcomes[i], checkpointObjects[j], false, deleteErr)
+			}
+		}()
+	}
+
+	for i, obj := range objects {
+		s.mu.Lock()
+		err := s.checkpoint.failed()
+		s.mu.Unlock()
+		if err != nil || s.ctx.Err() != nil {
+			break
+		}
+
+		object, recorded, spared := s.checkpoint.next()
+		if recorded {
+			s.mu.Lock()
+			outcomes[i].spared = spared
+			s.count(obj, spared)
+			s.progress.step(s.details)
+			s.mu.Unlock()
+			continue
+		}
+
+		// The object is checked once it can be deleted right away.
+		if removeBatch == nil {
+			s.sem <- struct{}{}
+		}
+		spared, err = s.sweeper.spare(s.ctx, obj.digest, obj.path)
+		if err != nil || spared {
+			s.mu.Lock()
+			s.finish(obj, &outcomes[i], object, spared, err)
+			s.mu.Unlock()
+			if removeBatch == nil {
+				<-s.sem
+			}
+			continue
+		}
+
+		if removeBatch != nil {
+			batch = append(batch, i)
+			batchObjects = append(batchObjects, object)
+			if len(batch) == blobDeleteBatchSize {
+				flush()
+			}
+			continue
+		}
+		s.wg.Add(1)
+		go func() {
+			defer s.wg.Done()
+			defer func() { <-s.sem }()
+			err := obj.remove()
+			s.mu.Lock()
+			defer s.mu.Unlock()
+			s.finish(obj, &outcomes[i], object, false, err)
+		}()
+	}
+	if s.ctx.Err() == nil {
+		flush()
+	}
+	s.wg.Wait()
+	if err := s.ctx.Err(); err != nil {
+		return nil, err
+	}
+	return outcomes, s.checkpoint.failed()
+}
+
+// finish records the outcome of the deletion of obj, the object-th of the
+// sweep. It must be called with mu locked.
+func (s *gcSweep) finish(obj sweepObject, outcome *sweepOutcome, object int, spared bool, err error) {
+	err = s.checkpoint.record(object, spared, err)
+	*outcome = sweepOutcome{spared: spared, err: err}
+	if err == nil {
+		s.count(obj, spared)
+	}
+	s.progress.step(s.details)
+}
+
+func (s *gcSweep) count(obj sweepObject, spared bool) {
+	if obj.blob && !spared {
+		s.blobsDeleted++
+		s.bytesReclaimed += obj.size
+	}
+}
+
+func (s *gcSweep) details() string {
+	return fmt.Sprintf("%d blobs deleted, %d bytes reclaimed", s.blobsDeleted, s.bytesReclaimed)
+}
@@ -0,0 +1,356 @@
+package storage
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"slices"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/distribution/distribution/v3/internal/dcontext"
+	storagedriver "github.com/distribution/distribution/v3/registry/storage/driver"
+	"github.com/distribution/distribution/v3/registry/storage/driver/inmemory"
+	"github.com/distribution/distribution/v3/testutil"
+	"github.com/distribution/reference"
+	"github.com/opencontainers/go-digest"
+	v1 "github.com/opencontainers/image-spec/specs-go/v1"
+)
+
+// countingDriver counts the deletions, and the largest number of deletions
+// running concurrently. The deletions of the paths containing a string of fail
+// fail.
+type countingDriver struct {
+	storagedriver.StorageDriver
+	fail []string
+
+	mu         sync.Mutex
+	deletes    int
+	batches    []int
+	running    atomic.Int32
+	maxRunning int32
+}
+
+func (d *countingDriver) enter() func() {
+	running := d.running.Add(1)
+	d.mu.Lock()
+	d.maxRunning = max(d.maxRunning, running)
+	d.mu.Unlock()
+	// The deletions last long enough to overlap.
+	time.Sleep(2 * time.Millisecond)
+	return func() { d.running.Add(-1) }
+}
+
+func (d *countingDriver) failing(path string) bool {
+	for _, f := range d.fail {
+		if strings.Contains(path, f) {
+			return true
+		}
+	}
+	return false
+}
+
+func (d *countingDriver) Delete(ctx context.Context, path string) error {
+	defer d.enter()()
+	if d.failing(path) {
+		return fmt.Errorf("injected failure deleting %s", path)
+	}
+	d.mu.Lock()
+	d.deletes++
+	d.mu.Unlock()
+	return d.StorageDriver.Delete(ctx, path)
+}
+
+// batchCountingDriver is a countingDriver deleting files in batches.
+type batchCountingDriver struct {
+	*countingDriver
+}
+
+func (d batchCountingDriver) DeleteBatch(ctx context.Context, paths []string) ([]error, error) {
+	if len(paths) == 0 {
+		return nil, nil
+	}
+	defer d.enter()()
+	d.mu.Lock()
+	d.batches = append(d.batches, len(paths))
+	d.mu.Unlock()
+	errs := make([]error, len(paths))
+	for i, path := range paths {
+		if d.failing(path) {
+			errs[i] = fmt.Errorf("injected failure deleting %s", path)
+			continue
+		}
+		if err := d.StorageDriver.Delete(ctx, path); err != nil {
+			if _, ok := err.(storagedriver.PathNotFoundError); !ok {
+				errs[i] = err
+			}
+		}
+	}
+	return errs, nil
+}
+
+const sweepFixtureImages = 24
+
+// sweepFixture returns a snapshot of a storage with a repository holding many
+// untagged images, each with its own layer.
+func sweepFixture(t *testing.T) []byte {
+	ctx := dcontext.Background()
+	d := inmemory.New()
+	registry := createRegistry(t, d)
+	repo := makeRepository(t, registry, "sweep/app")
+	taggedDigest := uploadGoldenImage(t, repo, "base layer", "tagged layer")
+	if err := repo.Tags(ctx).Tag(ctx, "latest", v1.Descriptor{Digest: taggedDigest}); err != nil {
+		t.Fatalf("failed to tag manifest: %v", err)
+	}
+	for i := range sweepFixtureImages {
+		uploadGoldenImage(t, repo, "base layer", fmt.Sprintf("untagged layer %d", i))
+		orphan := fmt.Sprintf("orphan layer %d", i)
+		if err := testutil.UploadBlobs(repo, map[digest.Digest]io.ReadSeeker{digest.FromString(orphan): strings.NewReader(orphan)}); err != nil {
+			t.Fatalf("layer upload failed: %v", err)
+		}
+	}
+	snapshot, err := d.Snapshot()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return snapshot
+}
+
+func TestGCDeleteParallelism(t *testing.T) {
+	ctx := dcontext.Background()
+	snapshot := sweepFixture(t)
+	opts := GCOpts{RemoveUntagged: true, Quiet: true}
+
+	sequential := &countingDriver{StorageDriver: restoreFixture(t, snapshot).StorageDriver}
+	expected, err := GarbageCollect(ctx, sequential, createRegistry(t, sequential), opts)
+	if err != nil {
+		t.Fatalf("Failed mark and sweep: %v", err)
+	}
+	if sequential.maxRunning != 1 {
+		t.Fatalf("deletions ran concurrently without parallelism: %d", sequential.maxRunning)
+	}
+
+	const parallelism = 4
+	opts.DeleteParallelism = parallelism
+	d := &countingDriver{StorageDriver: restoreFixture(t, snapshot).StorageDriver}
+	report, err := GarbageCollect(ctx, d, createRegistry(t, d), opts)
+	if err != nil {
+		t.Fatalf("Failed mark and sweep: %v", err)
+	}
+	if d.deletes != sequential.deletes {
+		t.Fatalf("%d deletions, expected %d", d.deletes, sequential.deletes)
+	}
+	if d.maxRunning < 2 || d.maxRunning > parallelism {
+		t.Fatalf("%d deletions ran concurrently, expected between 2 and %d", d.maxRunning, parallelism)
+	}
+	if fmt.Sprint(storedPaths(t, d)) != fmt.Sprint(storedPaths(t, sequential)) {
+		t.Fatal("parallel sweep left other paths than a sequential one")
+	}
+	if string(marshalReport(t, report)) != string(marshalReport(t, expected)) {
+		t.Fatalf("report of the parallel sweep differs:\n%s\n%s", marshalReport(t, report), marshalReport(t, expected))
+	}
+}
+
+func TestGCDeleteBatches(t *testing.T) {
+	ctx := dcontext.Background()
+	snapshot := sweepFixture(t)
+	d := batchCountingDriver{&countingDriver{StorageDriver: restoreFixture(t, snapshot).StorageDriver}}
+	report, err := GarbageCollect(ctx, d, createRegistry(t, d), GCOpts{RemoveUntagged: true, Quiet: true, DeleteParallelism: 2})
+	if err != nil {
+		t.Fatalf("Failed mark and sweep: %v", err)
+	}
+
+	// The blobs are deleted in a batch, while the manifests and the layer
+	// links are deleted one at a time.
+	if len(d.batches) != 1 || d.batches[0] != len(report.Blobs) {
+		t.Fatalf("blobs deleted in batches of %v, expected a batch of %d", d.batches, len(report.Blobs))
+	}
+	if expected := len(report.Repositories[0].Manifests) + len(report.Repositories[0].Blobs); d.deletes != expected {
+		t.Fatalf("%d deletions, expected %d", d.deletes, expected)
+	}
+	registry := createRegistry(t, d)
+	blobs := allBlobs(t, registry)
+	for _, blob := range report.Blobs {
+		if _, ok := blobs[blob.Digest]; ok {
+			t.Fatalf("blob %s was not deleted", blob.Digest)
+		}
+	}
+	if _, ok := blobs[digest.FromString("base layer")]; !ok {
+		t.Fatal("layer of the tagged manifest was deleted")
+	}
+}
+
+// TestGCDeleteFailures checks that the sweep completes despite failures, and
+// keeps the blobs referenced by the manifests which failed to be deleted.
+func TestGCDeleteFailures(t *testing.T) {
+	ctx := dcontext.Background()
+	snapshot := sweepFixture(t)
+	failedBlob := digest.FromString("orphan layer 3")
+	failedManifestLayer := digest.FromString("untagged layer 5")
+
+	// The manifest of the layer is found from a dry run.
+	dry := restoreFixture(t, snapshot)
+	dryRegistry := createRegistry(t, dry)
+	dryRun, err := GarbageCollect(ctx, dry, dryRegistry, GCOpts{DryRun: true, RemoveUntagged: true, Quiet: true})
+	if err != nil {
+		t.Fatalf("Failed mark and sweep: %v", err)
+	}
+	manifestService := makeManifestService(t, makeRepository(t, dryRegistry, "sweep/app"))
+	var failedManifest digest.Digest
+	for _, m := range dryRun.Repositories[0].Manifests {
+		manifest, err := manifestService.Get(ctx, m.Digest)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, desc := range manifest.References() {
+			if desc.Digest == failedManifestLayer {
+				failedManifest = m.Digest
+			}
+		}
+	}
+	if failedManifest == "" {
+		t.Fatal("no manifest references the layer")
+	}
+
+	d := &countingDriver{
+		StorageDriver: restoreFixture(t, snapshot).StorageDriver,
+		fail: []string{
+			"/blobs/sha256/" + failedBlob.Encoded()[:2] + "/" + failedBlob.Encoded(),
+			"revisions/sha256/" + failedManifest.Encoded(),
+		},
+	}
+	registry := createRegistry(t, d)
+	report, err := GarbageCollect(ctx, d, registry, GCOpts{RemoveUntagged: true, Quiet: true, DeleteParallelism: 4})
+	if err == nil || !strings.Contains(err.Error(), "failed to delete 2 objects") {
+		t.Fatalf("expected the failures to be reported, got %v", err)
+	}
+	if report == nil || len(report.Failed) != 2 {
+		t.Fatalf("expected 2 failures in the report, got %+v", report)
+	}
+	failed := map[string]bool{}
+	for _, f := range report.Failed {
+		failed[f.Kind+" "+f.Digest.String()] = true
+	}
+	if !failed["manifest "+failedManifest.String()] || !failed["blob "+failedBlob.String()] {
+		t.Fatalf("unexpected failures: %+v", report.Failed)
+	}
+
+	blobs := allBlobs(t, registry)
+	if _, ok := blobs[failedBlob]; !ok {
+		t.Fatal("blob which failed to be deleted is missing")
+	}
+	if _, ok := blobs[failedManifestLayer]; !ok {
+		t.Fatal("layer of the manifest which failed to be deleted was deleted")
+	}
+	repo := makeRepository(t, registry, "sweep/app")
+	if _, err := repo.Blobs(ctx).Stat(ctx, failedManifestLayer); err != nil {
+		t.Fatalf("layer link of the manifest which failed to be deleted was deleted: %v", err)
+	}
+	if len(blobs) != len(allBlobs(t, dryRegistry))-len(report.Blobs) {
+		t.Fatalf("%d blobs left, expected %d", len(blobs), len(allBlobs(t, dryRegistry))-len(report.Blobs))
+	}
+	for _, blob := range report.Blobs {
+		if _, ok := blobs[blob.Digest]; ok {
+			t.Fatalf("reported blob %s was not deleted", blob.Digest)
+		}
+	}
+	if len(report.Blobs) != len(dryRun.Blobs)-3 {
+		t.Fatalf("%d blobs deleted, expected all but the failed blob and the manifest and layer of the failed manifest", len(report.Blobs))
+	}
+
+	// The sizes of the blobs kept are not counted as reclaimed.
+	expected := dryRun.Summary.ReclaimedBytes
+	for _, blob := range dryRun.Blobs {
+		switch blob.Digest {
+		case failedBlob, failedManifest, failedManifestLayer:
+			expected -= blob.Size
+		}
+	}
+	summary := report.Summary
+	if !dryRun.Summary.Estimated || summary.Estimated || summary.ReclaimedBytes != expected || summary.ReclaimedBytes != report.ReclaimableBytes {
+		t.Fatalf("reclaimed %d bytes, expected %d estimated at %d", summary.ReclaimedBytes, expected, dryRun.Summary.ReclaimedBytes)
+	}
+	// The layer link of the blob which failed to be deleted is deleted, while
+	// that of the layer of the failed manifest is kept.
+	if summary.Manifests != dryRun.Summary.Manifests-1 || summary.Blobs != dryRun.Summary.Blobs-3 || summary.Layers != dryRun.Summary.Layers-1 {
+		t.Fatalf("unexpected summary %+v of the dry run %+v", summary, dryRun.Summary)
+	}
+	// The orphan layers are linked to the repository.
+	if len(summary.Repositories) != 1 || summary.Repositories[0].ReclaimedBytes != expected {
+		t.Fatalf("unexpected repositories %+v", summary.Repositories)
+	}
+}
+
+// gcEvents records the deletions garbage collection notifies.
+type gcEvents struct {
+	mu        sync.Mutex
+	manifests []string
+	links     []string
+}
+
+func (e *gcEvents) ManifestDeleted(repo reference.Named, dgst digest.Digest) error {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	e.manifests = append(e.manifests, repo.Name()+"@"+dgst.String())
+	return nil
+}
+
+func (e *gcEvents) BlobDeleted(repo reference.Named, dgst digest.Digest) error {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	e.links = append(e.links, repo.Name()+"@"+dgst.String())
+	return nil
+}
+
+// TestGCListener checks that the listener is notified of the manifests and
+// the layer links deleted, and of them only.
+func TestGCListener(t *testing.T) {
+	ctx := dcontext.Background()
+	snapshot := sweepFixture(t)
+	failedLink := digest.FromString("orphan layer 3")
+
+	events := &gcEvents{}
+	d := &countingDriver{StorageDriver: restoreFixture(t, snapshot).StorageDriver, fail: []string{failedLink.Encoded() + "/link"}}
+	opts := GCOpts{DryRun: true, RemoveUntagged: true, Quiet: true, Listener: events}
+	if _, err := GarbageCollect(ctx, d, createRegistry(t, d), opts); err != nil {
+		t.Fatalf("Failed mark and sweep: %v", err)
+	}
+	if len(events.manifests) != 0 || len(events.links) != 0 {
+		t.Fatalf("unexpected notifications of a dry run: %v, %v", events.manifests, events.links)
+	}
+
+	opts.DryRun = false
+	opts.DeleteParallelism = 4
+	report, err := GarbageCollect(ctx, d, createRegistry(t, d), opts)
+	if err == nil || len(report.Failed) != 1 {
+		t.Fatalf("expected the layer link to fail to be deleted, got %v", err)
+	}
+	var manifests, links []string
+	for _, r := range report.Repositories {
+		for _, m := range r.Manifests {
+			manifests = append(manifests, r.Name+"@"+m.Digest.String())
+		}
+		for _, blob := range r.Blobs {
+			links = append(links, r.Name+"@"+blob.Digest.String())
+		}
+	}
+	if len(manifests) != sweepFixtureImages || len(links) == 0 {
+		t.Fatalf("unexpected deletions reported: %v, %v", manifests, links)
+	}
+	slices.Sort(events.manifests)
+	slices.Sort(events.links)
+	slices.Sort(manifests)
+	slices.Sort(links)
+	if !slices.Equal(events.manifests, manifests) {
+		t.Fatalf("manifests notified %v, expected %v", events.manifests, manifests)
+	}
+	if !slices.Equal(events.links, links) {
+		t.Fatalf("layer links notified %v, expected %v", events.links, links)
+	}
+	if slices.Contains(events.links, "sweep/app@"+failedLink.String()) {
+		t.Fatal("the layer link which failed to be deleted was notified")
+	}
+}
@@ -0,0 +1,86 @@
+package storage
+
+import (
+	"context"
+	"path"
+	"sync"
+
+	"github.com/distribution/distribution/v3/registry/storage/driver"
+)
+
+// BlobInventory counts the blobs of the blob store and their bytes. The
+// counts are maintained as blobs are committed and removed, and are
+// reconciled with the content of the storage by walking the blob store.
+type BlobInventory struct {
+	mu    sync.Mutex
+	blobs int64
+	bytes int64
+}
+
+// NewBlobInventory returns an empty inventory, which should be reconciled
+// with the storage to account for the blobs already stored.
+func NewBlobInventory() *BlobInventory {
+	return &BlobInventory{}
+}
+
+// Counts returns the number of blobs and bytes in the blob store.
+func (inv *BlobInventory) Counts() (blobs, bytes int64) {
+	inv.mu.Lock()
+	defer inv.mu.Unlock()
+	return inv.blobs, inv.bytes
+}
+
+// added accounts for a blob of the given size committed to the blob store.
+func (inv *BlobInventory) added(size int64) {
+	if inv == nil {
+		return
+	}
+	inv.mu.Lock()
+	defer inv.mu.Unlock()
+	inv.blobs++
+	inv.bytes += size
+}
+
+// removed accounts for a blob of the given size removed from the blob store.
+func (inv *BlobInventory) removed(size int64) {
+	if inv == nil {
+		return
+	}
+	inv.mu.Lock()
+	defer inv.mu.Unlock()
+	inv.blobs = max(inv.blobs-1, 0)
+	inv.bytes = max(inv.bytes-size, 0)
+}
+
+// Reconcile walks the blob store of the storage driver and replaces the
+// counts of the inventory by what it stores. The blobs committed or removed
+// during the walk may be miscounted until the next reconciliation.
+func (inv *BlobInventory) Reconcile(ctx context.Context, storageDriver driver.StorageDriver) error {
+	root, err := pathFor(blobsPathSpec{})
+	if err != nil {
+		return err
+	}
+
+	var blobs, bytes int64
+	err = storageDriver.Walk(ctx, root, func(fileInfo driver.FileInfo) error {
+		if fileInfo.IsDir() {
+			return nil
+		}
+		if _, fileName := path.Split(fileInfo.Path()); fileName == "data" {
+			blobs++
+			bytes += fileInfo.Size()
+		}
+		return nil
+	})
+	switch err.(type) {
+	case nil, driver.PathNotFoundError:
+		// The blob store is empty until the first blob is committed.
+	default:
+		return err
+	}
+
+	inv.mu.Lock()
+	defer inv.mu.Unlock()
+	inv.blobs, inv.bytes = blobs, bytes
+	return nil
+}
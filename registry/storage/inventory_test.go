@@ -0,0 +1,83 @@
+package storage
+
+import (
+	"bytes"
+	"context"
+	"testing"
+
+	"github.com/distribution/distribution/v3/registry/storage/driver/inmemory"
+	"github.com/distribution/reference"
+	"github.com/opencontainers/go-digest"
+	v1 "github.com/opencontainers/image-spec/specs-go/v1"
+)
+
+func checkInventory(t *testing.T, inv *BlobInventory, expectedBlobs, expectedBytes int64) {
+	t.Helper()
+	if blobs, bytes := inv.Counts(); blobs != expectedBlobs || bytes != expectedBytes {
+		t.Fatalf("unexpected inventory: %d blobs of %d bytes, expected %d blobs of %d bytes", blobs, bytes, expectedBlobs, expectedBytes)
+	}
+}
+
+func TestBlobInventory(t *testing.T) {
+	ctx := context.Background()
+	driver := inmemory.New()
+	inv := NewBlobInventory()
+	registry, err := NewRegistry(ctx, driver, TrackBlobInventory(inv))
+	if err != nil {
+		t.Fatalf("error creating registry: %v", err)
+	}
+
+	// The blob store does not exist before the first commit.
+	if err := inv.Reconcile(ctx, driver); err != nil {
+		t.Fatalf("unexpected error reconciling the empty inventory: %v", err)
+	}
+	checkInventory(t, inv, 0, 0)
+
+	imageName, _ := reference.WithName("foo/bar")
+	repository, err := registry.Repository(ctx, imageName)
+	if err != nil {
+		t.Fatalf("unexpected error getting repo: %v", err)
+	}
+	bs := repository.Blobs(ctx)
+
+	layer := []byte("some layer content")
+	desc := v1.Descriptor{Digest: digest.FromBytes(layer), Size: int64(len(layer))}
+	for range 2 {
+		// The blob already stored is not counted twice.
+		if _, err := addBlob(ctx, bs, desc, bytes.NewReader(layer)); err != nil {
+			t.Fatalf("unexpected error adding blob: %v", err)
+		}
+	}
+	simpleUpload(t, bs, []byte{}, digestSha256Empty)
+	config := []byte("{}")
+	if _, err := bs.Put(ctx, v1.MediaTypeImageConfig, config); err != nil {
+		t.Fatalf("unexpected error putting blob: %v", err)
+	}
+	total := int64(len(layer) + len(config))
+	checkInventory(t, inv, 3, total)
+
+	v := NewVacuum(ctx, driver).WithBlobInventory(inv)
+	if err := v.RemoveBlob(desc.Digest.String()); err != nil {
+		t.Fatalf("unexpected error removing blob: %v", err)
+	}
+	checkInventory(t, inv, 2, total-desc.Size)
+
+	// Blobs pushed or removed behind the back of the inventory are accounted
+	// for by the reconciliation.
+	if err := driver.Delete(ctx, mustPath(t, blobPathSpec{digest: digest.FromBytes(config)})); err != nil {
+		t.Fatalf("unexpected error deleting blob: %v", err)
+	}
+	if err := inv.Reconcile(ctx, driver); err != nil {
+		t.Fatalf("unexpected error reconciling the inventory: %v", err)
+	}
+	checkInventory(t, inv, 1, 0)
+}
+
+func mustPath(t *testing.T, spec pathSpec) string {
+	t.Helper()
+	p, err := pathFor(spec)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return p
+}
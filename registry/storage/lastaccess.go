@@ -0,0 +1,199 @@
+package storage
+
+import (
+	"context"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/distribution/distribution/v3/registry/storage/driver"
+)
+
+const (
+	lastPulled = "lastpulled"
+	lastPushed = "lastpushed"
+)
+
+// maxRecordedLastAccess bounds the timestamps LastAccess remembers writing.
+// Past it, the timestamps are read from the storage again before being
+// written, which still bounds the writes.
+const maxRecordedLastAccess = 10000
+
+// AccessTimes are the last pull and push of a repository or a tag, zero if
+// not recorded.
+type AccessTimes struct {
+	LastPulled time.Time
+	LastPushed time.Time
+}
+
+// LastAccess records the last pull and push of the repositories and of their
+// tags in the storage. Each timestamp is written at most once per interval,
+// so that it may lag behind by as much, and is never moved back: a timestamp
+// written by an instance whose clock is ahead is kept until the interval has
+// passed on the clock of the others.
+type LastAccess struct {
+	driver   driver.StorageDriver
+	interval time.Duration
+	now      func() time.Time
+
+	mu sync.Mutex
+	// recorded holds the timestamps last written or read, so that the
+	// storage is not read on each access within the interval.
+	recorded map[lastAccessPathSpec]time.Time
+}
+
+// NewLastAccess returns a LastAccess writing each timestamp to the storage at
+// most once per interval.
+func NewLastAccess(storageDriver driver.StorageDriver, interval time.Duration) *LastAccess {
+	return &LastAccess{
+		driver:   storageDriver,
+		interval: interval,
+		now:      time.Now,
+		recorded: map[lastAccessPathSpec]time.Time{},
+	}
+}
+
+// Pulled records a pull of the repository, and of the tag unless empty.
+func (la *LastAccess) Pulled(ctx context.Context, repo, tag string) error {
+	return la.access(ctx, repo, tag, lastPulled)
+}
+
+// Pushed records a push to the repository, and to the tag unless empty.
+func (la *LastAccess) Pushed(ctx context.Context, repo, tag string) error {
+	return la.access(ctx, repo, tag, lastPushed)
+}
+
+func (la *LastAccess) access(ctx context.Context, repo, tag, access string) error {
+	now := la.now()
+	if err := la.record(ctx, lastAccessPathSpec{name: repo, access: access}, now); err != nil {
+		return err
+	}
+	if tag == "" {
+		return nil
+	}
+	return la.record(ctx, lastAccessPathSpec{name: repo, tag: tag, access: access}, now)
+}
+
+// record writes the timestamp, unless it was written within the interval.
+func (la *LastAccess) record(ctx context.Context, spec lastAccessPathSpec, now time.Time) error {
+	la.mu.Lock()
+	if at, ok := la.recorded[spec]; ok && now.Sub(at) < la.interval {
+		la.mu.Unlock()
+		return nil
+	}
+	if len(la.recorded) >= maxRecordedLastAccess {
+		for s, at := range la.recorded {
+			if now.Sub(at) >= la.interval {
+				delete(la.recorded, s)
+			}
+		}
+		if len(la.recorded) >= maxRecordedLastAccess {
+			clear(la.recorded)
+		}
+	}
+	// The timestamp is claimed, so that the concurrent accesses do not
+	// write it too.
+	la.recorded[spec] = now
+	la.mu.Unlock()
+
+	stored, err := readAccessTime(ctx, la.driver, spec)
+	if err == nil {
+		if !stored.IsZero() && now.Sub(stored) < la.interval {
+			// Another instance wrote it within the interval, or its clock
+			// is ahead.
+			la.replace(spec, now, stored)
+			return nil
+		}
+		err = la.write(ctx, spec, now)
+	}
+	if err != nil {
+		la.mu.Lock()
+		if at, ok := la.recorded[spec]; ok && at.Equal(now) {
+			delete(la.recorded, spec)
+		}
+		la.mu.Unlock()
+	}
+	return err
+}
+
+// replace replaces the timestamp claimed by the access at now, unless
+// another access claimed it since.
+func (la *LastAccess) replace(spec lastAccessPathSpec, now, at time.Time) {
+	la.mu.Lock()
+	defer la.mu.Unlock()
+	if claimed, ok := la.recorded[spec]; ok && claimed.Equal(now) {
+		la.recorded[spec] = at
+	}
+}
+
+func (la *LastAccess) write(ctx context.Context, spec lastAccessPathSpec, at time.Time) error {
+	p, err := pathFor(spec)
+	if err != nil {
+		return err
+	}
+	return la.driver.PutContent(ctx, p, []byte(at.UTC().Format(time.RFC3339Nano)))
+}
+
+// readAccessTime reads a timestamp written by LastAccess, zero if there is
+// none.
+func readAccessTime(ctx context.Context, storageDriver driver.StorageDriver, spec lastAccessPathSpec) (time.Time, error) {
+	p, err := pathFor(spec)
+	if err != nil {
+		return time.Time{}, err
+	}
+	content, err := storageDriver.GetContent(ctx, p)
+	if err != nil {
+		if _, ok := err.(driver.PathNotFoundError); ok {
+			return time.Time{}, nil
+		}
+		return time.Time{}, err
+	}
+	return time.Parse(time.RFC3339Nano, strings.TrimSpace(string(content)))
+}
+
+func readAccessTimes(ctx context.Context, storageDriver driver.StorageDriver, repo, tag string) (AccessTimes, error) {
+	var (
+		times AccessTimes
+		err   error
+	)
+	times.LastPulled, err = readAccessTime(ctx, storageDriver, lastAccessPathSpec{name: repo, tag: tag, access: lastPulled})
+	if err != nil {
+		return AccessTimes{}, err
+	}
+	times.LastPushed, err = readAccessTime(ctx, storageDriver, lastAccessPathSpec{name: repo, tag: tag, access: lastPushed})
+	if err != nil {
+		return AccessTimes{}, err
+	}
+	return times, nil
+}
+
+// RepositoryAccessTimes returns the last pull and push of the repository
+// recorded by LastAccess.
+func RepositoryAccessTimes(ctx context.Context, storageDriver driver.StorageDriver, repo string) (AccessTimes, error) {
+	return readAccessTimes(ctx, storageDriver, repo, "")
+}
+
+// TagAccessTimes returns the last pull and push of the tag recorded by
+// LastAccess. The last push is the modification time of the link of the tag
+// if it is later, as for the tags pushed before the pushes were recorded.
+func TagAccessTimes(ctx context.Context, storageDriver driver.StorageDriver, repo, tag string) (AccessTimes, error) {
+	times, err := readAccessTimes(ctx, storageDriver, repo, tag)
+	if err != nil {
+		return AccessTimes{}, err
+	}
+	linkPath, err := pathFor(manifestTagCurrentPathSpec{name: repo, tag: tag})
+	if err != nil {
+		return AccessTimes{}, err
+	}
+	fi, err := storageDriver.Stat(ctx, linkPath)
+	switch err.(type) {
+	case nil:
+		if fi.ModTime().After(times.LastPushed) {
+			times.LastPushed = fi.ModTime()
+		}
+	case driver.PathNotFoundError:
+	default:
+		return AccessTimes{}, err
+	}
+	return times, nil
+}
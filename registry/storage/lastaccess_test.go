@@ -0,0 +1,188 @@
+package storage
+
+import (
+	"context"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/distribution/distribution/v3/internal/dcontext"
+	storagedriver "github.com/distribution/distribution/v3/registry/storage/driver"
+	"github.com/distribution/distribution/v3/registry/storage/driver/inmemory"
+)
+
+// accessCountingDriver counts the reads and writes of the files.
+type accessCountingDriver struct {
+	storagedriver.StorageDriver
+	mu     sync.Mutex
+	reads  int
+	writes int
+}
+
+func (d *accessCountingDriver) GetContent(ctx context.Context, path string) ([]byte, error) {
+	d.mu.Lock()
+	d.reads++
+	d.mu.Unlock()
+	return d.StorageDriver.GetContent(ctx, path)
+}
+
+func (d *accessCountingDriver) PutContent(ctx context.Context, path string, content []byte) error {
+	d.mu.Lock()
+	d.writes++
+	d.mu.Unlock()
+	return d.StorageDriver.PutContent(ctx, path, content)
+}
+
+func (d *accessCountingDriver) counts() (int, int) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return d.reads, d.writes
+}
+
+func checkAccessTimes(t *testing.T, d storagedriver.StorageDriver, repo string, pulled, pushed time.Time) {
+	t.Helper()
+	times, err := RepositoryAccessTimes(context.Background(), d, repo)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !times.LastPulled.Equal(pulled) || !times.LastPushed.Equal(pushed) {
+		t.Fatalf("expected %s to be last pulled at %v and pushed at %v, got %+v", repo, pulled, pushed, times)
+	}
+}
+
+func TestLastAccessUpdateInterval(t *testing.T) {
+	ctx := context.Background()
+	d := &accessCountingDriver{StorageDriver: inmemory.New()}
+	lastAccess := NewLastAccess(d, time.Hour)
+	start := time.Date(2024, 1, 1, 12, 0, 0, 0, time.UTC)
+	now := start
+	lastAccess.now = func() time.Time { return now }
+
+	if err := lastAccess.Pulled(ctx, "foo/bar", "latest"); err != nil {
+		t.Fatal(err)
+	}
+	// The repository and the tag are written once.
+	if _, writes := d.counts(); writes != 2 {
+		t.Fatalf("expected 2 writes, got %d", writes)
+	}
+	reads, _ := d.counts()
+
+	// Within the interval, the pulls neither read nor write the storage.
+	for _, after := range []time.Duration{time.Minute, 30 * time.Minute, 59 * time.Minute} {
+		now = start.Add(after)
+		if err := lastAccess.Pulled(ctx, "foo/bar", "latest"); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if r, writes := d.counts(); r != reads || writes != 2 {
+		t.Fatalf("expected no access to the storage within the interval, got %d reads and %d writes", r-reads, writes-2)
+	}
+	checkAccessTimes(t, d, "foo/bar", start, time.Time{})
+
+	// Another tag, and the pushes, are recorded on their own.
+	if err := lastAccess.Pulled(ctx, "foo/bar", "v1"); err != nil {
+		t.Fatal(err)
+	}
+	if err := lastAccess.Pushed(ctx, "foo/bar", ""); err != nil {
+		t.Fatal(err)
+	}
+	if _, writes := d.counts(); writes != 4 {
+		t.Fatalf("expected 4 writes, got %d", writes)
+	}
+	checkAccessTimes(t, d, "foo/bar", start, now)
+
+	now = start.Add(time.Hour)
+	if err := lastAccess.Pulled(ctx, "foo/bar", "latest"); err != nil {
+		t.Fatal(err)
+	}
+	checkAccessTimes(t, d, "foo/bar", now, start.Add(59*time.Minute))
+	times, err := TagAccessTimes(ctx, d, "foo/bar", "latest")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !times.LastPulled.Equal(now) {
+		t.Fatalf("expected latest to be last pulled at %v, got %v", now, times.LastPulled)
+	}
+}
+
+func TestLastAccessInstances(t *testing.T) {
+	ctx := context.Background()
+	d := &accessCountingDriver{StorageDriver: inmemory.New()}
+	start := time.Date(2024, 1, 1, 12, 0, 0, 0, time.UTC)
+
+	// The clock of the first instance is 30 minutes ahead of the second.
+	ahead, behind := NewLastAccess(d, time.Hour), NewLastAccess(d, time.Hour)
+	aheadNow, behindNow := start.Add(30*time.Minute), start
+	ahead.now = func() time.Time { return aheadNow }
+	behind.now = func() time.Time { return behindNow }
+
+	if err := ahead.Pulled(ctx, "foo/bar", ""); err != nil {
+		t.Fatal(err)
+	}
+	// The timestamp in the future of the second instance is not moved back,
+	// nor written again until the interval has passed on its clock.
+	for _, after := range []time.Duration{0, 45 * time.Minute, 89 * time.Minute} {
+		behindNow = start.Add(after)
+		if err := behind.Pulled(ctx, "foo/bar", ""); err != nil {
+			t.Fatal(err)
+		}
+		checkAccessTimes(t, d, "foo/bar", aheadNow, time.Time{})
+	}
+	if _, writes := d.counts(); writes != 1 {
+		t.Fatalf("expected 1 write, got %d", writes)
+	}
+
+	behindNow = start.Add(90 * time.Minute)
+	if err := behind.Pulled(ctx, "foo/bar", ""); err != nil {
+		t.Fatal(err)
+	}
+	checkAccessTimes(t, d, "foo/bar", behindNow, time.Time{})
+
+	// The timestamp the second instance wrote within the interval is not
+	// written again by the first, whose clock is ahead.
+	aheadNow = start.Add(2 * time.Hour)
+	if err := ahead.Pulled(ctx, "foo/bar", ""); err != nil {
+		t.Fatal(err)
+	}
+	checkAccessTimes(t, d, "foo/bar", behindNow, time.Time{})
+	if _, writes := d.counts(); writes != 2 {
+		t.Fatalf("expected 2 writes, got %d", writes)
+	}
+}
+
+func TestTagAccessTimesPushed(t *testing.T) {
+	ctx := dcontext.Background()
+	d := newHistoryDriver()
+	registry := createRegistry(t, d)
+	repo := makeRepository(t, registry, "foo/bar")
+	pushedAt := time.Date(2024, 1, 1, 12, 0, 0, 0, time.UTC)
+	d.tagAt(t, repo, "latest", uploadGoldenImage(t, repo, "layer"), pushedAt)
+
+	// The pushes before they were recorded are those of the tag links.
+	times, err := TagAccessTimes(ctx, d, "foo/bar", "latest")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !times.LastPushed.Equal(pushedAt) || !times.LastPulled.IsZero() {
+		t.Fatalf("unexpected access times %+v", times)
+	}
+
+	lastAccess := NewLastAccess(d, time.Hour)
+	lastAccess.now = func() time.Time { return pushedAt.Add(time.Hour) }
+	if err := lastAccess.Pushed(ctx, "foo/bar", "latest"); err != nil {
+		t.Fatal(err)
+	}
+	times, err = TagAccessTimes(ctx, d, "foo/bar", "latest")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !times.LastPushed.Equal(pushedAt.Add(time.Hour)) {
+		t.Fatalf("expected the recorded push, got %v", times.LastPushed)
+	}
+
+	// A tag which does not exist has no access times.
+	times, err = TagAccessTimes(ctx, d, "foo/bar", "missing")
+	if err != nil || times != (AccessTimes{}) {
+		t.Fatalf("unexpected access times %+v: %v", times, err)
+	}
+}
@@ -0,0 +1,98 @@
+package storage
+
+import (
+	"context"
+	"fmt"
+	"path"
+	"slices"
+
+	"github.com/distribution/distribution/v3"
+	"github.com/distribution/distribution/v3/internal/dcontext"
+	v1 "github.com/opencontainers/image-spec/specs-go/v1"
+)
+
+// layerExistenceRule relaxes the existence checks of the layers of the image
+// manifests accepted by the repositories matching pattern.
+type layerExistenceRule struct {
+	pattern string
+	// exemptMediaTypes are the media types of the layers which are not
+	// checked.
+	exemptMediaTypes []string
+	// anyRepository accepts a layer missing from the repository if a blob of
+	// its digest and size is in the registry.
+	anyRepository bool
+}
+
+// layerExistenceRuleFor returns the layer existence rule applying to the
+// named repository: the first rule whose pattern matches, or else the default
+// rule. It returns nil if no rule applies.
+func (reg *registry) layerExistenceRuleFor(name string) *layerExistenceRule {
+	var fallback *layerExistenceRule
+	for i, rule := range reg.layerExistence {
+		if rule.pattern == "" {
+			if fallback == nil {
+				fallback = &reg.layerExistence[i]
+			}
+			continue
+		}
+		if ok, _ := path.Match(rule.pattern, name); ok {
+			return &reg.layerExistence[i]
+		}
+	}
+	return fallback
+}
+
+// layerVerifier checks the existence of the layers of the image manifests
+// pushed to a repository. The zero value checks that every layer is in the
+// repository.
+type layerVerifier struct {
+	rule *layerExistenceRule
+	// registryBlobs stats the blobs of the whole registry.
+	registryBlobs distribution.BlobStatter
+}
+
+// newLayerVerifier returns the layer verifier of the repository.
+func newLayerVerifier(repo *repository) layerVerifier {
+	return layerVerifier{
+		rule:          repo.registry.layerExistenceRuleFor(repo.Named().Name()),
+		registryBlobs: repo.registry.statter,
+	}
+}
+
+// stat checks that the layer is in the repository blobs, unless its media
+// type is exempt, or else in the registry if the rule allows it. It returns
+// distribution.ErrBlobUnknown if the layer is missing.
+func (lv layerVerifier) stat(ctx context.Context, blobs distribution.BlobStatter, layer v1.Descriptor) error {
+	if lv.rule != nil && slices.Contains(lv.rule.exemptMediaTypes, layer.MediaType) {
+		return nil
+	}
+	_, err := blobs.Stat(ctx, layer.Digest)
+	if err != distribution.ErrBlobUnknown || lv.rule == nil || !lv.rule.anyRepository || lv.registryBlobs == nil {
+		return err
+	}
+
+	desc, err := lv.registryBlobs.Stat(ctx, layer.Digest)
+	if err != nil {
+		return err
+	}
+	if desc.Size != layer.Size {
+		dcontext.GetLogger(ctx).Debugf("layer %s is in the registry with size %d instead of %d", layer.Digest, desc.Size, layer.Size)
+		return distribution.ErrBlobUnknown
+	}
+	return nil
+}
+
+// blobUnknown returns the error of the blob of a descriptor of the manifest
+// which is missing, the descriptor at index i of its references, of the
+// config and then of the layers.
+func blobUnknown(i int, descriptor v1.Descriptor) distribution.ErrManifestBlobUnknown {
+	field := "config"
+	if i > 0 {
+		field = fmt.Sprintf("layers[%d]", i-1)
+	}
+	return distribution.ErrManifestBlobUnknown{
+		Digest:    descriptor.Digest,
+		Field:     field,
+		MediaType: descriptor.MediaType,
+	}
+}
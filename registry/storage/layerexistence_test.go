@@ -0,0 +1,179 @@
+package storage
+
+import (
+	"slices"
+	"testing"
+
+	"github.com/distribution/distribution/v3"
+	"github.com/distribution/distribution/v3/internal/dcontext"
+	"github.com/distribution/distribution/v3/manifest/ocischema"
+	"github.com/distribution/distribution/v3/manifest/schema2"
+	"github.com/distribution/distribution/v3/registry/storage/driver/inmemory"
+	"github.com/opencontainers/go-digest"
+	"github.com/opencontainers/image-spec/specs-go"
+	v1 "github.com/opencontainers/image-spec/specs-go/v1"
+)
+
+const mediaTypeWasmLayer = "application/vnd.wasm.content.layer.v1+wasm"
+
+// putLayersManifest puts an OCI image manifest of the layers, with a config
+// pushed to the repository, and returns the fields of the descriptors whose
+// blobs are reported missing.
+func putLayersManifest(t *testing.T, repository distribution.Repository, layers ...v1.Descriptor) []string {
+	ctx := dcontext.Background()
+	config, err := repository.Blobs(ctx).Put(ctx, v1.MediaTypeImageConfig, []byte("{}"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	manifest, err := ocischema.FromStruct(ocischema.Manifest{
+		Versioned: specs.Versioned{SchemaVersion: 2},
+		MediaType: v1.MediaTypeImageManifest,
+		Config:    config,
+		Layers:    layers,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = makeManifestService(t, repository).Put(ctx, manifest)
+	if err == nil {
+		return nil
+	}
+	errs, ok := err.(distribution.ErrManifestVerification)
+	if !ok {
+		t.Fatalf("unexpected error putting manifest: %v", err)
+	}
+	var fields []string
+	for _, err := range errs {
+		unknown, ok := err.(distribution.ErrManifestBlobUnknown)
+		if !ok {
+			t.Fatalf("unexpected verification error: %v", err)
+		}
+		if !slices.ContainsFunc(layers, func(d v1.Descriptor) bool { return d.Digest == unknown.Digest && d.MediaType == unknown.MediaType }) {
+			t.Fatalf("unexpected descriptor of the unknown blob: %+v", unknown)
+		}
+		fields = append(fields, unknown.Field)
+	}
+	return fields
+}
+
+func missingLayer(mediaType, content string) v1.Descriptor {
+	return v1.Descriptor{
+		MediaType: mediaType,
+		Digest:    digest.FromString(content),
+		Size:      int64(len(content)),
+	}
+}
+
+func TestLayerExistenceStrict(t *testing.T) {
+	ctx := dcontext.Background()
+	registry := createRegistry(t, inmemory.New())
+	repo := makeRepository(t, registry, "layers/strict")
+	layer, err := repo.Blobs(ctx).Put(ctx, v1.MediaTypeImageLayerGzip, []byte("layer"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Every missing layer is reported, whatever its media type.
+	fields := putLayersManifest(t, repo,
+		missingLayer(v1.MediaTypeImageLayerGzip, "missing"),
+		layer,
+		missingLayer(mediaTypeWasmLayer, "module"),
+	)
+	if !slices.Equal(fields, []string{"layers[0]", "layers[2]"}) {
+		t.Fatalf("unexpected descriptors reported missing %v", fields)
+	}
+
+	// The schema2 manifests are checked the same way.
+	config, err := repo.Blobs(ctx).Put(ctx, schema2.MediaTypeImageConfig, []byte("{}"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	manifest, err := schema2.FromStruct(schema2.Manifest{
+		Versioned: specs.Versioned{SchemaVersion: 2},
+		MediaType: schema2.MediaTypeManifest,
+		Config:    config,
+		Layers:    []v1.Descriptor{layer, missingLayer(schema2.MediaTypeLayer, "missing")},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = makeManifestService(t, repo).Put(ctx, manifest)
+	errs, ok := err.(distribution.ErrManifestVerification)
+	if !ok || len(errs) != 1 || errs[0].(distribution.ErrManifestBlobUnknown).Field != "layers[1]" {
+		t.Fatalf("unexpected error putting schema2 manifest: %v", err)
+	}
+}
+
+func TestLayerExistenceExemptMediaTypes(t *testing.T) {
+	registry := createRegistry(t, inmemory.New(), RelaxLayerExistence("", []string{mediaTypeWasmLayer}, false))
+	repo := makeRepository(t, registry, "layers/exempt")
+
+	if fields := putLayersManifest(t, repo, missingLayer(mediaTypeWasmLayer, "module")); fields != nil {
+		t.Fatalf("unexpected descriptors reported missing %v", fields)
+	}
+	// The other media types are still checked.
+	fields := putLayersManifest(t, repo,
+		missingLayer(mediaTypeWasmLayer, "module"),
+		missingLayer(v1.MediaTypeImageLayerGzip, "missing"),
+	)
+	if !slices.Equal(fields, []string{"layers[1]"}) {
+		t.Fatalf("unexpected descriptors reported missing %v", fields)
+	}
+}
+
+func TestLayerExistenceAnyRepository(t *testing.T) {
+	ctx := dcontext.Background()
+	registry := createRegistry(t, inmemory.New(), RelaxLayerExistence("", nil, true))
+	source := makeRepository(t, registry, "layers/source")
+	repo := makeRepository(t, registry, "layers/mounts")
+	layer, err := source.Blobs(ctx).Put(ctx, v1.MediaTypeImageLayerGzip, []byte("layer"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// A layer of another repository is accepted, but not with another size,
+	// nor a layer of no repository.
+	if fields := putLayersManifest(t, repo, layer); fields != nil {
+		t.Fatalf("unexpected descriptors reported missing %v", fields)
+	}
+	resized := layer
+	resized.Size++
+	fields := putLayersManifest(t, repo, resized, missingLayer(v1.MediaTypeImageLayerGzip, "missing"))
+	if !slices.Equal(fields, []string{"layers[0]", "layers[1]"}) {
+		t.Fatalf("unexpected descriptors reported missing %v", fields)
+	}
+}
+
+func TestLayerExistenceRepositoryOverride(t *testing.T) {
+	ctx := dcontext.Background()
+	registry := createRegistry(t, inmemory.New(),
+		RelaxLayerExistence("prod/*", nil, false),
+		RelaxLayerExistence("ci/*", nil, true),
+		RelaxLayerExistence("", []string{mediaTypeWasmLayer}, false),
+	)
+	source := makeRepository(t, registry, "layers/source")
+	layer, err := source.Blobs(ctx).Put(ctx, v1.MediaTypeImageLayerGzip, []byte("layer"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	module := missingLayer(mediaTypeWasmLayer, "module")
+
+	// The default rule applies to the repositories matched by no pattern.
+	if fields := putLayersManifest(t, makeRepository(t, registry, "sandbox/app"), module); fields != nil {
+		t.Fatalf("unexpected descriptors reported missing by the default rule %v", fields)
+	}
+	// A rule relaxing nothing keeps the checks strict.
+	if fields := putLayersManifest(t, makeRepository(t, registry, "prod/app"), module, layer); !slices.Equal(fields, []string{"layers[0]", "layers[1]"}) {
+		t.Fatalf("unexpected descriptors reported missing by the strict rule %v", fields)
+	}
+	// A rule replaces the default rule.
+	if fields := putLayersManifest(t, makeRepository(t, registry, "ci/app"), module, layer); !slices.Equal(fields, []string{"layers[0]"}) {
+		t.Fatalf("unexpected descriptors reported missing by the repository rule %v", fields)
+	}
+}
+
+func TestRelaxLayerExistenceInvalidPattern(t *testing.T) {
+	if _, err := NewRegistry(dcontext.Background(), inmemory.New(), RelaxLayerExistence("[", nil, true)); err == nil {
+		t.Fatal("expected an error for an invalid pattern")
+	}
+}
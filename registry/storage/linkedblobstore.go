@@ -2,6 +2,7 @@ package storage
 
 import (
 	"context"
+	"encoding/json"
 	"fmt"
 	"io"
 	"net/http"
@@ -11,6 +12,7 @@ import (
 	"github.com/distribution/distribution/v3"
 	"github.com/distribution/distribution/v3/internal/dcontext"
 	"github.com/distribution/distribution/v3/internal/uuid"
+	"github.com/distribution/distribution/v3/registry/storage/cache"
 	"github.com/distribution/distribution/v3/registry/storage/driver"
 	"github.com/distribution/reference"
 	"github.com/opencontainers/go-digest"
@@ -137,12 +139,16 @@ func (lbs *linkedBlobStore) Create(ctx context.Context, options ...distribution.
 		}
 	}
 
-	if opts.Mount.ShouldMount {
+	if opts.Mount.ShouldMount && (lbs.registry == nil || !lbs.registry.mountDisabled) {
 		desc, err := lbs.mount(ctx, opts.Mount.From, opts.Mount.From.Digest(), opts.Mount.Stat)
 		if err == nil {
 			// Mount successful, no need to initiate an upload session
 			return nil, distribution.ErrBlobMounted{From: opts.Mount.From, Descriptor: desc}
 		}
+		if _, ok := err.(distribution.ErrQuotaExceeded); ok {
+			// Uploading the blob instead would exceed the quota as well.
+			return nil, err
+		}
 	}
 
 	uuid := uuid.NewString()
@@ -169,7 +175,7 @@ func (lbs *linkedBlobStore) Create(ctx context.Context, options ...distribution.
 		return nil, err
 	}
 
-	return lbs.newBlobUpload(ctx, uuid, path, startedAt, false)
+	return lbs.newBlobUpload(ctx, uuid, path, startedAt, false, nil)
 }
 
 func (lbs *linkedBlobStore) Resume(ctx context.Context, id string) (distribution.BlobWriter, error) {
@@ -198,6 +204,11 @@ func (lbs *linkedBlobStore) Resume(ctx context.Context, id string) (distribution
 		return nil, err
 	}
 
+	session, err := lbs.getUploadSession(ctx, id)
+	if err != nil {
+		return nil, err
+	}
+
 	path, err := pathFor(uploadDataPathSpec{
 		name: lbs.repository.Named().Name(),
 		id:   id,
@@ -206,7 +217,45 @@ func (lbs *linkedBlobStore) Resume(ctx context.Context, id string) (distribution
 		return nil, err
 	}
 
-	return lbs.newBlobUpload(ctx, id, path, startedAt, true)
+	return lbs.newBlobUpload(ctx, id, path, startedAt, true, session)
+}
+
+// getUploadSession returns the session persisted of the upload, from the
+// provider of the sessions if any, or nil if the upload has none, as those
+// started before the sessions were persisted.
+func (lbs *linkedBlobStore) getUploadSession(ctx context.Context, id string) (*uploadSession, error) {
+	var sessionBytes []byte
+	var version int64
+	if provider := lbs.uploadSessions(); provider != nil {
+		var err error
+		sessionBytes, version, err = provider.Get(ctx, lbs.repository.Named().Name(), id)
+		if err != nil || sessionBytes == nil {
+			return nil, err
+		}
+	} else {
+		sessionPath, err := pathFor(uploadSessionPathSpec{
+			name: lbs.repository.Named().Name(),
+			id:   id,
+		})
+		if err != nil {
+			return nil, err
+		}
+		sessionBytes, err = lbs.blobStore.driver.GetContent(ctx, sessionPath)
+		switch err.(type) {
+		case nil:
+		case driver.PathNotFoundError:
+			return nil, nil
+		default:
+			return nil, err
+		}
+	}
+
+	session := &uploadSession{}
+	if err := json.Unmarshal(sessionBytes, session); err != nil {
+		return nil, err
+	}
+	session.version = version
+	return session, nil
 }
 
 func (lbs *linkedBlobStore) Delete(ctx context.Context, dgst digest.Digest) error {
@@ -215,7 +264,7 @@ func (lbs *linkedBlobStore) Delete(ctx context.Context, dgst digest.Digest) erro
 	}
 
 	// Ensure the blob is available for deletion
-	_, err := lbs.blobAccessController.Stat(ctx, dgst)
+	desc, err := lbs.blobAccessController.Stat(ctx, dgst)
 	if err != nil {
 		return err
 	}
@@ -225,7 +274,7 @@ func (lbs *linkedBlobStore) Delete(ctx context.Context, dgst digest.Digest) erro
 		return err
 	}
 
-	return nil
+	return lbs.quotas().release(ctx, lbs.repository.Named().Name(), desc.Size)
 }
 
 func (lbs *linkedBlobStore) Enumerate(ctx context.Context, ingestor func(digest.Digest) error) error {
@@ -234,8 +283,12 @@ func (lbs *linkedBlobStore) Enumerate(ctx context.Context, ingestor func(digest.
 		return err
 	}
 	return lbs.driver.Walk(ctx, rootPath, func(fileInfo driver.FileInfo) error {
-		// exit early if directory...
+		// exit early if directory, skipping the links to the referrers of
+		// a manifest revision...
 		if fileInfo.IsDir() {
+			if path.Base(fileInfo.Path()) == referrersDirectory {
+				return driver.ErrSkipDir
+			}
 			return nil
 		}
 		filePath := fileInfo.Path()
@@ -268,7 +321,7 @@ func (lbs *linkedBlobStore) Enumerate(ctx context.Context, ingestor func(digest.
 		}
 
 		return nil
-	})
+	}, driver.WithParallelism(lbs.walkParallelism))
 }
 
 func (lbs *linkedBlobStore) mount(ctx context.Context, sourceRepo reference.Named, dgst digest.Digest, sourceStat *v1.Descriptor) (v1.Descriptor, error) {
@@ -300,8 +353,9 @@ func (lbs *linkedBlobStore) mount(ctx context.Context, sourceRepo reference.Name
 	return desc, lbs.linkBlob(ctx, desc)
 }
 
-// newBlobUpload allocates a new upload controller with the given state.
-func (lbs *linkedBlobStore) newBlobUpload(ctx context.Context, uuid, path string, startedAt time.Time, append bool) (distribution.BlobWriter, error) {
+// newBlobUpload allocates a new upload controller with the given state and
+// the session persisted, if any.
+func (lbs *linkedBlobStore) newBlobUpload(ctx context.Context, uuid, path string, startedAt time.Time, append bool, session *uploadSession) (distribution.BlobWriter, error) {
 	fw, err := lbs.driver.Writer(ctx, path, append)
 	if err != nil {
 		return nil, err
@@ -317,6 +371,7 @@ func (lbs *linkedBlobStore) newBlobUpload(ctx context.Context, uuid, path string
 		driver:                 lbs.driver,
 		path:                   path,
 		resumableDigestEnabled: lbs.resumableDigestEnabled,
+		session:                session,
 	}
 
 	return bw, nil
@@ -331,6 +386,18 @@ func (lbs *linkedBlobStore) linkBlob(ctx context.Context, canonical v1.Descripto
 	// since we don't care about the aliases. They are generally unused except
 	// for tarsum but those versions don't care about mediatype.
 
+	// The blobs are charged to the quota of the repository once, when the
+	// link of their canonical digest is created.
+	linked, err := lbs.linked(ctx, canonical.Digest)
+	if err != nil {
+		return err
+	}
+	if !linked {
+		if err := lbs.quotas().charge(ctx, lbs.repository.Named().Name(), canonical.Size); err != nil {
+			return err
+		}
+	}
+
 	// Don't make duplicate links.
 	seenDigests := make(map[digest.Digest]struct{}, len(dgsts))
 
@@ -346,6 +413,11 @@ func (lbs *linkedBlobStore) linkBlob(ctx context.Context, canonical v1.Descripto
 		}
 
 		if err := lbs.blobStore.link(ctx, blobLinkPath, canonical.Digest); err != nil {
+			if !linked {
+				if err := lbs.quotas().release(ctx, lbs.repository.Named().Name(), canonical.Size); err != nil {
+					dcontext.GetLogger(ctx).Errorf("error releasing the quota of a blob not linked: %v", err)
+				}
+			}
 			return err
 		}
 	}
@@ -353,6 +425,54 @@ func (lbs *linkedBlobStore) linkBlob(ctx context.Context, canonical v1.Descripto
 	return nil
 }
 
+// quotas returns the quotas applying to the links of the blob store, nil if
+// none apply. Only the layers count against the quotas.
+// uploadSessions returns the provider keeping the sessions of the uploads,
+// or nil if they are kept in the storage.
+func (lbs *linkedBlobStore) uploadSessions() cache.UploadSessionProvider {
+	if lbs.registry == nil {
+		return nil
+	}
+	return lbs.registry.uploadSessionProvider
+}
+
+func (lbs *linkedBlobStore) quotas() *Quotas {
+	if lbs.registry == nil {
+		return nil
+	}
+	return lbs.registry.quotas
+}
+
+// linked returns whether the blob is linked to the repository, without
+// checking the blob store. It is always false when no quota applies, for
+// the blobs are not charged then.
+func (lbs *linkedBlobStore) linked(ctx context.Context, dgst digest.Digest) (bool, error) {
+	if lbs.quotas() == nil {
+		return false, nil
+	}
+	blobLinkPath, err := lbs.linkPath(lbs.repository.Named().Name(), dgst)
+	if err != nil {
+		return false, err
+	}
+	if _, err := lbs.driver.Stat(ctx, blobLinkPath); err != nil {
+		if _, ok := err.(driver.PathNotFoundError); ok {
+			return false, nil
+		}
+		return false, err
+	}
+	return true, nil
+}
+
+// checkQuota returns distribution.ErrQuotaExceeded if linking the blob
+// would bring the repository over its quota.
+func (lbs *linkedBlobStore) checkQuota(ctx context.Context, desc v1.Descriptor) error {
+	linked, err := lbs.linked(ctx, desc.Digest)
+	if err != nil || linked {
+		return err
+	}
+	return lbs.quotas().check(ctx, lbs.repository.Named().Name(), desc.Size)
+}
+
 type linkedBlobStatter struct {
 	*blobStore
 	repository distribution.Repository
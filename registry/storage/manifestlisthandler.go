@@ -18,6 +18,7 @@ type manifestListHandler struct {
 	blobStore            distribution.BlobStore
 	ctx                  context.Context
 	validateImageIndexes validateImageIndexes
+	validateSubjects     validateSubjects
 }
 
 var _ ManifestHandler = &manifestListHandler{}
@@ -76,6 +77,8 @@ func (ms *manifestListHandler) Put(ctx context.Context, manifestList distributio
 func (ms *manifestListHandler) verifyManifest(ctx context.Context, mnfst distribution.Manifest, skipDependencyVerification bool) error {
 	var errs distribution.ErrManifestVerification
 
+	errs = append(errs, verifySubject(ctx, ms.blobStore, mnfst, ms.validateSubjects.exist && !skipDependencyVerification)...)
+
 	// Check if we should be validating the existence of any child images in images indexes
 	if ms.validateImageIndexes.imagesExist && !skipDependencyVerification {
 		// Get the manifest service we can use to check for the existence of child images
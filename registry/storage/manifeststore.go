@@ -134,24 +134,72 @@ func (ms *manifestStore) Get(ctx context.Context, dgst digest.Digest, options ..
 func (ms *manifestStore) Put(ctx context.Context, manifest distribution.Manifest, options ...distribution.ManifestServiceOption) (digest.Digest, error) {
 	dcontext.GetLogger(ms.ctx).Debug("(*manifestStore).Put")
 
+	var handler ManifestHandler
 	switch manifest.(type) {
 	case *schema2.DeserializedManifest:
-		return ms.schema2Handler.Put(ctx, manifest, ms.skipDependencyVerification)
+		handler = ms.schema2Handler
 	case *ocischema.DeserializedManifest:
-		return ms.ocischemaHandler.Put(ctx, manifest, ms.skipDependencyVerification)
+		handler = ms.ocischemaHandler
 	case *manifestlist.DeserializedManifestList:
-		return ms.manifestListHandler.Put(ctx, manifest, ms.skipDependencyVerification)
+		handler = ms.manifestListHandler
 	case *ocischema.DeserializedImageIndex:
-		return ms.ocischemaIndexHandler.Put(ctx, manifest, ms.skipDependencyVerification)
+		handler = ms.ocischemaIndexHandler
+	default:
+		return "", fmt.Errorf("unrecognized manifest type %T", manifest)
 	}
 
-	return "", fmt.Errorf("unrecognized manifest type %T", manifest)
+	if err := ms.repository.verifyMediaTypes(ms.repository.Named().Name(), manifest); err != nil {
+		return "", err
+	}
+	if err := ms.repository.verifyAnnotations(ms.repository.Named().Name(), manifest); err != nil {
+		return "", err
+	}
+
+	revision, err := handler.Put(ctx, manifest, ms.skipDependencyVerification)
+	if err != nil {
+		return "", err
+	}
+	if err := ms.linkReferrer(ctx, manifest, revision); err != nil {
+		return "", err
+	}
+	if err := ms.tagReferrer(ctx, manifest, revision); err != nil {
+		return "", err
+	}
+	if err := ms.repository.catalog.add(ctx, ms.repository.Named().Name()); err != nil {
+		// The manifest is put, and the index repaired by its next
+		// reconciliation.
+		dcontext.GetLogger(ctx).Errorf("failed to add %s to the catalog index: %v", ms.repository.Named().Name(), err)
+	}
+	return revision, nil
 }
 
-// Delete removes the revision of the specified manifest.
+// Delete removes the revision of the specified manifest, along with its link
+// from the referrers of its subject and its entry in the referrers tag of its
+// subject. The referrers tag of the manifest is removed too if the registry
+// cascades the deletions to it.
 func (ms *manifestStore) Delete(ctx context.Context, dgst digest.Digest) error {
 	dcontext.GetLogger(ms.ctx).Debug("(*manifestStore).Delete")
-	return ms.blobStore.Delete(ctx, dgst)
+
+	var subject *v1.Descriptor
+	if ms.blobStore.deleteEnabled {
+		// The subject is only known until the manifest is deleted. A
+		// manifest which cannot be read is still deleted.
+		if manifest, err := ms.Get(ctx, dgst); err == nil {
+			subject = manifestSubject(manifest)
+		}
+	}
+	if err := ms.blobStore.Delete(ctx, dgst); err != nil {
+		return err
+	}
+	if subject != nil {
+		if err := unlinkReferrer(ctx, ms.blobStore.driver, ms.repository.Named().Name(), subject.Digest, dgst); err != nil {
+			return err
+		}
+		if err := ms.untagReferrer(ctx, subject.Digest, dgst); err != nil {
+			return err
+		}
+	}
+	return ms.untagReferrers(ctx, dgst)
 }
 
 func (ms *manifestStore) Enumerate(ctx context.Context, ingester func(digest.Digest) error) error {
@@ -0,0 +1,84 @@
+package storage
+
+import (
+	"fmt"
+	"path"
+	"slices"
+
+	"github.com/distribution/distribution/v3"
+	"github.com/distribution/distribution/v3/manifest/ocischema"
+	"github.com/distribution/distribution/v3/manifest/schema2"
+)
+
+// mediaTypeRule restricts the media types accepted by the repositories
+// matching pattern. An empty list allows any media type.
+type mediaTypeRule struct {
+	pattern   string
+	manifests []string
+	layers    []string
+}
+
+// mediaTypeRuleFor returns the media type rule applying to the named
+// repository: the first rule whose pattern matches, or else the default rule.
+// It returns nil if no rule applies.
+func (reg *registry) mediaTypeRuleFor(name string) *mediaTypeRule {
+	var fallback *mediaTypeRule
+	for i, rule := range reg.mediaTypes {
+		if rule.pattern == "" {
+			if fallback == nil {
+				fallback = &reg.mediaTypes[i]
+			}
+			continue
+		}
+		if ok, _ := path.Match(rule.pattern, name); ok {
+			return &reg.mediaTypes[i]
+		}
+	}
+	return fallback
+}
+
+// verifyMediaTypes checks the media type of the manifest, and of the layers
+// of an image manifest, against the rule applying to the named repository.
+func (reg *registry) verifyMediaTypes(name string, manifest distribution.Manifest) error {
+	rule := reg.mediaTypeRuleFor(name)
+	if rule == nil {
+		return nil
+	}
+
+	var errs distribution.ErrManifestVerification
+	if len(rule.manifests) > 0 {
+		mediaType, _, err := manifest.Payload()
+		if err != nil {
+			return err
+		}
+		if !slices.Contains(rule.manifests, mediaType) {
+			errs = append(errs, distribution.ErrManifestFieldInvalid{
+				Field:  "mediaType",
+				Reason: fmt.Errorf("media type %q is not allowed", mediaType),
+			})
+		}
+	}
+
+	if len(rule.layers) > 0 {
+		var layers []distribution.Descriptor
+		switch m := manifest.(type) {
+		case *schema2.DeserializedManifest:
+			layers = m.Layers
+		case *ocischema.DeserializedManifest:
+			layers = m.Layers
+		}
+		for i, layer := range layers {
+			if !slices.Contains(rule.layers, layer.MediaType) {
+				errs = append(errs, distribution.ErrManifestFieldInvalid{
+					Field:  fmt.Sprintf("layers[%d].mediaType", i),
+					Reason: fmt.Errorf("media type %q is not allowed", layer.MediaType),
+				})
+			}
+		}
+	}
+
+	if len(errs) != 0 {
+		return errs
+	}
+	return nil
+}
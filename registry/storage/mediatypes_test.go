@@ -0,0 +1,148 @@
+package storage
+
+import (
+	"errors"
+	"io"
+	"strings"
+	"testing"
+
+	"github.com/distribution/distribution/v3"
+	"github.com/distribution/distribution/v3/internal/dcontext"
+	"github.com/distribution/distribution/v3/manifest/ocischema"
+	"github.com/distribution/distribution/v3/manifest/schema2"
+	"github.com/distribution/distribution/v3/registry/storage/driver/inmemory"
+	"github.com/distribution/distribution/v3/testutil"
+	"github.com/opencontainers/go-digest"
+	"github.com/opencontainers/image-spec/specs-go"
+	v1 "github.com/opencontainers/image-spec/specs-go/v1"
+)
+
+// makeMediaTypeManifests uploads a config and a layer to the repository, and
+// returns a schema 2 and an OCI image manifest referencing them, with a layer
+// of layerMediaType.
+func makeMediaTypeManifests(t *testing.T, repository distribution.Repository, layerMediaType string) []distribution.Manifest {
+	ctx := dcontext.Background()
+	config := digest.FromString("{}")
+	if err := testutil.UploadBlobs(repository, map[digest.Digest]io.ReadSeeker{config: strings.NewReader("{}")}); err != nil {
+		t.Fatalf("config upload failed: %v", err)
+	}
+	layers, err := testutil.CreateRandomLayers(1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := testutil.UploadBlobs(repository, layers); err != nil {
+		t.Fatalf("layer upload failed: %v", err)
+	}
+	var layer v1.Descriptor
+	for dgst := range layers {
+		layer, err = repository.Blobs(ctx).Stat(ctx, dgst)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	layer.MediaType = layerMediaType
+
+	docker, err := schema2.FromStruct(schema2.Manifest{
+		Versioned: specs.Versioned{SchemaVersion: 2},
+		MediaType: schema2.MediaTypeManifest,
+		Config:    v1.Descriptor{MediaType: schema2.MediaTypeImageConfig, Digest: config, Size: 2},
+		Layers:    []v1.Descriptor{layer},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	oci, err := ocischema.FromStruct(ocischema.Manifest{
+		Versioned: specs.Versioned{SchemaVersion: 2},
+		MediaType: v1.MediaTypeImageManifest,
+		Config:    v1.Descriptor{MediaType: v1.MediaTypeImageConfig, Digest: config, Size: 2},
+		Layers:    []v1.Descriptor{layer},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return []distribution.Manifest{docker, oci}
+}
+
+// checkMediaTypeRejected checks that err rejects the media type of field.
+func checkMediaTypeRejected(t *testing.T, err error, field string) {
+	t.Helper()
+	var verification distribution.ErrManifestVerification
+	if !errors.As(err, &verification) || len(verification) != 1 {
+		t.Fatalf("expected a manifest verification error, got %v", err)
+	}
+	var invalid distribution.ErrManifestFieldInvalid
+	if !errors.As(verification[0], &invalid) || invalid.Field != field {
+		t.Fatalf("expected field %s to be invalid, got %v", field, verification[0])
+	}
+}
+
+func TestAllowMediaTypesManifests(t *testing.T) {
+	ctx := dcontext.Background()
+	registry := createRegistry(t, inmemory.New(),
+		AllowMediaTypes("", []string{v1.MediaTypeImageManifest}, nil))
+	repo := makeRepository(t, registry, "mediatypes")
+	manifests := makeManifestService(t, repo)
+
+	mfsts := makeMediaTypeManifests(t, repo, v1.MediaTypeImageLayerGzip)
+	_, err := manifests.Put(ctx, mfsts[0])
+	checkMediaTypeRejected(t, err, "mediaType")
+	if !strings.Contains(err.Error(), schema2.MediaTypeManifest) {
+		t.Fatalf("expected the error to name the rejected media type: %v", err)
+	}
+
+	if _, err := manifests.Put(ctx, mfsts[1]); err != nil {
+		t.Fatalf("unexpected error putting an allowed manifest: %v", err)
+	}
+}
+
+func TestAllowMediaTypesLayers(t *testing.T) {
+	ctx := dcontext.Background()
+	registry := createRegistry(t, inmemory.New(),
+		AllowMediaTypes("", nil, []string{v1.MediaTypeImageLayerGzip, schema2.MediaTypeLayer}))
+	repo := makeRepository(t, registry, "mediatypes")
+	manifests := makeManifestService(t, repo)
+
+	for _, mfst := range makeMediaTypeManifests(t, repo, v1.MediaTypeImageLayerGzip) {
+		if _, err := manifests.Put(ctx, mfst); err != nil {
+			t.Fatalf("unexpected error putting %T with an allowed layer: %v", mfst, err)
+		}
+	}
+	for _, mfst := range makeMediaTypeManifests(t, repo, "application/vnd.example.layer") {
+		_, err := manifests.Put(ctx, mfst)
+		checkMediaTypeRejected(t, err, "layers[0].mediaType")
+	}
+}
+
+func TestAllowMediaTypesRepositories(t *testing.T) {
+	ctx := dcontext.Background()
+	registry := createRegistry(t, inmemory.New(),
+		AllowMediaTypes("artifacts/*", nil, nil),
+		AllowMediaTypes("legacy/*", []string{schema2.MediaTypeManifest}, nil),
+		AllowMediaTypes("", []string{v1.MediaTypeImageManifest}, nil))
+
+	for _, tc := range []struct {
+		name     string
+		rejected []bool
+	}{
+		{name: "library/image", rejected: []bool{true, false}},
+		{name: "legacy/image", rejected: []bool{false, true}},
+		{name: "artifacts/image", rejected: []bool{false, false}},
+	} {
+		repo := makeRepository(t, registry, tc.name)
+		manifests := makeManifestService(t, repo)
+		for i, mfst := range makeMediaTypeManifests(t, repo, v1.MediaTypeImageLayerGzip) {
+			_, err := manifests.Put(ctx, mfst)
+			if tc.rejected[i] {
+				checkMediaTypeRejected(t, err, "mediaType")
+			} else if err != nil {
+				t.Fatalf("%s: unexpected error putting %T: %v", tc.name, mfst, err)
+			}
+		}
+	}
+}
+
+func TestAllowMediaTypesInvalidPattern(t *testing.T) {
+	if _, err := NewRegistry(dcontext.Background(), inmemory.New(), AllowMediaTypes("[", nil, nil)); err == nil {
+		t.Fatal("expected an error for an invalid repository pattern")
+	}
+}
@@ -14,10 +14,12 @@ import (
 
 // ocischemaManifestHandler is a ManifestHandler that covers ocischema manifests.
 type ocischemaManifestHandler struct {
-	repository   distribution.Repository
-	blobStore    distribution.BlobStore
-	ctx          context.Context
-	manifestURLs manifestURLs
+	repository       distribution.Repository
+	blobStore        distribution.BlobStore
+	ctx              context.Context
+	manifestURLs     manifestURLs
+	validateSubjects validateSubjects
+	layers           layerVerifier
 }
 
 var _ ManifestHandler = &ocischemaManifestHandler{}
@@ -69,7 +71,12 @@ func (ms *ocischemaManifestHandler) verifyManifest(ctx context.Context, mnfst oc
 		return fmt.Errorf("unrecognized manifest schema version %d", mnfst.Manifest.SchemaVersion)
 	}
 
+	errs = append(errs, verifySubject(ctx, ms.blobStore, &mnfst, ms.validateSubjects.exist && !skipDependencyVerification)...)
+
 	if skipDependencyVerification {
+		if len(errs) != 0 {
+			return errs
+		}
 		return nil
 	}
 
@@ -80,10 +87,10 @@ func (ms *ocischemaManifestHandler) verifyManifest(ctx context.Context, mnfst oc
 
 	blobsService := ms.repository.Blobs(ctx)
 
-	for _, descriptor := range mnfst.References() {
+	for i, descriptor := range mnfst.References() {
 		err := descriptor.Digest.Validate()
 		if err != nil {
-			errs = append(errs, err, distribution.ErrManifestBlobUnknown{Digest: descriptor.Digest})
+			errs = append(errs, err, blobUnknown(i, descriptor))
 			continue
 		}
 
@@ -105,7 +112,7 @@ func (ms *ocischemaManifestHandler) verifyManifest(ctx context.Context, mnfst oc
 				if len(descriptor.URLs) == 0 ||
 					(descriptor.MediaType == v1.MediaTypeImageLayer || descriptor.MediaType == v1.MediaTypeImageLayerGzip) {
 
-					_, err = blobsService.Stat(ctx, descriptor.Digest)
+					err = ms.layers.stat(ctx, blobsService, descriptor)
 				}
 			}
 
@@ -122,7 +129,11 @@ func (ms *ocischemaManifestHandler) verifyManifest(ctx context.Context, mnfst oc
 			fallthrough // double check the blob store.
 		default:
 			// check the presence
-			_, err = blobsService.Stat(ctx, descriptor.Digest)
+			if i > 0 {
+				err = ms.layers.stat(ctx, blobsService, descriptor)
+			} else {
+				_, err = blobsService.Stat(ctx, descriptor.Digest)
+			}
 		}
 
 		if err != nil {
@@ -131,7 +142,7 @@ func (ms *ocischemaManifestHandler) verifyManifest(ctx context.Context, mnfst oc
 			}
 
 			// On error here, we always append unknown blob errors.
-			errs = append(errs, distribution.ErrManifestBlobUnknown{Digest: descriptor.Digest})
+			errs = append(errs, blobUnknown(i, descriptor))
 		}
 	}
 
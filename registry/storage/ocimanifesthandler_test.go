@@ -2,6 +2,7 @@ package storage
 
 import (
 	"context"
+	"encoding/json"
 	"regexp"
 	"strings"
 	"testing"
@@ -64,7 +65,7 @@ func TestVerifyOCIManifestNonDistributableLayer(t *testing.T) {
 		{
 			nonDistributableLayer,
 			nil,
-			distribution.ErrManifestBlobUnknown{Digest: nonDistributableLayer.Digest},
+			distribution.ErrManifestBlobUnknown{Digest: nonDistributableLayer.Digest, Field: "layers[0]", MediaType: nonDistributableLayer.MediaType},
 		},
 		{
 			layer,
@@ -328,3 +329,147 @@ func TestVerifyOCIManifestBlobLayerAndConfig(t *testing.T) {
 		checkFn(m, c.Err)
 	}
 }
+
+func TestVerifyOCIManifestSubject(t *testing.T) {
+	ctx := context.Background()
+	registry := createRegistry(t, inmemory.New(), EnableValidateSubjectsExist)
+	repo := makeRepository(t, registry, strings.ToLower(t.Name()))
+	manifestService := makeManifestService(t, repo)
+
+	subject := uploadRandomOCIImage(t, repo)
+	_, payload, err := subject.manifest.Payload()
+	if err != nil {
+		t.Fatal(err)
+	}
+	subjectDescriptor := v1.Descriptor{MediaType: v1.MediaTypeImageManifest, Digest: subject.manifestDigest, Size: int64(len(payload))}
+
+	config, err := repo.Blobs(ctx).Put(ctx, v1.MediaTypeEmptyJSON, []byte("{}"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	withSubject := func(change func(*v1.Descriptor)) *v1.Descriptor {
+		desc := subjectDescriptor
+		change(&desc)
+		return &desc
+	}
+
+	cases := []struct {
+		name         string
+		subject      *v1.Descriptor
+		artifactType string
+		field        string
+	}{
+		{
+			name:         "valid",
+			subject:      &subjectDescriptor,
+			artifactType: "application/vnd.example.signature+json",
+		},
+		{
+			name:    "malformed digest",
+			subject: withSubject(func(desc *v1.Descriptor) { desc.Digest = "sha256:nothex" }),
+			field:   "subject.digest",
+		},
+		{
+			name:    "not a manifest media type",
+			subject: withSubject(func(desc *v1.Descriptor) { desc.MediaType = v1.MediaTypeImageLayerGzip }),
+			field:   "subject.mediaType",
+		},
+		{
+			name:         "invalid artifact type",
+			subject:      &subjectDescriptor,
+			artifactType: "signature",
+			field:        "artifactType",
+		},
+		{
+			name:    "unknown subject",
+			subject: withSubject(func(desc *v1.Descriptor) { desc.Digest = digest.FromString("unknown") }),
+			field:   "subject",
+		},
+		{
+			name:    "size mismatch",
+			subject: withSubject(func(desc *v1.Descriptor) { desc.Size++ }),
+			field:   "subject.size",
+		},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			dm, err := ocischema.FromStruct(ocischema.Manifest{
+				Versioned:    specs.Versioned{SchemaVersion: 2},
+				MediaType:    v1.MediaTypeImageManifest,
+				ArtifactType: c.artifactType,
+				Config:       config,
+				Layers:       []v1.Descriptor{},
+				Subject:      c.subject,
+			})
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			_, err = manifestService.Put(ctx, dm)
+			if c.field == "" {
+				if err != nil {
+					t.Fatalf("unexpected error: %v", err)
+				}
+				return
+			}
+			verr, ok := err.(distribution.ErrManifestVerification)
+			if !ok || len(verr) != 1 {
+				t.Fatalf("expected a verification error of field %s, got %v", c.field, err)
+			}
+			if ferr, ok := verr[0].(distribution.ErrManifestFieldInvalid); !ok || ferr.Field != c.field {
+				t.Fatalf("expected a verification error of field %s, got %v", c.field, verr[0])
+			}
+		})
+	}
+}
+
+func TestVerifyOCIIndexSubject(t *testing.T) {
+	ctx := context.Background()
+	registry := createRegistry(t, inmemory.New())
+	repo := makeRepository(t, registry, strings.ToLower(t.Name()))
+	manifestService := makeManifestService(t, repo)
+
+	// The subject does not need to exist by default.
+	subject := &v1.Descriptor{MediaType: v1.MediaTypeImageManifest, Digest: digest.FromString("unknown"), Size: 1}
+	for _, c := range []struct {
+		subject      *v1.Descriptor
+		artifactType string
+		field        string
+	}{
+		{subject: subject, artifactType: "application/vnd.example.bundle"},
+		{subject: &v1.Descriptor{MediaType: "application/octet-stream", Digest: subject.Digest}, field: "subject.mediaType"},
+		{subject: subject, artifactType: "application/vnd.example bundle", field: "artifactType"},
+	} {
+		content, err := json.Marshal(ocischema.ImageIndex{
+			Versioned:    specs.Versioned{SchemaVersion: 2},
+			MediaType:    v1.MediaTypeImageIndex,
+			ArtifactType: c.artifactType,
+			Manifests:    []v1.Descriptor{},
+			Subject:      c.subject,
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		di := &ocischema.DeserializedImageIndex{}
+		if err := di.UnmarshalJSON(content); err != nil {
+			t.Fatal(err)
+		}
+
+		_, err = manifestService.Put(ctx, di)
+		if c.field == "" {
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			continue
+		}
+		verr, ok := err.(distribution.ErrManifestVerification)
+		if !ok || len(verr) != 1 {
+			t.Fatalf("expected a verification error of field %s, got %v", c.field, err)
+		}
+		if ferr, ok := verr[0].(distribution.ErrManifestFieldInvalid); !ok || ferr.Field != c.field {
+			t.Fatalf("expected a verification error of field %s, got %v", c.field, verr[0])
+		}
+	}
+}
@@ -34,7 +34,11 @@ const (
 //	        ├── _manifests
 //	        │   ├── revisions
 //	        │   │   └── <manifest digest path>
-//	        │   │       └── link
+//	        │   │       ├── link
+//	        │   │       └── _referrers
+//	        │   │           └── <algorithm>
+//	        │   │               └── <hex digest>
+//	        │   │                   └── link
 //	        │   └── tags
 //	        │       └── <tag>
 //	        │           ├── current
@@ -49,6 +53,7 @@ const (
 //	                ├── hashstates
 //	                │   └── <algorithm>
 //	                │       └── <offset>
+//	                ├── session
 //	                └── startedat
 //
 // The storage backend layout is broken up into a content-addressable blob
@@ -73,7 +78,9 @@ const (
 // implied as to the ordering of changes to a manifest. The tag store provides
 // support for name, tag lookups of manifests, using "current/link" under a
 // named tag directory. An index is maintained to support deletions of all
-// revisions of a given manifest tag.
+// revisions of a given manifest tag. The manifests whose subject is a revision
+// are linked under its "_referrers" directory, so that they are listed without
+// reading all the manifests of the repository.
 //
 // We cover the path formats implemented by this path mapper below.
 //
@@ -88,6 +95,11 @@ const (
 //	manifestRevisionPathSpec:      <root>/v2/repositories/<name>/_manifests/revisions/<algorithm>/<hex digest>/
 //	manifestRevisionLinkPathSpec:  <root>/v2/repositories/<name>/_manifests/revisions/<algorithm>/<hex digest>/link
 //
+//	Referrers:
+//
+//	manifestReferrersPathSpec:          <root>/v2/repositories/<name>/_manifests/revisions/<algorithm>/<hex digest>/_referrers/
+//	manifestReferrerLinkPathSpec:       <root>/v2/repositories/<name>/_manifests/revisions/<algorithm>/<hex digest>/_referrers/<algorithm>/<hex digest>/link
+//
 //	Tags:
 //
 //	manifestTagsPathSpec:                  <root>/v2/repositories/<name>/_manifests/tags/
@@ -107,12 +119,33 @@ const (
 //	uploadDataPathSpec:             <root>/v2/repositories/<name>/_uploads/<id>/data
 //	uploadStartedAtPathSpec:        <root>/v2/repositories/<name>/_uploads/<id>/startedat
 //	uploadHashStatePathSpec:        <root>/v2/repositories/<name>/_uploads/<id>/hashstates/<algorithm>/<offset>
+//	uploadSessionPathSpec:          <root>/v2/repositories/<name>/_uploads/<id>/session
+//
+//	Renames:
+//
+//	repositoryMovedPathSpec:        <root>/v2/repositories/<name>/_moved
+//
+//	Quotas:
+//
+//	quotaUsagePathSpec:             <root>/v2/repositories/<name>/_quota/usage
+//
+//	Statistics:
+//
+//	pullStatsPathSpec:              <root>/v2/repositories/<name>/_stats/pulls
+//	lastAccessPathSpec:             <root>/v2/repositories/<name>/_stats/<lastpulled|lastpushed>
+//	lastAccessPathSpec:             <root>/v2/repositories/<name>/_stats/tags/<tag>/<lastpulled|lastpushed>
+//
+//	Catalog:
+//
+//	catalogIndexPathSpec:           <root>/v2/_catalog/index
 //
 //	Blob Store:
 //
 //	blobsPathSpec:                  <root>/v2/blobs/
 //	blobPathSpec:                   <root>/v2/blobs/<algorithm>/<first two hex bytes of digest>/<hex digest>
 //	blobDataPathSpec:               <root>/v2/blobs/<algorithm>/<first two hex bytes of digest>/<hex digest>/data
+//	blobQuarantinePathSpec:         <root>/v2/blobs/<algorithm>/<first two hex bytes of digest>/<hex digest>/quarantined
+//	scrubQuarantinePathSpec:        <root>/v2/quarantine/<algorithm>/<first two hex bytes of digest>/<hex digest>/data
 //
 // For more information on the semantic meaning of each path and their
 // contents, please see the path spec documentation.
@@ -154,6 +187,25 @@ func pathFor(spec pathSpec) (string, error) {
 		}
 
 		return path.Join(root, "link"), nil
+	case manifestReferrersPathSpec:
+		root, err := pathFor(manifestRevisionPathSpec{name: v.name, revision: v.subject})
+		if err != nil {
+			return "", err
+		}
+
+		return path.Join(root, referrersDirectory), nil
+	case manifestReferrerLinkPathSpec:
+		root, err := pathFor(manifestReferrersPathSpec{name: v.name, subject: v.subject})
+		if err != nil {
+			return "", err
+		}
+
+		components, err := digestPathComponents(v.revision, false)
+		if err != nil {
+			return "", err
+		}
+
+		return path.Join(root, path.Join(components...), "link"), nil
 	case manifestTagsPathSpec:
 		return path.Join(append(repoPrefix, v.name, "_manifests", "tags")...), nil
 	case manifestTagPathSpec:
@@ -237,6 +289,24 @@ func pathFor(spec pathSpec) (string, error) {
 		components = append(components, "data")
 		blobPathPrefix := append(rootPrefix, "blobs")
 		return path.Join(append(blobPathPrefix, components...)...), nil
+	case blobQuarantinePathSpec:
+		components, err := digestPathComponents(v.digest, true)
+		if err != nil {
+			return "", err
+		}
+
+		components = append(components, "quarantined")
+		blobPathPrefix := append(rootPrefix, "blobs")
+		return path.Join(append(blobPathPrefix, components...)...), nil
+	case scrubQuarantinePathSpec:
+		components, err := digestPathComponents(v.digest, true)
+		if err != nil {
+			return "", err
+		}
+
+		components = append(components, "data")
+		quarantinePathPrefix := append(rootPrefix, "quarantine")
+		return path.Join(append(quarantinePathPrefix, components...)...), nil
 
 	case uploadDataPathSpec:
 		return path.Join(append(repoPrefix, v.name, "_uploads", v.id, "data")...), nil
@@ -248,8 +318,27 @@ func pathFor(spec pathSpec) (string, error) {
 			offset = "" // Limit to the prefix for listing offsets.
 		}
 		return path.Join(append(repoPrefix, v.name, "_uploads", v.id, "hashstates", string(v.alg), offset)...), nil
+	case uploadSessionPathSpec:
+		return path.Join(append(repoPrefix, v.name, "_uploads", v.id, "session")...), nil
+	case repositoryMovedPathSpec:
+		return path.Join(append(repoPrefix, v.name, "_moved")...), nil
+	case quotaUsagePathSpec:
+		return path.Join(append(repoPrefix, v.name, "_quota", "usage")...), nil
+	case pullStatsPathSpec:
+		return path.Join(append(repoPrefix, v.name, "_stats", "pulls")...), nil
+	case lastAccessPathSpec:
+		if v.tag != "" {
+			return path.Join(append(repoPrefix, v.name, "_stats", "tags", v.tag, v.access)...), nil
+		}
+		return path.Join(append(repoPrefix, v.name, "_stats", v.access)...), nil
 	case repositoriesRootPathSpec:
 		return path.Join(repoPrefix...), nil
+	case catalogIndexPathSpec:
+		return path.Join(append(rootPrefix, "_catalog", "index")...), nil
+	case readOnlyMarkerPathSpec:
+		return path.Join(append(rootPrefix, "_readonly")...), nil
+	case healthProbePathSpec:
+		return path.Join(append(rootPrefix, "_health", v.name)...), nil
 	default:
 		// TODO(sday): This is an internal error. Ensure it doesn't escape (panic?).
 		return "", fmt.Errorf("unknown path spec: %#v", v)
@@ -298,6 +387,30 @@ type manifestRevisionLinkPathSpec struct {
 
 func (manifestRevisionLinkPathSpec) pathSpec() {}
 
+// referrersDirectory is the directory of a manifest revision under which the
+// manifests whose subject it is are linked.
+const referrersDirectory = "_referrers"
+
+// manifestReferrersPathSpec describes the directory path of the links to the
+// manifests whose subject is a manifest revision.
+type manifestReferrersPathSpec struct {
+	name    string
+	subject digest.Digest
+}
+
+func (manifestReferrersPathSpec) pathSpec() {}
+
+// manifestReferrerLinkPathSpec describes the path of the link to a manifest
+// revision whose subject is another one. The contents of this file should
+// just be the digest of the manifest.
+type manifestReferrerLinkPathSpec struct {
+	name     string
+	subject  digest.Digest
+	revision digest.Digest
+}
+
+func (manifestReferrerLinkPathSpec) pathSpec() {}
+
 // manifestTagsPathSpec describes the path elements required to point to the
 // manifest tags directory.
 type manifestTagsPathSpec struct {
@@ -408,6 +521,23 @@ type blobDataPathSpec struct {
 
 func (blobDataPathSpec) pathSpec() {}
 
+// blobQuarantinePathSpec contains the path of the marker of a blob whose
+// content was found not to match its digest. It holds the digest of the
+// content read.
+type blobQuarantinePathSpec struct {
+	digest digest.Digest
+}
+
+func (blobQuarantinePathSpec) pathSpec() {}
+
+// scrubQuarantinePathSpec contains the path the content of a blob found by a
+// scrub not to match its digest is moved to, out of the blob store.
+type scrubQuarantinePathSpec struct {
+	digest digest.Digest
+}
+
+func (scrubQuarantinePathSpec) pathSpec() {}
+
 // uploadDataPathSpec defines the path parameters of the data file for
 // uploads.
 type uploadDataPathSpec struct {
@@ -445,11 +575,80 @@ type uploadHashStatePathSpec struct {
 
 func (uploadHashStatePathSpec) pathSpec() {}
 
+// uploadSessionPathSpec defines the path parameters for the file that stores
+// the session of an upload, its offset and the hash function state at it
+// when the upload was last closed, so that any registry instance can resume
+// it.
+type uploadSessionPathSpec struct {
+	name string
+	id   string
+}
+
+func (uploadSessionPathSpec) pathSpec() {}
+
+// repositoryMovedPathSpec describes the path of the marker left by the rename
+// of a repository, redirecting the clients of its previous name to the new
+// one.
+type repositoryMovedPathSpec struct {
+	name string
+}
+
+func (repositoryMovedPathSpec) pathSpec() {}
+
+// quotaUsagePathSpec describes the path of the usage of the quota of a
+// repository, when it is kept in the storage.
+type quotaUsagePathSpec struct {
+	name string
+}
+
+func (quotaUsagePathSpec) pathSpec() {}
+
+// pullStatsPathSpec describes the path of the pull counts of a repository,
+// when they are kept in the storage.
+type pullStatsPathSpec struct {
+	name string
+}
+
+func (pullStatsPathSpec) pathSpec() {}
+
+// lastAccessPathSpec describes the path of the timestamp of the last access
+// of a repository, or of one of its tags if set, where access is lastpulled
+// or lastpushed.
+type lastAccessPathSpec struct {
+	name   string
+	tag    string
+	access string
+}
+
+func (lastAccessPathSpec) pathSpec() {}
+
 // repositoriesRootPathSpec returns the root of repositories
 type repositoriesRootPathSpec struct{}
 
 func (repositoriesRootPathSpec) pathSpec() {}
 
+// catalogIndexPathSpec describes the path of the index of the names of the
+// repositories, when it is kept in the storage. It is outside of the
+// repositories, so that the walk reconciling it never sees it.
+type catalogIndexPathSpec struct{}
+
+func (catalogIndexPathSpec) pathSpec() {}
+
+// readOnlyMarkerPathSpec describes the path of the marker of the read-only
+// mode of the registry, when it persists across restarts.
+type readOnlyMarkerPathSpec struct{}
+
+func (readOnlyMarkerPathSpec) pathSpec() {}
+
+// healthProbePathSpec describes the path of the object written by the write
+// probe of an instance of the registry. It is outside of the repositories and
+// the blobs, so that the catalog and the garbage collection never see it.
+type healthProbePathSpec struct {
+	name string
+}
+
+func (healthProbePathSpec) pathSpec() {}
+
 // digestPathComponents provides a consistent path breakdown for a given
 // digest. For a generic digest, it will be as follows:
 //
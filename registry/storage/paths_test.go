@@ -25,6 +25,14 @@ func TestPathMapper(t *testing.T) {
 			},
 			expected: "/docker/registry/v2/repositories/foo/bar/_manifests/revisions/sha256/abcdef0123456789abcdef0123456789abcdef0123456789abcdef0123456789/link",
 		},
+		{
+			spec: manifestReferrerLinkPathSpec{
+				name:     "foo/bar",
+				subject:  "sha256:abcdef0123456789abcdef0123456789abcdef0123456789abcdef0123456789",
+				revision: "sha256:0123456789abcdef0123456789abcdef0123456789abcdef0123456789abcdef",
+			},
+			expected: "/docker/registry/v2/repositories/foo/bar/_manifests/revisions/sha256/abcdef0123456789abcdef0123456789abcdef0123456789abcdef0123456789/_referrers/sha256/0123456789abcdef0123456789abcdef0123456789abcdef0123456789abcdef/link",
+		},
 		{
 			spec: manifestTagsPathSpec{
 				name: "foo/bar",
@@ -68,6 +76,12 @@ func TestPathMapper(t *testing.T) {
 			},
 			expected: "/docker/registry/v2/repositories/foo/bar/_manifests/tags/thetag/index/sha256/abcdef0123456789abcdef0123456789abcdef0123456789abcdef0123456789/link",
 		},
+		{
+			spec: scrubQuarantinePathSpec{
+				digest: "sha256:abcdef0123456789abcdef0123456789abcdef0123456789abcdef0123456789",
+			},
+			expected: "/docker/registry/v2/quarantine/sha256/ab/abcdef0123456789abcdef0123456789abcdef0123456789abcdef0123456789/data",
+		},
 
 		{
 			spec: uploadDataPathSpec{
@@ -83,10 +97,37 @@ func TestPathMapper(t *testing.T) {
 			},
 			expected: "/docker/registry/v2/repositories/foo/bar/_uploads/asdf-asdf-asdf-adsf/startedat",
 		},
+		{
+			spec: uploadSessionPathSpec{
+				name: "foo/bar",
+				id:   "asdf-asdf-asdf-adsf",
+			},
+			expected: "/docker/registry/v2/repositories/foo/bar/_uploads/asdf-asdf-asdf-adsf/session",
+		},
 		{
 			spec:     layersPathSpec{name: "foo/bar"},
 			expected: "/docker/registry/v2/repositories/foo/bar/_layers",
 		},
+		{
+			spec:     repositoryMovedPathSpec{name: "foo/bar"},
+			expected: "/docker/registry/v2/repositories/foo/bar/_moved",
+		},
+		{
+			spec:     quotaUsagePathSpec{name: "foo/bar"},
+			expected: "/docker/registry/v2/repositories/foo/bar/_quota/usage",
+		},
+		{
+			spec:     readOnlyMarkerPathSpec{},
+			expected: "/docker/registry/v2/_readonly",
+		},
+		{
+			spec:     healthProbePathSpec{name: "probe"},
+			expected: "/docker/registry/v2/_health/probe",
+		},
+		{
+			spec:     catalogIndexPathSpec{},
+			expected: "/docker/registry/v2/_catalog/index",
+		},
 	} {
 		p, err := pathFor(testcase.spec)
 		if err != nil {
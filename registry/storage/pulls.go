@@ -0,0 +1,158 @@
+package storage
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"maps"
+	"sync"
+
+	"github.com/distribution/distribution/v3/registry/storage/cache"
+	"github.com/distribution/distribution/v3/registry/storage/driver"
+)
+
+// PullCounts counts the pulls of the manifests of the repositories, by the
+// tag or digest they were pulled by. The pulls are counted in memory, and
+// added to the counts kept by the provider when flushed, so that the store is
+// written once per repository pulled at each flush rather than on every
+// pull.
+type PullCounts struct {
+	provider cache.PullCountProvider
+
+	mu      sync.Mutex
+	pending map[string]map[string]int64 // pending holds the pulls not flushed yet, by repository
+
+	// flushMu serializes the flushes, so that the counts a failed flush puts
+	// back are not overtaken, and the reads with the flushes.
+	flushMu sync.Mutex
+}
+
+// NewPullCounts returns pull counts kept by the provider.
+func NewPullCounts(provider cache.PullCountProvider) *PullCounts {
+	return &PullCounts{provider: provider, pending: map[string]map[string]int64{}}
+}
+
+// Count counts a pull of the manifest of the repository by the reference, a
+// tag or digest.
+func (pc *PullCounts) Count(repo, reference string) {
+	pc.mu.Lock()
+	defer pc.mu.Unlock()
+	counts, ok := pc.pending[repo]
+	if !ok {
+		counts = map[string]int64{}
+		pc.pending[repo] = counts
+	}
+	counts[reference]++
+}
+
+// Counts returns the pull counts of the repository, including the pulls not
+// flushed yet.
+func (pc *PullCounts) Counts(ctx context.Context, repo string) (map[string]int64, error) {
+	// The pulls being flushed are neither pending nor kept by the provider.
+	pc.flushMu.Lock()
+	defer pc.flushMu.Unlock()
+
+	counts, err := pc.provider.PullCounts(ctx, repo)
+	if err != nil {
+		return nil, err
+	}
+	counts = maps.Clone(counts)
+	if counts == nil {
+		counts = map[string]int64{}
+	}
+	pc.mu.Lock()
+	defer pc.mu.Unlock()
+	for reference, count := range pc.pending[repo] {
+		counts[reference] += count
+	}
+	return counts, nil
+}
+
+// Flush adds the pulls counted since the last flush to the counts kept by the
+// provider. The pulls of the repositories failing to be flushed are kept for
+// the next flush.
+func (pc *PullCounts) Flush(ctx context.Context) error {
+	pc.flushMu.Lock()
+	defer pc.flushMu.Unlock()
+
+	pc.mu.Lock()
+	pending := pc.pending
+	pc.pending = map[string]map[string]int64{}
+	pc.mu.Unlock()
+
+	var errs []error
+	for repo, counts := range pending {
+		if err := pc.provider.AddPullCounts(ctx, repo, counts); err != nil {
+			errs = append(errs, err)
+			pc.mu.Lock()
+			for reference, count := range counts {
+				if pc.pending[repo] == nil {
+					pc.pending[repo] = map[string]int64{}
+				}
+				pc.pending[repo][reference] += count
+			}
+			pc.mu.Unlock()
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// storagePullCounts keeps the pull counts in a file of each repository. Its
+// updates are only serialized within the process, so that the instances of
+// the registry sharing the storage should keep the counts in redis instead.
+type storagePullCounts struct {
+	driver driver.StorageDriver
+	mu     sync.Mutex
+}
+
+// NewStoragePullCountProvider returns a PullCountProvider keeping the pull
+// counts of the repositories in the storage.
+func NewStoragePullCountProvider(storageDriver driver.StorageDriver) cache.PullCountProvider {
+	return &storagePullCounts{driver: storageDriver}
+}
+
+func (spc *storagePullCounts) PullCounts(ctx context.Context, repo string) (map[string]int64, error) {
+	spc.mu.Lock()
+	defer spc.mu.Unlock()
+	return spc.read(ctx, repo)
+}
+
+func (spc *storagePullCounts) AddPullCounts(ctx context.Context, repo string, counts map[string]int64) error {
+	spc.mu.Lock()
+	defer spc.mu.Unlock()
+	stored, err := spc.read(ctx, repo)
+	if err != nil {
+		return err
+	}
+	for reference, count := range counts {
+		stored[reference] += count
+	}
+	statsPath, err := pathFor(pullStatsPathSpec{name: repo})
+	if err != nil {
+		return err
+	}
+	content, err := json.Marshal(stored)
+	if err != nil {
+		return err
+	}
+	return spc.driver.PutContent(ctx, statsPath, content)
+}
+
+func (spc *storagePullCounts) read(ctx context.Context, repo string) (map[string]int64, error) {
+	statsPath, err := pathFor(pullStatsPathSpec{name: repo})
+	if err != nil {
+		return nil, err
+	}
+	counts := map[string]int64{}
+	content, err := spc.driver.GetContent(ctx, statsPath)
+	if err != nil {
+		if _, ok := err.(driver.PathNotFoundError); ok {
+			return counts, nil
+		}
+		return nil, err
+	}
+	if err := json.Unmarshal(content, &counts); err != nil {
+		return nil, err
+	}
+	return counts, nil
+}
@@ -0,0 +1,92 @@
+package storage
+
+import (
+	"context"
+	"errors"
+	"maps"
+	"sync"
+	"testing"
+
+	"github.com/distribution/distribution/v3/registry/storage/cache"
+	"github.com/distribution/distribution/v3/registry/storage/cache/cachecheck"
+	"github.com/distribution/distribution/v3/registry/storage/driver/inmemory"
+)
+
+func TestStoragePullCounts(t *testing.T) {
+	cachecheck.CheckPullCounts(t, NewStoragePullCountProvider(inmemory.New()))
+}
+
+// recordingPullCounts records the writes to the pull counts it keeps, and
+// fails them while failing is set.
+type recordingPullCounts struct {
+	cache.PullCountProvider
+	mu      sync.Mutex
+	writes  int
+	failing bool
+}
+
+func (r *recordingPullCounts) AddPullCounts(ctx context.Context, repo string, counts map[string]int64) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.writes++
+	if r.failing {
+		return errors.New("store unavailable")
+	}
+	return r.PullCountProvider.AddPullCounts(ctx, repo, counts)
+}
+
+func TestPullCountsFlush(t *testing.T) {
+	ctx := context.Background()
+	provider := &recordingPullCounts{PullCountProvider: NewStoragePullCountProvider(inmemory.New())}
+	pullCounts := NewPullCounts(provider)
+
+	for range 100 {
+		pullCounts.Count("foo/bar", "latest")
+		pullCounts.Count("foo/baz", "v1")
+	}
+	pullCounts.Count("foo/bar", "sha256:abc")
+
+	// The pulls not flushed yet are counted.
+	counts, err := pullCounts.Counts(ctx, "foo/bar")
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := map[string]int64{"latest": 100, "sha256:abc": 1}
+	if !maps.Equal(counts, expected) {
+		t.Fatalf("unexpected pull counts %v, expected %v", counts, expected)
+	}
+	if provider.writes != 0 {
+		t.Fatalf("expected no write before a flush, got %d", provider.writes)
+	}
+
+	// A flush writes each repository pulled once.
+	if err := pullCounts.Flush(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if provider.writes != 2 {
+		t.Fatalf("expected a write per repository, got %d", provider.writes)
+	}
+	if err := pullCounts.Flush(ctx); err != nil || provider.writes != 2 {
+		t.Fatalf("expected no write flushing no pull, got %d writes: %v", provider.writes, err)
+	}
+
+	// The pulls failing to be flushed are flushed next time.
+	pullCounts.Count("foo/bar", "latest")
+	provider.failing = true
+	if err := pullCounts.Flush(ctx); err == nil {
+		t.Fatal("expected the flush to fail")
+	}
+	pullCounts.Count("foo/bar", "latest")
+	provider.failing = false
+	if err := pullCounts.Flush(ctx); err != nil {
+		t.Fatal(err)
+	}
+	counts, err = provider.PullCounts(ctx, "foo/bar")
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected["latest"] = 102
+	if !maps.Equal(counts, expected) {
+		t.Fatalf("unexpected pull counts %v flushed, expected %v", counts, expected)
+	}
+}
@@ -3,6 +3,7 @@ package storage
 import (
 	"context"
 	"path"
+	"sort"
 	"strings"
 	"time"
 
@@ -16,6 +17,8 @@ import (
 type uploadData struct {
 	containingDir string
 	startedAt     time.Time
+	// size is the total size of the files of the upload.
+	size int64
 }
 
 func newUploadData() uploadData {
@@ -30,10 +33,70 @@ func newUploadData() uploadData {
 // created before olderThan.  The list of files deleted and errors
 // encountered are returned
 func PurgeUploads(ctx context.Context, driver storageDriver.StorageDriver, olderThan time.Time, actuallyDelete bool) ([]string, []error) {
-	logrus.Infof("PurgeUploads starting: olderThan=%s, actuallyDelete=%t", olderThan, actuallyDelete)
-	uploadData, errors := getOutstandingUploads(ctx, driver)
+	uploads, errors := purgeUploads(ctx, driver, olderThan, actuallyDelete)
 	var deleted []string
-	for _, uploadData := range uploadData {
+	for _, uploadData := range uploads {
+		deleted = append(deleted, uploadData.containingDir)
+	}
+	return deleted, errors
+}
+
+// UploadPurgeReport summarizes a purge of the uploads: the uploads it deleted,
+// or would delete with a dry run.
+type UploadPurgeReport struct {
+	DryRun  bool           `json:"dryRun"`
+	Uploads []PurgedUpload `json:"uploads"`
+	// ReclaimedBytes is the total size of Uploads.
+	ReclaimedBytes int64 `json:"reclaimedBytes"`
+}
+
+// PurgedUpload is an upload deleted from a repository, along with the total
+// size of its files: its data, its start date and its hash states.
+type PurgedUpload struct {
+	Repository string    `json:"repository"`
+	ID         string    `json:"id"`
+	StartedAt  time.Time `json:"startedAt"`
+	Size       int64     `json:"size"`
+}
+
+// PurgeStaleUploads deletes the uploads started before olderThan, unless
+// dryRun is set, and returns a report of the uploads deleted along with the
+// errors encountered. The uploads whose start is unknown are never deleted, so
+// that it is safe to run while the registry accepts pushes.
+func PurgeStaleUploads(ctx context.Context, driver storageDriver.StorageDriver, olderThan time.Time, dryRun bool) (*UploadPurgeReport, []error) {
+	report := &UploadPurgeReport{DryRun: dryRun, Uploads: make([]PurgedUpload, 0)}
+	root, err := pathFor(repositoriesRootPathSpec{})
+	if err != nil {
+		return report, []error{err}
+	}
+	uploads, errors := purgeUploads(ctx, driver, olderThan, !dryRun)
+	for id, uploadData := range uploads {
+		repo, _, _ := strings.Cut(strings.TrimPrefix(uploadData.containingDir, root+"/"), "/_uploads/")
+		report.Uploads = append(report.Uploads, PurgedUpload{
+			Repository: repo,
+			ID:         id,
+			StartedAt:  uploadData.startedAt,
+			Size:       uploadData.size,
+		})
+		report.ReclaimedBytes += uploadData.size
+	}
+	sort.Slice(report.Uploads, func(i, j int) bool {
+		a, b := report.Uploads[i], report.Uploads[j]
+		if a.Repository != b.Repository {
+			return a.Repository < b.Repository
+		}
+		return a.ID < b.ID
+	})
+	return report, errors
+}
+
+// purgeUploads deletes the uploads started before olderThan if actuallyDelete
+// is set, and returns the uploads deleted, by UUID.
+func purgeUploads(ctx context.Context, driver storageDriver.StorageDriver, olderThan time.Time, actuallyDelete bool) (map[string]uploadData, []error) {
+	logrus.Infof("PurgeUploads starting: olderThan=%s, actuallyDelete=%t", olderThan, actuallyDelete)
+	uploads, errors := getOutstandingUploads(ctx, driver)
+	deleted := make(map[string]uploadData)
+	for id, uploadData := range uploads {
 		if uploadData.startedAt.Before(olderThan) {
 			var err error
 			logrus.Infof("Upload files in %s have older date (%s) than purge date (%s).  Removing upload directory.",
@@ -42,7 +105,7 @@ func PurgeUploads(ctx context.Context, driver storageDriver.StorageDriver, older
 				err = driver.Delete(ctx, uploadData.containingDir)
 			}
 			if err == nil {
-				deleted = append(deleted, uploadData.containingDir)
+				deleted[id] = uploadData
 			} else {
 				errors = append(errors, err)
 			}
@@ -91,6 +154,8 @@ func getOutstandingUploads(ctx context.Context, driver storageDriver.StorageDriv
 		}
 		if isContainingDir {
 			ud.containingDir = filePath
+		} else if !fileInfo.IsDir() {
+			ud.size += fileInfo.Size()
 		}
 		if file == "startedat" {
 			if t, err := readStartedAtFile(ctx, driver, filePath); err == nil {
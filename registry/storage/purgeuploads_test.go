@@ -163,3 +163,73 @@ func TestPurgeMissingStartedAt(t *testing.T) {
 		t.Errorf("Files unexpectedly deleted: %s", deleted)
 	}
 }
+
+func TestPurgeStaleUploads(t *testing.T) {
+	ctx := context.Background()
+	fs := inmemory.New()
+	week := 7 * 24 * time.Hour
+	staleID, freshID := uuid.NewString(), uuid.NewString()
+	addUploads(ctx, t, fs, staleID, "library/app", time.Now().Add(-2*week))
+	addUploads(ctx, t, fs, freshID, "library/app", time.Now().Add(-time.Hour))
+	for id, data := range map[string]string{staleID: "stale data", freshID: "fresh data"} {
+		dataPath, err := pathFor(uploadDataPathSpec{name: "library/app", id: id})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := fs.PutContent(ctx, dataPath, []byte(data)); err != nil {
+			t.Fatal(err)
+		}
+		hashStatePath, err := pathFor(uploadHashStatePathSpec{name: "library/app", id: id, alg: "sha256", offset: int64(len(data))})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := fs.PutContent(ctx, hashStatePath, []byte("hash state")); err != nil {
+			t.Fatal(err)
+		}
+	}
+	startedAtPath, err := pathFor(uploadStartedAtPathSpec{name: "library/app", id: staleID})
+	if err != nil {
+		t.Fatal(err)
+	}
+	startedAt, err := fs.GetContent(ctx, startedAtPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	staleSize := int64(len("stale data") + len("hash state") + len(startedAt))
+
+	report, errs := PurgeStaleUploads(ctx, fs, time.Now().Add(-week), true)
+	if len(errs) != 0 {
+		t.Fatal("Unexpected errors", errs)
+	}
+	if len(report.Uploads) != 1 || report.Uploads[0].ID != staleID || report.Uploads[0].Repository != "library/app" {
+		t.Fatalf("unexpected uploads eligible for deletion: %+v", report.Uploads)
+	}
+	if report.ReclaimedBytes != staleSize || report.Uploads[0].Size != staleSize {
+		t.Fatalf("%d bytes reclaimable, expected %d", report.ReclaimedBytes, staleSize)
+	}
+	if uploads, _ := getOutstandingUploads(ctx, fs); len(uploads) != 2 {
+		t.Fatalf("dry run deleted uploads, %d left", len(uploads))
+	}
+
+	report, errs = PurgeStaleUploads(ctx, fs, time.Now().Add(-week), false)
+	if len(errs) != 0 {
+		t.Fatal("Unexpected errors", errs)
+	}
+	if report.DryRun || len(report.Uploads) != 1 || report.ReclaimedBytes != staleSize {
+		t.Fatalf("unexpected report: %+v", report)
+	}
+	uploads, _ := getOutstandingUploads(ctx, fs)
+	if _, ok := uploads[freshID]; len(uploads) != 1 || !ok {
+		t.Fatalf("unexpected uploads left: %v", uploads)
+	}
+	for _, id := range []string{staleID, freshID} {
+		dataPath, err := pathFor(uploadDataPathSpec{name: "library/app", id: id})
+		if err != nil {
+			t.Fatal(err)
+		}
+		_, err = fs.Stat(ctx, dataPath)
+		if _, deleted := err.(driver.PathNotFoundError); deleted != (id == staleID) {
+			t.Fatalf("data file of upload %s deleted: %v", id, deleted)
+		}
+	}
+}
@@ -0,0 +1,327 @@
+package storage
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"path"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/distribution/distribution/v3"
+	"github.com/distribution/distribution/v3/registry/storage/cache"
+	"github.com/distribution/distribution/v3/registry/storage/driver"
+	"github.com/distribution/reference"
+	"github.com/opencontainers/go-digest"
+)
+
+// QuotaRule limits the total size in bytes of the layers linked by each of
+// the repositories matching a glob pattern.
+type QuotaRule struct {
+	Pattern string
+	Limit   int64
+}
+
+// Quotas limits the total size of the layers linked by the repositories,
+// with the first rule matching their name. The usage of a repository is
+// charged the size of each blob linked to it, so that a blob shared by
+// several repositories counts against each of them, and is released when
+// the link is deleted, by a client or by the garbage collection.
+type Quotas struct {
+	usage cache.QuotaUsageProvider
+	rules []QuotaRule
+	// tenant, if set, is charged the usage of every repository, within the
+	// limit of the single rule.
+	tenant string
+}
+
+// NewQuotas returns the quotas of the rules, keeping the usage of the
+// repositories in the provider.
+func NewQuotas(usage cache.QuotaUsageProvider, rules ...QuotaRule) (*Quotas, error) {
+	for _, rule := range rules {
+		if _, err := path.Match(rule.Pattern, ""); err != nil || rule.Pattern == "" {
+			return nil, fmt.Errorf("invalid quota repository pattern %q", rule.Pattern)
+		}
+		if rule.Limit <= 0 {
+			return nil, fmt.Errorf("invalid quota limit %d of repositories %q", rule.Limit, rule.Pattern)
+		}
+	}
+	return &Quotas{usage: usage, rules: rules}, nil
+}
+
+// NewTenantQuota returns the quota limiting the total size of the layers
+// linked by all the repositories of the tenant, whose usage is kept in the
+// provider under the name of the tenant.
+func NewTenantQuota(usage cache.QuotaUsageProvider, tenant string, limit int64) (*Quotas, error) {
+	if limit <= 0 {
+		return nil, fmt.Errorf("invalid quota limit %d of tenant %s", limit, tenant)
+	}
+	return &Quotas{usage: usage, rules: []QuotaRule{{Pattern: tenant + "/*", Limit: limit}}, tenant: tenant}, nil
+}
+
+// EnforceQuotas is a functional option for NewRegistry. It refuses to link
+// the layers which would bring a repository over its quota.
+func EnforceQuotas(quotas *Quotas) RegistryOption {
+	return func(registry *registry) error {
+		registry.quotas = quotas
+		return nil
+	}
+}
+
+// Limit returns the limit of the quota of the repository, and false if it
+// has none.
+func (q *Quotas) Limit(name string) (int64, bool) {
+	if q.tenant != "" {
+		return q.rules[0].Limit, true
+	}
+	for _, rule := range q.rules {
+		if ok, _ := path.Match(rule.Pattern, name); ok {
+			return rule.Limit, true
+		}
+	}
+	return 0, false
+}
+
+// Usage returns the usage of the quota of the repository.
+func (q *Quotas) Usage(ctx context.Context, name string) (int64, error) {
+	return q.usage.Usage(ctx, q.key(name))
+}
+
+// key returns the name the usage of the repository is kept under.
+func (q *Quotas) key(name string) string {
+	if q.tenant != "" {
+		return q.tenant
+	}
+	return name
+}
+
+// check returns distribution.ErrQuotaExceeded if linking a blob of size
+// bytes would bring the repository over its quota. It does not charge the
+// blob, which the repositories pushing concurrently may still exceed the
+// quota with until it is charged.
+func (q *Quotas) check(ctx context.Context, name string, size int64) error {
+	if q == nil {
+		return nil
+	}
+	limit, ok := q.Limit(name)
+	if !ok {
+		return nil
+	}
+	usage, err := q.usage.Usage(ctx, q.key(name))
+	if err != nil {
+		return err
+	}
+	if usage+size > limit {
+		return distribution.ErrQuotaExceeded{Repository: name, Usage: usage, Limit: limit, Size: size}
+	}
+	return nil
+}
+
+// charge charges a blob of size bytes to the quota of the repository, or
+// returns distribution.ErrQuotaExceeded without charging it if it would
+// bring the repository over its quota.
+func (q *Quotas) charge(ctx context.Context, name string, size int64) error {
+	if q == nil {
+		return nil
+	}
+	limit, ok := q.Limit(name)
+	if !ok {
+		return nil
+	}
+	usage, err := q.usage.Add(ctx, q.key(name), size)
+	if err != nil {
+		return err
+	}
+	if usage > limit {
+		if _, err := q.usage.Add(ctx, q.key(name), -size); err != nil {
+			return err
+		}
+		return distribution.ErrQuotaExceeded{Repository: name, Usage: usage - size, Limit: limit, Size: size}
+	}
+	return nil
+}
+
+// release releases a blob of size bytes charged to the quota of the
+// repository.
+func (q *Quotas) release(ctx context.Context, name string, size int64) error {
+	if q == nil {
+		return nil
+	}
+	if _, ok := q.Limit(name); !ok {
+		return nil
+	}
+	_, err := q.usage.Add(ctx, q.key(name), -size)
+	return err
+}
+
+// QuotaUsage is the usage of the quota of a repository.
+type QuotaUsage struct {
+	Repository string
+	Usage      int64
+	Limit      int64
+}
+
+// Recalculate replaces the usage of the repositories with a quota by the
+// total size of the layers they link, walking the repositories of the
+// storage, and returns the usages recalculated. The usage of a tenant is the
+// total of its repositories. The layers linked or deleted during the walk may
+// be miscounted until the next recalculation.
+func (q *Quotas) Recalculate(ctx context.Context, storageDriver driver.StorageDriver, registry distribution.Namespace) ([]QuotaUsage, error) {
+	root, err := pathFor(repositoriesRootPathSpec{})
+	if err != nil {
+		return nil, err
+	}
+
+	// The repositories whose layers were pushed without a manifest are not
+	// enumerated by the registry, but count against their quota.
+	var usages []QuotaUsage
+	var tenantUsage int64
+	recalculated := make(map[string]struct{})
+	err = storageDriver.Walk(ctx, root, func(fileInfo driver.FileInfo) error {
+		if !fileInfo.IsDir() {
+			return nil
+		}
+		repoName, file := path.Split(fileInfo.Path()[len(root)+1:])
+		if !strings.HasPrefix(file, "_") {
+			return nil
+		}
+		repoName = strings.TrimSuffix(repoName, "/")
+		if _, ok := recalculated[repoName]; ok || (file != "_layers" && file != "_manifests") {
+			return driver.ErrSkipDir
+		}
+		recalculated[repoName] = struct{}{}
+		limit, ok := q.Limit(repoName)
+		if !ok {
+			return driver.ErrSkipDir
+		}
+		usage, err := q.layersSize(ctx, registry, repoName)
+		if err != nil {
+			return err
+		}
+		if q.tenant != "" {
+			tenantUsage += usage
+			return driver.ErrSkipDir
+		}
+		if err := q.usage.Set(ctx, repoName, usage); err != nil {
+			return err
+		}
+		usages = append(usages, QuotaUsage{Repository: repoName, Usage: usage, Limit: limit})
+		return driver.ErrSkipDir
+	})
+	if _, ok := err.(driver.PathNotFoundError); ok {
+		// No repository was pushed to yet.
+		err = nil
+	}
+	if q.tenant != "" && err == nil {
+		if err := q.usage.Set(ctx, q.tenant, tenantUsage); err != nil {
+			return nil, err
+		}
+		usages = []QuotaUsage{{Repository: q.tenant, Usage: tenantUsage, Limit: q.rules[0].Limit}}
+	}
+	return usages, err
+}
+
+// layersSize returns the total size of the layers linked by the repository.
+func (q *Quotas) layersSize(ctx context.Context, registry distribution.Namespace, repoName string) (int64, error) {
+	named, err := reference.WithName(repoName)
+	if err != nil {
+		return 0, fmt.Errorf("failed to parse repo name %s: %v", repoName, err)
+	}
+	repository, err := registry.Repository(ctx, named)
+	if err != nil {
+		return 0, fmt.Errorf("failed to construct repository: %v", err)
+	}
+	blobs := repository.Blobs(ctx)
+	blobEnumerator, ok := blobs.(distribution.BlobEnumerator)
+	if !ok {
+		return 0, errors.New("unable to convert BlobService into BlobEnumerator")
+	}
+
+	var size int64
+	counted := make(map[digest.Digest]struct{})
+	err = blobEnumerator.Enumerate(ctx, func(dgst digest.Digest) error {
+		desc, err := blobs.Stat(ctx, dgst)
+		if err != nil {
+			if err == distribution.ErrBlobUnknown {
+				// The link of a blob deleted from the blob store.
+				return nil
+			}
+			return err
+		}
+		if _, ok := counted[desc.Digest]; !ok {
+			counted[desc.Digest] = struct{}{}
+			size += desc.Size
+		}
+		return nil
+	})
+	if _, ok := err.(driver.PathNotFoundError); ok {
+		// The repository has no layers.
+		return 0, nil
+	}
+	if err != nil {
+		return 0, fmt.Errorf("failed to enumerate the layers of %s: %v", repoName, err)
+	}
+	return size, nil
+}
+
+// storageQuotaUsage keeps the usage of the quotas in a file of each
+// repository. Its updates are only serialized within the process, so that
+// the instances of the registry sharing the storage should keep the usage
+// in redis instead.
+type storageQuotaUsage struct {
+	driver driver.StorageDriver
+	mu     sync.Mutex
+}
+
+// NewStorageQuotaUsageProvider returns a QuotaUsageProvider keeping the
+// usage of the repositories in the storage.
+func NewStorageQuotaUsageProvider(storageDriver driver.StorageDriver) cache.QuotaUsageProvider {
+	return &storageQuotaUsage{driver: storageDriver}
+}
+
+func (squ *storageQuotaUsage) Usage(ctx context.Context, repo string) (int64, error) {
+	squ.mu.Lock()
+	defer squ.mu.Unlock()
+	return squ.read(ctx, repo)
+}
+
+func (squ *storageQuotaUsage) Add(ctx context.Context, repo string, delta int64) (int64, error) {
+	squ.mu.Lock()
+	defer squ.mu.Unlock()
+	usage, err := squ.read(ctx, repo)
+	if err != nil {
+		return 0, err
+	}
+	usage += delta
+	return usage, squ.write(ctx, repo, usage)
+}
+
+func (squ *storageQuotaUsage) Set(ctx context.Context, repo string, usage int64) error {
+	squ.mu.Lock()
+	defer squ.mu.Unlock()
+	return squ.write(ctx, repo, usage)
+}
+
+func (squ *storageQuotaUsage) read(ctx context.Context, repo string) (int64, error) {
+	usagePath, err := pathFor(quotaUsagePathSpec{name: repo})
+	if err != nil {
+		return 0, err
+	}
+	content, err := squ.driver.GetContent(ctx, usagePath)
+	if err != nil {
+		if _, ok := err.(driver.PathNotFoundError); ok {
+			return 0, nil
+		}
+		return 0, err
+	}
+	return strconv.ParseInt(string(content), 10, 64)
+}
+
+func (squ *storageQuotaUsage) write(ctx context.Context, repo string, usage int64) error {
+	usagePath, err := pathFor(quotaUsagePathSpec{name: repo})
+	if err != nil {
+		return err
+	}
+	return squ.driver.PutContent(ctx, usagePath, []byte(strconv.FormatInt(usage, 10)))
+}
@@ -0,0 +1,230 @@
+package storage
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"testing"
+
+	"github.com/distribution/distribution/v3"
+	"github.com/distribution/distribution/v3/registry/storage/cache/cachecheck"
+	"github.com/distribution/distribution/v3/registry/storage/driver/inmemory"
+	"github.com/distribution/distribution/v3/testutil"
+	"github.com/distribution/reference"
+	"github.com/opencontainers/go-digest"
+	v1 "github.com/opencontainers/image-spec/specs-go/v1"
+)
+
+func newTestQuotas(t *testing.T, rules ...QuotaRule) *Quotas {
+	t.Helper()
+	quotas, err := NewQuotas(NewStorageQuotaUsageProvider(inmemory.New()), rules...)
+	if err != nil {
+		t.Fatalf("error creating quotas: %v", err)
+	}
+	return quotas
+}
+
+func checkQuotaUsage(t *testing.T, quotas *Quotas, name string, expected int64) {
+	t.Helper()
+	if usage, err := quotas.Usage(context.Background(), name); err != nil || usage != expected {
+		t.Fatalf("unexpected usage %d of %s, expected %d: %v", usage, name, expected, err)
+	}
+}
+
+func addTestBlob(ctx context.Context, bs distribution.BlobIngester, size int) (v1.Descriptor, error) {
+	content := bytes.Repeat([]byte{byte(size)}, size)
+	desc := v1.Descriptor{Digest: digest.FromBytes(content), Size: int64(size)}
+	return addBlob(ctx, bs, desc, bytes.NewReader(content))
+}
+
+func TestStorageQuotaUsage(t *testing.T) {
+	cachecheck.CheckQuotaUsage(t, NewStorageQuotaUsageProvider(inmemory.New()))
+}
+
+func TestNewQuotasInvalid(t *testing.T) {
+	usage := NewStorageQuotaUsageProvider(inmemory.New())
+	if _, err := NewQuotas(usage, QuotaRule{Pattern: "ci/[", Limit: 1}); err == nil {
+		t.Fatal("expected error with an invalid pattern")
+	}
+	if _, err := NewQuotas(usage, QuotaRule{Pattern: "ci/*"}); err == nil {
+		t.Fatal("expected error without a limit")
+	}
+}
+
+func TestQuotaEnforcement(t *testing.T) {
+	ctx := context.Background()
+	quotas := newTestQuotas(t, QuotaRule{Pattern: "ci/*", Limit: 100})
+	registry, err := NewRegistry(ctx, inmemory.New(), EnableDelete, EnforceQuotas(quotas))
+	if err != nil {
+		t.Fatalf("error creating registry: %v", err)
+	}
+	bs := makeRepository(t, registry, "ci/app").Blobs(ctx)
+
+	first, err := addTestBlob(ctx, bs, 60)
+	if err != nil {
+		t.Fatalf("unexpected error adding blob: %v", err)
+	}
+	checkQuotaUsage(t, quotas, "ci/app", 60)
+
+	// The blob already linked is not charged again.
+	if _, err := addTestBlob(ctx, bs, 60); err != nil {
+		t.Fatalf("unexpected error adding blob again: %v", err)
+	}
+	checkQuotaUsage(t, quotas, "ci/app", 60)
+
+	// The quota may be reached, but not exceeded.
+	if _, err := addTestBlob(ctx, bs, 40); err != nil {
+		t.Fatalf("unexpected error adding blob up to the limit: %v", err)
+	}
+	checkQuotaUsage(t, quotas, "ci/app", 100)
+
+	_, err = addTestBlob(ctx, bs, 1)
+	expected := distribution.ErrQuotaExceeded{Repository: "ci/app", Usage: 100, Limit: 100, Size: 1}
+	if err != expected {
+		t.Fatalf("unexpected error adding blob over the limit: %v", err)
+	}
+	checkQuotaUsage(t, quotas, "ci/app", 100)
+	if _, err := registry.BlobStatter().Stat(ctx, digest.FromBytes([]byte{1})); err != distribution.ErrBlobUnknown {
+		t.Fatalf("expected the blob over the limit not to be stored: %v", err)
+	}
+
+	// The repositories without a quota are not limited.
+	if _, err := addTestBlob(ctx, makeRepository(t, registry, "prod/app").Blobs(ctx), 200); err != nil {
+		t.Fatalf("unexpected error adding blob to a repository without quota: %v", err)
+	}
+	checkQuotaUsage(t, quotas, "prod/app", 0)
+
+	// Deleting a blob releases its size.
+	if err := bs.Delete(ctx, first.Digest); err != nil {
+		t.Fatalf("unexpected error deleting blob: %v", err)
+	}
+	checkQuotaUsage(t, quotas, "ci/app", 40)
+	if _, err := addTestBlob(ctx, bs, 1); err != nil {
+		t.Fatalf("unexpected error adding blob after delete: %v", err)
+	}
+	checkQuotaUsage(t, quotas, "ci/app", 41)
+}
+
+func TestQuotaMount(t *testing.T) {
+	ctx := context.Background()
+	quotas := newTestQuotas(t, QuotaRule{Pattern: "ci/*", Limit: 100})
+	registry, err := NewRegistry(ctx, inmemory.New(), EnforceQuotas(quotas))
+	if err != nil {
+		t.Fatalf("error creating registry: %v", err)
+	}
+	source := makeRepository(t, registry, "ci/source")
+	large, err := addTestBlob(ctx, source.Blobs(ctx), 80)
+	if err != nil {
+		t.Fatalf("unexpected error adding blob: %v", err)
+	}
+	small, err := addTestBlob(ctx, source.Blobs(ctx), 20)
+	if err != nil {
+		t.Fatalf("unexpected error adding blob: %v", err)
+	}
+	checkQuotaUsage(t, quotas, "ci/source", 100)
+
+	mount := func(bs distribution.BlobStore, desc v1.Descriptor) error {
+		t.Helper()
+		canonical, err := reference.WithDigest(source.Named(), desc.Digest)
+		if err != nil {
+			t.Fatal(err)
+		}
+		bw, err := bs.Create(ctx, WithMountFrom(canonical))
+		if bw != nil {
+			t.Fatal("unexpected blobwriter returned from Create call, should mount instead")
+		}
+		return err
+	}
+
+	// The blobs mounted count against each repository linking them.
+	bs := makeRepository(t, registry, "ci/app").Blobs(ctx)
+	if err := mount(bs, large); err == nil {
+		t.Fatal("expected error mounting blob")
+	} else if _, ok := err.(distribution.ErrBlobMounted); !ok {
+		t.Fatalf("unexpected error mounting blob: %v", err)
+	}
+	checkQuotaUsage(t, quotas, "ci/app", 80)
+	checkQuotaUsage(t, quotas, "ci/source", 100)
+
+	if _, err := addTestBlob(ctx, bs, 15); err != nil {
+		t.Fatalf("unexpected error adding blob: %v", err)
+	}
+
+	// The mount over the quota is refused instead of falling back to an
+	// upload.
+	expected := distribution.ErrQuotaExceeded{Repository: "ci/app", Usage: 95, Limit: 100, Size: 20}
+	if err := mount(bs, small); err != expected {
+		t.Fatalf("unexpected error mounting blob over the limit: %v", err)
+	}
+	checkQuotaUsage(t, quotas, "ci/app", 95)
+	if _, err := bs.Stat(ctx, small.Digest); err != distribution.ErrBlobUnknown {
+		t.Fatalf("expected the blob over the limit not to be linked: %v", err)
+	}
+}
+
+func TestQuotaRecalculate(t *testing.T) {
+	ctx := context.Background()
+	driver := inmemory.New()
+	quotas := newTestQuotas(t, QuotaRule{Pattern: "ci/*", Limit: 1 << 30})
+	registry := createRegistry(t, driver, EnforceQuotas(quotas))
+
+	repo := makeRepository(t, registry, "ci/app")
+	kept := uploadRandomSchema2Image(t, repo)
+	uploadRandomSchema2Image(t, repo)
+	if err := repo.Tags(ctx).Tag(ctx, "latest", v1.Descriptor{Digest: kept.manifestDigest}); err != nil {
+		t.Fatalf("failed to tag manifest: %v", err)
+	}
+	// The layers shared with another repository count against both, even
+	// without a manifest.
+	for _, layer := range kept.layers {
+		if _, err := layer.Seek(0, io.SeekStart); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := testutil.UploadBlobs(makeRepository(t, registry, "ci/other"), kept.layers); err != nil {
+		t.Fatalf("layer upload failed: %v", err)
+	}
+	uploadRandomSchema2Image(t, makeRepository(t, registry, "prod/app"))
+
+	usage, err := quotas.Usage(ctx, "ci/app")
+	if err != nil || usage == 0 {
+		t.Fatalf("unexpected usage %d of ci/app: %v", usage, err)
+	}
+	otherUsage, err := quotas.Usage(ctx, "ci/other")
+	if err != nil || otherUsage == 0 || otherUsage >= usage {
+		t.Fatalf("unexpected usage %d of ci/other: %v", otherUsage, err)
+	}
+
+	// The recalculation finds the usage tracked as the blobs were linked.
+	for _, name := range []string{"ci/app", "ci/other"} {
+		if err := quotas.usage.Set(ctx, name, 12345); err != nil {
+			t.Fatal(err)
+		}
+	}
+	usages, err := quotas.Recalculate(ctx, driver, registry)
+	if err != nil {
+		t.Fatalf("unexpected error recalculating: %v", err)
+	}
+	expected := []QuotaUsage{
+		{Repository: "ci/app", Usage: usage, Limit: 1 << 30},
+		{Repository: "ci/other", Usage: otherUsage, Limit: 1 << 30},
+	}
+	if len(usages) != len(expected) || usages[0] != expected[0] || usages[1] != expected[1] {
+		t.Fatalf("unexpected usages recalculated: %v, expected %v", usages, expected)
+	}
+	checkQuotaUsage(t, quotas, "ci/app", usage)
+	checkQuotaUsage(t, quotas, "ci/other", otherUsage)
+
+	// The garbage collection releases the layers of the untagged manifest.
+	if _, err := GarbageCollect(ctx, driver, registry, GCOpts{RemoveUntagged: true, Quiet: true, Quotas: quotas}); err != nil {
+		t.Fatalf("failed to garbage collect: %v", err)
+	}
+	collected, err := quotas.Usage(ctx, "ci/app")
+	if err != nil || collected == 0 || collected >= usage {
+		t.Fatalf("unexpected usage %d of ci/app after garbage collection: %v", collected, err)
+	}
+	if _, err := quotas.Recalculate(ctx, driver, registry); err != nil {
+		t.Fatalf("unexpected error recalculating: %v", err)
+	}
+	checkQuotaUsage(t, quotas, "ci/app", collected)
+}
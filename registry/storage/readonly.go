@@ -0,0 +1,65 @@
+package storage
+
+import (
+	"context"
+	"encoding/json"
+	"time"
+
+	"github.com/distribution/distribution/v3/registry/storage/driver"
+)
+
+// ReadOnlyMarker marks the registry as read-only in the storage, so that the
+// read-only mode persists across restarts.
+type ReadOnlyMarker struct {
+	// Message is returned to the clients whose writes are refused.
+	Message string `json:"message,omitempty"`
+	// Since is when the registry was made read-only.
+	Since time.Time `json:"since"`
+}
+
+// GetReadOnlyMarker returns the read-only marker of the storage, or nil if
+// the registry is not marked read-only.
+func GetReadOnlyMarker(ctx context.Context, storageDriver driver.StorageDriver) (*ReadOnlyMarker, error) {
+	markerPath, err := pathFor(readOnlyMarkerPathSpec{})
+	if err != nil {
+		return nil, err
+	}
+	content, err := storageDriver.GetContent(ctx, markerPath)
+	if err != nil {
+		if _, ok := err.(driver.PathNotFoundError); ok {
+			return nil, nil
+		}
+		return nil, err
+	}
+	var marker ReadOnlyMarker
+	if err := json.Unmarshal(content, &marker); err != nil {
+		return nil, err
+	}
+	return &marker, nil
+}
+
+// PutReadOnlyMarker marks the registry as read-only in the storage.
+func PutReadOnlyMarker(ctx context.Context, storageDriver driver.StorageDriver, marker ReadOnlyMarker) error {
+	markerPath, err := pathFor(readOnlyMarkerPathSpec{})
+	if err != nil {
+		return err
+	}
+	content, err := json.Marshal(marker)
+	if err != nil {
+		return err
+	}
+	return storageDriver.PutContent(ctx, markerPath, content)
+}
+
+// DeleteReadOnlyMarker removes the read-only marker of the storage, if any.
+func DeleteReadOnlyMarker(ctx context.Context, storageDriver driver.StorageDriver) error {
+	markerPath, err := pathFor(readOnlyMarkerPathSpec{})
+	if err != nil {
+		return err
+	}
+	err = storageDriver.Delete(ctx, markerPath)
+	if _, ok := err.(driver.PathNotFoundError); ok {
+		return nil
+	}
+	return err
+}
@@ -0,0 +1,215 @@
+package storage
+
+import (
+	"context"
+	"fmt"
+	"path"
+	"regexp"
+	"slices"
+	"sort"
+
+	"github.com/distribution/distribution/v3"
+	"github.com/distribution/distribution/v3/internal/dcontext"
+	"github.com/distribution/distribution/v3/manifest/manifestlist"
+	"github.com/distribution/distribution/v3/manifest/ocischema"
+	"github.com/distribution/distribution/v3/manifest/schema2"
+	"github.com/distribution/distribution/v3/registry/storage/driver"
+	"github.com/opencontainers/go-digest"
+	v1 "github.com/opencontainers/image-spec/specs-go/v1"
+)
+
+var _ distribution.ReferrersLister = &manifestStore{}
+
+// manifestSubject returns the subject of a manifest, nil if it has none.
+func manifestSubject(manifest distribution.Manifest) *v1.Descriptor {
+	switch m := manifest.(type) {
+	case *ocischema.DeserializedManifest:
+		return m.Subject
+	case *ocischema.DeserializedImageIndex:
+		return m.Subject
+	}
+	return nil
+}
+
+// mediaTypeRegexp matches a media type as defined by RFC 6838, without
+// parameters.
+var mediaTypeRegexp = regexp.MustCompile(`^[A-Za-z0-9][A-Za-z0-9!#$&^_.+-]{0,126}/[A-Za-z0-9][A-Za-z0-9!#$&^_.+-]{0,126}$`)
+
+// verifySubject verifies the subject and the artifact type of an OCI manifest
+// or index put to the repository. The subject must describe a manifest, which
+// is checked to exist in blobs, with the declared size, if exist is set.
+func verifySubject(ctx context.Context, blobs distribution.BlobStatter, manifest distribution.Manifest, exist bool) []error {
+	var (
+		subject      *v1.Descriptor
+		artifactType string
+	)
+	switch m := manifest.(type) {
+	case *ocischema.DeserializedManifest:
+		subject, artifactType = m.Subject, m.ArtifactType
+	case *ocischema.DeserializedImageIndex:
+		subject, artifactType = m.Subject, m.ArtifactType
+	default:
+		return nil
+	}
+
+	var errs []error
+	if artifactType != "" && !mediaTypeRegexp.MatchString(artifactType) {
+		errs = append(errs, distribution.ErrManifestFieldInvalid{Field: "artifactType", Reason: fmt.Errorf("invalid media type %q", artifactType)})
+	}
+	if subject == nil {
+		return errs
+	}
+
+	if err := subject.Digest.Validate(); err != nil {
+		return append(errs, distribution.ErrManifestFieldInvalid{Field: "subject.digest", Reason: err})
+	}
+	switch subject.MediaType {
+	case v1.MediaTypeImageManifest, v1.MediaTypeImageIndex, schema2.MediaTypeManifest, manifestlist.MediaTypeManifestList:
+	default:
+		return append(errs, distribution.ErrManifestFieldInvalid{Field: "subject.mediaType", Reason: fmt.Errorf("%q is not a manifest media type", subject.MediaType)})
+	}
+
+	if !exist {
+		return errs
+	}
+	desc, err := blobs.Stat(ctx, subject.Digest)
+	switch {
+	case err == distribution.ErrBlobUnknown:
+		errs = append(errs, distribution.ErrManifestFieldInvalid{Field: "subject", Reason: fmt.Errorf("unknown manifest %s", subject.Digest)})
+	case err != nil:
+		errs = append(errs, err)
+	case desc.Size != subject.Size:
+		errs = append(errs, distribution.ErrManifestFieldInvalid{Field: "subject.size", Reason: fmt.Errorf("size %d differs from the size %d of manifest %s", subject.Size, desc.Size, subject.Digest)})
+	}
+	return errs
+}
+
+// linkReferrer links a manifest revision under the referrers of its subject,
+// if it has one. The subject does not need to exist.
+func (ms *manifestStore) linkReferrer(ctx context.Context, manifest distribution.Manifest, revision digest.Digest) error {
+	subject := manifestSubject(manifest)
+	if subject == nil {
+		return nil
+	}
+	linkPath, err := pathFor(manifestReferrerLinkPathSpec{name: ms.repository.Named().Name(), subject: subject.Digest, revision: revision})
+	if err != nil {
+		return err
+	}
+	return ms.blobStore.link(ctx, linkPath, revision)
+}
+
+// unlinkReferrer removes the link of a manifest revision from the referrers
+// of its subject.
+func unlinkReferrer(ctx context.Context, storageDriver driver.StorageDriver, name string, subject, revision digest.Digest) error {
+	linkPath, err := pathFor(manifestReferrerLinkPathSpec{name: name, subject: subject, revision: revision})
+	if err != nil {
+		return err
+	}
+	if err := storageDriver.Delete(ctx, path.Dir(linkPath)); err != nil {
+		if _, ok := err.(driver.PathNotFoundError); !ok {
+			return err
+		}
+	}
+	return nil
+}
+
+// Referrers returns the descriptors of the manifests of the repository whose
+// subject is the manifest subject, which does not need to exist, along with
+// the manifests listed by the referrers tag of the subject. The links to the
+// manifests which were deleted are skipped.
+func (ms *manifestStore) Referrers(ctx context.Context, subject digest.Digest, artifactType string) ([]v1.Descriptor, error) {
+	dcontext.GetLogger(ms.ctx).Debug("(*manifestStore).Referrers")
+
+	rootPath, err := pathFor(manifestReferrersPathSpec{name: ms.repository.Named().Name(), subject: subject})
+	if err != nil {
+		return nil, err
+	}
+	var revisions []digest.Digest
+	err = ms.blobStore.driver.Walk(ctx, rootPath, func(fileInfo driver.FileInfo) error {
+		if fileInfo.IsDir() || path.Base(fileInfo.Path()) != "link" {
+			return nil
+		}
+		revision, err := ms.blobStore.readlink(ctx, fileInfo.Path())
+		if err != nil {
+			return err
+		}
+		revisions = append(revisions, revision)
+		return nil
+	})
+	if err != nil {
+		if _, ok := err.(driver.PathNotFoundError); !ok {
+			return nil, err
+		}
+	}
+	sort.Slice(revisions, func(i, j int) bool { return revisions[i] < revisions[j] })
+
+	descriptors := make([]v1.Descriptor, 0, len(revisions))
+	for _, revision := range revisions {
+		manifest, err := ms.Get(ctx, revision)
+		if err != nil {
+			if _, ok := err.(distribution.ErrManifestUnknownRevision); ok {
+				continue
+			}
+			return nil, err
+		}
+		desc, err := referrerDescriptor(manifest, revision)
+		if err != nil {
+			return nil, err
+		}
+		if artifactType != "" && desc.ArtifactType != artifactType {
+			continue
+		}
+		descriptors = append(descriptors, desc)
+	}
+
+	// The manifests listed by the referrers tag are pushed by the clients
+	// which cannot use the referrers API, without a subject for some. They
+	// are listed after the others, as long as they exist.
+	index, err := ms.tagReferrers(ctx, subject)
+	if err != nil {
+		return nil, err
+	}
+	if index == nil {
+		return descriptors, nil
+	}
+	for _, desc := range index.Manifests {
+		if slices.Contains(revisions, desc.Digest) || (artifactType != "" && desc.ArtifactType != artifactType) {
+			continue
+		}
+		if exists, err := ms.Exists(ctx, desc.Digest); err != nil {
+			return nil, err
+		} else if !exists {
+			continue
+		}
+		revisions = append(revisions, desc.Digest)
+		descriptors = append(descriptors, desc)
+	}
+	return descriptors, nil
+}
+
+// referrerDescriptor returns the descriptor of a manifest listed among the
+// referrers of its subject. The artifact type of an image manifest without one
+// is the media type of its config.
+func referrerDescriptor(manifest distribution.Manifest, revision digest.Digest) (v1.Descriptor, error) {
+	mediaType, payload, err := manifest.Payload()
+	if err != nil {
+		return v1.Descriptor{}, err
+	}
+	desc := v1.Descriptor{
+		MediaType: mediaType,
+		Digest:    revision,
+		Size:      int64(len(payload)),
+	}
+	switch m := manifest.(type) {
+	case *ocischema.DeserializedManifest:
+		desc.ArtifactType = m.ArtifactType
+		if desc.ArtifactType == "" {
+			desc.ArtifactType = m.Config.MediaType
+		}
+		desc.Annotations = m.Annotations
+	case *ocischema.DeserializedImageIndex:
+		desc.ArtifactType = m.ArtifactType
+		desc.Annotations = m.Annotations
+	}
+	return desc, nil
+}
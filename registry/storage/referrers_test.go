@@ -0,0 +1,134 @@
+package storage
+
+import (
+	"io"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/distribution/distribution/v3"
+	"github.com/distribution/distribution/v3/internal/dcontext"
+	"github.com/distribution/distribution/v3/manifest/ocischema"
+	"github.com/distribution/distribution/v3/registry/storage/driver"
+	"github.com/distribution/distribution/v3/registry/storage/driver/inmemory"
+	"github.com/distribution/distribution/v3/testutil"
+	"github.com/opencontainers/go-digest"
+	"github.com/opencontainers/image-spec/specs-go"
+	v1 "github.com/opencontainers/image-spec/specs-go/v1"
+)
+
+// uploadReferrer uploads an artifact manifest whose subject is subject, with
+// the config of configMediaType.
+func uploadReferrer(t *testing.T, repository distribution.Repository, subject digest.Digest, artifactType, configMediaType string, annotations map[string]string) digest.Digest {
+	ctx := dcontext.Background()
+	if err := testutil.UploadBlobs(repository, map[digest.Digest]io.ReadSeeker{digest.FromString("{}"): strings.NewReader("{}")}); err != nil {
+		t.Fatalf("config upload failed: %v", err)
+	}
+	manifest, err := ocischema.FromStruct(ocischema.Manifest{
+		Versioned:    specs.Versioned{SchemaVersion: 2},
+		MediaType:    v1.MediaTypeImageManifest,
+		ArtifactType: artifactType,
+		Config:       v1.Descriptor{MediaType: configMediaType, Digest: digest.FromString("{}"), Size: 2},
+		Layers:       []v1.Descriptor{},
+		Subject:      &v1.Descriptor{MediaType: v1.MediaTypeImageManifest, Digest: subject},
+		Annotations:  annotations,
+	})
+	if err != nil {
+		t.Fatalf("failed to build manifest: %v", err)
+	}
+	dgst, err := makeManifestService(t, repository).Put(ctx, manifest)
+	if err != nil {
+		t.Fatalf("manifest upload failed: %v", err)
+	}
+	return dgst
+}
+
+func listReferrers(t *testing.T, repository distribution.Repository, subject digest.Digest, artifactType string) []v1.Descriptor {
+	ctx := dcontext.Background()
+	lister, ok := makeManifestService(t, repository).(distribution.ReferrersLister)
+	if !ok {
+		t.Fatal("unable to convert ManifestService into ReferrersLister")
+	}
+	descriptors, err := lister.Referrers(ctx, subject, artifactType)
+	if err != nil {
+		t.Fatalf("failed to list referrers: %v", err)
+	}
+	return descriptors
+}
+
+func TestReferrers(t *testing.T) {
+	ctx := dcontext.Background()
+	d := inmemory.New()
+	registry := createRegistry(t, d)
+	repo := makeRepository(t, registry, "referrers")
+	subject := uploadRandomOCIImage(t, repo).manifestDigest
+
+	signature := uploadReferrer(t, repo, subject, "application/vnd.example.signature", v1.MediaTypeEmptyJSON, nil)
+	sbom := uploadReferrer(t, repo, subject, "", "application/vnd.example.sbom", map[string]string{"org.example.format": "spdx"})
+	// The subject of a referrer does not need to exist.
+	missing := digest.FromString("missing subject")
+	orphan := uploadReferrer(t, repo, missing, "application/vnd.example.signature", v1.MediaTypeEmptyJSON, nil)
+
+	descriptors := listReferrers(t, repo, subject, "")
+	if len(descriptors) != 2 {
+		t.Fatalf("%d referrers listed, expected 2: %v", len(descriptors), descriptors)
+	}
+	byDigest := map[digest.Digest]v1.Descriptor{}
+	for _, desc := range descriptors {
+		if desc.MediaType != v1.MediaTypeImageManifest || desc.Size == 0 {
+			t.Fatalf("unexpected referrer descriptor: %+v", desc)
+		}
+		byDigest[desc.Digest] = desc
+	}
+	if byDigest[signature].ArtifactType != "application/vnd.example.signature" {
+		t.Fatalf("unexpected artifact type of the signature: %q", byDigest[signature].ArtifactType)
+	}
+	// The artifact type of a manifest without one is its config media type.
+	if byDigest[sbom].ArtifactType != "application/vnd.example.sbom" {
+		t.Fatalf("unexpected artifact type of the SBOM: %q", byDigest[sbom].ArtifactType)
+	}
+	if !reflect.DeepEqual(byDigest[sbom].Annotations, map[string]string{"org.example.format": "spdx"}) {
+		t.Fatalf("unexpected annotations of the SBOM: %v", byDigest[sbom].Annotations)
+	}
+
+	filtered := listReferrers(t, repo, subject, "application/vnd.example.sbom")
+	if len(filtered) != 1 || filtered[0].Digest != sbom {
+		t.Fatalf("unexpected referrers of artifact type application/vnd.example.sbom: %v", filtered)
+	}
+	if referrers := listReferrers(t, repo, missing, ""); len(referrers) != 1 || referrers[0].Digest != orphan {
+		t.Fatalf("unexpected referrers of a missing subject: %v", referrers)
+	}
+	if referrers := listReferrers(t, repo, digest.FromString("unreferenced"), ""); referrers == nil || len(referrers) != 0 {
+		t.Fatalf("unexpected referrers of an unreferenced manifest: %v", referrers)
+	}
+
+	// The links to the referrers are not enumerated as manifests.
+	enumerated := 0
+	err := makeManifestService(t, repo).(distribution.ManifestEnumerator).Enumerate(ctx, func(digest.Digest) error {
+		enumerated++
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("failed to enumerate manifests: %v", err)
+	}
+	if enumerated != 4 {
+		t.Fatalf("%d manifests enumerated, expected 4", enumerated)
+	}
+
+	// Deleting a referrer removes its link.
+	if err := makeManifestService(t, repo).Delete(ctx, signature); err != nil {
+		t.Fatalf("failed to delete referrer: %v", err)
+	}
+	if referrers := listReferrers(t, repo, subject, ""); len(referrers) != 1 || referrers[0].Digest != sbom {
+		t.Fatalf("unexpected referrers after deleting a referrer: %v", referrers)
+	}
+	linkPath, err := pathFor(manifestReferrerLinkPathSpec{name: "referrers", subject: subject, revision: signature})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := d.Stat(ctx, linkPath); err == nil {
+		t.Fatal("link of the deleted referrer was not removed")
+	} else if _, ok := err.(driver.PathNotFoundError); !ok {
+		t.Fatal(err)
+	}
+}
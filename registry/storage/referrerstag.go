@@ -0,0 +1,136 @@
+package storage
+
+import (
+	"context"
+	"encoding/hex"
+	"fmt"
+	"slices"
+	"strings"
+
+	"github.com/distribution/distribution/v3"
+	"github.com/distribution/distribution/v3/internal/dcontext"
+	"github.com/distribution/distribution/v3/manifest/ocischema"
+	"github.com/distribution/distribution/v3/registry/storage/driver"
+	"github.com/opencontainers/go-digest"
+	v1 "github.com/opencontainers/image-spec/specs-go/v1"
+)
+
+// ReferrersTag returns the tag of the referrers tag schema of the OCI
+// distribution specification under which the clients which cannot use the
+// referrers API maintain an image index of the referrers of the subject:
+// "<alg>-<encoded>", the algorithm truncated to 32 characters and the encoded
+// digest to 64.
+func ReferrersTag(subject digest.Digest) string {
+	alg, encoded := subject.Algorithm().String(), subject.Encoded()
+	return alg[:min(len(alg), 32)] + "-" + encoded[:min(len(encoded), 64)]
+}
+
+// IsReferrersTag returns whether the tag is a tag of the referrers tag schema,
+// of a digest of an available algorithm.
+func IsReferrersTag(tag string) bool {
+	alg, encoded, ok := strings.Cut(tag, "-")
+	if !ok {
+		return false
+	}
+	algorithm := digest.Algorithm(alg)
+	if !algorithm.Available() || len(encoded) != min(algorithm.Size()*2, 64) {
+		return false
+	}
+	_, err := hex.DecodeString(encoded)
+	return err == nil
+}
+
+// tagReferrers returns the image index of the referrers tag of the subject,
+// nil if there is none.
+func (ms *manifestStore) tagReferrers(ctx context.Context, subject digest.Digest) (*ocischema.DeserializedImageIndex, error) {
+	desc, err := ms.repository.Tags(ctx).Get(ctx, ReferrersTag(subject))
+	if err != nil {
+		if _, ok := err.(distribution.ErrTagUnknown); ok {
+			return nil, nil
+		}
+		return nil, err
+	}
+	manifest, err := ms.Get(ctx, desc.Digest)
+	if err != nil {
+		if _, ok := err.(distribution.ErrManifestUnknownRevision); ok {
+			return nil, nil
+		}
+		return nil, err
+	}
+	index, ok := manifest.(*ocischema.DeserializedImageIndex)
+	if !ok {
+		return nil, nil
+	}
+	return index, nil
+}
+
+// updateReferrersTag replaces the image index of the referrers tag of the
+// subject by an index of the descriptors update returns, keeping its
+// annotations, if the tag exists and update changes them. The index replaced
+// is left untagged.
+func (ms *manifestStore) updateReferrersTag(ctx context.Context, subject digest.Digest, update func([]v1.Descriptor) []v1.Descriptor) error {
+	if ms.repository.registry.referrersTagsFrozen {
+		return nil
+	}
+	index, err := ms.tagReferrers(ctx, subject)
+	if err != nil || index == nil {
+		return err
+	}
+	descriptors := update(slices.Clone(index.Manifests))
+	if slices.EqualFunc(descriptors, index.Manifests, func(a, b v1.Descriptor) bool { return a.Digest == b.Digest }) {
+		return nil
+	}
+	updated, err := ocischema.FromDescriptors(descriptors, index.Annotations)
+	if err != nil {
+		return err
+	}
+	revision, err := ms.Put(ctx, updated)
+	if err != nil {
+		return fmt.Errorf("failed to put the referrers index of %s: %v", subject, err)
+	}
+	tag := ReferrersTag(subject)
+	dcontext.GetLogger(ctx).Debugf("updating the referrers tag %s of %s to %s", tag, ms.repository.Named().Name(), revision)
+	return ms.repository.Tags(ctx).Tag(ctx, tag, v1.Descriptor{Digest: revision})
+}
+
+// tagReferrer adds a manifest revision with a subject to the image index of
+// the referrers tag of its subject, if the tag exists, so that the clients
+// maintaining the tag see the referrers pushed with the referrers API.
+func (ms *manifestStore) tagReferrer(ctx context.Context, manifest distribution.Manifest, revision digest.Digest) error {
+	subject := manifestSubject(manifest)
+	if subject == nil {
+		return nil
+	}
+	desc, err := referrerDescriptor(manifest, revision)
+	if err != nil {
+		return err
+	}
+	return ms.updateReferrersTag(ctx, subject.Digest, func(descriptors []v1.Descriptor) []v1.Descriptor {
+		if slices.ContainsFunc(descriptors, func(d v1.Descriptor) bool { return d.Digest == revision }) {
+			return descriptors
+		}
+		return append(descriptors, desc)
+	})
+}
+
+// untagReferrer removes a manifest revision from the image index of the
+// referrers tag of its subject.
+func (ms *manifestStore) untagReferrer(ctx context.Context, subject, revision digest.Digest) error {
+	return ms.updateReferrersTag(ctx, subject, func(descriptors []v1.Descriptor) []v1.Descriptor {
+		return slices.DeleteFunc(descriptors, func(d v1.Descriptor) bool { return d.Digest == revision })
+	})
+}
+
+// untagReferrers removes the referrers tag of a manifest deleted, if the
+// registry cascades the deletions to it.
+func (ms *manifestStore) untagReferrers(ctx context.Context, dgst digest.Digest) error {
+	if !ms.repository.registry.cascadeReferrersTags {
+		return nil
+	}
+	if err := ms.repository.Tags(ctx).Untag(ctx, ReferrersTag(dgst)); err != nil {
+		if _, ok := err.(driver.PathNotFoundError); !ok {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,179 @@
+package storage
+
+import (
+	"testing"
+
+	"github.com/distribution/distribution/v3"
+	"github.com/distribution/distribution/v3/internal/dcontext"
+	"github.com/distribution/distribution/v3/manifest/ocischema"
+	"github.com/distribution/distribution/v3/registry/storage/driver/inmemory"
+	"github.com/opencontainers/go-digest"
+	v1 "github.com/opencontainers/image-spec/specs-go/v1"
+)
+
+func TestReferrersTagName(t *testing.T) {
+	subject := digest.FromString("subject")
+	tag := ReferrersTag(subject)
+	if tag != "sha256-"+subject.Encoded() {
+		t.Fatalf("unexpected referrers tag %q", tag)
+	}
+	// The encoded digests longer than 64 characters are truncated.
+	long := digest.SHA512.FromString("subject")
+	if tag := ReferrersTag(long); tag != "sha512-"+long.Encoded()[:64] {
+		t.Fatalf("unexpected referrers tag %q", tag)
+	}
+
+	for tag, expected := range map[string]bool{
+		ReferrersTag(subject):                    true,
+		ReferrersTag(long):                       true,
+		"latest":                                 false,
+		"v1-beta":                                false,
+		"sha256-abc":                             false,
+		"sha256-" + subject.Encoded()[:63] + "g": false,
+		"md5-" + subject.Encoded():               false,
+	} {
+		if IsReferrersTag(tag) != expected {
+			t.Fatalf("IsReferrersTag(%q) != %v", tag, expected)
+		}
+	}
+}
+
+// tagReferrersIndex tags an image index of the descriptors under the
+// referrers tag of the subject, as the clients of the referrers tag schema
+// do.
+func tagReferrersIndex(t *testing.T, repository distribution.Repository, subject digest.Digest, descriptors ...v1.Descriptor) digest.Digest {
+	ctx := dcontext.Background()
+	index, err := ocischema.FromDescriptors(descriptors, nil)
+	if err != nil {
+		t.Fatalf("failed to build index: %v", err)
+	}
+	dgst, err := makeManifestService(t, repository).Put(ctx, index)
+	if err != nil {
+		t.Fatalf("index upload failed: %v", err)
+	}
+	if err := repository.Tags(ctx).Tag(ctx, ReferrersTag(subject), v1.Descriptor{Digest: dgst}); err != nil {
+		t.Fatalf("failed to tag index: %v", err)
+	}
+	return dgst
+}
+
+// referrersIndex returns the digests of the manifests of the referrers tag of
+// the subject.
+func referrersIndex(t *testing.T, repository distribution.Repository, subject digest.Digest) []digest.Digest {
+	ctx := dcontext.Background()
+	desc, err := repository.Tags(ctx).Get(ctx, ReferrersTag(subject))
+	if err != nil {
+		t.Fatalf("failed to get the referrers tag: %v", err)
+	}
+	manifest, err := makeManifestService(t, repository).Get(ctx, desc.Digest)
+	if err != nil {
+		t.Fatalf("failed to get the referrers index: %v", err)
+	}
+	var digests []digest.Digest
+	for _, desc := range manifest.(*ocischema.DeserializedImageIndex).Manifests {
+		digests = append(digests, desc.Digest)
+	}
+	return digests
+}
+
+func referrerDigests(descriptors []v1.Descriptor) []digest.Digest {
+	digests := make([]digest.Digest, 0, len(descriptors))
+	for _, desc := range descriptors {
+		digests = append(digests, desc.Digest)
+	}
+	return digests
+}
+
+func TestReferrersTagSchema(t *testing.T) {
+	ctx := dcontext.Background()
+	registry := createRegistry(t, inmemory.New())
+	repo := makeRepository(t, registry, "referrers/tags")
+	subject := uploadRandomOCIImage(t, repo).manifestDigest
+
+	// A signature is pushed with the referrers API, and an SBOM by a client
+	// of the referrers tag schema, which also lists it in the tag.
+	signature := uploadReferrer(t, repo, subject, "application/vnd.example.signature", v1.MediaTypeEmptyJSON, nil)
+	sbom := uploadReferrer(t, repo, digest.FromString("other subject"), "application/vnd.example.sbom", v1.MediaTypeEmptyJSON, nil)
+	sbomDesc := v1.Descriptor{MediaType: v1.MediaTypeImageManifest, Digest: sbom, Size: 1, ArtifactType: "application/vnd.example.sbom"}
+	signatureDesc := v1.Descriptor{MediaType: v1.MediaTypeImageManifest, Digest: signature, Size: 1, ArtifactType: "application/vnd.example.signature"}
+	tagReferrersIndex(t, repo, subject, signatureDesc, sbomDesc)
+
+	// The manifests of both schemas are listed once.
+	if referrers := referrerDigests(listReferrers(t, repo, subject, "")); len(referrers) != 2 || referrers[0] != signature || referrers[1] != sbom {
+		t.Fatalf("unexpected referrers %v", referrers)
+	}
+	if referrers := referrerDigests(listReferrers(t, repo, subject, "application/vnd.example.sbom")); len(referrers) != 1 || referrers[0] != sbom {
+		t.Fatalf("unexpected referrers of artifact type application/vnd.example.sbom %v", referrers)
+	}
+
+	// A referrer pushed with the referrers API is added to the tag.
+	attestation := uploadReferrer(t, repo, subject, "application/vnd.example.attestation", v1.MediaTypeEmptyJSON, nil)
+	if index := referrersIndex(t, repo, subject); len(index) != 3 || index[2] != attestation {
+		t.Fatalf("unexpected referrers tag %v", index)
+	}
+	if referrers := listReferrers(t, repo, subject, ""); len(referrers) != 3 {
+		t.Fatalf("unexpected referrers %v", referrers)
+	}
+
+	// A referrer deleted is removed from the tag, and so is a manifest of
+	// the tag deleted from the referrers.
+	ms := makeManifestService(t, repo)
+	if err := ms.Delete(ctx, attestation); err != nil {
+		t.Fatalf("failed to delete referrer: %v", err)
+	}
+	if index := referrersIndex(t, repo, subject); len(index) != 2 || index[0] != signature || index[1] != sbom {
+		t.Fatalf("unexpected referrers tag after deleting a referrer %v", index)
+	}
+	if err := ms.Delete(ctx, sbom); err != nil {
+		t.Fatalf("failed to delete manifest: %v", err)
+	}
+	if referrers := referrerDigests(listReferrers(t, repo, subject, "")); len(referrers) != 1 || referrers[0] != signature {
+		t.Fatalf("unexpected referrers after deleting a manifest of the tag %v", referrers)
+	}
+
+	// The referrers tag is kept when its subject is deleted.
+	if err := ms.Delete(ctx, subject); err != nil {
+		t.Fatalf("failed to delete subject: %v", err)
+	}
+	if _, err := repo.Tags(ctx).Get(ctx, ReferrersTag(subject)); err != nil {
+		t.Fatalf("unexpected error getting the referrers tag: %v", err)
+	}
+}
+
+func TestReferrersTagCascade(t *testing.T) {
+	ctx := dcontext.Background()
+	registry := createRegistry(t, inmemory.New(), CascadeReferrersTags)
+	repo := makeRepository(t, registry, "referrers/cascade")
+	subject := uploadRandomOCIImage(t, repo).manifestDigest
+	other := uploadRandomOCIImage(t, repo).manifestDigest
+	signature := uploadReferrer(t, repo, subject, "application/vnd.example.signature", v1.MediaTypeEmptyJSON, nil)
+	tagReferrersIndex(t, repo, subject, v1.Descriptor{MediaType: v1.MediaTypeImageManifest, Digest: signature, Size: 1})
+	tagReferrersIndex(t, repo, other)
+
+	if err := makeManifestService(t, repo).Delete(ctx, subject); err != nil {
+		t.Fatalf("failed to delete subject: %v", err)
+	}
+	if _, err := repo.Tags(ctx).Get(ctx, ReferrersTag(subject)); err == nil {
+		t.Fatal("the referrers tag of the subject deleted was kept")
+	} else if _, ok := err.(distribution.ErrTagUnknown); !ok {
+		t.Fatalf("unexpected error getting the referrers tag: %v", err)
+	}
+	if _, err := repo.Tags(ctx).Get(ctx, ReferrersTag(other)); err != nil {
+		t.Fatalf("unexpected error getting the referrers tag of another manifest: %v", err)
+	}
+}
+
+func TestReferrersTagFrozen(t *testing.T) {
+	registry := createRegistry(t, inmemory.New(), FreezeReferrersTags)
+	repo := makeRepository(t, registry, "referrers/frozen")
+	subject := uploadRandomOCIImage(t, repo).manifestDigest
+	tagReferrersIndex(t, repo, subject)
+
+	signature := uploadReferrer(t, repo, subject, "application/vnd.example.signature", v1.MediaTypeEmptyJSON, nil)
+	if index := referrersIndex(t, repo, subject); len(index) != 0 {
+		t.Fatalf("unexpected referrers tag %v", index)
+	}
+	if referrers := referrerDigests(listReferrers(t, repo, subject, "")); len(referrers) != 1 || referrers[0] != signature {
+		t.Fatalf("unexpected referrers %v", referrers)
+	}
+}
@@ -2,6 +2,8 @@ package storage
 
 import (
 	"context"
+	"fmt"
+	"path"
 	"regexp"
 	"runtime"
 
@@ -22,15 +24,26 @@ type registry struct {
 	blobServer                   *blobServer
 	statter                      *blobStatter // global statter service.
 	blobDescriptorCacheProvider  cache.BlobDescriptorCacheProvider
+	tagCacheProvider             cache.TagCacheProvider
+	uploadSessionProvider        cache.UploadSessionProvider
 	deleteEnabled                bool
+	cascadeReferrersTags         bool
+	referrersTagsFrozen          bool
+	mountDisabled                bool
 	tagLookupConcurrencyLimit    int
 	resumableDigestEnabled       bool
 	blobDescriptorServiceFactory distribution.BlobDescriptorServiceFactory
 	driver                       storagedriver.StorageDriver
+	quotas                       *Quotas
+	catalog                      *CatalogIndex
 
 	// Validation
 	manifestURLs         manifestURLs
 	validateImageIndexes validateImageIndexes
+	validateSubjects     validateSubjects
+	mediaTypes           []mediaTypeRule
+	annotations          []annotationRule
+	layerExistence       []layerExistenceRule
 }
 
 // manifestURLs holds regular expressions for controlling manifest URL whitelisting
@@ -47,6 +60,12 @@ type validateImageIndexes struct {
 	imagePlatforms []platform
 }
 
+// validateSubjects holds configuration for validation of the subjects of manifests
+type validateSubjects struct {
+	// exist enables checking that the subject of a manifest exists. Default false.
+	exist bool
+}
+
 // platform represents a platform to validate exists in the
 type platform struct {
 	architecture string
@@ -70,6 +89,25 @@ func TagLookupConcurrencyLimit(concurrencyLimit int) RegistryOption {
 	}
 }
 
+// WalkParallelism is a functional option for NewRegistry. It sets the number
+// of directories listed concurrently by the storage driver when enumerating
+// repositories, manifests and blobs. Enumeration is sequential by default.
+func WalkParallelism(parallelism int) RegistryOption {
+	return func(registry *registry) error {
+		registry.blobStore.walkParallelism = parallelism
+		return nil
+	}
+}
+
+// TrackBlobInventory is a functional option for NewRegistry. It counts the
+// blobs committed to the blob store in the inventory.
+func TrackBlobInventory(inventory *BlobInventory) RegistryOption {
+	return func(registry *registry) error {
+		registry.blobStore.inventory = inventory
+		return nil
+	}
+}
+
 // EnableDelete is a functional option for NewRegistry. It enables deletion on
 // the registry.
 func EnableDelete(registry *registry) error {
@@ -77,6 +115,28 @@ func EnableDelete(registry *registry) error {
 	return nil
 }
 
+// CascadeReferrersTags is a functional option for NewRegistry. The referrers
+// tag of a manifest deleted, of the referrers tag schema, is deleted with it.
+func CascadeReferrersTags(registry *registry) error {
+	registry.cascadeReferrersTags = true
+	return nil
+}
+
+// FreezeReferrersTags is a functional option for NewRegistry. The referrers
+// tags are not updated when a manifest with a subject is put or deleted. It
+// should be used if the registry is acting as a caching proxy.
+func FreezeReferrersTags(registry *registry) error {
+	registry.referrersTagsFrozen = true
+	return nil
+}
+
+// DisableBlobMounts is a functional option for NewRegistry. Cross-repository
+// blob mount requests are ignored and fall back to a regular upload.
+func DisableBlobMounts(registry *registry) error {
+	registry.mountDisabled = true
+	return nil
+}
+
 // DisableDigestResumption is a functional option for NewRegistry. It should be
 // used if the registry is acting as a caching proxy.
 func DisableDigestResumption(registry *registry) error {
@@ -84,6 +144,23 @@ func DisableDigestResumption(registry *registry) error {
 	return nil
 }
 
+// VerifyBlobReads is a functional option for NewRegistry. It verifies the
+// content of the blobs served against their digest, for the blobs of at most
+// maxSize bytes, or of any size if maxSize is 0, and one in sampling reads.
+// The blobs found corrupted are quarantined until they are pushed again.
+func VerifyBlobReads(maxSize int64, sampling int) RegistryOption {
+	return func(registry *registry) error {
+		if maxSize < 0 {
+			return fmt.Errorf("invalid blob read verification size %d", maxSize)
+		}
+		if sampling < 0 {
+			return fmt.Errorf("invalid blob read verification sampling %d", sampling)
+		}
+		registry.blobServer.verification = &blobReadVerification{maxSize: maxSize, sampling: uint64(sampling)}
+		return nil
+	}
+}
+
 // ManifestURLsAllowRegexp is a functional option for NewRegistry.
 func ManifestURLsAllowRegexp(r *regexp.Regexp) RegistryOption {
 	return func(registry *registry) error {
@@ -107,6 +184,82 @@ func EnableValidateImageIndexImagesExist(registry *registry) error {
 	return nil
 }
 
+// EnableValidateSubjectsExist is a functional option for NewRegistry. It enables
+// validation that the subject of a manifest exists in the repository, with the
+// declared size, before the manifest is accepted.
+func EnableValidateSubjectsExist(registry *registry) error {
+	registry.validateSubjects.exist = true
+	return nil
+}
+
+// AllowMediaTypes returns a functional option for NewRegistry. It restricts
+// the media types of the manifests, and of the layers they reference, accepted
+// by repositories matching pattern. The empty pattern sets the default rule
+// for repositories matched by no other pattern, and an empty list allows any
+// media type. The first matching pattern applies.
+func AllowMediaTypes(pattern string, manifests, layers []string) RegistryOption {
+	return func(registry *registry) error {
+		if pattern != "" {
+			if _, err := path.Match(pattern, ""); err != nil {
+				return fmt.Errorf("invalid media type repository pattern %q: %v", pattern, err)
+			}
+		}
+		registry.mediaTypes = append(registry.mediaTypes, mediaTypeRule{
+			pattern:   pattern,
+			manifests: manifests,
+			layers:    layers,
+		})
+		return nil
+	}
+}
+
+// RelaxLayerExistence returns a functional option for NewRegistry. It
+// accepts the image manifests pushed to repositories matching pattern without
+// checking that their layers of the exempt media types exist, and, if
+// anyRepository is set, with layers missing from the repository if a blob of
+// their digest and size is in the registry, as when it is to be mounted. The
+// empty pattern sets the default rule for repositories matched by no other
+// pattern, and a rule relaxing nothing keeps the checks strict. The first
+// matching pattern applies.
+func RelaxLayerExistence(pattern string, exemptMediaTypes []string, anyRepository bool) RegistryOption {
+	return func(registry *registry) error {
+		if pattern != "" {
+			if _, err := path.Match(pattern, ""); err != nil {
+				return fmt.Errorf("invalid layer existence repository pattern %q: %v", pattern, err)
+			}
+		}
+		registry.layerExistence = append(registry.layerExistence, layerExistenceRule{
+			pattern:          pattern,
+			exemptMediaTypes: exemptMediaTypes,
+			anyRepository:    anyRepository,
+		})
+		return nil
+	}
+}
+
+// RequireAnnotations returns a functional option for NewRegistry. It requires
+// the OCI manifests and image indexes accepted by repositories matching
+// pattern to have the annotations of the keys of required, whose values must
+// match their expression unless nil. The Docker manifests and manifest lists,
+// which have no annotations, are rejected if rejectSchema2 is set. The empty
+// pattern sets the default rule for repositories matched by no other pattern.
+// The first matching pattern applies.
+func RequireAnnotations(pattern string, required map[string]*regexp.Regexp, rejectSchema2 bool) RegistryOption {
+	return func(registry *registry) error {
+		if pattern != "" {
+			if _, err := path.Match(pattern, ""); err != nil {
+				return fmt.Errorf("invalid annotation repository pattern %q: %v", pattern, err)
+			}
+		}
+		registry.annotations = append(registry.annotations, annotationRule{
+			pattern:       pattern,
+			required:      required,
+			rejectSchema2: rejectSchema2,
+		})
+		return nil
+	}
+}
+
 // AddValidateImageIndexImagesExistPlatform returns a functional option for NewRegistry.
 // It adds a platform to check for existence before an image index is accepted.
 func AddValidateImageIndexImagesExistPlatform(architecture string, os string) RegistryOption {
@@ -151,6 +304,26 @@ func BlobDescriptorCacheProvider(blobDescriptorCacheProvider cache.BlobDescripto
 	}
 }
 
+// TagCacheProvider returns a functional option for NewRegistry. It caches the
+// digests referenced by the tags of the repositories with the provider.
+func TagCacheProvider(tagCacheProvider cache.TagCacheProvider) RegistryOption {
+	return func(registry *registry) error {
+		registry.tagCacheProvider = tagCacheProvider
+		return nil
+	}
+}
+
+// UploadSessionProvider returns a functional option for NewRegistry. It keeps
+// the sessions of the uploads with the provider instead of the storage, and
+// refuses the chunks of an upload whose session was updated concurrently
+// since it was resumed.
+func UploadSessionProvider(uploadSessionProvider cache.UploadSessionProvider) RegistryOption {
+	return func(registry *registry) error {
+		registry.uploadSessionProvider = uploadSessionProvider
+		return nil
+	}
+}
+
 // NewRegistry creates a new registry instance from the provided driver. The
 // resulting registry may be shared by multiple goroutines but is cheap to
 // allocate. If the Redirect option is specified, the backend blob server will
@@ -245,6 +418,9 @@ func (repo *repository) Tags(ctx context.Context) distribution.TagService {
 		blobStore:        repo.registry.blobStore,
 		concurrencyLimit: limit,
 	}
+	if repo.tagCacheProvider != nil {
+		return &cachedTagStore{tagStore: tags, cache: repo.tagCacheProvider}
+	}
 
 	return tags
 }
@@ -287,6 +463,7 @@ func (repo *repository) Manifests(ctx context.Context, options ...distribution.M
 		repository:           repo,
 		blobStore:            blobStore,
 		validateImageIndexes: repo.validateImageIndexes,
+		validateSubjects:     repo.validateSubjects,
 	}
 
 	ms := &manifestStore{
@@ -298,13 +475,16 @@ func (repo *repository) Manifests(ctx context.Context, options ...distribution.M
 			repository:   repo,
 			blobStore:    blobStore,
 			manifestURLs: repo.registry.manifestURLs,
+			layers:       newLayerVerifier(repo),
 		},
 		manifestListHandler: manifestListHandler,
 		ocischemaHandler: &ocischemaManifestHandler{
-			ctx:          ctx,
-			repository:   repo,
-			blobStore:    blobStore,
-			manifestURLs: repo.registry.manifestURLs,
+			ctx:              ctx,
+			repository:       repo,
+			blobStore:        blobStore,
+			manifestURLs:     repo.registry.manifestURLs,
+			validateSubjects: repo.registry.validateSubjects,
+			layers:           newLayerVerifier(repo),
 		},
 		ocischemaIndexHandler: &ocischemaIndexHandler{
 			manifestListHandler: manifestListHandler,
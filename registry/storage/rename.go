@@ -0,0 +1,233 @@
+package storage
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"path"
+	"strings"
+	"time"
+
+	"github.com/distribution/distribution/v3"
+	"github.com/distribution/distribution/v3/internal/dcontext"
+	"github.com/distribution/distribution/v3/registry/storage/driver"
+	"github.com/distribution/reference"
+	"github.com/opencontainers/go-digest"
+)
+
+// renamedDirs are the directories of a repository moved by its rename. The
+// uploads in progress are not, since their state is bound to the name they
+// were started with, and the usage of the quota is moved by its provider.
+var renamedDirs = []string{"_layers", "_manifests", "_stats"}
+
+// Rename moves the manifest revisions, the tags, the layer links and the
+// referrers of the repository from to the name to, with the Move of the
+// storage driver, so that the blobs stay shared with the other repositories
+// and the manifests keep their digests. The repositories nested under either
+// name are left in place. If the move fails, the content already moved is
+// moved back.
+//
+// Rename does not lock the repositories: the writes to either name must be
+// refused until it returns.
+func (reg *registry) Rename(ctx context.Context, from, to reference.Named) error {
+	if from.Name() == to.Name() {
+		return fmt.Errorf("repository %s renamed to itself", from.Name())
+	}
+	root, err := pathFor(repositoriesRootPathSpec{})
+	if err != nil {
+		return err
+	}
+	fromDir, toDir := path.Join(root, from.Name()), path.Join(root, to.Name())
+
+	if _, err := reg.driver.Stat(ctx, path.Join(fromDir, "_manifests")); err != nil {
+		if errors.As(err, new(driver.PathNotFoundError)) {
+			return distribution.ErrRepositoryUnknown{Name: from.Name()}
+		}
+		return err
+	}
+	if _, err := reg.driver.Stat(ctx, path.Join(toDir, "_manifests")); err == nil {
+		return distribution.ErrRepositoryExists{Name: to.Name()}
+	} else if !errors.As(err, new(driver.PathNotFoundError)) {
+		return err
+	}
+
+	usage, err := reg.quotaToRename(ctx, from, to)
+	if err != nil {
+		return err
+	}
+
+	// The files are listed before any is moved, since the listing of some
+	// drivers is paginated.
+	var files []string
+	for _, dir := range renamedDirs {
+		err := reg.driver.Walk(ctx, path.Join(fromDir, dir), func(fileInfo driver.FileInfo) error {
+			if !fileInfo.IsDir() {
+				files = append(files, strings.TrimPrefix(fileInfo.Path(), fromDir))
+			}
+			return nil
+		})
+		if err != nil && !errors.As(err, new(driver.PathNotFoundError)) {
+			return err
+		}
+	}
+
+	for i, file := range files {
+		if err := reg.driver.Move(ctx, fromDir+file, toDir+file); err != nil {
+			err = fmt.Errorf("failed to move %s to %s: %v", fromDir+file, toDir+file, err)
+			for _, file := range files[:i] {
+				if err := reg.driver.Move(ctx, toDir+file, fromDir+file); err != nil {
+					dcontext.GetLogger(ctx).Errorf("failed to move %s back to %s: %v", toDir+file, fromDir+file, err)
+				}
+			}
+			return err
+		}
+	}
+
+	// The usage of a tenant is unchanged by the renames within it.
+	if reg.quotas != nil && reg.quotas.tenant == "" {
+		if _, ok := reg.quotas.Limit(to.Name()); ok {
+			if err := reg.quotas.usage.Set(ctx, to.Name(), usage); err != nil {
+				dcontext.GetLogger(ctx).Errorf("failed to set the quota usage of %s: %v", to.Name(), err)
+			}
+		}
+		if _, ok := reg.quotas.Limit(from.Name()); ok {
+			if err := reg.quotas.usage.Set(ctx, from.Name(), 0); err != nil {
+				dcontext.GetLogger(ctx).Errorf("failed to release the quota usage of %s: %v", from.Name(), err)
+			}
+		}
+	}
+
+	// The directories left empty by the moves, the uploads and the usage of
+	// the quota of the previous name are deleted, and the marker of a
+	// previous rename of the new name no longer applies.
+	for _, dir := range append(renamedDirs, "_uploads", "_quota") {
+		if err := reg.driver.Delete(ctx, path.Join(fromDir, dir)); err != nil && !errors.As(err, new(driver.PathNotFoundError)) {
+			dcontext.GetLogger(ctx).Errorf("failed to delete %s: %v", path.Join(fromDir, dir), err)
+		}
+	}
+	if err := DeleteRepositoryMoved(ctx, reg.driver, to.Name()); err != nil {
+		dcontext.GetLogger(ctx).Errorf("failed to delete the moved marker of %s: %v", to.Name(), err)
+	}
+	if err := reg.catalog.remove(ctx, from.Name()); err != nil {
+		dcontext.GetLogger(ctx).Errorf("failed to remove %s from the catalog index: %v", from.Name(), err)
+	}
+	if err := reg.catalog.add(ctx, to.Name()); err != nil {
+		dcontext.GetLogger(ctx).Errorf("failed to add %s to the catalog index: %v", to.Name(), err)
+	}
+
+	reg.clearRenamedCaches(ctx, from, files)
+	return nil
+}
+
+// quotaToRename returns the usage of the quota of the repository from, to be
+// charged to the repository to, or distribution.ErrQuotaExceeded if it would
+// bring the repository to over its quota.
+func (reg *registry) quotaToRename(ctx context.Context, from, to reference.Named) (int64, error) {
+	if reg.quotas == nil || reg.quotas.tenant != "" {
+		return 0, nil
+	}
+	limit, ok := reg.quotas.Limit(to.Name())
+	if !ok {
+		return 0, nil
+	}
+	var usage int64
+	var err error
+	if _, ok := reg.quotas.Limit(from.Name()); ok {
+		usage, err = reg.quotas.Usage(ctx, from.Name())
+	} else {
+		// The usage of a repository without a quota is not kept.
+		usage, err = reg.quotas.layersSize(ctx, reg, from.Name())
+	}
+	if err != nil {
+		return 0, err
+	}
+	if usage > limit {
+		return 0, distribution.ErrQuotaExceeded{Repository: to.Name(), Limit: limit, Size: usage}
+	}
+	return usage, nil
+}
+
+// clearRenamedCaches removes the layers and the tags of the files moved from
+// the caches of the repository from, so that they are no longer served under
+// its name.
+func (reg *registry) clearRenamedCaches(ctx context.Context, from reference.Named, files []string) {
+	var descriptorCache distribution.BlobDescriptorService
+	if reg.blobDescriptorCacheProvider != nil {
+		var err error
+		descriptorCache, err = reg.blobDescriptorCacheProvider.RepositoryScoped(from.Name())
+		if err != nil {
+			dcontext.GetLogger(ctx).Errorf("failed to clear the descriptor cache of %s: %v", from.Name(), err)
+		}
+	}
+	for _, file := range files {
+		components := strings.Split(strings.TrimPrefix(file, "/"), "/")
+		switch {
+		case descriptorCache != nil && len(components) == 4 && components[0] == "_layers" && components[3] == "link":
+			dgst := digest.NewDigestFromEncoded(digest.Algorithm(components[1]), components[2])
+			if err := descriptorCache.Clear(ctx, dgst); err != nil && !errors.Is(err, distribution.ErrBlobUnknown) {
+				dcontext.GetLogger(ctx).Errorf("failed to clear the descriptor of %s from the cache of %s: %v", dgst, from.Name(), err)
+			}
+		case reg.tagCacheProvider != nil && len(components) == 5 && components[1] == "tags" && components[3] == "current":
+			if err := reg.tagCacheProvider.Clear(ctx, from.Name(), components[2]); err != nil {
+				dcontext.GetLogger(ctx).Errorf("failed to clear the tag %s from the cache of %s: %v", components[2], from.Name(), err)
+			}
+		}
+	}
+}
+
+// RepositoryMoved marks the previous name of a renamed repository, so that
+// its clients are redirected to the new name.
+type RepositoryMoved struct {
+	// Name is the new name of the repository.
+	Name string `json:"name"`
+	// Since is when the repository was renamed.
+	Since time.Time `json:"since"`
+}
+
+// GetRepositoryMoved returns the marker of the repository name, or nil if the
+// repository was not renamed.
+func GetRepositoryMoved(ctx context.Context, storageDriver driver.StorageDriver, name string) (*RepositoryMoved, error) {
+	markerPath, err := pathFor(repositoryMovedPathSpec{name: name})
+	if err != nil {
+		return nil, err
+	}
+	content, err := storageDriver.GetContent(ctx, markerPath)
+	if err != nil {
+		if _, ok := err.(driver.PathNotFoundError); ok {
+			return nil, nil
+		}
+		return nil, err
+	}
+	var marker RepositoryMoved
+	if err := json.Unmarshal(content, &marker); err != nil {
+		return nil, err
+	}
+	return &marker, nil
+}
+
+// PutRepositoryMoved marks the repository name as renamed.
+func PutRepositoryMoved(ctx context.Context, storageDriver driver.StorageDriver, name string, marker RepositoryMoved) error {
+	markerPath, err := pathFor(repositoryMovedPathSpec{name: name})
+	if err != nil {
+		return err
+	}
+	content, err := json.Marshal(marker)
+	if err != nil {
+		return err
+	}
+	return storageDriver.PutContent(ctx, markerPath, content)
+}
+
+// DeleteRepositoryMoved removes the marker of the repository name, if any.
+func DeleteRepositoryMoved(ctx context.Context, storageDriver driver.StorageDriver, name string) error {
+	markerPath, err := pathFor(repositoryMovedPathSpec{name: name})
+	if err != nil {
+		return err
+	}
+	err = storageDriver.Delete(ctx, markerPath)
+	if _, ok := err.(driver.PathNotFoundError); ok {
+		return nil
+	}
+	return err
+}
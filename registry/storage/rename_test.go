@@ -0,0 +1,232 @@
+package storage
+
+import (
+	"context"
+	"errors"
+	"io"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/distribution/distribution/v3"
+	"github.com/distribution/distribution/v3/internal/dcontext"
+	"github.com/distribution/distribution/v3/registry/storage/cache/memory"
+	storagedriver "github.com/distribution/distribution/v3/registry/storage/driver"
+	"github.com/distribution/distribution/v3/registry/storage/driver/inmemory"
+	"github.com/distribution/distribution/v3/testutil"
+	"github.com/distribution/reference"
+	v1 "github.com/opencontainers/image-spec/specs-go/v1"
+)
+
+func renameRepository(t *testing.T, registry distribution.Namespace, from, to string) error {
+	t.Helper()
+	fromName, err := reference.WithName(from)
+	if err != nil {
+		t.Fatal(err)
+	}
+	toName, err := reference.WithName(to)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return registry.(distribution.RepositoryRenamer).Rename(dcontext.Background(), fromName, toName)
+}
+
+func TestRename(t *testing.T) {
+	ctx := dcontext.Background()
+	d := inmemory.New()
+	registry := createRegistry(t, d,
+		BlobDescriptorCacheProvider(memory.NewInMemoryBlobDescriptorCacheProvider(memory.UnlimitedSize)),
+		TagCacheProvider(memory.NewInMemoryTagCacheProvider(memory.UnlimitedSize, time.Hour)))
+
+	repo := makeRepository(t, registry, "team/app")
+	image := uploadRandomSchema2Image(t, repo)
+	if err := repo.Tags(ctx).Tag(ctx, "latest", v1.Descriptor{Digest: image.manifestDigest}); err != nil {
+		t.Fatal(err)
+	}
+	signature := uploadReferrer(t, repo, image.manifestDigest, "application/vnd.example.signature", v1.MediaTypeEmptyJSON, nil)
+	// The layers are shared with another repository, and a repository is
+	// nested under the name renamed.
+	for _, layer := range image.layers {
+		if _, err := layer.Seek(0, io.SeekStart); err != nil {
+			t.Fatal(err)
+		}
+	}
+	shared := makeRepository(t, registry, "shared")
+	if err := testutil.UploadBlobs(shared, image.layers); err != nil {
+		t.Fatal(err)
+	}
+	uploadGoldenImage(t, shared, "shared layer")
+	nested := uploadRandomSchema2Image(t, makeRepository(t, registry, "team/app/nested"))
+
+	// The caches of the previous name are filled.
+	for dgst := range image.layers {
+		if _, err := repo.Blobs(ctx).Stat(ctx, dgst); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if _, err := repo.Tags(ctx).Get(ctx, "latest"); err != nil {
+		t.Fatal(err)
+	}
+	blobs := allBlobs(t, registry)
+
+	if err := renameRepository(t, registry, "team/app", "platform/app"); err != nil {
+		t.Fatalf("unexpected error renaming the repository: %v", err)
+	}
+
+	// The blobs are not copied, and stay shared.
+	if after := allBlobs(t, registry); !reflect.DeepEqual(after, blobs) {
+		t.Fatalf("the blobs changed with the rename: %v, expected %v", after, blobs)
+	}
+	renamed := makeRepository(t, registry, "platform/app")
+	desc, err := renamed.Tags(ctx).Get(ctx, "latest")
+	if err != nil || desc.Digest != image.manifestDigest {
+		t.Fatalf("unexpected tag of the renamed repository %v: %v", desc, err)
+	}
+	if _, err := makeManifestService(t, renamed).Get(ctx, image.manifestDigest); err != nil {
+		t.Fatalf("manifest of the renamed repository not found: %v", err)
+	}
+	if referrers := listReferrers(t, renamed, image.manifestDigest, ""); len(referrers) != 1 || referrers[0].Digest != signature {
+		t.Fatalf("unexpected referrers of the renamed repository: %v", referrers)
+	}
+	for dgst := range image.layers {
+		if _, err := renamed.Blobs(ctx).Stat(ctx, dgst); err != nil {
+			t.Fatalf("layer %s of the renamed repository not found: %v", dgst, err)
+		}
+		if _, err := shared.Blobs(ctx).Stat(ctx, dgst); err != nil {
+			t.Fatalf("layer %s of the shared repository not found: %v", dgst, err)
+		}
+	}
+
+	// The previous name is unknown, including to the caches.
+	repo = makeRepository(t, registry, "team/app")
+	if _, err := repo.Tags(ctx).Get(ctx, "latest"); !errors.As(err, new(distribution.ErrTagUnknown)) {
+		t.Fatalf("expected the tag of the previous name to be unknown, got %v", err)
+	}
+	for dgst := range image.layers {
+		if _, err := repo.Blobs(ctx).Stat(ctx, dgst); !errors.Is(err, distribution.ErrBlobUnknown) {
+			t.Fatalf("expected layer %s of the previous name to be unknown, got %v", dgst, err)
+		}
+	}
+	if _, err := makeManifestService(t, makeRepository(t, registry, "team/app/nested")).Get(ctx, nested.manifestDigest); err != nil {
+		t.Fatalf("manifest of the nested repository not found: %v", err)
+	}
+	repos := make([]string, 10)
+	n, err := registry.Repositories(ctx, repos, "")
+	if err != nil && err != io.EOF {
+		t.Fatal(err)
+	}
+	if expected := []string{"platform/app", "shared", "team/app/nested"}; !reflect.DeepEqual(repos[:n], expected) {
+		t.Fatalf("unexpected catalog %v, expected %v", repos[:n], expected)
+	}
+
+	if err := renameRepository(t, registry, "platform/app", "shared"); !errors.As(err, new(distribution.ErrRepositoryExists)) {
+		t.Fatalf("expected the rename to an existing repository to fail, got %v", err)
+	}
+	if err := renameRepository(t, registry, "team/app", "team/other"); !errors.As(err, new(distribution.ErrRepositoryUnknown)) {
+		t.Fatalf("expected the rename of an unknown repository to fail, got %v", err)
+	}
+}
+
+// failingMoveDriver fails the move after the first ones.
+type failingMoveDriver struct {
+	storagedriver.StorageDriver
+	moves int
+}
+
+func (d *failingMoveDriver) Move(ctx context.Context, sourcePath, destPath string) error {
+	d.moves--
+	if d.moves == 0 {
+		return errors.New("move failed")
+	}
+	return d.StorageDriver.Move(ctx, sourcePath, destPath)
+}
+
+func TestRenameRollback(t *testing.T) {
+	ctx := dcontext.Background()
+	d := &failingMoveDriver{StorageDriver: inmemory.New(), moves: 3}
+	registry := createRegistry(t, d)
+	image := uploadRandomSchema2Image(t, makeRepository(t, registry, "app"))
+
+	if err := renameRepository(t, registry, "app", "renamed"); err == nil {
+		t.Fatal("expected the rename to fail")
+	}
+	if _, err := makeManifestService(t, makeRepository(t, registry, "app")).Get(ctx, image.manifestDigest); err != nil {
+		t.Fatalf("manifest not moved back: %v", err)
+	}
+	for dgst := range image.layers {
+		if _, err := makeRepository(t, registry, "app").Blobs(ctx).Stat(ctx, dgst); err != nil {
+			t.Fatalf("layer %s not moved back: %v", dgst, err)
+		}
+	}
+	if err := renameRepository(t, registry, "app", "renamed"); err != nil {
+		t.Fatalf("unexpected error renaming the repository again: %v", err)
+	}
+}
+
+func TestRenameQuota(t *testing.T) {
+	ctx := dcontext.Background()
+	quotas := newTestQuotas(t, QuotaRule{Pattern: "ci/*", Limit: 100}, QuotaRule{Pattern: "small/*", Limit: 10})
+	registry := createRegistry(t, inmemory.New(), EnforceQuotas(quotas))
+
+	repo := makeRepository(t, registry, "ci/app")
+	if _, err := addTestBlob(ctx, repo.Blobs(ctx), 60); err != nil {
+		t.Fatal(err)
+	}
+	uploadGoldenImage(t, repo, "quota layer")
+	usage, err := quotas.Usage(ctx, "ci/app")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The repository renamed is charged the usage of the previous name.
+	if err := renameRepository(t, registry, "ci/app", "small/app"); !errors.As(err, new(distribution.ErrQuotaExceeded)) {
+		t.Fatalf("expected the rename over the quota to fail, got %v", err)
+	}
+	if err := renameRepository(t, registry, "ci/app", "ci/renamed"); err != nil {
+		t.Fatal(err)
+	}
+	checkQuotaUsage(t, quotas, "ci/app", 0)
+	checkQuotaUsage(t, quotas, "ci/renamed", usage)
+
+	// The usage of a repository without a quota is measured.
+	if err := renameRepository(t, registry, "ci/renamed", "any/app"); err != nil {
+		t.Fatal(err)
+	}
+	checkQuotaUsage(t, quotas, "ci/renamed", 0)
+	if err := renameRepository(t, registry, "any/app", "small/app"); !errors.As(err, new(distribution.ErrQuotaExceeded)) {
+		t.Fatalf("expected the rename over the quota to fail, got %v", err)
+	}
+	if err := renameRepository(t, registry, "any/app", "ci/app"); err != nil {
+		t.Fatal(err)
+	}
+	checkQuotaUsage(t, quotas, "ci/app", usage)
+}
+
+func TestRepositoryMoved(t *testing.T) {
+	ctx := dcontext.Background()
+	d := inmemory.New()
+	if marker, err := GetRepositoryMoved(ctx, d, "team/app"); err != nil || marker != nil {
+		t.Fatalf("unexpected marker %v: %v", marker, err)
+	}
+	since := time.Now().UTC().Truncate(time.Second)
+	if err := PutRepositoryMoved(ctx, d, "team/app", RepositoryMoved{Name: "platform/app", Since: since}); err != nil {
+		t.Fatal(err)
+	}
+	marker, err := GetRepositoryMoved(ctx, d, "team/app")
+	if err != nil || marker == nil || marker.Name != "platform/app" || !marker.Since.Equal(since) {
+		t.Fatalf("unexpected marker %v: %v", marker, err)
+	}
+
+	// A repository renamed to the name drops its marker.
+	registry := createRegistry(t, d)
+	uploadRandomSchema2Image(t, makeRepository(t, registry, "platform/app"))
+	if err := renameRepository(t, registry, "platform/app", "team/app"); err != nil {
+		t.Fatal(err)
+	}
+	if marker, err := GetRepositoryMoved(ctx, d, "team/app"); err != nil || marker != nil {
+		t.Fatalf("expected the marker to be removed, got %v: %v", marker, err)
+	}
+	if err := DeleteRepositoryMoved(ctx, d, "team/app"); err != nil {
+		t.Fatal(err)
+	}
+}
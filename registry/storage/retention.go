@@ -0,0 +1,247 @@
+package storage
+
+import (
+	"context"
+	"fmt"
+	"path"
+	"sort"
+	"time"
+
+	"github.com/distribution/distribution/v3"
+	"github.com/distribution/distribution/v3/registry/storage/driver"
+	"github.com/opencontainers/go-digest"
+)
+
+// RetentionPolicy selects the tags deleted by garbage collection. The
+// manifests only referenced by deleted tags are then deleted along with the
+// blobs no other manifest references, while the untagged manifests are only
+// deleted with RemoveUntagged.
+type RetentionPolicy struct {
+	// Default is the rule of the repositories no rule of Repositories
+	// applies to.
+	Default RetentionRule
+	// Repositories are the rules applying to the repositories matching their
+	// pattern. The first rule matching a repository applies to it.
+	Repositories []RetentionRule
+}
+
+// RetentionRule selects the tags deleted from a repository. A tag is kept if
+// it matches a protected pattern or is a referrers tag, if it is one of the KeepLatest tags pushed
+// last, if it was pushed within KeepWithin, or if it was pulled within
+// KeepPulledWithin. With neither KeepLatest, KeepWithin nor KeepPulledWithin,
+// no tag is deleted.
+type RetentionRule struct {
+	// Pattern selects the repositories the rule applies to, using the syntax
+	// of path.Match. It is ignored for the default rule.
+	Pattern string
+	// KeepLatest is the number of unprotected tags kept, from the tag
+	// pushed last.
+	KeepLatest int
+	// KeepWithin keeps the tags pushed within this duration.
+	KeepWithin time.Duration
+	// KeepPulledWithin keeps the tags pulled within this duration, as
+	// recorded by LastAccess. A tag not pulled since it was pushed is kept
+	// for this duration from its push.
+	KeepPulledWithin time.Duration
+	// ProtectPatterns are the patterns of the tags which are never deleted,
+	// using the syntax of path.Match.
+	ProtectPatterns []string
+	// PruneReferrersTags subjects the tags of the referrers tag schema to
+	// the rule, which otherwise never deletes them.
+	PruneReferrersTags bool
+}
+
+// Validate returns an error if a pattern of the policy is malformed.
+func (p *RetentionPolicy) Validate() error {
+	for _, rule := range p.Repositories {
+		if rule.Pattern == "" {
+			return fmt.Errorf("retention rules of repositories require a pattern")
+		}
+	}
+	for _, rule := range append([]RetentionRule{p.Default}, p.Repositories...) {
+		if rule.KeepLatest < 0 {
+			return fmt.Errorf("keeplatest must not be negative, %d invalid", rule.KeepLatest)
+		}
+		if rule.KeepWithin < 0 {
+			return fmt.Errorf("keepwithinduration must not be negative, %v invalid", rule.KeepWithin)
+		}
+		if rule.KeepPulledWithin < 0 {
+			return fmt.Errorf("keeppulledwithinduration must not be negative, %v invalid", rule.KeepPulledWithin)
+		}
+		patterns := rule.ProtectPatterns
+		if rule.Pattern != "" {
+			patterns = append([]string{rule.Pattern}, patterns...)
+		}
+		for _, pattern := range patterns {
+			if _, err := path.Match(pattern, ""); err != nil {
+				return fmt.Errorf("invalid retention pattern %q: %v", pattern, err)
+			}
+		}
+	}
+	return nil
+}
+
+// rule returns the rule applying to the repository name, along with the name
+// of the rule: the pattern of the repository rule, or "default".
+func (p *RetentionPolicy) rule(name string) (RetentionRule, string) {
+	for _, rule := range p.Repositories {
+		if ok, _ := path.Match(rule.Pattern, name); ok {
+			return rule, rule.Pattern
+		}
+	}
+	return p.Default, "default"
+}
+
+// retainedTag is a tag of a repository, along with whether the retention
+// policy keeps it.
+type retainedTag struct {
+	name     string
+	digest   digest.Digest
+	pushedAt time.Time
+	// pulledAt is the last pull of the tag, only read if the rule keeps the
+	// tags pulled recently.
+	pulledAt time.Time
+	kept     bool
+}
+
+// repositoryRetention is the outcome of the retention policy for a
+// repository.
+type repositoryRetention struct {
+	rule string
+	tags []retainedTag
+	// kept and pruned map the manifests to the tags referencing them.
+	kept   map[digest.Digest][]string
+	pruned map[digest.Digest][]string
+}
+
+// applyRetention selects the tags of a repository deleted by the retention
+// policy. The tags pushed at or after keepAfter are kept, unless it is zero.
+func applyRetention(ctx context.Context, storageDriver driver.StorageDriver, repository distribution.Repository, policy *RetentionPolicy, now, keepAfter time.Time) (*repositoryRetention, error) {
+	name := repository.Named().Name()
+	rule, ruleName := policy.rule(name)
+	r := &repositoryRetention{
+		rule:   ruleName,
+		kept:   make(map[digest.Digest][]string),
+		pruned: make(map[digest.Digest][]string),
+	}
+
+	tagService := repository.Tags(ctx)
+	allTags, err := tagService.All(ctx)
+	if err != nil {
+		if _, ok := err.(distribution.ErrRepositoryUnknown); ok {
+			return r, nil
+		}
+		return nil, fmt.Errorf("failed to retrieve tags: %v", err)
+	}
+
+	var unprotected []*retainedTag
+	r.tags = make([]retainedTag, 0, len(allTags))
+	for _, tag := range allTags {
+		desc, err := tagService.Get(ctx, tag)
+		if err != nil {
+			if _, ok := err.(distribution.ErrTagUnknown); ok {
+				continue
+			}
+			return nil, fmt.Errorf("failed to retrieve tag %s: %v", tag, err)
+		}
+		linkPath, err := pathFor(manifestTagCurrentPathSpec{name: name, tag: tag})
+		if err != nil {
+			return nil, err
+		}
+		fi, err := storageDriver.Stat(ctx, linkPath)
+		if err != nil {
+			return nil, fmt.Errorf("failed to stat tag %s: %v", tag, err)
+		}
+		retained := retainedTag{name: tag, digest: desc.Digest, pushedAt: fi.ModTime(), kept: true}
+		if rule.KeepPulledWithin > 0 {
+			times, err := TagAccessTimes(ctx, storageDriver, name, tag)
+			if err != nil {
+				return nil, fmt.Errorf("failed to read the last pull of tag %s: %v", tag, err)
+			}
+			retained.pulledAt = times.LastPulled
+		}
+		r.tags = append(r.tags, retained)
+	}
+	for i := range r.tags {
+		if !rule.protects(r.tags[i].name) {
+			unprotected = append(unprotected, &r.tags[i])
+		}
+	}
+
+	if rule.KeepLatest > 0 || rule.KeepWithin > 0 || rule.KeepPulledWithin > 0 {
+		// Tags pushed at the same time are ordered by name, so that the same
+		// tags are kept on each run.
+		sort.SliceStable(unprotected, func(i, j int) bool {
+			return unprotected[i].pushedAt.After(unprotected[j].pushedAt)
+		})
+		for i, tag := range unprotected {
+			tag.kept = i < rule.KeepLatest || (rule.KeepWithin > 0 && now.Sub(tag.pushedAt) <= rule.KeepWithin) ||
+				(rule.KeepPulledWithin > 0 && now.Sub(tag.lastUsed()) <= rule.KeepPulledWithin) ||
+				(!keepAfter.IsZero() && !tag.pushedAt.Before(keepAfter))
+		}
+	}
+
+	for _, tag := range r.tags {
+		if tag.kept {
+			r.kept[tag.digest] = append(r.kept[tag.digest], tag.name)
+		} else {
+			r.pruned[tag.digest] = append(r.pruned[tag.digest], tag.name)
+		}
+	}
+	return r, nil
+}
+
+// lastUsed returns the last pull of the tag, or its push if it was not pulled
+// since.
+func (tag *retainedTag) lastUsed() time.Time {
+	if tag.pulledAt.After(tag.pushedAt) {
+		return tag.pulledAt
+	}
+	return tag.pushedAt
+}
+
+// tagNames returns the names of all the tags of the repository, whose history
+// a deleted manifest is removed from.
+func (r *repositoryRetention) tagNames() []string {
+	names := make([]string, 0, len(r.tags))
+	for _, tag := range r.tags {
+		names = append(names, tag.name)
+	}
+	return names
+}
+
+func (rule RetentionRule) protects(tag string) bool {
+	if !rule.PruneReferrersTags && IsReferrersTag(tag) {
+		return true
+	}
+	for _, pattern := range rule.ProtectPatterns {
+		if ok, _ := path.Match(pattern, tag); ok {
+			return true
+		}
+	}
+	return false
+}
+
+// prunedManifests returns the manifests referenced by the manifests of the
+// deleted tags, such as the manifests of an index, which are deleted along
+// with them unless a kept manifest references them too.
+func (r *repositoryRetention) prunedManifests(ctx context.Context, manifestService distribution.ManifestService) (map[digest.Digest]struct{}, error) {
+	referenced := make(map[digest.Digest]struct{})
+	for dgst := range r.pruned {
+		if _, ok := r.kept[dgst]; ok {
+			continue
+		}
+		if ok, _ := manifestService.Exists(ctx, dgst); !ok {
+			continue
+		}
+		err := markManifestReferences(dgst, manifestService, ctx, func(d digest.Digest) bool {
+			_, seen := referenced[d]
+			referenced[d] = struct{}{}
+			return seen
+		})
+		if err != nil {
+			return nil, err
+		}
+	}
+	return referenced, nil
+}
@@ -0,0 +1,359 @@
+package storage
+
+import (
+	"context"
+	"sort"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/distribution/distribution/v3"
+	"github.com/distribution/distribution/v3/internal/dcontext"
+	storagedriver "github.com/distribution/distribution/v3/registry/storage/driver"
+	"github.com/distribution/distribution/v3/registry/storage/driver/inmemory"
+	"github.com/distribution/distribution/v3/testutil"
+	"github.com/opencontainers/go-digest"
+	v1 "github.com/opencontainers/image-spec/specs-go/v1"
+)
+
+// historyDriver reports the push times of the tags of a synthetic history.
+type historyDriver struct {
+	storagedriver.StorageDriver
+	mu       sync.Mutex
+	pushedAt map[string]time.Time
+}
+
+type historyFileInfo struct {
+	storagedriver.FileInfo
+	modTime time.Time
+}
+
+func (fi historyFileInfo) ModTime() time.Time {
+	return fi.modTime
+}
+
+func (d *historyDriver) Stat(ctx context.Context, path string) (storagedriver.FileInfo, error) {
+	fi, err := d.StorageDriver.Stat(ctx, path)
+	if err != nil {
+		return nil, err
+	}
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if pushedAt, ok := d.pushedAt[path]; ok {
+		return historyFileInfo{FileInfo: fi, modTime: pushedAt}, nil
+	}
+	return fi, nil
+}
+
+func newHistoryDriver() *historyDriver {
+	return &historyDriver{StorageDriver: inmemory.New(), pushedAt: make(map[string]time.Time)}
+}
+
+// tagAt tags the manifest dgst of repository, as if it was pushed at
+// pushedAt.
+func (d *historyDriver) tagAt(t *testing.T, repository distribution.Repository, tag string, dgst digest.Digest, pushedAt time.Time) {
+	ctx := dcontext.Background()
+	if err := repository.Tags(ctx).Tag(ctx, tag, v1.Descriptor{Digest: dgst}); err != nil {
+		t.Fatalf("failed to tag manifest: %v", err)
+	}
+	linkPath, err := pathFor(manifestTagCurrentPathSpec{name: repository.Named().Name(), tag: tag})
+	if err != nil {
+		t.Fatal(err)
+	}
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.pushedAt[linkPath] = pushedAt
+}
+
+func allTags(t *testing.T, repository distribution.Repository) []string {
+	ctx := dcontext.Background()
+	tags, err := repository.Tags(ctx).All(ctx)
+	if err != nil {
+		t.Fatalf("failed to retrieve tags: %v", err)
+	}
+	return tags
+}
+
+func reportedTags(report *GCReport, repo string) map[string]string {
+	tags := make(map[string]string)
+	for _, r := range report.Repositories {
+		if r.Name != repo {
+			continue
+		}
+		for _, tag := range r.Tags {
+			tags[tag.Name] = tag.Rule
+		}
+	}
+	return tags
+}
+
+func TestRetentionKeepLatest(t *testing.T) {
+	ctx := dcontext.Background()
+	d := newHistoryDriver()
+	registry := createRegistry(t, d)
+	repo := makeRepository(t, registry, "history/app")
+	now := time.Now()
+
+	// v1 to v4 are pushed a day apart, and v4 is also tagged latest.
+	// release-1 is older than all of them, and stable shares the manifest of
+	// v1.
+	v1Digest := uploadGoldenImage(t, repo, "base layer", "v1 layer")
+	v2Digest := uploadGoldenImage(t, repo, "base layer", "v2 layer")
+	v3Digest := uploadGoldenImage(t, repo, "base layer", "v3 layer")
+	v4Digest := uploadGoldenImage(t, repo, "base layer", "v4 layer")
+	releaseDigest := uploadGoldenImage(t, repo, "base layer", "release layer")
+	d.tagAt(t, repo, "release-1", releaseDigest, now.Add(-10*24*time.Hour))
+	d.tagAt(t, repo, "v1", v1Digest, now.Add(-4*24*time.Hour))
+	d.tagAt(t, repo, "v2", v2Digest, now.Add(-3*24*time.Hour))
+	d.tagAt(t, repo, "v3", v3Digest, now.Add(-2*24*time.Hour))
+	d.tagAt(t, repo, "v4", v4Digest, now.Add(-24*time.Hour))
+	d.tagAt(t, repo, "latest", v4Digest, now.Add(-24*time.Hour))
+	d.tagAt(t, repo, "stable", v1Digest, now.Add(-time.Hour))
+
+	opts := GCOpts{
+		DryRun: true,
+		Quiet:  true,
+		Retention: &RetentionPolicy{
+			Default: RetentionRule{KeepLatest: 3, ProtectPatterns: []string{"release-*"}},
+		},
+	}
+	report, err := GarbageCollect(ctx, d, registry, opts)
+	if err != nil {
+		t.Fatalf("Failed mark and sweep: %v", err)
+	}
+	// stable, latest and v4 are the unprotected tags pushed last.
+	tags := reportedTags(report, "history/app")
+	if len(tags) != 3 || tags["v1"] != "default" || tags["v2"] != "default" || tags["v3"] != "default" {
+		t.Fatalf("unexpected tags eligible for deletion: %v", tags)
+	}
+	if len(allTags(t, repo)) != 7 {
+		t.Fatal("dry run deleted tags")
+	}
+
+	opts.DryRun = false
+	if _, err := GarbageCollect(ctx, d, registry, opts); err != nil {
+		t.Fatalf("Failed mark and sweep: %v", err)
+	}
+	if tags := allTags(t, repo); len(tags) != 4 || tags[0] != "latest" || tags[1] != "release-1" || tags[2] != "stable" || tags[3] != "v4" {
+		t.Fatalf("unexpected tags after garbage collection: %v", tags)
+	}
+
+	// The manifest of v1 is kept with stable, while the manifests of v2 and
+	// v3 are deleted along with their exclusive layers.
+	manifests := allManifests(t, makeManifestService(t, repo))
+	for dgst, kept := range map[digest.Digest]bool{v1Digest: true, v2Digest: false, v3Digest: false, v4Digest: true, releaseDigest: true} {
+		if _, ok := manifests[dgst]; ok != kept {
+			t.Fatalf("manifest %s kept: %v, expected %v", dgst, ok, kept)
+		}
+	}
+	blobs := allBlobs(t, registry)
+	for content, kept := range map[string]bool{"base layer": true, "v1 layer": true, "v2 layer": false, "v3 layer": false, "v4 layer": true} {
+		if _, ok := blobs[digest.FromString(content)]; ok != kept {
+			t.Fatalf("layer %q kept: %v, expected %v", content, ok, kept)
+		}
+	}
+	for _, dgst := range []digest.Digest{v2Digest, v3Digest} {
+		if _, ok := blobs[dgst]; ok {
+			t.Fatalf("manifest blob %s was not deleted", dgst)
+		}
+	}
+}
+
+func TestRetentionRepositoryRules(t *testing.T) {
+	ctx := dcontext.Background()
+	d := newHistoryDriver()
+	registry := createRegistry(t, d)
+	now := time.Now()
+
+	for _, name := range []string{"team/app", "other/app"} {
+		repo := makeRepository(t, registry, name)
+		oldDigest := uploadGoldenImage(t, repo, name+" old layer")
+		recentDigest := uploadGoldenImage(t, repo, name+" recent layer")
+		d.tagAt(t, repo, "old", oldDigest, now.Add(-72*time.Hour))
+		d.tagAt(t, repo, "recent", recentDigest, now.Add(-time.Hour))
+	}
+
+	report, err := GarbageCollect(ctx, d, registry, GCOpts{
+		DryRun: true,
+		Quiet:  true,
+		Retention: &RetentionPolicy{
+			Repositories: []RetentionRule{{Pattern: "team/*", KeepWithin: 24 * time.Hour}},
+		},
+	})
+	if err != nil {
+		t.Fatalf("Failed mark and sweep: %v", err)
+	}
+	if tags := reportedTags(report, "team/app"); len(tags) != 1 || tags["old"] != "team/*" {
+		t.Fatalf("unexpected tags eligible for deletion in team/app: %v", tags)
+	}
+	// The default rule deletes no tag.
+	if tags := reportedTags(report, "other/app"); len(tags) != 0 {
+		t.Fatalf("unexpected tags eligible for deletion in other/app: %v", tags)
+	}
+	for _, r := range report.Repositories {
+		if r.Name == "team/app" && (len(r.Manifests) != 1 || r.Manifests[0].Digest == "") {
+			t.Fatalf("unexpected manifests eligible for deletion in team/app: %v", r.Manifests)
+		}
+	}
+}
+
+func TestRetentionKeepPulledWithin(t *testing.T) {
+	ctx := dcontext.Background()
+	d := newHistoryDriver()
+	registry := createRegistry(t, d)
+	repo := makeRepository(t, registry, "history/pulled")
+	now := time.Now()
+
+	// All the tags were pushed long ago. v1 was pulled recently, v2 long
+	// ago, and v3 never was, while new was pushed recently and never pulled.
+	for i, tag := range []string{"v1", "v2", "v3"} {
+		dgst := uploadGoldenImage(t, repo, tag+" layer")
+		d.tagAt(t, repo, tag, dgst, now.Add(-time.Duration(30-i)*24*time.Hour))
+	}
+	d.tagAt(t, repo, "new", uploadGoldenImage(t, repo, "new layer"), now.Add(-time.Hour))
+
+	lastAccess := NewLastAccess(d, time.Hour)
+	lastAccess.now = func() time.Time { return now.Add(-2 * time.Hour) }
+	if err := lastAccess.Pulled(ctx, "history/pulled", "v1"); err != nil {
+		t.Fatal(err)
+	}
+	lastAccess.now = func() time.Time { return now.Add(-10 * 24 * time.Hour) }
+	if err := lastAccess.Pulled(ctx, "history/pulled", "v2"); err != nil {
+		t.Fatal(err)
+	}
+
+	report, err := GarbageCollect(ctx, d, registry, GCOpts{
+		DryRun: true,
+		Quiet:  true,
+		Retention: &RetentionPolicy{
+			Default: RetentionRule{KeepPulledWithin: 7 * 24 * time.Hour},
+		},
+	})
+	if err != nil {
+		t.Fatalf("Failed mark and sweep: %v", err)
+	}
+	if tags := reportedTags(report, "history/pulled"); len(tags) != 2 || tags["v2"] != "default" || tags["v3"] != "default" {
+		t.Fatalf("unexpected tags eligible for deletion: %v", tags)
+	}
+	for _, tag := range report.Repositories[0].Tags {
+		if tag.Name == "v2" && !tag.PulledAt.Equal(now.Add(-10*24*time.Hour).UTC()) {
+			t.Fatalf("unexpected last pull of v2 reported: %v", tag.PulledAt)
+		}
+		if tag.Name == "v3" && !tag.PulledAt.IsZero() {
+			t.Fatalf("unexpected last pull of v3 reported: %v", tag.PulledAt)
+		}
+	}
+}
+
+func TestRetentionReferrersTags(t *testing.T) {
+	ctx := dcontext.Background()
+	d := newHistoryDriver()
+	registry := createRegistry(t, d)
+	repo := makeRepository(t, registry, "history/signed")
+	now := time.Now()
+
+	v1Digest := uploadGoldenImage(t, repo, "v1 layer")
+	v2Digest := uploadGoldenImage(t, repo, "v2 layer")
+	signature := uploadReferrer(t, repo, v1Digest, "application/vnd.example.signature", v1.MediaTypeEmptyJSON, nil)
+	index := tagReferrersIndex(t, repo, v1Digest, v1.Descriptor{MediaType: v1.MediaTypeImageManifest, Digest: signature, Size: 1})
+	d.tagAt(t, repo, ReferrersTag(v1Digest), index, now.Add(-48*time.Hour))
+	d.tagAt(t, repo, "v1", v1Digest, now.Add(-24*time.Hour))
+	d.tagAt(t, repo, "v2", v2Digest, now.Add(-time.Hour))
+
+	opts := GCOpts{
+		DryRun: true,
+		Quiet:  true,
+		Retention: &RetentionPolicy{
+			Default: RetentionRule{KeepLatest: 1},
+		},
+	}
+	report, err := GarbageCollect(ctx, d, registry, opts)
+	if err != nil {
+		t.Fatalf("Failed mark and sweep: %v", err)
+	}
+	// The referrers tag is neither deleted nor counted among the tags kept.
+	if tags := reportedTags(report, "history/signed"); len(tags) != 1 || tags["v1"] != "default" {
+		t.Fatalf("unexpected tags eligible for deletion: %v", tags)
+	}
+
+	opts.Retention.Default.PruneReferrersTags = true
+	report, err = GarbageCollect(ctx, d, registry, opts)
+	if err != nil {
+		t.Fatalf("Failed mark and sweep: %v", err)
+	}
+	if tags := reportedTags(report, "history/signed"); len(tags) != 2 || tags[ReferrersTag(v1Digest)] != "default" {
+		t.Fatalf("unexpected tags eligible for deletion: %v", tags)
+	}
+}
+
+// TestRetentionManifestList checks that the manifests of a deleted index are
+// deleted along with it, unless a kept tag references them.
+func TestRetentionManifestList(t *testing.T) {
+	ctx := dcontext.Background()
+	d := newHistoryDriver()
+	registry := createRegistry(t, d)
+	repo := makeRepository(t, registry, "history/multiarch")
+	manifestService := makeManifestService(t, repo)
+	now := time.Now()
+
+	sharedDigest := uploadGoldenImage(t, repo, "shared platform layer")
+	exclusiveDigest := uploadGoldenImage(t, repo, "exclusive platform layer")
+	manifestList, err := testutil.MakeManifestList(registry.BlobStatter(), []digest.Digest{sharedDigest, exclusiveDigest})
+	if err != nil {
+		t.Fatalf("failed to make manifest list: %v", err)
+	}
+	listDigest, err := manifestService.Put(ctx, manifestList)
+	if err != nil {
+		t.Fatalf("manifest upload failed: %v", err)
+	}
+	d.tagAt(t, repo, "multiarch", listDigest, now.Add(-48*time.Hour))
+	d.tagAt(t, repo, "single", sharedDigest, now.Add(-time.Hour))
+
+	report, err := GarbageCollect(ctx, d, registry, GCOpts{
+		Quiet: true,
+		Retention: &RetentionPolicy{
+			Default: RetentionRule{KeepLatest: 1},
+		},
+	})
+	if err != nil {
+		t.Fatalf("Failed mark and sweep: %v", err)
+	}
+
+	var deleted []digest.Digest
+	for _, r := range report.Repositories {
+		for _, m := range r.Manifests {
+			deleted = append(deleted, m.Digest)
+		}
+	}
+	expected := []digest.Digest{listDigest, exclusiveDigest}
+	sort.Slice(expected, func(i, j int) bool { return expected[i] < expected[j] })
+	if len(deleted) != 2 || deleted[0] != expected[0] || deleted[1] != expected[1] {
+		t.Fatalf("expected manifests %v to be deleted, got %v", expected, deleted)
+	}
+
+	manifests := allManifests(t, manifestService)
+	if _, ok := manifests[sharedDigest]; !ok {
+		t.Fatal("manifest referenced by a kept tag was deleted")
+	}
+	blobs := allBlobs(t, registry)
+	if _, ok := blobs[digest.FromString("exclusive platform layer")]; ok {
+		t.Fatal("layer of a deleted manifest was not deleted")
+	}
+	if _, ok := blobs[digest.FromString("shared platform layer")]; !ok {
+		t.Fatal("layer of a kept manifest was deleted")
+	}
+}
+
+func TestRetentionPolicyValidate(t *testing.T) {
+	for _, policy := range []RetentionPolicy{
+		{Default: RetentionRule{KeepLatest: -1}},
+		{Default: RetentionRule{KeepPulledWithin: -time.Hour}},
+		{Default: RetentionRule{ProtectPatterns: []string{"release-["}}},
+		{Repositories: []RetentionRule{{KeepLatest: 1}}},
+		{Repositories: []RetentionRule{{Pattern: "team/[", KeepLatest: 1}}},
+	} {
+		if err := policy.Validate(); err == nil {
+			t.Fatalf("expected an error validating %+v", policy)
+		}
+	}
+}
@@ -23,6 +23,7 @@ type schema2ManifestHandler struct {
 	blobStore    distribution.BlobStore
 	ctx          context.Context
 	manifestURLs manifestURLs
+	layers       layerVerifier
 }
 
 var _ ManifestHandler = &schema2ManifestHandler{}
@@ -85,10 +86,10 @@ func (ms *schema2ManifestHandler) verifyManifest(ctx context.Context, mnfst sche
 
 	blobsService := ms.repository.Blobs(ctx)
 
-	for _, descriptor := range mnfst.References() {
+	for i, descriptor := range mnfst.References() {
 		err := descriptor.Digest.Validate()
 		if err != nil {
-			errs = append(errs, err, distribution.ErrManifestBlobUnknown{Digest: descriptor.Digest})
+			errs = append(errs, err, blobUnknown(i, descriptor))
 			continue
 		}
 
@@ -122,7 +123,11 @@ func (ms *schema2ManifestHandler) verifyManifest(ctx context.Context, mnfst sche
 			fallthrough // double check the blob store.
 		default:
 			// check its presence
-			_, err = blobsService.Stat(ctx, descriptor.Digest)
+			if i > 0 {
+				err = ms.layers.stat(ctx, blobsService, descriptor)
+			} else {
+				_, err = blobsService.Stat(ctx, descriptor.Digest)
+			}
 		}
 
 		if err != nil {
@@ -131,7 +136,7 @@ func (ms *schema2ManifestHandler) verifyManifest(ctx context.Context, mnfst sche
 			}
 
 			// On error here, we always append unknown blob errors.
-			errs = append(errs, distribution.ErrManifestBlobUnknown{Digest: descriptor.Digest})
+			errs = append(errs, blobUnknown(i, descriptor))
 		}
 	}
 
@@ -0,0 +1,577 @@
+package storage
+
+import (
+	"bufio"
+	"context"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash/fnv"
+	"io"
+	"io/fs"
+	"math"
+	"math/rand/v2"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/distribution/distribution/v3/internal/dcontext"
+	"github.com/distribution/distribution/v3/registry/storage/driver"
+	"github.com/opencontainers/go-digest"
+	"golang.org/x/time/rate"
+)
+
+const (
+	// scrubCheckpointVersion is the version of the format of the checkpoints,
+	// which a scrub only resumes from if it has the same.
+	scrubCheckpointVersion = 1
+
+	// scrubChunkSize is the size of the reads of the content of the blobs,
+	// which are limited one at a time.
+	scrubChunkSize = 32 << 10
+)
+
+// The problems found by a scrub.
+const (
+	// ScrubMismatch is the problem of a blob whose content does not match
+	// its digest.
+	ScrubMismatch = "mismatch"
+	// ScrubEmpty is the problem of a blob whose content is empty, while its
+	// digest is not the digest of empty content.
+	ScrubEmpty = "empty"
+	// ScrubUnreadable is the problem of a blob whose content cannot be read.
+	ScrubUnreadable = "unreadable"
+)
+
+// ScrubOpts configures a scrub of the blob store.
+type ScrubOpts struct {
+	// Concurrency is the number of blobs read concurrently, 1 if zero.
+	Concurrency int
+	// RateLimit is the maximum number of bytes read per second, across the
+	// blobs read concurrently, unlimited if zero.
+	RateLimit int64
+	// Sample is the fraction of the blobs scrubbed, every blob if zero. The
+	// blobs are sampled at random, differently on each scrub.
+	Sample float64
+	// Quarantine moves the content of the blobs which does not match their
+	// digest out of the blob store, so that they are unknown to the registry
+	// until they are pushed again. The unreadable blobs are left in place.
+	Quarantine bool
+	// Quiet silences the progress.
+	Quiet bool
+	// Output is where the progress is printed, the standard output if nil.
+	Output io.Writer
+	// ProgressInterval is the interval at which the progress is printed,
+	// never if zero.
+	ProgressInterval time.Duration
+	// Checkpoint, if set, saves the progress of the scrub, so that it can be
+	// resumed if it is interrupted.
+	Checkpoint *ScrubCheckpointOpts
+}
+
+// ScrubCheckpointOpts configures the checkpoints of a scrub. The blobs are
+// scrubbed in the order of their digests, and the checkpoint records the last
+// blob before which every blob was scrubbed, along with the problems found.
+type ScrubCheckpointOpts struct {
+	// Path is the file the checkpoints are saved to. It is removed once the
+	// scrub completes.
+	Path string
+	// Resume resumes the scrub from the checkpoint saved to Path, if any,
+	// rather than starting over.
+	Resume bool
+	// Interval is the minimum time between two checkpoints, one minute if
+	// zero.
+	Interval time.Duration
+}
+
+// ScrubReport lists the problems found by a scrub of the blob store.
+type ScrubReport struct {
+	StartedAt time.Time `json:"startedAt"`
+	// Sample is the fraction of the blobs scrubbed, if they were sampled.
+	Sample float64 `json:"sample,omitempty"`
+	// Blobs is the number of blobs scrubbed, and Bytes the size of their
+	// content read.
+	Blobs int   `json:"blobs"`
+	Bytes int64 `json:"bytes"`
+	// Skipped is the number of blobs left out of the sample.
+	Skipped  int            `json:"skipped"`
+	Problems []ScrubProblem `json:"problems"`
+}
+
+// ScrubProblem is a blob found corrupted or unreadable by a scrub.
+type ScrubProblem struct {
+	Digest digest.Digest `json:"digest"`
+	// Problem is ScrubMismatch, ScrubEmpty or ScrubUnreadable.
+	Problem string `json:"problem"`
+	// Size is the number of bytes read.
+	Size int64 `json:"size"`
+	// Actual is the digest of the content read, if it was read completely.
+	Actual digest.Digest `json:"actual,omitempty"`
+	// Error is the error reading the content, or quarantining the blob.
+	Error       string `json:"error,omitempty"`
+	Quarantined bool   `json:"quarantined,omitempty"`
+}
+
+// scrubState is the state of a scrub saved to its checkpoints.
+type scrubState struct {
+	Version int `json:"version"`
+	// Seed selects the blobs of the sample, so that a scrub resumed
+	// scrubs the same sample.
+	Seed       uint64 `json:"seed"`
+	Quarantine bool   `json:"quarantine"`
+	// Last is the last blob before which every blob was scrubbed.
+	Last   digest.Digest `json:"last,omitempty"`
+	Report *ScrubReport  `json:"report"`
+}
+
+func (opts ScrubOpts) emit(format string, a ...any) {
+	if opts.Quiet {
+		return
+	}
+	w := opts.Output
+	if w == nil {
+		w = os.Stdout
+	}
+	fmt.Fprintf(w, format+"\n", a...)
+}
+
+// Scrub reads the content of the blobs of the blob store and verifies that it
+// matches their digest, reporting the blobs whose content does not match, is
+// empty or cannot be read. It may be run while the registry serves requests.
+// An interrupted scrub saves its checkpoint, and returns the error of the
+// context along with the report of the blobs scrubbed up to the checkpoint.
+func Scrub(ctx context.Context, storageDriver driver.StorageDriver, opts ScrubOpts) (*ScrubReport, error) {
+	if opts.Sample < 0 || opts.Sample > 1 {
+		return nil, fmt.Errorf("scrub sample must be between 0 and 1, %v invalid", opts.Sample)
+	}
+	if opts.Sample == 1 {
+		opts.Sample = 0
+	}
+	state, err := loadScrubState(opts, time.Now())
+	if err != nil {
+		return nil, err
+	}
+	if state.Last != "" {
+		opts.emit("resuming the scrub started at %s after %s", state.Report.StartedAt.Format(time.RFC3339), state.Last)
+	}
+
+	s := &scrubber{
+		driver:  storageDriver,
+		opts:    opts,
+		state:   state,
+		pending: make(map[int]*scrubResult),
+		saved:   time.Now(),
+	}
+	if opts.RateLimit > 0 {
+		s.limiter = rate.NewLimiter(rate.Limit(opts.RateLimit), scrubChunkSize)
+	}
+	s.printed = s.saved
+	err = s.run(ctx)
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	report := state.Report
+	if opts.Checkpoint != nil {
+		if err != nil {
+			if saveErr := s.save(); saveErr != nil {
+				dcontext.GetLogger(ctx).Errorf("%v", saveErr)
+			}
+		} else if removeErr := os.Remove(opts.Checkpoint.Path); removeErr != nil && !errors.Is(removeErr, fs.ErrNotExist) {
+			dcontext.GetLogger(ctx).Errorf("failed to remove checkpoint: %v", removeErr)
+		}
+	}
+	return report, err
+}
+
+// loadScrubState returns the state of a new scrub, or the state of the
+// checkpoint it resumes from.
+func loadScrubState(opts ScrubOpts, now time.Time) (*scrubState, error) {
+	state := &scrubState{
+		Version:    scrubCheckpointVersion,
+		Seed:       rand.Uint64(),
+		Quarantine: opts.Quarantine,
+		Report: &ScrubReport{
+			StartedAt: now,
+			Sample:    opts.Sample,
+			Problems:  make([]ScrubProblem, 0),
+		},
+	}
+	if opts.Checkpoint == nil {
+		return state, nil
+	}
+	if !opts.Checkpoint.Resume {
+		if err := os.Remove(opts.Checkpoint.Path); err != nil && !errors.Is(err, fs.ErrNotExist) {
+			return nil, fmt.Errorf("failed to remove checkpoint: %v", err)
+		}
+		return state, nil
+	}
+
+	content, err := os.ReadFile(opts.Checkpoint.Path)
+	if err != nil {
+		if errors.Is(err, fs.ErrNotExist) {
+			return state, nil
+		}
+		return nil, fmt.Errorf("failed to open checkpoint: %v", err)
+	}
+	var saved scrubState
+	if err := json.Unmarshal(content, &saved); err != nil || saved.Report == nil {
+		return nil, fmt.Errorf("failed to read checkpoint %s: %v", opts.Checkpoint.Path, err)
+	}
+	if saved.Version != scrubCheckpointVersion {
+		return nil, fmt.Errorf("checkpoint %s has version %d, expected %d", opts.Checkpoint.Path, saved.Version, scrubCheckpointVersion)
+	}
+	if saved.Quarantine != opts.Quarantine || saved.Report.Sample != opts.Sample {
+		return nil, fmt.Errorf("checkpoint %s was saved with other options", opts.Checkpoint.Path)
+	}
+	return &saved, nil
+}
+
+// scrubber scrubs the blobs in the order of their digests. The result of a
+// blob is only added to the report once every blob before it was scrubbed,
+// so that the report is always that of the blobs up to the last one.
+type scrubber struct {
+	driver  driver.StorageDriver
+	opts    ScrubOpts
+	limiter *rate.Limiter
+	// position is the position of the next blob walked.
+	position int
+
+	mu    sync.Mutex
+	state *scrubState
+	// pending are the results of the blobs being scrubbed, by their position
+	// in the order of the scrub. next is the position of the first blob
+	// whose result is not in the report yet.
+	pending map[int]*scrubResult
+	next    int
+	saved   time.Time
+	printed time.Time
+}
+
+// scrubResult is the result of the scrub of a blob.
+type scrubResult struct {
+	dgst    digest.Digest
+	done    bool
+	skipped bool
+	size    int64
+	problem *ScrubProblem
+}
+
+type scrubJob struct {
+	position int
+	dgst     digest.Digest
+}
+
+func (s *scrubber) run(ctx context.Context) error {
+	concurrency := max(s.opts.Concurrency, 1)
+	jobs := make(chan scrubJob)
+	errs := make(chan error, concurrency)
+	var wg sync.WaitGroup
+	for range concurrency {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for job := range jobs {
+				if err := s.scrub(ctx, job); err != nil {
+					errs <- err
+					return
+				}
+			}
+		}()
+	}
+
+	err := s.walk(ctx, func(dgst digest.Digest) error {
+		position := s.position
+		s.position++
+		s.mu.Lock()
+		s.pending[position] = &scrubResult{dgst: dgst}
+		s.mu.Unlock()
+		if !s.sampled(dgst) {
+			s.complete(position, nil, 0, true)
+			return nil
+		}
+		select {
+		case jobs <- scrubJob{position: position, dgst: dgst}:
+			return nil
+		case err := <-errs:
+			return err
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	})
+	close(jobs)
+	wg.Wait()
+	if err == nil {
+		select {
+		case err = <-errs:
+		default:
+		}
+	}
+	return err
+}
+
+// walk calls fn with the digest of each blob of the blob store after the last
+// blob scrubbed, in order.
+func (s *scrubber) walk(ctx context.Context, fn func(digest.Digest) error) error {
+	root, err := pathFor(blobsPathSpec{})
+	if err != nil {
+		return err
+	}
+	last := s.state.Last
+	list := func(dir string) ([]string, error) {
+		children, err := s.driver.List(ctx, dir)
+		if err != nil {
+			if errors.As(err, new(driver.PathNotFoundError)) {
+				return nil, nil
+			}
+			return nil, err
+		}
+		sort.Strings(children)
+		return children, nil
+	}
+
+	algorithms, err := list(root)
+	if err != nil {
+		return err
+	}
+	for _, algorithmDir := range algorithms {
+		algorithm := digest.Algorithm(path.Base(algorithmDir))
+		if last != "" && algorithm < last.Algorithm() {
+			continue
+		}
+		prefixes, err := list(algorithmDir)
+		if err != nil {
+			return err
+		}
+		for _, prefixDir := range prefixes {
+			if last != "" && algorithm == last.Algorithm() && path.Base(prefixDir) < last.Encoded()[:min(2, len(last.Encoded()))] {
+				continue
+			}
+			blobs, err := list(prefixDir)
+			if err != nil {
+				return err
+			}
+			for _, blobDir := range blobs {
+				dgst := digest.NewDigestFromEncoded(algorithm, path.Base(blobDir))
+				if err := dgst.Validate(); err != nil {
+					dcontext.GetLogger(ctx).Warnf("skipping the blob directory %s: %v", blobDir, err)
+					continue
+				}
+				if last != "" && (algorithm < last.Algorithm() || (algorithm == last.Algorithm() && dgst.Encoded() <= last.Encoded())) {
+					continue
+				}
+				if err := fn(dgst); err != nil {
+					return err
+				}
+			}
+		}
+	}
+	return nil
+}
+
+// sampled reports whether the blob is part of the sample scrubbed.
+func (s *scrubber) sampled(dgst digest.Digest) bool {
+	if s.opts.Sample == 0 {
+		return true
+	}
+	h := fnv.New64a()
+	_ = binary.Write(h, binary.BigEndian, s.state.Seed)
+	_, _ = io.WriteString(h, dgst.String())
+	return float64(h.Sum64()) < s.opts.Sample*math.MaxUint64
+}
+
+// scrub reads the content of a blob and records the problem found, if any,
+// quarantining the blob if set to. It only returns an error if the scrub is
+// interrupted.
+func (s *scrubber) scrub(ctx context.Context, job scrubJob) error {
+	problem, size, err := s.verify(ctx, job.dgst)
+	if errors.Is(err, errScrubBlobGone) {
+		s.complete(job.position, nil, 0, true)
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	if problem != nil && problem.Problem != ScrubUnreadable && s.opts.Quarantine {
+		if err := s.quarantine(ctx, job.dgst); err != nil {
+			problem.Error = err.Error()
+		} else {
+			problem.Quarantined = true
+		}
+	}
+	s.complete(job.position, problem, size, false)
+	return nil
+}
+
+// errScrubBlobGone is returned by verify for a blob without content, such as
+// one being deleted or quarantined, which is skipped.
+var errScrubBlobGone = errors.New("blob content not found")
+
+// verify reads the content of a blob, and returns the problem found, if any,
+// along with the number of bytes read.
+func (s *scrubber) verify(ctx context.Context, dgst digest.Digest) (*ScrubProblem, int64, error) {
+	blobPath, err := pathFor(blobDataPathSpec{digest: dgst})
+	if err != nil {
+		return nil, 0, err
+	}
+	unreadable := func(size int64, err error) (*ScrubProblem, int64, error) {
+		if ctx.Err() != nil {
+			return nil, size, ctx.Err()
+		}
+		dcontext.GetLoggerWithField(ctx, "digest", dgst).Errorf("blob unreadable: %v", err)
+		return &ScrubProblem{Digest: dgst, Problem: ScrubUnreadable, Size: size, Error: err.Error()}, size, nil
+	}
+
+	rc, err := s.driver.Reader(ctx, blobPath, 0)
+	if err != nil {
+		if errors.As(err, new(driver.PathNotFoundError)) {
+			return nil, 0, errScrubBlobGone
+		}
+		return unreadable(0, err)
+	}
+	defer rc.Close()
+
+	var r io.Reader = rc
+	if s.limiter != nil {
+		r = &rateLimitedReader{ctx: ctx, r: rc, limiter: s.limiter}
+	}
+	digester := dgst.Algorithm().Digester()
+	size, err := io.Copy(digester.Hash(), r)
+	if err != nil {
+		return unreadable(size, err)
+	}
+	actual := digester.Digest()
+	if actual == dgst {
+		return nil, size, nil
+	}
+	problem := &ScrubProblem{Digest: dgst, Problem: ScrubMismatch, Size: size, Actual: actual}
+	if size == 0 {
+		problem.Problem = ScrubEmpty
+	}
+	dcontext.GetLoggerWithFields(ctx, map[any]any{"digest": dgst, "actual": actual, "size": size}).Errorf("blob content does not match its digest")
+	return problem, size, nil
+}
+
+// quarantine moves the content of a blob out of the blob store, and lifts the
+// quarantine of the verification of the reads, if any, so that the blob is
+// unknown rather than corrupted until it is pushed again.
+func (s *scrubber) quarantine(ctx context.Context, dgst digest.Digest) error {
+	blobPath, err := pathFor(blobDataPathSpec{digest: dgst})
+	if err != nil {
+		return err
+	}
+	quarantinePath, err := pathFor(scrubQuarantinePathSpec{digest: dgst})
+	if err != nil {
+		return err
+	}
+	if err := s.driver.Move(ctx, blobPath, quarantinePath); err != nil {
+		return fmt.Errorf("failed to quarantine blob %s: %v", dgst, err)
+	}
+	markerPath, err := pathFor(blobQuarantinePathSpec{digest: dgst})
+	if err != nil {
+		return err
+	}
+	if err := s.driver.Delete(ctx, markerPath); err != nil && !errors.As(err, new(driver.PathNotFoundError)) {
+		return fmt.Errorf("failed to remove the quarantine marker of blob %s: %v", dgst, err)
+	}
+	return nil
+}
+
+// complete records that the blob at position was scrubbed, or skipped, adds
+// the results of the blobs scrubbed up to the first one still being scrubbed
+// to the report, and saves the checkpoint and prints the progress if their
+// interval elapsed.
+func (s *scrubber) complete(position int, problem *ScrubProblem, size int64, skipped bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	result := s.pending[position]
+	result.done, result.skipped, result.size, result.problem = true, skipped, size, problem
+
+	report := s.state.Report
+	for result := s.pending[s.next]; result != nil && result.done; result = s.pending[s.next] {
+		if result.skipped {
+			report.Skipped++
+		} else {
+			report.Blobs++
+			report.Bytes += result.size
+		}
+		if result.problem != nil {
+			report.Problems = append(report.Problems, *result.problem)
+		}
+		s.state.Last = result.dgst
+		delete(s.pending, s.next)
+		s.next++
+	}
+
+	now := time.Now()
+	if s.opts.Checkpoint != nil {
+		interval := s.opts.Checkpoint.Interval
+		if interval <= 0 {
+			interval = defaultCheckpointInterval
+		}
+		if now.Sub(s.saved) >= interval {
+			if err := s.save(); err != nil {
+				dcontext.GetLogger(context.Background()).Errorf("%v", err)
+			}
+			s.saved = now
+		}
+	}
+	if s.opts.ProgressInterval > 0 && now.Sub(s.printed) >= s.opts.ProgressInterval {
+		s.printed = now
+		s.opts.emit("progress: %d blobs scrubbed, %d bytes, %d skipped, %d problems, up to %s", report.Blobs, report.Bytes, report.Skipped, len(report.Problems), s.state.Last)
+	}
+}
+
+// save replaces the checkpoint with the state of the scrub. The blobs
+// scrubbed after the last one of the report are scrubbed again once the scrub
+// resumes.
+func (s *scrubber) save() error {
+	// The checkpoint is replaced at once, so that a scrub interrupted while
+	// it is written resumes from the previous one.
+	f, err := os.CreateTemp(filepath.Dir(s.opts.Checkpoint.Path), filepath.Base(s.opts.Checkpoint.Path)+".*")
+	if err != nil {
+		return fmt.Errorf("failed to save checkpoint: %v", err)
+	}
+	w := bufio.NewWriter(f)
+	err = json.NewEncoder(w).Encode(s.state)
+	if err == nil {
+		err = w.Flush()
+	}
+	if err == nil {
+		err = f.Sync()
+	}
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Rename(f.Name(), s.opts.Checkpoint.Path)
+	}
+	if err != nil {
+		os.Remove(f.Name())
+		return fmt.Errorf("failed to save checkpoint: %v", err)
+	}
+	return nil
+}
+
+// rateLimitedReader limits the rate at which r is read.
+type rateLimitedReader struct {
+	ctx     context.Context
+	r       io.Reader
+	limiter *rate.Limiter
+}
+
+func (l *rateLimitedReader) Read(p []byte) (int, error) {
+	if len(p) > l.limiter.Burst() {
+		p = p[:l.limiter.Burst()]
+	}
+	n, err := l.r.Read(p)
+	if n > 0 {
+		if waitErr := l.limiter.WaitN(l.ctx, n); waitErr != nil {
+			return n, waitErr
+		}
+	}
+	return n, err
+}
@@ -0,0 +1,280 @@
+package storage
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	storagedriver "github.com/distribution/distribution/v3/registry/storage/driver"
+	"github.com/distribution/distribution/v3/registry/storage/driver/filesystem"
+	"github.com/distribution/distribution/v3/registry/storage/driver/inmemory"
+	"github.com/opencontainers/go-digest"
+)
+
+// readerDriver counts the blobs read, and fails or interrupts the reads for
+// which fail, called with the path read and the number of reads, returns an
+// error.
+type readerDriver struct {
+	storagedriver.StorageDriver
+	mu    sync.Mutex
+	reads int
+	fail  func(path string, reads int) error
+}
+
+func (d *readerDriver) Reader(ctx context.Context, path string, offset int64) (io.ReadCloser, error) {
+	d.mu.Lock()
+	d.reads++
+	reads := d.reads
+	d.mu.Unlock()
+	if d.fail != nil {
+		if err := d.fail(path, reads); err != nil {
+			return nil, err
+		}
+	}
+	return d.StorageDriver.Reader(ctx, path, offset)
+}
+
+// putScrubBlob writes content as the content of the blob dgst, and returns
+// dgst.
+func putScrubBlob(t *testing.T, d storagedriver.StorageDriver, dgst digest.Digest, content []byte) digest.Digest {
+	t.Helper()
+	blobPath, err := pathFor(blobDataPathSpec{digest: dgst})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := d.PutContent(context.Background(), blobPath, content); err != nil {
+		t.Fatal(err)
+	}
+	return dgst
+}
+
+func TestScrub(t *testing.T) {
+	for name, newDriver := range map[string]func(t *testing.T) storagedriver.StorageDriver{
+		"inmemory": func(*testing.T) storagedriver.StorageDriver { return inmemory.New() },
+		"filesystem": func(t *testing.T) storagedriver.StorageDriver {
+			return filesystem.New(filesystem.DriverParameters{RootDirectory: t.TempDir(), MaxThreads: 100})
+		},
+	} {
+		t.Run(name, func(t *testing.T) {
+			ctx := context.Background()
+			d := newDriver(t)
+			for i := range 10 {
+				content := fmt.Appendf(nil, "blob %d", i)
+				putScrubBlob(t, d, digest.FromBytes(content), content)
+			}
+			putScrubBlob(t, d, digestSha256Empty, nil)
+			mismatch := putScrubBlob(t, d, digest.FromString("original"), []byte("corrupted"))
+			empty := putScrubBlob(t, d, digest.FromString("truncated"), nil)
+			unreadable := putScrubBlob(t, d, digest.FromString("unreadable"), []byte("unreadable"))
+			unreadablePath, _ := pathFor(blobDataPathSpec{digest: unreadable})
+			// A blob quarantined by the verification of the reads.
+			markerPath, _ := pathFor(blobQuarantinePathSpec{digest: mismatch})
+			if err := d.PutContent(ctx, markerPath, []byte(digest.FromString("corrupted"))); err != nil {
+				t.Fatal(err)
+			}
+
+			rd := &readerDriver{StorageDriver: d, fail: func(path string, _ int) error {
+				if path == unreadablePath {
+					return errors.New("i/o error")
+				}
+				return nil
+			}}
+
+			// Without repair, the problems are only reported.
+			report, err := Scrub(ctx, rd, ScrubOpts{Concurrency: 4, Quiet: true})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if report.Blobs != 14 || report.Skipped != 0 || report.Bytes == 0 {
+				t.Fatalf("unexpected report %+v", report)
+			}
+			expected := []ScrubProblem{
+				{Digest: mismatch, Problem: ScrubMismatch, Size: 9, Actual: digest.FromString("corrupted")},
+				{Digest: empty, Problem: ScrubEmpty, Actual: digestSha256Empty},
+				{Digest: unreadable, Problem: ScrubUnreadable, Error: "i/o error"},
+			}
+			problems := make(map[digest.Digest]ScrubProblem)
+			for _, problem := range report.Problems {
+				problems[problem.Digest] = problem
+			}
+			if len(problems) != len(expected) {
+				t.Fatalf("unexpected problems %+v", report.Problems)
+			}
+			for _, problem := range expected {
+				if problems[problem.Digest] != problem {
+					t.Errorf("unexpected problem %+v, expected %+v", problems[problem.Digest], problem)
+				}
+			}
+			for i := 1; i < len(report.Problems); i++ {
+				if report.Problems[i-1].Digest > report.Problems[i].Digest {
+					t.Fatalf("problems not in the order of the digests: %+v", report.Problems)
+				}
+			}
+
+			// The blobs whose content does not match are quarantined.
+			report, err = Scrub(ctx, rd, ScrubOpts{Concurrency: 4, Quarantine: true, Quiet: true})
+			if err != nil {
+				t.Fatal(err)
+			}
+			for _, problem := range report.Problems {
+				if problem.Quarantined != (problem.Problem != ScrubUnreadable) || problem.Error != expectedError(problem) {
+					t.Errorf("unexpected problem %+v", problem)
+				}
+			}
+			for dgst, content := range map[digest.Digest]string{mismatch: "corrupted", empty: ""} {
+				blobPath, _ := pathFor(blobDataPathSpec{digest: dgst})
+				if _, err := d.Stat(ctx, blobPath); !errors.As(err, new(storagedriver.PathNotFoundError)) {
+					t.Errorf("%s: expected the blob to be moved out of the blob store, got %v", dgst, err)
+				}
+				quarantinePath, _ := pathFor(scrubQuarantinePathSpec{digest: dgst})
+				if quarantined, err := d.GetContent(ctx, quarantinePath); err != nil || string(quarantined) != content {
+					t.Errorf("%s: unexpected quarantined content %q: %v", dgst, quarantined, err)
+				}
+			}
+			if _, err := d.Stat(ctx, markerPath); !errors.As(err, new(storagedriver.PathNotFoundError)) {
+				t.Errorf("expected the quarantine marker to be removed, got %v", err)
+			}
+			if _, err := d.Stat(ctx, unreadablePath); err != nil {
+				t.Errorf("expected the unreadable blob to be kept: %v", err)
+			}
+
+			// The blobs quarantined are no longer scrubbed.
+			report, err = Scrub(ctx, rd, ScrubOpts{Quiet: true})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if report.Blobs != 12 {
+				t.Fatalf("unexpected report %+v", report)
+			}
+			if len(report.Problems) != 1 || report.Problems[0].Digest != unreadable {
+				t.Fatalf("unexpected problems %+v", report.Problems)
+			}
+		})
+	}
+}
+
+func expectedError(problem ScrubProblem) string {
+	if problem.Problem == ScrubUnreadable {
+		return "i/o error"
+	}
+	return ""
+}
+
+func TestScrubResume(t *testing.T) {
+	d := inmemory.New()
+	var first, last digest.Digest
+	for i := range 50 {
+		content := fmt.Appendf(nil, "blob %d", i)
+		dgst := digest.FromBytes(content)
+		if first == "" || dgst < first {
+			first = dgst
+		}
+		if dgst > last {
+			last = dgst
+		}
+		putScrubBlob(t, d, dgst, content)
+	}
+	// The first and the last blobs are corrupted, found before and after
+	// the scrub is interrupted.
+	putScrubBlob(t, d, first, []byte("corrupted"))
+	putScrubBlob(t, d, last, []byte("corrupted"))
+
+	stateFile := filepath.Join(t.TempDir(), "scrub.json")
+	checkpoint := &ScrubCheckpointOpts{Path: stateFile, Resume: true, Interval: time.Nanosecond}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	rd := &readerDriver{StorageDriver: d}
+	rd.fail = func(_ string, reads int) error {
+		if reads > 20 {
+			cancel()
+			return ctx.Err()
+		}
+		return nil
+	}
+	interrupted, err := Scrub(ctx, rd, ScrubOpts{Concurrency: 4, Quiet: true, Checkpoint: checkpoint})
+	if !errors.Is(err, context.Canceled) {
+		t.Fatalf("expected the scrub to be interrupted, got %v", err)
+	}
+	if interrupted.Blobs == 0 || interrupted.Blobs > 20 || len(interrupted.Problems) != 1 || interrupted.Problems[0].Digest != first {
+		t.Fatalf("unexpected report of the interrupted scrub %+v", interrupted)
+	}
+	if _, err := os.Stat(stateFile); err != nil {
+		t.Fatalf("expected a checkpoint: %v", err)
+	}
+
+	// A scrub with other options does not resume.
+	if _, err := Scrub(context.Background(), d, ScrubOpts{Quarantine: true, Quiet: true, Checkpoint: checkpoint}); err == nil {
+		t.Fatal("expected the checkpoint of other options to be refused")
+	}
+
+	rd = &readerDriver{StorageDriver: d}
+	report, err := Scrub(context.Background(), rd, ScrubOpts{Concurrency: 4, Quiet: true, Checkpoint: checkpoint})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if rd.reads != 50-interrupted.Blobs {
+		t.Fatalf("expected the %d blobs left to be read once resumed, %d read", 50-interrupted.Blobs, rd.reads)
+	}
+	if report.Blobs != 50 || !report.StartedAt.Equal(interrupted.StartedAt) {
+		t.Fatalf("unexpected report of the resumed scrub %+v", report)
+	}
+	if len(report.Problems) != 2 || report.Problems[0].Digest != first || report.Problems[1].Digest != last {
+		t.Fatalf("unexpected problems %+v", report.Problems)
+	}
+	if _, err := os.Stat(stateFile); !errors.Is(err, os.ErrNotExist) {
+		t.Fatalf("expected the checkpoint to be removed once the scrub completes: %v", err)
+	}
+}
+
+func TestScrubSample(t *testing.T) {
+	d := inmemory.New()
+	for i := range 200 {
+		content := fmt.Appendf(nil, "blob %d", i)
+		putScrubBlob(t, d, digest.FromBytes(content), content)
+	}
+
+	rd := &readerDriver{StorageDriver: d}
+	report, err := Scrub(context.Background(), rd, ScrubOpts{Sample: 0.25, Quiet: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if report.Blobs+report.Skipped != 200 || report.Blobs != rd.reads || report.Sample != 0.25 {
+		t.Fatalf("unexpected report %+v, %d blobs read", report, rd.reads)
+	}
+	// The blobs are sampled at random, 50 expected.
+	if report.Blobs < 20 || report.Blobs > 80 {
+		t.Fatalf("unexpected sample of %d blobs", report.Blobs)
+	}
+
+	if _, err := Scrub(context.Background(), d, ScrubOpts{Sample: 1.5}); err == nil {
+		t.Fatal("expected a sample over 1 to be refused")
+	}
+}
+
+func TestScrubRateLimit(t *testing.T) {
+	d := inmemory.New()
+	for i := range 3 {
+		content := make([]byte, scrubChunkSize)
+		content[0] = byte(i)
+		putScrubBlob(t, d, digest.FromBytes(content), content)
+	}
+
+	// The first chunk is read at once, the two others at the rate limit.
+	started := time.Now()
+	report, err := Scrub(context.Background(), d, ScrubOpts{Concurrency: 3, RateLimit: 4 * scrubChunkSize, Quiet: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if report.Bytes != 3*scrubChunkSize || len(report.Problems) != 0 {
+		t.Fatalf("unexpected report %+v", report)
+	}
+	if elapsed := time.Since(started); elapsed < 400*time.Millisecond {
+		t.Fatalf("expected the reads to be limited, read in %v", elapsed)
+	}
+}
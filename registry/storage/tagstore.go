@@ -17,7 +17,11 @@ import (
 	storagedriver "github.com/distribution/distribution/v3/registry/storage/driver"
 )
 
-var _ distribution.TagService = &tagStore{}
+var (
+	_ distribution.TagService         = &tagStore{}
+	_ distribution.TagDetailLister    = &tagStore{}
+	_ distribution.TagHistoryProvider = &tagStore{}
+)
 
 // tagStore provides methods to manage manifest tags in a backend storage driver.
 // This implementation uses the same on-disk layout as the (now deleted) tag
@@ -234,6 +238,53 @@ func (ts *tagStore) ManifestDigests(ctx context.Context, tag string) ([]digest.D
 	return dgsts, nil
 }
 
+// History returns the manifests the tag has referenced, newest first, from the
+// index of the tag. The time of each is the modification time of its link in
+// the index, which is written every time the tag is set.
+func (ts *tagStore) History(ctx context.Context, tag string) ([]distribution.TagHistoryEntry, error) {
+	if _, err := ts.Get(ctx, tag); err != nil {
+		return nil, err
+	}
+
+	root, err := pathFor(manifestTagIndexPathSpec{
+		name: ts.repository.Named().Name(),
+		tag:  tag,
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	history := make([]distribution.TagHistoryEntry, 0)
+	err = ts.blobStore.driver.Walk(ctx, root, func(fileInfo storagedriver.FileInfo) error {
+		if fileInfo.IsDir() || path.Base(fileInfo.Path()) != "link" {
+			return nil
+		}
+		dgst, err := digestFromPath(path.Dir(fileInfo.Path()))
+		if err != nil {
+			return err
+		}
+		history = append(history, distribution.TagHistoryEntry{Digest: dgst, ModTime: fileInfo.ModTime()})
+		return nil
+	}, storagedriver.WithParallelism(ts.blobStore.walkParallelism))
+	if err != nil {
+		switch err.(type) {
+		case storagedriver.PathNotFoundError:
+			// the tag was set before its index was recorded
+			return history, nil
+		default:
+			return nil, err
+		}
+	}
+
+	sort.Slice(history, func(i, j int) bool {
+		if !history[i].ModTime.Equal(history[j].ModTime) {
+			return history[i].ModTime.After(history[j].ModTime)
+		}
+		return history[i].Digest < history[j].Digest
+	})
+	return history, nil
+}
+
 // List returns the tags for the repository.
 func (ts *tagStore) List(ctx context.Context, limit int, last string) ([]string, error) {
 	filledBuffer := false
@@ -293,6 +344,125 @@ func (ts *tagStore) List(ctx context.Context, limit int, last string) ([]string,
 	return tags, io.EOF
 }
 
+// ListDetails returns the tags for the repository along with the manifests
+// they currently reference. The current links of the tags are found during a
+// single walk, taking their modification time from it, and then read
+// concurrently.
+func (ts *tagStore) ListDetails(ctx context.Context, limit int, last string) ([]distribution.TagDetail, error) {
+	if limit == 0 {
+		return nil, errors.New("attempted to list 0 tags")
+	}
+
+	root, err := pathFor(manifestTagsPathSpec{
+		name: ts.repository.Named().Name(),
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	startAfter := ""
+	if last != "" {
+		startAfter, err = pathFor(manifestTagPathSpec{
+			name: ts.repository.Named().Name(),
+			tag:  last,
+		})
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	filledBuffer := false
+	var details []distribution.TagDetail
+	err = ts.blobStore.driver.Walk(ctx, root, func(fileInfo storagedriver.FileInfo) error {
+		// The walk enters each tag after last, only to find its current link.
+		parts := strings.Split(fileInfo.Path()[len(root)+1:], "/")
+		if !lessPath(last, parts[0]) {
+			return storagedriver.ErrSkipDir
+		}
+		switch {
+		case len(parts) == 1:
+			return nil
+		case len(parts) == 2 && parts[1] == "current":
+			return nil
+		case len(parts) == 3 && parts[2] == "link" && !fileInfo.IsDir():
+			details = append(details, distribution.TagDetail{
+				Name:    parts[0],
+				ModTime: fileInfo.ModTime(),
+			})
+			// if we've filled our slice, no need to walk any further
+			if limit > 0 && len(details) == limit {
+				filledBuffer = true
+				return storagedriver.ErrFilledBuffer
+			}
+		}
+		return storagedriver.ErrSkipDir
+	}, storagedriver.WithStartAfterHint(startAfter), storagedriver.WithParallelism(ts.blobStore.walkParallelism))
+	if err != nil {
+		switch err := err.(type) {
+		case storagedriver.PathNotFoundError:
+			return nil, distribution.ErrRepositoryUnknown{Name: ts.repository.Named().Name()}
+		default:
+			return nil, err
+		}
+	}
+
+	manifests, err := ts.repository.Manifests(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	g, gctx := errgroup.WithContext(ctx)
+	g.SetLimit(ts.concurrencyLimit)
+	for i := range details {
+		g.Go(func() error {
+			desc, err := ts.Get(gctx, details[i].Name)
+			if err != nil {
+				switch err.(type) {
+				case distribution.ErrTagUnknown:
+					// the tag was removed since the walk
+					return nil
+				}
+				return err
+			}
+			details[i].Descriptor = desc
+
+			manifest, err := manifests.Get(gctx, desc.Digest)
+			if err != nil {
+				switch err.(type) {
+				case distribution.ErrManifestUnknownRevision:
+					return nil
+				}
+				return err
+			}
+			mediaType, payload, err := manifest.Payload()
+			if err != nil {
+				return err
+			}
+			details[i].Descriptor.MediaType = mediaType
+			details[i].Descriptor.Size = int64(len(payload))
+			return nil
+		})
+	}
+	if err := g.Wait(); err != nil {
+		return nil, err
+	}
+
+	resolved := details[:0]
+	for _, detail := range details {
+		if detail.Descriptor.Digest != "" {
+			resolved = append(resolved, detail)
+		}
+	}
+
+	if filledBuffer {
+		// There are potentially more tags to list
+		return resolved, nil
+	}
+
+	// We didn't fill the buffer, so that's the end of the list of tags
+	return resolved, io.EOF
+}
+
 // handleTag calls function fn with a tag path if fileInfo
 // has a path of a tag under root and that it is lexographically
 // after last. Otherwise, it will return ErrSkipDir or ErrFilledBuffer.
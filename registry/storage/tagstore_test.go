@@ -2,11 +2,13 @@ package storage
 
 import (
 	"context"
+	"io"
 	"reflect"
 	"testing"
 
 	"github.com/distribution/distribution/v3"
 	"github.com/distribution/distribution/v3/manifest/schema2"
+	"github.com/distribution/distribution/v3/registry/storage/driver"
 	"github.com/distribution/distribution/v3/registry/storage/driver/inmemory"
 	"github.com/distribution/reference"
 	digest "github.com/opencontainers/go-digest"
@@ -19,6 +21,7 @@ type tagsTestEnv struct {
 	bs  distribution.BlobStore
 	ms  distribution.ManifestService
 	gbs distribution.BlobStatter
+	d   driver.StorageDriver
 	ctx context.Context
 }
 
@@ -45,6 +48,7 @@ func testTagStore(t *testing.T) *tagsTestEnv {
 		ts:  repo.Tags(ctx),
 		bs:  repo.Blobs(ctx),
 		gbs: reg.BlobStatter(),
+		d:   d,
 		ms:  ms,
 	}
 }
@@ -305,6 +309,190 @@ func TestTagIndexes(t *testing.T) {
 	}
 }
 
+func TestTagListDetails(t *testing.T) {
+	env := testTagStore(t)
+	tagStore := env.ts
+	ctx := env.ctx
+
+	lister, ok := tagStore.(distribution.TagDetailLister)
+	if !ok {
+		t.Fatal("tagStore does not implement TagDetailLister interface")
+	}
+
+	conf, err := env.bs.Put(ctx, "application/octet-stream", []byte{0})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var descs []v1.Descriptor
+	for i := range 2 {
+		layer, err := env.bs.Put(ctx, "application/octet-stream", []byte{byte(i + 1)})
+		if err != nil {
+			t.Fatal(err)
+		}
+		dm, err := schema2.FromStruct(schema2.Manifest{
+			Versioned: specs.Versioned{SchemaVersion: 2},
+			MediaType: schema2.MediaTypeManifest,
+			Config:    v1.Descriptor{Digest: conf.Digest, Size: 1, MediaType: schema2.MediaTypeImageConfig},
+			Layers:    []v1.Descriptor{{Digest: layer.Digest, Size: 1, MediaType: schema2.MediaTypeLayer}},
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		dgst, err := env.ms.Put(ctx, dm)
+		if err != nil {
+			t.Fatal(err)
+		}
+		descs = append(descs, v1.Descriptor{Digest: dgst})
+	}
+
+	// "b" is moved to the second manifest, and "d" references a manifest
+	// which does not exist.
+	for tag, desc := range map[string]v1.Descriptor{
+		"a": descs[0],
+		"b": descs[0],
+		"c": descs[1],
+		"d": {Digest: digest.FromString("missing manifest")},
+	} {
+		if err := tagStore.Tag(ctx, tag, desc); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := tagStore.Tag(ctx, "b", descs[1]); err != nil {
+		t.Fatal(err)
+	}
+
+	details, err := lister.ListDetails(ctx, -1, "")
+	if err != io.EOF {
+		t.Fatalf("unexpected error listing tag details: %v", err)
+	}
+	var names []string
+	for _, detail := range details {
+		names = append(names, detail.Name)
+
+		desc, err := tagStore.Get(ctx, detail.Name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if detail.Descriptor.Digest != desc.Digest {
+			t.Errorf("tag %s: digest %s listed, resolved %s", detail.Name, detail.Descriptor.Digest, desc.Digest)
+		}
+		mediaType := ""
+		if manifest, err := env.ms.Get(ctx, desc.Digest); err == nil {
+			mediaType, _, _ = manifest.Payload()
+		}
+		if detail.Descriptor.MediaType != mediaType {
+			t.Errorf("tag %s: media type %q listed, resolved %q", detail.Name, detail.Descriptor.MediaType, mediaType)
+		}
+
+		linkPath, err := pathFor(manifestTagCurrentPathSpec{name: "a/b", tag: detail.Name})
+		if err != nil {
+			t.Fatal(err)
+		}
+		fi, err := env.d.Stat(ctx, linkPath)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !detail.ModTime.Equal(fi.ModTime()) {
+			t.Errorf("tag %s: modification time %v listed, link modified %v", detail.Name, detail.ModTime, fi.ModTime())
+		}
+	}
+	if !reflect.DeepEqual(names, []string{"a", "b", "c", "d"}) {
+		t.Fatalf("unexpected tags listed in detail: %v", names)
+	}
+
+	// The details are paginated like the plain list.
+	var paginated []distribution.TagDetail
+	last := ""
+	for {
+		page, err := lister.ListDetails(ctx, 3, last)
+		if err != nil && err != io.EOF {
+			t.Fatal(err)
+		}
+		tags, listErr := tagStore.List(ctx, 3, last)
+		if listErr != err || len(tags) != len(page) {
+			t.Fatalf("page after %q: %d tags and %v listed in detail, %d tags and %v listed", last, len(page), err, len(tags), listErr)
+		}
+		paginated = append(paginated, page...)
+		if err == io.EOF {
+			break
+		}
+		last = page[len(page)-1].Name
+	}
+	if !reflect.DeepEqual(paginated, details) {
+		t.Fatalf("paginated details %v differ from %v", paginated, details)
+	}
+}
+
+func TestTagHistory(t *testing.T) {
+	env := testTagStore(t)
+	tagStore := env.ts
+	ctx := env.ctx
+
+	provider, ok := tagStore.(distribution.TagHistoryProvider)
+	if !ok {
+		t.Fatal("tagStore does not implement TagHistoryProvider interface")
+	}
+
+	conf, err := env.bs.Put(ctx, "application/octet-stream", []byte{0})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var dgsts []digest.Digest
+	for i := range 3 {
+		layer, err := env.bs.Put(ctx, "application/octet-stream", []byte{byte(i + 1)})
+		if err != nil {
+			t.Fatal(err)
+		}
+		dm, err := schema2.FromStruct(schema2.Manifest{
+			Versioned: specs.Versioned{SchemaVersion: 2},
+			MediaType: schema2.MediaTypeManifest,
+			Config:    v1.Descriptor{Digest: conf.Digest, Size: 1, MediaType: schema2.MediaTypeImageConfig},
+			Layers:    []v1.Descriptor{{Digest: layer.Digest, Size: 1, MediaType: schema2.MediaTypeLayer}},
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		dgst, err := env.ms.Put(ctx, dm)
+		if err != nil {
+			t.Fatal(err)
+		}
+		dgsts = append(dgsts, dgst)
+	}
+
+	// The tag is overwritten three times, moving back to the first manifest
+	// last.
+	for _, dgst := range []digest.Digest{dgsts[0], dgsts[1], dgsts[2], dgsts[0]} {
+		if err := tagStore.Tag(ctx, "latest", v1.Descriptor{Digest: dgst}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// Another tag does not show up in the history.
+	if err := tagStore.Tag(ctx, "other", v1.Descriptor{Digest: dgsts[1]}); err != nil {
+		t.Fatal(err)
+	}
+
+	history, err := provider.History(ctx, "latest")
+	if err != nil {
+		t.Fatalf("unexpected error getting the tag history: %v", err)
+	}
+	var got []digest.Digest
+	for i, entry := range history {
+		got = append(got, entry.Digest)
+		if i > 0 && entry.ModTime.After(history[i-1].ModTime) {
+			t.Fatalf("history is not ordered newest first: %v", history)
+		}
+	}
+	if expected := []digest.Digest{dgsts[0], dgsts[2], dgsts[1]}; !reflect.DeepEqual(got, expected) {
+		t.Fatalf("unexpected history: %v != %v", got, expected)
+	}
+
+	if _, err := provider.History(ctx, "unknown"); err == nil {
+		t.Fatal("expected an error getting the history of an unknown tag")
+	} else if _, ok := err.(distribution.ErrTagUnknown); !ok {
+		t.Fatalf("unexpected error getting the history of an unknown tag: %v", err)
+	}
+}
+
 func digestMap(dgsts []digest.Digest) map[digest.Digest]struct{} {
 	set := make(map[digest.Digest]struct{})
 	for _, dgst := range dgsts {
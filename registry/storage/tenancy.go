@@ -0,0 +1,225 @@
+package storage
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"slices"
+	"strings"
+
+	"github.com/distribution/distribution/v3"
+	"github.com/distribution/distribution/v3/registry/storage/driver"
+	"github.com/distribution/reference"
+	"github.com/opencontainers/go-digest"
+	v1 "github.com/opencontainers/image-spec/specs-go/v1"
+)
+
+// Tenant is a tenant of a TenantNamespace, with the registry holding its
+// repositories, usually over a TenantDriver.
+type Tenant struct {
+	Name     string
+	Registry distribution.Namespace
+}
+
+// TenantNamespace routes the repositories to the registries of their tenant,
+// selected by the first component of their name. The registries of the
+// tenants share no blob, so that no blob is deduplicated or mounted across
+// tenants.
+type TenantNamespace struct {
+	tenants []Tenant
+}
+
+var (
+	_ distribution.Namespace              = &TenantNamespace{}
+	_ distribution.RepositoryPrefixLister = &TenantNamespace{}
+	_ distribution.RepositoryEnumerator   = &TenantNamespace{}
+	_ distribution.RepositoryRemover      = &TenantNamespace{}
+	_ distribution.RepositoryRenamer      = &TenantNamespace{}
+)
+
+// NewTenantNamespace returns the namespace of the tenants, whose names must
+// be distinct.
+func NewTenantNamespace(tenants ...Tenant) (*TenantNamespace, error) {
+	tenants = slices.Clone(tenants)
+	slices.SortFunc(tenants, func(a, b Tenant) int {
+		return compareCatalog(a.Name, b.Name)
+	})
+	for i, tenant := range tenants {
+		if tenant.Name == "" || strings.Contains(tenant.Name, "/") {
+			return nil, fmt.Errorf("invalid tenant name %q", tenant.Name)
+		}
+		if i > 0 && tenants[i-1].Name == tenant.Name {
+			return nil, fmt.Errorf("duplicate tenant %q", tenant.Name)
+		}
+	}
+	return &TenantNamespace{tenants: tenants}, nil
+}
+
+// TenantOf returns the name of the tenant of the repository, and false if no
+// tenant holds it.
+func (tn *TenantNamespace) TenantOf(name string) (string, bool) {
+	tenant, ok := tn.tenant(name)
+	return tenant.Name, ok
+}
+
+func (tn *TenantNamespace) tenant(name string) (Tenant, bool) {
+	tenantName, _, ok := strings.Cut(name, "/")
+	if !ok {
+		return Tenant{}, false
+	}
+	i, found := slices.BinarySearchFunc(tn.tenants, tenantName, func(tenant Tenant, name string) int {
+		return compareCatalog(tenant.Name, name)
+	})
+	if !found {
+		return Tenant{}, false
+	}
+	return tn.tenants[i], true
+}
+
+func (tn *TenantNamespace) Scope() distribution.Scope {
+	return distribution.GlobalScope
+}
+
+// Repository returns the repository of the registry of its tenant, or
+// distribution.ErrRepositoryNameInvalid if its name selects no tenant.
+func (tn *TenantNamespace) Repository(ctx context.Context, name reference.Named) (distribution.Repository, error) {
+	tenant, ok := tn.tenant(name.Name())
+	if !ok {
+		return nil, distribution.ErrRepositoryNameInvalid{
+			Name:   name.Name(),
+			Reason: errors.New("the first component of the name is not a tenant"),
+		}
+	}
+	return tenant.Registry.Repository(ctx, name)
+}
+
+func (tn *TenantNamespace) Repositories(ctx context.Context, repos []string, last string) (int, error) {
+	return tn.TenantRepositories(ctx, nil, repos, last, "")
+}
+
+func (tn *TenantNamespace) RepositoriesWithPrefix(ctx context.Context, repos []string, last, prefix string) (int, error) {
+	return tn.TenantRepositories(ctx, nil, repos, last, prefix)
+}
+
+// TenantRepositories fills repos like RepositoriesWithPrefix, with the
+// repositories of the tenants named, or of all of them if tenants is nil.
+// The tenants are listed one after the other, in the order of the catalog.
+func (tn *TenantNamespace) TenantRepositories(ctx context.Context, tenants []string, repos []string, last, prefix string) (int, error) {
+	if len(repos) == 0 {
+		return 0, errors.New("attempted to list 0 repositories")
+	}
+	lastTenant, _, _ := strings.Cut(last, "/")
+	filled := 0
+	for _, tenant := range tn.tenants {
+		if tenants != nil && !slices.Contains(tenants, tenant.Name) {
+			continue
+		}
+		tenantLast := ""
+		if last != "" {
+			c := compareCatalog(tenant.Name, lastTenant)
+			if c < 0 {
+				continue
+			}
+			if c == 0 {
+				tenantLast = last
+			}
+		}
+		// The prefix is narrowed to the repositories of the tenant.
+		tenantPrefix := tenant.Name + "/"
+		if strings.HasPrefix(prefix, tenantPrefix) {
+			tenantPrefix = prefix
+		} else if !strings.HasPrefix(tenantPrefix, prefix) {
+			continue
+		}
+		if filled == len(repos) {
+			return filled, nil
+		}
+		lister, ok := tenant.Registry.(distribution.RepositoryPrefixLister)
+		if !ok {
+			return filled, distribution.ErrUnsupported
+		}
+		n, err := lister.RepositoriesWithPrefix(ctx, repos[filled:], tenantLast, tenantPrefix)
+		filled += n
+		if err == nil {
+			return filled, nil
+		}
+		if err != io.EOF && !errors.As(err, new(driver.PathNotFoundError)) {
+			return filled, err
+		}
+	}
+	return filled, io.EOF
+}
+
+// Enumerate calls ingester with the repositories of every tenant.
+func (tn *TenantNamespace) Enumerate(ctx context.Context, ingester func(string) error) error {
+	for _, tenant := range tn.tenants {
+		enumerator, ok := tenant.Registry.(distribution.RepositoryEnumerator)
+		if !ok {
+			return fmt.Errorf("unable to convert the Namespace of tenant %s to RepositoryEnumerator", tenant.Name)
+		}
+		if err := enumerator.Enumerate(ctx, ingester); err != nil && !errors.As(err, new(driver.PathNotFoundError)) {
+			return err
+		}
+	}
+	return nil
+}
+
+func (tn *TenantNamespace) Remove(ctx context.Context, name reference.Named) error {
+	tenant, ok := tn.tenant(name.Name())
+	if !ok {
+		return distribution.ErrRepositoryUnknown{Name: name.Name()}
+	}
+	remover, ok := tenant.Registry.(distribution.RepositoryRemover)
+	if !ok {
+		return distribution.ErrUnsupported
+	}
+	return remover.Remove(ctx, name)
+}
+
+// Rename renames the repository within its tenant. The repositories are not
+// moved across tenants, which share no blob.
+func (tn *TenantNamespace) Rename(ctx context.Context, from, to reference.Named) error {
+	tenant, ok := tn.tenant(from.Name())
+	if !ok {
+		return distribution.ErrRepositoryUnknown{Name: from.Name()}
+	}
+	if toTenant, ok := tn.tenant(to.Name()); !ok || toTenant.Name != tenant.Name {
+		return distribution.ErrRepositoryNameInvalid{
+			Name:   to.Name(),
+			Reason: fmt.Errorf("the repository is not renamed out of tenant %s", tenant.Name),
+		}
+	}
+	renamer, ok := tenant.Registry.(distribution.RepositoryRenamer)
+	if !ok {
+		return distribution.ErrUnsupported
+	}
+	return renamer.Rename(ctx, from, to)
+}
+
+// Blobs enumerates the blobs of every tenant, a blob stored by several
+// tenants being enumerated once for each.
+func (tn *TenantNamespace) Blobs() distribution.BlobEnumerator {
+	return tenantBlobs(tn.tenants)
+}
+
+// BlobStatter finds no blob, since there is no blob store shared by the
+// tenants.
+func (tn *TenantNamespace) BlobStatter() distribution.BlobStatter {
+	return tenantBlobs(tn.tenants)
+}
+
+type tenantBlobs []Tenant
+
+func (tb tenantBlobs) Enumerate(ctx context.Context, ingester func(dgst digest.Digest) error) error {
+	for _, tenant := range tb {
+		if err := tenant.Registry.Blobs().Enumerate(ctx, ingester); err != nil && !errors.As(err, new(driver.PathNotFoundError)) {
+			return err
+		}
+	}
+	return nil
+}
+
+func (tb tenantBlobs) Stat(ctx context.Context, dgst digest.Digest) (v1.Descriptor, error) {
+	return v1.Descriptor{}, distribution.ErrBlobUnknown
+}
@@ -0,0 +1,187 @@
+package storage
+
+import (
+	"errors"
+	"io"
+	"reflect"
+	"testing"
+
+	"github.com/distribution/distribution/v3"
+	"github.com/distribution/distribution/v3/internal/dcontext"
+	"github.com/distribution/distribution/v3/registry/storage/driver"
+	"github.com/distribution/distribution/v3/registry/storage/driver/inmemory"
+	"github.com/distribution/distribution/v3/registry/storage/driver/testsuites"
+	"github.com/distribution/reference"
+	"github.com/opencontainers/go-digest"
+)
+
+func TestTenantDriverSuite(t *testing.T) {
+	root := inmemory.New()
+	testsuites.Driver(t, func() (driver.StorageDriver, error) {
+		return TenantDriver(root, "/tenants/suite"), nil
+	}, false)
+}
+
+func newTestTenantNamespace(t *testing.T, d driver.StorageDriver, names ...string) *TenantNamespace {
+	t.Helper()
+	var tenants []Tenant
+	for _, name := range names {
+		tenants = append(tenants, Tenant{Name: name, Registry: createRegistry(t, TenantDriver(d, "/tenants/"+name))})
+	}
+	namespace, err := NewTenantNamespace(tenants...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return namespace
+}
+
+func TestTenantNamespaceIsolation(t *testing.T) {
+	ctx := dcontext.Background()
+	d := inmemory.New()
+	namespace := newTestTenantNamespace(t, d, "b", "a")
+
+	source := makeRepository(t, namespace, "a/app")
+	image := uploadRandomSchema2Image(t, source)
+	var layer digest.Digest
+	for dgst := range image.layers {
+		layer = dgst
+	}
+
+	// The blobs of a tenant are stored under its prefix only.
+	blobPath, err := pathFor(blobDataPathSpec{digest: layer})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := d.Stat(ctx, "/tenants/a"+blobPath); err != nil {
+		t.Fatalf("expected the blob under the prefix of the tenant: %v", err)
+	}
+	for _, p := range []string{blobPath, "/tenants/b" + blobPath} {
+		if _, err := d.Stat(ctx, p); !errors.As(err, new(driver.PathNotFoundError)) {
+			t.Fatalf("unexpected blob at %s: %v", p, err)
+		}
+	}
+
+	// A blob of another tenant is neither deduplicated nor mounted.
+	target := makeRepository(t, namespace, "b/app").Blobs(ctx)
+	if _, err := target.Stat(ctx, layer); err != distribution.ErrBlobUnknown {
+		t.Fatalf("unexpected blob of another tenant found: %v", err)
+	}
+	canonical, err := reference.WithDigest(source.Named(), layer)
+	if err != nil {
+		t.Fatal(err)
+	}
+	bw, err := target.Create(ctx, WithMountFrom(canonical))
+	if err != nil {
+		t.Fatalf("expected an upload session instead of a mount across tenants, got: %v", err)
+	}
+	defer bw.Cancel(ctx)
+	if _, err := namespace.BlobStatter().Stat(ctx, layer); err != distribution.ErrBlobUnknown {
+		t.Fatalf("unexpected blob found by the namespace: %v", err)
+	}
+
+	for _, name := range []string{"c/app", "app"} {
+		named, err := reference.WithName(name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := namespace.Repository(ctx, named); !errors.As(err, new(distribution.ErrRepositoryNameInvalid)) {
+			t.Fatalf("unexpected error getting repository %s of no tenant: %v", name, err)
+		}
+	}
+	if err := renameRepository(t, namespace, "a/app", "b/moved"); !errors.As(err, new(distribution.ErrRepositoryNameInvalid)) {
+		t.Fatalf("unexpected error renaming a repository across tenants: %v", err)
+	}
+}
+
+func TestTenantNamespaceCatalog(t *testing.T) {
+	ctx := dcontext.Background()
+	d := inmemory.New()
+	namespace := newTestTenantNamespace(t, d, "b", "a", "a-c")
+	for _, name := range []string{"b/one", "a/two", "a-c/three", "a/one", "b/two/nested"} {
+		uploadRandomSchema2Image(t, makeRepository(t, namespace, name))
+	}
+
+	expected := []string{"a/one", "a/two", "a-c/three", "b/one", "b/two/nested"}
+	for _, n := range []int{1, 2, 10} {
+		if catalog := listCatalog(t, namespace, n); !reflect.DeepEqual(catalog, expected) {
+			t.Fatalf("unexpected catalog %v listed %d at a time, expected %v", catalog, n, expected)
+		}
+	}
+
+	var enumerated []string
+	if err := namespace.Enumerate(ctx, func(name string) error {
+		enumerated = append(enumerated, name)
+		return nil
+	}); err != nil || !reflect.DeepEqual(enumerated, expected) {
+		t.Fatalf("unexpected repositories %v enumerated: %v", enumerated, err)
+	}
+
+	repos := make([]string, 10)
+	for _, tc := range []struct {
+		tenants  []string
+		last     string
+		prefix   string
+		expected []string
+	}{
+		{tenants: []string{"b", "a-c"}, expected: []string{"a-c/three", "b/one", "b/two/nested"}},
+		{tenants: []string{"b"}, prefix: "b/t", expected: []string{"b/two/nested"}},
+		{prefix: "a", last: "a/one", expected: []string{"a/two", "a-c/three"}},
+		{tenants: []string{}, expected: []string{}},
+	} {
+		n, err := namespace.TenantRepositories(ctx, tc.tenants, repos, tc.last, tc.prefix)
+		if err != io.EOF || !reflect.DeepEqual(repos[:n], tc.expected) {
+			t.Fatalf("unexpected repositories %v of tenants %v after %q with prefix %q: %v", repos[:n], tc.tenants, tc.last, tc.prefix, err)
+		}
+	}
+
+	if err := renameRepository(t, namespace, "a/one", "a/renamed"); err != nil {
+		t.Fatal(err)
+	}
+	named, _ := reference.WithName("b/one")
+	if err := namespace.Remove(ctx, named); err != nil {
+		t.Fatal(err)
+	}
+	expected = []string{"a/renamed", "a/two", "a-c/three", "b/two/nested"}
+	if catalog := listCatalog(t, namespace, 10); !reflect.DeepEqual(catalog, expected) {
+		t.Fatalf("unexpected catalog %v after the rename and the remove, expected %v", catalog, expected)
+	}
+	// The garbage collection of a tenant keeps its content.
+	if _, err := GarbageCollect(ctx, TenantDriver(d, "/tenants/a"), createRegistry(t, TenantDriver(d, "/tenants/a")), GCOpts{Quiet: true}); err != nil {
+		t.Fatalf("unexpected error garbage collecting tenant a: %v", err)
+	}
+	if catalog := listCatalog(t, namespace, 10); !reflect.DeepEqual(catalog, expected) {
+		t.Fatalf("unexpected catalog %v after the garbage collection, expected %v", catalog, expected)
+	}
+}
+
+func TestTenantQuota(t *testing.T) {
+	ctx := dcontext.Background()
+	d := inmemory.New()
+	tenantDriver := TenantDriver(d, "/tenants/ci")
+	quota, err := NewTenantQuota(NewStorageQuotaUsageProvider(tenantDriver), "ci", 100)
+	if err != nil {
+		t.Fatal(err)
+	}
+	registry := createRegistry(t, tenantDriver, EnforceQuotas(quota))
+
+	// The layers of all the repositories of the tenant count against its
+	// quota.
+	if _, err := addTestBlob(ctx, makeRepository(t, registry, "ci/one").Blobs(ctx), 60); err != nil {
+		t.Fatalf("unexpected error adding blob: %v", err)
+	}
+	if _, err := addTestBlob(ctx, makeRepository(t, registry, "ci/two").Blobs(ctx), 50); !errors.As(err, new(distribution.ErrQuotaExceeded)) {
+		t.Fatalf("expected the quota of the tenant to be exceeded, got: %v", err)
+	}
+	if _, err := addTestBlob(ctx, makeRepository(t, registry, "ci/two").Blobs(ctx), 40); err != nil {
+		t.Fatalf("unexpected error adding blob up to the limit: %v", err)
+	}
+	checkQuotaUsage(t, quota, "ci/any", 100)
+
+	if err := quota.usage.Set(ctx, "ci", 0); err != nil {
+		t.Fatal(err)
+	}
+	usages, err := quota.Recalculate(ctx, tenantDriver, registry)
+	if err != nil || !reflect.DeepEqual(usages, []QuotaUsage{{Repository: "ci", Usage: 100, Limit: 100}}) {
+		t.Fatalf("unexpected usages %v recalculated: %v", usages, err)
+	}
+}
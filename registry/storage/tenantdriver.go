@@ -0,0 +1,262 @@
+package storage
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"path"
+	"strings"
+
+	"github.com/distribution/distribution/v3/registry/storage/driver"
+)
+
+// tenantDriver roots the paths of a storage driver under the prefix of a
+// tenant, so that the registry over it keeps its repositories and blobs apart
+// from those of the other tenants.
+type tenantDriver struct {
+	driver.StorageDriver
+	prefix string
+}
+
+var (
+	_ driver.StorageDriver    = &tenantDriver{}
+	_ driver.CookieRedirector = &tenantDriver{}
+	_ driver.UsageReporter    = &tenantDriver{}
+	_ driver.BatchDeleter     = &tenantDriver{}
+	_ driver.FilePathResolver = &tenantDriver{}
+)
+
+// TenantDriver returns the storage driver storing the content of the tenant
+// under prefix, an absolute path, in storageDriver. It does not close
+// storageDriver, which is shared by the tenants.
+func TenantDriver(storageDriver driver.StorageDriver, prefix string) driver.StorageDriver {
+	return &tenantDriver{StorageDriver: storageDriver, prefix: path.Clean("/" + prefix)}
+}
+
+// fullPath returns the path of the wrapped driver of the path of a file of
+// the tenant.
+func (d *tenantDriver) fullPath(subPath string) (string, error) {
+	if !driver.PathRegexp.MatchString(subPath) {
+		return "", driver.InvalidPathError{Path: subPath, DriverName: d.Name()}
+	}
+	return d.prefix + subPath, nil
+}
+
+// fullDirPath returns the path of the wrapped driver of the path of a
+// directory of the tenant, which may be its root.
+func (d *tenantDriver) fullDirPath(subPath string) (string, error) {
+	if subPath == "/" {
+		return d.prefix, nil
+	}
+	return d.fullPath(subPath)
+}
+
+// tenantPath returns the path of the tenant of a path of the wrapped driver.
+func (d *tenantDriver) tenantPath(fullPath string) string {
+	if fullPath == d.prefix {
+		return "/"
+	}
+	return strings.TrimPrefix(fullPath, d.prefix)
+}
+
+// tenantError replaces the paths of the wrapped driver in the errors by the
+// paths of the tenant.
+func (d *tenantDriver) tenantError(err error) error {
+	switch err := err.(type) {
+	case driver.PathNotFoundError:
+		err.Path = d.tenantPath(err.Path)
+		return err
+	case driver.InvalidPathError:
+		err.Path = d.tenantPath(err.Path)
+		return err
+	case driver.InvalidOffsetError:
+		err.Path = d.tenantPath(err.Path)
+		return err
+	}
+	return err
+}
+
+// tenantFileInfo is the FileInfo of the wrapped driver with the path of the
+// tenant.
+type tenantFileInfo struct {
+	driver.FileInfo
+	path string
+}
+
+func (fi tenantFileInfo) Path() string {
+	return fi.path
+}
+
+func (d *tenantDriver) GetContent(ctx context.Context, path string) ([]byte, error) {
+	fullPath, err := d.fullPath(path)
+	if err != nil {
+		return nil, err
+	}
+	content, err := d.StorageDriver.GetContent(ctx, fullPath)
+	return content, d.tenantError(err)
+}
+
+func (d *tenantDriver) PutContent(ctx context.Context, path string, content []byte) error {
+	fullPath, err := d.fullPath(path)
+	if err != nil {
+		return err
+	}
+	return d.tenantError(d.StorageDriver.PutContent(ctx, fullPath, content))
+}
+
+func (d *tenantDriver) Reader(ctx context.Context, path string, offset int64) (io.ReadCloser, error) {
+	fullPath, err := d.fullPath(path)
+	if err != nil {
+		return nil, err
+	}
+	reader, err := d.StorageDriver.Reader(ctx, fullPath, offset)
+	return reader, d.tenantError(err)
+}
+
+func (d *tenantDriver) Writer(ctx context.Context, path string, append bool) (driver.FileWriter, error) {
+	fullPath, err := d.fullPath(path)
+	if err != nil {
+		return nil, err
+	}
+	writer, err := d.StorageDriver.Writer(ctx, fullPath, append)
+	return writer, d.tenantError(err)
+}
+
+func (d *tenantDriver) Stat(ctx context.Context, path string) (driver.FileInfo, error) {
+	fullPath, err := d.fullDirPath(path)
+	if err != nil {
+		return nil, err
+	}
+	fileInfo, err := d.StorageDriver.Stat(ctx, fullPath)
+	if err != nil {
+		return nil, d.tenantError(err)
+	}
+	return tenantFileInfo{FileInfo: fileInfo, path: d.tenantPath(fileInfo.Path())}, nil
+}
+
+func (d *tenantDriver) List(ctx context.Context, path string) ([]string, error) {
+	fullPath, err := d.fullDirPath(path)
+	if err != nil {
+		return nil, err
+	}
+	children, err := d.StorageDriver.List(ctx, fullPath)
+	if err != nil {
+		return nil, d.tenantError(err)
+	}
+	for i, child := range children {
+		children[i] = d.tenantPath(child)
+	}
+	return children, nil
+}
+
+func (d *tenantDriver) Move(ctx context.Context, sourcePath string, destPath string) error {
+	fullSourcePath, err := d.fullPath(sourcePath)
+	if err != nil {
+		return err
+	}
+	fullDestPath, err := d.fullPath(destPath)
+	if err != nil {
+		return err
+	}
+	return d.tenantError(d.StorageDriver.Move(ctx, fullSourcePath, fullDestPath))
+}
+
+func (d *tenantDriver) Delete(ctx context.Context, path string) error {
+	fullPath, err := d.fullPath(path)
+	if err != nil {
+		return err
+	}
+	return d.tenantError(d.StorageDriver.Delete(ctx, fullPath))
+}
+
+func (d *tenantDriver) RedirectURL(r *http.Request, path string) (string, error) {
+	fullPath, err := d.fullPath(path)
+	if err != nil {
+		return "", err
+	}
+	return d.StorageDriver.RedirectURL(r, fullPath)
+}
+
+func (d *tenantDriver) RedirectURLWithCookies(r *http.Request, path string) (string, []*http.Cookie, error) {
+	fullPath, err := d.fullPath(path)
+	if err != nil {
+		return "", nil, err
+	}
+	if redirector, ok := d.StorageDriver.(driver.CookieRedirector); ok {
+		return redirector.RedirectURLWithCookies(r, fullPath)
+	}
+	url, err := d.StorageDriver.RedirectURL(r, fullPath)
+	return url, nil, err
+}
+
+func (d *tenantDriver) Walk(ctx context.Context, path string, f driver.WalkFn, options ...func(*driver.WalkOptions)) error {
+	fullPath, err := d.fullDirPath(path)
+	if err != nil {
+		return err
+	}
+	walkOptions := &driver.WalkOptions{}
+	for _, o := range options {
+		o(walkOptions)
+	}
+	options = []func(*driver.WalkOptions){driver.WithParallelism(walkOptions.Parallelism)}
+	if walkOptions.StartAfterHint != "" {
+		options = append(options, driver.WithStartAfterHint(d.prefix+walkOptions.StartAfterHint))
+	}
+	err = d.StorageDriver.Walk(ctx, fullPath, func(fileInfo driver.FileInfo) error {
+		return f(tenantFileInfo{FileInfo: fileInfo, path: d.tenantPath(fileInfo.Path())})
+	}, options...)
+	return d.tenantError(err)
+}
+
+func (d *tenantDriver) Usage(ctx context.Context, path string) (int64, int64, error) {
+	reporter, ok := d.StorageDriver.(driver.UsageReporter)
+	if !ok {
+		return 0, 0, driver.ErrUnsupportedMethod{DriverName: d.Name()}
+	}
+	fullPath, err := d.fullDirPath(path)
+	if err != nil {
+		return 0, 0, err
+	}
+	bytes, objects, err := reporter.Usage(ctx, fullPath)
+	return bytes, objects, d.tenantError(err)
+}
+
+func (d *tenantDriver) DeleteBatch(ctx context.Context, paths []string) ([]error, error) {
+	deleter, ok := d.StorageDriver.(driver.BatchDeleter)
+	if !ok {
+		return nil, driver.ErrUnsupportedMethod{DriverName: d.Name()}
+	}
+	// The invalid paths fail alone, the others are deleted in a batch.
+	errs := make([]error, len(paths))
+	var fullPaths []string
+	var batched []int
+	for i, p := range paths {
+		fullPath, err := d.fullPath(p)
+		if err != nil {
+			errs[i] = err
+			continue
+		}
+		fullPaths = append(fullPaths, fullPath)
+		batched = append(batched, i)
+	}
+	batchErrs, err := deleter.DeleteBatch(ctx, fullPaths)
+	if err != nil {
+		return nil, err
+	}
+	for j, i := range batched {
+		errs[i] = d.tenantError(batchErrs[j])
+	}
+	return errs, nil
+}
+
+func (d *tenantDriver) FilePathForContent(path string) (string, error) {
+	resolver, ok := d.StorageDriver.(driver.FilePathResolver)
+	if !ok {
+		return "", driver.ErrUnsupportedMethod{DriverName: d.Name()}
+	}
+	fullPath, err := d.fullPath(path)
+	if err != nil {
+		return "", err
+	}
+	return resolver.FilePathForContent(fullPath)
+}
@@ -24,8 +24,29 @@ func NewVacuum(ctx context.Context, driver driver.StorageDriver) Vacuum {
 
 // Vacuum removes content from the filesystem
 type Vacuum struct {
-	driver driver.StorageDriver
-	ctx    context.Context
+	driver    driver.StorageDriver
+	ctx       context.Context
+	inventory *BlobInventory
+}
+
+// WithBlobInventory returns a copy of the vacuum which accounts for the blobs
+// it removes in the inventory.
+func (v Vacuum) WithBlobInventory(inventory *BlobInventory) Vacuum {
+	v.inventory = inventory
+	return v
+}
+
+// blobSize returns the size of the data of the blob to remove, for the
+// inventory to account for it. It returns -1 if the blob is not counted.
+func (v Vacuum) blobSize(dataPath string) int64 {
+	if v.inventory == nil {
+		return -1
+	}
+	fi, err := v.driver.Stat(v.ctx, dataPath)
+	if err != nil {
+		return -1
+	}
+	return fi.Size()
 }
 
 // RemoveBlob removes a blob from the filesystem
@@ -40,6 +61,12 @@ func (v Vacuum) RemoveBlob(dgst string) error {
 		return err
 	}
 
+	dataPath, err := pathFor(blobDataPathSpec{digest: d})
+	if err != nil {
+		return err
+	}
+	size := v.blobSize(dataPath)
+
 	dcontext.GetLogger(v.ctx).Infof("Deleting blob: %s", blobPath)
 
 	err = v.driver.Delete(v.ctx, blobPath)
@@ -47,9 +74,54 @@ func (v Vacuum) RemoveBlob(dgst string) error {
 		return err
 	}
 
+	if size >= 0 {
+		v.inventory.removed(size)
+	}
 	return nil
 }
 
+// RemoveBlobs removes the data of blobs from the filesystem in batches, and
+// returns the error removing each of them. It returns ErrUnsupportedMethod if
+// the driver does not delete files in batches.
+func (v Vacuum) RemoveBlobs(dgsts []digest.Digest) ([]error, error) {
+	bd, ok := v.driver.(driver.BatchDeleter)
+	if !ok {
+		return nil, driver.ErrUnsupportedMethod{DriverName: v.driver.Name()}
+	}
+	dataPaths := make([]string, 0, len(dgsts))
+	sizes := make([]int64, 0, len(dgsts))
+	for _, dgst := range dgsts {
+		dataPath, err := pathFor(blobDataPathSpec{digest: dgst})
+		if err != nil {
+			return nil, err
+		}
+		dcontext.GetLogger(v.ctx).Infof("Deleting blob: %s", dataPath)
+		dataPaths = append(dataPaths, dataPath)
+		sizes = append(sizes, v.blobSize(dataPath))
+	}
+	errs, err := bd.DeleteBatch(v.ctx, dataPaths)
+	if err != nil {
+		return errs, err
+	}
+	for i, size := range sizes {
+		if size >= 0 && (i >= len(errs) || errs[i] == nil) {
+			v.inventory.removed(size)
+		}
+	}
+	return errs, nil
+}
+
+// deletesBatches returns whether the driver deletes files in batches, rather
+// than wrapping a driver which does not.
+func (v Vacuum) deletesBatches() bool {
+	bd, ok := v.driver.(driver.BatchDeleter)
+	if !ok {
+		return false
+	}
+	_, err := bd.DeleteBatch(v.ctx, nil)
+	return err == nil
+}
+
 // RemoveManifest removes a manifest from the filesystem
 func (v Vacuum) RemoveManifest(name string, dgst digest.Digest, tags []string) error {
 	// remove a tag manifest reference, in case of not found continue to next one
@@ -84,6 +156,23 @@ func (v Vacuum) RemoveManifest(name string, dgst digest.Digest, tags []string) e
 	return v.driver.Delete(v.ctx, manifestPath)
 }
 
+// RemoveReferrer removes the link of a manifest from the referrers of its
+// subject
+func (v Vacuum) RemoveReferrer(name string, subject, dgst digest.Digest) error {
+	dcontext.GetLogger(v.ctx).Infof("deleting referrer %s of manifest %s", dgst, subject)
+	return unlinkReferrer(v.ctx, v.driver, name, subject, dgst)
+}
+
+// RemoveTag removes a tag, along with its history, from the filesystem
+func (v Vacuum) RemoveTag(name, tag string) error {
+	tagPath, err := pathFor(manifestTagPathSpec{name: name, tag: tag})
+	if err != nil {
+		return err
+	}
+	dcontext.GetLogger(v.ctx).Infof("deleting tag: %s", tagPath)
+	return v.driver.Delete(v.ctx, tagPath)
+}
+
 // RemoveRepository removes a repository directory from the
 // filesystem
 func (v Vacuum) RemoveRepository(repoName string) error {
@@ -108,6 +197,24 @@ func (v Vacuum) RemoveRepository(repoName string) error {
 		}
 	}
 
+	repoQuotaDir := path.Join(rootForRepository, repoName, "_quota")
+	dcontext.GetLogger(v.ctx).Infof("Deleting repo: %s", repoQuotaDir)
+	err = v.driver.Delete(v.ctx, repoQuotaDir)
+	if err != nil {
+		if _, ok := err.(driver.PathNotFoundError); !ok {
+			return err
+		}
+	}
+
+	repoStatsDir := path.Join(rootForRepository, repoName, "_stats")
+	dcontext.GetLogger(v.ctx).Infof("Deleting repo: %s", repoStatsDir)
+	err = v.driver.Delete(v.ctx, repoStatsDir)
+	if err != nil {
+		if _, ok := err.(driver.PathNotFoundError); !ok {
+			return err
+		}
+	}
+
 	repoUploadDir := path.Join(rootForRepository, repoName, "_uploads")
 	dcontext.GetLogger(v.ctx).Infof("Deleting repo: %s", repoUploadDir)
 	err = v.driver.Delete(v.ctx, repoUploadDir)
@@ -0,0 +1,38 @@
+package storage
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+
+	"github.com/distribution/distribution/v3/registry/storage/driver"
+	"github.com/google/uuid"
+)
+
+// ProbeWrites writes a small object to the storage, reads it back and
+// deletes it, returning an error if any of these fails. Unlike a stat, it
+// detects a backend which has become read-only, with expired credentials or
+// a changed bucket policy. The name distinguishes the objects of the
+// instances of the registry sharing the storage.
+func ProbeWrites(ctx context.Context, storageDriver driver.StorageDriver, name string) error {
+	probePath, err := pathFor(healthProbePathSpec{name: name})
+	if err != nil {
+		return err
+	}
+
+	content := []byte(uuid.NewString())
+	if err := storageDriver.PutContent(ctx, probePath, content); err != nil {
+		return fmt.Errorf("write probe: error writing %s: %w", probePath, err)
+	}
+	read, err := storageDriver.GetContent(ctx, probePath)
+	if err != nil {
+		return fmt.Errorf("write probe: error reading %s: %w", probePath, err)
+	}
+	if !bytes.Equal(read, content) {
+		return fmt.Errorf("write probe: %s read back differs from the content written", probePath)
+	}
+	if err := storageDriver.Delete(ctx, probePath); err != nil {
+		return fmt.Errorf("write probe: error deleting %s: %w", probePath, err)
+	}
+	return nil
+}
@@ -0,0 +1,94 @@
+package storage
+
+import (
+	"context"
+	"errors"
+	"io"
+	"strings"
+	"testing"
+
+	"github.com/distribution/distribution/v3/registry/storage/driver"
+	"github.com/distribution/distribution/v3/registry/storage/driver/inmemory"
+)
+
+// probeDriver fails the operations of the write probe as configured.
+type probeDriver struct {
+	driver.StorageDriver
+	putErr    error
+	deleteErr error
+	corrupt   bool
+}
+
+func (d *probeDriver) PutContent(ctx context.Context, path string, content []byte) error {
+	if d.putErr != nil {
+		return d.putErr
+	}
+	return d.StorageDriver.PutContent(ctx, path, content)
+}
+
+func (d *probeDriver) GetContent(ctx context.Context, path string) ([]byte, error) {
+	content, err := d.StorageDriver.GetContent(ctx, path)
+	if err == nil && d.corrupt {
+		content[0] ^= 0xff
+	}
+	return content, err
+}
+
+func (d *probeDriver) Delete(ctx context.Context, path string) error {
+	if d.deleteErr != nil {
+		return d.deleteErr
+	}
+	return d.StorageDriver.Delete(ctx, path)
+}
+
+func TestProbeWrites(t *testing.T) {
+	ctx := context.Background()
+	probePath, err := pathFor(healthProbePathSpec{name: "probe"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, tc := range []struct {
+		name     string
+		failures probeDriver
+		expected string
+		left     bool
+	}{
+		{name: "ok"},
+		{name: "write fail", failures: probeDriver{putErr: errors.New("access denied")}, expected: "error writing"},
+		{name: "read mismatch", failures: probeDriver{corrupt: true}, expected: "differs", left: true},
+		{name: "delete fail", failures: probeDriver{deleteErr: errors.New("access denied")}, expected: "error deleting", left: true},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			d := &probeDriver{StorageDriver: inmemory.New()}
+			registry := createRegistry(t, d)
+			uploadRandomSchema2Image(t, makeRepository(t, registry, "foo/bar"))
+
+			d.putErr, d.deleteErr, d.corrupt = tc.failures.putErr, tc.failures.deleteErr, tc.failures.corrupt
+			err := ProbeWrites(ctx, d, "probe")
+			if tc.expected == "" && err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if tc.expected != "" && (err == nil || !strings.Contains(err.Error(), tc.expected)) {
+				t.Fatalf("expected error %q, got %v", tc.expected, err)
+			}
+			d.putErr, d.deleteErr, d.corrupt = nil, nil, false
+			if _, err := d.Stat(ctx, probePath); (err == nil) != tc.left {
+				t.Fatalf("unexpected probe object left %t: %v", tc.left, err)
+			}
+
+			// The objects left by a failed probe are neither listed by the
+			// catalog nor collected.
+			repos := make([]string, 10)
+			if n, err := registry.Repositories(ctx, repos, ""); n != 1 || repos[0] != "foo/bar" || err != io.EOF {
+				t.Fatalf("unexpected repositories %v: %v", repos[:n], err)
+			}
+			if _, err := GarbageCollect(ctx, d, registry, GCOpts{Quiet: true}); err != nil {
+				t.Fatalf("failed to garbage collect: %v", err)
+			}
+			if _, err := d.Stat(ctx, probePath); (err == nil) != tc.left {
+				t.Fatalf("unexpected probe object left %t after garbage collection: %v", tc.left, err)
+			}
+		})
+	}
+}
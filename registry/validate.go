@@ -0,0 +1,143 @@
+package registry
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"strings"
+
+	"github.com/distribution/distribution/v3/configuration"
+	"github.com/distribution/distribution/v3/notifications"
+	"github.com/distribution/distribution/v3/registry/auth"
+	"github.com/distribution/distribution/v3/registry/proxy"
+	"github.com/distribution/distribution/v3/registry/replication"
+	storagedriver "github.com/distribution/distribution/v3/registry/storage/driver"
+	"github.com/distribution/distribution/v3/registry/storage/driver/factory"
+)
+
+// configProblem is an error, or a warning, found validating a section of the
+// configuration.
+type configProblem struct {
+	Section string
+	Message string
+	Warning bool
+}
+
+func (p configProblem) String() string {
+	level := "error"
+	if p.Warning {
+		level = "warning"
+	}
+	return fmt.Sprintf("%s: %s: %s", level, p.Section, p.Message)
+}
+
+// validateConfiguration checks the configuration as the registry would on
+// startup, without listening: the storage driver parameters, the access
+// controller, the proxy remotes, the replication peers, the notification
+// endpoints and the TLS files. If online is set, the storage and the upstream
+// and peer registries and token endpoints are probed too.
+func validateConfiguration(ctx context.Context, config *configuration.Configuration, online bool) []configProblem {
+	var problems []configProblem
+	fail := func(section string, err error) {
+		problems = append(problems, configProblem{Section: section, Message: err.Error()})
+	}
+	warn := func(section, message string) {
+		problems = append(problems, configProblem{Section: section, Message: message, Warning: true})
+	}
+
+	driver, err := factory.Create(ctx, config.Storage.Type(), config.Storage.Parameters())
+	if err != nil {
+		fail("storage", err)
+	} else if online {
+		if _, err := driver.Stat(ctx, "/"); err != nil {
+			if _, ok := err.(storagedriver.PathNotFoundError); !ok {
+				fail("storage", fmt.Errorf("failed to reach the %s storage: %v", config.Storage.Type(), err))
+			}
+		}
+	}
+
+	if authType := config.Auth.Type(); authType != "" && !strings.EqualFold(authType, "none") {
+		if err := auth.ValidateAccessController(authType, config.Auth.Parameters()); err != nil {
+			fail("auth."+authType, err)
+		} else if online && authType == "token" {
+			for _, option := range []string{"realm", "jwks"} {
+				if err := probeTokenURL(ctx, config.Auth.Parameters()[option]); err != nil {
+					fail("auth.token."+option, err)
+				}
+			}
+		}
+	}
+
+	if config.Proxy.Enabled() {
+		warnings, err := proxy.Validate(config.Proxy)
+		if err != nil {
+			fail("proxy", err)
+		}
+		for _, warning := range warnings {
+			warn("proxy", warning)
+		}
+		if err == nil && online {
+			for _, remote := range config.Proxy.RemoteConfigs() {
+				if err := proxy.ProbeRemote(ctx, remote); err != nil {
+					fail("proxy", err)
+				}
+			}
+		}
+	}
+
+	if len(config.Replication.Peers) > 0 {
+		warnings, err := replication.Validate(config.Replication)
+		if err != nil {
+			fail("replication", err)
+		}
+		for _, warning := range warnings {
+			warn("replication", warning)
+		}
+		if err == nil && online {
+			for _, peer := range config.Replication.Peers {
+				if err := proxy.ProbeRemote(ctx, peer.Remote()); err != nil {
+					fail("replication", err)
+				}
+			}
+		}
+	}
+
+	for _, endpoint := range config.Notifications.Endpoints {
+		if endpoint.Disabled {
+			continue
+		}
+		if err := notifications.ValidateEndpoint(endpoint); err != nil {
+			fail("notifications.endpoints", err)
+		}
+	}
+
+	if config.HTTP.TLS.Certificate != "" || config.HTTP.TLS.LetsEncrypt.CacheFile != "" {
+		if _, err := newTLSConfig(config); err != nil {
+			fail("http.tls", err)
+		}
+	}
+	return problems
+}
+
+// probeTokenURL checks that the http url of a token auth option answers.
+// The options which are not http urls, such as a local jwks file, are not
+// probed.
+func probeTokenURL(ctx context.Context, option any) error {
+	u, ok := option.(string)
+	if !ok || !(strings.HasPrefix(u, "http://") || strings.HasPrefix(u, "https://")) {
+		return nil
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, u, nil)
+	if err != nil {
+		return err
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return fmt.Errorf("failed to reach %s: %v", u, err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode >= http.StatusInternalServerError {
+		return fmt.Errorf("unexpected status from %s: %s", u, resp.Status)
+	}
+	return nil
+}
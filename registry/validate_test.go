@@ -0,0 +1,133 @@
+package registry
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/distribution/distribution/v3/configuration"
+	_ "github.com/distribution/distribution/v3/registry/auth/token"
+	_ "github.com/distribution/distribution/v3/registry/storage/driver/filesystem"
+	_ "github.com/distribution/distribution/v3/registry/storage/driver/inmemory"
+)
+
+func TestValidateConfiguration(t *testing.T) {
+	dir := t.TempDir()
+	writeHtpasswd(t, filepath.Join(dir, "htpasswd"), "alice")
+	if err := os.WriteFile(filepath.Join(dir, "invalid"), []byte("alice\n"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, tc := range []struct {
+		name   string
+		config string
+		// problems are the sections of the problems expected, the warnings
+		// prefixed with "warning:".
+		problems []string
+	}{
+		{
+			name:   "valid",
+			config: "storage: {inmemory: {}}\nauth: {htpasswd: {realm: registry, path: " + filepath.Join(dir, "htpasswd") + "}}",
+		},
+		{
+			name:     "unknown storage driver",
+			config:   "storage: {unknown: {}}",
+			problems: []string{"storage"},
+		},
+		{
+			name:     "invalid storage parameters",
+			config:   "storage: {filesystem: {rootdirectory: " + dir + ", fsync: sometimes}}",
+			problems: []string{"storage"},
+		},
+		{
+			name:     "unknown auth",
+			config:   "storage: {inmemory: {}}\nauth: {unknown: {}}",
+			problems: []string{"auth.unknown"},
+		},
+		{
+			name:   "missing htpasswd file",
+			config: "storage: {inmemory: {}}\nauth: {htpasswd: {realm: registry, path: " + filepath.Join(dir, "missing") + "}}",
+		},
+		{
+			name:     "invalid htpasswd file",
+			config:   "storage: {inmemory: {}}\nauth: {htpasswd: {realm: registry, path: " + filepath.Join(dir, "invalid") + "}}",
+			problems: []string{"auth.htpasswd"},
+		},
+		{
+			name:     "unreadable token bundle",
+			config:   "storage: {inmemory: {}}\nauth: {token: {realm: https://auth.example.com/token, service: registry, issuer: auth, rootcertbundle: " + filepath.Join(dir, "missing") + "}}",
+			problems: []string{"auth.token"},
+		},
+		{
+			name:     "invalid proxy remote",
+			config:   "storage: {inmemory: {}}\nproxy: {remoteurl: registry-1.docker.io}",
+			problems: []string{"proxy"},
+		},
+		{
+			name:     "proxy credentials ignored",
+			config:   "storage: {inmemory: {}}\nproxy: {remoteurl: https://123456789012.dkr.ecr.us-west-2.amazonaws.com, username: user, ecr: {}}",
+			problems: []string{"warning:proxy"},
+		},
+		{
+			name:     "duplicate replication peer",
+			config:   "storage: {inmemory: {}}\nreplication: {peers: [{name: a, url: https://a.example.com}, {name: a, url: https://b.example.com}]}",
+			problems: []string{"replication"},
+		},
+		{
+			name:     "invalid notification endpoint",
+			config:   "storage: {inmemory: {}}\nnotifications: {endpoints: [{name: a, url: /events}, {name: b, url: /events, disabled: true}]}",
+			problems: []string{"notifications.endpoints"},
+		},
+		{
+			name:     "unreadable tls certificate",
+			config:   "storage: {inmemory: {}}\nhttp: {tls: {certificate: " + filepath.Join(dir, "missing") + ", key: " + filepath.Join(dir, "missing") + "}}",
+			problems: []string{"http.tls"},
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			config, err := configuration.Parse(strings.NewReader("version: 0.1\n" + tc.config))
+			if err != nil {
+				t.Fatal(err)
+			}
+			var problems []string
+			for _, problem := range validateConfiguration(context.Background(), config, false) {
+				section := problem.Section
+				if problem.Warning {
+					section = "warning:" + section
+				}
+				problems = append(problems, section)
+			}
+			if !reflect.DeepEqual(problems, tc.problems) {
+				t.Fatalf("unexpected problems %v, expected %v", problems, tc.problems)
+			}
+		})
+	}
+}
+
+func TestValidateConfigurationOnline(t *testing.T) {
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer upstream.Close()
+	down := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	down.Close()
+
+	for _, tc := range []struct {
+		remote   string
+		problems int
+	}{
+		{remote: upstream.URL},
+		{remote: down.URL, problems: 1},
+	} {
+		config, err := configuration.Parse(strings.NewReader("version: 0.1\nstorage: {inmemory: {}}\nproxy: {remoteurl: " + tc.remote + "}"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if problems := validateConfiguration(context.Background(), config, true); len(problems) != tc.problems {
+			t.Fatalf("unexpected problems probing %s: %v", tc.remote, problems)
+		}
+	}
+}
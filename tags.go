@@ -2,6 +2,7 @@ package distribution
 
 import (
 	"context"
+	"time"
 
 	"github.com/opencontainers/go-digest"
 	v1 "github.com/opencontainers/image-spec/specs-go/v1"
@@ -39,3 +40,41 @@ type TagManifestsProvider interface {
 	// includes currently linked digest. There is no ordering guaranteed
 	ManifestDigests(ctx context.Context, tag string) ([]digest.Digest, error)
 }
+
+// TagDetail describes a tag and the manifest it currently references.
+type TagDetail struct {
+	// Name is the name of the tag.
+	Name string
+
+	// Descriptor describes the manifest the tag references. Only its digest
+	// is set if the manifest cannot be read.
+	Descriptor v1.Descriptor
+
+	// ModTime is the time the tag was last modified.
+	ModTime time.Time
+}
+
+// TagDetailLister provides a method to list tags along with the manifests
+// they reference, without resolving each tag individually.
+type TagDetailLister interface {
+	// ListDetails returns the details of the tags after last, with the same
+	// ordering and pagination as the List method of TagService.
+	ListDetails(ctx context.Context, limit int, last string) ([]TagDetail, error)
+}
+
+// TagHistoryEntry describes a manifest a tag has referenced.
+type TagHistoryEntry struct {
+	// Digest is the digest of the manifest.
+	Digest digest.Digest
+
+	// ModTime is the time the tag last referenced the manifest.
+	ModTime time.Time
+}
+
+// TagHistoryProvider provides a method to retrieve the manifests a tag has
+// referenced.
+type TagHistoryProvider interface {
+	// History returns the manifests the tag has referenced, including the
+	// current one, newest first. The manifests may since have been deleted.
+	History(ctx context.Context, tag string) ([]TagHistoryEntry, error)
+}
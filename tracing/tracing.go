@@ -2,11 +2,16 @@ package tracing
 
 import (
 	"context"
+	"fmt"
+	"os"
 
+	"github.com/distribution/distribution/v3/configuration"
 	"github.com/distribution/distribution/v3/internal/dcontext"
 	"github.com/distribution/distribution/v3/version"
 	"go.opentelemetry.io/contrib/exporters/autoexport"
 	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracegrpc"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracehttp"
 	"go.opentelemetry.io/otel/exporters/stdout/stdouttrace"
 	"go.opentelemetry.io/otel/propagation"
 	"go.opentelemetry.io/otel/sdk/resource"
@@ -18,9 +23,6 @@ const (
 	// ServiceName is trace service name
 	serviceName = "distribution"
 
-	// DefaultSamplingRatio default sample ratio
-	defaultSamplingRatio = 1
-
 	// AttributePrefix defines a standardized prefix for custom telemetry attributes
 	// associated with the CNCF Distribution project.
 	AttributePrefix = "io.cncf.distribution."
@@ -28,7 +30,7 @@ const (
 
 // InitOpenTelemetry initializes OpenTelemetry for the application. This function sets up the
 // necessary components for collecting telemetry data, such as traces.
-func InitOpenTelemetry(ctx context.Context) error {
+func InitOpenTelemetry(ctx context.Context, config configuration.Tracing) error {
 	res, err := resource.New(
 		ctx,
 		resource.WithAttributes(
@@ -41,7 +43,7 @@ func InitOpenTelemetry(ctx context.Context) error {
 		return err
 	}
 
-	autoExp, err := autoexport.NewSpanExporter(ctx)
+	exp, err := newSpanExporter(ctx, config)
 	if err != nil {
 		return err
 	}
@@ -55,14 +57,17 @@ func InitOpenTelemetry(ctx context.Context) error {
 		return err
 	}
 
-	compositeExp := newCompositeExporter(autoExp, loggerExp)
+	compositeExp := newCompositeExporter(exp, loggerExp)
 
 	sp := sdktrace.NewBatchSpanProcessor(compositeExp)
-	provider := sdktrace.NewTracerProvider(
-		sdktrace.WithSampler(sdktrace.TraceIDRatioBased(defaultSamplingRatio)),
+	opts := []sdktrace.TracerProviderOption{
 		sdktrace.WithResource(res),
 		sdktrace.WithSpanProcessor(sp),
-	)
+	}
+	if sampler := newSampler(config.Sampling); sampler != nil {
+		opts = append(opts, sdktrace.WithSampler(sampler))
+	}
+	provider := sdktrace.NewTracerProvider(opts...)
 	otel.SetTracerProvider(provider)
 	otel.SetErrorHandler(lw)
 
@@ -71,3 +76,52 @@ func InitOpenTelemetry(ctx context.Context) error {
 
 	return nil
 }
+
+// newSpanExporter returns the exporter of the configuration, or the one of the
+// environment when none is configured.
+func newSpanExporter(ctx context.Context, config configuration.Tracing) (sdktrace.SpanExporter, error) {
+	switch config.Exporter {
+	case "":
+		return autoexport.NewSpanExporter(ctx)
+	case "otlp":
+		switch config.OTLP.Protocol {
+		case "", "http/protobuf":
+			opts := []otlptracehttp.Option{otlptracehttp.WithHeaders(config.OTLP.Headers)}
+			if config.OTLP.Endpoint != "" {
+				opts = append(opts, otlptracehttp.WithEndpoint(config.OTLP.Endpoint))
+			}
+			if config.OTLP.Insecure {
+				opts = append(opts, otlptracehttp.WithInsecure())
+			}
+			return otlptracehttp.New(ctx, opts...)
+		case "grpc":
+			opts := []otlptracegrpc.Option{otlptracegrpc.WithHeaders(config.OTLP.Headers)}
+			if config.OTLP.Endpoint != "" {
+				opts = append(opts, otlptracegrpc.WithEndpoint(config.OTLP.Endpoint))
+			}
+			if config.OTLP.Insecure {
+				opts = append(opts, otlptracegrpc.WithInsecure())
+			}
+			return otlptracegrpc.New(ctx, opts...)
+		default:
+			return nil, fmt.Errorf("unsupported otlp protocol %q", config.OTLP.Protocol)
+		}
+	default:
+		return nil, fmt.Errorf("unsupported tracing exporter %q", config.Exporter)
+	}
+}
+
+// newSampler returns the sampler of the configuration. No trace is sampled
+// by default, unless the sampler is set by the OTEL_TRACES_SAMPLER
+// environment variable, in which case nil is returned.
+func newSampler(config configuration.TracingSampling) sdktrace.Sampler {
+	if config == (configuration.TracingSampling{}) && os.Getenv("OTEL_TRACES_SAMPLER") != "" {
+		return nil
+	}
+
+	sampler := sdktrace.TraceIDRatioBased(config.Ratio)
+	if config.ParentBased {
+		sampler = sdktrace.ParentBased(sampler)
+	}
+	return sampler
+}
@@ -0,0 +1,50 @@
+package tracing
+
+import (
+	"context"
+	"testing"
+
+	"github.com/distribution/distribution/v3/configuration"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/trace"
+)
+
+func TestNewSampler(t *testing.T) {
+	traceID := trace.TraceID{0x01}
+	sampled := trace.ContextWithRemoteSpanContext(context.Background(), trace.NewSpanContext(trace.SpanContextConfig{
+		TraceID:    traceID,
+		SpanID:     trace.SpanID{0x01},
+		TraceFlags: trace.FlagsSampled,
+		Remote:     true,
+	}))
+
+	for _, tc := range []struct {
+		name     string
+		config   configuration.TracingSampling
+		parent   context.Context
+		expected sdktrace.SamplingDecision
+	}{
+		{name: "default", parent: context.Background(), expected: sdktrace.Drop},
+		{name: "default with sampled caller", parent: sampled, expected: sdktrace.Drop},
+		{name: "ratio", config: configuration.TracingSampling{Ratio: 1}, parent: context.Background(), expected: sdktrace.RecordAndSample},
+		{name: "parent based", config: configuration.TracingSampling{ParentBased: true}, parent: sampled, expected: sdktrace.RecordAndSample},
+		{name: "parent based without caller", config: configuration.TracingSampling{ParentBased: true}, parent: context.Background(), expected: sdktrace.Drop},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			t.Setenv("OTEL_TRACES_SAMPLER", "")
+			result := newSampler(tc.config).ShouldSample(sdktrace.SamplingParameters{
+				ParentContext: tc.parent,
+				TraceID:       traceID,
+				Name:          "GET manifest",
+			})
+			if result.Decision != tc.expected {
+				t.Fatalf("unexpected sampling decision %v, expected %v", result.Decision, tc.expected)
+			}
+		})
+	}
+
+	t.Setenv("OTEL_TRACES_SAMPLER", "always_on")
+	if sampler := newSampler(configuration.TracingSampling{}); sampler != nil {
+		t.Fatalf("expected the sampler of the environment, got %s", sampler.Description())
+	}
+}